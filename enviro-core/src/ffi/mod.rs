@@ -10,9 +10,11 @@
 //! - Direct memory access where safe
 
 use std::os::raw::{c_int, c_uint};
+use std::path::Path;
+use std::time::Duration;
 
 #[cfg(go_available)]
-use std::ffi::CString;
+use std::ffi::{CStr, CString};
 #[cfg(go_available)]
 use std::os::raw::c_char;
 
@@ -21,6 +23,66 @@ pub type FfiResult = c_int;
 
 pub const FFI_SUCCESS: FfiResult = 0;
 pub const FFI_ERROR: FfiResult = -1;
+/// The Go side timed out, e.g. waiting for the control plane to serve
+pub const FFI_TIMEOUT: FfiResult = -2;
+/// The Go side rejected its configuration, e.g. an invalid network CIDR
+pub const FFI_INVALID_ARGUMENT: FfiResult = -3;
+/// The control plane's listen address is taken by another process
+pub const FFI_ADDRESS_IN_USE: FfiResult = -4;
+/// Missing privileges, e.g. to bind a port or load eBPF programs
+pub const FFI_PERMISSION_DENIED: FfiResult = -5;
+/// The control plane is already running. Init calls returned
+/// `FFI_SUCCESS` for this before the code existed; the wrappers below
+/// still treat it as success.
+pub const FFI_ALREADY_INITIALIZED: FfiResult = -6;
+/// The control plane has not been initialized
+pub const FFI_NOT_INITIALIZED: FfiResult = -7;
+/// The platform lacks a requested feature, e.g. the eBPF datapath
+pub const FFI_UNSUPPORTED: FfiResult = -8;
+
+/// Kind of failure reported by the Go control plane, by result code
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum GoErrorKind {
+    Error,
+    Timeout,
+    InvalidArgument,
+    AddressInUse,
+    PermissionDenied,
+    AlreadyInitialized,
+    NotInitialized,
+    Unsupported,
+}
+
+impl GoErrorKind {
+    /// Maps a result code to its kind; unknown codes are `Error`
+    pub fn from_code(code: FfiResult) -> Self {
+        match code {
+            FFI_TIMEOUT => GoErrorKind::Timeout,
+            FFI_INVALID_ARGUMENT => GoErrorKind::InvalidArgument,
+            FFI_ADDRESS_IN_USE => GoErrorKind::AddressInUse,
+            FFI_PERMISSION_DENIED => GoErrorKind::PermissionDenied,
+            FFI_ALREADY_INITIALIZED => GoErrorKind::AlreadyInitialized,
+            FFI_NOT_INITIALIZED => GoErrorKind::NotInitialized,
+            FFI_UNSUPPORTED => GoErrorKind::Unsupported,
+            _ => GoErrorKind::Error,
+        }
+    }
+}
+
+/// Failure of a call into the Go control plane
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct GoError {
+    pub kind: GoErrorKind,
+    pub message: String,
+}
+
+impl std::fmt::Display for GoError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(&self.message)
+    }
+}
+
+impl std::error::Error for GoError {}
 
 /// OOM (Out-Of-Memory) killer configuration
 ///
@@ -155,49 +217,551 @@ extern "C" {
     ///
     /// # Returns:
     /// - FFI_SUCCESS on successful initialization
+    /// - FFI_ALREADY_INITIALIZED if the control plane already runs
+    /// - FFI_INVALID_ARGUMENT if the configuration is invalid
     /// - FFI_ERROR if binding fails
     pub fn go_init_control_plane(addr: *const c_char) -> FfiResult;
 
+    /// Initialize the Go gRPC control plane from a JSON-encoded config or
+    /// the path of a YAML, TOML or JSON config file
+    ///
+    /// # Returns:
+    /// - FFI_SUCCESS on successful initialization
+    /// - FFI_ALREADY_INITIALIZED if the control plane already runs
+    /// - FFI_INVALID_ARGUMENT if the configuration is invalid
+    /// - FFI_ERROR if the file can't be read or binding fails
+    pub fn go_init_control_plane_with_config(config: *const c_char) -> FfiResult;
+
+    /// Set up the datapath of a control plane initialized with
+    /// `"defer_network": true` from a JSON-encoded network config, or
+    /// rebuild it for a new one
+    ///
+    /// # Returns:
+    /// - FFI_SUCCESS once the datapath is up
+    /// - FFI_INVALID_ARGUMENT if the configuration is invalid
+    /// - FFI_NOT_INITIALIZED if no control plane runs
+    /// - FFI_ERROR if the datapath can't be set up; the network is left
+    ///   uninitialized
+    pub fn go_init_network(config: *const c_char) -> FfiResult;
+
     /// Shutdown the control plane gracefully
     pub fn go_shutdown_control_plane() -> FfiResult;
+
+    /// Stop taking new containers, wait up to `timeout_ms` for in-flight
+    /// RPCs and then shut the control plane down, leaving containers
+    /// running
+    ///
+    /// # Returns:
+    /// - FFI_SUCCESS once drained and stopped
+    /// - FFI_TIMEOUT if RPCs were cut off; the control plane is stopped
+    /// - FFI_NOT_INITIALIZED if no control plane runs
+    pub fn go_drain_control_plane(timeout_ms: c_int) -> FfiResult;
+
+    /// Pull an image into the Go control plane's image cache unless it is
+    /// cached, waiting up to `timeout_ms`
+    ///
+    /// # Returns:
+    /// - FFI_SUCCESS with `image_json` set to the JSON-encoded image and
+    ///   the paths of its blobs, released with `go_free_string`
+    /// - FFI_INVALID_ARGUMENT for invalid references
+    /// - FFI_TIMEOUT if the pull took longer
+    /// - FFI_NOT_INITIALIZED if no control plane runs
+    pub fn go_pull_image(
+        reference: *const c_char,
+        timeout_ms: c_int,
+        image_json: *mut *mut c_char,
+    ) -> FfiResult;
+
+    /// Record the resource usage of a container, a JSON-encoded
+    /// ContainerStats, served by StatsService instead of reading its cgroup
+    ///
+    /// # Returns:
+    /// - FFI_SUCCESS once recorded
+    /// - FFI_INVALID_ARGUMENT for invalid stats and unknown containers
+    /// - FFI_NOT_INITIALIZED if no control plane runs
+    pub fn go_report_container_stats(stats_json: *const c_char) -> FfiResult;
+
+    /// List the containers and their networks as a JSON array of
+    /// Container, those with all of the JSON-encoded `labels` unless null,
+    /// including the networks restored and re-adopted on init
+    ///
+    /// # Returns:
+    /// - FFI_SUCCESS with `out_json` set to the array of `out_len` bytes,
+    ///   released with `go_free_string`
+    /// - FFI_INVALID_ARGUMENT for invalid labels
+    /// - FFI_NOT_INITIALIZED if no control plane runs
+    pub fn go_list_container_networks(
+        labels: *const c_char,
+        out_json: *mut *mut c_char,
+        out_len: *mut usize,
+    ) -> FfiResult;
+
+    /// Check that the network of a container carries traffic, retrying
+    /// the checks that fail for up to `timeout_ms`, or the node's
+    /// readiness timeout when 0
+    ///
+    /// # Returns:
+    /// - FFI_SUCCESS with `report_json` set to the JSON-encoded
+    ///   ReadinessReport, released with `go_free_string`
+    /// - FFI_TIMEOUT with `report_json` set if a check still failed
+    /// - FFI_INVALID_ARGUMENT for containers the control plane doesn't
+    ///   serve
+    /// - FFI_NOT_INITIALIZED if no control plane runs
+    pub fn go_verify_container_network(
+        container_id: *const c_char,
+        timeout_ms: c_int,
+        report_json: *mut *mut c_char,
+    ) -> FfiResult;
+
+    /// Start a control plane of its own from a JSON-encoded config or
+    /// config file, like `go_init_control_plane_with_config`, next to the
+    /// one of the init calls, and set `handle` for the `go_network_` calls
+    ///
+    /// # Returns:
+    /// - FFI_SUCCESS with `handle` set
+    /// - FFI_INVALID_ARGUMENT if the configuration is invalid
+    /// - FFI_ERROR if binding fails or another control plane holds the
+    ///   network instance or a resource it can't share
+    pub fn go_network_new(config: *const c_char, handle: *mut u64) -> FfiResult;
+
+    /// Stop the control plane of `handle` and forget the handle
+    ///
+    /// # Returns:
+    /// - FFI_SUCCESS once stopped
+    /// - FFI_INVALID_ARGUMENT for unknown handles
+    pub fn go_network_free(handle: u64) -> FfiResult;
+
+    /// `go_init_network` for the control plane of `handle`
+    pub fn go_network_init(handle: u64, config: *const c_char) -> FfiResult;
+
+    /// `go_drain_control_plane` for the control plane of `handle`, which
+    /// frees the handle
+    pub fn go_network_drain(handle: u64, timeout_ms: c_int) -> FfiResult;
+
+    /// `go_list_container_networks` for the control plane of `handle`
+    pub fn go_network_list_container_networks(
+        handle: u64,
+        labels: *const c_char,
+        out_json: *mut *mut c_char,
+        out_len: *mut usize,
+    ) -> FfiResult;
+
+    /// `go_verify_container_network` for the control plane of `handle`
+    pub fn go_network_verify_container_network(
+        handle: u64,
+        container_id: *const c_char,
+        timeout_ms: c_int,
+        report_json: *mut *mut c_char,
+    ) -> FfiResult;
+
+    /// Error message of the most recent failed call, or null. Must be
+    /// released with `go_free_string`.
+    pub fn go_get_last_error() -> *mut c_char;
+
+    /// Release a string returned by `go_get_last_error`, `go_pull_image`,
+    /// `go_list_container_networks` or `go_verify_container_network`
+    pub fn go_free_string(s: *mut c_char);
 }
 
-/// Safe Rust wrapper for Go control plane initialization
+/// Converts the result code of a Go call into a `GoError` carrying the Go
+/// side's description of the failure, prefixed with `context`
 #[cfg(go_available)]
-pub fn init_control_plane(addr: &str) -> Result<(), String> {
-    let c_addr = CString::new(addr).map_err(|e| format!("Invalid address: {}", e))?;
+fn go_result(code: FfiResult, context: &str) -> Result<(), GoError> {
+    if code == FFI_SUCCESS {
+        return Ok(());
+    }
+    let message = unsafe {
+        let err = go_get_last_error();
+        if err.is_null() {
+            context.to_string()
+        } else {
+            let msg = CStr::from_ptr(err).to_string_lossy().into_owned();
+            go_free_string(err);
+            format!("{}: {}", context, msg)
+        }
+    };
+    Err(GoError {
+        kind: GoErrorKind::from_code(code),
+        message,
+    })
+}
 
-    let result = unsafe { go_init_control_plane(c_addr.as_ptr()) };
+/// Like `go_result`, but a control plane that already runs counts as
+/// initialized, so hosts may init defensively
+#[cfg(go_available)]
+fn go_init_result(code: FfiResult, context: &str) -> Result<(), GoError> {
+    match go_result(code, context) {
+        Err(e) if e.kind == GoErrorKind::AlreadyInitialized => Ok(()),
+        result => result,
+    }
+}
 
-    if result == FFI_SUCCESS {
-        Ok(())
-    } else {
-        Err("Failed to initialize Go control plane".to_string())
+/// Error returned when the Go library was not built
+#[cfg(not(go_available))]
+fn go_unavailable() -> GoError {
+    GoError {
+        kind: GoErrorKind::Unsupported,
+        message: "Go FFI not available on this platform or build configuration".to_string(),
     }
 }
 
+/// Safe Rust wrapper for Go control plane initialization. Succeeds if the
+/// control plane already runs.
+#[cfg(go_available)]
+pub fn init_control_plane(addr: &str) -> Result<(), GoError> {
+    let c_addr = CString::new(addr).map_err(|e| GoError {
+        kind: GoErrorKind::InvalidArgument,
+        message: format!("Invalid address: {}", e),
+    })?;
+
+    let result = unsafe { go_init_control_plane(c_addr.as_ptr()) };
+    go_init_result(result, "Failed to initialize Go control plane")
+}
+
+/// Fallback implementation when Go is not available
+#[cfg(not(go_available))]
+pub fn init_control_plane(_addr: &str) -> Result<(), GoError> {
+    Err(go_unavailable())
+}
+
+/// Safe Rust wrapper initializing the Go control plane from a YAML, TOML
+/// or JSON config file, overridden by the ENVIRO_ environment variables.
+/// Succeeds if the control plane already runs.
+#[cfg(go_available)]
+pub fn init_control_plane_from_file(path: &Path) -> Result<(), GoError> {
+    let c_path = CString::new(path.to_string_lossy().as_bytes()).map_err(|e| GoError {
+        kind: GoErrorKind::InvalidArgument,
+        message: format!("Invalid config path: {}", e),
+    })?;
+
+    let result = unsafe { go_init_control_plane_with_config(c_path.as_ptr()) };
+    go_init_result(result, "Failed to initialize Go control plane")
+}
+
 /// Fallback implementation when Go is not available
 #[cfg(not(go_available))]
-pub fn init_control_plane(_addr: &str) -> Result<(), String> {
-    Err("Go FFI not available on this platform or build configuration".to_string())
+pub fn init_control_plane_from_file(_path: &Path) -> Result<(), GoError> {
+    Err(go_unavailable())
+}
+
+/// Safe Rust wrapper setting up the datapath of a Go control plane
+/// initialized with `"defer_network": true`, from the JSON-encoded network
+/// config. Called again it rebuilds the datapath for the new config.
+#[cfg(go_available)]
+pub fn init_network(config_json: &str) -> Result<(), GoError> {
+    let c_config = CString::new(config_json).map_err(|e| GoError {
+        kind: GoErrorKind::InvalidArgument,
+        message: format!("Invalid network config: {}", e),
+    })?;
+
+    let result = unsafe { go_init_network(c_config.as_ptr()) };
+    go_result(result, "Failed to initialize Go network")
+}
+
+/// Fallback implementation when Go is not available
+#[cfg(not(go_available))]
+pub fn init_network(_config_json: &str) -> Result<(), GoError> {
+    Err(go_unavailable())
 }
 
 /// Safe Rust wrapper for Go control plane shutdown
 #[cfg(go_available)]
-pub fn shutdown_control_plane() -> Result<(), String> {
+pub fn shutdown_control_plane() -> Result<(), GoError> {
     let result = unsafe { go_shutdown_control_plane() };
+    go_result(result, "Failed to shutdown Go control plane")
+}
 
-    if result == FFI_SUCCESS {
-        Ok(())
-    } else {
-        Err("Failed to shutdown Go control plane".to_string())
+/// Fallback implementation when Go is not available
+#[cfg(not(go_available))]
+pub fn shutdown_control_plane() -> Result<(), GoError> {
+    Err(go_unavailable())
+}
+
+/// Safe Rust wrapper draining the Go control plane before it stops, for
+/// supervisors restarting it without disrupting running containers
+#[cfg(go_available)]
+pub fn drain_control_plane(timeout: Duration) -> Result<(), GoError> {
+    let timeout_ms = c_int::try_from(timeout.as_millis()).unwrap_or(c_int::MAX);
+    let result = unsafe { go_drain_control_plane(timeout_ms) };
+    go_result(result, "Failed to drain Go control plane")
+}
+
+/// Fallback implementation when Go is not available
+#[cfg(not(go_available))]
+pub fn drain_control_plane(_timeout: Duration) -> Result<(), GoError> {
+    Err(go_unavailable())
+}
+
+/// Safe Rust wrapper pulling an image through the Go control plane's
+/// shared image cache, so containers don't each hit the registry. Returns
+/// the JSON-encoded image, whose layers name the blob files to unpack.
+#[cfg(go_available)]
+pub fn pull_image(reference: &str, timeout: Duration) -> Result<String, GoError> {
+    let c_ref = CString::new(reference).map_err(|e| GoError {
+        kind: GoErrorKind::InvalidArgument,
+        message: format!("Invalid image reference: {}", e),
+    })?;
+    let timeout_ms = c_int::try_from(timeout.as_millis()).unwrap_or(c_int::MAX);
+
+    let mut image_json: *mut c_char = std::ptr::null_mut();
+    let result = unsafe { go_pull_image(c_ref.as_ptr(), timeout_ms, &mut image_json) };
+    go_result(result, "Failed to pull image")?;
+    let json = unsafe {
+        let json = CStr::from_ptr(image_json).to_string_lossy().into_owned();
+        go_free_string(image_json);
+        json
+    };
+    Ok(json)
+}
+
+/// Fallback implementation when Go is not available
+#[cfg(not(go_available))]
+pub fn pull_image(_reference: &str, _timeout: Duration) -> Result<String, GoError> {
+    Err(go_unavailable())
+}
+
+/// Safe Rust wrapper reporting the resource usage of a container, as
+/// JSON such as `{"container_id":"c1","cpu":{"usage_usec":1500000}}`, to
+/// the Go control plane's StatsService
+#[cfg(go_available)]
+pub fn report_container_stats(stats_json: &str) -> Result<(), GoError> {
+    let c_stats = CString::new(stats_json).map_err(|e| GoError {
+        kind: GoErrorKind::InvalidArgument,
+        message: format!("Invalid container stats: {}", e),
+    })?;
+
+    let result = unsafe { go_report_container_stats(c_stats.as_ptr()) };
+    go_result(result, "Failed to report container stats")
+}
+
+/// Fallback implementation when Go is not available
+#[cfg(not(go_available))]
+pub fn report_container_stats(_stats_json: &str) -> Result<(), GoError> {
+    Err(go_unavailable())
+}
+
+/// Safe Rust wrapper listing the containers the Go control plane knows,
+/// with all of `labels_json` such as `{"app":"web"}` when set, as the JSON
+/// array of the ListContainers response. Usable for crash recovery right
+/// after init, before the gRPC API serves.
+#[cfg(go_available)]
+pub fn list_container_networks(labels_json: Option<&str>) -> Result<String, GoError> {
+    list_networks(labels_json, |labels, out_json, out_len| unsafe {
+        go_list_container_networks(labels, out_json, out_len)
+    })
+}
+
+/// Calls `list`, `go_list_container_networks` or its `go_network_`
+/// variant, with `labels_json` and returns the JSON array it lists
+#[cfg(go_available)]
+fn list_networks(
+    labels_json: Option<&str>,
+    list: impl FnOnce(*const c_char, *mut *mut c_char, *mut usize) -> FfiResult,
+) -> Result<String, GoError> {
+    let c_labels = labels_json
+        .map(CString::new)
+        .transpose()
+        .map_err(|e| GoError {
+            kind: GoErrorKind::InvalidArgument,
+            message: format!("Invalid labels: {}", e),
+        })?;
+    let labels_ptr = c_labels.as_ref().map_or(std::ptr::null(), |l| l.as_ptr());
+
+    let mut out_json: *mut c_char = std::ptr::null_mut();
+    let mut out_len: usize = 0;
+    let result = list(labels_ptr, &mut out_json, &mut out_len);
+    go_result(result, "Failed to list container networks")?;
+    let json = unsafe {
+        let bytes = std::slice::from_raw_parts(out_json as *const u8, out_len);
+        let json = String::from_utf8_lossy(bytes).into_owned();
+        go_free_string(out_json);
+        json
+    };
+    Ok(json)
+}
+
+/// Fallback implementation when Go is not available
+#[cfg(not(go_available))]
+pub fn list_container_networks(_labels_json: Option<&str>) -> Result<String, GoError> {
+    Err(go_unavailable())
+}
+
+/// Safe Rust wrapper checking that the network of a container carries
+/// traffic, for holding back its entrypoint until then. Waits up to
+/// `timeout` for it to, the node's readiness timeout when `None`, and
+/// returns the JSON-encoded ReadinessReport whether the network became
+/// ready or not; its `ready` field tells, and its checks which failed.
+#[cfg(go_available)]
+pub fn verify_container_network(
+    container_id: &str,
+    timeout: Option<Duration>,
+) -> Result<String, GoError> {
+    verify_network(
+        container_id,
+        timeout,
+        |id, timeout_ms, report_json| unsafe {
+            go_verify_container_network(id, timeout_ms, report_json)
+        },
+    )
+}
+
+/// Calls `verify`, `go_verify_container_network` or its `go_network_`
+/// variant, for `container_id` and returns the report it sets
+#[cfg(go_available)]
+fn verify_network(
+    container_id: &str,
+    timeout: Option<Duration>,
+    verify: impl FnOnce(*const c_char, c_int, *mut *mut c_char) -> FfiResult,
+) -> Result<String, GoError> {
+    let c_id = CString::new(container_id).map_err(|e| GoError {
+        kind: GoErrorKind::InvalidArgument,
+        message: format!("Invalid container ID: {}", e),
+    })?;
+    let timeout_ms = timeout.map_or(0, |t| {
+        c_int::try_from(t.as_millis()).unwrap_or(c_int::MAX).max(1)
+    });
+
+    let mut report_json: *mut c_char = std::ptr::null_mut();
+    let result = verify(c_id.as_ptr(), timeout_ms, &mut report_json);
+    // A network that isn't ready still comes with its report
+    if report_json.is_null() {
+        go_result(result, "Failed to verify container network")?;
     }
+    let json = unsafe {
+        let json = CStr::from_ptr(report_json).to_string_lossy().into_owned();
+        go_free_string(report_json);
+        json
+    };
+    Ok(json)
 }
 
 /// Fallback implementation when Go is not available
 #[cfg(not(go_available))]
-pub fn shutdown_control_plane() -> Result<(), String> {
-    Err("Go FFI not available on this platform or build configuration".to_string())
+pub fn verify_container_network(
+    _container_id: &str,
+    _timeout: Option<Duration>,
+) -> Result<String, GoError> {
+    Err(go_unavailable())
+}
+
+/// A Go control plane of its own, next to the one of `init_control_plane`
+/// and those of other `GoNetwork`s. Its config names a network instance
+/// of its own, which scopes the datapath, and its own address and state
+/// dir. Dropping it stops the control plane.
+#[derive(Debug)]
+pub struct GoNetwork {
+    #[cfg_attr(not(go_available), allow(dead_code))]
+    handle: u64,
+}
+
+impl GoNetwork {
+    /// Starts a control plane from a JSON-encoded config or the path of a
+    /// config file
+    #[cfg(go_available)]
+    pub fn new(config: &str) -> Result<Self, GoError> {
+        let c_config = CString::new(config).map_err(|e| GoError {
+            kind: GoErrorKind::InvalidArgument,
+            message: format!("Invalid config: {}", e),
+        })?;
+
+        let mut handle: u64 = 0;
+        let result = unsafe { go_network_new(c_config.as_ptr(), &mut handle) };
+        go_result(result, "Failed to initialize Go control plane")?;
+        Ok(GoNetwork { handle })
+    }
+
+    /// Fallback implementation when Go is not available
+    #[cfg(not(go_available))]
+    pub fn new(_config: &str) -> Result<Self, GoError> {
+        Err(go_unavailable())
+    }
+
+    /// Sets up the datapath of a control plane started with
+    /// `"defer_network": true`, like `init_network`
+    #[cfg(go_available)]
+    pub fn init_network(&self, config_json: &str) -> Result<(), GoError> {
+        let c_config = CString::new(config_json).map_err(|e| GoError {
+            kind: GoErrorKind::InvalidArgument,
+            message: format!("Invalid network config: {}", e),
+        })?;
+
+        let result = unsafe { go_network_init(self.handle, c_config.as_ptr()) };
+        go_result(result, "Failed to initialize Go network")
+    }
+
+    /// Fallback implementation when Go is not available
+    #[cfg(not(go_available))]
+    pub fn init_network(&self, _config_json: &str) -> Result<(), GoError> {
+        Err(go_unavailable())
+    }
+
+    /// Drains the control plane before it stops, like
+    /// `drain_control_plane`
+    #[cfg(go_available)]
+    pub fn drain(self, timeout: Duration) -> Result<(), GoError> {
+        let timeout_ms = c_int::try_from(timeout.as_millis()).unwrap_or(c_int::MAX);
+        let result = unsafe { go_network_drain(self.handle, timeout_ms) };
+        // Draining freed the handle
+        std::mem::forget(self);
+        go_result(result, "Failed to drain Go control plane")
+    }
+
+    /// Fallback implementation when Go is not available
+    #[cfg(not(go_available))]
+    pub fn drain(self, _timeout: Duration) -> Result<(), GoError> {
+        Err(go_unavailable())
+    }
+
+    /// Lists the containers of the control plane, like
+    /// `list_container_networks`
+    #[cfg(go_available)]
+    pub fn list_container_networks(&self, labels_json: Option<&str>) -> Result<String, GoError> {
+        list_networks(labels_json, |labels, out_json, out_len| unsafe {
+            go_network_list_container_networks(self.handle, labels, out_json, out_len)
+        })
+    }
+
+    /// Fallback implementation when Go is not available
+    #[cfg(not(go_available))]
+    pub fn list_container_networks(&self, _labels_json: Option<&str>) -> Result<String, GoError> {
+        Err(go_unavailable())
+    }
+
+    /// Verifies the network of a container of the control plane, like
+    /// `verify_container_network`
+    #[cfg(go_available)]
+    pub fn verify_container_network(
+        &self,
+        container_id: &str,
+        timeout: Option<Duration>,
+    ) -> Result<String, GoError> {
+        verify_network(
+            container_id,
+            timeout,
+            |id, timeout_ms, report_json| unsafe {
+                go_network_verify_container_network(self.handle, id, timeout_ms, report_json)
+            },
+        )
+    }
+
+    /// Fallback implementation when Go is not available
+    #[cfg(not(go_available))]
+    pub fn verify_container_network(
+        &self,
+        _container_id: &str,
+        _timeout: Option<Duration>,
+    ) -> Result<String, GoError> {
+        Err(go_unavailable())
+    }
+}
+
+impl Drop for GoNetwork {
+    fn drop(&mut self) {
+        #[cfg(go_available)]
+        unsafe {
+            go_network_free(self.handle);
+        }
+    }
 }
 
 #[cfg(test)]
@@ -217,6 +781,11 @@ mod tests {
     fn test_ffi_constants() {
         assert_eq!(FFI_SUCCESS, 0);
         assert_eq!(FFI_ERROR, -1);
+        assert_eq!(
+            GoErrorKind::from_code(FFI_ADDRESS_IN_USE),
+            GoErrorKind::AddressInUse
+        );
+        assert_eq!(GoErrorKind::from_code(-100), GoErrorKind::Error);
     }
 
     // Note: Actual FFI tests require the Zig/Go libraries to be built
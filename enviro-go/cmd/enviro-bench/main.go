@@ -0,0 +1,47 @@
+// Command enviro-bench reads the output of the datapath benchmarks of
+// pkg/benchmark on stdin, echoing it to stderr, and prints the results as
+// JSON, for CI to track across commits. It exits with status 1 when a
+// benchmark failed or went over its budget, e.g. creating container
+// networks over benchmark.CreateBudget, or when there were no results.
+//
+//	go test -v -tags bpfobj -run '^$' -bench . ./pkg/benchmark | enviro-bench > results.json
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/benchmark"
+)
+
+func main() {
+	report, err := benchmark.ParseReport(io.TeeReader(os.Stdin, os.Stderr))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	if len(report.Results) == 0 {
+		log.Print("No benchmark results")
+		failed = true
+	}
+	for _, name := range report.Failed {
+		log.Printf("%s failed", name)
+		failed = true
+	}
+	for _, res := range report.OverBudget() {
+		log.Printf("%s/%s took %dns per op, over its budget of %dns", res.Name, res.Mode, res.NsPerOp, res.BudgetNs)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
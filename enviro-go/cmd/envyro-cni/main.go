@@ -0,0 +1,246 @@
+// Command envyro-cni is a CNI plugin that has the local Enviro control
+// plane network pods, so kubelet and other CNI runtimes get the eBPF
+// datapath. ADD creates the container's network with CreateContainer, DEL
+// removes it and CHECK verifies it still exists with the same addresses.
+// The container is given one interface, which must be named eth0.
+//
+// Install it in the runtime's CNI bin directory as envyro-cni with a
+// network configuration such as
+//
+//	{
+//	  "cniVersion": "1.0.0",
+//	  "name": "enviro",
+//	  "type": "envyro-cni",
+//	  "endpoint": "unix:///run/enviro/enviro.sock"
+//	}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/client"
+)
+
+// containerIfName is the only interface name the control plane creates
+const containerIfName = "eth0"
+
+// callTimeout bounds each command, including the client's retries
+const callTimeout = 60 * time.Second
+
+// args are the parameters the runtime passes in the environment
+type args struct {
+	Command     string
+	ContainerID string
+	Netns       string
+	IfName      string
+}
+
+func main() {
+	a := args{
+		Command:     os.Getenv("CNI_COMMAND"),
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+	}
+	version, err := run(a, os.Stdin)
+	if err == nil {
+		return
+	}
+	var cerr *cniError
+	if !errors.As(err, &cerr) {
+		cerr = newError(errControlPlane, err.Error(), "")
+	}
+	cerr.CNIVersion = version
+	printJSON(cerr)
+	os.Exit(1)
+}
+
+// run executes the command in a with the configuration read from stdin,
+// returning the configuration's version to report errors in
+func run(a args, stdin io.Reader) (string, error) {
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		return "", newError(errDecodingFailure, "failed to read network configuration", err.Error())
+	}
+	var conf netConf
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &conf); err != nil {
+			return "", newError(errDecodingFailure, "failed to decode network configuration", err.Error())
+		}
+	}
+	if conf.CNIVersion == "" {
+		conf.CNIVersion = supportedVersions[len(supportedVersions)-1]
+	}
+
+	if a.Command == "VERSION" {
+		return conf.CNIVersion, printJSON(map[string]any{
+			"cniVersion":        supportedVersions[len(supportedVersions)-1],
+			"supportedVersions": supportedVersions,
+		})
+	}
+	if err := checkVersion(conf.CNIVersion); err != nil {
+		return conf.CNIVersion, err
+	}
+	if a.ContainerID == "" {
+		return conf.CNIVersion, newError(errInvalidEnvironment, "CNI_CONTAINERID is required", "")
+	}
+
+	c, err := newClient(conf)
+	if err != nil {
+		return conf.CNIVersion, newError(errInvalidConfig, "invalid control plane connection settings", err.Error())
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+
+	switch a.Command {
+	case "ADD":
+		err = cmdAdd(ctx, c, conf, a)
+	case "DEL":
+		err = cmdDel(ctx, c, a)
+	case "CHECK":
+		err = cmdCheck(ctx, c, conf, a)
+	default:
+		err = newError(errInvalidEnvironment, fmt.Sprintf("unknown CNI_COMMAND %q", a.Command), "")
+	}
+	return conf.CNIVersion, err
+}
+
+// newClient connects to the control plane per conf
+func newClient(conf netConf) (*client.Client, error) {
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	opts := []client.Option{client.WithTimeout(callTimeout)}
+	if conf.CAFile != "" || conf.CertFile != "" || conf.KeyFile != "" {
+		opts = append(opts, client.WithTLSFiles(conf.CAFile, conf.CertFile, conf.KeyFile))
+	}
+	if conf.TokenFile != "" {
+		token, err := os.ReadFile(conf.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, client.WithToken(strings.TrimSpace(string(token))))
+	}
+	return client.New([]string{endpoint}, opts...)
+}
+
+// cmdAdd creates the container's network and prints the result. Repeating
+// it returns the network already created.
+func cmdAdd(ctx context.Context, c *client.Client, conf netConf, a args) error {
+	if a.Netns == "" {
+		return newError(errInvalidEnvironment, "CNI_NETNS is required", "")
+	}
+	if a.IfName != containerIfName {
+		return newError(errInvalidEnvironment, fmt.Sprintf("CNI_IFNAME must be %s", containerIfName), "")
+	}
+	container, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{
+		Id:        a.ContainerID,
+		NetnsPath: a.Netns,
+		Mtu:       int32(conf.MTU),
+		// Relative paths are under the cgroup v2 mount
+		CgroupPath: cgroupPath(conf.RuntimeConfig.CgroupPath),
+		// Makes retries of the client and the runtime safe
+		IdempotencyKey: a.ContainerID,
+	})
+	if err != nil {
+		return controlPlaneError("failed to create container network", err)
+	}
+	return printJSON(newResult(conf.CNIVersion, container, a.IfName, a.Netns))
+}
+
+// cmdDel removes the container's network. Networks that are already gone
+// are not an error, as the spec requires.
+func cmdDel(ctx context.Context, c *client.Client, a args) error {
+	err := c.DeleteContainer(ctx, a.ContainerID, 0)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return controlPlaneError("failed to delete container network", err)
+	}
+	return nil
+}
+
+// cmdCheck verifies that the container's network is ready with the
+// addresses ADD reported
+func cmdCheck(ctx context.Context, c *client.Client, conf netConf, a args) error {
+	if conf.CNIVersion < "0.4.0" {
+		return newError(errIncompatibleVersion, fmt.Sprintf("CHECK is not supported by CNI version %s", conf.CNIVersion), "")
+	}
+	container, err := c.GetContainer(ctx, a.ContainerID)
+	if status.Code(err) == codes.NotFound {
+		return newError(errUnknownContainer, fmt.Sprintf("no network for container %s", a.ContainerID), "")
+	}
+	if err != nil {
+		return controlPlaneError("failed to get container network", err)
+	}
+	if container.State != pb.ContainerState_CONTAINER_STATE_READY {
+		return newError(errControlPlane, fmt.Sprintf("container network is %s", container.State), container.Error)
+	}
+	if conf.PrevResult == nil {
+		return nil
+	}
+
+	want := make(map[string]bool)
+	for _, ip := range newResult(conf.CNIVersion, container, a.IfName, a.Netns).IPs {
+		want[ip.Address] = true
+	}
+	for _, ip := range conf.PrevResult.IPs {
+		if !want[ip.Address] {
+			return newError(errControlPlane, fmt.Sprintf("container no longer has address %s", ip.Address), "")
+		}
+		delete(want, ip.Address)
+	}
+	for addr := range want {
+		return newError(errControlPlane, fmt.Sprintf("container has unexpected address %s", addr), "")
+	}
+	return nil
+}
+
+// controlPlaneError reports a failed call, asking the runtime to try again
+// later when the control plane is unavailable
+func controlPlaneError(msg string, err error) error {
+	code := errControlPlane
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		code = errTryAgainLater
+	}
+	return newError(code, msg, status.Convert(err).Message())
+}
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupPath returns the directory of the cgroup the runtime passed, which
+// kubelet gives relative to the hierarchy with the cgroupfs driver, e.g.
+// /kubepods/burstable/pod<uid>, and as a slice name with the systemd one,
+// e.g. kubepods-burstable-pod<uid>.slice, nested in kubepods.slice and
+// kubepods-burstable.slice
+func cgroupPath(p string) string {
+	switch {
+	case p == "" || strings.HasPrefix(p, cgroupRoot+"/"):
+		return p
+	case !strings.Contains(p, "/") && strings.HasSuffix(p, ".slice"):
+		dir := cgroupRoot
+		parts := strings.Split(strings.TrimSuffix(p, ".slice"), "-")
+		for i := range parts {
+			dir = filepath.Join(dir, strings.Join(parts[:i+1], "-")+".slice")
+		}
+		return dir
+	}
+	return filepath.Join(cgroupRoot, p)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// supportedVersions are the CNI spec versions whose results envyro-cni
+// can produce, oldest first
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"}
+
+// Error codes defined by the CNI spec, and errControlPlane for failures
+// reported by the control plane
+const (
+	errIncompatibleVersion = 1
+	errUnknownContainer    = 3
+	errInvalidEnvironment  = 4
+	errDecodingFailure     = 6
+	errInvalidConfig       = 7
+	errTryAgainLater       = 11
+	errControlPlane        = 100
+)
+
+// netConf is the network configuration kubelet or the runtime passes on
+// stdin
+type netConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	// Endpoint is the control plane, defaults to its local socket
+	Endpoint string `json:"endpoint"`
+	// TokenFile holds a bearer token with the operator role, for control
+	// planes with authentication
+	TokenFile string `json:"token_file"`
+	// CAFile, CertFile and KeyFile connect with TLS as by
+	// client.WithTLSFiles, when any is set
+	CAFile   string `json:"ca_file"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// MTU overrides the node's MTU for containers when set
+	MTU int `json:"mtu"`
+	// PrevResult is the result of ADD, given to CHECK
+	PrevResult *result `json:"prevResult"`
+	// RuntimeConfig holds what the runtime passes for the capabilities
+	// the configuration lists, such as {"cgroupPath": true}
+	RuntimeConfig struct {
+		// CgroupPath is the pod's cgroup, for connect-time policy
+		CgroupPath string `json:"cgroupPath"`
+	} `json:"runtimeConfig"`
+}
+
+// defaultEndpoint is the control plane's socket in its default setup
+const defaultEndpoint = "unix:///run/enviro/enviro.sock"
+
+// result is the outcome of ADD, in the format of the requested version
+type result struct {
+	CNIVersion string     `json:"cniVersion"`
+	Interfaces []iface    `json:"interfaces,omitempty"`
+	IPs        []ipConfig `json:"ips,omitempty"`
+}
+
+// iface is an interface created for the container
+type iface struct {
+	Name    string `json:"name"`
+	MAC     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// ipConfig is an address assigned to one of result.Interfaces
+type ipConfig struct {
+	// Version is "4" or "6", only present before spec 1.0.0
+	Version   string `json:"version,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+}
+
+// cniError is the error format of the spec
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *cniError) Error() string {
+	return e.Msg
+}
+
+// newError returns an error with one of the codes above
+func newError(code int, msg, details string) *cniError {
+	return &cniError{Code: code, Msg: msg, Details: details}
+}
+
+// newResult describes the network of c, which the control plane created
+// in netns as interface ifName, in the format of version
+func newResult(version string, c *pb.Container, ifName, netns string) *result {
+	r := &result{
+		CNIVersion: version,
+		Interfaces: []iface{
+			{Name: c.HostInterface},
+			{Name: ifName, MAC: c.Mac, Sandbox: netns},
+		},
+	}
+	container := 1
+	for _, s := range []string{c.Ip, c.Ipv6} {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		ip := ipConfig{
+			Interface: &container,
+			// Containers are routed, each address on its own
+			Address: netip.PrefixFrom(addr, addr.BitLen()).String(),
+		}
+		if version != "1.0.0" {
+			ip.Version = "4"
+			if addr.Is6() {
+				ip.Version = "6"
+			}
+		}
+		r.IPs = append(r.IPs, ip)
+	}
+	return r
+}
+
+// checkVersion fails for versions envyro-cni can't produce results in
+func checkVersion(version string) error {
+	for _, v := range supportedVersions {
+		if v == version {
+			return nil
+		}
+	}
+	return newError(errIncompatibleVersion, fmt.Sprintf("incompatible CNI version %q", version),
+		fmt.Sprintf("supported versions are %v", supportedVersions))
+}
+
+// printJSON writes v to stdout, where the runtime reads results from
+func printJSON(v any) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
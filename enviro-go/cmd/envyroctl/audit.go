@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func auditCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	method := fs.String("method", "", "only show calls of this method, e.g. StopContainer")
+	principal := fs.String("principal", "", "only show calls of this caller")
+	since := fs.String("since", "", "only show calls since this time, RFC 3339 or a duration such as 24h")
+	limit := fs.Int("limit", 0, "show the newest calls only, default 100")
+	verify := fs.Bool("verify", false, "check the hash chain of the whole log, failing when it is broken")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		req := &pb.QueryAuditLogRequest{
+			Method:    *method,
+			Principal: *principal,
+			Limit:     int32(*limit),
+			Verify:    *verify,
+		}
+		if *since != "" {
+			t, err := parseSince(*since)
+			if err != nil {
+				return fmt.Errorf("invalid -since: %w", err)
+			}
+			req.Since = timestamppb.New(t)
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.QueryAuditLog(ctx, req)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			if err := e.printJSON(resp); err != nil {
+				return err
+			}
+		} else {
+			w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tPRINCIPAL\tPEER\tMETHOD\tCODE\tDURATION\tREQUEST")
+			for _, r := range resp.Records {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.AsTime().Local().Format(time.RFC3339),
+					orNone(r.Principal), orNone(r.Peer), path.Base(r.Method), r.Code,
+					r.Duration.AsDuration().Round(time.Microsecond), r.Request)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if *verify && !resp.Verified {
+			return errors.New(resp.VerifyError)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// maxBackupSize bounds the backups the control plane returns
+const maxBackupSize = 256 << 20
+
+func backupCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	req := &pb.BackupRequest{Headers: make(map[string]string)}
+	file := fs.String("f", "", "file to write the backup to; - for stdout")
+	fs.StringVar(&req.Url, "url", "", "http(s) URL the control plane uploads the backup to instead, e.g. a presigned object store URL")
+	fs.Var(labelsFlag(req.Headers), "header", "header of the upload as name=value, may be repeated")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		if (*file == "") == (req.Url == "") {
+			return errors.New("give either -f or -url")
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.Backup(ctx, req, grpc.MaxCallRecvMsgSize(maxBackupSize))
+		if err != nil {
+			return err
+		}
+		switch *file {
+		case "":
+		case "-":
+			_, err := os.Stdout.Write(resp.Archive)
+			return err
+		default:
+			if err := os.WriteFile(*file, resp.Archive, 0o600); err != nil {
+				return err
+			}
+			resp.Location = *file
+		}
+		resp.Archive = nil
+		if e.json {
+			return e.printJSON(resp)
+		}
+
+		m := resp.Manifest
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Location:\t%s\n", resp.Location)
+		fmt.Fprintf(w, "Size:\t%d\n", resp.Size)
+		fmt.Fprintf(w, "SHA-256:\t%s\n", resp.Sha256)
+		fmt.Fprintf(w, "Node:\t%s\n", m.Node)
+		fmt.Fprintf(w, "Server version:\t%s\n", m.ServerVersion)
+		fmt.Fprintf(w, "Created:\t%s\n", m.CreatedAt.AsTime().Local().Format(time.RFC3339))
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "FILE\tVERSION\tSIZE\tSHA-256")
+		for _, f := range m.Files {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", f.Name, f.Version, f.Size, f.Sha256)
+		}
+		return w.Flush()
+	}
+}
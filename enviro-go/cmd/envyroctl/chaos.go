@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func chaosLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		chaos, err := e.client.Chaos()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := chaos.ListFaults(ctx, &pb.ListFaultsRequest{})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		if !resp.Enabled {
+			return errors.New("chaos is not enabled on this control plane")
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TARGET\tFAULT\tEXPIRES")
+		for _, c := range resp.Containers {
+			f := c.Fault
+			fmt.Fprintf(w, "%s\t%s\t%s\n", c.ContainerId, describeFault([]string{
+				percentOf("drop", f.DropPercent),
+				delayOf(f.Delay.AsDuration(), f.Jitter.AsDuration()),
+				percentOf("reorder", f.ReorderPercent),
+			}), expiresAt(c.ExpiresAt.AsTime(), c.ExpiresAt != nil))
+		}
+		for _, m := range resp.Methods {
+			f := m.Fault
+			delay := delayOf(f.Delay.AsDuration(), 0)
+			if delay != "" && f.DelayPercent > 0 {
+				delay = fmt.Sprintf("%s of %v%%", delay, f.DelayPercent)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", f.Method, describeFault([]string{
+				delay,
+				percentOf(codes.Code(f.Code).String(), f.ErrorPercent),
+			}), expiresAt(m.ExpiresAt.AsTime(), m.ExpiresAt != nil))
+		}
+		return w.Flush()
+	}
+}
+
+// percentOf describes a percentage of packets or calls, "" for none
+func percentOf(what string, percent float64) string {
+	if percent == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s %v%%", what, percent)
+}
+
+// delayOf describes a delay, "" for none
+func delayOf(delay, jitter time.Duration) string {
+	switch {
+	case delay == 0:
+		return ""
+	case jitter == 0:
+		return fmt.Sprintf("delay %s", delay)
+	default:
+		return fmt.Sprintf("delay %s±%s", delay, jitter)
+	}
+}
+
+// describeFault joins the non-empty parts of a fault
+func describeFault(parts []string) string {
+	var out []string
+	for _, p := range parts {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+// expiresAt shows when a fault expires, "never" for faults lasting until
+// cleared
+func expiresAt(t time.Time, ok bool) string {
+	if !ok {
+		return "never"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func chaosContainerCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	drop := fs.Float64("drop", 0, "percentage of the packets to drop")
+	delay := fs.Duration("delay", 0, "delay of each packet")
+	jitter := fs.Duration("jitter", 0, "variation of the delay")
+	reorder := fs.Float64("reorder", 0, "percentage of the packets that skip the delay, needs -delay")
+	duration := fs.Duration("for", 0, "clear the fault after this long, default never")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		req := &pb.SetContainerFaultRequest{
+			ContainerId: args[0],
+			Fault: &pb.ContainerFault{
+				DropPercent:    *drop,
+				ReorderPercent: *reorder,
+			},
+		}
+		if *delay != 0 {
+			req.Fault.Delay = durationpb.New(*delay)
+		}
+		if *jitter != 0 {
+			req.Fault.Jitter = durationpb.New(*jitter)
+		}
+		if *duration != 0 {
+			req.Duration = durationpb.New(*duration)
+		}
+		chaos, err := e.client.Chaos()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		if _, err := chaos.SetContainerFault(ctx, req); err != nil {
+			return err
+		}
+		fmt.Fprintln(e.out, args[0])
+		return nil
+	}
+}
+
+func chaosMethodCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	errorPercent := fs.Float64("error", 0, "percentage of the calls to fail")
+	code := fs.String("code", "unavailable", "status code of the failed calls, e.g. internal or deadline_exceeded")
+	delay := fs.Duration("delay", 0, "delay of the delayed calls")
+	delayPercent := fs.Float64("delay-percent", 0, "percentage of the calls to delay, default all with -delay")
+	duration := fs.Duration("for", 0, "clear the fault after this long, default never")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		var c codes.Code
+		if err := c.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(*code)))); err != nil {
+			return fmt.Errorf("invalid -code: %w", err)
+		}
+		req := &pb.SetMethodFaultRequest{Fault: &pb.MethodFault{
+			Method:       fullMethod(args[0]),
+			ErrorPercent: *errorPercent,
+			Code:         uint32(c),
+			DelayPercent: *delayPercent,
+		}}
+		if *delay != 0 {
+			req.Fault.Delay = durationpb.New(*delay)
+		}
+		if *duration != 0 {
+			req.Duration = durationpb.New(*duration)
+		}
+		chaos, err := e.client.Chaos()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		if _, err := chaos.SetMethodFault(ctx, req); err != nil {
+			return err
+		}
+		fmt.Fprintln(e.out, req.Fault.Method)
+		return nil
+	}
+}
+
+func chaosClearCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		chaos, err := e.client.Chaos()
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for _, target := range args {
+			ctx, cancel := e.call(ctx)
+			if strings.Contains(target, "/") {
+				_, err = chaos.ClearMethodFault(ctx, &pb.ClearMethodFaultRequest{Method: fullMethod(target)})
+			} else {
+				_, err = chaos.ClearContainerFault(ctx, &pb.ClearContainerFaultRequest{ContainerId: target})
+			}
+			cancel()
+			if err != nil {
+				errs = append(errs, itemError(target, err))
+				continue
+			}
+			fmt.Fprintln(e.out, target)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// fullMethod expands a method given as SERVICE/METHOD, e.g.
+// ContainerService/CreateContainer, to its full name
+func fullMethod(method string) string {
+	if strings.HasPrefix(method, "/") {
+		return method
+	}
+	return "/enviro.api.v1." + method
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func psCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	quiet := fs.Bool("q", false, "only print container IDs")
+	namespace := fs.String("n", "", "only list the containers of this namespace")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		containers, err := e.client.ListContainersInNamespace(ctx, *namespace)
+		if err != nil {
+			return err
+		}
+		switch {
+		case e.json:
+			return e.printJSON(&pb.ListContainersResponse{Containers: containers})
+		case *quiet:
+			for _, c := range containers {
+				fmt.Fprintln(e.out, c.Id)
+			}
+			return nil
+		}
+		return e.printContainers(containers)
+	}
+}
+
+// printContainers writes a table of containers
+func (e *env) printContainers(containers []*pb.Container) error {
+	w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tNAMESPACE\tSTATE\tIP\tIPV6\tNODE\tCREATED")
+	for _, c := range containers {
+		var created time.Time
+		if c.CreatedAt != nil {
+			created = c.CreatedAt.AsTime()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Id, c.Name, c.Namespace,
+			enumName(c.State, "CONTAINER_STATE_"), c.Ip, c.Ipv6, c.Node, age(created))
+	}
+	return w.Flush()
+}
+
+// printContainer writes c as JSON or as a table row
+func (e *env) printContainer(c *pb.Container) error {
+	if e.json {
+		return e.printJSON(c)
+	}
+	return e.printContainers([]*pb.Container{c})
+}
+
+func createCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	req := &pb.CreateContainerRequest{Labels: make(map[string]string)}
+	fs.StringVar(&req.Name, "name", "", "DNS name of the container")
+	fs.StringVar(&req.NetnsPath, "netns", "", "network namespace of the container, e.g. /proc/<pid>/ns/net")
+	pid := fs.Int("pid", 0, "process whose network namespace to use when -netns is empty")
+	fs.StringVar(&req.Mac, "mac", "", "MAC of the container interface, reserved for the container")
+	fs.StringVar(&req.RequestedIp, "ip", "", "IPv4 address of the container, reserved for the container")
+	fs.StringVar(&req.RequestedIp6, "ip6", "", "IPv6 address of the container, reserved for the container")
+	mtu := fs.Int("mtu", 0, "MTU of the container interface, default the node's")
+	fs.StringVar(&req.Namespace, "n", "", "namespace of the container, default \"default\"")
+	fs.Uint64Var(&req.IngressBps, "ingress-bps", 0, "limit of traffic to the container in bits per second")
+	fs.Uint64Var(&req.EgressBps, "egress-bps", 0, "limit of traffic from the container in bits per second")
+	fs.StringVar(&req.Attachment, "attachment", "", "veth, or sriov or macvlan to give the container a device on the physical network")
+	fs.StringVar(&req.CgroupPath, "cgroup", "", "cgroup v2 directory of the container's processes, for connect-time policy")
+	fs.StringVar(&req.IdempotencyKey, "idempotency-key", "", "key making retries of the create safe")
+	fs.Var(labelsFlag(req.Labels), "label", "label as key=value, may be repeated")
+	var sources, caps stringsFlag
+	fs.Var(&sources, "allow-source", "prefix the container may send from besides its addresses, may be repeated")
+	fs.Var(&caps, "cap", "network capability to grant, spoof_source, may be repeated")
+	fs.BoolVar(&req.DisableSourceCheck, "no-source-check", false, "let the container send from any MAC and address, needs -cap spoof_source")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		req.Id, req.Pid, req.Mtu = args[0], int32(*pid), int32(*mtu)
+		req.AllowedSources, req.Capabilities = sources, caps
+		c, err := e.client.CreateContainer(ctx, req)
+		if err != nil {
+			return err
+		}
+		return e.printContainer(c)
+	}
+}
+
+func startCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		return e.eachContainer(args, func(id string) (*pb.Container, error) {
+			return e.client.StartContainer(ctx, id)
+		})
+	}
+}
+
+func stopCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	timeout := fs.Duration("t", 0, "kill containers still running after this long, default the server's")
+	return func(ctx context.Context, e *env, args []string) error {
+		return e.eachContainer(args, func(id string) (*pb.Container, error) {
+			return e.client.StopContainer(ctx, id, *timeout)
+		})
+	}
+}
+
+func rmCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	drain := fs.Duration("drain", 0, "wait up to this long for the containers' connections to close, rejecting new ones")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		var errs []error
+		for _, id := range args {
+			if err := e.client.DeleteContainer(ctx, id, *drain); err != nil {
+				errs = append(errs, itemError(id, err))
+				continue
+			}
+			fmt.Fprintln(e.out, id)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// eachContainer calls fn for each of the container IDs ids, printing the
+// containers it returns and carrying on past failures
+func (e *env) eachContainer(ids []string, fn func(id string) (*pb.Container, error)) error {
+	if len(ids) == 0 {
+		return errUsage
+	}
+	var containers []*pb.Container
+	var errs []error
+	for _, id := range ids {
+		c, err := fn(id)
+		if err != nil {
+			errs = append(errs, itemError(id, err))
+			continue
+		}
+		containers = append(containers, c)
+	}
+	if len(containers) > 0 {
+		var err error
+		if e.json {
+			err = e.printJSON(&pb.ListContainersResponse{Containers: containers})
+		} else {
+			err = e.printContainers(containers)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func inspectCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		var errs []error
+		for _, id := range args {
+			c, err := e.client.GetContainer(ctx, id)
+			if err != nil {
+				errs = append(errs, itemError(id, err))
+				continue
+			}
+			errs = append(errs, e.printJSON(c))
+		}
+		return errors.Join(errs...)
+	}
+}
+
+func logsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	follow := fs.Bool("f", false, "keep printing output as it is written")
+	tail := fs.Uint("tail", 0, "only print the last n lines, 0 for all")
+	since := fs.String("since", "", "only print output written since this time, RFC 3339 or a duration such as 10m")
+	stream := fs.String("stream", "", "only print this stream: stdout or stderr")
+	timestamps := fs.Bool("timestamps", false, "prefix lines with the time they were written")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		req := &pb.StreamLogsRequest{ContainerId: args[0], Follow: *follow, Tail: uint32(*tail)}
+		if *since != "" {
+			t, err := parseSince(*since)
+			if err != nil {
+				return fmt.Errorf("invalid -since: %w", err)
+			}
+			req.Since = timestamppb.New(t)
+		}
+		switch *stream {
+		case "":
+		case "stdout":
+			req.Stream = pb.LogStream_LOG_STREAM_STDOUT
+		case "stderr":
+			req.Stream = pb.LogStream_LOG_STREAM_STDERR
+		default:
+			return fmt.Errorf("unknown stream %q, want stdout or stderr", *stream)
+		}
+
+		logs, err := e.client.StreamLogs(ctx, req)
+		if err != nil {
+			return err
+		}
+		// Partial entries continue a line, which is only timestamped once
+		midLine := map[pb.LogStream]bool{}
+		for {
+			resp, err := logs.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for _, entry := range resp.Entries {
+				if e.json {
+					if err := e.printJSONLine(entry); err != nil {
+						return err
+					}
+					continue
+				}
+				w := e.out
+				if entry.Stream == pb.LogStream_LOG_STREAM_STDERR {
+					w = os.Stderr
+				}
+				if *timestamps && !midLine[entry.Stream] {
+					fmt.Fprintf(w, "%s ", entry.Timestamp.AsTime().Format(time.RFC3339Nano))
+				}
+				midLine[entry.Stream] = entry.Partial
+				if _, err := w.Write(entry.Data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// parseSince parses an RFC 3339 time or a duration before now
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func eventsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	snapshot := fs.Bool("snapshot", false, "start with an event per existing container")
+	after := fs.Uint64("after", 0, "resume after the event with this sequence number")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		var events pb.ContainerService_WatchEventsClient
+		var err error
+		if *after > 0 {
+			events, err = e.client.WatchAfter(ctx, *after)
+		} else {
+			events, err = e.client.Watch(ctx, *snapshot)
+		}
+		if err != nil {
+			return err
+		}
+		for {
+			ev, err := events.Recv()
+			if err != nil {
+				return err
+			}
+			if e.json {
+				if err := e.printJSONLine(ev); err != nil {
+					return err
+				}
+				continue
+			}
+			line := fmt.Sprintf("%s  %-22s %s", ev.Timestamp.AsTime().Local().Format(time.RFC3339),
+				enumName(ev.Type, "CONTAINER_EVENT_TYPE_"), eventDetail(ev))
+			fmt.Fprintln(e.out, strings.TrimSpace(line))
+		}
+	}
+}
+
+// eventDetail describes what an event is about
+func eventDetail(ev *pb.ContainerEvent) string {
+	var parts []string
+	add := func(key, value string) {
+		if value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	add("seq", fmt.Sprint(ev.Sequence))
+	add("container", ev.ContainerId)
+	add("ip", ev.Ip)
+	add("ipv6", ev.Ipv6)
+	add("policy", ev.Policy)
+	add("node", ev.Node)
+	add("settings", strings.Join(ev.Settings, ","))
+	if ev.Type == pb.ContainerEventType_CONTAINER_EVENT_TYPE_LEADER_CHANGED {
+		add("leader", ev.LeaderId)
+		add("leader_address", ev.LeaderAddress)
+	}
+	if ev.Dropped > 0 {
+		add("dropped", fmt.Sprint(ev.Dropped))
+	}
+	if ev.Error != "" {
+		parts = append(parts, fmt.Sprintf("error=%q", ev.Error))
+	}
+	return strings.Join(parts, " ")
+}
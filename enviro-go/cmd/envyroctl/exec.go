@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// detachKey detaches attach -t, as Ctrl-C is passed on: Ctrl-]
+const detachKey = 0x1d
+
+// exitError is the non-zero exit code of a process, which envyroctl exits
+// with
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func execCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	stdin := fs.Bool("i", false, "pass on stdin")
+	tty := fs.Bool("t", false, "run the command in a terminal, putting this one in raw mode")
+	var vars stringsFlag
+	fs.Var(&vars, "e", "environment variable as KEY=value, may be repeated")
+	workDir := fs.String("w", "", "working directory of the command")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) < 2 {
+			return errUsage
+		}
+		t, err := newTerminal(*tty)
+		if err != nil {
+			return err
+		}
+		stream, err := e.client.Exec(ctx, &pb.ExecStart{
+			ContainerId:  args[0],
+			Command:      args[1:],
+			Env:          vars,
+			WorkingDir:   *workDir,
+			Tty:          *tty,
+			Stdin:        *stdin,
+			TerminalSize: t.size(),
+		})
+		if err != nil {
+			return err
+		}
+		send := func(in *pb.SessionInput) error {
+			return stream.Send(&pb.ExecRequest{Request: &pb.ExecRequest_Input{Input: in}})
+		}
+		return e.session(ctx, t, *stdin, false, stream.Recv, send, stream.CloseSend)
+	}
+}
+
+func attachCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	stdin := fs.Bool("i", false, "pass on stdin")
+	tty := fs.Bool("t", false, "the container has a terminal: put this one in raw mode, Ctrl-] detaches")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		t, err := newTerminal(*tty)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream, err := e.client.Attach(ctx, &pb.AttachStart{
+			ContainerId:  args[0],
+			Stdin:        *stdin,
+			TerminalSize: t.size(),
+		})
+		if err != nil {
+			return err
+		}
+		send := func(in *pb.SessionInput) error {
+			return stream.Send(&pb.AttachRequest{Request: &pb.AttachRequest_Input{Input: in}})
+		}
+		err = e.session(ctx, t, *stdin, *tty, stream.Recv, send, stream.CloseSend)
+		if errors.Is(err, errDetached) {
+			// Cancelling the call detaches
+			return nil
+		}
+		return err
+	}
+}
+
+// errDetached ends a session detached with detachKey
+var errDetached = errors.New("detached")
+
+// session passes stdin and the terminal's size to a session and copies its
+// output until the process exits, returning an exitError for a non-zero
+// exit code. With detach, reading detachKey ends the session with
+// errDetached.
+func (e *env) session(ctx context.Context, t *terminal, stdin, detach bool, recv func() (*pb.SessionOutput, error),
+	send func(*pb.SessionInput) error, closeSend func() error) error {
+	// Input is sent by the stdin and resize goroutines
+	var sendMu sync.Mutex
+	sendInput := func(in *pb.SessionInput) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return send(in)
+	}
+
+	if t != nil {
+		if err := t.makeRaw(); err != nil {
+			return err
+		}
+		defer t.restore()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		t.notifyResize(ctx, func(size *pb.TerminalSize) {
+			sendInput(&pb.SessionInput{Input: &pb.SessionInput_Resize{Resize: size}})
+		})
+	}
+
+	detached := make(chan struct{})
+	if stdin {
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := os.Stdin.Read(buf)
+				data := buf[:n]
+				if detach {
+					for i, b := range data {
+						if b == detachKey {
+							close(detached)
+							data = data[:i]
+							err = nil
+							break
+						}
+					}
+				}
+				if len(data) > 0 {
+					if err := sendInput(&pb.SessionInput{Input: &pb.SessionInput_Stdin{Stdin: data}}); err != nil {
+						return
+					}
+				}
+				select {
+				case <-detached:
+					return
+				default:
+				}
+				if err != nil {
+					// Half-closing the call closes the process's stdin
+					sendMu.Lock()
+					closeSend()
+					sendMu.Unlock()
+					return
+				}
+			}
+		}()
+	}
+
+	type result struct {
+		out *pb.SessionOutput
+		err error
+	}
+	outputs := make(chan result)
+	go func() {
+		for {
+			out, err := recv()
+			select {
+			case outputs <- result{out, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		var r result
+		select {
+		case r = <-outputs:
+		case <-detached:
+			return errDetached
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if errors.Is(r.err, io.EOF) {
+			return errors.New("session ended without an exit status")
+		}
+		if r.err != nil {
+			return r.err
+		}
+		switch out := r.out.Output.(type) {
+		case *pb.SessionOutput_Stdout:
+			os.Stdout.Write(out.Stdout)
+		case *pb.SessionOutput_Stderr:
+			os.Stderr.Write(out.Stderr)
+		case *pb.SessionOutput_Exit:
+			if code := out.Exit.GetCode(); code != 0 {
+				return exitError(code)
+			}
+			return nil
+		}
+	}
+}
+
+// terminal is the local terminal of a session with -t
+type terminal struct {
+	fd    int
+	state *term.State
+}
+
+// newTerminal returns the terminal of stdin with tty, nil otherwise
+func newTerminal(tty bool) (*terminal, error) {
+	if !tty {
+		return nil, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("-t needs stdin to be a terminal")
+	}
+	return &terminal{fd: fd}, nil
+}
+
+// size returns the size of t, nil when t is nil or it is unknown
+func (t *terminal) size() *pb.TerminalSize {
+	if t == nil {
+		return nil
+	}
+	width, height, err := term.GetSize(t.fd)
+	if err != nil {
+		return nil
+	}
+	return &pb.TerminalSize{Width: uint32(width), Height: uint32(height)}
+}
+
+// makeRaw passes keys such as Ctrl-C to the session instead of handling
+// them, until restore is called
+func (t *terminal) makeRaw() error {
+	state, err := term.MakeRaw(t.fd)
+	if err != nil {
+		return err
+	}
+	t.state = state
+	return nil
+}
+
+func (t *terminal) restore() {
+	if t.state != nil {
+		term.Restore(t.fd, t.state)
+	}
+}
+
+// stringsFlag collects repeated flags
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return fmt.Sprint([]string(*s))
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func imagePullCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	always := fs.Bool("always", false, "resolve the tag with the registry even if the image is cached")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		images, err := e.client.Images()
+		if err != nil {
+			return err
+		}
+		// Pulls take as long as the layers take to download, so the
+		// timeout doesn't apply
+		pull, err := images.PullImage(ctx, &pb.PullImageRequest{Image: args[0], Always: *always})
+		if err != nil {
+			return err
+		}
+		var phase string
+		reported := make(map[string]bool)
+		for {
+			p, err := pull.Recv()
+			if err != nil {
+				return err
+			}
+			if e.json {
+				if err := e.printJSONLine(p); err != nil {
+					return err
+				}
+			} else {
+				if p.Phase != phase && p.Result == nil {
+					phase = p.Phase
+					fmt.Fprintf(e.out, "%s: %s\n", p.Image, phase)
+				}
+				for _, l := range p.Layers {
+					if !l.Done || reported[l.Digest] {
+						continue
+					}
+					reported[l.Digest] = true
+					state := "downloaded"
+					if l.Cached {
+						state = "cached"
+					}
+					fmt.Fprintf(e.out, "  %s  %s, %d bytes\n", shortDigest(l.Digest), state, l.Size)
+				}
+			}
+			if img := p.Result; img != nil {
+				if !e.json {
+					fmt.Fprintf(e.out, "%s: pulled %s, %d bytes\n", img.Reference, img.Digest, img.Size)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+func imageLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		images, err := e.client.Images()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := images.ListImages(ctx, &pb.ListImagesRequest{})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "REFERENCE\tDIGEST\tPLATFORM\tLAYERS\tSIZE\tPULLED")
+		for _, img := range resp.Images {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", img.Reference, shortDigest(img.Digest), img.Platform,
+				len(img.Layers), img.Size, img.PulledAt.AsTime().Local().Format(time.RFC3339))
+		}
+		return w.Flush()
+	}
+}
+
+func imageRmCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		images, err := e.client.Images()
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for _, ref := range args {
+			callCtx, cancel := e.call(ctx)
+			resp, err := images.RemoveImage(callCtx, &pb.RemoveImageRequest{Image: ref})
+			cancel()
+			if err != nil {
+				errs = append(errs, itemError(ref, err))
+				continue
+			}
+			if e.json {
+				if err := e.printJSONLine(resp); err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Fprintf(e.out, "%s: freed %d bytes\n", resp.Image.Reference, resp.FreedBytes)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// shortDigest returns the first 12 hex digits of a digest, as docker
+// shows them
+func shortDigest(d string) string {
+	_, hex, _ := strings.Cut(d, ":")
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
@@ -0,0 +1,333 @@
+// Command envyroctl talks to the control plane of a node: it lists,
+// creates and stops containers, follows their logs and the event stream,
+// inspects and configures the container network, and applies the specs
+// the node is reconciled with.
+//
+//	envyroctl ps
+//	envyroctl -address unix:///run/enviro/enviro.sock create -name web c1
+//	envyroctl -o json inspect c1
+//	envyroctl logs -f c1
+//	envyroctl exec -i -t c1 sh
+//	envyroctl policy apply -f deny-db.yaml
+//	envyroctl apply -f node.yaml
+//
+// Global flags come before the command; run envyroctl -h for them and
+// envyroctl <command> -h for those of a command.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/client"
+)
+
+// defaultAddress is where the control plane serves gRPC by default
+const defaultAddress = "127.0.0.1:50051"
+
+// errUsage fails a command whose arguments are wrong, after its usage has
+// been printed
+var errUsage = errors.New("usage")
+
+// command is a subcommand of envyroctl
+type command struct {
+	name string
+	// args describes the arguments after the flags
+	args    string
+	summary string
+	// flags registers the flags of the command on fs, returning the
+	// function that runs it with the remaining arguments
+	flags func(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error
+}
+
+var commands = []command{
+	{"ps", "", "list containers", psCommand},
+	{"create", "ID", "create the network of a container", createCommand},
+	{"start", "ID...", "start containers", startCommand},
+	{"stop", "ID...", "stop containers", stopCommand},
+	{"rm", "ID...", "delete containers and their networks", rmCommand},
+	{"inspect", "ID...", "show containers as JSON", inspectCommand},
+	{"logs", "ID", "print the logs of a container", logsCommand},
+	{"exec", "ID COMMAND [ARG...]", "run a command in a running container", execCommand},
+	{"attach", "ID", "attach to the main process of a running container", attachCommand},
+	{"events", "", "follow container, network and node events", eventsCommand},
+	{"network ls", "", "show the container networks", networkLsCommand},
+	{"network gc", "", "remove network resources no container owns", networkGCCommand},
+	{"network export", "ID", "write the network state of a container for moving it to another node", networkExportCommand},
+	{"network import", "ID", "create a container from the network state another node exported", networkImportCommand},
+	{"network renew-lease", "ID...", "renew the address leases of containers not running yet", networkRenewLeaseCommand},
+	{"network verify", "ID...", "check that the networks of containers carry traffic", networkVerifyCommand},
+	{"afxdp ls", "", "list AF_XDP sockets", afxdpLsCommand},
+	{"afxdp attach", "ID", "steer flows to an AF_XDP socket owned by a container", afxdpAttachCommand},
+	{"afxdp detach", "ID...", "close the AF_XDP sockets of containers", afxdpDetachCommand},
+	{"policy ls", "", "list network policies", policyLsCommand},
+	{"policy apply", "", "add or replace network policies from a file", policyApplyCommand},
+	{"policy rm", "NAME...", "remove network policies", policyRmCommand},
+	{"reservation ls", "", "list the addresses reserved for containers", reservationLsCommand},
+	{"reservation rm", "ID...", "release the addresses reserved for containers", reservationRmCommand},
+	{"identity ls", "", "list the numeric identities of label sets and how many containers hold them", identityLsCommand},
+	{"snat ls", "[PORT]", "list the SNAT port slices of containers, or the container translated to PORT", snatLsCommand},
+	{"service ls", "", "list services and the endpoints of those exposed on a node port", serviceLsCommand},
+	{"namespace ls", "", "list namespaces with their quotas and usage", namespaceLsCommand},
+	{"namespace create", "NAME", "create a namespace", namespaceCreateCommand},
+	{"namespace update", "NAME", "replace the allowed namespaces and quota of a namespace", namespaceUpdateCommand},
+	{"namespace rm", "NAME...", "delete empty namespaces", namespaceRmCommand},
+	{"stats", "", "show datapath counters", statsCommand},
+	{"usage", "[ID...]", "show the CPU, memory, block IO and network usage of containers", usageCommand},
+	{"latency", "", "show the datapath latency of the node and containers", latencyCommand},
+	{"top", "", "show the flows to containers with the most traffic lately", topCommand},
+	{"drops watch", "", "follow the packets the XDP router drops", dropsWatchCommand},
+	{"drops stats", "", "show the XDP router's drops by reason and policy", dropsStatsCommand},
+	{"datapath ls", "", "show the programs and maps of the XDP router", datapathLsCommand},
+	{"datapath dump", "MAP", "show the entries of a map of the XDP router", datapathDumpCommand},
+	{"capabilities", "", "show the eBPF features of the node's kernel and how the XDP router uses them", capabilitiesCommand},
+	{"apply", "", "reconcile the node with a spec from a file", applyCommand},
+	{"spec", "", "show the applied spec and whether the node matches it", specCommand},
+	{"audit", "", "show the mutating calls recorded in the audit log", auditCommand},
+	{"config", "", "show the effective config of the control plane and where each setting came from", configCommand},
+	{"settings set", "KEY=VALUE...", "override settings of the config until reset, e.g. log_level=debug", settingsSetCommand},
+	{"settings reset", "[KEY...]", "reset overridden settings to the config, all of them without KEY", settingsResetCommand},
+	{"backup", "", "snapshot the state of the control plane for restoring it with -restore-from", backupCommand},
+	{"image pull", "IMAGE", "pull an image into the node's image cache", imagePullCommand},
+	{"image ls", "", "list the images in the node's image cache", imageLsCommand},
+	{"image rm", "IMAGE...", "remove images from the node's image cache with the layers no other image uses", imageRmCommand},
+	{"chaos ls", "", "list the faults injected into containers and the API", chaosLsCommand},
+	{"chaos container", "ID", "drop, delay or reorder the packets to a container", chaosContainerCommand},
+	{"chaos method", "SERVICE/METHOD", "fail or delay calls of an API method, e.g. ContainerService/CreateContainer", chaosMethodCommand},
+	{"chaos clear", "ID|SERVICE/METHOD...", "clear the faults of containers and methods", chaosClearCommand},
+	{"version", "", "show the version and features of the control plane", versionCommand},
+}
+
+// env is what commands share: the client and how to print results
+type env struct {
+	client *client.Client
+	// timeout bounds each call, streams aside
+	timeout time.Duration
+	json    bool
+	out     io.Writer
+}
+
+func main() {
+	flag.Usage = usage
+	address := flag.String("address", defaultAddress, "control plane address, host:port or unix:///path/to/socket")
+	caFile := flag.String("tls-ca", "", "CA file verifying the control plane's certificate, enables TLS")
+	certFile := flag.String("tls-cert", "", "client certificate file for mTLS")
+	keyFile := flag.String("tls-key", "", "client key file for mTLS")
+	tokenFile := flag.String("token-file", "", "file of the bearer token to authenticate with")
+	output := flag.String("o", "table", "output format: table or json")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of each call, streams aside")
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "envyroctl: unknown output format %q, want table or json\n", *output)
+		os.Exit(2)
+	}
+	cmd, args, ok := findCommand(flag.Args())
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	run := cmd.flags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: envyroctl [global flags] %s [flags] %s\n\n%s\n", cmd.name, cmd.args, capitalize(cmd.summary))
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(fs.Output(), "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	fs.Parse(args)
+
+	var opts []client.Option
+	if *caFile != "" || *certFile != "" {
+		opts = append(opts, client.WithTLSFiles(*caFile, *certFile, *keyFile))
+	}
+	if *tokenFile != "" {
+		token, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			fatal(err)
+		}
+		opts = append(opts, client.WithToken(strings.TrimSpace(string(token))))
+	}
+	opts = append(opts, client.WithTimeout(*timeout))
+	c, err := client.New([]string{*address}, opts...)
+	if err != nil {
+		fatal(err)
+	}
+	defer c.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	e := &env{client: c, timeout: *timeout, json: *output == "json", out: os.Stdout}
+	if err := run(ctx, e, fs.Args()); err != nil {
+		if errors.Is(err, errUsage) {
+			fs.Usage()
+			os.Exit(2)
+		}
+		var exit exitError
+		if errors.As(err, &exit) {
+			os.Exit(int(exit))
+		}
+		// Interrupting a stream isn't an error
+		if ctx.Err() != nil {
+			return
+		}
+		fatal(err)
+	}
+}
+
+// findCommand returns the command args start with, which may be two
+// words long, and the arguments after it
+func findCommand(args []string) (command, []string, bool) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: envyroctl [global flags] <command> [flags] [args]\n\nCommands:\n")
+	width := 0
+	for _, cmd := range commands {
+		width = max(width, len(cmd.name))
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+// fatal prints err and exits
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "envyroctl: %s\n", describe(err))
+	os.Exit(1)
+}
+
+// describe formats err, without the rpc error prefix for gRPC errors
+func describe(err error) string {
+	if st, ok := status.FromError(err); ok {
+		return fmt.Sprintf("%s: %s", st.Code(), st.Message())
+	}
+	return err.Error()
+}
+
+// itemError labels the error of one of the items a command acts on
+func itemError(item string, err error) error {
+	return fmt.Errorf("%s: %s", item, describe(err))
+}
+
+// call returns a context bounding a NodeService call, which the client's
+// timeout doesn't cover
+func (e *env) call(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, e.timeout)
+}
+
+// printJSON writes m as indented JSON. It is indented by encoding/json,
+// as protojson varies its whitespace on purpose.
+func (e *env) printJSON(m proto.Message) error {
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.out, "%s\n", buf.Bytes())
+	return err
+}
+
+// printJSONLine writes m as JSON on a single line, for streams
+func (e *env) printJSONLine(m proto.Message) error {
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.out, "%s\n", buf.Bytes())
+	return err
+}
+
+// enumName shortens an enum value such as CONTAINER_STATE_READY to ready
+func enumName(s fmt.Stringer, prefix string) string {
+	return strings.ToLower(strings.TrimPrefix(s.String(), prefix))
+}
+
+// age formats how long ago t was, e.g. 5m or 3h
+func age(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelsFlag collects repeated key=value flags
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string {
+	var pairs []string
+	for _, k := range sortedKeys(l) {
+		pairs = append(pairs, k+"="+l[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l labelsFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("%q is not key=value", s)
+	}
+	l[k] = v
+	return nil
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:] + "."
+}
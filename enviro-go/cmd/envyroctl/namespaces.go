@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func namespaceLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		namespaces, err := e.client.ListNamespaces(ctx)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(&pb.ListNamespacesResponse{Namespaces: namespaces})
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCIDR\tCIDR6\tMTU\tALLOW FROM\tCONTAINERS\tADDRESSES\tBANDWIDTH")
+		for _, ns := range namespaces {
+			quota, usage := ns.GetQuota(), ns.GetUsage()
+			mtu := "default"
+			if ns.Mtu > 0 {
+				mtu = fmt.Sprint(ns.Mtu)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", ns.Name, orAny(ns.Cidr), orAny(ns.Cidr6), mtu,
+				strings.Join(ns.AllowFrom, ","),
+				ofQuota(uint64(usage.GetContainers()), uint64(quota.GetMaxContainers())),
+				ofQuota(uint64(usage.GetAddresses()), uint64(quota.GetMaxAddresses())),
+				ofQuota(max(usage.GetIngressBps(), usage.GetEgressBps()), quota.GetMaxBandwidthBps()))
+		}
+		return w.Flush()
+	}
+}
+
+// ofQuota shows usage against a limit, 0 meaning unlimited
+func ofQuota(used, limit uint64) string {
+	if limit == 0 {
+		return fmt.Sprint(used)
+	}
+	return fmt.Sprintf("%d/%d", used, limit)
+}
+
+// quotaFlags registers the flags setting a namespace's allowed namespaces
+// and quota
+func quotaFlags(fs *flag.FlagSet) (allowFrom *string, quota *pb.NamespaceQuota) {
+	quota = &pb.NamespaceQuota{}
+	allowFrom = fs.String("allow-from", "", "comma-separated namespaces whose containers may reach this one's")
+	fs.Func("max-containers", "most containers of the namespace, 0 for unlimited", func(s string) error {
+		_, err := fmt.Sscan(s, &quota.MaxContainers)
+		return err
+	})
+	fs.Func("max-addresses", "most addresses of the namespace's containers, 0 for unlimited", func(s string) error {
+		_, err := fmt.Sscan(s, &quota.MaxAddresses)
+		return err
+	})
+	fs.Uint64Var(&quota.MaxBandwidthBps, "max-bandwidth", 0, "most bits per second of the containers' limits in each direction, 0 for unlimited")
+	return allowFrom, quota
+}
+
+// splitList splits a comma-separated flag value
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func namespaceCreateCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	cidr := fs.String("cidr", "", "range of the node's IPv4 network reserved for the namespace")
+	cidr6 := fs.String("cidr6", "", "range of the node's IPv6 network reserved for the namespace")
+	mtu := fs.Int("mtu", 0, "MTU of the namespace's containers, 0 for the node's")
+	allowFrom, quota := quotaFlags(fs)
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		ns, err := e.client.CreateNamespace(ctx, &pb.Namespace{
+			Name:      args[0],
+			Cidr:      *cidr,
+			Cidr6:     *cidr6,
+			AllowFrom: splitList(*allowFrom),
+			Quota:     quota,
+			Mtu:       int32(*mtu),
+		})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(ns)
+		}
+		fmt.Fprintln(e.out, ns.Name)
+		return nil
+	}
+}
+
+func namespaceUpdateCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	allowFrom, quota := quotaFlags(fs)
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		ns, err := e.client.UpdateNamespace(ctx, args[0], splitList(*allowFrom), quota)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(ns)
+		}
+		fmt.Fprintln(e.out, ns.Name)
+		return nil
+	}
+}
+
+func namespaceRmCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		var errs []error
+		for _, name := range args {
+			ctx, cancel := e.call(ctx)
+			err := e.client.DeleteNamespace(ctx, name)
+			cancel()
+			if err != nil {
+				errs = append(errs, itemError(name, err))
+				continue
+			}
+			fmt.Fprintln(e.out, name)
+		}
+		return errors.Join(errs...)
+	}
+}
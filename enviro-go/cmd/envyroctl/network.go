@@ -0,0 +1,1032 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v3"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func networkLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.GetNetworkConfig(ctx, &pb.GetNetworkConfigRequest{})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp.Config)
+		}
+
+		config := resp.Config
+		mtu := "default"
+		if config.Mtu > 0 {
+			mtu = fmt.Sprint(config.Mtu)
+		}
+		datapath := "kernel"
+		switch {
+		case config.Rootless:
+			datapath = "slirp4netns (rootless)"
+		case config.XdpAttached:
+			datapath = "xdp/" + config.XdpMode
+		case config.UserspaceForwarding:
+			datapath = "userspace (xdp inactive: " + config.XdpError + ")"
+		case config.XdpEnabled:
+			datapath = "kernel (xdp failed: " + config.XdpError + ")"
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CIDR\tGATEWAY\tSUBNET\tIPAM\tMTU\tDATAPATH\tDEFAULT POLICY")
+		for _, n := range []struct{ cidr, gateway, subnet, ipam string }{
+			{config.Cidr, config.Gateway, config.GetOverlay().GetSubnet(), config.Ipam},
+			{config.Cidr6, config.Gateway6, config.GetOverlay().GetSubnet6(), config.Ipam6},
+		} {
+			if n.cidr != "" {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", n.cidr, n.gateway, n.subnet, n.ipam, mtu, datapath, config.DefaultPolicy)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if len(config.VirtualFunctions) == 0 {
+			return nil
+		}
+
+		fmt.Fprintln(e.out)
+		w = tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PF\tVF\tPCI ADDRESS\tINTERFACE\tCONTAINER")
+		for _, vf := range config.VirtualFunctions {
+			name, holder := vf.Name, vf.ContainerId
+			if name == "" {
+				name = "-"
+			}
+			if holder == "" {
+				holder = "-"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", vf.Pf, vf.Index, vf.PciAddress, name, holder)
+		}
+		return w.Flush()
+	}
+}
+
+func networkExportCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	file := fs.String("f", "-", "file to write the state to; - for stdout")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		state, err := e.client.ExportNetworkState(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if *file != "-" {
+			return os.WriteFile(*file, state, 0o600)
+		}
+		_, err = fmt.Fprintf(e.out, "%s\n", state)
+		return err
+	}
+}
+
+func networkImportCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	req := &pb.ImportNetworkStateRequest{Labels: make(map[string]string)}
+	file := fs.String("f", "-", "file of the state from network export; - for stdin")
+	fs.StringVar(&req.NetnsPath, "netns", "", "network namespace of the container, e.g. /proc/<pid>/ns/net")
+	pid := fs.Int("pid", 0, "process whose network namespace to use when -netns is empty")
+	fs.Var(labelsFlag(req.Labels), "label", "label as key=value, may be repeated")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		state, err := readInput(*file)
+		if err != nil {
+			return err
+		}
+		req.Id, req.Pid, req.State = args[0], int32(*pid), state
+		c, err := e.client.ImportNetworkState(ctx, req)
+		if err != nil {
+			return err
+		}
+		return e.printContainer(c)
+	}
+}
+
+func networkRenewLeaseCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		var errs []error
+		for _, id := range args {
+			if err := e.client.RenewLease(ctx, id); err != nil {
+				errs = append(errs, itemError(id, err))
+				continue
+			}
+			fmt.Fprintln(e.out, id)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+func networkVerifyCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	timeout := fs.Duration("t", 0, "wait up to this long for the networks to carry traffic, default the server's")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		if !e.json {
+			fmt.Fprintln(w, "ID\tCHECK\tRESULT\tATTEMPTS\tDURATION\tERROR")
+		}
+		var errs []error
+		for _, id := range args {
+			report, err := e.client.VerifyContainerNetwork(ctx, id, *timeout)
+			if err != nil {
+				errs = append(errs, itemError(id, err))
+				continue
+			}
+			if !report.Ready {
+				errs = append(errs, itemError(id, errors.New("network not ready")))
+			}
+			if e.json {
+				if err := e.printJSONLine(report); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, c := range report.Checks {
+				result, msg := "passed", c.Error
+				if !c.Passed {
+					result = "failed"
+				}
+				if msg == "" {
+					msg = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", id, c.Name, result, c.Attempts, c.Duration.AsDuration().Round(time.Millisecond), msg)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return errors.Join(errs...)
+	}
+}
+
+func networkGCCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	dryRun := fs.Bool("dry-run", false, "only list the orphaned resources")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.CollectGarbage(ctx, &pb.CollectGarbageRequest{DryRun: *dryRun})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tNAME\tADDRESS\tRESULT")
+		var failed int
+		for _, o := range resp.Orphans {
+			result := "removed"
+			switch {
+			case o.Error != "":
+				result = "failed: " + o.Error
+				failed++
+			case !o.Removed:
+				result = "found"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", o.Kind, o.Name, o.Address, result)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("failed to remove %d of %d orphaned resources", failed, len(resp.Orphans))
+		}
+		return nil
+	}
+}
+
+func afxdpLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.ListAFXDPSockets(ctx, &pb.ListAFXDPSocketsRequest{})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CONTAINER\tQUEUE\tFLOWS\tFRAMES\tMODE\tSOCKET")
+		for _, x := range resp.Sockets {
+			flows := make([]string, 0, len(x.Flows))
+			for _, f := range x.Flows {
+				flows = append(flows, formatAFXDPFlow(f, x.ContainerId))
+			}
+			mode := "copy"
+			if x.ZeroCopy {
+				mode = "zero-copy"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%dx%d\t%s\t%s\n", x.ContainerId, x.Queue, strings.Join(flows, ","),
+				x.FrameCount, x.FrameSize, mode, x.SocketPath)
+		}
+		return w.Flush()
+	}
+}
+
+func afxdpAttachCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	req := &pb.AttachAFXDPRequest{}
+	queue := fs.Uint("queue", 0, "receive queue of the XDP interface to bind to")
+	var flows stringsFlag
+	fs.Var(&flows, "flow", "flow to steer as PROTO[:PORT][@CONTAINER], may be repeated")
+	fs.StringVar(&req.SocketPath, "socket", "", "Unix socket on the node the container picks the AF_XDP socket up from")
+	frameSize := fs.Uint("frame-size", 0, "UMEM frame size, 2048 or 4096, default 4096")
+	frames := fs.Uint("frames", 0, "UMEM frames and ring size, a power of two, default 4096")
+	fs.BoolVar(&req.ZeroCopy, "zero-copy", false, "bind in zero-copy mode, which needs driver support")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 || len(flows) == 0 {
+			return errUsage
+		}
+		req.ContainerId = args[0]
+		req.Queue, req.FrameSize, req.FrameCount = uint32(*queue), uint32(*frameSize), uint32(*frames)
+		for _, s := range flows {
+			f, err := parseAFXDPFlow(s)
+			if err != nil {
+				return err
+			}
+			req.Flows = append(req.Flows, f)
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.AttachAFXDP(ctx, req)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp.Socket)
+		}
+		fmt.Fprintln(e.out, resp.Socket.SocketPath)
+		return nil
+	}
+}
+
+func afxdpDetachCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for _, id := range args {
+			ctx, cancel := e.call(ctx)
+			_, err := nodes.DetachAFXDP(ctx, &pb.DetachAFXDPRequest{ContainerId: id})
+			cancel()
+			if err != nil {
+				errs = append(errs, itemError(id, err))
+				continue
+			}
+			fmt.Fprintln(e.out, id)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// parseAFXDPFlow parses PROTO[:PORT][@CONTAINER], e.g. udp:4789@web
+func parseAFXDPFlow(s string) (*pb.AFXDPFlow, error) {
+	spec, container, _ := strings.Cut(s, "@")
+	protocol, port, hasPort := strings.Cut(spec, ":")
+	f := &pb.AFXDPFlow{ContainerId: container, Protocol: protocol}
+	if hasPort {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in flow %q", s)
+		}
+		f.Port = uint32(p)
+	}
+	return f, nil
+}
+
+// formatAFXDPFlow formats f as parseAFXDPFlow takes it, leaving out the
+// container when it is owner
+func formatAFXDPFlow(f *pb.AFXDPFlow, owner string) string {
+	s := f.Protocol
+	if f.Port != 0 {
+		s += ":" + strconv.FormatUint(uint64(f.Port), 10)
+	}
+	if f.ContainerId != owner {
+		s += "@" + f.ContainerId
+	}
+	return s
+}
+
+func policyLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	namespace := fs.String("n", "", "only list the policies of this namespace")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.ListPolicies(ctx, &pb.ListPoliciesRequest{Namespace: *namespace})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tNAMESPACE\tSOURCE\tDESTINATION\tPROTOCOL\tPORT\tACTION")
+		for _, p := range resp.Policies {
+			port := ""
+			if p.Port > 0 {
+				port = fmt.Sprint(p.Port)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, p.Namespace, orAny(p.SourceContainer+p.SourceCidr),
+				p.DestContainer+p.DestCidr, orAny(p.Protocol), orAny(port), p.Action)
+		}
+		return w.Flush()
+	}
+}
+
+// orAny shows an empty policy field as matching anything
+func orAny(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
+
+func policyApplyCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	file := fs.String("f", "", "YAML or JSON file of a policy, a list of policies or the output of policy ls -o json; - for stdin")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 || *file == "" {
+			return errUsage
+		}
+		data, err := readInput(*file)
+		if err != nil {
+			return err
+		}
+		policies, err := parsePolicies(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", *file, err)
+		}
+
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		for _, p := range policies {
+			ctx, cancel := e.call(ctx)
+			_, err := nodes.ApplyPolicy(ctx, &pb.ApplyPolicyRequest{Policy: p})
+			cancel()
+			if err != nil {
+				return itemError("policy "+p.Name, err)
+			}
+			fmt.Fprintln(e.out, p.Name)
+		}
+		return nil
+	}
+}
+
+// readInput reads the file of -f, stdin for -
+func readInput(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+// parsePolicies decodes the policies of policy apply. YAML is converted to
+// JSON first, so both use the JSON names of the fields.
+func parsePolicies(data []byte) ([]*pb.NetworkPolicy, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var items []any
+	switch doc := doc.(type) {
+	case []any:
+		items = doc
+	case map[string]any:
+		if list, ok := doc["policies"].([]any); ok && len(doc) == 1 {
+			items = list
+		} else {
+			items = []any{doc}
+		}
+	default:
+		return nil, errors.New("expected a policy or a list of policies")
+	}
+
+	policies := make([]*pb.NetworkPolicy, 0, len(items))
+	for i, item := range items {
+		raw, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		p := &pb.NetworkPolicy{}
+		if err := protojson.Unmarshal(raw, p); err != nil {
+			return nil, fmt.Errorf("policy %d: %w", i+1, err)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+func policyRmCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for _, name := range args {
+			ctx, cancel := e.call(ctx)
+			_, err := nodes.RemovePolicy(ctx, &pb.RemovePolicyRequest{Name: name})
+			cancel()
+			if err != nil {
+				errs = append(errs, itemError(name, err))
+				continue
+			}
+			fmt.Fprintln(e.out, name)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+func reservationLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.ListReservations(ctx, &pb.ListReservationsRequest{})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CONTAINER\tIP\tIPV6\tMAC")
+		for _, r := range resp.Reservations {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.ContainerId, orNone(r.Ip), orNone(r.Ipv6), orNone(r.Mac))
+		}
+		return w.Flush()
+	}
+}
+
+func identityLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.ListIdentities(ctx, &pb.ListIdentitiesRequest{})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tLABELS\tHOLDERS\tRELEASED")
+		for _, id := range resp.Identities {
+			released := "-"
+			if id.ReleasedAt != nil {
+				released = id.ReleasedAt.AsTime().Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\n", id.Id, labelsFlag(id.Labels), len(id.Holders), released)
+		}
+		return w.Flush()
+	}
+}
+
+// orNone shows an empty reservation field as reserving nothing
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func snatLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 1 {
+			return errUsage
+		}
+		req := &pb.ListSNATSlicesRequest{}
+		if len(args) == 1 {
+			port, err := strconv.ParseUint(args[0], 10, 16)
+			if err != nil || port == 0 {
+				return fmt.Errorf("invalid port %q", args[0])
+			}
+			req.Port = uint32(port)
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.ListSNATSlices(ctx, req)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CONTAINER\tPORTS")
+		for _, s := range resp.Slices {
+			fmt.Fprintf(w, "%s\t%d-%d\n", s.ContainerId, s.PortMin, s.PortMax)
+		}
+		return w.Flush()
+	}
+}
+
+func reservationRmCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for _, id := range args {
+			ctx, cancel := e.call(ctx)
+			_, err := nodes.ReleaseReservation(ctx, &pb.ReleaseReservationRequest{ContainerId: id})
+			cancel()
+			if err != nil {
+				errs = append(errs, itemError(id, err))
+				continue
+			}
+			fmt.Fprintln(e.out, id)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+func statsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	container := fs.String("container", "", "only show the counters of this container")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.GetStats(ctx, &pb.GetStatsRequest{})
+		if err != nil {
+			return err
+		}
+		if *container != "" {
+			var found []*pb.ContainerStats
+			for _, c := range resp.Containers {
+				if c.ContainerId == *container {
+					found = append(found, c)
+				}
+			}
+			if len(found) == 0 {
+				return fmt.Errorf("no counters for container %q", *container)
+			}
+			resp = &pb.GetStatsResponse{Containers: found}
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', tabwriter.AlignRight)
+		if len(resp.Stats) > 0 {
+			fmt.Fprintln(w, "NODE\tCOUNTER\tVALUE\t")
+			for _, k := range sortedKeys(resp.Stats) {
+				fmt.Fprintf(w, "\t%s\t%d\t\n", k, resp.Stats[k])
+			}
+		}
+		if len(resp.Containers) > 0 {
+			if len(resp.Stats) > 0 {
+				fmt.Fprintln(w, "\t\t\t")
+			}
+			fmt.Fprintln(w, "CONTAINER\tCOUNTER\tVALUE\t")
+			for _, c := range resp.Containers {
+				for i, k := range sortedKeys(c.Stats) {
+					id := c.ContainerId
+					if i > 0 {
+						id = ""
+					}
+					fmt.Fprintf(w, "%s\t%s\t%d\t\n", id, k, c.Stats[k])
+				}
+			}
+		}
+		if len(resp.Peers) > 0 {
+			fmt.Fprintln(w, "\t\t\t")
+			fmt.Fprintln(w, "PEER\tRX BYTES\tTX BYTES\t")
+			for _, p := range resp.Peers {
+				fmt.Fprintf(w, "%s\t%d\t%d\t\n", p.Name, p.RxBytes, p.TxBytes)
+			}
+		}
+		if setup := resp.SetupLatency; setup.GetSamples() > 0 {
+			fmt.Fprintln(w, "\t\t\t\t")
+			fmt.Fprintf(w, "SETUP (%d)\tP50\tP95\tP99\t\n", setup.Samples)
+			quantiles := func(name string, q *pb.LatencyQuantiles) {
+				fmt.Fprintf(w, "%s\t%v\t%v\t%v\t\n", name, q.GetP50().AsDuration(), q.GetP95().AsDuration(), q.GetP99().AsDuration())
+			}
+			quantiles("total", setup.Total)
+			for _, stage := range sortedKeys(setup.Stages) {
+				quantiles(stage, setup.Stages[stage])
+			}
+		}
+		return w.Flush()
+	}
+}
+
+func topCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	container := fs.String("container", "", "only show the flows of this container")
+	limit := fs.Int("n", 0, "flows to show, default the node's configured number")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.TopFlows(ctx, &pb.TopFlowsRequest{ContainerId: *container, Limit: int32(*limit)})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		if resp.SampledAt == nil {
+			fmt.Fprintln(e.out, "No flows sampled yet")
+			return nil
+		}
+
+		fmt.Fprintf(e.out, "Traffic over %s to %s\n\n", resp.Window.AsDuration().Round(time.Second),
+			resp.SampledAt.AsTime().Local().Format(time.RFC3339))
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		if *container == "" {
+			fmt.Fprintln(w, "CONTAINER\tBYTES/S\tPACKETS/S\tBYTES")
+			for _, t := range resp.Containers {
+				fmt.Fprintf(w, "%s\t%.0f\t%.0f\t%d\n", t.ContainerId, t.BytesPerSecond, t.PacketsPerSecond, t.Bytes)
+			}
+			fmt.Fprintln(w, "\t\t\t")
+		}
+		fmt.Fprintln(w, "CONTAINER\tPROTOCOL\tSOURCE\tDESTINATION\tBYTES/S\tPACKETS/S\tBYTES")
+		for _, f := range resp.Node.GetFlows() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.0f\t%.0f\t%d\n", f.ContainerId, f.Protocol,
+				net.JoinHostPort(f.SrcAddress, fmt.Sprint(f.SrcPort)), net.JoinHostPort(f.DstAddress, fmt.Sprint(f.DstPort)),
+				f.BytesPerSecond, f.PacketsPerSecond, f.Bytes)
+		}
+		return w.Flush()
+	}
+}
+
+func latencyCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	container := fs.String("container", "", "only show the latency of this container")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.GetLatencyStats(ctx, &pb.GetLatencyStatsRequest{ContainerId: *container})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "CONTAINER\tPACKETS\tMEAN\tP50\tP95\tP99\t")
+		row := func(name string, l *pb.LatencyStats) {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t\n", name, l.GetPackets(), l.GetMean().AsDuration(),
+				l.GetP50().AsDuration(), l.GetP95().AsDuration(), l.GetP99().AsDuration())
+		}
+		if resp.Node != nil {
+			row("(node)", resp.Node)
+		}
+		for _, c := range resp.Containers {
+			row(c.ContainerId, c.Latency)
+		}
+		return w.Flush()
+	}
+}
+
+func dropsWatchCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	container := fs.String("container", "", "only show drops of packets from or to this container")
+	reason := fs.String("reason", "", "only show drops of this reason: malformed, namespace, policy, default_policy, icmp_error, fault, syn_cookie, spoofed or neighbor_spoofed")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		drops, err := nodes.StreamDropEvents(ctx, &pb.StreamDropEventsRequest{ContainerId: *container, Reason: *reason})
+		if err != nil {
+			return err
+		}
+		for {
+			ev, err := drops.Recv()
+			if err != nil {
+				return err
+			}
+			if e.json {
+				if err := e.printJSONLine(ev); err != nil {
+					return err
+				}
+				continue
+			}
+			if ev.Missed > 0 {
+				fmt.Fprintf(e.out, "(%d drops missed)\n", ev.Missed)
+			}
+			fmt.Fprintf(e.out, "%s  %-14s %s\n", ev.Time.AsTime().Local().Format(time.RFC3339),
+				ev.Reason, dropDetail(ev))
+		}
+	}
+}
+
+// dropDetail describes the packet of a drop event
+func dropDetail(ev *pb.DropEvent) string {
+	var parts []string
+	add := func(key, value string) {
+		if value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	add("proto", ev.Protocol)
+	add("src", ev.SrcAddress)
+	add("dst", ev.DstAddress)
+	if ev.DstPort > 0 {
+		add("port", fmt.Sprint(ev.DstPort))
+	}
+	add("bytes", fmt.Sprint(ev.Bytes))
+	add("container", ev.ContainerId)
+	add("src_container", ev.SrcContainerId)
+	add("policy", ev.Policy)
+	return strings.Join(parts, " ")
+}
+
+func dropsStatsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.GetDropStats(ctx, &pb.GetDropStatsRequest{})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "REASON\tPOLICY\tPACKETS")
+		for _, c := range resp.Counts {
+			policy := c.Policy
+			if policy == "" {
+				policy = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\n", c.Reason, policy, c.Packets)
+		}
+		if resp.Lost > 0 {
+			fmt.Fprintf(w, "(lost)\t-\t%d\n", resp.Lost)
+		}
+		return w.Flush()
+	}
+}
+
+func datapathLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.DatapathInspect(ctx, &pb.DatapathInspectRequest{})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PROGRAM\tTYPE\tID\tTAG\tATTACHED\tLOADED\tLOAD TIME\tRUNS\tRUN TIME")
+		for _, p := range resp.Programs {
+			attached := "-"
+			if p.Attached {
+				attached = p.Interface + " (" + p.XdpMode + ")"
+			}
+			loaded := "-"
+			if p.LoadedAt != nil {
+				loaded = p.LoadedAt.AsTime().Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%d\t%s\n", p.Name, p.Type, p.Id, p.Tag, attached, loaded,
+				p.LoadDuration.AsDuration(), p.RunCount, p.RunTime.AsDuration())
+		}
+		fmt.Fprintln(w, "\t\t\t\t\t\t\t\t")
+		fmt.Fprintln(w, "MAP\tTYPE\tID\tKEY\tVALUE\tMAX ENTRIES\t\t\t")
+		for _, m := range resp.Maps {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t\t\t\n", m.Name, m.Type, m.Id, m.KeySize, m.ValueSize, m.MaxEntries)
+		}
+		return w.Flush()
+	}
+}
+
+func capabilitiesCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	missing := fs.Bool("missing", false, "only show the features the kernel lacks")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.GetCapabilities(ctx, &pb.GetCapabilitiesRequest{})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+
+		v := resp.Datapath
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Kernel:\t%s\n", resp.KernelRelease)
+		switch {
+		case resp.XdpAttached:
+			fmt.Fprintf(w, "XDP router:\tattached in %s mode\n", resp.XdpMode)
+		case resp.XdpError != "":
+			fmt.Fprintf(w, "XDP router:\tinactive: %s\n", resp.XdpError)
+		default:
+			fmt.Fprintf(w, "XDP router:\tnot enabled\n")
+		}
+		if v.Error != "" {
+			fmt.Fprintf(w, "Unsupported:\t%s\n", strings.ReplaceAll(v.Error, "\n", "; "))
+		} else {
+			fmt.Fprintf(w, "Modes:\t%s\n", strings.Join(v.Modes, ", "))
+			fmt.Fprintf(w, "Drop events:\t%s\n", v.DropEvents)
+			fmt.Fprintf(w, "Conntrack map:\t%s\n", v.ConntrackMap)
+		}
+		fmt.Fprintf(w, "Batch ops:\t%t\n", v.BatchOps)
+		fmt.Fprintf(w, "SYN cookies:\t%t\n", v.SynCookies)
+		fmt.Fprintf(w, "SYN protection:\t%t\n", resp.SynProtection)
+		fmt.Fprintf(w, "Source checks:\t%t\n", resp.SourceCheck)
+		fmt.Fprintf(w, "Connect-time policy:\t%t (kernel %t)\n", resp.ConnectPolicy, v.ConnectPolicy)
+		fmt.Fprintf(w, "Socket acceleration:\t%t (kernel %t)\n", resp.SocketAcceleration, v.SocketAcceleration)
+		fmt.Fprintf(w, "Proxy redirection:\t%t (kernel %t)\n", resp.ProxyRedirect, v.ProxyRedirect)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(e.out)
+		w = tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "FEATURE\tAVAILABLE\tERROR")
+		for _, f := range resp.Features {
+			if *missing && f.Available {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%t\t%s\n", f.Name, f.Available, f.Error)
+		}
+		return w.Flush()
+	}
+}
+
+func datapathDumpCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	pageSize := fs.Uint("page-size", 0, "entries per page, 100 when zero")
+	pageToken := fs.String("page-token", "", "continue after the page that printed this token")
+	all := fs.Bool("all", false, "follow every page to the end of the map")
+	raw := fs.Bool("raw", false, "show keys and values in hex rather than decoded")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		req := &pb.DatapathInspectRequest{MapName: args[0], PageSize: uint32(*pageSize), PageToken: *pageToken}
+		var entries []*pb.DatapathMapEntry
+		for {
+			callCtx, cancel := e.call(ctx)
+			resp, err := nodes.DatapathInspect(callCtx, req)
+			cancel()
+			if err != nil {
+				return err
+			}
+			entries = append(entries, resp.Entries...)
+			req.PageToken = resp.NextPageToken
+			if !*all || req.PageToken == "" {
+				break
+			}
+		}
+		if e.json {
+			return e.printJSON(&pb.DatapathInspectResponse{Entries: entries, NextPageToken: req.PageToken})
+		}
+
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE")
+		for _, en := range entries {
+			if *raw {
+				fmt.Fprintf(w, "%x\t%x\n", en.RawKey, en.RawValue)
+			} else {
+				fmt.Fprintf(w, "%s\t%s\n", en.Key, en.Value)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if req.PageToken != "" {
+			fmt.Fprintf(os.Stderr, "more entries follow, continue with -page-token %s\n", req.PageToken)
+		}
+		return nil
+	}
+}
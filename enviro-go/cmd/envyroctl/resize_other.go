@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// notifyResize is only implemented on Unix; elsewhere the size is only
+// passed when the session starts.
+func (t *terminal) notifyResize(ctx context.Context, fn func(*pb.TerminalSize)) {}
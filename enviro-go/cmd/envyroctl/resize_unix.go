@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// notifyResize calls fn with the size of t whenever it is resized, until
+// ctx is done
+func (t *terminal) notifyResize(ctx context.Context, fn func(*pb.TerminalSize)) {
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(resized)
+		for {
+			select {
+			case <-resized:
+				if size := t.size(); size != nil {
+					fn(size)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"text/tabwriter"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func serviceLsCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	namespace := fs.String("namespace", "", "only list the services of this namespace")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		services, err := e.client.ListServices(ctx, *namespace)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(&pb.ListServicesResponse{Services: services})
+		}
+		var hosts []string
+		for _, svc := range services {
+			if svc.ExposeNodePort {
+				if hosts, err = e.nodeHosts(ctx); err != nil {
+					return err
+				}
+				break
+			}
+		}
+
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tNAMESPACE\tVIP\tPORTS\tBACKENDS\tTOPOLOGY\tNODE PORTS\tENDPOINTS")
+		for _, svc := range services {
+			var ports, nodePorts, endpoints []string
+			for _, p := range servicePorts(svc) {
+				ports = append(ports, formatServicePort(p))
+				if p.NodePort != 0 {
+					nodePorts = append(nodePorts, fmt.Sprint(p.NodePort))
+					endpoints = append(endpoints, nodePortEndpoints(hosts, p.NodePort)...)
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", svc.Name, svc.Namespace, svc.Vip,
+				strings.Join(ports, ","), len(svc.Backends), orDefault(svc.Topology, "any"),
+				orDefault(strings.Join(nodePorts, ","), "-"), orDefault(strings.Join(endpoints, ","), "-"))
+		}
+		return w.Flush()
+	}
+}
+
+// servicePorts returns the ports of svc, its single port when a control
+// plane predating several ports sent none
+func servicePorts(svc *pb.Service) []*pb.ServicePort {
+	if len(svc.Ports) > 0 {
+		return svc.Ports
+	}
+	return []*pb.ServicePort{{Port: svc.Port, Protocol: svc.Protocol, TargetPort: svc.TargetPort, NodePort: svc.NodePort}}
+}
+
+// formatServicePort formats p as name:port->target/protocol, leaving out
+// the name and target port when there are none
+func formatServicePort(p *pb.ServicePort) string {
+	s := fmt.Sprint(p.Port)
+	if p.Name != "" {
+		s = p.Name + ":" + s
+	}
+	if p.TargetPort != 0 && p.TargetPort != p.Port {
+		s += fmt.Sprintf("->%d", p.TargetPort)
+	}
+	return s + "/" + orDefault(p.Protocol, "tcp")
+}
+
+// nodeHosts returns the hosts of the control plane and its registered
+// nodes, which all serve the node ports of services
+func (e *env) nodeHosts(ctx context.Context) ([]string, error) {
+	nodes, err := e.client.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := nodes.ListNodes(ctx, &pb.ListNodesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{e.client.Endpoint()}
+	for _, n := range resp.Nodes {
+		addrs = append(addrs, n.Address)
+	}
+	var hosts []string
+	for _, addr := range addrs {
+		// Control planes listening on a unix socket have no host to reach
+		// them at
+		if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// nodePortEndpoints returns host:port for each of hosts
+func nodePortEndpoints(hosts []string, port uint32) []string {
+	endpoints := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		endpoints = append(endpoints, net.JoinHostPort(host, fmt.Sprint(port)))
+	}
+	return endpoints
+}
+
+// orDefault shows an unset field as its default
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func configCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	overrides := fs.Bool("overrides", false, "only show the settings overridden at runtime")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.DumpEffectiveConfig(ctx, &pb.DumpEffectiveConfigRequest{})
+		if err != nil {
+			return err
+		}
+		if *overrides {
+			var settings []*pb.ConfigSetting
+			for _, s := range resp.Settings {
+				if s.Source != "config" {
+					settings = append(settings, s)
+				}
+			}
+			resp.Settings = settings
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+		for _, s := range resp.Settings {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, s.Value, s.Source)
+		}
+		return w.Flush()
+	}
+}
+
+func settingsSetCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		settings := &pb.RuntimeSettings{}
+		for _, arg := range args {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return fmt.Errorf("invalid setting %q, want KEY=VALUE", arg)
+			}
+			if err := setRuntimeSetting(settings, key, value); err != nil {
+				return err
+			}
+		}
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.UpdateRuntimeSettings(ctx, &pb.UpdateRuntimeSettingsRequest{Settings: settings})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		fmt.Fprintf(e.out, "Overridden: %s\n", strings.Join(resp.Overrides, ", "))
+		return nil
+	}
+}
+
+// setRuntimeSetting sets the field of settings overriding the setting of
+// the config at key to value
+func setRuntimeSetting(settings *pb.RuntimeSettings, key, value string) error {
+	var err error
+	parseUint := func(bits int) uint64 {
+		var n uint64
+		n, err = strconv.ParseUint(value, 10, bits)
+		return n
+	}
+	switch key {
+	case "log_level":
+		settings.LogLevel = &value
+	case "network.log_throttle.sample_every":
+		n := parseUint(64)
+		settings.LogSampleEvery = &n
+	case "rate_limit.default.rate":
+		var rate float64
+		rate, err = strconv.ParseFloat(value, 64)
+		settings.RateLimit = &rate
+	case "rate_limit.default.burst":
+		n := uint32(parseUint(32))
+		settings.RateLimitBurst = &n
+	case "rate_limit.default.max_in_flight":
+		n := uint32(parseUint(32))
+		settings.RateLimitMaxInFlight = &n
+	case "event_buffer_size":
+		n := uint32(parseUint(32))
+		settings.EventBufferSize = &n
+	case "reconcile.interval":
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		settings.ReconcileInterval = durationpb.New(d)
+	default:
+		return fmt.Errorf("%s can't be overridden, only log_level, network.log_throttle.sample_every, "+
+			"rate_limit.default.rate, rate_limit.default.burst, rate_limit.default.max_in_flight, "+
+			"event_buffer_size and reconcile.interval", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+func settingsResetCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		nodes, err := e.client.Nodes()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		resp, err := nodes.ResetRuntimeSettings(ctx, &pb.ResetRuntimeSettingsRequest{Keys: args})
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		if len(resp.Overrides) == 0 {
+			fmt.Fprintln(e.out, "No settings are overridden")
+			return nil
+		}
+		fmt.Fprintf(e.out, "Still overridden: %s\n", strings.Join(resp.Overrides, ", "))
+		return nil
+	}
+}
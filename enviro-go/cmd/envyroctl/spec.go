@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v3"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func applyCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	file := fs.String("f", "", "YAML or JSON file of the spec, e.g. the spec of spec -o json; - for stdin")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 || *file == "" {
+			return errUsage
+		}
+		data, err := readInput(*file)
+		if err != nil {
+			return err
+		}
+		spec, err := parseSpec(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", *file, err)
+		}
+		generation, err := e.client.ApplySpec(ctx, spec)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(e.out, "generation %d\n", generation)
+		return nil
+	}
+}
+
+// parseSpec decodes the spec of apply. YAML is converted to JSON first,
+// so both use the JSON names of the fields.
+func parseSpec(data []byte) (*pb.Spec, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	spec := &pb.Spec{}
+	if err := protojson.Unmarshal(raw, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+func specCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		resp, err := e.client.GetSpec(ctx)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(resp)
+		}
+		if resp.Spec == nil {
+			fmt.Fprintln(e.out, "No spec applied")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Generation:\t%d\n", resp.Generation)
+		fmt.Fprintf(w, "Containers:\t%d\n", len(resp.Spec.Containers))
+		fmt.Fprintf(w, "Services:\t%d\n", len(resp.Spec.Services))
+		fmt.Fprintf(w, "Policies:\t%d\n", len(resp.Spec.Policies))
+		st := resp.Status
+		switch {
+		case st == nil:
+			fmt.Fprintf(w, "Status:\tnot reconciled yet\n")
+		case st.Converged:
+			fmt.Fprintf(w, "Status:\tconverged, generation %d, %s ago\n", st.Generation, age(st.Time.AsTime()))
+		default:
+			fmt.Fprintf(w, "Status:\tconverging, generation %d, %s ago\n", st.Generation, age(st.Time.AsTime()))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		for _, re := range st.GetErrors() {
+			fmt.Fprintf(e.out, "  %s: %s\n", re.Resource, re.Error)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func usageCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	watch := fs.Bool("watch", false, "keep sampling until interrupted, showing the CPU usage between samples")
+	interval := fs.Duration("interval", 0, "how often to sample with -watch, default the control plane's")
+	return func(ctx context.Context, e *env, args []string) error {
+		stats, err := e.client.Stats()
+		if err != nil {
+			return err
+		}
+		if !*watch {
+			ctx, cancel := e.call(ctx)
+			defer cancel()
+			resp, err := stats.GetContainerStats(ctx, &pb.GetContainerStatsRequest{ContainerIds: args})
+			if err != nil {
+				return err
+			}
+			if e.json {
+				return e.printJSON(resp)
+			}
+			return e.printUsage(resp.Containers, false)
+		}
+
+		req := &pb.StreamContainerStatsRequest{ContainerIds: args}
+		if *interval > 0 {
+			req.Interval = durationpb.New(*interval)
+		}
+		samples, err := stats.StreamContainerStats(ctx, req)
+		if err != nil {
+			return err
+		}
+		for {
+			resp, err := samples.Recv()
+			if err != nil {
+				return err
+			}
+			if e.json {
+				if err := e.printJSONLine(resp); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := e.printUsage(resp.Containers, true); err != nil {
+				return err
+			}
+			fmt.Fprintln(e.out)
+		}
+	}
+}
+
+// printUsage prints a table of the resource usage of containers, with
+// their CPU usage in percent when sampled by a stream
+func (e *env) printUsage(containers []*pb.ContainerStats, percent bool) error {
+	w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	cpuHeader := "CPU TIME"
+	if percent {
+		cpuHeader = "CPU %"
+	}
+	fmt.Fprintf(w, "CONTAINER\t%s\tMEMORY\tLIMIT\tPIDS\tBLOCK READ\tBLOCK WRITE\tNET BYTES\tSOURCE\n", cpuHeader)
+	for _, c := range containers {
+		cpu, mem, limit, pids, read, write := "-", "-", "-", "-", "-", "-"
+		if c.Cpu != nil {
+			if percent {
+				cpu = fmt.Sprintf("%.1f", c.Cpu.UsagePercent)
+			} else {
+				cpu = fmt.Sprintf("%.2fs", float64(c.Cpu.UsageUsec)/1e6)
+			}
+		}
+		if c.Memory != nil {
+			mem = fmt.Sprint(c.Memory.WorkingSetBytes)
+			if c.Memory.LimitBytes > 0 {
+				limit = fmt.Sprint(c.Memory.LimitBytes)
+			}
+		}
+		if c.Pids != nil {
+			pids = fmt.Sprint(c.Pids.Current)
+		}
+		if c.Io != nil {
+			read, write = fmt.Sprint(c.Io.ReadBytes), fmt.Sprint(c.Io.WriteBytes)
+		}
+		source := c.Source
+		if source == "" {
+			source = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", c.ContainerId, cpu, mem, limit, pids, read, write,
+			c.Stats["bytes_processed"], source)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func versionCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		ctx, cancel := e.call(ctx)
+		defer cancel()
+		info, err := e.client.APIInfo(ctx)
+		if status.Code(err) == codes.Unimplemented {
+			return errors.New("the control plane predates the versioned API")
+		}
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(info)
+		}
+		w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Server version:\t%s\n", info.ServerVersion)
+		fmt.Fprintf(w, "API version:\t%s\n", info.ApiVersion)
+		if len(info.CompatiblePackages) > 0 {
+			fmt.Fprintf(w, "Also serves:\t%s\n", strings.Join(info.CompatiblePackages, ", "))
+		}
+		fmt.Fprintf(w, "Features:\t%s\n", strings.Join(info.Features, ", "))
+		fmt.Fprintf(w, "Max message size:\t%d received, %d sent\n", info.MaxRecvMessageSize, info.MaxSendMessageSize)
+		return w.Flush()
+	}
+}
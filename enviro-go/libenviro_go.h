@@ -12,6 +12,8 @@
 
 #ifndef GO_CGO_GOSTRING_TYPEDEF
 typedef struct { const char *p; ptrdiff_t n; } _GoString_;
+extern size_t _GoStringLen(_GoString_ s);
+extern const char *_GoStringPtr(_GoString_ s);
 #endif
 
 #endif
@@ -19,14 +21,93 @@ typedef struct { const char *p; ptrdiff_t n; } _GoString_;
 /* Start of preamble from import "C" comments.  */
 
 
-#line 15 "control.go"
+#line 9 "ffi.go"
 
+#include <stdint.h>
 #include <stdlib.h>
 
-// FFI result codes matching Rust
+// FFI result codes matching Rust. The codes are stable; go_get_last_error
+// describes the failure of a call returning one other than FFI_SUCCESS.
 typedef int ffi_result;
 #define FFI_SUCCESS 0
+// Failures without a code of their own
 #define FFI_ERROR -1
+#define FFI_TIMEOUT -2
+// Invalid configuration or arguments
+#define FFI_INVALID_ARGUMENT -3
+// The listen address is taken by another process
+#define FFI_ADDRESS_IN_USE -4
+// Missing privileges, e.g. to bind a port or load eBPF programs
+#define FFI_PERMISSION_DENIED -5
+// An init call while the control plane runs, which leaves it running.
+// Init calls returned FFI_SUCCESS for this before the code existed.
+#define FFI_ALREADY_INITIALIZED -6
+// A call needing the control plane before it is initialized
+#define FFI_NOT_INITIALIZED -7
+// The platform lacks a requested feature, e.g. the eBPF datapath
+#define FFI_UNSUPPORTED -8
+
+// Receives each event as a JSON-encoded ContainerEvent, which includes
+// events about the control plane and its nodes. The string is only valid
+// for the duration of the call.
+typedef void (*enviro_event_callback)(const char* event_json, void* user_data);
+
+static inline void call_event_callback(enviro_event_callback cb, const char* event_json, void* user_data) {
+	cb(event_json, user_data);
+}
+
+// Performs action ("start" or "stop") on a container and returns once it
+// is done. timeout_ms is how long a stopping container may take to exit
+// before it is killed. On failure the callback may write a NUL-terminated
+// message of at most err_len bytes to err.
+typedef ffi_result (*enviro_runtime_callback)(const char* action, const char* container_id, int timeout_ms,
+	char* err, size_t err_len, void* user_data);
+
+static inline ffi_result call_runtime_callback(enviro_runtime_callback cb, const char* action,
+	const char* container_id, int timeout_ms, char* err, size_t err_len, void* user_data) {
+	return cb(action, container_id, timeout_ms, err, err_len, user_data);
+}
+
+// Operations of the session callback
+#define ENVIRO_SESSION_EXEC 0
+#define ENVIRO_SESSION_ATTACH 1
+#define ENVIRO_SESSION_STDIN 2
+#define ENVIRO_SESSION_CLOSE_STDIN 3
+#define ENVIRO_SESSION_RESIZE 4
+#define ENVIRO_SESSION_CLOSE 5
+
+// Streams of go_session_output
+#define ENVIRO_STREAM_STDOUT 1
+#define ENVIRO_STREAM_STDERR 2
+
+// Drives the exec and attach sessions of the runtime. ENVIRO_SESSION_EXEC
+// runs a command in a container and ENVIRO_SESSION_ATTACH attaches to its
+// main process, data holding the JSON-encoded container_id and options,
+// e.g. {"container_id":"c1","command":["sh"],"tty":true,"stdin":true,
+// "size":{"width":80,"height":24}}. Once that returns FFI_SUCCESS the
+// session is known by session_id, and later operations pass its input:
+// ENVIRO_SESSION_STDIN the len bytes of data, ENVIRO_SESSION_RESIZE the
+// JSON-encoded size, and ENVIRO_SESSION_CLOSE_STDIN nothing.
+// ENVIRO_SESSION_CLOSE ends the session, killing an exec'd command or
+// detaching. data is only valid for the duration of the call. On failure
+// the callback may write a NUL-terminated message of at most err_len bytes
+// to err.
+typedef ffi_result (*enviro_session_callback)(uint64_t session_id, int op, const char* data, size_t len,
+	char* err, size_t err_len, void* user_data);
+
+static inline ffi_result call_session_callback(enviro_session_callback cb, uint64_t session_id, int op,
+	const char* data, size_t len, char* err, size_t err_len, void* user_data) {
+	return cb(session_id, op, data, len, err, err_len, user_data);
+}
+
+// Receives each log record as a JSON object with at least the time,
+// level and msg keys. level is -4 for debug, 0 for info, 4 for warn and 8
+// for error. The string is only valid for the duration of the call.
+typedef void (*enviro_log_callback)(int level, const char* record_json, void* user_data);
+
+static inline void call_log_callback(enviro_log_callback cb, int level, const char* record_json, void* user_data) {
+	cb(level, record_json, user_data);
+}
 
 #line 1 "cgo-generated-wrapper"
 
@@ -54,10 +135,16 @@ typedef size_t GoUintptr;
 typedef float GoFloat32;
 typedef double GoFloat64;
 #ifdef _MSC_VER
+#if !defined(__cplusplus) || _MSVC_LANG <= 201402L
 #include <complex.h>
 typedef _Fcomplex GoComplex64;
 typedef _Dcomplex GoComplex128;
 #else
+#include <complex>
+typedef std::complex<float> GoComplex64;
+typedef std::complex<double> GoComplex128;
+#endif
+#else
 typedef float _Complex GoComplex64;
 typedef double _Complex GoComplex128;
 #endif
@@ -85,7 +172,37 @@ extern "C" {
 #endif
 
 extern ffi_result go_init_control_plane(char* addr);
-extern ffi_result go_shutdown_control_plane();
+extern ffi_result go_init_control_plane_with_log_level(char* addr, char* level);
+extern ffi_result go_init_control_plane_with_config(char* config);
+extern ffi_result go_init_control_plane_traced(char* config, char* traceparent);
+extern ffi_result go_init_control_plane_blocking(char* addr, int timeoutMs);
+extern ffi_result go_shutdown_control_plane(void);
+extern ffi_result go_drain_control_plane(int timeoutMs);
+extern ffi_result go_reload_control_plane(char* config);
+extern ffi_result go_init_network(char* config);
+extern ffi_result go_network_new(char* config, uint64_t* handle);
+extern ffi_result go_network_free(uint64_t handle);
+extern ffi_result go_network_drain(uint64_t handle, int timeoutMs);
+extern ffi_result go_network_reload(uint64_t handle, char* config);
+extern ffi_result go_network_init(uint64_t handle, char* config);
+extern ffi_result go_network_register_event_callback(uint64_t handle, enviro_event_callback cb, void* userData);
+extern ffi_result go_network_pull_image(uint64_t handle, char* ref, int timeoutMs, char** imageJSON);
+extern ffi_result go_network_report_container_stats(uint64_t handle, char* statsJSON);
+extern ffi_result go_network_list_container_networks(uint64_t handle, char* labels, char** outJSON, size_t* outLen);
+extern ffi_result go_network_verify_container_network(uint64_t handle, char* containerID, int timeoutMs, char** reportJSON);
+extern char* go_get_last_error(void);
+extern void go_free_string(char* s);
+extern ffi_result go_register_event_callback(enviro_event_callback cb, void* userData);
+extern ffi_result go_set_log_level(char* level);
+extern ffi_result go_register_log_callback(enviro_log_callback cb, void* userData);
+extern ffi_result go_register_runtime_callback(enviro_runtime_callback cb, void* userData);
+extern ffi_result go_register_session_callback(enviro_session_callback cb, void* userData);
+extern ffi_result go_session_output(uint64_t sessionID, int stream, char* data, size_t length);
+extern ffi_result go_session_exit(uint64_t sessionID, int exitCode, char* errMsg);
+extern ffi_result go_pull_image(char* ref, int timeoutMs, char** imageJSON);
+extern ffi_result go_report_container_stats(char* statsJSON);
+extern ffi_result go_list_container_networks(char* labels, char** outJSON, size_t* outLen);
+extern ffi_result go_verify_container_network(char* containerID, int timeoutMs, char** reportJSON);
 
 #ifdef __cplusplus
 }
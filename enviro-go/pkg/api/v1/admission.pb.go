@@ -0,0 +1,361 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.32.0
+// 	protoc        (unknown)
+// source: admission.proto
+
+package v1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type AdmissionOperation int32
+
+const (
+	AdmissionOperation_ADMISSION_OPERATION_UNSPECIFIED AdmissionOperation = 0
+	// CreateContainer, including creates by ApplySpec
+	AdmissionOperation_ADMISSION_OPERATION_CREATE AdmissionOperation = 1
+	// StartContainer, including starts by ApplySpec
+	AdmissionOperation_ADMISSION_OPERATION_START AdmissionOperation = 2
+)
+
+// Enum value maps for AdmissionOperation.
+var (
+	AdmissionOperation_name = map[int32]string{
+		0: "ADMISSION_OPERATION_UNSPECIFIED",
+		1: "ADMISSION_OPERATION_CREATE",
+		2: "ADMISSION_OPERATION_START",
+	}
+	AdmissionOperation_value = map[string]int32{
+		"ADMISSION_OPERATION_UNSPECIFIED": 0,
+		"ADMISSION_OPERATION_CREATE":      1,
+		"ADMISSION_OPERATION_START":       2,
+	}
+)
+
+func (x AdmissionOperation) Enum() *AdmissionOperation {
+	p := new(AdmissionOperation)
+	*p = x
+	return p
+}
+
+func (x AdmissionOperation) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (AdmissionOperation) Descriptor() protoreflect.EnumDescriptor {
+	return file_admission_proto_enumTypes[0].Descriptor()
+}
+
+func (AdmissionOperation) Type() protoreflect.EnumType {
+	return &file_admission_proto_enumTypes[0]
+}
+
+func (x AdmissionOperation) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use AdmissionOperation.Descriptor instead.
+func (AdmissionOperation) EnumDescriptor() ([]byte, []int) {
+	return file_admission_proto_rawDescGZIP(), []int{0}
+}
+
+type AdmissionRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Identifies the request in the control plane's logs
+	Uid       string             `protobuf:"bytes,1,opt,name=uid,proto3" json:"uid,omitempty"`
+	Operation AdmissionOperation `protobuf:"varint,2,opt,name=operation,proto3,enum=enviro.api.v1.AdmissionOperation" json:"operation,omitempty"`
+	// The caller's identity when authentication is enabled
+	Principal string `protobuf:"bytes,3,opt,name=principal,proto3" json:"principal,omitempty"`
+	// The request being created, with CREATE. Earlier webhooks' mutations
+	// are applied.
+	Create *CreateContainerRequest `protobuf:"bytes,4,opt,name=create,proto3" json:"create,omitempty"`
+	// The container being started, with START
+	Container *Container `protobuf:"bytes,5,opt,name=container,proto3" json:"container,omitempty"`
+}
+
+func (x *AdmissionRequest) Reset() {
+	*x = AdmissionRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_admission_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AdmissionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AdmissionRequest) ProtoMessage() {}
+
+func (x *AdmissionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admission_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AdmissionRequest.ProtoReflect.Descriptor instead.
+func (*AdmissionRequest) Descriptor() ([]byte, []int) {
+	return file_admission_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *AdmissionRequest) GetUid() string {
+	if x != nil {
+		return x.Uid
+	}
+	return ""
+}
+
+func (x *AdmissionRequest) GetOperation() AdmissionOperation {
+	if x != nil {
+		return x.Operation
+	}
+	return AdmissionOperation_ADMISSION_OPERATION_UNSPECIFIED
+}
+
+func (x *AdmissionRequest) GetPrincipal() string {
+	if x != nil {
+		return x.Principal
+	}
+	return ""
+}
+
+func (x *AdmissionRequest) GetCreate() *CreateContainerRequest {
+	if x != nil {
+		return x.Create
+	}
+	return nil
+}
+
+func (x *AdmissionRequest) GetContainer() *Container {
+	if x != nil {
+		return x.Container
+	}
+	return nil
+}
+
+type AdmissionResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Rejects the request with PERMISSION_DENIED when false
+	Allowed bool `protobuf:"varint,1,opt,name=allowed,proto3" json:"allowed,omitempty"`
+	// Why the request was rejected, returned to the caller
+	Reason string `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`
+	// Replaces the request being created when set, with CREATE. Its id and
+	// idempotency key can't be changed.
+	Create *CreateContainerRequest `protobuf:"bytes,3,opt,name=create,proto3" json:"create,omitempty"`
+}
+
+func (x *AdmissionResponse) Reset() {
+	*x = AdmissionResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_admission_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AdmissionResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AdmissionResponse) ProtoMessage() {}
+
+func (x *AdmissionResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admission_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AdmissionResponse.ProtoReflect.Descriptor instead.
+func (*AdmissionResponse) Descriptor() ([]byte, []int) {
+	return file_admission_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AdmissionResponse) GetAllowed() bool {
+	if x != nil {
+		return x.Allowed
+	}
+	return false
+}
+
+func (x *AdmissionResponse) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *AdmissionResponse) GetCreate() *CreateContainerRequest {
+	if x != nil {
+		return x.Create
+	}
+	return nil
+}
+
+var File_admission_proto protoreflect.FileDescriptor
+
+var file_admission_proto_rawDesc = []byte{
+	0x0a, 0x0f, 0x61, 0x64, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x12, 0x0d, 0x65, 0x6e, 0x76, 0x69, 0x72, 0x6f, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x76, 0x31,
+	0x1a, 0x0f, 0x63, 0x6f, 0x6e, 0x74, 0x61, 0x69, 0x6e, 0x65, 0x72, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x22, 0xfa, 0x01, 0x0a, 0x10, 0x41, 0x64, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x75, 0x69, 0x64, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x03, 0x75, 0x69, 0x64, 0x12, 0x3f, 0x0a, 0x09, 0x6f, 0x70, 0x65, 0x72,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x21, 0x2e, 0x65, 0x6e,
+	0x76, 0x69, 0x72, 0x6f, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x76, 0x31, 0x2e, 0x41, 0x64, 0x6d, 0x69,
+	0x73, 0x73, 0x69, 0x6f, 0x6e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x09,
+	0x6f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1c, 0x0a, 0x09, 0x70, 0x72, 0x69,
+	0x6e, 0x63, 0x69, 0x70, 0x61, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x70, 0x72,
+	0x69, 0x6e, 0x63, 0x69, 0x70, 0x61, 0x6c, 0x12, 0x3d, 0x0a, 0x06, 0x63, 0x72, 0x65, 0x61, 0x74,
+	0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x25, 0x2e, 0x65, 0x6e, 0x76, 0x69, 0x72, 0x6f,
+	0x2e, 0x61, 0x70, 0x69, 0x2e, 0x76, 0x31, 0x2e, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x43, 0x6f,
+	0x6e, 0x74, 0x61, 0x69, 0x6e, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x06,
+	0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x12, 0x36, 0x0a, 0x09, 0x63, 0x6f, 0x6e, 0x74, 0x61, 0x69,
+	0x6e, 0x65, 0x72, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x65, 0x6e, 0x76, 0x69,
+	0x72, 0x6f, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x76, 0x31, 0x2e, 0x43, 0x6f, 0x6e, 0x74, 0x61, 0x69,
+	0x6e, 0x65, 0x72, 0x52, 0x09, 0x63, 0x6f, 0x6e, 0x74, 0x61, 0x69, 0x6e, 0x65, 0x72, 0x22, 0x84,
+	0x01, 0x0a, 0x11, 0x41, 0x64, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x65, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x65, 0x64, 0x12, 0x16,
+	0x0a, 0x06, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06,
+	0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x12, 0x3d, 0x0a, 0x06, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x25, 0x2e, 0x65, 0x6e, 0x76, 0x69, 0x72, 0x6f, 0x2e,
+	0x61, 0x70, 0x69, 0x2e, 0x76, 0x31, 0x2e, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x43, 0x6f, 0x6e,
+	0x74, 0x61, 0x69, 0x6e, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x06, 0x63,
+	0x72, 0x65, 0x61, 0x74, 0x65, 0x2a, 0x78, 0x0a, 0x12, 0x41, 0x64, 0x6d, 0x69, 0x73, 0x73, 0x69,
+	0x6f, 0x6e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x23, 0x0a, 0x1f, 0x41,
+	0x44, 0x4d, 0x49, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x4f, 0x50, 0x45, 0x52, 0x41, 0x54, 0x49,
+	0x4f, 0x4e, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00,
+	0x12, 0x1e, 0x0a, 0x1a, 0x41, 0x44, 0x4d, 0x49, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x4f, 0x50,
+	0x45, 0x52, 0x41, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x43, 0x52, 0x45, 0x41, 0x54, 0x45, 0x10, 0x01,
+	0x12, 0x1d, 0x0a, 0x19, 0x41, 0x44, 0x4d, 0x49, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x4f, 0x50,
+	0x45, 0x52, 0x41, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x53, 0x54, 0x41, 0x52, 0x54, 0x10, 0x02, 0x32,
+	0x5e, 0x0a, 0x10, 0x41, 0x64, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x57, 0x65, 0x62, 0x68,
+	0x6f, 0x6f, 0x6b, 0x12, 0x4a, 0x0a, 0x05, 0x41, 0x64, 0x6d, 0x69, 0x74, 0x12, 0x1f, 0x2e, 0x65,
+	0x6e, 0x76, 0x69, 0x72, 0x6f, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x76, 0x31, 0x2e, 0x41, 0x64, 0x6d,
+	0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x20, 0x2e,
+	0x65, 0x6e, 0x76, 0x69, 0x72, 0x6f, 0x2e, 0x61, 0x70, 0x69, 0x2e, 0x76, 0x31, 0x2e, 0x41, 0x64,
+	0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42,
+	0x32, 0x5a, 0x30, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x31, 0x30,
+	0x39, 0x30, 0x6d, 0x62, 0x2f, 0x65, 0x6e, 0x76, 0x69, 0x72, 0x6f, 0x2f, 0x65, 0x6e, 0x76, 0x69,
+	0x72, 0x6f, 0x2d, 0x67, 0x6f, 0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x76, 0x31,
+	0x3b, 0x76, 0x31, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_admission_proto_rawDescOnce sync.Once
+	file_admission_proto_rawDescData = file_admission_proto_rawDesc
+)
+
+func file_admission_proto_rawDescGZIP() []byte {
+	file_admission_proto_rawDescOnce.Do(func() {
+		file_admission_proto_rawDescData = protoimpl.X.CompressGZIP(file_admission_proto_rawDescData)
+	})
+	return file_admission_proto_rawDescData
+}
+
+var file_admission_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_admission_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_admission_proto_goTypes = []interface{}{
+	(AdmissionOperation)(0),        // 0: enviro.api.v1.AdmissionOperation
+	(*AdmissionRequest)(nil),       // 1: enviro.api.v1.AdmissionRequest
+	(*AdmissionResponse)(nil),      // 2: enviro.api.v1.AdmissionResponse
+	(*CreateContainerRequest)(nil), // 3: enviro.api.v1.CreateContainerRequest
+	(*Container)(nil),              // 4: enviro.api.v1.Container
+}
+var file_admission_proto_depIdxs = []int32{
+	0, // 0: enviro.api.v1.AdmissionRequest.operation:type_name -> enviro.api.v1.AdmissionOperation
+	3, // 1: enviro.api.v1.AdmissionRequest.create:type_name -> enviro.api.v1.CreateContainerRequest
+	4, // 2: enviro.api.v1.AdmissionRequest.container:type_name -> enviro.api.v1.Container
+	3, // 3: enviro.api.v1.AdmissionResponse.create:type_name -> enviro.api.v1.CreateContainerRequest
+	1, // 4: enviro.api.v1.AdmissionWebhook.Admit:input_type -> enviro.api.v1.AdmissionRequest
+	2, // 5: enviro.api.v1.AdmissionWebhook.Admit:output_type -> enviro.api.v1.AdmissionResponse
+	5, // [5:6] is the sub-list for method output_type
+	4, // [4:5] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_admission_proto_init() }
+func file_admission_proto_init() {
+	if File_admission_proto != nil {
+		return
+	}
+	file_container_proto_init()
+	if !protoimpl.UnsafeEnabled {
+		file_admission_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AdmissionRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_admission_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AdmissionResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_admission_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_admission_proto_goTypes,
+		DependencyIndexes: file_admission_proto_depIdxs,
+		EnumInfos:         file_admission_proto_enumTypes,
+		MessageInfos:      file_admission_proto_msgTypes,
+	}.Build()
+	File_admission_proto = out.File
+	file_admission_proto_rawDesc = nil
+	file_admission_proto_goTypes = nil
+	file_admission_proto_depIdxs = nil
+}
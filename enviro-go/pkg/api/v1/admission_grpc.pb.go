@@ -0,0 +1,111 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: admission.proto
+
+package v1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	AdmissionWebhook_Admit_FullMethodName = "/enviro.api.v1.AdmissionWebhook/Admit"
+)
+
+// AdmissionWebhookClient is the client API for AdmissionWebhook service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdmissionWebhookClient interface {
+	// Admit allows, rejects or mutates a request
+	Admit(ctx context.Context, in *AdmissionRequest, opts ...grpc.CallOption) (*AdmissionResponse, error)
+}
+
+type admissionWebhookClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdmissionWebhookClient(cc grpc.ClientConnInterface) AdmissionWebhookClient {
+	return &admissionWebhookClient{cc}
+}
+
+func (c *admissionWebhookClient) Admit(ctx context.Context, in *AdmissionRequest, opts ...grpc.CallOption) (*AdmissionResponse, error) {
+	out := new(AdmissionResponse)
+	err := c.cc.Invoke(ctx, AdmissionWebhook_Admit_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdmissionWebhookServer is the server API for AdmissionWebhook service.
+// All implementations must embed UnimplementedAdmissionWebhookServer
+// for forward compatibility
+type AdmissionWebhookServer interface {
+	// Admit allows, rejects or mutates a request
+	Admit(context.Context, *AdmissionRequest) (*AdmissionResponse, error)
+	mustEmbedUnimplementedAdmissionWebhookServer()
+}
+
+// UnimplementedAdmissionWebhookServer must be embedded to have forward compatible implementations.
+type UnimplementedAdmissionWebhookServer struct {
+}
+
+func (UnimplementedAdmissionWebhookServer) Admit(context.Context, *AdmissionRequest) (*AdmissionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Admit not implemented")
+}
+func (UnimplementedAdmissionWebhookServer) mustEmbedUnimplementedAdmissionWebhookServer() {}
+
+// UnsafeAdmissionWebhookServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdmissionWebhookServer will
+// result in compilation errors.
+type UnsafeAdmissionWebhookServer interface {
+	mustEmbedUnimplementedAdmissionWebhookServer()
+}
+
+func RegisterAdmissionWebhookServer(s grpc.ServiceRegistrar, srv AdmissionWebhookServer) {
+	s.RegisterService(&AdmissionWebhook_ServiceDesc, srv)
+}
+
+func _AdmissionWebhook_Admit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AdmissionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdmissionWebhookServer).Admit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdmissionWebhook_Admit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdmissionWebhookServer).Admit(ctx, req.(*AdmissionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// AdmissionWebhook_ServiceDesc is the grpc.ServiceDesc for AdmissionWebhook service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AdmissionWebhook_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "enviro.api.v1.AdmissionWebhook",
+	HandlerType: (*AdmissionWebhookServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Admit",
+			Handler:    _AdmissionWebhook_Admit_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "admission.proto",
+}
@@ -0,0 +1,275 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: chaos.proto
+
+package v1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ChaosService_SetContainerFault_FullMethodName   = "/enviro.api.v1.ChaosService/SetContainerFault"
+	ChaosService_ClearContainerFault_FullMethodName = "/enviro.api.v1.ChaosService/ClearContainerFault"
+	ChaosService_SetMethodFault_FullMethodName      = "/enviro.api.v1.ChaosService/SetMethodFault"
+	ChaosService_ClearMethodFault_FullMethodName    = "/enviro.api.v1.ChaosService/ClearMethodFault"
+	ChaosService_ListFaults_FullMethodName          = "/enviro.api.v1.ChaosService/ListFaults"
+)
+
+// ChaosServiceClient is the client API for ChaosService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ChaosServiceClient interface {
+	// SetContainerFault degrades the traffic to a container of this node,
+	// replacing its previous fault. Fails with NOT_FOUND for containers
+	// without a network on this node.
+	SetContainerFault(ctx context.Context, in *SetContainerFaultRequest, opts ...grpc.CallOption) (*SetContainerFaultResponse, error)
+	// ClearContainerFault restores the traffic to a container. Containers
+	// without a fault are left alone.
+	ClearContainerFault(ctx context.Context, in *ClearContainerFaultRequest, opts ...grpc.CallOption) (*ClearContainerFaultResponse, error)
+	// SetMethodFault fails or delays calls of an API method, replacing its
+	// previous fault. The health service and ChaosService can't be faulted.
+	SetMethodFault(ctx context.Context, in *SetMethodFaultRequest, opts ...grpc.CallOption) (*SetMethodFaultResponse, error)
+	// ClearMethodFault stops faulting calls of an API method
+	ClearMethodFault(ctx context.Context, in *ClearMethodFaultRequest, opts ...grpc.CallOption) (*ClearMethodFaultResponse, error)
+	// ListFaults returns the injected faults
+	ListFaults(ctx context.Context, in *ListFaultsRequest, opts ...grpc.CallOption) (*ListFaultsResponse, error)
+}
+
+type chaosServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChaosServiceClient(cc grpc.ClientConnInterface) ChaosServiceClient {
+	return &chaosServiceClient{cc}
+}
+
+func (c *chaosServiceClient) SetContainerFault(ctx context.Context, in *SetContainerFaultRequest, opts ...grpc.CallOption) (*SetContainerFaultResponse, error) {
+	out := new(SetContainerFaultResponse)
+	err := c.cc.Invoke(ctx, ChaosService_SetContainerFault_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chaosServiceClient) ClearContainerFault(ctx context.Context, in *ClearContainerFaultRequest, opts ...grpc.CallOption) (*ClearContainerFaultResponse, error) {
+	out := new(ClearContainerFaultResponse)
+	err := c.cc.Invoke(ctx, ChaosService_ClearContainerFault_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chaosServiceClient) SetMethodFault(ctx context.Context, in *SetMethodFaultRequest, opts ...grpc.CallOption) (*SetMethodFaultResponse, error) {
+	out := new(SetMethodFaultResponse)
+	err := c.cc.Invoke(ctx, ChaosService_SetMethodFault_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chaosServiceClient) ClearMethodFault(ctx context.Context, in *ClearMethodFaultRequest, opts ...grpc.CallOption) (*ClearMethodFaultResponse, error) {
+	out := new(ClearMethodFaultResponse)
+	err := c.cc.Invoke(ctx, ChaosService_ClearMethodFault_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chaosServiceClient) ListFaults(ctx context.Context, in *ListFaultsRequest, opts ...grpc.CallOption) (*ListFaultsResponse, error) {
+	out := new(ListFaultsResponse)
+	err := c.cc.Invoke(ctx, ChaosService_ListFaults_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ChaosServiceServer is the server API for ChaosService service.
+// All implementations must embed UnimplementedChaosServiceServer
+// for forward compatibility
+type ChaosServiceServer interface {
+	// SetContainerFault degrades the traffic to a container of this node,
+	// replacing its previous fault. Fails with NOT_FOUND for containers
+	// without a network on this node.
+	SetContainerFault(context.Context, *SetContainerFaultRequest) (*SetContainerFaultResponse, error)
+	// ClearContainerFault restores the traffic to a container. Containers
+	// without a fault are left alone.
+	ClearContainerFault(context.Context, *ClearContainerFaultRequest) (*ClearContainerFaultResponse, error)
+	// SetMethodFault fails or delays calls of an API method, replacing its
+	// previous fault. The health service and ChaosService can't be faulted.
+	SetMethodFault(context.Context, *SetMethodFaultRequest) (*SetMethodFaultResponse, error)
+	// ClearMethodFault stops faulting calls of an API method
+	ClearMethodFault(context.Context, *ClearMethodFaultRequest) (*ClearMethodFaultResponse, error)
+	// ListFaults returns the injected faults
+	ListFaults(context.Context, *ListFaultsRequest) (*ListFaultsResponse, error)
+	mustEmbedUnimplementedChaosServiceServer()
+}
+
+// UnimplementedChaosServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedChaosServiceServer struct {
+}
+
+func (UnimplementedChaosServiceServer) SetContainerFault(context.Context, *SetContainerFaultRequest) (*SetContainerFaultResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetContainerFault not implemented")
+}
+func (UnimplementedChaosServiceServer) ClearContainerFault(context.Context, *ClearContainerFaultRequest) (*ClearContainerFaultResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClearContainerFault not implemented")
+}
+func (UnimplementedChaosServiceServer) SetMethodFault(context.Context, *SetMethodFaultRequest) (*SetMethodFaultResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetMethodFault not implemented")
+}
+func (UnimplementedChaosServiceServer) ClearMethodFault(context.Context, *ClearMethodFaultRequest) (*ClearMethodFaultResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClearMethodFault not implemented")
+}
+func (UnimplementedChaosServiceServer) ListFaults(context.Context, *ListFaultsRequest) (*ListFaultsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFaults not implemented")
+}
+func (UnimplementedChaosServiceServer) mustEmbedUnimplementedChaosServiceServer() {}
+
+// UnsafeChaosServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChaosServiceServer will
+// result in compilation errors.
+type UnsafeChaosServiceServer interface {
+	mustEmbedUnimplementedChaosServiceServer()
+}
+
+func RegisterChaosServiceServer(s grpc.ServiceRegistrar, srv ChaosServiceServer) {
+	s.RegisterService(&ChaosService_ServiceDesc, srv)
+}
+
+func _ChaosService_SetContainerFault_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetContainerFaultRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChaosServiceServer).SetContainerFault(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChaosService_SetContainerFault_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChaosServiceServer).SetContainerFault(ctx, req.(*SetContainerFaultRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChaosService_ClearContainerFault_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClearContainerFaultRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChaosServiceServer).ClearContainerFault(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChaosService_ClearContainerFault_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChaosServiceServer).ClearContainerFault(ctx, req.(*ClearContainerFaultRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChaosService_SetMethodFault_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetMethodFaultRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChaosServiceServer).SetMethodFault(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChaosService_SetMethodFault_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChaosServiceServer).SetMethodFault(ctx, req.(*SetMethodFaultRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChaosService_ClearMethodFault_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClearMethodFaultRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChaosServiceServer).ClearMethodFault(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChaosService_ClearMethodFault_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChaosServiceServer).ClearMethodFault(ctx, req.(*ClearMethodFaultRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChaosService_ListFaults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFaultsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChaosServiceServer).ListFaults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChaosService_ListFaults_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChaosServiceServer).ListFaults(ctx, req.(*ListFaultsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ChaosService_ServiceDesc is the grpc.ServiceDesc for ChaosService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ChaosService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "enviro.api.v1.ChaosService",
+	HandlerType: (*ChaosServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SetContainerFault",
+			Handler:    _ChaosService_SetContainerFault_Handler,
+		},
+		{
+			MethodName: "ClearContainerFault",
+			Handler:    _ChaosService_ClearContainerFault_Handler,
+		},
+		{
+			MethodName: "SetMethodFault",
+			Handler:    _ChaosService_SetMethodFault_Handler,
+		},
+		{
+			MethodName: "ClearMethodFault",
+			Handler:    _ChaosService_ClearMethodFault_Handler,
+		},
+		{
+			MethodName: "ListFaults",
+			Handler:    _ChaosService_ListFaults_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "chaos.proto",
+}
@@ -0,0 +1,1552 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: container.proto
+
+package v1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ContainerService_CreateContainer_FullMethodName        = "/enviro.api.v1.ContainerService/CreateContainer"
+	ContainerService_StartContainer_FullMethodName         = "/enviro.api.v1.ContainerService/StartContainer"
+	ContainerService_StopContainer_FullMethodName          = "/enviro.api.v1.ContainerService/StopContainer"
+	ContainerService_DeleteContainer_FullMethodName        = "/enviro.api.v1.ContainerService/DeleteContainer"
+	ContainerService_ListContainers_FullMethodName         = "/enviro.api.v1.ContainerService/ListContainers"
+	ContainerService_GetContainer_FullMethodName           = "/enviro.api.v1.ContainerService/GetContainer"
+	ContainerService_WatchEvents_FullMethodName            = "/enviro.api.v1.ContainerService/WatchEvents"
+	ContainerService_ExposePort_FullMethodName             = "/enviro.api.v1.ContainerService/ExposePort"
+	ContainerService_UnexposePort_FullMethodName           = "/enviro.api.v1.ContainerService/UnexposePort"
+	ContainerService_ListPortForwards_FullMethodName       = "/enviro.api.v1.ContainerService/ListPortForwards"
+	ContainerService_CreateService_FullMethodName          = "/enviro.api.v1.ContainerService/CreateService"
+	ContainerService_UpdateServiceBackends_FullMethodName  = "/enviro.api.v1.ContainerService/UpdateServiceBackends"
+	ContainerService_DeleteService_FullMethodName          = "/enviro.api.v1.ContainerService/DeleteService"
+	ContainerService_ListServices_FullMethodName           = "/enviro.api.v1.ContainerService/ListServices"
+	ContainerService_SetBandwidthLimit_FullMethodName      = "/enviro.api.v1.ContainerService/SetBandwidthLimit"
+	ContainerService_SetQoSClass_FullMethodName            = "/enviro.api.v1.ContainerService/SetQoSClass"
+	ContainerService_CaptureTraffic_FullMethodName         = "/enviro.api.v1.ContainerService/CaptureTraffic"
+	ContainerService_StreamLogs_FullMethodName             = "/enviro.api.v1.ContainerService/StreamLogs"
+	ContainerService_Exec_FullMethodName                   = "/enviro.api.v1.ContainerService/Exec"
+	ContainerService_Attach_FullMethodName                 = "/enviro.api.v1.ContainerService/Attach"
+	ContainerService_ApplySpec_FullMethodName              = "/enviro.api.v1.ContainerService/ApplySpec"
+	ContainerService_GetSpec_FullMethodName                = "/enviro.api.v1.ContainerService/GetSpec"
+	ContainerService_CreateNamespace_FullMethodName        = "/enviro.api.v1.ContainerService/CreateNamespace"
+	ContainerService_UpdateNamespace_FullMethodName        = "/enviro.api.v1.ContainerService/UpdateNamespace"
+	ContainerService_DeleteNamespace_FullMethodName        = "/enviro.api.v1.ContainerService/DeleteNamespace"
+	ContainerService_ListNamespaces_FullMethodName         = "/enviro.api.v1.ContainerService/ListNamespaces"
+	ContainerService_ExportNetworkState_FullMethodName     = "/enviro.api.v1.ContainerService/ExportNetworkState"
+	ContainerService_ImportNetworkState_FullMethodName     = "/enviro.api.v1.ContainerService/ImportNetworkState"
+	ContainerService_RenewLease_FullMethodName             = "/enviro.api.v1.ContainerService/RenewLease"
+	ContainerService_ProgramService_FullMethodName         = "/enviro.api.v1.ContainerService/ProgramService"
+	ContainerService_GetServiceConnections_FullMethodName  = "/enviro.api.v1.ContainerService/GetServiceConnections"
+	ContainerService_VerifyContainerNetwork_FullMethodName = "/enviro.api.v1.ContainerService/VerifyContainerNetwork"
+)
+
+// ContainerServiceClient is the client API for ContainerService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ContainerServiceClient interface {
+	// CreateContainer sets up networking for a container. Creating an
+	// existing container returns it unchanged.
+	CreateContainer(ctx context.Context, in *CreateContainerRequest, opts ...grpc.CallOption) (*CreateContainerResponse, error)
+	// StartContainer has the container runtime start a created container.
+	// Starting a running container returns it unchanged.
+	StartContainer(ctx context.Context, in *StartContainerRequest, opts ...grpc.CallOption) (*StartContainerResponse, error)
+	// StopContainer has the container runtime stop a running container.
+	// Stopping a container that isn't running returns it unchanged.
+	StopContainer(ctx context.Context, in *StopContainerRequest, opts ...grpc.CallOption) (*StopContainerResponse, error)
+	// DeleteContainer tears down a container's networking
+	DeleteContainer(ctx context.Context, in *DeleteContainerRequest, opts ...grpc.CallOption) (*DeleteContainerResponse, error)
+	// ListContainers returns all known containers
+	ListContainers(ctx context.Context, in *ListContainersRequest, opts ...grpc.CallOption) (*ListContainersResponse, error)
+	// GetContainer returns a single container
+	GetContainer(ctx context.Context, in *GetContainerRequest, opts ...grpc.CallOption) (*GetContainerResponse, error)
+	// WatchEvents streams container lifecycle events as they happen
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (ContainerService_WatchEventsClient, error)
+	// ExposePort forwards a host port to a container port
+	ExposePort(ctx context.Context, in *ExposePortRequest, opts ...grpc.CallOption) (*ExposePortResponse, error)
+	// UnexposePort removes a port forward
+	UnexposePort(ctx context.Context, in *UnexposePortRequest, opts ...grpc.CallOption) (*UnexposePortResponse, error)
+	// ListPortForwards returns the active port forwards
+	ListPortForwards(ctx context.Context, in *ListPortForwardsRequest, opts ...grpc.CallOption) (*ListPortForwardsResponse, error)
+	// CreateService adds a virtual IP and port balanced across containers
+	CreateService(ctx context.Context, in *CreateServiceRequest, opts ...grpc.CallOption) (*CreateServiceResponse, error)
+	// UpdateServiceBackends replaces the containers a service balances
+	// across. Established connections stay on their backend.
+	UpdateServiceBackends(ctx context.Context, in *UpdateServiceBackendsRequest, opts ...grpc.CallOption) (*UpdateServiceBackendsResponse, error)
+	// DeleteService removes a service
+	DeleteService(ctx context.Context, in *DeleteServiceRequest, opts ...grpc.CallOption) (*DeleteServiceResponse, error)
+	// ListServices returns the services ordered by name
+	ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error)
+	// SetBandwidthLimit caps a container's traffic, replacing its previous
+	// limits without recreating its network
+	SetBandwidthLimit(ctx context.Context, in *SetBandwidthLimitRequest, opts ...grpc.CallOption) (*SetBandwidthLimitResponse, error)
+	// SetQoSClass changes the priority of the traffic a container sends off
+	// the node
+	SetQoSClass(ctx context.Context, in *SetQoSClassRequest, opts ...grpc.CallOption) (*SetQoSClassResponse, error)
+	// CaptureTraffic streams a container's packets as a pcap file until a
+	// limit is hit or the client cancels
+	CaptureTraffic(ctx context.Context, in *CaptureTrafficRequest, opts ...grpc.CallOption) (ContainerService_CaptureTrafficClient, error)
+	// StreamLogs streams a container's output, and with follow keeps
+	// streaming it as it is written until the client cancels
+	StreamLogs(ctx context.Context, in *StreamLogsRequest, opts ...grpc.CallOption) (ContainerService_StreamLogsClient, error)
+	// Exec runs a command in a running container, streaming its stdin,
+	// stdout and stderr. The first request starts the command; the server
+	// sends the response header once it runs and the exit status last.
+	// Cancelling the call kills the command.
+	Exec(ctx context.Context, opts ...grpc.CallOption) (ContainerService_ExecClient, error)
+	// Attach connects to the stdin, stdout and stderr of the main process of
+	// a running container, like Exec. Cancelling the call detaches, leaving
+	// the process running.
+	Attach(ctx context.Context, opts ...grpc.CallOption) (ContainerService_AttachClient, error)
+	// ApplySpec replaces the desired state of the node. A controller loop
+	// then creates, starts, stops, recreates and deletes containers,
+	// services and policies until the node matches it, and keeps it so.
+	// Resources named by an earlier spec but not this one are deleted;
+	// those created by other calls are left alone unless the spec names
+	// them. Applying the current spec again changes nothing.
+	ApplySpec(ctx context.Context, in *ApplySpecRequest, opts ...grpc.CallOption) (*ApplySpecResponse, error)
+	// GetSpec returns the applied spec and the outcome of the last
+	// reconciliation
+	GetSpec(ctx context.Context, in *GetSpecRequest, opts ...grpc.CallOption) (*GetSpecResponse, error)
+	// CreateNamespace adds a namespace containers, services and policies
+	// can be created in
+	CreateNamespace(ctx context.Context, in *CreateNamespaceRequest, opts ...grpc.CallOption) (*CreateNamespaceResponse, error)
+	// UpdateNamespace replaces the namespaces allowed into a namespace and
+	// its quota. A lower quota only stops new containers.
+	UpdateNamespace(ctx context.Context, in *UpdateNamespaceRequest, opts ...grpc.CallOption) (*UpdateNamespaceResponse, error)
+	// DeleteNamespace removes a namespace without containers, services or
+	// policies
+	DeleteNamespace(ctx context.Context, in *DeleteNamespaceRequest, opts ...grpc.CallOption) (*DeleteNamespaceResponse, error)
+	// ListNamespaces returns the namespaces ordered by name, with their usage
+	ListNamespaces(ctx context.Context, in *ListNamespacesRequest, opts ...grpc.CallOption) (*ListNamespacesResponse, error)
+	// ExportNetworkState captures the network of a container of this node
+	// for moving it to another: its addresses, MAC and reservation, the
+	// policies naming it, the services it backs and the connections the XDP
+	// router tracks. The container keeps its network; delete it once
+	// ImportNetworkState succeeded on the other node.
+	ExportNetworkState(ctx context.Context, in *ExportNetworkStateRequest, opts ...grpc.CallOption) (*ExportNetworkStateResponse, error)
+	// ImportNetworkState creates a container from the exported network state
+	// of another node's container, with the same addresses, which must be
+	// free in this node's networks. Policies and services of the same name
+	// must match the exported ones; missing ones are created. Fails with
+	// INVALID_ARGUMENT for states that don't fit this node.
+	ImportNetworkState(ctx context.Context, in *ImportNetworkStateRequest, opts ...grpc.CallOption) (*ImportNetworkStateResponse, error)
+	// RenewLease renews the lease of a container's addresses, for
+	// containers not running yet. Networks whose lease expires are deleted,
+	// when the control plane is configured with lease TTLs.
+	RenewLease(ctx context.Context, in *RenewLeaseRequest, opts ...grpc.CallOption) (*RenewLeaseResponse, error)
+	// ProgramService creates or replaces a service on this node as the
+	// leader distributes it, with the backends placed on other nodes as
+	// remote backends, or deletes it when service is unset. The leader
+	// calls it as services, placements and nodes change.
+	ProgramService(ctx context.Context, in *ProgramServiceRequest, opts ...grpc.CallOption) (*ProgramServiceResponse, error)
+	// GetServiceConnections returns the connections each service balanced
+	// on this node, by where the backend they went to runs relative to it
+	GetServiceConnections(ctx context.Context, in *GetServiceConnectionsRequest, opts ...grpc.CallOption) (*GetServiceConnectionsResponse, error)
+	// VerifyContainerNetwork checks that the network of a container of
+	// this node carries traffic, for runtimes to hold back its entrypoint
+	// until then: the datapath routes its addresses to its host veth, both
+	// ends of the veth are up with carrier, the gateways answer an ICMP echo
+	// sent from inside its namespace, and namespace isolation and the
+	// policies let it reach its required destinations. Checks that fail are
+	// retried until the timeout. The report is returned whether the network
+	// became ready or not.
+	VerifyContainerNetwork(ctx context.Context, in *VerifyContainerNetworkRequest, opts ...grpc.CallOption) (*VerifyContainerNetworkResponse, error)
+}
+
+type containerServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewContainerServiceClient(cc grpc.ClientConnInterface) ContainerServiceClient {
+	return &containerServiceClient{cc}
+}
+
+func (c *containerServiceClient) CreateContainer(ctx context.Context, in *CreateContainerRequest, opts ...grpc.CallOption) (*CreateContainerResponse, error) {
+	out := new(CreateContainerResponse)
+	err := c.cc.Invoke(ctx, ContainerService_CreateContainer_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) StartContainer(ctx context.Context, in *StartContainerRequest, opts ...grpc.CallOption) (*StartContainerResponse, error) {
+	out := new(StartContainerResponse)
+	err := c.cc.Invoke(ctx, ContainerService_StartContainer_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) StopContainer(ctx context.Context, in *StopContainerRequest, opts ...grpc.CallOption) (*StopContainerResponse, error) {
+	out := new(StopContainerResponse)
+	err := c.cc.Invoke(ctx, ContainerService_StopContainer_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) DeleteContainer(ctx context.Context, in *DeleteContainerRequest, opts ...grpc.CallOption) (*DeleteContainerResponse, error) {
+	out := new(DeleteContainerResponse)
+	err := c.cc.Invoke(ctx, ContainerService_DeleteContainer_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) ListContainers(ctx context.Context, in *ListContainersRequest, opts ...grpc.CallOption) (*ListContainersResponse, error) {
+	out := new(ListContainersResponse)
+	err := c.cc.Invoke(ctx, ContainerService_ListContainers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) GetContainer(ctx context.Context, in *GetContainerRequest, opts ...grpc.CallOption) (*GetContainerResponse, error) {
+	out := new(GetContainerResponse)
+	err := c.cc.Invoke(ctx, ContainerService_GetContainer_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (ContainerService_WatchEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ContainerService_ServiceDesc.Streams[0], ContainerService_WatchEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &containerServiceWatchEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ContainerService_WatchEventsClient interface {
+	Recv() (*ContainerEvent, error)
+	grpc.ClientStream
+}
+
+type containerServiceWatchEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *containerServiceWatchEventsClient) Recv() (*ContainerEvent, error) {
+	m := new(ContainerEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *containerServiceClient) ExposePort(ctx context.Context, in *ExposePortRequest, opts ...grpc.CallOption) (*ExposePortResponse, error) {
+	out := new(ExposePortResponse)
+	err := c.cc.Invoke(ctx, ContainerService_ExposePort_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) UnexposePort(ctx context.Context, in *UnexposePortRequest, opts ...grpc.CallOption) (*UnexposePortResponse, error) {
+	out := new(UnexposePortResponse)
+	err := c.cc.Invoke(ctx, ContainerService_UnexposePort_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) ListPortForwards(ctx context.Context, in *ListPortForwardsRequest, opts ...grpc.CallOption) (*ListPortForwardsResponse, error) {
+	out := new(ListPortForwardsResponse)
+	err := c.cc.Invoke(ctx, ContainerService_ListPortForwards_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) CreateService(ctx context.Context, in *CreateServiceRequest, opts ...grpc.CallOption) (*CreateServiceResponse, error) {
+	out := new(CreateServiceResponse)
+	err := c.cc.Invoke(ctx, ContainerService_CreateService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) UpdateServiceBackends(ctx context.Context, in *UpdateServiceBackendsRequest, opts ...grpc.CallOption) (*UpdateServiceBackendsResponse, error) {
+	out := new(UpdateServiceBackendsResponse)
+	err := c.cc.Invoke(ctx, ContainerService_UpdateServiceBackends_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) DeleteService(ctx context.Context, in *DeleteServiceRequest, opts ...grpc.CallOption) (*DeleteServiceResponse, error) {
+	out := new(DeleteServiceResponse)
+	err := c.cc.Invoke(ctx, ContainerService_DeleteService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error) {
+	out := new(ListServicesResponse)
+	err := c.cc.Invoke(ctx, ContainerService_ListServices_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) SetBandwidthLimit(ctx context.Context, in *SetBandwidthLimitRequest, opts ...grpc.CallOption) (*SetBandwidthLimitResponse, error) {
+	out := new(SetBandwidthLimitResponse)
+	err := c.cc.Invoke(ctx, ContainerService_SetBandwidthLimit_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) SetQoSClass(ctx context.Context, in *SetQoSClassRequest, opts ...grpc.CallOption) (*SetQoSClassResponse, error) {
+	out := new(SetQoSClassResponse)
+	err := c.cc.Invoke(ctx, ContainerService_SetQoSClass_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) CaptureTraffic(ctx context.Context, in *CaptureTrafficRequest, opts ...grpc.CallOption) (ContainerService_CaptureTrafficClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ContainerService_ServiceDesc.Streams[1], ContainerService_CaptureTraffic_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &containerServiceCaptureTrafficClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ContainerService_CaptureTrafficClient interface {
+	Recv() (*CaptureTrafficResponse, error)
+	grpc.ClientStream
+}
+
+type containerServiceCaptureTrafficClient struct {
+	grpc.ClientStream
+}
+
+func (x *containerServiceCaptureTrafficClient) Recv() (*CaptureTrafficResponse, error) {
+	m := new(CaptureTrafficResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *containerServiceClient) StreamLogs(ctx context.Context, in *StreamLogsRequest, opts ...grpc.CallOption) (ContainerService_StreamLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ContainerService_ServiceDesc.Streams[2], ContainerService_StreamLogs_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &containerServiceStreamLogsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ContainerService_StreamLogsClient interface {
+	Recv() (*StreamLogsResponse, error)
+	grpc.ClientStream
+}
+
+type containerServiceStreamLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *containerServiceStreamLogsClient) Recv() (*StreamLogsResponse, error) {
+	m := new(StreamLogsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *containerServiceClient) Exec(ctx context.Context, opts ...grpc.CallOption) (ContainerService_ExecClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ContainerService_ServiceDesc.Streams[3], ContainerService_Exec_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &containerServiceExecClient{stream}
+	return x, nil
+}
+
+type ContainerService_ExecClient interface {
+	Send(*ExecRequest) error
+	Recv() (*SessionOutput, error)
+	grpc.ClientStream
+}
+
+type containerServiceExecClient struct {
+	grpc.ClientStream
+}
+
+func (x *containerServiceExecClient) Send(m *ExecRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *containerServiceExecClient) Recv() (*SessionOutput, error) {
+	m := new(SessionOutput)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *containerServiceClient) Attach(ctx context.Context, opts ...grpc.CallOption) (ContainerService_AttachClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ContainerService_ServiceDesc.Streams[4], ContainerService_Attach_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &containerServiceAttachClient{stream}
+	return x, nil
+}
+
+type ContainerService_AttachClient interface {
+	Send(*AttachRequest) error
+	Recv() (*SessionOutput, error)
+	grpc.ClientStream
+}
+
+type containerServiceAttachClient struct {
+	grpc.ClientStream
+}
+
+func (x *containerServiceAttachClient) Send(m *AttachRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *containerServiceAttachClient) Recv() (*SessionOutput, error) {
+	m := new(SessionOutput)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *containerServiceClient) ApplySpec(ctx context.Context, in *ApplySpecRequest, opts ...grpc.CallOption) (*ApplySpecResponse, error) {
+	out := new(ApplySpecResponse)
+	err := c.cc.Invoke(ctx, ContainerService_ApplySpec_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) GetSpec(ctx context.Context, in *GetSpecRequest, opts ...grpc.CallOption) (*GetSpecResponse, error) {
+	out := new(GetSpecResponse)
+	err := c.cc.Invoke(ctx, ContainerService_GetSpec_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) CreateNamespace(ctx context.Context, in *CreateNamespaceRequest, opts ...grpc.CallOption) (*CreateNamespaceResponse, error) {
+	out := new(CreateNamespaceResponse)
+	err := c.cc.Invoke(ctx, ContainerService_CreateNamespace_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) UpdateNamespace(ctx context.Context, in *UpdateNamespaceRequest, opts ...grpc.CallOption) (*UpdateNamespaceResponse, error) {
+	out := new(UpdateNamespaceResponse)
+	err := c.cc.Invoke(ctx, ContainerService_UpdateNamespace_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) DeleteNamespace(ctx context.Context, in *DeleteNamespaceRequest, opts ...grpc.CallOption) (*DeleteNamespaceResponse, error) {
+	out := new(DeleteNamespaceResponse)
+	err := c.cc.Invoke(ctx, ContainerService_DeleteNamespace_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) ListNamespaces(ctx context.Context, in *ListNamespacesRequest, opts ...grpc.CallOption) (*ListNamespacesResponse, error) {
+	out := new(ListNamespacesResponse)
+	err := c.cc.Invoke(ctx, ContainerService_ListNamespaces_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) ExportNetworkState(ctx context.Context, in *ExportNetworkStateRequest, opts ...grpc.CallOption) (*ExportNetworkStateResponse, error) {
+	out := new(ExportNetworkStateResponse)
+	err := c.cc.Invoke(ctx, ContainerService_ExportNetworkState_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) ImportNetworkState(ctx context.Context, in *ImportNetworkStateRequest, opts ...grpc.CallOption) (*ImportNetworkStateResponse, error) {
+	out := new(ImportNetworkStateResponse)
+	err := c.cc.Invoke(ctx, ContainerService_ImportNetworkState_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) RenewLease(ctx context.Context, in *RenewLeaseRequest, opts ...grpc.CallOption) (*RenewLeaseResponse, error) {
+	out := new(RenewLeaseResponse)
+	err := c.cc.Invoke(ctx, ContainerService_RenewLease_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) ProgramService(ctx context.Context, in *ProgramServiceRequest, opts ...grpc.CallOption) (*ProgramServiceResponse, error) {
+	out := new(ProgramServiceResponse)
+	err := c.cc.Invoke(ctx, ContainerService_ProgramService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) GetServiceConnections(ctx context.Context, in *GetServiceConnectionsRequest, opts ...grpc.CallOption) (*GetServiceConnectionsResponse, error) {
+	out := new(GetServiceConnectionsResponse)
+	err := c.cc.Invoke(ctx, ContainerService_GetServiceConnections_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *containerServiceClient) VerifyContainerNetwork(ctx context.Context, in *VerifyContainerNetworkRequest, opts ...grpc.CallOption) (*VerifyContainerNetworkResponse, error) {
+	out := new(VerifyContainerNetworkResponse)
+	err := c.cc.Invoke(ctx, ContainerService_VerifyContainerNetwork_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ContainerServiceServer is the server API for ContainerService service.
+// All implementations must embed UnimplementedContainerServiceServer
+// for forward compatibility
+type ContainerServiceServer interface {
+	// CreateContainer sets up networking for a container. Creating an
+	// existing container returns it unchanged.
+	CreateContainer(context.Context, *CreateContainerRequest) (*CreateContainerResponse, error)
+	// StartContainer has the container runtime start a created container.
+	// Starting a running container returns it unchanged.
+	StartContainer(context.Context, *StartContainerRequest) (*StartContainerResponse, error)
+	// StopContainer has the container runtime stop a running container.
+	// Stopping a container that isn't running returns it unchanged.
+	StopContainer(context.Context, *StopContainerRequest) (*StopContainerResponse, error)
+	// DeleteContainer tears down a container's networking
+	DeleteContainer(context.Context, *DeleteContainerRequest) (*DeleteContainerResponse, error)
+	// ListContainers returns all known containers
+	ListContainers(context.Context, *ListContainersRequest) (*ListContainersResponse, error)
+	// GetContainer returns a single container
+	GetContainer(context.Context, *GetContainerRequest) (*GetContainerResponse, error)
+	// WatchEvents streams container lifecycle events as they happen
+	WatchEvents(*WatchEventsRequest, ContainerService_WatchEventsServer) error
+	// ExposePort forwards a host port to a container port
+	ExposePort(context.Context, *ExposePortRequest) (*ExposePortResponse, error)
+	// UnexposePort removes a port forward
+	UnexposePort(context.Context, *UnexposePortRequest) (*UnexposePortResponse, error)
+	// ListPortForwards returns the active port forwards
+	ListPortForwards(context.Context, *ListPortForwardsRequest) (*ListPortForwardsResponse, error)
+	// CreateService adds a virtual IP and port balanced across containers
+	CreateService(context.Context, *CreateServiceRequest) (*CreateServiceResponse, error)
+	// UpdateServiceBackends replaces the containers a service balances
+	// across. Established connections stay on their backend.
+	UpdateServiceBackends(context.Context, *UpdateServiceBackendsRequest) (*UpdateServiceBackendsResponse, error)
+	// DeleteService removes a service
+	DeleteService(context.Context, *DeleteServiceRequest) (*DeleteServiceResponse, error)
+	// ListServices returns the services ordered by name
+	ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error)
+	// SetBandwidthLimit caps a container's traffic, replacing its previous
+	// limits without recreating its network
+	SetBandwidthLimit(context.Context, *SetBandwidthLimitRequest) (*SetBandwidthLimitResponse, error)
+	// SetQoSClass changes the priority of the traffic a container sends off
+	// the node
+	SetQoSClass(context.Context, *SetQoSClassRequest) (*SetQoSClassResponse, error)
+	// CaptureTraffic streams a container's packets as a pcap file until a
+	// limit is hit or the client cancels
+	CaptureTraffic(*CaptureTrafficRequest, ContainerService_CaptureTrafficServer) error
+	// StreamLogs streams a container's output, and with follow keeps
+	// streaming it as it is written until the client cancels
+	StreamLogs(*StreamLogsRequest, ContainerService_StreamLogsServer) error
+	// Exec runs a command in a running container, streaming its stdin,
+	// stdout and stderr. The first request starts the command; the server
+	// sends the response header once it runs and the exit status last.
+	// Cancelling the call kills the command.
+	Exec(ContainerService_ExecServer) error
+	// Attach connects to the stdin, stdout and stderr of the main process of
+	// a running container, like Exec. Cancelling the call detaches, leaving
+	// the process running.
+	Attach(ContainerService_AttachServer) error
+	// ApplySpec replaces the desired state of the node. A controller loop
+	// then creates, starts, stops, recreates and deletes containers,
+	// services and policies until the node matches it, and keeps it so.
+	// Resources named by an earlier spec but not this one are deleted;
+	// those created by other calls are left alone unless the spec names
+	// them. Applying the current spec again changes nothing.
+	ApplySpec(context.Context, *ApplySpecRequest) (*ApplySpecResponse, error)
+	// GetSpec returns the applied spec and the outcome of the last
+	// reconciliation
+	GetSpec(context.Context, *GetSpecRequest) (*GetSpecResponse, error)
+	// CreateNamespace adds a namespace containers, services and policies
+	// can be created in
+	CreateNamespace(context.Context, *CreateNamespaceRequest) (*CreateNamespaceResponse, error)
+	// UpdateNamespace replaces the namespaces allowed into a namespace and
+	// its quota. A lower quota only stops new containers.
+	UpdateNamespace(context.Context, *UpdateNamespaceRequest) (*UpdateNamespaceResponse, error)
+	// DeleteNamespace removes a namespace without containers, services or
+	// policies
+	DeleteNamespace(context.Context, *DeleteNamespaceRequest) (*DeleteNamespaceResponse, error)
+	// ListNamespaces returns the namespaces ordered by name, with their usage
+	ListNamespaces(context.Context, *ListNamespacesRequest) (*ListNamespacesResponse, error)
+	// ExportNetworkState captures the network of a container of this node
+	// for moving it to another: its addresses, MAC and reservation, the
+	// policies naming it, the services it backs and the connections the XDP
+	// router tracks. The container keeps its network; delete it once
+	// ImportNetworkState succeeded on the other node.
+	ExportNetworkState(context.Context, *ExportNetworkStateRequest) (*ExportNetworkStateResponse, error)
+	// ImportNetworkState creates a container from the exported network state
+	// of another node's container, with the same addresses, which must be
+	// free in this node's networks. Policies and services of the same name
+	// must match the exported ones; missing ones are created. Fails with
+	// INVALID_ARGUMENT for states that don't fit this node.
+	ImportNetworkState(context.Context, *ImportNetworkStateRequest) (*ImportNetworkStateResponse, error)
+	// RenewLease renews the lease of a container's addresses, for
+	// containers not running yet. Networks whose lease expires are deleted,
+	// when the control plane is configured with lease TTLs.
+	RenewLease(context.Context, *RenewLeaseRequest) (*RenewLeaseResponse, error)
+	// ProgramService creates or replaces a service on this node as the
+	// leader distributes it, with the backends placed on other nodes as
+	// remote backends, or deletes it when service is unset. The leader
+	// calls it as services, placements and nodes change.
+	ProgramService(context.Context, *ProgramServiceRequest) (*ProgramServiceResponse, error)
+	// GetServiceConnections returns the connections each service balanced
+	// on this node, by where the backend they went to runs relative to it
+	GetServiceConnections(context.Context, *GetServiceConnectionsRequest) (*GetServiceConnectionsResponse, error)
+	// VerifyContainerNetwork checks that the network of a container of
+	// this node carries traffic, for runtimes to hold back its entrypoint
+	// until then: the datapath routes its addresses to its host veth, both
+	// ends of the veth are up with carrier, the gateways answer an ICMP echo
+	// sent from inside its namespace, and namespace isolation and the
+	// policies let it reach its required destinations. Checks that fail are
+	// retried until the timeout. The report is returned whether the network
+	// became ready or not.
+	VerifyContainerNetwork(context.Context, *VerifyContainerNetworkRequest) (*VerifyContainerNetworkResponse, error)
+	mustEmbedUnimplementedContainerServiceServer()
+}
+
+// UnimplementedContainerServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedContainerServiceServer struct {
+}
+
+func (UnimplementedContainerServiceServer) CreateContainer(context.Context, *CreateContainerRequest) (*CreateContainerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateContainer not implemented")
+}
+func (UnimplementedContainerServiceServer) StartContainer(context.Context, *StartContainerRequest) (*StartContainerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartContainer not implemented")
+}
+func (UnimplementedContainerServiceServer) StopContainer(context.Context, *StopContainerRequest) (*StopContainerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StopContainer not implemented")
+}
+func (UnimplementedContainerServiceServer) DeleteContainer(context.Context, *DeleteContainerRequest) (*DeleteContainerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteContainer not implemented")
+}
+func (UnimplementedContainerServiceServer) ListContainers(context.Context, *ListContainersRequest) (*ListContainersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListContainers not implemented")
+}
+func (UnimplementedContainerServiceServer) GetContainer(context.Context, *GetContainerRequest) (*GetContainerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetContainer not implemented")
+}
+func (UnimplementedContainerServiceServer) WatchEvents(*WatchEventsRequest, ContainerService_WatchEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedContainerServiceServer) ExposePort(context.Context, *ExposePortRequest) (*ExposePortResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExposePort not implemented")
+}
+func (UnimplementedContainerServiceServer) UnexposePort(context.Context, *UnexposePortRequest) (*UnexposePortResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnexposePort not implemented")
+}
+func (UnimplementedContainerServiceServer) ListPortForwards(context.Context, *ListPortForwardsRequest) (*ListPortForwardsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPortForwards not implemented")
+}
+func (UnimplementedContainerServiceServer) CreateService(context.Context, *CreateServiceRequest) (*CreateServiceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateService not implemented")
+}
+func (UnimplementedContainerServiceServer) UpdateServiceBackends(context.Context, *UpdateServiceBackendsRequest) (*UpdateServiceBackendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateServiceBackends not implemented")
+}
+func (UnimplementedContainerServiceServer) DeleteService(context.Context, *DeleteServiceRequest) (*DeleteServiceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteService not implemented")
+}
+func (UnimplementedContainerServiceServer) ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListServices not implemented")
+}
+func (UnimplementedContainerServiceServer) SetBandwidthLimit(context.Context, *SetBandwidthLimitRequest) (*SetBandwidthLimitResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetBandwidthLimit not implemented")
+}
+func (UnimplementedContainerServiceServer) SetQoSClass(context.Context, *SetQoSClassRequest) (*SetQoSClassResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetQoSClass not implemented")
+}
+func (UnimplementedContainerServiceServer) CaptureTraffic(*CaptureTrafficRequest, ContainerService_CaptureTrafficServer) error {
+	return status.Errorf(codes.Unimplemented, "method CaptureTraffic not implemented")
+}
+func (UnimplementedContainerServiceServer) StreamLogs(*StreamLogsRequest, ContainerService_StreamLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamLogs not implemented")
+}
+func (UnimplementedContainerServiceServer) Exec(ContainerService_ExecServer) error {
+	return status.Errorf(codes.Unimplemented, "method Exec not implemented")
+}
+func (UnimplementedContainerServiceServer) Attach(ContainerService_AttachServer) error {
+	return status.Errorf(codes.Unimplemented, "method Attach not implemented")
+}
+func (UnimplementedContainerServiceServer) ApplySpec(context.Context, *ApplySpecRequest) (*ApplySpecResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ApplySpec not implemented")
+}
+func (UnimplementedContainerServiceServer) GetSpec(context.Context, *GetSpecRequest) (*GetSpecResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSpec not implemented")
+}
+func (UnimplementedContainerServiceServer) CreateNamespace(context.Context, *CreateNamespaceRequest) (*CreateNamespaceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateNamespace not implemented")
+}
+func (UnimplementedContainerServiceServer) UpdateNamespace(context.Context, *UpdateNamespaceRequest) (*UpdateNamespaceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateNamespace not implemented")
+}
+func (UnimplementedContainerServiceServer) DeleteNamespace(context.Context, *DeleteNamespaceRequest) (*DeleteNamespaceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteNamespace not implemented")
+}
+func (UnimplementedContainerServiceServer) ListNamespaces(context.Context, *ListNamespacesRequest) (*ListNamespacesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListNamespaces not implemented")
+}
+func (UnimplementedContainerServiceServer) ExportNetworkState(context.Context, *ExportNetworkStateRequest) (*ExportNetworkStateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExportNetworkState not implemented")
+}
+func (UnimplementedContainerServiceServer) ImportNetworkState(context.Context, *ImportNetworkStateRequest) (*ImportNetworkStateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ImportNetworkState not implemented")
+}
+func (UnimplementedContainerServiceServer) RenewLease(context.Context, *RenewLeaseRequest) (*RenewLeaseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenewLease not implemented")
+}
+func (UnimplementedContainerServiceServer) ProgramService(context.Context, *ProgramServiceRequest) (*ProgramServiceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProgramService not implemented")
+}
+func (UnimplementedContainerServiceServer) GetServiceConnections(context.Context, *GetServiceConnectionsRequest) (*GetServiceConnectionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetServiceConnections not implemented")
+}
+func (UnimplementedContainerServiceServer) VerifyContainerNetwork(context.Context, *VerifyContainerNetworkRequest) (*VerifyContainerNetworkResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyContainerNetwork not implemented")
+}
+func (UnimplementedContainerServiceServer) mustEmbedUnimplementedContainerServiceServer() {}
+
+// UnsafeContainerServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ContainerServiceServer will
+// result in compilation errors.
+type UnsafeContainerServiceServer interface {
+	mustEmbedUnimplementedContainerServiceServer()
+}
+
+func RegisterContainerServiceServer(s grpc.ServiceRegistrar, srv ContainerServiceServer) {
+	s.RegisterService(&ContainerService_ServiceDesc, srv)
+}
+
+func _ContainerService_CreateContainer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateContainerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).CreateContainer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_CreateContainer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).CreateContainer(ctx, req.(*CreateContainerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_StartContainer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartContainerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).StartContainer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_StartContainer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).StartContainer(ctx, req.(*StartContainerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_StopContainer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StopContainerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).StopContainer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_StopContainer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).StopContainer(ctx, req.(*StopContainerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_DeleteContainer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteContainerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).DeleteContainer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_DeleteContainer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).DeleteContainer(ctx, req.(*DeleteContainerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_ListContainers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListContainersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).ListContainers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_ListContainers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).ListContainers(ctx, req.(*ListContainersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_GetContainer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetContainerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).GetContainer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_GetContainer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).GetContainer(ctx, req.(*GetContainerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ContainerServiceServer).WatchEvents(m, &containerServiceWatchEventsServer{stream})
+}
+
+type ContainerService_WatchEventsServer interface {
+	Send(*ContainerEvent) error
+	grpc.ServerStream
+}
+
+type containerServiceWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *containerServiceWatchEventsServer) Send(m *ContainerEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ContainerService_ExposePort_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExposePortRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).ExposePort(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_ExposePort_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).ExposePort(ctx, req.(*ExposePortRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_UnexposePort_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnexposePortRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).UnexposePort(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_UnexposePort_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).UnexposePort(ctx, req.(*UnexposePortRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_ListPortForwards_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPortForwardsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).ListPortForwards(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_ListPortForwards_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).ListPortForwards(ctx, req.(*ListPortForwardsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_CreateService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).CreateService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_CreateService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).CreateService(ctx, req.(*CreateServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_UpdateServiceBackends_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateServiceBackendsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).UpdateServiceBackends(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_UpdateServiceBackends_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).UpdateServiceBackends(ctx, req.(*UpdateServiceBackendsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_DeleteService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).DeleteService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_DeleteService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).DeleteService(ctx, req.(*DeleteServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_ListServices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListServicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).ListServices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_ListServices_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).ListServices(ctx, req.(*ListServicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_SetBandwidthLimit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetBandwidthLimitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).SetBandwidthLimit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_SetBandwidthLimit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).SetBandwidthLimit(ctx, req.(*SetBandwidthLimitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_SetQoSClass_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetQoSClassRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).SetQoSClass(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_SetQoSClass_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).SetQoSClass(ctx, req.(*SetQoSClassRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_CaptureTraffic_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(CaptureTrafficRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ContainerServiceServer).CaptureTraffic(m, &containerServiceCaptureTrafficServer{stream})
+}
+
+type ContainerService_CaptureTrafficServer interface {
+	Send(*CaptureTrafficResponse) error
+	grpc.ServerStream
+}
+
+type containerServiceCaptureTrafficServer struct {
+	grpc.ServerStream
+}
+
+func (x *containerServiceCaptureTrafficServer) Send(m *CaptureTrafficResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ContainerService_StreamLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamLogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ContainerServiceServer).StreamLogs(m, &containerServiceStreamLogsServer{stream})
+}
+
+type ContainerService_StreamLogsServer interface {
+	Send(*StreamLogsResponse) error
+	grpc.ServerStream
+}
+
+type containerServiceStreamLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *containerServiceStreamLogsServer) Send(m *StreamLogsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ContainerService_Exec_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ContainerServiceServer).Exec(&containerServiceExecServer{stream})
+}
+
+type ContainerService_ExecServer interface {
+	Send(*SessionOutput) error
+	Recv() (*ExecRequest, error)
+	grpc.ServerStream
+}
+
+type containerServiceExecServer struct {
+	grpc.ServerStream
+}
+
+func (x *containerServiceExecServer) Send(m *SessionOutput) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *containerServiceExecServer) Recv() (*ExecRequest, error) {
+	m := new(ExecRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ContainerService_Attach_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ContainerServiceServer).Attach(&containerServiceAttachServer{stream})
+}
+
+type ContainerService_AttachServer interface {
+	Send(*SessionOutput) error
+	Recv() (*AttachRequest, error)
+	grpc.ServerStream
+}
+
+type containerServiceAttachServer struct {
+	grpc.ServerStream
+}
+
+func (x *containerServiceAttachServer) Send(m *SessionOutput) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *containerServiceAttachServer) Recv() (*AttachRequest, error) {
+	m := new(AttachRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ContainerService_ApplySpec_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ApplySpecRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).ApplySpec(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_ApplySpec_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).ApplySpec(ctx, req.(*ApplySpecRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_GetSpec_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSpecRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).GetSpec(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_GetSpec_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).GetSpec(ctx, req.(*GetSpecRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_CreateNamespace_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateNamespaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).CreateNamespace(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_CreateNamespace_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).CreateNamespace(ctx, req.(*CreateNamespaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_UpdateNamespace_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateNamespaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).UpdateNamespace(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_UpdateNamespace_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).UpdateNamespace(ctx, req.(*UpdateNamespaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_DeleteNamespace_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteNamespaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).DeleteNamespace(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_DeleteNamespace_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).DeleteNamespace(ctx, req.(*DeleteNamespaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_ListNamespaces_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListNamespacesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).ListNamespaces(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_ListNamespaces_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).ListNamespaces(ctx, req.(*ListNamespacesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_ExportNetworkState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportNetworkStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).ExportNetworkState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_ExportNetworkState_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).ExportNetworkState(ctx, req.(*ExportNetworkStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_ImportNetworkState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportNetworkStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).ImportNetworkState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_ImportNetworkState_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).ImportNetworkState(ctx, req.(*ImportNetworkStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_RenewLease_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenewLeaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).RenewLease(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_RenewLease_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).RenewLease(ctx, req.(*RenewLeaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_ProgramService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProgramServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).ProgramService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_ProgramService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).ProgramService(ctx, req.(*ProgramServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_GetServiceConnections_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServiceConnectionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).GetServiceConnections(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_GetServiceConnections_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).GetServiceConnections(ctx, req.(*GetServiceConnectionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContainerService_VerifyContainerNetwork_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyContainerNetworkRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContainerServiceServer).VerifyContainerNetwork(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContainerService_VerifyContainerNetwork_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContainerServiceServer).VerifyContainerNetwork(ctx, req.(*VerifyContainerNetworkRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ContainerService_ServiceDesc is the grpc.ServiceDesc for ContainerService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ContainerService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "enviro.api.v1.ContainerService",
+	HandlerType: (*ContainerServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateContainer",
+			Handler:    _ContainerService_CreateContainer_Handler,
+		},
+		{
+			MethodName: "StartContainer",
+			Handler:    _ContainerService_StartContainer_Handler,
+		},
+		{
+			MethodName: "StopContainer",
+			Handler:    _ContainerService_StopContainer_Handler,
+		},
+		{
+			MethodName: "DeleteContainer",
+			Handler:    _ContainerService_DeleteContainer_Handler,
+		},
+		{
+			MethodName: "ListContainers",
+			Handler:    _ContainerService_ListContainers_Handler,
+		},
+		{
+			MethodName: "GetContainer",
+			Handler:    _ContainerService_GetContainer_Handler,
+		},
+		{
+			MethodName: "ExposePort",
+			Handler:    _ContainerService_ExposePort_Handler,
+		},
+		{
+			MethodName: "UnexposePort",
+			Handler:    _ContainerService_UnexposePort_Handler,
+		},
+		{
+			MethodName: "ListPortForwards",
+			Handler:    _ContainerService_ListPortForwards_Handler,
+		},
+		{
+			MethodName: "CreateService",
+			Handler:    _ContainerService_CreateService_Handler,
+		},
+		{
+			MethodName: "UpdateServiceBackends",
+			Handler:    _ContainerService_UpdateServiceBackends_Handler,
+		},
+		{
+			MethodName: "DeleteService",
+			Handler:    _ContainerService_DeleteService_Handler,
+		},
+		{
+			MethodName: "ListServices",
+			Handler:    _ContainerService_ListServices_Handler,
+		},
+		{
+			MethodName: "SetBandwidthLimit",
+			Handler:    _ContainerService_SetBandwidthLimit_Handler,
+		},
+		{
+			MethodName: "SetQoSClass",
+			Handler:    _ContainerService_SetQoSClass_Handler,
+		},
+		{
+			MethodName: "ApplySpec",
+			Handler:    _ContainerService_ApplySpec_Handler,
+		},
+		{
+			MethodName: "GetSpec",
+			Handler:    _ContainerService_GetSpec_Handler,
+		},
+		{
+			MethodName: "CreateNamespace",
+			Handler:    _ContainerService_CreateNamespace_Handler,
+		},
+		{
+			MethodName: "UpdateNamespace",
+			Handler:    _ContainerService_UpdateNamespace_Handler,
+		},
+		{
+			MethodName: "DeleteNamespace",
+			Handler:    _ContainerService_DeleteNamespace_Handler,
+		},
+		{
+			MethodName: "ListNamespaces",
+			Handler:    _ContainerService_ListNamespaces_Handler,
+		},
+		{
+			MethodName: "ExportNetworkState",
+			Handler:    _ContainerService_ExportNetworkState_Handler,
+		},
+		{
+			MethodName: "ImportNetworkState",
+			Handler:    _ContainerService_ImportNetworkState_Handler,
+		},
+		{
+			MethodName: "RenewLease",
+			Handler:    _ContainerService_RenewLease_Handler,
+		},
+		{
+			MethodName: "ProgramService",
+			Handler:    _ContainerService_ProgramService_Handler,
+		},
+		{
+			MethodName: "GetServiceConnections",
+			Handler:    _ContainerService_GetServiceConnections_Handler,
+		},
+		{
+			MethodName: "VerifyContainerNetwork",
+			Handler:    _ContainerService_VerifyContainerNetwork_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _ContainerService_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "CaptureTraffic",
+			Handler:       _ContainerService_CaptureTraffic_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamLogs",
+			Handler:       _ContainerService_StreamLogs_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Exec",
+			Handler:       _ContainerService_Exec_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Attach",
+			Handler:       _ContainerService_Attach_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "container.proto",
+}
@@ -0,0 +1,18 @@
+// Package v1 contains the protobuf definitions and generated gRPC bindings
+// of version 1 of the Enviro control plane API, in the proto package
+// enviro.api.v1.
+//
+// Version 1 only evolves compatibly: fields and methods are added, never
+// renumbered, retyped or removed, and new features are announced by
+// InfoService.GetAPIInfo. Control planes also serve the methods of the
+// unversioned enviro.api package that preceded it, whose messages are the
+// same on the wire, so older clients keep working.
+//
+// The REST/JSON gateway in *.pb.gw.go is generated from the HTTP bindings
+// in gateway.yaml. Regenerate after editing either (requires buf,
+// protoc-gen-go, protoc-gen-go-grpc and protoc-gen-grpc-gateway on PATH):
+//
+//	go generate ./pkg/api/v1
+package v1
+
+//go:generate buf generate
@@ -0,0 +1,1853 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: node.proto
+
+package v1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	NodeService_GetNetworkConfig_FullMethodName      = "/enviro.api.v1.NodeService/GetNetworkConfig"
+	NodeService_GetStats_FullMethodName              = "/enviro.api.v1.NodeService/GetStats"
+	NodeService_GetLatencyStats_FullMethodName       = "/enviro.api.v1.NodeService/GetLatencyStats"
+	NodeService_ReloadXDP_FullMethodName             = "/enviro.api.v1.NodeService/ReloadXDP"
+	NodeService_UpgradeDataPath_FullMethodName       = "/enviro.api.v1.NodeService/UpgradeDataPath"
+	NodeService_DatapathInspect_FullMethodName       = "/enviro.api.v1.NodeService/DatapathInspect"
+	NodeService_SetLogLevel_FullMethodName           = "/enviro.api.v1.NodeService/SetLogLevel"
+	NodeService_DumpConnections_FullMethodName       = "/enviro.api.v1.NodeService/DumpConnections"
+	NodeService_ListFlows_FullMethodName             = "/enviro.api.v1.NodeService/ListFlows"
+	NodeService_StreamDropEvents_FullMethodName      = "/enviro.api.v1.NodeService/StreamDropEvents"
+	NodeService_GetDropStats_FullMethodName          = "/enviro.api.v1.NodeService/GetDropStats"
+	NodeService_CollectGarbage_FullMethodName        = "/enviro.api.v1.NodeService/CollectGarbage"
+	NodeService_SetMTU_FullMethodName                = "/enviro.api.v1.NodeService/SetMTU"
+	NodeService_AttachAFXDP_FullMethodName           = "/enviro.api.v1.NodeService/AttachAFXDP"
+	NodeService_DetachAFXDP_FullMethodName           = "/enviro.api.v1.NodeService/DetachAFXDP"
+	NodeService_ListAFXDPSockets_FullMethodName      = "/enviro.api.v1.NodeService/ListAFXDPSockets"
+	NodeService_ApplyPolicy_FullMethodName           = "/enviro.api.v1.NodeService/ApplyPolicy"
+	NodeService_RemovePolicy_FullMethodName          = "/enviro.api.v1.NodeService/RemovePolicy"
+	NodeService_ListPolicies_FullMethodName          = "/enviro.api.v1.NodeService/ListPolicies"
+	NodeService_ListReservations_FullMethodName      = "/enviro.api.v1.NodeService/ListReservations"
+	NodeService_ReleaseReservation_FullMethodName    = "/enviro.api.v1.NodeService/ReleaseReservation"
+	NodeService_ListSNATSlices_FullMethodName        = "/enviro.api.v1.NodeService/ListSNATSlices"
+	NodeService_AddPeer_FullMethodName               = "/enviro.api.v1.NodeService/AddPeer"
+	NodeService_RemovePeer_FullMethodName            = "/enviro.api.v1.NodeService/RemovePeer"
+	NodeService_ListPeers_FullMethodName             = "/enviro.api.v1.NodeService/ListPeers"
+	NodeService_RotateOverlayKey_FullMethodName      = "/enviro.api.v1.NodeService/RotateOverlayKey"
+	NodeService_RegisterNode_FullMethodName          = "/enviro.api.v1.NodeService/RegisterNode"
+	NodeService_NodeHeartbeat_FullMethodName         = "/enviro.api.v1.NodeService/NodeHeartbeat"
+	NodeService_ListNodes_FullMethodName             = "/enviro.api.v1.NodeService/ListNodes"
+	NodeService_QueryAuditLog_FullMethodName         = "/enviro.api.v1.NodeService/QueryAuditLog"
+	NodeService_TopFlows_FullMethodName              = "/enviro.api.v1.NodeService/TopFlows"
+	NodeService_GetCapabilities_FullMethodName       = "/enviro.api.v1.NodeService/GetCapabilities"
+	NodeService_Backup_FullMethodName                = "/enviro.api.v1.NodeService/Backup"
+	NodeService_UpdateRuntimeSettings_FullMethodName = "/enviro.api.v1.NodeService/UpdateRuntimeSettings"
+	NodeService_ResetRuntimeSettings_FullMethodName  = "/enviro.api.v1.NodeService/ResetRuntimeSettings"
+	NodeService_DumpEffectiveConfig_FullMethodName   = "/enviro.api.v1.NodeService/DumpEffectiveConfig"
+	NodeService_AllocateIdentity_FullMethodName      = "/enviro.api.v1.NodeService/AllocateIdentity"
+	NodeService_ReleaseIdentity_FullMethodName       = "/enviro.api.v1.NodeService/ReleaseIdentity"
+	NodeService_ListIdentities_FullMethodName        = "/enviro.api.v1.NodeService/ListIdentities"
+	NodeService_WatchIdentities_FullMethodName       = "/enviro.api.v1.NodeService/WatchIdentities"
+)
+
+// NodeServiceClient is the client API for NodeService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type NodeServiceClient interface {
+	// GetNetworkConfig returns the effective network configuration
+	GetNetworkConfig(ctx context.Context, in *GetNetworkConfigRequest, opts ...grpc.CallOption) (*GetNetworkConfigResponse, error)
+	// GetStats returns the node's network statistics and those of each
+	// container
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error)
+	// GetLatencyStats returns how long the XDP router takes per packet, for
+	// the node and each container. Fails with FAILED_PRECONDITION while XDP
+	// is not attached.
+	GetLatencyStats(ctx context.Context, in *GetLatencyStatsRequest, opts ...grpc.CallOption) (*GetLatencyStatsResponse, error)
+	// ReloadXDP detaches the XDP router and attaches it again, e.g. after
+	// the interface flapped. Container routes and policies are kept.
+	ReloadXDP(ctx context.Context, in *ReloadXDPRequest, opts ...grpc.CallOption) (*ReloadXDPResponse, error)
+	// UpgradeDataPath replaces the XDP router with the program in an eBPF
+	// object on the node, keeping its maps and without detaching it. Fails
+	// with INVALID_ARGUMENT when the object's maps are incompatible; the
+	// old program then stays attached.
+	UpgradeDataPath(ctx context.Context, in *UpgradeDataPathRequest, opts ...grpc.CallOption) (*UpgradeDataPathResponse, error)
+	// DatapathInspect returns the programs and maps of the XDP router, and
+	// a page of the entries of one map, decoded where the map is known.
+	// Fails with FAILED_PRECONDITION while XDP is not attached, and with
+	// NOT_FOUND for maps the router doesn't have.
+	DatapathInspect(ctx context.Context, in *DatapathInspectRequest, opts ...grpc.CallOption) (*DatapathInspectResponse, error)
+	// SetLogLevel changes the log level of the running control plane
+	SetLogLevel(ctx context.Context, in *SetLogLevelRequest, opts ...grpc.CallOption) (*SetLogLevelResponse, error)
+	// DumpConnections returns the flows of containers tracked by the XDP
+	// router, one direction each. Fails with FAILED_PRECONDITION while XDP
+	// is not attached.
+	DumpConnections(ctx context.Context, in *DumpConnectionsRequest, opts ...grpc.CallOption) (*DumpConnectionsResponse, error)
+	// ListFlows returns the active flows of a container, with what it sent
+	// and received on each. Fails with FAILED_PRECONDITION while XDP is not
+	// attached, and with NOT_FOUND for unknown containers.
+	ListFlows(ctx context.Context, in *ListFlowsRequest, opts ...grpc.CallOption) (*ListFlowsResponse, error)
+	// StreamDropEvents streams the packets the XDP router drops from now on,
+	// with why and, for policy drops, the policy that matched. Events the
+	// client is too slow for are discarded and counted in the next one
+	// sent. Fails with FAILED_PRECONDITION while XDP is not attached.
+	StreamDropEvents(ctx context.Context, in *StreamDropEventsRequest, opts ...grpc.CallOption) (NodeService_StreamDropEventsClient, error)
+	// GetDropStats returns the drops counted by reason and policy since the
+	// control plane started. Fails like StreamDropEvents.
+	GetDropStats(ctx context.Context, in *GetDropStatsRequest, opts ...grpc.CallOption) (*GetDropStatsResponse, error)
+	// CollectGarbage removes the veths, XDP routes and counters and address
+	// leases that no container of the node owns, e.g. those of a create
+	// interrupted by a crash. Nodes also collect them periodically.
+	CollectGarbage(ctx context.Context, in *CollectGarbageRequest, opts ...grpc.CallOption) (*CollectGarbageResponse, error)
+	// SetMTU changes the node's container MTU, applying it to existing
+	// containers without an MTU of their own. Not persisted across restarts.
+	SetMTU(ctx context.Context, in *SetMTURequest, opts ...grpc.CallOption) (*SetMTUResponse, error)
+	// AttachAFXDP creates an AF_XDP socket owned by a container, bound to a
+	// receive queue of the XDP interface, and steers the selected flows
+	// arriving on that queue to it, past conntrack and the MTU check. The
+	// owner picks the socket and its UMEM up from a Unix socket on the
+	// node. Fails with FAILED_PRECONDITION unless the router is attached in
+	// an XDP mode, and with ALREADY_EXISTS when the container or queue has
+	// a socket. Sockets are not persisted.
+	AttachAFXDP(ctx context.Context, in *AttachAFXDPRequest, opts ...grpc.CallOption) (*AttachAFXDPResponse, error)
+	// DetachAFXDP stops steering to a container's AF_XDP socket and closes
+	// it. Sockets are also detached with their owner's network or any
+	// container their flows go to.
+	DetachAFXDP(ctx context.Context, in *DetachAFXDPRequest, opts ...grpc.CallOption) (*DetachAFXDPResponse, error)
+	// ListAFXDPSockets returns the AF_XDP sockets ordered by owner
+	ListAFXDPSockets(ctx context.Context, in *ListAFXDPSocketsRequest, opts ...grpc.CallOption) (*ListAFXDPSocketsResponse, error)
+	// ApplyPolicy adds a network policy, replacing one of the same name.
+	// Policies are enforced by the XDP router, or by nftables without it.
+	ApplyPolicy(ctx context.Context, in *ApplyPolicyRequest, opts ...grpc.CallOption) (*ApplyPolicyResponse, error)
+	// RemovePolicy deletes a network policy by name
+	RemovePolicy(ctx context.Context, in *RemovePolicyRequest, opts ...grpc.CallOption) (*RemovePolicyResponse, error)
+	// ListPolicies returns the network policies ordered by name
+	ListPolicies(ctx context.Context, in *ListPoliciesRequest, opts ...grpc.CallOption) (*ListPoliciesResponse, error)
+	// ListReservations returns the addresses reserved for containers that
+	// requested them, ordered by container ID
+	ListReservations(ctx context.Context, in *ListReservationsRequest, opts ...grpc.CallOption) (*ListReservationsResponse, error)
+	// ReleaseReservation lets other containers have the reserved addresses
+	// of a container. A container holding them keeps them until deleted.
+	ReleaseReservation(ctx context.Context, in *ReleaseReservationRequest, opts ...grpc.CallOption) (*ReleaseReservationResponse, error)
+	// ListSNATSlices returns the containers' slices of the SNAT port range
+	// ordered by port, or with port set only the slice holding it, for
+	// tracing a flow seen outside the node back to its container. It is
+	// empty unless the node slices the range.
+	ListSNATSlices(ctx context.Context, in *ListSNATSlicesRequest, opts ...grpc.CallOption) (*ListSNATSlicesResponse, error)
+	// AddPeer routes a peer node's container subnets through the overlay,
+	// replacing a peer of the same name. Control planes propagate nodes by
+	// adding each node's overlay, from GetNetworkConfig, as a peer of the
+	// others. Fails with FAILED_PRECONDITION without an overlay.
+	AddPeer(ctx context.Context, in *AddPeerRequest, opts ...grpc.CallOption) (*AddPeerResponse, error)
+	// RemovePeer stops routing a peer node's subnets
+	RemovePeer(ctx context.Context, in *RemovePeerRequest, opts ...grpc.CallOption) (*RemovePeerResponse, error)
+	// ListPeers returns the overlay peers ordered by name. Peers are not
+	// persisted, so they must be added again after a restart.
+	ListPeers(ctx context.Context, in *ListPeersRequest, opts ...grpc.CallOption) (*ListPeersResponse, error)
+	// RotateOverlayKey replaces the node's WireGuard key and returns the new
+	// public key. Peers can't reach the node until they are given it with
+	// AddPeer. Fails with FAILED_PRECONDITION without encryption.
+	RotateOverlayKey(ctx context.Context, in *RotateOverlayKeyRequest, opts ...grpc.CallOption) (*RotateOverlayKeyResponse, error)
+	// RegisterNode adds a worker node to the leader's registry as ready, or
+	// updates it when it registers again. The node then calls NodeHeartbeat
+	// every heartbeat_interval of the response.
+	RegisterNode(ctx context.Context, in *RegisterNodeRequest, opts ...grpc.CallOption) (*RegisterNodeResponse, error)
+	// NodeHeartbeat keeps a registered node ready and updates its capacity.
+	// Nodes missing heartbeats are marked NOT_READY. Fails with NOT_FOUND
+	// for nodes that aren't registered, e.g. after the leader restarted,
+	// which should then register again.
+	NodeHeartbeat(ctx context.Context, in *NodeHeartbeatRequest, opts ...grpc.CallOption) (*NodeHeartbeatResponse, error)
+	// ListNodes returns the registered nodes ordered by name
+	ListNodes(ctx context.Context, in *ListNodesRequest, opts ...grpc.CallOption) (*ListNodesResponse, error)
+	// QueryAuditLog returns the records of the audit log, oldest first, and
+	// verifies its hash chain when asked to. Fails with FAILED_PRECONDITION
+	// when the control plane has no audit log configured.
+	QueryAuditLog(ctx context.Context, in *QueryAuditLogRequest, opts ...grpc.CallOption) (*QueryAuditLogResponse, error)
+	// TopFlows returns the flows to containers with the most traffic over
+	// the sliding window of the node's flow analytics, for the node and per
+	// container. Fails with FAILED_PRECONDITION unless flow analytics are
+	// enabled and XDP is attached.
+	TopFlows(ctx context.Context, in *TopFlowsRequest, opts ...grpc.CallOption) (*TopFlowsResponse, error)
+	// GetCapabilities returns the eBPF features the node's kernel was found
+	// to support at startup, the variant of the XDP router chosen for them,
+	// and how the router is attached
+	GetCapabilities(ctx context.Context, in *GetCapabilitiesRequest, opts ...grpc.CallOption) (*GetCapabilitiesResponse, error)
+	// Backup snapshots the state the control plane keeps in its state dir:
+	// the container registry, the applied spec, and the container networks
+	// with their addresses, reservations, policies, services and
+	// namespaces. The snapshot is a gzipped tarball of the state files and a
+	// manifest of their checksums and versions, returned or uploaded to an
+	// object store. A control plane is rebuilt from it with restore_from.
+	// Fails with FAILED_PRECONDITION when no state dir is configured, and
+	// UNAVAILABLE when the upload fails.
+	Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*BackupResponse, error)
+	// UpdateRuntimeSettings overrides settings of the config while serving,
+	// e.g. to raise the log level during an incident. The settings of the
+	// request are validated and applied together, or none is. Overrides
+	// are kept in the state dir, so they survive restarts, else until the
+	// control plane stops, and win over the config until reset. Fails with
+	// INVALID_ARGUMENT for invalid values, and FAILED_PRECONDITION for the
+	// log level of a logger supplied by an embedding application.
+	UpdateRuntimeSettings(ctx context.Context, in *UpdateRuntimeSettingsRequest, opts ...grpc.CallOption) (*UpdateRuntimeSettingsResponse, error)
+	// ResetRuntimeSettings drops overrides, going back to the settings of
+	// the config
+	ResetRuntimeSettings(ctx context.Context, in *ResetRuntimeSettingsRequest, opts ...grpc.CallOption) (*ResetRuntimeSettingsResponse, error)
+	// DumpEffectiveConfig returns the settings in effect, those of the
+	// config with the runtime overrides, and where each came from
+	DumpEffectiveConfig(ctx context.Context, in *DumpEffectiveConfigRequest, opts ...grpc.CallOption) (*DumpEffectiveConfigResponse, error)
+	// AllocateIdentity returns the numeric identity of a label set, the
+	// same on every node and across restarts and failovers: that of a known
+	// set, else a new one assigned atomically. The holder, e.g. the
+	// container with the labels, references the identity until it releases
+	// it; allocating again for the same holder changes nothing. Identities
+	// without holders are collected identities.gc_period after their last
+	// release. Numbers are never reused, so a number cached after its
+	// identity was collected never names another label set. Only the
+	// leader allocates, and with Raft replicates the identity before
+	// returning it.
+	AllocateIdentity(ctx context.Context, in *AllocateIdentityRequest, opts ...grpc.CallOption) (*AllocateIdentityResponse, error)
+	// ReleaseIdentity drops the reference of a holder to an identity. Fails
+	// with NOT_FOUND for unknown identities.
+	ReleaseIdentity(ctx context.Context, in *ReleaseIdentityRequest, opts ...grpc.CallOption) (*ReleaseIdentityResponse, error)
+	// ListIdentities returns the identities ordered by number, with the
+	// revision of the table they are at
+	ListIdentities(ctx context.Context, in *ListIdentitiesRequest, opts ...grpc.CallOption) (*ListIdentitiesResponse, error)
+	// WatchIdentities streams the changes to the identities after a
+	// revision, which keeps the caches of agents current. It starts with a
+	// RESET event followed by the whole table for revision 0, and when the
+	// changes after the revision are no longer retained, e.g. after a
+	// failover.
+	WatchIdentities(ctx context.Context, in *WatchIdentitiesRequest, opts ...grpc.CallOption) (NodeService_WatchIdentitiesClient, error)
+}
+
+type nodeServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewNodeServiceClient(cc grpc.ClientConnInterface) NodeServiceClient {
+	return &nodeServiceClient{cc}
+}
+
+func (c *nodeServiceClient) GetNetworkConfig(ctx context.Context, in *GetNetworkConfigRequest, opts ...grpc.CallOption) (*GetNetworkConfigResponse, error) {
+	out := new(GetNetworkConfigResponse)
+	err := c.cc.Invoke(ctx, NodeService_GetNetworkConfig_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error) {
+	out := new(GetStatsResponse)
+	err := c.cc.Invoke(ctx, NodeService_GetStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) GetLatencyStats(ctx context.Context, in *GetLatencyStatsRequest, opts ...grpc.CallOption) (*GetLatencyStatsResponse, error) {
+	out := new(GetLatencyStatsResponse)
+	err := c.cc.Invoke(ctx, NodeService_GetLatencyStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ReloadXDP(ctx context.Context, in *ReloadXDPRequest, opts ...grpc.CallOption) (*ReloadXDPResponse, error) {
+	out := new(ReloadXDPResponse)
+	err := c.cc.Invoke(ctx, NodeService_ReloadXDP_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) UpgradeDataPath(ctx context.Context, in *UpgradeDataPathRequest, opts ...grpc.CallOption) (*UpgradeDataPathResponse, error) {
+	out := new(UpgradeDataPathResponse)
+	err := c.cc.Invoke(ctx, NodeService_UpgradeDataPath_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) DatapathInspect(ctx context.Context, in *DatapathInspectRequest, opts ...grpc.CallOption) (*DatapathInspectResponse, error) {
+	out := new(DatapathInspectResponse)
+	err := c.cc.Invoke(ctx, NodeService_DatapathInspect_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) SetLogLevel(ctx context.Context, in *SetLogLevelRequest, opts ...grpc.CallOption) (*SetLogLevelResponse, error) {
+	out := new(SetLogLevelResponse)
+	err := c.cc.Invoke(ctx, NodeService_SetLogLevel_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) DumpConnections(ctx context.Context, in *DumpConnectionsRequest, opts ...grpc.CallOption) (*DumpConnectionsResponse, error) {
+	out := new(DumpConnectionsResponse)
+	err := c.cc.Invoke(ctx, NodeService_DumpConnections_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ListFlows(ctx context.Context, in *ListFlowsRequest, opts ...grpc.CallOption) (*ListFlowsResponse, error) {
+	out := new(ListFlowsResponse)
+	err := c.cc.Invoke(ctx, NodeService_ListFlows_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) StreamDropEvents(ctx context.Context, in *StreamDropEventsRequest, opts ...grpc.CallOption) (NodeService_StreamDropEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &NodeService_ServiceDesc.Streams[0], NodeService_StreamDropEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &nodeServiceStreamDropEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type NodeService_StreamDropEventsClient interface {
+	Recv() (*DropEvent, error)
+	grpc.ClientStream
+}
+
+type nodeServiceStreamDropEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *nodeServiceStreamDropEventsClient) Recv() (*DropEvent, error) {
+	m := new(DropEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *nodeServiceClient) GetDropStats(ctx context.Context, in *GetDropStatsRequest, opts ...grpc.CallOption) (*GetDropStatsResponse, error) {
+	out := new(GetDropStatsResponse)
+	err := c.cc.Invoke(ctx, NodeService_GetDropStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) CollectGarbage(ctx context.Context, in *CollectGarbageRequest, opts ...grpc.CallOption) (*CollectGarbageResponse, error) {
+	out := new(CollectGarbageResponse)
+	err := c.cc.Invoke(ctx, NodeService_CollectGarbage_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) SetMTU(ctx context.Context, in *SetMTURequest, opts ...grpc.CallOption) (*SetMTUResponse, error) {
+	out := new(SetMTUResponse)
+	err := c.cc.Invoke(ctx, NodeService_SetMTU_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) AttachAFXDP(ctx context.Context, in *AttachAFXDPRequest, opts ...grpc.CallOption) (*AttachAFXDPResponse, error) {
+	out := new(AttachAFXDPResponse)
+	err := c.cc.Invoke(ctx, NodeService_AttachAFXDP_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) DetachAFXDP(ctx context.Context, in *DetachAFXDPRequest, opts ...grpc.CallOption) (*DetachAFXDPResponse, error) {
+	out := new(DetachAFXDPResponse)
+	err := c.cc.Invoke(ctx, NodeService_DetachAFXDP_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ListAFXDPSockets(ctx context.Context, in *ListAFXDPSocketsRequest, opts ...grpc.CallOption) (*ListAFXDPSocketsResponse, error) {
+	out := new(ListAFXDPSocketsResponse)
+	err := c.cc.Invoke(ctx, NodeService_ListAFXDPSockets_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ApplyPolicy(ctx context.Context, in *ApplyPolicyRequest, opts ...grpc.CallOption) (*ApplyPolicyResponse, error) {
+	out := new(ApplyPolicyResponse)
+	err := c.cc.Invoke(ctx, NodeService_ApplyPolicy_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) RemovePolicy(ctx context.Context, in *RemovePolicyRequest, opts ...grpc.CallOption) (*RemovePolicyResponse, error) {
+	out := new(RemovePolicyResponse)
+	err := c.cc.Invoke(ctx, NodeService_RemovePolicy_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ListPolicies(ctx context.Context, in *ListPoliciesRequest, opts ...grpc.CallOption) (*ListPoliciesResponse, error) {
+	out := new(ListPoliciesResponse)
+	err := c.cc.Invoke(ctx, NodeService_ListPolicies_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ListReservations(ctx context.Context, in *ListReservationsRequest, opts ...grpc.CallOption) (*ListReservationsResponse, error) {
+	out := new(ListReservationsResponse)
+	err := c.cc.Invoke(ctx, NodeService_ListReservations_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ReleaseReservation(ctx context.Context, in *ReleaseReservationRequest, opts ...grpc.CallOption) (*ReleaseReservationResponse, error) {
+	out := new(ReleaseReservationResponse)
+	err := c.cc.Invoke(ctx, NodeService_ReleaseReservation_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ListSNATSlices(ctx context.Context, in *ListSNATSlicesRequest, opts ...grpc.CallOption) (*ListSNATSlicesResponse, error) {
+	out := new(ListSNATSlicesResponse)
+	err := c.cc.Invoke(ctx, NodeService_ListSNATSlices_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) AddPeer(ctx context.Context, in *AddPeerRequest, opts ...grpc.CallOption) (*AddPeerResponse, error) {
+	out := new(AddPeerResponse)
+	err := c.cc.Invoke(ctx, NodeService_AddPeer_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) RemovePeer(ctx context.Context, in *RemovePeerRequest, opts ...grpc.CallOption) (*RemovePeerResponse, error) {
+	out := new(RemovePeerResponse)
+	err := c.cc.Invoke(ctx, NodeService_RemovePeer_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ListPeers(ctx context.Context, in *ListPeersRequest, opts ...grpc.CallOption) (*ListPeersResponse, error) {
+	out := new(ListPeersResponse)
+	err := c.cc.Invoke(ctx, NodeService_ListPeers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) RotateOverlayKey(ctx context.Context, in *RotateOverlayKeyRequest, opts ...grpc.CallOption) (*RotateOverlayKeyResponse, error) {
+	out := new(RotateOverlayKeyResponse)
+	err := c.cc.Invoke(ctx, NodeService_RotateOverlayKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) RegisterNode(ctx context.Context, in *RegisterNodeRequest, opts ...grpc.CallOption) (*RegisterNodeResponse, error) {
+	out := new(RegisterNodeResponse)
+	err := c.cc.Invoke(ctx, NodeService_RegisterNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) NodeHeartbeat(ctx context.Context, in *NodeHeartbeatRequest, opts ...grpc.CallOption) (*NodeHeartbeatResponse, error) {
+	out := new(NodeHeartbeatResponse)
+	err := c.cc.Invoke(ctx, NodeService_NodeHeartbeat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ListNodes(ctx context.Context, in *ListNodesRequest, opts ...grpc.CallOption) (*ListNodesResponse, error) {
+	out := new(ListNodesResponse)
+	err := c.cc.Invoke(ctx, NodeService_ListNodes_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) QueryAuditLog(ctx context.Context, in *QueryAuditLogRequest, opts ...grpc.CallOption) (*QueryAuditLogResponse, error) {
+	out := new(QueryAuditLogResponse)
+	err := c.cc.Invoke(ctx, NodeService_QueryAuditLog_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) TopFlows(ctx context.Context, in *TopFlowsRequest, opts ...grpc.CallOption) (*TopFlowsResponse, error) {
+	out := new(TopFlowsResponse)
+	err := c.cc.Invoke(ctx, NodeService_TopFlows_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) GetCapabilities(ctx context.Context, in *GetCapabilitiesRequest, opts ...grpc.CallOption) (*GetCapabilitiesResponse, error) {
+	out := new(GetCapabilitiesResponse)
+	err := c.cc.Invoke(ctx, NodeService_GetCapabilities_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*BackupResponse, error) {
+	out := new(BackupResponse)
+	err := c.cc.Invoke(ctx, NodeService_Backup_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) UpdateRuntimeSettings(ctx context.Context, in *UpdateRuntimeSettingsRequest, opts ...grpc.CallOption) (*UpdateRuntimeSettingsResponse, error) {
+	out := new(UpdateRuntimeSettingsResponse)
+	err := c.cc.Invoke(ctx, NodeService_UpdateRuntimeSettings_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ResetRuntimeSettings(ctx context.Context, in *ResetRuntimeSettingsRequest, opts ...grpc.CallOption) (*ResetRuntimeSettingsResponse, error) {
+	out := new(ResetRuntimeSettingsResponse)
+	err := c.cc.Invoke(ctx, NodeService_ResetRuntimeSettings_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) DumpEffectiveConfig(ctx context.Context, in *DumpEffectiveConfigRequest, opts ...grpc.CallOption) (*DumpEffectiveConfigResponse, error) {
+	out := new(DumpEffectiveConfigResponse)
+	err := c.cc.Invoke(ctx, NodeService_DumpEffectiveConfig_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) AllocateIdentity(ctx context.Context, in *AllocateIdentityRequest, opts ...grpc.CallOption) (*AllocateIdentityResponse, error) {
+	out := new(AllocateIdentityResponse)
+	err := c.cc.Invoke(ctx, NodeService_AllocateIdentity_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ReleaseIdentity(ctx context.Context, in *ReleaseIdentityRequest, opts ...grpc.CallOption) (*ReleaseIdentityResponse, error) {
+	out := new(ReleaseIdentityResponse)
+	err := c.cc.Invoke(ctx, NodeService_ReleaseIdentity_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) ListIdentities(ctx context.Context, in *ListIdentitiesRequest, opts ...grpc.CallOption) (*ListIdentitiesResponse, error) {
+	out := new(ListIdentitiesResponse)
+	err := c.cc.Invoke(ctx, NodeService_ListIdentities_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) WatchIdentities(ctx context.Context, in *WatchIdentitiesRequest, opts ...grpc.CallOption) (NodeService_WatchIdentitiesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &NodeService_ServiceDesc.Streams[1], NodeService_WatchIdentities_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &nodeServiceWatchIdentitiesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type NodeService_WatchIdentitiesClient interface {
+	Recv() (*IdentityEvent, error)
+	grpc.ClientStream
+}
+
+type nodeServiceWatchIdentitiesClient struct {
+	grpc.ClientStream
+}
+
+func (x *nodeServiceWatchIdentitiesClient) Recv() (*IdentityEvent, error) {
+	m := new(IdentityEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NodeServiceServer is the server API for NodeService service.
+// All implementations must embed UnimplementedNodeServiceServer
+// for forward compatibility
+type NodeServiceServer interface {
+	// GetNetworkConfig returns the effective network configuration
+	GetNetworkConfig(context.Context, *GetNetworkConfigRequest) (*GetNetworkConfigResponse, error)
+	// GetStats returns the node's network statistics and those of each
+	// container
+	GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error)
+	// GetLatencyStats returns how long the XDP router takes per packet, for
+	// the node and each container. Fails with FAILED_PRECONDITION while XDP
+	// is not attached.
+	GetLatencyStats(context.Context, *GetLatencyStatsRequest) (*GetLatencyStatsResponse, error)
+	// ReloadXDP detaches the XDP router and attaches it again, e.g. after
+	// the interface flapped. Container routes and policies are kept.
+	ReloadXDP(context.Context, *ReloadXDPRequest) (*ReloadXDPResponse, error)
+	// UpgradeDataPath replaces the XDP router with the program in an eBPF
+	// object on the node, keeping its maps and without detaching it. Fails
+	// with INVALID_ARGUMENT when the object's maps are incompatible; the
+	// old program then stays attached.
+	UpgradeDataPath(context.Context, *UpgradeDataPathRequest) (*UpgradeDataPathResponse, error)
+	// DatapathInspect returns the programs and maps of the XDP router, and
+	// a page of the entries of one map, decoded where the map is known.
+	// Fails with FAILED_PRECONDITION while XDP is not attached, and with
+	// NOT_FOUND for maps the router doesn't have.
+	DatapathInspect(context.Context, *DatapathInspectRequest) (*DatapathInspectResponse, error)
+	// SetLogLevel changes the log level of the running control plane
+	SetLogLevel(context.Context, *SetLogLevelRequest) (*SetLogLevelResponse, error)
+	// DumpConnections returns the flows of containers tracked by the XDP
+	// router, one direction each. Fails with FAILED_PRECONDITION while XDP
+	// is not attached.
+	DumpConnections(context.Context, *DumpConnectionsRequest) (*DumpConnectionsResponse, error)
+	// ListFlows returns the active flows of a container, with what it sent
+	// and received on each. Fails with FAILED_PRECONDITION while XDP is not
+	// attached, and with NOT_FOUND for unknown containers.
+	ListFlows(context.Context, *ListFlowsRequest) (*ListFlowsResponse, error)
+	// StreamDropEvents streams the packets the XDP router drops from now on,
+	// with why and, for policy drops, the policy that matched. Events the
+	// client is too slow for are discarded and counted in the next one
+	// sent. Fails with FAILED_PRECONDITION while XDP is not attached.
+	StreamDropEvents(*StreamDropEventsRequest, NodeService_StreamDropEventsServer) error
+	// GetDropStats returns the drops counted by reason and policy since the
+	// control plane started. Fails like StreamDropEvents.
+	GetDropStats(context.Context, *GetDropStatsRequest) (*GetDropStatsResponse, error)
+	// CollectGarbage removes the veths, XDP routes and counters and address
+	// leases that no container of the node owns, e.g. those of a create
+	// interrupted by a crash. Nodes also collect them periodically.
+	CollectGarbage(context.Context, *CollectGarbageRequest) (*CollectGarbageResponse, error)
+	// SetMTU changes the node's container MTU, applying it to existing
+	// containers without an MTU of their own. Not persisted across restarts.
+	SetMTU(context.Context, *SetMTURequest) (*SetMTUResponse, error)
+	// AttachAFXDP creates an AF_XDP socket owned by a container, bound to a
+	// receive queue of the XDP interface, and steers the selected flows
+	// arriving on that queue to it, past conntrack and the MTU check. The
+	// owner picks the socket and its UMEM up from a Unix socket on the
+	// node. Fails with FAILED_PRECONDITION unless the router is attached in
+	// an XDP mode, and with ALREADY_EXISTS when the container or queue has
+	// a socket. Sockets are not persisted.
+	AttachAFXDP(context.Context, *AttachAFXDPRequest) (*AttachAFXDPResponse, error)
+	// DetachAFXDP stops steering to a container's AF_XDP socket and closes
+	// it. Sockets are also detached with their owner's network or any
+	// container their flows go to.
+	DetachAFXDP(context.Context, *DetachAFXDPRequest) (*DetachAFXDPResponse, error)
+	// ListAFXDPSockets returns the AF_XDP sockets ordered by owner
+	ListAFXDPSockets(context.Context, *ListAFXDPSocketsRequest) (*ListAFXDPSocketsResponse, error)
+	// ApplyPolicy adds a network policy, replacing one of the same name.
+	// Policies are enforced by the XDP router, or by nftables without it.
+	ApplyPolicy(context.Context, *ApplyPolicyRequest) (*ApplyPolicyResponse, error)
+	// RemovePolicy deletes a network policy by name
+	RemovePolicy(context.Context, *RemovePolicyRequest) (*RemovePolicyResponse, error)
+	// ListPolicies returns the network policies ordered by name
+	ListPolicies(context.Context, *ListPoliciesRequest) (*ListPoliciesResponse, error)
+	// ListReservations returns the addresses reserved for containers that
+	// requested them, ordered by container ID
+	ListReservations(context.Context, *ListReservationsRequest) (*ListReservationsResponse, error)
+	// ReleaseReservation lets other containers have the reserved addresses
+	// of a container. A container holding them keeps them until deleted.
+	ReleaseReservation(context.Context, *ReleaseReservationRequest) (*ReleaseReservationResponse, error)
+	// ListSNATSlices returns the containers' slices of the SNAT port range
+	// ordered by port, or with port set only the slice holding it, for
+	// tracing a flow seen outside the node back to its container. It is
+	// empty unless the node slices the range.
+	ListSNATSlices(context.Context, *ListSNATSlicesRequest) (*ListSNATSlicesResponse, error)
+	// AddPeer routes a peer node's container subnets through the overlay,
+	// replacing a peer of the same name. Control planes propagate nodes by
+	// adding each node's overlay, from GetNetworkConfig, as a peer of the
+	// others. Fails with FAILED_PRECONDITION without an overlay.
+	AddPeer(context.Context, *AddPeerRequest) (*AddPeerResponse, error)
+	// RemovePeer stops routing a peer node's subnets
+	RemovePeer(context.Context, *RemovePeerRequest) (*RemovePeerResponse, error)
+	// ListPeers returns the overlay peers ordered by name. Peers are not
+	// persisted, so they must be added again after a restart.
+	ListPeers(context.Context, *ListPeersRequest) (*ListPeersResponse, error)
+	// RotateOverlayKey replaces the node's WireGuard key and returns the new
+	// public key. Peers can't reach the node until they are given it with
+	// AddPeer. Fails with FAILED_PRECONDITION without encryption.
+	RotateOverlayKey(context.Context, *RotateOverlayKeyRequest) (*RotateOverlayKeyResponse, error)
+	// RegisterNode adds a worker node to the leader's registry as ready, or
+	// updates it when it registers again. The node then calls NodeHeartbeat
+	// every heartbeat_interval of the response.
+	RegisterNode(context.Context, *RegisterNodeRequest) (*RegisterNodeResponse, error)
+	// NodeHeartbeat keeps a registered node ready and updates its capacity.
+	// Nodes missing heartbeats are marked NOT_READY. Fails with NOT_FOUND
+	// for nodes that aren't registered, e.g. after the leader restarted,
+	// which should then register again.
+	NodeHeartbeat(context.Context, *NodeHeartbeatRequest) (*NodeHeartbeatResponse, error)
+	// ListNodes returns the registered nodes ordered by name
+	ListNodes(context.Context, *ListNodesRequest) (*ListNodesResponse, error)
+	// QueryAuditLog returns the records of the audit log, oldest first, and
+	// verifies its hash chain when asked to. Fails with FAILED_PRECONDITION
+	// when the control plane has no audit log configured.
+	QueryAuditLog(context.Context, *QueryAuditLogRequest) (*QueryAuditLogResponse, error)
+	// TopFlows returns the flows to containers with the most traffic over
+	// the sliding window of the node's flow analytics, for the node and per
+	// container. Fails with FAILED_PRECONDITION unless flow analytics are
+	// enabled and XDP is attached.
+	TopFlows(context.Context, *TopFlowsRequest) (*TopFlowsResponse, error)
+	// GetCapabilities returns the eBPF features the node's kernel was found
+	// to support at startup, the variant of the XDP router chosen for them,
+	// and how the router is attached
+	GetCapabilities(context.Context, *GetCapabilitiesRequest) (*GetCapabilitiesResponse, error)
+	// Backup snapshots the state the control plane keeps in its state dir:
+	// the container registry, the applied spec, and the container networks
+	// with their addresses, reservations, policies, services and
+	// namespaces. The snapshot is a gzipped tarball of the state files and a
+	// manifest of their checksums and versions, returned or uploaded to an
+	// object store. A control plane is rebuilt from it with restore_from.
+	// Fails with FAILED_PRECONDITION when no state dir is configured, and
+	// UNAVAILABLE when the upload fails.
+	Backup(context.Context, *BackupRequest) (*BackupResponse, error)
+	// UpdateRuntimeSettings overrides settings of the config while serving,
+	// e.g. to raise the log level during an incident. The settings of the
+	// request are validated and applied together, or none is. Overrides
+	// are kept in the state dir, so they survive restarts, else until the
+	// control plane stops, and win over the config until reset. Fails with
+	// INVALID_ARGUMENT for invalid values, and FAILED_PRECONDITION for the
+	// log level of a logger supplied by an embedding application.
+	UpdateRuntimeSettings(context.Context, *UpdateRuntimeSettingsRequest) (*UpdateRuntimeSettingsResponse, error)
+	// ResetRuntimeSettings drops overrides, going back to the settings of
+	// the config
+	ResetRuntimeSettings(context.Context, *ResetRuntimeSettingsRequest) (*ResetRuntimeSettingsResponse, error)
+	// DumpEffectiveConfig returns the settings in effect, those of the
+	// config with the runtime overrides, and where each came from
+	DumpEffectiveConfig(context.Context, *DumpEffectiveConfigRequest) (*DumpEffectiveConfigResponse, error)
+	// AllocateIdentity returns the numeric identity of a label set, the
+	// same on every node and across restarts and failovers: that of a known
+	// set, else a new one assigned atomically. The holder, e.g. the
+	// container with the labels, references the identity until it releases
+	// it; allocating again for the same holder changes nothing. Identities
+	// without holders are collected identities.gc_period after their last
+	// release. Numbers are never reused, so a number cached after its
+	// identity was collected never names another label set. Only the
+	// leader allocates, and with Raft replicates the identity before
+	// returning it.
+	AllocateIdentity(context.Context, *AllocateIdentityRequest) (*AllocateIdentityResponse, error)
+	// ReleaseIdentity drops the reference of a holder to an identity. Fails
+	// with NOT_FOUND for unknown identities.
+	ReleaseIdentity(context.Context, *ReleaseIdentityRequest) (*ReleaseIdentityResponse, error)
+	// ListIdentities returns the identities ordered by number, with the
+	// revision of the table they are at
+	ListIdentities(context.Context, *ListIdentitiesRequest) (*ListIdentitiesResponse, error)
+	// WatchIdentities streams the changes to the identities after a
+	// revision, which keeps the caches of agents current. It starts with a
+	// RESET event followed by the whole table for revision 0, and when the
+	// changes after the revision are no longer retained, e.g. after a
+	// failover.
+	WatchIdentities(*WatchIdentitiesRequest, NodeService_WatchIdentitiesServer) error
+	mustEmbedUnimplementedNodeServiceServer()
+}
+
+// UnimplementedNodeServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedNodeServiceServer struct {
+}
+
+func (UnimplementedNodeServiceServer) GetNetworkConfig(context.Context, *GetNetworkConfigRequest) (*GetNetworkConfigResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetNetworkConfig not implemented")
+}
+func (UnimplementedNodeServiceServer) GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedNodeServiceServer) GetLatencyStats(context.Context, *GetLatencyStatsRequest) (*GetLatencyStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLatencyStats not implemented")
+}
+func (UnimplementedNodeServiceServer) ReloadXDP(context.Context, *ReloadXDPRequest) (*ReloadXDPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReloadXDP not implemented")
+}
+func (UnimplementedNodeServiceServer) UpgradeDataPath(context.Context, *UpgradeDataPathRequest) (*UpgradeDataPathResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpgradeDataPath not implemented")
+}
+func (UnimplementedNodeServiceServer) DatapathInspect(context.Context, *DatapathInspectRequest) (*DatapathInspectResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DatapathInspect not implemented")
+}
+func (UnimplementedNodeServiceServer) SetLogLevel(context.Context, *SetLogLevelRequest) (*SetLogLevelResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetLogLevel not implemented")
+}
+func (UnimplementedNodeServiceServer) DumpConnections(context.Context, *DumpConnectionsRequest) (*DumpConnectionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DumpConnections not implemented")
+}
+func (UnimplementedNodeServiceServer) ListFlows(context.Context, *ListFlowsRequest) (*ListFlowsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFlows not implemented")
+}
+func (UnimplementedNodeServiceServer) StreamDropEvents(*StreamDropEventsRequest, NodeService_StreamDropEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamDropEvents not implemented")
+}
+func (UnimplementedNodeServiceServer) GetDropStats(context.Context, *GetDropStatsRequest) (*GetDropStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDropStats not implemented")
+}
+func (UnimplementedNodeServiceServer) CollectGarbage(context.Context, *CollectGarbageRequest) (*CollectGarbageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CollectGarbage not implemented")
+}
+func (UnimplementedNodeServiceServer) SetMTU(context.Context, *SetMTURequest) (*SetMTUResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetMTU not implemented")
+}
+func (UnimplementedNodeServiceServer) AttachAFXDP(context.Context, *AttachAFXDPRequest) (*AttachAFXDPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AttachAFXDP not implemented")
+}
+func (UnimplementedNodeServiceServer) DetachAFXDP(context.Context, *DetachAFXDPRequest) (*DetachAFXDPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DetachAFXDP not implemented")
+}
+func (UnimplementedNodeServiceServer) ListAFXDPSockets(context.Context, *ListAFXDPSocketsRequest) (*ListAFXDPSocketsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAFXDPSockets not implemented")
+}
+func (UnimplementedNodeServiceServer) ApplyPolicy(context.Context, *ApplyPolicyRequest) (*ApplyPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ApplyPolicy not implemented")
+}
+func (UnimplementedNodeServiceServer) RemovePolicy(context.Context, *RemovePolicyRequest) (*RemovePolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemovePolicy not implemented")
+}
+func (UnimplementedNodeServiceServer) ListPolicies(context.Context, *ListPoliciesRequest) (*ListPoliciesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPolicies not implemented")
+}
+func (UnimplementedNodeServiceServer) ListReservations(context.Context, *ListReservationsRequest) (*ListReservationsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListReservations not implemented")
+}
+func (UnimplementedNodeServiceServer) ReleaseReservation(context.Context, *ReleaseReservationRequest) (*ReleaseReservationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseReservation not implemented")
+}
+func (UnimplementedNodeServiceServer) ListSNATSlices(context.Context, *ListSNATSlicesRequest) (*ListSNATSlicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSNATSlices not implemented")
+}
+func (UnimplementedNodeServiceServer) AddPeer(context.Context, *AddPeerRequest) (*AddPeerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddPeer not implemented")
+}
+func (UnimplementedNodeServiceServer) RemovePeer(context.Context, *RemovePeerRequest) (*RemovePeerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemovePeer not implemented")
+}
+func (UnimplementedNodeServiceServer) ListPeers(context.Context, *ListPeersRequest) (*ListPeersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPeers not implemented")
+}
+func (UnimplementedNodeServiceServer) RotateOverlayKey(context.Context, *RotateOverlayKeyRequest) (*RotateOverlayKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateOverlayKey not implemented")
+}
+func (UnimplementedNodeServiceServer) RegisterNode(context.Context, *RegisterNodeRequest) (*RegisterNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterNode not implemented")
+}
+func (UnimplementedNodeServiceServer) NodeHeartbeat(context.Context, *NodeHeartbeatRequest) (*NodeHeartbeatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method NodeHeartbeat not implemented")
+}
+func (UnimplementedNodeServiceServer) ListNodes(context.Context, *ListNodesRequest) (*ListNodesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListNodes not implemented")
+}
+func (UnimplementedNodeServiceServer) QueryAuditLog(context.Context, *QueryAuditLogRequest) (*QueryAuditLogResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryAuditLog not implemented")
+}
+func (UnimplementedNodeServiceServer) TopFlows(context.Context, *TopFlowsRequest) (*TopFlowsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TopFlows not implemented")
+}
+func (UnimplementedNodeServiceServer) GetCapabilities(context.Context, *GetCapabilitiesRequest) (*GetCapabilitiesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCapabilities not implemented")
+}
+func (UnimplementedNodeServiceServer) Backup(context.Context, *BackupRequest) (*BackupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Backup not implemented")
+}
+func (UnimplementedNodeServiceServer) UpdateRuntimeSettings(context.Context, *UpdateRuntimeSettingsRequest) (*UpdateRuntimeSettingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateRuntimeSettings not implemented")
+}
+func (UnimplementedNodeServiceServer) ResetRuntimeSettings(context.Context, *ResetRuntimeSettingsRequest) (*ResetRuntimeSettingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResetRuntimeSettings not implemented")
+}
+func (UnimplementedNodeServiceServer) DumpEffectiveConfig(context.Context, *DumpEffectiveConfigRequest) (*DumpEffectiveConfigResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DumpEffectiveConfig not implemented")
+}
+func (UnimplementedNodeServiceServer) AllocateIdentity(context.Context, *AllocateIdentityRequest) (*AllocateIdentityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AllocateIdentity not implemented")
+}
+func (UnimplementedNodeServiceServer) ReleaseIdentity(context.Context, *ReleaseIdentityRequest) (*ReleaseIdentityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseIdentity not implemented")
+}
+func (UnimplementedNodeServiceServer) ListIdentities(context.Context, *ListIdentitiesRequest) (*ListIdentitiesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListIdentities not implemented")
+}
+func (UnimplementedNodeServiceServer) WatchIdentities(*WatchIdentitiesRequest, NodeService_WatchIdentitiesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchIdentities not implemented")
+}
+func (UnimplementedNodeServiceServer) mustEmbedUnimplementedNodeServiceServer() {}
+
+// UnsafeNodeServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to NodeServiceServer will
+// result in compilation errors.
+type UnsafeNodeServiceServer interface {
+	mustEmbedUnimplementedNodeServiceServer()
+}
+
+func RegisterNodeServiceServer(s grpc.ServiceRegistrar, srv NodeServiceServer) {
+	s.RegisterService(&NodeService_ServiceDesc, srv)
+}
+
+func _NodeService_GetNetworkConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetNetworkConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).GetNetworkConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_GetNetworkConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).GetNetworkConfig(ctx, req.(*GetNetworkConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_GetLatencyStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetLatencyStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).GetLatencyStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_GetLatencyStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).GetLatencyStats(ctx, req.(*GetLatencyStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ReloadXDP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadXDPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ReloadXDP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ReloadXDP_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ReloadXDP(ctx, req.(*ReloadXDPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_UpgradeDataPath_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpgradeDataPathRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).UpgradeDataPath(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_UpgradeDataPath_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).UpgradeDataPath(ctx, req.(*UpgradeDataPathRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_DatapathInspect_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DatapathInspectRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).DatapathInspect(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_DatapathInspect_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).DatapathInspect(ctx, req.(*DatapathInspectRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_SetLogLevel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetLogLevelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).SetLogLevel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_SetLogLevel_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).SetLogLevel(ctx, req.(*SetLogLevelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_DumpConnections_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DumpConnectionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).DumpConnections(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_DumpConnections_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).DumpConnections(ctx, req.(*DumpConnectionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ListFlows_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFlowsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ListFlows(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ListFlows_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ListFlows(ctx, req.(*ListFlowsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_StreamDropEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamDropEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NodeServiceServer).StreamDropEvents(m, &nodeServiceStreamDropEventsServer{stream})
+}
+
+type NodeService_StreamDropEventsServer interface {
+	Send(*DropEvent) error
+	grpc.ServerStream
+}
+
+type nodeServiceStreamDropEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *nodeServiceStreamDropEventsServer) Send(m *DropEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _NodeService_GetDropStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDropStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).GetDropStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_GetDropStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).GetDropStats(ctx, req.(*GetDropStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_CollectGarbage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CollectGarbageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).CollectGarbage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_CollectGarbage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).CollectGarbage(ctx, req.(*CollectGarbageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_SetMTU_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetMTURequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).SetMTU(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_SetMTU_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).SetMTU(ctx, req.(*SetMTURequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_AttachAFXDP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AttachAFXDPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).AttachAFXDP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_AttachAFXDP_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).AttachAFXDP(ctx, req.(*AttachAFXDPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_DetachAFXDP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DetachAFXDPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).DetachAFXDP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_DetachAFXDP_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).DetachAFXDP(ctx, req.(*DetachAFXDPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ListAFXDPSockets_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAFXDPSocketsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ListAFXDPSockets(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ListAFXDPSockets_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ListAFXDPSockets(ctx, req.(*ListAFXDPSocketsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ApplyPolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ApplyPolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ApplyPolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ApplyPolicy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ApplyPolicy(ctx, req.(*ApplyPolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_RemovePolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemovePolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).RemovePolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_RemovePolicy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).RemovePolicy(ctx, req.(*RemovePolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ListPolicies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPoliciesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ListPolicies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ListPolicies_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ListPolicies(ctx, req.(*ListPoliciesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ListReservations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListReservationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ListReservations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ListReservations_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ListReservations(ctx, req.(*ListReservationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ReleaseReservation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseReservationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ReleaseReservation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ReleaseReservation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ReleaseReservation(ctx, req.(*ReleaseReservationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ListSNATSlices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSNATSlicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ListSNATSlices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ListSNATSlices_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ListSNATSlices(ctx, req.(*ListSNATSlicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_AddPeer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddPeerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).AddPeer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_AddPeer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).AddPeer(ctx, req.(*AddPeerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_RemovePeer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemovePeerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).RemovePeer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_RemovePeer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).RemovePeer(ctx, req.(*RemovePeerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ListPeers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPeersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ListPeers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ListPeers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ListPeers(ctx, req.(*ListPeersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_RotateOverlayKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RotateOverlayKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).RotateOverlayKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_RotateOverlayKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).RotateOverlayKey(ctx, req.(*RotateOverlayKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_RegisterNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).RegisterNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_RegisterNode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).RegisterNode(ctx, req.(*RegisterNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_NodeHeartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NodeHeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).NodeHeartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_NodeHeartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).NodeHeartbeat(ctx, req.(*NodeHeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ListNodes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListNodesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ListNodes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ListNodes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ListNodes(ctx, req.(*ListNodesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_QueryAuditLog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryAuditLogRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).QueryAuditLog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_QueryAuditLog_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).QueryAuditLog(ctx, req.(*QueryAuditLogRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_TopFlows_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TopFlowsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).TopFlows(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_TopFlows_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).TopFlows(ctx, req.(*TopFlowsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_GetCapabilities_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCapabilitiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).GetCapabilities(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_GetCapabilities_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).GetCapabilities(ctx, req.(*GetCapabilitiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_Backup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).Backup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_Backup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).Backup(ctx, req.(*BackupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_UpdateRuntimeSettings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateRuntimeSettingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).UpdateRuntimeSettings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_UpdateRuntimeSettings_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).UpdateRuntimeSettings(ctx, req.(*UpdateRuntimeSettingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ResetRuntimeSettings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResetRuntimeSettingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ResetRuntimeSettings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ResetRuntimeSettings_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ResetRuntimeSettings(ctx, req.(*ResetRuntimeSettingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_DumpEffectiveConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DumpEffectiveConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).DumpEffectiveConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_DumpEffectiveConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).DumpEffectiveConfig(ctx, req.(*DumpEffectiveConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_AllocateIdentity_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AllocateIdentityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).AllocateIdentity(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_AllocateIdentity_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).AllocateIdentity(ctx, req.(*AllocateIdentityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ReleaseIdentity_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseIdentityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ReleaseIdentity(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ReleaseIdentity_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ReleaseIdentity(ctx, req.(*ReleaseIdentityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_ListIdentities_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListIdentitiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).ListIdentities(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_ListIdentities_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).ListIdentities(ctx, req.(*ListIdentitiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_WatchIdentities_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchIdentitiesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NodeServiceServer).WatchIdentities(m, &nodeServiceWatchIdentitiesServer{stream})
+}
+
+type NodeService_WatchIdentitiesServer interface {
+	Send(*IdentityEvent) error
+	grpc.ServerStream
+}
+
+type nodeServiceWatchIdentitiesServer struct {
+	grpc.ServerStream
+}
+
+func (x *nodeServiceWatchIdentitiesServer) Send(m *IdentityEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// NodeService_ServiceDesc is the grpc.ServiceDesc for NodeService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var NodeService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "enviro.api.v1.NodeService",
+	HandlerType: (*NodeServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetNetworkConfig",
+			Handler:    _NodeService_GetNetworkConfig_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _NodeService_GetStats_Handler,
+		},
+		{
+			MethodName: "GetLatencyStats",
+			Handler:    _NodeService_GetLatencyStats_Handler,
+		},
+		{
+			MethodName: "ReloadXDP",
+			Handler:    _NodeService_ReloadXDP_Handler,
+		},
+		{
+			MethodName: "UpgradeDataPath",
+			Handler:    _NodeService_UpgradeDataPath_Handler,
+		},
+		{
+			MethodName: "DatapathInspect",
+			Handler:    _NodeService_DatapathInspect_Handler,
+		},
+		{
+			MethodName: "SetLogLevel",
+			Handler:    _NodeService_SetLogLevel_Handler,
+		},
+		{
+			MethodName: "DumpConnections",
+			Handler:    _NodeService_DumpConnections_Handler,
+		},
+		{
+			MethodName: "ListFlows",
+			Handler:    _NodeService_ListFlows_Handler,
+		},
+		{
+			MethodName: "GetDropStats",
+			Handler:    _NodeService_GetDropStats_Handler,
+		},
+		{
+			MethodName: "CollectGarbage",
+			Handler:    _NodeService_CollectGarbage_Handler,
+		},
+		{
+			MethodName: "SetMTU",
+			Handler:    _NodeService_SetMTU_Handler,
+		},
+		{
+			MethodName: "AttachAFXDP",
+			Handler:    _NodeService_AttachAFXDP_Handler,
+		},
+		{
+			MethodName: "DetachAFXDP",
+			Handler:    _NodeService_DetachAFXDP_Handler,
+		},
+		{
+			MethodName: "ListAFXDPSockets",
+			Handler:    _NodeService_ListAFXDPSockets_Handler,
+		},
+		{
+			MethodName: "ApplyPolicy",
+			Handler:    _NodeService_ApplyPolicy_Handler,
+		},
+		{
+			MethodName: "RemovePolicy",
+			Handler:    _NodeService_RemovePolicy_Handler,
+		},
+		{
+			MethodName: "ListPolicies",
+			Handler:    _NodeService_ListPolicies_Handler,
+		},
+		{
+			MethodName: "ListReservations",
+			Handler:    _NodeService_ListReservations_Handler,
+		},
+		{
+			MethodName: "ReleaseReservation",
+			Handler:    _NodeService_ReleaseReservation_Handler,
+		},
+		{
+			MethodName: "ListSNATSlices",
+			Handler:    _NodeService_ListSNATSlices_Handler,
+		},
+		{
+			MethodName: "AddPeer",
+			Handler:    _NodeService_AddPeer_Handler,
+		},
+		{
+			MethodName: "RemovePeer",
+			Handler:    _NodeService_RemovePeer_Handler,
+		},
+		{
+			MethodName: "ListPeers",
+			Handler:    _NodeService_ListPeers_Handler,
+		},
+		{
+			MethodName: "RotateOverlayKey",
+			Handler:    _NodeService_RotateOverlayKey_Handler,
+		},
+		{
+			MethodName: "RegisterNode",
+			Handler:    _NodeService_RegisterNode_Handler,
+		},
+		{
+			MethodName: "NodeHeartbeat",
+			Handler:    _NodeService_NodeHeartbeat_Handler,
+		},
+		{
+			MethodName: "ListNodes",
+			Handler:    _NodeService_ListNodes_Handler,
+		},
+		{
+			MethodName: "QueryAuditLog",
+			Handler:    _NodeService_QueryAuditLog_Handler,
+		},
+		{
+			MethodName: "TopFlows",
+			Handler:    _NodeService_TopFlows_Handler,
+		},
+		{
+			MethodName: "GetCapabilities",
+			Handler:    _NodeService_GetCapabilities_Handler,
+		},
+		{
+			MethodName: "Backup",
+			Handler:    _NodeService_Backup_Handler,
+		},
+		{
+			MethodName: "UpdateRuntimeSettings",
+			Handler:    _NodeService_UpdateRuntimeSettings_Handler,
+		},
+		{
+			MethodName: "ResetRuntimeSettings",
+			Handler:    _NodeService_ResetRuntimeSettings_Handler,
+		},
+		{
+			MethodName: "DumpEffectiveConfig",
+			Handler:    _NodeService_DumpEffectiveConfig_Handler,
+		},
+		{
+			MethodName: "AllocateIdentity",
+			Handler:    _NodeService_AllocateIdentity_Handler,
+		},
+		{
+			MethodName: "ReleaseIdentity",
+			Handler:    _NodeService_ReleaseIdentity_Handler,
+		},
+		{
+			MethodName: "ListIdentities",
+			Handler:    _NodeService_ListIdentities_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamDropEvents",
+			Handler:       _NodeService_StreamDropEvents_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchIdentities",
+			Handler:       _NodeService_WatchIdentities_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "node.proto",
+}
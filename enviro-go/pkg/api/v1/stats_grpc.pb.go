@@ -0,0 +1,188 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: stats.proto
+
+package v1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	StatsService_GetContainerStats_FullMethodName    = "/enviro.api.v1.StatsService/GetContainerStats"
+	StatsService_StreamContainerStats_FullMethodName = "/enviro.api.v1.StatsService/StreamContainerStats"
+)
+
+// StatsServiceClient is the client API for StatsService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type StatsServiceClient interface {
+	// GetContainerStats samples the containers. Fails with NOT_FOUND for
+	// requested containers that don't exist.
+	GetContainerStats(ctx context.Context, in *GetContainerStatsRequest, opts ...grpc.CallOption) (*GetContainerStatsResponse, error)
+	// StreamContainerStats samples the containers every interval until
+	// cancelled, omitting those deleted meanwhile, with the CPU usage since
+	// the previous sample. Fails with NOT_FOUND for requested containers
+	// that don't exist when it starts, and INVALID_ARGUMENT for intervals
+	// under a second.
+	StreamContainerStats(ctx context.Context, in *StreamContainerStatsRequest, opts ...grpc.CallOption) (StatsService_StreamContainerStatsClient, error)
+}
+
+type statsServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStatsServiceClient(cc grpc.ClientConnInterface) StatsServiceClient {
+	return &statsServiceClient{cc}
+}
+
+func (c *statsServiceClient) GetContainerStats(ctx context.Context, in *GetContainerStatsRequest, opts ...grpc.CallOption) (*GetContainerStatsResponse, error) {
+	out := new(GetContainerStatsResponse)
+	err := c.cc.Invoke(ctx, StatsService_GetContainerStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statsServiceClient) StreamContainerStats(ctx context.Context, in *StreamContainerStatsRequest, opts ...grpc.CallOption) (StatsService_StreamContainerStatsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &StatsService_ServiceDesc.Streams[0], StatsService_StreamContainerStats_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &statsServiceStreamContainerStatsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type StatsService_StreamContainerStatsClient interface {
+	Recv() (*StreamContainerStatsResponse, error)
+	grpc.ClientStream
+}
+
+type statsServiceStreamContainerStatsClient struct {
+	grpc.ClientStream
+}
+
+func (x *statsServiceStreamContainerStatsClient) Recv() (*StreamContainerStatsResponse, error) {
+	m := new(StreamContainerStatsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// StatsServiceServer is the server API for StatsService service.
+// All implementations must embed UnimplementedStatsServiceServer
+// for forward compatibility
+type StatsServiceServer interface {
+	// GetContainerStats samples the containers. Fails with NOT_FOUND for
+	// requested containers that don't exist.
+	GetContainerStats(context.Context, *GetContainerStatsRequest) (*GetContainerStatsResponse, error)
+	// StreamContainerStats samples the containers every interval until
+	// cancelled, omitting those deleted meanwhile, with the CPU usage since
+	// the previous sample. Fails with NOT_FOUND for requested containers
+	// that don't exist when it starts, and INVALID_ARGUMENT for intervals
+	// under a second.
+	StreamContainerStats(*StreamContainerStatsRequest, StatsService_StreamContainerStatsServer) error
+	mustEmbedUnimplementedStatsServiceServer()
+}
+
+// UnimplementedStatsServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedStatsServiceServer struct {
+}
+
+func (UnimplementedStatsServiceServer) GetContainerStats(context.Context, *GetContainerStatsRequest) (*GetContainerStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetContainerStats not implemented")
+}
+func (UnimplementedStatsServiceServer) StreamContainerStats(*StreamContainerStatsRequest, StatsService_StreamContainerStatsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamContainerStats not implemented")
+}
+func (UnimplementedStatsServiceServer) mustEmbedUnimplementedStatsServiceServer() {}
+
+// UnsafeStatsServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StatsServiceServer will
+// result in compilation errors.
+type UnsafeStatsServiceServer interface {
+	mustEmbedUnimplementedStatsServiceServer()
+}
+
+func RegisterStatsServiceServer(s grpc.ServiceRegistrar, srv StatsServiceServer) {
+	s.RegisterService(&StatsService_ServiceDesc, srv)
+}
+
+func _StatsService_GetContainerStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetContainerStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatsServiceServer).GetContainerStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StatsService_GetContainerStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatsServiceServer).GetContainerStats(ctx, req.(*GetContainerStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StatsService_StreamContainerStats_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamContainerStatsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StatsServiceServer).StreamContainerStats(m, &statsServiceStreamContainerStatsServer{stream})
+}
+
+type StatsService_StreamContainerStatsServer interface {
+	Send(*StreamContainerStatsResponse) error
+	grpc.ServerStream
+}
+
+type statsServiceStreamContainerStatsServer struct {
+	grpc.ServerStream
+}
+
+func (x *statsServiceStreamContainerStatsServer) Send(m *StreamContainerStatsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// StatsService_ServiceDesc is the grpc.ServiceDesc for StatsService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var StatsService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "enviro.api.v1.StatsService",
+	HandlerType: (*StatsServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetContainerStats",
+			Handler:    _StatsService_GetContainerStats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamContainerStats",
+			Handler:       _StatsService_StreamContainerStats_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "stats.proto",
+}
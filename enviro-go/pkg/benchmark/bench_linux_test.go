@@ -0,0 +1,491 @@
+//go:build linux
+
+package benchmark
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// Ports of the echo and discard servers in env.Server
+const (
+	echoPort    = 7
+	discardPort = 9
+)
+
+// Sizes of each latency probe and throughput write
+const (
+	probeSize = 64
+	writeSize = 64 << 10
+)
+
+// replyTimeout fails a latency benchmark whose probe got lost
+const replyTimeout = time.Second
+
+// benchEnv is the Env of the mode the last benchmark ran in, which the
+// next one in that mode reuses. Envs of different modes can't coexist, as
+// they create the same links and namespaces. benchErrs holds why Envs of
+// other modes couldn't be set up.
+var (
+	benchEnv  *Env
+	benchErrs = make(map[string]error)
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if benchEnv != nil {
+		benchEnv.Close()
+	}
+	os.Exit(code)
+}
+
+// benchModes runs fn as a sub-benchmark of b in each of Modes, skipping
+// those the manager can't forward in
+func benchModes(b *testing.B, fn func(b *testing.B, env *Env)) {
+	if os.Geteuid() != 0 {
+		b.Skip("setting up the datapath needs root")
+	}
+	for _, mode := range Modes {
+		b.Run(mode, func(b *testing.B) {
+			env, err := modeEnv(mode)
+			if errors.Is(err, ErrModeUnavailable) {
+				b.Skip(err)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			fn(b, env)
+			if err := env.Err(); err != nil {
+				// A failing benchmark may leave the Env broken
+				benchEnv.Close()
+				benchEnv = nil
+			}
+		})
+	}
+}
+
+// modeEnv returns benchEnv, set up for mode first if need be
+func modeEnv(mode string) (*Env, error) {
+	if err := benchErrs[mode]; err != nil {
+		return nil, err
+	}
+	if benchEnv != nil && benchEnv.Mode == mode {
+		return benchEnv, nil
+	}
+	if benchEnv != nil {
+		benchEnv.Close()
+		benchEnv = nil
+	}
+	env, err := Setup(Config{Mode: mode})
+	if err != nil {
+		benchErrs[mode] = err
+		return nil, err
+	}
+	benchEnv = env
+	return env, nil
+}
+
+// BenchmarkCreateContainerNetwork measures setting up a container
+// network: veth pair, addresses, routes and datapath entries. Deleting it
+// again is not timed.
+func BenchmarkCreateContainerNetwork(b *testing.B) {
+	benchModes(b, createContainerNetwork)
+}
+
+func createContainerNetwork(b *testing.B, env *Env) {
+	b.ReportAllocs()
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		id := fmt.Sprintf("enviro-bench-%d", i)
+		_, err := env.Manager.CreateContainerNetwork(ctx, network.ContainerNetworkSpec{
+			ContainerID: id,
+			NetnsPath:   env.createNetns,
+		})
+		if err != nil {
+			env.fatal(b, err)
+		}
+		b.StopTimer()
+		if err := env.Manager.DeleteContainerNetwork(ctx, id); err != nil {
+			env.fatal(b, err)
+		}
+		b.StartTimer()
+	}
+}
+
+// BenchmarkCreateContainerNetworkWarm measures setting up a container
+// network from a warm attachment: moving the peer of a veth pair created
+// ahead into the container's namespace and renaming its host side.
+// Waiting for the pool to refill and deleting the network are not timed,
+// so it compares with BenchmarkCreateContainerNetwork for the latency the
+// pool saves.
+func BenchmarkCreateContainerNetworkWarm(b *testing.B) {
+	benchModes(b, createContainerNetworkWarm)
+}
+
+func createContainerNetworkWarm(b *testing.B, env *Env) {
+	b.ReportAllocs()
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := env.waitWarm(); err != nil {
+			env.fatal(b, err)
+		}
+		b.StartTimer()
+		id := fmt.Sprintf("enviro-bench-warm-%d", i)
+		cn, err := env.Manager.CreateContainerNetwork(ctx, network.ContainerNetworkSpec{
+			ContainerID: id,
+			NetnsPath:   env.createNetns,
+			Namespace:   WarmNamespace,
+		})
+		if err != nil {
+			env.fatal(b, err)
+		}
+		b.StopTimer()
+		if !cn.Timing.Warm {
+			env.fatal(b, fmt.Errorf("%s didn't take a warm attachment", id))
+		}
+		if err := env.Manager.DeleteContainerNetwork(ctx, id); err != nil {
+			env.fatal(b, err)
+		}
+		b.StartTimer()
+	}
+}
+
+// BenchmarkPolicyUpdate measures replacing a policy protecting the server
+// container. With XDP each update is an eBPF map update; otherwise it
+// rebuilds the nftables policy table, and in ModeUserspace also replaces
+// the forwarder's rules.
+func BenchmarkPolicyUpdate(b *testing.B) {
+	benchModes(b, policyUpdate)
+}
+
+func policyUpdate(b *testing.B, env *Env) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		err := env.Manager.ApplyPolicy(network.NetworkPolicy{
+			Name:          "enviro-bench",
+			DestContainer: serverID,
+			Protocol:      "tcp",
+			// Ports the forwarding benchmarks don't use
+			Port:   uint16(1000 + i%1000),
+			Action: network.PolicyDeny,
+		})
+		if err != nil {
+			env.fatal(b, err)
+		}
+	}
+	b.StopTimer()
+	if err := env.Manager.RemovePolicy("enviro-bench"); err != nil {
+		env.fatal(b, err)
+	}
+}
+
+// BenchmarkForwardLatency measures the round trip of a UDP probe from the
+// client namespace to an echo server in the server container
+func BenchmarkForwardLatency(b *testing.B) {
+	benchModes(b, forwardLatency)
+}
+
+func forwardLatency(b *testing.B, env *Env) {
+	addr := &net.UDPAddr{IP: net.ParseIP(env.Server.IPv4), Port: echoPort}
+	var server *net.UDPConn
+	err := env.inServer(func() (err error) {
+		server, err = net.ListenUDP("udp", addr)
+		return err
+	})
+	if err != nil {
+		env.fatal(b, err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, probeSize)
+		for {
+			n, from, err := server.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			server.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	var client *net.UDPConn
+	err = env.inClient(func() (err error) {
+		client, err = net.DialUDP("udp", nil, addr)
+		return err
+	})
+	if err != nil {
+		env.fatal(b, err)
+	}
+	defer client.Close()
+
+	b.ReportAllocs()
+	probe := make([]byte, probeSize)
+	reply := make([]byte, probeSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.SetReadDeadline(time.Now().Add(replyTimeout))
+		if _, err := client.Write(probe); err != nil {
+			env.fatal(b, err)
+		}
+		if _, err := client.Read(reply); err != nil {
+			env.fatal(b, fmt.Errorf("no reply from %s: %w", addr, err))
+		}
+	}
+}
+
+// BenchmarkForwardThroughput measures a TCP stream from the client
+// namespace to a discard server in the server container
+func BenchmarkForwardThroughput(b *testing.B) {
+	benchModes(b, forwardThroughput)
+}
+
+func forwardThroughput(b *testing.B, env *Env) {
+	addr := &net.TCPAddr{IP: net.ParseIP(env.Server.IPv4), Port: discardPort}
+	var lis *net.TCPListener
+	err := env.inServer(func() (err error) {
+		lis, err = net.ListenTCP("tcp", addr)
+		return err
+	})
+	if err != nil {
+		env.fatal(b, err)
+	}
+	defer lis.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		_, err = io.Copy(io.Discard, conn)
+		done <- err
+	}()
+
+	var client *net.TCPConn
+	err = env.inClient(func() (err error) {
+		client, err = net.DialTCP("tcp", nil, addr)
+		return err
+	})
+	if err != nil {
+		env.fatal(b, err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(writeSize)
+	buf := make([]byte, writeSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(buf); err != nil {
+			client.Close()
+			env.fatal(b, err)
+		}
+	}
+	// The stream only counts once the server has read all of it
+	client.CloseWrite()
+	if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) {
+		env.fatal(b, err)
+	}
+	b.StopTimer()
+	client.Close()
+}
+
+// BenchmarkForwardLatencyMirrored is BenchmarkForwardLatency with the
+// traffic of the server container mirrored both ways to the peer one, for
+// the cost of the copies
+func BenchmarkForwardLatencyMirrored(b *testing.B) {
+	benchModes(b, mirrored(forwardLatency))
+}
+
+// BenchmarkForwardThroughputMirrored is BenchmarkForwardThroughput with
+// the traffic mirrored like BenchmarkForwardLatencyMirrored's
+func BenchmarkForwardThroughputMirrored(b *testing.B) {
+	benchModes(b, mirrored(forwardThroughput))
+}
+
+// mirrored returns fn run while the traffic of env.Server is mirrored
+func mirrored(fn func(b *testing.B, env *Env)) func(b *testing.B, env *Env) {
+	return func(b *testing.B, env *Env) {
+		env.mirror(b)
+		defer env.stopMirror(b)
+		fn(b, env)
+	}
+}
+
+// mirror mirrors the traffic of env.Server both ways to env.Peer
+func (env *Env) mirror(b *testing.B) {
+	if err := env.Manager.MirrorTraffic(serverID, peerID, network.DirectionBoth); err != nil {
+		env.fatal(b, err)
+	}
+}
+
+// stopMirror stops the mirror of mirror
+func (env *Env) stopMirror(b *testing.B) {
+	if err := env.Manager.StopMirror(serverID, peerID); err != nil {
+		env.fatal(b, err)
+	}
+}
+
+// BenchmarkLocalLatency measures the round trip of a TCP probe from the
+// peer container to an echo server in the server container on the same
+// node, through the stacks of both
+func BenchmarkLocalLatency(b *testing.B) {
+	benchModes(b, func(b *testing.B, env *Env) { localLatency(b, env, false) })
+}
+
+// BenchmarkLocalLatencySpliced is BenchmarkLocalLatency with the sockets
+// of both ends spliced past the stacks through the sockhash, see
+// network.SocketAccelerationConfig. It skips the modes the manager doesn't
+// splice sockets in.
+func BenchmarkLocalLatencySpliced(b *testing.B) {
+	benchModes(b, func(b *testing.B, env *Env) { localLatency(b, env, true) })
+}
+
+func localLatency(b *testing.B, env *Env, spliced bool) {
+	if spliced && env.spliceErr != nil {
+		b.Skip(env.spliceErr)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP(env.Server.IPv4), Port: echoPort}
+	var lis *net.TCPListener
+	err := env.inContainer(env.Server, spliced, func() (err error) {
+		lis, err = net.ListenTCP("tcp", addr)
+		return err
+	})
+	if err != nil {
+		env.fatal(b, err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	var client *net.TCPConn
+	err = env.inContainer(env.Peer, spliced, func() (err error) {
+		client, err = net.DialTCP("tcp", nil, addr)
+		return err
+	})
+	if err != nil {
+		env.fatal(b, err)
+	}
+	defer client.Close()
+	before := env.splicedBytes(b, spliced)
+
+	b.ReportAllocs()
+	probe := make([]byte, probeSize)
+	reply := make([]byte, probeSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.SetReadDeadline(time.Now().Add(replyTimeout))
+		if _, err := client.Write(probe); err != nil {
+			env.fatal(b, err)
+		}
+		if _, err := io.ReadFull(client, reply); err != nil {
+			env.fatal(b, fmt.Errorf("no reply from %s: %w", addr, err))
+		}
+	}
+	b.StopTimer()
+	env.checkSpliced(b, spliced, before)
+}
+
+// BenchmarkLocalThroughput measures a TCP stream from the peer container
+// to a discard server in the server container on the same node, through
+// the stacks of both
+func BenchmarkLocalThroughput(b *testing.B) {
+	benchModes(b, func(b *testing.B, env *Env) { localThroughput(b, env, false) })
+}
+
+// BenchmarkLocalThroughputSpliced is BenchmarkLocalThroughput with the
+// sockets of both ends spliced like BenchmarkLocalLatencySpliced's
+func BenchmarkLocalThroughputSpliced(b *testing.B) {
+	benchModes(b, func(b *testing.B, env *Env) { localThroughput(b, env, true) })
+}
+
+func localThroughput(b *testing.B, env *Env, spliced bool) {
+	if spliced && env.spliceErr != nil {
+		b.Skip(env.spliceErr)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP(env.Server.IPv4), Port: discardPort}
+	var lis *net.TCPListener
+	err := env.inContainer(env.Server, spliced, func() (err error) {
+		lis, err = net.ListenTCP("tcp", addr)
+		return err
+	})
+	if err != nil {
+		env.fatal(b, err)
+	}
+	defer lis.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		_, err = io.Copy(io.Discard, conn)
+		done <- err
+	}()
+
+	var client *net.TCPConn
+	err = env.inContainer(env.Peer, spliced, func() (err error) {
+		client, err = net.DialTCP("tcp", nil, addr)
+		return err
+	})
+	if err != nil {
+		env.fatal(b, err)
+	}
+	before := env.splicedBytes(b, spliced)
+
+	b.ReportAllocs()
+	b.SetBytes(writeSize)
+	buf := make([]byte, writeSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(buf); err != nil {
+			client.Close()
+			env.fatal(b, err)
+		}
+	}
+	// The stream only counts once the server has read all of it
+	client.CloseWrite()
+	if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) {
+		env.fatal(b, err)
+	}
+	b.StopTimer()
+	client.Close()
+	env.checkSpliced(b, spliced, before)
+}
+
+// splicedBytes returns the bytes the manager spliced so far, when spliced
+func (env *Env) splicedBytes(b *testing.B, spliced bool) uint64 {
+	if !spliced {
+		return 0
+	}
+	stats, err := env.Manager.GetStats()
+	if err != nil {
+		env.fatal(b, err)
+	}
+	return stats["accelerated_bytes"]
+}
+
+// checkSpliced fails b when it should have spliced but the manager didn't
+// splice a byte more than before, as the benchmark would have measured the
+// stacks
+func (env *Env) checkSpliced(b *testing.B, spliced bool, before uint64) {
+	if spliced && env.splicedBytes(b, spliced) == before {
+		env.fatal(b, errors.New("no bytes were spliced"))
+	}
+}
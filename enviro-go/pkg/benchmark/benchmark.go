@@ -0,0 +1,195 @@
+// Package benchmark measures the container datapath of pkg/network:
+// container network setup, from scratch and from a warm pool, policy
+// updates, forwarding from a client namespace through the node's uplink
+// to a container, also while its traffic is mirrored, and between two
+// containers of the node, through their stacks and spliced past them,
+// with the XDP router, the userspace forwarder the manager falls back to
+// without it, and on the kernel path.
+//
+// The benchmarks are the Benchmark functions of the package's tests, each
+// running a sub-benchmark per mode, e.g. BenchmarkForwardLatency/xdp,
+// which is skipped when the manager can't forward in that mode. They
+// create network namespaces, links and nftables rules, so they need root,
+// and ModeXDP needs the router embedded with -tags bpfobj:
+//
+//	go test -v -tags bpfobj -run '^$' -bench . ./pkg/benchmark
+//
+// ParseReport reads their output into Results, as cmd/enviro-bench does
+// to report them as JSON.
+package benchmark
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Datapath modes an Env can forward in
+const (
+	// ModeKernel routes with the kernel and enforces policies with nftables
+	ModeKernel = "kernel"
+	// ModeUserspace forwards uplink traffic with the userspace forwarder,
+	// see network.DatapathUserspace
+	ModeUserspace = "userspace"
+	// ModeXDP forwards uplink traffic with the XDP router
+	ModeXDP = "xdp"
+)
+
+// Modes are the modes each benchmark runs in, in order
+var Modes = []string{ModeKernel, ModeUserspace, ModeXDP}
+
+// ErrModeUnavailable is returned by Setup when the manager doesn't
+// forward in the mode of its Config, e.g. ModeXDP when the router could
+// not be attached
+var ErrModeUnavailable = errors.New("benchmark: datapath mode unavailable")
+
+// CreateBudget is the longest creating a container network may take on
+// average before it counts as over budget. It leaves room for slow CI
+// machines, where the kernel path takes around 30ms.
+const CreateBudget = 50 * time.Millisecond
+
+// Budgets are the longest an op of the named benchmarks may take
+var Budgets = map[string]time.Duration{
+	"CreateContainerNetwork":     CreateBudget,
+	"CreateContainerNetworkWarm": CreateBudget,
+}
+
+// DefaultCIDR is the container network of an Env unless Config.CIDR is set
+const DefaultCIDR = "10.250.0.0/24"
+
+// WarmNamespace is the namespace whose containers take the warm
+// attachments of an Env's manager, see network.WarmPoolConfig. The
+// containers of the others are created from scratch.
+const WarmNamespace = "enviro-bench-warm"
+
+// Config describes the Env to set up
+type Config struct {
+	// Mode is the datapath to forward with, ModeKernel when empty
+	Mode string
+	// CIDR is the container network, DefaultCIDR when empty. It must not
+	// overlap the host's networks.
+	CIDR string
+}
+
+// Result is the outcome of one benchmark in one mode
+type Result struct {
+	Name string `json:"name"`
+	// Mode is the datapath the benchmark ran in, one of Modes
+	Mode       string `json:"mode"`
+	Iterations int    `json:"iterations"`
+	NsPerOp    int64  `json:"ns_per_op"`
+	// MBPerSec is set for throughput benchmarks
+	MBPerSec    float64 `json:"mb_per_sec,omitempty"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+	BytesPerOp  int64   `json:"alloc_bytes_per_op"`
+	// BudgetNs is the budget of the benchmark in Budgets, if any
+	BudgetNs int64 `json:"budget_ns,omitempty"`
+}
+
+// OverBudget reports whether the benchmark took longer per op than its
+// budget
+func (r Result) OverBudget() bool {
+	return r.BudgetNs > 0 && r.NsPerOp > r.BudgetNs
+}
+
+// Report is what ParseReport reads of a benchmark run
+type Report struct {
+	Results []Result `json:"results"`
+	// Skipped holds why benchmarks were skipped, by name and mode, e.g.
+	// "ForwardLatency/xdp" when the router failed to load
+	Skipped map[string]string `json:"skipped,omitempty"`
+	// Failed names the benchmarks that failed, likewise
+	Failed []string `json:"failed,omitempty"`
+}
+
+// OverBudget returns the results of r over their budget
+func (r Report) OverBudget() []Result {
+	var over []Result
+	for _, res := range r.Results {
+		if res.OverBudget() {
+			over = append(over, res)
+		}
+	}
+	return over
+}
+
+// resultLine matches a result in the output of go test -bench: the name
+// with the GOMAXPROCS suffix, the iterations and the measurements
+var resultLine = regexp.MustCompile(`^Benchmark(\S+?)(?:-\d+)?\s+(\d+)\s+(.*)$`)
+
+// ParseReport reads the output of go test -bench for the benchmarks of
+// this package. Only with -v does it hold the skipped ones.
+func ParseReport(r io.Reader) (Report, error) {
+	report := Report{Skipped: make(map[string]string)}
+	// logged is the last message a benchmark logged, indented as
+	// file:line: message before the result or SKIP line
+	var logged string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+		if line != trimmed {
+			if _, msg, ok := strings.Cut(trimmed, ": "); ok {
+				logged = msg
+			}
+			continue
+		}
+		msg := logged
+		logged = ""
+		if name, ok := strings.CutPrefix(line, "--- SKIP: Benchmark"); ok {
+			report.Skipped[name] = msg
+			continue
+		}
+		if name, ok := strings.CutPrefix(line, "--- FAIL: Benchmark"); ok {
+			report.Failed = append(report.Failed, name)
+			continue
+		}
+		m := resultLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		res, err := parseResult(m[1], m[2], m[3])
+		if err != nil {
+			return report, fmt.Errorf("%q: %w", line, err)
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report, sc.Err()
+}
+
+// parseResult parses the result of benchmark name: its iterations and
+// measurements, pairs of a value and its unit
+func parseResult(name, iterations, measurements string) (Result, error) {
+	res := Result{Name: name}
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		res.Name, res.Mode = name[:i], name[i+1:]
+	}
+	res.BudgetNs = Budgets[res.Name].Nanoseconds()
+	var err error
+	if res.Iterations, err = strconv.Atoi(iterations); err != nil {
+		return res, err
+	}
+	fields := strings.Fields(measurements)
+	for i := 0; i+1 < len(fields); i += 2 {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return res, err
+		}
+		switch fields[i+1] {
+		case "ns/op":
+			res.NsPerOp = int64(v)
+		case "MB/s":
+			res.MBPerSec = v
+		case "B/op":
+			res.BytesPerOp = int64(v)
+		case "allocs/op":
+			res.AllocsPerOp = int64(v)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,42 @@
+package benchmark
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReport(t *testing.T) {
+	out := `goos: linux
+BenchmarkCreateContainerNetwork
+BenchmarkCreateContainerNetwork/kernel
+BenchmarkCreateContainerNetwork/kernel-8         	      20	  61519276 ns/op	  910880 B/op	    7430 allocs/op
+BenchmarkForwardThroughput/userspace
+BenchmarkForwardThroughput/userspace-8         	       5	     81979 ns/op	 799.42 MB/s	    1193 B/op	      24 allocs/op
+BenchmarkForwardThroughput/xdp
+    bench_linux_test.go:60: benchmark: datapath mode unavailable
+--- SKIP: BenchmarkForwardThroughput/xdp
+BenchmarkPolicyUpdate/kernel
+    bench_linux_test.go:120: apply: exit status 1
+--- FAIL: BenchmarkPolicyUpdate/kernel
+FAIL
+`
+	report, err := ParseReport(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Report{
+		Results: []Result{
+			{Name: "CreateContainerNetwork", Mode: ModeKernel, Iterations: 20, NsPerOp: 61519276, AllocsPerOp: 7430, BytesPerOp: 910880, BudgetNs: CreateBudget.Nanoseconds()},
+			{Name: "ForwardThroughput", Mode: ModeUserspace, Iterations: 5, NsPerOp: 81979, MBPerSec: 799.42, AllocsPerOp: 24, BytesPerOp: 1193},
+		},
+		Skipped: map[string]string{"ForwardThroughput/xdp": "benchmark: datapath mode unavailable"},
+		Failed:  []string{"PolicyUpdate/kernel"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("ParseReport() = %+v, want %+v", report, want)
+	}
+	if over := report.OverBudget(); len(over) != 1 || over[0].Name != "CreateContainerNetwork" {
+		t.Errorf("OverBudget() = %+v, want the CreateContainerNetwork result", over)
+	}
+}
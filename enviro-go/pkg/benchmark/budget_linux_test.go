@@ -0,0 +1,92 @@
+//go:build linux
+
+package benchmark
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// budgetTestEnv has a child of TestCreateContainerNetworkBudget run the
+// test in the network namespace of its own it was started in
+const budgetTestEnv = "ENVIRO_TEST_CREATE_BUDGET"
+
+// TestCreateContainerNetworkBudget fails when creating a container
+// network takes longer than CreateBudget on average, and checks that the
+// network manager timed the creates by stage, and that taking a warm
+// attachment stays within the budget too. It runs in a child in a
+// network namespace of its own, so the uplink stays off the host.
+func TestCreateContainerNetworkBudget(t *testing.T) {
+	if os.Getenv(budgetTestEnv) != "" {
+		runCreateContainerNetworkBudget(t)
+		return
+	}
+	if testing.Short() {
+		t.Skip("benchmarks take a while")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("setting up the datapath needs root")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCreateContainerNetworkBudget$", "-test.v")
+	cmd.Env = append(os.Environ(), budgetTestEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWNET}
+	out, err := cmd.CombinedOutput()
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("can't create a network namespace: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
+
+func runCreateContainerNetworkBudget(t *testing.T) {
+	env, err := Setup(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	r := testing.Benchmark(func(b *testing.B) {
+		createContainerNetwork(b, env)
+	})
+	if err := env.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Duration(r.NsPerOp()); got > CreateBudget {
+		t.Errorf("creating a container network took %v per op over %d ops, budget %v", got, r.N, CreateBudget)
+	}
+
+	latency := env.Manager.SetupLatency()
+	// testing.Benchmark runs the benchmark several times, and the server
+	// of the Env is created too
+	if want := min(r.N+1, network.SetupWindow); latency.Samples < want {
+		t.Errorf("SetupLatency() has %d samples, want at least %d", latency.Samples, want)
+	}
+	if latency.Total.P50 <= 0 || latency.Total.P50 > latency.Total.P99 {
+		t.Errorf("SetupLatency() total quantiles %+v", latency.Total)
+	}
+	for _, stage := range []network.SetupStage{network.SetupAllocation, network.SetupNetlink, network.SetupNetns, network.SetupMaps} {
+		if h := latency.StageHistograms[stage]; h.Packets == 0 {
+			t.Errorf("no creates timed in stage %s", stage)
+		}
+	}
+
+	warm := testing.Benchmark(func(b *testing.B) {
+		createContainerNetworkWarm(b, env)
+	})
+	if err := env.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Duration(warm.NsPerOp()); got > CreateBudget {
+		t.Errorf("creating a container network from a warm attachment took %v per op over %d ops, budget %v", got, warm.N, CreateBudget)
+	}
+	t.Logf("creating a container network took %v per op, %v from a warm attachment", time.Duration(r.NsPerOp()), time.Duration(warm.NsPerOp()))
+}
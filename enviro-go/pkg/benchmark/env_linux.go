@@ -0,0 +1,477 @@
+//go:build linux
+
+package benchmark
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/cgroup"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// Names of the links and namespaces an Env creates. Leftovers of an
+// interrupted run are removed by the next Setup.
+const (
+	uplinkName      = "enviro-bench0"
+	clientLinkName  = "enviro-bench1"
+	clientNetnsName = "enviro-bench-client"
+	serverNetnsName = "enviro-bench-server"
+	peerNetnsName   = "enviro-bench-peer"
+	createNetnsName = "enviro-bench-create"
+
+	serverID = "enviro-bench-server"
+	peerID   = "enviro-bench-peer"
+)
+
+// cgroupNames are the cgroups of env.Server and env.Peer, children of the
+// benchmark's own
+var cgroupNames = map[string]string{serverID: "enviro-bench-server", peerID: "enviro-bench-peer"}
+
+// errNoSplicing skips the benchmarks of spliced sockets
+var errNoSplicing = errors.New("sockets aren't spliced without the XDP router on a kernel from 5.4")
+
+// warmPoolSize is the number of warm attachments of an Env's manager
+const warmPoolSize = 4
+
+// warmTimeout fails a benchmark whose warm pool didn't refill
+const warmTimeout = 5 * time.Second
+
+// The uplink is a /30 between the host and the client namespace
+var (
+	uplinkAddr = netip.MustParsePrefix("10.251.0.1/30")
+	clientAddr = netip.MustParsePrefix("10.251.0.2/30")
+)
+
+// Env is a network manager and the namespaces the benchmarks run in: a
+// client namespace behind the manager's uplink, and a container to send
+// to. The uplink is a veth pair, so traffic from the client is redirected
+// to the container by the XDP router in ModeXDP and by the userspace
+// forwarder in ModeUserspace; replies take the kernel path in all modes.
+type Env struct {
+	Manager *network.NetworkManager
+	// Mode is the datapath the manager forwards with, that of the Config
+	Mode string
+	// Server is the container the forwarding benchmarks send to
+	Server *network.ContainerNetwork
+	// Peer is a container on the node of Server, which the local
+	// benchmarks send from
+	Peer *network.ContainerNetwork
+
+	clientNetns string
+	createNetns string
+	// cgroup is the benchmark's own cgroup, which inCgroup moves it back
+	// to. spliceErr is why sockets of Peer and Server can't be spliced,
+	// nil when the two have cgroups and Manager splices their sockets.
+	cgroup    string
+	spliceErr error
+
+	mu  sync.Mutex
+	err error
+}
+
+// Setup creates an Env. Close it to remove everything it created. It
+// fails with ErrModeUnavailable when the manager doesn't forward in
+// cfg.Mode.
+func Setup(cfg Config) (*Env, error) {
+	if cfg.CIDR == "" {
+		cfg.CIDR = DefaultCIDR
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = ModeKernel
+	}
+	cleanup()
+
+	env := &Env{}
+	if err := env.setup(cfg); err != nil {
+		env.Close()
+		return nil, err
+	}
+	return env, nil
+}
+
+func (env *Env) setup(cfg Config) error {
+	var err error
+	if env.clientNetns, err = newNetns(clientNetnsName); err != nil {
+		return err
+	}
+	if env.createNetns, err = newNetns(createNetnsName); err != nil {
+		return err
+	}
+	serverNetns, err := newNetns(serverNetnsName)
+	if err != nil {
+		return err
+	}
+	peerNetns, err := newNetns(peerNetnsName)
+	if err != nil {
+		return err
+	}
+	prefix, err := netip.ParsePrefix(cfg.CIDR)
+	if err != nil {
+		return fmt.Errorf("%w: %v", network.ErrInvalidCIDR, err)
+	}
+	if err := setupUplink(env.clientNetns, prefix.Masked()); err != nil {
+		return err
+	}
+
+	var datapathMode network.DatapathMode
+	switch cfg.Mode {
+	case ModeKernel:
+	case ModeUserspace:
+		datapathMode = network.DatapathUserspace
+	case ModeXDP:
+		// Native XDP on a veth only delivers the frames it redirects to
+		// peers running XDP themselves
+		datapathMode = network.DatapathXDPGeneric
+	default:
+		return fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+	env.Manager, err = network.NewNetworkManager(network.NetworkConfig{
+		EnableXDP:    cfg.Mode != ModeKernel,
+		DatapathMode: datapathMode,
+		Interface:    uplinkName,
+		CIDR:         cfg.CIDR,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		// Only sockets opened in the cgroups of Peer and Server are
+		// spliced, see inContainer
+		SocketAcceleration: network.SocketAccelerationConfig{Enable: cfg.Mode == ModeXDP},
+		WarmPool: network.WarmPoolConfig{
+			Size:       warmPoolSize,
+			Interval:   time.Millisecond,
+			Namespaces: []string{WarmNamespace},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := env.Manager.CreateNamespace(network.Namespace{Name: WarmNamespace}); err != nil {
+		return err
+	}
+	caps := env.Manager.Capabilities()
+	switch {
+	case caps.XDP:
+		env.Mode = ModeXDP
+	case caps.Userspace:
+		env.Mode = ModeUserspace
+	default:
+		env.Mode = ModeKernel
+	}
+	if env.Mode != cfg.Mode {
+		return fmt.Errorf("%w: %s forwards in %s mode: %s", ErrModeUnavailable, cfg.Mode, env.Mode, caps.XDPError)
+	}
+
+	env.spliceErr = errNoSplicing
+	if caps.SocketAcceleration {
+		env.spliceErr = env.setupCgroups()
+	}
+	cgroupPath := func(id string) string {
+		if env.spliceErr != nil {
+			return ""
+		}
+		return filepath.Join(env.cgroup, cgroupNames[id])
+	}
+
+	ctx := context.Background()
+	env.Server, err = env.Manager.CreateContainerNetwork(ctx, network.ContainerNetworkSpec{
+		ContainerID: serverID,
+		NetnsPath:   serverNetns,
+		CgroupPath:  cgroupPath(serverID),
+	})
+	if err != nil {
+		return err
+	}
+	env.Peer, err = env.Manager.CreateContainerNetwork(ctx, network.ContainerNetworkSpec{
+		ContainerID: peerID,
+		NetnsPath:   peerNetns,
+		CgroupPath:  cgroupPath(peerID),
+	})
+	return err
+}
+
+// setupCgroups creates the cgroups of Server and Peer below the
+// benchmark's own
+func (env *Env) setupCgroups() error {
+	var err error
+	if env.cgroup, err = ownCgroup(); err != nil {
+		return err
+	}
+	for _, name := range cgroupNames {
+		if err := os.Mkdir(filepath.Join(env.cgroup, name), 0o755); err != nil {
+			return fmt.Errorf("failed to create cgroup: %w", err)
+		}
+	}
+	return nil
+}
+
+// ownCgroup returns the directory of the benchmark's cgroup in the cgroup
+// v2 hierarchy at cgroup.DefaultRoot
+func ownCgroup() (string, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(cgroup.DefaultRoot, &st); err != nil {
+		return "", err
+	}
+	if st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return "", fmt.Errorf("no cgroup v2 hierarchy at %s", cgroup.DefaultRoot)
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(cgroup.DefaultRoot, path), nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2 group")
+}
+
+// setupUplink creates the uplink veth pair, moves its peer into the
+// client namespace at path and routes cidr from there via the host
+func setupUplink(path string, cidr netip.Prefix) error {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: uplinkName},
+		PeerName:  clientLinkName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create uplink: %w", err)
+	}
+	uplink, err := netlink.LinkByName(uplinkName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrAdd(uplink, &netlink.Addr{IPNet: prefixNet(uplinkAddr)}); err != nil {
+		return fmt.Errorf("failed to address uplink: %w", err)
+	}
+	if err := netlink.LinkSetUp(uplink); err != nil {
+		return err
+	}
+
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	peer, err := netlink.LinkByName(clientLinkName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetNsFd(peer, int(ns)); err != nil {
+		return fmt.Errorf("failed to move %s into client namespace: %w", clientLinkName, err)
+	}
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	if peer, err = h.LinkByName(clientLinkName); err != nil {
+		return err
+	}
+	if err := h.AddrAdd(peer, &netlink.Addr{IPNet: prefixNet(clientAddr)}); err != nil {
+		return fmt.Errorf("failed to address %s: %w", clientLinkName, err)
+	}
+	if err := h.LinkSetUp(peer); err != nil {
+		return err
+	}
+	if lo, err := h.LinkByName("lo"); err == nil {
+		h.LinkSetUp(lo)
+	}
+	return h.RouteAdd(&netlink.Route{
+		LinkIndex: peer.Attrs().Index,
+		Dst:       prefixNet(cidr),
+		Gw:        net.IP(uplinkAddr.Addr().AsSlice()),
+	})
+}
+
+// Close deletes the container networks and namespaces and detaches the
+// XDP router
+func (env *Env) Close() error {
+	var errs []error
+	if env.Manager != nil {
+		ctx := context.Background()
+		for id := range env.Manager.Allocations() {
+			errs = append(errs, env.Manager.DeleteContainerNetwork(ctx, id))
+		}
+		errs = append(errs, env.Manager.Close())
+	}
+	return errors.Join(append(errs, cleanup())...)
+}
+
+// Err returns the error that failed a benchmark, if any, which
+// testing.Benchmark doesn't report
+func (env *Env) Err() error {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.err
+}
+
+// fatal records err for Err and fails b
+func (env *Env) fatal(b *testing.B, err error) {
+	env.mu.Lock()
+	if env.err == nil {
+		env.err = err
+	}
+	env.mu.Unlock()
+	b.Fatal(err)
+}
+
+// waitWarm waits for a warm attachment to be ready
+func (env *Env) waitWarm() error {
+	for deadline := time.Now().Add(warmTimeout); env.Manager.WarmPool().Ready == 0; time.Sleep(100 * time.Microsecond) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no warm attachment ready after %v: %+v", warmTimeout, env.Manager.WarmPool())
+		}
+	}
+	return nil
+}
+
+// inClient runs fn in the client namespace, for opening sockets there
+func (env *Env) inClient(fn func() error) error {
+	return inNetns(env.clientNetns, fn)
+}
+
+// inServer runs fn in the namespace of env.Server
+func (env *Env) inServer(fn func() error) error {
+	return inNetns(env.Server.NetnsPath, fn)
+}
+
+// inContainer runs fn in the namespace of cn, and in its cgroup when
+// spliced, so the sockets fn opens there are spliced to those opened
+// alike in the other container
+func (env *Env) inContainer(cn *network.ContainerNetwork, spliced bool, fn func() error) error {
+	return inNetns(cn.NetnsPath, func() error {
+		if !spliced {
+			return fn()
+		}
+		return env.inCgroup(cn.CgroupPath, fn)
+	})
+}
+
+// inCgroup runs fn with the benchmark's process in the cgroup at path.
+// It moves all threads of the process, so it must not run concurrently
+// with itself.
+func (env *Env) inCgroup(path string, fn func() error) error {
+	if err := joinCgroup(path); err != nil {
+		return err
+	}
+	fnErr := fn()
+	return errors.Join(fnErr, joinCgroup(env.cgroup))
+}
+
+// joinCgroup moves the benchmark's process into the cgroup at path
+func joinCgroup(path string) error {
+	err := os.WriteFile(filepath.Join(path, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0)
+	if err != nil {
+		return fmt.Errorf("failed to join cgroup %s: %w", path, err)
+	}
+	return nil
+}
+
+// cleanup removes the uplink, namespaces and cgroups of an Env. Deleting
+// the uplink also deletes its peer.
+func cleanup() error {
+	var errs []error
+	if link, err := netlink.LinkByName(uplinkName); err == nil {
+		errs = append(errs, netlink.LinkDel(link))
+	}
+	for _, name := range []string{clientNetnsName, serverNetnsName, peerNetnsName, createNetnsName} {
+		if err := netns.DeleteNamed(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if dir, err := ownCgroup(); err == nil {
+		for _, name := range cgroupNames {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newNetns creates a named network namespace and returns its path
+func newNetns(name string) (string, error) {
+	// NewNamed moves the thread into the new namespace
+	err := restoringNetns(func() error {
+		ns, err := netns.NewNamed(name)
+		if err != nil {
+			return fmt.Errorf("failed to create netns %s: %w", name, err)
+		}
+		return ns.Close()
+	})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(netnsDir, name), nil
+}
+
+// netnsDir is where netns.NewNamed bind-mounts namespaces
+const netnsDir = "/var/run/netns"
+
+// inNetns runs fn on a thread in the namespace at path. Sockets fn opens
+// stay in that namespace.
+func inNetns(path string, fn func() error) error {
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %s: %w", path, err)
+	}
+	defer ns.Close()
+
+	return restoringNetns(func() error {
+		if err := netns.Set(ns); err != nil {
+			return fmt.Errorf("failed to enter netns %s: %w", path, err)
+		}
+		return fn()
+	})
+}
+
+// restoringNetns runs fn on a locked thread, which it moves back to its
+// network namespace afterwards. fn runs on a goroutine of its own, which
+// exits without unlocking a thread it couldn't move back, so the runtime
+// terminates the thread instead of reusing it.
+func restoringNetns(fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		orig, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- err
+			return
+		}
+		defer orig.Close()
+		fnErr := fn()
+		if err := netns.Set(orig); err != nil {
+			errc <- errors.Join(fnErr, fmt.Errorf("failed to restore network namespace: %w", err))
+			return
+		}
+		runtime.UnlockOSThread()
+		errc <- fnErr
+	}()
+	return <-errc
+}
+
+func prefixNet(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   net.IP(p.Addr().AsSlice()),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
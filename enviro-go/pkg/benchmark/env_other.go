@@ -0,0 +1,24 @@
+//go:build !linux
+
+package benchmark
+
+import "github.com/1090mb/enviro/enviro-go/pkg/network"
+
+// Env is a network manager under test; the datapath only runs on Linux
+type Env struct {
+	Manager *network.NetworkManager
+	Mode    string
+	Server  *network.ContainerNetwork
+	Peer    *network.ContainerNetwork
+}
+
+// Setup fails with network.ErrUnsupportedPlatform
+func Setup(cfg Config) (*Env, error) {
+	return nil, network.ErrUnsupportedPlatform
+}
+
+// Close does nothing
+func (env *Env) Close() error { return nil }
+
+// Err always returns nil
+func (env *Env) Err() error { return nil }
@@ -0,0 +1,225 @@
+// Package cgroup reads the resource usage of cgroup v2 groups from their
+// interface files, e.g. cpu.stat and memory.current. Files of controllers
+// not enabled for a group are skipped, leaving their stats zero.
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultRoot is where the cgroup v2 hierarchy is mounted
+const DefaultRoot = "/sys/fs/cgroup"
+
+// ErrNotFound is returned for groups that don't exist
+var ErrNotFound = errors.New("cgroup: not found")
+
+// Stats is the resource usage of a group
+type Stats struct {
+	CPU    CPUStats
+	Memory MemoryStats
+	IO     IOStats
+	Pids   PidsStats
+}
+
+// CPUStats is read from cpu.stat
+type CPUStats struct {
+	// UsageUsec is the CPU time consumed, in microseconds, of which
+	// UserUsec in user and SystemUsec in kernel mode
+	UsageUsec  uint64
+	UserUsec   uint64
+	SystemUsec uint64
+	// Periods are the enforcement periods of cpu.max, ThrottledPeriods
+	// those the group was throttled in for ThrottledUsec in total
+	Periods          uint64
+	ThrottledPeriods uint64
+	ThrottledUsec    uint64
+}
+
+// MemoryStats is read from memory.current, memory.max, memory.stat and
+// memory.events
+type MemoryStats struct {
+	Usage uint64
+	// Limit is 0 when unlimited
+	Limit uint64
+	// WorkingSet is Usage less the inactive page cache, which the kernel
+	// reclaims first, as kubelet evicts by
+	WorkingSet uint64
+	Anon       uint64
+	File       uint64
+	Kernel     uint64
+	// OOMKills counts the processes of the group the OOM killer killed
+	OOMKills uint64
+}
+
+// IOStats is read from io.stat, summed over Devices
+type IOStats struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+	ReadOps    uint64
+	WriteOps   uint64
+	// Devices are ordered by major and minor number
+	Devices []IODeviceStats
+}
+
+// IODeviceStats is the IO of a group on a block device
+type IODeviceStats struct {
+	Major, Minor uint32
+	ReadBytes    uint64
+	WriteBytes   uint64
+	ReadOps      uint64
+	WriteOps     uint64
+}
+
+// PidsStats is read from pids.current and pids.max
+type PidsStats struct {
+	Current uint64
+	// Limit is 0 when unlimited
+	Limit uint64
+}
+
+// Read returns the usage of the group at dir, e.g.
+// /sys/fs/cgroup/system.slice/foo.service
+func Read(dir string) (Stats, error) {
+	var s Stats
+	fi, err := os.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, fmt.Errorf("%w: %s", ErrNotFound, dir)
+	}
+	if err != nil {
+		return s, err
+	}
+	if !fi.IsDir() {
+		return s, fmt.Errorf("cgroup: %s is not a directory", dir)
+	}
+	r := reader{dir: dir}
+
+	cpu := r.keyed("cpu.stat")
+	s.CPU = CPUStats{
+		UsageUsec:        cpu["usage_usec"],
+		UserUsec:         cpu["user_usec"],
+		SystemUsec:       cpu["system_usec"],
+		Periods:          cpu["nr_periods"],
+		ThrottledPeriods: cpu["nr_throttled"],
+		ThrottledUsec:    cpu["throttled_usec"],
+	}
+
+	mem := r.keyed("memory.stat")
+	s.Memory = MemoryStats{
+		Usage:    r.value("memory.current"),
+		Limit:    r.value("memory.max"),
+		Anon:     mem["anon"],
+		File:     mem["file"],
+		Kernel:   mem["kernel"],
+		OOMKills: r.keyed("memory.events")["oom_kill"],
+	}
+	if inactive := mem["inactive_file"]; inactive < s.Memory.Usage {
+		s.Memory.WorkingSet = s.Memory.Usage - inactive
+	}
+
+	s.IO = r.io()
+	s.Pids = PidsStats{Current: r.value("pids.current"), Limit: r.value("pids.max")}
+	if r.err != nil {
+		return Stats{}, r.err
+	}
+	return s, nil
+}
+
+// reader reads the interface files of a group, keeping the first error
+// other than a missing file
+type reader struct {
+	dir string
+	err error
+}
+
+func (r *reader) read(name string) []byte {
+	data, err := os.ReadFile(filepath.Join(r.dir, name))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) && r.err == nil {
+			r.err = err
+		}
+		return nil
+	}
+	return data
+}
+
+// value reads a file of a single value, "max" being 0
+func (r *reader) value(name string) uint64 {
+	s := string(bytes.TrimSpace(r.read(name)))
+	if s == "" || s == "max" {
+		return 0
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("cgroup: invalid %s: %q", name, s)
+	}
+	return v
+}
+
+// keyed reads a file of "key value" lines, such as cpu.stat
+func (r *reader) keyed(name string) map[string]uint64 {
+	values := make(map[string]uint64)
+	sc := bufio.NewScanner(bytes.NewReader(r.read(name)))
+	for sc.Scan() {
+		key, s, ok := strings.Cut(sc.Text(), " ")
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseUint(s, 10, 64); err == nil {
+			values[key] = v
+		}
+	}
+	return values
+}
+
+// io reads io.stat, lines of "major:minor rbytes=... wbytes=... rios=...
+// wios=... dbytes=... dios=..."
+func (r *reader) io() IOStats {
+	var s IOStats
+	sc := bufio.NewScanner(bytes.NewReader(r.read("io.stat")))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var d IODeviceStats
+		if _, err := fmt.Sscanf(fields[0], "%d:%d", &d.Major, &d.Minor); err != nil {
+			continue
+		}
+		for _, f := range fields[1:] {
+			key, value, _ := strings.Cut(f, "=")
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				d.ReadBytes = v
+			case "wbytes":
+				d.WriteBytes = v
+			case "rios":
+				d.ReadOps = v
+			case "wios":
+				d.WriteOps = v
+			}
+		}
+		s.ReadBytes += d.ReadBytes
+		s.WriteBytes += d.WriteBytes
+		s.ReadOps += d.ReadOps
+		s.WriteOps += d.WriteOps
+		s.Devices = append(s.Devices, d)
+	}
+	sort.Slice(s.Devices, func(i, j int) bool {
+		a, b := s.Devices[i], s.Devices[j]
+		return a.Major < b.Major || (a.Major == b.Major && a.Minor < b.Minor)
+	})
+	return s
+}
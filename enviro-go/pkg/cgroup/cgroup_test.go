@@ -0,0 +1,100 @@
+package cgroup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeGroup writes the interface files of a group to a new directory
+func writeGroup(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  Stats
+		// wantErr is part of the error, none if empty
+		wantErr string
+	}{
+		{
+			name: "all controllers",
+			files: map[string]string{
+				"cpu.stat": "usage_usec 1500000\nuser_usec 1000000\nsystem_usec 500000\n" +
+					"nr_periods 10\nnr_throttled 2\nthrottled_usec 3000\nnr_bursts 0\n",
+				"memory.current": "104857600\n",
+				"memory.max":     "268435456\n",
+				"memory.stat":    "anon 52428800\nfile 41943040\nkernel 4194304\ninactive_file 20971520\n",
+				"memory.events":  "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n",
+				"io.stat": "259:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n" +
+					"8:0 rbytes=1024 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+				"pids.current": "7\n",
+				"pids.max":     "max\n",
+			},
+			want: Stats{
+				CPU: CPUStats{UsageUsec: 1500000, UserUsec: 1000000, SystemUsec: 500000, Periods: 10, ThrottledPeriods: 2, ThrottledUsec: 3000},
+				Memory: MemoryStats{Usage: 104857600, Limit: 268435456, WorkingSet: 83886080, Anon: 52428800, File: 41943040,
+					Kernel: 4194304, OOMKills: 1},
+				IO: IOStats{ReadBytes: 5120, WriteBytes: 8192, ReadOps: 2, WriteOps: 2, Devices: []IODeviceStats{
+					{Major: 8, Minor: 0, ReadBytes: 1024, ReadOps: 1},
+					{Major: 259, Minor: 0, ReadBytes: 4096, WriteBytes: 8192, ReadOps: 1, WriteOps: 2},
+				}},
+				Pids: PidsStats{Current: 7},
+			},
+		},
+		{
+			name:  "only cpu",
+			files: map[string]string{"cpu.stat": "usage_usec 10\n", "memory.max": "max\n"},
+			want:  Stats{CPU: CPUStats{UsageUsec: 10}},
+		},
+		{
+			name:  "unparsable lines skipped",
+			files: map[string]string{"cpu.stat": "usage_usec ten\nuser_usec 5\nbroken\n", "io.stat": "sda rbytes=1\n"},
+			want:  Stats{CPU: CPUStats{UserUsec: 5}},
+		},
+		{name: "invalid value", files: map[string]string{"pids.current": "many\n"}, wantErr: `invalid pids.current: "many"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Read(writeGroup(t, tt.files))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Read() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Read() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMissing(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Read(filepath.Join(dir, "missing")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Read() of a missing group = %v, want %v", err, ErrNotFound)
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(file); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Read() of a file = %v, want it rejected", err)
+	}
+}
@@ -0,0 +1,854 @@
+// Package client is a Go client for the Enviro control plane.
+//
+// A Client talks to one or more control plane endpoints, retrying
+// idempotent calls with exponential backoff while an endpoint is
+// unavailable and following followers to the elected leader.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// notLeaderReason is the ErrorInfo reason followers reject mutating RPCs
+// with; its metadata names the leader
+const notLeaderReason = "NOT_LEADER"
+
+// drainingReason is the ErrorInfo reason of calls rejected by a control
+// plane that is draining; they never reached the handler
+const drainingReason = "DRAINING"
+
+// maxRedirects bounds the leader redirects followed by a single call, so
+// a split election can't bounce it around forever
+const maxRedirects = 3
+
+// RetryPolicy controls retries of idempotent calls failing with
+// codes.Unavailable or codes.ResourceExhausted
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt; 1 disables retries
+	MaxAttempts int
+	// InitialBackoff is the pause before the first retry. It grows by
+	// Multiplier per retry up to MaxBackoff, with 20% jitter.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// DefaultRetryPolicy is used unless WithRetryPolicy is given
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+	}
+}
+
+// options collects the settings of New
+type options struct {
+	tls      *tls.Config
+	tlsErr   error
+	token    string
+	timeout  time.Duration
+	retry    RetryPolicy
+	dialOpts []grpc.DialOption
+}
+
+// Option configures a Client
+type Option func(*options)
+
+// WithTLSConfig connects with TLS using config
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) { o.tls = config }
+}
+
+// WithTLSFiles connects with TLS, verifying the server against the CA in
+// caFile, or the system roots when empty. certFile and keyFile present a
+// client certificate for mTLS when set.
+func WithTLSFiles(caFile, certFile, keyFile string) Option {
+	return func(o *options) {
+		o.tls, o.tlsErr = loadTLSConfig(caFile, certFile, keyFile)
+	}
+}
+
+// WithToken authenticates every call with a bearer token
+func WithToken(token string) Option {
+	return func(o *options) { o.token = token }
+}
+
+// WithTimeout bounds calls whose context has no deadline, including their
+// retries. Watches are not bounded.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) { o.timeout = d }
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *options) { o.retry = policy }
+}
+
+// WithDialOptions adds options to every connection, e.g. a custom dialer
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(o *options) { o.dialOpts = append(o.dialOpts, opts...) }
+}
+
+func loadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client key pair: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// tokenCredentials sends a bearer token with every call
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+// Client calls the ContainerService of a control plane. Connections are
+// opened on first use and shared by all calls to the same endpoint, or
+// taken from a Pool. It is safe for concurrent use.
+type Client struct {
+	opts     options
+	dialOpts []grpc.DialOption
+	// pool holds the connections of clients created by Pool.Client
+	pool *Pool
+
+	mu sync.Mutex
+	// endpoints are tried in order, starting at current, which is moved
+	// on when one is unavailable and to the leader when redirected
+	endpoints []string
+	current   int
+	conns     map[string]*grpc.ClientConn
+	closed    bool
+}
+
+// New creates a client for the control plane at endpoints, e.g.
+// "10.0.0.1:50051". Connections are opened lazily, so New does not fail
+// for unreachable endpoints.
+func New(endpoints []string, opts ...Option) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("client: no endpoints")
+	}
+	o, dialOpts, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		opts:      o,
+		dialOpts:  dialOpts,
+		endpoints: append([]string(nil), endpoints...),
+		conns:     make(map[string]*grpc.ClientConn),
+	}, nil
+}
+
+// newOptions applies opts, returning them with the dial options they
+// make up
+func newOptions(opts []Option) (options, []grpc.DialOption, error) {
+	o := options{retry: DefaultRetryPolicy()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.tlsErr != nil {
+		return o, nil, o.tlsErr
+	}
+	if o.retry.MaxAttempts < 1 {
+		o.retry.MaxAttempts = 1
+	}
+
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if o.tls != nil {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(o.tls))}
+	}
+	if o.token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(tokenCredentials{token: o.token, secure: o.tls != nil}))
+	}
+	return o, append(dialOpts, o.dialOpts...), nil
+}
+
+// Close closes all connections, but those of a Pool. Calls in progress
+// fail.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	var errs []error
+	for addr, conn := range c.conns {
+		errs = append(errs, conn.Close())
+		delete(c.conns, addr)
+	}
+	return errors.Join(errs...)
+}
+
+// Endpoint returns the endpoint calls currently go to
+func (c *Client) Endpoint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints[c.current]
+}
+
+// Nodes returns a NodeService stub for the current endpoint, sharing its
+// connection. Its calls are neither retried nor redirected to the leader,
+// and the timeout doesn't apply.
+func (c *Client) Nodes() (pb.NodeServiceClient, error) {
+	conn, _, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewNodeServiceClient(conn), nil
+}
+
+// Chaos returns a ChaosService stub for the current endpoint, sharing its
+// connection, like Nodes
+func (c *Client) Chaos() (pb.ChaosServiceClient, error) {
+	conn, _, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewChaosServiceClient(conn), nil
+}
+
+// Images returns an ImageService stub for the current endpoint, sharing
+// its connection, like Nodes
+func (c *Client) Images() (pb.ImageServiceClient, error) {
+	conn, _, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewImageServiceClient(conn), nil
+}
+
+// Stats returns a StatsService stub for the current endpoint, sharing its
+// connection, like Nodes
+func (c *Client) Stats() (pb.StatsServiceClient, error) {
+	conn, _, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewStatsServiceClient(conn), nil
+}
+
+// APIInfo returns the version and features of the control plane at the
+// current endpoint. Control planes older than the versioned API fail with
+// codes.Unimplemented. It is not retried.
+func (c *Client) APIInfo(ctx context.Context) (*pb.GetAPIInfoResponse, error) {
+	conn, _, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok && c.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.timeout)
+		defer cancel()
+	}
+	return pb.NewInfoServiceClient(conn).GetAPIInfo(ctx, &pb.GetAPIInfoRequest{})
+}
+
+// conn returns the connection to the current endpoint and its address
+func (c *Client) conn() (grpc.ClientConnInterface, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, "", errors.New("client: closed")
+	}
+	addr := c.endpoints[c.current]
+	if c.pool != nil {
+		conn, err := c.pool.Conn(addr)
+		return conn, addr, err
+	}
+	conn, ok := c.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = grpc.Dial(addr, c.dialOpts...); err != nil {
+			return nil, "", fmt.Errorf("client: failed to connect to %s: %w", addr, err)
+		}
+		c.conns[addr] = conn
+	}
+	return conn, addr, nil
+}
+
+// next moves on from the endpoint failed, unless another call did
+// already. It returns false when there is no other endpoint.
+func (c *Client) next(failed string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.endpoints[c.current] == failed {
+		c.current = (c.current + 1) % len(c.endpoints)
+	}
+	return len(c.endpoints) > 1
+}
+
+// follow makes leader the current endpoint, adding it if it is new
+func (c *Client) follow(leader string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, addr := range c.endpoints {
+		if addr == leader {
+			c.current = i
+			return
+		}
+	}
+	c.endpoints = append(c.endpoints, leader)
+	c.current = len(c.endpoints) - 1
+}
+
+// invoke runs fn with the configured timeout, see retry
+func (c *Client) invoke(ctx context.Context, idempotent bool, fn func(context.Context, pb.ContainerServiceClient) error) error {
+	if _, ok := ctx.Deadline(); !ok && c.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.timeout)
+		defer cancel()
+	}
+	return c.retry(ctx, idempotent, fn)
+}
+
+// retry runs fn against the ContainerService of the current endpoint,
+// see retryConn
+func (c *Client) retry(ctx context.Context, idempotent bool, fn func(context.Context, pb.ContainerServiceClient) error) error {
+	return c.retryConn(ctx, idempotent, func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		return fn(ctx, pb.NewContainerServiceClient(conn))
+	})
+}
+
+// retryConn runs fn against the current endpoint. Calls rejected by a
+// follower never reached the handler, so they are redirected to the
+// leader whether or not they are idempotent; only idempotent calls are
+// retried on codes.Unavailable and codes.ResourceExhausted, the latter no
+// sooner than the server's RetryInfo asks.
+func (c *Client) retryConn(ctx context.Context, idempotent bool, fn func(context.Context, grpc.ClientConnInterface) error) error {
+	backoff := c.opts.retry.InitialBackoff
+	attempt, redirects := 1, 0
+	for {
+		conn, addr, err := c.conn()
+		if err != nil {
+			return err
+		}
+		err = fn(ctx, conn)
+		if err == nil {
+			return nil
+		}
+
+		leader, notLeader := leaderAddress(err)
+		// delay is the least pause the server asked for
+		var delay time.Duration
+		switch {
+		case notLeader && redirects < maxRedirects:
+			redirects++
+			if leader != "" && leader != addr {
+				c.follow(leader)
+				continue
+			}
+			// No leader elected yet: ask another endpoint after a pause
+			c.next(addr)
+		case isDraining(err):
+			// Like redirects, draining rejections are safe to send
+			// elsewhere, but never back to the draining endpoint
+			if redirects >= maxRedirects || !c.next(addr) {
+				return err
+			}
+			redirects++
+			continue
+		case !notLeader && status.Code(err) == codes.Unavailable:
+			c.next(addr)
+			if !idempotent || attempt >= c.opts.retry.MaxAttempts {
+				return err
+			}
+			attempt++
+		case !notLeader && status.Code(err) == codes.ResourceExhausted:
+			if !idempotent || attempt >= c.opts.retry.MaxAttempts {
+				return err
+			}
+			attempt++
+			delay = retryDelay(err)
+		default:
+			return err
+		}
+
+		if err := sleep(ctx, max(jitter(backoff), delay)); err != nil {
+			return err
+		}
+		backoff = min(time.Duration(float64(backoff)*c.opts.retry.Multiplier), c.opts.retry.MaxBackoff)
+	}
+}
+
+// leaderAddress reports whether err was returned by a follower, and the
+// leader's address when one is elected
+func leaderAddress(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.FailedPrecondition {
+		return "", false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == notLeaderReason {
+			return info.Metadata["leader_address"], true
+		}
+	}
+	return "", false
+}
+
+// isDraining reports whether err was returned by a control plane that is
+// draining
+func isDraining(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Unavailable {
+		return false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == drainingReason {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay returns the delay the RetryInfo of a rate limited call asks
+// for, zero when it has none
+func retryDelay(err error) time.Duration {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			return info.GetRetryDelay().AsDuration()
+		}
+	}
+	return 0
+}
+
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (0.8 + 0.4*rand.Float64()))
+}
+
+// sleep waits for d, returning the context's status early when it is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// CreateContainer sets up networking for a container. It is only retried
+// when req has an idempotency key, since a retry without one could act on
+// a create that already succeeded.
+func (c *Client) CreateContainer(ctx context.Context, req *pb.CreateContainerRequest) (*pb.Container, error) {
+	var resp *pb.CreateContainerResponse
+	err := c.invoke(ctx, req.GetIdempotencyKey() != "", func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.CreateContainer(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Container, nil
+}
+
+// StartContainer has the node's container runtime start a created
+// container. Starting a running container returns it unchanged, so it is
+// retried.
+func (c *Client) StartContainer(ctx context.Context, id string) (*pb.Container, error) {
+	var resp *pb.StartContainerResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.StartContainer(ctx, &pb.StartContainerRequest{Id: id})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Container, nil
+}
+
+// StopContainer has the node's container runtime stop a container, killing
+// it if it has not exited after timeout; zero uses the server's default.
+// Stopping a stopped container returns it unchanged, so it is retried.
+func (c *Client) StopContainer(ctx context.Context, id string, timeout time.Duration) (*pb.Container, error) {
+	req := &pb.StopContainerRequest{Id: id}
+	if timeout > 0 {
+		req.Timeout = durationpb.New(timeout)
+	}
+	var resp *pb.StopContainerResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.StopContainer(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Container, nil
+}
+
+// DeleteContainer tears down a container's networking, first draining its
+// connections for up to drain, rounded up to whole seconds; zero tears it
+// down at once. It is not retried: a retry of a delete that succeeded
+// would fail with codes.NotFound.
+func (c *Client) DeleteContainer(ctx context.Context, id string, drain time.Duration) error {
+	req := &pb.DeleteContainerRequest{Id: id}
+	if drain > 0 {
+		req.DrainSeconds = uint32((drain + time.Second - 1) / time.Second)
+	}
+	return c.invoke(ctx, false, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		_, err := svc.DeleteContainer(ctx, req)
+		return err
+	})
+}
+
+// ListContainers returns all known containers
+func (c *Client) ListContainers(ctx context.Context) ([]*pb.Container, error) {
+	return c.ListContainersInNamespace(ctx, "")
+}
+
+// ListContainersInNamespace returns the containers of a namespace, all
+// known containers when it is empty
+func (c *Client) ListContainersInNamespace(ctx context.Context, namespace string) ([]*pb.Container, error) {
+	var resp *pb.ListContainersResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.ListContainers(ctx, &pb.ListContainersRequest{Namespace: namespace})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Containers, nil
+}
+
+// GetContainer returns a single container
+func (c *Client) GetContainer(ctx context.Context, id string) (*pb.Container, error) {
+	var resp *pb.GetContainerResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.GetContainer(ctx, &pb.GetContainerRequest{Id: id})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Container, nil
+}
+
+// ApplySpec replaces the spec the node is reconciled with, returning its
+// generation. Applying the same spec again changes nothing, so it is
+// retried.
+func (c *Client) ApplySpec(ctx context.Context, spec *pb.Spec) (uint64, error) {
+	var resp *pb.ApplySpecResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.ApplySpec(ctx, &pb.ApplySpecRequest{Spec: spec})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Generation, nil
+}
+
+// GetSpec returns the applied spec and how reconciling the node with it
+// went
+func (c *Client) GetSpec(ctx context.Context) (*pb.GetSpecResponse, error) {
+	var resp *pb.GetSpecResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.GetSpec(ctx, &pb.GetSpecRequest{})
+		return err
+	})
+	return resp, err
+}
+
+// CreateNamespace adds a namespace. It is not retried: a retry of a create
+// that succeeded would fail with codes.AlreadyExists.
+func (c *Client) CreateNamespace(ctx context.Context, ns *pb.Namespace) (*pb.Namespace, error) {
+	var resp *pb.CreateNamespaceResponse
+	err := c.invoke(ctx, false, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.CreateNamespace(ctx, &pb.CreateNamespaceRequest{Namespace: ns})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Namespace, nil
+}
+
+// UpdateNamespace replaces the namespaces allowed into a namespace and its
+// quota. Replacing them again changes nothing, so it is retried.
+func (c *Client) UpdateNamespace(ctx context.Context, name string, allowFrom []string, quota *pb.NamespaceQuota) (*pb.Namespace, error) {
+	var resp *pb.UpdateNamespaceResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.UpdateNamespace(ctx, &pb.UpdateNamespaceRequest{Name: name, AllowFrom: allowFrom, Quota: quota})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Namespace, nil
+}
+
+// DeleteNamespace removes an empty namespace. It is not retried, like
+// DeleteContainer.
+func (c *Client) DeleteNamespace(ctx context.Context, name string) error {
+	return c.invoke(ctx, false, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		_, err := svc.DeleteNamespace(ctx, &pb.DeleteNamespaceRequest{Name: name})
+		return err
+	})
+}
+
+// ListNamespaces returns the namespaces with their usage
+func (c *Client) ListNamespaces(ctx context.Context) ([]*pb.Namespace, error) {
+	var resp *pb.ListNamespacesResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.ListNamespaces(ctx, &pb.ListNamespacesRequest{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Namespaces, nil
+}
+
+// ListServices returns the services of a namespace, all services when it
+// is empty
+func (c *Client) ListServices(ctx context.Context, namespace string) ([]*pb.Service, error) {
+	var resp *pb.ListServicesResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.ListServices(ctx, &pb.ListServicesRequest{Namespace: namespace})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Services, nil
+}
+
+// ExportNetworkState returns the network state of a container for
+// ImportNetworkState on another node. It only reads, so it is retried.
+func (c *Client) ExportNetworkState(ctx context.Context, id string) ([]byte, error) {
+	var resp *pb.ExportNetworkStateResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.ExportNetworkState(ctx, &pb.ExportNetworkStateRequest{Id: id})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.State, nil
+}
+
+// ImportNetworkState creates a container from the exported network state
+// of another node's. It is not retried, like CreateContainer without an
+// idempotency key.
+func (c *Client) ImportNetworkState(ctx context.Context, req *pb.ImportNetworkStateRequest) (*pb.Container, error) {
+	var resp *pb.ImportNetworkStateResponse
+	err := c.invoke(ctx, false, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.ImportNetworkState(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Container, nil
+}
+
+// RenewLease renews the lease of a container's addresses. Renewing twice
+// does no harm, so it is retried.
+func (c *Client) RenewLease(ctx context.Context, id string) error {
+	return c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		_, err := svc.RenewLease(ctx, &pb.RenewLeaseRequest{Id: id})
+		return err
+	})
+}
+
+// VerifyContainerNetwork checks that the network of a container carries
+// traffic, waiting up to timeout for it to, or the node's readiness
+// timeout when zero. Verifying runs no change, so it is retried.
+func (c *Client) VerifyContainerNetwork(ctx context.Context, id string, timeout time.Duration) (*pb.ReadinessReport, error) {
+	req := &pb.VerifyContainerNetworkRequest{Id: id}
+	if timeout > 0 {
+		req.Timeout = durationpb.New(timeout)
+	}
+	var resp *pb.VerifyContainerNetworkResponse
+	err := c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		var err error
+		resp, err = svc.VerifyContainerNetwork(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Report, nil
+}
+
+// ProgramService creates, replaces or deletes a service on the node as
+// its leader distributes it. Programming the same service twice does no
+// harm, so it is retried.
+func (c *Client) ProgramService(ctx context.Context, req *pb.ProgramServiceRequest) error {
+	return c.invoke(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		_, err := svc.ProgramService(ctx, req)
+		return err
+	})
+}
+
+// Watch streams container events until ctx is done or the stream fails;
+// it is not resumed. With includeSnapshot, existing containers are sent
+// first, see pb.WatchEventsRequest. Opening the stream is retried.
+func (c *Client) Watch(ctx context.Context, includeSnapshot bool) (pb.ContainerService_WatchEventsClient, error) {
+	return c.watch(ctx, &pb.WatchEventsRequest{IncludeSnapshot: includeSnapshot})
+}
+
+// WatchAfter resumes a watch, streaming the events after the one with
+// sequence number after first. The stream fails with codes.OutOfRange
+// once those are no longer retained, in which case the caller should
+// Watch with a snapshot instead.
+func (c *Client) WatchAfter(ctx context.Context, after uint64) (pb.ContainerService_WatchEventsClient, error) {
+	return c.watch(ctx, &pb.WatchEventsRequest{AfterSequence: after})
+}
+
+// watch opens an event stream per req
+func (c *Client) watch(ctx context.Context, req *pb.WatchEventsRequest) (pb.ContainerService_WatchEventsClient, error) {
+	var stream pb.ContainerService_WatchEventsClient
+	// The stream lives as long as ctx, so the timeout doesn't apply
+	err := c.retry(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		s, err := svc.WatchEvents(ctx, req)
+		if err != nil {
+			return err
+		}
+		// Errors such as Unavailable only surface with the first message
+		// or header; wait for the header so they can be retried
+		if _, err := s.Header(); err != nil {
+			return err
+		}
+		stream = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// StreamLogs streams a container's log until it ends or, with req.Follow,
+// until ctx is done or the stream fails; it is not resumed. Opening the
+// stream is retried.
+func (c *Client) StreamLogs(ctx context.Context, req *pb.StreamLogsRequest) (pb.ContainerService_StreamLogsClient, error) {
+	var stream pb.ContainerService_StreamLogsClient
+	// The stream lives as long as ctx, so the timeout doesn't apply
+	err := c.retry(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		s, err := svc.StreamLogs(ctx, req)
+		if err != nil {
+			return err
+		}
+		// Wait for the header so errors such as Unavailable can be retried
+		if _, err := s.Header(); err != nil {
+			return err
+		}
+		stream = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Exec starts a command in a container, returning the call to pass its
+// input to and read its output and exit status from, see pb.ExecRequest.
+// Opening the call is not retried, as the command may have run, and the
+// timeout doesn't apply.
+func (c *Client) Exec(ctx context.Context, start *pb.ExecStart) (pb.ContainerService_ExecClient, error) {
+	var stream pb.ContainerService_ExecClient
+	err := c.retry(ctx, false, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		s, err := svc.Exec(ctx)
+		if err != nil {
+			return err
+		}
+		// A failed send shows as the error of the call
+		s.Send(&pb.ExecRequest{Request: &pb.ExecRequest_Start{Start: start}})
+		// The header is sent once the command runs
+		if _, err := s.Header(); err != nil {
+			return err
+		}
+		stream = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Attach attaches to the main process of a container, like Exec. Opening
+// the call is retried.
+func (c *Client) Attach(ctx context.Context, start *pb.AttachStart) (pb.ContainerService_AttachClient, error) {
+	var stream pb.ContainerService_AttachClient
+	err := c.retry(ctx, true, func(ctx context.Context, svc pb.ContainerServiceClient) error {
+		s, err := svc.Attach(ctx)
+		if err != nil {
+			return err
+		}
+		s.Send(&pb.AttachRequest{Request: &pb.AttachRequest_Start{Start: start}})
+		if _, err := s.Header(); err != nil {
+			return err
+		}
+		stream = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
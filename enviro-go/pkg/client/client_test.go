@@ -0,0 +1,228 @@
+package client
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// fastRetries retries quickly, so tests don't wait on backoff
+var fastRetries = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 2}
+
+func newFakeServer(t *testing.T) *FakeServer {
+	t.Helper()
+	f, err := NewFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newClient(t *testing.T, endpoints ...string) *Client {
+	t.Helper()
+	c, err := New(endpoints, WithRetryPolicy(fastRetries), WithTimeout(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// TestClient runs a container through its lifecycle against the fake
+// server
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, newFakeServer(t).Addr())
+
+	created, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "web", Name: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Ip != "10.88.0.2" || created.State != pb.ContainerState_CONTAINER_STATE_READY {
+		t.Errorf("CreateContainer() = %v", created)
+	}
+	if again, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "web"}); err != nil || again.Ip != created.Ip {
+		t.Errorf("CreateContainer() again = %v, %v, want %s", again, err, created.Ip)
+	}
+	if _, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "db"}); err != nil {
+		t.Fatal(err)
+	}
+	if started, err := c.StartContainer(ctx, "web"); err != nil || started.State != pb.ContainerState_CONTAINER_STATE_RUNNING {
+		t.Errorf("StartContainer() = %v, %v", started, err)
+	}
+	if err := c.DeleteContainer(ctx, "web", 0); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("DeleteContainer() of a running container = %v, want %v", err, codes.FailedPrecondition)
+	}
+	if stopped, err := c.StopContainer(ctx, "web", time.Second); err != nil || stopped.State != pb.ContainerState_CONTAINER_STATE_STOPPED {
+		t.Errorf("StopContainer() = %v, %v", stopped, err)
+	}
+	if err := c.DeleteContainer(ctx, "web", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetContainer(ctx, "web"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetContainer() of a deleted container = %v, want %v", err, codes.NotFound)
+	}
+	containers, err := c.ListContainers(ctx)
+	if err != nil || len(containers) != 1 || containers[0].Id != "db" {
+		t.Errorf("ListContainers() = %v, %v, want db", containers, err)
+	}
+
+	c.Close()
+	if _, err := c.ListContainers(ctx); err == nil {
+		t.Error("ListContainers() after Close succeeded")
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeServer(t)
+	c := newClient(t, f.Addr())
+	if _, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "web"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		code     codes.Code
+		failures int
+		call     func() error
+		want     codes.Code
+	}{
+		{name: "read", code: codes.Unavailable, failures: 2, call: func() error {
+			_, err := c.GetContainer(ctx, "web")
+			return err
+		}},
+		{name: "rate limited", code: codes.ResourceExhausted, failures: 2, call: func() error {
+			_, err := c.ListContainers(ctx)
+			return err
+		}},
+		{name: "attempts exhausted", code: codes.Unavailable, failures: 3, call: func() error {
+			_, err := c.GetContainer(ctx, "web")
+			return err
+		}, want: codes.Unavailable},
+		{name: "create without idempotency key", code: codes.Unavailable, failures: 1, call: func() error {
+			_, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "db"})
+			return err
+		}, want: codes.Unavailable},
+		{name: "create with idempotency key", code: codes.Unavailable, failures: 1, call: func() error {
+			_, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "db", IdempotencyKey: "k1"})
+			return err
+		}},
+		{name: "not retried", code: codes.Internal, failures: 1, call: func() error {
+			_, err := c.GetContainer(ctx, "web")
+			return err
+		}, want: codes.Internal},
+		{name: "watch", code: codes.Unavailable, failures: 2, call: func() error {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			_, err := c.Watch(ctx, false)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.FailNext(tt.code, tt.failures)
+			if err := tt.call(); status.Code(err) != tt.want {
+				t.Errorf("call = %v, want %v", err, tt.want)
+			}
+			// Drop failures the call didn't use
+			f.mu.Lock()
+			f.failures = nil
+			f.mu.Unlock()
+		})
+	}
+}
+
+// TestClientEndpoints moves on from an unavailable endpoint and follows a
+// follower's redirect to the leader
+func TestClientEndpoints(t *testing.T) {
+	ctx := context.Background()
+	leader, follower := newFakeServer(t), newFakeServer(t)
+	follower.SetLeader(leader.Addr())
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := lis.Addr().String()
+	lis.Close()
+
+	c := newClient(t, down, follower.Addr())
+	// Reads are served by the follower once the endpoint that is down is
+	// left behind
+	if _, err := c.ListContainers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Endpoint(); got != follower.Addr() {
+		t.Errorf("Endpoint() = %s, want the follower %s", got, follower.Addr())
+	}
+	// A mutation is redirected, even when not retried
+	if _, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Endpoint(); got != leader.Addr() {
+		t.Errorf("Endpoint() = %s, want the leader %s", got, leader.Addr())
+	}
+	if _, err := c.GetContainer(ctx, "web"); err != nil {
+		t.Errorf("GetContainer() from the leader = %v", err)
+	}
+
+	// Followers naming themselves are given up on after a few redirects
+	follower.SetLeader(follower.Addr())
+	c = newClient(t, follower.Addr())
+	if _, err := c.StartContainer(ctx, "web"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("StartContainer() without a leader = %v, want %v", err, codes.FailedPrecondition)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newClient(t, newFakeServer(t).Addr())
+	if _, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := c.Watch(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream is open once Watch returns, so the events of this create
+	// follow the snapshot
+	if _, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "db"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		typ pb.ContainerEventType
+		id  string
+	}{
+		{pb.ContainerEventType_CONTAINER_EVENT_TYPE_SNAPSHOT, "web"},
+		{pb.ContainerEventType_CONTAINER_EVENT_TYPE_SNAPSHOT_END, ""},
+		{pb.ContainerEventType_CONTAINER_EVENT_TYPE_CREATED, "db"},
+		{pb.ContainerEventType_CONTAINER_EVENT_TYPE_NETWORK_READY, "db"},
+	}
+	for _, w := range want {
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != w.typ || ev.ContainerId != w.id {
+			t.Errorf("event %v %q, want %v %q", ev.Type, ev.ContainerId, w.typ, w.id)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(nil); err == nil {
+		t.Error("New() without endpoints succeeded")
+	}
+	if _, err := New([]string{"127.0.0.1:1"}, WithTLSFiles(filepath.Join(t.TempDir(), "missing.pem"), "", "")); err == nil {
+		t.Error("New() with a missing CA file succeeded")
+	}
+}
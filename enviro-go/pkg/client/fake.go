@@ -0,0 +1,309 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// FakeServer is an in-memory ContainerService for tests of code using
+// Client. Containers are ready as soon as they are created and get
+// addresses from 10.88.0.0/16; nothing touches the host.
+type FakeServer struct {
+	pb.UnimplementedContainerServiceServer
+
+	server   *grpc.Server
+	listener net.Listener
+
+	mu         sync.Mutex
+	containers map[string]*pb.Container
+	next       netip.Addr
+	watchers   map[chan *pb.ContainerEvent]struct{}
+	// leader, when set, makes the server a follower rejecting mutations
+	leader   string
+	failures []error
+}
+
+// NewFakeServer starts a fake control plane on a random loopback port
+func NewFakeServer() (*FakeServer, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	f := &FakeServer{
+		server:     grpc.NewServer(),
+		listener:   lis,
+		containers: make(map[string]*pb.Container),
+		next:       netip.MustParseAddr("10.88.0.2"),
+		watchers:   make(map[chan *pb.ContainerEvent]struct{}),
+	}
+	pb.RegisterContainerServiceServer(f.server, f)
+	go f.server.Serve(lis)
+	return f, nil
+}
+
+// Addr returns the address to pass to New
+func (f *FakeServer) Addr() string {
+	return f.listener.Addr().String()
+}
+
+// Close stops the server, ending open watches
+func (f *FakeServer) Close() {
+	f.server.Stop()
+}
+
+// SetLeader makes the server a follower of the control plane at addr:
+// mutations fail like on a real follower, naming addr as the leader. An
+// empty addr makes it the leader again.
+func (f *FakeServer) SetLeader(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.leader = addr
+}
+
+// FailNext makes the next n calls fail with code, before they are handled
+func (f *FakeServer) FailNext(code codes.Code, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := 0; i < n; i++ {
+		f.failures = append(f.failures, status.Error(code, "injected failure"))
+	}
+}
+
+// begin returns the injected failure for the next call, if any, or the
+// redirect of a follower for mutations. Callers must hold f.mu.
+func (f *FakeServer) begin(mutation bool) error {
+	if len(f.failures) > 0 {
+		err := f.failures[0]
+		f.failures = f.failures[1:]
+		return err
+	}
+	if mutation && f.leader != "" {
+		st, _ := status.New(codes.FailedPrecondition, "not the leader").WithDetails(&errdetails.ErrorInfo{
+			Reason:   notLeaderReason,
+			Domain:   "enviro.api",
+			Metadata: map[string]string{"leader_address": f.leader},
+		})
+		return st.Err()
+	}
+	return nil
+}
+
+// publish sends ev to all watchers, dropping it for those that are behind.
+// Callers must hold f.mu.
+func (f *FakeServer) publish(typ pb.ContainerEventType, c *pb.Container) {
+	ev := &pb.ContainerEvent{
+		Type:        typ,
+		ContainerId: c.Id,
+		Timestamp:   timestamppb.Now(),
+		Ip:          c.Ip,
+	}
+	if typ != pb.ContainerEventType_CONTAINER_EVENT_TYPE_DELETED {
+		ev.Container = proto.Clone(c).(*pb.Container)
+	}
+	for ch := range f.watchers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// CreateContainer registers a ready container. Creating an existing
+// container returns it unchanged.
+func (f *FakeServer) CreateContainer(ctx context.Context, req *pb.CreateContainerRequest) (*pb.CreateContainerResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.begin(true); err != nil {
+		return nil, err
+	}
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "container id is required")
+	}
+	if c, ok := f.containers[req.GetId()]; ok {
+		return &pb.CreateContainerResponse{Container: proto.Clone(c).(*pb.Container)}, nil
+	}
+	c := &pb.Container{
+		Id:        req.GetId(),
+		Name:      req.GetName(),
+		Ip:        f.next.String(),
+		Mtu:       req.GetMtu(),
+		State:     pb.ContainerState_CONTAINER_STATE_READY,
+		CreatedAt: timestamppb.Now(),
+	}
+	f.next = f.next.Next()
+	f.containers[c.Id] = c
+	f.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_CREATED, c)
+	f.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NETWORK_READY, c)
+	return &pb.CreateContainerResponse{Container: proto.Clone(c).(*pb.Container)}, nil
+}
+
+// StartContainer marks a container running
+func (f *FakeServer) StartContainer(ctx context.Context, req *pb.StartContainerRequest) (*pb.StartContainerResponse, error) {
+	c, err := f.setRunning(req.GetId(), true)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.StartContainerResponse{Container: c}, nil
+}
+
+// StopContainer marks a running container stopped
+func (f *FakeServer) StopContainer(ctx context.Context, req *pb.StopContainerRequest) (*pb.StopContainerResponse, error) {
+	c, err := f.setRunning(req.GetId(), false)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.StopContainerResponse{Container: c}, nil
+}
+
+// setRunning starts or stops container id, leaving it unchanged when it
+// already is or, when stopping, it isn't running
+func (f *FakeServer) setRunning(id string, running bool) (*pb.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.begin(true); err != nil {
+		return nil, err
+	}
+	c, ok := f.containers[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", id)
+	}
+	if running != (c.State == pb.ContainerState_CONTAINER_STATE_RUNNING) {
+		c.State = pb.ContainerState_CONTAINER_STATE_STOPPED
+		typ := pb.ContainerEventType_CONTAINER_EVENT_TYPE_STOPPED
+		if running {
+			c.State = pb.ContainerState_CONTAINER_STATE_RUNNING
+			typ = pb.ContainerEventType_CONTAINER_EVENT_TYPE_STARTED
+		}
+		f.publish(typ, c)
+	}
+	return proto.Clone(c).(*pb.Container), nil
+}
+
+// DeleteContainer removes a container. Running containers have to be
+// stopped first.
+func (f *FakeServer) DeleteContainer(ctx context.Context, req *pb.DeleteContainerRequest) (*pb.DeleteContainerResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.begin(true); err != nil {
+		return nil, err
+	}
+	c, ok := f.containers[req.GetId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetId())
+	}
+	if c.State == pb.ContainerState_CONTAINER_STATE_RUNNING {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %q is running, stop it first", c.Id)
+	}
+	delete(f.containers, c.Id)
+	f.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_DELETED, c)
+	return &pb.DeleteContainerResponse{}, nil
+}
+
+// ListContainers returns all containers, sorted by ID
+func (f *FakeServer) ListContainers(ctx context.Context, req *pb.ListContainersRequest) (*pb.ListContainersResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.begin(false); err != nil {
+		return nil, err
+	}
+	return &pb.ListContainersResponse{Containers: f.sorted()}, nil
+}
+
+// GetContainer returns a single container
+func (f *FakeServer) GetContainer(ctx context.Context, req *pb.GetContainerRequest) (*pb.GetContainerResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.begin(false); err != nil {
+		return nil, err
+	}
+	c, ok := f.containers[req.GetId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetId())
+	}
+	return &pb.GetContainerResponse{Container: proto.Clone(c).(*pb.Container)}, nil
+}
+
+// WatchEvents streams events until the client goes away or Close
+func (f *FakeServer) WatchEvents(req *pb.WatchEventsRequest, stream pb.ContainerService_WatchEventsServer) error {
+	f.mu.Lock()
+	if err := f.begin(false); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	ch := make(chan *pb.ContainerEvent, 64)
+	f.watchers[ch] = struct{}{}
+	var snapshot []*pb.ContainerEvent
+	if req.GetIncludeSnapshot() {
+		for _, c := range f.sorted() {
+			snapshot = append(snapshot, &pb.ContainerEvent{
+				Type:        pb.ContainerEventType_CONTAINER_EVENT_TYPE_SNAPSHOT,
+				ContainerId: c.Id,
+				Timestamp:   timestamppb.Now(),
+				Ip:          c.Ip,
+				Container:   c,
+			})
+		}
+		snapshot = append(snapshot, &pb.ContainerEvent{
+			Type:      pb.ContainerEventType_CONTAINER_EVENT_TYPE_SNAPSHOT_END,
+			Timestamp: timestamppb.Now(),
+		})
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.watchers, ch)
+		f.mu.Unlock()
+	}()
+
+	// Let the client see the stream is open before any event
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for _, ev := range snapshot {
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case ev := <-ch:
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sorted returns copies of the containers, sorted by ID. Callers must hold
+// f.mu.
+func (f *FakeServer) sorted() []*pb.Container {
+	containers := make([]*pb.Container, 0, len(f.containers))
+	for _, c := range f.containers {
+		containers = append(containers, proto.Clone(c).(*pb.Container))
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Id < containers[j].Id
+	})
+	return containers
+}
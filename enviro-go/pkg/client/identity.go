@@ -0,0 +1,245 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// AllocateIdentity returns the identity of a label set, referenced by
+// holder, e.g. "node-a/<container id>". Allocating again for the same
+// holder returns the same identity, so it is retried, and redirected to
+// the leader, which alone allocates.
+func (c *Client) AllocateIdentity(ctx context.Context, labels map[string]string, holder string) (*pb.Identity, error) {
+	var resp *pb.AllocateIdentityResponse
+	err := c.invokeNodes(ctx, func(ctx context.Context, nodes pb.NodeServiceClient) error {
+		var err error
+		resp, err = nodes.AllocateIdentity(ctx, &pb.AllocateIdentityRequest{Labels: labels, Holder: holder})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Identity, nil
+}
+
+// ReleaseIdentity drops the reference of holder to identity id. Releasing
+// again is a no-op, so it is retried like AllocateIdentity.
+func (c *Client) ReleaseIdentity(ctx context.Context, id uint32, holder string) (*pb.Identity, error) {
+	var resp *pb.ReleaseIdentityResponse
+	err := c.invokeNodes(ctx, func(ctx context.Context, nodes pb.NodeServiceClient) error {
+		var err error
+		resp, err = nodes.ReleaseIdentity(ctx, &pb.ReleaseIdentityRequest{Id: id, Holder: holder})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Identity, nil
+}
+
+// WatchIdentities streams the changes to the identities after revision
+// after, starting with a RESET and the whole table for 0 or a revision
+// the control plane no longer retains. Opening the stream is retried.
+func (c *Client) WatchIdentities(ctx context.Context, after uint64) (pb.NodeService_WatchIdentitiesClient, error) {
+	var stream pb.NodeService_WatchIdentitiesClient
+	// The stream lives as long as ctx, so the timeout doesn't apply
+	err := c.retryConn(ctx, true, func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		s, err := pb.NewNodeServiceClient(conn).WatchIdentities(ctx, &pb.WatchIdentitiesRequest{AfterRevision: after})
+		if err != nil {
+			return err
+		}
+		if _, err := s.Header(); err != nil {
+			return err
+		}
+		stream = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// invokeNodes runs an idempotent NodeService call with the configured
+// timeout, see retryConn
+func (c *Client) invokeNodes(ctx context.Context, fn func(context.Context, pb.NodeServiceClient) error) error {
+	if _, ok := ctx.Deadline(); !ok && c.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.timeout)
+		defer cancel()
+	}
+	return c.retryConn(ctx, true, func(ctx context.Context, conn grpc.ClientConnInterface) error {
+		return fn(ctx, pb.NewNodeServiceClient(conn))
+	})
+}
+
+// IdentityCache holds the identities of the control plane for a node
+// agent, kept up to date by Run. Identities collected by the control plane
+// are dropped, so a number reused by a stale entry never resolves.
+type IdentityCache struct {
+	client *Client
+
+	mu       sync.RWMutex
+	revision uint64
+	byID     map[uint32]*pb.Identity
+	byLabels map[string]uint32
+	// synced is closed once the first table is received
+	synced chan struct{}
+}
+
+// NewIdentityCache returns an empty cache of the identities of the control
+// plane c talks to
+func NewIdentityCache(c *Client) *IdentityCache {
+	return &IdentityCache{
+		client:   c,
+		byID:     make(map[uint32]*pb.Identity),
+		byLabels: make(map[string]uint32),
+		synced:   make(chan struct{}),
+	}
+}
+
+// Run follows the changes to the identities until ctx is done, resuming
+// from the last revision applied when the stream fails
+func (c *IdentityCache) Run(ctx context.Context) error {
+	backoff := c.client.opts.retry.InitialBackoff
+	for {
+		stream, err := c.client.WatchIdentities(ctx, c.Revision())
+		if err == nil {
+			backoff = c.client.opts.retry.InitialBackoff
+			for {
+				var ev *pb.IdentityEvent
+				if ev, err = stream.Recv(); err != nil {
+					break
+				}
+				c.Apply(ev)
+			}
+		}
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		if code := status.Code(err); code == codes.PermissionDenied || code == codes.Unauthenticated || code == codes.Unimplemented {
+			return err
+		}
+		if err := sleep(ctx, jitter(backoff)); err != nil {
+			return err
+		}
+		backoff = min(time.Duration(float64(backoff)*c.client.opts.retry.Multiplier), c.client.opts.retry.MaxBackoff)
+	}
+}
+
+// Synced returns a channel closed once the cache holds the whole table
+func (c *IdentityCache) Synced() <-chan struct{} {
+	return c.synced
+}
+
+// Apply applies an event of WatchIdentities. Changes the cache already
+// holds are ignored; a RESET empties it for the table that follows.
+func (c *IdentityCache) Apply(ev *pb.IdentityEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch ev.Type {
+	case pb.IdentityEventType_IDENTITY_EVENT_TYPE_RESET:
+		c.byID = make(map[uint32]*pb.Identity)
+		c.byLabels = make(map[string]uint32)
+		c.revision = ev.Revision
+		select {
+		case <-c.synced:
+		default:
+			close(c.synced)
+		}
+		return
+	case pb.IdentityEventType_IDENTITY_EVENT_TYPE_PUT:
+		// The table following a RESET is at its revision
+		if ev.Revision < c.revision {
+			return
+		}
+		c.put(ev.Identity)
+	case pb.IdentityEventType_IDENTITY_EVENT_TYPE_DELETE:
+		if ev.Revision <= c.revision {
+			return
+		}
+		if old, ok := c.byID[ev.Identity.GetId()]; ok && old.Revision <= ev.Revision {
+			c.remove(old.Id)
+		}
+	default:
+		return
+	}
+	c.revision = ev.Revision
+}
+
+// put caches id unless a later revision of it is. Callers must hold c.mu.
+func (c *IdentityCache) put(id *pb.Identity) {
+	if old, ok := c.byID[id.GetId()]; ok && old.Revision > id.Revision {
+		return
+	}
+	c.remove(id.GetId())
+	c.byID[id.GetId()] = id
+	c.byLabels[labelsKey(id.GetLabels())] = id.GetId()
+}
+
+// remove drops identity id. Callers must hold c.mu.
+func (c *IdentityCache) remove(id uint32) {
+	old, ok := c.byID[id]
+	if !ok {
+		return
+	}
+	delete(c.byID, id)
+	// The labels may have a new identity since
+	if key := labelsKey(old.GetLabels()); c.byLabels[key] == id {
+		delete(c.byLabels, key)
+	}
+}
+
+// Revision returns the revision of the last change applied
+func (c *IdentityCache) Revision() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.revision
+}
+
+// Lookup returns the cached identity id
+func (c *IdentityCache) Lookup(id uint32) (*pb.Identity, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ident, ok := c.byID[id]
+	return ident, ok
+}
+
+// LookupLabels returns the cached identity of labels
+func (c *IdentityCache) LookupLabels(labels map[string]string) (*pb.Identity, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.byLabels[labelsKey(labels)]
+	if !ok {
+		return nil, false
+	}
+	return c.byID[id], true
+}
+
+// Allocate allocates the identity of labels for holder and caches it
+// ahead of its change on the watch, which Run still resumes from
+func (c *IdentityCache) Allocate(ctx context.Context, labels map[string]string, holder string) (*pb.Identity, error) {
+	id, err := c.client.AllocateIdentity(ctx, labels, holder)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.put(id)
+	c.mu.Unlock()
+	return id, nil
+}
+
+// labelsKey identifies a label set in the cache
+func labelsKey(labels map[string]string) string {
+	// Maps encode with sorted keys
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
@@ -0,0 +1,375 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/stats"
+)
+
+// Pool defaults, see PoolConfig
+const (
+	DefaultPoolMaxConns         = 4
+	DefaultPoolStreamsPerConn   = 100
+	DefaultPoolKeepaliveTime    = 5 * time.Minute
+	DefaultPoolKeepaliveTimeout = 20 * time.Second
+	DefaultPoolIdleTimeout      = 30 * time.Minute
+	DefaultPoolMinBackoff       = 100 * time.Millisecond
+	DefaultPoolMaxBackoff       = 10 * time.Second
+)
+
+// errPoolClosed fails calls through a closed Pool
+var errPoolClosed = errors.New("client: pool closed")
+
+// PoolConfig tunes a Pool. Zero values use the defaults.
+type PoolConfig struct {
+	// MaxConnsPerPeer bounds the connections to each peer. A peer starts
+	// with one, and another is dialed whenever each has StreamsPerConn
+	// calls in flight.
+	MaxConnsPerPeer int `json:"max_conns_per_peer"`
+	StreamsPerConn  int `json:"streams_per_conn"`
+	// KeepaliveTime pings a peer after this long without activity, and
+	// KeepaliveTimeout closes the connection when the ping isn't answered
+	// in time. Servers reject pings more frequent than their keepalive
+	// min_time, 5 minutes unless configured.
+	KeepaliveTime    time.Duration `json:"keepalive_time"`
+	KeepaliveTimeout time.Duration `json:"keepalive_timeout"`
+	// IdleTimeout closes connections without calls for this long; the
+	// next call dials them again
+	IdleTimeout time.Duration `json:"idle_timeout"`
+	// MinBackoff and MaxBackoff bound the exponential backoff, with 20%
+	// jitter, between attempts to reconnect to a peer
+	MinBackoff time.Duration `json:"min_backoff"`
+	MaxBackoff time.Duration `json:"max_backoff"`
+}
+
+// Validate rejects negative values
+func (c PoolConfig) Validate() error {
+	if c.MaxConnsPerPeer < 0 || c.StreamsPerConn < 0 {
+		return errors.New("max_conns_per_peer and streams_per_conn must not be negative")
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"keepalive_time", c.KeepaliveTime},
+		{"keepalive_timeout", c.KeepaliveTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"min_backoff", c.MinBackoff},
+		{"max_backoff", c.MaxBackoff},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("%s must not be negative", d.name)
+		}
+	}
+	if c.MinBackoff > 0 && c.MaxBackoff > 0 && c.MinBackoff > c.MaxBackoff {
+		return errors.New("min_backoff exceeds max_backoff")
+	}
+	return nil
+}
+
+func (c PoolConfig) withDefaults() PoolConfig {
+	if c.MaxConnsPerPeer == 0 {
+		c.MaxConnsPerPeer = DefaultPoolMaxConns
+	}
+	if c.StreamsPerConn == 0 {
+		c.StreamsPerConn = DefaultPoolStreamsPerConn
+	}
+	if c.KeepaliveTime == 0 {
+		c.KeepaliveTime = DefaultPoolKeepaliveTime
+	}
+	if c.KeepaliveTimeout == 0 {
+		c.KeepaliveTimeout = DefaultPoolKeepaliveTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultPoolIdleTimeout
+	}
+	if c.MinBackoff == 0 {
+		c.MinBackoff = DefaultPoolMinBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = max(DefaultPoolMaxBackoff, c.MinBackoff)
+	}
+	return c
+}
+
+// Pool shares connections to the control planes of other nodes among
+// the clients it hands out. Connections to a peer are dialed on its first
+// call and multiplex calls as HTTP/2 streams; each call goes to the
+// connection with the fewest calls in flight, preferring those that are
+// connected. Lost connections are reconnected with jittered backoff. It
+// is safe for concurrent use.
+type Pool struct {
+	config   PoolConfig
+	opts     options
+	dialOpts []grpc.DialOption
+
+	mu     sync.Mutex
+	peers  map[string]*peer
+	closed bool
+}
+
+// NewPool creates a pool dialing peers with opts, which also apply to the
+// clients of Client
+func NewPool(config PoolConfig, opts ...Option) (*Pool, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("client: invalid pool config: %w", err)
+	}
+	config = config.withDefaults()
+	o, dialOpts, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	dialOpts = append(dialOpts,
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    config.KeepaliveTime,
+			Timeout: config.KeepaliveTimeout,
+		}),
+		grpc.WithIdleTimeout(config.IdleTimeout),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  config.MinBackoff,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   config.MaxBackoff,
+			},
+			MinConnectTimeout: 20 * time.Second,
+		}),
+	)
+	return &Pool{
+		config:   config,
+		opts:     o,
+		dialOpts: dialOpts,
+		peers:    make(map[string]*peer),
+	}, nil
+}
+
+// Client returns a client of the control plane at addr whose calls go
+// over the pool's connections. Closing it leaves them open.
+func (p *Pool) Client(addr string) *Client {
+	return &Client{
+		opts:      p.opts,
+		pool:      p,
+		endpoints: []string{addr},
+		conns:     make(map[string]*grpc.ClientConn),
+	}
+}
+
+// Conn returns the connection to addr, which spreads each call over the
+// peer's connections
+func (p *Pool) Conn(addr string) (grpc.ClientConnInterface, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errPoolClosed
+	}
+	pr, ok := p.peers[addr]
+	if !ok {
+		pr = &peer{pool: p, addr: addr}
+		p.peers[addr] = pr
+	}
+	return pr, nil
+}
+
+// Close closes every connection. Calls in progress fail, as do later
+// ones.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	peers := p.peers
+	p.peers = make(map[string]*peer)
+	p.mu.Unlock()
+
+	var errs []error
+	for _, pr := range peers {
+		errs = append(errs, pr.close())
+	}
+	return errors.Join(errs...)
+}
+
+// PeerStats are the connections to a peer and the calls made over them
+type PeerStats struct {
+	Address string
+	// Conns counts the connections by connectivity state, e.g. "READY" or
+	// "TRANSIENT_FAILURE"
+	Conns    map[string]int
+	InFlight int64
+	// Calls and Failures count the calls finished, and those of them that
+	// failed
+	Calls    uint64
+	Failures uint64
+	// Connects counts the transports established, those beyond the number
+	// of connections being reconnects
+	Connects uint64
+}
+
+// Stats returns the statistics of each peer ordered by address
+func (p *Pool) Stats() []PeerStats {
+	p.mu.Lock()
+	peers := make([]*peer, 0, len(p.peers))
+	for _, pr := range p.peers {
+		peers = append(peers, pr)
+	}
+	p.mu.Unlock()
+
+	out := make([]PeerStats, 0, len(peers))
+	for _, pr := range peers {
+		out = append(out, pr.stats())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// peer is the connections to one address
+type peer struct {
+	pool *Pool
+	addr string
+
+	mu     sync.Mutex
+	conns  []*subConn
+	closed bool
+}
+
+// subConn is a connection to a peer, counting the calls over it
+type subConn struct {
+	conn     *grpc.ClientConn
+	inFlight atomic.Int64
+	calls    atomic.Uint64
+	failures atomic.Uint64
+	connects atomic.Uint64
+}
+
+// pick returns the connection for the next call, dialing another while
+// every connection is loaded
+func (pr *peer) pick() (*subConn, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.closed {
+		return nil, errPoolClosed
+	}
+	var best *subConn
+	bestRank := 0
+	for _, sc := range pr.conns {
+		rank := stateRank(sc.conn.GetState())
+		if best == nil || rank < bestRank || rank == bestRank && sc.inFlight.Load() < best.inFlight.Load() {
+			best, bestRank = sc, rank
+		}
+	}
+	if best != nil && best.inFlight.Load() < int64(pr.pool.config.StreamsPerConn) || len(pr.conns) >= pr.pool.config.MaxConnsPerPeer {
+		return best, nil
+	}
+
+	sc := &subConn{}
+	conn, err := grpc.Dial(pr.addr, append(pr.pool.dialOpts, grpc.WithStatsHandler(sc))...)
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, fmt.Errorf("client: failed to connect to %s: %w", pr.addr, err)
+	}
+	sc.conn = conn
+	pr.conns = append(pr.conns, sc)
+	return sc, nil
+}
+
+// stateRank orders connectivity states by how soon a call would be sent
+func stateRank(s connectivity.State) int {
+	switch s {
+	case connectivity.Ready:
+		return 0
+	case connectivity.Idle, connectivity.Connecting:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Invoke implements grpc.ClientConnInterface
+func (pr *peer) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	sc, err := pr.pick()
+	if err != nil {
+		return err
+	}
+	return sc.conn.Invoke(ctx, method, args, reply, opts...)
+}
+
+// NewStream implements grpc.ClientConnInterface. The stream stays on the
+// connection it was opened on.
+func (pr *peer) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	sc, err := pr.pick()
+	if err != nil {
+		return nil, err
+	}
+	return sc.conn.NewStream(ctx, desc, method, opts...)
+}
+
+func (pr *peer) stats() PeerStats {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	s := PeerStats{Address: pr.addr, Conns: make(map[string]int)}
+	for _, sc := range pr.conns {
+		s.Conns[sc.conn.GetState().String()]++
+		s.InFlight += sc.inFlight.Load()
+		s.Calls += sc.calls.Load()
+		s.Failures += sc.failures.Load()
+		s.Connects += sc.connects.Load()
+	}
+	return s
+}
+
+func (pr *peer) close() error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pr.closed = true
+	var errs []error
+	for _, sc := range pr.conns {
+		errs = append(errs, sc.conn.Close())
+	}
+	pr.conns = nil
+	return errors.Join(errs...)
+}
+
+// TagRPC implements stats.Handler
+func (sc *subConn) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+// HandleRPC implements stats.Handler, counting the calls in flight
+func (sc *subConn) HandleRPC(_ context.Context, s stats.RPCStats) {
+	switch s := s.(type) {
+	case *stats.Begin:
+		sc.inFlight.Add(1)
+	case *stats.End:
+		sc.inFlight.Add(-1)
+		sc.calls.Add(1)
+		if s.Error != nil {
+			sc.failures.Add(1)
+		}
+	}
+}
+
+// TagConn implements stats.Handler
+func (sc *subConn) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn implements stats.Handler, counting the transports
+// established
+func (sc *subConn) HandleConn(_ context.Context, s stats.ConnStats) {
+	if _, ok := s.(*stats.ConnBegin); ok {
+		sc.connects.Add(1)
+	}
+}
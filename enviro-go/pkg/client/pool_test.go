@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func TestPoolConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config PoolConfig
+		// wantErr is part of the error, none if empty
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "set", config: PoolConfig{MaxConnsPerPeer: 2, StreamsPerConn: 10, MinBackoff: time.Second, MaxBackoff: time.Minute}},
+		{name: "only min backoff", config: PoolConfig{MinBackoff: time.Minute}},
+		{name: "negative conns", config: PoolConfig{MaxConnsPerPeer: -1}, wantErr: "max_conns_per_peer"},
+		{name: "negative streams", config: PoolConfig{StreamsPerConn: -1}, wantErr: "streams_per_conn"},
+		{name: "negative duration", config: PoolConfig{IdleTimeout: -time.Second}, wantErr: "idle_timeout must not be negative"},
+		{name: "backoff", config: PoolConfig{MinBackoff: time.Minute, MaxBackoff: time.Second}, wantErr: "min_backoff exceeds max_backoff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := NewPool(PoolConfig{StreamsPerConn: -1}); err == nil {
+		t.Error("NewPool() of an invalid config succeeded")
+	}
+	// The max backoff defaults to at least the min
+	if c := (PoolConfig{MinBackoff: time.Minute}).withDefaults(); c.MaxBackoff != time.Minute {
+		t.Errorf("max backoff %s with a min of 1m, want 1m", c.MaxBackoff)
+	}
+}
+
+// waitPeer waits for fn to accept the statistics of the only peer of p
+func waitPeer(t *testing.T, p *Pool, fn func(s PeerStats) bool) PeerStats {
+	t.Helper()
+	var stats []PeerStats
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if stats = p.Stats(); len(stats) == 1 && fn(stats[0]) {
+			return stats[0]
+		}
+	}
+	t.Fatalf("pool statistics %+v", stats)
+	return PeerStats{}
+}
+
+// TestPool makes calls over a pool, which dials another connection to the
+// peer once the first has its streams in flight
+func TestPool(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	fake, err := NewFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	p, err := NewPool(PoolConfig{MaxConnsPerPeer: 2, StreamsPerConn: 1}, WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	c := p.Client(fake.Addr())
+	if _, err := c.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	s := waitPeer(t, p, func(s PeerStats) bool { return s.Calls == 1 })
+	if s.Address != fake.Addr() || s.Conns["READY"] != 1 || s.Connects != 1 || s.Failures != 0 {
+		t.Errorf("statistics after a call %+v, want one ready connection", s)
+	}
+
+	// Each connection takes one stream before another is dialed, up to
+	// two
+	watchCtx, stopWatches := context.WithCancel(ctx)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Watch(watchCtx, false); err != nil {
+			t.Fatalf("watch %d: %v", i, err)
+		}
+	}
+	s = waitPeer(t, p, func(s PeerStats) bool { return s.InFlight == 3 })
+	if n := len(s.Conns); n != 1 || s.Conns["READY"] != 2 {
+		t.Errorf("connections with 3 streams in flight %v, want 2 ready", s.Conns)
+	}
+	stopWatches()
+	waitPeer(t, p, func(s PeerStats) bool { return s.InFlight == 0 && s.Calls == 4 })
+
+	// Failed calls are counted, and closing a client of the pool leaves
+	// its connections open
+	fake.FailNext(codes.NotFound, 1)
+	if _, err := c.GetContainer(ctx, "web"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetContainer() = %v, want the injected %s", err, codes.NotFound)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Client(fake.Addr()).GetContainer(ctx, "web"); err != nil {
+		t.Errorf("GetContainer() after closing another client = %v", err)
+	}
+	s = waitPeer(t, p, func(s PeerStats) bool { return s.Calls == 6 })
+	// The canceled watches failed too
+	if s.Failures != 4 || s.Connects != 2 {
+		t.Errorf("statistics %+v, want 4 failures over 2 connects", s)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Client(fake.Addr()).GetContainer(ctx, "web"); !errors.Is(err, errPoolClosed) {
+		t.Errorf("GetContainer() after Close = %v, want %v", err, errPoolClosed)
+	}
+	if stats := p.Stats(); len(stats) != 0 {
+		t.Errorf("statistics after Close %+v", stats)
+	}
+}
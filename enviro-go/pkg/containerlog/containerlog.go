@@ -0,0 +1,299 @@
+// Package containerlog reads container logs written by the runtime in the
+// CRI logging format, one entry per line:
+//
+//	2024-01-02T15:04:05.999999999Z stdout F hello world
+//
+// where the tag is F for a full line and P for part of a longer one. A
+// log can be read from the start or its last lines, and followed as it is
+// written, including across rotation.
+package containerlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Stream is the output stream of a log entry
+type Stream string
+
+const (
+	Stdout Stream = "stdout"
+	Stderr Stream = "stderr"
+)
+
+// ErrInvalidEntry is returned by ParseEntry for lines not in the CRI format
+var ErrInvalidEntry = errors.New("containerlog: invalid log entry")
+
+// DefaultPollInterval is how often a followed log is checked for new output
+const DefaultPollInterval = 250 * time.Millisecond
+
+// maxBatchSize bounds the bytes of the entries passed to one callback
+const maxBatchSize = 32 << 10
+
+// Entry is one line of container output, or part of one
+type Entry struct {
+	Time   time.Time
+	Stream Stream
+	// Partial is set for all but the last part of a line the runtime split
+	Partial bool
+	// Data is the output, with the newline unless Partial is set
+	Data []byte
+}
+
+// ParseEntry parses a log line without its trailing newline
+func ParseEntry(line []byte) (Entry, error) {
+	fields := bytes.SplitN(line, []byte(" "), 4)
+	if len(fields) < 3 {
+		return Entry{}, fmt.Errorf("%w: %q", ErrInvalidEntry, line)
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+	if err != nil {
+		return Entry{}, fmt.Errorf("%w: %v", ErrInvalidEntry, err)
+	}
+	e := Entry{Time: t, Stream: Stream(fields[1])}
+	if e.Stream != Stdout && e.Stream != Stderr {
+		return Entry{}, fmt.Errorf("%w: unknown stream %q", ErrInvalidEntry, fields[1])
+	}
+	switch string(fields[2]) {
+	case "P":
+		e.Partial = true
+	case "F":
+	default:
+		return Entry{}, fmt.Errorf("%w: unknown tag %q", ErrInvalidEntry, fields[2])
+	}
+	if len(fields) == 4 {
+		e.Data = fields[3]
+	}
+	if !e.Partial {
+		e.Data = append(e.Data, '\n')
+	}
+	return e, nil
+}
+
+// Options selects the entries Read passes on
+type Options struct {
+	// Follow keeps reading output as it is written until ctx is done
+	Follow bool
+	// Tail starts with the last Tail entries of the log, rather than all
+	Tail int
+	// Since skips entries written before it
+	Since time.Time
+	// Stream only passes entries of that stream, both when empty
+	Stream Stream
+	// PollInterval defaults to DefaultPollInterval
+	PollInterval time.Duration
+}
+
+// match reports whether e is selected by o
+func (o Options) match(e Entry) bool {
+	return (o.Stream == "" || e.Stream == o.Stream) && !e.Time.Before(o.Since)
+}
+
+// Read passes the entries of the log at path to fn in batches, in order.
+// fn is not called again until it returns, so a slow consumer holds back
+// reading rather than entries piling up. Lines that aren't valid entries
+// are skipped. A missing log has no entries, or when following is waited
+// for.
+func Read(ctx context.Context, path string, opts Options, fn func([]Entry) error) error {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	r := &reader{path: path, opts: opts, fn: fn}
+	defer r.close()
+
+	if err := r.open(); err != nil {
+		return err
+	}
+	if opts.Tail > 0 {
+		if err := r.tail(); err != nil {
+			return err
+		}
+	}
+	for {
+		if err := r.copy(); err != nil {
+			return err
+		}
+		if !opts.Follow {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(opts.PollInterval):
+		}
+		if err := r.reopenIfRotated(); err != nil {
+			return err
+		}
+	}
+}
+
+// reader is the state of one Read
+type reader struct {
+	path string
+	opts Options
+	fn   func([]Entry) error
+
+	// f is nil while the log doesn't exist
+	f  *os.File
+	br *bufio.Reader
+	// pending is the start of a line whose newline hasn't been written yet
+	pending []byte
+	// offset is how far f has been read
+	offset int64
+
+	batch     []Entry
+	batchSize int
+}
+
+// open opens the log if it exists
+func (r *reader) open() error {
+	f, err := os.Open(r.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.f = f
+	r.br = bufio.NewReader(f)
+	r.pending = nil
+	r.offset = 0
+	return nil
+}
+
+func (r *reader) close() {
+	if r.f != nil {
+		r.f.Close()
+	}
+}
+
+// next returns the next complete line, or io.EOF
+func (r *reader) next() ([]byte, error) {
+	if r.f == nil {
+		return nil, io.EOF
+	}
+	line, err := r.br.ReadBytes('\n')
+	r.offset += int64(len(line))
+	if err == io.EOF {
+		r.pending = append(r.pending, line...)
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(r.pending) > 0 {
+		line = append(r.pending, line...)
+		r.pending = nil
+	}
+	return bytes.TrimSuffix(line, []byte("\n")), nil
+}
+
+// tail reads the log up to its end, keeping the last matching entries
+// in a ring, and passes them on
+func (r *reader) tail() error {
+	var ring []Entry
+	start := 0
+	for {
+		line, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		e, err := ParseEntry(line)
+		if err != nil || !r.opts.match(e) {
+			continue
+		}
+		if len(ring) < r.opts.Tail {
+			ring = append(ring, e)
+		} else {
+			ring[start] = e
+			start = (start + 1) % len(ring)
+		}
+	}
+	for i := range ring {
+		if err := r.add(ring[(start+i)%len(ring)]); err != nil {
+			return err
+		}
+	}
+	return r.flush()
+}
+
+// copy passes on the matching entries up to the end of the log
+func (r *reader) copy() error {
+	for {
+		line, err := r.next()
+		if err == io.EOF {
+			return r.flush()
+		}
+		if err != nil {
+			return err
+		}
+		e, err := ParseEntry(line)
+		if err != nil || !r.opts.match(e) {
+			continue
+		}
+		if err := r.add(e); err != nil {
+			return err
+		}
+	}
+}
+
+// add appends e to the batch, passing the batch on once it is full
+func (r *reader) add(e Entry) error {
+	r.batch = append(r.batch, e)
+	r.batchSize += len(e.Data)
+	if r.batchSize >= maxBatchSize {
+		return r.flush()
+	}
+	return nil
+}
+
+func (r *reader) flush() error {
+	if len(r.batch) == 0 {
+		return nil
+	}
+	err := r.fn(r.batch)
+	r.batch = nil
+	r.batchSize = 0
+	return err
+}
+
+// reopenIfRotated starts over with the log at path when it was created,
+// replaced by rotation or truncated since it was opened. The rest of a
+// rotated log is read first.
+func (r *reader) reopenIfRotated() error {
+	fi, err := os.Stat(r.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.f != nil {
+		cur, err := r.f.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(fi, cur) && fi.Size() >= r.offset {
+			return nil
+		}
+		if os.SameFile(fi, cur) {
+			// Truncated, so the rest is gone
+			r.pending = nil
+		} else if err := r.copy(); err != nil {
+			return err
+		}
+		r.f.Close()
+		r.f = nil
+	}
+	return r.open()
+}
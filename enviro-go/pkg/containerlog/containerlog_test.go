@@ -0,0 +1,190 @@
+package containerlog
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+// line formats an entry written n seconds after start
+func line(n int, stream Stream, tag, data string) string {
+	return start.Add(time.Duration(n)*time.Second).Format(time.RFC3339Nano) + " " + string(stream) + " " + tag + " " + data + "\n"
+}
+
+// data joins the data of entries
+func data(entries []Entry) string {
+	var b strings.Builder
+	for _, e := range entries {
+		b.Write(e.Data)
+	}
+	return b.String()
+}
+
+func TestParseEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Entry
+		// wantErr is part of the error, none if empty
+		wantErr string
+	}{
+		{name: "full", line: "2024-01-02T15:04:05.5Z stdout F hello world",
+			want: Entry{Time: start.Add(500 * time.Millisecond), Stream: Stdout, Data: []byte("hello world\n")}},
+		{name: "partial", line: "2024-01-02T15:04:05Z stderr P hel",
+			want: Entry{Time: start, Stream: Stderr, Partial: true, Data: []byte("hel")}},
+		{name: "empty line", line: "2024-01-02T15:04:05Z stdout F", want: Entry{Time: start, Stream: Stdout, Data: []byte("\n")}},
+		{name: "too few fields", line: "2024-01-02T15:04:05Z stdout", wantErr: "invalid log entry"},
+		{name: "time", line: "yesterday stdout F hi", wantErr: "cannot parse"},
+		{name: "stream", line: "2024-01-02T15:04:05Z stdin F hi", wantErr: `unknown stream "stdin"`},
+		{name: "tag", line: "2024-01-02T15:04:05Z stdout X hi", wantErr: `unknown tag "X"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseEntry([]byte(tt.line))
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrInvalidEntry) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseEntry() = %v, want %v with %q", err, ErrInvalidEntry, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Time.Equal(tt.want.Time) {
+				t.Errorf("time %s, want %s", got.Time, tt.want.Time)
+			}
+			got.Time = tt.want.Time
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseEntry() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	log := line(0, Stdout, "F", "one") +
+		line(1, Stderr, "F", "two") +
+		"not an entry\n" +
+		line(2, Stdout, "P", "thr") +
+		line(2, Stdout, "F", "ee") +
+		line(3, Stderr, "F", "four")
+	path := filepath.Join(t.TempDir(), "web.log")
+	if err := os.WriteFile(path, []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{name: "all", want: "one\ntwo\nthree\nfour\n"},
+		{name: "tail", opts: Options{Tail: 2}, want: "ee\nfour\n"},
+		{name: "tail of more than the log", opts: Options{Tail: 10}, want: "one\ntwo\nthree\nfour\n"},
+		{name: "since", opts: Options{Since: start.Add(2 * time.Second)}, want: "three\nfour\n"},
+		{name: "stream", opts: Options{Stream: Stderr}, want: "two\nfour\n"},
+		{name: "tail of a stream", opts: Options{Stream: Stdout, Tail: 1}, want: "ee\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Entry
+			err := Read(context.Background(), path, tt.opts, func(entries []Entry) error {
+				got = append(got, entries...)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data(got) != tt.want {
+				t.Errorf("read %q, want %q", data(got), tt.want)
+			}
+		})
+	}
+
+	if err := Read(context.Background(), filepath.Join(t.TempDir(), "missing.log"), Options{}, func([]Entry) error {
+		t.Error("entries read from a missing log")
+		return nil
+	}); err != nil {
+		t.Errorf("Read() of a missing log = %v", err)
+	}
+	stop := errors.New("stop")
+	if err := Read(context.Background(), path, Options{}, func([]Entry) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("Read() = %v, want the callback's error", err)
+	}
+}
+
+// TestReadFollow follows a log as it is created, written in pieces,
+// rotated and truncated
+func TestReadFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web.log")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	read := make(chan string, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- Read(ctx, path, Options{Follow: true, PollInterval: time.Millisecond}, func(entries []Entry) error {
+			read <- data(entries)
+			return nil
+		})
+	}()
+	expect := func(want string) {
+		t.Helper()
+		var got string
+		for deadline := time.After(10 * time.Second); got != want; {
+			select {
+			case s := <-read:
+				got += s
+			case <-deadline:
+				t.Fatalf("read %q, want %q", got, want)
+			}
+		}
+	}
+	write := func(s string) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(line(0, Stdout, "F", "one"))
+	expect("one\n")
+
+	// Half a line is held until its newline is written
+	l := line(1, Stdout, "F", "two")
+	write(l[:10])
+	time.Sleep(20 * time.Millisecond)
+	write(l[10:])
+	expect("two\n")
+
+	// The rest of a rotated log is read before the new one
+	write(line(2, Stdout, "F", "three"))
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write(line(3, Stdout, "F", "four"))
+	expect("three\nfour\n")
+
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	write(line(4, Stdout, "F", "5"))
+	expect("5\n")
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Read() = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+)
+
+// DefaultWebhookTimeout bounds each call to an admission webhook unless
+// its Timeout says otherwise
+const DefaultWebhookTimeout = 10 * time.Second
+
+// maxWebhookResponse bounds the body read from an HTTP webhook
+const maxWebhookResponse = 1 << 20
+
+// ErrAdmissionDenied is wrapped by the errors of admission controllers
+// rejecting a request, which fails with codes.PermissionDenied. Other
+// errors fail it with codes.Unavailable, and gRPC status errors are
+// returned as they are.
+var ErrAdmissionDenied = errors.New("admission denied")
+
+// AdmissionController admits container requests before the control plane
+// carries them out, e.g. to forbid options or fill in defaults
+type AdmissionController interface {
+	// AdmitCreate rejects a CreateContainer request by returning an error,
+	// or mutates req. The mutated request is validated again; its id and
+	// idempotency key can't be changed.
+	AdmitCreate(ctx context.Context, req *pb.CreateContainerRequest) error
+	// AdmitStart rejects starting container c by returning an error
+	AdmitStart(ctx context.Context, c *pb.Container) error
+}
+
+// AdmissionConfig configures the admission controllers run before
+// containers are created and started, including by ApplySpec. Containers
+// placed on a node are admitted by the leader and again by the node.
+// Mutating a container of ApplySpec makes it drift from the spec, so it
+// is recreated on every pass unless the spec agrees with the mutation.
+type AdmissionConfig struct {
+	// Controllers run in process, in order, before the webhooks
+	Controllers []AdmissionController `json:"-"`
+	// Webhooks are called in order, each seeing the mutations of those
+	// before it
+	Webhooks []WebhookConfig `json:"webhooks"`
+}
+
+// WebhookConfig configures an admission webhook, which is sent an
+// AdmissionRequest and answers with an AdmissionResponse, see
+// pkg/api/v1/admission.proto
+type WebhookConfig struct {
+	// Name identifies the webhook in logs and errors
+	Name string `json:"name"`
+	// URL of a webhook served over HTTP, which the request is POSTed to
+	// as JSON, e.g. "https://policy.internal/admit"
+	URL string `json:"url"`
+	// Address of a webhook served over gRPC as the AdmissionWebhook
+	// service, e.g. "policy.internal:8443". Exactly one of URL and
+	// Address is set.
+	Address string `json:"address"`
+	// CAFile verifies the webhook's certificate instead of the system
+	// roots. gRPC webhooks are called over TLS only when it is set.
+	CAFile string `json:"ca_file"`
+	// Operations limits the webhook to "create" or "start" requests; it
+	// is called for both when empty
+	Operations []string `json:"operations"`
+	// Timeout bounds each call, DefaultWebhookTimeout when zero
+	Timeout time.Duration `json:"timeout"`
+	// FailOpen admits requests when the webhook fails or can't be
+	// reached, instead of rejecting them with codes.Unavailable
+	FailOpen bool `json:"fail_open"`
+}
+
+// webhookOperations are the values of WebhookConfig.Operations
+var webhookOperations = map[string]pb.AdmissionOperation{
+	"create": pb.AdmissionOperation_ADMISSION_OPERATION_CREATE,
+	"start":  pb.AdmissionOperation_ADMISSION_OPERATION_START,
+}
+
+func (c AdmissionConfig) validate() error {
+	names := make(map[string]bool, len(c.Webhooks))
+	for i, w := range c.Webhooks {
+		if w.Name == "" {
+			return fmt.Errorf("webhook %d: name is required", i+1)
+		}
+		if names[w.Name] {
+			return fmt.Errorf("webhook %s is configured twice", w.Name)
+		}
+		names[w.Name] = true
+		if (w.URL == "") == (w.Address == "") {
+			return fmt.Errorf("webhook %s needs one of url and address", w.Name)
+		}
+		if w.URL != "" {
+			u, err := url.Parse(w.URL)
+			if err != nil {
+				return fmt.Errorf("webhook %s: %w", w.Name, err)
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return fmt.Errorf("webhook %s: url must be http or https", w.Name)
+			}
+		}
+		for _, op := range w.Operations {
+			if _, ok := webhookOperations[op]; !ok {
+				return fmt.Errorf("webhook %s: unknown operation %q, want create or start", w.Name, op)
+			}
+		}
+		if w.Timeout < 0 {
+			return fmt.Errorf("webhook %s: timeout must not be negative", w.Name)
+		}
+	}
+	return nil
+}
+
+// admission runs the admission controllers and webhooks in order
+type admission struct {
+	controllers []AdmissionController
+	webhooks    []*webhook
+	log         *slog.Logger
+}
+
+// newAdmission loads the CAs of the webhooks. gRPC webhooks are dialed
+// when first called.
+func newAdmission(config AdmissionConfig, logger *slog.Logger) (*admission, error) {
+	a := &admission{controllers: config.Controllers, log: logger}
+	for _, wc := range config.Webhooks {
+		w, err := newWebhook(wc, logger)
+		if err != nil {
+			return nil, err
+		}
+		a.webhooks = append(a.webhooks, w)
+		a.controllers = append(a.controllers, w)
+	}
+	return a, nil
+}
+
+// admitCreate runs the controllers on a copy of req, returning the
+// request they admitted
+func (a *admission) admitCreate(ctx context.Context, req *pb.CreateContainerRequest) (*pb.CreateContainerRequest, error) {
+	if len(a.controllers) == 0 {
+		return req, nil
+	}
+	logger := logging.FromContext(ctx, a.log).With("container_id", req.Id)
+	admitted := proto.Clone(req).(*pb.CreateContainerRequest)
+	for _, c := range a.controllers {
+		if err := c.AdmitCreate(ctx, admitted); err != nil {
+			logger.Warn("Rejected container create", "error", err)
+			return nil, admissionError(err)
+		}
+	}
+	if admitted.Id != req.Id || admitted.IdempotencyKey != req.IdempotencyKey {
+		logger.Error("Admission changed the container id or idempotency key", "admitted_id", admitted.Id)
+		return nil, status.Error(codes.Internal, "admission changed the container id or idempotency key")
+	}
+	if !proto.Equal(admitted, req) {
+		logger.Info("Admission mutated container create")
+	}
+	return admitted, nil
+}
+
+// admitStart runs the controllers on a copy of c
+func (a *admission) admitStart(ctx context.Context, c *pb.Container) error {
+	for _, ctrl := range a.controllers {
+		if err := ctrl.AdmitStart(ctx, proto.Clone(c).(*pb.Container)); err != nil {
+			logging.FromContext(ctx, a.log).Warn("Rejected container start", "container_id", c.Id, "error", err)
+			return admissionError(err)
+		}
+	}
+	return nil
+}
+
+// close closes the connections to gRPC webhooks
+func (a *admission) close() error {
+	var errs []error
+	for _, w := range a.webhooks {
+		errs = append(errs, w.close())
+	}
+	return errors.Join(errs...)
+}
+
+// admissionError maps the errors of admission controllers to gRPC status
+// codes
+func admissionError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, ErrAdmissionDenied) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+// webhook is an AdmissionController calling a webhook
+type webhook struct {
+	config WebhookConfig
+	// ops are the operations the webhook is called for
+	ops     map[pb.AdmissionOperation]bool
+	timeout time.Duration
+	tls     *tls.Config
+	http    *http.Client
+	log     *slog.Logger
+
+	mu   sync.Mutex
+	conn *grpc.ClientConn
+}
+
+func newWebhook(config WebhookConfig, logger *slog.Logger) (*webhook, error) {
+	w := &webhook{
+		config:  config,
+		ops:     make(map[pb.AdmissionOperation]bool),
+		timeout: config.Timeout,
+		log:     logger.With("webhook", config.Name),
+	}
+	if w.timeout == 0 {
+		w.timeout = DefaultWebhookTimeout
+	}
+	ops := config.Operations
+	if len(ops) == 0 {
+		ops = []string{"create", "start"}
+	}
+	for _, op := range ops {
+		w.ops[webhookOperations[op]] = true
+	}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: failed to read CA: %w", config.Name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("webhook %s: no certificates found in %s", config.Name, config.CAFile)
+		}
+		w.tls = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	if config.URL != "" {
+		w.http = &http.Client{Transport: &http.Transport{TLSClientConfig: w.tls, Proxy: http.ProxyFromEnvironment}}
+	}
+	return w, nil
+}
+
+// AdmitCreate implements AdmissionController
+func (w *webhook) AdmitCreate(ctx context.Context, req *pb.CreateContainerRequest) error {
+	resp, err := w.admit(ctx, &pb.AdmissionRequest{Operation: pb.AdmissionOperation_ADMISSION_OPERATION_CREATE, Create: req})
+	if err != nil || resp == nil || resp.Create == nil {
+		return err
+	}
+	proto.Reset(req)
+	proto.Merge(req, resp.Create)
+	return nil
+}
+
+// AdmitStart implements AdmissionController
+func (w *webhook) AdmitStart(ctx context.Context, c *pb.Container) error {
+	_, err := w.admit(ctx, &pb.AdmissionRequest{Operation: pb.AdmissionOperation_ADMISSION_OPERATION_START, Container: c})
+	return err
+}
+
+// admit calls the webhook, returning a nil response when it isn't called
+// for the operation or failed open
+func (w *webhook) admit(ctx context.Context, req *pb.AdmissionRequest) (*pb.AdmissionResponse, error) {
+	if !w.ops[req.Operation] {
+		return nil, nil
+	}
+	req.Uid = newRequestID()
+	if id, ok := identityFromContext(ctx); ok {
+		req.Principal = id.Name
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	var resp *pb.AdmissionResponse
+	var err error
+	if w.http != nil {
+		resp, err = w.post(ctx, req)
+	} else {
+		resp, err = w.call(ctx, req)
+	}
+	if err != nil {
+		if w.config.FailOpen {
+			logging.FromContext(ctx, w.log).Warn("Admission webhook failed, admitting request", "uid", req.Uid, "error", err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("admission webhook %s failed: %w", w.config.Name, err)
+	}
+	if !resp.Allowed {
+		reason := resp.Reason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		return nil, fmt.Errorf("%w by %s: %s", ErrAdmissionDenied, w.config.Name, reason)
+	}
+	return resp, nil
+}
+
+// post sends req to an HTTP webhook as JSON
+func (w *webhook) post(ctx context.Context, req *pb.AdmissionRequest) (*pb.AdmissionResponse, error) {
+	body, err := protojson.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := w.http.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, maxWebhookResponse))
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", httpResp.Status)
+	}
+	resp := &pb.AdmissionResponse{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return resp, nil
+}
+
+// call sends req to a gRPC webhook
+func (w *webhook) call(ctx context.Context, req *pb.AdmissionRequest) (*pb.AdmissionResponse, error) {
+	w.mu.Lock()
+	if w.conn == nil {
+		creds := insecure.NewCredentials()
+		if w.tls != nil {
+			creds = credentials.NewTLS(w.tls)
+		}
+		conn, err := grpc.Dial(w.config.Address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			w.mu.Unlock()
+			return nil, err
+		}
+		w.conn = conn
+	}
+	conn := w.conn
+	w.mu.Unlock()
+	return pb.NewAdmissionWebhookClient(conn).Admit(ctx, req)
+}
+
+// close closes the connection to a gRPC webhook, if dialed
+func (w *webhook) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
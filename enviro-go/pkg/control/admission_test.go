@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func TestAdmissionConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		webhooks []WebhookConfig
+		// wantErr is part of the error, none if empty
+		wantErr string
+	}{
+		{name: "none"},
+		{name: "valid", webhooks: []WebhookConfig{
+			{Name: "http", URL: "https://policy.internal/admit", Operations: []string{"create"}},
+			{Name: "grpc", Address: "policy.internal:8443", Timeout: time.Second},
+		}},
+		{name: "no name", webhooks: []WebhookConfig{{URL: "https://policy.internal/admit"}}, wantErr: "webhook 1: name is required"},
+		{name: "twice", webhooks: []WebhookConfig{{Name: "a", URL: "https://a/"}, {Name: "a", URL: "https://b/"}},
+			wantErr: "webhook a is configured twice"},
+		{name: "neither url nor address", webhooks: []WebhookConfig{{Name: "a"}}, wantErr: "needs one of url and address"},
+		{name: "url and address", webhooks: []WebhookConfig{{Name: "a", URL: "https://a/", Address: "a:8443"}},
+			wantErr: "needs one of url and address"},
+		{name: "scheme", webhooks: []WebhookConfig{{Name: "a", URL: "ftp://a/"}}, wantErr: "url must be http or https"},
+		{name: "operation", webhooks: []WebhookConfig{{Name: "a", URL: "https://a/", Operations: []string{"delete"}}},
+			wantErr: `unknown operation "delete"`},
+		{name: "negative timeout", webhooks: []WebhookConfig{{Name: "a", URL: "https://a/", Timeout: -time.Second}},
+			wantErr: "timeout must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := AdmissionConfig{Webhooks: tt.webhooks}.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// admissionFunc is an AdmissionController running create on creates and
+// admitting all starts
+type admissionFunc struct {
+	create func(req *pb.CreateContainerRequest) error
+}
+
+func (f admissionFunc) AdmitCreate(ctx context.Context, req *pb.CreateContainerRequest) error {
+	return f.create(req)
+}
+
+func (f admissionFunc) AdmitStart(ctx context.Context, c *pb.Container) error {
+	return nil
+}
+
+// TestAdmitCreate runs in-process controllers on creates, with their
+// mutations seen by the controllers after them
+func TestAdmitCreate(t *testing.T) {
+	label := admissionFunc{create: func(req *pb.CreateContainerRequest) error {
+		if req.Labels == nil {
+			req.Labels = make(map[string]string)
+		}
+		req.Labels["team"] = "infra"
+		return nil
+	}}
+	requireTeam := admissionFunc{create: func(req *pb.CreateContainerRequest) error {
+		if req.Labels["team"] == "" {
+			return fmt.Errorf("%w: a team label is required", ErrAdmissionDenied)
+		}
+		return nil
+	}}
+	tests := []struct {
+		name        string
+		controllers []AdmissionController
+		wantCode    codes.Code
+		wantLabels  map[string]string
+	}{
+		{name: "none"},
+		{name: "mutated", controllers: []AdmissionController{label}, wantLabels: map[string]string{"team": "infra"}},
+		{name: "mutation seen", controllers: []AdmissionController{label, requireTeam}, wantLabels: map[string]string{"team": "infra"}},
+		{name: "denied", controllers: []AdmissionController{requireTeam, label}, wantCode: codes.PermissionDenied},
+		{name: "failed", controllers: []AdmissionController{admissionFunc{create: func(*pb.CreateContainerRequest) error {
+			return errors.New("policy engine down")
+		}}}, wantCode: codes.Unavailable},
+		{name: "status", controllers: []AdmissionController{admissionFunc{create: func(*pb.CreateContainerRequest) error {
+			return status.Error(codes.ResourceExhausted, "quota exceeded")
+		}}}, wantCode: codes.ResourceExhausted},
+		{name: "id changed", controllers: []AdmissionController{admissionFunc{create: func(req *pb.CreateContainerRequest) error {
+			req.Id = "other"
+			return nil
+		}}}, wantCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAdmission(AdmissionConfig{Controllers: tt.controllers}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &pb.CreateContainerRequest{Id: "web", Name: "web"}
+			admitted, err := a.admitCreate(context.Background(), req)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("admitCreate() = %v, want %s", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if len(req.Labels) != 0 {
+				t.Errorf("admission changed the request to %v", req)
+			}
+			if got := admitted.Labels; len(got) != len(tt.wantLabels) || got["team"] != tt.wantLabels["team"] {
+				t.Errorf("admitted labels %v, want %v", got, tt.wantLabels)
+			}
+		})
+	}
+}
+
+// testWebhook answers admission requests with respond
+type testWebhook struct {
+	pb.UnimplementedAdmissionWebhookServer
+	respond func(req *pb.AdmissionRequest) (*pb.AdmissionResponse, error)
+}
+
+func (w testWebhook) Admit(ctx context.Context, req *pb.AdmissionRequest) (*pb.AdmissionResponse, error) {
+	return w.respond(req)
+}
+
+// TestAdmissionWebhooks calls webhooks served over HTTP and gRPC, which
+// mutate creates, deny starts or fail
+func TestAdmissionWebhooks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The HTTP webhook labels creates and denies containers named
+	// "forbidden"
+	var calls atomic.Int32
+	mutate := func(req *pb.AdmissionRequest) *pb.AdmissionResponse {
+		calls.Add(1)
+		if req.GetCreate().GetName() == "forbidden" || req.GetContainer().GetName() == "forbidden" {
+			return &pb.AdmissionResponse{Reason: "name is forbidden"}
+		}
+		create := req.GetCreate()
+		if create != nil {
+			create.Labels = map[string]string{"admitted-by": "http"}
+		}
+		return &pb.AdmissionResponse{Allowed: true, Create: create}
+	}
+	httpHook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &pb.AdmissionRequest{}
+		if err := protojson.Unmarshal(body, req); err != nil || req.Uid == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		data, _ := protojson.Marshal(mutate(req))
+		w.Write(data)
+	}))
+	defer httpHook.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	// The gRPC webhook denies starting containers without the label of
+	// the HTTP one
+	lis := occupy(t)
+	server := grpc.NewServer()
+	pb.RegisterAdmissionWebhookServer(server, testWebhook{respond: func(req *pb.AdmissionRequest) (*pb.AdmissionResponse, error) {
+		if req.GetContainer().GetLabels()["admitted-by"] != "http" {
+			return &pb.AdmissionResponse{Reason: "not admitted over HTTP"}, nil
+		}
+		return &pb.AdmissionResponse{Allowed: true}, nil
+	}})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	tests := []struct {
+		name     string
+		webhooks []WebhookConfig
+		create   *pb.CreateContainerRequest
+		// start is started when create is admitted
+		start      *pb.Container
+		wantCreate codes.Code
+		wantStart  codes.Code
+		wantLabels map[string]string
+	}{
+		{
+			name: "mutated and started",
+			webhooks: []WebhookConfig{
+				{Name: "http", URL: httpHook.URL},
+				{Name: "grpc", Address: lis.Addr().String(), Operations: []string{"start"}},
+			},
+			create:     &pb.CreateContainerRequest{Id: "web", Name: "web"},
+			start:      &pb.Container{Id: "web", Name: "web", Labels: map[string]string{"admitted-by": "http"}},
+			wantLabels: map[string]string{"admitted-by": "http"},
+		},
+		{
+			name:       "start denied over gRPC",
+			webhooks:   []WebhookConfig{{Name: "grpc", Address: lis.Addr().String(), Operations: []string{"start"}}},
+			create:     &pb.CreateContainerRequest{Id: "web", Name: "web"},
+			start:      &pb.Container{Id: "web", Name: "web"},
+			wantStart:  codes.PermissionDenied,
+			wantLabels: map[string]string{},
+		},
+		{
+			name:       "create denied over HTTP",
+			webhooks:   []WebhookConfig{{Name: "http", URL: httpHook.URL}},
+			create:     &pb.CreateContainerRequest{Id: "web", Name: "forbidden"},
+			wantCreate: codes.PermissionDenied,
+		},
+		{
+			name:       "failed closed",
+			webhooks:   []WebhookConfig{{Name: "failing", URL: failing.URL}},
+			create:     &pb.CreateContainerRequest{Id: "web", Name: "web"},
+			wantCreate: codes.Unavailable,
+		},
+		{
+			name:       "failed open",
+			webhooks:   []WebhookConfig{{Name: "failing", URL: failing.URL, FailOpen: true}},
+			create:     &pb.CreateContainerRequest{Id: "web", Name: "web"},
+			start:      &pb.Container{Id: "web", Name: "web"},
+			wantLabels: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAdmission(AdmissionConfig{Webhooks: tt.webhooks}, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.close()
+			admitted, err := a.admitCreate(ctx, tt.create)
+			if code := status.Code(err); code != tt.wantCreate {
+				t.Fatalf("admitCreate() = %v, want %s", err, tt.wantCreate)
+			}
+			if err != nil {
+				return
+			}
+			if got := admitted.Labels; len(got) != len(tt.wantLabels) || got["admitted-by"] != tt.wantLabels["admitted-by"] {
+				t.Errorf("admitted labels %v, want %v", got, tt.wantLabels)
+			}
+			if err := a.admitStart(ctx, tt.start); status.Code(err) != tt.wantStart {
+				t.Errorf("admitStart() = %v, want %s", err, tt.wantStart)
+			}
+		})
+	}
+
+	// Webhooks limited to an operation aren't called for the other
+	calls.Store(0)
+	a, err := newAdmission(AdmissionConfig{Webhooks: []WebhookConfig{{Name: "http", URL: httpHook.URL, Operations: []string{"create"}}}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.admitStart(ctx, &pb.Container{Id: "web", Name: "forbidden"}); err != nil {
+		t.Errorf("start admitted by a webhook for creates only = %v", err)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("webhook for creates called %d times for a start", n)
+	}
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+)
+
+// Audit log defaults, see AuditConfig
+const (
+	DefaultAuditMaxSize    = 100 << 20
+	DefaultAuditMaxBackups = 10
+)
+
+// auditSummaryLimit truncates the request summaries and errors of audit
+// records
+const auditSummaryLimit = 512
+
+// AuditConfig records every mutating RPC in an append-only file, one JSON
+// object per line with the method, the caller, a summary of the request,
+// the result and the latency. Each record carries the hash of the one
+// before and its own, chaining them so that editing or deleting records
+// is detected by QueryAuditLog. Calls rejected for lacking credentials or
+// role are recorded too.
+type AuditConfig struct {
+	// Path is the file records are appended to; none are written when
+	// empty
+	Path string `json:"path"`
+	// MaxSize rotates the file before it grows past this many bytes,
+	// DefaultAuditMaxSize when zero
+	MaxSize int64 `json:"max_size"`
+	// MaxBackups is the number of rotated files kept, Path.1 being the
+	// newest, DefaultAuditMaxBackups when zero. Older ones are deleted.
+	MaxBackups int `json:"max_backups"`
+	// KeyFile holds a secret the hashes are computed with as HMAC-SHA256
+	// keys, so that the chain can't be recomputed without it after
+	// editing records. Hashes are plain SHA-256 when empty.
+	KeyFile string `json:"key_file"`
+}
+
+func (c AuditConfig) withDefaults() AuditConfig {
+	if c.MaxSize == 0 {
+		c.MaxSize = DefaultAuditMaxSize
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = DefaultAuditMaxBackups
+	}
+	return c
+}
+
+func (c AuditConfig) validate() error {
+	if c.MaxSize < 0 || c.MaxBackups < 0 {
+		return errors.New("audit limits must not be negative")
+	}
+	if c.Path == "" {
+		if c.KeyFile != "" {
+			return errors.New("key_file needs path")
+		}
+		return nil
+	}
+	if fi, err := os.Stat(filepath.Dir(c.Path)); err != nil || !fi.IsDir() {
+		return fmt.Errorf("directory of %s doesn't exist", c.Path)
+	}
+	return nil
+}
+
+// unauditedMethods aren't recorded although they aren't in
+// readOnlyMethods: node and chaos service methods that only read, which are
+// admin-only for what they reveal, and the heartbeats of node agents.
+// Every other method is, so new RPCs are audited until listed here.
+var unauditedMethods = map[string]bool{
+	"/enviro.api.v1.NodeService/GetNetworkConfig":    true,
+	"/enviro.api.v1.NodeService/GetStats":            true,
+	"/enviro.api.v1.NodeService/GetLatencyStats":     true,
+	"/enviro.api.v1.NodeService/DatapathInspect":     true,
+	"/enviro.api.v1.NodeService/DumpConnections":     true,
+	"/enviro.api.v1.NodeService/ListFlows":           true,
+	"/enviro.api.v1.NodeService/TopFlows":            true,
+	"/enviro.api.v1.NodeService/GetCapabilities":     true,
+	"/enviro.api.v1.NodeService/StreamDropEvents":    true,
+	"/enviro.api.v1.NodeService/GetDropStats":        true,
+	"/enviro.api.v1.NodeService/ListAFXDPSockets":    true,
+	"/enviro.api.v1.NodeService/ListPolicies":        true,
+	"/enviro.api.v1.NodeService/ListReservations":    true,
+	"/enviro.api.v1.NodeService/ListSNATSlices":      true,
+	"/enviro.api.v1.NodeService/ListPeers":           true,
+	"/enviro.api.v1.NodeService/QueryAuditLog":       true,
+	"/enviro.api.v1.NodeService/DumpEffectiveConfig": true,
+	"/enviro.api.v1.NodeService/NodeHeartbeat":       true,
+	"/enviro.api.v1.ContainerService/CaptureTraffic": true,
+	"/enviro.api.v1.ChaosService/ListFaults":         true,
+}
+
+// audited reports whether calls of method are recorded
+func audited(method string) bool {
+	if strings.HasPrefix(method, healthMethodPrefix) {
+		return false
+	}
+	method = canonicalMethod(method)
+	return !readOnlyMethods[method] && !unauditedMethods[method]
+}
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	// Seq numbers the records from 1, continuing across rotations and
+	// restarts
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	// Principal is the caller's identity, see withAuditPrincipal
+	Principal string `json:"principal,omitempty"`
+	// Peer is the caller's IP address
+	Peer      string `json:"peer,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Request is the request as JSON, truncated to auditSummaryLimit
+	// bytes. Of client streams, it is the first message.
+	Request    string `json:"request,omitempty"`
+	Code       string `json:"code"`
+	Error      string `json:"error,omitempty"`
+	DurationNs int64  `json:"duration_ns"`
+	// Prev is the Hash of the record before, empty for the first
+	Prev string `json:"prev"`
+	// Hash is of Prev and the record with Hash empty, as JSON
+	Hash string `json:"hash"`
+}
+
+// auditLog appends records to the file of AuditConfig, rotating it by
+// size. The file is opened on the first record.
+type auditLog struct {
+	config AuditConfig
+	// key is nil without AuditConfig.KeyFile
+	key []byte
+	log *slog.Logger
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// seq and hash are of the last record written
+	seq  uint64
+	hash string
+}
+
+// newAuditLog continues the chain of the records in the existing files of
+// config
+func newAuditLog(config AuditConfig, logger *slog.Logger) (*auditLog, error) {
+	l := &auditLog{config: config.withDefaults(), log: logger}
+	if config.KeyFile != "" {
+		key, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit key: %w", err)
+		}
+		if l.key = bytes.TrimSpace(key); len(l.key) == 0 {
+			return nil, fmt.Errorf("audit key file %s is empty", config.KeyFile)
+		}
+	}
+	for _, path := range []string{l.config.Path, l.config.Path + ".1"} {
+		last, ok, err := lastAuditRecord(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		if ok {
+			l.seq, l.hash = last.Seq, last.Hash
+			break
+		}
+	}
+	return l, nil
+}
+
+// lastAuditRecord returns the last record of the file at path, reading
+// only its tail. ok is false when the file is missing or empty.
+func lastAuditRecord(path string) (r auditRecord, ok bool, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, false, nil
+	}
+	if err != nil {
+		return r, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return r, false, err
+	}
+	const tail = 64 << 10
+	off := max(fi.Size()-tail, 0)
+	buf := make([]byte, fi.Size()-off)
+	if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+		return r, false, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 {
+		return r, false, nil
+	}
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	if err := json.Unmarshal(buf, &r); err != nil {
+		return r, false, fmt.Errorf("last record of %s: %w", path, err)
+	}
+	return r, true, nil
+}
+
+// newHash returns the hash the chain is computed with
+func (l *auditLog) newHash() hash.Hash {
+	if l.key != nil {
+		return hmac.New(sha256.New, l.key)
+	}
+	return sha256.New()
+}
+
+// seal sets the hash of r, which follows the record of hash prev
+func (l *auditLog) seal(r *auditRecord, prev string) error {
+	r.Prev, r.Hash = prev, ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	h := l.newHash()
+	h.Write([]byte(prev))
+	h.Write(data)
+	r.Hash = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+func (l *auditLog) write(r auditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.Seq = l.seq + 1
+	if err := l.seal(&r, l.hash); err != nil {
+		return err
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.f != nil && l.size+int64(len(line)) > l.config.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.seq, l.hash = r.Seq, r.Hash
+	return nil
+}
+
+// open opens the file for appending, readable only by its owner
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// rotate shifts Path.N to Path.N+1, dropping the oldest, and Path to
+// Path.1. The next write opens a new file, continuing the chain.
+func (l *auditLog) rotate() error {
+	err := l.f.Close()
+	l.f = nil
+	if err != nil {
+		return err
+	}
+	path, keep := l.config.Path, l.config.MaxBackups
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, keep)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := keep - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
+
+// close closes the file, logging the last hash so that truncating the log
+// afterwards can be told by comparing it
+func (l *auditLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seq > 0 {
+		l.log.Info("Closed audit log", "seq", l.seq, "hash", l.hash)
+	}
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// auditQuery filters the records query returns
+type auditQuery struct {
+	// Method matches full method names, or their last element
+	Method    string
+	Principal string
+	// Since and Until bound the record times when not zero
+	Since, Until time.Time
+	// Limit keeps the newest matching records
+	Limit int
+	// Verify checks the hash chain of all records, not just the matching
+	Verify bool
+}
+
+func (q auditQuery) matches(r auditRecord) bool {
+	if q.Method != "" && r.Method != q.Method && !strings.HasSuffix(r.Method, "/"+q.Method) {
+		return false
+	}
+	if q.Principal != "" && r.Principal != q.Principal {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// errAuditChain reports records failing verification
+var errAuditChain = errors.New("audit log chain broken")
+
+// query returns the matching records of the rotated files and the current
+// one, oldest first. With q.Verify, verifyErr wraps errAuditChain for the
+// first record whose hash doesn't match or that doesn't follow the record
+// before. The first record kept may follow records of deleted backups.
+func (l *auditLog) query(q auditQuery) (records []auditRecord, verifyErr error, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var prev *auditRecord
+	check := func(path string, line int, r auditRecord) error {
+		sealed := r
+		if err := l.seal(&sealed, r.Prev); err != nil {
+			return err
+		}
+		switch {
+		case sealed.Hash != r.Hash:
+			return fmt.Errorf("%w: %s:%d: hash mismatch of record %d", errAuditChain, path, line, r.Seq)
+		case prev != nil && (r.Seq != prev.Seq+1 || r.Prev != prev.Hash):
+			return fmt.Errorf("%w: %s:%d: record %d doesn't follow record %d", errAuditChain, path, line, r.Seq, prev.Seq)
+		}
+		return nil
+	}
+
+	paths := make([]string, 0, l.config.MaxBackups+1)
+	for i := l.config.MaxBackups; i >= 1; i-- {
+		paths = append(paths, fmt.Sprintf("%s.%d", l.config.Path, i))
+	}
+	paths = append(paths, l.config.Path)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var r auditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				if q.Verify && verifyErr == nil {
+					verifyErr = fmt.Errorf("%w: %s:%d: %v", errAuditChain, path, line, err)
+				}
+				continue
+			}
+			if q.Verify && verifyErr == nil {
+				if verifyErr = check(path, line, r); verifyErr != nil && !errors.Is(verifyErr, errAuditChain) {
+					f.Close()
+					return nil, nil, verifyErr
+				}
+			}
+			prev = &r
+			if q.matches(r) {
+				records = append(records, r)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if q.Verify && verifyErr == nil {
+		var last auditRecord
+		if prev != nil {
+			last = *prev
+		}
+		if last.Seq != l.seq || last.Hash != l.hash {
+			verifyErr = fmt.Errorf("%w: last record is %d, %d was written", errAuditChain, last.Seq, l.seq)
+		}
+	}
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[len(records)-q.Limit:]
+	}
+	return records, verifyErr, nil
+}
+
+// serverOptions returns the interceptors recording the audited calls.
+// They run before authentication, so that rejected calls are recorded.
+func (l *auditLog) serverOptions() []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !audited(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, principal := withAuditPrincipal(ctx)
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		l.record(ctx, info.FullMethod, *principal, auditSummary(req), start, err)
+		return resp, err
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !audited(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		ctx, principal := withAuditPrincipal(ss.Context())
+		as := &auditStream{ServerStream: ss, ctx: ctx}
+		start := time.Now()
+		err := handler(srv, as)
+		l.record(ctx, info.FullMethod, *principal, as.first, start, err)
+		return err
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+// record writes the record of a call. Failing to doesn't fail the call,
+// which has already had its effect.
+func (l *auditLog) record(ctx context.Context, method, principal, request string, start time.Time, err error) {
+	r := auditRecord{
+		Time:       start.UTC(),
+		Method:     method,
+		Principal:  principal,
+		Peer:       clientAddress(ctx),
+		RequestID:  requestIDFromContext(ctx),
+		Request:    request,
+		Code:       status.Code(err).String(),
+		DurationNs: int64(time.Since(start)),
+	}
+	if err != nil {
+		r.Error = truncate(status.Convert(err).Message(), auditSummaryLimit)
+	}
+	if err := l.write(r); err != nil {
+		l.log.Error("Failed to write audit record", "method", method, "principal", principal, "error", err)
+	}
+}
+
+// auditSummary returns req as JSON, truncated to auditSummaryLimit bytes.
+// The credentials a backup may be uploaded with are redacted.
+func auditSummary(req any) string {
+	m, ok := req.(proto.Message)
+	if !ok {
+		return ""
+	}
+	if r, ok := m.(*pb.BackupRequest); ok {
+		m = redactBackupRequest(r)
+	}
+	data, err := protojson.MarshalOptions{}.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	return truncate(string(data), auditSummaryLimit)
+}
+
+// truncate cuts s to at most n bytes, marking the cut with "..."
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n-3], "") + "..."
+}
+
+type auditPrincipalKey struct{}
+
+// withAuditPrincipal returns the principal a call is recorded with, which
+// authorize sets to the identity it authenticates. Until then, it is the
+// common name of the caller's verified client certificate, if any.
+func withAuditPrincipal(ctx context.Context) (context.Context, *string) {
+	var principal string
+	if cn, ok := verifiedCommonName(ctx); ok {
+		principal = "cert:" + cn
+	}
+	return context.WithValue(ctx, auditPrincipalKey{}, &principal), &principal
+}
+
+// setAuditPrincipal records the identity authorize authenticated for the
+// call of ctx, when the call is audited
+func setAuditPrincipal(ctx context.Context, name string) {
+	if principal, ok := ctx.Value(auditPrincipalKey{}).(*string); ok {
+		*principal = name
+	}
+}
+
+// auditStream overrides the stream context and keeps the summary of the
+// first message received
+type auditStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	once  sync.Once
+	first string
+}
+
+func (s *auditStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *auditStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.once.Do(func() { s.first = auditSummary(m) })
+	}
+	return err
+}
+
+// defaultAuditQueryLimit is the number of records QueryAuditLog returns
+// when the request has no limit
+const defaultAuditQueryLimit = 100
+
+// QueryAuditLog returns the matching records of the audit log
+func (s *nodeService) QueryAuditLog(ctx context.Context, req *pb.QueryAuditLogRequest) (*pb.QueryAuditLogResponse, error) {
+	if s.audit == nil {
+		return nil, status.Error(codes.FailedPrecondition, "audit log is not configured")
+	}
+	if req.GetLimit() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	q := auditQuery{
+		Method:    req.GetMethod(),
+		Principal: req.GetPrincipal(),
+		Limit:     int(req.GetLimit()),
+		Verify:    req.GetVerify(),
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultAuditQueryLimit
+	}
+	if req.Since != nil {
+		q.Since = req.Since.AsTime()
+	}
+	if req.Until != nil {
+		q.Until = req.Until.AsTime()
+	}
+
+	records, verifyErr, err := s.audit.query(q)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read audit log: %v", err)
+	}
+	resp := &pb.QueryAuditLogResponse{Records: make([]*pb.AuditRecord, 0, len(records))}
+	for _, r := range records {
+		resp.Records = append(resp.Records, &pb.AuditRecord{
+			Seq:       r.Seq,
+			Time:      timestamppb.New(r.Time),
+			Method:    r.Method,
+			Principal: r.Principal,
+			Peer:      r.Peer,
+			RequestId: r.RequestID,
+			Request:   r.Request,
+			Code:      r.Code,
+			Error:     r.Error,
+			Duration:  durationpb.New(time.Duration(r.DurationNs)),
+			Hash:      r.Hash,
+		})
+	}
+	if q.Verify {
+		resp.Verified = verifyErr == nil
+		if verifyErr != nil {
+			logging.FromContext(ctx, s.log).Warn("Audit log failed verification", "error", verifyErr)
+			resp.VerifyError = verifyErr.Error()
+		}
+	}
+	return resp, nil
+}
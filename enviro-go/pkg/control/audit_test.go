@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func TestAudited(t *testing.T) {
+	tests := []struct {
+		method string
+		want   bool
+	}{
+		{method: "/enviro.api.v1.ContainerService/CreateContainer", want: true},
+		{method: "/enviro.api.ContainerService/DeleteContainer", want: true},
+		{method: "/enviro.api.v1.NodeService/QueryAuditLog"},
+		{method: "/enviro.api.v1.ContainerService/ListContainers"},
+		{method: "/enviro.api.ContainerService/ListContainers"},
+		{method: "/enviro.api.v1.NodeService/NodeHeartbeat"},
+		{method: "/grpc.health.v1.Health/Check"},
+		// New methods are audited until listed
+		{method: "/enviro.api.v1.NodeService/SomethingNew", want: true},
+	}
+	for _, tt := range tests {
+		if got := audited(tt.method); got != tt.want {
+			t.Errorf("audited(%s) = %v, want %v", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestAuditSummary(t *testing.T) {
+	long := auditSummary(&pb.CreateContainerRequest{Id: "web", Name: strings.Repeat("ü", auditSummaryLimit)})
+	if len(long) > auditSummaryLimit || !strings.HasSuffix(long, "...") || !strings.HasPrefix(strings.ReplaceAll(long, " ", ""), `{"id":"web"`) {
+		t.Errorf("summary of a long request %q", long)
+	}
+	backup := auditSummary(&pb.BackupRequest{Url: "https://bucket.example.org/b.tar?X-Signature=secret", Headers: map[string]string{"Authorization": "secret"}})
+	if strings.Contains(backup, "secret") || !strings.Contains(backup, "bucket.example.org") {
+		t.Errorf("summary of a backup request %q, want its credentials redacted", backup)
+	}
+	if got := auditSummary("not a message"); got != "" {
+		t.Errorf("summary of a non-message %q", got)
+	}
+}
+
+// auditedContainers creates containers for an admin and finds none to
+// delete
+type auditedContainers struct {
+	pb.UnimplementedContainerServiceServer
+}
+
+func (s *auditedContainers) CreateContainer(ctx context.Context, req *pb.CreateContainerRequest) (*pb.CreateContainerResponse, error) {
+	// As authorize would
+	setAuditPrincipal(ctx, "admin")
+	return &pb.CreateContainerResponse{Container: &pb.Container{Id: req.Id}}, nil
+}
+
+func (s *auditedContainers) DeleteContainer(ctx context.Context, req *pb.DeleteContainerRequest) (*pb.DeleteContainerResponse, error) {
+	return nil, status.Errorf(codes.NotFound, "container %s not found", req.Id)
+}
+
+func (s *auditedContainers) ListContainers(ctx context.Context, req *pb.ListContainersRequest) (*pb.ListContainersResponse, error) {
+	return &pb.ListContainersResponse{}, nil
+}
+
+// TestAuditLog records the mutating calls to a server in a log rotated
+// as it grows, whose chain continues when reopened and breaks when
+// edited
+func TestAuditLog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "audit.key")
+	if err := os.WriteFile(keyFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := AuditConfig{Path: filepath.Join(dir, "audit.log"), MaxSize: 1024, KeyFile: keyFile}
+	l, err := newAuditLog(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(l.serverOptions()...)
+	pb.RegisterContainerServiceServer(server, &auditedContainers{})
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.DialContext(ctx, "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewContainerServiceClient(conn)
+
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		if _, err := client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "web", Name: "web"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("DeleteContainer() = %v, want %s", err, codes.NotFound)
+	}
+	if _, err := client.ListContainers(ctx, &pb.ListContainersRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, verifyErr, err := l.query(auditQuery{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifyErr != nil {
+		t.Errorf("verification of the written log = %v", verifyErr)
+	}
+	if len(records) != 9 {
+		t.Fatalf("got %d records, want 9 without the read", len(records))
+	}
+	for i, r := range records {
+		if r.Seq != uint64(i+1) {
+			t.Errorf("record %d has seq %d", i, r.Seq)
+		}
+	}
+	if r := records[0]; r.Principal != "admin" || r.Code != "OK" || r.Peer != "bufconn" || r.Prev != "" {
+		t.Errorf("first record %+v", r)
+	}
+	req := &pb.CreateContainerRequest{}
+	if err := protojson.Unmarshal([]byte(records[0].Request), req); err != nil || req.Name != "web" {
+		t.Errorf("request %q recorded, want the create of web", records[0].Request)
+	}
+	if r := records[8]; r.Principal != "" || r.Code != "NotFound" || r.Error != "container missing not found" {
+		t.Errorf("record of the failed delete %+v", r)
+	}
+	for _, path := range []string{config.Path, config.Path + ".1"} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("log not rotated: %v", err)
+		}
+		if fi.Mode().Perm() != 0o600 {
+			t.Errorf("%s has mode %s, want 0600", path, fi.Mode().Perm())
+		}
+	}
+
+	queries := []struct {
+		name  string
+		query auditQuery
+		want  []uint64
+	}{
+		{name: "method", query: auditQuery{Method: "DeleteContainer"}, want: []uint64{9}},
+		{name: "full method", query: auditQuery{Method: "/enviro.api.v1.ContainerService/DeleteContainer"}, want: []uint64{9}},
+		{name: "principal and limit", query: auditQuery{Principal: "admin", Limit: 2}, want: []uint64{7, 8}},
+		{name: "until", query: auditQuery{Until: start.Add(-time.Second)}},
+		{name: "since", query: auditQuery{Since: start.Add(-time.Second), Limit: 1}, want: []uint64{9}},
+	}
+	for _, q := range queries {
+		records, _, err := l.query(q.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, r := range records {
+			got = append(got, r.Seq)
+		}
+		if len(got) != len(q.want) || len(got) > 0 && (got[0] != q.want[0] || got[len(got)-1] != q.want[len(q.want)-1]) {
+			t.Errorf("%s: got records %v, want %v", q.name, got, q.want)
+		}
+	}
+
+	// The chain continues in the log reopened
+	last := records[8]
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = newAuditLog(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	l.record(ctx, "/enviro.api.v1.ContainerService/StartContainer", "admin", `{"id":"web"}`, time.Now(), nil)
+	records, verifyErr, err = l.query(auditQuery{Method: "StartContainer", Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifyErr != nil || len(records) != 1 || records[0].Seq != 10 || records[0].Prev != last.Hash {
+		t.Errorf("record after reopening %+v, verified %v, want 10 following %s", records, verifyErr, last.Hash)
+	}
+
+	// The chain can't be verified without the key, nor once edited
+	unkeyed, err := newAuditLog(AuditConfig{Path: config.Path, MaxSize: config.MaxSize}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, verifyErr, err := unkeyed.query(auditQuery{Verify: true}); err != nil || !errors.Is(verifyErr, errAuditChain) {
+		t.Errorf("verification without the key = %v, %v, want %v", verifyErr, err, errAuditChain)
+	}
+	data, err := os.ReadFile(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.Path, []byte(strings.Replace(string(data), `"principal":"admin"`, `"principal":"root"`, 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	records, verifyErr, err = l.query(auditQuery{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(verifyErr, errAuditChain) || !strings.Contains(verifyErr.Error(), "hash mismatch") {
+		t.Errorf("verification of an edited log = %v, want a hash mismatch", verifyErr)
+	}
+	if len(records) != 10 {
+		t.Errorf("got %d records of an edited log, want all 10", len(records))
+	}
+}
+
+func TestQueryAuditLog(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := &nodeService{log: logger}
+	if _, err := s.QueryAuditLog(ctx, &pb.QueryAuditLogRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("QueryAuditLog() without an audit log = %v, want %s", err, codes.FailedPrecondition)
+	}
+
+	l, err := newAuditLog(AuditConfig{Path: filepath.Join(t.TempDir(), "audit.log")}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	s.audit = l
+	for i := 0; i < defaultAuditQueryLimit+1; i++ {
+		l.record(ctx, "/enviro.api.v1.ContainerService/CreateContainer", "admin", "", time.Now(), nil)
+	}
+	if _, err := s.QueryAuditLog(ctx, &pb.QueryAuditLogRequest{Limit: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("QueryAuditLog() of a negative limit = %v, want %s", err, codes.InvalidArgument)
+	}
+	resp, err := s.QueryAuditLog(ctx, &pb.QueryAuditLogRequest{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(resp.Records); n != defaultAuditQueryLimit || resp.Records[n-1].Seq != defaultAuditQueryLimit+1 {
+		t.Errorf("got %d records, want the newest %d", n, defaultAuditQueryLimit)
+	}
+	if !resp.Verified || resp.VerifyError != "" {
+		t.Errorf("verified %v: %s", resp.Verified, resp.VerifyError)
+	}
+}
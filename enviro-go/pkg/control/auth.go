@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+)
+
+// Role is the level of access granted to a caller
+type Role string
+
+const (
+	// RoleReadOnly may list, get and watch
+	RoleReadOnly Role = "read-only"
+	// RoleOperator may additionally manage containers, but not the node
+	RoleOperator Role = "operator"
+	// RoleAdmin may call every RPC
+	RoleAdmin Role = "admin"
+)
+
+// roleRank orders roles by the access they grant
+var roleRank = map[Role]int{RoleReadOnly: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// ErrInvalidToken is returned by authenticators for unknown or expired
+// tokens
+var ErrInvalidToken = errors.New("invalid token")
+
+// Identity is an authenticated caller
+type Identity struct {
+	// Name identifies the caller in logs
+	Name string
+	Role Role
+}
+
+// Authenticator verifies bearer tokens
+type Authenticator interface {
+	// Authenticate returns the identity token belongs to, or an error
+	// such as ErrInvalidToken
+	Authenticate(ctx context.Context, token string) (Identity, error)
+}
+
+// AuthConfig enables authentication and authorization of control plane
+// RPCs. The health service is always reachable without credentials.
+type AuthConfig struct {
+	// TokenFile enables the static token authenticator, see
+	// NewStaticTokenAuthenticator
+	TokenFile string `json:"token_file"`
+	// JWT enables bearer tokens that are JWTs, see JWTConfig
+	JWT *JWTConfig `json:"jwt"`
+	// Authenticator verifies bearer tokens before TokenFile and JWT
+	Authenticator Authenticator `json:"-"`
+	// ClientCertRoles grants roles to verified client certificates by
+	// subject common name. Requires ClientCAFile.
+	ClientCertRoles map[string]Role `json:"client_cert_roles"`
+}
+
+// enabled reports whether any credentials are configured
+func (c AuthConfig) enabled() bool {
+	return c.TokenFile != "" || c.JWT != nil || c.Authenticator != nil || len(c.ClientCertRoles) > 0
+}
+
+// readOnlyMethods may be called with RoleReadOnly and operatorMethods with
+// RoleOperator. Every other method requires RoleAdmin, so new RPCs are
+// admin-only until listed here. Methods called by their legacy
+// enviro.api name are looked up by their enviro.api.v1 name.
+var readOnlyMethods = map[string]bool{
+	"/enviro.api.v1.ContainerService/ListContainers":        true,
+	"/enviro.api.v1.ContainerService/GetContainer":          true,
+	"/enviro.api.v1.ContainerService/WatchEvents":           true,
+	"/enviro.api.v1.ContainerService/ListPortForwards":      true,
+	"/enviro.api.v1.ContainerService/StreamLogs":            true,
+	"/enviro.api.v1.ContainerService/ListServices":          true,
+	"/enviro.api.v1.ContainerService/GetServiceConnections": true,
+	"/enviro.api.v1.ContainerService/GetSpec":               true,
+	"/enviro.api.v1.ContainerService/ListNamespaces":        true,
+	"/enviro.api.v1.NodeService/ListNodes":                  true,
+	"/enviro.api.v1.NodeService/ListIdentities":             true,
+	"/enviro.api.v1.NodeService/WatchIdentities":            true,
+	"/enviro.api.v1.ImageService/ListImages":                true,
+	"/enviro.api.v1.StatsService/GetContainerStats":         true,
+	"/enviro.api.v1.StatsService/StreamContainerStats":      true,
+	"/enviro.api.v1.InfoService/GetAPIInfo":                 true,
+	// Server reflection describes the API, e.g. for grpcurl
+	"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo":      true,
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo": true,
+}
+
+var operatorMethods = map[string]bool{
+	"/enviro.api.v1.ContainerService/CreateContainer":       true,
+	"/enviro.api.v1.ContainerService/StartContainer":        true,
+	"/enviro.api.v1.ContainerService/StopContainer":         true,
+	"/enviro.api.v1.ContainerService/DeleteContainer":       true,
+	"/enviro.api.v1.ContainerService/ExposePort":            true,
+	"/enviro.api.v1.ContainerService/UnexposePort":          true,
+	"/enviro.api.v1.ContainerService/CaptureTraffic":        true,
+	"/enviro.api.v1.ContainerService/CreateService":         true,
+	"/enviro.api.v1.ContainerService/UpdateServiceBackends": true,
+	"/enviro.api.v1.ContainerService/DeleteService":         true,
+	"/enviro.api.v1.ContainerService/SetBandwidthLimit":     true,
+	"/enviro.api.v1.ContainerService/SetQoSClass":           true,
+	"/enviro.api.v1.ContainerService/ExportNetworkState":    true,
+	"/enviro.api.v1.ContainerService/ImportNetworkState":    true,
+	"/enviro.api.v1.ContainerService/RenewLease":            true,
+	// The leader programs the services of the nodes it places containers
+	// on with its scheduler token
+	"/enviro.api.v1.ContainerService/ProgramService": true,
+	// Runtimes verify the networks of the containers they start
+	"/enviro.api.v1.ContainerService/VerifyContainerNetwork": true,
+	// Node agents register and heartbeat with the operator role
+	"/enviro.api.v1.NodeService/RegisterNode":  true,
+	"/enviro.api.v1.NodeService/NodeHeartbeat": true,
+	// and allocate the identities of their containers' labels
+	"/enviro.api.v1.NodeService/AllocateIdentity": true,
+	"/enviro.api.v1.NodeService/ReleaseIdentity":  true,
+	// The runtime pulls the images of the containers it creates
+	"/enviro.api.v1.ImageService/PullImage":   true,
+	"/enviro.api.v1.ImageService/RemoveImage": true,
+}
+
+// requiredRole returns the least role allowed to call method
+func requiredRole(method string) Role {
+	switch {
+	case readOnlyMethods[method]:
+		return RoleReadOnly
+	case operatorMethods[method]:
+		return RoleOperator
+	default:
+		return RoleAdmin
+	}
+}
+
+// healthMethodPrefix prefixes the health service methods, which are
+// exempt from authentication and draining
+const healthMethodPrefix = "/grpc.health.v1.Health/"
+
+// authorizer authenticates callers and checks their role per method
+type authorizer struct {
+	// tokens are tried in order until one accepts the token
+	tokens    []Authenticator
+	certRoles map[string]Role
+	log       *slog.Logger
+}
+
+func newAuthorizer(config AuthConfig, logger *slog.Logger) (*authorizer, error) {
+	for cn, role := range config.ClientCertRoles {
+		if err := role.validate(); err != nil {
+			return nil, fmt.Errorf("client certificate %q: %w", cn, err)
+		}
+	}
+	a := &authorizer{certRoles: config.ClientCertRoles, log: logger}
+	if config.Authenticator != nil {
+		a.tokens = append(a.tokens, config.Authenticator)
+	}
+	if config.TokenFile != "" {
+		tokens, err := NewStaticTokenAuthenticator(config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = append(a.tokens, tokens)
+	}
+	if config.JWT != nil {
+		tokens, err := NewJWTAuthenticator(*config.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = append(a.tokens, tokens)
+	}
+	return a, nil
+}
+
+// serverOptions returns the interceptors enforcing authentication. They
+// run after request logging so rejected requests are logged too.
+func (a *authorizer) serverOptions() []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &loggingStream{ServerStream: ss, ctx: ctx})
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+// authorize checks the caller may invoke method, stores its identity in
+// the context and adds a principal field to the request logger
+func (a *authorizer) authorize(ctx context.Context, method string) (context.Context, error) {
+	if strings.HasPrefix(method, healthMethodPrefix) {
+		return ctx, nil
+	}
+
+	id, err := a.authenticate(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	setAuditPrincipal(ctx, id.Name)
+	if need := requiredRole(canonicalMethod(method)); roleRank[id.Role] < roleRank[need] {
+		return ctx, status.Errorf(codes.PermissionDenied, "%s requires the %s role", method, need)
+	}
+
+	logger := logging.FromContext(ctx, a.log).With("principal", id.Name)
+	return logging.WithLogger(context.WithValue(ctx, identityKey{}, id), logger), nil
+}
+
+type identityKey struct{}
+
+// identityFromContext returns the identity authorize authenticated
+func identityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// authenticate identifies the caller by a mapped client certificate, then
+// by bearer token
+func (a *authorizer) authenticate(ctx context.Context) (Identity, error) {
+	if cn, ok := verifiedCommonName(ctx); ok {
+		if role, ok := a.certRoles[cn]; ok {
+			return Identity{Name: "cert:" + cn, Role: role}, nil
+		}
+	}
+
+	token, ok := bearerToken(ctx)
+	if !ok || len(a.tokens) == 0 {
+		return Identity{}, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+	var err error
+	for _, tokens := range a.tokens {
+		id, tokenErr := tokens.Authenticate(ctx, token)
+		if tokenErr == nil {
+			return id, nil
+		}
+		// Report the last reason, unless it's just that a token meant for
+		// another authenticator isn't a JWT
+		if err == nil || !errors.Is(tokenErr, errNotJWT) {
+			err = tokenErr
+		}
+	}
+	return Identity{}, status.Errorf(codes.Unauthenticated, "authentication failed: %v", err)
+}
+
+// bearerToken extracts the token from the authorization header
+func bearerToken(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, v := range md.Get("authorization") {
+		scheme, token, ok := strings.Cut(v, " ")
+		if ok && strings.EqualFold(scheme, "bearer") && token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+func (r Role) validate() error {
+	if _, ok := roleRank[r]; !ok {
+		return fmt.Errorf("unknown role %q", r)
+	}
+	return nil
+}
+
+// staticTokens authenticates against a fixed set of tokens, keyed by their
+// SHA-256 so lookups don't leak timing about the token itself
+type staticTokens map[[sha256.Size]byte]Identity
+
+// NewStaticTokenAuthenticator loads tokens from path. Each line holds a
+// token, a role and a name separated by whitespace; blank lines and lines
+// starting with # are ignored:
+//
+//	3f9c1e0a7b... admin deploy-bot
+func NewStaticTokenAuthenticator(path string) (Authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer f.Close()
+
+	tokens := make(staticTokens)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected token, role and name", path, line)
+		}
+		role := Role(fields[1])
+		if err := role.validate(); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		tokens[sha256.Sum256([]byte(fields[0]))] = Identity{Name: fields[2], Role: role}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens in %s", path)
+	}
+	return tokens, nil
+}
+
+// Authenticate implements Authenticator
+func (t staticTokens) Authenticate(ctx context.Context, token string) (Identity, error) {
+	id, ok := t[sha256.Sum256([]byte(token))]
+	if !ok {
+		return Identity{}, ErrInvalidToken
+	}
+	return id, nil
+}
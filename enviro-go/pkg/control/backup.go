@@ -0,0 +1,419 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// backupFormat is bumped on incompatible changes to the layout of backup
+// tarballs
+const backupFormat = 1
+
+// backupManifestName is the first entry of a backup tarball, and
+// backupStatePrefix that of the state files following it
+const (
+	backupManifestName = "manifest.json"
+	backupStatePrefix  = "state/"
+)
+
+// restoredFileName is the state file recording the backup the state dir
+// was restored from, so restarting with the same restore_from keeps the
+// state
+const restoredFileName = "restored.json"
+
+// backupTransferTimeout bounds uploading and downloading a backup
+const backupTransferTimeout = 5 * time.Minute
+
+// maxBackupSize bounds the backups read for a restore
+const maxBackupSize = 256 << 20
+
+// errInvalidBackup is returned for backups that can't be restored
+var errInvalidBackup = errors.New("invalid backup")
+
+// backupFiles are the state files a backup holds, with the versions of
+// their formats this build reads
+var backupFiles = map[string]int{
+	registryFileName:      registryVersion,
+	specFileName:          specVersion,
+	settingsFileName:      settingsVersion,
+	identityFileName:      identityVersion,
+	network.StateFileName: network.StateVersion,
+}
+
+// Backup snapshots the state files and returns them, or uploads them when
+// a URL is requested
+func (s *nodeService) Backup(ctx context.Context, req *pb.BackupRequest) (*pb.BackupResponse, error) {
+	if s.store == nil {
+		return nil, status.Error(codes.FailedPrecondition, "state dir is not configured")
+	}
+	var target *url.URL
+	if req.GetUrl() != "" {
+		u, err := url.Parse(req.GetUrl())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "url must be an http or https URL")
+		}
+		target = u
+	}
+
+	archive, manifest, err := writeBackup(s.store)
+	if err != nil {
+		s.log.Error("Failed to take backup", "error", err)
+		return nil, status.Errorf(codes.Internal, "failed to take backup: %v", err)
+	}
+	sum := sha256.Sum256(archive)
+	resp := &pb.BackupResponse{
+		Sha256:   hex.EncodeToString(sum[:]),
+		Size:     int64(len(archive)),
+		Manifest: manifest,
+	}
+	if target == nil {
+		resp.Archive = archive
+		return resp, nil
+	}
+
+	// The query may hold the credentials of a presigned URL
+	location := *target
+	location.RawQuery, location.Fragment = "", ""
+	resp.Location = location.String()
+	if err := uploadBackup(ctx, target.String(), req.GetHeaders(), archive); err != nil {
+		s.log.Warn("Failed to upload backup", "location", resp.Location, "error", err)
+		return nil, status.Errorf(codes.Unavailable, "failed to upload backup to %s: %v", resp.Location, err)
+	}
+	s.log.Info("Uploaded backup", "location", resp.Location, "size", resp.Size, "sha256", resp.Sha256)
+	return resp, nil
+}
+
+// redactBackupRequest returns req without the query of its URL and the
+// values of its headers, which may hold credentials
+func redactBackupRequest(req *pb.BackupRequest) *pb.BackupRequest {
+	redacted := &pb.BackupRequest{Url: req.GetUrl()}
+	if u, err := url.Parse(req.GetUrl()); err == nil && u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+		redacted.Url = u.String()
+	}
+	if len(req.GetHeaders()) > 0 {
+		redacted.Headers = make(map[string]string, len(req.GetHeaders()))
+		for k := range req.GetHeaders() {
+			redacted.Headers[k] = "REDACTED"
+		}
+	}
+	return redacted
+}
+
+// writeBackup returns the tarball of a snapshot of the state files in
+// store and its manifest. The files are read while none is written, so
+// the snapshot holds the state as a crash at that moment would have left
+// it, which restarts reconcile.
+func writeBackup(store *storage.Store) ([]byte, *pb.BackupManifest, error) {
+	names := make([]string, 0, len(backupFiles))
+	for name := range backupFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files, err := store.Snapshot(names...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest := &pb.BackupManifest{
+		FormatVersion: backupFormat,
+		ServerVersion: serverVersion(),
+		CreatedAt:     timestamppb.Now(),
+	}
+	manifest.Node, _ = os.Hostname()
+	for _, name := range names {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		version, err := stateFileVersion(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		sum := sha256.Sum256(data)
+		manifest.Files = append(manifest.Files, &pb.BackupFile{
+			Name:    name,
+			Size:    int64(len(data)),
+			Sha256:  hex.EncodeToString(sum[:]),
+			Version: uint32(version),
+		})
+	}
+	manifestData, err := protojson.MarshalOptions{Multiline: true}.Marshal(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	mtime := manifest.CreatedAt.AsTime()
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: mtime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := add(backupManifestName, manifestData); err != nil {
+		return nil, nil, err
+	}
+	for _, f := range manifest.Files {
+		if err := add(backupStatePrefix+f.Name, files[f.Name]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), manifest, nil
+}
+
+// stateFileVersion returns the "version" field of a state file
+func stateFileVersion(data []byte) (int, error) {
+	var file struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, fmt.Errorf("%w: %v", storage.ErrCorrupt, err)
+	}
+	return file.Version, nil
+}
+
+// readBackup returns the manifest and state files of a backup tarball,
+// checking them against the manifest and that this build reads their
+// versions
+func readBackup(archive []byte) (*pb.BackupManifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidBackup, err)
+	}
+	tr := tar.NewReader(gz)
+	var manifest *pb.BackupManifest
+	files := make(map[string][]byte)
+	// maxBackupSize only bounds the compressed archive, so the entries are
+	// bounded too, against archives that inflate far beyond it
+	var total int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", errInvalidBackup, err)
+		}
+		data, err := readLimited(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %v", errInvalidBackup, hdr.Name, err)
+		}
+		if total += len(data); total > maxBackupSize {
+			return nil, nil, fmt.Errorf("%w: unpacks to more than %d bytes", errInvalidBackup, maxBackupSize)
+		}
+		switch name, isState := strings.CutPrefix(hdr.Name, backupStatePrefix); {
+		case hdr.Name == backupManifestName:
+			manifest = &pb.BackupManifest{}
+			if err := protojson.Unmarshal(data, manifest); err != nil {
+				return nil, nil, fmt.Errorf("%w: %s: %v", errInvalidBackup, backupManifestName, err)
+			}
+		case isState && name == path.Base(name):
+			files[name] = data
+		default:
+			return nil, nil, fmt.Errorf("%w: unexpected entry %s", errInvalidBackup, hdr.Name)
+		}
+	}
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("%w: no %s", errInvalidBackup, backupManifestName)
+	}
+	if manifest.FormatVersion != backupFormat {
+		return nil, nil, fmt.Errorf("%w: unsupported format version %d, taken by control plane %s",
+			errInvalidBackup, manifest.FormatVersion, manifest.ServerVersion)
+	}
+
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, f := range manifest.Files {
+		listed[f.Name] = true
+		data, ok := files[f.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s is missing", errInvalidBackup, f.Name)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != f.Size || hex.EncodeToString(sum[:]) != f.Sha256 {
+			return nil, nil, fmt.Errorf("%w: %s doesn't match its checksum", errInvalidBackup, f.Name)
+		}
+		supported, ok := backupFiles[f.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: unknown state file %s, taken by control plane %s",
+				errInvalidBackup, f.Name, manifest.ServerVersion)
+		}
+		version, err := stateFileVersion(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %v", errInvalidBackup, f.Name, err)
+		}
+		if version != supported || uint32(version) != f.Version {
+			return nil, nil, fmt.Errorf("%w: %s has version %d, this control plane reads version %d",
+				errInvalidBackup, f.Name, version, supported)
+		}
+	}
+	for name := range files {
+		if !listed[name] {
+			return nil, nil, fmt.Errorf("%w: %s is not in the manifest", errInvalidBackup, name)
+		}
+	}
+	return manifest, files, nil
+}
+
+// restoreBackup writes the state files of the backup at source, a file or
+// an http(s) URL, to store before the control plane loads them. The
+// state dir must hold no state yet, unless it was restored from the same
+// backup before.
+func restoreBackup(ctx context.Context, store *storage.Store, source string, logger *slog.Logger) error {
+	archive, err := fetchBackup(ctx, source)
+	if err != nil {
+		return fmt.Errorf("failed to read backup %s: %w", source, err)
+	}
+	sum := sha256.Sum256(archive)
+	checksum := hex.EncodeToString(sum[:])
+
+	restored, err := store.Read(restoredFileName)
+	switch {
+	case err == nil:
+		var prev restoredFile
+		if json.Unmarshal(restored, &prev) == nil && prev.Sha256 == checksum {
+			logger.Info("State dir was restored from this backup already", "source", prev.Source, "restored_at", prev.RestoredAt)
+			return nil
+		}
+		return fmt.Errorf("state dir %s was restored from another backup already", store.Dir())
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	for name := range backupFiles {
+		if _, err := store.Read(name); !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("state dir %s already holds state, remove it to restore a backup", store.Dir())
+		}
+	}
+
+	manifest, files, err := readBackup(archive)
+	if err != nil {
+		return fmt.Errorf("backup %s: %w", source, err)
+	}
+	for _, f := range manifest.Files {
+		if err := store.Write(f.Name, files[f.Name]); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(restoredFile{
+		Source:     source,
+		Sha256:     checksum,
+		RestoredAt: time.Now(),
+		Manifest:   json.RawMessage(protojson.Format(manifest)),
+	})
+	if err != nil {
+		return err
+	}
+	if err := store.Write(restoredFileName, data); err != nil {
+		return err
+	}
+	logger.Info("Restored state from backup", "source", source, "node", manifest.Node,
+		"server_version", manifest.ServerVersion, "created_at", manifest.CreatedAt.AsTime(), "files", len(manifest.Files))
+	return nil
+}
+
+// restoredFile is the content of restoredFileName
+type restoredFile struct {
+	Source     string          `json:"source"`
+	Sha256     string          `json:"sha256"`
+	RestoredAt time.Time       `json:"restored_at"`
+	Manifest   json.RawMessage `json:"manifest"`
+}
+
+// fetchBackup reads the backup at source, a file or an http(s) URL
+func fetchBackup(ctx context.Context, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readLimited(f)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backupTransferTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET returned %s", resp.Status)
+	}
+	return readLimited(resp.Body)
+}
+
+// readLimited reads r, failing beyond maxBackupSize
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBackupSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBackupSize {
+		return nil, fmt.Errorf("backup is larger than %d bytes", maxBackupSize)
+	}
+	return data, nil
+}
+
+// uploadBackup PUTs archive to target with headers
+func uploadBackup(ctx context.Context, target string, headers map[string]string, archive []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, backupTransferTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT returned %s", resp.Status)
+	}
+	return nil
+}
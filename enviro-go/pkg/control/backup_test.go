@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// backupEntry is a tar entry of a test backup
+type backupEntry struct {
+	name string
+	data []byte
+	// size, when set, is the size of an entry of zeros instead of data
+	size int64
+}
+
+// makeBackup returns the gzipped tarball of entries
+func makeBackup(t *testing.T, entries ...backupEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		var r io.Reader = bytes.NewReader(e.data)
+		size := int64(len(e.data))
+		if e.size > 0 {
+			r, size = io.LimitReader(zeros{}, e.size), e.size
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o600, Size: size, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(tw, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zeros reads as an endless stream of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// backupManifestEntry returns the manifest entry listing files
+func backupManifestEntry(t *testing.T, files map[string][]byte, edit func(*pb.BackupManifest)) backupEntry {
+	t.Helper()
+	m := &pb.BackupManifest{FormatVersion: backupFormat, ServerVersion: "test"}
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		m.Files = append(m.Files, &pb.BackupFile{
+			Name:    name,
+			Size:    int64(len(data)),
+			Sha256:  hex.EncodeToString(sum[:]),
+			Version: uint32(backupFiles[name]),
+		})
+	}
+	if edit != nil {
+		edit(m)
+	}
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backupEntry{name: backupManifestName, data: data}
+}
+
+func TestReadBackup(t *testing.T) {
+	registry := []byte(`{"version":1,"containers":[]}`)
+	spec := []byte(`{"version":1}`)
+	files := map[string][]byte{registryFileName: registry, specFileName: spec}
+	state := func(name string, data []byte) backupEntry {
+		return backupEntry{name: backupStatePrefix + name, data: data}
+	}
+	valid := []backupEntry{
+		backupManifestEntry(t, files, nil),
+		state(registryFileName, registry),
+		state(specFileName, spec),
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+		wantErr string
+	}{
+		{name: "valid", archive: makeBackup(t, valid...)},
+		{name: "not gzip", archive: []byte("not a backup"), wantErr: "gzip"},
+		{name: "truncated", archive: makeBackup(t, valid...)[:40], wantErr: "invalid backup"},
+		{name: "empty", archive: makeBackup(t), wantErr: "no manifest.json"},
+		{name: "no manifest", archive: makeBackup(t, valid[1:]...), wantErr: "no manifest.json"},
+		{
+			name:    "malformed manifest",
+			archive: makeBackup(t, backupEntry{name: backupManifestName, data: []byte("{")}),
+			wantErr: "manifest.json",
+		},
+		{
+			name: "unsupported format",
+			archive: makeBackup(t, backupManifestEntry(t, nil, func(m *pb.BackupManifest) {
+				m.FormatVersion = backupFormat + 1
+			})),
+			wantErr: "unsupported format version",
+		},
+		{name: "missing file", archive: makeBackup(t, valid[:2]...), wantErr: "spec.json is missing"},
+		{
+			name:    "unlisted file",
+			archive: makeBackup(t, backupManifestEntry(t, map[string][]byte{registryFileName: registry}, nil), valid[1], valid[2]),
+			wantErr: "not in the manifest",
+		},
+		{
+			name:    "checksum mismatch",
+			archive: makeBackup(t, valid[0], state(registryFileName, []byte(`{"version":1,"containers":null}`)), valid[2]),
+			wantErr: "doesn't match its checksum",
+		},
+		{
+			name: "unknown state file",
+			archive: makeBackup(t,
+				backupManifestEntry(t, map[string][]byte{"other.json": spec}, nil),
+				state("other.json", spec)),
+			wantErr: "unknown state file",
+		},
+		{
+			name: "newer state version",
+			archive: makeBackup(t,
+				backupManifestEntry(t, map[string][]byte{specFileName: []byte(`{"version":2}`)}, nil),
+				state(specFileName, []byte(`{"version":2}`))),
+			wantErr: "this control plane reads version",
+		},
+		{
+			name:    "unexpected entry",
+			archive: makeBackup(t, append(valid, backupEntry{name: "etc/passwd", data: []byte("root")})...),
+			wantErr: "unexpected entry",
+		},
+		{
+			name:    "state file path",
+			archive: makeBackup(t, append(valid, state("../containers.json", registry))...),
+			wantErr: "unexpected entry",
+		},
+		{
+			name:    "oversized entry",
+			archive: makeBackup(t, backupEntry{name: backupManifestName, size: maxBackupSize + 1}),
+			wantErr: "larger than",
+		},
+		{
+			name: "oversized in total",
+			archive: makeBackup(t,
+				backupEntry{name: backupStatePrefix + "a.json", size: maxBackupSize / 2},
+				backupEntry{name: backupStatePrefix + "b.json", size: maxBackupSize / 2},
+				backupEntry{name: backupStatePrefix + "c.json", size: 1}),
+			wantErr: "unpacks to more than",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, got, err := readBackup(tt.archive)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readBackup() error = %v, want %q", err, tt.wantErr)
+				}
+				if !errors.Is(err, errInvalidBackup) {
+					t.Errorf("readBackup() error = %v, want %v", err, errInvalidBackup)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readBackup(): %v", err)
+			}
+			if manifest.GetServerVersion() != "test" || len(got) != len(files) {
+				t.Fatalf("readBackup() = %v, %d files", manifest, len(got))
+			}
+			for name, data := range files {
+				if !bytes.Equal(got[name], data) {
+					t.Errorf("file %s = %q, want %q", name, got[name], data)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// chaosMethodPrefix prefixes the ChaosService methods, which can't be
+// faulted so faults can always be cleared
+const chaosMethodPrefix = "/enviro.api.v1.ChaosService/"
+
+// maxMethodFaultDelay bounds the delay of method faults
+const maxMethodFaultDelay = time.Minute
+
+// ChaosConfig enables ChaosService, which injects faults into the traffic
+// of containers and into the API, for game days. It is disabled by
+// default, and its methods then fail with codes.FailedPrecondition.
+type ChaosConfig struct {
+	Enable bool `json:"enable"`
+}
+
+// chaosService implements pb.ChaosServiceServer. It keeps the method
+// faults, which its interceptors inject, and when faults expire; the
+// network manager keeps the container faults.
+type chaosService struct {
+	pb.UnimplementedChaosServiceServer
+
+	enabled bool
+	network *network.NetworkManager
+	log     *slog.Logger
+
+	mu sync.Mutex
+	// methods holds the method faults by canonical method name
+	methods map[string]*methodFault
+	// expiries holds the timers clearing container faults by container ID
+	expiries map[string]*faultExpiry
+}
+
+// methodFault is a method fault and when it expires
+type methodFault struct {
+	fault  *pb.MethodFault
+	code   codes.Code
+	delay  time.Duration
+	expiry *faultExpiry
+}
+
+// faultExpiry clears a fault when its timer fires
+type faultExpiry struct {
+	at    time.Time
+	timer *time.Timer
+}
+
+func newChaosService(config ChaosConfig, nm *network.NetworkManager, logger *slog.Logger) *chaosService {
+	return &chaosService{
+		enabled:  config.Enable,
+		network:  nm,
+		log:      logger,
+		methods:  make(map[string]*methodFault),
+		expiries: make(map[string]*faultExpiry),
+	}
+}
+
+// serverOptions returns the interceptors injecting method faults. They
+// run after authentication and rate limiting, so faulted calls are
+// authorized and counted like others.
+func (s *chaosService) serverOptions() []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := s.inject(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := s.inject(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+// inject delays or fails a call of method as its fault says, if any
+func (s *chaosService) inject(ctx context.Context, method string) error {
+	s.mu.Lock()
+	f, ok := s.methods[canonicalMethod(method)]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if f.delay > 0 && hit(f.fault.DelayPercent, 100) {
+		t := time.NewTimer(f.delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return status.FromContextError(ctx.Err()).Err()
+		case <-t.C:
+		}
+	}
+	if hit(f.fault.ErrorPercent, 0) {
+		logging.FromContext(ctx, s.log).Debug("Injected method fault", "code", f.code)
+		return status.Errorf(f.code, "chaos: fault injected into %s", method)
+	}
+	return nil
+}
+
+// hit reports whether a call is among percent of the calls, def when
+// percent is zero
+func hit(percent, def float64) bool {
+	if percent == 0 {
+		percent = def
+	}
+	return rand.Float64()*100 < percent
+}
+
+// checkEnabled fails with codes.FailedPrecondition unless chaos is enabled
+func (s *chaosService) checkEnabled() error {
+	if !s.enabled {
+		return status.Error(codes.FailedPrecondition, "chaos is not enabled in the control plane's config")
+	}
+	return nil
+}
+
+// expireAfter returns the expiry of a fault lasting d, calling clear when
+// it expires. It is nil for faults lasting until cleared explicitly.
+func expireAfter(d *durationpb.Duration, clear func(*faultExpiry)) (*faultExpiry, error) {
+	if d == nil {
+		return nil, nil
+	}
+	if err := d.CheckValid(); err != nil || d.AsDuration() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "duration must be positive")
+	}
+	e := &faultExpiry{at: time.Now().Add(d.AsDuration())}
+	e.timer = time.AfterFunc(d.AsDuration(), func() { clear(e) })
+	return e, nil
+}
+
+// stop stops the timer of e, which may be nil
+func (e *faultExpiry) stop() {
+	if e != nil {
+		e.timer.Stop()
+	}
+}
+
+// timestamp returns when e expires, nil for a nil e
+func (e *faultExpiry) timestamp() *timestamppb.Timestamp {
+	if e == nil {
+		return nil
+	}
+	return timestamppb.New(e.at)
+}
+
+// SetContainerFault degrades the traffic to a container of this node
+func (s *chaosService) SetContainerFault(ctx context.Context, req *pb.SetContainerFaultRequest) (*pb.SetContainerFaultResponse, error) {
+	if err := s.checkEnabled(); err != nil {
+		return nil, err
+	}
+	if req.GetContainerId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "container id is required")
+	}
+	f, err := containerFaultFromProto(req.Fault)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := req.ContainerId
+	expiry, err := expireAfter(req.Duration, func(e *faultExpiry) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.expiries[id] != e {
+			return
+		}
+		delete(s.expiries, id)
+		if err := s.network.ClearContainerFault(id); err != nil && !errors.Is(err, network.ErrContainerNotFound) {
+			s.log.Error("Failed to clear expired container fault", "container_id", id, "error", err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.network.SetContainerFault(id, f); err != nil {
+		expiry.stop()
+		return nil, networkError(err)
+	}
+	s.expiries[id].stop()
+	if expiry != nil {
+		s.expiries[id] = expiry
+	} else {
+		delete(s.expiries, id)
+	}
+	return &pb.SetContainerFaultResponse{}, nil
+}
+
+// ClearContainerFault restores the traffic to a container
+func (s *chaosService) ClearContainerFault(ctx context.Context, req *pb.ClearContainerFaultRequest) (*pb.ClearContainerFaultResponse, error) {
+	if err := s.checkEnabled(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.network.ClearContainerFault(req.GetContainerId()); err != nil {
+		return nil, networkError(err)
+	}
+	s.expiries[req.ContainerId].stop()
+	delete(s.expiries, req.ContainerId)
+	return &pb.ClearContainerFaultResponse{}, nil
+}
+
+// SetMethodFault fails or delays calls of an API method
+func (s *chaosService) SetMethodFault(ctx context.Context, req *pb.SetMethodFaultRequest) (*pb.SetMethodFaultResponse, error) {
+	if err := s.checkEnabled(); err != nil {
+		return nil, err
+	}
+	f, err := newMethodFault(req.GetFault())
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	method := canonicalMethod(f.fault.Method)
+	f.expiry, err = expireAfter(req.Duration, func(e *faultExpiry) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if cur, ok := s.methods[method]; ok && cur.expiry == e {
+			delete(s.methods, method)
+			s.log.Info("Method fault expired", "method", method)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if prev, ok := s.methods[method]; ok {
+		prev.expiry.stop()
+	}
+	s.methods[method] = f
+	logging.FromContext(ctx, s.log).Warn("Injected method fault", "method", method, "error_percent", f.fault.ErrorPercent,
+		"code", f.code, "delay", f.delay, "delay_percent", f.fault.DelayPercent)
+	return &pb.SetMethodFaultResponse{}, nil
+}
+
+// ClearMethodFault stops faulting calls of an API method
+func (s *chaosService) ClearMethodFault(ctx context.Context, req *pb.ClearMethodFaultRequest) (*pb.ClearMethodFaultResponse, error) {
+	if err := s.checkEnabled(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	method := canonicalMethod(req.GetMethod())
+	f, ok := s.methods[method]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "method %q has no fault", req.GetMethod())
+	}
+	f.expiry.stop()
+	delete(s.methods, method)
+	logging.FromContext(ctx, s.log).Info("Cleared method fault", "method", method)
+	return &pb.ClearMethodFaultResponse{}, nil
+}
+
+// ListFaults returns the injected faults
+func (s *chaosService) ListFaults(ctx context.Context, req *pb.ListFaultsRequest) (*pb.ListFaultsResponse, error) {
+	resp := &pb.ListFaultsResponse{Enabled: s.enabled}
+	if !s.enabled {
+		return resp, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, f := range s.network.ContainerFaults() {
+		resp.Containers = append(resp.Containers, &pb.ContainerFaultStatus{
+			ContainerId: id,
+			Fault:       containerFaultToProto(f),
+			ExpiresAt:   s.expiries[id].timestamp(),
+		})
+	}
+	sort.Slice(resp.Containers, func(i, j int) bool { return resp.Containers[i].ContainerId < resp.Containers[j].ContainerId })
+	for _, f := range s.methods {
+		resp.Methods = append(resp.Methods, &pb.MethodFaultStatus{
+			Fault:     proto.Clone(f.fault).(*pb.MethodFault),
+			ExpiresAt: f.expiry.timestamp(),
+		})
+	}
+	sort.Slice(resp.Methods, func(i, j int) bool { return resp.Methods[i].Fault.Method < resp.Methods[j].Fault.Method })
+	return resp, nil
+}
+
+// newMethodFault validates f, filling in its defaults
+func newMethodFault(f *pb.MethodFault) (*methodFault, error) {
+	if f == nil {
+		return nil, status.Error(codes.InvalidArgument, "fault is required")
+	}
+	method := canonicalMethod(f.Method)
+	switch {
+	case !isFullMethod(method):
+		return nil, status.Errorf(codes.InvalidArgument, "method %q is not a full method name such as /enviro.api.v1.ContainerService/CreateContainer", f.Method)
+	case strings.HasPrefix(method, chaosMethodPrefix) || strings.HasPrefix(method, healthMethodPrefix):
+		return nil, status.Errorf(codes.InvalidArgument, "method %s can't be faulted", method)
+	}
+	for _, p := range []struct {
+		name  string
+		value float64
+	}{{"error", f.ErrorPercent}, {"delay", f.DelayPercent}} {
+		if p.value < 0 || p.value > 100 {
+			return nil, status.Errorf(codes.InvalidArgument, "%s percentage %v is not between 0 and 100", p.name, p.value)
+		}
+	}
+	code := codes.Code(f.Code)
+	if f.Code == 0 {
+		code = codes.Unavailable
+	} else if f.Code > uint32(codes.Unauthenticated) {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown status code %d", f.Code)
+	}
+	var delay time.Duration
+	if f.Delay != nil {
+		if err := f.Delay.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid delay: %v", err)
+		}
+		delay = f.Delay.AsDuration()
+	}
+	switch {
+	case delay < 0 || delay > maxMethodFaultDelay:
+		return nil, status.Errorf(codes.InvalidArgument, "delay %s is not between 0 and %s", delay, maxMethodFaultDelay)
+	case f.DelayPercent > 0 && delay == 0:
+		return nil, status.Error(codes.InvalidArgument, "delay percentage requires a delay")
+	case f.ErrorPercent == 0 && delay == 0:
+		return nil, status.Error(codes.InvalidArgument, "fault has no effect")
+	}
+
+	f = proto.Clone(f).(*pb.MethodFault)
+	f.Method, f.Code = method, uint32(code)
+	return &methodFault{fault: f, code: code, delay: delay}, nil
+}
+
+// containerFaultFromProto converts f, failing with
+// codes.InvalidArgument for invalid faults
+func containerFaultFromProto(f *pb.ContainerFault) (network.ContainerFault, error) {
+	if f == nil {
+		return network.ContainerFault{}, status.Error(codes.InvalidArgument, "fault is required")
+	}
+	for _, d := range []*durationpb.Duration{f.Delay, f.Jitter} {
+		if d != nil {
+			if err := d.CheckValid(); err != nil {
+				return network.ContainerFault{}, status.Errorf(codes.InvalidArgument, "invalid duration: %v", err)
+			}
+		}
+	}
+	nf := network.ContainerFault{
+		DropPercent:    f.DropPercent,
+		Delay:          f.Delay.AsDuration(),
+		Jitter:         f.Jitter.AsDuration(),
+		ReorderPercent: f.ReorderPercent,
+	}
+	if err := nf.Validate(); err != nil {
+		return network.ContainerFault{}, networkError(err)
+	}
+	return nf, nil
+}
+
+func containerFaultToProto(f network.ContainerFault) *pb.ContainerFault {
+	out := &pb.ContainerFault{DropPercent: f.DropPercent, ReorderPercent: f.ReorderPercent}
+	if f.Delay > 0 {
+		out.Delay = durationpb.New(f.Delay)
+	}
+	if f.Jitter > 0 {
+		out.Jitter = durationpb.New(f.Jitter)
+	}
+	return out
+}
+
+// isFullMethod reports whether method is a full method name such as
+// /enviro.api.v1.ContainerService/CreateContainer
+func isFullMethod(method string) bool {
+	service, name, ok := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	return ok && strings.HasPrefix(method, "/") && service != "" && name != "" && !strings.Contains(name, "/")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+func TestNewMethodFault(t *testing.T) {
+	const create = "/enviro.api.v1.ContainerService/CreateContainer"
+	tests := []struct {
+		name  string
+		fault *pb.MethodFault
+		// wantErr is part of the error, none if empty
+		wantErr   string
+		wantCode  codes.Code
+		wantDelay time.Duration
+	}{
+		{name: "error", fault: &pb.MethodFault{Method: create, ErrorPercent: 50}, wantCode: codes.Unavailable},
+		{name: "code", fault: &pb.MethodFault{Method: create, ErrorPercent: 50, Code: uint32(codes.Internal)}, wantCode: codes.Internal},
+		{name: "delay", fault: &pb.MethodFault{Method: create, Delay: durationpb.New(time.Second)}, wantCode: codes.Unavailable,
+			wantDelay: time.Second},
+		{name: "legacy name", fault: &pb.MethodFault{Method: "/enviro.api.ContainerService/CreateContainer", ErrorPercent: 1},
+			wantCode: codes.Unavailable},
+		{name: "none", wantErr: "fault is required"},
+		{name: "not a full method", fault: &pb.MethodFault{Method: "CreateContainer", ErrorPercent: 1}, wantErr: "not a full method name"},
+		{name: "chaos", fault: &pb.MethodFault{Method: "/enviro.api.v1.ChaosService/ClearMethodFault", ErrorPercent: 1},
+			wantErr: "can't be faulted"},
+		{name: "health", fault: &pb.MethodFault{Method: "/grpc.health.v1.Health/Check", ErrorPercent: 1}, wantErr: "can't be faulted"},
+		{name: "percentage", fault: &pb.MethodFault{Method: create, ErrorPercent: 101}, wantErr: "error percentage 101"},
+		{name: "unknown code", fault: &pb.MethodFault{Method: create, ErrorPercent: 1, Code: 17}, wantErr: "unknown status code 17"},
+		{name: "long delay", fault: &pb.MethodFault{Method: create, Delay: durationpb.New(2 * time.Minute)}, wantErr: "delay 2m0s"},
+		{name: "delay percentage", fault: &pb.MethodFault{Method: create, ErrorPercent: 1, DelayPercent: 50},
+			wantErr: "delay percentage requires a delay"},
+		{name: "no effect", fault: &pb.MethodFault{Method: create}, wantErr: "fault has no effect"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newMethodFault(tt.fault)
+			if tt.wantErr != "" {
+				if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("newMethodFault() = %v, want %s with %q", err, codes.InvalidArgument, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.code != tt.wantCode || f.delay != tt.wantDelay || f.fault.Method != create {
+				t.Errorf("fault %s with code %s and delay %s, want %s and %s", f.fault.Method, f.code, f.delay, tt.wantCode, tt.wantDelay)
+			}
+		})
+	}
+}
+
+// TestMethodFaults fails and delays calls to a server through the
+// interceptors of a chaos service
+func TestMethodFaults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := newChaosService(ChaosConfig{Enable: true}, &network.NetworkManager{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(s.serverOptions()...)
+	pb.RegisterContainerServiceServer(server, &blockingContainers{})
+	pb.RegisterChaosServiceServer(server, s)
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.DialContext(ctx, "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	containers, chaos := pb.NewContainerServiceClient(conn), pb.NewChaosServiceClient(conn)
+	createContainer := func(ctx context.Context) error {
+		_, err := containers.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "web"})
+		return err
+	}
+
+	const create = "/enviro.api.v1.ContainerService/CreateContainer"
+	if _, err := chaos.SetMethodFault(ctx, &pb.SetMethodFaultRequest{Fault: &pb.MethodFault{Method: create, ErrorPercent: 100,
+		Code: uint32(codes.Aborted)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := createContainer(ctx); status.Code(err) != codes.Aborted {
+		t.Errorf("CreateContainer() with a fault = %v, want %s", err, codes.Aborted)
+	}
+	if _, err := containers.ListContainers(ctx, &pb.ListContainersRequest{}); err != nil {
+		t.Errorf("ListContainers() without a fault = %v", err)
+	}
+
+	// A delay replaces the fault, holding calls up past their deadline
+	if _, err := chaos.SetMethodFault(ctx, &pb.SetMethodFaultRequest{Fault: &pb.MethodFault{Method: create,
+		Delay: durationpb.New(time.Minute)}}); err != nil {
+		t.Fatal(err)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if err := createContainer(short); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("CreateContainer() with a delay = %v, want %s", err, codes.DeadlineExceeded)
+	}
+	list, err := chaos.ListFaults(ctx, &pb.ListFaultsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.Enabled || len(list.Methods) != 1 || list.Methods[0].Fault.Code != uint32(codes.Unavailable) || list.Methods[0].ExpiresAt != nil {
+		t.Errorf("ListFaults() = %v, want the delay of %s", list, create)
+	}
+
+	// Faults set by the legacy name apply to both and expire
+	if _, err := chaos.SetMethodFault(ctx, &pb.SetMethodFaultRequest{Fault: &pb.MethodFault{Method: "/enviro.api.ContainerService/CreateContainer",
+		ErrorPercent: 100}, Duration: durationpb.New(100 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := createContainer(ctx); status.Code(err) != codes.Unavailable {
+		t.Errorf("CreateContainer() with an expiring fault = %v, want %s", err, codes.Unavailable)
+	}
+	for deadline := time.Now().Add(10 * time.Second); createContainer(ctx) != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("fault didn't expire")
+		}
+	}
+
+	if _, err := chaos.ClearMethodFault(ctx, &pb.ClearMethodFaultRequest{Method: create}); status.Code(err) != codes.NotFound {
+		t.Errorf("ClearMethodFault() of an expired fault = %v, want %s", err, codes.NotFound)
+	}
+	if _, err := chaos.SetMethodFault(ctx, &pb.SetMethodFaultRequest{Fault: &pb.MethodFault{Method: create, ErrorPercent: 100},
+		Duration: durationpb.New(-time.Second)}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SetMethodFault() of a negative duration = %v, want %s", err, codes.InvalidArgument)
+	}
+}
+
+func TestChaosDisabled(t *testing.T) {
+	ctx := context.Background()
+	s := newChaosService(ChaosConfig{}, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	list, err := s.ListFaults(ctx, &pb.ListFaultsRequest{})
+	if err != nil || list.Enabled {
+		t.Errorf("ListFaults() = %v, %v, want chaos disabled", list, err)
+	}
+	calls := map[string]func() error{
+		"SetMethodFault": func() error {
+			_, err := s.SetMethodFault(ctx, &pb.SetMethodFaultRequest{Fault: &pb.MethodFault{
+				Method: "/enviro.api.v1.ContainerService/CreateContainer", ErrorPercent: 100}})
+			return err
+		},
+		"ClearMethodFault": func() error {
+			_, err := s.ClearMethodFault(ctx, &pb.ClearMethodFaultRequest{Method: "/enviro.api.v1.ContainerService/CreateContainer"})
+			return err
+		},
+		"SetContainerFault": func() error {
+			_, err := s.SetContainerFault(ctx, &pb.SetContainerFaultRequest{ContainerId: "web", Fault: &pb.ContainerFault{DropPercent: 1}})
+			return err
+		},
+		"ClearContainerFault": func() error {
+			_, err := s.ClearContainerFault(ctx, &pb.ClearContainerFaultRequest{ContainerId: "web"})
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("%s() with chaos disabled = %v, want %s", name, err, codes.FailedPrecondition)
+		}
+	}
+}
+
+func TestContainerFaultFromProto(t *testing.T) {
+	f, err := containerFaultFromProto(&pb.ContainerFault{DropPercent: 10, Delay: durationpb.New(time.Second), Jitter: durationpb.New(time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (network.ContainerFault{DropPercent: 10, Delay: time.Second, Jitter: time.Millisecond}); f != want {
+		t.Errorf("containerFaultFromProto() = %+v, want %+v", f, want)
+	}
+	for _, invalid := range []*pb.ContainerFault{nil, {}, {Delay: &durationpb.Duration{Nanos: -1, Seconds: 1}}, {ReorderPercent: 10}} {
+		if _, err := containerFaultFromProto(invalid); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("containerFaultFromProto(%v) = %v, want %s", invalid, err, codes.InvalidArgument)
+		}
+	}
+}
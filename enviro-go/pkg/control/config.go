@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// DefaultAddress is where the control plane serves gRPC unless configured
+// otherwise
+const DefaultAddress = "127.0.0.1:50051"
+
+// EnvPrefix starts the environment variables LoadConfig reads. Each names
+// the path of a config key, e.g. ENVIRO_NETWORK_CIDR for network.cidr.
+const EnvPrefix = "ENVIRO"
+
+// errInvalidConfig is returned by LoadConfig for configs that fail to
+// decode or validate
+var errInvalidConfig = errors.New("invalid config")
+
+// durationType is converted from strings such as "10s" in config files
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// LoadConfig reads the control plane config from a YAML, TOML or JSON
+// file, by its extension, and overrides it with the ENVIRO_ environment
+// variables. An empty path reads the environment only. Keys are those of
+// the JSON encoding of ControlPlaneConfig; durations may be given as
+// strings such as "10s". Unknown keys are rejected, defaults applied and
+// the result validated.
+func LoadConfig(path string) (ControlPlaneConfig, error) {
+	var config ControlPlaneConfig
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("failed to read config: %w", err)
+		}
+		if err := decodeConfig(filepath.Ext(path), data, &config); err != nil {
+			return config, fmt.Errorf("%w %s: %w", errInvalidConfig, path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&config).Elem(), EnvPrefix); err != nil {
+		return config, fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+	if config.Address == "" {
+		config.Address = DefaultAddress
+	}
+	if config.Network.CIDR == "" && config.Network.CIDR6 == "" {
+		config.Network.CIDR = DefaultCIDR
+	}
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+	return config, nil
+}
+
+// decodeConfig decodes a config file in the format of its extension ext.
+// Files are decoded generically first, so every format shares the JSON
+// keys of the config.
+func decodeConfig(ext string, data []byte, config *ControlPlaneConfig) error {
+	var raw map[string]any
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+	case ".json":
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown config format %q, want .yaml, .toml or .json", ext)
+	}
+
+	normalized, err := normalizeConfig(raw, reflect.TypeOf(*config), "")
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(normalized)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(config)
+}
+
+// normalizeConfig converts the duration strings of v, decoded generically
+// from a file at key, to the nanoseconds their JSON encoding expects
+func normalizeConfig(v any, t reflect.Type, key string) (any, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == durationType {
+		if s, ok := v.(string); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			return int64(d), nil
+		}
+		return v, nil
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for k, elem := range v {
+			var elemType reflect.Type
+			switch t.Kind() {
+			case reflect.Struct:
+				f, ok := jsonField(t, k)
+				if !ok {
+					// Left for the decoder to reject
+					continue
+				}
+				elemType = f.Type
+			case reflect.Map:
+				elemType = t.Elem()
+			default:
+				continue
+			}
+			n, err := normalizeConfig(elem, elemType, joinKey(key, k))
+			if err != nil {
+				return nil, err
+			}
+			v[k] = n
+		}
+	case []any:
+		if t.Kind() != reflect.Slice {
+			return v, nil
+		}
+		for i, elem := range v {
+			n, err := normalizeConfig(elem, t.Elem(), fmt.Sprintf("%s[%d]", key, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = n
+		}
+	}
+	return v, nil
+}
+
+// applyEnv sets the fields of the struct v from the environment variables
+// named by prefix and the fields' JSON keys. Structs behind nil pointers
+// are only allocated when a variable sets one of their fields.
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := jsonName(f)
+		if !ok {
+			continue
+		}
+		env := prefix + "_" + strings.ToUpper(name)
+		fv := v.Field(i)
+
+		if f.Type.Kind() == reflect.Pointer && f.Type.Elem().Kind() == reflect.Struct {
+			if fv.IsNil() {
+				if !envHasPrefix(env + "_") {
+					continue
+				}
+				fv.Set(reflect.New(f.Type.Elem()))
+			}
+			if err := applyEnv(fv.Elem(), env); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+			if err := applyEnv(fv, env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fv, s); err != nil {
+			return fmt.Errorf("invalid %s: %w", env, err)
+		}
+	}
+	return nil
+}
+
+// setFromEnv parses s into v. Lists are comma-separated and maps given as
+// comma-separated key=value pairs.
+func setFromEnv(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return errors.New("can only be set in a config file")
+		}
+		parts := splitList(s)
+		out := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			out.Index(i).SetString(strings.TrimSpace(p))
+		}
+		v.Set(out)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return errors.New("can only be set in a config file")
+		}
+		out := reflect.MakeMap(v.Type())
+		for _, kv := range splitList(s) {
+			k, val, ok := strings.Cut(kv, "=")
+			if !ok {
+				return fmt.Errorf("%q is not key=value", kv)
+			}
+			out.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)).Convert(v.Type().Key()),
+				reflect.ValueOf(strings.TrimSpace(val)).Convert(v.Type().Elem()))
+		}
+		v.Set(out)
+	default:
+		return errors.New("can only be set in a config file")
+	}
+	return nil
+}
+
+// Validate checks the config for errors that don't need the host, such
+// as malformed CIDRs, levels or durations. NewControlPlaneWithConfig
+// checks the rest, e.g. that TLS files exist.
+func (c ControlPlaneConfig) Validate() error {
+	netConfig := c.Network
+	if netConfig.CIDR == "" && netConfig.CIDR6 == "" {
+		netConfig.CIDR = DefaultCIDR
+	}
+	if netConfig.IPAM.Backend == network.IPAMExternal && netConfig.IPAM.External == nil {
+		// NewControlPlane connects the plugin as the backend
+		if err := c.IPAMPlugin.validate(); err != nil {
+			return fmt.Errorf("invalid ipam_plugin config: %w", err)
+		}
+		netConfig.IPAM.External = &ipamPlugin{}
+	}
+	if err := netConfig.Validate(); err != nil {
+		return err
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if _, err := logging.NewHandler(io.Discard, c.LogFormat); err != nil {
+		return err
+	}
+	if _, err := c.subsystemLevels(); err != nil {
+		return err
+	}
+	if err := c.Server.validate(); err != nil {
+		return fmt.Errorf("invalid server config: %w", err)
+	}
+	if err := c.Nodes.validate(); err != nil {
+		return fmt.Errorf("invalid nodes config: %w", err)
+	}
+	if err := c.Tracing.validate(); err != nil {
+		return fmt.Errorf("invalid tracing config: %w", err)
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return fmt.Errorf("invalid rate_limit config: %w", err)
+	}
+	if err := c.Reconcile.validate(); err != nil {
+		return fmt.Errorf("invalid reconcile config: %w", err)
+	}
+	if c.EventBufferSize < 0 || c.EventBufferSize > maxEventBufferSize {
+		return fmt.Errorf("event_buffer_size must be between 0 and %d", maxEventBufferSize)
+	}
+	if err := c.Identities.validate(); err != nil {
+		return fmt.Errorf("invalid identities config: %w", err)
+	}
+	if err := c.Admission.validate(); err != nil {
+		return fmt.Errorf("invalid admission config: %w", err)
+	}
+	if err := c.Audit.validate(); err != nil {
+		return fmt.Errorf("invalid audit config: %w", err)
+	}
+	if err := c.Images.validate(); err != nil {
+		return fmt.Errorf("invalid images config: %w", err)
+	}
+	if err := c.Stats.validate(); err != nil {
+		return fmt.Errorf("invalid stats config: %w", err)
+	}
+	if err := c.Privileges.validate(); err != nil {
+		return fmt.Errorf("invalid privileges config: %w", err)
+	}
+	if err := c.Scheduler.Connections.Validate(); err != nil {
+		return fmt.Errorf("invalid scheduler connections config: %w", err)
+	}
+	if len(c.Auth.ClientCertRoles) > 0 && c.ClientCAFile == "" {
+		return errors.New("client_cert_roles needs client_ca_file")
+	}
+	if err := c.Storage.validate(); err != nil {
+		return fmt.Errorf("invalid storage config: %w", err)
+	}
+	if c.RestoreFrom != "" && c.StateDir == "" {
+		return errors.New("restore_from needs state_dir")
+	}
+	if c.Raft != nil && c.Coordinator != nil {
+		return errors.New("raft and coordinator are exclusive")
+	}
+	return nil
+}
+
+// jsonField returns the field of struct t encoded as key in JSON
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name, ok := jsonName(f); ok && name == key {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// jsonName returns the JSON key of f, false for fields not encoded
+func jsonName(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+	tag := f.Tag.Get("json")
+	name, _, _ := strings.Cut(tag, ",")
+	switch name {
+	case "-":
+		return "", false
+	case "":
+		return f.Name, true
+	}
+	return name, true
+}
+
+// envHasPrefix reports whether any environment variable starts with prefix
+func envHasPrefix(prefix string) bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinKey joins the path of a config key
+func joinKey(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		// file is the name and content of the config file, none if empty
+		file, content string
+		env           map[string]string
+		check         func(t *testing.T, c ControlPlaneConfig)
+		// wantErr is part of the error when loading fails
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, c ControlPlaneConfig) {
+				if c.Address != DefaultAddress || c.Network.CIDR != DefaultCIDR {
+					t.Errorf("address %s and CIDR %s, want the defaults", c.Address, c.Network.CIDR)
+				}
+				if c.Raft != nil {
+					t.Errorf("raft %+v without any set", c.Raft)
+				}
+			},
+		},
+		{
+			name: "YAML",
+			file: "enviro.yaml",
+			content: `address: 127.0.0.1:50052
+network:
+  cidr: 10.99.0.0/16
+nodes:
+  heartbeat_interval: 5s
+log_levels:
+  raft: warn
+`,
+			check: func(t *testing.T, c ControlPlaneConfig) {
+				if c.Address != "127.0.0.1:50052" || c.Network.CIDR != "10.99.0.0/16" {
+					t.Errorf("address %s and CIDR %s", c.Address, c.Network.CIDR)
+				}
+				if c.Nodes.HeartbeatInterval != 5*time.Second {
+					t.Errorf("heartbeat interval %s, want 5s", c.Nodes.HeartbeatInterval)
+				}
+				if c.LogLevels["raft"] != "warn" {
+					t.Errorf("log levels %v", c.LogLevels)
+				}
+			},
+		},
+		{
+			name: "TOML",
+			file: "enviro.toml",
+			content: `address = "127.0.0.1:50052"
+allowed_spiffe_ids = ["spiffe://example.org/a"]
+
+[nodes]
+heartbeat_interval = "1m"
+missed_heartbeats = 5
+`,
+			check: func(t *testing.T, c ControlPlaneConfig) {
+				if c.Address != "127.0.0.1:50052" || c.Network.CIDR != DefaultCIDR {
+					t.Errorf("address %s and CIDR %s", c.Address, c.Network.CIDR)
+				}
+				if c.Nodes.HeartbeatInterval != time.Minute || c.Nodes.MissedHeartbeats != 5 {
+					t.Errorf("nodes %+v", c.Nodes)
+				}
+				if !slices.Equal(c.AllowedSPIFFEIDs, []string{"spiffe://example.org/a"}) {
+					t.Errorf("SPIFFE IDs %v", c.AllowedSPIFFEIDs)
+				}
+			},
+		},
+		{
+			name:    "JSON in nanoseconds",
+			file:    "enviro.json",
+			content: `{"nodes": {"heartbeat_interval": 2000000000}}`,
+			check: func(t *testing.T, c ControlPlaneConfig) {
+				if c.Nodes.HeartbeatInterval != 2*time.Second {
+					t.Errorf("heartbeat interval %s, want 2s", c.Nodes.HeartbeatInterval)
+				}
+			},
+		},
+		{
+			name:    "environment over the file",
+			file:    "enviro.yaml",
+			content: "network:\n  cidr: 10.99.0.0/16\nnodes:\n  heartbeat_interval: 5s\n",
+			env: map[string]string{
+				"ENVIRO_NETWORK_CIDR":             "10.98.0.0/16",
+				"ENVIRO_NODES_HEARTBEAT_INTERVAL": "7s",
+				"ENVIRO_ALLOWED_SPIFFE_IDS":       "spiffe://example.org/a, spiffe://example.org/b",
+				"ENVIRO_LOG_LEVELS":               "raft=error, auth=debug",
+				"ENVIRO_RATE_LIMIT_DEFAULT_RATE":  "2.5",
+				"ENVIRO_SERVER_UNKNOWN":           "ignored",
+			},
+			check: func(t *testing.T, c ControlPlaneConfig) {
+				if c.Network.CIDR != "10.98.0.0/16" || c.Nodes.HeartbeatInterval != 7*time.Second {
+					t.Errorf("CIDR %s and heartbeat interval %s", c.Network.CIDR, c.Nodes.HeartbeatInterval)
+				}
+				if want := []string{"spiffe://example.org/a", "spiffe://example.org/b"}; !slices.Equal(c.AllowedSPIFFEIDs, want) {
+					t.Errorf("SPIFFE IDs %v, want %v", c.AllowedSPIFFEIDs, want)
+				}
+				if want := map[string]string{"raft": "error", "auth": "debug"}; !maps.Equal(c.LogLevels, want) {
+					t.Errorf("log levels %v, want %v", c.LogLevels, want)
+				}
+				if c.RateLimit.Default.Rate != 2.5 {
+					t.Errorf("default rate %g, want 2.5", c.RateLimit.Default.Rate)
+				}
+			},
+		},
+		{
+			name: "list of sections from the environment",
+			env: map[string]string{
+				"ENVIRO_RAFT_ID":    "a",
+				"ENVIRO_RAFT_DIR":   "/var/lib/enviro/raft",
+				"ENVIRO_RAFT_PEERS": "a",
+			},
+			// Peers can only be set in a file
+			wantErr: "ENVIRO_RAFT_PEERS",
+		},
+		{name: "unknown key", file: "enviro.yaml", content: "adress: 127.0.0.1:50052\n", wantErr: "adress"},
+		{name: "unknown nested key", file: "enviro.toml", content: "[nodes]\ninterval = \"5s\"\n", wantErr: "interval"},
+		{name: "unknown format", file: "enviro.ini", content: "address=127.0.0.1:50052\n", wantErr: "unknown config format"},
+		{name: "malformed file", file: "enviro.json", content: `{"address":`, wantErr: "enviro.json"},
+		{name: "malformed duration", file: "enviro.yaml", content: "nodes:\n  heartbeat_interval: soon\n",
+			wantErr: "nodes.heartbeat_interval"},
+		{name: "malformed variable", env: map[string]string{"ENVIRO_NODES_MISSED_HEARTBEATS": "many"},
+			wantErr: "ENVIRO_NODES_MISSED_HEARTBEATS"},
+		{name: "invalid", env: map[string]string{"ENVIRO_NETWORK_CIDR": "10.99.0.0/33"}, wantErr: "10.99.0.0/33"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var path string
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), tt.file)
+				if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config, err := LoadConfig(path)
+			if tt.wantErr != "" {
+				if !errors.Is(err, errInvalidConfig) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadConfig() = %v, want %v with %q", err, errInvalidConfig, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() = %v", err)
+			}
+			tt.check(t, config)
+		})
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadConfig() of a missing file = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestSubsystemLoggers(t *testing.T) {
+	for _, levels := range []map[string]string{{"raft": "loud"}, {"raft": "warn", "kernel": "debug"}} {
+		if _, _, err := (ControlPlaneConfig{LogLevels: levels}).subsystemLoggers(slog.Default()); err == nil {
+			t.Errorf("subsystemLoggers() of %v succeeded", levels)
+		}
+	}
+
+	var b strings.Builder
+	logger, err := logging.New(&b, "info", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsystem, levels, err := ControlPlaneConfig{LogLevels: map[string]string{"raft": "warn"}}.subsystemLoggers(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsystem("raft").Info("dropped")
+	subsystem("api").Info("logged")
+	levels.Set(nil)
+	subsystem("raft").Info("logged after the override went")
+	if got := b.String(); strings.Contains(got, "dropped") || strings.Count(got, "logged") != 2 {
+		t.Errorf("logged %q", got)
+	}
+	if !strings.Contains(b.String(), "subsystem=api") {
+		t.Errorf("logged %q without the subsystem", b.String())
+	}
+}
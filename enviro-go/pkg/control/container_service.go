@@ -0,0 +1,1330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/containerlog"
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// containerService implements pb.ContainerServiceServer on top of the
+// network manager, keeping an in-memory registry of containers.
+type containerService struct {
+	pb.UnimplementedContainerServiceServer
+
+	network *network.NetworkManager
+	// runtime starts and stops containers, nil when none is attached
+	runtime Runtime
+	// logDir holds the container logs written by the runtime, empty when
+	// not configured
+	logDir string
+	log    *slog.Logger
+	// events is published to under mu, so a snapshot taken under mu is
+	// consistent with the events that follow it
+	events *eventBus
+
+	mu         sync.Mutex
+	containers map[string]*pb.Container
+	// busy holds the containers being created or deleted, or that the
+	// runtime is starting or stopping
+	busy map[string]bool
+	// idempotency replays creates retried with the same key
+	idempotency *idempotencyCache
+	// cluster replicates the registry and services while leading, and
+	// serves reads while following. It is nil without Raft.
+	cluster *raftCluster
+	// scheduler places containers created with a placement on nodes
+	scheduler *scheduler
+	// registry persists containers, nil without a state dir
+	registry *registryStore
+	// reconciler holds the spec of ApplySpec
+	reconciler *reconciler
+	// admission admits creates and starts
+	admission *admission
+	// distributor programs the services on the nodes containers are
+	// placed on, nil when not distributing
+	distributor *serviceDistributor
+	// servicesMu serializes changes to services, which the distributor
+	// rewrites as their backends move between nodes
+	servicesMu sync.Mutex
+}
+
+func newContainerService(nm *network.NetworkManager, runtime Runtime, logDir string, events *eventBus, logger *slog.Logger) *containerService {
+	return &containerService{
+		network:     nm,
+		runtime:     runtime,
+		logDir:      logDir,
+		log:         logger,
+		events:      events,
+		containers:  make(map[string]*pb.Container),
+		busy:        make(map[string]bool),
+		idempotency: newIdempotencyCache(),
+		admission:   &admission{log: logger},
+	}
+}
+
+// CreateContainer sets up networking for a container
+func (s *containerService) CreateContainer(ctx context.Context, req *pb.CreateContainerRequest) (*pb.CreateContainerResponse, error) {
+	if err := validateCreate(req); err != nil {
+		return nil, err
+	}
+	if req.GetIdempotencyKey() == "" {
+		return s.createContainer(ctx, req)
+	}
+
+	call, owner, err := s.idempotency.begin(req)
+	if err != nil {
+		return nil, err
+	}
+	if !owner {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		return proto.Clone(call.resp).(*pb.CreateContainerResponse), nil
+	}
+	resp, err := s.createContainer(ctx, req)
+	s.idempotency.finish(req.IdempotencyKey, call, resp, err)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(resp).(*pb.CreateContainerResponse), nil
+}
+
+// validateContainerID checks that id is set and a single path element, as
+// it names the container's log directory and cgroup
+func validateContainerID(id string) error {
+	if id == "" {
+		return status.Error(codes.InvalidArgument, "container id is required")
+	}
+	if filepath.Base(id) != id || id == "." || id == ".." {
+		return status.Errorf(codes.InvalidArgument, "invalid container id %q", id)
+	}
+	return nil
+}
+
+// validateCreate checks a CreateContainer request
+func validateCreate(req *pb.CreateContainerRequest) error {
+	if err := validateContainerID(req.GetId()); err != nil {
+		return err
+	}
+	if err := network.ValidateName(req.GetName()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := network.ValidateName(req.GetNamespace()); err != nil {
+		return status.Error(codes.InvalidArgument, "namespace: "+err.Error())
+	}
+	if _, err := network.ParseMAC(req.GetMac()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateRequestedIPs(req.GetRequestedIp(), req.GetRequestedIp6()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateAttachment(req.GetAttachment()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateSources(req.GetAllowedSources(), req.GetCapabilities()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	for _, d := range req.GetRequiredDestinations() {
+		if d.GetPort() > 65535 {
+			return status.Errorf(codes.InvalidArgument, "required destination %s: invalid port %d", d.GetAddr(), d.GetPort())
+		}
+	}
+	if req.GetDnsTtl() > network.MaxDNSTTL {
+		return status.Errorf(codes.InvalidArgument, "dns_ttl %d is longer than %d", req.GetDnsTtl(), network.MaxDNSTTL)
+	}
+	if req.GetMtu() < 0 {
+		return status.Error(codes.InvalidArgument, "mtu must not be negative")
+	}
+	if req.GetPlacement().GetCpuMillicores() < 0 {
+		return status.Error(codes.InvalidArgument, "placement cpu_millicores must not be negative")
+	}
+	return nil
+}
+
+// validateRequestedIPs checks that the requested addresses, when set, are
+// IPv4 and IPv6 addresses respectively. Whether the node can hand them
+// out is up to its network manager.
+func validateRequestedIPs(ipv4, ipv6 string) error {
+	for _, r := range []struct {
+		s, family string
+		is4       bool
+	}{{ipv4, "IPv4", true}, {ipv6, "IPv6", false}} {
+		if r.s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(r.s); err != nil || addr.Is4() != r.is4 {
+			return fmt.Errorf("requested address %q is not an %s address", r.s, r.family)
+		}
+	}
+	return nil
+}
+
+// validateSources checks that the allowed sources are prefixes and the
+// capabilities ones the network manager knows. Whether the container may
+// opt out of source checks is up to it.
+func validateSources(allowed, capabilities []string) error {
+	for _, s := range allowed {
+		if _, err := netip.ParsePrefix(s); err != nil {
+			return fmt.Errorf("allowed source %q is not a prefix", s)
+		}
+	}
+	for _, c := range capabilities {
+		if network.NetworkCapability(c) != network.CapabilitySpoofSource {
+			return fmt.Errorf("unknown capability %q", c)
+		}
+	}
+	return nil
+}
+
+// validateAttachment checks that attachment, when set, is one the network
+// manager knows. Whether the node has the devices is up to it.
+func validateAttachment(attachment string) error {
+	switch network.Attachment(attachment) {
+	case "", network.AttachmentVeth, network.AttachmentSRIOV, network.AttachmentMacvlan:
+		return nil
+	}
+	return fmt.Errorf("unknown attachment %q", attachment)
+}
+
+// networkCapabilities converts the capabilities of a request
+func networkCapabilities(capabilities []string) []network.NetworkCapability {
+	var out []network.NetworkCapability
+	for _, c := range capabilities {
+		out = append(out, network.NetworkCapability(c))
+	}
+	return out
+}
+
+// existing returns the container a create of id finds, if any. Failed
+// containers are created anew, and so are those left DELETING without a
+// delete in flight, e.g. by a leader that lost its leadership mid-delete.
+// A create racing a delete of id fails with ABORTED. Callers must hold
+// s.mu.
+func (s *containerService) existing(id string) (*pb.Container, bool, error) {
+	c, ok := s.containers[id]
+	if !ok || c.State == pb.ContainerState_CONTAINER_STATE_FAILED {
+		return nil, false, nil
+	}
+	if c.State == pb.ContainerState_CONTAINER_STATE_DELETING {
+		if s.busy[id] {
+			return nil, false, status.Errorf(codes.Aborted, "container %q is being deleted", id)
+		}
+		return nil, false, nil
+	}
+	return cloneContainer(c), true, nil
+}
+
+// createContainer admits and runs a validated CreateContainer request.
+// Replays of an idempotent create aren't admitted again.
+func (s *containerService) createContainer(ctx context.Context, req *pb.CreateContainerRequest) (*pb.CreateContainerResponse, error) {
+	req, err := s.admission.admitCreate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCreate(req); err != nil {
+		return nil, err
+	}
+	if req.Placement != nil {
+		return s.placeContainer(ctx, req)
+	}
+
+	s.mu.Lock()
+	if c, ok, err := s.existing(req.Id); ok || err != nil {
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return &pb.CreateContainerResponse{Container: c}, nil
+	}
+	c := &pb.Container{
+		Id:        req.Id,
+		Name:      req.Name,
+		Namespace: namespaceOrDefault(req.Namespace),
+		Labels:    req.Labels,
+		State:     pb.ContainerState_CONTAINER_STATE_CREATING,
+		CreatedAt: timestamppb.Now(),
+	}
+	s.containers[req.Id] = c
+	s.busy[req.Id] = true
+	s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_CREATED, c)
+	s.mu.Unlock()
+
+	cn, err := s.network.CreateContainerNetwork(ctx, network.ContainerNetworkSpec{
+		ContainerID: req.Id,
+		Name:        req.Name,
+		NetnsPath:   req.NetnsPath,
+		Pid:         int(req.Pid),
+		MAC:         req.Mac,
+		MTU:         int(req.Mtu),
+		Namespace:   req.Namespace,
+		IngressBps:  req.IngressBps,
+		EgressBps:   req.EgressBps,
+
+		RequestedIP:  req.RequestedIp,
+		RequestedIP6: req.RequestedIp6,
+		Attachment:   network.Attachment(req.Attachment),
+		DNSTTL:       req.DnsTtl,
+
+		AllowedSources:     req.AllowedSources,
+		Capabilities:       networkCapabilities(req.Capabilities),
+		DisableSourceCheck: req.DisableSourceCheck,
+		CgroupPath:         req.CgroupPath,
+
+		RequiredDestinations: requiredDestinations(req.RequiredDestinations),
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, req.Id)
+	if err != nil {
+		s.logger(ctx).Error("Failed to create container network", "container_id", req.Id, "error", err)
+		c.State = pb.ContainerState_CONTAINER_STATE_FAILED
+		c.Error = err.Error()
+		s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NETWORK_ERROR, c)
+		return nil, networkError(err)
+	}
+	setContainerNetwork(c, cn)
+	c.State = pb.ContainerState_CONTAINER_STATE_READY
+	s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NETWORK_READY, c)
+	resp := &pb.CreateContainerResponse{Container: cloneContainer(c)}
+	if req.IncludeTimings && cn.Timing != nil {
+		resp.Timings = setupTimings(cn.Timing)
+	}
+	if cn.Readiness != nil {
+		resp.Readiness = readinessReport(*cn.Readiness)
+	}
+	return resp, nil
+}
+
+// requiredDestinations converts the required destinations of a create
+func requiredDestinations(dests []*pb.Destination) []network.Destination {
+	var out []network.Destination
+	for _, d := range dests {
+		out = append(out, network.Destination{Addr: d.Addr, Protocol: d.Protocol, Port: uint16(d.Port)})
+	}
+	return out
+}
+
+// setupTimings converts the timing of a container network setup
+func setupTimings(t *network.SetupTiming) *pb.SetupTimings {
+	out := &pb.SetupTimings{
+		Total:  durationpb.New(t.Total),
+		Stages: make(map[string]*durationpb.Duration, len(t.Stages)),
+	}
+	for stage, d := range t.Stages {
+		out.Stages[string(stage)] = durationpb.New(d)
+	}
+	return out
+}
+
+// placeContainer runs a validated CreateContainer request with a
+// placement, creating the container on the node the scheduler picks
+func (s *containerService) placeContainer(ctx context.Context, req *pb.CreateContainerRequest) (*pb.CreateContainerResponse, error) {
+	s.mu.Lock()
+	if c, ok, err := s.existing(req.Id); ok || err != nil {
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return &pb.CreateContainerResponse{Container: c}, nil
+	}
+	// Picking under s.mu lets concurrent placements see each other
+	node, err := s.scheduler.pick(req, s.placedContainers())
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	c := &pb.Container{
+		Id:        req.Id,
+		Name:      req.Name,
+		Namespace: namespaceOrDefault(req.Namespace),
+		Labels:    req.Labels,
+		Node:      node.Name,
+		State:     pb.ContainerState_CONTAINER_STATE_CREATING,
+		CreatedAt: timestamppb.Now(),
+	}
+	s.containers[req.Id] = c
+	s.busy[req.Id] = true
+	s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_CREATED, c)
+	s.mu.Unlock()
+	s.logger(ctx).Info("Scheduled container", "container_id", req.Id, "node", node.Name)
+
+	created, err := s.scheduler.create(ctx, node.Name, req)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, req.Id)
+	if err != nil {
+		s.logger(ctx).Error("Failed to create container on node", "container_id", req.Id, "node", node.Name, "error", err)
+		c.State = pb.ContainerState_CONTAINER_STATE_FAILED
+		c.Error = status.Convert(err).Message()
+		s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NETWORK_ERROR, c)
+		return nil, err
+	}
+	c.Ip = created.Ip
+	c.Ipv6 = created.Ipv6
+	c.Mac = created.Mac
+	c.Mtu = created.Mtu
+	c.IngressBps = created.IngressBps
+	c.EgressBps = created.EgressBps
+	c.HostInterface = created.HostInterface
+	c.Attachment = created.Attachment
+	c.Device = created.Device
+	c.State = pb.ContainerState_CONTAINER_STATE_READY
+	s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NETWORK_READY, c)
+	return &pb.CreateContainerResponse{Container: cloneContainer(c)}, nil
+}
+
+// StartContainer has the runtime start a container whose network is set
+// up, on the node the container was placed on if any
+func (s *containerService) StartContainer(ctx context.Context, req *pb.StartContainerRequest) (*pb.StartContainerResponse, error) {
+	if err := s.admitStart(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	c, err := s.transition(ctx, req.GetId(), pb.ContainerState_CONTAINER_STATE_RUNNING, func(node string) error {
+		if node != "" {
+			return s.scheduler.start(ctx, node, req.Id)
+		}
+		return s.runtime.Start(ctx, req.Id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.StartContainerResponse{Container: c}, nil
+}
+
+// admitStart runs the admission controllers on a container about to be
+// started. Unknown containers are left for transition to reject.
+func (s *containerService) admitStart(ctx context.Context, id string) error {
+	if len(s.admission.controllers) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	c, ok := s.containers[id]
+	if ok {
+		c = cloneContainer(c)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.admission.admitStart(ctx, c)
+}
+
+// StopContainer has the runtime stop a running container
+func (s *containerService) StopContainer(ctx context.Context, req *pb.StopContainerRequest) (*pb.StopContainerResponse, error) {
+	timeout := defaultStopTimeout
+	if req.GetTimeout() != nil {
+		if err := req.Timeout.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid timeout: %v", err)
+		}
+		timeout = req.Timeout.AsDuration()
+		if timeout > maxStopTimeout || timeout < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "timeout must be between 0 and %s", maxStopTimeout)
+		}
+	}
+
+	c, err := s.transition(ctx, req.GetId(), pb.ContainerState_CONTAINER_STATE_STOPPED, func(node string) error {
+		if node != "" {
+			return s.scheduler.stop(ctx, node, req.Id, timeout)
+		}
+		return s.runtime.Stop(ctx, req.Id, timeout)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.StopContainerResponse{Container: c}, nil
+}
+
+// transition moves container id to state RUNNING or STOPPED by calling fn
+// with the node the container was placed on, which asks the runtime there
+// to do so. A container already in that state, or not running when
+// stopped, is returned unchanged. The runtime is called without holding
+// s.mu; meanwhile the container can't be deleted.
+func (s *containerService) transition(ctx context.Context, id string, to pb.ContainerState, fn func(node string) error) (*pb.Container, error) {
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "container id is required")
+	}
+
+	s.mu.Lock()
+	c, ok := s.containers[id]
+	if !ok {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.NotFound, "container %q not found", id)
+	}
+	if c.Node == "" && s.runtime == nil {
+		s.mu.Unlock()
+		return nil, runtimeError(ErrNoRuntime)
+	}
+	if s.busy[id] {
+		s.mu.Unlock()
+		switch c.State {
+		case pb.ContainerState_CONTAINER_STATE_CREATING:
+			return nil, status.Errorf(codes.Aborted, "container %q is being created", id)
+		case pb.ContainerState_CONTAINER_STATE_DELETING, pb.ContainerState_CONTAINER_STATE_DRAINING:
+			return nil, status.Errorf(codes.Aborted, "container %q is being deleted", id)
+		}
+		return nil, status.Errorf(codes.Aborted, "container %q is being started or stopped", id)
+	}
+	running := c.State == pb.ContainerState_CONTAINER_STATE_RUNNING
+	if c.State == to || (to == pb.ContainerState_CONTAINER_STATE_STOPPED && !running) {
+		defer s.mu.Unlock()
+		return cloneContainer(c), nil
+	}
+	if to == pb.ContainerState_CONTAINER_STATE_RUNNING && c.State != pb.ContainerState_CONTAINER_STATE_READY &&
+		c.State != pb.ContainerState_CONTAINER_STATE_STOPPED {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "container %q is %s", id, c.State)
+	}
+	s.busy[id] = true
+	node := c.Node
+	s.mu.Unlock()
+
+	err := fn(node)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, id)
+	if err != nil {
+		s.logger(ctx).Error("Container runtime failed", "container_id", id, "state", to, "error", err)
+		return nil, runtimeError(err)
+	}
+	c.State = to
+	typ := pb.ContainerEventType_CONTAINER_EVENT_TYPE_STARTED
+	if to == pb.ContainerState_CONTAINER_STATE_STOPPED {
+		typ = pb.ContainerEventType_CONTAINER_EVENT_TYPE_STOPPED
+	}
+	s.publish(typ, c)
+	return cloneContainer(c), nil
+}
+
+// maxDeleteDrain bounds the drain of a delete, like maxStopTimeout a stop
+const maxDeleteDrain = 5 * time.Minute
+
+// DeleteContainer tears down a container's networking. Running containers
+// have to be stopped first. With drain_seconds set, the container is
+// DRAINING until its connections close or the grace period expires,
+// publishing DRAINING events as they do.
+func (s *containerService) DeleteContainer(ctx context.Context, req *pb.DeleteContainerRequest) (*pb.DeleteContainerResponse, error) {
+	drain := time.Duration(req.GetDrainSeconds()) * time.Second
+	if drain > maxDeleteDrain {
+		return nil, status.Errorf(codes.InvalidArgument, "drain must be at most %s", maxDeleteDrain)
+	}
+
+	s.mu.Lock()
+	c, ok := s.containers[req.GetId()]
+	if !ok {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetId())
+	}
+	if c.State == pb.ContainerState_CONTAINER_STATE_DRAINING {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.Aborted, "container %q is being drained", c.Id)
+	}
+	if s.busy[c.Id] && c.State == pb.ContainerState_CONTAINER_STATE_CREATING {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.Aborted, "container %q is being created", c.Id)
+	}
+	if s.busy[c.Id] && c.State == pb.ContainerState_CONTAINER_STATE_DELETING {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.Aborted, "container %q is being deleted", c.Id)
+	}
+	if s.busy[c.Id] || c.State == pb.ContainerState_CONTAINER_STATE_RUNNING {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "container %q is running, stop it first", c.Id)
+	}
+	s.busy[c.Id] = true
+	node := c.Node
+	if drain > 0 {
+		c.State = pb.ContainerState_CONTAINER_STATE_DRAINING
+		s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_DRAINING, c)
+	} else {
+		c.State = pb.ContainerState_CONTAINER_STATE_DELETING
+		s.saveRegistry()
+	}
+	s.mu.Unlock()
+
+	var err error
+	switch {
+	case node != "":
+		// The node drains it, reporting the connections left in its own
+		// events
+		err = s.scheduler.delete(ctx, node, req.Id, drain)
+	case drain > 0:
+		err = s.drainContainer(ctx, c, drain)
+		if err == nil {
+			err = s.network.DeleteContainerNetwork(ctx, req.Id)
+		}
+		if err != nil {
+			err = networkError(err)
+		}
+	default:
+		if err = s.network.DeleteContainerNetwork(ctx, req.Id); err != nil {
+			err = networkError(err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, req.Id)
+	if err != nil {
+		s.logger(ctx).Error("Failed to delete container network", "container_id", req.Id, "node", node, "error", err)
+		c.State = pb.ContainerState_CONTAINER_STATE_FAILED
+		c.Error = status.Convert(err).Message()
+		c.DrainingFlows = 0
+		s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NETWORK_ERROR, c)
+		return nil, err
+	}
+	delete(s.containers, req.Id)
+	s.idempotency.forget(req.Id)
+	s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_DELETED, c)
+	return &pb.DeleteContainerResponse{}, nil
+}
+
+// drainContainer waits for the connections of c to close, for up to
+// drain, publishing the number left whenever it changes, and moves it to
+// DELETING after
+func (s *containerService) drainContainer(ctx context.Context, c *pb.Container, drain time.Duration) error {
+	remaining, err := s.network.DrainContainerNetwork(ctx, c.Id, drain, func(remaining int) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		c.DrainingFlows = uint32(remaining)
+		s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_DRAINING, c)
+	})
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		s.logger(ctx).Warn("Deleting container with connections left after drain", "container_id", c.Id, "remaining", remaining)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.State = pb.ContainerState_CONTAINER_STATE_DELETING
+	c.DrainingFlows = 0
+	s.saveRegistry()
+	return nil
+}
+
+// ListContainers returns all known containers, or those of a namespace,
+// ordered by ID
+func (s *containerService) ListContainers(ctx context.Context, req *pb.ListContainersRequest) (*pb.ListContainersResponse, error) {
+	if s.following() {
+		containers := s.cluster.fsm.listContainers()
+		if req.GetNamespace() != "" {
+			containers = slices.DeleteFunc(containers, func(c *pb.Container) bool {
+				return namespaceOrDefault(c.Namespace) != req.Namespace
+			})
+		}
+		return &pb.ListContainersResponse{Containers: containers}, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &pb.ListContainersResponse{Containers: make([]*pb.Container, 0, len(s.containers))}
+	for _, c := range s.containers {
+		if req.GetNamespace() != "" && namespaceOrDefault(c.Namespace) != req.Namespace {
+			continue
+		}
+		resp.Containers = append(resp.Containers, cloneContainer(c))
+	}
+	sort.Slice(resp.Containers, func(i, j int) bool {
+		return resp.Containers[i].Id < resp.Containers[j].Id
+	})
+	return resp, nil
+}
+
+// ContainerNetworks returns the containers with all of labels, or every
+// container when labels is empty, as ListContainers does. Once NewControlPlane
+// returns they include the networks restored from the state dir and those
+// re-adopted without a record.
+func (cp *ControlPlane) ContainerNetworks(labels map[string]string) ([]*pb.Container, error) {
+	resp, err := cp.containers.ListContainers(context.Background(), &pb.ListContainersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(resp.Containers, func(c *pb.Container) bool {
+		for k, v := range labels {
+			if l, ok := c.Labels[k]; !ok || l != v {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// GetContainer returns a single container
+func (s *containerService) GetContainer(ctx context.Context, req *pb.GetContainerRequest) (*pb.GetContainerResponse, error) {
+	if s.following() {
+		c, ok := s.cluster.fsm.getContainer(req.GetId())
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetId())
+		}
+		return &pb.GetContainerResponse{Container: c}, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.containers[req.GetId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetId())
+	}
+	return &pb.GetContainerResponse{Container: cloneContainer(c)}, nil
+}
+
+// WatchEvents streams container events until the client goes away or the
+// control plane shuts down, after the snapshot or the retained events the
+// watch resumes after
+func (s *containerService) WatchEvents(req *pb.WatchEventsRequest, stream pb.ContainerService_WatchEventsServer) error {
+	if req.GetIncludeSnapshot() && req.GetAfterSequence() != 0 {
+		return status.Error(codes.InvalidArgument, "include_snapshot and after_sequence are exclusive")
+	}
+
+	s.mu.Lock()
+	sub, backlog, err := s.events.subscribe(req.GetAfterSequence())
+	if errors.Is(err, errEventsNotRetained) {
+		s.mu.Unlock()
+		return status.Errorf(codes.OutOfRange, "events after %d are no longer retained, watch again with a snapshot", req.AfterSequence)
+	}
+	if err != nil {
+		s.mu.Unlock()
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if req.GetIncludeSnapshot() {
+		for _, c := range s.containers {
+			ev := newContainerEvent(pb.ContainerEventType_CONTAINER_EVENT_TYPE_SNAPSHOT, c)
+			ev.Sequence = sub.start
+			backlog = append(backlog, ev)
+		}
+		sort.Slice(backlog, func(i, j int) bool {
+			return backlog[i].ContainerId < backlog[j].ContainerId
+		})
+		backlog = append(backlog, &pb.ContainerEvent{
+			Type:      pb.ContainerEventType_CONTAINER_EVENT_TYPE_SNAPSHOT_END,
+			Timestamp: timestamppb.Now(),
+			Sequence:  sub.start,
+		})
+	}
+	s.mu.Unlock()
+	defer s.events.unsubscribe(sub)
+
+	// Tell clients the watch is established, even before any event
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for _, ev := range backlog {
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return status.Error(codes.Unavailable, "control plane shutting down")
+			}
+			if err := stream.Send(sub.annotate(ev)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ExposePort forwards a host port to a container port
+func (s *containerService) ExposePort(ctx context.Context, req *pb.ExposePortRequest) (*pb.ExposePortResponse, error) {
+	if err := validatePortForward(req.GetContainerId(), req.GetHostPort(), req.GetProtocol()); err != nil {
+		return nil, err
+	}
+	if req.GetContainerPort() == 0 || req.GetContainerPort() > 65535 {
+		return nil, status.Error(codes.InvalidArgument, "container port must be between 1 and 65535")
+	}
+
+	fwd, err := s.network.ExposePort(req.ContainerId, uint16(req.HostPort), uint16(req.ContainerPort), req.Protocol)
+	if err != nil {
+		return nil, networkError(err)
+	}
+	return &pb.ExposePortResponse{Forward: portForwardToProto(fwd)}, nil
+}
+
+// UnexposePort removes a port forward
+func (s *containerService) UnexposePort(ctx context.Context, req *pb.UnexposePortRequest) (*pb.UnexposePortResponse, error) {
+	if err := validatePortForward(req.GetContainerId(), req.GetHostPort(), req.GetProtocol()); err != nil {
+		return nil, err
+	}
+	if err := s.network.UnexposePort(req.ContainerId, uint16(req.HostPort), req.Protocol); err != nil {
+		return nil, networkError(err)
+	}
+	return &pb.UnexposePortResponse{}, nil
+}
+
+// ListPortForwards returns the active port forwards ordered by protocol
+// and host port
+func (s *containerService) ListPortForwards(ctx context.Context, req *pb.ListPortForwardsRequest) (*pb.ListPortForwardsResponse, error) {
+	resp := &pb.ListPortForwardsResponse{}
+	for _, fwd := range s.network.ListPortForwards() {
+		if req.GetContainerId() != "" && fwd.ContainerID != req.ContainerId {
+			continue
+		}
+		resp.Forwards = append(resp.Forwards, portForwardToProto(fwd))
+	}
+	return resp, nil
+}
+
+// CreateService adds a load-balanced service
+func (s *containerService) CreateService(ctx context.Context, req *pb.CreateServiceRequest) (*pb.CreateServiceResponse, error) {
+	svc := req.GetService()
+	if svc == nil {
+		return nil, status.Error(codes.InvalidArgument, "service is required")
+	}
+	if err := validateServicePorts(svc); err != nil {
+		return nil, err
+	}
+	s.servicesMu.Lock()
+	defer s.servicesMu.Unlock()
+
+	// Backends placed on other nodes are balanced to through the overlay
+	service := serviceFromProto(svc)
+	service.Backends, service.RemoteBackends = s.clusterView().split(service.Backends, "", true)
+	created, err := s.network.CreateService(service)
+	if err != nil {
+		return nil, networkError(err)
+	}
+	s.replicateService(created.Name)
+	s.distributor.kick()
+	return &pb.CreateServiceResponse{Service: serviceToProto(created)}, nil
+}
+
+// UpdateServiceBackends replaces the backends of a service
+func (s *containerService) UpdateServiceBackends(ctx context.Context, req *pb.UpdateServiceBackendsRequest) (*pb.UpdateServiceBackendsResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	s.servicesMu.Lock()
+	defer s.servicesMu.Unlock()
+
+	services := s.network.ListServices()
+	i := slices.IndexFunc(services, func(svc network.Service) bool { return svc.Name == req.Name })
+	if i < 0 {
+		return nil, status.Errorf(codes.NotFound, "%v: %s", network.ErrServiceNotFound, req.Name)
+	}
+	svc := services[i]
+	svc.Backends, svc.RemoteBackends = s.clusterView().split(req.Backends, "", true)
+	updated, err := s.network.PutService(svc)
+	if err != nil {
+		return nil, networkError(err)
+	}
+	s.replicateService(req.Name)
+	s.distributor.kick()
+	return &pb.UpdateServiceBackendsResponse{Service: serviceToProto(updated)}, nil
+}
+
+// DeleteService removes a service
+func (s *containerService) DeleteService(ctx context.Context, req *pb.DeleteServiceRequest) (*pb.DeleteServiceResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	s.servicesMu.Lock()
+	defer s.servicesMu.Unlock()
+	if err := s.network.DeleteService(req.Name); err != nil {
+		return nil, networkError(err)
+	}
+	s.replicateService(req.Name)
+	s.distributor.kick()
+	return &pb.DeleteServiceResponse{}, nil
+}
+
+// ListServices returns the services, or those of a namespace, ordered by
+// name
+func (s *containerService) ListServices(ctx context.Context, req *pb.ListServicesRequest) (*pb.ListServicesResponse, error) {
+	if s.following() {
+		services := s.cluster.fsm.listServices()
+		if req.GetNamespace() != "" {
+			services = slices.DeleteFunc(services, func(svc *pb.Service) bool {
+				return namespaceOrDefault(svc.Namespace) != req.Namespace
+			})
+		}
+		return &pb.ListServicesResponse{Services: services}, nil
+	}
+
+	resp := &pb.ListServicesResponse{}
+	for _, svc := range s.network.ListServices() {
+		if req.GetNamespace() != "" && svc.Namespace != req.Namespace {
+			continue
+		}
+		resp.Services = append(resp.Services, serviceToProto(svc))
+	}
+	return resp, nil
+}
+
+// SetBandwidthLimit replaces a container's bandwidth limits
+func (s *containerService) SetBandwidthLimit(ctx context.Context, req *pb.SetBandwidthLimitRequest) (*pb.SetBandwidthLimitResponse, error) {
+	if req.GetContainerId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "container id is required")
+	}
+	if err := s.network.SetBandwidthLimit(req.ContainerId, req.IngressBps, req.EgressBps); err != nil {
+		s.logger(ctx).Error("Failed to set bandwidth limit", "container_id", req.ContainerId, "error", err)
+		return nil, networkError(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.containers[req.ContainerId]; ok {
+		c.IngressBps, c.EgressBps = req.IngressBps, req.EgressBps
+		s.saveRegistry()
+	}
+	return &pb.SetBandwidthLimitResponse{}, nil
+}
+
+// SetQoSClass changes the priority of a container's traffic
+func (s *containerService) SetQoSClass(ctx context.Context, req *pb.SetQoSClassRequest) (*pb.SetQoSClassResponse, error) {
+	if req.GetContainerId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "container id is required")
+	}
+	if err := s.network.SetQoSClass(req.ContainerId, network.QoSClass(req.QosClass)); err != nil {
+		s.logger(ctx).Error("Failed to set QoS class", "container_id", req.ContainerId, "error", err)
+		return nil, networkError(err)
+	}
+	return &pb.SetQoSClassResponse{}, nil
+}
+
+// maxCaptureDuration bounds captures so they can't outlive a drain
+const maxCaptureDuration = 10 * time.Minute
+
+// CaptureTraffic streams the packets of a container in pcap format
+func (s *containerService) CaptureTraffic(req *pb.CaptureTrafficRequest, stream pb.ContainerService_CaptureTrafficServer) error {
+	if req.GetContainerId() == "" {
+		return status.Error(codes.InvalidArgument, "container id is required")
+	}
+	if req.GetPort() > 65535 {
+		return status.Error(codes.InvalidArgument, "port must be at most 65535")
+	}
+	duration := maxCaptureDuration
+	if req.Duration != nil {
+		if err := req.Duration.CheckValid(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid duration: %v", err)
+		}
+		if d := req.Duration.AsDuration(); d > maxCaptureDuration || d < 0 {
+			return status.Errorf(codes.InvalidArgument, "duration must be between 0 and %s", maxCaptureDuration)
+		} else if d > 0 {
+			duration = d
+		}
+	}
+
+	opts := network.CaptureOptions{
+		SnapLen:    int(req.SnapLength),
+		Duration:   duration,
+		MaxPackets: int(req.MaxPackets),
+		Protocol:   req.Protocol,
+		Port:       uint16(req.Port),
+	}
+	_, err := s.network.CaptureTraffic(stream.Context(), req.ContainerId, opts, captureStreamWriter{stream})
+	if err != nil {
+		if st, ok := status.FromError(err); ok {
+			return st.Err()
+		}
+		return networkError(err)
+	}
+	return nil
+}
+
+// StreamLogs streams the log the runtime writes for a container. Follows
+// end when the control plane shuts down.
+func (s *containerService) StreamLogs(req *pb.StreamLogsRequest, stream pb.ContainerService_StreamLogsServer) error {
+	id := req.GetContainerId()
+	if err := validateContainerID(id); err != nil {
+		return err
+	}
+	opts := containerlog.Options{
+		Follow: req.Follow,
+		Tail:   int(req.Tail),
+	}
+	if req.Since != nil {
+		if err := req.Since.CheckValid(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid since: %v", err)
+		}
+		opts.Since = req.Since.AsTime()
+	}
+	switch req.Stream {
+	case pb.LogStream_LOG_STREAM_UNSPECIFIED:
+	case pb.LogStream_LOG_STREAM_STDOUT:
+		opts.Stream = containerlog.Stdout
+	case pb.LogStream_LOG_STREAM_STDERR:
+		opts.Stream = containerlog.Stderr
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown stream %v", req.Stream)
+	}
+	if s.logDir == "" {
+		return status.Error(codes.FailedPrecondition, "container logs are not configured")
+	}
+
+	// Logs outlive the registry across restarts, so either will do
+	path := filepath.Join(s.logDir, id+".log")
+	s.mu.Lock()
+	_, known := s.containers[id]
+	s.mu.Unlock()
+	if !known {
+		if _, err := os.Stat(path); err != nil {
+			return status.Errorf(codes.NotFound, "container %q not found", id)
+		}
+	}
+
+	// Tell clients the stream is established, even before any output
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.events.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := containerlog.Read(ctx, path, opts, func(entries []containerlog.Entry) error {
+		resp := &pb.StreamLogsResponse{Entries: make([]*pb.LogEntry, len(entries))}
+		for i, e := range entries {
+			resp.Entries[i] = logEntryToProto(e)
+		}
+		// Blocks while the client is behind, which pauses reading
+		return stream.Send(resp)
+	})
+	switch {
+	case err == nil:
+		return nil
+	case stream.Context().Err() != nil:
+		return status.FromContextError(stream.Context().Err()).Err()
+	case ctx.Err() != nil:
+		return status.Error(codes.Unavailable, "control plane shutting down")
+	default:
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func logEntryToProto(e containerlog.Entry) *pb.LogEntry {
+	stream := pb.LogStream_LOG_STREAM_STDOUT
+	if e.Stream == containerlog.Stderr {
+		stream = pb.LogStream_LOG_STREAM_STDERR
+	}
+	return &pb.LogEntry{
+		Timestamp: timestamppb.New(e.Time),
+		Stream:    stream,
+		Partial:   e.Partial,
+		Data:      e.Data,
+	}
+}
+
+// captureStreamWriter sends each write as one response message
+type captureStreamWriter struct {
+	stream pb.ContainerService_CaptureTrafficServer
+}
+
+func (w captureStreamWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&pb.CaptureTrafficResponse{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func validatePortForward(containerID string, hostPort uint32, protocol string) error {
+	if containerID == "" {
+		return status.Error(codes.InvalidArgument, "container id is required")
+	}
+	if hostPort == 0 || hostPort > 65535 {
+		return status.Error(codes.InvalidArgument, "host port must be between 1 and 65535")
+	}
+	if protocol != "" && protocol != "tcp" && protocol != "udp" {
+		return status.Errorf(codes.InvalidArgument, "unsupported protocol %q", protocol)
+	}
+	return nil
+}
+
+func portForwardToProto(fwd network.PortForward) *pb.PortForward {
+	return &pb.PortForward{
+		ContainerId:   fwd.ContainerID,
+		HostPort:      uint32(fwd.HostPort),
+		ContainerPort: uint32(fwd.ContainerPort),
+		Protocol:      fwd.Protocol,
+	}
+}
+
+func serviceFromProto(svc *pb.Service) network.Service {
+	out := network.Service{
+		Name:             svc.GetName(),
+		Namespace:        namespaceOrDefault(svc.GetNamespace()),
+		VIP:              svc.GetVip(),
+		Port:             uint16(svc.GetPort()),
+		Protocol:         svc.GetProtocol(),
+		TargetPort:       uint16(svc.GetTargetPort()),
+		Backends:         svc.GetBackends(),
+		Topology:         network.TopologyPreference(svc.GetTopology()),
+		MinLocalBackends: int(svc.GetMinLocalBackends()),
+		ExposeNodePort:   svc.GetExposeNodePort(),
+		NodePort:         uint16(svc.GetNodePort()),
+	}
+	for _, p := range svc.GetPorts() {
+		port := network.ServicePort{
+			Name:       p.GetName(),
+			Port:       uint16(p.GetPort()),
+			Protocol:   p.GetProtocol(),
+			TargetPort: uint16(p.GetTargetPort()),
+			NodePort:   uint16(p.GetNodePort()),
+		}
+		if hc := p.GetHealthCheck(); hc != nil {
+			port.HealthCheck = &network.ServiceHealthCheck{
+				Port:      uint16(hc.GetPort()),
+				Interval:  hc.GetInterval().AsDuration(),
+				Timeout:   hc.GetTimeout().AsDuration(),
+				Threshold: int(hc.GetThreshold()),
+			}
+		}
+		out.Ports = append(out.Ports, port)
+	}
+	for _, bp := range svc.GetBackendPorts() {
+		out.BackendPorts = append(out.BackendPorts, network.BackendPort{
+			ContainerID: bp.GetContainerId(),
+			Port:        bp.GetPort(),
+			TargetPort:  uint16(bp.GetTargetPort()),
+		})
+	}
+	return out
+}
+
+func serviceToProto(svc network.Service) *pb.Service {
+	out := &pb.Service{
+		Name:             svc.Name,
+		Namespace:        svc.Namespace,
+		Vip:              svc.VIP,
+		Port:             uint32(svc.Port),
+		Protocol:         svc.Protocol,
+		TargetPort:       uint32(svc.TargetPort),
+		Backends:         serviceBackendIDs(svc),
+		Topology:         string(svc.Topology),
+		MinLocalBackends: uint32(svc.MinLocalBackends),
+		ExposeNodePort:   svc.ExposeNodePort,
+		NodePort:         uint32(svc.NodePort),
+	}
+	for _, p := range svc.Ports {
+		port := &pb.ServicePort{
+			Name:       p.Name,
+			Port:       uint32(p.Port),
+			Protocol:   p.Protocol,
+			TargetPort: uint32(p.TargetPort),
+			NodePort:   uint32(p.NodePort),
+		}
+		if hc := p.HealthCheck; hc != nil {
+			port.HealthCheck = &pb.ServiceHealthCheck{
+				Port:      uint32(hc.Port),
+				Interval:  durationpb.New(hc.Interval),
+				Timeout:   durationpb.New(hc.Timeout),
+				Threshold: uint32(hc.Threshold),
+			}
+		}
+		out.Ports = append(out.Ports, port)
+	}
+	for _, bp := range svc.BackendPorts {
+		out.BackendPorts = append(out.BackendPorts, &pb.BackendPort{
+			ContainerId: bp.ContainerID,
+			Port:        bp.Port,
+			TargetPort:  uint32(bp.TargetPort),
+		})
+	}
+	return out
+}
+
+// validateServicePorts checks that the ports of svc fit in 16 bits
+func validateServicePorts(svc *pb.Service) error {
+	if err := checkServicePorts(svc); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// checkServicePorts checks that the ports of svc fit in 16 bits
+func checkServicePorts(svc *pb.Service) error {
+	ports := []uint32{svc.GetPort(), svc.GetTargetPort(), svc.GetNodePort()}
+	for _, p := range svc.GetPorts() {
+		ports = append(ports, p.GetPort(), p.GetTargetPort(), p.GetNodePort(), p.GetHealthCheck().GetPort())
+	}
+	for _, bp := range svc.GetBackendPorts() {
+		ports = append(ports, bp.GetTargetPort())
+	}
+	for _, p := range ports {
+		if p > 65535 {
+			return errors.New("ports must be at most 65535")
+		}
+	}
+	return nil
+}
+
+// publish sends an event for c to watchers, persists the registry,
+// replicates c and has the services redistributed as placements change.
+// Callers must hold s.mu.
+func (s *containerService) publish(typ pb.ContainerEventType, c *pb.Container) {
+	s.events.publish(newContainerEvent(typ, c))
+	s.saveRegistry()
+	s.distributor.kick()
+	if s.cluster == nil {
+		return
+	}
+	if typ == pb.ContainerEventType_CONTAINER_EVENT_TYPE_DELETED {
+		s.cluster.deleteContainer(c.Id)
+	} else {
+		s.cluster.putContainer(c)
+	}
+}
+
+// replicateService replicates the current definition of service name, or
+// its removal. Reading it back under s.mu keeps concurrent changes in
+// order.
+func (s *containerService) replicateService(name string) {
+	if s.cluster == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, svc := range s.network.ListServices() {
+		if svc.Name == name {
+			s.cluster.putService(serviceToProto(svc))
+			return
+		}
+	}
+	s.cluster.deleteService(name)
+}
+
+// syncCluster replaces the replicated state with this control plane's
+// registry and services, once it is elected. Container networks are set
+// up on the leader's node, so its registry is the one clients act on,
+// except for the containers placed on other nodes, which it takes over.
+func (s *containerService) syncCluster() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.cluster.fsm.listContainers() {
+		if _, ok := s.containers[c.Id]; !ok && c.Node != "" {
+			s.containers[c.Id] = c
+		}
+	}
+	containers := make([]*pb.Container, 0, len(s.containers))
+	for _, c := range s.containers {
+		containers = append(containers, c)
+	}
+	var services []*pb.Service
+	for _, svc := range s.network.ListServices() {
+		services = append(services, serviceToProto(svc))
+	}
+	s.cluster.sync(containers, services)
+}
+
+// following reports whether reads are served from the Raft replica, as
+// this control plane is a follower
+func (s *containerService) following() bool {
+	return s.cluster != nil && !s.cluster.IsLeader()
+}
+
+func newContainerEvent(typ pb.ContainerEventType, c *pb.Container) *pb.ContainerEvent {
+	ev := &pb.ContainerEvent{
+		Type:        typ,
+		ContainerId: c.Id,
+		Timestamp:   timestamppb.Now(),
+		Ip:          c.Ip,
+		Ipv6:        c.Ipv6,
+		Error:       c.Error,
+	}
+	if typ != pb.ContainerEventType_CONTAINER_EVENT_TYPE_DELETED {
+		ev.Container = cloneContainer(c)
+	}
+	return ev
+}
+
+// logger returns the request logger set by the logging interceptor
+func (s *containerService) logger(ctx context.Context) *slog.Logger {
+	return logging.FromContext(ctx, s.log)
+}
+
+// cloneContainer copies c so responses don't race with registry updates.
+// Callers must hold s.mu.
+func cloneContainer(c *pb.Container) *pb.Container {
+	return proto.Clone(c).(*pb.Container)
+}
+
+// networkError maps network package errors to gRPC status codes
+func networkError(err error) error {
+	switch {
+	case errors.Is(err, network.ErrPoolExhausted), errors.Is(err, network.ErrQuotaExceeded),
+		errors.Is(err, network.ErrDeviceUnavailable), errors.Is(err, network.ErrSNATExhausted):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, network.ErrContainerNotFound), errors.Is(err, network.ErrForwardNotFound),
+		errors.Is(err, network.ErrPolicyNotFound), errors.Is(err, network.ErrServiceNotFound),
+		errors.Is(err, network.ErrPeerNotFound), errors.Is(err, network.ErrNamespaceNotFound),
+		errors.Is(err, network.ErrAFXDPNotFound), errors.Is(err, network.ErrMapNotFound),
+		errors.Is(err, network.ErrReservationNotFound), errors.Is(err, network.ErrSNATPortNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, network.ErrPortInUse), errors.Is(err, network.ErrNameInUse),
+		errors.Is(err, network.ErrMACInUse), errors.Is(err, network.ErrServiceExists),
+		errors.Is(err, network.ErrNamespaceExists), errors.Is(err, network.ErrAFXDPInUse),
+		errors.Is(err, network.ErrAddressInUse):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, network.ErrInvalidName), errors.Is(err, network.ErrInvalidMAC),
+		errors.Is(err, network.ErrInvalidCapture), errors.Is(err, network.ErrInvalidDatapath),
+		errors.Is(err, network.ErrInvalidPolicy), errors.Is(err, network.ErrInvalidService),
+		errors.Is(err, network.ErrInvalidPeer), errors.Is(err, network.ErrInvalidQoSClass),
+		errors.Is(err, network.ErrInvalidNamespace), errors.Is(err, network.ErrInvalidAFXDP),
+		errors.Is(err, network.ErrInvalidInspection), errors.Is(err, network.ErrInvalidDropFilter),
+		errors.Is(err, network.ErrInvalidAddress), errors.Is(err, network.ErrInvalidNetworkState),
+		errors.Is(err, network.ErrInvalidFault), errors.Is(err, network.ErrInvalidAttachment), invalidConfig(err):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, network.ErrXDPInactive), errors.Is(err, network.ErrOverlayDisabled),
+		errors.Is(err, network.ErrEncryptionDisabled), errors.Is(err, network.ErrNamespaceNotEmpty),
+		errors.Is(err, network.ErrRootless), errors.Is(err, network.ErrAnalyticsDisabled),
+		errors.Is(err, network.ErrDirectAttachment):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, network.ErrCapabilityRequired):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, network.ErrUnsupportedPlatform):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.Is(err, network.ErrIPAMUnavailable), errors.Is(err, network.ErrNotReady):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// invalidConfig reports whether err is due to an invalid network
+// configuration
+func invalidConfig(err error) bool {
+	return errors.Is(err, network.ErrInvalidCIDR) || errors.Is(err, network.ErrInvalidMTU) ||
+		errors.Is(err, network.ErrInvalidInterface) || errors.Is(err, network.ErrInvalidConfig)
+}
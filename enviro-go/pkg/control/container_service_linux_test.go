@@ -0,0 +1,381 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// lifecycleTestEnv has a child of TestContainerLifecycle run the test in
+// the network namespace of its own it was started in
+const lifecycleTestEnv = "ENVIRO_TEST_CONTAINER_LIFECYCLE"
+
+// TestContainerLifecycle serves the ContainerService on a bufconn listener
+// and creates, gets, lists and deletes containers through a gRPC client,
+// also with creates and deletes of the same container racing. It runs in
+// a child in a network namespace of its own, so the veths stay off the
+// host.
+func TestContainerLifecycle(t *testing.T) {
+	if os.Getenv(lifecycleTestEnv) != "" {
+		runContainerLifecycle(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating container networks needs root")
+	}
+	runInNetns(t, lifecycleTestEnv)
+}
+
+// runInNetns runs the test t again in a child in a network namespace of
+// its own, with env set to tell the child apart, like the helper of the
+// same name in pkg/network
+func runInNetns(t *testing.T, env string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), env+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Skipf("can't create a network namespace: %v", err)
+	}
+	// Subtests of the child are reported as "--- SKIP: name/subtest"
+	if strings.Contains(string(out), "--- SKIP: "+t.Name()+" (") {
+		t.Skipf("child skipped:\n%s", out)
+	}
+	if err != nil || !strings.Contains(string(out), "--- PASS: "+t.Name()+" (") {
+		t.Fatalf("child failed: %v\n%s", err, out)
+	}
+}
+
+// newNetns starts a process in a network namespace of its own for the
+// duration of the test and returns the path of the namespace
+func newNetns(t *testing.T) string {
+	t.Helper()
+	sleep := exec.Command("sleep", "infinity")
+	sleep.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWNET}
+	if err := sleep.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sleep.Process.Kill()
+		sleep.Wait()
+	})
+	return fmt.Sprintf("/proc/%d/ns/net", sleep.Process.Pid)
+}
+
+func runContainerLifecycle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	nm, err := network.NewNetworkManager(network.NetworkConfig{CIDR: "10.99.0.0/24", Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+	s := newContainerService(nm, nil, t.TempDir(), newEventBus(), logger)
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterContainerServiceServer(server, s)
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.DialContext(ctx, "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewContainerServiceClient(conn)
+
+	t.Run("lifecycle", func(t *testing.T) {
+		netns := newNetns(t)
+		created, err := client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "c1", Name: "web", NetnsPath: netns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := created.Container
+		if c.State != pb.ContainerState_CONTAINER_STATE_READY || c.Ip == "" || c.HostInterface == "" {
+			t.Fatalf("created container %v, want it READY with an address and a veth", c)
+		}
+		// Creating it again returns it as it is
+		again, err := client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "c1", Name: "web", NetnsPath: netns})
+		if err != nil || again.Container.Ip != c.Ip {
+			t.Errorf("repeated create = %v, %v, want %s", again.GetContainer(), err, c.Ip)
+		}
+
+		got, err := client.GetContainer(ctx, &pb.GetContainerRequest{Id: "c1"})
+		if err != nil || got.Container.Ip != c.Ip || got.Container.Name != "web" {
+			t.Errorf("GetContainer() = %v, %v, want %v", got.GetContainer(), err, c)
+		}
+		list, err := client.ListContainers(ctx, &pb.ListContainersRequest{})
+		if err != nil || len(list.Containers) != 1 || list.Containers[0].Id != "c1" {
+			t.Errorf("ListContainers() = %v, %v, want c1", list.GetContainers(), err)
+		}
+
+		if _, err := client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "c1"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.GetContainer(ctx, &pb.GetContainerRequest{Id: "c1"}); status.Code(err) != codes.NotFound {
+			t.Errorf("GetContainer() after delete = %v, want %v", err, codes.NotFound)
+		}
+		if _, err := netlink.LinkByName(c.HostInterface); err == nil {
+			t.Errorf("veth %s left after delete", c.HostInterface)
+		}
+		if _, err := client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "c1"}); status.Code(err) != codes.NotFound {
+			t.Errorf("repeated delete = %v, want %v", err, codes.NotFound)
+		}
+	})
+
+	t.Run("in flight", func(t *testing.T) {
+		// Operations on a container another create or delete holds fail
+		// with ABORTED; one left DELETING by another leader is created
+		// anew
+		s.mu.Lock()
+		s.containers["creating"] = &pb.Container{Id: "creating", State: pb.ContainerState_CONTAINER_STATE_CREATING}
+		s.containers["deleting"] = &pb.Container{Id: "deleting", State: pb.ContainerState_CONTAINER_STATE_DELETING}
+		s.containers["stale"] = &pb.Container{Id: "stale", State: pb.ContainerState_CONTAINER_STATE_DELETING}
+		s.busy["creating"], s.busy["deleting"] = true, true
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			delete(s.containers, "creating")
+			delete(s.containers, "deleting")
+			clear(s.busy)
+			s.mu.Unlock()
+		}()
+
+		if _, err := client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "creating"}); status.Code(err) != codes.Aborted {
+			t.Errorf("delete of a container being created = %v, want %v", err, codes.Aborted)
+		}
+		if _, err := client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "deleting"}); status.Code(err) != codes.Aborted {
+			t.Errorf("delete of a container being deleted = %v, want %v", err, codes.Aborted)
+		}
+		if _, err := client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "deleting", NetnsPath: newNetns(t)}); status.Code(err) != codes.Aborted {
+			t.Errorf("create of a container being deleted = %v, want %v", err, codes.Aborted)
+		}
+		created, err := client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "stale", NetnsPath: newNetns(t)})
+		if err != nil || created.Container.State != pb.ContainerState_CONTAINER_STATE_READY {
+			t.Fatalf("create of a stale DELETING container = %v, %v, want it created anew", created.GetContainer(), err)
+		}
+		if _, err := client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "stale"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("concurrent create and delete", func(t *testing.T) {
+		netns := newNetns(t)
+		for i := 0; i < 20; i++ {
+			var wg sync.WaitGroup
+			var createErr, deleteErr error
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_, createErr = client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "racy", NetnsPath: netns})
+			}()
+			go func() {
+				defer wg.Done()
+				_, deleteErr = client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "racy"})
+			}()
+			wg.Wait()
+			if createErr != nil {
+				t.Fatalf("round %d: create = %v", i, createErr)
+			}
+
+			got, err := client.GetContainer(ctx, &pb.GetContainerRequest{Id: "racy"})
+			_, hasNetwork := nm.ContainerNetworks()["racy"]
+			switch code := status.Code(deleteErr); code {
+			case codes.OK:
+				// The delete ran after the create and removed all of it
+				if status.Code(err) != codes.NotFound || hasNetwork {
+					t.Fatalf("round %d: after delete the container is %v, %v with network %v", i, got.GetContainer(), err, hasNetwork)
+				}
+				continue
+			case codes.NotFound, codes.Aborted:
+				// The delete ran before the create registered it, or while
+				// it ran, and left it alone
+				if err != nil || got.Container.State != pb.ContainerState_CONTAINER_STATE_READY || !hasNetwork {
+					t.Fatalf("round %d: delete = %v, then the container is %v, %v with network %v", i, deleteErr, got.GetContainer(), err, hasNetwork)
+				}
+			default:
+				t.Fatalf("round %d: delete = %v", i, deleteErr)
+			}
+			if _, err := client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "racy"}); err != nil {
+				t.Fatalf("round %d: %v", i, err)
+			}
+		}
+		if got := nm.Allocations(); len(got) != 0 {
+			t.Errorf("addresses %v left allocated", got)
+		}
+	})
+
+	t.Run("reconcile", func(t *testing.T) {
+		// Passes are run here rather than by the loop, one at a time
+		r := newReconciler(ReconcileConfig{}, s, nil, nil, nil, logger)
+		s.reconciler = r
+		defer func() { s.reconciler = nil }()
+		netns := newNetns(t)
+
+		// pass applies spec, reconciles the node with it and returns the
+		// container of the spec, if any
+		pass := func(step string, spec *pb.Spec) *pb.Container {
+			t.Helper()
+			if _, err := client.ApplySpec(ctx, &pb.ApplySpecRequest{Spec: spec}); err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			r.reconcile(ctx)
+			got, err := client.GetSpec(ctx, &pb.GetSpecRequest{})
+			if err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			if st := got.Status; st.GetGeneration() != got.Generation || !st.GetConverged() {
+				t.Errorf("%s: status %v of generation %d, want it converged", step, st, got.Generation)
+			}
+			c, err := client.GetContainer(ctx, &pb.GetContainerRequest{Id: "spec"})
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			return c.Container
+		}
+
+		spec := &pb.Spec{Containers: []*pb.ContainerSpec{{Id: "spec", Name: "web", NetnsPath: netns}}}
+		created := pass("create", spec)
+		if created == nil || created.Name != "web" || created.State != pb.ContainerState_CONTAINER_STATE_READY {
+			t.Fatalf("reconciled container %v, want web READY", created)
+		}
+		if again := pass("reconcile again", spec); again == nil || again.HostInterface != created.HostInterface {
+			t.Errorf("reconciling again changed the container to %v", again)
+		}
+
+		// A container deleted behind the reconciler's back is created
+		// again, and one that drifted from the spec recreated
+		if _, err := client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "spec"}); err != nil {
+			t.Fatal(err)
+		}
+		if c := pass("deleted", spec); c == nil {
+			t.Error("deleted container not created again")
+		}
+		spec.Containers[0].Name = "api"
+		if c := pass("drifted", spec); c == nil || c.Name != "api" {
+			t.Errorf("drifted container reconciled to %v, want it named api", c)
+		}
+
+		if c := pass("pruned", &pb.Spec{}); c != nil {
+			t.Errorf("container %v left after the spec dropped it", c)
+		}
+		if len(r.managed.Containers) != 0 {
+			t.Errorf("managed containers %v left after pruning", r.managed.Containers)
+		}
+	})
+
+	t.Run("chaos", func(t *testing.T) {
+		chaos := newChaosService(ChaosConfig{Enable: true}, nm, logger)
+		created, err := client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "faulted", NetnsPath: newNetns(t)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "faulted"})
+		link, err := netlink.LinkByName(created.Container.HostInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// netemOf returns the netem qdisc of the host veth, nil if none
+		netemOf := func() *netlink.Netem {
+			t.Helper()
+			qdiscs, err := netlink.QdiscList(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, q := range qdiscs {
+				if n, ok := q.(*netlink.Netem); ok {
+					return n
+				}
+			}
+			return nil
+		}
+		fault := &pb.ContainerFault{DropPercent: 10, Delay: durationpb.New(50 * time.Millisecond)}
+		if _, err := chaos.SetContainerFault(ctx, &pb.SetContainerFaultRequest{ContainerId: "missing", Fault: fault}); status.Code(err) != codes.NotFound {
+			t.Errorf("SetContainerFault() of a missing container = %v, want %s", err, codes.NotFound)
+		}
+
+		probe := netlink.NewNetem(netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Parent: netlink.HANDLE_ROOT}, netlink.NetemQdiscAttrs{})
+		if err := netlink.QdiscAdd(probe); errors.Is(err, unix.ENOENT) {
+			t.Skip("the kernel has no netem qdisc")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.QdiscDel(probe); err != nil {
+			t.Fatal(err)
+		}
+
+		// Without XDP, netem drops the packets as well as delaying them
+		if _, err := chaos.SetContainerFault(ctx, &pb.SetContainerFaultRequest{ContainerId: "faulted", Fault: fault,
+			Duration: durationpb.New(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		if n := netemOf(); n == nil || n.Latency == 0 || n.Loss == 0 {
+			t.Errorf("netem qdisc %+v, want a delay and loss", n)
+		}
+		list, err := chaos.ListFaults(ctx, &pb.ListFaultsRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Containers) != 1 || list.Containers[0].ContainerId != "faulted" || list.Containers[0].ExpiresAt == nil ||
+			!proto.Equal(list.Containers[0].Fault, fault) {
+			t.Errorf("ListFaults() = %v, want the expiring fault of faulted", list.Containers)
+		}
+
+		// A fault replaced by one that expires soon is cleared on expiry
+		if _, err := chaos.SetContainerFault(ctx, &pb.SetContainerFaultRequest{ContainerId: "faulted",
+			Fault: &pb.ContainerFault{Delay: durationpb.New(time.Millisecond)}, Duration: durationpb.New(100 * time.Millisecond)}); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(10 * time.Second); netemOf() != nil; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("netem qdisc left after the fault expired")
+			}
+		}
+		if faults := nm.ContainerFaults(); len(faults) != 0 {
+			t.Errorf("faults %v left after expiring", faults)
+		}
+
+		if _, err := chaos.SetContainerFault(ctx, &pb.SetContainerFaultRequest{ContainerId: "faulted", Fault: fault}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chaos.ClearContainerFault(ctx, &pb.ClearContainerFaultRequest{ContainerId: "faulted"}); err != nil {
+			t.Fatal(err)
+		}
+		if n := netemOf(); n != nil {
+			t.Errorf("netem qdisc %+v left after clearing the fault", n)
+		}
+	})
+}
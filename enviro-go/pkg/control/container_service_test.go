@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+func TestServiceProtoPorts(t *testing.T) {
+	svc := network.Service{
+		Name:           "api",
+		Namespace:      "default",
+		VIP:            "10.96.0.10",
+		Port:           80,
+		Protocol:       "tcp",
+		TargetPort:     8080,
+		ExposeNodePort: true,
+		NodePort:       30080,
+		Backends:       []string{"a", "b"},
+		Ports: []network.ServicePort{
+			{Name: "http", Port: 80, Protocol: "tcp", TargetPort: 8080, NodePort: 30080,
+				HealthCheck: &network.ServiceHealthCheck{Interval: 2 * time.Second, Timeout: time.Second, Threshold: 3}},
+			{Name: "dns", Port: 53, Protocol: "udp", TargetPort: 53, NodePort: 30053,
+				HealthCheck: &network.ServiceHealthCheck{Port: 8053}},
+		},
+		BackendPorts: []network.BackendPort{{ContainerID: "b", Port: "http", TargetPort: 9090}},
+	}
+	got := serviceFromProto(serviceToProto(svc))
+	if !reflect.DeepEqual(got, svc) {
+		t.Errorf("round trip = %+v, want %+v", got, svc)
+	}
+}
+
+func TestSameService(t *testing.T) {
+	want := network.Service{
+		Name: "api", Namespace: "default", VIP: "10.96.0.10",
+		Ports: []network.ServicePort{
+			{Name: "http", Port: 80, TargetPort: 8080, HealthCheck: &network.ServiceHealthCheck{}},
+			{Name: "dns", Port: 53, Protocol: "udp"},
+		},
+		BackendPorts: []network.BackendPort{
+			{ContainerID: "b", Port: "http", TargetPort: 9090},
+			{ContainerID: "a", Port: "http", TargetPort: 9090},
+		},
+	}
+	// have is want as the network manager stores it
+	have := want
+	have.Ports = want.ServicePorts()
+	have.Ports[0].NodePort = 30080
+	have.BackendPorts = []network.BackendPort{want.BackendPorts[1], want.BackendPorts[0]}
+
+	tests := []struct {
+		name   string
+		change func(s *network.Service)
+		want   bool
+	}{
+		{name: "same", change: func(*network.Service) {}, want: true},
+		{name: "target port", change: func(s *network.Service) { s.Ports[0].TargetPort = 8081 }},
+		{name: "node port", change: func(s *network.Service) { s.Ports[0].NodePort = 30081 }},
+		{name: "health check", change: func(s *network.Service) {
+			s.Ports[0].HealthCheck = &network.ServiceHealthCheck{Threshold: 5}
+		}},
+		{name: "no health check", change: func(s *network.Service) { s.Ports[0].HealthCheck = nil }},
+		{name: "port removed", change: func(s *network.Service) { s.Ports = s.Ports[:1] }},
+		{name: "backend port", change: func(s *network.Service) { s.BackendPorts = s.BackendPorts[:1] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := want
+			w.Ports = append([]network.ServicePort(nil), want.Ports...)
+			w.BackendPorts = append([]network.BackendPort(nil), want.BackendPorts...)
+			tt.change(&w)
+			if got := sameService(have, w); got != tt.want {
+				t.Errorf("sameService() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckServicePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		svc     *pb.Service
+		wantErr bool
+	}{
+		{name: "valid", svc: &pb.Service{Port: 80, Ports: []*pb.ServicePort{{Port: 443, TargetPort: 8443}}}},
+		{name: "port", svc: &pb.Service{Ports: []*pb.ServicePort{{Port: 65536}}}, wantErr: true},
+		{name: "health check", svc: &pb.Service{Ports: []*pb.ServicePort{
+			{Port: 53, HealthCheck: &pb.ServiceHealthCheck{Port: 70000}},
+		}}, wantErr: true},
+		{name: "backend port", svc: &pb.Service{BackendPorts: []*pb.BackendPort{{TargetPort: 1 << 16}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkServicePorts(tt.svc); (err != nil) != tt.wantErr {
+				t.Errorf("checkServicePorts() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestStreamLogs streams the log of a container that is no longer in the
+// registry, filtered and followed until the control plane shuts down
+func TestStreamLogs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dir := t.TempDir()
+	log := "2024-01-02T15:04:05Z stdout F one\n" +
+		"2024-01-02T15:04:06Z stderr P tw\n" +
+		"2024-01-02T15:04:06Z stderr F o\n" +
+		"2024-01-02T15:04:07Z stdout F three\n"
+	if err := os.WriteFile(filepath.Join(dir, "web.log"), []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	events := newEventBus()
+	s := newContainerService(nil, nil, dir, events, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterContainerServiceServer(server, s)
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.DialContext(ctx, "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewContainerServiceClient(conn)
+
+	// read returns the data of the entries streamed and the error the
+	// stream ended with
+	read := func(req *pb.StreamLogsRequest) (string, error) {
+		stream, err := client.StreamLogs(ctx, req)
+		if err != nil {
+			return "", err
+		}
+		var got string
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				return got, err
+			}
+			for _, e := range resp.Entries {
+				got += string(e.Data)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		req  *pb.StreamLogsRequest
+		want string
+	}{
+		{name: "all", req: &pb.StreamLogsRequest{ContainerId: "web"}, want: "one\ntwo\nthree\n"},
+		{name: "tail", req: &pb.StreamLogsRequest{ContainerId: "web", Tail: 1}, want: "three\n"},
+		{name: "since", req: &pb.StreamLogsRequest{ContainerId: "web",
+			Since: timestamppb.New(time.Date(2024, 1, 2, 15, 4, 6, 0, time.UTC))}, want: "two\nthree\n"},
+		{name: "stderr", req: &pb.StreamLogsRequest{ContainerId: "web", Stream: pb.LogStream_LOG_STREAM_STDERR}, want: "two\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := read(tt.req)
+			if !errors.Is(err, io.EOF) || got != tt.want {
+				t.Errorf("streamed %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		req  *pb.StreamLogsRequest
+		want codes.Code
+	}{
+		{req: &pb.StreamLogsRequest{ContainerId: "api"}, want: codes.NotFound},
+		{req: &pb.StreamLogsRequest{ContainerId: "../web"}, want: codes.InvalidArgument},
+		{req: &pb.StreamLogsRequest{ContainerId: "web", Stream: 7}, want: codes.InvalidArgument},
+		{req: &pb.StreamLogsRequest{ContainerId: "web", Since: &timestamppb.Timestamp{Nanos: -1}}, want: codes.InvalidArgument},
+	} {
+		if _, err := read(tt.req); status.Code(err) != tt.want {
+			t.Errorf("StreamLogs(%v) = %v, want %v", tt.req, err, tt.want)
+		}
+	}
+
+	// A follow reads what is written next, and ends on shutdown
+	stream, err := client.StreamLogs(ctx, &pb.StreamLogsRequest{ContainerId: "web", Follow: true, Tail: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "web.log"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("2024-01-02T15:04:08Z stdout F four\n"); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for got != "three\nfour\n" {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("streamed %q, then %v", got, err)
+		}
+		for _, e := range resp.Entries {
+			got += string(e.Data)
+		}
+	}
+	events.close()
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("follow on shutdown = %v, want %v", err, codes.Unavailable)
+	}
+
+	s.logDir = ""
+	if _, err := read(&pb.StreamLogsRequest{ContainerId: "web"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("StreamLogs() without a log directory = %v, want %v", err, codes.FailedPrecondition)
+	}
+}
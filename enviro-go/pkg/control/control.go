@@ -3,7 +3,7 @@
 // This Go module provides:
 // - gRPC server for container orchestration
 // - eBPF-based networking for sub-millisecond latency
-// - Distributed control plane coordination
+// - Distributed control plane coordination over Raft
 //
 // Performance Design:
 // - Goroutine-per-request for natural concurrency
@@ -12,124 +12,940 @@
 
 package main
 
-/*
-#include <stdlib.h>
-
-// FFI result codes matching Rust
-typedef int ffi_result;
-#define FFI_SUCCESS 0
-#define FFI_ERROR -1
-*/
-import "C"
-
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc"
-)
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
-// Global control plane instance
-var (
-	controlPlane *ControlPlane
-	mu           sync.Mutex
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/image"
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
 )
 
+// DefaultCIDR is the container network used when none is configured
+const DefaultCIDR = "10.88.0.0/16"
+
+// DefaultShutdownTimeout bounds the graceful drain when the caller has no
+// deadline of its own
+const DefaultShutdownTimeout = 10 * time.Second
+
 // ControlPlane manages the gRPC server and networking
 type ControlPlane struct {
 	grpcServer *grpc.Server
 	listener   net.Listener
 	address    string
+	network    *network.NetworkManager
+	health     *health.Server
+	events     *eventBus
+	inflight   *inflightTracker
+	limiter    *rateLimiter
+	log        *slog.Logger
+	// certs is nil when serving plaintext
+	certs *certReloader
+	// metrics is nil when MetricsAddress is not configured
+	metrics *metrics
+	// gateway is nil when GatewayAddress is not configured
+	gateway *gateway
+	// store is nil when StateDir is not configured
+	store *storage.Store
+	// leadership is nil when no Coordinator is configured
+	leadership *leadership
+	// audit is nil when Audit.Path is not configured
+	audit *auditLog
+	// cluster is nil when Raft is not configured
+	cluster *raftCluster
+	// images is nil when the image cache is not configured
+	images *image.Puller
+	// stats takes the resource usage the runtime reports through the FFI
+	stats *statsService
+	// containers is the registry of containers ContainerNetworks lists
+	containers *containerService
+	// serving is whether the control plane serves, which the health
+	// service reports once the network is initialized too
+	serving atomic.Bool
+	// started is closed once Start has handed the listener to Serve
+	started chan struct{}
+	// nodes registers the worker nodes while leading
+	nodes *nodeRegistry
+	// scheduler holds the connections to the nodes containers are placed
+	// on
+	scheduler *scheduler
+	// admission holds the connections to the admission webhooks
+	admission *admission
+	// tracer records the spans of RPCs and of container network setup
+	tracer *tracer
+	// reconciler drives the node toward the spec applied by ApplySpec
+	reconciler *reconciler
+	// distributor programs the services on the nodes containers are
+	// placed on
+	distributor *serviceDistributor
+	// identities hands out the identities of label sets
+	identities *identityAllocator
+	// networkDefaults fills in what the control plane provides of the
+	// configs InitNetwork takes, such as the state store
+	networkDefaults func(network.NetworkConfig) network.NetworkConfig
+	// saved is the registry restored once InitNetwork re-adopted the
+	// container networks, nil once restored
+	saved map[string]*pb.Container
+	// stopped ends watchComponents, the node registry's sweep and the
+	// collection of identities
+	stopped chan struct{}
+	// done is closed once Stop has finished, with stopErr set
+	done    chan struct{}
+	stopErr error
+
+	// reloadMu serializes Reload, which changes config to what it applied
+	reloadMu sync.Mutex
+	config   ControlPlaneConfig
+	// overrides are the settings of config overridden while serving, by
+	// key, which Reload leaves in effect
+	overrides map[string]json.RawMessage
+	// logLevel is nil when the level of the logger can't be changed
+	logLevel  *slog.LevelVar
+	logLevels *logging.Levels
+
+	stateMu  sync.Mutex
+	state    State
+	hooks    []func()
+	stopOnce sync.Once
 }
 
-// NewControlPlane creates a new control plane instance
-func NewControlPlane(address string) (*ControlPlane, error) {
-	listener, err := net.Listen("tcp", address)
+// ControlPlaneConfig holds the control plane settings
+type ControlPlaneConfig struct {
+	// Address to serve gRPC on, e.g. "0.0.0.0:50051", or a unix socket
+	// such as "unix:///run/enviro/enviro.sock"
+	Address string `json:"address"`
+	// ListenRetry retries binding while the address is still in use
+	ListenRetry ListenRetry `json:"listen_retry"`
+	// Socket sets the permissions of a unix socket Address
+	Socket SocketConfig `json:"socket"`
+	// Network configures the container network, CIDR defaults to
+	// DefaultCIDR when neither CIDR nor CIDR6 is set
+	Network network.NetworkConfig `json:"network"`
+	// DeferNetwork starts serving without setting up the datapath, which
+	// InitNetwork does later, e.g. once the network config arrived from a
+	// remote source. Until then the RPCs needing the network fail with
+	// codes.FailedPrecondition and the health service reports NOT_SERVING.
+	DeferNetwork bool `json:"defer_network"`
+	// IPAMPlugin allocates container addresses when Network.IPAM.Backend
+	// is "external" and sets no External backend
+	IPAMPlugin IPAMPluginConfig `json:"ipam_plugin"`
+	// StateDir persists the container registry, container networks,
+	// policies, services and the spec applied by ApplySpec across
+	// restarts when set. On start they are reconciled with the interfaces
+	// still present.
+	StateDir string `json:"state_dir"`
+	// RestoreFrom restores StateDir from a backup taken with Backup, a
+	// file or an http(s) URL, before the state is loaded. StateDir must
+	// hold no state yet, or have been restored from the same backup.
+	RestoreFrom string `json:"restore_from"`
+	// Storage tunes how the files of StateDir are written, e.g. how often
+	// they are synced to disk
+	Storage StorageConfig `json:"storage"`
+
+	// CertFile and KeyFile enable TLS when both are set
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile verifies client certificates presented to the server
+	ClientCAFile string `json:"client_ca_file"`
+	// RequireClientCert rejects clients without a certificate signed by
+	// ClientCAFile (mTLS)
+	RequireClientCert bool `json:"require_client_cert"`
+	// AllowedSPIFFEIDs additionally requires client certificates to carry
+	// one of these SPIFFE IDs, e.g. "spiffe://example.org/agent", or any
+	// ID of a trust domain such as "spiffe://example.org". Requires
+	// RequireClientCert.
+	AllowedSPIFFEIDs []string `json:"allowed_spiffe_ids"`
+	// CertReloadInterval is how often the TLS files are checked for
+	// changes and reloaded, DefaultCertReloadInterval when zero. When
+	// negative they are only reloaded by Reload.
+	CertReloadInterval time.Duration `json:"cert_reload_interval"`
+
+	// Auth requires callers to authenticate when any credentials are
+	// configured
+	Auth AuthConfig `json:"auth"`
+	// RateLimit limits the requests of each client
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	// Admission runs admission controllers and webhooks before containers
+	// are created and started
+	Admission AdmissionConfig `json:"admission"`
+	// Audit records the mutating RPCs and their callers
+	Audit AuditConfig `json:"audit"`
+	// Chaos enables fault injection for game days
+	Chaos ChaosConfig `json:"chaos"`
+	// Images configures the image cache ImageService pulls into, under
+	// StateDir by default
+	Images ImageConfig `json:"images"`
+	// Stats configures where StatsService takes the resource usage of
+	// containers from
+	Stats StatsConfig `json:"stats"`
+
+	// Server tunes the gRPC server, e.g. its keepalive
+	Server ServerConfig `json:"server"`
+
+	// Nodes tunes the registry of worker nodes, which register and
+	// heartbeat with the leader
+	Nodes NodeRegistryConfig `json:"nodes"`
+	// Scheduler places containers created with a placement on the
+	// registered nodes
+	Scheduler SchedulerConfig `json:"scheduler"`
+	// Reconcile tunes the loop driving the node toward the spec applied
+	// by ApplySpec
+	Reconcile ReconcileConfig `json:"reconcile"`
+	// EventBufferSize is the number of undelivered events kept for each
+	// watch, 256 when zero. Watches falling further behind lose their
+	// oldest events.
+	EventBufferSize int `json:"event_buffer_size"`
+	// Identities tunes the numeric identities AllocateIdentity hands out
+	// for label sets
+	Identities IdentityConfig `json:"identities"`
+
+	// Coordinator elects a leader among control planes. When set, only the
+	// leader accepts mutating RPCs; followers reject them with
+	// codes.FailedPrecondition naming the leader.
+	Coordinator Coordinator `json:"-"`
+	// Raft elects the leader with an embedded Raft cluster, which also
+	// replicates the leader's containers and services to followers. It
+	// can't be combined with Coordinator.
+	Raft *RaftConfig `json:"raft"`
+
+	// Runtime starts and stops containers for StartContainer and
+	// StopContainer, which fail with codes.FailedPrecondition when unset.
+	// Exec and Attach need it to be a SessionRuntime too.
+	Runtime Runtime `json:"-"`
+	// Privileges drops the privileges of the standalone server once it is
+	// initialized, see PrivilegeConfig
+	Privileges PrivilegeConfig `json:"privileges"`
+
+	// LogDir is where the runtime writes the output of each container to
+	// <id>.log in the CRI logging format, for StreamLogs
+	LogDir string `json:"log_dir"`
+
+	// MetricsAddress serves Prometheus metrics on /metrics when set,
+	// e.g. "127.0.0.1:9090"
+	MetricsAddress string `json:"metrics_address"`
+	// GatewayAddress serves the API as JSON over HTTP when set, e.g.
+	// "127.0.0.1:8080", with the TLS config of the gRPC server. See
+	// pkg/api/v1/gateway.yaml for the routes.
+	GatewayAddress string `json:"gateway_address"`
+	// Tracing exports OpenTelemetry traces of RPCs and container network
+	// setup
+	Tracing TracingConfig `json:"tracing"`
+
+	// Logger receives control plane and network logs. When nil, a logger
+	// is built from LogLevel and LogFormat if either is set, otherwise
+	// slog.Default() is used.
+	Logger *slog.Logger `json:"-"`
+	// LogLevel is "debug", "info", "warn" or "error"
+	LogLevel string `json:"log_level"`
+	// LogLevelVar is the level Logger logs at, which lets SetLogLevel
+	// change it. It is created along with the logger built from LogLevel.
+	LogLevelVar *slog.LevelVar `json:"-"`
+	// LogFormat is "text" or "json"
+	LogFormat string `json:"log_format"`
+	// LogLevels overrides the level of subsystems, e.g. {"raft": "warn"}.
+	// Each subsystem tags its logs with its name, one of admission, api,
+	// audit, auth, chaos, containers, identities, images, ipam, leader,
+	// metrics, network, nodes, raft, reconcile, scheduler, stats or
+	// storage. Subsystems of a Logger not built by the logging package log
+	// at its level.
+	LogLevels map[string]string `json:"log_levels"`
+}
+
+// logSubsystems are the subsystems of the control plane with their own
+// logger
+var logSubsystems = map[string]bool{
+	"api": true, "auth": true, "containers": true, "leader": true, "metrics": true,
+	"network": true, "nodes": true, "raft": true, "scheduler": true, "storage": true, "admission": true,
+	"audit": true, "chaos": true, "images": true, "stats": true, "ipam": true,
+	"identities": true, "reconcile": true,
+}
+
+// subsystemLevels parses LogLevels
+func (c ControlPlaneConfig) subsystemLevels() (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level, len(c.LogLevels))
+	for name, s := range c.LogLevels {
+		if !logSubsystems[name] {
+			return nil, fmt.Errorf("unknown log subsystem %q", name)
+		}
+		level, err := logging.ParseLevel(s)
+		if err != nil {
+			return nil, err
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}
+
+// subsystemLoggers returns the function creating the logger of each
+// subsystem from logger, at its level in LogLevels if any, and the levels
+// that let Reload change them
+func (c ControlPlaneConfig) subsystemLoggers(logger *slog.Logger) (func(name string) *slog.Logger, *logging.Levels, error) {
+	levels, err := c.subsystemLevels()
 	if err != nil {
-		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+		return nil, nil, err
 	}
+	overrides := logging.NewLevels(levels)
+	return func(name string) *slog.Logger {
+		return overrides.Subsystem(logger, name)
+	}, overrides, nil
+}
 
-	grpcServer := grpc.NewServer(
-		// Performance optimizations
-		grpc.MaxConcurrentStreams(1000),
-		grpc.MaxRecvMsgSize(16 * 1024 * 1024), // 16MB
-		grpc.MaxSendMsgSize(16 * 1024 * 1024),
-	)
+// tlsEnabled reports whether any TLS setting is configured, which then
+// requires a certificate and key
+func (c ControlPlaneConfig) tlsEnabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.ClientCAFile != "" || c.RequireClientCert || len(c.AllowedSPIFFEIDs) > 0
+}
 
-	// TODO: Register gRPC services here
-	// Example: pb.RegisterContainerServiceServer(grpcServer, &containerService{})
+// logger returns the configured logger, see Logger, and the level it logs
+// at when that can be changed
+func (c ControlPlaneConfig) logger() (*slog.Logger, *slog.LevelVar, error) {
+	switch {
+	case c.Logger != nil:
+		return c.Logger, c.LogLevelVar, nil
+	case c.LogLevel != "" || c.LogFormat != "":
+		level, err := logging.ParseLevel(c.LogLevel)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := new(slog.LevelVar)
+		v.Set(level)
+		logger, err := logging.NewLeveled(os.Stderr, v, c.LogFormat)
+		return logger, v, err
+	default:
+		return slog.Default(), nil, nil
+	}
+}
 
-	return &ControlPlane{
-		grpcServer: grpcServer,
-		listener:   listener,
-		address:    address,
-	}, nil
+// NewControlPlane creates a new control plane instance
+func NewControlPlane(address string) (*ControlPlane, error) {
+	return NewControlPlaneWithConfig(ControlPlaneConfig{Address: address})
 }
 
-// Start begins serving gRPC requests
-func (cp *ControlPlane) Start() error {
-	log.Printf("Starting gRPC control plane on %s", cp.address)
-	return cp.grpcServer.Serve(cp.listener)
+// NewControlPlaneWithConfig creates a new control plane instance from config
+func NewControlPlaneWithConfig(config ControlPlaneConfig) (*ControlPlane, error) {
+	return newControlPlane(config, nil)
 }
 
-// Stop gracefully shuts down the control plane
-func (cp *ControlPlane) Stop() {
-	log.Println("Shutting down gRPC control plane")
-	cp.grpcServer.GracefulStop()
+// NewControlPlaneWithNetwork creates a control plane serving nm, e.g. one
+// whose datapath was set up by NewNetworkManager before the control plane
+// is created, or one from NewDeferredNetworkManager that InitNetwork sets
+// up later. config.Network is taken as the config of nm, and
+// config.DeferNetwork is ignored. Stop closes nm; when creating the
+// control plane fails, nm is left to the caller.
+func NewControlPlaneWithNetwork(config ControlPlaneConfig, nm *network.NetworkManager) (*ControlPlane, error) {
+	if nm == nil {
+		return nil, fmt.Errorf("%w: no network manager", errInvalidConfig)
+	}
+	return newControlPlane(config, nm)
 }
 
-//export go_init_control_plane
-func go_init_control_plane(addr *C.char) C.ffi_result {
-	mu.Lock()
-	defer mu.Unlock()
+// newControlPlane creates a control plane from config, serving nm or,
+// when nil, a network manager of its own
+func newControlPlane(config ControlPlaneConfig, nm *network.NetworkManager) (*ControlPlane, error) {
+	address := config.Address
 
-	if controlPlane != nil {
-		log.Println("Control plane already initialized")
-		return C.FFI_SUCCESS
+	logger, logLevel, err := config.logger()
+	if err != nil {
+		return nil, err
+	}
+	// The logs of control planes of several network instances in one
+	// process are told apart by it
+	instance := config.Network.Instance
+	if nm != nil {
+		instance = nm.Instance()
+	}
+	if instance != "" {
+		logger = logger.With("instance", instance)
+	}
+	subsystem, logLevels, err := config.subsystemLoggers(logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	nodes := newNodeRegistry(config.Nodes, subsystem("nodes"))
+
+	admit, err := newAdmission(config.Admission, subsystem("admission"))
+	if err != nil {
+		return nil, err
 	}
 
-	goAddr := C.GoString(addr)
+	var plugin *ipamPlugin
+	if config.Network.IPAM.Backend == network.IPAMExternal && config.Network.IPAM.External == nil {
+		if plugin, err = newIPAMPlugin(config.IPAMPlugin, subsystem("ipam")); err != nil {
+			return nil, err
+		}
+		config.Network.IPAM.External = plugin
+	}
+
+	var certs *certReloader
+	if config.tlsEnabled() {
+		if certs, err = newCertReloader(config); err != nil {
+			return nil, err
+		}
+	}
+
+	var auth *authorizer
+	if config.Auth.enabled() {
+		if auth, err = newAuthorizer(config.Auth, subsystem("auth")); err != nil {
+			return nil, err
+		}
+		if certs == nil {
+			logger.Warn("Bearer tokens are sent in plaintext without TLS")
+		}
+	}
+
+	var audit *auditLog
+	if config.Audit.Path != "" {
+		if audit, err = newAuditLog(config.Audit, subsystem("audit")); err != nil {
+			return nil, err
+		}
+	}
+
+	var store *storage.Store
+	var registry *registryStore
+	var saved map[string]*pb.Container
+	var savedSpec *specFile
+	var overrides map[string]json.RawMessage
+	var savedIdentities *identityState
+	if config.StateDir != "" {
+		if store, err = config.Storage.open(config.StateDir, subsystem("storage")); err != nil {
+			return nil, err
+		}
+		if config.RestoreFrom != "" {
+			if err := restoreBackup(context.Background(), store, config.RestoreFrom, subsystem("storage")); err != nil {
+				closeStore(store)
+				return nil, err
+			}
+		}
+		registry = &registryStore{store: store}
+		if saved, err = registry.load(); err != nil {
+			closeStore(store)
+			return nil, err
+		}
+		if savedSpec, err = loadSpec(store); err != nil {
+			closeStore(store)
+			return nil, err
+		}
+		if overrides, err = loadSettings(store); err != nil {
+			closeStore(store)
+			return nil, err
+		}
+		if savedIdentities, err = loadIdentities(store); err != nil {
+			closeStore(store)
+			return nil, err
+		}
+		if _, err := config.withOverrides(overrides); err != nil {
+			closeStore(store)
+			return nil, fmt.Errorf("%s: %w", settingsFileName, err)
+		}
+	}
+	var images *image.Puller
+	if dir := config.Images.dir(config.StateDir); dir != "" {
+		if images, err = newImagePuller(config.Images, dir, subsystem("images")); err != nil {
+			closeStore(store)
+			return nil, err
+		}
+	}
 
-	cp, err := NewControlPlane(goAddr)
+	tr, err := newTracer(config.Tracing)
 	if err != nil {
-		log.Printf("Failed to initialize control plane: %v", err)
-		return C.FFI_ERROR
+		closeStore(store)
+		return nil, err
+	}
+	sched, err := newScheduler(config.Scheduler, nodes, tr.dialOptions(), subsystem("scheduler"))
+	if err != nil {
+		tr.shutdown(context.Background())
+		closeStore(store)
+		return nil, err
 	}
 
-	controlPlane = cp
+	// Containers whose network lease expired fail, once the container
+	// service is up to know them
+	var leaseOwner atomic.Pointer[containerService]
+	networkDefaults := func(nc network.NetworkConfig) network.NetworkConfig {
+		if nc.CIDR == "" && nc.CIDR6 == "" {
+			nc.CIDR = DefaultCIDR
+		}
+		if nc.IPAM.Backend == network.IPAMExternal && nc.IPAM.External == nil && plugin != nil {
+			nc.IPAM.External = plugin
+		}
+		if nc.Logger == nil {
+			nc.Logger = subsystem("network")
+		}
+		if nc.State == nil && store != nil {
+			nc.State = network.NewFileStateStore(store)
+		}
+		if nc.TracerProvider == nil {
+			nc.TracerProvider = tr.provider
+		}
+		onReclaim := nc.Leases.OnReclaim
+		nc.Leases.OnReclaim = func(r network.LeaseReclaim) {
+			if s := leaseOwner.Load(); s != nil {
+				s.leaseReclaimed(r)
+			}
+			if onReclaim != nil {
+				onReclaim(r)
+			}
+		}
+		return nc
+	}
+	config.Network = networkDefaults(config.Network)
+	// The network manager of the caller is the caller's until the control
+	// plane is created
+	ownNetwork := nm == nil
+	closeNetwork := func() {
+		if ownNetwork {
+			nm.Close()
+		}
+	}
+	switch {
+	case !ownNetwork:
+	case config.DeferNetwork:
+		nm = network.NewDeferredNetworkManager(config.Network)
+	default:
+		if nm, err = network.NewNetworkManager(config.Network); err != nil {
+			if plugin != nil {
+				plugin.Close()
+			}
+			tr.shutdown(context.Background())
+			closeStore(store)
+			return nil, err
+		}
+	}
 
-	// Start serving in a goroutine
-	go func() {
-		if err := cp.Start(); err != nil {
-			log.Printf("Control plane error: %v", err)
+	listener, err := listen(address, config.ListenRetry, config.Socket, logger)
+	if err != nil {
+		tr.shutdown(context.Background())
+		closeNetwork()
+		closeStore(store)
+		return nil, err
+	}
+
+	var cluster *raftCluster
+	if config.Raft != nil {
+		cluster, err = newRaftCluster(*config.Raft, subsystem("raft"))
+		if err != nil {
+			tr.shutdown(context.Background())
+			listener.Close()
+			closeNetwork()
+			closeStore(store)
+			return nil, err
 		}
-	}()
+		config.Coordinator = cluster
+	}
+
+	opts, interceptors := config.Server.serverOptions()
+	if certs != nil {
+		opts = append(opts, grpc.Creds(gatewayCredentials{credentials.NewTLS(certs.tlsConfig())}))
+	}
+	opts = append(opts, tr.serverOptions()...)
+	opts = append(opts, requestLogging(subsystem("api"))...)
+	opts = append(opts, config.Server.Deadlines.serverOptions()...)
+
+	events := newEventBus()
+	events.setBufferSize(config.EventBufferSize)
+
+	var m *metrics
+	if config.MetricsAddress != "" {
+		if m, err = newMetrics(config.MetricsAddress, nm, events, sched.pool, store, subsystem("metrics")); err != nil {
+			if cluster != nil {
+				cluster.close()
+			}
+			tr.shutdown(context.Background())
+			listener.Close()
+			closeNetwork()
+			closeStore(store)
+			return nil, fmt.Errorf("failed to listen for metrics on %s: %w", config.MetricsAddress, err)
+		}
+		opts = append(opts, m.serverOptions()...)
+	}
+	inflight := newInflightTracker()
+	opts = append(opts, inflight.serverOptions()...)
+	opts = append(opts, networkGate(nm)...)
+	if audit != nil {
+		opts = append(opts, audit.serverOptions()...)
+	}
+	if auth != nil {
+		opts = append(opts, auth.serverOptions()...)
+	}
+	limiter := newRateLimiter(config.RateLimit)
+	opts = append(opts, limiter.serverOptions()...)
+	chaos := newChaosService(config.Chaos, nm, subsystem("chaos"))
+	if config.Chaos.Enable {
+		logger.Warn("Chaos is enabled, admins can inject faults into containers and the API")
+		opts = append(opts, chaos.serverOptions()...)
+	}
+	var leader *leadership
+	if config.Coordinator != nil {
+		leader = newLeadership(config.Coordinator, events, subsystem("leader"))
+		opts = append(opts, leader.serverOptions()...)
+	}
+	opts = append(opts, interceptors...)
+	grpcServer := grpc.NewServer(opts...)
 
-	log.Println("Control plane initialized successfully")
-	return C.FFI_SUCCESS
+	var gw *gateway
+	if config.GatewayAddress != "" {
+		var tlsConfig *tls.Config
+		if certs != nil {
+			tlsConfig = certs.tlsConfig()
+		}
+		if gw, err = newGateway(config.GatewayAddress, tlsConfig, config.Server, subsystem("api")); err != nil {
+			if m != nil {
+				m.listener.Close()
+			}
+			if cluster != nil {
+				cluster.close()
+			}
+			tr.shutdown(context.Background())
+			listener.Close()
+			closeNetwork()
+			closeStore(store)
+			return nil, fmt.Errorf("failed to listen for the REST gateway on %s: %w", config.GatewayAddress, err)
+		}
+	}
+
+	containers := newContainerService(nm, config.Runtime, config.LogDir, events, subsystem("containers"))
+	containers.cluster = cluster
+	containers.admission = admit
+	if registry != nil {
+		containers.registry = registry
+		// A deferred network has no container networks to reconcile the
+		// registry with until InitNetwork
+		if nm.Initialized() {
+			containers.restore(saved)
+			saved = nil
+		} else if saved == nil {
+			saved = make(map[string]*pb.Container)
+		}
+	}
+	leaseOwner.Store(containers)
+	pb.RegisterContainerServiceServer(grpcServer, containers)
+	containers.scheduler = sched
+	nodes.cluster = cluster
+	nodes.events = events
+	nodeService := newNodeService(nm, events, nodes, logLevel, subsystem("nodes"))
+	nodeService.audit = audit
+	nodeService.store = store
+	identities := newIdentityAllocator(config.Identities, cluster, store, savedIdentities, subsystem("identities"))
+	nodeService.identities = identities
+	pb.RegisterNodeServiceServer(grpcServer, nodeService)
+	registerLegacyServices(grpcServer, containers, nodeService)
+	pb.RegisterChaosServiceServer(grpcServer, chaos)
+	pb.RegisterImageServiceServer(grpcServer, &imageService{images: images})
+	stats := newStatsService(config.Stats, nm, events, subsystem("stats"))
+	pb.RegisterStatsServiceServer(grpcServer, stats)
+	pb.RegisterInfoServiceServer(grpcServer, &infoService{config: config, network: nm})
+	reconciler := newReconciler(config.Reconcile, containers, nodeService, store, savedSpec, subsystem("reconcile"))
+	containers.reconciler = reconciler
+	self, _ := os.Hostname()
+	distributor := newServiceDistributor(containers, nodes, sched, self, config.Network.Topology, subsystem("scheduler"))
+	containers.distributor = distributor
+
+	// Report NOT_SERVING until Start is called
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	reflection.Register(grpcServer)
+
+	cp := &ControlPlane{
+		grpcServer:  grpcServer,
+		listener:    listener,
+		address:     address,
+		network:     nm,
+		health:      healthServer,
+		events:      events,
+		inflight:    inflight,
+		limiter:     limiter,
+		log:         logger,
+		certs:       certs,
+		metrics:     m,
+		gateway:     gw,
+		store:       store,
+		leadership:  leader,
+		audit:       audit,
+		cluster:     cluster,
+		images:      images,
+		stats:       stats,
+		containers:  containers,
+		started:     make(chan struct{}),
+		nodes:       nodes,
+		scheduler:   sched,
+		admission:   admit,
+		tracer:      tr,
+		reconciler:  reconciler,
+		distributor: distributor,
+		identities:  identities,
+		saved:       saved,
+		stopped:     make(chan struct{}),
+		done:        make(chan struct{}),
+		config:      config,
+		logLevel:    logLevel,
+		logLevels:   logLevels,
+		overrides:   overrides,
+
+		networkDefaults: networkDefaults,
+	}
+	nodeService.control = cp
+	nodes.leading = func() bool {
+		_, leading := cp.Leader()
+		return leading
+	}
+	identities.active = nodes.leading
+	// A cordoned node is left as it is
+	reconciler.active = func() bool {
+		_, leading := cp.Leader()
+		return leading && !inflight.isCordoned()
+	}
+	if leader != nil {
+		leader.changed = func(leading bool) {
+			cp.setLeaderHealth()
+			if leading && cluster != nil {
+				nodes.adopt(cluster.fsm.listNodes())
+				containers.syncCluster()
+			}
+			if leading {
+				reconciler.kick()
+			}
+		}
+	}
+	cp.applyOverrides()
+	cp.SetNotServing()
+	return cp, nil
 }
 
-//export go_shutdown_control_plane
-func go_shutdown_control_plane() C.ffi_result {
-	mu.Lock()
-	defer mu.Unlock()
+// closeStore closes a store opened during construction, if any
+func closeStore(store *storage.Store) {
+	if store != nil {
+		store.Close()
+	}
+}
+
+// Start serves gRPC requests until the control plane is stopped, either
+// by Stop or Drain or once ctx is done, in which case it stops it as Stop
+// would within DefaultShutdownTimeout. It returns nil once stopped, after
+// Stop has released the network and other resources, and the error of
+// the server when it fails to serve. A control plane is only started
+// once; control planes are independent of each other, so a process can
+// run several on different addresses and state directories.
+func (cp *ControlPlane) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cp.stateMu.Lock()
+	if cp.state != StateCreated {
+		state := cp.state
+		cp.stateMu.Unlock()
+		return fmt.Errorf("control plane cannot start: %s", state)
+	}
+	// The loops Stop ends are started before serving is published and
+	// under stateMu, so a Stop racing Start finds them all started or
+	// none, as Start then fails
+	if cp.leadership != nil {
+		cp.leadership.start()
+	}
+	cp.reconciler.start()
+	cp.distributor.start()
+	cp.state = StateServing
+	close(cp.started)
+	cp.stateMu.Unlock()
+
+	cp.SetServing()
+	go cp.watchComponents()
+	go cp.watchSpoofing()
+	go cp.watchNeighborSpoofing()
+	go cp.nodes.run(cp.stopped)
+	go cp.identities.run(cp.stopped)
 
-	if controlPlane == nil {
-		log.Println("Control plane not initialized")
-		return C.FFI_ERROR
+	if cp.metrics != nil {
+		go cp.metrics.serve()
+	}
+	if cp.gateway != nil {
+		go cp.gateway.serve(cp.grpcServer)
 	}
+	if cp.certs != nil {
+		go cp.certs.watch(cp.log)
+	}
+
+	cp.log.Info("Starting gRPC control plane", "address", cp.address)
+	served := make(chan error, 1)
+	go func() {
+		served <- cp.grpcServer.Serve(cp.listener)
+	}()
 
-	controlPlane.Stop()
-	controlPlane = nil
+	var err error
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		cp.log.Info("Stopping gRPC control plane as its context is done", "error", ctx.Err())
+		stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), DefaultShutdownTimeout)
+		cp.Stop(stopCtx)
+		cancel()
+		err = <-served
+	}
+	if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		cp.events.publish(&pb.ContainerEvent{
+			Type:      pb.ContainerEventType_CONTAINER_EVENT_TYPE_CONTROL_PLANE_STOPPED,
+			Timestamp: timestamppb.Now(),
+			Error:     err.Error(),
+		})
+		return err
+	}
+	// Serve returns as soon as Stop stopped the server, before it closed
+	// the rest
+	<-cp.done
+	return nil
+}
 
-	log.Println("Control plane shutdown complete")
-	return C.FFI_SUCCESS
+// Done returns a channel closed once Stop has finished
+func (cp *ControlPlane) Done() <-chan struct{} {
+	return cp.done
 }
 
-// Required for CGO - must have main() when building c-shared
-func main() {
-	// This is never called when built as c-shared library
-	// But Go requires it to be present
+// WaitReady blocks until Start has been called and the listener accepts a
+// connection, or ctx is done.
+func (cp *ControlPlane) WaitReady(ctx context.Context) error {
+	select {
+	case <-cp.started:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, cp.listener.Addr().Network(), cp.listener.Addr().String())
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("control plane not accepting on %s: %w", cp.listener.Addr(), err)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// Stop gracefully shuts down the control plane and runs the shutdown
+// hooks: it rejects new RPCs with codes.Unavailable, reports NOT_SERVING
+// to health checks, waits for in-flight RPCs and then stops the server.
+// If ctx is done before in-flight RPCs finish, remaining connections are
+// closed forcibly and ctx's error is returned; without a deadline of its
+// own, ctx is given DefaultShutdownTimeout. Only the first call does any
+// work; concurrent callers wait for it to finish and get its result. See
+// Drain to stop taking new containers first.
+func (cp *ControlPlane) Stop(ctx context.Context) error {
+	cp.stopOnce.Do(func() {
+		defer close(cp.done)
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, DefaultShutdownTimeout)
+			defer cancel()
+		}
+		cp.setState(StateStopping)
+		cp.log.Info("Shutting down gRPC control plane")
+
+		// Let another control plane take over mutating RPCs first
+		if cp.leadership != nil {
+			cp.leadership.stop(ctx)
+		}
+		// The reconciler calls the services directly, outside the drain
+		cp.reconciler.stop()
+		cp.distributor.stop()
+
+		// Reject new requests and let the running ones finish, so none is
+		// cut off half way through changing the network
+		cp.SetNotServing()
+		cp.inflight.drain()
+
+		// Event watches never finish on their own and would block the drain
+		cp.events.close()
+
+		if err := cp.inflight.wait(ctx); err != nil {
+			cp.log.Warn("In-flight requests did not finish", "in_flight", cp.InFlight(), "error", err)
+			cp.stopErr = err
+		}
+		if cp.gateway != nil {
+			cp.gateway.shutdown(ctx)
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			cp.grpcServer.GracefulStop()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			cp.log.Warn("Graceful drain interrupted, closing remaining connections", "error", ctx.Err())
+			cp.grpcServer.Stop()
+			<-drained
+			cp.stopErr = ctx.Err()
+		}
+		// Serve closes the listener once it runs, which may be after a
+		// Stop right after Start; the address must be free once Stop
+		// returns, e.g. for a re-initialization over the FFI
+		cp.listener.Close()
+
+		if cp.metrics != nil {
+			cp.metrics.shutdown(ctx)
+		}
+		if cp.certs != nil {
+			cp.certs.close()
+		}
+		if cp.audit != nil {
+			if err := cp.audit.close(); err != nil {
+				cp.log.Error("Failed to close audit log", "error", err)
+			}
+		}
+		close(cp.stopped)
+		if err := cp.scheduler.close(); err != nil {
+			cp.log.Warn("Failed to close connections to nodes", "error", err)
+		}
+		if err := cp.admission.close(); err != nil {
+			cp.log.Warn("Failed to close connections to admission webhooks", "error", err)
+		}
+		if cp.cluster != nil {
+			if err := cp.cluster.close(); err != nil {
+				cp.log.Error("Failed to leave Raft cluster", "error", err)
+			}
+		}
+		if err := cp.network.Close(); err != nil {
+			cp.log.Error("Failed to close network manager", "error", err)
+		}
+		if cp.images != nil {
+			if err := cp.images.Close(); err != nil {
+				cp.log.Error("Failed to close image cache", "error", err)
+			}
+		}
+		if cp.store != nil {
+			if err := cp.store.Close(); err != nil {
+				cp.log.Error("Failed to close state store", "error", err)
+			}
+		}
+		if err := cp.tracer.shutdown(ctx); err != nil {
+			cp.log.Warn("Failed to export remaining spans", "error", err)
+		}
+		cp.runShutdownHooks()
+		cp.setState(StateStopped)
+	})
+	return cp.stopErr
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Leader identifies the control plane currently elected leader
+type Leader struct {
+	// ID is unique among the control planes taking part in the election
+	ID string `json:"id"`
+	// Address is where clients reach the leader's gRPC server
+	Address string `json:"address"`
+}
+
+// Coordinator elects one leader among control planes sharing a
+// coordination store. Each control plane has its own Coordinator, which
+// knows the Leader it campaigns as.
+type Coordinator interface {
+	// Campaign blocks until this control plane is elected leader or ctx is
+	// done. It returns immediately while already leading.
+	Campaign(ctx context.Context) error
+	// Resign gives up leadership, if held, so another candidate can be
+	// elected
+	Resign(ctx context.Context) error
+	// IsLeader reports whether this control plane currently leads
+	IsLeader() bool
+	// Watch sends the current leader and then each new one until ctx is
+	// done, when the channel is closed. The zero Leader means there is
+	// none. Slow receivers may miss intermediate leaders but always get
+	// the latest.
+	Watch(ctx context.Context) <-chan Leader
+}
+
+// MemoryElection is an election held in memory, for control planes in one
+// process such as tests and embedded setups
+type MemoryElection struct {
+	mu     sync.Mutex
+	leader *memoryCoordinator
+	// changed is closed and replaced whenever the leader changes
+	changed chan struct{}
+}
+
+// NewMemoryElection creates an election without a leader
+func NewMemoryElection() *MemoryElection {
+	return &MemoryElection{changed: make(chan struct{})}
+}
+
+// Join returns a Coordinator campaigning in e as member
+func (e *MemoryElection) Join(member Leader) Coordinator {
+	return &memoryCoordinator{election: e, member: member}
+}
+
+// setLeader changes the leader and wakes up campaigners and watchers.
+// Callers must hold e.mu.
+func (e *MemoryElection) setLeader(c *memoryCoordinator) {
+	e.leader = c
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// current returns the leader and a channel closed on its change
+func (e *MemoryElection) current() (Leader, <-chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.leader == nil {
+		return Leader{}, e.changed
+	}
+	return e.leader.member, e.changed
+}
+
+// memoryCoordinator is a member of a MemoryElection
+type memoryCoordinator struct {
+	election *MemoryElection
+	member   Leader
+}
+
+// Campaign implements Coordinator
+func (c *memoryCoordinator) Campaign(ctx context.Context) error {
+	e := c.election
+	for {
+		e.mu.Lock()
+		if e.leader == c {
+			e.mu.Unlock()
+			return nil
+		}
+		if e.leader == nil {
+			e.setLeader(c)
+			e.mu.Unlock()
+			return nil
+		}
+		changed := e.changed
+		e.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Resign implements Coordinator
+func (c *memoryCoordinator) Resign(ctx context.Context) error {
+	e := c.election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.leader == c {
+		e.setLeader(nil)
+	}
+	return nil
+}
+
+// IsLeader implements Coordinator
+func (c *memoryCoordinator) IsLeader() bool {
+	e := c.election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader == c
+}
+
+// Watch implements Coordinator
+func (c *memoryCoordinator) Watch(ctx context.Context) <-chan Leader {
+	out := make(chan Leader, 1)
+	go func() {
+		defer close(out)
+		sent, last := false, Leader{}
+		for {
+			leader, changed := c.election.current()
+			if !sent || leader != last {
+				select {
+				case out <- leader:
+					sent, last = true, leader
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRPCDeadline is the deadline of unary RPCs whose client set none,
+// unless DeadlineConfig says otherwise
+const DefaultRPCDeadline = 5 * time.Minute
+
+// ServerDeadlineReason is the ErrorInfo reason attached to the RPCs failing
+// with codes.DeadlineExceeded because the server's deadline passed before
+// the client's. Its metadata holds the "deadline" the server imposed, so
+// clients know to ask for less or to call with a deadline of their own
+// within the maximum.
+const ServerDeadlineReason = "SERVER_DEADLINE"
+
+// DeadlineConfig bounds how long RPCs run, cancelling their context once
+// the deadline passes. Unary RPCs without a deadline get Default, and
+// those with a later one than Max get Max. Streams, such as watches and
+// exec sessions, run for as long as the client keeps them open unless
+// Methods bounds them.
+type DeadlineConfig struct {
+	// Default is DefaultRPCDeadline, or Max if that is shorter, when zero,
+	// and none when negative
+	Default time.Duration `json:"default"`
+	// Max is none when zero
+	Max time.Duration `json:"max"`
+	// Methods overrides Default and Max for methods by their full name,
+	// e.g. "/enviro.api.v1.ContainerService/CreateContainer"
+	Methods map[string]MethodDeadline `json:"methods"`
+}
+
+// MethodDeadline bounds the RPCs to a method. Zero values keep those of
+// DeadlineConfig, negative ones lift them.
+type MethodDeadline struct {
+	Default time.Duration `json:"default"`
+	Max     time.Duration `json:"max"`
+}
+
+func (c DeadlineConfig) validate() error {
+	if c.Max < 0 {
+		return errors.New("max must not be negative")
+	}
+	if c.Max > 0 && c.Default > c.Max {
+		return fmt.Errorf("default %s is longer than max %s", c.Default, c.Max)
+	}
+	for method := range c.Methods {
+		if !isFullMethod(method) {
+			return fmt.Errorf("method %q is not a full method name such as /enviro.api.v1.ContainerService/CreateContainer", method)
+		}
+		if def, max := c.limits(canonicalMethod(method), false); max > 0 && def > max {
+			return fmt.Errorf("method %s: default %s is longer than max %s", method, def, max)
+		}
+	}
+	return nil
+}
+
+// limits returns the default and maximum deadline of the RPCs to method,
+// 0 for none
+func (c DeadlineConfig) limits(method string, stream bool) (def, max time.Duration) {
+	implicit := false
+	if !stream {
+		def, max = c.Default, c.Max
+		if def == 0 {
+			def, implicit = DefaultRPCDeadline, true
+		}
+	}
+	for m, d := range c.Methods {
+		if canonicalMethod(m) != method {
+			continue
+		}
+		if d.Default != 0 {
+			def, implicit = d.Default, false
+		}
+		if d.Max != 0 {
+			max = d.Max
+		}
+	}
+	def, max = positive(def), positive(max)
+	if implicit && max > 0 && def > max {
+		// Configured defaults beyond the max are rejected by validate
+		def = max
+	}
+	return def, max
+}
+
+// positive returns d, or 0 when it is negative
+func positive(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// timeout returns the deadline the server imposes on a call to method
+// with ctx, 0 when the call's own deadline is within the limits
+func (c DeadlineConfig) timeout(ctx context.Context, method string, stream bool) time.Duration {
+	def, max := c.limits(method, stream)
+	deadline, ok := ctx.Deadline()
+	switch {
+	case !ok && def > 0:
+		return def
+	case !ok, max > 0 && time.Until(deadline) > max:
+		return max
+	}
+	return 0
+}
+
+// serverOptions returns the interceptors enforcing the deadlines. They run
+// after request logging, which logs the status codes they return.
+func (c DeadlineConfig) serverOptions() []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		parent := ctx
+		timeout := c.timeout(ctx, info.FullMethod, false)
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		resp, err := handler(ctx, req)
+		return resp, deadlineError(parent, ctx, timeout, err)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		parent := ss.Context()
+		timeout := c.timeout(parent, info.FullMethod, true)
+		ctx := parent
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			ss = &deadlineStream{ServerStream: ss, ctx: ctx}
+		}
+		return deadlineError(parent, ctx, timeout, handler(srv, ss))
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+// deadlineStream is a stream whose context has the server's deadline
+type deadlineStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *deadlineStream) Context() context.Context {
+	return s.ctx
+}
+
+// deadlineError returns the error of a call whose context ctx, derived
+// from parent with the server's timeout, if any, ended as
+// codes.DeadlineExceeded or codes.Canceled, whatever the handler made of
+// it, e.g. codes.Internal from a wrapped context error. The message of
+// err is kept.
+func deadlineError(parent, ctx context.Context, timeout time.Duration, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	st := status.Convert(err)
+	if timeout > 0 && parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		msg := fmt.Sprintf("server deadline of %s exceeded: %s", timeout, st.Message())
+		info := &errdetails.ErrorInfo{
+			Reason:   ServerDeadlineReason,
+			Domain:   "enviro.api",
+			Metadata: map[string]string{"deadline": timeout.String()},
+		}
+		withInfo, detailErr := status.New(codes.DeadlineExceeded, msg).WithDetails(info)
+		if detailErr != nil {
+			return status.Error(codes.DeadlineExceeded, msg)
+		}
+		return withInfo.Err()
+	}
+	code := status.FromContextError(ctx.Err()).Code()
+	if st.Code() == code {
+		return err
+	}
+	return status.Error(code, st.Message())
+}
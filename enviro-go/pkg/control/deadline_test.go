@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testCreateMethod = "/enviro.api.v1.ContainerService/CreateContainer"
+	testWatchMethod  = "/enviro.api.v1.ContainerService/WatchEvents"
+)
+
+func TestDeadlineLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  DeadlineConfig
+		method  string
+		stream  bool
+		wantDef time.Duration
+		wantMax time.Duration
+	}{
+		{name: "defaults", method: testCreateMethod, wantDef: DefaultRPCDeadline},
+		{name: "stream has none", method: testWatchMethod, stream: true},
+		{
+			name:    "configured",
+			config:  DeadlineConfig{Default: time.Minute, Max: time.Hour},
+			method:  testCreateMethod,
+			wantDef: time.Minute,
+			wantMax: time.Hour,
+		},
+		{name: "implicit default capped", config: DeadlineConfig{Max: time.Minute}, method: testCreateMethod, wantDef: time.Minute, wantMax: time.Minute},
+		{
+			name: "implicit default capped by method",
+			config: DeadlineConfig{Methods: map[string]MethodDeadline{
+				testCreateMethod: {Max: time.Second},
+			}},
+			method:  testCreateMethod,
+			wantDef: time.Second,
+			wantMax: time.Second,
+		},
+		{name: "default lifted", config: DeadlineConfig{Default: -1, Max: time.Hour}, method: testCreateMethod, wantMax: time.Hour},
+		{
+			name: "method overrides default",
+			config: DeadlineConfig{Default: time.Minute, Max: time.Hour, Methods: map[string]MethodDeadline{
+				testCreateMethod: {Default: 10 * time.Minute},
+			}},
+			method:  testCreateMethod,
+			wantDef: 10 * time.Minute,
+			wantMax: time.Hour,
+		},
+		{
+			name: "method lifts max",
+			config: DeadlineConfig{Max: time.Hour, Methods: map[string]MethodDeadline{
+				testCreateMethod: {Max: -1},
+			}},
+			method:  testCreateMethod,
+			wantDef: DefaultRPCDeadline,
+		},
+		{
+			name: "other method keeps config",
+			config: DeadlineConfig{Max: time.Hour, Methods: map[string]MethodDeadline{
+				testCreateMethod: {Max: -1},
+			}},
+			method:  "/enviro.api.v1.ContainerService/DeleteContainer",
+			wantDef: DefaultRPCDeadline,
+			wantMax: time.Hour,
+		},
+		{
+			name: "legacy method name",
+			config: DeadlineConfig{Methods: map[string]MethodDeadline{
+				"/enviro.api.ContainerService/CreateContainer": {Default: time.Second},
+			}},
+			method:  testCreateMethod,
+			wantDef: time.Second,
+		},
+		{
+			name: "stream bounded by method",
+			config: DeadlineConfig{Default: time.Minute, Max: time.Hour, Methods: map[string]MethodDeadline{
+				testWatchMethod: {Max: 24 * time.Hour},
+			}},
+			method:  testWatchMethod,
+			stream:  true,
+			wantMax: 24 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def, max := tt.config.limits(tt.method, tt.stream)
+			if def != tt.wantDef || max != tt.wantMax {
+				t.Errorf("limits() = %s, %s, want %s, %s", def, max, tt.wantDef, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestDeadlineTimeout(t *testing.T) {
+	config := DeadlineConfig{Default: time.Minute, Max: time.Hour}
+	tests := []struct {
+		name     string
+		config   DeadlineConfig
+		deadline time.Duration
+		stream   bool
+		want     time.Duration
+	}{
+		{name: "no deadline gets default", config: config, want: time.Minute},
+		{name: "deadline within max is kept", config: config, deadline: 30 * time.Minute},
+		{name: "deadline beyond max is capped", config: config, deadline: 2 * time.Hour, want: time.Hour},
+		{name: "no default and no deadline gets max", config: DeadlineConfig{Default: -1, Max: time.Hour}, want: time.Hour},
+		{name: "no limits", config: DeadlineConfig{Default: -1}},
+		{name: "stream without deadline", config: config, stream: true},
+		{name: "stream beyond method max", config: DeadlineConfig{Methods: map[string]MethodDeadline{
+			testCreateMethod: {Max: time.Minute},
+		}}, deadline: time.Hour, stream: true, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			if got := tt.config.timeout(ctx, testCreateMethod, tt.stream); got != tt.want {
+				t.Errorf("timeout() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadlineValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  DeadlineConfig
+		wantErr bool
+	}{
+		{name: "zero"},
+		{name: "default within max", config: DeadlineConfig{Default: time.Minute, Max: time.Hour}},
+		{name: "negative max", config: DeadlineConfig{Max: -1}, wantErr: true},
+		{name: "default beyond max", config: DeadlineConfig{Default: 2 * time.Hour, Max: time.Hour}, wantErr: true},
+		{name: "implicit default beyond max", config: DeadlineConfig{Max: time.Minute}},
+		{name: "method default beyond its max", config: DeadlineConfig{Methods: map[string]MethodDeadline{
+			testCreateMethod: {Default: time.Hour, Max: time.Minute},
+		}}, wantErr: true},
+		{name: "method default beyond config max", config: DeadlineConfig{Max: time.Hour, Methods: map[string]MethodDeadline{
+			testCreateMethod: {Default: 2 * time.Hour},
+		}}, wantErr: true},
+		{name: "method lifts max", config: DeadlineConfig{Max: time.Hour, Methods: map[string]MethodDeadline{
+			testCreateMethod: {Default: 2 * time.Hour, Max: -1},
+		}}},
+		{name: "method not a full name", config: DeadlineConfig{Methods: map[string]MethodDeadline{
+			"CreateContainer": {Default: time.Second},
+		}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeadlineError(t *testing.T) {
+	expired := func(parent context.Context) context.Context {
+		ctx, cancel := context.WithDeadline(parent, time.Now().Add(-time.Second))
+		t.Cleanup(cancel)
+		return ctx
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	handlerErr := fmt.Errorf("failed: %w", context.DeadlineExceeded)
+
+	tests := []struct {
+		name       string
+		parent     context.Context
+		ctx        context.Context
+		timeout    time.Duration
+		err        error
+		wantCode   codes.Code
+		wantReason bool
+	}{
+		{name: "no error", parent: context.Background(), ctx: expired(context.Background()), timeout: time.Minute, wantCode: codes.OK},
+		{
+			name:     "context still live",
+			parent:   context.Background(),
+			ctx:      context.Background(),
+			timeout:  time.Minute,
+			err:      status.Error(codes.NotFound, "gone"),
+			wantCode: codes.NotFound,
+		},
+		{
+			name:       "server deadline",
+			parent:     context.Background(),
+			ctx:        expired(context.Background()),
+			timeout:    time.Minute,
+			err:        handlerErr,
+			wantCode:   codes.DeadlineExceeded,
+			wantReason: true,
+		},
+		{
+			name:     "client deadline",
+			parent:   expired(context.Background()),
+			ctx:      expired(context.Background()),
+			err:      handlerErr,
+			wantCode: codes.DeadlineExceeded,
+		},
+		{
+			name:     "client canceled",
+			parent:   canceled,
+			ctx:      canceled,
+			err:      status.Error(codes.Internal, "interrupted"),
+			wantCode: codes.Canceled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := deadlineError(tt.parent, tt.ctx, tt.timeout, tt.err)
+			st := status.Convert(err)
+			if st.Code() != tt.wantCode {
+				t.Fatalf("deadlineError() code = %s, want %s", st.Code(), tt.wantCode)
+			}
+			var reason bool
+			for _, d := range st.Details() {
+				if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == ServerDeadlineReason {
+					reason = info.Metadata["deadline"] == tt.timeout.String()
+				}
+			}
+			if reason != tt.wantReason {
+				t.Errorf("deadlineError() details = %v, want %s: %v", st.Details(), ServerDeadlineReason, tt.wantReason)
+			}
+			if tt.err != nil && !errors.Is(tt.err, context.DeadlineExceeded) && st.Message() != status.Convert(tt.err).Message() {
+				t.Errorf("deadlineError() message = %q, want that of %v", st.Message(), tt.err)
+			}
+		})
+	}
+}
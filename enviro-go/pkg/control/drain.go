@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// DrainingReason is the ErrorInfo reason attached to the CreateContainer
+// calls a draining control plane rejects with codes.Unavailable. They
+// never reached the handler, so they can be retried on another node.
+const DrainingReason = "DRAINING"
+
+// createMethod is rejected from the start of a drain
+const createMethod = "/enviro.api.v1.ContainerService/CreateContainer"
+
+// watchMethod streams until the control plane stops, so it isn't waited
+// for
+const watchMethod = "/enviro.api.v1.ContainerService/WatchEvents"
+
+// inflightTracker counts the RPCs in progress, rejecting new containers
+// once cordoned and every new RPC once draining. Event watches are not
+// counted: they only end when the control plane stops, so waiting on them
+// would never finish. The health service is exempt so probes keep seeing
+// NOT_SERVING.
+type inflightTracker struct {
+	mu       sync.Mutex
+	count    int
+	cordoned bool
+	draining bool
+	// idle is closed, and replaced, whenever count drops to zero
+	idle chan struct{}
+}
+
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{idle: make(chan struct{})}
+}
+
+// serverOptions returns the interceptors tracking requests
+func (t *inflightTracker) serverOptions() []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+			return handler(ctx, req)
+		}
+		if err := t.begin(info.FullMethod); err != nil {
+			return nil, err
+		}
+		defer t.end()
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		switch {
+		case strings.HasPrefix(info.FullMethod, healthMethodPrefix):
+			return handler(srv, ss)
+		case canonicalMethod(info.FullMethod) == watchMethod:
+			if t.isDraining() {
+				return errDraining
+			}
+			return handler(srv, ss)
+		}
+		if err := t.begin(info.FullMethod); err != nil {
+			return err
+		}
+		defer t.end()
+		return handler(srv, ss)
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+var errDraining = status.Error(codes.Unavailable, "control plane is draining")
+
+// errCordoned rejects new containers while draining
+var errCordoned = func() error {
+	msg := "control plane is draining and takes no new containers"
+	st, err := status.New(codes.Unavailable, msg).WithDetails(&errdetails.ErrorInfo{Reason: DrainingReason, Domain: "enviro.api"})
+	if err != nil {
+		return status.Error(codes.Unavailable, msg)
+	}
+	return st.Err()
+}()
+
+// isDraining reports whether err was returned by a control plane that is
+// draining, e.g. by a node the scheduler placed a container on
+func isDraining(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Unavailable {
+		return false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == DrainingReason {
+			return true
+		}
+	}
+	return false
+}
+
+// begin counts a new request to method, or returns the error rejecting it
+func (t *inflightTracker) begin(method string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.draining:
+		return errDraining
+	case t.cordoned && canonicalMethod(method) == createMethod:
+		return errCordoned
+	}
+	t.count++
+	return nil
+}
+
+func (t *inflightTracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.count--
+	if t.count == 0 {
+		close(t.idle)
+		t.idle = make(chan struct{})
+	}
+}
+
+// cordon rejects new containers from now on. It returns false when
+// already cordoned.
+func (t *inflightTracker) cordon() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cordoned {
+		return false
+	}
+	t.cordoned = true
+	return true
+}
+
+// drain rejects new requests from now on. It is idempotent.
+func (t *inflightTracker) drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cordoned = true
+	t.draining = true
+}
+
+func (t *inflightTracker) isCordoned() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cordoned
+}
+
+func (t *inflightTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+func (t *inflightTracker) inFlight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count
+}
+
+// wait blocks until no requests are in flight, or ctx is done
+func (t *inflightTracker) wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		if t.count == 0 {
+			t.mu.Unlock()
+			return nil
+		}
+		idle := t.idle
+		t.mu.Unlock()
+
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// InFlight returns the number of RPCs currently being handled, event
+// watches aside
+func (cp *ControlPlane) InFlight() int {
+	return cp.inflight.inFlight()
+}
+
+// Draining reports whether Drain or Stop was called, after which new
+// containers are rejected
+func (cp *ControlPlane) Draining() bool {
+	return cp.inflight.isCordoned()
+}
+
+// Drain stops the control plane without cutting off work in progress.
+// It first stops taking new containers: CreateContainer fails with
+// codes.Unavailable and a DrainingReason ErrorInfo, which makes a leader
+// placing containers on this node mark it unschedulable and clients move
+// on to another endpoint. Other RPCs are still served, so running
+// containers can be stopped or inspected. Once no RPCs are in flight, or
+// ctx is done, it calls Stop, which leaves the containers running.
+//
+// It returns ctx's error when RPCs were still in flight; they are cut
+// off by Stop. Like Stop, it gives ctx DefaultShutdownTimeout when it has
+// no deadline.
+func (cp *ControlPlane) Drain(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultShutdownTimeout)
+		defer cancel()
+	}
+	if cp.inflight.cordon() {
+		cp.log.Info("Draining control plane", "in_flight", cp.InFlight())
+		cp.events.publish(&pb.ContainerEvent{
+			Type:      pb.ContainerEventType_CONTAINER_EVENT_TYPE_CONTROL_PLANE_DRAINING,
+			Timestamp: timestamppb.Now(),
+		})
+	}
+	// Stop logs the requests that didn't finish in time
+	err := cp.inflight.wait(ctx)
+	if stopErr := cp.Stop(ctx); err == nil {
+		err = stopErr
+	}
+	return err
+}
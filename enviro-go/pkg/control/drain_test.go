@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// blockingContainers holds GetContainer calls until release is closed
+type blockingContainers struct {
+	pb.UnimplementedContainerServiceServer
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingContainers) GetContainer(ctx context.Context, req *pb.GetContainerRequest) (*pb.GetContainerResponse, error) {
+	s.entered <- struct{}{}
+	<-s.release
+	return &pb.GetContainerResponse{Container: &pb.Container{Id: req.Id}}, nil
+}
+
+func (s *blockingContainers) CreateContainer(ctx context.Context, req *pb.CreateContainerRequest) (*pb.CreateContainerResponse, error) {
+	return &pb.CreateContainerResponse{Container: &pb.Container{Id: req.Id}}, nil
+}
+
+func (s *blockingContainers) ListContainers(ctx context.Context, req *pb.ListContainersRequest) (*pb.ListContainersResponse, error) {
+	return &pb.ListContainersResponse{}, nil
+}
+
+// TestDrainInFlight cordons and drains a server while an RPC is in
+// flight, which completes while new ones are rejected, and is waited for
+func TestDrainInFlight(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tracker := newInflightTracker()
+	containers := &blockingContainers{entered: make(chan struct{}), release: make(chan struct{})}
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(tracker.serverOptions()...)
+	pb.RegisterContainerServiceServer(server, containers)
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.DialContext(ctx, "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewContainerServiceClient(conn)
+
+	type result struct {
+		resp *pb.GetContainerResponse
+		err  error
+	}
+	long := make(chan result, 1)
+	go func() {
+		resp, err := client.GetContainer(ctx, &pb.GetContainerRequest{Id: "c1"})
+		long <- result{resp, err}
+	}()
+	<-containers.entered
+	if got := tracker.inFlight(); got != 1 {
+		t.Fatalf("inFlight() = %d, want 1", got)
+	}
+
+	// Cordoned, new containers are rejected as retryable elsewhere and
+	// the other RPCs are served
+	tracker.cordon()
+	_, err = client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "c2"})
+	if !isDraining(err) {
+		t.Errorf("CreateContainer() while cordoned = %v, want %v", err, errCordoned)
+	}
+	if _, err := client.ListContainers(ctx, &pb.ListContainersRequest{}); err != nil {
+		t.Errorf("ListContainers() while cordoned = %v", err)
+	}
+
+	// Draining, every new RPC is rejected
+	tracker.drain()
+	for name, call := range map[string]func() error{
+		"ListContainers": func() error {
+			_, err := client.ListContainers(ctx, &pb.ListContainersRequest{})
+			return err
+		},
+		"CreateContainer": func() error {
+			_, err := client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "c3"})
+			return err
+		},
+	} {
+		if err := call(); status.Code(err) != codes.Unavailable {
+			t.Errorf("%s() while draining = %v, want %v", name, err, codes.Unavailable)
+		}
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if err := tracker.wait(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait() with an RPC in flight = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case r := <-long:
+		t.Fatalf("in-flight RPC cut off by the drain: %v, %v", r.resp, r.err)
+	default:
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- tracker.wait(ctx) }()
+	close(containers.release)
+	r := <-long
+	if r.err != nil || r.resp.Container.GetId() != "c1" {
+		t.Errorf("in-flight GetContainer() = %v, %v, want c1", r.resp, r.err)
+	}
+	if err := <-waited; err != nil {
+		t.Errorf("wait() = %v, want the in-flight RPC waited for", err)
+	}
+	if got := tracker.inFlight(); got != 0 {
+		t.Errorf("inFlight() after the drain = %d, want 0", got)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// eventBufferSize is the number of undelivered events kept per watcher
+// unless configured otherwise. Once full, the oldest event is dropped for
+// each new one.
+const eventBufferSize = 256
+
+// maxEventBufferSize bounds the configured buffer size, which each watch
+// allocates
+const maxEventBufferSize = 1 << 16
+
+// eventHistorySize is the number of latest events kept for watches
+// resuming after a sequence number
+const eventHistorySize = 1024
+
+// errEventBusClosed is returned when subscribing during shutdown
+var errEventBusClosed = errors.New("event bus closed")
+
+// errEventsNotRetained is returned when resuming after a sequence number
+// whose following events are no longer retained
+var errEventsNotRetained = errors.New("events after the sequence number are no longer retained")
+
+// eventBus fans container events out to watchers. Publishing never blocks:
+// a watcher that falls behind loses its oldest events and is told how many
+// on the next event it receives.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   map[*eventSub]struct{}
+	closed bool
+	// done is closed along with the bus, to end other streams that never
+	// finish on their own
+	done chan struct{}
+	// seq is the sequence number of the latest event
+	seq uint64
+	// history holds the latest events, oldest first
+	history []*pb.ContainerEvent
+
+	// dropped counts events dropped across all watchers
+	dropped atomic.Uint64
+	// bufferSize is the buffer of watches started from now on,
+	// eventBufferSize when zero
+	bufferSize atomic.Int64
+}
+
+// eventSub is a single watcher's buffered queue
+type eventSub struct {
+	ch      chan *pb.ContainerEvent
+	dropped atomic.Uint64
+	// start is the sequence number of the latest event before the watch
+	start uint64
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*eventSub]struct{}),
+		done: make(chan struct{}),
+		// Numbering from the current time makes the sequence numbers of an
+		// earlier run of the control plane older than any of this one
+		seq: uint64(time.Now().UnixMicro()),
+	}
+}
+
+// subscribe registers a watcher. With after set, the retained events
+// after that sequence number are returned for sending first, failing with
+// errEventsNotRetained when any is missing. Its channel is closed by
+// unsubscribe or when the bus is closed.
+func (b *eventBus) subscribe(after uint64) (*eventSub, []*pb.ContainerEvent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, nil, errEventBusClosed
+	}
+	var replay []*pb.ContainerEvent
+	if after != 0 {
+		if after > b.seq || b.seq-after > uint64(len(b.history)) {
+			return nil, nil, errEventsNotRetained
+		}
+		replay = append(replay, b.history[len(b.history)-int(b.seq-after):]...)
+	}
+	size := int(b.bufferSize.Load())
+	if size == 0 {
+		size = eventBufferSize
+	}
+	sub := &eventSub{ch: make(chan *pb.ContainerEvent, size), start: b.seq}
+	b.subs[sub] = struct{}{}
+	return sub, replay, nil
+}
+
+// setBufferSize changes the buffer of the watches started from now on,
+// back to eventBufferSize with zero. Started watches keep theirs.
+func (b *eventBus) setBufferSize(size int) {
+	b.bufferSize.Store(int64(size))
+}
+
+// unsubscribe removes a watcher and releases its buffer
+func (b *eventBus) unsubscribe(sub *eventSub) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// publish numbers ev and delivers it to every watcher. ev must not be
+// modified afterwards.
+func (b *eventBus) publish(ev *pb.ContainerEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	ev.Sequence = b.seq
+	if len(b.history) == eventHistorySize {
+		copy(b.history, b.history[1:])
+		b.history = b.history[:len(b.history)-1]
+	}
+	b.history = append(b.history, ev)
+
+	for sub := range b.subs {
+		for {
+			select {
+			case sub.ch <- ev:
+			default:
+				// Full: drop the oldest event unless the watcher just
+				// drained it, then try again
+				select {
+				case <-sub.ch:
+					sub.dropped.Add(1)
+					b.dropped.Add(1)
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// close ends every watch, e.g. so graceful shutdown isn't held up by
+// streams that never finish on their own
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		close(b.done)
+	}
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// annotate fills in the number of events dropped before ev
+func (s *eventSub) annotate(ev *pb.ContainerEvent) *pb.ContainerEvent {
+	if n := s.dropped.Swap(0); n > 0 {
+		// Events are shared between watchers, so annotate a copy
+		ev = proto.Clone(ev).(*pb.ContainerEvent)
+		ev.Dropped = n
+	}
+	return ev
+}
@@ -0,0 +1,1406 @@
+//go:build cgo
+
+// FFI exports consumed by the Rust runtime when built with
+// -buildmode=c-shared. Kept separate so the control plane itself
+// builds without cgo.
+
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// FFI result codes matching Rust. The codes are stable; go_get_last_error
+// describes the failure of a call returning one other than FFI_SUCCESS.
+typedef int ffi_result;
+#define FFI_SUCCESS 0
+// Failures without a code of their own
+#define FFI_ERROR -1
+#define FFI_TIMEOUT -2
+// Invalid configuration or arguments
+#define FFI_INVALID_ARGUMENT -3
+// The listen address is taken by another process
+#define FFI_ADDRESS_IN_USE -4
+// Missing privileges, e.g. to bind a port or load eBPF programs
+#define FFI_PERMISSION_DENIED -5
+// An init call while the control plane runs, which leaves it running.
+// Init calls returned FFI_SUCCESS for this before the code existed.
+#define FFI_ALREADY_INITIALIZED -6
+// A call needing the control plane before it is initialized
+#define FFI_NOT_INITIALIZED -7
+// The platform lacks a requested feature, e.g. the eBPF datapath
+#define FFI_UNSUPPORTED -8
+
+// Receives each event as a JSON-encoded ContainerEvent, which includes
+// events about the control plane and its nodes. The string is only valid
+// for the duration of the call.
+typedef void (*enviro_event_callback)(const char* event_json, void* user_data);
+
+static inline void call_event_callback(enviro_event_callback cb, const char* event_json, void* user_data) {
+	cb(event_json, user_data);
+}
+
+// Performs action ("start" or "stop") on a container and returns once it
+// is done. timeout_ms is how long a stopping container may take to exit
+// before it is killed. On failure the callback may write a NUL-terminated
+// message of at most err_len bytes to err.
+typedef ffi_result (*enviro_runtime_callback)(const char* action, const char* container_id, int timeout_ms,
+	char* err, size_t err_len, void* user_data);
+
+static inline ffi_result call_runtime_callback(enviro_runtime_callback cb, const char* action,
+	const char* container_id, int timeout_ms, char* err, size_t err_len, void* user_data) {
+	return cb(action, container_id, timeout_ms, err, err_len, user_data);
+}
+
+// Operations of the session callback
+#define ENVIRO_SESSION_EXEC 0
+#define ENVIRO_SESSION_ATTACH 1
+#define ENVIRO_SESSION_STDIN 2
+#define ENVIRO_SESSION_CLOSE_STDIN 3
+#define ENVIRO_SESSION_RESIZE 4
+#define ENVIRO_SESSION_CLOSE 5
+
+// Streams of go_session_output
+#define ENVIRO_STREAM_STDOUT 1
+#define ENVIRO_STREAM_STDERR 2
+
+// Drives the exec and attach sessions of the runtime. ENVIRO_SESSION_EXEC
+// runs a command in a container and ENVIRO_SESSION_ATTACH attaches to its
+// main process, data holding the JSON-encoded container_id and options,
+// e.g. {"container_id":"c1","command":["sh"],"tty":true,"stdin":true,
+// "size":{"width":80,"height":24}}. Once that returns FFI_SUCCESS the
+// session is known by session_id, and later operations pass its input:
+// ENVIRO_SESSION_STDIN the len bytes of data, ENVIRO_SESSION_RESIZE the
+// JSON-encoded size, and ENVIRO_SESSION_CLOSE_STDIN nothing.
+// ENVIRO_SESSION_CLOSE ends the session, killing an exec'd command or
+// detaching. data is only valid for the duration of the call. On failure
+// the callback may write a NUL-terminated message of at most err_len bytes
+// to err.
+typedef ffi_result (*enviro_session_callback)(uint64_t session_id, int op, const char* data, size_t len,
+	char* err, size_t err_len, void* user_data);
+
+static inline ffi_result call_session_callback(enviro_session_callback cb, uint64_t session_id, int op,
+	const char* data, size_t len, char* err, size_t err_len, void* user_data) {
+	return cb(session_id, op, data, len, err, err_len, user_data);
+}
+
+// Receives each log record as a JSON object with at least the time,
+// level and msg keys. level is -4 for debug, 0 for info, 4 for warn and 8
+// for error. The string is only valid for the duration of the call.
+typedef void (*enviro_log_callback)(int level, const char* record_json, void* user_data);
+
+static inline void call_log_callback(enviro_log_callback cb, int level, const char* record_json, void* user_data) {
+	cb(level, record_json, user_data);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/image"
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/tracing"
+)
+
+// runtimeErrLen is the size of the buffer runtime callbacks write errors to
+const runtimeErrLen = 1024
+
+var (
+	// errAlreadyInitialized is returned by init calls while a control
+	// plane runs
+	errAlreadyInitialized = errors.New("control plane already initialized")
+	// errNotInitialized is returned by calls needing a running control
+	// plane
+	errNotInitialized = errors.New("control plane not initialized")
+	// errUnknownSession is returned by session calls for sessions that
+	// ended or never existed
+	errUnknownSession = errors.New("unknown session")
+	// errUnknownStream is returned by go_session_output for streams other
+	// than stdout and stderr
+	errUnknownStream = errors.New("unknown output stream")
+	// errNullArgument is returned for NULL pointers where calls need one
+	errNullArgument = errors.New("argument must not be NULL")
+	// errUnknownHandle is returned by the go_network_ calls for handles
+	// go_network_new didn't return or that were freed
+	errUnknownHandle = errors.New("unknown network handle")
+	// errUnknownContainer is returned by go_verify_container_network for
+	// containers the control plane doesn't serve
+	errUnknownContainer = errors.New("unknown container")
+	// errNetworkNotReady is returned by go_verify_container_network for
+	// networks that didn't become ready in time
+	errNetworkNotReady = errors.New("container network not ready")
+)
+
+// The control planes of the FFI exports by handle. The exports are a thin
+// wrapper over their API, which allows any number of instances: the
+// singleton exports drive the one of defaultHandle the host initialized,
+// and the go_network_ exports those of the handles go_network_new
+// returned. mu serializes them.
+var (
+	controlPlanes = make(map[uint64]*ControlPlane)
+	lastHandle    uint64
+	mu            sync.Mutex
+)
+
+// defaultHandle is the handle of the control plane of the init calls and
+// the other singleton exports. go_network_new never returns it.
+const defaultHandle = 0
+
+// lastError is the error of the most recent failed export call, cleared by
+// every init, shutdown and go_set_log_level call
+var (
+	lastError   string
+	lastErrorMu sync.Mutex
+)
+
+// The registered event callbacks by handle. That of defaultHandle is
+// shared across re-initializations; the others are dropped with their
+// handle.
+var (
+	eventCallbacks = make(map[uint64]eventCallback)
+	eventMu        sync.Mutex
+)
+
+// eventCallback is a registered event callback with its user data
+type eventCallback struct {
+	cb       C.enviro_event_callback
+	userData unsafe.Pointer
+}
+
+// The registered runtime callback, shared across re-initializations
+var (
+	runtimeCallback C.enviro_runtime_callback
+	runtimeUserData unsafe.Pointer
+	runtimeMu       sync.Mutex
+)
+
+// The registered session callback, shared across re-initializations, and
+// the open sessions by ID
+var (
+	sessionCallback C.enviro_session_callback
+	sessionUserData unsafe.Pointer
+	sessions        = make(map[uint64]*ffiSession)
+	lastSessionID   uint64
+	sessionMu       sync.Mutex
+)
+
+// The registered log callback, shared across re-initializations
+var (
+	logCallback C.enviro_log_callback
+	logUserData unsafe.Pointer
+	logMu       sync.Mutex
+)
+
+// logLevel is the level of the library's logs, shared across
+// re-initializations
+var logLevel = new(slog.LevelVar)
+
+// ffiLog logs the library's own messages outside of a control plane
+var ffiLog = newFFILogger(slog.NewTextHandler(os.Stderr, nil))
+
+// go_init_control_plane starts the control plane. addr is either a listen
+// address or a JSON-encoded ControlPlaneConfig. While a control plane
+// runs, this and the other init calls return FFI_ALREADY_INITIALIZED.
+// With "defer_network" set in the config only the server is brought up,
+// and go_init_network sets up the datapath later.
+//
+//export go_init_control_plane
+func go_init_control_plane(addr *C.char) C.ffi_result {
+	return initControlPlane(C.GoString(addr))
+}
+
+// initControlPlane starts the control plane on addr, a listen address or
+// JSON-encoded config
+func initControlPlane(addr string) C.ffi_result {
+	mu.Lock()
+	defer mu.Unlock()
+	setLastError(nil)
+
+	if controlPlanes[defaultHandle] != nil {
+		return fail(errAlreadyInitialized)
+	}
+
+	config := ControlPlaneConfig{Address: addr}
+	if strings.HasPrefix(strings.TrimSpace(config.Address), "{") {
+		if err := json.Unmarshal([]byte(config.Address), &config); err != nil {
+			return initFailed(fmt.Errorf("invalid control plane config: %w", err))
+		}
+	}
+	if _, err := startControlPlaneWithConfig(defaultHandle, config); err != nil {
+		return initFailed(err)
+	}
+
+	ffiLog.Info("Control plane initialized successfully")
+	return C.FFI_SUCCESS
+}
+
+// go_init_control_plane_with_log_level is go_init_control_plane with the
+// log verbosity ("debug", "info", "warn" or "error") set by the host.
+//
+//export go_init_control_plane_with_log_level
+func go_init_control_plane_with_log_level(addr *C.char, level *C.char) C.ffi_result {
+	mu.Lock()
+	defer mu.Unlock()
+	setLastError(nil)
+
+	if controlPlanes[defaultHandle] != nil {
+		return fail(errAlreadyInitialized)
+	}
+
+	config := ControlPlaneConfig{
+		Address:  C.GoString(addr),
+		LogLevel: C.GoString(level),
+	}
+	if _, err := startControlPlaneWithConfig(defaultHandle, config); err != nil {
+		return initFailed(err)
+	}
+
+	ffiLog.Info("Control plane initialized successfully")
+	return C.FFI_SUCCESS
+}
+
+// go_init_control_plane_with_config initializes the control plane from a
+// JSON-encoded ControlPlaneConfig, e.g. to pass TLS certificate paths, or
+// from the path of a YAML, TOML or JSON config file. Config files are
+// read by LoadConfig, which also applies the ENVIRO_ environment
+// variables.
+//
+//export go_init_control_plane_with_config
+func go_init_control_plane_with_config(config *C.char) C.ffi_result {
+	return initWithConfig(C.GoString(config), "")
+}
+
+// go_init_control_plane_traced is go_init_control_plane_with_config
+// recording the start of the control plane as a span of the trace of the
+// W3C traceparent, e.g. that of the host starting up. An empty
+// traceparent starts no span.
+//
+//export go_init_control_plane_traced
+func go_init_control_plane_traced(config *C.char, traceparent *C.char) C.ffi_result {
+	return initWithConfig(C.GoString(config), C.GoString(traceparent))
+}
+
+// initWithConfig starts the control plane from a JSON-encoded config or
+// config file, within the trace of traceparent if any
+func initWithConfig(configArg, traceparent string) C.ffi_result {
+	mu.Lock()
+	defer mu.Unlock()
+	setLastError(nil)
+
+	if controlPlanes[defaultHandle] != nil {
+		return fail(errAlreadyInitialized)
+	}
+
+	ctx, err := tracing.FromTraceparent(context.Background(), traceparent)
+	if err != nil {
+		return initFailed(fmt.Errorf("%w: %v", network.ErrInvalidConfig, err))
+	}
+	config, err := parseConfig(configArg)
+	if err != nil {
+		return initFailed(err)
+	}
+
+	start := time.Now()
+	cp, err := startControlPlaneWithConfig(defaultHandle, config)
+	if err != nil {
+		return initFailed(err)
+	}
+	if traceparent != "" {
+		// The control plane's tracer only exists once it is created
+		_, span := cp.tracer.start(ctx, "InitControlPlane", trace.WithTimestamp(start))
+		span.End()
+	}
+
+	ffiLog.Info("Control plane initialized successfully")
+	return C.FFI_SUCCESS
+}
+
+// parseConfig decodes a JSON-encoded config, or loads the config file at
+// path s
+func parseConfig(s string) (ControlPlaneConfig, error) {
+	if !strings.HasPrefix(strings.TrimSpace(s), "{") {
+		return LoadConfig(s)
+	}
+	var config ControlPlaneConfig
+	if err := json.Unmarshal([]byte(s), &config); err != nil {
+		return config, fmt.Errorf("invalid control plane config: %w", err)
+	}
+	return config, nil
+}
+
+// go_init_control_plane_blocking is like go_init_control_plane but only
+// returns once the server accepts connections. If that does not happen
+// within timeoutMs the server is torn down and FFI_TIMEOUT is returned.
+//
+//export go_init_control_plane_blocking
+func go_init_control_plane_blocking(addr *C.char, timeoutMs C.int) C.ffi_result {
+	return initControlPlaneBlocking(C.GoString(addr), time.Duration(timeoutMs)*time.Millisecond)
+}
+
+// initControlPlaneBlocking starts the control plane on addr and waits for
+// it to accept connections for at most timeout
+func initControlPlaneBlocking(addr string, timeout time.Duration) C.ffi_result {
+	mu.Lock()
+	defer mu.Unlock()
+	setLastError(nil)
+
+	if controlPlanes[defaultHandle] != nil {
+		return fail(errAlreadyInitialized)
+	}
+
+	cp, err := startControlPlane(addr)
+	if err != nil {
+		return initFailed(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := cp.WaitReady(ctx); err != nil {
+		ffiLog.Error("Control plane did not become ready", "error", err)
+		setLastError(fmt.Errorf("control plane did not become ready: %w", err))
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+		defer stopCancel()
+		cp.Stop(stopCtx)
+		delete(controlPlanes, defaultHandle)
+		return C.FFI_TIMEOUT
+	}
+
+	ffiLog.Info("Control plane initialized and serving")
+	return C.FFI_SUCCESS
+}
+
+// startControlPlane creates the control plane of defaultHandle and starts
+// serving it in a goroutine. Callers must hold mu.
+func startControlPlane(addr string) (*ControlPlane, error) {
+	return startControlPlaneWithConfig(defaultHandle, ControlPlaneConfig{Address: addr})
+}
+
+// startControlPlaneWithConfig is startControlPlane with a full config, for
+// the control plane of handle. Callers must hold mu.
+func startControlPlaneWithConfig(handle uint64, config ControlPlaneConfig) (*ControlPlane, error) {
+	if config.Runtime == nil {
+		config.Runtime = ffiRuntime{}
+	}
+	if config.Logger == nil {
+		if config.LogLevel != "" {
+			level, err := logging.ParseLevel(config.LogLevel)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", network.ErrInvalidConfig, err)
+			}
+			logLevel.Set(level)
+		}
+		stderr, err := logging.NewHandler(os.Stderr, config.LogFormat)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", network.ErrInvalidConfig, err)
+		}
+		config.Logger, config.LogLevelVar = newFFILogger(stderr), logLevel
+	}
+	cp, err := NewControlPlaneWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	controlPlanes[handle] = cp
+	forwardEvents(handle, cp)
+
+	// Serve until go_shutdown_control_plane or go_drain_control_plane, or
+	// go_network_free or go_network_drain, stop it. A failure to serve reaches the event callback as
+	// CONTROL_PLANE_STOPPED.
+	go func() {
+		if err := cp.Start(context.Background()); err != nil {
+			cp.log.Error("Control plane error", "error", err)
+		}
+	}()
+
+	return cp, nil
+}
+
+//export go_shutdown_control_plane
+func go_shutdown_control_plane() C.ffi_result {
+	return shutdownControlPlane(defaultHandle)
+}
+
+// shutdownControlPlane stops the control plane of handle
+func shutdownControlPlane(handle uint64) C.ffi_result {
+	mu.Lock()
+	defer mu.Unlock()
+	setLastError(nil)
+
+	cp, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+
+	// Stop logs the connections it had to close
+	cp.Stop(ctx)
+	delete(controlPlanes, handle)
+
+	ffiLog.Info("Control plane shutdown complete", "handle", handle)
+	return C.FFI_SUCCESS
+}
+
+// go_drain_control_plane stops the control plane without cutting off work
+// in progress, e.g. before the supervisor restarts it: new containers are
+// rejected as retryable right away, while the other RPCs are served until
+// none is in flight or timeoutMs passed. Containers keep running. It
+// returns FFI_TIMEOUT when RPCs had to be cut off, after which the
+// control plane is stopped all the same.
+//
+//export go_drain_control_plane
+func go_drain_control_plane(timeoutMs C.int) C.ffi_result {
+	return drainControlPlane(defaultHandle, timeoutMs)
+}
+
+// drainControlPlane drains and stops the control plane of handle
+func drainControlPlane(handle uint64, timeoutMs C.int) C.ffi_result {
+	mu.Lock()
+	defer mu.Unlock()
+	setLastError(nil)
+
+	cp, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	err = cp.Drain(ctx)
+	delete(controlPlanes, handle)
+	if err != nil {
+		setLastError(fmt.Errorf("requests in flight were cut off: %w", err))
+		return C.FFI_TIMEOUT
+	}
+	ffiLog.Info("Control plane drained", "handle", handle)
+	return C.FFI_SUCCESS
+}
+
+// go_reload_control_plane applies a JSON-encoded config or config file,
+// like go_init_control_plane_with_config takes, to the running control
+// plane without dropping connections. Changes that need a restart are
+// logged and left as they are; see ControlPlane.Reload.
+//
+//export go_reload_control_plane
+func go_reload_control_plane(config *C.char) C.ffi_result {
+	return reloadControlPlane(defaultHandle, C.GoString(config))
+}
+
+// reloadControlPlane applies config to the control plane of handle
+func reloadControlPlane(handle uint64, config string) C.ffi_result {
+	mu.Lock()
+	defer mu.Unlock()
+	setLastError(nil)
+
+	cp, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := cp.Reload(cfg); err != nil {
+		return fail(err)
+	}
+	return C.FFI_SUCCESS
+}
+
+// go_init_network sets up the datapath for a JSON-encoded NetworkConfig,
+// the "network" of the config of the init calls, completing the start of
+// a control plane initialized with "defer_network". Until then the RPCs
+// needing the network fail with FAILED_PRECONDITION and the health
+// service reports NOT_SERVING. Called again, e.g. after a config change
+// the running datapath can't take, it rebuilds the datapath, re-adopting
+// the container networks of the state dir. A failed call leaves the
+// network uninitialized.
+//
+//export go_init_network
+func go_init_network(config *C.char) C.ffi_result {
+	return initNetwork(defaultHandle, C.GoString(config))
+}
+
+// initNetwork sets up the datapath of the control plane of handle
+func initNetwork(handle uint64, config string) C.ffi_result {
+	mu.Lock()
+	defer mu.Unlock()
+	setLastError(nil)
+
+	cp, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+	var netConfig network.NetworkConfig
+	if err := json.Unmarshal([]byte(config), &netConfig); err != nil {
+		return fail(fmt.Errorf("invalid network config: %w", err))
+	}
+	if err := cp.InitNetwork(netConfig); err != nil {
+		ffiLog.Error("Failed to initialize network", "handle", handle, "error", err)
+		return fail(err)
+	}
+	ffiLog.Info("Network initialized successfully", "handle", handle)
+	return C.FFI_SUCCESS
+}
+
+// go_network_new starts a control plane of its own, next to that of the
+// init calls and those of other handles, from a JSON-encoded config or
+// config file like go_init_control_plane_with_config takes, and sets
+// *handle to the handle the other go_network_ calls take. The network
+// "instance" of the config scopes its datapath, see NetworkConfig.Instance;
+// its address, state dir and metrics address have to differ from those of
+// the other control planes too. Its events reach the callback registered
+// with go_network_register_event_callback for the handle. The runtime,
+// session and log callbacks, the log level and the last error are shared
+// by all control planes. go_network_free stops it.
+//
+//export go_network_new
+func go_network_new(config *C.char, handle *C.uint64_t) C.ffi_result {
+	mu.Lock()
+	defer mu.Unlock()
+	setLastError(nil)
+
+	if config == nil || handle == nil {
+		return fail(fmt.Errorf("%w: config and handle", errNullArgument))
+	}
+	cfg, err := parseConfig(C.GoString(config))
+	if err != nil {
+		return initFailed(err)
+	}
+	h := lastHandle + 1
+	if _, err := startControlPlaneWithConfig(h, cfg); err != nil {
+		return initFailed(err)
+	}
+	lastHandle = h
+	*handle = C.uint64_t(h)
+
+	ffiLog.Info("Control plane initialized successfully", "handle", h, "instance", cfg.Network.Instance)
+	return C.FFI_SUCCESS
+}
+
+// go_network_free stops the control plane of handle like
+// go_shutdown_control_plane and forgets the handle and its event callback
+//
+//export go_network_free
+func go_network_free(handle C.uint64_t) C.ffi_result {
+	if handle == defaultHandle {
+		return fail(errUnknownHandle)
+	}
+	res := shutdownControlPlane(uint64(handle))
+	registerEventCallback(uint64(handle), nil, nil)
+	return res
+}
+
+// go_network_drain is go_drain_control_plane for the control plane of
+// handle, after which the handle is forgotten as by go_network_free
+//
+//export go_network_drain
+func go_network_drain(handle C.uint64_t, timeoutMs C.int) C.ffi_result {
+	if handle == defaultHandle {
+		return fail(errUnknownHandle)
+	}
+	res := drainControlPlane(uint64(handle), timeoutMs)
+	registerEventCallback(uint64(handle), nil, nil)
+	return res
+}
+
+// go_network_reload is go_reload_control_plane for the control plane of
+// handle
+//
+//export go_network_reload
+func go_network_reload(handle C.uint64_t, config *C.char) C.ffi_result {
+	if handle == defaultHandle {
+		return fail(errUnknownHandle)
+	}
+	return reloadControlPlane(uint64(handle), C.GoString(config))
+}
+
+// go_network_init is go_init_network for the control plane of handle
+//
+//export go_network_init
+func go_network_init(handle C.uint64_t, config *C.char) C.ffi_result {
+	if handle == defaultHandle {
+		return fail(errUnknownHandle)
+	}
+	return initNetwork(uint64(handle), C.GoString(config))
+}
+
+// go_network_register_event_callback is go_register_event_callback for
+// the events of the control plane of handle only
+//
+//export go_network_register_event_callback
+func go_network_register_event_callback(handle C.uint64_t, cb C.enviro_event_callback, userData unsafe.Pointer) C.ffi_result {
+	setLastError(nil)
+	if handle == defaultHandle {
+		return fail(errUnknownHandle)
+	}
+	if _, err := lookupUnlocked(uint64(handle)); err != nil {
+		return fail(err)
+	}
+	registerEventCallback(uint64(handle), cb, userData)
+	return C.FFI_SUCCESS
+}
+
+// go_network_pull_image is go_pull_image for the control plane of handle
+//
+//export go_network_pull_image
+func go_network_pull_image(handle C.uint64_t, ref *C.char, timeoutMs C.int, imageJSON **C.char) C.ffi_result {
+	if handle == defaultHandle {
+		return fail(errUnknownHandle)
+	}
+	return pullImage(uint64(handle), ref, timeoutMs, imageJSON)
+}
+
+// go_network_report_container_stats is go_report_container_stats for the
+// control plane of handle
+//
+//export go_network_report_container_stats
+func go_network_report_container_stats(handle C.uint64_t, statsJSON *C.char) C.ffi_result {
+	if handle == defaultHandle {
+		return fail(errUnknownHandle)
+	}
+	return reportContainerStats(uint64(handle), statsJSON)
+}
+
+// go_network_list_container_networks is go_list_container_networks for
+// the control plane of handle
+//
+//export go_network_list_container_networks
+func go_network_list_container_networks(handle C.uint64_t, labels *C.char, outJSON **C.char, outLen *C.size_t) C.ffi_result {
+	if handle == defaultHandle {
+		return fail(errUnknownHandle)
+	}
+	return listContainerNetworks(uint64(handle), labels, outJSON, outLen)
+}
+
+// go_network_verify_container_network is go_verify_container_network for
+// the control plane of handle
+//
+//export go_network_verify_container_network
+func go_network_verify_container_network(handle C.uint64_t, containerID *C.char, timeoutMs C.int, reportJSON **C.char) C.ffi_result {
+	if handle == defaultHandle {
+		return fail(errUnknownHandle)
+	}
+	return verifyContainerNetwork(uint64(handle), containerID, timeoutMs, reportJSON)
+}
+
+// lookup returns the control plane of handle, failing with
+// errNotInitialized for defaultHandle before an init call and
+// errUnknownHandle for other handles without one. Callers must hold mu.
+func lookup(handle uint64) (*ControlPlane, error) {
+	if cp := controlPlanes[handle]; cp != nil {
+		return cp, nil
+	}
+	if handle == defaultHandle {
+		return nil, errNotInitialized
+	}
+	return nil, errUnknownHandle
+}
+
+// lookupUnlocked is lookup for calls that don't hold mu while they run
+func lookupUnlocked(handle uint64) (*ControlPlane, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	return lookup(handle)
+}
+
+// go_get_last_error returns the message of the error the most recent
+// failed call returned a code for, or NULL if it succeeded. The caller
+// owns the string and must release it with go_free_string. The error is
+// shared by all threads.
+//
+//export go_get_last_error
+func go_get_last_error() *C.char {
+	lastErrorMu.Lock()
+	defer lastErrorMu.Unlock()
+
+	if lastError == "" {
+		return nil
+	}
+	return C.CString(lastError)
+}
+
+// go_free_string releases a string returned by go_get_last_error,
+// go_pull_image, go_list_container_networks or
+// go_verify_container_network, or their go_network_ variants
+//
+//export go_free_string
+func go_free_string(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// go_register_event_callback registers cb to receive the events of the
+// current and any later control plane; NULL unregisters it. Besides
+// container events these notify the host of CONTROL_PLANE_STOPPED when
+// serving fails, after which the control plane has to be shut down,
+// CONTROL_PLANE_DRAINING when go_drain_control_plane starts, NODE_LOST
+// and NODE_READY as worker nodes come and go, and DATAPATH_ERROR when the
+// XDP router fails. cb is called from a single
+// background thread and should return quickly: a slow callback loses the
+// oldest events, as reported by the event's dropped field. user_data is
+// passed through unchanged.
+//
+//export go_register_event_callback
+func go_register_event_callback(cb C.enviro_event_callback, userData unsafe.Pointer) C.ffi_result {
+	registerEventCallback(defaultHandle, cb, userData)
+	return C.FFI_SUCCESS
+}
+
+// registerEventCallback registers cb for the events of the control plane
+// of handle
+func registerEventCallback(handle uint64, cb C.enviro_event_callback, userData unsafe.Pointer) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+
+	if cb == nil {
+		delete(eventCallbacks, handle)
+		return
+	}
+	eventCallbacks[handle] = eventCallback{cb: cb, userData: userData}
+}
+
+// go_set_log_level sets the level ("debug", "info", "warn" or "error") of
+// the current and any later control plane, until an init call sets
+// another.
+//
+//export go_set_log_level
+func go_set_log_level(level *C.char) C.ffi_result {
+	setLastError(nil)
+
+	l, err := logging.ParseLevel(C.GoString(level))
+	if err != nil {
+		return fail(fmt.Errorf("%w: %v", network.ErrInvalidConfig, err))
+	}
+	logLevel.Set(l)
+	return C.FFI_SUCCESS
+}
+
+// go_register_log_callback registers cb to receive the library's log
+// records instead of stderr; NULL unregisters it. cb is called with one
+// record at a time from whichever thread logs, so it should return
+// quickly and must not call the init or shutdown functions. user_data is
+// passed through unchanged.
+//
+//export go_register_log_callback
+func go_register_log_callback(cb C.enviro_log_callback, userData unsafe.Pointer) C.ffi_result {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	logCallback = cb
+	logUserData = userData
+	return C.FFI_SUCCESS
+}
+
+// go_register_runtime_callback registers cb to start and stop containers
+// for StartContainer and StopContainer; NULL unregisters it. cb is called
+// from gRPC handler threads, possibly concurrently for different
+// containers, and blocks the RPC until it returns. user_data is passed
+// through unchanged.
+//
+//export go_register_runtime_callback
+func go_register_runtime_callback(cb C.enviro_runtime_callback, userData unsafe.Pointer) C.ffi_result {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+
+	runtimeCallback = cb
+	runtimeUserData = userData
+	return C.FFI_SUCCESS
+}
+
+// ffiRuntime is the Runtime of the registered runtime callback
+type ffiRuntime struct{}
+
+// Start calls the runtime callback with "start"
+func (ffiRuntime) Start(ctx context.Context, id string) error {
+	return callRuntime(ctx, "start", id, 0)
+}
+
+// Stop calls the runtime callback with "stop"
+func (ffiRuntime) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	return callRuntime(ctx, "stop", id, timeout)
+}
+
+// callRuntime performs action on container id through the registered
+// runtime callback. The callback can't be interrupted, so ctx is only
+// checked before calling it.
+func callRuntime(ctx context.Context, action, id string, timeout time.Duration) error {
+	runtimeMu.Lock()
+	cb, userData := runtimeCallback, runtimeUserData
+	runtimeMu.Unlock()
+	if cb == nil {
+		return ErrNoRuntime
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	cAction := C.CString(action)
+	defer C.free(unsafe.Pointer(cAction))
+	cID := C.CString(id)
+	defer C.free(unsafe.Pointer(cID))
+	errBuf := (*C.char)(C.calloc(runtimeErrLen, 1))
+	defer C.free(unsafe.Pointer(errBuf))
+
+	res := C.call_runtime_callback(cb, cAction, cID, C.int(timeout.Milliseconds()), errBuf, runtimeErrLen-1, userData)
+	return runtimeResult(res, errBuf, fmt.Sprintf("failed to %s container %s", action, id))
+}
+
+// runtimeResult returns the error of a runtime or session callback that
+// returned res, described by errBuf or else by fallback
+func runtimeResult(res C.ffi_result, errBuf *C.char, fallback string) error {
+	if res == C.FFI_SUCCESS {
+		return nil
+	}
+	msg := C.GoString(errBuf)
+	if msg == "" {
+		msg = fallback
+	}
+	switch res {
+	case C.FFI_TIMEOUT:
+		return fmt.Errorf("%w: %s", ErrRuntimeTimeout, msg)
+	case C.FFI_INVALID_ARGUMENT:
+		return fmt.Errorf("%w: %s", ErrRuntimeRejected, msg)
+	default:
+		return errors.New(msg)
+	}
+}
+
+// go_register_session_callback registers cb to run the sessions of Exec
+// and Attach; NULL unregisters it, failing new sessions with
+// FAILED_PRECONDITION while open ones carry on. cb is called from gRPC
+// handler threads, concurrently for different sessions; for a single
+// session only ENVIRO_SESSION_CLOSE may overlap another call. Stdin calls
+// may block, which holds back the client's input. user_data is passed
+// through unchanged.
+//
+//export go_register_session_callback
+func go_register_session_callback(cb C.enviro_session_callback, userData unsafe.Pointer) C.ffi_result {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+
+	sessionCallback = cb
+	sessionUserData = userData
+	return C.FFI_SUCCESS
+}
+
+// go_session_output passes len bytes of data the process of session
+// session_id wrote to stream, ENVIRO_STREAM_STDOUT or
+// ENVIRO_STREAM_STDERR. It blocks while the client is behind and returns
+// FFI_ERROR once the client is gone, or FFI_INVALID_ARGUMENT for a
+// session that ended. Calls for one session must not overlap.
+//
+//export go_session_output
+func go_session_output(sessionID C.uint64_t, stream C.int, data *C.char, length C.size_t) C.ffi_result {
+	sessionMu.Lock()
+	s, ok := sessions[uint64(sessionID)]
+	sessionMu.Unlock()
+	if !ok {
+		return fail(errUnknownSession)
+	}
+
+	w := s.stdout
+	switch stream {
+	case C.ENVIRO_STREAM_STDOUT:
+	case C.ENVIRO_STREAM_STDERR:
+		w = s.stderr
+	default:
+		return fail(fmt.Errorf("%w %d", errUnknownStream, int(stream)))
+	}
+	if _, err := w.Write(C.GoBytes(unsafe.Pointer(data), C.int(length))); err != nil {
+		return fail(err)
+	}
+	return C.FFI_SUCCESS
+}
+
+// go_session_exit ends session session_id once its process exited with
+// exit_code and all of its output was passed to go_session_output. A
+// non-NULL error fails the session instead, e.g. when the runtime lost
+// the process. The session ID is unknown afterwards, and the callback
+// should ignore an ENVIRO_SESSION_CLOSE racing with the exit.
+//
+//export go_session_exit
+func go_session_exit(sessionID C.uint64_t, exitCode C.int, errMsg *C.char) C.ffi_result {
+	sessionMu.Lock()
+	s, ok := sessions[uint64(sessionID)]
+	delete(sessions, uint64(sessionID))
+	sessionMu.Unlock()
+	if !ok {
+		return fail(errUnknownSession)
+	}
+
+	s.code = int(exitCode)
+	if errMsg != nil {
+		s.err = errors.New(C.GoString(errMsg))
+	}
+	close(s.done)
+	return C.FFI_SUCCESS
+}
+
+// go_pull_image pulls the image of ref, e.g. "nginx:1.25", into the image
+// cache unless it is cached, waiting at most timeout_ms, and sets
+// *image_json to the JSON-encoded Image with the paths of its manifest,
+// config and layer blobs, which the caller releases with go_free_string.
+// Pulls of an image, through the FFI or the API, share one download. It
+// fails with FFI_INVALID_ARGUMENT for invalid references and FFI_TIMEOUT
+// when the pull takes longer.
+//
+//export go_pull_image
+func go_pull_image(ref *C.char, timeoutMs C.int, imageJSON **C.char) C.ffi_result {
+	return pullImage(defaultHandle, ref, timeoutMs, imageJSON)
+}
+
+// pullImage pulls ref into the image cache of the control plane of handle
+func pullImage(handle uint64, ref *C.char, timeoutMs C.int, imageJSON **C.char) C.ffi_result {
+	// The pull can take minutes, so it doesn't hold mu; shutting down
+	// cancels it
+	cp, err := lookupUnlocked(handle)
+	if err != nil {
+		return fail(err)
+	}
+	if cp.images == nil {
+		return fail(errImagesDisabled)
+	}
+	if ref == nil || imageJSON == nil {
+		return fail(fmt.Errorf("%w: ref and image_json must not be NULL", image.ErrInvalidReference))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+	img, err := cp.images.Pull(ctx, C.GoString(ref), image.PullIfMissing, nil)
+	if err != nil {
+		return fail(err)
+	}
+	data, err := protojson.Marshal(imageToProto(cp.images, img))
+	if err != nil {
+		return fail(err)
+	}
+	*imageJSON = C.CString(string(data))
+	return C.FFI_SUCCESS
+}
+
+// go_report_container_stats records the resource usage of a container,
+// a JSON-encoded ContainerStats such as {"container_id":"c1","cpu":
+// {"usage_usec":1500000},"memory":{"usage_bytes":10485760}}, for
+// runtimes that track it themselves. StatsService serves it rather than
+// reading the container's cgroup until it is older than the configured
+// stats.report_max_age, so the runtime should report at least as often.
+// Its network counters are ignored. It fails with FFI_INVALID_ARGUMENT
+// for invalid stats and unknown containers.
+//
+//export go_report_container_stats
+func go_report_container_stats(statsJSON *C.char) C.ffi_result {
+	return reportContainerStats(defaultHandle, statsJSON)
+}
+
+// reportContainerStats records stats with the control plane of handle
+func reportContainerStats(handle uint64, statsJSON *C.char) C.ffi_result {
+	cp, err := lookupUnlocked(handle)
+	if err != nil {
+		return fail(err)
+	}
+	if statsJSON == nil {
+		return fail(fmt.Errorf("%w: stats_json must not be NULL", errInvalidStats))
+	}
+	stats := &pb.ContainerStats{}
+	if err := protojson.Unmarshal([]byte(C.GoString(statsJSON)), stats); err != nil {
+		return fail(fmt.Errorf("%w: %v", errInvalidStats, err))
+	}
+	if err := cp.stats.report(stats); err != nil {
+		return fail(err)
+	}
+	return C.FFI_SUCCESS
+}
+
+// go_list_container_networks sets *out_json to the containers and their
+// networks as a JSON array of Container in the protobuf JSON mapping, as in
+// the ListContainers response, e.g. [{"id":"c1","ip":"10.88.0.2","state":
+// "CONTAINER_STATE_READY","hostInterface":"veth1a2b3c","mac":
+// "0a:58:0a:58:00:02","labels":{"app":"web"}}], and *out_len to its length.
+// The caller releases it with go_free_string. labels, a JSON object such as
+// {"app":"web"}, lists only the containers with all of them; NULL lists
+// every container. Called right after an init call it already reflects the
+// networks restored from the state dir and re-adopted, e.g. for the
+// runtime's crash recovery before it serves the API. It fails with
+// FFI_INVALID_ARGUMENT for invalid labels.
+//
+//export go_list_container_networks
+func go_list_container_networks(labels *C.char, outJSON **C.char, outLen *C.size_t) C.ffi_result {
+	return listContainerNetworks(defaultHandle, labels, outJSON, outLen)
+}
+
+// listContainerNetworks lists the containers of the control plane of
+// handle
+func listContainerNetworks(handle uint64, labels *C.char, outJSON **C.char, outLen *C.size_t) C.ffi_result {
+	cp, err := lookupUnlocked(handle)
+	if err != nil {
+		return fail(err)
+	}
+	if outJSON == nil || outLen == nil {
+		return fail(fmt.Errorf("%w: out_json and out_len", errNullArgument))
+	}
+	var filter string
+	if labels != nil {
+		filter = C.GoString(labels)
+	}
+	data, err := containerNetworksJSON(cp, filter)
+	if err != nil {
+		return fail(err)
+	}
+	*outJSON = C.CString(string(data))
+	*outLen = C.size_t(len(data))
+	return C.FFI_SUCCESS
+}
+
+// containerNetworksJSON returns the containers of cp with the labels of
+// the JSON object labels, all of them when it is empty, as the JSON array
+// go_list_container_networks returns
+func containerNetworksJSON(cp *ControlPlane, labels string) ([]byte, error) {
+	var filter map[string]string
+	if labels != "" {
+		if err := json.Unmarshal([]byte(labels), &filter); err != nil {
+			return nil, err
+		}
+	}
+	containers, err := cp.ContainerNetworks(filter)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]json.RawMessage, 0, len(containers))
+	for _, c := range containers {
+		raw, err := protojson.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, raw)
+	}
+	return json.Marshal(out)
+}
+
+// Exec runs a command through the session callback
+func (ffiRuntime) Exec(ctx context.Context, id string, opts ExecOptions, stdout, stderr io.Writer) (Session, error) {
+	return openFFISession(ctx, C.ENVIRO_SESSION_EXEC, struct {
+		ContainerID string `json:"container_id"`
+		ExecOptions
+	}{id, opts}, stdout, stderr)
+}
+
+// Attach attaches through the session callback
+func (ffiRuntime) Attach(ctx context.Context, id string, opts AttachOptions, stdout, stderr io.Writer) (Session, error) {
+	return openFFISession(ctx, C.ENVIRO_SESSION_ATTACH, struct {
+		ContainerID string `json:"container_id"`
+		AttachOptions
+	}{id, opts}, stdout, stderr)
+}
+
+// ffiSession is a session of the registered session callback. It keeps
+// the callback it was opened with.
+type ffiSession struct {
+	id       uint64
+	cb       C.enviro_session_callback
+	userData unsafe.Pointer
+	stdout   io.Writer
+	stderr   io.Writer
+
+	// done is closed by go_session_exit, with code or err set
+	done      chan struct{}
+	code      int
+	err       error
+	closeOnce sync.Once
+}
+
+// openFFISession opens a session with op, ENVIRO_SESSION_EXEC or
+// ENVIRO_SESSION_ATTACH, passing the callback options as JSON
+func openFFISession(ctx context.Context, op C.int, options any, stdout, stderr io.Writer) (*ffiSession, error) {
+	data, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sessionMu.Lock()
+	if sessionCallback == nil {
+		sessionMu.Unlock()
+		return nil, ErrNoSessions
+	}
+	lastSessionID++
+	s := &ffiSession{
+		id:       lastSessionID,
+		cb:       sessionCallback,
+		userData: sessionUserData,
+		stdout:   stdout,
+		stderr:   stderr,
+		done:     make(chan struct{}),
+	}
+	// Registered first, as output may come before the callback returns
+	sessions[s.id] = s
+	sessionMu.Unlock()
+
+	if err := s.call(op, data); err != nil {
+		sessionMu.Lock()
+		delete(sessions, s.id)
+		sessionMu.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// call passes op and data to the session callback
+func (s *ffiSession) call(op C.int, data []byte) error {
+	errBuf := (*C.char)(C.calloc(runtimeErrLen, 1))
+	defer C.free(unsafe.Pointer(errBuf))
+	var p *C.char
+	if len(data) > 0 {
+		p = (*C.char)(unsafe.Pointer(&data[0]))
+	}
+	res := C.call_session_callback(s.cb, C.uint64_t(s.id), op, p, C.size_t(len(data)), errBuf, runtimeErrLen-1, s.userData)
+	return runtimeResult(res, errBuf, fmt.Sprintf("session %d failed", s.id))
+}
+
+func (s *ffiSession) Write(p []byte) (int, error) {
+	if err := s.call(C.ENVIRO_SESSION_STDIN, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *ffiSession) CloseStdin() error {
+	return s.call(C.ENVIRO_SESSION_CLOSE_STDIN, nil)
+}
+
+func (s *ffiSession) Resize(size TerminalSize) error {
+	data, err := json.Marshal(size)
+	if err != nil {
+		return err
+	}
+	return s.call(C.ENVIRO_SESSION_RESIZE, data)
+}
+
+func (s *ffiSession) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-s.done:
+		return s.code, s.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Close tells the callback to end the session unless it exited, after
+// which its output is refused
+func (s *ffiSession) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		sessionMu.Lock()
+		_, open := sessions[s.id]
+		delete(sessions, s.id)
+		sessionMu.Unlock()
+		if open {
+			err = s.call(C.ENVIRO_SESSION_CLOSE, nil)
+		}
+	})
+	return err
+}
+
+// forwardEvents passes the events of cp to the callback registered for
+// handle until cp stops. Callers must hold mu.
+func forwardEvents(handle uint64, cp *ControlPlane) {
+	sub, _, err := cp.events.subscribe(0)
+	if err != nil {
+		cp.log.Error("Failed to subscribe to container events", "error", err)
+		return
+	}
+	go func() {
+		for ev := range sub.ch {
+			eventMu.Lock()
+			cb, ok := eventCallbacks[handle]
+			eventMu.Unlock()
+			if !ok {
+				continue
+			}
+
+			data, err := protojson.Marshal(sub.annotate(ev))
+			if err != nil {
+				cp.log.Error("Failed to encode container event", "error", err)
+				continue
+			}
+			cs := C.CString(string(data))
+			C.call_event_callback(cb.cb, cs, cb.userData)
+			C.free(unsafe.Pointer(cs))
+		}
+	}()
+}
+
+// newFFILogger creates a logger at logLevel passing records to the log
+// callback, or to stderr while none is registered
+func newFFILogger(stderr slog.Handler) *slog.Logger {
+	return logging.Fanout(logLevel, ffiLogHandler{stderr: stderr, callback: logging.NewCallbackHandler(callLog)})
+}
+
+// ffiLogHandler passes records to the log callback when one is registered
+type ffiLogHandler struct {
+	stderr, callback slog.Handler
+}
+
+func (h ffiLogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h ffiLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	logMu.Lock()
+	registered := logCallback != nil
+	logMu.Unlock()
+	if registered {
+		return h.callback.Handle(ctx, r)
+	}
+	return h.stderr.Handle(ctx, r)
+}
+
+func (h ffiLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ffiLogHandler{stderr: h.stderr.WithAttrs(attrs), callback: h.callback.WithAttrs(attrs)}
+}
+
+func (h ffiLogHandler) WithGroup(name string) slog.Handler {
+	return ffiLogHandler{stderr: h.stderr.WithGroup(name), callback: h.callback.WithGroup(name)}
+}
+
+// callLog passes a log record to the registered callback, if any
+func callLog(level slog.Level, record []byte) {
+	logMu.Lock()
+	cb, userData := logCallback, logUserData
+	logMu.Unlock()
+	if cb == nil {
+		return
+	}
+
+	cs := C.CString(string(record))
+	C.call_log_callback(cb, C.int(level), cs, userData)
+	C.free(unsafe.Pointer(cs))
+}
+
+// initFailed records err as the last error of an init call
+func initFailed(err error) C.ffi_result {
+	ffiLog.Error("Failed to initialize control plane", "error", err)
+	return fail(err)
+}
+
+// fail records err as the last error and returns its code
+func fail(err error) C.ffi_result {
+	setLastError(err)
+	return errorCode(err)
+}
+
+// errorCode returns the result code telling the host what kind of error
+// err is, FFI_ERROR for those without a code of their own
+func errorCode(err error) C.ffi_result {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return C.FFI_SUCCESS
+	case invalidConfig(err), errors.Is(err, errInvalidConfig), errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return C.FFI_INVALID_ARGUMENT
+	case errors.Is(err, syscall.EADDRINUSE):
+		return C.FFI_ADDRESS_IN_USE
+	case errors.Is(err, fs.ErrPermission):
+		return C.FFI_PERMISSION_DENIED
+	case errors.Is(err, errUnknownSession), errors.Is(err, errUnknownStream), errors.Is(err, image.ErrInvalidReference),
+		errors.Is(err, errInvalidStats), errors.Is(err, errNullArgument), errors.Is(err, errUnknownHandle),
+		errors.Is(err, errUnknownContainer):
+		return C.FFI_INVALID_ARGUMENT
+	case errors.Is(err, errAlreadyInitialized):
+		return C.FFI_ALREADY_INITIALIZED
+	case errors.Is(err, errNotInitialized):
+		return C.FFI_NOT_INITIALIZED
+	case errors.Is(err, network.ErrUnsupportedPlatform):
+		return C.FFI_UNSUPPORTED
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errNetworkNotReady):
+		return C.FFI_TIMEOUT
+	default:
+		return C.FFI_ERROR
+	}
+}
+
+func setLastError(err error) {
+	lastErrorMu.Lock()
+	defer lastErrorMu.Unlock()
+
+	lastError = ""
+	if err != nil {
+		lastError = err.Error()
+	}
+}
+
+// go_verify_container_network checks that the network of container_id
+// carries traffic, as the VerifyContainerNetwork RPC does, for runtimes
+// to hold back its entrypoint until then. It waits at most timeout_ms for
+// the network to become ready, the node's readiness timeout when 0 or
+// less, and sets *report_json to the JSON-encoded ReadinessReport, e.g.
+// {"ready":true,"checks":[{"name":"datapath","passed":true,"duration":
+// "0.000120s","attempts":1},...],"duration":"0.002s"}, which the caller
+// releases with go_free_string. It returns FFI_TIMEOUT, with the report
+// set, when a check still fails by then, and FFI_INVALID_ARGUMENT for
+// containers the control plane doesn't serve.
+//
+//export go_verify_container_network
+func go_verify_container_network(containerID *C.char, timeoutMs C.int, reportJSON **C.char) C.ffi_result {
+	return verifyContainerNetwork(defaultHandle, containerID, timeoutMs, reportJSON)
+}
+
+// verifyContainerNetwork verifies a container network with the control
+// plane of handle
+func verifyContainerNetwork(handle uint64, containerID *C.char, timeoutMs C.int, reportJSON **C.char) C.ffi_result {
+	// The checks take up to the timeout, so they don't hold mu
+	cp, err := lookupUnlocked(handle)
+	if err != nil {
+		return fail(err)
+	}
+	if containerID == nil || reportJSON == nil {
+		return fail(fmt.Errorf("%w: container_id and report_json", errNullArgument))
+	}
+	req := &pb.VerifyContainerNetworkRequest{Id: C.GoString(containerID)}
+	if timeoutMs > 0 {
+		req.Timeout = durationpb.New(time.Duration(timeoutMs) * time.Millisecond)
+	}
+	resp, err := cp.containers.VerifyContainerNetwork(context.Background(), req)
+	if err != nil {
+		if code := status.Code(err); code == codes.NotFound || code == codes.FailedPrecondition {
+			return fail(fmt.Errorf("%w: %s", errUnknownContainer, status.Convert(err).Message()))
+		}
+		return fail(err)
+	}
+	data, err := protojson.Marshal(resp.Report)
+	if err != nil {
+		return fail(err)
+	}
+	*reportJSON = C.CString(string(data))
+	for _, c := range resp.Report.Checks {
+		if !c.Passed {
+			return fail(fmt.Errorf("%w: %s: %s check: %s", errNetworkNotReady, req.Id, c.Name, c.Error))
+		}
+	}
+	return C.FFI_SUCCESS
+}
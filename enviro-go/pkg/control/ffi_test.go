@@ -0,0 +1,212 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func TestContainerNetworksJSON(t *testing.T) {
+	web := &pb.Container{
+		Id:            "web",
+		Ip:            "10.88.0.2",
+		Ipv6:          "fd00::2",
+		State:         pb.ContainerState_CONTAINER_STATE_READY,
+		HostInterface: "veth1a2b3c",
+		Mac:           "0a:58:0a:58:00:02",
+		Labels:        map[string]string{"app": "web", "tier": "front"},
+	}
+	db := &pb.Container{
+		Id:            "db",
+		Ip:            "10.88.0.3",
+		State:         pb.ContainerState_CONTAINER_STATE_RUNNING,
+		HostInterface: "veth4d5e6f",
+		Mac:           "0a:58:0a:58:00:03",
+		Labels:        map[string]string{"app": "db"},
+	}
+	cp := &ControlPlane{containers: &containerService{
+		containers: map[string]*pb.Container{web.Id: web, db.Id: db},
+	}}
+
+	tests := []struct {
+		name   string
+		labels string
+		want   []*pb.Container
+	}{
+		{name: "all", want: []*pb.Container{db, web}},
+		{name: "empty filter", labels: "{}", want: []*pb.Container{db, web}},
+		{name: "one label", labels: `{"app":"web"}`, want: []*pb.Container{web}},
+		{name: "all labels", labels: `{"app":"web","tier":"front"}`, want: []*pb.Container{web}},
+		{name: "label mismatch", labels: `{"app":"web","tier":"back"}`, want: []*pb.Container{}},
+		{name: "unknown label", labels: `{"zone":"a"}`, want: []*pb.Container{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := containerNetworksJSON(cp, tt.labels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The schema is an array of Container in the protobuf JSON
+			// mapping, whose unknown fields protojson rejects
+			var raw []json.RawMessage
+			if err := json.Unmarshal(data, &raw); err != nil {
+				t.Fatalf("not a JSON array: %v: %s", err, data)
+			}
+			if raw == nil {
+				t.Fatalf("null instead of an array: %s", data)
+			}
+			got := make([]*pb.Container, 0, len(raw))
+			for _, r := range raw {
+				c := &pb.Container{}
+				if err := protojson.Unmarshal(r, c); err != nil {
+					t.Fatalf("not a Container: %v: %s", err, r)
+				}
+				got = append(got, c)
+			}
+			if !slices.EqualFunc(got, tt.want, func(a, b *pb.Container) bool { return proto.Equal(a, b) }) {
+				t.Errorf("listed %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, labels := range []string{`{"app":`, `["app"]`, `{"app":1}`} {
+		if _, err := containerNetworksJSON(cp, labels); err == nil {
+			t.Errorf("labels %s accepted", labels)
+		}
+	}
+}
+
+// lastErrorMessage returns the message of go_get_last_error, false when it
+// returned NULL. Test files can't use cgo, so it reads the string itself.
+func lastErrorMessage() (string, bool) {
+	p := go_get_last_error()
+	if p == nil {
+		return "", false
+	}
+	defer go_free_string(p)
+	var msg []byte
+	for q := unsafe.Pointer(p); *(*byte)(q) != 0; q = unsafe.Add(q, 1) {
+		msg = append(msg, *(*byte)(q))
+	}
+	return string(msg), true
+}
+
+// TestInitShutdown initializes, shuts down and initializes the control
+// plane of the init exports again, with calls failing in between and the
+// error each leaves for go_get_last_error. The network is deferred, so
+// the datapath stays off the host.
+func TestInitShutdown(t *testing.T) {
+	config := func(socket string) string {
+		return fmt.Sprintf(`{"address":%q,"defer_network":true,"state_dir":%q,"log_level":"error"}`,
+			"unix://"+filepath.Join(t.TempDir(), socket), t.TempDir())
+	}
+	// Both inits use the same socket, which the shutdown must release
+	addr := config("enviro.sock")
+	success := errorCode(nil)
+
+	// check fails unless the call returned want and left an error
+	// containing msg, none if empty
+	check := func(step string, got, want any, msg string) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%s returned %v, want %v", step, got, want)
+		}
+		last, ok := lastErrorMessage()
+		if msg == "" && ok {
+			t.Errorf("%s left error %q, want none", step, last)
+		}
+		if msg != "" && !strings.Contains(last, msg) {
+			t.Errorf("%s left error %q, want %q", step, last, msg)
+		}
+	}
+
+	check("failed init", initWithConfig(`{"log_level":"loud"}`, ""), errorCode(errInvalidConfig), "loud")
+	if controlPlanes[defaultHandle] != nil {
+		t.Fatal("failed init registered a control plane")
+	}
+	check("shutdown before init", shutdownControlPlane(defaultHandle), errorCode(errNotInitialized), errNotInitialized.Error())
+
+	for _, step := range []string{"init", "init after shutdown"} {
+		check(step, initWithConfig(addr, ""), success, "")
+		check(step+" again", initWithConfig(config("other.sock"), ""), errorCode(errAlreadyInitialized), errAlreadyInitialized.Error())
+		check("shutdown", shutdownControlPlane(defaultHandle), success, "")
+		if controlPlanes[defaultHandle] != nil {
+			t.Fatal("shutdown left the control plane registered")
+		}
+	}
+	check("repeated shutdown", shutdownControlPlane(defaultHandle), errorCode(errNotInitialized), errNotInitialized.Error())
+}
+
+// TestInitUnbindable initializes the control plane on addresses it can't
+// listen on, with both the init returning right away and the blocking one
+func TestInitUnbindable(t *testing.T) {
+	modes := []struct {
+		name string
+		init func(addr string) any
+	}{
+		{name: "init", init: func(addr string) any { return initControlPlane(addr) }},
+		{name: "blocking init", init: func(addr string) any { return initControlPlaneBlocking(addr, time.Second) }},
+	}
+	addrs := []struct {
+		name string
+		addr string
+	}{
+		{name: "missing socket directory", addr: "unix://" + filepath.Join(t.TempDir(), "missing", "enviro.sock")},
+		{name: "invalid port", addr: "127.0.0.1:99999"},
+	}
+	for _, mode := range modes {
+		for _, tt := range addrs {
+			t.Run(mode.name+"/"+tt.name, func(t *testing.T) {
+				if got, want := mode.init(tt.addr), any(errorCode(errors.New("unbindable"))); got != want {
+					t.Errorf("returned %v, want %v", got, want)
+				}
+				msg, _ := lastErrorMessage()
+				if want := "failed to listen on " + tt.addr; !strings.HasPrefix(msg, want) {
+					t.Errorf("left error %q, want it to start with %q", msg, want)
+				}
+				if controlPlanes[defaultHandle] != nil {
+					t.Fatal("failed init registered a control plane")
+				}
+			})
+		}
+		// Nothing of the failed inits is left to keep the next from
+		// succeeding
+		socket := "unix://" + filepath.Join(t.TempDir(), "enviro.sock")
+		if got, want := mode.init(socket), any(errorCode(nil)); got != want {
+			msg, _ := lastErrorMessage()
+			t.Fatalf("%s on %s returned %v, want %v: %s", mode.name, socket, got, want, msg)
+		}
+		shutdownControlPlane(defaultHandle)
+	}
+}
+
+// TestInitInUse initializes the control plane on a port another listener
+// holds, which the host learns from the code and the last error
+func TestInitInUse(t *testing.T) {
+	addr := occupy(t).Addr().String()
+	if got, want := any(initControlPlane(addr)), any(errorCode(syscall.EADDRINUSE)); got != want {
+		t.Errorf("init on %s returned %v, want %v", addr, got, want)
+	}
+	msg, _ := lastErrorMessage()
+	if want := "failed to listen on " + addr + ": bind: address already in use"; !strings.HasPrefix(msg, want) {
+		t.Errorf("left error %q, want it to start with %q", msg, want)
+	}
+	if controlPlanes[defaultHandle] != nil {
+		shutdownControlPlane(defaultHandle)
+		t.Fatal("failed init registered a control plane")
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// gatewayCertHeader passes the common name of the verified client
+// certificate of an HTTP request on to the gRPC server, which only
+// trusts it from the gateway
+const gatewayCertHeader = "x-enviro-gateway-client-cn"
+
+// eventStreamType is the content type of server-sent events
+const eventStreamType = "text/event-stream"
+
+// gateway serves the API as JSON over HTTP, with the bindings of
+// pkg/api/v1/gateway.yaml. It calls the gRPC server over in-process
+// connections, so its requests pass the same interceptors as gRPC ones,
+// e.g. authentication and rate limiting.
+type gateway struct {
+	listener net.Listener
+	server   *http.Server
+	// pipe hands the gateway's connections to the gRPC server
+	pipe *pipeListener
+	conn *grpc.ClientConn
+	log  *slog.Logger
+}
+
+// newGateway binds address, serving HTTPS with tlsConfig when it is not
+// nil. Nothing is served until serve is called.
+func newGateway(address string, tlsConfig *tls.Config, server ServerConfig, logger *slog.Logger) (*gateway, error) {
+	pipe := newPipeListener()
+	maxMsgSize := server.MaxSendMsgSize
+	if maxMsgSize == 0 {
+		maxMsgSize = DefaultMaxMsgSize
+	}
+	conn, err := grpc.Dial("passthrough:///gateway",
+		grpc.WithContextDialer(pipe.dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgSize)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonpb := &runtime.JSONPb{
+		MarshalOptions:   protojson.MarshalOptions{EmitUnpopulated: true},
+		UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+	}
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, jsonpb),
+		runtime.WithMarshalerOption(eventStreamType, &eventStreamMarshaler{JSONPb: jsonpb}),
+		runtime.WithIncomingHeaderMatcher(gatewayIncomingHeader),
+		runtime.WithOutgoingHeaderMatcher(gatewayOutgoingHeader),
+		runtime.WithMetadata(gatewayMetadata),
+		runtime.WithHealthzEndpoint(healthpb.NewHealthClient(conn)),
+	)
+	ctx := context.Background()
+	if err := pb.RegisterContainerServiceHandler(ctx, mux, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := pb.RegisterNodeServiceHandler(ctx, mux, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := pb.RegisterChaosServiceHandler(ctx, mux, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := pb.RegisterImageServiceHandler(ctx, mux, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := pb.RegisterStatsServiceHandler(ctx, mux, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := pb.RegisterInfoServiceHandler(ctx, mux, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return &gateway{
+		listener: listener,
+		server:   &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		pipe:     pipe,
+		conn:     conn,
+		log:      logger,
+	}, nil
+}
+
+// serve runs the gateway until shutdown is called, passing its requests
+// to grpcServer
+func (g *gateway) serve(grpcServer *grpc.Server) {
+	go grpcServer.Serve(g.pipe)
+	g.log.Info("Serving REST gateway", "address", g.listener.Addr().String())
+	if err := g.server.Serve(g.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		g.log.Error("REST gateway error", "error", err)
+	}
+}
+
+// shutdown stops the gateway, waiting for requests in flight until ctx is
+// done
+func (g *gateway) shutdown(ctx context.Context) {
+	if err := g.server.Shutdown(ctx); err != nil {
+		g.server.Close()
+	}
+	g.conn.Close()
+	g.pipe.Close()
+}
+
+// gatewayIncomingHeader forwards the headers DefaultHeaderMatcher does,
+// except for the one the gateway sets itself
+func gatewayIncomingHeader(key string) (string, bool) {
+	key, ok := runtime.DefaultHeaderMatcher(key)
+	if !ok || strings.EqualFold(key, gatewayCertHeader) {
+		return "", false
+	}
+	return key, true
+}
+
+// gatewayOutgoingHeader returns the retry-after and request ID headers as
+// the HTTP headers of the same name, and the others prefixed with
+// Grpc-Metadata- as usual
+func gatewayOutgoingHeader(key string) (string, bool) {
+	switch key {
+	case retryAfterHeader, requestIDHeader:
+		return key, true
+	}
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// gatewayMetadata passes on the verified client certificate of r
+func gatewayMetadata(_ context.Context, r *http.Request) metadata.MD {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return metadata.Pairs(gatewayCertHeader, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+}
+
+// fromGateway reports whether the request of ctx came through the gateway
+func fromGateway(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	_, ok = p.Addr.(gatewayAddr)
+	return ok
+}
+
+// verifiedCommonName returns the common name of the verified client
+// certificate of the caller of ctx, which gateway requests pass in
+// metadata
+func verifiedCommonName(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	if _, ok := p.Addr.(gatewayAddr); ok {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if cns := md.Get(gatewayCertHeader); len(cns) > 0 {
+			return cns[0], true
+		}
+		return "", false
+	}
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+		return tlsInfo.State.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	return "", false
+}
+
+// clientAddress returns the IP address of the caller of ctx, which the
+// gateway appends to X-Forwarded-For
+func clientAddress(ctx context.Context) string {
+	if fromGateway(ctx) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if fwd := md.Get("x-forwarded-for"); len(fwd) > 0 {
+			hops := strings.Split(fwd[len(fwd)-1], ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+		return ""
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// eventStreamMarshaler writes server streams as server-sent events, one
+// data line of JSON per message
+type eventStreamMarshaler struct {
+	*runtime.JSONPb
+}
+
+func (m *eventStreamMarshaler) Marshal(v any) ([]byte, error) {
+	data, err := m.JSONPb.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("data: "), data...), nil
+}
+
+func (m *eventStreamMarshaler) ContentType(any) string {
+	return eventStreamType
+}
+
+func (m *eventStreamMarshaler) Delimiter() []byte {
+	return []byte("\n\n")
+}
+
+// gatewayCredentials wraps the TLS credentials of the gRPC server so the
+// gateway's in-process connections skip the handshake; the gateway
+// terminates TLS itself
+type gatewayCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (c gatewayCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if _, ok := conn.RemoteAddr().(gatewayAddr); ok {
+		return conn, gatewayAuthInfo{}, nil
+	}
+	return c.TransportCredentials.ServerHandshake(conn)
+}
+
+func (c gatewayCredentials) Clone() credentials.TransportCredentials {
+	return gatewayCredentials{c.TransportCredentials.Clone()}
+}
+
+type gatewayAuthInfo struct {
+	credentials.CommonAuthInfo
+}
+
+func (gatewayAuthInfo) AuthType() string { return "gateway" }
+
+// pipeListener hands out in-process connections to the gRPC server
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return gatewayAddr{}
+}
+
+// dial connects to the gRPC server serving l
+func (l *pipeListener) dial(ctx context.Context, _ string) (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- gatewayConn{server}:
+		return client, nil
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	server.Close()
+	client.Close()
+	return nil, fmt.Errorf("gateway connection: %w", net.ErrClosed)
+}
+
+// gatewayConn is the server end of an in-process connection, marked by
+// its remote address
+type gatewayConn struct {
+	net.Conn
+}
+
+func (gatewayConn) RemoteAddr() net.Addr {
+	return gatewayAddr{}
+}
+
+type gatewayAddr struct{}
+
+func (gatewayAddr) Network() string { return "gateway" }
+func (gatewayAddr) String() string  { return "gateway" }
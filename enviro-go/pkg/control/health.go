@@ -0,0 +1,142 @@
+package main
+
+import (
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// healthServices are the services reported individually by the health
+// service, in addition to the overall "" entry.
+var healthServices = []string{
+	"",
+	pb.ContainerService_ServiceDesc.ServiceName,
+	pb.NodeService_ServiceDesc.ServiceName,
+}
+
+// Components reported by the health service, SERVING while the control
+// plane serves and the component works
+const (
+	// DatapathHealthService is the datapath: the XDP router attached when
+	// XDP is enabled, kernel routing otherwise
+	DatapathHealthService = "enviro.api.Datapath"
+	// IPAMHealthService has every address pool able to address another
+	// container
+	IPAMHealthService = "enviro.api.IPAM"
+	// RoutingHealthService has no network of the host overlapping the
+	// container networks or service CIDRs, see network.CIDROverlaps
+	RoutingHealthService = "enviro.api.Routing"
+	// StorageHealthService has the last write to StateDir succeed, and is
+	// always SERVING without one
+	StorageHealthService = "enviro.api.Storage"
+)
+
+// componentHealthInterval is how often the components are checked
+const componentHealthInterval = 5 * time.Second
+
+// SetServing marks the control plane and its services ready
+func (cp *ControlPlane) SetServing() {
+	cp.setHealth(healthpb.HealthCheckResponse_SERVING)
+}
+
+// SetNotServing marks the control plane and its services not ready, e.g.
+// during startup or drain
+func (cp *ControlPlane) SetNotServing() {
+	cp.setHealth(healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+// SetServiceStatus sets the health of a single service
+func (cp *ControlPlane) SetServiceStatus(service string, serving bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	cp.health.SetServingStatus(service, status)
+}
+
+// setHealth reports status for the control plane and its services, which
+// are NOT_SERVING regardless until the network is initialized
+func (cp *ControlPlane) setHealth(status healthpb.HealthCheckResponse_ServingStatus) {
+	cp.serving.Store(status == healthpb.HealthCheckResponse_SERVING)
+	if !cp.network.Initialized() {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for _, service := range healthServices {
+		cp.health.SetServingStatus(service, status)
+	}
+	cp.setLeaderHealth()
+	cp.setComponentHealth()
+}
+
+// updateHealth reports the health again, e.g. once the network is
+// initialized
+func (cp *ControlPlane) updateHealth() {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if cp.serving.Load() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	cp.setHealth(status)
+}
+
+// setComponentHealth reports the health of each component. The network
+// manager itself needs no entry, as the services are NOT_SERVING without.
+func (cp *ControlPlane) setComponentHealth() {
+	serving := cp.serving.Load() && cp.network.Initialized()
+	// XDPError is only set when XDP is enabled but not attached
+	cp.SetServiceStatus(DatapathHealthService, serving && cp.network.Capabilities().XDPError == "")
+
+	ipam := serving
+	for _, pool := range cp.network.PoolUsage() {
+		if uint64(pool.Allocated) >= pool.Size {
+			ipam = false
+		}
+	}
+	cp.SetServiceStatus(IPAMHealthService, ipam)
+	cp.SetServiceStatus(RoutingHealthService, serving && len(cp.network.CIDROverlaps()) == 0)
+	cp.SetServiceStatus(StorageHealthService, cp.serving.Load() && (cp.store == nil || !cp.store.Stats().Failing))
+}
+
+// watchComponents updates the health of the components until Stop, and
+// reports the datapath failing to watchers
+func (cp *ControlPlane) watchComponents() {
+	t := time.NewTicker(componentHealthInterval)
+	defer t.Stop()
+	var datapathErr string
+	for {
+		select {
+		case <-cp.stopped:
+			return
+		case <-t.C:
+		}
+		cp.setComponentHealth()
+
+		// XDPError changes when the router is reattached to a recreated
+		// interface
+		if err := cp.network.Capabilities().XDPError; err != datapathErr {
+			datapathErr = err
+			if err != "" {
+				cp.events.publish(&pb.ContainerEvent{
+					Type:      pb.ContainerEventType_CONTAINER_EVENT_TYPE_DATAPATH_ERROR,
+					Timestamp: timestamppb.Now(),
+					Error:     err,
+				})
+			}
+		}
+	}
+}
+
+// setLeaderHealth reports LeaderHealthService SERVING while serving and
+// leading
+func (cp *ControlPlane) setLeaderHealth() {
+	if cp.leadership == nil {
+		return
+	}
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if _, leading := cp.leadership.current(); leading && cp.serving.Load() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	cp.health.SetServingStatus(LeaderHealthService, status)
+}
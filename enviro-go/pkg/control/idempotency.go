@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// idempotencyTTL is how long a successful create is replayed for its key
+const idempotencyTTL = 10 * time.Minute
+
+// idempotencyCache replays CreateContainer results for requests carrying
+// the same idempotency key. Failed creates roll back completely, so their
+// keys are forgotten and a retry runs again.
+type idempotencyCache struct {
+	mu    sync.Mutex
+	calls map[string]*idempotentCall
+}
+
+// idempotentCall is a create in progress or its result
+type idempotentCall struct {
+	// request is the request the key was first used with, without the key
+	request     []byte
+	containerID string
+	// done is closed once resp or err is set
+	done    chan struct{}
+	resp    *pb.CreateContainerResponse
+	err     error
+	expires time.Time
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{calls: make(map[string]*idempotentCall)}
+}
+
+// begin returns the call for the key of req. When owner is true the
+// caller runs the request and must pass its result to finish; otherwise
+// it waits on call.done for the original's result.
+func (c *idempotencyCache) begin(req *pb.CreateContainerRequest) (call *idempotentCall, owner bool, err error) {
+	fingerprint, err := requestFingerprint(req)
+	if err != nil {
+		return nil, false, status.Errorf(codes.Internal, "failed to fingerprint request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, call := range c.calls {
+		if call.resp != nil && now.After(call.expires) {
+			delete(c.calls, key)
+		}
+	}
+
+	if call, ok := c.calls[req.IdempotencyKey]; ok {
+		if !bytes.Equal(call.request, fingerprint) {
+			return nil, false, status.Error(codes.InvalidArgument, "idempotency key was used with a different request")
+		}
+		return call, false, nil
+	}
+	call = &idempotentCall{request: fingerprint, containerID: req.Id, done: make(chan struct{})}
+	c.calls[req.IdempotencyKey] = call
+	return call, true, nil
+}
+
+// finish records the result of the call started under key
+func (c *idempotencyCache) finish(key string, call *idempotentCall, resp *pb.CreateContainerResponse, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	call.resp, call.err = resp, err
+	call.expires = time.Now().Add(idempotencyTTL)
+	if err != nil {
+		delete(c.calls, key)
+	}
+	close(call.done)
+}
+
+// forget drops the keys of a deleted container, so a stale key doesn't
+// replay a container that no longer exists
+func (c *idempotencyCache) forget(containerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, call := range c.calls {
+		if call.containerID == containerID {
+			select {
+			case <-call.done:
+				delete(c.calls, key)
+			default:
+			}
+		}
+	}
+}
+
+// requestFingerprint serializes req without its idempotency key
+func requestFingerprint(req *pb.CreateContainerRequest) ([]byte, error) {
+	req = proto.Clone(req).(*pb.CreateContainerRequest)
+	req.IdempotencyKey = ""
+	return proto.MarshalOptions{Deterministic: true}.Marshal(req)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	req := &pb.CreateContainerRequest{Id: "c1", Name: "web", IdempotencyKey: "k1"}
+	resp := &pb.CreateContainerResponse{Container: &pb.Container{Id: "c1", Ip: "10.0.0.2"}}
+
+	t.Run("replay", func(t *testing.T) {
+		c := newIdempotencyCache()
+		call, owner, err := c.begin(req)
+		if err != nil || !owner {
+			t.Fatalf("begin() = %v, %v, want the owner", owner, err)
+		}
+		// A retry while the create runs waits for its result
+		waiting, owner, err := c.begin(req)
+		if err != nil || owner || waiting != call {
+			t.Fatalf("begin() while running = %v, %v, want to wait on the call", owner, err)
+		}
+		select {
+		case <-waiting.done:
+			t.Fatal("call done before finish")
+		default:
+		}
+		c.finish(req.IdempotencyKey, call, resp, nil)
+		<-waiting.done
+		if waiting.resp != resp || waiting.err != nil {
+			t.Errorf("waiting call got %v, %v, want %v", waiting.resp, waiting.err, resp)
+		}
+
+		replayed, owner, err := c.begin(req)
+		if err != nil || owner || replayed.resp != resp {
+			t.Errorf("begin() after finish = %v, %v, %v, want %v replayed", replayed.resp, owner, err, resp)
+		}
+		// A different key is a different call
+		other := &pb.CreateContainerRequest{Id: "c1", Name: "web", IdempotencyKey: "k2"}
+		if _, owner, err := c.begin(other); err != nil || !owner {
+			t.Errorf("begin() with another key = %v, %v, want the owner", owner, err)
+		}
+	})
+
+	t.Run("key mismatch", func(t *testing.T) {
+		c := newIdempotencyCache()
+		call, _, err := c.begin(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.finish(req.IdempotencyKey, call, resp, nil)
+		tests := []struct {
+			name string
+			req  *pb.CreateContainerRequest
+		}{
+			{name: "other ID", req: &pb.CreateContainerRequest{Id: "c2", Name: "web", IdempotencyKey: "k1"}},
+			{name: "other name", req: &pb.CreateContainerRequest{Id: "c1", Name: "db", IdempotencyKey: "k1"}},
+			{name: "added field", req: &pb.CreateContainerRequest{Id: "c1", Name: "web", IdempotencyKey: "k1", RequestedIp: "10.0.0.9"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, _, err := c.begin(tt.req)
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("begin() = %v, want %v", err, codes.InvalidArgument)
+				}
+			})
+		}
+	})
+
+	t.Run("failure forgotten", func(t *testing.T) {
+		c := newIdempotencyCache()
+		call, _, err := c.begin(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.finish(req.IdempotencyKey, call, nil, errors.New("create failed"))
+		if _, owner, err := c.begin(req); err != nil || !owner {
+			t.Errorf("begin() after a failure = %v, %v, want to run again", owner, err)
+		}
+	})
+
+	t.Run("forget", func(t *testing.T) {
+		c := newIdempotencyCache()
+		call, _, err := c.begin(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Calls still running are kept
+		c.forget("c1")
+		if _, owner, _ := c.begin(req); owner {
+			t.Error("forget() dropped a running call")
+		}
+		c.finish(req.IdempotencyKey, call, resp, nil)
+		c.forget("c1")
+		if _, owner, err := c.begin(req); err != nil || !owner {
+			t.Errorf("begin() after forget = %v, %v, want to run again", owner, err)
+		}
+	})
+}
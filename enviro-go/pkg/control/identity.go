@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// DefaultIdentityGCPeriod is how long an identity without holders is kept
+// unless configured otherwise
+const DefaultIdentityGCPeriod = 10 * time.Minute
+
+// identityCollectInterval is how often identities without holders are
+// checked for collection, or the GC period when shorter
+const identityCollectInterval = time.Minute
+
+// identityHistorySize is the number of latest changes kept for watches
+// resuming after a revision
+const identityHistorySize = 1024
+
+// identityFileName is the state file identities are kept in without Raft,
+// which replicates them instead
+const identityFileName = "identities.json"
+
+// identityVersion is bumped on incompatible changes to the identity file
+const identityVersion = 1
+
+// firstIdentity is the number of the first identity; 0 is none
+const firstIdentity = 1
+
+// Errors of the identity allocator
+var (
+	errInvalidIdentity     = errors.New("invalid identity request")
+	errIdentityNotFound    = errors.New("identity not found")
+	errIdentitiesExhausted = errors.New("identity numbers exhausted")
+)
+
+// IdentityConfig tunes the numeric identities of label sets, which
+// AllocateIdentity hands out. With Raft they are replicated and the same
+// on every control plane; otherwise the leader keeps them in its state
+// dir.
+type IdentityConfig struct {
+	// GCPeriod is how long an identity is kept after its last holder
+	// released it, so a container recreated with the same labels gets it
+	// back, DefaultIdentityGCPeriod when zero
+	GCPeriod time.Duration `json:"gc_period"`
+}
+
+func (c IdentityConfig) validate() error {
+	if c.GCPeriod < 0 {
+		return errors.New("gc_period must not be negative")
+	}
+	return nil
+}
+
+// identityRecord is an identity of the table. Records are replaced on
+// change, never modified.
+type identityRecord struct {
+	ID     uint32            `json:"id"`
+	Labels map[string]string `json:"labels"`
+	// Holders are ordered
+	Holders []string `json:"holders,omitempty"`
+	// ReleasedAt is set while the identity has no holders
+	ReleasedAt time.Time `json:"released_at"`
+	Revision   uint64    `json:"revision"`
+}
+
+func (r *identityRecord) proto() *pb.Identity {
+	out := &pb.Identity{
+		Id:       r.ID,
+		Labels:   maps.Clone(r.Labels),
+		Holders:  slices.Clone(r.Holders),
+		Revision: r.Revision,
+	}
+	if !r.ReleasedAt.IsZero() {
+		out.ReleasedAt = timestamppb.New(r.ReleasedAt)
+	}
+	return out
+}
+
+// identityChange is a change to the table, as replicated: Identity is put,
+// or deleted with Delete. Its revision is assigned when applied.
+type identityChange struct {
+	Identity identityRecord `json:"identity"`
+	Delete   bool           `json:"delete,omitempty"`
+}
+
+// identityState is the table as saved and replicated
+type identityState struct {
+	// Next is the number of the next identity. It only grows, so numbers
+	// are never reused.
+	Next       uint32                     `json:"next"`
+	Revision   uint64                     `json:"revision"`
+	Identities map[uint32]*identityRecord `json:"identities"`
+}
+
+func newIdentityState() identityState {
+	return identityState{Next: firstIdentity, Identities: make(map[uint32]*identityRecord)}
+}
+
+// clone returns a copy of s sharing its records
+func (s identityState) clone() identityState {
+	s.Identities = maps.Clone(s.Identities)
+	return s
+}
+
+// apply makes change at the next revision, returning the record put or
+// deleted
+func (s *identityState) apply(change identityChange) *identityRecord {
+	s.Revision++
+	rec := change.Identity
+	rec.Revision = s.Revision
+	if change.Delete {
+		delete(s.Identities, rec.ID)
+		return &rec
+	}
+	s.Identities[rec.ID] = &rec
+	if rec.ID >= s.Next {
+		s.Next = rec.ID + 1
+	}
+	return &rec
+}
+
+// labelsKey identifies a label set in the table
+func labelsKey(labels map[string]string) string {
+	// Maps encode with sorted keys
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
+
+// identityTable holds the identities of label sets and their latest
+// changes for watches. With Raft it is part of the replicated state.
+type identityTable struct {
+	mu       sync.Mutex
+	state    identityState
+	byLabels map[string]uint32
+	// history holds the events of the latest changes, oldest first
+	history []*pb.IdentityEvent
+	// changed is closed and replaced on every change
+	changed chan struct{}
+}
+
+func newIdentityTable() *identityTable {
+	return &identityTable{
+		state:    newIdentityState(),
+		byLabels: make(map[string]uint32),
+		changed:  make(chan struct{}),
+	}
+}
+
+// apply makes change and tells the watches
+func (t *identityTable) apply(change identityChange) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rec := t.state.apply(change)
+	ev := &pb.IdentityEvent{Type: pb.IdentityEventType_IDENTITY_EVENT_TYPE_PUT, Revision: rec.Revision, Identity: rec.proto()}
+	if change.Delete {
+		ev.Type = pb.IdentityEventType_IDENTITY_EVENT_TYPE_DELETE
+		delete(t.byLabels, labelsKey(rec.Labels))
+	} else {
+		t.byLabels[labelsKey(rec.Labels)] = rec.ID
+	}
+	if len(t.history) == identityHistorySize {
+		copy(t.history, t.history[1:])
+		t.history = t.history[:len(t.history)-1]
+	}
+	t.history = append(t.history, ev)
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// restore replaces the table with state. Watches start over from the
+// whole table.
+func (t *identityTable) restore(state identityState) {
+	if state.Identities == nil {
+		state.Identities = make(map[uint32]*identityRecord)
+	}
+	state.Next = max(state.Next, firstIdentity)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state = state
+	t.byLabels = make(map[string]uint32, len(state.Identities))
+	for id, rec := range state.Identities {
+		t.byLabels[labelsKey(rec.Labels)] = id
+	}
+	t.history = nil
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// snapshot returns a copy of the state
+func (t *identityTable) snapshot() identityState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state.clone()
+}
+
+// lookup returns the identity of labels
+func (t *identityTable) lookup(labels map[string]string) (*identityRecord, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id, ok := t.byLabels[labelsKey(labels)]
+	if !ok {
+		return nil, false
+	}
+	return t.state.Identities[id], true
+}
+
+// get returns identity id
+func (t *identityTable) get(id uint32) (*identityRecord, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rec, ok := t.state.Identities[id]
+	return rec, ok
+}
+
+// nextID returns the number the next identity gets, false once they are
+// exhausted
+func (t *identityTable) nextID() (uint32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state.Next, t.state.Next < math.MaxUint32
+}
+
+// list returns the identities ordered by number and the revision of the
+// table
+func (t *identityTable) list() ([]*identityRecord, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.listLocked(), t.state.Revision
+}
+
+func (t *identityTable) listLocked() []*identityRecord {
+	out := make([]*identityRecord, 0, len(t.state.Identities))
+	for _, rec := range t.state.Identities {
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// watch returns the events after revision after, and a channel closed on
+// the next change. When the changes after it are no longer retained, or
+// for 0, the events are a RESET followed by the whole table.
+func (t *identityTable) watch(after uint64) ([]*pb.IdentityEvent, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rev := t.state.Revision
+	if after != 0 && after <= rev && rev-after <= uint64(len(t.history)) {
+		return slices.Clone(t.history[len(t.history)-int(rev-after):]), t.changed
+	}
+	events := []*pb.IdentityEvent{{Type: pb.IdentityEventType_IDENTITY_EVENT_TYPE_RESET, Revision: rev}}
+	for _, rec := range t.listLocked() {
+		events = append(events, &pb.IdentityEvent{Type: pb.IdentityEventType_IDENTITY_EVENT_TYPE_PUT, Revision: rev, Identity: rec.proto()})
+	}
+	return events, t.changed
+}
+
+// identityFile is the content of identityFileName
+type identityFile struct {
+	Version int `json:"version"`
+	identityState
+}
+
+// loadIdentities returns the identities saved in store, nil if none was
+// allocated yet
+func loadIdentities(store *storage.Store) (*identityState, error) {
+	data, err := store.Read(identityFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identities: %w", err)
+	}
+	var file identityFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", storage.ErrCorrupt, identityFileName, err)
+	}
+	if file.Version != identityVersion {
+		return nil, fmt.Errorf("identities %s have unsupported version %d", identityFileName, file.Version)
+	}
+	return &file.identityState, nil
+}
+
+// saveIdentities persists state to store
+func saveIdentities(store *storage.Store, state identityState) error {
+	data, err := json.Marshal(identityFile{Version: identityVersion, identityState: state})
+	if err != nil {
+		return err
+	}
+	return store.Write(identityFileName, data)
+}
+
+// identityAllocator hands out the identities of label sets. Changes are
+// serialized, so concurrent allocations of a label set get the same
+// identity, and committed before they are returned: replicated with Raft,
+// else saved to the state dir.
+type identityAllocator struct {
+	table *identityTable
+	// commit makes a change to the table durably
+	commit func(identityChange) error
+	// barrier waits for the table to hold every committed change, nil
+	// when it always does
+	barrier  func() error
+	gcPeriod time.Duration
+	// active reports whether to collect identities: while leading
+	active func() bool
+	log    *slog.Logger
+
+	mu sync.Mutex
+}
+
+// newIdentityAllocator returns an allocator of the identities replicated
+// by cluster, or else of those saved in store, if any, starting from saved
+func newIdentityAllocator(config IdentityConfig, cluster *raftCluster, store *storage.Store, saved *identityState, logger *slog.Logger) *identityAllocator {
+	if config.GCPeriod == 0 {
+		config.GCPeriod = DefaultIdentityGCPeriod
+	}
+	a := &identityAllocator{gcPeriod: config.GCPeriod, active: func() bool { return true }, log: logger}
+	if cluster != nil {
+		a.table, a.commit, a.barrier = cluster.fsm.identities, cluster.applyIdentity, cluster.barrier
+		return a
+	}
+	a.table = newIdentityTable()
+	if saved != nil {
+		a.table.restore(*saved)
+	}
+	a.commit = func(change identityChange) error {
+		if store != nil {
+			state := a.table.snapshot()
+			state.apply(change)
+			if err := saveIdentities(store, state); err != nil {
+				return err
+			}
+		}
+		a.table.apply(change)
+		return nil
+	}
+	return a
+}
+
+// sync waits for the table to hold every committed change, e.g. those of
+// the previous leader. Callers must hold a.mu.
+func (a *identityAllocator) sync() error {
+	if a.barrier == nil {
+		return nil
+	}
+	return a.barrier()
+}
+
+// put commits rec, returning it as in the table
+func (a *identityAllocator) put(rec identityRecord) (*identityRecord, error) {
+	if err := a.commit(identityChange{Identity: rec}); err != nil {
+		return nil, err
+	}
+	got, ok := a.table.get(rec.ID)
+	if !ok {
+		return nil, fmt.Errorf("identity %d not applied", rec.ID)
+	}
+	return got, nil
+}
+
+// allocate returns the identity of labels referenced by holder, assigning
+// a new one for unknown labels
+func (a *identityAllocator) allocate(labels map[string]string, holder string) (*identityRecord, error) {
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("%w: labels are required", errInvalidIdentity)
+	}
+	if _, ok := labels[""]; ok {
+		return nil, fmt.Errorf("%w: label names must not be empty", errInvalidIdentity)
+	}
+	if holder == "" {
+		return nil, fmt.Errorf("%w: holder is required", errInvalidIdentity)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.sync(); err != nil {
+		return nil, err
+	}
+	if rec, ok := a.table.lookup(labels); ok {
+		if _, found := slices.BinarySearch(rec.Holders, holder); found {
+			return rec, nil
+		}
+		next := *rec
+		next.Holders = append(slices.Clone(rec.Holders), holder)
+		sort.Strings(next.Holders)
+		next.ReleasedAt = time.Time{}
+		return a.put(next)
+	}
+	id, ok := a.table.nextID()
+	if !ok {
+		return nil, errIdentitiesExhausted
+	}
+	rec, err := a.put(identityRecord{ID: id, Labels: maps.Clone(labels), Holders: []string{holder}})
+	if err != nil {
+		return nil, err
+	}
+	a.log.Info("Allocated identity", "identity", id, "labels", labels, "holder", holder)
+	return rec, nil
+}
+
+// release drops the reference of holder to identity id. Once it has no
+// holders the identity is collected after the GC period.
+func (a *identityAllocator) release(id uint32, holder string, now time.Time) (*identityRecord, error) {
+	if holder == "" {
+		return nil, fmt.Errorf("%w: holder is required", errInvalidIdentity)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.sync(); err != nil {
+		return nil, err
+	}
+	rec, ok := a.table.get(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", errIdentityNotFound, id)
+	}
+	i, found := slices.BinarySearch(rec.Holders, holder)
+	if !found {
+		return rec, nil
+	}
+	next := *rec
+	next.Holders = slices.Delete(slices.Clone(rec.Holders), i, i+1)
+	if len(next.Holders) == 0 {
+		next.Holders = nil
+		next.ReleasedAt = now.UTC()
+	}
+	return a.put(next)
+}
+
+// collect deletes the identities released at least the GC period before
+// now, returning how many
+func (a *identityAllocator) collect(now time.Time) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.sync(); err != nil {
+		return 0, err
+	}
+	recs, _ := a.table.list()
+	collected := 0
+	for _, rec := range recs {
+		if len(rec.Holders) > 0 || rec.ReleasedAt.IsZero() || now.Sub(rec.ReleasedAt) < a.gcPeriod {
+			continue
+		}
+		if err := a.commit(identityChange{Identity: *rec, Delete: true}); err != nil {
+			return collected, err
+		}
+		collected++
+		a.log.Info("Collected identity", "identity", rec.ID, "labels", rec.Labels)
+	}
+	return collected, nil
+}
+
+// run collects the identities released a GC period ago while active,
+// until stop is closed
+func (a *identityAllocator) run(stop <-chan struct{}) {
+	t := time.NewTicker(min(a.gcPeriod, identityCollectInterval))
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			if !a.active() {
+				continue
+			}
+			if _, err := a.collect(now); err != nil {
+				a.log.Warn("Failed to collect identities", "error", err)
+			}
+		}
+	}
+}
+
+// identityError converts an error of the allocator to a status
+func identityError(err error) error {
+	switch {
+	case errors.Is(err, errInvalidIdentity):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errIdentityNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errIdentitiesExhausted):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Errorf(codes.Unavailable, "failed to commit identity: %v", err)
+	}
+}
+
+// AllocateIdentity returns the identity of a label set for a holder
+func (s *nodeService) AllocateIdentity(ctx context.Context, req *pb.AllocateIdentityRequest) (*pb.AllocateIdentityResponse, error) {
+	rec, err := s.identities.allocate(req.GetLabels(), req.GetHolder())
+	if err != nil {
+		return nil, identityError(err)
+	}
+	return &pb.AllocateIdentityResponse{Identity: rec.proto()}, nil
+}
+
+// ReleaseIdentity drops the reference of a holder to an identity
+func (s *nodeService) ReleaseIdentity(ctx context.Context, req *pb.ReleaseIdentityRequest) (*pb.ReleaseIdentityResponse, error) {
+	rec, err := s.identities.release(req.GetId(), req.GetHolder(), time.Now())
+	if err != nil {
+		return nil, identityError(err)
+	}
+	return &pb.ReleaseIdentityResponse{Identity: rec.proto()}, nil
+}
+
+// ListIdentities returns the identities ordered by number
+func (s *nodeService) ListIdentities(ctx context.Context, req *pb.ListIdentitiesRequest) (*pb.ListIdentitiesResponse, error) {
+	recs, revision := s.identities.table.list()
+	resp := &pb.ListIdentitiesResponse{Identities: make([]*pb.Identity, 0, len(recs)), Revision: revision}
+	for _, rec := range recs {
+		resp.Identities = append(resp.Identities, rec.proto())
+	}
+	return resp, nil
+}
+
+// WatchIdentities streams the changes to the identities after a revision
+func (s *nodeService) WatchIdentities(req *pb.WatchIdentitiesRequest, stream pb.NodeService_WatchIdentitiesServer) error {
+	// Tell clients the stream is established, even before any change
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	after := req.GetAfterRevision()
+	for {
+		events, changed := s.identities.table.watch(after)
+		for _, ev := range events {
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+			after = ev.Revision
+		}
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-s.events.done:
+			return status.Error(codes.Unavailable, "control plane shutting down")
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/client"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// replicatedAllocator returns an allocator committing to fsm as the Raft
+// leader would, without replicating
+func replicatedAllocator(t *testing.T, fsm *replicatedState, gcPeriod time.Duration) *identityAllocator {
+	t.Helper()
+	a := newIdentityAllocator(IdentityConfig{GCPeriod: gcPeriod}, nil, nil, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	a.table = fsm.identities
+	a.commit = func(change identityChange) error {
+		value, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(raftCommand{Op: opIdentity, Value: value})
+		if err != nil {
+			return err
+		}
+		if err, ok := fsm.Apply(&raft.Log{Data: data}).(error); ok {
+			return err
+		}
+		return nil
+	}
+	return a
+}
+
+// identityAllocators returns an allocator of each kind with gcPeriod
+func identityAllocators(t *testing.T, gcPeriod time.Duration) map[string]*identityAllocator {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store, err := storage.Open(storage.Config{Dir: t.TempDir(), Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return map[string]*identityAllocator{
+		"local":      newIdentityAllocator(IdentityConfig{GCPeriod: gcPeriod}, nil, store, nil, logger),
+		"replicated": replicatedAllocator(t, newReplicatedState(), gcPeriod),
+	}
+}
+
+func TestAllocateIdentityConcurrently(t *testing.T) {
+	web := map[string]string{"app": "web", "tier": "frontend"}
+	tests := []struct {
+		name    string
+		labels  []map[string]string
+		holders []string
+		// wantIDs are the distinct identities allocated
+		wantIDs int
+	}{
+		{name: "same set from two agents", labels: []map[string]string{web, {"tier": "frontend", "app": "web"}},
+			holders: []string{"node-a/c1", "node-b/c2"}, wantIDs: 1},
+		{name: "same holder twice", labels: []map[string]string{web, web},
+			holders: []string{"node-a/c1", "node-a/c1"}, wantIDs: 1},
+		{name: "different sets", labels: []map[string]string{web, {"app": "db"}},
+			holders: []string{"node-a/c1", "node-b/c2"}, wantIDs: 2},
+	}
+	for _, tt := range tests {
+		for kind, a := range identityAllocators(t, time.Minute) {
+			t.Run(tt.name+"/"+kind, func(t *testing.T) {
+				const rounds = 50
+				ids := make([][]uint32, len(tt.holders))
+				var wg sync.WaitGroup
+				for i := range tt.holders {
+					ids[i] = make([]uint32, rounds)
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						for r := 0; r < rounds; r++ {
+							rec, err := a.allocate(tt.labels[i], tt.holders[i])
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							ids[i][r] = rec.ID
+						}
+					}(i)
+				}
+				wg.Wait()
+
+				distinct := make(map[uint32]bool)
+				for i := range ids {
+					for _, id := range ids[i] {
+						if id != ids[i][0] {
+							t.Errorf("%s got identities %d and %d", tt.holders[i], ids[i][0], id)
+						}
+						distinct[id] = true
+					}
+				}
+				if len(distinct) != tt.wantIDs {
+					t.Errorf("allocated %d identities, want %d", len(distinct), tt.wantIDs)
+				}
+				for i, holder := range tt.holders {
+					rec, ok := a.table.get(ids[i][0])
+					if !ok {
+						t.Fatalf("identity %d not in the table", ids[i][0])
+					}
+					if _, found := slices.BinarySearch(rec.Holders, holder); !found {
+						t.Errorf("identity %d has holders %q, want %s", rec.ID, rec.Holders, holder)
+					}
+				}
+				if recs, _ := a.table.list(); len(recs) != tt.wantIDs {
+					t.Errorf("table holds %d identities, want %d", len(recs), tt.wantIDs)
+				}
+			})
+		}
+	}
+}
+
+func TestAllocateIdentityInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		holder string
+	}{
+		{name: "no labels", holder: "node-a/c1"},
+		{name: "empty label name", labels: map[string]string{"": "x"}, holder: "node-a/c1"},
+		{name: "no holder", labels: map[string]string{"app": "web"}},
+	}
+	a := identityAllocators(t, time.Minute)["local"]
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := a.allocate(tt.labels, tt.holder); !errors.Is(err, errInvalidIdentity) {
+				t.Errorf("allocate() = %v, want errInvalidIdentity", err)
+			}
+		})
+	}
+	if _, err := a.release(42, "node-a/c1", time.Now()); !errors.Is(err, errIdentityNotFound) {
+		t.Errorf("release() = %v, want errIdentityNotFound", err)
+	}
+}
+
+// follow applies the changes of table after the revision of cache
+func follow(cache *client.IdentityCache, table *identityTable) {
+	events, _ := table.watch(cache.Revision())
+	for _, ev := range events {
+		cache.Apply(ev)
+	}
+}
+
+func TestIdentityReuseAfterGC(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	db := map[string]string{"app": "db"}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	const gcPeriod = time.Minute
+
+	for kind, a := range identityAllocators(t, gcPeriod) {
+		t.Run(kind, func(t *testing.T) {
+			cache := client.NewIdentityCache(nil)
+			// stale misses the changes from the release on, and catches
+			// up only once the number could have been reused
+			stale := client.NewIdentityCache(nil)
+
+			first, err := a.allocate(web, "node-a/c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			follow(cache, a.table)
+			follow(stale, a.table)
+			if _, err := a.release(first.ID, "node-a/c1", start); err != nil {
+				t.Fatal(err)
+			}
+
+			steps := []struct {
+				name          string
+				at            time.Duration
+				wantCollected int
+			}{
+				{name: "within the GC period", at: gcPeriod / 2},
+				{name: "after the GC period", at: gcPeriod, wantCollected: 1},
+				{name: "again", at: 2 * gcPeriod},
+			}
+			for _, step := range steps {
+				n, err := a.collect(start.Add(step.at))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != step.wantCollected {
+					t.Errorf("%s: collected %d, want %d", step.name, n, step.wantCollected)
+				}
+			}
+			follow(cache, a.table)
+			if _, ok := cache.Lookup(first.ID); ok {
+				t.Errorf("cache still holds collected identity %d", first.ID)
+			}
+
+			second, err := a.allocate(db, "node-b/c2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := a.allocate(web, "node-a/c3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rec := range []*identityRecord{second, again} {
+				if rec.ID == first.ID {
+					t.Errorf("identity %d of %v was reused for %v", first.ID, first.Labels, rec.Labels)
+				}
+			}
+			if second.ID == again.ID {
+				t.Errorf("%v and %v share identity %d", db, web, again.ID)
+			}
+
+			follow(cache, a.table)
+			if got, ok := cache.LookupLabels(web); !ok || got.Id != again.ID {
+				t.Errorf("cache has %v for %v, want identity %d", got, web, again.ID)
+			}
+
+			// Catching up, the stale cache resolves no number to two label
+			// sets
+			follow(stale, a.table)
+			for _, tc := range []struct {
+				labels map[string]string
+				want   uint32
+			}{{web, again.ID}, {db, second.ID}} {
+				got, ok := stale.LookupLabels(tc.labels)
+				if !ok || got.Id != tc.want {
+					t.Errorf("stale cache has %v for %v, want identity %d", got, tc.labels, tc.want)
+					continue
+				}
+				if byID, _ := stale.Lookup(tc.want); byID == nil || labelsKey(byID.Labels) != labelsKey(tc.labels) {
+					t.Errorf("stale cache has %v for identity %d, want %v", byID, tc.want, tc.labels)
+				}
+			}
+			if _, ok := stale.Lookup(first.ID); ok {
+				t.Errorf("stale cache still holds collected identity %d", first.ID)
+			}
+		})
+	}
+}
+
+func TestIdentityWatch(t *testing.T) {
+	table := newIdentityTable()
+	for i := 1; i <= identityHistorySize+10; i++ {
+		table.apply(identityChange{Identity: identityRecord{ID: uint32(i), Labels: map[string]string{"n": fmt.Sprint(i)}}})
+	}
+	table.apply(identityChange{Identity: identityRecord{ID: 1, Labels: map[string]string{"n": "1"}}, Delete: true})
+	_, rev := table.list()
+	total := identityHistorySize + 9
+
+	reset := func(events []*pb.IdentityEvent) bool {
+		return len(events) == total+1 && events[0].Type == pb.IdentityEventType_IDENTITY_EVENT_TYPE_RESET && events[0].Revision == rev
+	}
+	tests := []struct {
+		name  string
+		after uint64
+		check func([]*pb.IdentityEvent) bool
+	}{
+		{name: "from the start", after: 0, check: reset},
+		{name: "up to date", after: rev, check: func(events []*pb.IdentityEvent) bool { return len(events) == 0 }},
+		{name: "last change", after: rev - 1, check: func(events []*pb.IdentityEvent) bool {
+			return len(events) == 1 && events[0].Type == pb.IdentityEventType_IDENTITY_EVENT_TYPE_DELETE && events[0].Identity.Id == 1
+		}},
+		{name: "oldest retained", after: rev - identityHistorySize, check: func(events []*pb.IdentityEvent) bool {
+			return len(events) == identityHistorySize && events[0].Revision == rev-identityHistorySize+1
+		}},
+		{name: "no longer retained", after: rev - identityHistorySize - 1, check: reset},
+		{name: "ahead", after: rev + 1, check: reset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, _ := table.watch(tt.after)
+			if !tt.check(events) {
+				t.Errorf("watch(%d) returned %d events", tt.after, len(events))
+			}
+		})
+	}
+}
+
+func TestIdentityPersistence(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	tests := []struct {
+		name string
+		// reopen returns an allocator with the state of a
+		reopen func(t *testing.T, a *identityAllocator) *identityAllocator
+	}{
+		{name: "replicated snapshot", reopen: func(t *testing.T, a *identityAllocator) *identityAllocator {
+			snap := raftSnapshot{Identities: new(identityState)}
+			*snap.Identities = a.table.snapshot()
+			data, err := json.Marshal(snap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fsm := newReplicatedState()
+			if err := fsm.Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+				t.Fatal(err)
+			}
+			return replicatedAllocator(t, fsm, time.Minute)
+		}},
+		{name: "state file", reopen: func(t *testing.T, a *identityAllocator) *identityAllocator {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			store, err := storage.Open(storage.Config{Dir: t.TempDir(), Logger: logger})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			if err := saveIdentities(store, a.table.snapshot()); err != nil {
+				t.Fatal(err)
+			}
+			saved, err := loadIdentities(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return newIdentityAllocator(IdentityConfig{}, nil, store, saved, logger)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := replicatedAllocator(t, newReplicatedState(), time.Minute)
+			first, err := a.allocate(web, "node-a/c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Leave a hole, which is never filled
+			gone, err := a.allocate(map[string]string{"app": "gone"}, "node-a/c2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.release(gone.ID, "node-a/c2", time.Now().Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.collect(time.Now()); err != nil {
+				t.Fatal(err)
+			}
+
+			b := tt.reopen(t, a)
+			got, err := b.allocate(web, "node-b/c3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != first.ID || !slices.Equal(got.Holders, []string{"node-a/c1", "node-b/c3"}) {
+				t.Errorf("allocate() after reopening = %+v, want identity %d", got, first.ID)
+			}
+			next, err := b.allocate(map[string]string{"app": "new"}, "node-b/c4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next.ID <= gone.ID {
+				t.Errorf("allocate() after reopening = %d, want above %d", next.ID, gone.ID)
+			}
+		})
+	}
+}
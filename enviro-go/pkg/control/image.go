@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/image"
+)
+
+// imageServicePrefix prefixes the ImageService methods, which act on the
+// image cache of the node serving them and so are allowed on followers
+const imageServicePrefix = "/enviro.api.v1.ImageService/"
+
+// errImagesDisabled is returned when there is no image cache
+var errImagesDisabled = errors.New("image cache is not configured")
+
+// ImageConfig configures the image cache ImageService pulls into. It is
+// enabled by Dir, or by StateDir, and ImageService fails with
+// codes.FailedPrecondition without either.
+type ImageConfig struct {
+	// Dir is the cache directory, "images" of StateDir by default
+	Dir string `json:"dir"`
+	// AuthFile holds the credentials of registries in the format of
+	// docker's config.json, {"auths": {"ghcr.io": {"auth": "..."}}}. It is
+	// read on each pull, so `docker login` takes effect without a restart.
+	AuthFile string `json:"auth_file"`
+	// PlainHTTP lists the registries pulled from over HTTP rather than
+	// HTTPS, e.g. "localhost:5000"
+	PlainHTTP []string `json:"plain_http"`
+	// Platform selects the image of multi-platform indexes, e.g.
+	// "linux/arm64", the platform of the control plane by default
+	Platform string `json:"platform"`
+	// MaxConcurrentDownloads bounds the layers downloaded at once,
+	// image.DefaultMaxConcurrentDownloads when zero
+	MaxConcurrentDownloads int `json:"max_concurrent_downloads"`
+}
+
+func (c ImageConfig) validate() error {
+	if c.MaxConcurrentDownloads < 0 {
+		return errors.New("max_concurrent_downloads must not be negative")
+	}
+	if c.Platform != "" {
+		if _, err := image.ParsePlatform(c.Platform); err != nil {
+			return err
+		}
+	}
+	for _, host := range c.PlainHTTP {
+		if host == "" || strings.ContainsAny(host, "/ ") {
+			return fmt.Errorf("plain_http registry %q is not a host[:port]", host)
+		}
+	}
+	return nil
+}
+
+// dir returns the cache directory, empty when the cache is disabled
+func (c ImageConfig) dir(stateDir string) string {
+	if c.Dir != "" || stateDir == "" {
+		return c.Dir
+	}
+	return filepath.Join(stateDir, "images")
+}
+
+// newImagePuller opens the image cache at dir. The puller holds nothing
+// to release until it pulls, so it needn't be closed when the control
+// plane fails to start.
+func newImagePuller(config ImageConfig, dir string, logger *slog.Logger) (*image.Puller, error) {
+	var platform image.Platform
+	if config.Platform != "" {
+		var err error
+		if platform, err = image.ParsePlatform(config.Platform); err != nil {
+			return nil, err
+		}
+	}
+	var keychain image.Keychain
+	if config.AuthFile != "" {
+		keychain = authFileKeychain(config.AuthFile, logger)
+	}
+	return image.NewPuller(image.Config{
+		Dir:                    dir,
+		Keychain:               keychain,
+		PlainHTTP:              config.PlainHTTP,
+		Platform:               platform,
+		MaxConcurrentDownloads: config.MaxConcurrentDownloads,
+		Logger:                 logger,
+	})
+}
+
+// authFileKeychain returns the credentials of registries in the docker
+// config file at path. Its keys may be URLs such as
+// "https://index.docker.io/v1/", as docker login writes for Docker Hub.
+func authFileKeychain(path string, logger *slog.Logger) image.Keychain {
+	return func(registry string) (image.Credentials, bool) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.Warn("Failed to read registry credentials", "path", path, "error", err)
+			return image.Credentials{}, false
+		}
+		var file struct {
+			Auths map[string]struct {
+				Auth     string `json:"auth"`
+				Username string `json:"username"`
+				Password string `json:"password"`
+			} `json:"auths"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			logger.Warn("Invalid registry credentials", "path", path, "error", err)
+			return image.Credentials{}, false
+		}
+		for key, auth := range file.Auths {
+			if registryHost(key) != registry {
+				continue
+			}
+			creds := image.Credentials{Username: auth.Username, Password: auth.Password}
+			if auth.Auth != "" {
+				decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+				user, pass, ok := strings.Cut(string(decoded), ":")
+				if err != nil || !ok {
+					logger.Warn("Invalid registry credentials", "path", path, "registry", key)
+					return image.Credentials{}, false
+				}
+				creds = image.Credentials{Username: user, Password: pass}
+			}
+			return creds, creds.Username != "" || creds.Password != ""
+		}
+		return image.Credentials{}, false
+	}
+}
+
+// registryHost returns the registry of a key of a docker config file, as
+// image references name it
+func registryHost(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+	switch key {
+	case "index.docker.io", "registry-1.docker.io":
+		return image.DockerHub
+	}
+	return key
+}
+
+// imageService implements pb.ImageServiceServer over the image cache
+type imageService struct {
+	pb.UnimplementedImageServiceServer
+
+	// images is nil when the cache is disabled
+	images *image.Puller
+}
+
+// PullImage pulls an image into the cache, streaming its progress
+func (s *imageService) PullImage(req *pb.PullImageRequest, stream pb.ImageService_PullImageServer) error {
+	if s.images == nil {
+		return status.Error(codes.FailedPrecondition, errImagesDisabled.Error())
+	}
+	policy := image.PullIfMissing
+	if req.GetAlways() {
+		policy = image.PullAlways
+	}
+	// Progress is reported on this goroutine, so a failed send leaves the
+	// pull to the context of the stream. The done progress is sent last,
+	// with the image.
+	var sendErr error
+	done := &pb.PullImageProgress{Phase: string(image.PhaseDone)}
+	img, err := s.images.Pull(stream.Context(), req.GetImage(), policy, func(p image.Progress) {
+		if p.Phase == image.PhaseDone {
+			done = pullProgressToProto(p)
+		} else if sendErr == nil {
+			sendErr = stream.Send(pullProgressToProto(p))
+		}
+	})
+	if err != nil {
+		return imageError(err)
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	done.Image = img.Reference
+	done.Result = imageToProto(s.images, img)
+	return stream.Send(done)
+}
+
+// ListImages returns the cached images
+func (s *imageService) ListImages(ctx context.Context, req *pb.ListImagesRequest) (*pb.ListImagesResponse, error) {
+	if s.images == nil {
+		return nil, status.Error(codes.FailedPrecondition, errImagesDisabled.Error())
+	}
+	resp := &pb.ListImagesResponse{}
+	for _, img := range s.images.Images() {
+		resp.Images = append(resp.Images, imageToProto(s.images, img))
+	}
+	return resp, nil
+}
+
+// RemoveImage removes an image and the blobs only it uses from the cache
+func (s *imageService) RemoveImage(ctx context.Context, req *pb.RemoveImageRequest) (*pb.RemoveImageResponse, error) {
+	if s.images == nil {
+		return nil, status.Error(codes.FailedPrecondition, errImagesDisabled.Error())
+	}
+	img, freed, err := s.images.Remove(req.GetImage())
+	if err != nil {
+		return nil, imageError(err)
+	}
+	return &pb.RemoveImageResponse{Image: imageToProto(s.images, img), FreedBytes: freed}, nil
+}
+
+func pullProgressToProto(p image.Progress) *pb.PullImageProgress {
+	out := &pb.PullImageProgress{Image: p.Reference, Phase: string(p.Phase)}
+	for _, l := range p.Layers {
+		out.Layers = append(out.Layers, &pb.LayerProgress{
+			Digest:     string(l.Digest),
+			Size:       l.Size,
+			Downloaded: l.Downloaded,
+			Cached:     l.Cached,
+			Done:       l.Done,
+		})
+		out.Downloaded += l.Downloaded
+		out.Total += l.Size
+	}
+	return out
+}
+
+// imageToProto converts img, with the paths of its blobs in the cache of
+// images
+func imageToProto(images *image.Puller, img image.Image) *pb.Image {
+	blob := func(d image.Descriptor) *pb.ImageBlob {
+		return &pb.ImageBlob{
+			Digest:    string(d.Digest),
+			MediaType: d.MediaType,
+			Size:      d.Size,
+			Path:      images.BlobPath(d.Digest),
+		}
+	}
+	out := &pb.Image{
+		Reference:   img.Reference,
+		Digest:      string(img.Manifest.Digest),
+		IndexDigest: string(img.Index),
+		Platform:    img.Platform.String(),
+		Manifest:    blob(img.Manifest),
+		Config:      blob(img.Config),
+		Size:        img.Size(),
+		PulledAt:    timestamppb.New(img.PulledAt),
+	}
+	for _, l := range img.Layers {
+		out.Layers = append(out.Layers, blob(l))
+	}
+	return out
+}
+
+// imageError converts errors of the image cache to gRPC status errors
+func imageError(err error) error {
+	switch {
+	case errors.Is(err, image.ErrInvalidReference):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, image.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, image.ErrUnauthorized):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, image.ErrDigestMismatch):
+		return status.Error(codes.DataLoss, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+}
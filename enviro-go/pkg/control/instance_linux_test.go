@@ -0,0 +1,236 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// instancesTestEnv has a child of TestNetworkInstances run the test in the
+// network namespace of its own it was started in
+const instancesTestEnv = "ENVIRO_TEST_NETWORK_INSTANCES"
+
+// TestNetworkInstances runs the control planes of two network instances
+// in one process, creating a container of the same ID in both at once,
+// and checks that neither sees the state, events or metrics of the other.
+// It runs in a child in a network namespace of its own, so the datapaths
+// stay off the host.
+func TestNetworkInstances(t *testing.T) {
+	if os.Getenv(instancesTestEnv) != "" {
+		runNetworkInstances(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("setting up the datapath needs root")
+	}
+	runInNetns(t, instancesTestEnv)
+}
+
+// testInstance is a control plane of runNetworkInstances
+type testInstance struct {
+	name   string
+	cidr   netip.Prefix
+	cp     *ControlPlane
+	client pb.ContainerServiceClient
+	events *eventSub
+	netns  string
+}
+
+func runNetworkInstances(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	instances := []*testInstance{
+		{name: "a", cidr: netip.MustParsePrefix("10.91.0.0/24")},
+		{name: "b", cidr: netip.MustParsePrefix("10.92.0.0/24")},
+	}
+	for _, inst := range instances {
+		// The loopback of the new namespace is down
+		socket := filepath.Join(t.TempDir(), "enviro.sock")
+		cp, err := NewControlPlaneWithConfig(ControlPlaneConfig{
+			Address:        "unix://" + socket,
+			MetricsAddress: ":0",
+			StateDir:       t.TempDir(),
+			Logger:         logger,
+			Network:        network.NetworkConfig{Instance: inst.name, CIDR: inst.cidr.String()},
+		})
+		if err != nil {
+			t.Fatalf("instance %s: %v", inst.name, err)
+		}
+		go cp.Start(ctx)
+		defer cp.Stop(context.Background())
+		if err := cp.WaitReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		sub, _, err := cp.events.subscribe(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst.cp, inst.client, inst.events = cp, pb.NewContainerServiceClient(conn), sub
+
+		sleep := exec.Command("sleep", "infinity")
+		sleep.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWNET}
+		if err := sleep.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			sleep.Process.Kill()
+			sleep.Wait()
+		}()
+		inst.netns = fmt.Sprintf("/proc/%d/ns/net", sleep.Process.Pid)
+	}
+
+	// A third manager can't take an instance that runs
+	if _, err := network.NewNetworkManager(network.NetworkConfig{Instance: "a", CIDR: "10.93.0.0/24"}); !errors.Is(err, network.ErrInstanceInUse) {
+		t.Errorf("NewNetworkManager() of a running instance = %v, want %v", err, network.ErrInstanceInUse)
+	}
+
+	// The same container in both instances at once
+	resps := make([]*pb.CreateContainerResponse, len(instances))
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, inst := range instances {
+		wg.Add(1)
+		go func(i int, inst *testInstance) {
+			defer wg.Done()
+			resps[i], errs[i] = inst.client.CreateContainer(ctx, &pb.CreateContainerRequest{Id: "c1", NetnsPath: inst.netns})
+		}(i, inst)
+	}
+	wg.Wait()
+	for i, inst := range instances {
+		if errs[i] != nil {
+			t.Fatalf("instance %s: CreateContainer() = %v", inst.name, errs[i])
+		}
+		c := resps[i].Container
+		if ip, err := netip.ParseAddr(c.Ip); err != nil || !inst.cidr.Contains(ip) {
+			t.Errorf("instance %s: container address %s, want one of %s", inst.name, c.Ip, inst.cidr)
+		}
+		if prefix := "v" + inst.name + "-"; !strings.HasPrefix(c.HostInterface, prefix) {
+			t.Errorf("instance %s: host interface %s, want one starting with %s", inst.name, c.HostInterface, prefix)
+		}
+	}
+
+	for _, inst := range instances {
+		// State
+		networks := inst.cp.network.ContainerNetworks()
+		if len(networks) != 1 || networks["c1"] == nil {
+			t.Fatalf("instance %s: networks %v, want c1", inst.name, networks)
+		}
+		if ip := netip.MustParseAddr(networks["c1"].IPv4); !inst.cidr.Contains(ip) {
+			t.Errorf("instance %s: network of c1 has address %s", inst.name, ip)
+		}
+
+		// Events
+		created := 0
+	events:
+		for {
+			select {
+			case ev := <-inst.events.ch:
+				if ev.Ip != "" && !inst.cidr.Contains(netip.MustParseAddr(ev.Ip)) {
+					t.Errorf("instance %s: event %v of another instance", inst.name, ev)
+				}
+				if ev.Type == pb.ContainerEventType_CONTAINER_EVENT_TYPE_CREATED {
+					created++
+				}
+			case <-time.After(200 * time.Millisecond):
+				break events
+			}
+		}
+		if created != 1 {
+			t.Errorf("instance %s: %d created events, want 1", inst.name, created)
+		}
+
+		// Metrics
+		families, err := inst.cp.metrics.registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		setups := uint64(0)
+		for _, f := range families {
+			for _, m := range f.Metric {
+				labels := make(map[string]string)
+				for _, l := range m.Label {
+					labels[l.GetName()] = l.GetValue()
+				}
+				if got := labels["network_instance"]; got != inst.name {
+					t.Errorf("instance %s: metric %s has instance %q", inst.name, f.GetName(), got)
+				}
+				if cidr, ok := labels["cidr"]; ok && cidr != inst.cidr.String() {
+					t.Errorf("instance %s: metric %s of pool %s", inst.name, f.GetName(), cidr)
+				}
+				if f.GetName() == "enviro_container_network_setup_seconds" {
+					setups += m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+		if setups != 1 {
+			t.Errorf("instance %s: %d network setups measured, want 1", inst.name, setups)
+		}
+	}
+
+	// Each instance programs tables of its own
+	conn, err := nftables.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := conn.ListTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, table := range tables {
+		names[table.Name] = true
+	}
+	for _, inst := range instances {
+		if name := "enviro-neighbor-" + inst.name; !names[name] {
+			t.Errorf("no table %s among %v", name, names)
+		}
+	}
+
+	// Deleting the container of one instance leaves that of the other
+	a, b := instances[0], instances[1]
+	if _, err := a.client.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.client.GetContainer(ctx, &pb.GetContainerRequest{Id: "c1"}); err != nil {
+		t.Errorf("instance b: GetContainer() after deleting c1 of a = %v", err)
+	}
+	if got := len(b.cp.network.ContainerNetworks()); got != 1 {
+		t.Errorf("instance b: %d networks after deleting c1 of a, want 1", got)
+	}
+	// The garbage collector of a leaves the veth of b alone
+	if _, err := a.cp.network.CollectGarbage(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := netlink.LinkByName(resps[1].Container.HostInterface); err != nil {
+		t.Errorf("instance b: veth gone after a collected garbage: %v", err)
+	}
+}
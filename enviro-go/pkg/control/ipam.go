@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// DefaultIPAMPluginTimeout bounds each call to the IPAM plugin unless its
+// Timeout says otherwise
+const DefaultIPAMPluginTimeout = 10 * time.Second
+
+// DefaultIPAMPluginBackoff is the delay before the first retry of a call
+// to the IPAM plugin unless its RetryBackoff says otherwise
+const DefaultIPAMPluginBackoff = 200 * time.Millisecond
+
+// DefaultIPAMPluginCacheTTL is how long the allocations of the IPAM
+// plugin are cached unless its CacheTTL says otherwise
+const DefaultIPAMPluginCacheTTL = time.Hour
+
+// IPAMPluginConfig configures the IPAM plugin container addresses are
+// allocated by with the "external" IPAM backend, see
+// pkg/api/v1/ipam.proto. The plugin allocates the addresses of both
+// container networks.
+type IPAMPluginConfig struct {
+	// Address of a plugin served over gRPC as the IPAMPlugin service,
+	// e.g. "ipam.internal:8443"
+	Address string `json:"address"`
+	// URL of a plugin served over HTTP, which each request of the
+	// IPAMPlugin service is POSTed to as JSON under the path of its
+	// method, e.g. "https://ipam.internal/enviro" takes AllocateAddress
+	// at "https://ipam.internal/enviro/AllocateAddress". Failures are
+	// answered with 409 Conflict for ALREADY_EXISTS, 429 Too Many
+	// Requests for RESOURCE_EXHAUSTED and 400 Bad Request for
+	// INVALID_ARGUMENT. Exactly one of URL and Address is set.
+	URL string `json:"url"`
+	// CAFile verifies the plugin's certificate instead of the system
+	// roots. gRPC plugins are called over TLS only when it is set.
+	CAFile string `json:"ca_file"`
+	// Timeout bounds each call, DefaultIPAMPluginTimeout when zero
+	Timeout time.Duration `json:"timeout"`
+	// Retries is the number of extra attempts of calls failing while the
+	// plugin can't be reached
+	Retries int `json:"retries"`
+	// RetryBackoff is the delay before the first retry, doubled each
+	// attempt, DefaultIPAMPluginBackoff when zero
+	RetryBackoff time.Duration `json:"retry_backoff"`
+	// CacheTTL is how long the addresses the plugin allocated are handed
+	// out again while it can't be reached, to containers allocating the
+	// address they held, DefaultIPAMPluginCacheTTL when zero
+	CacheTTL time.Duration `json:"cache_ttl"`
+}
+
+func (c IPAMPluginConfig) validate() error {
+	if (c.Address == "") == (c.URL == "") {
+		return errors.New("one of address and url is required")
+	}
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.New("url must be http or https")
+		}
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	if c.Retries < 0 || c.RetryBackoff < 0 {
+		return errors.New("retries must not be negative")
+	}
+	if c.CacheTTL < 0 {
+		return errors.New("cache ttl must not be negative")
+	}
+	return nil
+}
+
+// ipamPlugin is the network.IPAM backend calling an IPAM plugin
+type ipamPlugin struct {
+	config IPAMPluginConfig
+	tls    *tls.Config
+	// http calls a plugin served over HTTP, nil for gRPC plugins
+	http *http.Client
+	// node is sent to the plugin as the node containers run on
+	node string
+	log  *slog.Logger
+
+	mu   sync.Mutex
+	conn *grpc.ClientConn
+	// cache holds the addresses the plugin allocated and hasn't released,
+	// see IPAMPluginConfig.CacheTTL
+	cache map[cacheKey]cachedAddr
+}
+
+// cacheKey is the address of a container in a pool
+type cacheKey struct {
+	containerID string
+	pool        netip.Prefix
+}
+
+// cachedAddr is an address the plugin allocated at the time
+type cachedAddr struct {
+	addr netip.Addr
+	at   time.Time
+}
+
+// newIPAMPlugin loads the plugin's CA. The plugin is dialed when first
+// called.
+func newIPAMPlugin(config IPAMPluginConfig, logger *slog.Logger) (*ipamPlugin, error) {
+	p := &ipamPlugin{config: config, log: logger, cache: make(map[cacheKey]cachedAddr)}
+	if p.config.Timeout == 0 {
+		p.config.Timeout = DefaultIPAMPluginTimeout
+	}
+	if p.config.RetryBackoff == 0 {
+		p.config.RetryBackoff = DefaultIPAMPluginBackoff
+	}
+	if p.config.CacheTTL == 0 {
+		p.config.CacheTTL = DefaultIPAMPluginCacheTTL
+	}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("IPAM plugin: failed to read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("IPAM plugin: no certificates found in %s", config.CAFile)
+		}
+		p.tls = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	if config.URL != "" {
+		p.http = &http.Client{Transport: &http.Transport{TLSClientConfig: p.tls, Proxy: http.ProxyFromEnvironment}}
+	}
+	p.node, _ = os.Hostname()
+	return p, nil
+}
+
+// Name implements network.IPAM
+func (p *ipamPlugin) Name() string { return network.IPAMExternal }
+
+// Manages implements network.IPAM
+func (p *ipamPlugin) Manages(pool netip.Prefix) bool { return true }
+
+// Allocate implements network.IPAM. While the plugin can't be reached,
+// containers get the address it last allocated them back from the cache.
+func (p *ipamPlugin) Allocate(ctx context.Context, req network.IPAMRequest) (netip.Addr, error) {
+	addr, err := p.allocate(ctx, req, false)
+	if errors.Is(err, network.ErrIPAMUnavailable) {
+		if cached, ok := p.cached(req); ok {
+			p.log.Warn("IPAM plugin unavailable, allocating cached address", "container_id", req.ContainerID, "address", cached, "error", err)
+			return cached, nil
+		}
+	}
+	return addr, err
+}
+
+// Restore implements network.IPAM. Containers keep their addresses while
+// the plugin can't be reached, rather than losing their networks.
+func (p *ipamPlugin) Restore(ctx context.Context, req network.IPAMRequest) error {
+	addr, err := p.allocate(ctx, req, true)
+	if errors.Is(err, network.ErrIPAMUnavailable) {
+		p.log.Warn("Failed to restore address with IPAM plugin", "container_id", req.ContainerID, "address", req.Addr, "error", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if addr != req.Addr {
+		return fmt.Errorf("IPAM plugin allocated %s in place of %s", addr, req.Addr)
+	}
+	return nil
+}
+
+func (p *ipamPlugin) allocate(ctx context.Context, req network.IPAMRequest, restore bool) (netip.Addr, error) {
+	var resp *pb.AllocateAddressResponse
+	err := p.call(ctx, func(ctx context.Context, client pb.IPAMPluginClient) error {
+		var err error
+		resp, err = client.AllocateAddress(ctx, &pb.AllocateAddressRequest{
+			ContainerId:      req.ContainerID,
+			Namespace:        req.Namespace,
+			Pool:             req.Pool.String(),
+			Gateway:          req.Gateway.String(),
+			RequestedAddress: addrString(req.Addr),
+			Mac:              req.MAC,
+			Hostname:         req.Hostname,
+			Node:             p.node,
+			Restore:          restore,
+		})
+		return err
+	})
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, err := netip.ParseAddr(resp.Address)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w: IPAM plugin returned invalid address %q", network.ErrIPAMUnavailable, resp.Address)
+	}
+	p.remember(req, addr)
+	return addr, nil
+}
+
+// Release implements network.IPAM. Addresses the plugin failed to
+// release stay cached, as it still holds them for the container.
+func (p *ipamPlugin) Release(ctx context.Context, req network.IPAMRequest) error {
+	err := p.call(ctx, func(ctx context.Context, client pb.IPAMPluginClient) error {
+		_, err := client.ReleaseAddress(ctx, &pb.ReleaseAddressRequest{
+			ContainerId: req.ContainerID,
+			Pool:        req.Pool.String(),
+			Address:     req.Addr.String(),
+			Node:        p.node,
+		})
+		return err
+	})
+	if err == nil {
+		p.forget(req)
+	}
+	return err
+}
+
+// List implements network.IPAM
+func (p *ipamPlugin) List(ctx context.Context, pool netip.Prefix) ([]network.IPAMAllocation, error) {
+	var resp *pb.ListAddressesResponse
+	err := p.call(ctx, func(ctx context.Context, client pb.IPAMPluginClient) error {
+		var err error
+		resp, err = client.ListAddresses(ctx, &pb.ListAddressesRequest{Pool: pool.String(), Node: p.node})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]network.IPAMAllocation, 0, len(resp.Allocations))
+	for _, a := range resp.Allocations {
+		addr, err := netip.ParseAddr(a.Address)
+		if err != nil {
+			return nil, fmt.Errorf("%w: IPAM plugin listed invalid address %q", network.ErrIPAMUnavailable, a.Address)
+		}
+		out = append(out, network.IPAMAllocation{ContainerID: a.ContainerId, Addr: addr})
+	}
+	return out, nil
+}
+
+// call calls the plugin with fn, bounding each attempt by the timeout and
+// retrying those failing while the plugin can't be reached. Its errors
+// are mapped by pluginError.
+func (p *ipamPlugin) call(ctx context.Context, fn func(context.Context, pb.IPAMPluginClient) error) error {
+	client, err := p.client()
+	if err != nil {
+		return fmt.Errorf("%w: %w", network.ErrIPAMUnavailable, err)
+	}
+	backoff := p.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+		err = fn(callCtx, client)
+		cancel()
+		if err == nil || !retryable(err) || attempt >= p.config.Retries {
+			break
+		}
+		p.log.Debug("IPAM plugin unavailable, retrying", "backoff", backoff, "attempt", attempt+1, "attempts", p.config.Retries, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return pluginError(err)
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		return pluginError(err)
+	}
+	return nil
+}
+
+// remember caches addr as allocated for the container of req
+func (p *ipamPlugin) remember(req network.IPAMRequest, addr netip.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for k, c := range p.cache {
+		if now.Sub(c.at) >= p.config.CacheTTL {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[cacheKey{req.ContainerID, req.Pool}] = cachedAddr{addr: addr, at: now}
+}
+
+// forget drops the cached address of the container of req
+func (p *ipamPlugin) forget(req network.IPAMRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.cache, cacheKey{req.ContainerID, req.Pool})
+}
+
+// cached returns the address cached for the container of req, unless it
+// expired or the container requested another one
+func (p *ipamPlugin) cached(req network.IPAMRequest) (netip.Addr, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.cache[cacheKey{req.ContainerID, req.Pool}]
+	if !ok || time.Since(c.at) >= p.config.CacheTTL || req.Addr.IsValid() && req.Addr != c.addr {
+		return netip.Addr{}, false
+	}
+	return c.addr, true
+}
+
+// client returns the client of an HTTP plugin, or dials a gRPC plugin the
+// first time it is called
+func (p *ipamPlugin) client() (pb.IPAMPluginClient, error) {
+	if p.http != nil {
+		return &ipamWebhook{url: strings.TrimSuffix(p.config.URL, "/"), http: p.http}, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		creds := insecure.NewCredentials()
+		if p.tls != nil {
+			creds = credentials.NewTLS(p.tls)
+		}
+		conn, err := grpc.Dial(p.config.Address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+	}
+	return pb.NewIPAMPluginClient(p.conn), nil
+}
+
+// Close implements network.IPAM, closing the connection to the plugin if
+// dialed
+func (p *ipamPlugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// retryable reports whether a call failed with err while the plugin
+// couldn't be reached
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// pluginError maps the status codes of the plugin to the network errors
+// the API reports allocation failures with
+func pluginError(err error) error {
+	switch status.Code(err) {
+	case codes.AlreadyExists:
+		return fmt.Errorf("%w: %s", network.ErrAddressInUse, status.Convert(err).Message())
+	case codes.ResourceExhausted:
+		return fmt.Errorf("%w: %s", network.ErrPoolExhausted, status.Convert(err).Message())
+	case codes.InvalidArgument:
+		return fmt.Errorf("%w: %s", network.ErrInvalidAddress, status.Convert(err).Message())
+	}
+	return fmt.Errorf("%w: %w", network.ErrIPAMUnavailable, err)
+}
+
+// addrString formats addr, empty when unset
+func addrString(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.String()
+}
+
+// ipamWebhook is the client of an IPAM plugin served over HTTP, see
+// IPAMPluginConfig.URL. It fails with the status codes a gRPC plugin
+// would, Unavailable when the plugin can't be reached.
+type ipamWebhook struct {
+	url  string
+	http *http.Client
+}
+
+func (w *ipamWebhook) AllocateAddress(ctx context.Context, in *pb.AllocateAddressRequest, _ ...grpc.CallOption) (*pb.AllocateAddressResponse, error) {
+	out := &pb.AllocateAddressResponse{}
+	return out, w.post(ctx, "AllocateAddress", in, out)
+}
+
+func (w *ipamWebhook) ReleaseAddress(ctx context.Context, in *pb.ReleaseAddressRequest, _ ...grpc.CallOption) (*pb.ReleaseAddressResponse, error) {
+	out := &pb.ReleaseAddressResponse{}
+	return out, w.post(ctx, "ReleaseAddress", in, out)
+}
+
+func (w *ipamWebhook) ListAddresses(ctx context.Context, in *pb.ListAddressesRequest, _ ...grpc.CallOption) (*pb.ListAddressesResponse, error) {
+	out := &pb.ListAddressesResponse{}
+	return out, w.post(ctx, "ListAddresses", in, out)
+}
+
+// post sends in to the path of method as JSON, decoding the response into
+// out
+func (w *ipamWebhook) post(ctx context.Context, method string, in, out proto.Message) error {
+	body, err := protojson.Marshal(in)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := resp.Status
+		if text := strings.TrimSpace(string(data)); text != "" {
+			msg += ": " + text
+		}
+		return status.Error(webhookCode(resp.StatusCode), msg)
+	}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, out); err != nil {
+		return status.Errorf(codes.Internal, "invalid response: %v", err)
+	}
+	return nil
+}
+
+// webhookCode maps the HTTP status of a failed webhook call to the gRPC
+// code a plugin fails with
+func webhookCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	}
+	if httpStatus >= http.StatusInternalServerError {
+		return codes.Unavailable
+	}
+	return codes.Unknown
+}
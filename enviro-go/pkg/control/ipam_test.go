@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/network/ipamtest"
+)
+
+// fakePlugin is an IPAM plugin allocating from the pools it is asked
+// about, served over gRPC or HTTP
+type fakePlugin struct {
+	pb.UnimplementedIPAMPluginServer
+
+	mu sync.Mutex
+	// held maps the allocated addresses to their container and node
+	held map[netip.Addr]fakeHolder
+	// down fails that many calls with codes.Unavailable
+	down int
+}
+
+type fakeHolder struct {
+	containerID string
+	node        string
+}
+
+func newFakePlugin() *fakePlugin {
+	return &fakePlugin{held: make(map[netip.Addr]fakeHolder)}
+}
+
+// setDown fails the next n calls
+func (f *fakePlugin) setDown(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = n
+}
+
+func (f *fakePlugin) failing() bool {
+	if f.down > 0 {
+		f.down--
+		return true
+	}
+	return false
+}
+
+func (f *fakePlugin) AllocateAddress(ctx context.Context, req *pb.AllocateAddressRequest) (*pb.AllocateAddressResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing() {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+	pool, err := netip.ParsePrefix(req.Pool)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	gateway, _ := netip.ParseAddr(req.Gateway)
+	usable := func(addr netip.Addr) bool {
+		next := addr.Next()
+		return pool.Contains(addr) && addr != pool.Addr() && addr != gateway && pool.Contains(next)
+	}
+	holder := fakeHolder{containerID: req.ContainerId, node: req.Node}
+	for addr, h := range f.held {
+		if h == holder && pool.Contains(addr) {
+			return &pb.AllocateAddressResponse{Address: addr.String()}, nil
+		}
+	}
+	if req.RequestedAddress != "" {
+		addr, err := netip.ParseAddr(req.RequestedAddress)
+		if err != nil || !usable(addr) {
+			return nil, status.Errorf(codes.InvalidArgument, "%s isn't allocatable", req.RequestedAddress)
+		}
+		if h, ok := f.held[addr]; ok && h != holder {
+			return nil, status.Errorf(codes.AlreadyExists, "%s is held by %s", addr, h.containerID)
+		}
+		f.held[addr] = holder
+		return &pb.AllocateAddressResponse{Address: addr.String()}, nil
+	}
+	for addr := pool.Addr(); pool.Contains(addr); addr = addr.Next() {
+		if _, ok := f.held[addr]; ok || !usable(addr) {
+			continue
+		}
+		f.held[addr] = holder
+		return &pb.AllocateAddressResponse{Address: addr.String()}, nil
+	}
+	return nil, status.Errorf(codes.ResourceExhausted, "%s is full", pool)
+}
+
+func (f *fakePlugin) ReleaseAddress(ctx context.Context, req *pb.ReleaseAddressRequest) (*pb.ReleaseAddressResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing() {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+	addr, err := netip.ParseAddr(req.Address)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if f.held[addr] == (fakeHolder{containerID: req.ContainerId, node: req.Node}) {
+		delete(f.held, addr)
+	}
+	return &pb.ReleaseAddressResponse{}, nil
+}
+
+func (f *fakePlugin) ListAddresses(ctx context.Context, req *pb.ListAddressesRequest) (*pb.ListAddressesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing() {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+	pool, err := netip.ParsePrefix(req.Pool)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resp := &pb.ListAddressesResponse{}
+	for addr, h := range f.held {
+		if pool.Contains(addr) && h.node == req.Node {
+			resp.Allocations = append(resp.Allocations, &pb.AddressAllocation{ContainerId: h.containerID, Address: addr.String()})
+		}
+	}
+	return resp, nil
+}
+
+// ServeHTTP serves the plugin as a webhook, see IPAMPluginConfig.URL
+func (f *fakePlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var resp proto.Message
+	switch path.Base(r.URL.Path) {
+	case "AllocateAddress":
+		req := &pb.AllocateAddressRequest{}
+		if err = protojson.Unmarshal(body, req); err == nil {
+			resp, err = f.AllocateAddress(r.Context(), req)
+		}
+	case "ReleaseAddress":
+		req := &pb.ReleaseAddressRequest{}
+		if err = protojson.Unmarshal(body, req); err == nil {
+			resp, err = f.ReleaseAddress(r.Context(), req)
+		}
+	case "ListAddresses":
+		req := &pb.ListAddressesRequest{}
+		if err = protojson.Unmarshal(body, req); err == nil {
+			resp, err = f.ListAddresses(r.Context(), req)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		code := map[codes.Code]int{
+			codes.AlreadyExists:     http.StatusConflict,
+			codes.ResourceExhausted: http.StatusTooManyRequests,
+			codes.InvalidArgument:   http.StatusBadRequest,
+		}[status.Code(err)]
+		if code == 0 {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, status.Convert(err).Message(), code)
+		return
+	}
+	data, _ := protojson.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// servePlugin serves f over transport, "grpc" or "http", returning the
+// config of a plugin calling it
+func servePlugin(t *testing.T, f *fakePlugin, transport string) IPAMPluginConfig {
+	t.Helper()
+	if transport == "http" {
+		srv := httptest.NewServer(f)
+		t.Cleanup(srv.Close)
+		return IPAMPluginConfig{URL: srv.URL + "/ipam"}
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterIPAMPluginServer(srv, f)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return IPAMPluginConfig{Address: lis.Addr().String()}
+}
+
+func newTestPlugin(t *testing.T, config IPAMPluginConfig) *ipamPlugin {
+	t.Helper()
+	p, err := newIPAMPlugin(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestIPAMPluginConformance(t *testing.T) {
+	for _, transport := range []string{"grpc", "http"} {
+		t.Run(transport, func(t *testing.T) {
+			ipamtest.Run(t, func(t *testing.T) network.IPAM {
+				return newTestPlugin(t, servePlugin(t, newFakePlugin(), transport))
+			})
+		})
+	}
+}
+
+func TestIPAMPluginRetries(t *testing.T) {
+	for _, transport := range []string{"grpc", "http"} {
+		t.Run(transport, func(t *testing.T) {
+			f := newFakePlugin()
+			config := servePlugin(t, f, transport)
+			config.Retries, config.RetryBackoff = 2, time.Millisecond
+			p := newTestPlugin(t, config)
+			req := network.IPAMRequest{ContainerID: "c1", Pool: ipamtest.Pool, Gateway: ipamtest.Gateway}
+
+			f.setDown(2)
+			if _, err := p.Allocate(context.Background(), req); err != nil {
+				t.Errorf("Allocate() with 2 retries of 2 failures = %v", err)
+			}
+			f.setDown(3)
+			req.ContainerID = "c2"
+			if _, err := p.Allocate(context.Background(), req); !errors.Is(err, network.ErrIPAMUnavailable) {
+				t.Errorf("Allocate() with 2 retries of 3 failures = %v, want %v", err, network.ErrIPAMUnavailable)
+			}
+			// Refusals aren't retried
+			f.setDown(0)
+			req.ContainerID, req.Addr = "c3", ipamtest.Gateway
+			if _, err := p.Allocate(context.Background(), req); !errors.Is(err, network.ErrInvalidAddress) {
+				t.Errorf("Allocate() of the gateway = %v, want %v", err, network.ErrInvalidAddress)
+			}
+		})
+	}
+}
+
+func TestIPAMPluginCache(t *testing.T) {
+	f := newFakePlugin()
+	p := newTestPlugin(t, servePlugin(t, f, "grpc"))
+	ctx := context.Background()
+	req := func(id string) network.IPAMRequest {
+		return network.IPAMRequest{ContainerID: id, Pool: ipamtest.Pool, Gateway: ipamtest.Gateway}
+	}
+
+	addr, err := p.Allocate(ctx, req("c1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.setDown(1 << 20)
+	if got, err := p.Allocate(ctx, req("c1")); err != nil || got != addr {
+		t.Errorf("Allocate() of a cached address while down = %s, %v, want %s", got, err, addr)
+	}
+	if _, err := p.Allocate(ctx, req("c2")); !errors.Is(err, network.ErrIPAMUnavailable) {
+		t.Errorf("Allocate() of an uncached address while down = %v, want %v", err, network.ErrIPAMUnavailable)
+	}
+	// The plugin still holds the address it failed to release
+	released := req("c1")
+	released.Addr = addr
+	if err := p.Release(ctx, released); err == nil {
+		t.Fatal("Release() succeeded while down")
+	}
+	if got, err := p.Allocate(ctx, req("c1")); err != nil || got != addr {
+		t.Errorf("Allocate() after a failed release = %s, %v, want %s", got, err, addr)
+	}
+
+	f.setDown(0)
+	if err := p.Release(ctx, released); err != nil {
+		t.Fatal(err)
+	}
+	f.setDown(1 << 20)
+	if _, err := p.Allocate(ctx, req("c1")); !errors.Is(err, network.ErrIPAMUnavailable) {
+		t.Errorf("Allocate() of a released address while down = %v, want %v", err, network.ErrIPAMUnavailable)
+	}
+}
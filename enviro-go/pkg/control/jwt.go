@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWTConfig enables bearer tokens that are JWTs signed by a trusted issuer.
+// Tokens must carry an exp claim and name the caller's role in RoleClaim.
+type JWTConfig struct {
+	// KeyFile holds the PEM public key tokens are signed with: RSA (RS*
+	// and PS*), ECDSA (ES*) or Ed25519 (EdDSA)
+	KeyFile string `json:"key_file"`
+	// HMACSecretFile holds the shared secret of HS* tokens instead
+	HMACSecretFile string `json:"hmac_secret_file"`
+	// Verifier checks signatures instead of KeyFile or HMACSecretFile,
+	// e.g. against keys fetched from the issuer
+	Verifier JWTVerifier `json:"-"`
+
+	// Issuer and Audience, when set, must match the iss and aud claims
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// RoleClaim names the claim holding the caller's role, "role" when
+	// empty
+	RoleClaim string `json:"role_claim"`
+	// Leeway tolerates clock skew when checking exp and nbf
+	Leeway time.Duration `json:"leeway"`
+}
+
+// JWTVerifier checks JWT signatures
+type JWTVerifier interface {
+	// Verify checks that sig is a signature of signed made with algorithm
+	// alg, e.g. "RS256", and the key kid, which may be empty
+	Verify(alg, kid string, signed, sig []byte) error
+}
+
+// errNotJWT is returned for tokens that aren't JWTs, e.g. static tokens
+var errNotJWT = fmt.Errorf("%w: not a JWT", ErrInvalidToken)
+
+// jwtAuthenticator authenticates callers by JWT
+type jwtAuthenticator struct {
+	config   JWTConfig
+	verifier JWTVerifier
+	now      func() time.Time
+}
+
+// NewJWTAuthenticator returns an Authenticator of JWTs per config
+func NewJWTAuthenticator(config JWTConfig) (Authenticator, error) {
+	verifier := config.Verifier
+	switch {
+	case verifier != nil:
+	case config.KeyFile != "" && config.HMACSecretFile != "":
+		return nil, errors.New("jwt: key_file and hmac_secret_file are exclusive")
+	case config.KeyFile != "":
+		var err error
+		if verifier, err = NewJWTKeyVerifier(config.KeyFile); err != nil {
+			return nil, err
+		}
+	case config.HMACSecretFile != "":
+		secret, err := os.ReadFile(config.HMACSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: failed to read HMAC secret: %w", err)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) < 32 {
+			return nil, errors.New("jwt: HMAC secret must be at least 32 bytes")
+		}
+		verifier = NewJWTHMACVerifier(secret)
+	default:
+		return nil, errors.New("jwt: needs key_file, hmac_secret_file or a verifier")
+	}
+	if config.RoleClaim == "" {
+		config.RoleClaim = "role"
+	}
+	return &jwtAuthenticator{config: config, verifier: verifier, now: time.Now}, nil
+}
+
+// jwtHeader is the JOSE header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the registered claims checked by jwtAuthenticator
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+}
+
+// jwtAudience is an aud claim, either a string or an array of them
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = jwtAudience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Authenticate implements Authenticator
+func (j *jwtAuthenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errNotJWT
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Identity{}, err
+	}
+	if header.Alg == "" || header.Alg == "none" {
+		return Identity{}, fmt.Errorf("%w: unsigned token", ErrInvalidToken)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := j.verifier.Verify(header.Alg, header.Kid, signed, sig); err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	// Only trust the payload once the signature checks out
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Identity{}, err
+	}
+	var raw map[string]any
+	if err := decodeJWTPart(parts[1], &raw); err != nil {
+		return Identity{}, err
+	}
+	if err := j.checkClaims(claims); err != nil {
+		return Identity{}, err
+	}
+	role, _ := raw[j.config.RoleClaim].(string)
+	if err := Role(role).validate(); err != nil {
+		return Identity{}, fmt.Errorf("%w: %s claim: %v", ErrInvalidToken, j.config.RoleClaim, err)
+	}
+	name := claims.Subject
+	if name == "" {
+		name = "unknown"
+	}
+	return Identity{Name: "jwt:" + name, Role: Role(role)}, nil
+}
+
+// checkClaims validates the time, issuer and audience claims
+func (j *jwtAuthenticator) checkClaims(c jwtClaims) error {
+	now := j.now()
+	if c.ExpiresAt == nil {
+		return fmt.Errorf("%w: no exp claim", ErrInvalidToken)
+	}
+	if now.After(jwtTime(*c.ExpiresAt).Add(j.config.Leeway)) {
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if c.NotBefore != nil && now.Before(jwtTime(*c.NotBefore).Add(-j.config.Leeway)) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if j.config.Issuer != "" && c.Issuer != j.config.Issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, c.Issuer)
+	}
+	if j.config.Audience != "" {
+		for _, aud := range c.Audience {
+			if aud == j.config.Audience {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: not issued for %q", ErrInvalidToken, j.config.Audience)
+	}
+	return nil
+}
+
+// jwtTime converts a NumericDate claim
+func jwtTime(secs float64) time.Time {
+	return time.Unix(0, 0).Add(time.Duration(secs * float64(time.Second)))
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: malformed encoding", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed JSON", ErrInvalidToken)
+	}
+	return nil
+}
+
+// jwtHash returns the hash of the RS, PS or ES algorithm alg, e.g. "RS256",
+// by its size suffix
+func jwtHash(alg string) (crypto.Hash, bool) {
+	switch alg[len(alg)-3:] {
+	case "256":
+		return crypto.SHA256, true
+	case "384":
+		return crypto.SHA384, true
+	case "512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// jwtKeyVerifier verifies signatures with a single public key, ignoring
+// the key ID
+type jwtKeyVerifier struct {
+	key crypto.PublicKey
+}
+
+// NewJWTKeyVerifier loads a PEM public key (PKIX) or certificate from path
+func NewJWTKeyVerifier(path string) (JWTVerifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt: no PEM data in %s", path)
+	}
+	var key crypto.PublicKey
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+		key = cert.PublicKey
+	default:
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("jwt: unsupported key type %T", key)
+	}
+	return jwtKeyVerifier{key: key}, nil
+}
+
+// Verify implements JWTVerifier
+func (v jwtKeyVerifier) Verify(alg, kid string, signed, sig []byte) error {
+	if alg == "EdDSA" {
+		key, ok := v.key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(key, signed, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h, ok := jwtHash(alg)
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hasher := h.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch key := v.key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(key, h, digest, sig) == nil {
+				return nil
+			}
+		case "PS":
+			if rsa.VerifyPSS(key, h, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+				return nil
+			}
+		default:
+			return fmt.Errorf("algorithm %q doesn't match RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			return fmt.Errorf("algorithm %q doesn't match ECDSA key", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if ecdsa.Verify(key, digest, r, s) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("algorithm %q doesn't match key", alg)
+	}
+	return errors.New("bad signature")
+}
+
+// jwtHMACVerifier verifies HS256, HS384 and HS512 signatures
+type jwtHMACVerifier []byte
+
+// NewJWTHMACVerifier returns a verifier of tokens signed with secret
+func NewJWTHMACVerifier(secret []byte) JWTVerifier {
+	return jwtHMACVerifier(secret)
+}
+
+// Verify implements JWTVerifier
+func (v jwtHMACVerifier) Verify(alg, kid string, signed, sig []byte) error {
+	var h func() hash.Hash
+	switch alg {
+	case "HS256":
+		h = sha256.New
+	case "HS384":
+		h = sha512.New384
+	case "HS512":
+		h = sha512.New
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	mac := hmac.New(h, v)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
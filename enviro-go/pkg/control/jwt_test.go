@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testJWTSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// signJWT returns a token of header and claims, signed by sign
+func signJWT(t *testing.T, header, claims map[string]any, sign func(signed []byte) []byte) string {
+	t.Helper()
+	var parts []string
+	for _, v := range []map[string]any{header, claims} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	}
+	signed := strings.Join(parts, ".")
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func signHS256(signed []byte) []byte {
+	mac := hmac.New(sha256.New, testJWTSecret)
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
+
+func TestJWTClaims(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	secs := func(d time.Duration) float64 { return float64(now.Add(d).Unix()) }
+
+	tests := []struct {
+		name     string
+		config   JWTConfig
+		claims   map[string]any
+		wantName string
+		wantRole Role
+		wantErr  string
+	}{
+		{
+			name:     "valid",
+			claims:   map[string]any{"sub": "alice", "role": "operator", "exp": secs(time.Hour)},
+			wantName: "jwt:alice",
+			wantRole: RoleOperator,
+		},
+		{
+			name:     "no subject",
+			claims:   map[string]any{"role": "read-only", "exp": secs(time.Hour)},
+			wantName: "jwt:unknown",
+			wantRole: RoleReadOnly,
+		},
+		{
+			name:    "no exp",
+			claims:  map[string]any{"sub": "alice", "role": "admin"},
+			wantErr: "no exp claim",
+		},
+		{
+			name:    "expired",
+			claims:  map[string]any{"sub": "alice", "role": "admin", "exp": secs(-time.Second)},
+			wantErr: "expired",
+		},
+		{
+			name:     "expired within leeway",
+			config:   JWTConfig{Leeway: time.Minute},
+			claims:   map[string]any{"sub": "alice", "role": "admin", "exp": secs(-30 * time.Second)},
+			wantName: "jwt:alice",
+			wantRole: RoleAdmin,
+		},
+		{
+			name:    "expired beyond leeway",
+			config:  JWTConfig{Leeway: time.Minute},
+			claims:  map[string]any{"sub": "alice", "role": "admin", "exp": secs(-2 * time.Minute)},
+			wantErr: "expired",
+		},
+		{
+			name:    "not valid yet",
+			claims:  map[string]any{"sub": "alice", "role": "admin", "exp": secs(time.Hour), "nbf": secs(time.Minute)},
+			wantErr: "not valid yet",
+		},
+		{
+			name:     "nbf within leeway",
+			config:   JWTConfig{Leeway: time.Minute},
+			claims:   map[string]any{"sub": "alice", "role": "admin", "exp": secs(time.Hour), "nbf": secs(30 * time.Second)},
+			wantName: "jwt:alice",
+			wantRole: RoleAdmin,
+		},
+		{
+			name:     "fractional exp",
+			claims:   map[string]any{"sub": "alice", "role": "admin", "exp": secs(0) + 0.5},
+			wantName: "jwt:alice",
+			wantRole: RoleAdmin,
+		},
+		{
+			name:     "issuer matches",
+			config:   JWTConfig{Issuer: "https://issuer"},
+			claims:   map[string]any{"iss": "https://issuer", "role": "admin", "exp": secs(time.Hour)},
+			wantName: "jwt:unknown",
+			wantRole: RoleAdmin,
+		},
+		{
+			name:    "issuer differs",
+			config:  JWTConfig{Issuer: "https://issuer"},
+			claims:  map[string]any{"iss": "https://other", "role": "admin", "exp": secs(time.Hour)},
+			wantErr: "unexpected issuer",
+		},
+		{
+			name:     "audience string",
+			config:   JWTConfig{Audience: "envyro"},
+			claims:   map[string]any{"aud": "envyro", "role": "admin", "exp": secs(time.Hour)},
+			wantName: "jwt:unknown",
+			wantRole: RoleAdmin,
+		},
+		{
+			name:     "audience array",
+			config:   JWTConfig{Audience: "envyro"},
+			claims:   map[string]any{"aud": []string{"other", "envyro"}, "role": "admin", "exp": secs(time.Hour)},
+			wantName: "jwt:unknown",
+			wantRole: RoleAdmin,
+		},
+		{
+			name:    "audience missing",
+			config:  JWTConfig{Audience: "envyro"},
+			claims:  map[string]any{"role": "admin", "exp": secs(time.Hour)},
+			wantErr: "not issued for",
+		},
+		{
+			name:    "no role",
+			claims:  map[string]any{"sub": "alice", "exp": secs(time.Hour)},
+			wantErr: "role claim",
+		},
+		{
+			name:    "unknown role",
+			claims:  map[string]any{"sub": "alice", "role": "root", "exp": secs(time.Hour)},
+			wantErr: "unknown role",
+		},
+		{
+			name:    "role not a string",
+			claims:  map[string]any{"sub": "alice", "role": []string{"admin"}, "exp": secs(time.Hour)},
+			wantErr: "role claim",
+		},
+		{
+			name:     "custom role claim",
+			config:   JWTConfig{RoleClaim: "envyro_role"},
+			claims:   map[string]any{"sub": "alice", "role": "read-only", "envyro_role": "admin", "exp": secs(time.Hour)},
+			wantName: "jwt:alice",
+			wantRole: RoleAdmin,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.Verifier = NewJWTHMACVerifier(testJWTSecret)
+			auth, err := NewJWTAuthenticator(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth.(*jwtAuthenticator).now = func() time.Time { return now }
+
+			token := signJWT(t, map[string]any{"alg": "HS256", "typ": "JWT"}, tt.claims, signHS256)
+			id, err := auth.Authenticate(context.Background(), token)
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrInvalidToken) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Authenticate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate(): %v", err)
+			}
+			if id.Name != tt.wantName || id.Role != tt.wantRole {
+				t.Errorf("Authenticate() = %+v, want name %s and role %s", id, tt.wantName, tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestJWTMalformed(t *testing.T) {
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	claims := map[string]any{"sub": "alice", "role": "admin", "exp": exp}
+	valid := signJWT(t, map[string]any{"alg": "HS256"}, claims, signHS256)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "static token", token: "not-a-jwt"},
+		{name: "too many parts", token: valid + ".x"},
+		{name: "unsigned", token: signJWT(t, map[string]any{"alg": "none"}, claims, func([]byte) []byte { return nil })},
+		{name: "no alg", token: signJWT(t, map[string]any{}, claims, signHS256)},
+		{name: "unsupported alg", token: signJWT(t, map[string]any{"alg": "HS128"}, claims, signHS256)},
+		{name: "bad signature", token: signJWT(t, map[string]any{"alg": "HS256"}, claims, func([]byte) []byte { return []byte("forged") })},
+		{name: "signature of other claims", token: strings.Join([]string{
+			strings.Split(valid, ".")[0],
+			base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","role":"admin","exp":9999999999}`)),
+			strings.Split(valid, ".")[2],
+		}, ".")},
+		{name: "malformed header", token: "!!!." + strings.SplitN(valid, ".", 2)[1]},
+		{name: "malformed signature", token: valid[:strings.LastIndex(valid, ".")] + ".!!!"},
+	}
+	auth, err := NewJWTAuthenticator(JWTConfig{Verifier: NewJWTHMACVerifier(testJWTSecret)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(context.Background(), valid); err != nil {
+		t.Fatalf("Authenticate(valid): %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := auth.Authenticate(context.Background(), tt.token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Authenticate() error = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestJWTKeyVerifier(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signES256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+	signEdDSA := func(signed []byte) []byte {
+		sig, err := edKey.Sign(rand.Reader, signed, crypto.Hash(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+
+	tests := []struct {
+		name  string
+		pub   crypto.PublicKey
+		alg   string
+		sign  func([]byte) []byte
+		valid bool
+	}{
+		{name: "ES256", pub: &ecKey.PublicKey, alg: "ES256", sign: signES256, valid: true},
+		{name: "EdDSA", pub: edPub, alg: "EdDSA", sign: signEdDSA, valid: true},
+		{name: "EdDSA with ECDSA key", pub: &ecKey.PublicKey, alg: "EdDSA", sign: signEdDSA},
+		{name: "RS256 with ECDSA key", pub: &ecKey.PublicKey, alg: "RS256", sign: signES256},
+		{name: "HS256 with ECDSA key", pub: &ecKey.PublicKey, alg: "HS256", sign: signHS256},
+	}
+	claims := map[string]any{"sub": "alice", "role": "admin", "exp": float64(time.Now().Add(time.Hour).Unix())}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			der, err := x509.MarshalPKIXPublicKey(tt.pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "key.pem")
+			if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			auth, err := NewJWTAuthenticator(JWTConfig{KeyFile: path})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token := signJWT(t, map[string]any{"alg": tt.alg}, claims, tt.sign)
+			_, err = auth.Authenticate(context.Background(), token)
+			if tt.valid && err != nil {
+				t.Errorf("Authenticate(): %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Authenticate() error = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestNewJWTAuthenticatorConfig(t *testing.T) {
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short")
+	long := filepath.Join(dir, "long")
+	if err := os.WriteFile(short, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(long, append(testJWTSecret, '\n'), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  JWTConfig
+		wantErr bool
+	}{
+		{name: "hmac secret", config: JWTConfig{HMACSecretFile: long}},
+		{name: "short hmac secret", config: JWTConfig{HMACSecretFile: short}, wantErr: true},
+		{name: "missing hmac secret", config: JWTConfig{HMACSecretFile: filepath.Join(dir, "none")}, wantErr: true},
+		{name: "key and secret", config: JWTConfig{KeyFile: long, HMACSecretFile: long}, wantErr: true},
+		{name: "key not PEM", config: JWTConfig{KeyFile: long}, wantErr: true},
+		{name: "nothing", config: JWTConfig{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewJWTAuthenticator(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewJWTAuthenticator() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
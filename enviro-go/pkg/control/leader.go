@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// LeaderHealthService is reported SERVING by the health service only on
+// the leader, so load balancers can route mutating RPCs to it. It is only
+// registered when a Coordinator is configured.
+const LeaderHealthService = "enviro.api.Leader"
+
+// NotLeaderReason is the ErrorInfo reason attached to RPCs rejected by
+// followers. Its metadata holds the leader's "leader_id" and
+// "leader_address" when one is known.
+const NotLeaderReason = "NOT_LEADER"
+
+// campaignRetry is the pause before campaigning again after an error
+const campaignRetry = time.Second
+
+// nodeServicePrefix prefixes the NodeService methods, which act on the
+// node serving them and so are allowed on followers
+const nodeServicePrefix = "/enviro.api.v1.NodeService/"
+
+// registryMethods are the NodeService methods changing the cluster's node
+// registry or identities, which only the leader keeps
+var registryMethods = map[string]bool{
+	"/enviro.api.v1.NodeService/RegisterNode":     true,
+	"/enviro.api.v1.NodeService/NodeHeartbeat":    true,
+	"/enviro.api.v1.NodeService/AllocateIdentity": true,
+	"/enviro.api.v1.NodeService/ReleaseIdentity":  true,
+}
+
+// leadership tracks the election of a control plane and rejects mutating
+// RPCs while it doesn't lead
+type leadership struct {
+	coord  Coordinator
+	events *eventBus
+	log    *slog.Logger
+	// changed is called with whether this control plane leads after every
+	// change of leader
+	changed func(leading bool)
+
+	mu      sync.Mutex
+	leader  Leader
+	leading bool
+	// lost wakes up the campaign when leadership was lost
+	lost chan struct{}
+	// loopMu guards cancel, which start and stop hand over
+	loopMu sync.Mutex
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+func newLeadership(coord Coordinator, events *eventBus, logger *slog.Logger) *leadership {
+	return &leadership{
+		coord:   coord,
+		events:  events,
+		log:     logger,
+		changed: func(bool) {},
+		lost:    make(chan struct{}, 1),
+	}
+}
+
+// start campaigns for leadership until stop is called, campaigning again
+// whenever leadership is lost
+func (l *leadership) start() {
+	l.loopMu.Lock()
+	defer l.loopMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+
+	l.done.Add(2)
+	go func() {
+		defer l.done.Done()
+		for leader := range l.coord.Watch(ctx) {
+			l.update(leader)
+		}
+	}()
+	go func() {
+		defer l.done.Done()
+		l.campaign(ctx)
+	}()
+}
+
+func (l *leadership) campaign(ctx context.Context) {
+	for {
+		if err := l.coord.Campaign(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			l.log.Warn("Leader campaign failed", "error", err)
+			select {
+			case <-time.After(campaignRetry):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-l.lost:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stop ends the campaign and resigns, so another control plane can take
+// over before this one drains
+func (l *leadership) stop(ctx context.Context) {
+	l.loopMu.Lock()
+	cancel := l.cancel
+	l.loopMu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	l.done.Wait()
+	if err := l.coord.Resign(ctx); err != nil {
+		l.log.Warn("Failed to resign leadership", "error", err)
+	}
+}
+
+// update records a change of leader, logging it and publishing an event
+func (l *leadership) update(leader Leader) {
+	leading := l.coord.IsLeader()
+
+	l.mu.Lock()
+	if leader == l.leader && leading == l.leading {
+		l.mu.Unlock()
+		return
+	}
+	wasLeading := l.leading
+	l.leader, l.leading = leader, leading
+	l.mu.Unlock()
+
+	switch {
+	case leading:
+		l.log.Info("Elected leader")
+	case leader.ID == "":
+		l.log.Warn("No leader elected")
+	default:
+		l.log.Info("Following leader", "leader", leader.ID, "leader_address", leader.Address)
+	}
+	if wasLeading && !leading {
+		select {
+		case l.lost <- struct{}{}:
+		default:
+		}
+	}
+	l.changed(leading)
+	l.events.publish(&pb.ContainerEvent{
+		Type:          pb.ContainerEventType_CONTAINER_EVENT_TYPE_LEADER_CHANGED,
+		Timestamp:     timestamppb.Now(),
+		LeaderId:      leader.ID,
+		LeaderAddress: leader.Address,
+	})
+}
+
+// current returns the known leader and whether this control plane leads
+func (l *leadership) current() (Leader, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader, l.leading
+}
+
+// serverOptions returns the interceptors rejecting mutating RPCs on
+// followers. Read-only, health and NodeService methods are always allowed,
+// except for registryMethods.
+func (l *leadership) serverOptions() []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := l.check(info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := l.check(info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+// check returns codes.FailedPrecondition, detailed with the leader, when
+// method mutates and this control plane doesn't lead
+func (l *leadership) check(method string) error {
+	method = canonicalMethod(method)
+	if readOnlyMethods[method] || strings.HasPrefix(method, healthMethodPrefix) ||
+		(strings.HasPrefix(method, nodeServicePrefix) && !registryMethods[method]) ||
+		strings.HasPrefix(method, imageServicePrefix) {
+		return nil
+	}
+	leader, leading := l.current()
+	if leading {
+		return nil
+	}
+
+	msg := "not the leader and no leader is elected"
+	info := &errdetails.ErrorInfo{Reason: NotLeaderReason, Domain: "enviro.api"}
+	if leader.ID != "" {
+		msg = "not the leader, the leader is " + leader.ID + " at " + leader.Address
+		info.Metadata = map[string]string{
+			"leader_id":      leader.ID,
+			"leader_address": leader.Address,
+		}
+	}
+	st, err := status.New(codes.FailedPrecondition, msg).WithDetails(info)
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, msg)
+	}
+	return st.Err()
+}
+
+// Leader returns the elected leader, and whether this control plane is it.
+// Without a Coordinator every control plane leads itself.
+func (cp *ControlPlane) Leader() (Leader, bool) {
+	if cp.leadership == nil {
+		return Leader{Address: cp.address}, true
+	}
+	return cp.leadership.current()
+}
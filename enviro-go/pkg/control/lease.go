@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// RenewLease renews the lease of the addresses of a container of this
+// node, see network.LeaseConfig
+func (s *containerService) RenewLease(ctx context.Context, req *pb.RenewLeaseRequest) (*pb.RenewLeaseResponse, error) {
+	s.mu.Lock()
+	c, ok := s.containers[req.GetId()]
+	var node string
+	if ok {
+		node = c.Node
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetId())
+	}
+	if node != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %q is placed on node %s, renew its lease there", req.Id, node)
+	}
+	if err := s.network.RenewLease(req.Id); err != nil {
+		return nil, networkError(err)
+	}
+	return &pb.RenewLeaseResponse{}, nil
+}
+
+// leaseReclaimed fails the container whose network r deleted as its lease
+// expired
+func (s *containerService) leaseReclaimed(r network.LeaseReclaim) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.containers[r.ContainerID]
+	if !ok || c.Node != "" {
+		return
+	}
+	s.log.Warn("Container network lease expired", "container_id", r.ContainerID, "renewed", r.Renewed)
+	c.State = pb.ContainerState_CONTAINER_STATE_FAILED
+	c.Error = "network lease expired"
+	s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_LEASE_RECLAIMED, c)
+}
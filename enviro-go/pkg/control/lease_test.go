@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+func TestLeaseReclaimed(t *testing.T) {
+	tests := []struct {
+		name      string
+		container *pb.Container
+		wantState pb.ContainerState
+		wantEvent bool
+	}{
+		{name: "local", container: &pb.Container{Id: "c1", State: pb.ContainerState_CONTAINER_STATE_READY},
+			wantState: pb.ContainerState_CONTAINER_STATE_FAILED, wantEvent: true},
+		{name: "other node", container: &pb.Container{Id: "c1", Node: "n2", State: pb.ContainerState_CONTAINER_STATE_READY},
+			wantState: pb.ContainerState_CONTAINER_STATE_READY},
+		{name: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &containerService{
+				log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+				events:     newEventBus(),
+				containers: map[string]*pb.Container{},
+			}
+			if tt.container != nil {
+				s.containers[tt.container.Id] = tt.container
+			}
+			sub, _, err := s.events.subscribe(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.leaseReclaimed(network.LeaseReclaim{ContainerID: "c1", IPv4: "10.88.0.2"})
+
+			if tt.container != nil && tt.container.State != tt.wantState {
+				t.Errorf("state %s, want %s", tt.container.State, tt.wantState)
+			}
+			select {
+			case ev := <-sub.ch:
+				if !tt.wantEvent || ev.Type != pb.ContainerEventType_CONTAINER_EVENT_TYPE_LEASE_RECLAIMED {
+					t.Errorf("event %s, want event %v", ev.Type, tt.wantEvent)
+				}
+				if ev.GetContainer().GetError() != "network lease expired" {
+					t.Errorf("container error %q", ev.GetContainer().GetError())
+				}
+			default:
+				if tt.wantEvent {
+					t.Error("no event published")
+				}
+			}
+		})
+	}
+}
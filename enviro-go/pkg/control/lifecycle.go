@@ -0,0 +1,78 @@
+package main
+
+import "net"
+
+// State is the serving state of a ControlPlane
+type State int
+
+const (
+	// StateCreated means the listener is bound but Start has not been called
+	StateCreated State = iota
+	// StateServing means the gRPC server is accepting requests
+	StateServing
+	// StateStopping means Stop is draining the server or running hooks
+	StateStopping
+	// StateStopped means Stop has completed
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateCreated:
+		return "created"
+	case StateServing:
+		return "serving"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the current serving state
+func (cp *ControlPlane) State() State {
+	cp.stateMu.Lock()
+	defer cp.stateMu.Unlock()
+	return cp.state
+}
+
+// Addr returns the bound listener address. This is the actual port when
+// the control plane was configured with port 0.
+func (cp *ControlPlane) Addr() net.Addr {
+	return cp.listener.Addr()
+}
+
+// OnShutdown registers fn to run once the server has drained, before Stop
+// returns. Hooks run in registration order; a panicking hook is logged and
+// does not prevent the remaining hooks from running.
+func (cp *ControlPlane) OnShutdown(fn func()) {
+	cp.stateMu.Lock()
+	defer cp.stateMu.Unlock()
+	cp.hooks = append(cp.hooks, fn)
+}
+
+func (cp *ControlPlane) setState(s State) {
+	cp.stateMu.Lock()
+	defer cp.stateMu.Unlock()
+	cp.state = s
+}
+
+func (cp *ControlPlane) runShutdownHooks() {
+	cp.stateMu.Lock()
+	hooks := cp.hooks
+	cp.hooks = nil
+	cp.stateMu.Unlock()
+
+	for i, fn := range hooks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					cp.log.Error("Shutdown hook panicked", "hook", i, "panic", r)
+				}
+			}()
+			fn()
+		}()
+	}
+}
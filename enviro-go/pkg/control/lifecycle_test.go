@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestControlPlane creates a control plane on a socket of its own with
+// the network deferred, so the datapath stays off the host
+func newTestControlPlane(t *testing.T) *ControlPlane {
+	t.Helper()
+	cp, err := NewControlPlaneWithConfig(ControlPlaneConfig{
+		Address:      "unix://" + filepath.Join(t.TempDir(), "enviro.sock"),
+		DeferNetwork: true,
+		StateDir:     t.TempDir(),
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+// TestLifecycle starts and stops a control plane twice over, with the
+// shutdown hooks run once and in order and State following along
+func TestLifecycle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cp := newTestControlPlane(t)
+	if got := cp.State(); got != StateCreated {
+		t.Errorf("State() after creating = %s, want %s", got, StateCreated)
+	}
+
+	var ran []int
+	hook := func(i int) func() {
+		return func() { ran = append(ran, i) }
+	}
+	cp.OnShutdown(hook(1))
+	// A panicking hook keeps neither the ones after it from running nor
+	// Stop from finishing
+	cp.OnShutdown(func() { panic("hook failed") })
+	cp.OnShutdown(hook(2))
+	cp.OnShutdown(hook(3))
+
+	started := make(chan error, 1)
+	go func() { started <- cp.Start(ctx) }()
+	if err := cp.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := cp.State(); got != StateServing {
+		t.Errorf("State() after starting = %s, want %s", got, StateServing)
+	}
+	if err := cp.Start(ctx); err == nil {
+		t.Error("second Start() succeeded")
+	}
+	if len(ran) != 0 {
+		t.Errorf("hooks %v ran before Stop", ran)
+	}
+
+	for _, step := range []string{"Stop()", "second Stop()"} {
+		if err := cp.Stop(ctx); err != nil {
+			t.Errorf("%s = %v", step, err)
+		}
+		if want := []int{1, 2, 3}; !slices.Equal(ran, want) {
+			t.Errorf("hooks ran %v after %s, want %v", ran, step, want)
+		}
+		if got := cp.State(); got != StateStopped {
+			t.Errorf("State() after %s = %s, want %s", step, got, StateStopped)
+		}
+	}
+	select {
+	case <-cp.Done():
+	default:
+		t.Error("Done() not closed after Stop")
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Start() = %v after Stop", err)
+	}
+	if err := cp.Start(ctx); err == nil {
+		t.Error("Start() after Stop succeeded")
+	}
+}
+
+// TestStopBeforeStart stops a control plane that never started, which
+// runs the hooks and leaves it unable to start
+func TestStopBeforeStart(t *testing.T) {
+	cp := newTestControlPlane(t)
+	ran := 0
+	cp.OnShutdown(func() { ran++ })
+	if err := cp.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 1 {
+		t.Errorf("hook ran %d times, want 1", ran)
+	}
+	if got := cp.State(); got != StateStopped {
+		t.Errorf("State() = %s, want %s", got, StateStopped)
+	}
+	if err := cp.Start(context.Background()); err == nil {
+		t.Error("Start() after Stop succeeded")
+	}
+}
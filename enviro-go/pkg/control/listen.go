@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// unixScheme prefixes addresses of unix sockets, e.g.
+// unix:///run/enviro/enviro.sock
+const unixScheme = "unix://"
+
+// defaultSocketMode lets the socket's owner and group connect
+const defaultSocketMode = 0o660
+
+// ListenRetry controls retrying a bind that fails with EADDRINUSE, which
+// commonly happens when systemd restarts us before the old instance has
+// released the port.
+type ListenRetry struct {
+	// Attempts is the number of extra attempts after the first failure
+	Attempts int `json:"attempts"`
+	// Backoff is the delay before the first retry, doubled each attempt
+	Backoff time.Duration `json:"backoff"`
+}
+
+// SocketConfig sets the permissions of the socket file when the control
+// plane listens on a unix socket. Only callers that may write to the socket
+// can connect, so its group is a simple way to grant local access.
+type SocketConfig struct {
+	// Mode is the octal file mode, e.g. "0600", defaults to "0660"
+	Mode string `json:"mode"`
+	// User and Group own the socket, as names or numeric IDs. Empty
+	// leaves them to the process.
+	User  string `json:"user"`
+	Group string `json:"group"`
+}
+
+// apply sets the mode and ownership of the socket at path
+func (c SocketConfig) apply(path string) error {
+	mode := uint64(defaultSocketMode)
+	if c.Mode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(c.Mode, 8, 32); err != nil || mode > 0o777 {
+			return fmt.Errorf("invalid socket mode %q", c.Mode)
+		}
+	}
+	if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+		return err
+	}
+
+	uid, gid := -1, -1
+	if c.User != "" {
+		id, err := lookupID(c.User, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid socket user: %w", err)
+		}
+		uid = id
+	}
+	if c.Group != "" {
+		id, err := lookupID(c.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid socket group: %w", err)
+		}
+		gid = id
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// lookupID returns the numeric ID name is, or that lookup finds for it
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	s, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
+
+// removeStaleSocket removes the socket at path if no one listens on it,
+// e.g. after a crash, so it can be bound again. A live socket is left
+// for the bind to fail with EADDRINUSE.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&fs.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(path)
+	}
+}
+
+// BindError describes why the control plane listener could not be bound.
+type BindError struct {
+	// Address is the address as configured
+	Address string
+	// Resolved is the resolved address, empty if resolution failed
+	Resolved string
+	// Syscall is the failing system call, e.g. "bind" or "listen"
+	Syscall string
+	// Holder identifies the process holding the port, when known
+	Holder string
+	Err    error
+}
+
+func (e *BindError) Error() string {
+	msg := fmt.Sprintf("failed to listen on %s", e.Address)
+	if e.Resolved != "" && e.Resolved != e.Address {
+		msg += fmt.Sprintf(" (resolved %s)", e.Resolved)
+	}
+	if e.Syscall != "" {
+		msg += fmt.Sprintf(": %s: %v", e.Syscall, errors.Unwrap(e.Err))
+	} else {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	if e.Holder != "" {
+		msg += "; port held by " + e.Holder
+	}
+	return msg
+}
+
+func (e *BindError) Unwrap() error { return e.Err }
+
+// listen binds address, retrying on EADDRINUSE according to retry.
+// Addresses starting with unix:// are unix sockets, set up per socket.
+func listen(address string, retry ListenRetry, socket SocketConfig, logger *slog.Logger) (net.Listener, error) {
+	network, addr := "tcp", address
+	if path, ok := strings.CutPrefix(address, unixScheme); ok {
+		network, addr = "unix", path
+	}
+
+	backoff := retry.Backoff
+	for attempt := 0; ; attempt++ {
+		if network == "unix" {
+			removeStaleSocket(addr)
+		}
+		listener, err := net.Listen(network, addr)
+		if err == nil && network == "unix" {
+			if err := socket.apply(addr); err != nil {
+				listener.Close()
+				return nil, &BindError{Address: address, Err: err}
+			}
+		}
+		if err == nil {
+			return listener, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) || attempt >= retry.Attempts {
+			return nil, newBindError(address, err)
+		}
+		logger.Warn("Address in use, retrying", "address", address, "backoff", backoff, "attempt", attempt+1, "attempts", retry.Attempts)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func newBindError(address string, err error) *BindError {
+	be := &BindError{Address: address, Err: err}
+
+	var sysErr *os.SyscallError
+	if errors.As(err, &sysErr) {
+		be.Syscall = sysErr.Syscall
+		be.Err = sysErr
+	}
+
+	if strings.HasPrefix(address, unixScheme) {
+		return be
+	}
+	addr, resolveErr := net.ResolveTCPAddr("tcp", address)
+	if resolveErr != nil {
+		return be
+	}
+	be.Resolved = addr.String()
+
+	if errors.Is(err, syscall.EADDRINUSE) {
+		be.Holder = findPortHolder(addr.Port)
+	}
+	return be
+}
@@ -0,0 +1,72 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpListen is the st value of a listening socket in /proc/net/tcp
+const tcpListen = "0A"
+
+// findPortHolder returns "pid N (comm)" for the process listening on port,
+// or "" if it cannot be determined. Best effort: other users' processes are
+// only visible when running as root.
+func findPortHolder(port int) string {
+	inode := listeningInode("/proc/net/tcp", port)
+	if inode == "" {
+		inode = listeningInode("/proc/net/tcp6", port)
+	}
+	if inode == "" {
+		return ""
+	}
+
+	target := "socket:[" + inode + "]"
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || link != target {
+			continue
+		}
+		procDir := filepath.Dir(filepath.Dir(fd))
+		pid := filepath.Base(procDir)
+		comm, _ := os.ReadFile(filepath.Join(procDir, "comm"))
+		return fmt.Sprintf("pid %s (%s)", pid, strings.TrimSpace(string(comm)))
+	}
+	return "inode " + inode
+}
+
+// listeningInode scans a /proc/net/tcp style table for a listening socket on
+// port and returns its inode.
+func listeningInode(path string, port int) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+		local := fields[1]
+		i := strings.LastIndexByte(local, ':')
+		if i < 0 {
+			continue
+		}
+		p, err := strconv.ParseUint(local[i+1:], 16, 16)
+		if err != nil || int(p) != port {
+			continue
+		}
+		return fields[9]
+	}
+	return ""
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFindPortHolder(t *testing.T) {
+	held := occupy(t)
+	_, err := listen(held.Addr().String(), ListenRetry{}, SocketConfig{}, nil)
+	want := fmt.Sprintf("; port held by pid %d (", os.Getpid())
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("listen() = %v, want the holder %q", err, want)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// findPortHolder is only implemented on Linux.
+func findPortHolder(port int) string {
+	return ""
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// occupy listens on a free port of the loopback until the test ends
+func occupy(t *testing.T) net.Listener {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	return lis
+}
+
+func TestListenInUse(t *testing.T) {
+	held := occupy(t)
+	addr := held.Addr().String()
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	start := time.Now()
+	_, err := listen(addr, ListenRetry{Attempts: 2, Backoff: 10 * time.Millisecond}, SocketConfig{}, logger)
+	var be *BindError
+	if !errors.As(err, &be) {
+		t.Fatalf("listen() = %v, want a BindError", err)
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("listen() = %v, want %v", err, syscall.EADDRINUSE)
+	}
+	if be.Address != addr || be.Resolved != addr || be.Syscall != "bind" {
+		t.Errorf("BindError{Address: %q, Resolved: %q, Syscall: %q}, want %s resolved as is and bind", be.Address, be.Resolved, be.Syscall, addr)
+	}
+	if want := "failed to listen on " + addr + ": bind: address already in use"; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("listen() = %q, want it to start with %q", err, want)
+	}
+	// Two retries back off 10ms and 20ms
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("listen() gave up after %v, want it to retry for 30ms", elapsed)
+	}
+	if got := strings.Count(logs.String(), "Address in use, retrying"); got != 2 {
+		t.Errorf("logged %d retries, want 2: %s", got, logs.String())
+	}
+}
+
+func TestListenRetry(t *testing.T) {
+	held := occupy(t)
+	addr := held.Addr().String()
+	// The port is released while listen backs off
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		held.Close()
+	}()
+
+	lis, err := listen(addr, ListenRetry{Attempts: 8, Backoff: 5 * time.Millisecond}, SocketConfig{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("listen() = %v, want it bound once released", err)
+	}
+	defer lis.Close()
+	if lis.Addr().String() != addr {
+		t.Errorf("listening on %s, want %s", lis.Addr(), addr)
+	}
+
+	// Without retries the first failure is returned
+	_, err = listen(addr, ListenRetry{}, SocketConfig{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("listen() without retries = %v, want %v", err, syscall.EADDRINUSE)
+	}
+}
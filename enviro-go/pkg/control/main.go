@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// main runs the control plane as a standalone server.
+//
+// When built with -buildmode=c-shared this is never called; the Rust
+// runtime drives the control plane through the FFI exports instead.
+func main() {
+	configFile := flag.String("config", "", "YAML, TOML or JSON config file, overridden by ENVIRO_ environment variables and exclusive with the other flags; SIGHUP reloads it")
+	addr := flag.String("addr", DefaultAddress, "address to serve gRPC on, or unix:///path/to/socket")
+	socketMode := flag.String("socket-mode", "", "octal mode of a unix socket, default 0660")
+	socketUser := flag.String("socket-user", "", "user owning a unix socket")
+	socketGroup := flag.String("socket-group", "", "group owning a unix socket")
+	cidr := flag.String("cidr", DefaultCIDR, "container network CIDR, IPv4 or IPv6")
+	stateDir := flag.String("state-dir", "", "directory to persist containers, their networks, policies and services in")
+	restoreFrom := flag.String("restore-from", "", "restore the state dir from this backup file or http(s) URL before starting")
+	logDir := flag.String("log-dir", "", "directory the runtime writes container logs to")
+	cidr6 := flag.String("cidr6", "", "IPv6 container network CIDR for dual-stack")
+	serviceCIDR := flag.String("service-cidr", "", "IPv4 network service VIPs are taken from, which must not overlap the container networks")
+	serviceCIDR6 := flag.String("service-cidr6", "", "IPv6 network service VIPs are taken from, like -service-cidr")
+	iface := flag.String("xdp-interface", "", "attach the XDP router to this interface")
+	analytics := flag.Bool("flow-analytics", false, "rank the flows to containers by their traffic, needs XDP")
+	datapathMode := flag.String("datapath-mode", "", "first mode to attach the XDP router in: native, generic or tc, or userspace to forward without it")
+	runAs := flag.String("user", "", "user to drop to once the datapath is initialized, keeping only the capabilities the network still needs")
+	runAsGroup := flag.String("group", "", "group to drop to with -user, default the user's primary group")
+	rootless := flag.String("rootless", "off", "connect containers with slirp4netns: off, auto without CAP_NET_ADMIN, or on")
+	sriovPFs := flag.String("sriov-pfs", "", "comma-separated SR-IOV physical functions whose VFs containers can be attached to")
+	macvlanParent := flag.String("macvlan-parent", "", "interface to create the macvlans of containers on, default the first of -sriov-pfs or -xdp-interface")
+	macvlanFallback := flag.Bool("macvlan-fallback", false, "attach SR-IOV containers with macvlan when no VF is free")
+	ipam := flag.String("ipam", network.IPAMHostLocal, "backend allocating container addresses: host-local, dhcp or external")
+	dhcpServer := flag.String("dhcp-server", "", "DHCP server to lease container IPv4 addresses from with -ipam dhcp, as host[:port]")
+	dhcpRelay := flag.String("dhcp-relay-address", "", "address of this host the DHCP server replies to, default the first IPv4 address of -xdp-interface")
+	ipamPlugin := flag.String("ipam-plugin", "", "address of the gRPC IPAM plugin allocating container addresses with -ipam external")
+	ipamPluginURL := flag.String("ipam-plugin-url", "", "URL of the HTTP IPAM plugin allocating container addresses with -ipam external, in place of -ipam-plugin")
+	ipamPluginCA := flag.String("ipam-plugin-ca", "", "CA file verifying the IPAM plugin's certificate, calling it over TLS")
+	ipamPluginRetries := flag.Int("ipam-plugin-retries", 0, "extra attempts of IPAM plugin calls failing while it can't be reached")
+	ipamFailure := flag.String("ipam-failure-policy", network.IPAMFailClosed, "what allocations do while the IPAM backend is unavailable: fail-closed or emergency-pool")
+	ipamEmergency := flag.String("ipam-emergency-ranges", "", "comma-separated CIDRs of the pools allocated from with -ipam-failure-policy emergency-pool")
+	warmPoolSize := flag.Int("warm-pool-size", 0, "veth pairs to keep ready for containers to take, 0 to create each on demand")
+	verifyOnCreate := flag.Bool("verify-network-on-create", false, "check that container networks carry traffic before creates return, deleting those that don't")
+	readinessTimeout := flag.Duration("network-readiness-timeout", network.DefaultReadinessTimeout, "how long container networks may take to carry traffic once created")
+	ipamReconcile := flag.String("ipam-reconcile", "", "reconcile the addresses the IPAM backend holds with those of the containers periodically: report or repair")
+	certFile := flag.String("tls-cert", "", "TLS certificate file")
+	keyFile := flag.String("tls-key", "", "TLS private key file")
+	clientCA := flag.String("tls-client-ca", "", "CA file for verifying client certificates")
+	requireClientCert := flag.Bool("tls-require-client-cert", false, "require client certificates (mTLS)")
+	spiffeIDs := flag.String("tls-allowed-spiffe-ids", "", "comma-separated SPIFFE IDs or trust domains client certificates must match")
+	certReload := flag.Duration("tls-reload-interval", DefaultCertReloadInterval, "check TLS files for changes this often, negative to only reload on SIGHUP")
+	tokenFile := flag.String("auth-token-file", "", "file of bearer tokens and their roles")
+	jwtKey := flag.String("auth-jwt-key", "", "PEM public key verifying JWT bearer tokens")
+	jwtSecret := flag.String("auth-jwt-hmac-secret", "", "file of the shared secret verifying HMAC-signed JWT bearer tokens")
+	jwtIssuer := flag.String("auth-jwt-issuer", "", "required iss claim of JWT bearer tokens")
+	jwtAudience := flag.String("auth-jwt-audience", "", "required aud claim of JWT bearer tokens")
+	auditLog := flag.String("audit-log", "", "file to record mutating RPCs and their callers in")
+	auditKey := flag.String("audit-key-file", "", "file of the secret key the audit log's hash chain is computed with")
+	chaos := flag.Bool("chaos", false, "let admins inject faults into containers and the API, for game days")
+	imageDir := flag.String("image-dir", "", "directory to cache pulled images in, default images of the state dir")
+	registryAuth := flag.String("registry-auth-file", "", "docker config.json holding the credentials of registries images are pulled from")
+	plainHTTP := flag.String("insecure-registries", "", "comma-separated registries to pull images from over HTTP")
+	cgroupRoot := flag.String("cgroup-root", "", "directory holding the cgroup v2 group of each container, named by its ID, default /sys/fs/cgroup")
+	statsInterval := flag.Duration("stats-interval", DefaultStatsInterval, "how often streams of container stats sample unless the client asks otherwise")
+	rateLimit := flag.Float64("rate-limit", 0, "requests per second each client may make, 0 for no limit")
+	rateBurst := flag.Int("rate-burst", 0, "requests each client may make at once before -rate-limit applies, default the rate")
+	maxInFlight := flag.Int("max-in-flight", 0, "requests and streams each client may have in flight, 0 for no limit")
+	keepaliveTime := flag.Duration("keepalive-time", DefaultKeepaliveTime, "ping clients idle for this long")
+	keepaliveMinTime := flag.Duration("keepalive-min-time", DefaultKeepaliveMinTime, "shortest interval clients may ping at")
+	rpcDeadline := flag.Duration("rpc-deadline", DefaultRPCDeadline, "deadline of RPCs whose client set none, negative for none; streams are exempt")
+	rpcMaxDeadline := flag.Duration("rpc-max-deadline", 0, "cut longer deadlines set by clients to this, 0 for no limit")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on")
+	gatewayAddr := flag.String("gateway-addr", "", "address to serve the API as JSON over HTTP on")
+	traceEndpoint := flag.String("trace-endpoint", "", "OTLP/gRPC collector to export traces to, e.g. localhost:4317")
+	traceInsecure := flag.Bool("trace-insecure", false, "export traces without TLS")
+	raftID := flag.String("raft-id", "", "join the Raft cluster of -raft-peers as this peer")
+	raftDir := flag.String("raft-dir", "", "directory to keep the Raft log and snapshots in")
+	raftBind := flag.String("raft-bind", "", "address the Raft transport listens on, default the peer's raft address")
+	raftPeers := flag.String("raft-peers", "", "comma-separated Raft peers as id=raft-host:port=grpc-address, this one included")
+	schedulerToken := flag.String("scheduler-token-file", "", "file of the bearer token to create scheduled containers on nodes with")
+	heartbeat := flag.Duration("node-heartbeat-interval", DefaultHeartbeatInterval, "how often registered nodes heartbeat")
+	retries := flag.Int("listen-retries", 0, "retries while the address is in use")
+	backoff := flag.Duration("listen-backoff", 100*time.Millisecond, "initial delay between listen retries")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	logLevels := flag.String("log-levels", "", "comma-separated levels of subsystems overriding -log-level, e.g. raft=warn,network=debug")
+	flag.Parse()
+
+	var config ControlPlaneConfig
+	if *configFile != "" {
+		var set []string
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "config" {
+				set = append(set, "-"+f.Name)
+			}
+		})
+		if len(set) > 0 {
+			fmt.Fprintf(os.Stderr, "-config can't be combined with %s\n", strings.Join(set, ", "))
+			os.Exit(2)
+		}
+		var err error
+		if config, err = LoadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		subsystemLevels, err := logging.ParseLevels(*logLevels)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		auth := AuthConfig{TokenFile: *tokenFile}
+		if *jwtKey != "" || *jwtSecret != "" {
+			auth.JWT = &JWTConfig{
+				KeyFile:        *jwtKey,
+				HMACSecretFile: *jwtSecret,
+				Issuer:         *jwtIssuer,
+				Audience:       *jwtAudience,
+			}
+		}
+
+		var raftConfig *RaftConfig
+		if *raftID != "" {
+			peers, err := parseRaftPeers(*raftPeers)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid -raft-peers: %v\n", err)
+				os.Exit(2)
+			}
+			raftConfig = &RaftConfig{ID: *raftID, Dir: *raftDir, BindAddress: *raftBind, Peers: peers}
+		}
+
+		config = ControlPlaneConfig{
+			LogLevel:    *logLevel,
+			LogFormat:   *logFormat,
+			LogLevels:   subsystemLevels,
+			Address:     *addr,
+			ListenRetry: ListenRetry{Attempts: *retries, Backoff: *backoff},
+			Socket:      SocketConfig{Mode: *socketMode, User: *socketUser, Group: *socketGroup},
+			StateDir:    *stateDir,
+			RestoreFrom: *restoreFrom,
+			LogDir:      *logDir,
+			Privileges:  PrivilegeConfig{User: *runAs, Group: *runAsGroup},
+			Network: network.NetworkConfig{
+				CIDR:         *cidr,
+				CIDR6:        *cidr6,
+				ServiceCIDR:  *serviceCIDR,
+				ServiceCIDR6: *serviceCIDR6,
+				EnableXDP:    *iface != "",
+				Interface:    *iface,
+				DatapathMode: network.DatapathMode(*datapathMode),
+				Rootless:     network.RootlessConfig{Mode: network.RootlessMode(*rootless)},
+				Analytics:    network.AnalyticsConfig{Enable: *analytics},
+				Devices: network.DeviceConfig{
+					PhysicalFunctions: splitList(*sriovPFs),
+					MacvlanParent:     *macvlanParent,
+					MacvlanFallback:   *macvlanFallback,
+				},
+				IPAM: network.IPAMConfig{
+					Backend:         *ipam,
+					DHCP:            network.DHCPConfig{Server: *dhcpServer, RelayAddress: *dhcpRelay},
+					FailurePolicy:   *ipamFailure,
+					EmergencyRanges: splitList(*ipamEmergency),
+					Reconcile:       network.IPAMReconcileConfig{Mode: *ipamReconcile},
+				},
+				WarmPool:  network.WarmPoolConfig{Size: *warmPoolSize},
+				Readiness: network.ReadinessConfig{VerifyOnCreate: *verifyOnCreate, Timeout: *readinessTimeout},
+			},
+			IPAMPlugin:         IPAMPluginConfig{Address: *ipamPlugin, URL: *ipamPluginURL, CAFile: *ipamPluginCA, Retries: *ipamPluginRetries},
+			CertFile:           *certFile,
+			KeyFile:            *keyFile,
+			ClientCAFile:       *clientCA,
+			RequireClientCert:  *requireClientCert,
+			AllowedSPIFFEIDs:   splitList(*spiffeIDs),
+			CertReloadInterval: *certReload,
+			Auth:               auth,
+			Audit:              AuditConfig{Path: *auditLog, KeyFile: *auditKey},
+			Chaos:              ChaosConfig{Enable: *chaos},
+			Images:             ImageConfig{Dir: *imageDir, AuthFile: *registryAuth, PlainHTTP: splitList(*plainHTTP)},
+			Stats:              StatsConfig{CgroupRoot: *cgroupRoot, Interval: *statsInterval},
+			RateLimit:          RateLimitConfig{Default: RateLimit{Rate: *rateLimit, Burst: *rateBurst, MaxInFlight: *maxInFlight}},
+			Server:             ServerConfig{Keepalive: KeepaliveConfig{Time: *keepaliveTime, MinTime: *keepaliveMinTime}, Deadlines: DeadlineConfig{Default: *rpcDeadline, Max: *rpcMaxDeadline}},
+			MetricsAddress:     *metricsAddr,
+			GatewayAddress:     *gatewayAddr,
+			Tracing:            TracingConfig{Endpoint: *traceEndpoint, Insecure: *traceInsecure},
+			Raft:               raftConfig,
+			Nodes:              NodeRegistryConfig{HeartbeatInterval: *heartbeat},
+			Scheduler:          SchedulerConfig{TokenFile: *schedulerToken},
+		}
+	}
+
+	level, err := logging.ParseLevel(config.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	levelVar := new(slog.LevelVar)
+	levelVar.Set(level)
+	logger, err := logging.NewLeveled(os.Stderr, levelVar, config.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	config.Logger, config.LogLevelVar = logger, levelVar
+
+	cp, err := NewControlPlaneWithConfig(config)
+	if err != nil {
+		logger.Error("Failed to initialize control plane", "error", err)
+		os.Exit(1)
+	}
+	// A failed drop can leave the process short of privileges either way
+	if err := cp.DropPrivileges(); err != nil {
+		logger.Error("Failed to drop privileges", "error", err)
+		os.Exit(1)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				// Without a config file only the TLS files can have changed
+				reloaded := config
+				if *configFile != "" {
+					var err error
+					if reloaded, err = LoadConfig(*configFile); err != nil {
+						logger.Error("Failed to reload config", "error", err)
+						continue
+					}
+				}
+				if _, err := cp.Reload(reloaded); err != nil {
+					logger.Error("Failed to reload config", "error", err)
+				}
+				continue
+			}
+			// SIGTERM only rejects new containers until the requests in
+			// flight finish, SIGINT rejects every new request at once
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+			if sig == syscall.SIGTERM {
+				cp.Drain(ctx)
+			} else {
+				cp.Stop(ctx)
+			}
+			cancel()
+			return
+		}
+	}()
+
+	// Start returns once a signal stopped the control plane
+	if err := cp.Start(context.Background()); err != nil {
+		logger.Error("Control plane error", "error", err)
+		os.Exit(1)
+	}
+}
+
+// parseRaftPeers parses the peers of -raft-peers
+func parseRaftPeers(s string) ([]RaftPeer, error) {
+	var peers []RaftPeer
+	for _, p := range splitList(s) {
+		parts := strings.SplitN(p, "=", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid raft peer %q, want id=raft-host:port=grpc-address", p)
+		}
+		peers = append(peers, RaftPeer{ID: parts[0], RaftAddress: parts[1], Address: parts[2]})
+	}
+	return peers, nil
+}
+
+// splitList splits a comma-separated flag value, nil when empty
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/client"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// metricsNamespace prefixes every exported metric name
+const metricsNamespace = "enviro"
+
+// metrics serves the Prometheus endpoint and records gRPC request metrics
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	listener net.Listener
+	server   *http.Server
+	log      *slog.Logger
+}
+
+// newMetrics binds address and registers the control plane collectors,
+// those of store unless nil. Nothing is served until serve is called.
+func newMetrics(address string, nm *network.NetworkManager, events *eventBus, pool *client.Pool, store *storage.Store, logger *slog.Logger) (*metrics, error) {
+	m := &metrics{
+		log:      logger,
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "grpc",
+			Name:      "requests_total",
+			Help:      "gRPC requests handled, by method and status code.",
+		}, []string{"method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "grpc",
+			Name:      "request_duration_seconds",
+			Help:      "gRPC request latency, by method.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"method"}),
+	}
+	// The metrics of a network instance carry its name, for when the
+	// control planes of several instances are scraped together
+	var registerer prometheus.Registerer = m.registry
+	if instance := nm.Instance(); instance != "" {
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels{"network_instance": instance}, m.registry)
+	}
+	registerer.MustRegister(
+		m.requests,
+		m.latency,
+		newNetworkCollector(nm),
+		newPeerCollector(pool),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "events",
+			Name:      "dropped_total",
+			Help:      "Container events dropped because a watcher fell behind.",
+		}, func() float64 { return float64(events.dropped.Load()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if store != nil {
+		registerer.MustRegister(storageMetrics(store)...)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	m.listener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	m.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return m, nil
+}
+
+// serve runs the metrics endpoint until shutdown is called
+func (m *metrics) serve() {
+	m.log.Info("Serving metrics", "address", m.listener.Addr().String(), "path", "/metrics")
+	if err := m.server.Serve(m.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		m.log.Error("Metrics server error", "error", err)
+	}
+}
+
+// shutdown stops the metrics endpoint, waiting for in-flight scrapes
+// until ctx is done
+func (m *metrics) shutdown(ctx context.Context) {
+	if err := m.server.Shutdown(ctx); err != nil {
+		m.server.Close()
+	}
+}
+
+// serverOptions returns the interceptors recording request metrics
+func (m *metrics) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(m.unaryInterceptor),
+		grpc.ChainStreamInterceptor(m.streamInterceptor),
+	}
+}
+
+func (m *metrics) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.observe(info.FullMethod, start, err)
+	return resp, err
+}
+
+func (m *metrics) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	m.observe(info.FullMethod, start, err)
+	return err
+}
+
+func (m *metrics) observe(method string, start time.Time, err error) {
+	method = canonicalMethod(method)
+	m.latency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	m.requests.WithLabelValues(method, status.Code(err).String()).Inc()
+}
+
+// storageMetrics returns the health counters of the state store
+func storageMetrics(store *storage.Store) []prometheus.Collector {
+	counter := func(name, help string, value func(storage.Stats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "storage",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(store.Stats())) })
+	}
+	return []prometheus.Collector{
+		counter("writes_total", "State files written.", func(s storage.Stats) uint64 { return s.Writes }),
+		counter("write_errors_total", "State file writes and batched syncs that failed.", func(s storage.Stats) uint64 { return s.WriteErrors }),
+		counter("fallback_reads_total", "State files read from their previous generation, the current one being missing or corrupt.", func(s storage.Stats) uint64 { return s.FallbackReads }),
+		counter("corrupt_reads_total", "State file generations that failed validation on read.", func(s storage.Stats) uint64 { return s.CorruptReads }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "storage",
+			Name:      "failing",
+			Help:      "1 while the last state file write or sync failed.",
+		}, func() float64 {
+			if store.Stats().Failing {
+				return 1
+			}
+			return 0
+		}),
+	}
+}
+
+// peerCollector reads the statistics of the connections to other nodes on
+// each scrape
+type peerCollector struct {
+	pool        *client.Pool
+	connections *prometheus.Desc
+	inFlight    *prometheus.Desc
+	calls       *prometheus.Desc
+	failures    *prometheus.Desc
+	connects    *prometheus.Desc
+}
+
+func newPeerCollector(pool *client.Pool) *peerCollector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", name), help, labels, nil)
+	}
+	return &peerCollector{
+		pool:        pool,
+		connections: desc("connections", "Pooled connections to other nodes, by node address and connectivity state.", "address", "state"),
+		inFlight:    desc("requests_in_flight", "Calls in flight to other nodes, by node address.", "address"),
+		calls:       desc("requests_total", "Calls to other nodes finished, by node address.", "address"),
+		failures:    desc("request_failures_total", "Calls to other nodes that failed, by node address.", "address"),
+		connects:    desc("connects_total", "Connections established to other nodes, reconnects included, by node address.", "address"),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connections
+	ch <- c.inFlight
+	ch <- c.calls
+	ch <- c.failures
+	ch <- c.connects
+}
+
+// Collect implements prometheus.Collector
+func (c *peerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range c.pool.Stats() {
+		for state, n := range p.Conns {
+			ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(n), p.Address, state)
+		}
+		ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(p.InFlight), p.Address)
+		ch <- prometheus.MustNewConstMetric(c.calls, prometheus.CounterValue, float64(p.Calls), p.Address)
+		ch <- prometheus.MustNewConstMetric(c.failures, prometheus.CounterValue, float64(p.Failures), p.Address)
+		ch <- prometheus.MustNewConstMetric(c.connects, prometheus.CounterValue, float64(p.Connects), p.Address)
+	}
+}
+
+// networkCollector reads the network manager's statistics on each scrape,
+// so the datapath is not touched unless metrics are collected.
+type networkCollector struct {
+	network *network.NetworkManager
+	descs   map[string]*prometheus.Desc
+	// containerDescs are the per-container counters by GetContainerStats
+	// key
+	containerDescs map[string]*prometheus.Desc
+
+	poolSize      *prometheus.Desc
+	poolAllocated *prometheus.Desc
+	poolWarm      *prometheus.Desc
+	mapEntries    *prometheus.Desc
+	mapMaxEntries *prometheus.Desc
+	// latency and containerLatency are the XDP router's latency
+	// histograms, node-wide and by container
+	latency          *prometheus.Desc
+	containerLatency *prometheus.Desc
+	// setupLatency and setupStageLatency are how long creating container
+	// networks took, in total and by stage, see SetupLatency
+	setupLatency      *prometheus.Desc
+	setupStageLatency *prometheus.Desc
+	// protocolPackets and protocolBytes break the traffic of containers
+	// down by direction and protocol, and packetSize is its sizes
+	protocolPackets *prometheus.Desc
+	protocolBytes   *prometheus.Desc
+	packetSize      *prometheus.Desc
+	// drops and dropsLost count the router's drop events, see DropStats
+	drops     *prometheus.Desc
+	dropsLost *prometheus.Desc
+	// flowBytes and flowPackets are the container traffic of the flow
+	// analytics, and topFlowBytes the node's top flows, see TopFlows
+	flowBytes    *prometheus.Desc
+	flowPackets  *prometheus.Desc
+	topFlowBytes *prometheus.Desc
+	// programRuns, programRunTime and interfaceRunTime are the kernel's
+	// counts for the router's programs, and programInstructions and
+	// programMapLookups their size, see GetProgramStats
+	programRuns         *prometheus.Desc
+	programRunTime      *prometheus.Desc
+	programInstructions *prometheus.Desc
+	programMapLookups   *prometheus.Desc
+	interfaceRunTime    *prometheus.Desc
+	// serviceConnections counts the connections to service ports by the
+	// locality of their backend, see ServiceConnections
+	serviceConnections *prometheus.Desc
+}
+
+// networkCounters maps GetStats keys to metric names
+var networkCounters = map[string]string{
+	"packets_processed": "packets_processed_total",
+	"bytes_processed":   "bytes_processed_total",
+	"drop_count":        "packets_dropped_total",
+	"redirect_count":    "packets_redirected_total",
+	"frag_needed_count": "packets_too_big_total",
+	"reject_count":      "packets_rejected_total",
+	"logs_suppressed":   "logs_suppressed_total",
+	"drop_spoofed":      "packets_spoofed_total",
+
+	"drop_neighbor_spoofed": "neighbor_spoofed_total",
+
+	"syn_cookies_sent":      "syn_cookies_sent_total",
+	"syn_cookies_validated": "syn_cookies_validated_total",
+	"syn_cookies_failed":    "syn_cookies_failed_total",
+
+	"policy_packet_checks":  "policy_packet_checks_total",
+	"policy_connect_checks": "policy_connect_checks_total",
+	"policy_connect_denied": "policy_connect_denied_total",
+
+	"accelerated_sockets":  "accelerated_sockets_total",
+	"accelerated_messages": "accelerated_messages_total",
+	"accelerated_bytes":    "accelerated_bytes_total",
+}
+
+// containerCounters maps GetContainerStats keys to metric names
+var containerCounters = map[string]string{
+	"packets_processed":       "packets_processed_total",
+	"bytes_processed":         "bytes_processed_total",
+	"drop_count":              "packets_dropped_total",
+	"redirect_count":          "packets_redirected_total",
+	"frag_needed_count":       "packets_too_big_total",
+	"reject_count":            "packets_rejected_total",
+	"drop_spoofed":            "packets_spoofed_total",
+	"drop_neighbor_spoofed":   "neighbor_spoofed_total",
+	"shaping_dropped_packets": "shaping_dropped_packets_total",
+	"shaping_delayed_packets": "shaping_delayed_packets_total",
+	"policy_packet_checks":    "policy_packet_checks_total",
+	"policy_connect_checks":   "policy_connect_checks_total",
+	"policy_connect_denied":   "policy_connect_denied_total",
+	"accelerated_sockets":     "accelerated_sockets_total",
+	"accelerated_messages":    "accelerated_messages_total",
+	"accelerated_bytes":       "accelerated_bytes_total",
+}
+
+func newNetworkCollector(nm *network.NetworkManager) *networkCollector {
+	c := &networkCollector{
+		network:        nm,
+		descs:          make(map[string]*prometheus.Desc),
+		containerDescs: make(map[string]*prometheus.Desc),
+		poolSize: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "ipam", "addresses"),
+			"Allocatable container addresses, by pool.",
+			[]string{"cidr"}, nil,
+		),
+		poolAllocated: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "ipam", "allocated_addresses"),
+			"Container addresses allocated, by pool.",
+			[]string{"cidr"}, nil,
+		),
+		poolWarm: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "ipam", "warm_addresses"),
+			"Container addresses allocated to warm attachments no container took yet, by pool.",
+			[]string{"cidr"}, nil,
+		),
+		mapEntries: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "datapath", "map_entries"),
+			"Entries in an eBPF hash map of the XDP router.",
+			[]string{"map"}, nil,
+		),
+		mapMaxEntries: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "datapath", "map_max_entries"),
+			"Capacity of an eBPF hash map of the XDP router.",
+			[]string{"map"}, nil,
+		),
+		latency: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "network", "latency_seconds"),
+			"Time the XDP router took per packet, from entering the program to its verdict.",
+			nil, nil,
+		),
+		containerLatency: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "latency_seconds"),
+			"Time the XDP router took per packet to a container, by container.",
+			[]string{"container_id"}, nil,
+		),
+		setupLatency: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "network_setup_seconds"),
+			"Time creating a container network took, from the request to the network being ready.",
+			nil, nil,
+		),
+		setupStageLatency: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "network_setup_stage_seconds"),
+			"Time creating a container network spent in a stage, by stage.",
+			[]string{"stage"}, nil,
+		),
+		protocolPackets: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "protocol_packets_total"),
+			"Packets to (ingress) and from (egress) a container, by container, direction and protocol.",
+			[]string{"container_id", "direction", "protocol"}, nil,
+		),
+		protocolBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "protocol_bytes_total"),
+			"Bytes to (ingress) and from (egress) a container, by container, direction and protocol.",
+			[]string{"container_id", "direction", "protocol"}, nil,
+		),
+		packetSize: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "packet_size_bytes"),
+			"Sizes of the packets to (ingress) and from (egress) a container, by container and direction.",
+			[]string{"container_id", "direction"}, nil,
+		),
+		drops: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "network", "drop_events_total"),
+			"Packets the XDP router dropped, by reason and, for reason policy, the deny policy that matched.",
+			[]string{"reason", "policy"}, nil,
+		),
+		serviceConnections: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "service", "connections_total"),
+			"Connections a service balanced, by service, port and where the backend runs: node, rack, zone or cross_zone.",
+			[]string{"service", "port", "locality"}, nil,
+		),
+		dropsLost: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "network", "drop_events_lost_total"),
+			"Drops of the XDP router whose events were discarded as they were read too slowly.",
+			nil, nil,
+		),
+		flowBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "flow_bytes_per_second"),
+			"Bytes per second of the flows to a container over the flow analytics window, by container.",
+			[]string{"container_id"}, nil,
+		),
+		flowPackets: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "flow_packets_per_second"),
+			"Packets per second of the flows to a container over the flow analytics window, by container.",
+			[]string{"container_id"}, nil,
+		),
+		topFlowBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "network", "top_flow_bytes_per_second"),
+			"Bytes per second of the node's busiest flows over the flow analytics window, by rank from 1.",
+			[]string{"rank", "container_id", "protocol", "src", "dst"}, nil,
+		),
+		programRuns: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "datapath", "program_runs_total"),
+			"Runs of an eBPF program of the XDP router while program stats were collected, by program.",
+			[]string{"program"}, nil,
+		),
+		programRunTime: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "datapath", "program_run_seconds_total"),
+			"Time spent in an eBPF program of the XDP router while program stats were collected, by program.",
+			[]string{"program"}, nil,
+		),
+		programInstructions: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "datapath", "program_instructions"),
+			"Instructions of an eBPF program of the XDP router as loaded, by program.",
+			[]string{"program"}, nil,
+		),
+		programMapLookups: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "datapath", "program_map_lookups"),
+			"Map lookup calls in an eBPF program of the XDP router as loaded, by program.",
+			[]string{"program"}, nil,
+		),
+		interfaceRunTime: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "datapath", "interface_packet_seconds"),
+			"Average time the XDP router's programs on an interface took per packet, by interface.",
+			[]string{"interface"}, nil,
+		),
+	}
+	for key, name := range networkCounters {
+		c.descs[key] = prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "network", name),
+			"Network datapath counter "+key+".",
+			nil, nil,
+		)
+	}
+	for key, name := range containerCounters {
+		c.containerDescs[key] = prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", name),
+			"Network datapath counter "+key+", by container.",
+			[]string{"container_id"}, nil,
+		)
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *networkCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+	for _, desc := range c.containerDescs {
+		ch <- desc
+	}
+	ch <- c.poolSize
+	ch <- c.poolAllocated
+	ch <- c.poolWarm
+	ch <- c.mapEntries
+	ch <- c.mapMaxEntries
+	ch <- c.latency
+	ch <- c.containerLatency
+	ch <- c.setupLatency
+	ch <- c.setupStageLatency
+	ch <- c.protocolPackets
+	ch <- c.protocolBytes
+	ch <- c.packetSize
+	ch <- c.drops
+	ch <- c.dropsLost
+	ch <- c.flowBytes
+	ch <- c.flowPackets
+	ch <- c.topFlowBytes
+	ch <- c.programRuns
+	ch <- c.programRunTime
+	ch <- c.programInstructions
+	ch <- c.programMapLookups
+	ch <- c.interfaceRunTime
+	ch <- c.serviceConnections
+}
+
+// Collect implements prometheus.Collector
+func (c *networkCollector) Collect(ch chan<- prometheus.Metric) {
+	snap, err := c.network.ListStats()
+	if err != nil {
+		for _, desc := range c.descs {
+			ch <- prometheus.NewInvalidMetric(desc, err)
+		}
+		for _, desc := range c.containerDescs {
+			ch <- prometheus.NewInvalidMetric(desc, err)
+		}
+	}
+	for key, desc := range c.descs {
+		if stat, ok := snap.Node[key]; ok {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(stat))
+		}
+	}
+	for id, stats := range snap.Containers {
+		for key, desc := range c.containerDescs {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(stats[key]), id)
+		}
+		for _, dir := range []network.Direction{network.DirectionIngress, network.DirectionEgress} {
+			for _, proto := range network.TrafficProtocols {
+				packets := stats[network.TrafficStatKey(dir, proto, "packets")]
+				bytes := stats[network.TrafficStatKey(dir, proto, "bytes")]
+				ch <- prometheus.MustNewConstMetric(c.protocolPackets, prometheus.CounterValue, float64(packets), id, string(dir), proto)
+				ch <- prometheus.MustNewConstMetric(c.protocolBytes, prometheus.CounterValue, float64(bytes), id, string(dir), proto)
+			}
+		}
+	}
+
+	for _, pool := range c.network.PoolUsage() {
+		ch <- prometheus.MustNewConstMetric(c.poolSize, prometheus.GaugeValue, float64(pool.Size), pool.CIDR)
+		ch <- prometheus.MustNewConstMetric(c.poolAllocated, prometheus.GaugeValue, float64(pool.Allocated), pool.CIDR)
+		ch <- prometheus.MustNewConstMetric(c.poolWarm, prometheus.GaugeValue, float64(pool.Warm), pool.CIDR)
+	}
+
+	c.collectLatency(ch)
+	c.collectSetupLatency(ch)
+	c.collectPacketSizes(ch)
+	c.collectDrops(ch)
+	c.collectTopFlows(ch)
+	c.collectPrograms(ch)
+	c.collectServiceConnections(ch)
+
+	maps, err := c.network.DatapathMapUsage()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.mapEntries, err)
+		return
+	}
+	for name, usage := range maps {
+		ch <- prometheus.MustNewConstMetric(c.mapEntries, prometheus.GaugeValue, float64(usage.Entries), name)
+		ch <- prometheus.MustNewConstMetric(c.mapMaxEntries, prometheus.GaugeValue, float64(usage.MaxEntries), name)
+	}
+}
+
+// collectLatency exports the router's latency histograms, none without XDP
+// or with a router object predating them
+func (c *networkCollector) collectLatency(ch chan<- prometheus.Metric) {
+	snap, err := c.network.GetLatencyStats("")
+	if errors.Is(err, network.ErrXDPInactive) || errors.Is(err, network.ErrInvalidDatapath) {
+		return
+	}
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.latency, err)
+		return
+	}
+	ch <- latencyHistogram(c.latency, snap.Node)
+	for id, h := range snap.Containers {
+		ch <- latencyHistogram(c.containerLatency, h, id)
+	}
+}
+
+// collectSetupLatency exports how long creating container networks took
+func (c *networkCollector) collectSetupLatency(ch chan<- prometheus.Metric) {
+	l := c.network.SetupLatency()
+	ch <- latencyHistogram(c.setupLatency, l.TotalHistogram)
+	for stage, h := range l.StageHistograms {
+		ch <- latencyHistogram(c.setupStageLatency, h, string(stage))
+	}
+}
+
+// collectPacketSizes exports the packet size histograms of containers,
+// none without XDP or with a router object predating them
+func (c *networkCollector) collectPacketSizes(ch chan<- prometheus.Metric) {
+	snap, err := c.network.GetPacketSizes("")
+	if errors.Is(err, network.ErrXDPInactive) || errors.Is(err, network.ErrInvalidDatapath) {
+		return
+	}
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.packetSize, err)
+		return
+	}
+	for id, sizes := range snap.Containers {
+		ch <- sizeHistogram(c.packetSize, sizes.Ingress, id, string(network.DirectionIngress))
+		ch <- sizeHistogram(c.packetSize, sizes.Egress, id, string(network.DirectionEgress))
+	}
+}
+
+// collectDrops exports the router's drop event counts, none without XDP or
+// with a router object predating drop events
+func (c *networkCollector) collectDrops(ch chan<- prometheus.Metric) {
+	stats, err := c.network.DropStats()
+	if errors.Is(err, network.ErrXDPInactive) || errors.Is(err, network.ErrInvalidDatapath) {
+		return
+	}
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.drops, err)
+		return
+	}
+	for _, n := range stats.Counts {
+		ch <- prometheus.MustNewConstMetric(c.drops, prometheus.CounterValue, float64(n.Packets), string(n.Reason), n.Policy)
+	}
+	ch <- prometheus.MustNewConstMetric(c.dropsLost, prometheus.CounterValue, float64(stats.Lost))
+}
+
+// collectServiceConnections exports the connections of service ports by
+// the locality of their backend, none on platforms without services.
+// Ports without a name are labeled by number and protocol.
+func (c *networkCollector) collectServiceConnections(ch chan<- prometheus.Metric) {
+	conns, err := c.network.ServiceConnections()
+	if errors.Is(err, network.ErrUnsupportedPlatform) {
+		return
+	}
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.serviceConnections, err)
+		return
+	}
+	for _, s := range conns {
+		for _, p := range s.Ports {
+			port := p.Port.Name
+			if port == "" {
+				port = strconv.Itoa(int(p.Port.Port)) + "/" + p.Port.Protocol
+			}
+			for _, l := range network.Localities {
+				ch <- prometheus.MustNewConstMetric(c.serviceConnections, prometheus.CounterValue, float64(p.Connections[l]), s.Service, port, string(l))
+			}
+		}
+	}
+}
+
+// collectPrograms exports the kernel's counts for the router's programs,
+// none without XDP
+func (c *networkCollector) collectPrograms(ch chan<- prometheus.Metric) {
+	snap, err := c.network.GetProgramStats()
+	if errors.Is(err, network.ErrXDPInactive) {
+		return
+	}
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.programRuns, err)
+		return
+	}
+	for _, p := range snap.Programs {
+		ch <- prometheus.MustNewConstMetric(c.programRuns, prometheus.CounterValue, float64(p.RunCount), p.Name)
+		ch <- prometheus.MustNewConstMetric(c.programRunTime, prometheus.CounterValue, p.RunTime.Seconds(), p.Name)
+		ch <- prometheus.MustNewConstMetric(c.programInstructions, prometheus.GaugeValue, float64(p.Instructions), p.Name)
+		ch <- prometheus.MustNewConstMetric(c.programMapLookups, prometheus.GaugeValue, float64(p.MapLookups), p.Name)
+	}
+	for iface, d := range snap.Interfaces {
+		ch <- prometheus.MustNewConstMetric(c.interfaceRunTime, prometheus.GaugeValue, d.Seconds(), iface)
+	}
+}
+
+// collectTopFlows exports the traffic of the flow analytics, none unless
+// they are enabled and XDP is attached
+func (c *networkCollector) collectTopFlows(ch chan<- prometheus.Metric) {
+	top, err := c.network.TopFlows("", 0)
+	if errors.Is(err, network.ErrAnalyticsDisabled) || errors.Is(err, network.ErrXDPInactive) {
+		return
+	}
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.flowBytes, err)
+		return
+	}
+	for id, t := range top.Containers {
+		ch <- prometheus.MustNewConstMetric(c.flowBytes, prometheus.GaugeValue, t.BytesPerSecond, id)
+		ch <- prometheus.MustNewConstMetric(c.flowPackets, prometheus.GaugeValue, t.PacketsPerSecond, id)
+	}
+	for i, f := range top.Node.Flows {
+		ch <- prometheus.MustNewConstMetric(c.topFlowBytes, prometheus.GaugeValue, f.BytesPerSecond,
+			strconv.Itoa(i+1), f.ContainerID, f.Protocol, f.Src.String(), f.Dst.String())
+	}
+}
+
+// sizeHistogram converts h to a Prometheus histogram, with a bucket per
+// packet size class
+func sizeHistogram(desc *prometheus.Desc, h network.SizeHistogram, labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, network.SizeBuckets-1)
+	var cumulative uint64
+	for i, bound := range h.UpperBounds() {
+		cumulative += h.Buckets[i]
+		buckets[float64(bound)] = cumulative
+	}
+	return prometheus.MustNewConstHistogram(desc, h.Packets, float64(h.Bytes), buckets, labels...)
+}
+
+// latencyHistogram converts h to a Prometheus histogram, with a bucket per
+// power of two nanoseconds
+func latencyHistogram(desc *prometheus.Desc, h network.LatencyHistogram, labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, network.LatencyBuckets-1)
+	var cumulative uint64
+	for i, bound := range h.UpperBounds() {
+		cumulative += h.Buckets[i]
+		buckets[bound.Seconds()] = cumulative
+	}
+	return prometheus.MustNewConstHistogram(desc, h.Packets, h.Total.Seconds(), buckets, labels...)
+}
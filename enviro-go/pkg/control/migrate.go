@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// ExportNetworkState returns the network state of a container of this
+// node as JSON, for ImportNetworkState on another node
+func (s *containerService) ExportNetworkState(ctx context.Context, req *pb.ExportNetworkStateRequest) (*pb.ExportNetworkStateResponse, error) {
+	s.mu.Lock()
+	c, ok := s.containers[req.GetId()]
+	var node string
+	if ok {
+		node = c.Node
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetId())
+	}
+	if node != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %q is placed on node %s, export it there", req.Id, node)
+	}
+
+	state, err := s.network.ExportNetworkState(req.Id)
+	if err != nil {
+		return nil, networkError(err)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.logger(ctx).Info("Exported container network state", "container_id", req.Id,
+		"policies", len(state.Policies), "services", len(state.Services), "connections", len(state.Connections))
+	return &pb.ExportNetworkStateResponse{State: data}, nil
+}
+
+// ImportNetworkState creates a container from the network state another
+// node exported, registering it like CreateContainer does. Admission
+// isn't asked again, as the container was admitted on the exporting node.
+func (s *containerService) ImportNetworkState(ctx context.Context, req *pb.ImportNetworkStateRequest) (*pb.ImportNetworkStateResponse, error) {
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "container id is required")
+	}
+	var state network.NetworkState
+	if err := json.Unmarshal(req.GetState(), &state); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid network state: %v", err)
+	}
+
+	s.mu.Lock()
+	if _, ok, err := s.existing(req.Id); ok || err != nil {
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.AlreadyExists, "container %q already exists", req.Id)
+	}
+	c := &pb.Container{
+		Id:        req.Id,
+		Name:      state.Network.Name,
+		Namespace: namespaceOrDefault(state.Network.Namespace),
+		Labels:    req.Labels,
+		State:     pb.ContainerState_CONTAINER_STATE_CREATING,
+		CreatedAt: timestamppb.Now(),
+	}
+	s.containers[req.Id] = c
+	s.busy[req.Id] = true
+	s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_CREATED, c)
+	s.mu.Unlock()
+
+	cn, err := s.network.ImportNetworkState(ctx, network.ContainerNetworkSpec{
+		ContainerID: req.Id,
+		NetnsPath:   req.NetnsPath,
+		Pid:         int(req.Pid),
+	}, state)
+	if err == nil {
+		for _, svc := range state.Services {
+			s.replicateService(svc.Name)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, req.Id)
+	if err != nil {
+		s.logger(ctx).Error("Failed to import container network state", "container_id", req.Id, "error", err)
+		c.State = pb.ContainerState_CONTAINER_STATE_FAILED
+		c.Error = err.Error()
+		s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NETWORK_ERROR, c)
+		return nil, networkError(err)
+	}
+	setContainerNetwork(c, cn)
+	c.State = pb.ContainerState_CONTAINER_STATE_READY
+	s.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NETWORK_READY, c)
+	return &pb.ImportNetworkStateResponse{Container: cloneContainer(c)}, nil
+}
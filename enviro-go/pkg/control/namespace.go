@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// CreateNamespace adds a namespace
+func (s *containerService) CreateNamespace(ctx context.Context, req *pb.CreateNamespaceRequest) (*pb.CreateNamespaceResponse, error) {
+	ns := req.GetNamespace()
+	if ns == nil {
+		return nil, status.Error(codes.InvalidArgument, "namespace is required")
+	}
+	if err := validateQuota(ns.GetQuota()); err != nil {
+		return nil, err
+	}
+	created, err := s.network.CreateNamespace(network.Namespace{
+		Name:      ns.GetName(),
+		CIDR:      ns.GetCidr(),
+		CIDR6:     ns.GetCidr6(),
+		AllowFrom: ns.GetAllowFrom(),
+		Quota:     quotaFromProto(ns.GetQuota()),
+		MTU:       int(ns.GetMtu()),
+	})
+	if err != nil {
+		s.logger(ctx).Error("Failed to create namespace", "namespace", ns.GetName(), "error", err)
+		return nil, networkError(err)
+	}
+	return &pb.CreateNamespaceResponse{Namespace: s.namespaceToProto(created)}, nil
+}
+
+// UpdateNamespace replaces the namespaces allowed into a namespace and its
+// quota
+func (s *containerService) UpdateNamespace(ctx context.Context, req *pb.UpdateNamespaceRequest) (*pb.UpdateNamespaceResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	if err := validateQuota(req.GetQuota()); err != nil {
+		return nil, err
+	}
+	updated, err := s.network.UpdateNamespace(req.Name, req.AllowFrom, quotaFromProto(req.GetQuota()))
+	if err != nil {
+		s.logger(ctx).Error("Failed to update namespace", "namespace", req.Name, "error", err)
+		return nil, networkError(err)
+	}
+	return &pb.UpdateNamespaceResponse{Namespace: s.namespaceToProto(updated)}, nil
+}
+
+// DeleteNamespace removes an empty namespace
+func (s *containerService) DeleteNamespace(ctx context.Context, req *pb.DeleteNamespaceRequest) (*pb.DeleteNamespaceResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	if err := s.network.DeleteNamespace(req.Name); err != nil {
+		return nil, networkError(err)
+	}
+	return &pb.DeleteNamespaceResponse{}, nil
+}
+
+// ListNamespaces returns the namespaces ordered by name, with their usage
+func (s *containerService) ListNamespaces(ctx context.Context, req *pb.ListNamespacesRequest) (*pb.ListNamespacesResponse, error) {
+	resp := &pb.ListNamespacesResponse{}
+	for _, ns := range s.network.ListNamespaces() {
+		resp.Namespaces = append(resp.Namespaces, s.namespaceToProto(ns))
+	}
+	return resp, nil
+}
+
+// validateQuota rejects negative quotas, which int32 fields allow
+func validateQuota(q *pb.NamespaceQuota) error {
+	if q.GetMaxContainers() < 0 || q.GetMaxAddresses() < 0 {
+		return status.Error(codes.InvalidArgument, "quotas must not be negative")
+	}
+	return nil
+}
+
+func quotaFromProto(q *pb.NamespaceQuota) network.NamespaceQuota {
+	return network.NamespaceQuota{
+		MaxContainers:   int(q.GetMaxContainers()),
+		MaxAddresses:    int(q.GetMaxAddresses()),
+		MaxBandwidthBps: q.GetMaxBandwidthBps(),
+	}
+}
+
+// namespaceToProto converts ns, adding its current usage
+func (s *containerService) namespaceToProto(ns network.Namespace) *pb.Namespace {
+	out := &pb.Namespace{
+		Name:      ns.Name,
+		Cidr:      ns.CIDR,
+		Cidr6:     ns.CIDR6,
+		AllowFrom: ns.AllowFrom,
+		Quota: &pb.NamespaceQuota{
+			MaxContainers:   int32(ns.Quota.MaxContainers),
+			MaxAddresses:    int32(ns.Quota.MaxAddresses),
+			MaxBandwidthBps: ns.Quota.MaxBandwidthBps,
+		},
+		Mtu: int32(ns.MTU),
+	}
+	// The namespace may have been deleted meanwhile
+	if usage, err := s.network.NamespaceUsage(ns.Name); err == nil {
+		out.Usage = &pb.NamespaceUsage{
+			Containers: int32(usage.Containers),
+			Addresses:  int32(usage.Addresses),
+			IngressBps: usage.IngressBps,
+			EgressBps:  usage.EgressBps,
+		}
+	}
+	return out
+}
+
+// namespaceOrDefault returns the namespace name, which is empty in
+// requests and records made before namespaces existed for the default one
+func namespaceOrDefault(name string) string {
+	if name == "" {
+		return network.DefaultNamespace
+	}
+	return name
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// errNetworkNotInitialized rejects the RPCs needing the network before
+// InitNetwork set it up
+var errNetworkNotInitialized = status.Error(codes.FailedPrecondition, "network not initialized")
+
+// networkServicePrefixes prefix the methods of the services acting on the
+// network
+var networkServicePrefixes = []string{
+	"/enviro.api.v1.ContainerService/",
+	nodeServicePrefix,
+}
+
+// offlineMethods are the methods of the network services that don't need
+// the network, and so are served before it is initialized
+var offlineMethods = map[string]bool{
+	"/enviro.api.v1.ContainerService/ListContainers": true,
+	"/enviro.api.v1.ContainerService/GetContainer":   true,
+	"/enviro.api.v1.ContainerService/WatchEvents":    true,
+	"/enviro.api.v1.ContainerService/StreamLogs":     true,
+	"/enviro.api.v1.ContainerService/GetSpec":        true,
+	"/enviro.api.v1.ContainerService/ListNamespaces": true,
+
+	"/enviro.api.v1.NodeService/SetLogLevel":         true,
+	"/enviro.api.v1.NodeService/RegisterNode":        true,
+	"/enviro.api.v1.NodeService/NodeHeartbeat":       true,
+	"/enviro.api.v1.NodeService/ListNodes":           true,
+	"/enviro.api.v1.NodeService/QueryAuditLog":       true,
+	"/enviro.api.v1.NodeService/Backup":              true,
+	"/enviro.api.v1.NodeService/DumpEffectiveConfig": true,
+	"/enviro.api.v1.NodeService/AllocateIdentity":    true,
+	"/enviro.api.v1.NodeService/ReleaseIdentity":     true,
+	"/enviro.api.v1.NodeService/ListIdentities":      true,
+	"/enviro.api.v1.NodeService/WatchIdentities":     true,
+}
+
+// needsNetwork reports whether method can only be served once the network
+// is initialized
+func needsNetwork(method string) bool {
+	method = canonicalMethod(method)
+	if offlineMethods[method] {
+		return false
+	}
+	for _, prefix := range networkServicePrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// networkGate returns the interceptors rejecting the RPCs needing the
+// network while nm is not initialized
+func networkGate(nm *network.NetworkManager) []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !nm.Initialized() && needsNetwork(info.FullMethod) {
+			return nil, errNetworkNotInitialized
+		}
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !nm.Initialized() && needsNetwork(info.FullMethod) {
+			return errNetworkNotInitialized
+		}
+		return handler(srv, ss)
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+// InitNetwork sets up the datapath for config, which takes the defaults
+// of ControlPlaneConfig.Network, completing the start of a control plane
+// created with DeferNetwork: the RPCs needing the network are served from
+// then on, the health service reports SERVING while the control plane
+// serves, and the containers of the state dir are restored. Called again,
+// e.g. after a config change the running datapath can't take, it rebuilds
+// the datapath for the new config; see network.NetworkManager.Init. A
+// failed InitNetwork leaves the network uninitialized.
+func (cp *ControlPlane) InitNetwork(config network.NetworkConfig) error {
+	cp.reloadMu.Lock()
+	defer cp.reloadMu.Unlock()
+
+	if state := cp.State(); state >= StateStopping {
+		return fmt.Errorf("control plane cannot initialize the network: %s", state)
+	}
+	config = cp.networkDefaults(config)
+	err := cp.network.Init(config)
+	// Whether the network failed or came up, the health follows
+	defer cp.updateHealth()
+	if err != nil {
+		return err
+	}
+	cp.config.Network = config
+
+	cp.containers.mu.Lock()
+	if cp.saved != nil {
+		cp.containers.restore(cp.saved)
+		cp.saved = nil
+	}
+	cp.containers.mu.Unlock()
+	cp.log.Info("Network initialized", "cidr", config.CIDR, "cidr6", config.CIDR6)
+	return nil
+}
+
+// NetworkInitialized reports whether the network is set up, which it is
+// from the start unless the control plane was created with DeferNetwork
+func (cp *ControlPlane) NetworkInitialized() bool {
+	return cp.network.Initialized()
+}
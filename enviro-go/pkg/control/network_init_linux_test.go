@@ -0,0 +1,131 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// networkInitTestEnv has a child of TestDeferredNetwork run the test in
+// the network namespace of its own it was started in
+const networkInitTestEnv = "ENVIRO_TEST_NETWORK_INIT"
+
+// TestDeferredNetwork serves a control plane created with DeferNetwork,
+// issuing RPCs before InitNetwork, after a failed one and after the
+// network came up. It runs in a child in a network namespace of its own,
+// so the datapath stays off the host.
+func TestDeferredNetwork(t *testing.T) {
+	if os.Getenv(networkInitTestEnv) != "" {
+		runDeferredNetwork(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("setting up the datapath needs root")
+	}
+	runInNetns(t, networkInitTestEnv)
+}
+
+func runDeferredNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	// The loopback of the new namespace is down
+	socket := filepath.Join(t.TempDir(), "enviro.sock")
+	cp, err := NewControlPlaneWithConfig(ControlPlaneConfig{
+		Address:      "unix://" + socket,
+		DeferNetwork: true,
+		StateDir:     t.TempDir(),
+		Logger:       logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cp.Start(ctx)
+	defer cp.Stop(context.Background())
+	if err := cp.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	nodes := pb.NewNodeServiceClient(conn)
+	containers := pb.NewContainerServiceClient(conn)
+	health := healthpb.NewHealthClient(conn)
+	info := pb.NewInfoServiceClient(conn)
+
+	// check issues the RPCs, which need the network to succeed when
+	// initialized and otherwise fail with codes.FailedPrecondition
+	check := func(step string, initialized bool) {
+		t.Helper()
+		wantCode, wantHealth := codes.FailedPrecondition, healthpb.HealthCheckResponse_NOT_SERVING
+		if initialized {
+			wantCode, wantHealth = codes.OK, healthpb.HealthCheckResponse_SERVING
+		}
+		if got := cp.NetworkInitialized(); got != initialized {
+			t.Errorf("%s: NetworkInitialized() = %v, want %v", step, got, initialized)
+		}
+		_, err := nodes.GetNetworkConfig(ctx, &pb.GetNetworkConfigRequest{})
+		if got := status.Code(err); got != wantCode {
+			t.Errorf("%s: GetNetworkConfig() = %v, want %v", step, err, wantCode)
+		}
+		_, err = nodes.GetCapabilities(ctx, &pb.GetCapabilitiesRequest{})
+		if got := status.Code(err); got != wantCode {
+			t.Errorf("%s: GetCapabilities() = %v, want %v", step, err, wantCode)
+		}
+		// Listing needs no network
+		if _, err := containers.ListContainers(ctx, &pb.ListContainersRequest{}); err != nil {
+			t.Errorf("%s: ListContainers() = %v", step, err)
+		}
+		for _, service := range []string{"", pb.NodeService_ServiceDesc.ServiceName} {
+			resp, err := health.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				t.Fatalf("%s: health of %q: %v", step, service, err)
+			}
+			if resp.Status != wantHealth {
+				t.Errorf("%s: health of %q is %v, want %v", step, service, resp.Status, wantHealth)
+			}
+		}
+		resp, err := info.GetAPIInfo(ctx, &pb.GetAPIInfoRequest{})
+		if err != nil {
+			t.Fatalf("%s: GetAPIInfo() = %v", step, err)
+		}
+		if got := slices.Contains(resp.Features, "network"); got != initialized {
+			t.Errorf("%s: features %q, want network %v", step, resp.Features, initialized)
+		}
+	}
+
+	check("deferred", false)
+	// Reported as the config's, e.g. to the FFI
+	err = cp.InitNetwork(network.NetworkConfig{CIDR: "10.99.0.0/33"})
+	if !invalidConfig(err) {
+		t.Errorf("InitNetwork() with an invalid CIDR = %v, want an invalid config", err)
+	}
+	check("failed init", false)
+	if err := cp.InitNetwork(network.NetworkConfig{CIDR: "10.99.0.0/24"}); err != nil {
+		t.Fatalf("InitNetwork() = %v", err)
+	}
+	check("initialized", true)
+	if err := cp.InitNetwork(network.NetworkConfig{CIDR: "10.98.0.0/24"}); err != nil {
+		t.Fatalf("InitNetwork() again = %v", err)
+	}
+	check("rebuilt", true)
+}
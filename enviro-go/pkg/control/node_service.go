@@ -0,0 +1,839 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// nodeService implements pb.NodeServiceServer. Its methods require the
+// admin role, except for the node registry's, which are listed in
+// readOnlyMethods and operatorMethods.
+type nodeService struct {
+	pb.UnimplementedNodeServiceServer
+
+	network *network.NetworkManager
+	events  *eventBus
+	// level is nil when the log level can't be changed, e.g. for a logger
+	// supplied by an embedding application
+	level *slog.LevelVar
+	log   *slog.Logger
+	// nodes registers the worker nodes of the cluster
+	nodes *nodeRegistry
+	// audit is nil when the audit log is not configured
+	audit *auditLog
+	// store is nil when StateDir is not configured
+	store *storage.Store
+	// control is the control plane serving the service, which owns the
+	// runtime settings
+	control *ControlPlane
+	// identities hands out the identities of label sets
+	identities *identityAllocator
+}
+
+func newNodeService(nm *network.NetworkManager, events *eventBus, nodes *nodeRegistry, level *slog.LevelVar, logger *slog.Logger) *nodeService {
+	return &nodeService{network: nm, events: events, nodes: nodes, level: level, log: logger}
+}
+
+// GetNetworkConfig returns the effective network configuration
+func (s *nodeService) GetNetworkConfig(ctx context.Context, req *pb.GetNetworkConfigRequest) (*pb.GetNetworkConfigResponse, error) {
+	cfg := s.network.Config()
+	caps := s.network.Capabilities()
+	var ipam, ipam6 string
+	for _, pool := range s.network.PoolUsage() {
+		if strings.Contains(pool.CIDR, ":") {
+			ipam6 = pool.IPAM
+		} else {
+			ipam = pool.IPAM
+		}
+	}
+	config := &pb.NetworkConfig{
+		Cidr:                cfg.CIDR,
+		Cidr6:               cfg.CIDR6,
+		Gateway:             cfg.Gateway,
+		Gateway6:            cfg.Gateway6,
+		Mtu:                 int32(cfg.MTU),
+		Interface:           cfg.Interface,
+		XdpEnabled:          cfg.EnableXDP,
+		XdpAttached:         caps.XDP,
+		XdpMode:             string(caps.XDPMode),
+		XdpError:            caps.XDPError,
+		DefaultPolicy:       string(cfg.DefaultPolicy),
+		DatapathMode:        string(cfg.DatapathMode),
+		Overlay:             overlayToProto(cfg.Node, s.network.OverlayPublicKey()),
+		Rootless:            caps.Rootless,
+		UserspaceForwarding: caps.Userspace,
+		Ipam:                ipam,
+		Ipam6:               ipam6,
+
+		MacvlanParent:   cfg.Devices.MacvlanParent,
+		MacvlanFallback: cfg.Devices.MacvlanFallback,
+	}
+	// A physical function gone missing doesn't hide the rest of the
+	// configuration
+	vfs, err := s.network.VirtualFunctions()
+	if err != nil {
+		s.log.Warn("Failed to discover virtual functions", "error", err)
+	}
+	for _, vf := range vfs {
+		config.VirtualFunctions = append(config.VirtualFunctions, &pb.VirtualFunction{
+			Pf:          vf.PF,
+			Index:       int32(vf.Index),
+			PciAddress:  vf.PCIAddress,
+			Name:        vf.Name,
+			ContainerId: vf.ContainerID,
+		})
+	}
+	return &pb.GetNetworkConfigResponse{Config: config}, nil
+}
+
+func overlayToProto(node *network.NodeConfig, publicKey string) *pb.Overlay {
+	if node == nil {
+		return nil
+	}
+	return &pb.Overlay{
+		Address:   node.Address,
+		Vni:       node.VNI,
+		Port:      int32(node.Port),
+		Subnet:    node.Subnet,
+		Subnet6:   node.Subnet6,
+		PublicKey: publicKey,
+	}
+}
+
+// GetStats returns the node-wide statistics and those of each container,
+// sorted by container ID, and the state of the overlay peers
+func (s *nodeService) GetStats(ctx context.Context, req *pb.GetStatsRequest) (*pb.GetStatsResponse, error) {
+	snap, err := s.network.ListStats()
+	if err != nil {
+		return nil, networkError(err)
+	}
+
+	resp := &pb.GetStatsResponse{Stats: snap.Node}
+	for id, stats := range snap.Containers {
+		resp.Containers = append(resp.Containers, &pb.ContainerStats{ContainerId: id, Stats: stats})
+	}
+	sort.Slice(resp.Containers, func(i, j int) bool {
+		return resp.Containers[i].ContainerId < resp.Containers[j].ContainerId
+	})
+	for _, p := range snap.Peers {
+		stats := &pb.PeerStats{Name: p.Name, Encrypted: p.Encrypted, RxBytes: p.RxBytes, TxBytes: p.TxBytes}
+		if !p.LastHandshake.IsZero() {
+			stats.LastHandshake = timestamppb.New(p.LastHandshake)
+		}
+		resp.Peers = append(resp.Peers, stats)
+	}
+	resp.SetupLatency = setupLatencyToProto(s.network.SetupLatency())
+	return resp, nil
+}
+
+func setupLatencyToProto(l network.SetupLatency) *pb.SetupLatencyStats {
+	out := &pb.SetupLatencyStats{
+		Samples: uint32(l.Samples),
+		Total:   quantilesToProto(l.Total),
+		Stages:  make(map[string]*pb.LatencyQuantiles, len(l.Stages)),
+	}
+	for stage, q := range l.Stages {
+		out.Stages[string(stage)] = quantilesToProto(q)
+	}
+	return out
+}
+
+func quantilesToProto(q network.SetupQuantiles) *pb.LatencyQuantiles {
+	return &pb.LatencyQuantiles{
+		P50: durationpb.New(q.P50),
+		P95: durationpb.New(q.P95),
+		P99: durationpb.New(q.P99),
+	}
+}
+
+// GetLatencyStats returns the latency of the XDP router, for the node and
+// each container or only the requested one
+func (s *nodeService) GetLatencyStats(ctx context.Context, req *pb.GetLatencyStatsRequest) (*pb.GetLatencyStatsResponse, error) {
+	snap, err := s.network.GetLatencyStats(req.GetContainerId())
+	if err != nil {
+		return nil, networkError(err)
+	}
+	resp := &pb.GetLatencyStatsResponse{}
+	if req.GetContainerId() == "" {
+		resp.Node = latencyToProto(snap.Node)
+	}
+	for id, h := range snap.Containers {
+		resp.Containers = append(resp.Containers, &pb.ContainerLatencyStats{ContainerId: id, Latency: latencyToProto(h)})
+	}
+	sort.Slice(resp.Containers, func(i, j int) bool {
+		return resp.Containers[i].ContainerId < resp.Containers[j].ContainerId
+	})
+	return resp, nil
+}
+
+func latencyToProto(h network.LatencyHistogram) *pb.LatencyStats {
+	return &pb.LatencyStats{
+		Packets: h.Packets,
+		Mean:    durationpb.New(h.Mean()),
+		P50:     durationpb.New(h.Quantile(0.5)),
+		P95:     durationpb.New(h.Quantile(0.95)),
+		P99:     durationpb.New(h.Quantile(0.99)),
+		Buckets: h.Buckets[:],
+	}
+}
+
+// ReloadXDP re-attaches the XDP router, keeping its maps
+func (s *nodeService) ReloadXDP(ctx context.Context, req *pb.ReloadXDPRequest) (*pb.ReloadXDPResponse, error) {
+	if err := s.network.ReloadXDP(ctx); err != nil {
+		logging.FromContext(ctx, s.log).Error("Failed to reload XDP", "error", err)
+		s.publishDatapathError(err)
+		return nil, networkError(err)
+	}
+	return &pb.ReloadXDPResponse{XdpMode: string(s.network.Capabilities().XDPMode)}, nil
+}
+
+// UpgradeDataPath swaps in the XDP router from an object on the node
+func (s *nodeService) UpgradeDataPath(ctx context.Context, req *pb.UpgradeDataPathRequest) (*pb.UpgradeDataPathResponse, error) {
+	if req.GetObjectPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "object path is required")
+	}
+	if err := s.network.UpgradeDataPath(ctx, req.ObjectPath); err != nil {
+		logging.FromContext(ctx, s.log).Error("Failed to upgrade XDP router", "object", req.ObjectPath, "error", err)
+		s.publishDatapathError(err)
+		return nil, networkError(err)
+	}
+	return &pb.UpgradeDataPathResponse{}, nil
+}
+
+// DatapathInspect returns the programs and maps of the XDP router, and a
+// page of the entries of the requested map
+func (s *nodeService) DatapathInspect(ctx context.Context, req *pb.DatapathInspectRequest) (*pb.DatapathInspectResponse, error) {
+	in, err := s.network.InspectDatapath(network.InspectRequest{
+		Map:       req.GetMapName(),
+		PageSize:  int(req.GetPageSize()),
+		PageToken: req.GetPageToken(),
+	})
+	if err != nil {
+		return nil, networkError(err)
+	}
+	resp := &pb.DatapathInspectResponse{NextPageToken: in.NextPageToken}
+	for _, p := range in.Programs {
+		resp.Programs = append(resp.Programs, datapathProgramToProto(p))
+	}
+	for _, m := range in.Maps {
+		resp.Maps = append(resp.Maps, &pb.DatapathMap{
+			Name:       m.Name,
+			Type:       m.Type,
+			Id:         m.ID,
+			KeySize:    m.KeySize,
+			ValueSize:  m.ValueSize,
+			MaxEntries: m.MaxEntries,
+		})
+	}
+	for _, e := range in.Entries {
+		resp.Entries = append(resp.Entries, &pb.DatapathMapEntry{
+			Key:      e.Key,
+			Value:    e.Value,
+			RawKey:   e.RawKey,
+			RawValue: e.RawValue,
+		})
+	}
+	return resp, nil
+}
+
+func datapathProgramToProto(p network.DatapathProgram) *pb.DatapathProgram {
+	out := &pb.DatapathProgram{
+		Name:         p.Name,
+		Type:         p.Type,
+		Id:           p.ID,
+		Tag:          p.Tag,
+		Attached:     p.Attached,
+		Interface:    p.Interface,
+		XdpMode:      string(p.Mode),
+		LoadDuration: durationpb.New(p.LoadDuration),
+		RunCount:     p.RunCount,
+		RunTime:      durationpb.New(p.RunTime),
+	}
+	if !p.LoadedAt.IsZero() {
+		out.LoadedAt = timestamppb.New(p.LoadedAt)
+	}
+	return out
+}
+
+// publishDatapathError reports a failure to change the datapath to
+// watchers, unless the request was turned down before touching it
+func (s *nodeService) publishDatapathError(err error) {
+	if errors.Is(err, network.ErrXDPInactive) || errors.Is(err, network.ErrInvalidDatapath) {
+		return
+	}
+	s.events.publish(&pb.ContainerEvent{
+		Type:      pb.ContainerEventType_CONTAINER_EVENT_TYPE_DATAPATH_ERROR,
+		Timestamp: timestamppb.Now(),
+		Error:     err.Error(),
+	})
+}
+
+// publishPolicy reports a policy change to watchers
+func (s *nodeService) publishPolicy(typ pb.ContainerEventType, name string) {
+	s.events.publish(&pb.ContainerEvent{
+		Type:      typ,
+		Timestamp: timestamppb.Now(),
+		Policy:    name,
+	})
+}
+
+// SetLogLevel changes the level of the control plane and network logs
+func (s *nodeService) SetLogLevel(ctx context.Context, req *pb.SetLogLevelRequest) (*pb.SetLogLevelResponse, error) {
+	if req.GetLevel() == "" {
+		return nil, status.Error(codes.InvalidArgument, "level is required")
+	}
+	level, err := logging.ParseLevel(req.GetLevel())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if s.level == nil {
+		return nil, status.Error(codes.FailedPrecondition, "log level is not adjustable for the configured logger")
+	}
+
+	previous := s.level.Level()
+	s.level.Set(level)
+	logging.FromContext(ctx, s.log).Warn("Changed log level", "previous", previous, "level", level)
+	return &pb.SetLogLevelResponse{PreviousLevel: strings.ToLower(previous.String())}, nil
+}
+
+// DumpConnections returns the tracked flows, optionally of one container
+func (s *nodeService) DumpConnections(ctx context.Context, req *pb.DumpConnectionsRequest) (*pb.DumpConnectionsResponse, error) {
+	conns, err := s.network.ListConnections(req.GetContainerId())
+	if err != nil {
+		return nil, networkError(err)
+	}
+
+	resp := &pb.DumpConnectionsResponse{Connections: make([]*pb.Connection, 0, len(conns))}
+	for _, c := range conns {
+		resp.Connections = append(resp.Connections, &pb.Connection{
+			ContainerId: c.ContainerID,
+			Protocol:    c.Protocol,
+			SrcAddress:  c.Src.Addr().String(),
+			SrcPort:     uint32(c.Src.Port()),
+			DstAddress:  c.Dst.Addr().String(),
+			DstPort:     uint32(c.Dst.Port()),
+			State:       string(c.State),
+			Packets:     c.Packets,
+			Bytes:       c.Bytes,
+			Age:         durationpb.New(c.Age),
+			Idle:        durationpb.New(c.Idle),
+			Outbound:    c.Outbound,
+		})
+	}
+	return resp, nil
+}
+
+// ListFlows returns the flows of a container, both directions joined
+func (s *nodeService) ListFlows(ctx context.Context, req *pb.ListFlowsRequest) (*pb.ListFlowsResponse, error) {
+	if req.GetContainerId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "container_id is required")
+	}
+	flows, err := s.network.ListFlows(req.GetContainerId())
+	if err != nil {
+		return nil, networkError(err)
+	}
+
+	resp := &pb.ListFlowsResponse{Flows: make([]*pb.Flow, 0, len(flows))}
+	for _, f := range flows {
+		resp.Flows = append(resp.Flows, &pb.Flow{
+			Protocol:      f.Protocol,
+			LocalAddress:  f.Local.Addr().String(),
+			LocalPort:     uint32(f.Local.Port()),
+			RemoteAddress: f.Remote.Addr().String(),
+			RemotePort:    uint32(f.Remote.Port()),
+			Outbound:      f.Outbound,
+			State:         string(f.State),
+			TxPackets:     f.TxPackets,
+			TxBytes:       f.TxBytes,
+			RxPackets:     f.RxPackets,
+			RxBytes:       f.RxBytes,
+			Age:           durationpb.New(f.Age),
+			Idle:          durationpb.New(f.Idle),
+		})
+	}
+	return resp, nil
+}
+
+// TopFlows returns the flows with the most traffic over the analytics
+// window, optionally of one container
+func (s *nodeService) TopFlows(ctx context.Context, req *pb.TopFlowsRequest) (*pb.TopFlowsResponse, error) {
+	if req.GetLimit() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	top, err := s.network.TopFlows(req.GetContainerId(), int(req.GetLimit()))
+	if err != nil {
+		return nil, networkError(err)
+	}
+
+	resp := &pb.TopFlowsResponse{
+		Window:     durationpb.New(top.Window),
+		Node:       talkersToProto("", top.Node),
+		Containers: make([]*pb.Talkers, 0, len(top.Containers)),
+	}
+	if !top.SampledAt.IsZero() {
+		resp.SampledAt = timestamppb.New(top.SampledAt)
+	}
+	for id, t := range top.Containers {
+		resp.Containers = append(resp.Containers, talkersToProto(id, t))
+	}
+	sort.Slice(resp.Containers, func(i, j int) bool {
+		a, b := resp.Containers[i], resp.Containers[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.ContainerId < b.ContainerId
+	})
+	return resp, nil
+}
+
+func talkersToProto(containerID string, t network.Talkers) *pb.Talkers {
+	out := &pb.Talkers{
+		ContainerId:      containerID,
+		Packets:          t.Packets,
+		Bytes:            t.Bytes,
+		PacketsPerSecond: t.PacketsPerSecond,
+		BytesPerSecond:   t.BytesPerSecond,
+		Flows:            make([]*pb.FlowRate, 0, len(t.Flows)),
+	}
+	for _, f := range t.Flows {
+		out.Flows = append(out.Flows, &pb.FlowRate{
+			ContainerId:      f.ContainerID,
+			Protocol:         f.Protocol,
+			SrcAddress:       f.Src.Addr().String(),
+			SrcPort:          uint32(f.Src.Port()),
+			DstAddress:       f.Dst.Addr().String(),
+			DstPort:          uint32(f.Dst.Port()),
+			Packets:          f.Packets,
+			Bytes:            f.Bytes,
+			PacketsPerSecond: f.PacketsPerSecond,
+			BytesPerSecond:   f.BytesPerSecond,
+		})
+	}
+	return out
+}
+
+// GetCapabilities returns the kernel features probed at startup and how
+// the XDP router uses them
+func (s *nodeService) GetCapabilities(ctx context.Context, req *pb.GetCapabilitiesRequest) (*pb.GetCapabilitiesResponse, error) {
+	k := s.network.KernelCapabilities()
+	caps := s.network.Capabilities()
+	resp := &pb.GetCapabilitiesResponse{
+		KernelRelease: k.Release,
+		ProbedAt:      timestamppb.New(k.ProbedAt),
+		Features:      make([]*pb.KernelFeature, 0, len(k.Features)),
+		Datapath: &pb.DatapathVariant{
+			DropEvents:   k.Datapath.DropEvents,
+			ConntrackMap: k.Datapath.ConntrackMap,
+			BatchOps:     k.Datapath.BatchOps,
+			Error:        k.Datapath.Error,
+			SynCookies:   k.Datapath.SYNCookies,
+
+			ConnectPolicy:      k.Datapath.ConnectPolicy,
+			SocketAcceleration: k.Datapath.SocketAcceleration,
+			ProxyRedirect:      k.Datapath.ProxyRedirect,
+		},
+		XdpAttached:   caps.XDP,
+		XdpMode:       string(caps.XDPMode),
+		XdpError:      caps.XDPError,
+		SynProtection: caps.SYNProtection,
+		SourceCheck:   caps.SourceCheck,
+		ConnectPolicy: caps.ConnectPolicy,
+
+		SocketAcceleration: caps.SocketAcceleration,
+		ProxyRedirect:      caps.ProxyRedirect,
+	}
+	for _, f := range k.Features {
+		resp.Features = append(resp.Features, &pb.KernelFeature{Name: f.Name, Available: f.Available, Error: f.Error})
+	}
+	for _, m := range k.Datapath.Modes {
+		resp.Datapath.Modes = append(resp.Datapath.Modes, string(m))
+	}
+	return resp, nil
+}
+
+// StreamDropEvents streams the packets the XDP router drops until the
+// client cancels or the control plane shuts down. Events are discarded
+// rather than buffered while the client is behind, and counted in the
+// next one sent.
+func (s *nodeService) StreamDropEvents(req *pb.StreamDropEventsRequest, stream pb.NodeService_StreamDropEventsServer) error {
+	w, err := s.network.WatchDrops(network.DropFilter{
+		ContainerID: req.GetContainerId(),
+		Reason:      network.DropReason(req.GetReason()),
+	})
+	if err != nil {
+		return networkError(err)
+	}
+	defer w.Close()
+
+	// Tell clients the stream is established, even before any drop
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-s.events.done:
+			return status.Error(codes.Unavailable, "control plane shutting down")
+		case e, ok := <-w.C:
+			if !ok {
+				return status.Error(codes.Unavailable, "control plane shutting down")
+			}
+			if err := stream.Send(dropEventToProto(e, w.Missed())); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func dropEventToProto(e network.DropEvent, missed uint64) *pb.DropEvent {
+	out := &pb.DropEvent{
+		Time:           timestamppb.New(e.Time),
+		Reason:         string(e.Reason),
+		Protocol:       e.Protocol,
+		DstPort:        uint32(e.Port),
+		Bytes:          uint64(e.Bytes),
+		ContainerId:    e.ContainerID,
+		SrcContainerId: e.SourceContainerID,
+		Policy:         e.Policy,
+		Missed:         missed,
+	}
+	if e.Src.IsValid() {
+		out.SrcAddress = e.Src.String()
+	}
+	if e.Dst.IsValid() {
+		out.DstAddress = e.Dst.String()
+	}
+	return out
+}
+
+// GetDropStats returns the drops of the XDP router counted by reason and
+// policy
+func (s *nodeService) GetDropStats(ctx context.Context, req *pb.GetDropStatsRequest) (*pb.GetDropStatsResponse, error) {
+	stats, err := s.network.DropStats()
+	if err != nil {
+		return nil, networkError(err)
+	}
+	resp := &pb.GetDropStatsResponse{Counts: make([]*pb.DropCount, 0, len(stats.Counts)), Lost: stats.Lost}
+	for _, c := range stats.Counts {
+		resp.Counts = append(resp.Counts, &pb.DropCount{Reason: string(c.Reason), Policy: c.Policy, Packets: c.Packets})
+	}
+	return resp, nil
+}
+
+// CollectGarbage removes, or with dry_run only finds, the network
+// resources no container owns. Orphans removed before a failure to list
+// the others are only logged.
+func (s *nodeService) CollectGarbage(ctx context.Context, req *pb.CollectGarbageRequest) (*pb.CollectGarbageResponse, error) {
+	orphans, err := s.network.CollectGarbage(ctx, req.GetDryRun())
+	if err != nil {
+		logging.FromContext(ctx, s.log).Error("Failed to collect orphaned network resources", "error", err)
+		return nil, networkError(err)
+	}
+	resp := &pb.CollectGarbageResponse{Orphans: make([]*pb.OrphanedResource, 0, len(orphans))}
+	for _, o := range orphans {
+		resp.Orphans = append(resp.Orphans, &pb.OrphanedResource{
+			Kind:    string(o.Kind),
+			Name:    o.Name,
+			Address: o.Address,
+			Removed: o.Removed,
+			Error:   o.Error,
+		})
+	}
+	return resp, nil
+}
+
+// SetMTU changes the container MTU of the node
+func (s *nodeService) SetMTU(ctx context.Context, req *pb.SetMTURequest) (*pb.SetMTUResponse, error) {
+	updated, err := s.network.SetMTU(ctx, int(req.GetMtu()))
+	if err != nil {
+		logging.FromContext(ctx, s.log).Error("Failed to set MTU", "mtu", req.GetMtu(), "updated", updated, "error", err)
+		return nil, networkError(err)
+	}
+	return &pb.SetMTUResponse{UpdatedContainers: int32(updated)}, nil
+}
+
+// AttachAFXDP creates an AF_XDP socket for a container and steers its
+// flows to it
+func (s *nodeService) AttachAFXDP(ctx context.Context, req *pb.AttachAFXDPRequest) (*pb.AttachAFXDPResponse, error) {
+	spec := network.AFXDPSpec{
+		ContainerID: req.GetContainerId(),
+		Queue:       int(req.GetQueue()),
+		FrameSize:   int(req.GetFrameSize()),
+		FrameCount:  int(req.GetFrameCount()),
+		SocketPath:  req.GetSocketPath(),
+		ZeroCopy:    req.GetZeroCopy(),
+	}
+	for _, f := range req.GetFlows() {
+		if f.GetPort() > 65535 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid port %d", f.GetPort())
+		}
+		spec.Flows = append(spec.Flows, network.AFXDPFlow{
+			Container: f.GetContainerId(),
+			Protocol:  f.GetProtocol(),
+			Port:      uint16(f.GetPort()),
+		})
+	}
+	x, err := s.network.AttachAFXDP(ctx, spec)
+	if err != nil {
+		logging.FromContext(ctx, s.log).Error("Failed to attach AF_XDP socket", "container_id", spec.ContainerID, "error", err)
+		return nil, networkError(err)
+	}
+	return &pb.AttachAFXDPResponse{Socket: afxdpSocketToProto(x)}, nil
+}
+
+// DetachAFXDP closes the AF_XDP socket of a container
+func (s *nodeService) DetachAFXDP(ctx context.Context, req *pb.DetachAFXDPRequest) (*pb.DetachAFXDPResponse, error) {
+	if req.GetContainerId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "container_id is required")
+	}
+	if err := s.network.DetachAFXDP(ctx, req.GetContainerId()); err != nil {
+		return nil, networkError(err)
+	}
+	return &pb.DetachAFXDPResponse{}, nil
+}
+
+// ListAFXDPSockets returns the AF_XDP sockets ordered by owner
+func (s *nodeService) ListAFXDPSockets(ctx context.Context, req *pb.ListAFXDPSocketsRequest) (*pb.ListAFXDPSocketsResponse, error) {
+	resp := &pb.ListAFXDPSocketsResponse{}
+	for _, x := range s.network.ListAFXDPSockets() {
+		resp.Sockets = append(resp.Sockets, afxdpSocketToProto(x))
+	}
+	return resp, nil
+}
+
+func afxdpSocketToProto(x network.AFXDPSocket) *pb.AFXDPSocket {
+	out := &pb.AFXDPSocket{
+		ContainerId: x.ContainerID,
+		Queue:       uint32(x.Queue),
+		FrameSize:   uint32(x.FrameSize),
+		FrameCount:  uint32(x.FrameCount),
+		SocketPath:  x.SocketPath,
+		ZeroCopy:    x.ZeroCopy,
+	}
+	for _, f := range x.Flows {
+		out.Flows = append(out.Flows, &pb.AFXDPFlow{ContainerId: f.Container, Protocol: f.Protocol, Port: uint32(f.Port)})
+	}
+	return out
+}
+
+// ApplyPolicy adds or replaces a network policy
+func (s *nodeService) ApplyPolicy(ctx context.Context, req *pb.ApplyPolicyRequest) (*pb.ApplyPolicyResponse, error) {
+	p := req.GetPolicy()
+	if p == nil {
+		return nil, status.Error(codes.InvalidArgument, "policy is required")
+	}
+	if p.GetPort() > 65535 {
+		return nil, status.Error(codes.InvalidArgument, "port must be at most 65535")
+	}
+	if err := s.network.ApplyPolicy(policyFromProto(p)); err != nil {
+		logging.FromContext(ctx, s.log).Error("Failed to apply network policy", "policy", p.GetName(), "error", err)
+		return nil, networkError(err)
+	}
+	s.publishPolicy(pb.ContainerEventType_CONTAINER_EVENT_TYPE_POLICY_APPLIED, p.GetName())
+	return &pb.ApplyPolicyResponse{}, nil
+}
+
+func policyFromProto(p *pb.NetworkPolicy) network.NetworkPolicy {
+	return network.NetworkPolicy{
+		Name:            p.GetName(),
+		Namespace:       namespaceOrDefault(p.GetNamespace()),
+		SourceContainer: p.GetSourceContainer(),
+		SourceCIDR:      p.GetSourceCidr(),
+		DestContainer:   p.GetDestContainer(),
+		DestCIDR:        p.GetDestCidr(),
+		Protocol:        p.GetProtocol(),
+		Port:            uint16(p.GetPort()),
+		Action:          network.PolicyAction(p.GetAction()),
+	}
+}
+
+// RemovePolicy deletes a network policy
+func (s *nodeService) RemovePolicy(ctx context.Context, req *pb.RemovePolicyRequest) (*pb.RemovePolicyResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	if err := s.network.RemovePolicy(req.GetName()); err != nil {
+		return nil, networkError(err)
+	}
+	s.publishPolicy(pb.ContainerEventType_CONTAINER_EVENT_TYPE_POLICY_REMOVED, req.GetName())
+	return &pb.RemovePolicyResponse{}, nil
+}
+
+// ListPolicies returns the network policies, or those of a namespace,
+// ordered by name
+func (s *nodeService) ListPolicies(ctx context.Context, req *pb.ListPoliciesRequest) (*pb.ListPoliciesResponse, error) {
+	resp := &pb.ListPoliciesResponse{}
+	for _, p := range s.network.ListPolicies() {
+		if req.GetNamespace() != "" && p.Namespace != req.Namespace {
+			continue
+		}
+		resp.Policies = append(resp.Policies, &pb.NetworkPolicy{
+			Name:            p.Name,
+			Namespace:       p.Namespace,
+			SourceContainer: p.SourceContainer,
+			SourceCidr:      p.SourceCIDR,
+			DestContainer:   p.DestContainer,
+			DestCidr:        p.DestCIDR,
+			Protocol:        p.Protocol,
+			Port:            uint32(p.Port),
+			Action:          string(p.Action),
+		})
+	}
+	return resp, nil
+}
+
+// ListReservations returns the addresses reserved for containers
+func (s *nodeService) ListReservations(ctx context.Context, req *pb.ListReservationsRequest) (*pb.ListReservationsResponse, error) {
+	reservations := s.network.ListReservations()
+	resp := &pb.ListReservationsResponse{Reservations: make([]*pb.Reservation, 0, len(reservations))}
+	for _, r := range reservations {
+		resp.Reservations = append(resp.Reservations, &pb.Reservation{
+			ContainerId: r.ContainerID,
+			Ip:          r.IPv4,
+			Ipv6:        r.IPv6,
+			Mac:         r.MAC,
+		})
+	}
+	return resp, nil
+}
+
+// ReleaseReservation drops the reserved addresses of a container
+func (s *nodeService) ReleaseReservation(ctx context.Context, req *pb.ReleaseReservationRequest) (*pb.ReleaseReservationResponse, error) {
+	if req.GetContainerId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "container_id is required")
+	}
+	if err := s.network.ReleaseReservation(req.GetContainerId()); err != nil {
+		return nil, networkError(err)
+	}
+	return &pb.ReleaseReservationResponse{}, nil
+}
+
+// ListSNATSlices returns the SNAT port slices of containers, or the one
+// holding a port
+func (s *nodeService) ListSNATSlices(ctx context.Context, req *pb.ListSNATSlicesRequest) (*pb.ListSNATSlicesResponse, error) {
+	if req.GetPort() > 65535 {
+		return nil, status.Error(codes.InvalidArgument, "port must be between 0 and 65535")
+	}
+	var slices []network.SNATSlice
+	if port := uint16(req.GetPort()); port != 0 {
+		slice, err := s.network.SNATMapping(port)
+		if err != nil {
+			return nil, networkError(err)
+		}
+		slices = append(slices, slice)
+	} else {
+		slices = s.network.ListSNATSlices()
+	}
+	resp := &pb.ListSNATSlicesResponse{Slices: make([]*pb.SNATSlice, 0, len(slices))}
+	for _, slice := range slices {
+		resp.Slices = append(resp.Slices, &pb.SNATSlice{
+			ContainerId: slice.ContainerID,
+			PortMin:     uint32(slice.Ports.Min),
+			PortMax:     uint32(slice.Ports.Max),
+		})
+	}
+	return resp, nil
+}
+
+// AddPeer adds or replaces an overlay peer
+func (s *nodeService) AddPeer(ctx context.Context, req *pb.AddPeerRequest) (*pb.AddPeerResponse, error) {
+	p := req.GetPeer()
+	if p == nil {
+		return nil, status.Error(codes.InvalidArgument, "peer is required")
+	}
+	err := s.network.AddPeer(network.Peer{
+		Name:      p.GetName(),
+		Address:   p.GetAddress(),
+		Subnet:    p.GetSubnet(),
+		Subnet6:   p.GetSubnet6(),
+		PublicKey: p.GetPublicKey(),
+	})
+	if err != nil {
+		logging.FromContext(ctx, s.log).Error("Failed to add overlay peer", "peer", p.GetName(), "error", err)
+		return nil, networkError(err)
+	}
+	return &pb.AddPeerResponse{}, nil
+}
+
+// RemovePeer removes an overlay peer
+func (s *nodeService) RemovePeer(ctx context.Context, req *pb.RemovePeerRequest) (*pb.RemovePeerResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	if err := s.network.RemovePeer(req.GetName()); err != nil {
+		return nil, networkError(err)
+	}
+	return &pb.RemovePeerResponse{}, nil
+}
+
+// ListPeers returns the overlay peers ordered by name
+func (s *nodeService) ListPeers(ctx context.Context, req *pb.ListPeersRequest) (*pb.ListPeersResponse, error) {
+	resp := &pb.ListPeersResponse{}
+	for _, p := range s.network.Peers() {
+		resp.Peers = append(resp.Peers, &pb.Peer{
+			Name:      p.Name,
+			Address:   p.Address,
+			Subnet:    p.Subnet,
+			Subnet6:   p.Subnet6,
+			PublicKey: p.PublicKey,
+		})
+	}
+	return resp, nil
+}
+
+// RotateOverlayKey replaces the node's WireGuard key
+func (s *nodeService) RotateOverlayKey(ctx context.Context, req *pb.RotateOverlayKeyRequest) (*pb.RotateOverlayKeyResponse, error) {
+	key, err := s.network.RotateKey()
+	if err != nil {
+		logging.FromContext(ctx, s.log).Error("Failed to rotate overlay key", "error", err)
+		return nil, networkError(err)
+	}
+	return &pb.RotateOverlayKeyResponse{PublicKey: key}, nil
+}
+
+// RegisterNode adds a worker node to the registry
+func (s *nodeService) RegisterNode(ctx context.Context, req *pb.RegisterNodeRequest) (*pb.RegisterNodeResponse, error) {
+	if err := validateNodeName(req.GetName()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &pb.RegisterNodeResponse{
+		Node:              s.nodes.register(req),
+		HeartbeatInterval: durationpb.New(s.nodes.interval),
+	}, nil
+}
+
+// NodeHeartbeat keeps a registered node ready
+func (s *nodeService) NodeHeartbeat(ctx context.Context, req *pb.NodeHeartbeatRequest) (*pb.NodeHeartbeatResponse, error) {
+	if err := validateNodeName(req.GetName()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	n, ok := s.nodes.heartbeat(req)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "node %q is not registered", req.Name)
+	}
+	return &pb.NodeHeartbeatResponse{Node: n}, nil
+}
+
+// ListNodes returns the registered nodes ordered by name, from the Raft
+// replica on followers
+func (s *nodeService) ListNodes(ctx context.Context, req *pb.ListNodesRequest) (*pb.ListNodesResponse, error) {
+	if s.nodes.cluster != nil && !s.nodes.cluster.IsLeader() {
+		return &pb.ListNodesResponse{Nodes: s.nodes.cluster.fsm.listNodes()}, nil
+	}
+	return &pb.ListNodesResponse{Nodes: s.nodes.list()}, nil
+}
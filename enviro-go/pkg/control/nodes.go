@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// DefaultHeartbeatInterval is how often registered nodes heartbeat unless
+// configured otherwise
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// DefaultMissedHeartbeats is how many heartbeats a node may miss before
+// it is marked NOT_READY, unless configured otherwise
+const DefaultMissedHeartbeats = 3
+
+// maxNodeNameLen bounds node names, the length of a DNS name
+const maxNodeNameLen = 253
+
+// NodeRegistryConfig tunes the registry of worker nodes
+type NodeRegistryConfig struct {
+	// HeartbeatInterval is how often nodes are asked to heartbeat,
+	// DefaultHeartbeatInterval when zero
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+	// MissedHeartbeats marks nodes NOT_READY once they missed this many
+	// heartbeats in a row, DefaultMissedHeartbeats when zero
+	MissedHeartbeats int `json:"missed_heartbeats"`
+}
+
+func (c NodeRegistryConfig) validate() error {
+	if c.HeartbeatInterval < 0 || c.MissedHeartbeats < 0 {
+		return errors.New("heartbeat_interval and missed_heartbeats must not be negative")
+	}
+	return nil
+}
+
+// nodeRegistry tracks the worker nodes registered with the leader
+type nodeRegistry struct {
+	interval time.Duration
+	// grace is how long a node may go without heartbeating
+	grace time.Duration
+	log   *slog.Logger
+	// cluster replicates the registry while leading. It is nil without
+	// Raft.
+	cluster *raftCluster
+	// leading reports whether this control plane leads; followers don't
+	// sweep, as nodes heartbeat to the leader
+	leading func() bool
+	// events receives NODE_LOST and NODE_READY, when set
+	events *eventBus
+
+	mu    sync.Mutex
+	nodes map[string]*pb.Node
+	// seen is when each node last heartbeat on the local clock, which
+	// unlike Node.LastHeartbeat is unaffected by a change of leader
+	seen map[string]time.Time
+}
+
+func newNodeRegistry(config NodeRegistryConfig, logger *slog.Logger) *nodeRegistry {
+	interval := config.HeartbeatInterval
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	missed := config.MissedHeartbeats
+	if missed == 0 {
+		missed = DefaultMissedHeartbeats
+	}
+	return &nodeRegistry{
+		interval: interval,
+		grace:    interval * time.Duration(missed),
+		log:      logger,
+		leading:  func() bool { return true },
+		nodes:    make(map[string]*pb.Node),
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// register adds the node of req as ready, or updates it when it is
+// already registered
+func (r *nodeRegistry) register(req *pb.RegisterNodeRequest) *pb.Node {
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[req.Name]
+	if !ok {
+		n = &pb.Node{Name: req.Name, RegisteredAt: timestamppb.New(now)}
+		r.nodes[req.Name] = n
+		r.log.Info("Registered node", "node", req.Name, "address", req.Address)
+	}
+	n.Address = req.Address
+	n.Labels = req.Labels
+	n.Zone = req.Zone
+	n.Rack = req.Rack
+	n.Unschedulable = req.Unschedulable
+	r.beat(n, req.Capacity, now)
+	return proto.Clone(n).(*pb.Node)
+}
+
+// heartbeat marks the node of req ready with its capacity, false when the
+// node is not registered
+func (r *nodeRegistry) heartbeat(req *pb.NodeHeartbeatRequest) (*pb.Node, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[req.Name]
+	if !ok {
+		return nil, false
+	}
+	if n.Unschedulable != req.Unschedulable {
+		r.log.Info("Node changed schedulability", "node", n.Name, "unschedulable", req.Unschedulable)
+		n.Unschedulable = req.Unschedulable
+	}
+	r.beat(n, req.Capacity, time.Now())
+	return proto.Clone(n).(*pb.Node), true
+}
+
+// beat records a heartbeat of n and replicates it, keeping its capacity
+// when none is reported. Callers must hold r.mu.
+func (r *nodeRegistry) beat(n *pb.Node, capacity *pb.NodeCapacity, now time.Time) {
+	if n.State == pb.NodeState_NODE_STATE_NOT_READY {
+		r.log.Info("Node is ready again", "node", n.Name)
+		r.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NODE_READY, n.Name, now)
+	}
+	n.State = pb.NodeState_NODE_STATE_READY
+	if capacity != nil {
+		n.Capacity = capacity
+	}
+	n.LastHeartbeat = timestamppb.New(now)
+	r.seen[n.Name] = now
+	r.replicate(n)
+}
+
+// get returns a copy of node name
+func (r *nodeRegistry) get(name string) (*pb.Node, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[name]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(n).(*pb.Node), true
+}
+
+// cordon marks node name unschedulable until it reports otherwise
+func (r *nodeRegistry) cordon(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[name]
+	if !ok || n.Unschedulable {
+		return
+	}
+	n.Unschedulable = true
+	r.log.Info("Node is unschedulable", "node", name)
+	r.replicate(n)
+}
+
+// reserve takes the resources of p and an address off the capacity of
+// node name, until the node reports its capacity again
+func (r *nodeRegistry) reserve(name string, p *pb.Placement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[name]
+	if !ok || n.Capacity == nil {
+		return
+	}
+	n.Capacity.CpuMillicores -= p.CpuMillicores
+	n.Capacity.MemoryBytes -= p.MemoryBytes
+	if n.Capacity.IpPoolFree > 0 {
+		n.Capacity.IpPoolFree--
+	}
+	r.replicate(n)
+}
+
+// list returns copies of the nodes ordered by name
+func (r *nodeRegistry) list() []*pb.Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]*pb.Node, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		out = append(out, proto.Clone(n).(*pb.Node))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// sweep marks the ready nodes that haven't heartbeat within the grace
+// period NOT_READY
+func (r *nodeRegistry) sweep(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, n := range r.nodes {
+		if n.State == pb.NodeState_NODE_STATE_READY && now.Sub(r.seen[name]) > r.grace {
+			n.State = pb.NodeState_NODE_STATE_NOT_READY
+			r.log.Warn("Node missed heartbeats", "node", name, "last_heartbeat", n.LastHeartbeat.AsTime())
+			r.publish(pb.ContainerEventType_CONTAINER_EVENT_TYPE_NODE_LOST, name, now)
+			r.replicate(n)
+		}
+	}
+}
+
+// run sweeps the registry every heartbeat interval until stop is closed
+func (r *nodeRegistry) run(stop <-chan struct{}) {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			if r.leading() {
+				r.sweep(now)
+			}
+		}
+	}
+}
+
+// adopt replaces the registry with the nodes replicated by the previous
+// leader, giving each a full grace period to heartbeat to this one
+func (r *nodeRegistry) adopt(nodes []*pb.Node) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes = make(map[string]*pb.Node, len(nodes))
+	r.seen = make(map[string]time.Time, len(nodes))
+	for _, n := range nodes {
+		r.nodes[n.Name] = n
+		r.seen[n.Name] = now
+	}
+}
+
+// publish reports a change of a node's readiness to watchers
+func (r *nodeRegistry) publish(typ pb.ContainerEventType, name string, now time.Time) {
+	if r.events != nil {
+		r.events.publish(&pb.ContainerEvent{Type: typ, Timestamp: timestamppb.New(now), Node: name})
+	}
+}
+
+// replicate copies n to the followers. Callers must hold r.mu.
+func (r *nodeRegistry) replicate(n *pb.Node) {
+	if r.cluster != nil {
+		r.cluster.putNode(n)
+	}
+}
+
+// validateNodeName checks that a node has a name of reasonable length
+func validateNodeName(name string) error {
+	if name == "" {
+		return errors.New("node name is required")
+	}
+	if len(name) > maxNodeNameLen {
+		return fmt.Errorf("node name is longer than %d characters", maxNodeNameLen)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// TestNodeRegistry marks a node NOT_READY once it missed its heartbeats
+// and READY again on the next one
+func TestNodeRegistry(t *testing.T) {
+	r := newNodeRegistry(NodeRegistryConfig{HeartbeatInterval: time.Second, MissedHeartbeats: 2},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	r.events = newEventBus()
+	if r.grace != 2*time.Second {
+		t.Errorf("grace %s, want 2s", r.grace)
+	}
+	capacity := &pb.NodeCapacity{CpuMillicores: 2000, MemoryBytes: 1 << 30, IpPoolFree: 10}
+	n := r.register(&pb.RegisterNodeRequest{Name: "b", Address: "192.0.2.2:7443", Zone: "z1", Capacity: capacity})
+	if n.State != pb.NodeState_NODE_STATE_READY || n.RegisteredAt == nil || n.Capacity.GetCpuMillicores() != 2000 {
+		t.Errorf("register() = %v", n)
+	}
+	r.register(&pb.RegisterNodeRequest{Name: "a"})
+	if _, ok := r.heartbeat(&pb.NodeHeartbeatRequest{Name: "c"}); ok {
+		t.Error("heartbeat() of an unregistered node succeeded")
+	}
+
+	// Registering again updates the node, keeping when it registered
+	again := r.register(&pb.RegisterNodeRequest{Name: "b", Address: "192.0.2.3:7443"})
+	if again.Address != "192.0.2.3:7443" || again.Zone != "" || !again.RegisteredAt.AsTime().Equal(n.RegisteredAt.AsTime()) {
+		t.Errorf("register() again = %v", again)
+	}
+	if again.Capacity.GetCpuMillicores() != 2000 {
+		t.Errorf("capacity %v after registering without one, want it kept", again.Capacity)
+	}
+
+	r.sweep(time.Now().Add(time.Second))
+	if n, _ := r.get("b"); n.State != pb.NodeState_NODE_STATE_READY {
+		t.Errorf("state %v within the grace period, want ready", n.State)
+	}
+	r.sweep(time.Now().Add(3 * time.Second))
+	nodes := r.list()
+	if len(nodes) != 2 || nodes[0].Name != "a" || nodes[1].Name != "b" {
+		t.Fatalf("list() = %v, want a and b", nodes)
+	}
+	for _, n := range nodes {
+		if n.State != pb.NodeState_NODE_STATE_NOT_READY {
+			t.Errorf("node %s %v after missed heartbeats, want not ready", n.Name, n.State)
+		}
+	}
+	n, ok := r.heartbeat(&pb.NodeHeartbeatRequest{Name: "b", Unschedulable: true,
+		Capacity: &pb.NodeCapacity{CpuMillicores: 500}})
+	if !ok || n.State != pb.NodeState_NODE_STATE_READY || !n.Unschedulable || n.Capacity.GetCpuMillicores() != 500 {
+		t.Errorf("heartbeat() = %v, %v", n, ok)
+	}
+
+	var got []string
+	for _, ev := range r.events.history {
+		got = append(got, ev.Type.String()+" "+ev.Node)
+	}
+	// A sweep marks nodes in no particular order
+	if len(got) == 3 {
+		sort.Strings(got[:2])
+	}
+	want := []string{"CONTAINER_EVENT_TYPE_NODE_LOST a", "CONTAINER_EVENT_TYPE_NODE_LOST b", "CONTAINER_EVENT_TYPE_NODE_READY b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+
+	// An adopted node has a full grace period from now
+	r.adopt([]*pb.Node{{Name: "c", State: pb.NodeState_NODE_STATE_READY}})
+	r.sweep(time.Now().Add(time.Second))
+	if nodes := r.list(); len(nodes) != 1 || nodes[0].State != pb.NodeState_NODE_STATE_READY {
+		t.Errorf("list() after adopting = %v, want c ready", nodes)
+	}
+}
+
+func TestNodeRegistryRPCs(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := newNodeService(nil, newEventBus(), newNodeRegistry(NodeRegistryConfig{}, logger), nil, logger)
+
+	resp, err := s.RegisterNode(ctx, &pb.RegisterNodeRequest{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.HeartbeatInterval.AsDuration() != DefaultHeartbeatInterval {
+		t.Errorf("heartbeat interval %s, want %s", resp.HeartbeatInterval.AsDuration(), DefaultHeartbeatInterval)
+	}
+	if _, err := s.NodeHeartbeat(ctx, &pb.NodeHeartbeatRequest{Name: "a"}); err != nil {
+		t.Errorf("NodeHeartbeat() = %v", err)
+	}
+	if _, err := s.NodeHeartbeat(ctx, &pb.NodeHeartbeatRequest{Name: "b"}); status.Code(err) != codes.NotFound {
+		t.Errorf("NodeHeartbeat() of an unregistered node = %v, want %v", err, codes.NotFound)
+	}
+	for _, name := range []string{"", strings.Repeat("n", maxNodeNameLen+1)} {
+		if _, err := s.RegisterNode(ctx, &pb.RegisterNodeRequest{Name: name}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("RegisterNode() of a %d character name = %v, want %v", len(name), err, codes.InvalidArgument)
+		}
+	}
+	list, err := s.ListNodes(ctx, &pb.ListNodesRequest{})
+	if err != nil || len(list.Nodes) != 1 || list.Nodes[0].Name != "a" {
+		t.Errorf("ListNodes() = %v, %v, want a", list, err)
+	}
+	if err := (NodeRegistryConfig{MissedHeartbeats: -1}).validate(); err == nil {
+		t.Error("validate() of negative missed heartbeats succeeded")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// PrivilegeConfig drops the privileges of the standalone server once it
+// is initialized. The c-shared library never drops them, as the process
+// belongs to the Rust runtime.
+type PrivilegeConfig struct {
+	// User to run as once initialized, as a name or numeric ID. Empty
+	// keeps running as the user the server was started as.
+	User string `json:"user"`
+	// Group to run as, the primary group of User by default
+	Group string `json:"group"`
+}
+
+func (c PrivilegeConfig) validate() error {
+	if c.Group != "" && c.User == "" {
+		return errors.New("group needs user")
+	}
+	return nil
+}
+
+// ids returns the uid and gid to run as
+func (c PrivilegeConfig) ids() (uid, gid int, err error) {
+	uid, err = lookupID(c.User, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid user: %w", err)
+	}
+	group := c.Group
+	if group == "" {
+		u, err := user.LookupId(strconv.Itoa(uid))
+		if err != nil {
+			return 0, 0, fmt.Errorf("no primary group of user %s, set a group: %w", c.User, err)
+		}
+		group = u.Gid
+	}
+	gid, err = lookupID(group, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid group: %w", err)
+	}
+	return uid, gid, nil
+}
+
+// DropPrivileges switches the process to the user and group of
+// config.Privileges once the control plane is initialized, keeping only
+// the capabilities the network manager still needs, and hands the
+// directories the control plane keeps writing to over to them. The
+// process should exit when it fails, as it may be left with neither its
+// privileges nor the ones it needs. It does nothing without a user.
+func (cp *ControlPlane) DropPrivileges() error {
+	config := cp.config.Privileges
+	if config.User == "" {
+		return nil
+	}
+	uid, gid, err := config.ids()
+	if err != nil {
+		return err
+	}
+	dirs := []string{cp.config.StateDir, cp.config.Images.dir(cp.config.StateDir)}
+	if cp.config.Raft != nil {
+		dirs = append(dirs, cp.config.Raft.Dir)
+	}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if err := chownTree(dir, uid, gid); err != nil {
+			return fmt.Errorf("failed to hand %s over to %d:%d: %w", dir, uid, gid, err)
+		}
+	}
+	return cp.network.DropPrivileges(uid, gid)
+}
+
+// chownTree changes the owner of dir and everything below it, without
+// following links
+func chownTree(dir string, uid, gid int) error {
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
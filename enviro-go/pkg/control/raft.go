@@ -0,0 +1,714 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// Raft tuning. Commands are applied asynchronously, so applyTimeout only
+// bounds queueing them while the leader is busy.
+const (
+	raftTransportTimeout = 10 * time.Second
+	raftMaxPool          = 3
+	raftRetainSnapshots  = 2
+	raftLogCache         = 512
+	raftApplyTimeout     = 5 * time.Second
+)
+
+// RaftConfig runs an embedded Raft cluster among the control planes in
+// Peers. It elects the leader in place of a Coordinator and replicates the
+// leader's container registry, including each container's addresses, its
+// services and its registered nodes to the followers, which serve
+// ListContainers, GetContainer, ListServices and ListNodes from their
+// replica. A new leader takes over the registered nodes.
+//
+// The Raft transport is neither encrypted nor authenticated; keep it on a
+// trusted network.
+type RaftConfig struct {
+	// ID is this control plane's ID among Peers
+	ID string `json:"id"`
+	// Dir holds the Raft log and snapshots
+	Dir string `json:"dir"`
+	// BindAddress is the host:port the Raft transport listens on, the
+	// RaftAddress of this control plane's peer when empty
+	BindAddress string `json:"bind_address"`
+	// Peers are all members of the cluster, this control plane included.
+	// A member without Raft state bootstraps the cluster with them, so
+	// they must be the same on every member.
+	Peers []RaftPeer `json:"peers"`
+}
+
+// RaftPeer is a member of a Raft cluster of control planes
+type RaftPeer struct {
+	ID string `json:"id"`
+	// RaftAddress is the host:port members reach its Raft transport on
+	RaftAddress string `json:"raft_address"`
+	// Address is where clients reach its gRPC server
+	Address string `json:"address"`
+}
+
+// validate checks that the peers are complete and include c.ID
+func (c RaftConfig) validate() error {
+	if c.ID == "" || c.Dir == "" {
+		return errors.New("raft: id and dir are required")
+	}
+	ids := make(map[string]bool)
+	for _, p := range c.Peers {
+		if p.ID == "" || p.RaftAddress == "" || p.Address == "" {
+			return errors.New("raft: peers need an id, raft_address and address")
+		}
+		if ids[p.ID] {
+			return fmt.Errorf("raft: duplicate peer %s", p.ID)
+		}
+		ids[p.ID] = true
+	}
+	if !ids[c.ID] {
+		return fmt.Errorf("raft: id %s is not among the peers", c.ID)
+	}
+	return nil
+}
+
+// self returns the peer of this control plane
+func (c RaftConfig) self() RaftPeer {
+	for _, p := range c.Peers {
+		if p.ID == c.ID {
+			return p
+		}
+	}
+	return RaftPeer{}
+}
+
+// raftCluster is a control plane's member of a Raft cluster. It implements
+// Coordinator with Raft's leader election, and holds the replicated state.
+type raftCluster struct {
+	config RaftConfig
+	raft   *raft.Raft
+	fsm    *replicatedState
+	log    *slog.Logger
+	// closers release the transport and stores after raft shuts down
+	closers  []io.Closer
+	observer *raft.Observer
+	stop     chan struct{}
+
+	mu     sync.Mutex
+	leader Leader
+	// changed is closed and replaced whenever the leader changes
+	changed chan struct{}
+}
+
+// newRaftCluster opens the Raft state in config.Dir, bootstrapping the
+// cluster on first start, and joins it
+func newRaftCluster(config RaftConfig, logger *slog.Logger) (*raftCluster, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	self := config.self()
+	bind := config.BindAddress
+	if bind == "" {
+		bind = self.RaftAddress
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", self.RaftAddress)
+	if err != nil {
+		return nil, fmt.Errorf("raft: invalid raft_address %s: %w", self.RaftAddress, err)
+	}
+
+	hlog := newRaftLogger(logger)
+	c := &raftCluster{
+		config:  config,
+		fsm:     newReplicatedState(),
+		log:     logger,
+		stop:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	fail := func(err error) (*raftCluster, error) {
+		c.closeStores()
+		return nil, err
+	}
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(config.Dir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("raft: failed to open log: %w", err)
+	}
+	c.closers = append(c.closers, store)
+	logs, err := raft.NewLogCache(raftLogCache, store)
+	if err != nil {
+		return fail(err)
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(config.Dir, raftRetainSnapshots, hlog)
+	if err != nil {
+		return fail(fmt.Errorf("raft: failed to open snapshots: %w", err))
+	}
+	transport, err := raft.NewTCPTransportWithLogger(bind, advertise, raftMaxPool, raftTransportTimeout, hlog)
+	if err != nil {
+		return fail(fmt.Errorf("raft: failed to listen on %s: %w", bind, err))
+	}
+	c.closers = append(c.closers, transport)
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(config.ID)
+	conf.Logger = hlog
+
+	existing, err := raft.HasExistingState(logs, store, snaps)
+	if err != nil {
+		return fail(err)
+	}
+	if !existing {
+		var servers []raft.Server
+		for _, p := range config.Peers {
+			servers = append(servers, raft.Server{
+				ID:      raft.ServerID(p.ID),
+				Address: raft.ServerAddress(p.RaftAddress),
+			})
+		}
+		if err := raft.BootstrapCluster(conf, logs, store, snaps, transport, raft.Configuration{Servers: servers}); err != nil {
+			return fail(fmt.Errorf("raft: failed to bootstrap: %w", err))
+		}
+	}
+
+	if c.raft, err = raft.NewRaft(conf, c.fsm, logs, store, snaps, transport); err != nil {
+		return fail(fmt.Errorf("raft: %w", err))
+	}
+	observations := make(chan raft.Observation, 16)
+	c.observer = raft.NewObserver(observations, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	})
+	c.raft.RegisterObserver(c.observer)
+	go c.observe(observations)
+
+	logger.Info("Joined Raft cluster", "id", config.ID, "raft_address", self.RaftAddress,
+		"peers", len(config.Peers), "bootstrapped", !existing)
+	return c, nil
+}
+
+// observe tracks the leader until close
+func (c *raftCluster) observe(observations <-chan raft.Observation) {
+	for {
+		select {
+		case o := <-observations:
+			leader := o.Data.(raft.LeaderObservation)
+			c.setLeader(c.peerLeader(string(leader.LeaderID)))
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// peerLeader returns the Leader of peer id, the zero Leader when id is
+// empty
+func (c *raftCluster) peerLeader(id string) Leader {
+	if id == "" {
+		return Leader{}
+	}
+	for _, p := range c.config.Peers {
+		if p.ID == id {
+			return Leader{ID: p.ID, Address: p.Address}
+		}
+	}
+	return Leader{ID: id}
+}
+
+// setLeader changes the leader and wakes up campaigners and watchers
+func (c *raftCluster) setLeader(leader Leader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if leader == c.leader {
+		return
+	}
+	c.leader = leader
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// current returns the leader and a channel closed on its change
+func (c *raftCluster) current() (Leader, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader, c.changed
+}
+
+// Campaign implements Coordinator. Raft holds elections on its own, so
+// this only waits for this control plane to win one.
+func (c *raftCluster) Campaign(ctx context.Context) error {
+	for {
+		_, changed := c.current()
+		if c.IsLeader() {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Resign implements Coordinator by transferring leadership to another
+// voter, if there is one
+func (c *raftCluster) Resign(ctx context.Context) error {
+	if !c.IsLeader() || len(c.config.Peers) < 2 {
+		return nil
+	}
+	return c.raft.LeadershipTransfer().Error()
+}
+
+// IsLeader implements Coordinator
+func (c *raftCluster) IsLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// Watch implements Coordinator
+func (c *raftCluster) Watch(ctx context.Context) <-chan Leader {
+	out := make(chan Leader, 1)
+	go func() {
+		defer close(out)
+		sent, last := false, Leader{}
+		for {
+			leader, changed := c.current()
+			if !sent || leader != last {
+				select {
+				case out <- leader:
+					sent, last = true, leader
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// apply replicates cmd when leading. It doesn't wait for the command to
+// commit; failures are logged, as the next sync on election repairs them.
+func (c *raftCluster) apply(cmd raftCommand) {
+	if !c.IsLeader() {
+		return
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		c.log.Error("Failed to encode Raft command", "op", cmd.Op, "error", err)
+		return
+	}
+	f := c.raft.Apply(data, raftApplyTimeout)
+	go func() {
+		if err := f.Error(); err != nil {
+			c.log.Warn("Failed to replicate state", "op", cmd.Op, "key", cmd.Key, "error", err)
+		}
+	}()
+}
+
+// applyIdentity replicates change to the identities, waiting for it to
+// commit, unlike the other state the leader rebuilds on election
+func (c *raftCluster) applyIdentity(change identityChange) error {
+	if !c.IsLeader() {
+		return raft.ErrNotLeader
+	}
+	value, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(raftCommand{Op: opIdentity, Value: value})
+	if err != nil {
+		return err
+	}
+	f := c.raft.Apply(data, raftApplyTimeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// barrier waits for the FSM to apply every committed command, e.g. those
+// of the previous leader
+func (c *raftCluster) barrier() error {
+	return c.raft.Barrier(raftApplyTimeout).Error()
+}
+
+// putContainer replicates the record of c
+func (c *raftCluster) putContainer(container *pb.Container) {
+	c.apply(newRaftCommand(opPutContainer, container.Id, container))
+}
+
+// deleteContainer replicates the removal of container id
+func (c *raftCluster) deleteContainer(id string) {
+	c.apply(raftCommand{Op: opDeleteContainer, Key: id})
+}
+
+// putService replicates the definition of svc
+func (c *raftCluster) putService(svc *pb.Service) {
+	c.apply(newRaftCommand(opPutService, svc.Name, svc))
+}
+
+// deleteService replicates the removal of service name
+func (c *raftCluster) deleteService(name string) {
+	c.apply(raftCommand{Op: opDeleteService, Key: name})
+}
+
+// putNode replicates the registration of node n
+func (c *raftCluster) putNode(n *pb.Node) {
+	c.apply(newRaftCommand(opPutNode, n.Name, n))
+}
+
+// sync replaces the replicated containers and services with the leader's,
+// after an election
+func (c *raftCluster) sync(containers []*pb.Container, services []*pb.Service) {
+	snap := raftSnapshot{
+		Containers: make(map[string]json.RawMessage, len(containers)),
+		Services:   make(map[string]json.RawMessage, len(services)),
+	}
+	for _, container := range containers {
+		snap.Containers[container.Id], _ = protojson.Marshal(container)
+	}
+	for _, svc := range services {
+		snap.Services[svc.Name], _ = protojson.Marshal(svc)
+	}
+	value, err := json.Marshal(snap)
+	if err != nil {
+		c.log.Error("Failed to encode Raft command", "op", opSync, "error", err)
+		return
+	}
+	c.apply(raftCommand{Op: opSync, Value: value})
+}
+
+// close leaves the cluster; a leader should have resigned first
+func (c *raftCluster) close() error {
+	close(c.stop)
+	c.raft.DeregisterObserver(c.observer)
+	err := c.raft.Shutdown().Error()
+	c.closeStores()
+	return err
+}
+
+// closeStores closes the transport and the log store
+func (c *raftCluster) closeStores() {
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i].Close()
+	}
+	c.closers = nil
+}
+
+// Raft command operations
+const (
+	opPutContainer    = "put_container"
+	opDeleteContainer = "delete_container"
+	opPutService      = "put_service"
+	opDeleteService   = "delete_service"
+	opPutNode         = "put_node"
+	opSync            = "sync"
+	opIdentity        = "identity"
+)
+
+// raftCommand is a change to the replicated state, as stored in the Raft
+// log. Value holds a container or service in the protobuf JSON mapping, or
+// a raftSnapshot for opSync, or an identityChange for opIdentity.
+type raftCommand struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func newRaftCommand(op, key string, m proto.Message) raftCommand {
+	value, _ := protojson.Marshal(m)
+	return raftCommand{Op: op, Key: key, Value: value}
+}
+
+// raftSnapshot is the replicated state, keyed by container ID, service
+// name and node name, and the identities. opSync leaves out the nodes
+// and identities.
+type raftSnapshot struct {
+	Containers map[string]json.RawMessage `json:"containers"`
+	Services   map[string]json.RawMessage `json:"services"`
+	Nodes      map[string]json.RawMessage `json:"nodes,omitempty"`
+	Identities *identityState             `json:"identities,omitempty"`
+}
+
+// replicatedState is the Raft FSM holding the leader's containers,
+// services and nodes, and the identities of label sets
+type replicatedState struct {
+	mu         sync.RWMutex
+	containers map[string]*pb.Container
+	services   map[string]*pb.Service
+	nodes      map[string]*pb.Node
+	// identities are changed only through Raft, so they are the same on
+	// every control plane
+	identities *identityTable
+}
+
+func newReplicatedState() *replicatedState {
+	return &replicatedState{
+		containers: make(map[string]*pb.Container),
+		services:   make(map[string]*pb.Service),
+		nodes:      make(map[string]*pb.Node),
+		identities: newIdentityTable(),
+	}
+}
+
+// Apply implements raft.FSM
+func (s *replicatedState) Apply(l *raft.Log) any {
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd.Op {
+	case opPutContainer:
+		c := &pb.Container{}
+		if err := protojson.Unmarshal(cmd.Value, c); err != nil {
+			return err
+		}
+		s.containers[cmd.Key] = c
+	case opDeleteContainer:
+		delete(s.containers, cmd.Key)
+	case opPutService:
+		svc := &pb.Service{}
+		if err := protojson.Unmarshal(cmd.Value, svc); err != nil {
+			return err
+		}
+		s.services[cmd.Key] = svc
+	case opDeleteService:
+		delete(s.services, cmd.Key)
+	case opPutNode:
+		n := &pb.Node{}
+		if err := protojson.Unmarshal(cmd.Value, n); err != nil {
+			return err
+		}
+		s.nodes[cmd.Key] = n
+	case opSync:
+		var snap raftSnapshot
+		if err := json.Unmarshal(cmd.Value, &snap); err != nil {
+			return err
+		}
+		return s.restore(snap, false)
+	case opIdentity:
+		var change identityChange
+		if err := json.Unmarshal(cmd.Value, &change); err != nil {
+			return err
+		}
+		s.identities.apply(change)
+	default:
+		return fmt.Errorf("raft: unknown command %q", cmd.Op)
+	}
+	return nil
+}
+
+// Snapshot implements raft.FSM
+func (s *replicatedState) Snapshot() (raft.FSMSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := raftSnapshot{
+		Containers: make(map[string]json.RawMessage, len(s.containers)),
+		Services:   make(map[string]json.RawMessage, len(s.services)),
+		Nodes:      make(map[string]json.RawMessage, len(s.nodes)),
+	}
+	identities := s.identities.snapshot()
+	snap.Identities = &identities
+	for id, c := range s.containers {
+		data, err := protojson.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		snap.Containers[id] = data
+	}
+	for name, svc := range s.services {
+		data, err := protojson.Marshal(svc)
+		if err != nil {
+			return nil, err
+		}
+		snap.Services[name] = data
+	}
+	for name, n := range s.nodes {
+		data, err := protojson.Marshal(n)
+		if err != nil {
+			return nil, err
+		}
+		snap.Nodes[name] = data
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	return stateSnapshot(data), nil
+}
+
+// Restore implements raft.FSM
+func (s *replicatedState) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	var snap raftSnapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restore(snap, true)
+}
+
+// restore replaces the containers and services with those of snap, and
+// the nodes and identities too when withNodes is set. Callers must hold
+// s.mu.
+func (s *replicatedState) restore(snap raftSnapshot, withNodes bool) error {
+	containers := make(map[string]*pb.Container, len(snap.Containers))
+	for id, data := range snap.Containers {
+		c := &pb.Container{}
+		if err := protojson.Unmarshal(data, c); err != nil {
+			return err
+		}
+		containers[id] = c
+	}
+	services := make(map[string]*pb.Service, len(snap.Services))
+	for name, data := range snap.Services {
+		svc := &pb.Service{}
+		if err := protojson.Unmarshal(data, svc); err != nil {
+			return err
+		}
+		services[name] = svc
+	}
+	if withNodes {
+		nodes := make(map[string]*pb.Node, len(snap.Nodes))
+		for name, data := range snap.Nodes {
+			n := &pb.Node{}
+			if err := protojson.Unmarshal(data, n); err != nil {
+				return err
+			}
+			nodes[name] = n
+		}
+		s.nodes = nodes
+		identities := newIdentityState()
+		if snap.Identities != nil {
+			identities = *snap.Identities
+		}
+		s.identities.restore(identities)
+	}
+	s.containers, s.services = containers, services
+	return nil
+}
+
+// listContainers returns copies of the replicated containers ordered by ID
+func (s *replicatedState) listContainers() []*pb.Container {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*pb.Container, 0, len(s.containers))
+	for _, c := range s.containers {
+		out = append(out, cloneContainer(c))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out
+}
+
+// getContainer returns a copy of replicated container id
+func (s *replicatedState) getContainer(id string) (*pb.Container, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.containers[id]
+	if !ok {
+		return nil, false
+	}
+	return cloneContainer(c), true
+}
+
+// listServices returns copies of the replicated services ordered by name
+func (s *replicatedState) listServices() []*pb.Service {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*pb.Service, 0, len(s.services))
+	for _, svc := range s.services {
+		out = append(out, proto.Clone(svc).(*pb.Service))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// listNodes returns copies of the replicated nodes ordered by name
+func (s *replicatedState) listNodes() []*pb.Node {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*pb.Node, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		out = append(out, proto.Clone(n).(*pb.Node))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// stateSnapshot is an encoded raftSnapshot
+type stateSnapshot []byte
+
+// Persist implements raft.FSMSnapshot
+func (s stateSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release implements raft.FSMSnapshot
+func (s stateSnapshot) Release() {}
+
+// raftSink forwards Raft's logs to the control plane logger
+type raftSink struct {
+	log *slog.Logger
+}
+
+// newRaftLogger returns a Raft logger writing to logger
+func newRaftLogger(logger *slog.Logger) hclog.Logger {
+	l := hclog.NewInterceptLogger(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Debug,
+		Output: io.Discard,
+	})
+	l.RegisterSink(raftSink{log: logger})
+	return l
+}
+
+// Accept implements hclog.SinkAdapter
+func (s raftSink) Accept(name string, level hclog.Level, msg string, args ...any) {
+	var l slog.Level
+	switch level {
+	case hclog.Trace, hclog.Debug:
+		l = slog.LevelDebug
+	case hclog.Info:
+		l = slog.LevelInfo
+	case hclog.Warn:
+		l = slog.LevelWarn
+	default:
+		l = slog.LevelError
+	}
+	// Raft's messages start lower case, unlike the control plane's
+	if msg != "" {
+		msg = strings.ToUpper(msg[:1]) + msg[1:]
+	}
+	s.log.Log(context.Background(), l, msg, args...)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func TestRaftConfigValidate(t *testing.T) {
+	peer := func(id string) RaftPeer {
+		return RaftPeer{ID: id, RaftAddress: id + ":7000", Address: id + ":50051"}
+	}
+	tests := []struct {
+		name    string
+		config  RaftConfig
+		wantErr string
+	}{
+		{name: "valid", config: RaftConfig{ID: "a", Dir: "/var/lib/enviro/raft", Peers: []RaftPeer{peer("a"), peer("b")}}},
+		{name: "no id", config: RaftConfig{Dir: "/var/lib/enviro/raft", Peers: []RaftPeer{peer("a")}}, wantErr: "id and dir are required"},
+		{name: "no dir", config: RaftConfig{ID: "a", Peers: []RaftPeer{peer("a")}}, wantErr: "id and dir are required"},
+		{name: "incomplete peer", config: RaftConfig{ID: "a", Dir: "/var/lib/enviro/raft", Peers: []RaftPeer{peer("a"), {ID: "b"}}},
+			wantErr: "peers need"},
+		{name: "duplicate peer", config: RaftConfig{ID: "a", Dir: "/var/lib/enviro/raft", Peers: []RaftPeer{peer("a"), peer("a")}},
+			wantErr: "duplicate peer a"},
+		{name: "not a peer", config: RaftConfig{ID: "c", Dir: "/var/lib/enviro/raft", Peers: []RaftPeer{peer("a"), peer("b")}},
+			wantErr: "id c is not among the peers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// applyCommand applies cmd to s as Raft would once committed
+func applyCommand(t *testing.T, s *replicatedState, cmd raftCommand) {
+	t.Helper()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := s.Apply(&raft.Log{Data: data}).(error); ok {
+		t.Fatalf("%s: %v", cmd.Op, err)
+	}
+}
+
+// containerIDs returns the IDs of containers in order
+func containerIDs(containers []*pb.Container) []string {
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		ids = append(ids, c.Id)
+	}
+	return ids
+}
+
+// TestReplicatedState applies the commands of a leader to a replica, and
+// restores another replica from its snapshot
+func TestReplicatedState(t *testing.T) {
+	s := newReplicatedState()
+	web := &pb.Container{Id: "web", Ip: "10.88.0.2"}
+	db := &pb.Container{Id: "db", Ip: "10.88.0.3"}
+	for _, cmd := range []raftCommand{
+		newRaftCommand(opPutContainer, web.Id, web),
+		newRaftCommand(opPutContainer, db.Id, db),
+		newRaftCommand(opPutContainer, "old", &pb.Container{Id: "old"}),
+		{Op: opDeleteContainer, Key: "old"},
+		newRaftCommand(opPutService, "web", &pb.Service{Name: "web"}),
+		newRaftCommand(opPutService, "old", &pb.Service{Name: "old"}),
+		{Op: opDeleteService, Key: "old"},
+		newRaftCommand(opPutNode, "n1", &pb.Node{Name: "n1"}),
+	} {
+		applyCommand(t, s, cmd)
+	}
+
+	check := func(step string, s *replicatedState, nodes []string) {
+		t.Helper()
+		if got, want := containerIDs(s.listContainers()), []string{"db", "web"}; !slices.Equal(got, want) {
+			t.Errorf("%s: containers %v, want %v", step, got, want)
+		}
+		if got, ok := s.getContainer("web"); !ok || !proto.Equal(got, web) {
+			t.Errorf("%s: container web = %v, want %v", step, got, web)
+		}
+		if _, ok := s.getContainer("old"); ok {
+			t.Errorf("%s: deleted container old replicated", step)
+		}
+		if got := s.listServices(); len(got) != 1 || got[0].Name != "web" {
+			t.Errorf("%s: services %v, want web", step, got)
+		}
+		var got []string
+		for _, n := range s.listNodes() {
+			got = append(got, n.Name)
+		}
+		if !slices.Equal(got, nodes) {
+			t.Errorf("%s: nodes %v, want %v", step, got, nodes)
+		}
+	}
+	check("applied", s, []string{"n1"})
+
+	// The replica's copies are its own
+	s.listContainers()[0].Ip = "10.88.0.99"
+	if c, _ := s.getContainer("db"); c.Ip != db.Ip {
+		t.Errorf("changing a listed container changed the replica to %s", c.Ip)
+	}
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newReplicatedState()
+	if err := restored.Restore(io.NopCloser(strings.NewReader(string(snap.(stateSnapshot))))); err != nil {
+		t.Fatal(err)
+	}
+	check("restored", restored, []string{"n1"})
+
+	// A sync after an election replaces the containers and services but
+	// keeps the nodes
+	synced := newReplicatedState()
+	applyCommand(t, synced, newRaftCommand(opPutContainer, "gone", &pb.Container{Id: "gone"}))
+	applyCommand(t, synced, newRaftCommand(opPutNode, "n1", &pb.Node{Name: "n1"}))
+	value, err := json.Marshal(raftSnapshot{
+		Containers: map[string]json.RawMessage{"web": mustProtoJSON(t, web), "db": mustProtoJSON(t, db)},
+		Services:   map[string]json.RawMessage{"web": mustProtoJSON(t, &pb.Service{Name: "web"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyCommand(t, synced, raftCommand{Op: opSync, Value: value})
+	check("synced", synced, []string{"n1"})
+
+	data, _ := json.Marshal(raftCommand{Op: "rename_container"})
+	if _, ok := s.Apply(&raft.Log{Data: data}).(error); !ok {
+		t.Error("unknown command applied")
+	}
+}
+
+func mustProtoJSON(t *testing.T, m proto.Message) json.RawMessage {
+	t.Helper()
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestRaftCluster runs a cluster of one control plane, which elects
+// itself, replicates containers and finds them again on a restart
+func TestRaftCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for Raft elections")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	lis := occupy(t)
+	raftAddr := lis.Addr().String()
+	lis.Close()
+	config := RaftConfig{
+		ID:    "a",
+		Dir:   t.TempDir(),
+		Peers: []RaftPeer{{ID: "a", RaftAddress: raftAddr, Address: "127.0.0.1:50051"}},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	web := &pb.Container{Id: "web", Ip: "10.88.0.2"}
+
+	// join starts the member and waits for it to lead
+	join := func(step string) *raftCluster {
+		t.Helper()
+		c, err := newRaftCluster(config, logger)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if err := c.Campaign(ctx); err != nil {
+			c.close()
+			t.Fatalf("%s: %v", step, err)
+		}
+		return c
+	}
+
+	c := join("bootstrap")
+	// The leader may be watched before the member observed its election
+	var leader Leader
+	for leader = range c.Watch(ctx) {
+		if leader.ID != "" {
+			break
+		}
+	}
+	if want := (Leader{ID: "a", Address: "127.0.0.1:50051"}); leader != want {
+		t.Errorf("watched leader %+v, want %+v", leader, want)
+	}
+	c.putContainer(web)
+	c.putContainer(&pb.Container{Id: "old"})
+	c.deleteContainer("old")
+	if err := c.barrier(); err != nil {
+		t.Fatal(err)
+	}
+	if got := containerIDs(c.fsm.listContainers()); !slices.Equal(got, []string{"web"}) {
+		t.Errorf("replicated %v, want [web]", got)
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The member restarts from its log rather than bootstrapping again
+	c = join("restart")
+	defer c.close()
+	if err := c.barrier(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := c.fsm.getContainer("web"); !ok || !proto.Equal(got, web) {
+		t.Errorf("container web after a restart = %v, want %v", got, web)
+	}
+}
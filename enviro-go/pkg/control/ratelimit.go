@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// retryAfterHeader tells rate limited clients how many seconds to wait
+// before trying again, like HTTP's Retry-After
+const retryAfterHeader = "retry-after"
+
+// rateLimitSweepInterval is how often the buckets of idle clients are
+// dropped, bounding the limiter's memory
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit bounds the requests of each client. Zero fields don't limit.
+type RateLimit struct {
+	// Rate is the sustained number of requests per second
+	Rate float64 `json:"rate"`
+	// Burst is how many requests may be made at once before Rate applies,
+	// Rate rounded up when zero
+	Burst int `json:"burst"`
+	// MaxInFlight bounds the requests handled at once, streams included
+	MaxInFlight int `json:"max_in_flight"`
+}
+
+func (l RateLimit) validate() error {
+	if l.Rate < 0 || math.IsNaN(l.Rate) || math.IsInf(l.Rate, 0) || l.Burst < 0 || l.MaxInFlight < 0 {
+		return errors.New("rate, burst and max_in_flight must not be negative")
+	}
+	return nil
+}
+
+// burst returns the bucket size of a limit with a Rate
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// RateLimitConfig limits the requests of each client, so one can't starve
+// the others. Clients are identified by their authenticated identity,
+// else by the common name of their verified client certificate, else by
+// their IP address. Rejected requests fail with
+// codes.ResourceExhausted, a RetryInfo detail and a retry-after header of
+// the seconds to wait. The health service is exempt.
+type RateLimitConfig struct {
+	// Default limits the requests to methods not in Methods, together
+	Default RateLimit `json:"default"`
+	// Methods limits the requests to each method by its full name, e.g.
+	// "/enviro.api.v1.ContainerService/CreateContainer", apart from the others
+	Methods map[string]RateLimit `json:"methods"`
+}
+
+func (c RateLimitConfig) validate() error {
+	if err := c.Default.validate(); err != nil {
+		return err
+	}
+	for method, limit := range c.Methods {
+		if !isFullMethod(method) {
+			return fmt.Errorf("method %q is not a full method name such as /enviro.api.v1.ContainerService/CreateContainer", method)
+		}
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("method %s: %w", method, err)
+		}
+	}
+	return nil
+}
+
+// limit returns the limit of method and the scope its requests are
+// counted in, the method itself or "" for Default
+func (c RateLimitConfig) limit(method string) (RateLimit, string) {
+	for m, l := range c.Methods {
+		if canonicalMethod(m) == method {
+			return l, method
+		}
+	}
+	return c.Default, ""
+}
+
+// rateLimiter keeps a token bucket and an in-flight count per client and
+// scope. Changing its config keeps the buckets, so clients don't get a
+// fresh burst on every reload.
+type rateLimiter struct {
+	mu        sync.Mutex
+	config    RateLimitConfig
+	buckets   map[bucketKey]*clientBucket
+	lastSweep time.Time
+}
+
+type bucketKey struct {
+	client string
+	scope  string
+}
+
+type clientBucket struct {
+	tokens   float64
+	last     time.Time
+	inFlight int
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{config: config, buckets: make(map[bucketKey]*clientBucket), lastSweep: time.Now()}
+}
+
+// setConfig replaces the limits at runtime
+func (l *rateLimiter) setConfig(config RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+}
+
+// serverOptions returns the interceptors enforcing the limits. They run
+// after authentication, which identifies the client.
+func (l *rateLimiter) serverOptions() []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		release, err := l.acquire(ctx, info.FullMethod, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		release, err := l.acquire(ss.Context(), info.FullMethod, time.Now())
+		if err != nil {
+			return err
+		}
+		defer release()
+		return handler(srv, ss)
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+// acquire admits a request of the client of ctx to method, returning the
+// function to call once it is handled, or the error rejecting it
+func (l *rateLimiter) acquire(ctx context.Context, method string, now time.Time) (func(), error) {
+	if strings.HasPrefix(method, healthMethodPrefix) {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, scope := l.config.limit(canonicalMethod(method))
+	if limit == (RateLimit{}) {
+		return func() {}, nil
+	}
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	key := bucketKey{client: clientIdentity(ctx), scope: scope}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &clientBucket{tokens: limit.burst(), last: now}
+		l.buckets[key] = b
+	}
+
+	if limit.MaxInFlight > 0 && b.inFlight >= limit.MaxInFlight {
+		return nil, rateLimited(ctx, fmt.Sprintf("too many requests in flight, at most %d", limit.MaxInFlight), time.Second)
+	}
+	if limit.Rate > 0 {
+		b.tokens = math.Min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+		if b.tokens < 1 {
+			b.last = now
+			wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+			return nil, rateLimited(ctx, fmt.Sprintf("rate limit of %g requests per second exceeded", limit.Rate), wait)
+		}
+		b.tokens--
+	}
+	b.last = now
+	b.inFlight++
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		b.inFlight--
+	}, nil
+}
+
+// sweep drops the buckets without requests in flight that have refilled,
+// which are as good as new. Callers must hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.inFlight > 0 {
+			continue
+		}
+		// Scopes are canonical names and Methods may have legacy ones, so
+		// the limit is found as acquire found it. A scope whose method
+		// lost its limit has none left.
+		limit, scope := l.config.limit(key.scope)
+		if scope != key.scope {
+			limit = RateLimit{}
+		}
+		if limit.Rate == 0 || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst() {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimited returns the codes.ResourceExhausted error rejecting a
+// request, setting the retry-after header to wait rounded up to seconds
+func rateLimited(ctx context.Context, msg string, wait time.Duration) error {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(retryAfterHeader, strconv.FormatInt(seconds, 10)))
+
+	st, err := status.New(codes.ResourceExhausted, msg).WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, msg)
+	}
+	return st.Err()
+}
+
+// clientIdentity names the client of ctx for rate limiting: its
+// authenticated identity, else the common name of its verified client
+// certificate, else its IP address
+func clientIdentity(ctx context.Context) string {
+	if id, ok := identityFromContext(ctx); ok {
+		return "id:" + id.Name
+	}
+	if cn, ok := verifiedCommonName(ctx); ok {
+		return "cert:" + cn
+	}
+	return "addr:" + clientAddress(ctx)
+}
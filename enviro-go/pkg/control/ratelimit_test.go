@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestRateLimitSweep drains a client's bucket and lets a sweep run before
+// it has refilled, which must keep it however its limit's method is named
+func TestRateLimitSweep(t *testing.T) {
+	const (
+		method = "/enviro.api.v1.ContainerService/CreateContainer"
+		legacy = "/enviro.api.ContainerService/CreateContainer"
+	)
+	// Refills a token in 100s, so the bucket stays short of one at the sweep
+	slow := RateLimit{Rate: 0.01, Burst: 2}
+	tests := []struct {
+		name   string
+		config RateLimitConfig
+		// called is the method name the requests are made with
+		called string
+	}{
+		{name: "default", config: RateLimitConfig{Default: slow}, called: method},
+		{name: "method", config: RateLimitConfig{Methods: map[string]RateLimit{method: slow}}, called: method},
+		{name: "legacy method", config: RateLimitConfig{Methods: map[string]RateLimit{legacy: slow}}, called: method},
+		{name: "called by legacy name", config: RateLimitConfig{Methods: map[string]RateLimit{method: slow}}, called: legacy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			l := newRateLimiter(tt.config)
+			now := l.lastSweep
+			for i := 0; i < slow.Burst; i++ {
+				release, err := l.acquire(ctx, tt.called, now)
+				if err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+				release()
+			}
+
+			// A dropped bucket would come back full and admit the request
+			_, err := l.acquire(ctx, tt.called, now.Add(rateLimitSweepInterval))
+			if status.Code(err) != codes.ResourceExhausted {
+				t.Errorf("request after the sweep = %v, want %s", err, codes.ResourceExhausted)
+			}
+			if !l.lastSweep.Equal(now.Add(rateLimitSweepInterval)) {
+				t.Error("no sweep ran")
+			}
+		})
+	}
+}
+
+// TestRateLimitSweepRemoved sweeps the bucket of a method whose limit was
+// removed, which has nothing left to keep it for
+func TestRateLimitSweepRemoved(t *testing.T) {
+	const method = "/enviro.api.v1.ContainerService/CreateContainer"
+	ctx := context.Background()
+	l := newRateLimiter(RateLimitConfig{Methods: map[string]RateLimit{
+		"/enviro.api.ContainerService/CreateContainer": {Rate: 0.01, Burst: 1},
+	}})
+	now := l.lastSweep
+	release, err := l.acquire(ctx, method, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	l.setConfig(RateLimitConfig{Default: RateLimit{Rate: 1}})
+	l.mu.Lock()
+	l.sweep(now.Add(rateLimitSweepInterval))
+	n := len(l.buckets)
+	l.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d buckets left after the sweep, want 0", n)
+	}
+}
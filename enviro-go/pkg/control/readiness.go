@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// VerifyContainerNetwork checks that the network of a container of this
+// node carries traffic, see network.NetworkManager.VerifyContainerNetwork.
+// A network that doesn't become ready isn't an error of the call: the
+// report says which check failed.
+func (s *containerService) VerifyContainerNetwork(ctx context.Context, req *pb.VerifyContainerNetworkRequest) (*pb.VerifyContainerNetworkResponse, error) {
+	s.mu.Lock()
+	c, ok := s.containers[req.GetId()]
+	var node string
+	if ok {
+		node = c.Node
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.GetId())
+	}
+	if node != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %q is placed on node %s, verify its network there", req.Id, node)
+	}
+	if req.Timeout != nil {
+		if err := req.Timeout.CheckValid(); err != nil || req.Timeout.AsDuration() <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "timeout must be positive")
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout.AsDuration())
+		defer cancel()
+	}
+	report, err := s.network.VerifyContainerNetwork(ctx, req.Id)
+	if err != nil && !errors.Is(err, network.ErrNotReady) {
+		return nil, networkError(err)
+	}
+	return &pb.VerifyContainerNetworkResponse{Report: readinessReport(report)}, nil
+}
+
+// readinessReport converts the report of a network verification
+func readinessReport(r network.ReadinessReport) *pb.ReadinessReport {
+	out := &pb.ReadinessReport{Ready: r.Ready, Duration: durationpb.New(r.Duration)}
+	for _, c := range r.Checks {
+		out.Checks = append(out.Checks, &pb.ReadinessCheck{
+			Name:     c.Name,
+			Passed:   c.Passed,
+			Error:    c.Error,
+			Duration: durationpb.New(c.Duration),
+			Attempts: uint32(c.Attempts),
+		})
+	}
+	return out
+}
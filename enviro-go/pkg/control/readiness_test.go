@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+func TestVerifyContainerNetworkRejects(t *testing.T) {
+	s := &containerService{containers: map[string]*pb.Container{
+		"local":  {Id: "local", State: pb.ContainerState_CONTAINER_STATE_READY},
+		"remote": {Id: "remote", Node: "n2", State: pb.ContainerState_CONTAINER_STATE_READY},
+	}}
+	tests := []struct {
+		name string
+		req  *pb.VerifyContainerNetworkRequest
+		code codes.Code
+	}{
+		{name: "unknown", req: &pb.VerifyContainerNetworkRequest{Id: "missing"}, code: codes.NotFound},
+		{name: "other node", req: &pb.VerifyContainerNetworkRequest{Id: "remote"}, code: codes.FailedPrecondition},
+		{name: "zero timeout", req: &pb.VerifyContainerNetworkRequest{Id: "local", Timeout: durationpb.New(0)},
+			code: codes.InvalidArgument},
+		{name: "negative timeout", req: &pb.VerifyContainerNetworkRequest{Id: "local", Timeout: durationpb.New(-time.Second)},
+			code: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.VerifyContainerNetwork(context.Background(), tt.req)
+			if status.Code(err) != tt.code {
+				t.Errorf("VerifyContainerNetwork() = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
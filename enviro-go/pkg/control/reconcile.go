@@ -0,0 +1,849 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// DefaultReconcileInterval is how often the node is reconciled with the
+// applied spec unless configured otherwise
+const DefaultReconcileInterval = 30 * time.Second
+
+// reconcileCallTimeout bounds each call a reconciliation makes, which
+// covers stopping a container with the default timeout
+const reconcileCallTimeout = time.Minute
+
+// specFileName is the state file the applied spec is kept in
+const specFileName = "spec.json"
+
+// specVersion is bumped on incompatible changes to the spec file
+const specVersion = 1
+
+// ReconcileConfig tunes the loop reconciling the node with the spec
+// applied by ApplySpec
+type ReconcileConfig struct {
+	// Interval is how often the node is reconciled besides after every
+	// ApplySpec, DefaultReconcileInterval when zero
+	Interval time.Duration `json:"interval"`
+}
+
+func (c ReconcileConfig) validate() error {
+	if c.Interval < 0 {
+		return errors.New("interval must not be negative")
+	}
+	return nil
+}
+
+// managedSet names the resources of the applied specs. Those the current
+// spec leaves out are deleted, and forgotten once they are gone.
+type managedSet struct {
+	Containers map[string]bool `json:"containers,omitempty"`
+	Services   map[string]bool `json:"services,omitempty"`
+	Policies   map[string]bool `json:"policies,omitempty"`
+}
+
+func newManagedSet() managedSet {
+	return managedSet{
+		Containers: make(map[string]bool),
+		Services:   make(map[string]bool),
+		Policies:   make(map[string]bool),
+	}
+}
+
+// add adds the resources of spec
+func (m managedSet) add(spec *pb.Spec) {
+	for _, c := range spec.Containers {
+		m.Containers[c.Id] = true
+	}
+	for _, svc := range spec.Services {
+		m.Services[svc.Name] = true
+	}
+	for _, p := range spec.Policies {
+		m.Policies[p.Name] = true
+	}
+}
+
+func (m managedSet) clone() managedSet {
+	return managedSet{
+		Containers: maps.Clone(m.Containers),
+		Services:   maps.Clone(m.Services),
+		Policies:   maps.Clone(m.Policies),
+	}
+}
+
+// specFile is how the reconciler persists the applied spec
+type specFile struct {
+	Version    int             `json:"version"`
+	Generation uint64          `json:"generation"`
+	Spec       json.RawMessage `json:"spec"`
+	Managed    managedSet      `json:"managed"`
+
+	// spec is Spec decoded
+	spec *pb.Spec
+}
+
+// loadSpec returns the spec saved in store, nil if none was applied yet
+func loadSpec(store *storage.Store) (*specFile, error) {
+	data, err := store.Read(specFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load spec: %w", err)
+	}
+	var file specFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", storage.ErrCorrupt, specFileName, err)
+	}
+	if file.Version != specVersion {
+		return nil, fmt.Errorf("spec %s has unsupported version %d", specFileName, file.Version)
+	}
+	file.spec = &pb.Spec{}
+	if err := protojson.Unmarshal(file.Spec, file.spec); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", storage.ErrCorrupt, specFileName, err)
+	}
+	return &file, nil
+}
+
+// reconciler drives the node toward the spec applied by ApplySpec. It
+// acts through the services' own handlers, so its changes are validated,
+// published and replicated like those of clients.
+type reconciler struct {
+	containers *containerService
+	nodes      *nodeService
+	// store persists the spec, nil without a state dir
+	store *storage.Store
+	// active reports whether to reconcile: while leading and not cordoned
+	active func() bool
+	log    *slog.Logger
+	// trigger requests a reconciliation
+	trigger chan struct{}
+	// retime tells the loop interval changed
+	retime chan struct{}
+	// loopMu guards cancel and done, which start and stop hand over
+	loopMu sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu         sync.Mutex
+	interval   time.Duration
+	spec       *pb.Spec
+	generation uint64
+	managed    managedSet
+	status     *pb.ReconcileStatus
+}
+
+// newReconciler returns a reconciler continuing with saved, the spec
+// loaded from store, if any
+func newReconciler(config ReconcileConfig, containers *containerService, nodes *nodeService, store *storage.Store, saved *specFile, logger *slog.Logger) *reconciler {
+	if config.Interval == 0 {
+		config.Interval = DefaultReconcileInterval
+	}
+	r := &reconciler{
+		containers: containers,
+		nodes:      nodes,
+		store:      store,
+		interval:   config.Interval,
+		active:     func() bool { return true },
+		log:        logger,
+		trigger:    make(chan struct{}, 1),
+		retime:     make(chan struct{}, 1),
+		managed:    newManagedSet(),
+	}
+	if saved == nil {
+		return r
+	}
+	r.spec, r.generation = saved.spec, saved.Generation
+	maps.Copy(r.managed.Containers, saved.Managed.Containers)
+	maps.Copy(r.managed.Services, saved.Managed.Services)
+	maps.Copy(r.managed.Policies, saved.Managed.Policies)
+	logger.Info("Loaded spec", "generation", r.generation)
+	return r
+}
+
+// save persists the spec and managed resources. Callers must hold r.mu.
+func (r *reconciler) save(spec *pb.Spec, generation uint64, managed managedSet) error {
+	if r.store == nil {
+		return nil
+	}
+	raw, err := protojson.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(specFile{Version: specVersion, Generation: generation, Spec: raw, Managed: managed})
+	if err != nil {
+		return err
+	}
+	return r.store.Write(specFileName, data)
+}
+
+// start reconciles until stop is called
+func (r *reconciler) start() {
+	r.loopMu.Lock()
+	defer r.loopMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go r.run(ctx)
+}
+
+// stop ends the loop, cancelling a reconciliation in progress
+func (r *reconciler) stop() {
+	r.loopMu.Lock()
+	cancel, done := r.cancel, r.done
+	r.loopMu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// kick requests a reconciliation, e.g. after the spec changed
+func (r *reconciler) kick() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// setInterval changes how often the node is reconciled, back to
+// DefaultReconcileInterval with zero. The next reconciliation is after
+// the new interval.
+func (r *reconciler) setInterval(interval time.Duration) {
+	if interval == 0 {
+		interval = DefaultReconcileInterval
+	}
+	r.mu.Lock()
+	r.interval = interval
+	r.mu.Unlock()
+	select {
+	case r.retime <- struct{}{}:
+	default:
+	}
+}
+
+// currentInterval returns how often the node is reconciled
+func (r *reconciler) currentInterval() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.interval
+}
+
+func (r *reconciler) run(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.currentInterval())
+	defer ticker.Stop()
+	for {
+		if r.active() {
+			r.reconcile(ctx)
+		}
+		if !r.wait(ctx, ticker) {
+			return
+		}
+	}
+}
+
+// wait blocks until the next reconciliation is due, returning false once
+// ctx is done
+func (r *reconciler) wait(ctx context.Context, ticker *time.Ticker) bool {
+	for {
+		select {
+		case <-ticker.C:
+			return true
+		case <-r.trigger:
+			return true
+		case <-r.retime:
+			ticker.Reset(r.currentInterval())
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// apply replaces the spec, returning its generation
+func (r *reconciler) apply(spec *pb.Spec) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.spec != nil && proto.Equal(spec, r.spec) {
+		return r.generation, nil
+	}
+	managed := r.managed.clone()
+	managed.add(spec)
+	if err := r.save(spec, r.generation+1, managed); err != nil {
+		return 0, err
+	}
+	r.spec, r.managed = spec, managed
+	r.generation++
+	r.log.Info("Applied spec", "generation", r.generation, "containers", len(spec.Containers),
+		"services", len(spec.Services), "policies", len(spec.Policies))
+	r.kick()
+	return r.generation, nil
+}
+
+// reconcile makes one pass over the spec, acting on what differs, and
+// records the outcome in r.status
+func (r *reconciler) reconcile(ctx context.Context) {
+	r.mu.Lock()
+	spec, generation, managed := r.spec, r.generation, r.managed.clone()
+	r.mu.Unlock()
+	if spec == nil {
+		return
+	}
+
+	p := &reconcilePass{reconciler: r, ctx: ctx, log: r.log.With("generation", generation)}
+	p.network(spec.GetNetwork())
+	for _, c := range spec.Containers {
+		p.container(c)
+	}
+	services := make(map[string]network.Service)
+	for _, svc := range r.containers.network.ListServices() {
+		services[svc.Name] = svc
+	}
+	for _, svc := range spec.Services {
+		p.service(svc, services)
+	}
+	policies := make(map[string]network.NetworkPolicy)
+	for _, policy := range r.containers.network.ListPolicies() {
+		policies[policy.Name] = policy
+	}
+	for _, policy := range spec.Policies {
+		p.policy(policy, policies)
+	}
+	forgotten := p.prune(spec, managed)
+	if ctx.Err() != nil {
+		return
+	}
+
+	converged := len(p.errors) == 0 && !p.pending
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(forgotten.Containers)+len(forgotten.Services)+len(forgotten.Policies) > 0 {
+		for id := range forgotten.Containers {
+			delete(r.managed.Containers, id)
+		}
+		for name := range forgotten.Services {
+			delete(r.managed.Services, name)
+		}
+		for name := range forgotten.Policies {
+			delete(r.managed.Policies, name)
+		}
+		if err := r.save(r.spec, r.generation, r.managed); err != nil {
+			r.log.Error("Failed to save spec", "error", err)
+		}
+	}
+	r.status = &pb.ReconcileStatus{
+		Generation: generation,
+		Time:       timestamppb.Now(),
+		Converged:  converged,
+		Errors:     p.errors,
+	}
+	switch {
+	case len(p.errors) > 0:
+		p.log.Warn("Node does not match spec", "errors", len(p.errors))
+	case p.changes > 0 && converged:
+		p.log.Info("Node matches spec", "changes", p.changes)
+	}
+}
+
+// reconcilePass is a single reconciliation
+type reconcilePass struct {
+	*reconciler
+	ctx context.Context
+	log *slog.Logger
+	// changes counts the calls that changed something
+	changes int
+	// pending is set when a resource is still changing, e.g. a container
+	// being created by a client
+	pending bool
+	errors  []*pb.ReconcileError
+}
+
+// fail records that resource could not be reconciled
+func (p *reconcilePass) fail(resource string, err error) {
+	p.log.Warn("Failed to reconcile", "resource", resource, "error", err)
+	p.errors = append(p.errors, &pb.ReconcileError{Resource: resource, Error: status.Convert(err).Message()})
+}
+
+// call runs fn, bounded by reconcileCallTimeout, as a change to resource
+func (p *reconcilePass) call(resource, action string, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(p.ctx, reconcileCallTimeout)
+	defer cancel()
+	p.log.Info("Reconciling", "resource", resource, "action", action)
+	err := fn(ctx)
+	if err == nil {
+		p.changes++
+	}
+	return err
+}
+
+func (p *reconcilePass) network(spec *pb.NetworkSpec) {
+	cfg := p.containers.network.Config()
+	if action := network.PolicyAction(spec.GetDefaultPolicy()); action != "" && action != cfg.DefaultPolicy {
+		err := p.call("network", "set default policy", func(context.Context) error {
+			return p.containers.network.SetDefaultPolicy(action)
+		})
+		if err != nil {
+			p.fail("network", networkError(err))
+		}
+	}
+	if mtu := int(spec.GetMtu()); mtu != 0 && mtu != cfg.MTU {
+		err := p.call("network", "set mtu", func(ctx context.Context) error {
+			_, err := p.nodes.SetMTU(ctx, &pb.SetMTURequest{Mtu: int32(mtu)})
+			return err
+		})
+		if err != nil {
+			p.fail("network", err)
+		}
+	}
+}
+
+func (p *reconcilePass) container(spec *pb.ContainerSpec) {
+	resource := "container " + spec.Id
+	svc := p.containers
+
+	resp, err := svc.GetContainer(p.ctx, &pb.GetContainerRequest{Id: spec.Id})
+	if status.Code(err) == codes.NotFound {
+		p.createContainer(spec)
+		return
+	}
+	if err != nil {
+		p.fail(resource, err)
+		return
+	}
+
+	c := resp.Container
+	switch c.State {
+	case pb.ContainerState_CONTAINER_STATE_CREATING, pb.ContainerState_CONTAINER_STATE_DELETING,
+		pb.ContainerState_CONTAINER_STATE_DRAINING:
+		p.pending = true
+		return
+	case pb.ContainerState_CONTAINER_STATE_FAILED:
+	default:
+		if !containerDrifted(c, spec) {
+			p.limitContainer(spec, c)
+			p.runContainer(spec, c.State)
+			return
+		}
+	}
+
+	// Failed or changed: recreate
+	if c.State == pb.ContainerState_CONTAINER_STATE_RUNNING {
+		if err := p.call(resource, "stop", func(ctx context.Context) error {
+			_, err := svc.StopContainer(ctx, &pb.StopContainerRequest{Id: spec.Id})
+			return err
+		}); err != nil {
+			p.fail(resource, err)
+			return
+		}
+	}
+	if err := p.call(resource, "delete", func(ctx context.Context) error {
+		_, err := svc.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: spec.Id})
+		return err
+	}); err != nil && status.Code(err) != codes.NotFound {
+		p.fail(resource, err)
+		return
+	}
+	p.createContainer(spec)
+}
+
+// createContainer creates the container of spec, and starts it when it
+// should run
+func (p *reconcilePass) createContainer(spec *pb.ContainerSpec) {
+	resource := "container " + spec.Id
+	var c *pb.Container
+	err := p.call(resource, "create", func(ctx context.Context) error {
+		resp, err := p.containers.CreateContainer(ctx, &pb.CreateContainerRequest{
+			Id:         spec.Id,
+			Name:       spec.Name,
+			NetnsPath:  spec.NetnsPath,
+			Pid:        spec.Pid,
+			Mac:        spec.Mac,
+			Mtu:        spec.Mtu,
+			Labels:     maps.Clone(spec.Labels),
+			Placement:  spec.Placement,
+			Namespace:  spec.Namespace,
+			IngressBps: spec.IngressBps,
+			EgressBps:  spec.EgressBps,
+
+			RequestedIp:  spec.RequestedIp,
+			RequestedIp6: spec.RequestedIp6,
+			Attachment:   spec.Attachment,
+		})
+		if err != nil {
+			return err
+		}
+		c = resp.Container
+		return nil
+	})
+	if err != nil {
+		p.fail(resource, err)
+		return
+	}
+	p.runContainer(spec, c.State)
+}
+
+// runContainer starts or stops a container in state as its spec says
+func (p *reconcilePass) runContainer(spec *pb.ContainerSpec, state pb.ContainerState) {
+	resource := "container " + spec.Id
+	running := state == pb.ContainerState_CONTAINER_STATE_RUNNING
+	var err error
+	switch {
+	case spec.Running && !running:
+		err = p.call(resource, "start", func(ctx context.Context) error {
+			_, err := p.containers.StartContainer(ctx, &pb.StartContainerRequest{Id: spec.Id})
+			return err
+		})
+	case !spec.Running && running:
+		err = p.call(resource, "stop", func(ctx context.Context) error {
+			_, err := p.containers.StopContainer(ctx, &pb.StopContainerRequest{Id: spec.Id})
+			return err
+		})
+	}
+	switch {
+	case status.Code(err) == codes.Aborted:
+		// Being started or stopped by a client
+		p.pending = true
+	case err != nil:
+		p.fail(resource, err)
+	}
+}
+
+// limitContainer sets the bandwidth limits of spec on c, a container of
+// this node, when they changed
+func (p *reconcilePass) limitContainer(spec *pb.ContainerSpec, c *pb.Container) {
+	if c.IngressBps == spec.IngressBps && c.EgressBps == spec.EgressBps {
+		return
+	}
+	resource := "container " + spec.Id
+	err := p.call(resource, "limit bandwidth", func(ctx context.Context) error {
+		_, err := p.containers.SetBandwidthLimit(ctx, &pb.SetBandwidthLimitRequest{
+			ContainerId: spec.Id,
+			IngressBps:  spec.IngressBps,
+			EgressBps:   spec.EgressBps,
+		})
+		return err
+	})
+	if err != nil {
+		p.fail(resource, err)
+	}
+}
+
+// containerDrifted reports whether c was created differently from spec.
+// Bandwidth limits only count for placed containers, which can't be
+// limited in place.
+func containerDrifted(c *pb.Container, spec *pb.ContainerSpec) bool {
+	return c.Name != spec.Name ||
+		namespaceOrDefault(c.Namespace) != namespaceOrDefault(spec.Namespace) ||
+		(spec.Mac != "" && c.Mac != spec.Mac) ||
+		(spec.RequestedIp != "" && c.Ip != spec.RequestedIp) ||
+		(spec.RequestedIp6 != "" && c.Ipv6 != spec.RequestedIp6) ||
+		c.Mtu != spec.Mtu ||
+		!maps.Equal(c.Labels, spec.Labels) ||
+		attachmentDrifted(c.Attachment, spec.Attachment) ||
+		(c.Node != "") != (spec.Placement != nil) ||
+		(c.Node != "" && (c.IngressBps != spec.IngressBps || c.EgressBps != spec.EgressBps))
+}
+
+// attachmentDrifted reports whether a container attached with got doesn't
+// have the attachment want asks for. The macvlan a node falls back to
+// serves for SR-IOV.
+func attachmentDrifted(got, want string) bool {
+	if want == "" {
+		want = string(network.AttachmentVeth)
+	}
+	// Rootless containers have none
+	if got == "" {
+		got = string(network.AttachmentVeth)
+	}
+	return got != want && !(want == string(network.AttachmentSRIOV) && got == string(network.AttachmentMacvlan))
+}
+
+// service creates or updates a service; current holds the existing ones
+// by name
+func (p *reconcilePass) service(spec *pb.Service, current map[string]network.Service) {
+	resource := "service " + spec.Name
+	want := serviceFromProto(spec)
+	have, ok := current[spec.Name]
+	svc := p.containers
+
+	if ok && !sameService(have, want) {
+		if err := p.call(resource, "delete", func(ctx context.Context) error {
+			_, err := svc.DeleteService(ctx, &pb.DeleteServiceRequest{Name: spec.Name})
+			return err
+		}); err != nil {
+			p.fail(resource, err)
+			return
+		}
+		ok = false
+	}
+	var err error
+	switch {
+	case !ok:
+		err = p.call(resource, "create", func(ctx context.Context) error {
+			_, err := svc.CreateService(ctx, &pb.CreateServiceRequest{Service: spec})
+			return err
+		})
+	case !sameBackends(have.Backends, want.Backends):
+		err = p.call(resource, "update backends", func(ctx context.Context) error {
+			_, err := svc.UpdateServiceBackends(ctx, &pb.UpdateServiceBackendsRequest{Name: spec.Name, Backends: spec.Backends})
+			return err
+		})
+	}
+	if err != nil {
+		p.fail(resource, err)
+	}
+}
+
+// sameService reports whether have, an existing service, has the
+// namespace, address, ports and backend ports of want, backends aside.
+// Node ports want leaves to the node are ignored.
+func sameService(have, want network.Service) bool {
+	havePorts, wantPorts := have.ServicePorts(), want.ServicePorts()
+	samePort := func(h, w network.ServicePort) bool {
+		if w.NodePort == 0 {
+			h.NodePort = 0
+		}
+		if h.HealthCheck == nil || w.HealthCheck == nil {
+			return h == w
+		}
+		hc, wc := *h.HealthCheck, *w.HealthCheck
+		h.HealthCheck, w.HealthCheck = nil, nil
+		return h == w && hc == wc
+	}
+	haveBackendPorts, wantBackendPorts := slices.Clone(have.BackendPorts), slices.Clone(want.BackendPorts)
+	for _, ports := range [][]network.BackendPort{haveBackendPorts, wantBackendPorts} {
+		slices.SortFunc(ports, func(a, b network.BackendPort) int {
+			if c := strings.Compare(a.ContainerID, b.ContainerID); c != 0 {
+				return c
+			}
+			return strings.Compare(a.Port, b.Port)
+		})
+	}
+	return have.Namespace == want.Namespace && have.VIP == want.VIP && have.ExposeNodePort == want.ExposeNodePort &&
+		slices.EqualFunc(havePorts, wantPorts, samePort) && slices.Equal(haveBackendPorts, wantBackendPorts)
+}
+
+// sameBackends compares backends regardless of their order
+func sameBackends(have, want []string) bool {
+	want = slices.Clone(want)
+	slices.Sort(want)
+	return slices.Equal(have, want)
+}
+
+// policy applies a policy that is missing or differs; current holds the
+// existing ones by name
+func (p *reconcilePass) policy(spec *pb.NetworkPolicy, current map[string]network.NetworkPolicy) {
+	if have, ok := current[spec.Name]; ok && have == policyFromProto(spec) {
+		return
+	}
+	resource := "policy " + spec.Name
+	err := p.call(resource, "apply", func(ctx context.Context) error {
+		_, err := p.nodes.ApplyPolicy(ctx, &pb.ApplyPolicyRequest{Policy: spec})
+		return err
+	})
+	if err != nil {
+		p.fail(resource, err)
+	}
+}
+
+// prune deletes the managed resources spec leaves out, returning those
+// that are gone
+func (p *reconcilePass) prune(spec *pb.Spec, managed managedSet) managedSet {
+	gone := newManagedSet()
+	keep := newManagedSet()
+	keep.add(spec)
+
+	for name := range managed.Policies {
+		if keep.Policies[name] {
+			continue
+		}
+		err := p.call("policy "+name, "remove", func(ctx context.Context) error {
+			_, err := p.nodes.RemovePolicy(ctx, &pb.RemovePolicyRequest{Name: name})
+			return err
+		})
+		if err != nil && status.Code(err) != codes.NotFound {
+			p.fail("policy "+name, err)
+			continue
+		}
+		gone.Policies[name] = true
+	}
+	for name := range managed.Services {
+		if keep.Services[name] {
+			continue
+		}
+		err := p.call("service "+name, "delete", func(ctx context.Context) error {
+			_, err := p.containers.DeleteService(ctx, &pb.DeleteServiceRequest{Name: name})
+			return err
+		})
+		if err != nil && status.Code(err) != codes.NotFound {
+			p.fail("service "+name, err)
+			continue
+		}
+		gone.Services[name] = true
+	}
+	for id := range managed.Containers {
+		if keep.Containers[id] {
+			continue
+		}
+		if err := p.deleteContainer(id); err != nil {
+			p.fail("container "+id, err)
+			continue
+		}
+		gone.Containers[id] = true
+	}
+	return gone
+}
+
+// deleteContainer stops and deletes container id, if it exists
+func (p *reconcilePass) deleteContainer(id string) error {
+	svc := p.containers
+	resp, err := svc.GetContainer(p.ctx, &pb.GetContainerRequest{Id: id})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Container.State == pb.ContainerState_CONTAINER_STATE_RUNNING {
+		if err := p.call("container "+id, "stop", func(ctx context.Context) error {
+			_, err := svc.StopContainer(ctx, &pb.StopContainerRequest{Id: id})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	err = p.call("container "+id, "delete", func(ctx context.Context) error {
+		_, err := svc.DeleteContainer(ctx, &pb.DeleteContainerRequest{Id: id})
+		return err
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	return err
+}
+
+// validateSpec checks spec up front, so ApplySpec rejects what the
+// reconciler could never apply
+func validateSpec(spec *pb.Spec) error {
+	ids := make(map[string]bool)
+	for _, c := range spec.Containers {
+		if c.Id == "" {
+			return errors.New("container id is required")
+		}
+		if ids[c.Id] {
+			return fmt.Errorf("container %s is listed twice", c.Id)
+		}
+		ids[c.Id] = true
+		if err := network.ValidateName(c.Name); err != nil {
+			return fmt.Errorf("container %s: %w", c.Id, err)
+		}
+		if err := network.ValidateName(c.Namespace); err != nil {
+			return fmt.Errorf("container %s: namespace: %w", c.Id, err)
+		}
+		if _, err := network.ParseMAC(c.Mac); err != nil {
+			return fmt.Errorf("container %s: %w", c.Id, err)
+		}
+		if err := validateRequestedIPs(c.RequestedIp, c.RequestedIp6); err != nil {
+			return fmt.Errorf("container %s: %w", c.Id, err)
+		}
+		if err := validateAttachment(c.Attachment); err != nil {
+			return fmt.Errorf("container %s: %w", c.Id, err)
+		}
+		if c.Mtu < 0 {
+			return fmt.Errorf("container %s: mtu must not be negative", c.Id)
+		}
+		if c.GetPlacement().GetCpuMillicores() < 0 {
+			return fmt.Errorf("container %s: placement cpu_millicores must not be negative", c.Id)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, svc := range spec.Services {
+		if err := checkServicePorts(svc); err != nil {
+			return fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+		if err := serviceFromProto(svc).Validate(); err != nil {
+			return err
+		}
+		if names[svc.Name] {
+			return fmt.Errorf("service %s is listed twice", svc.Name)
+		}
+		names[svc.Name] = true
+	}
+
+	names = make(map[string]bool)
+	for _, p := range spec.Policies {
+		if p.Port > 65535 {
+			return fmt.Errorf("policy %s: port must be at most 65535", p.Name)
+		}
+		if err := policyFromProto(p).Validate(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return fmt.Errorf("policy %s is listed twice", p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	switch network.PolicyAction(spec.GetNetwork().GetDefaultPolicy()) {
+	case "", network.PolicyAllow, network.PolicyDeny, network.PolicyReject:
+	default:
+		return fmt.Errorf("network: unknown default policy %q", spec.Network.DefaultPolicy)
+	}
+	if spec.GetNetwork().GetMtu() < 0 {
+		return errors.New("network: mtu must not be negative")
+	}
+	return nil
+}
+
+// ApplySpec replaces the spec the reconciler drives the node toward
+func (s *containerService) ApplySpec(ctx context.Context, req *pb.ApplySpecRequest) (*pb.ApplySpecResponse, error) {
+	spec := req.GetSpec()
+	if spec == nil {
+		return nil, status.Error(codes.InvalidArgument, "spec is required")
+	}
+	if err := validateSpec(spec); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	generation, err := s.reconciler.apply(proto.Clone(spec).(*pb.Spec))
+	if err != nil {
+		s.logger(ctx).Error("Failed to apply spec", "error", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.ApplySpecResponse{Generation: generation}, nil
+}
+
+// GetSpec returns the applied spec and the last reconciliation's outcome
+func (s *containerService) GetSpec(ctx context.Context, req *pb.GetSpecRequest) (*pb.GetSpecResponse, error) {
+	r := s.reconciler
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resp := &pb.GetSpecResponse{Generation: r.generation}
+	if r.spec != nil {
+		resp.Spec = proto.Clone(r.spec).(*pb.Spec)
+	}
+	if r.status != nil {
+		resp.Status = proto.Clone(r.status).(*pb.ReconcileStatus)
+	}
+	return resp, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"maps"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+func TestValidateSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		spec *pb.Spec
+		// wantErr is part of the error, none if empty
+		wantErr string
+	}{
+		{name: "empty", spec: &pb.Spec{}},
+		{name: "valid", spec: &pb.Spec{
+			Containers: []*pb.ContainerSpec{{Id: "a", Name: "web"}, {Id: "b", Mac: "0a:58:0a:58:00:02"}},
+			Network:    &pb.NetworkSpec{DefaultPolicy: "deny", Mtu: 1400},
+		}},
+		{name: "container without id", spec: &pb.Spec{Containers: []*pb.ContainerSpec{{Name: "web"}}},
+			wantErr: "container id is required"},
+		{name: "container twice", spec: &pb.Spec{Containers: []*pb.ContainerSpec{{Id: "a"}, {Id: "a"}}},
+			wantErr: "container a is listed twice"},
+		{name: "malformed MAC", spec: &pb.Spec{Containers: []*pb.ContainerSpec{{Id: "a", Mac: "0a:58"}}},
+			wantErr: "container a"},
+		{name: "negative container MTU", spec: &pb.Spec{Containers: []*pb.ContainerSpec{{Id: "a", Mtu: -1}}},
+			wantErr: "container a: mtu must not be negative"},
+		{name: "negative CPU", spec: &pb.Spec{Containers: []*pb.ContainerSpec{{Id: "a", Placement: &pb.Placement{CpuMillicores: -1}}}},
+			wantErr: "cpu_millicores must not be negative"},
+		{name: "policy port", spec: &pb.Spec{Policies: []*pb.NetworkPolicy{{Name: "p", Port: 65536}}},
+			wantErr: "policy p: port must be at most 65535"},
+		{name: "unknown default policy", spec: &pb.Spec{Network: &pb.NetworkSpec{DefaultPolicy: "maybe"}},
+			wantErr: `unknown default policy "maybe"`},
+		{name: "negative network MTU", spec: &pb.Spec{Network: &pb.NetworkSpec{Mtu: -1}},
+			wantErr: "network: mtu must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSpec(tt.spec)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateSpec() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateSpec() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestContainerDrifted(t *testing.T) {
+	created := &pb.Container{
+		Id:     "a",
+		Name:   "web",
+		Ip:     "10.88.0.2",
+		Mac:    "0a:58:0a:58:00:02",
+		Labels: map[string]string{"app": "web"},
+	}
+	spec := &pb.ContainerSpec{Id: "a", Name: "web", Labels: map[string]string{"app": "web"}}
+	tests := []struct {
+		name   string
+		change func(c *pb.Container, spec *pb.ContainerSpec)
+		want   bool
+	}{
+		{name: "as created", change: func(*pb.Container, *pb.ContainerSpec) {}},
+		{name: "default namespace", change: func(c *pb.Container, _ *pb.ContainerSpec) { c.Namespace = "default" }},
+		{name: "veth", change: func(c *pb.Container, _ *pb.ContainerSpec) { c.Attachment = string(network.AttachmentVeth) }},
+		{name: "macvlan for SR-IOV", change: func(c *pb.Container, spec *pb.ContainerSpec) {
+			c.Attachment, spec.Attachment = string(network.AttachmentMacvlan), string(network.AttachmentSRIOV)
+		}},
+		{name: "local bandwidth", change: func(_ *pb.Container, spec *pb.ContainerSpec) { spec.EgressBps = 1 << 20 }},
+		{name: "name", change: func(_ *pb.Container, spec *pb.ContainerSpec) { spec.Name = "api" }, want: true},
+		{name: "namespace", change: func(_ *pb.Container, spec *pb.ContainerSpec) { spec.Namespace = "team" }, want: true},
+		{name: "MAC", change: func(_ *pb.Container, spec *pb.ContainerSpec) { spec.Mac = "0a:58:0a:58:00:03" }, want: true},
+		{name: "requested IP", change: func(_ *pb.Container, spec *pb.ContainerSpec) { spec.RequestedIp = "10.88.0.3" }, want: true},
+		{name: "MTU", change: func(_ *pb.Container, spec *pb.ContainerSpec) { spec.Mtu = 1400 }, want: true},
+		{name: "labels", change: func(_ *pb.Container, spec *pb.ContainerSpec) { spec.Labels = nil }, want: true},
+		{name: "attachment", change: func(_ *pb.Container, spec *pb.ContainerSpec) { spec.Attachment = string(network.AttachmentMacvlan) },
+			want: true},
+		{name: "placed", change: func(_ *pb.Container, spec *pb.ContainerSpec) { spec.Placement = &pb.Placement{} }, want: true},
+		{name: "placed bandwidth", change: func(c *pb.Container, spec *pb.ContainerSpec) {
+			c.Node, spec.Placement, spec.EgressBps = "n1", &pb.Placement{}, 1<<20
+		}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := proto.Clone(created).(*pb.Container)
+			s := proto.Clone(spec).(*pb.ContainerSpec)
+			tt.change(c, s)
+			if got := containerDrifted(c, s); got != tt.want {
+				t.Errorf("containerDrifted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReconcilerApply applies specs, which get a generation each and are
+// kept in the state dir for the next reconciler
+func TestReconcilerApply(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store, err := storage.Open(storage.Config{Dir: t.TempDir(), Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	r := newReconciler(ReconcileConfig{}, nil, nil, store, nil, logger)
+	s := &containerService{reconciler: r}
+
+	first := &pb.Spec{Containers: []*pb.ContainerSpec{{Id: "a"}}, Services: []*pb.Service{{Name: "web", Vip: "10.96.0.10", Port: 80}}}
+	second := &pb.Spec{Containers: []*pb.ContainerSpec{{Id: "b"}}}
+	steps := []struct {
+		name string
+		spec *pb.Spec
+		want uint64
+	}{
+		{name: "first", spec: first, want: 1},
+		{name: "same again", spec: first, want: 1},
+		{name: "second", spec: second, want: 2},
+	}
+	for _, step := range steps {
+		resp, err := s.ApplySpec(ctx, &pb.ApplySpecRequest{Spec: step.spec})
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if resp.Generation != step.want {
+			t.Errorf("%s: generation %d, want %d", step.name, resp.Generation, step.want)
+		}
+	}
+	select {
+	case <-r.trigger:
+	default:
+		t.Error("applying a spec requested no reconciliation")
+	}
+
+	for _, req := range []*pb.ApplySpecRequest{{}, {Spec: &pb.Spec{Containers: []*pb.ContainerSpec{{}}}}} {
+		if _, err := s.ApplySpec(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ApplySpec(%v) = %v, want %s", req, err, codes.InvalidArgument)
+		}
+	}
+	got, err := s.GetSpec(ctx, &pb.GetSpecRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Generation != 2 || !proto.Equal(got.Spec, second) {
+		t.Errorf("GetSpec() = %v, want generation 2 of %v", got, second)
+	}
+
+	// The resources of the first spec stay managed until pruned
+	saved, err := loadSpec(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Generation != 2 || !proto.Equal(saved.spec, second) {
+		t.Errorf("saved generation %d of %v, want 2 of %v", saved.Generation, saved.spec, second)
+	}
+	if want := map[string]bool{"a": true, "b": true}; !maps.Equal(saved.Managed.Containers, want) {
+		t.Errorf("saved managed containers %v, want %v", saved.Managed.Containers, want)
+	}
+	if want := map[string]bool{"web": true}; !maps.Equal(saved.Managed.Services, want) {
+		t.Errorf("saved managed services %v, want %v", saved.Managed.Services, want)
+	}
+	restarted := newReconciler(ReconcileConfig{}, nil, nil, store, saved, logger)
+	if gen, err := restarted.apply(proto.Clone(second).(*pb.Spec)); err != nil || gen != 2 {
+		t.Errorf("applying the saved spec after a restart = %d, %v, want generation 2", gen, err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// registryFileName is the state file the container registry is kept in,
+// next to the network state
+const registryFileName = "containers.json"
+
+// registryVersion is bumped on incompatible changes to the registry file
+const registryVersion = 1
+
+// registryFile holds the containers in the protobuf JSON mapping, keyed by
+// ID
+type registryFile struct {
+	Version    int                        `json:"version"`
+	Containers map[string]json.RawMessage `json:"containers"`
+}
+
+// registryStore persists the container registry, so a restarted control
+// plane knows the containers it had, their specs and their states
+type registryStore struct {
+	store *storage.Store
+}
+
+// load returns the saved containers, none if nothing was saved yet
+func (r *registryStore) load() (map[string]*pb.Container, error) {
+	data, err := r.store.Read(registryFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]*pb.Container{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load container registry: %w", err)
+	}
+
+	var file registryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", storage.ErrCorrupt, registryFileName, err)
+	}
+	if file.Version != registryVersion {
+		return nil, fmt.Errorf("container registry %s has unsupported version %d", registryFileName, file.Version)
+	}
+	containers := make(map[string]*pb.Container, len(file.Containers))
+	for id, raw := range file.Containers {
+		c := &pb.Container{}
+		if err := protojson.Unmarshal(raw, c); err != nil {
+			return nil, fmt.Errorf("%w: %s: container %s: %v", storage.ErrCorrupt, registryFileName, id, err)
+		}
+		containers[id] = c
+	}
+	return containers, nil
+}
+
+// save replaces the saved containers
+func (r *registryStore) save(containers map[string]*pb.Container) error {
+	file := registryFile{Version: registryVersion, Containers: make(map[string]json.RawMessage, len(containers))}
+	for id, c := range containers {
+		raw, err := protojson.Marshal(c)
+		if err != nil {
+			return err
+		}
+		file.Containers[id] = raw
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return r.store.Write(registryFileName, data)
+}
+
+// saveRegistry writes the registry through to the state dir, if one is
+// configured. A failure is logged: the change already took effect and is
+// only lost on restart. Callers must hold s.mu.
+func (s *containerService) saveRegistry() {
+	if s.registry == nil {
+		return
+	}
+	if err := s.registry.save(s.containers); err != nil {
+		s.log.Error("Failed to save container registry", "error", err)
+	}
+}
+
+// restore reconciles the saved registry with the container networks the
+// network manager re-adopted, and makes the result the registry. It runs
+// before the service is shared.
+//
+// A container whose network is gone can't be running or be started, so
+// it is marked FAILED and can be created again. An interrupted create
+// whose network came up is READY, an interrupted delete, including its
+// drain, is finished. A
+// container whose network survived keeps its recorded state, as the
+// runtime can't report on its containers; its process lives as long as
+// the network namespace does. Networks without a record, e.g. created
+// before the registry was persisted, are adopted as READY. Containers
+// placed on other nodes are kept as recorded.
+func (s *containerService) restore(saved map[string]*pb.Container) {
+	networks := s.network.ContainerNetworks()
+	for id, c := range saved {
+		logger := s.log.With("container_id", id)
+		if c.Node != "" {
+			s.containers[id] = c
+			continue
+		}
+
+		cn, ok := networks[id]
+		delete(networks, id)
+		deleting := c.State == pb.ContainerState_CONTAINER_STATE_DELETING ||
+			c.State == pb.ContainerState_CONTAINER_STATE_DRAINING
+		switch {
+		case deleting && !ok:
+			logger.Info("Finished deleting container interrupted by restart")
+			continue
+		case deleting:
+			// Draining isn't kept across restarts, so the container takes
+			// new connections again
+			c.DrainingFlows = 0
+			logger.Warn("Container delete was interrupted by restart")
+			c.State = pb.ContainerState_CONTAINER_STATE_FAILED
+			c.Error = "delete interrupted by restart"
+		case c.State == pb.ContainerState_CONTAINER_STATE_CREATING && !ok:
+			logger.Warn("Container create was interrupted by restart")
+			c.State = pb.ContainerState_CONTAINER_STATE_FAILED
+			c.Error = "create interrupted by restart"
+		case c.State == pb.ContainerState_CONTAINER_STATE_CREATING:
+			logger.Info("Finished creating container interrupted by restart")
+			c.State = pb.ContainerState_CONTAINER_STATE_READY
+		case !ok && c.State != pb.ContainerState_CONTAINER_STATE_FAILED:
+			logger.Warn("Container network is gone", "state", c.State)
+			c.State = pb.ContainerState_CONTAINER_STATE_FAILED
+			c.Error = "network lost across restart"
+		}
+		if ok {
+			setContainerNetwork(c, cn)
+		} else {
+			setContainerNetwork(c, &network.ContainerNetwork{})
+		}
+		s.containers[id] = c
+	}
+	for id, cn := range networks {
+		s.log.Info("Adopting container network without a record", "container_id", id)
+		c := &pb.Container{Id: id, Name: cn.Name, State: pb.ContainerState_CONTAINER_STATE_READY}
+		setContainerNetwork(c, cn)
+		s.containers[id] = c
+	}
+	if len(s.containers) > 0 {
+		s.log.Info("Restored container registry", "containers", len(s.containers))
+	}
+	s.saveRegistry()
+}
+
+// setContainerNetwork copies the namespace, addresses, bandwidth limits
+// and interface of cn to c
+func setContainerNetwork(c *pb.Container, cn *network.ContainerNetwork) {
+	c.Namespace = namespaceOrDefault(cn.Namespace)
+	c.Ip = cn.IPv4
+	c.Ipv6 = cn.IPv6
+	c.Mac = cn.MAC
+	c.Mtu = int32(cn.MTU)
+	c.IngressBps = cn.IngressBps
+	c.EgressBps = cn.EgressBps
+	c.HostInterface = cn.HostInterface
+	c.Attachment, c.Device = string(cn.Attachment), nil
+	if cn.Attachment == "" && !cn.Rootless {
+		c.Attachment = string(network.AttachmentVeth)
+	}
+	if d := cn.Device; d != nil {
+		c.Device = &pb.NetworkDevice{Parent: d.Parent, Vf: int32(d.VF), PciAddress: d.PCIAddress}
+	}
+}
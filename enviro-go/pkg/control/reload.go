@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// Keys of the config Reload applies to a running control plane, by their
+// path in its JSON encoding. Changes to any other key need a restart.
+const (
+	reloadLogLevel      = "log_level"
+	reloadLogLevels     = "log_levels"
+	reloadLogThrottle   = "network.log_throttle"
+	reloadDefaultPolicy = "network.default_policy"
+	reloadMTU           = "network.mtu"
+	reloadRateLimit     = "rate_limit"
+)
+
+// reloadTLSKeys are the reloadable keys of the TLS config, which can be
+// changed but not turned on or off while serving
+var reloadTLSKeys = []string{"cert_file", "key_file", "client_ca_file", "require_client_cert", "allowed_spiffe_ids"}
+
+// reloadable reports whether key, or the key it is part of, is applied by
+// Reload, returning that key
+func reloadable(key string) (string, bool) {
+	keys := append([]string{reloadLogLevel, reloadLogLevels, reloadLogThrottle, reloadDefaultPolicy, reloadMTU, reloadRateLimit}, reloadTLSKeys...)
+	for _, k := range keys {
+		if key == k || strings.HasPrefix(key, k+".") {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// Reload applies the changes of config that are safe while serving
+// without dropping connections: the log level and subsystem levels, the
+// datapath log throttle, the default network policy, the container MTU,
+// the rate limits and the TLS files and client certificate checks. The TLS files are read
+// again even when unchanged, picking up rotated certificates.
+//
+// It returns the keys of the other changes, e.g. "network.cidr", which
+// need a restart and are left as they are. On error, the changes applied
+// before it stay in effect. Settings overridden by UpdateRuntimeSettings
+// stay overridden.
+func (cp *ControlPlane) Reload(config ControlPlaneConfig) ([]string, error) {
+	if config.Network.CIDR == "" && config.Network.CIDR6 == "" {
+		config.Network.CIDR = DefaultCIDR
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+	levels, err := config.subsystemLevels()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+
+	cp.reloadMu.Lock()
+	defer cp.reloadMu.Unlock()
+
+	changes, err := configChanges(cp.config, config)
+	if err != nil {
+		return nil, err
+	}
+	var restart, applied []string
+	pending := make(map[string]bool)
+	for _, key := range changes {
+		if k, ok := reloadable(key); ok {
+			pending[k] = true
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	// needRestart moves the changed keys out of pending into restart
+	needRestart := func(keys ...string) {
+		for _, k := range keys {
+			if pending[k] {
+				delete(pending, k)
+				restart = append(restart, k)
+			}
+		}
+	}
+
+	if cp.certs != nil && config.tlsEnabled() {
+		if err := cp.certs.update(config); err != nil {
+			return nil, fmt.Errorf("failed to reload TLS config: %w", err)
+		}
+		cp.config.CertFile, cp.config.KeyFile, cp.config.ClientCAFile = config.CertFile, config.KeyFile, config.ClientCAFile
+		cp.config.RequireClientCert, cp.config.AllowedSPIFFEIDs = config.RequireClientCert, config.AllowedSPIFFEIDs
+		for _, k := range reloadTLSKeys {
+			if pending[k] {
+				applied = append(applied, k)
+			}
+		}
+	} else {
+		needRestart(reloadTLSKeys...)
+	}
+
+	if pending[reloadDefaultPolicy] {
+		if err := cp.network.SetDefaultPolicy(config.Network.DefaultPolicy); err != nil {
+			return nil, err
+		}
+		cp.config.Network.DefaultPolicy = config.Network.DefaultPolicy
+		applied = append(applied, reloadDefaultPolicy)
+	}
+
+	// Setting the MTU back to the kernel default would need the
+	// interfaces recreated
+	if config.Network.MTU == 0 {
+		needRestart(reloadMTU)
+	}
+	if pending[reloadMTU] {
+		cp.config.Network.MTU = config.Network.MTU
+		if _, err := cp.network.SetMTU(context.Background(), config.Network.MTU); err != nil {
+			return nil, err
+		}
+		applied = append(applied, reloadMTU)
+	}
+
+	if pending[reloadLogThrottle] {
+		throttle := config.Network.LogThrottle
+		if throttle == (network.ThrottleConfig{}) {
+			throttle = network.DefaultThrottleConfig()
+		}
+		cp.network.SetLogThrottle(throttle)
+		cp.config.Network.LogThrottle = config.Network.LogThrottle
+		applied = append(applied, reloadLogThrottle)
+	}
+
+	if pending[reloadRateLimit] {
+		cp.limiter.setConfig(config.RateLimit)
+		cp.config.RateLimit = config.RateLimit
+		applied = append(applied, reloadRateLimit)
+	}
+
+	if cp.logLevel == nil {
+		needRestart(reloadLogLevel)
+	}
+	if pending[reloadLogLevel] {
+		level, err := logging.ParseLevel(config.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		cp.logLevel.Set(level)
+		cp.config.LogLevel = config.LogLevel
+		applied = append(applied, reloadLogLevel)
+	}
+	if pending[reloadLogLevels] {
+		cp.logLevels.Set(levels)
+		cp.config.LogLevels = config.LogLevels
+		applied = append(applied, reloadLogLevels)
+	}
+
+	// Runtime overrides win over the config
+	if len(cp.overrides) > 0 {
+		effective, err := cp.config.withOverrides(cp.overrides)
+		if err != nil {
+			return nil, err
+		}
+		cp.applySettings(effective, sortedKeys(cp.overrides))
+	}
+
+	sort.Strings(restart)
+	if len(restart) > 0 {
+		cp.log.Warn("Reloaded control plane config, some changes need a restart", "applied", applied, "restart_required", restart)
+	} else {
+		cp.log.Info("Reloaded control plane config", "applied", applied)
+	}
+	return restart, nil
+}
+
+// configChanges returns the paths of the keys whose values differ between
+// the JSON encodings of a and b, e.g. "network.cidr"
+func configChanges(a, b ControlPlaneConfig) ([]string, error) {
+	var values [2]any
+	for i, config := range []ControlPlaneConfig{a, b} {
+		data, err := json.Marshal(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode config: %w", err)
+		}
+		if err := json.Unmarshal(data, &values[i]); err != nil {
+			return nil, fmt.Errorf("failed to decode config: %w", err)
+		}
+	}
+	var changes []string
+	diffValues("", values[0], values[1], &changes)
+	sort.Strings(changes)
+	return changes, nil
+}
+
+// diffValues appends the keys below key at which the decoded JSON values
+// a and b differ to changes
+func diffValues(key string, a, b any, changes *[]string) {
+	if isEmpty(a) && isEmpty(b) {
+		return
+	}
+	ma, okA := a.(map[string]any)
+	mb, okB := b.(map[string]any)
+	if !okA || !okB {
+		if !reflect.DeepEqual(a, b) {
+			*changes = append(*changes, key)
+		}
+		return
+	}
+	for k, v := range ma {
+		diffValues(joinKey(key, k), v, mb[k], changes)
+	}
+	for k, v := range mb {
+		if _, ok := ma[k]; !ok {
+			diffValues(joinKey(key, k), nil, v, changes)
+		}
+	}
+}
+
+// isEmpty reports whether a decoded JSON value is null or an empty list or
+// object, which configure the same
+func isEmpty(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case map[string]any:
+		return len(v) == 0
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+func TestConfigChanges(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b ControlPlaneConfig
+		want []string
+	}{
+		{name: "same", a: ControlPlaneConfig{Address: "127.0.0.1:50051"}, b: ControlPlaneConfig{Address: "127.0.0.1:50051"}},
+		{name: "top level", a: ControlPlaneConfig{Address: "127.0.0.1:50051"}, b: ControlPlaneConfig{Address: "127.0.0.1:50052"},
+			want: []string{"address"}},
+		{name: "nested", a: ControlPlaneConfig{Network: network.NetworkConfig{CIDR: "10.99.0.0/16", MTU: 1500}},
+			b:    ControlPlaneConfig{Network: network.NetworkConfig{CIDR: "10.98.0.0/16", MTU: 9000}},
+			want: []string{"network.cidr", "network.mtu"}},
+		{name: "added map key", a: ControlPlaneConfig{LogLevels: map[string]string{"raft": "warn"}},
+			b:    ControlPlaneConfig{LogLevels: map[string]string{"raft": "warn", "auth": "debug"}},
+			want: []string{"log_levels.auth"}},
+		{name: "removed map key", a: ControlPlaneConfig{LogLevels: map[string]string{"raft": "warn", "auth": "debug"}},
+			b:    ControlPlaneConfig{LogLevels: map[string]string{"auth": "debug"}},
+			want: []string{"log_levels.raft"}},
+		{name: "removed map", a: ControlPlaneConfig{LogLevels: map[string]string{"raft": "warn"}},
+			want: []string{"log_levels"}},
+		{name: "empty and nil", a: ControlPlaneConfig{AllowedSPIFFEIDs: []string{}, LogLevels: map[string]string{}}},
+		{name: "list", a: ControlPlaneConfig{AllowedSPIFFEIDs: []string{"spiffe://example.org/a"}},
+			b:    ControlPlaneConfig{AllowedSPIFFEIDs: []string{"spiffe://example.org/b"}},
+			want: []string{"allowed_spiffe_ids"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := configChanges(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("configChanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReload reloads the config of a control plane, which applies the
+// changes it can while serving and reports the others
+func TestReload(t *testing.T) {
+	level := new(slog.LevelVar)
+	level.Set(slog.LevelWarn)
+	logger, err := logging.NewLeveled(io.Discard, level, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ControlPlaneConfig{
+		Address:      "unix://" + filepath.Join(t.TempDir(), "enviro.sock"),
+		Network:      network.NetworkConfig{CIDR: "10.99.0.0/16"},
+		DeferNetwork: true,
+		StateDir:     t.TempDir(),
+		Logger:       logger,
+		LogLevelVar:  level,
+	}
+	cp, err := NewControlPlaneWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Stop(context.Background())
+	raft := cp.logLevels.Subsystem(logger, "raft")
+
+	changed := config
+	changed.LogLevel = "debug"
+	changed.LogLevels = map[string]string{"raft": "error"}
+	changed.RateLimit = RateLimitConfig{Default: RateLimit{Rate: 5}}
+	changed.Network.CIDR = "10.98.0.0/16"
+	restart, err := cp.Reload(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"network.cidr"}; !slices.Equal(restart, want) {
+		t.Errorf("Reload() needs a restart for %v, want %v", restart, want)
+	}
+	if got := level.Level(); got != slog.LevelDebug {
+		t.Errorf("level %s after the reload, want %s", got, slog.LevelDebug)
+	}
+	if raft.Enabled(context.Background(), slog.LevelWarn) {
+		t.Error("raft logs warnings after its level was reloaded to error")
+	}
+	if got := cp.limiter.config.Default.Rate; got != 5 {
+		t.Errorf("default rate %g after the reload, want 5", got)
+	}
+	if got := cp.config.Network.CIDR; got != config.Network.CIDR {
+		t.Errorf("CIDR %s after the reload, want it left at %s", got, config.Network.CIDR)
+	}
+
+	// An invalid config changes nothing
+	invalid := changed
+	invalid.LogLevel = "loud"
+	invalid.RateLimit = RateLimitConfig{}
+	if _, err := cp.Reload(invalid); !errors.Is(err, errInvalidConfig) {
+		t.Errorf("Reload() of an invalid config = %v, want %v", err, errInvalidConfig)
+	}
+	if got := cp.limiter.config.Default.Rate; got != 5 {
+		t.Errorf("default rate %g after a failed reload, want 5", got)
+	}
+
+	// Reloading the applied changes again has nothing left to do but
+	// the restart
+	restart, err = cp.Reload(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"network.cidr"}; !slices.Equal(restart, want) {
+		t.Errorf("second Reload() needs a restart for %v, want %v", restart, want)
+	}
+}
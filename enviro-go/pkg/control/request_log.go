@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+)
+
+// requestIDHeader carries the request ID in gRPC metadata. Callers may set
+// it to correlate their logs with ours; otherwise one is generated. The ID
+// is echoed back in the response header.
+const requestIDHeader = "x-request-id"
+
+// requestLogging returns interceptors that attach a logger with request_id
+// and method fields to each request context, and trace_id when the request
+// is traced.
+func requestLogging(logger *slog.Logger) []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, l := requestLogger(ctx, logger, info.FullMethod)
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logRequest(ctx, l, start, err)
+		return resp, err
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, l := requestLogger(ss.Context(), logger, info.FullMethod)
+		start := time.Now()
+		err := handler(srv, &loggingStream{ServerStream: ss, ctx: ctx})
+		logRequest(ctx, l, start, err)
+		return err
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary),
+		grpc.ChainStreamInterceptor(stream),
+	}
+}
+
+// requestLogger derives the request logger and stores it in ctx
+func requestLogger(ctx context.Context, logger *slog.Logger, method string) (context.Context, *slog.Logger) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDHeader); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+
+	l := logger.With("request_id", id, "method", method)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	return logging.WithLogger(context.WithValue(ctx, requestIDKey{}, id), l), l
+}
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID requestLogger gave the request
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func logRequest(ctx context.Context, l *slog.Logger, start time.Time, err error) {
+	l.Debug("Handled request", "code", status.Code(err).String(), "duration", time.Since(start))
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// loggingStream overrides the stream context with the request logger
+type loggingStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *loggingStream) Context() context.Context {
+	return s.ctx
+}
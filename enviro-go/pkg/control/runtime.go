@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned by a Runtime
+var (
+	// ErrNoRuntime means no container runtime is attached to the control
+	// plane
+	ErrNoRuntime = errors.New("no container runtime attached")
+	// ErrRuntimeTimeout means the container did not start or stop in time
+	ErrRuntimeTimeout = errors.New("container runtime timed out")
+	// ErrRuntimeRejected means the runtime refused the request, e.g. for a
+	// container it doesn't know
+	ErrRuntimeRejected = errors.New("container runtime rejected request")
+	// ErrNoSessions means the runtime can't exec in or attach to
+	// containers
+	ErrNoSessions = errors.New("container runtime doesn't support exec and attach")
+)
+
+// defaultStopTimeout is how long StopContainer lets a container exit
+// before it is killed, unless the request sets a timeout
+const defaultStopTimeout = 10 * time.Second
+
+// maxStopTimeout bounds stops so they can't outlive a drain
+const maxStopTimeout = 5 * time.Minute
+
+// Runtime runs container processes. The control plane only sets up
+// container networking; StartContainer and StopContainer are handed to a
+// Runtime, which the Rust runtime registers through the FFI.
+type Runtime interface {
+	// Start starts the process of container id
+	Start(ctx context.Context, id string) error
+	// Stop stops the process of container id, killing it if it has not
+	// exited after timeout
+	Stop(ctx context.Context, id string, timeout time.Duration) error
+}
+
+// SessionRuntime is implemented by Runtimes that can run commands in
+// containers and attach to them, for Exec and Attach. The output of a
+// session is written to stdout and stderr, which block while the client
+// is behind and fail once it is gone.
+type SessionRuntime interface {
+	// Exec runs a command in container id
+	Exec(ctx context.Context, id string, opts ExecOptions, stdout, stderr io.Writer) (Session, error)
+	// Attach attaches to the main process of container id
+	Attach(ctx context.Context, id string, opts AttachOptions, stdout, stderr io.Writer) (Session, error)
+}
+
+// ExecOptions describes a command to run in a container
+type ExecOptions struct {
+	// Command is the command and its arguments
+	Command []string `json:"command"`
+	// Env holds variables as KEY=value, added to the container's
+	Env []string `json:"env,omitempty"`
+	// WorkingDir is the container's when empty
+	WorkingDir string `json:"working_dir,omitempty"`
+	// TTY runs the command in a terminal, whose output goes to stdout
+	TTY bool `json:"tty"`
+	// Stdin passes on input; otherwise stdin is empty
+	Stdin bool `json:"stdin"`
+	// Size is the initial size of the terminal with TTY
+	Size TerminalSize `json:"size"`
+}
+
+// AttachOptions describes how to attach to a container
+type AttachOptions struct {
+	// Stdin passes on input, when the container has a stdin
+	Stdin bool `json:"stdin"`
+	// Size is the size of the terminal, when the container has one
+	Size TerminalSize `json:"size"`
+}
+
+// TerminalSize is the size of a terminal in characters
+type TerminalSize struct {
+	Width  uint32 `json:"width"`
+	Height uint32 `json:"height"`
+}
+
+// Session is a command run by Exec or a process attached to by Attach
+type Session interface {
+	// Write writes to the stdin of the process
+	Write(p []byte) (int, error)
+	// CloseStdin closes the stdin of the process
+	CloseStdin() error
+	// Resize resizes the terminal of the process
+	Resize(size TerminalSize) error
+	// Wait returns the exit code of the process once it exited and all of
+	// its output was written
+	Wait(ctx context.Context) (int, error)
+	// Close ends the session, killing a command run by Exec and detaching
+	// from an attached process. It may be called more than once.
+	Close() error
+}
+
+// runtimeError maps Runtime errors to gRPC status codes
+func runtimeError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		// Already a status, e.g. from the node a container was placed on
+		return err
+	}
+	switch {
+	case errors.Is(err, ErrNoRuntime), errors.Is(err, ErrRuntimeRejected), errors.Is(err, ErrNoSessions):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrRuntimeTimeout):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
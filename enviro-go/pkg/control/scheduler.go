@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/client"
+)
+
+// dispatchTimeout bounds calls to nodes whose context has no deadline
+const dispatchTimeout = 30 * time.Second
+
+// Scorer ranks the nodes a container fits on; the scheduler picks the
+// node with the highest total score of all scorers. Built-in scorers
+// score between 0 and 1.
+type Scorer interface {
+	// Score rates placing the container of req on node, which already
+	// runs the placed containers
+	Score(req *pb.CreateContainerRequest, node *pb.Node, placed []*pb.Container) float64
+}
+
+// ScorerFunc adapts a function to a Scorer
+type ScorerFunc func(req *pb.CreateContainerRequest, node *pb.Node, placed []*pb.Container) float64
+
+// Score implements Scorer
+func (f ScorerFunc) Score(req *pb.CreateContainerRequest, node *pb.Node, placed []*pb.Container) float64 {
+	return f(req, node, placed)
+}
+
+// SchedulerConfig configures the placement of containers across the
+// registered nodes
+type SchedulerConfig struct {
+	// Scorers are added to the built-in ones, which prefer the nodes with
+	// the most capacity left and then those with the fewest containers
+	Scorers []Scorer `json:"-"`
+	// TokenFile holds the bearer token the leader creates containers on
+	// nodes with, for nodes requiring authentication. It needs the
+	// operator role there.
+	TokenFile string `json:"token_file"`
+	// CAFile, CertFile and KeyFile connect to nodes with TLS as by
+	// client.WithTLSFiles, when any is set
+	CAFile   string `json:"ca_file"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Connections tunes the pool of connections to nodes, which calls to
+	// the same node share
+	Connections client.PoolConfig `json:"connections"`
+}
+
+// scheduler places containers on the registered nodes and dispatches
+// their lifecycle calls to the nodes' control planes
+type scheduler struct {
+	nodes   *nodeRegistry
+	scorers []Scorer
+	// pool holds the connections to nodes
+	pool *client.Pool
+	log  *slog.Logger
+}
+
+// newScheduler creates a scheduler connecting to nodes with the options
+// of config and dialOpts
+func newScheduler(config SchedulerConfig, nodes *nodeRegistry, dialOpts []grpc.DialOption, logger *slog.Logger) (*scheduler, error) {
+	opts := []client.Option{client.WithTimeout(dispatchTimeout), client.WithDialOptions(dialOpts...)}
+	if config.CAFile != "" || config.CertFile != "" || config.KeyFile != "" {
+		opts = append(opts, client.WithTLSFiles(config.CAFile, config.CertFile, config.KeyFile))
+	}
+	if config.TokenFile != "" {
+		token, err := os.ReadFile(config.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scheduler token: %w", err)
+		}
+		opts = append(opts, client.WithToken(strings.TrimSpace(string(token))))
+	}
+	pool, err := client.NewPool(config.Connections, opts...)
+	if err != nil {
+		return nil, err
+	}
+	scorers := append([]Scorer{ScorerFunc(scoreLeastAllocated), ScorerFunc(scoreSpread)}, config.Scorers...)
+	return &scheduler{
+		nodes:   nodes,
+		scorers: scorers,
+		pool:    pool,
+		log:     logger,
+	}, nil
+}
+
+// pick returns the node to place the container of req on, given the
+// containers already placed on each node, and reserves its resources
+// there until the node next reports its capacity
+func (s *scheduler) pick(req *pb.CreateContainerRequest, placed map[string][]*pb.Container) (*pb.Node, error) {
+	var best *pb.Node
+	var bestScore float64
+	var reasons []string
+	for _, n := range s.nodes.list() {
+		if reason := unfit(req, n, placed[n.Name]); reason != "" {
+			reasons = append(reasons, n.Name+": "+reason)
+			continue
+		}
+		var score float64
+		for _, sc := range s.scorers {
+			score += sc.Score(req, n, placed[n.Name])
+		}
+		// Nodes are listed by name, so ties go to the first
+		if best == nil || score > bestScore {
+			best, bestScore = n, score
+		}
+	}
+	if best == nil {
+		msg := "no registered node"
+		if len(reasons) > 0 {
+			msg = "no node fits: " + strings.Join(reasons, "; ")
+		}
+		return nil, status.Error(codes.ResourceExhausted, msg)
+	}
+	s.nodes.reserve(best.Name, req.Placement)
+	return best, nil
+}
+
+// unfit returns why the container of req can't be placed on n, empty
+// when it can
+func unfit(req *pb.CreateContainerRequest, n *pb.Node, placed []*pb.Container) string {
+	p := req.Placement
+	if n.State != pb.NodeState_NODE_STATE_READY {
+		return "not ready"
+	}
+	if n.Unschedulable {
+		return "unschedulable"
+	}
+	for k, v := range p.NodeSelector {
+		if n.Labels[k] != v {
+			return fmt.Sprintf("label %s is not %q", k, v)
+		}
+	}
+	capacity := n.GetCapacity()
+	switch {
+	case p.CpuMillicores > capacity.GetCpuMillicores():
+		return "not enough CPU"
+	case p.MemoryBytes > capacity.GetMemoryBytes():
+		return "not enough memory"
+	case capacity.GetIpPoolFree() == 0:
+		return "no free addresses"
+	}
+	for _, key := range p.AntiAffinity {
+		value, ok := req.Labels[key]
+		if !ok {
+			continue
+		}
+		for _, c := range placed {
+			if v, ok := c.Labels[key]; ok && v == value {
+				return fmt.Sprintf("runs %s with %s=%s", c.Id, key, value)
+			}
+		}
+	}
+	return ""
+}
+
+// scoreLeastAllocated prefers the nodes left with the largest share of
+// their CPU and memory after placing the container
+func scoreLeastAllocated(req *pb.CreateContainerRequest, n *pb.Node, placed []*pb.Container) float64 {
+	left := func(capacity, request float64) float64 {
+		if capacity <= 0 {
+			return 0
+		}
+		return (capacity - request) / capacity
+	}
+	capacity := n.GetCapacity()
+	cpu := left(float64(capacity.GetCpuMillicores()), float64(req.Placement.CpuMillicores))
+	mem := left(float64(capacity.GetMemoryBytes()), float64(req.Placement.MemoryBytes))
+	return (cpu + mem) / 2
+}
+
+// scoreSpread prefers the nodes running the fewest placed containers
+func scoreSpread(req *pb.CreateContainerRequest, n *pb.Node, placed []*pb.Container) float64 {
+	return 1 / float64(1+len(placed))
+}
+
+// client returns a client of node name over the pooled connections
+func (s *scheduler) client(name string) (*client.Client, error) {
+	n, ok := s.nodes.get(name)
+	if !ok {
+		return nil, status.Errorf(codes.Unavailable, "node %q is not registered", name)
+	}
+	return s.pool.Client(n.Address), nil
+}
+
+// create creates the container of req on node name. The request is
+// stripped of its placement and keyed by the container ID, so retrying
+// is safe.
+func (s *scheduler) create(ctx context.Context, name string, req *pb.CreateContainerRequest) (*pb.Container, error) {
+	c, err := s.client(name)
+	if err != nil {
+		return nil, err
+	}
+	req = proto.Clone(req).(*pb.CreateContainerRequest)
+	req.Placement = nil
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = req.Id
+	}
+	created, err := c.CreateContainer(ctx, req)
+	if isDraining(err) {
+		// Place no more containers on the node until it reports it takes
+		// them again
+		s.nodes.cordon(name)
+	}
+	return created, err
+}
+
+// start starts container id on node name
+func (s *scheduler) start(ctx context.Context, name, id string) error {
+	c, err := s.client(name)
+	if err != nil {
+		return err
+	}
+	_, err = c.StartContainer(ctx, id)
+	return err
+}
+
+// stop stops container id on node name
+func (s *scheduler) stop(ctx context.Context, name, id string, timeout time.Duration) error {
+	c, err := s.client(name)
+	if err != nil {
+		return err
+	}
+	_, err = c.StopContainer(ctx, id, timeout)
+	return err
+}
+
+// delete deletes container id on node name; containers the node no
+// longer has are already deleted
+func (s *scheduler) delete(ctx context.Context, name, id string, drain time.Duration) error {
+	c, err := s.client(name)
+	if err != nil {
+		return err
+	}
+	if err := c.DeleteContainer(ctx, id, drain); status.Code(err) != codes.NotFound {
+		return err
+	}
+	return nil
+}
+
+// close closes the connections to nodes
+func (s *scheduler) close() error {
+	return s.pool.Close()
+}
+
+// placedContainers groups the containers placed on nodes by node. Callers
+// must hold s.mu.
+func (s *containerService) placedContainers() map[string][]*pb.Container {
+	placed := make(map[string][]*pb.Container)
+	for _, c := range s.containers {
+		if c.Node != "" {
+			placed[c.Node] = append(placed[c.Node], c)
+		}
+	}
+	for _, cs := range placed {
+		sort.Slice(cs, func(i, j int) bool { return cs[i].Id < cs[j].Id })
+	}
+	return placed
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/client"
+)
+
+// testNode is a node registered for a scheduling test
+type testNode struct {
+	name          string
+	labels        map[string]string
+	capacity      *pb.NodeCapacity
+	unschedulable bool
+	// lost nodes have missed their heartbeats
+	lost bool
+}
+
+// newTestScheduler returns a scheduler of the nodes, which it can't
+// reach, with scorers added to the built-in ones
+func newTestScheduler(t *testing.T, nodes []testNode, scorers ...Scorer) *scheduler {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	registry := newNodeRegistry(NodeRegistryConfig{}, logger)
+	// The lost nodes are registered first, to miss the heartbeats the
+	// others don't
+	for _, lost := range []bool{true, false} {
+		for _, n := range nodes {
+			if n.lost != lost {
+				continue
+			}
+			registry.register(&pb.RegisterNodeRequest{
+				Name:          n.name,
+				Address:       n.name + ":50051",
+				Labels:        n.labels,
+				Capacity:      n.capacity,
+				Unschedulable: n.unschedulable,
+			})
+		}
+		if lost {
+			registry.sweep(time.Now().Add(registry.grace + time.Second))
+		}
+	}
+	s, err := newScheduler(SchedulerConfig{Scorers: scorers}, registry, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.close() })
+	return s
+}
+
+func TestSchedulerPick(t *testing.T) {
+	capacity := func(cpu int64, memory uint64) *pb.NodeCapacity {
+		return &pb.NodeCapacity{CpuMillicores: cpu, MemoryBytes: memory, IpPoolFree: 10}
+	}
+	small, large := capacity(1000, 1<<30), capacity(4000, 4<<30)
+	req := func(p *pb.Placement, labels map[string]string) *pb.CreateContainerRequest {
+		return &pb.CreateContainerRequest{Id: "new", Labels: labels, Placement: p}
+	}
+	web := map[string]string{"app": "web"}
+
+	tests := []struct {
+		name    string
+		nodes   []testNode
+		req     *pb.CreateContainerRequest
+		placed  map[string][]*pb.Container
+		scorers []Scorer
+		want    string
+		// wantErr is part of the error when no node fits
+		wantErr string
+	}{
+		{name: "no nodes", req: req(&pb.Placement{}, nil), wantErr: "no registered node"},
+		{name: "most capacity left", nodes: []testNode{{name: "a", capacity: small}, {name: "b", capacity: large}},
+			req: req(&pb.Placement{CpuMillicores: 500, MemoryBytes: 1 << 29}, nil), want: "b"},
+		{name: "ties to the first", nodes: []testNode{{name: "a", capacity: small}, {name: "b", capacity: small}},
+			req: req(&pb.Placement{}, nil), want: "a"},
+		{name: "fewest containers", nodes: []testNode{{name: "a", capacity: small}, {name: "b", capacity: small}},
+			req:    req(&pb.Placement{}, nil),
+			placed: map[string][]*pb.Container{"a": {{Id: "c1"}, {Id: "c2"}}, "b": {{Id: "c3"}}}, want: "b"},
+		{name: "node selector", nodes: []testNode{{name: "a", capacity: large}, {name: "b", capacity: small, labels: map[string]string{"disk": "ssd"}}},
+			req: req(&pb.Placement{NodeSelector: map[string]string{"disk": "ssd"}}, nil), want: "b"},
+		{name: "anti-affinity", nodes: []testNode{{name: "a", capacity: large}, {name: "b", capacity: small}},
+			req:    req(&pb.Placement{AntiAffinity: []string{"app"}}, web),
+			placed: map[string][]*pb.Container{"a": {{Id: "web-1", Labels: web}}}, want: "b"},
+		{name: "anti-affinity without the label", nodes: []testNode{{name: "a", capacity: large}, {name: "b", capacity: small}},
+			req:    req(&pb.Placement{AntiAffinity: []string{"app"}}, nil),
+			placed: map[string][]*pb.Container{"a": {{Id: "web-1", Labels: web}}, "b": {{Id: "web-2", Labels: web}}}, want: "a"},
+		{name: "unschedulable", nodes: []testNode{{name: "a", capacity: large, unschedulable: true}, {name: "b", capacity: small}},
+			req: req(&pb.Placement{}, nil), want: "b"},
+		{name: "lost", nodes: []testNode{{name: "a", capacity: large, lost: true}, {name: "b", capacity: small}},
+			req: req(&pb.Placement{}, nil), want: "b"},
+		{name: "custom scorer", nodes: []testNode{{name: "a", capacity: small}, {name: "b", capacity: large}},
+			req: req(&pb.Placement{}, nil), want: "a",
+			scorers: []Scorer{ScorerFunc(func(req *pb.CreateContainerRequest, n *pb.Node, placed []*pb.Container) float64 {
+				if n.Name == "a" {
+					return 10
+				}
+				return 0
+			})}},
+		{name: "not enough CPU", nodes: []testNode{{name: "a", capacity: small}},
+			req: req(&pb.Placement{CpuMillicores: 2000}, nil), wantErr: "a: not enough CPU"},
+		{name: "not enough memory", nodes: []testNode{{name: "a", capacity: small}},
+			req: req(&pb.Placement{MemoryBytes: 2 << 30}, nil), wantErr: "a: not enough memory"},
+		{name: "no free addresses", nodes: []testNode{{name: "a", capacity: &pb.NodeCapacity{CpuMillicores: 1000, MemoryBytes: 1 << 30}}},
+			req: req(&pb.Placement{}, nil), wantErr: "a: no free addresses"},
+		{name: "none fits", nodes: []testNode{{name: "a", capacity: small, unschedulable: true}, {name: "b", capacity: small, lost: true}},
+			req: req(&pb.Placement{}, nil), wantErr: "a: unschedulable; b: not ready"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScheduler(t, tt.nodes, tt.scorers...)
+			n, err := s.pick(tt.req, tt.placed)
+			if tt.wantErr != "" {
+				if status.Code(err) != codes.ResourceExhausted || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("pick() = %v, want %s with %q", err, codes.ResourceExhausted, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("pick() = %v", err)
+			}
+			if n.Name != tt.want {
+				t.Errorf("picked %s, want %s", n.Name, tt.want)
+			}
+		})
+	}
+}
+
+// TestSchedulerReserve places containers until the node's capacity runs
+// out before it reports it again
+func TestSchedulerReserve(t *testing.T) {
+	s := newTestScheduler(t, []testNode{{name: "a", capacity: &pb.NodeCapacity{CpuMillicores: 1000, MemoryBytes: 1 << 30, IpPoolFree: 2}}})
+	req := &pb.CreateContainerRequest{Id: "new", Placement: &pb.Placement{CpuMillicores: 400}}
+	for i := 0; i < 2; i++ {
+		if _, err := s.pick(req, nil); err != nil {
+			t.Fatalf("pick %d: %v", i, err)
+		}
+	}
+	if _, err := s.pick(req, nil); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("pick beyond the capacity = %v, want %s", err, codes.ResourceExhausted)
+	}
+	n, _ := s.nodes.get("a")
+	if c := n.Capacity; c.CpuMillicores != 200 || c.IpPoolFree != 0 {
+		t.Errorf("capacity left %v, want 200 millicores and no addresses", c)
+	}
+
+	// The next heartbeat reports the capacity the node has left
+	s.nodes.heartbeat(&pb.NodeHeartbeatRequest{Name: "a", Capacity: &pb.NodeCapacity{CpuMillicores: 1000, MemoryBytes: 1 << 30, IpPoolFree: 1}})
+	if _, err := s.pick(req, nil); err != nil {
+		t.Errorf("pick after a heartbeat = %v", err)
+	}
+}
+
+// TestSchedulerDispatch sends a container's lifecycle calls to the fake
+// control plane of its node
+func TestSchedulerDispatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	fake, err := client.NewFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	s := newTestScheduler(t, nil)
+	s.nodes.register(&pb.RegisterNodeRequest{Name: "a", Address: fake.Addr()})
+
+	req := &pb.CreateContainerRequest{Id: "web", Placement: &pb.Placement{CpuMillicores: 100}}
+	created, err := s.create(ctx, "a", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id != "web" || created.Ip == "" {
+		t.Errorf("created %v", created)
+	}
+	if req.Placement == nil || req.IdempotencyKey != "" {
+		t.Error("create changed the request")
+	}
+	// Retrying the create is safe
+	if again, err := s.create(ctx, "a", req); err != nil || again.Ip != created.Ip {
+		t.Errorf("retried create = %v, %v, want %s", again, err, created.Ip)
+	}
+	if err := s.start(ctx, "a", "web"); err != nil {
+		t.Errorf("start: %v", err)
+	}
+	if err := s.stop(ctx, "a", "web", time.Second); err != nil {
+		t.Errorf("stop: %v", err)
+	}
+	for _, step := range []string{"delete", "delete of a deleted container"} {
+		if err := s.delete(ctx, "a", "web", 0); err != nil {
+			t.Errorf("%s: %v", step, err)
+		}
+	}
+
+	if err := s.start(ctx, "b", "web"); status.Code(err) != codes.Unavailable {
+		t.Errorf("start on an unregistered node = %v, want %s", err, codes.Unavailable)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// DefaultMaxConcurrentStreams limits streams per client connection
+	DefaultMaxConcurrentStreams = 1000
+	// DefaultMaxMsgSize limits received and sent messages
+	DefaultMaxMsgSize = 16 * 1024 * 1024
+	// minMsgSize rejects limits too small for any real request
+	minMsgSize = 1024
+)
+
+// Keepalive defaults, see KeepaliveConfig
+const (
+	// DefaultKeepaliveTime finds clients that vanished without closing
+	// their connections, whose watches would otherwise hold up draining
+	DefaultKeepaliveTime    = 2 * time.Minute
+	DefaultKeepaliveTimeout = 20 * time.Second
+	// DefaultKeepaliveMinTime lets clients behind NAT keep their watches
+	// alive by pinging, which gRPC otherwise only allows every 5 minutes
+	DefaultKeepaliveMinTime = 30 * time.Second
+)
+
+// ServerConfig tunes the gRPC server. Zero values keep the defaults.
+type ServerConfig struct {
+	// MaxConcurrentStreams defaults to DefaultMaxConcurrentStreams
+	MaxConcurrentStreams uint32 `json:"max_concurrent_streams"`
+	// MaxRecvMsgSize and MaxSendMsgSize are in bytes and default to
+	// DefaultMaxMsgSize
+	MaxRecvMsgSize int `json:"max_recv_msg_size"`
+	MaxSendMsgSize int `json:"max_send_msg_size"`
+	// Keepalive pings idle clients, e.g. to keep NAT mappings alive
+	Keepalive KeepaliveConfig `json:"keepalive"`
+	// Deadlines bounds how long RPCs run
+	Deadlines DeadlineConfig `json:"deadlines"`
+	// UnaryInterceptors and StreamInterceptors run after the built-in
+	// logging, metrics, draining, auth and rate limiting interceptors
+	UnaryInterceptors  []grpc.UnaryServerInterceptor  `json:"-"`
+	StreamInterceptors []grpc.StreamServerInterceptor `json:"-"`
+}
+
+// KeepaliveConfig mirrors keepalive.ServerParameters and
+// keepalive.EnforcementPolicy. Zero values keep the defaults: those of
+// this package where there is one, else gRPC's. Clients pinging more
+// often than MinTime, or without RPCs unless PermitWithoutStream, are
+// disconnected.
+type KeepaliveConfig struct {
+	// MaxConnectionIdle closes connections without RPCs for this long
+	MaxConnectionIdle time.Duration `json:"max_connection_idle"`
+	// MaxConnectionAge closes connections older than this, after
+	// MaxConnectionAgeGrace for running RPCs
+	MaxConnectionAge      time.Duration `json:"max_connection_age"`
+	MaxConnectionAgeGrace time.Duration `json:"max_connection_age_grace"`
+	// Time pings clients idle for this long, Timeout closes the connection
+	// when the ping is not answered in time. They default to
+	// DefaultKeepaliveTime and DefaultKeepaliveTimeout.
+	Time    time.Duration `json:"time"`
+	Timeout time.Duration `json:"timeout"`
+	// MinTime is the shortest interval clients may ping at,
+	// DefaultKeepaliveMinTime by default
+	MinTime time.Duration `json:"min_time"`
+	// PermitWithoutStream allows client pings without active RPCs
+	PermitWithoutStream bool `json:"permit_without_stream"`
+}
+
+// validate rejects values that would leave the server unusable
+func (c ServerConfig) validate() error {
+	for _, size := range []struct {
+		name  string
+		value int
+	}{
+		{"max_recv_msg_size", c.MaxRecvMsgSize},
+		{"max_send_msg_size", c.MaxSendMsgSize},
+	} {
+		if size.value != 0 && size.value < minMsgSize {
+			return fmt.Errorf("%s %d is below the minimum of %d bytes", size.name, size.value, minMsgSize)
+		}
+	}
+	k := c.Keepalive
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"max_connection_idle", k.MaxConnectionIdle},
+		{"max_connection_age", k.MaxConnectionAge},
+		{"max_connection_age_grace", k.MaxConnectionAgeGrace},
+		{"time", k.Time},
+		{"timeout", k.Timeout},
+		{"min_time", k.MinTime},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("keepalive %s must not be negative", d.name)
+		}
+	}
+	if err := c.Deadlines.validate(); err != nil {
+		return fmt.Errorf("deadlines: %w", err)
+	}
+	return nil
+}
+
+// withDefaults fills in the unset values that have a default
+func (c KeepaliveConfig) withDefaults() KeepaliveConfig {
+	if c.Time == 0 {
+		c.Time = DefaultKeepaliveTime
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultKeepaliveTimeout
+	}
+	if c.MinTime == 0 {
+		c.MinTime = DefaultKeepaliveMinTime
+	}
+	return c
+}
+
+// serverOptions returns the tuning options with defaults applied. The
+// extra interceptors are returned separately so they chain last.
+func (c ServerConfig) serverOptions() (opts, interceptors []grpc.ServerOption) {
+	streams := c.MaxConcurrentStreams
+	if streams == 0 {
+		streams = DefaultMaxConcurrentStreams
+	}
+	recv, send := c.MaxRecvMsgSize, c.MaxSendMsgSize
+	if recv == 0 {
+		recv = DefaultMaxMsgSize
+	}
+	if send == 0 {
+		send = DefaultMaxMsgSize
+	}
+	k := c.Keepalive.withDefaults()
+	opts = []grpc.ServerOption{
+		grpc.MaxConcurrentStreams(streams),
+		grpc.MaxRecvMsgSize(recv),
+		grpc.MaxSendMsgSize(send),
+		// gRPC applies its own defaults to the zero values left
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			MaxConnectionIdle:     k.MaxConnectionIdle,
+			MaxConnectionAge:      k.MaxConnectionAge,
+			MaxConnectionAgeGrace: k.MaxConnectionAgeGrace,
+			Time:                  k.Time,
+			Timeout:               k.Timeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             k.MinTime,
+			PermitWithoutStream: k.PermitWithoutStream,
+		}),
+	}
+
+	if len(c.UnaryInterceptors) > 0 {
+		interceptors = append(interceptors, grpc.ChainUnaryInterceptor(c.UnaryInterceptors...))
+	}
+	if len(c.StreamInterceptors) > 0 {
+		interceptors = append(interceptors, grpc.ChainStreamInterceptor(c.StreamInterceptors...))
+	}
+	return opts, interceptors
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+)
+
+// sessionStream is the server side of an Exec or Attach call
+type sessionStream interface {
+	Send(*pb.SessionOutput) error
+	SendHeader(metadata.MD) error
+	Context() context.Context
+}
+
+// openSession starts a session with rt, writing its output to stdout and
+// stderr
+type openSession func(ctx context.Context, rt SessionRuntime, stdout, stderr io.Writer) (Session, error)
+
+// Exec runs a command in a running container, on the node the container
+// was placed on if any
+func (s *containerService) Exec(stream pb.ContainerService_ExecServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := req.GetStart()
+	if start == nil {
+		return status.Error(codes.InvalidArgument, "the first request must start the command")
+	}
+	if len(start.Command) == 0 {
+		return status.Error(codes.InvalidArgument, "command is required")
+	}
+	opts := ExecOptions{
+		Command:    start.Command,
+		Env:        start.Env,
+		WorkingDir: start.WorkingDir,
+		TTY:        start.Tty,
+		Stdin:      start.Stdin,
+		Size:       terminalSize(start.TerminalSize),
+	}
+	recv := func() (*pb.SessionInput, error) {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if req.GetInput() == nil {
+			return nil, status.Error(codes.InvalidArgument, "only the first request may start the command")
+		}
+		return req.GetInput(), nil
+	}
+	return s.runSession(stream, "exec", start.ContainerId, recv, func(ctx context.Context, rt SessionRuntime, stdout, stderr io.Writer) (Session, error) {
+		return rt.Exec(ctx, start.ContainerId, opts, stdout, stderr)
+	})
+}
+
+// Attach attaches to the main process of a running container, on the
+// node the container was placed on if any
+func (s *containerService) Attach(stream pb.ContainerService_AttachServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	start := req.GetStart()
+	if start == nil {
+		return status.Error(codes.InvalidArgument, "the first request must start the attach")
+	}
+	opts := AttachOptions{
+		Stdin: start.Stdin,
+		Size:  terminalSize(start.TerminalSize),
+	}
+	recv := func() (*pb.SessionInput, error) {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if req.GetInput() == nil {
+			return nil, status.Error(codes.InvalidArgument, "only the first request may start the attach")
+		}
+		return req.GetInput(), nil
+	}
+	return s.runSession(stream, "attach", start.ContainerId, recv, func(ctx context.Context, rt SessionRuntime, stdout, stderr io.Writer) (Session, error) {
+		return rt.Attach(ctx, start.ContainerId, opts, stdout, stderr)
+	})
+}
+
+// runSession opens a session of kind "exec" or "attach" with container
+// id, passes it the input recv returns and streams its output until the
+// process exits or the client goes away. Sessions end when the control
+// plane shuts down.
+func (s *containerService) runSession(stream sessionStream, kind, id string, recv func() (*pb.SessionInput, error), open openSession) error {
+	if id == "" {
+		return status.Error(codes.InvalidArgument, "container id is required")
+	}
+	s.mu.Lock()
+	c, ok := s.containers[id]
+	if !ok {
+		s.mu.Unlock()
+		return status.Errorf(codes.NotFound, "container %q not found", id)
+	}
+	if c.State != pb.ContainerState_CONTAINER_STATE_RUNNING {
+		s.mu.Unlock()
+		return status.Errorf(codes.FailedPrecondition, "container %q is %s", id, c.State)
+	}
+	node := c.Node
+	s.mu.Unlock()
+
+	var rt SessionRuntime
+	switch runtime, ok := s.runtime.(SessionRuntime); {
+	case node != "":
+		rt = s.scheduler.sessions(node)
+	case s.runtime == nil:
+		return runtimeError(ErrNoRuntime)
+	case !ok:
+		return runtimeError(ErrNoSessions)
+	default:
+		rt = runtime
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.events.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// The runtime writes output from its own threads, which must stop once
+	// the call is over
+	var sendMu sync.Mutex
+	ended := false
+	send := func(out *pb.SessionOutput) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		if ended {
+			return io.ErrClosedPipe
+		}
+		return stream.Send(out)
+	}
+	defer func() {
+		sendMu.Lock()
+		ended = true
+		sendMu.Unlock()
+	}()
+	stdout := sessionWriter(func(p []byte) error {
+		return send(&pb.SessionOutput{Output: &pb.SessionOutput_Stdout{Stdout: p}})
+	})
+	stderr := sessionWriter(func(p []byte) error {
+		return send(&pb.SessionOutput{Output: &pb.SessionOutput_Stderr{Stderr: p}})
+	})
+
+	log := s.logger(ctx).With("container_id", id, "session", kind)
+	sess, err := open(ctx, rt, stdout, stderr)
+	if err != nil {
+		log.Error("Failed to open session", "error", err)
+		return runtimeError(err)
+	}
+	defer sess.Close()
+	log.Info("Session opened")
+	// Tell the client the process runs, even before any output
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+
+	// invalid holds the error of a request that isn't input, which ends
+	// the call
+	invalid := make(chan error, 1)
+	go func() {
+		for {
+			in, err := recv()
+			if errors.Is(err, io.EOF) {
+				sess.CloseStdin()
+				return
+			}
+			if err != nil {
+				if status.Code(err) == codes.InvalidArgument {
+					invalid <- err
+					cancel()
+				}
+				return
+			}
+			switch in := in.Input.(type) {
+			case *pb.SessionInput_Stdin:
+				_, err = sess.Write(in.Stdin)
+			case *pb.SessionInput_CloseStdin:
+				if in.CloseStdin {
+					err = sess.CloseStdin()
+				}
+			case *pb.SessionInput_Resize:
+				err = sess.Resize(terminalSize(in.Resize))
+			}
+			if err != nil {
+				// E.g. stdin closed by the process; its output still counts
+				log.Debug("Failed to pass on session input", "error", err)
+			}
+		}
+	}()
+
+	code, err := sess.Wait(ctx)
+	switch {
+	case err == nil:
+		log.Info("Session ended", "exit_code", code)
+		return send(&pb.SessionOutput{Output: &pb.SessionOutput_Exit{Exit: &pb.ExitStatus{Code: int32(code)}}})
+	case stream.Context().Err() != nil:
+		log.Info("Session closed by client")
+		return status.FromContextError(stream.Context().Err()).Err()
+	case ctx.Err() != nil:
+		select {
+		case err := <-invalid:
+			return err
+		default:
+		}
+		return status.Error(codes.Unavailable, "control plane shutting down")
+	default:
+		log.Error("Session failed", "error", err)
+		return runtimeError(err)
+	}
+}
+
+// sessionWriter sends each write as a message of a session's output
+type sessionWriter func(p []byte) error
+
+func (w sessionWriter) Write(p []byte) (int, error) {
+	if err := w(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func terminalSize(size *pb.TerminalSize) TerminalSize {
+	return TerminalSize{Width: size.GetWidth(), Height: size.GetHeight()}
+}
+
+// nodeSessions runs the sessions of the containers placed on a node
+// through the node's Exec and Attach
+type nodeSessions struct {
+	scheduler *scheduler
+	node      string
+}
+
+// sessions returns the SessionRuntime of node name
+func (s *scheduler) sessions(name string) SessionRuntime {
+	return nodeSessions{scheduler: s, node: name}
+}
+
+func (n nodeSessions) Exec(ctx context.Context, id string, opts ExecOptions, stdout, stderr io.Writer) (Session, error) {
+	c, err := n.scheduler.client(n.node)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.Exec(ctx, &pb.ExecStart{
+		ContainerId:  id,
+		Command:      opts.Command,
+		Env:          opts.Env,
+		WorkingDir:   opts.WorkingDir,
+		Tty:          opts.TTY,
+		Stdin:        opts.Stdin,
+		TerminalSize: &pb.TerminalSize{Width: opts.Size.Width, Height: opts.Size.Height},
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	send := func(in *pb.SessionInput) error {
+		return stream.Send(&pb.ExecRequest{Request: &pb.ExecRequest_Input{Input: in}})
+	}
+	return newRemoteSession(stream, send, cancel, stdout, stderr), nil
+}
+
+func (n nodeSessions) Attach(ctx context.Context, id string, opts AttachOptions, stdout, stderr io.Writer) (Session, error) {
+	c, err := n.scheduler.client(n.node)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.Attach(ctx, &pb.AttachStart{
+		ContainerId:  id,
+		Stdin:        opts.Stdin,
+		TerminalSize: &pb.TerminalSize{Width: opts.Size.Width, Height: opts.Size.Height},
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	send := func(in *pb.SessionInput) error {
+		return stream.Send(&pb.AttachRequest{Request: &pb.AttachRequest_Input{Input: in}})
+	}
+	return newRemoteSession(stream, send, cancel, stdout, stderr), nil
+}
+
+// remoteSession is a session on another node, relayed over an Exec or
+// Attach call to it
+type remoteSession struct {
+	// send passes input on, serialized by mu
+	send   func(*pb.SessionInput) error
+	mu     sync.Mutex
+	cancel context.CancelFunc
+
+	// done is closed once the call ended, with code or err set
+	done chan struct{}
+	code int
+	err  error
+}
+
+// outputReceiver is the client side of an Exec or Attach call
+type outputReceiver interface {
+	Recv() (*pb.SessionOutput, error)
+}
+
+// newRemoteSession relays the output stream receives to stdout and stderr
+// until the call ends
+func newRemoteSession(stream outputReceiver, send func(*pb.SessionInput) error, cancel context.CancelFunc, stdout, stderr io.Writer) *remoteSession {
+	r := &remoteSession{send: send, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		for {
+			out, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				r.err = errors.New("session ended without an exit status")
+				return
+			}
+			if err != nil {
+				r.err = err
+				return
+			}
+			switch out := out.Output.(type) {
+			case *pb.SessionOutput_Stdout:
+				_, err = stdout.Write(out.Stdout)
+			case *pb.SessionOutput_Stderr:
+				_, err = stderr.Write(out.Stderr)
+			case *pb.SessionOutput_Exit:
+				r.code = int(out.Exit.GetCode())
+				return
+			}
+			if err != nil {
+				r.err = err
+				cancel()
+				return
+			}
+		}
+	}()
+	return r
+}
+
+func (r *remoteSession) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.send(&pb.SessionInput{Input: &pb.SessionInput_Stdin{Stdin: p}}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (r *remoteSession) CloseStdin() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.send(&pb.SessionInput{Input: &pb.SessionInput_CloseStdin{CloseStdin: true}})
+}
+
+func (r *remoteSession) Resize(size TerminalSize) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.send(&pb.SessionInput{Input: &pb.SessionInput_Resize{Resize: &pb.TerminalSize{Width: size.Width, Height: size.Height}}})
+}
+
+func (r *remoteSession) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-r.done:
+		return r.code, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Close cancels the call, which kills a command and detaches an attach on
+// the node
+func (r *remoteSession) Close() error {
+	r.cancel()
+	return nil
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// settingsFileName is the state file the runtime overrides are kept in
+const settingsFileName = "settings.json"
+
+// settingsVersion is bumped on incompatible changes to the settings file
+const settingsVersion = 1
+
+// Keys of the settings of the config UpdateRuntimeSettings overrides, by
+// their path in its JSON encoding
+const (
+	settingLogLevel          = "log_level"
+	settingLogSampleEvery    = "network.log_throttle.sample_every"
+	settingRateLimit         = "rate_limit.default.rate"
+	settingRateLimitBurst    = "rate_limit.default.burst"
+	settingRateLimitInFlight = "rate_limit.default.max_in_flight"
+	settingEventBufferSize   = "event_buffer_size"
+	settingReconcileInterval = "reconcile.interval"
+)
+
+// runtimeSettingKeys are the keys of the settings that can be overridden
+var runtimeSettingKeys = []string{
+	settingEventBufferSize, settingLogLevel, settingLogSampleEvery, settingRateLimit,
+	settingRateLimitBurst, settingRateLimitInFlight, settingReconcileInterval,
+}
+
+// Sources of the settings of the effective config
+const (
+	sourceConfig   = "config"
+	sourceOverride = "runtime-override"
+)
+
+// errInvalidSetting is returned for overrides that are unknown or whose
+// values are invalid
+var errInvalidSetting = errors.New("invalid runtime setting")
+
+// errLogLevelFixed is returned for overriding the level of a logger
+// supplied by an embedding application
+var errLogLevelFixed = errors.New("log level is not adjustable for the configured logger")
+
+// settingsFile is the content of settingsFileName
+type settingsFile struct {
+	Version   int                        `json:"version"`
+	Overrides map[string]json.RawMessage `json:"overrides"`
+}
+
+// ConfigSetting is a setting of the effective config
+type ConfigSetting struct {
+	// Key is the path of the setting in the JSON config, e.g.
+	// "network.cidr"
+	Key string
+	// Value is its JSON encoding
+	Value json.RawMessage
+	// Source is "config", or "runtime-override" for settings overridden by
+	// UpdateRuntimeSettings
+	Source string
+}
+
+// loadSettings returns the overrides saved in store, none without a store
+// or before any was made
+func loadSettings(store *storage.Store) (map[string]json.RawMessage, error) {
+	if store == nil {
+		return nil, nil
+	}
+	data, err := store.Read(settingsFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load runtime settings: %w", err)
+	}
+	var file settingsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", storage.ErrCorrupt, settingsFileName, err)
+	}
+	if file.Version != settingsVersion {
+		return nil, fmt.Errorf("runtime settings %s have unsupported version %d", settingsFileName, file.Version)
+	}
+	return file.Overrides, nil
+}
+
+// saveSettings persists overrides, unless there is no store
+func saveSettings(store *storage.Store, overrides map[string]json.RawMessage) error {
+	if store == nil {
+		return nil
+	}
+	data, err := json.Marshal(settingsFile{Version: settingsVersion, Overrides: overrides})
+	if err != nil {
+		return err
+	}
+	if err := store.Write(settingsFileName, data); err != nil {
+		return fmt.Errorf("failed to save runtime settings: %w", err)
+	}
+	return nil
+}
+
+// withOverrides returns c with overrides, by key, set on it, checking that
+// the keys can be overridden and the values are valid
+func (c ControlPlaneConfig) withOverrides(overrides map[string]json.RawMessage) (ControlPlaneConfig, error) {
+	if len(overrides) == 0 {
+		return c, nil
+	}
+	// Overriding one field of the log throttle mustn't turn off the others
+	if _, ok := overrides[settingLogSampleEvery]; ok && c.Network.LogThrottle == (network.ThrottleConfig{}) {
+		c.Network.LogThrottle = network.DefaultThrottleConfig()
+	}
+	patch := make(map[string]any)
+	for key, value := range overrides {
+		if !slices.Contains(runtimeSettingKeys, key) {
+			return c, fmt.Errorf("%w: %s can't be overridden", errInvalidSetting, key)
+		}
+		parts := strings.Split(key, ".")
+		m := patch
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := m[p].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				m[p] = next
+			}
+			m = next
+		}
+		m[parts[len(parts)-1]] = value
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return c, fmt.Errorf("%w: %v", errInvalidSetting, err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%w: %v", errInvalidSetting, err)
+	}
+	if err := c.validateSettings(); err != nil {
+		return c, fmt.Errorf("%w: %w", errInvalidSetting, err)
+	}
+	return c, nil
+}
+
+// validateSettings checks the settings that can be overridden
+func (c ControlPlaneConfig) validateSettings() error {
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if err := c.RateLimit.Default.validate(); err != nil {
+		return fmt.Errorf("rate_limit.default: %w", err)
+	}
+	if err := c.Reconcile.validate(); err != nil {
+		return fmt.Errorf("reconcile: %w", err)
+	}
+	if c.EventBufferSize < 0 || c.EventBufferSize > maxEventBufferSize {
+		return fmt.Errorf("event_buffer_size must be between 0 and %d", maxEventBufferSize)
+	}
+	return nil
+}
+
+// UpdateRuntimeSettings overrides settings of the config while serving,
+// by their key, e.g. "log_level", with their JSON values. The settings are
+// validated together and applied, or none is. Overrides are saved in the
+// state dir, if any, and win over the config, reloaded or not, until
+// ResetRuntimeSettings. It returns the keys overridden after the update.
+func (cp *ControlPlane) UpdateRuntimeSettings(settings map[string]json.RawMessage) ([]string, error) {
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("%w: no settings", errInvalidSetting)
+	}
+	if _, ok := settings[settingLogLevel]; ok && cp.logLevel == nil {
+		return nil, errLogLevelFixed
+	}
+
+	cp.reloadMu.Lock()
+	defer cp.reloadMu.Unlock()
+
+	overrides := maps.Clone(cp.overrides)
+	if overrides == nil {
+		overrides = make(map[string]json.RawMessage)
+	}
+	for key, value := range settings {
+		overrides[key] = value
+	}
+	effective, err := cp.config.withOverrides(overrides)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveSettings(cp.store, overrides); err != nil {
+		return nil, err
+	}
+	cp.overrides = overrides
+	keys := sortedKeys(settings)
+	cp.applySettings(effective, keys)
+	cp.settingsChanged(keys)
+	cp.log.Warn("Overrode runtime settings", "settings", formatSettings(settings))
+	return sortedKeys(overrides), nil
+}
+
+// ResetRuntimeSettings drops the overrides of keys, all of them without
+// any, going back to the settings of the config. It returns the keys still
+// overridden.
+func (cp *ControlPlane) ResetRuntimeSettings(keys ...string) ([]string, error) {
+	for _, key := range keys {
+		if !slices.Contains(runtimeSettingKeys, key) {
+			return nil, fmt.Errorf("%w: %s can't be overridden", errInvalidSetting, key)
+		}
+	}
+
+	cp.reloadMu.Lock()
+	defer cp.reloadMu.Unlock()
+
+	if len(keys) == 0 {
+		keys = sortedKeys(cp.overrides)
+	}
+	overrides := maps.Clone(cp.overrides)
+	var reset []string
+	for _, key := range keys {
+		if _, ok := overrides[key]; ok && !slices.Contains(reset, key) {
+			delete(overrides, key)
+			reset = append(reset, key)
+		}
+	}
+	if len(reset) == 0 {
+		return sortedKeys(cp.overrides), nil
+	}
+	sort.Strings(reset)
+	effective, err := cp.config.withOverrides(overrides)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveSettings(cp.store, overrides); err != nil {
+		return nil, err
+	}
+	cp.overrides = overrides
+	cp.applySettings(effective, reset)
+	cp.settingsChanged(reset)
+	cp.log.Warn("Reset runtime settings to the config", "settings", reset)
+	return sortedKeys(overrides), nil
+}
+
+// EffectiveConfig returns the settings in effect, those of the config with
+// the runtime overrides, ordered by key
+func (cp *ControlPlane) EffectiveConfig() ([]ConfigSetting, error) {
+	cp.reloadMu.Lock()
+	defer cp.reloadMu.Unlock()
+
+	effective, err := cp.config.withOverrides(cp.overrides)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := flattenConfig(effective)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range settings {
+		if _, ok := cp.overrides[s.Key]; ok {
+			settings[i].Source = sourceOverride
+		}
+	}
+	return settings, nil
+}
+
+// applyOverrides puts the overrides loaded at startup into effect.
+// Overriding the log level of a logger supplied by an embedding
+// application is ignored.
+func (cp *ControlPlane) applyOverrides() {
+	if len(cp.overrides) == 0 {
+		return
+	}
+	if _, ok := cp.overrides[settingLogLevel]; ok && cp.logLevel == nil {
+		cp.log.Warn("Ignoring the runtime override of the log level", "error", errLogLevelFixed)
+	}
+	// Validated when loaded
+	effective, _ := cp.config.withOverrides(cp.overrides)
+	cp.applySettings(effective, sortedKeys(cp.overrides))
+	cp.log.Info("Loaded runtime settings", "settings", formatSettings(cp.overrides))
+}
+
+// applySettings puts the settings of keys in effective into effect.
+// Callers must hold cp.reloadMu.
+func (cp *ControlPlane) applySettings(effective ControlPlaneConfig, keys []string) {
+	rateLimit := false
+	for _, key := range keys {
+		switch key {
+		case settingLogLevel:
+			if cp.logLevel != nil {
+				level, _ := logging.ParseLevel(effective.LogLevel)
+				cp.logLevel.Set(level)
+			}
+		case settingLogSampleEvery:
+			throttle := effective.Network.LogThrottle
+			if throttle == (network.ThrottleConfig{}) {
+				throttle = network.DefaultThrottleConfig()
+			}
+			cp.network.SetLogThrottle(throttle)
+		case settingRateLimit, settingRateLimitBurst, settingRateLimitInFlight:
+			rateLimit = true
+		case settingEventBufferSize:
+			cp.events.setBufferSize(effective.EventBufferSize)
+		case settingReconcileInterval:
+			cp.reconciler.setInterval(effective.Reconcile.Interval)
+		}
+	}
+	if rateLimit {
+		cp.limiter.setConfig(effective.RateLimit)
+	}
+}
+
+// settingsChanged publishes a RUNTIME_SETTINGS_CHANGED event for keys
+func (cp *ControlPlane) settingsChanged(keys []string) {
+	cp.events.publish(&pb.ContainerEvent{
+		Type:      pb.ContainerEventType_CONTAINER_EVENT_TYPE_RUNTIME_SETTINGS_CHANGED,
+		Timestamp: timestamppb.Now(),
+		Settings:  keys,
+	})
+}
+
+// flattenConfig returns the settings of the JSON encoding of config, by
+// the paths of its values that aren't objects, ordered by key. Empty
+// objects are settings of their own.
+func flattenConfig(config ControlPlaneConfig) ([]ConfigSetting, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+	var settings []ConfigSetting
+	var flatten func(key string, v any) error
+	flatten = func(key string, v any) error {
+		if m, ok := v.(map[string]any); ok && len(m) > 0 {
+			for k, v := range m {
+				if err := flatten(joinKey(key, k), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		settings = append(settings, ConfigSetting{Key: key, Value: data, Source: sourceConfig})
+		return nil
+	}
+	if err := flatten("", value); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings, nil
+}
+
+// formatSettings returns settings as "key=value" for logging, ordered
+func formatSettings(settings map[string]json.RawMessage) []string {
+	out := make([]string, 0, len(settings))
+	for _, key := range sortedKeys(settings) {
+		out = append(out, key+"="+string(settings[key]))
+	}
+	return out
+}
+
+// sortedKeys returns the keys of m, ordered
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runtimeSettingsFromProto returns the settings set in settings by their
+// keys, with their JSON values
+func runtimeSettingsFromProto(settings *pb.RuntimeSettings) (map[string]json.RawMessage, error) {
+	out := make(map[string]json.RawMessage)
+	set := func(key string, value any) error {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		out[key] = data
+		return nil
+	}
+	var errs []error
+	if settings.LogLevel != nil {
+		errs = append(errs, set(settingLogLevel, settings.GetLogLevel()))
+	}
+	if settings.LogSampleEvery != nil {
+		errs = append(errs, set(settingLogSampleEvery, settings.GetLogSampleEvery()))
+	}
+	if settings.RateLimit != nil {
+		errs = append(errs, set(settingRateLimit, settings.GetRateLimit()))
+	}
+	if settings.RateLimitBurst != nil {
+		errs = append(errs, set(settingRateLimitBurst, settings.GetRateLimitBurst()))
+	}
+	if settings.RateLimitMaxInFlight != nil {
+		errs = append(errs, set(settingRateLimitInFlight, settings.GetRateLimitMaxInFlight()))
+	}
+	if settings.EventBufferSize != nil {
+		errs = append(errs, set(settingEventBufferSize, settings.GetEventBufferSize()))
+	}
+	if d := settings.GetReconcileInterval(); d != nil {
+		if err := d.CheckValid(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", settingReconcileInterval, err))
+		} else {
+			errs = append(errs, set(settingReconcileInterval, d.AsDuration()))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidSetting, err)
+	}
+	return out, nil
+}
+
+// settingsError converts an error of the runtime settings to a status
+func settingsError(err error) error {
+	switch {
+	case errors.Is(err, errInvalidSetting):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errLogLevelFixed):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// UpdateRuntimeSettings overrides settings of the config until reset
+func (s *nodeService) UpdateRuntimeSettings(ctx context.Context, req *pb.UpdateRuntimeSettingsRequest) (*pb.UpdateRuntimeSettingsResponse, error) {
+	settings, err := runtimeSettingsFromProto(req.GetSettings())
+	if err != nil {
+		return nil, settingsError(err)
+	}
+	overrides, err := s.control.UpdateRuntimeSettings(settings)
+	if err != nil {
+		return nil, settingsError(err)
+	}
+	return &pb.UpdateRuntimeSettingsResponse{Overrides: overrides}, nil
+}
+
+// ResetRuntimeSettings drops overrides of the config
+func (s *nodeService) ResetRuntimeSettings(ctx context.Context, req *pb.ResetRuntimeSettingsRequest) (*pb.ResetRuntimeSettingsResponse, error) {
+	overrides, err := s.control.ResetRuntimeSettings(req.GetKeys()...)
+	if err != nil {
+		return nil, settingsError(err)
+	}
+	return &pb.ResetRuntimeSettingsResponse{Overrides: overrides}, nil
+}
+
+// DumpEffectiveConfig returns the settings in effect and their sources
+func (s *nodeService) DumpEffectiveConfig(ctx context.Context, req *pb.DumpEffectiveConfigRequest) (*pb.DumpEffectiveConfigResponse, error) {
+	settings, err := s.control.EffectiveConfig()
+	if err != nil {
+		return nil, settingsError(err)
+	}
+	resp := &pb.DumpEffectiveConfigResponse{Settings: make([]*pb.ConfigSetting, 0, len(settings))}
+	for _, setting := range settings {
+		resp.Settings = append(resp.Settings, &pb.ConfigSetting{
+			Key:    setting.Key,
+			Value:  string(setting.Value),
+			Source: setting.Source,
+		})
+	}
+	return resp, nil
+}
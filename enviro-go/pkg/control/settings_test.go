@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+func TestWithOverrides(t *testing.T) {
+	base := ControlPlaneConfig{
+		LogLevel:  "info",
+		RateLimit: RateLimitConfig{Default: RateLimit{Rate: 10, Burst: 20}, Methods: map[string]RateLimit{"/a.B/C": {Rate: 1}}},
+	}
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		check     func(c ControlPlaneConfig) bool
+		wantErr   bool
+	}{
+		{name: "none", check: func(c ControlPlaneConfig) bool { return c.LogLevel == "info" }},
+		{name: "log level", overrides: map[string]string{"log_level": `"debug"`},
+			check: func(c ControlPlaneConfig) bool { return c.LogLevel == "debug" }},
+		{name: "rate keeps burst and methods", overrides: map[string]string{"rate_limit.default.rate": "2.5"},
+			check: func(c ControlPlaneConfig) bool {
+				return c.RateLimit.Default == RateLimit{Rate: 2.5, Burst: 20} && c.RateLimit.Methods["/a.B/C"].Rate == 1
+			}},
+		{name: "sample every keeps the default throttle", overrides: map[string]string{"network.log_throttle.sample_every": "7"},
+			check: func(c ControlPlaneConfig) bool {
+				want := network.DefaultThrottleConfig()
+				want.SampleEvery = 7
+				return c.Network.LogThrottle == want
+			}},
+		{name: "several", overrides: map[string]string{"event_buffer_size": "1024", "reconcile.interval": "5000000000"},
+			check: func(c ControlPlaneConfig) bool {
+				return c.EventBufferSize == 1024 && c.Reconcile.Interval == 5*time.Second
+			}},
+		{name: "unknown key", overrides: map[string]string{"network.cidr": `"10.0.0.0/8"`}, wantErr: true},
+		{name: "wrong type", overrides: map[string]string{"log_level": "3"}, wantErr: true},
+		{name: "invalid level", overrides: map[string]string{"log_level": `"loud"`}, wantErr: true},
+		{name: "negative rate", overrides: map[string]string{"rate_limit.default.rate": "-1"}, wantErr: true},
+		{name: "negative interval", overrides: map[string]string{"reconcile.interval": "-1"}, wantErr: true},
+		{name: "buffer too large", overrides: map[string]string{"event_buffer_size": "1000000"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overrides := make(map[string]json.RawMessage)
+			for k, v := range tt.overrides {
+				overrides[k] = json.RawMessage(v)
+			}
+			got, err := base.withOverrides(overrides)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidSetting) {
+					t.Errorf("withOverrides() = %v, want errInvalidSetting", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(got) {
+				t.Errorf("withOverrides() = %+v", got)
+			}
+		})
+	}
+	if base.RateLimit.Default.Rate != 10 || base.LogLevel != "info" {
+		t.Errorf("withOverrides() changed the config: %+v", base)
+	}
+}
+
+func TestFlattenConfig(t *testing.T) {
+	settings, err := flattenConfig(ControlPlaneConfig{
+		LogLevel:  "warn",
+		LogLevels: map[string]string{"raft": "error"},
+		Reconcile: ReconcileConfig{Interval: 90 * time.Second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string)
+	var keys []string
+	for _, s := range settings {
+		values[s.Key] = string(s.Value)
+		keys = append(keys, s.Key)
+		if s.Source != sourceConfig {
+			t.Errorf("%s has source %q", s.Key, s.Source)
+		}
+	}
+	if !slices.IsSorted(keys) {
+		t.Errorf("keys not ordered: %q", keys)
+	}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"log_level", `"warn"`},
+		{"log_levels.raft", `"error"`},
+		{"reconcile.interval", "90000000000"},
+		{"rate_limit.default.rate", "0"},
+		{"rate_limit.methods", "null"},
+		{"network.cidr", `""`},
+	}
+	for _, tt := range tests {
+		if got, ok := values[tt.key]; !ok || got != tt.want {
+			t.Errorf("%s = %s (set %v), want %s", tt.key, got, ok, tt.want)
+		}
+	}
+	if _, ok := values["log_levels"]; ok {
+		t.Error("log_levels is a setting besides its keys")
+	}
+}
+
+func TestRuntimeSettingsFromProto(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings *pb.RuntimeSettings
+		want     map[string]string
+		wantErr  bool
+	}{
+		{name: "none", settings: &pb.RuntimeSettings{}, want: map[string]string{}},
+		{name: "all", settings: &pb.RuntimeSettings{
+			LogLevel:             proto.String("debug"),
+			LogSampleEvery:       proto.Uint64(10),
+			RateLimit:            proto.Float64(0.5),
+			RateLimitBurst:       proto.Uint32(4),
+			RateLimitMaxInFlight: proto.Uint32(0),
+			EventBufferSize:      proto.Uint32(512),
+			ReconcileInterval:    durationpb.New(time.Minute),
+		}, want: map[string]string{
+			"log_level":                         `"debug"`,
+			"network.log_throttle.sample_every": "10",
+			"rate_limit.default.rate":           "0.5",
+			"rate_limit.default.burst":          "4",
+			"rate_limit.default.max_in_flight":  "0",
+			"event_buffer_size":                 "512",
+			"reconcile.interval":                "60000000000",
+		}},
+		{name: "NaN rate", settings: &pb.RuntimeSettings{RateLimit: proto.Float64(math.NaN())}, wantErr: true},
+		{name: "invalid interval", settings: &pb.RuntimeSettings{ReconcileInterval: &durationpb.Duration{Nanos: -1, Seconds: 1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runtimeSettingsFromProto(tt.settings)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidSetting) {
+					t.Errorf("runtimeSettingsFromProto() = %v, want errInvalidSetting", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("runtimeSettingsFromProto() = %s, want %q", formatSettings(got), tt.want)
+			}
+			for k, v := range tt.want {
+				if string(got[k]) != v {
+					t.Errorf("%s = %s, want %s", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestRuntimeSettings(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store, err := storage.Open(storage.Config{Dir: t.TempDir(), Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	config := ControlPlaneConfig{LogLevel: "info", RateLimit: RateLimitConfig{Default: RateLimit{Rate: 10}}}
+	level := new(slog.LevelVar)
+	cp := &ControlPlane{
+		config:     config,
+		logLevel:   level,
+		limiter:    newRateLimiter(config.RateLimit),
+		events:     newEventBus(),
+		reconciler: newReconciler(config.Reconcile, nil, nil, nil, nil, logger),
+		store:      store,
+		log:        logger,
+	}
+	sub, _, err := cp.events.subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changed returns the keys of the event published since last called
+	changed := func() []string {
+		t.Helper()
+		select {
+		case ev := <-sub.ch:
+			if ev.Type != pb.ContainerEventType_CONTAINER_EVENT_TYPE_RUNTIME_SETTINGS_CHANGED {
+				t.Errorf("event %s", ev.Type)
+			}
+			return ev.Settings
+		default:
+			return nil
+		}
+	}
+	saved := func() []string {
+		t.Helper()
+		overrides, err := loadSettings(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sortedKeys(overrides)
+	}
+
+	tests := []struct {
+		name          string
+		update        map[string]string
+		reset         []string
+		wantErr       error
+		wantOverrides []string
+		wantChanged   []string
+		check         func() bool
+	}{
+		{name: "update", update: map[string]string{"log_level": `"debug"`, "rate_limit.default.burst": "3", "event_buffer_size": "8"},
+			wantOverrides: []string{"event_buffer_size", "log_level", "rate_limit.default.burst"},
+			wantChanged:   []string{"event_buffer_size", "log_level", "rate_limit.default.burst"},
+			check: func() bool {
+				return level.Level() == slog.LevelDebug && cp.limiter.config.Default == RateLimit{Rate: 10, Burst: 3} &&
+					cp.events.bufferSize.Load() == 8
+			}},
+		{name: "invalid leaves all", update: map[string]string{"log_level": `"error"`, "rate_limit.default.rate": "-2"},
+			wantErr: errInvalidSetting, wantOverrides: []string{"event_buffer_size", "log_level", "rate_limit.default.burst"},
+			check: func() bool { return level.Level() == slog.LevelDebug && cp.limiter.config.Default.Rate == 10 }},
+		{name: "interval", update: map[string]string{"reconcile.interval": "1000000000"},
+			wantOverrides: []string{"event_buffer_size", "log_level", "rate_limit.default.burst", "reconcile.interval"},
+			wantChanged:   []string{"reconcile.interval"},
+			check:         func() bool { return cp.reconciler.currentInterval() == time.Second }},
+		{name: "unknown reset", reset: []string{"network.cidr"}, wantErr: errInvalidSetting,
+			wantOverrides: []string{"event_buffer_size", "log_level", "rate_limit.default.burst", "reconcile.interval"}},
+		{name: "reset some", reset: []string{"log_level", "reconcile.interval"},
+			wantOverrides: []string{"event_buffer_size", "rate_limit.default.burst"},
+			wantChanged:   []string{"log_level", "reconcile.interval"},
+			check: func() bool {
+				return level.Level() == slog.LevelInfo && cp.reconciler.currentInterval() == DefaultReconcileInterval
+			}},
+		{name: "reset all", reset: []string{},
+			wantChanged: []string{"event_buffer_size", "rate_limit.default.burst"},
+			check: func() bool {
+				return cp.limiter.config.Default == RateLimit{Rate: 10} && cp.events.bufferSize.Load() == 0
+			}},
+		{name: "reset nothing", reset: []string{"log_level"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var overrides []string
+			var err error
+			if tt.update != nil {
+				settings := make(map[string]json.RawMessage)
+				for k, v := range tt.update {
+					settings[k] = json.RawMessage(v)
+				}
+				overrides, err = cp.UpdateRuntimeSettings(settings)
+			} else {
+				overrides, err = cp.ResetRuntimeSettings(tt.reset...)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				overrides = sortedKeys(cp.overrides)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(overrides, tt.wantOverrides) {
+				t.Errorf("overrides = %q, want %q", overrides, tt.wantOverrides)
+			}
+			if got := saved(); !slices.Equal(got, tt.wantOverrides) {
+				t.Errorf("saved overrides = %q, want %q", got, tt.wantOverrides)
+			}
+			if got := changed(); !slices.Equal(got, tt.wantChanged) {
+				t.Errorf("changed = %q, want %q", got, tt.wantChanged)
+			}
+			if tt.check != nil && !tt.check() {
+				t.Error("settings not in effect")
+			}
+		})
+	}
+
+	if _, err := cp.UpdateRuntimeSettings(map[string]json.RawMessage{"log_level": json.RawMessage(`"warn"`)}); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := cp.EffectiveConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range settings {
+		want := sourceConfig
+		if s.Key == "log_level" {
+			want = sourceOverride
+			if string(s.Value) != `"warn"` {
+				t.Errorf("log_level = %s", s.Value)
+			}
+		}
+		if s.Source != want {
+			t.Errorf("%s has source %q, want %q", s.Key, s.Source, want)
+		}
+	}
+
+	cp.logLevel = nil
+	if _, err := cp.UpdateRuntimeSettings(map[string]json.RawMessage{"log_level": json.RawMessage(`"debug"`)}); !errors.Is(err, errLogLevelFixed) {
+		t.Errorf("overriding a fixed log level = %v, want errLogLevelFixed", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// A container is reported with a SPOOFING event once the router dropped
+// spoofThreshold of its frames within spoofWindow, and at most once a
+// window while it keeps on
+const (
+	spoofWindow    = 10 * time.Second
+	spoofThreshold = 10
+)
+
+// neighborSpoofInterval is how often the ARP and neighbor discovery
+// containers had dropped for claiming others' addresses are counted
+const neighborSpoofInterval = time.Second
+
+// spoofCount is what a container spoofed in the current window
+type spoofCount struct {
+	start    time.Time
+	packets  uint64
+	source   string
+	reported bool
+}
+
+// spoofTracker counts spoofed drops by sending container
+type spoofTracker struct {
+	counts map[string]*spoofCount
+}
+
+func newSpoofTracker() *spoofTracker {
+	return &spoofTracker{counts: make(map[string]*spoofCount)}
+}
+
+// add counts e, returning the SPOOFING event to publish when its sender
+// just crossed the threshold
+func (t *spoofTracker) add(e network.DropEvent) *pb.ContainerEvent {
+	id := e.SourceContainerID
+	if id == "" {
+		return nil
+	}
+	c := t.counts[id]
+	if c == nil || e.Time.Sub(c.start) >= spoofWindow {
+		c = &spoofCount{start: e.Time}
+		t.counts[id] = c
+	}
+	c.packets++
+	if e.Src.IsValid() {
+		c.source = e.Src.String()
+	}
+	if c.reported || c.packets < spoofThreshold {
+		return nil
+	}
+	c.reported = true
+	return &pb.ContainerEvent{
+		Type:           pb.ContainerEventType_CONTAINER_EVENT_TYPE_SPOOFING,
+		ContainerId:    id,
+		Timestamp:      timestamppb.New(e.Time),
+		SpoofedPackets: c.packets,
+		SpoofedSource:  c.source,
+	}
+}
+
+// expire forgets the containers whose window ended before now
+func (t *spoofTracker) expire(now time.Time) {
+	for id, c := range t.counts {
+		if now.Sub(c.start) >= spoofWindow {
+			delete(t.counts, id)
+		}
+	}
+}
+
+// watchSpoofing publishes SPOOFING events for the containers that keep
+// sending from addresses or MACs not theirs, until the control plane
+// stops. Without the XDP router, nothing is checked.
+func (cp *ControlPlane) watchSpoofing() {
+	w, err := cp.network.WatchDrops(network.DropFilter{Reason: network.DropSpoofed})
+	if err != nil {
+		cp.log.Debug("Not reporting spoofing containers", "error", err)
+		return
+	}
+	defer w.Close()
+	t := newSpoofTracker()
+	expire := time.NewTicker(spoofWindow)
+	defer expire.Stop()
+	for {
+		select {
+		case <-cp.stopped:
+			return
+		case now := <-expire.C:
+			t.expire(now)
+		case e, ok := <-w.C:
+			if !ok {
+				return
+			}
+			if ev := t.add(e); ev != nil {
+				cp.events.publish(ev)
+			}
+		}
+	}
+}
+
+// neighborSpoofEvents returns the NEIGHBOR_SPOOFING events for the
+// containers whose count in counts changed since last, by container ID
+func neighborSpoofEvents(last, counts map[string]uint64, now time.Time) []*pb.ContainerEvent {
+	var out []*pb.ContainerEvent
+	for id, n := range counts {
+		prev := last[id]
+		if n == prev {
+			continue
+		}
+		// Counts start over when a container is recreated
+		if prev > n {
+			prev = 0
+		}
+		out = append(out, &pb.ContainerEvent{
+			Type:           pb.ContainerEventType_CONTAINER_EVENT_TYPE_NEIGHBOR_SPOOFING,
+			ContainerId:    id,
+			Timestamp:      timestamppb.New(now),
+			SpoofedPackets: n - prev,
+		})
+	}
+	slices.SortFunc(out, func(a, b *pb.ContainerEvent) int { return strings.Compare(a.ContainerId, b.ContainerId) })
+	return out
+}
+
+// watchNeighborSpoofing publishes NEIGHBOR_SPOOFING events for the
+// containers that had ARP or neighbor discovery dropped for claiming an
+// address or MAC not theirs, until the control plane stops. Drops before
+// the first count aren't reported.
+func (cp *ControlPlane) watchNeighborSpoofing() {
+	last, err := cp.network.NeighborSpoofing()
+	if err != nil {
+		cp.log.Debug("Not reporting neighbor spoofing", "error", err)
+		return
+	}
+	t := time.NewTicker(neighborSpoofInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-cp.stopped:
+			return
+		case now := <-t.C:
+			counts, err := cp.network.NeighborSpoofing()
+			if err != nil {
+				cp.log.Debug("Failed to count neighbor spoofing", "error", err)
+				continue
+			}
+			for _, ev := range neighborSpoofEvents(last, counts, now) {
+				cp.events.publish(ev)
+			}
+			last = counts
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+func TestSpoofTracker(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	drop := func(id string, after time.Duration) network.DropEvent {
+		return network.DropEvent{
+			Time:              start.Add(after),
+			Reason:            network.DropSpoofed,
+			Src:               netip.MustParseAddr("10.9.9.9"),
+			SourceContainerID: id,
+		}
+	}
+	tests := []struct {
+		name  string
+		drops []network.DropEvent
+		// want are the indexes of the drops that publish an event
+		want []int
+	}{
+		{name: "below threshold", drops: repeatDrops(drop("a", 0), spoofThreshold-1)},
+		{name: "threshold", drops: repeatDrops(drop("a", 0), spoofThreshold+5), want: []int{spoofThreshold - 1}},
+		{name: "unknown sender", drops: repeatDrops(drop("", 0), spoofThreshold)},
+		{
+			name:  "once a window",
+			drops: append(repeatDrops(drop("a", 0), spoofThreshold), repeatDrops(drop("a", spoofWindow), spoofThreshold)...),
+			want:  []int{spoofThreshold - 1, 2*spoofThreshold - 1},
+		},
+		{
+			name:  "counted by sender",
+			drops: append(repeatDrops(drop("a", 0), spoofThreshold-1), drop("b", time.Second)),
+		},
+		{
+			name:  "window starts over",
+			drops: append(repeatDrops(drop("a", 0), spoofThreshold-1), drop("a", spoofWindow)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newSpoofTracker()
+			var got []int
+			for i, e := range tt.drops {
+				ev := tr.add(e)
+				if ev == nil {
+					continue
+				}
+				got = append(got, i)
+				if ev.ContainerId != e.SourceContainerID || ev.SpoofedPackets != spoofThreshold || ev.SpoofedSource != "10.9.9.9" {
+					t.Errorf("event = %v, want %d packets of %s from 10.9.9.9", ev, spoofThreshold, e.SourceContainerID)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("events at drops %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("events at drops %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func repeatDrops(e network.DropEvent, n int) []network.DropEvent {
+	out := make([]network.DropEvent, n)
+	for i := range out {
+		out[i] = e
+	}
+	return out
+}
+
+func TestNeighborSpoofEvents(t *testing.T) {
+	tests := []struct {
+		name         string
+		last, counts map[string]uint64
+		// want are the packets of the events by container
+		want map[string]uint64
+	}{
+		{name: "none"},
+		{name: "unchanged", last: map[string]uint64{"a": 3}, counts: map[string]uint64{"a": 3}},
+		{name: "first drops", counts: map[string]uint64{"a": 2}, want: map[string]uint64{"a": 2}},
+		{
+			name:   "grew",
+			last:   map[string]uint64{"a": 2, "b": 5},
+			counts: map[string]uint64{"a": 7, "b": 5},
+			want:   map[string]uint64{"a": 5},
+		},
+		{name: "recreated", last: map[string]uint64{"a": 9}, counts: map[string]uint64{"a": 1}, want: map[string]uint64{"a": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(map[string]uint64)
+			for _, ev := range neighborSpoofEvents(tt.last, tt.counts, time.Now()) {
+				if ev.Type != pb.ContainerEventType_CONTAINER_EVENT_TYPE_NEIGHBOR_SPOOFING {
+					t.Errorf("event type = %v", ev.Type)
+				}
+				got[ev.ContainerId] = ev.SpoofedPackets
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("events = %v, want %v", got, tt.want)
+			}
+			for id, n := range tt.want {
+				if got[id] != n {
+					t.Errorf("events = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/cgroup"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// Defaults of StatsConfig
+const (
+	DefaultStatsInterval     = 10 * time.Second
+	DefaultStatsReportMaxAge = 30 * time.Second
+)
+
+// minStatsInterval bounds how often StreamContainerStats samples
+const minStatsInterval = time.Second
+
+// errInvalidStats is returned for container stats the runtime reports
+// that can't be used
+var errInvalidStats = errors.New("invalid container stats")
+
+// StatsConfig configures where StatsService takes the resource usage of
+// containers from
+type StatsConfig struct {
+	// CgroupRoot holds the cgroup v2 group of each container, named by
+	// its ID, cgroup.DefaultRoot when empty
+	CgroupRoot string `json:"cgroup_root"`
+	// Interval is how often StreamContainerStats samples unless the
+	// request says otherwise, DefaultStatsInterval when zero
+	Interval time.Duration `json:"interval"`
+	// ReportMaxAge is how long the usage the runtime reports through the
+	// FFI is used rather than reading the cgroup, DefaultStatsReportMaxAge
+	// when zero
+	ReportMaxAge time.Duration `json:"report_max_age"`
+}
+
+func (c StatsConfig) validate() error {
+	if c.Interval < 0 || c.ReportMaxAge < 0 {
+		return errors.New("durations must not be negative")
+	}
+	if c.Interval != 0 && c.Interval < minStatsInterval {
+		return fmt.Errorf("interval must be at least %s", minStatsInterval)
+	}
+	return nil
+}
+
+// statsService implements pb.StatsServiceServer
+type statsService struct {
+	pb.UnimplementedStatsServiceServer
+
+	config  StatsConfig
+	network *network.NetworkManager
+	events  *eventBus
+	log     *slog.Logger
+
+	mu sync.Mutex
+	// reported holds the latest usage the runtime reported by container ID
+	reported map[string]reportedStats
+}
+
+type reportedStats struct {
+	stats *pb.ContainerStats
+	at    time.Time
+}
+
+func newStatsService(config StatsConfig, nm *network.NetworkManager, events *eventBus, logger *slog.Logger) *statsService {
+	if config.CgroupRoot == "" {
+		config.CgroupRoot = cgroup.DefaultRoot
+	}
+	if config.Interval == 0 {
+		config.Interval = DefaultStatsInterval
+	}
+	if config.ReportMaxAge == 0 {
+		config.ReportMaxAge = DefaultStatsReportMaxAge
+	}
+	return &statsService{
+		config:   config,
+		network:  nm,
+		events:   events,
+		log:      logger,
+		reported: make(map[string]reportedStats),
+	}
+}
+
+// GetContainerStats samples the requested containers
+func (s *statsService) GetContainerStats(ctx context.Context, req *pb.GetContainerStatsRequest) (*pb.GetContainerStatsResponse, error) {
+	containers, err := s.sample(req.GetContainerIds(), true)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetContainerStatsResponse{Containers: containers}, nil
+}
+
+// StreamContainerStats samples the requested containers every interval
+func (s *statsService) StreamContainerStats(req *pb.StreamContainerStatsRequest, stream pb.StatsService_StreamContainerStatsServer) error {
+	interval := s.config.Interval
+	if req.Interval != nil {
+		if err := req.Interval.CheckValid(); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if interval = req.Interval.AsDuration(); interval < minStatsInterval {
+			return status.Errorf(codes.InvalidArgument, "interval must be at least %s", minStatsInterval)
+		}
+	}
+	// Requested containers must exist when the stream starts, and are
+	// left out once deleted
+	containers, err := s.sample(req.GetContainerIds(), true)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	ctx := stream.Context()
+	prev := make(map[string]*pb.ContainerStats)
+	for {
+		for _, c := range containers {
+			setCPUPercent(c, prev[c.ContainerId])
+		}
+		prev = make(map[string]*pb.ContainerStats, len(containers))
+		for _, c := range containers {
+			prev[c.ContainerId] = c
+		}
+		if err := stream.Send(&pb.StreamContainerStatsResponse{Containers: containers}); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-s.events.done:
+			return status.Error(codes.Unavailable, "control plane shutting down")
+		case <-ticker.C:
+		}
+		if containers, err = s.sample(req.GetContainerIds(), false); err != nil {
+			return err
+		}
+	}
+}
+
+// setCPUPercent sets the CPU usage of c since prev, a sample of the same
+// container
+func setCPUPercent(c, prev *pb.ContainerStats) {
+	if prev == nil || c.Cpu == nil || prev.Cpu == nil || c.Time == nil || prev.Time == nil {
+		return
+	}
+	elapsed := c.Time.AsTime().Sub(prev.Time.AsTime()).Microseconds()
+	// A recreated cgroup starts over
+	if elapsed <= 0 || c.Cpu.UsageUsec < prev.Cpu.UsageUsec {
+		return
+	}
+	c.Cpu.UsagePercent = float64(c.Cpu.UsageUsec-prev.Cpu.UsageUsec) / float64(elapsed) * 100
+}
+
+// sample returns the stats of the containers of ids, ordered by ID, or of
+// every container when empty. Containers that don't exist fail the
+// sample when strict and are left out otherwise.
+func (s *statsService) sample(ids []string, strict bool) ([]*pb.ContainerStats, error) {
+	var counters map[string]map[string]uint64
+	if len(ids) == 0 {
+		var err error
+		if counters, err = s.network.GetAllContainerStats(); err != nil {
+			return nil, networkError(err)
+		}
+		s.forget(counters)
+	} else {
+		counters = make(map[string]map[string]uint64, len(ids))
+		for _, id := range ids {
+			stats, err := s.network.GetContainerStats(id)
+			if errors.Is(err, network.ErrContainerNotFound) && !strict {
+				continue
+			}
+			if err != nil {
+				return nil, networkError(err)
+			}
+			counters[id] = stats
+		}
+	}
+
+	now := time.Now()
+	containers := make([]*pb.ContainerStats, 0, len(counters))
+	for id, stats := range counters {
+		c := &pb.ContainerStats{ContainerId: id, Stats: stats}
+		s.setUsage(c, now)
+		containers = append(containers, c)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ContainerId < containers[j].ContainerId })
+	if err := s.setPacketSizes(ids, containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// setPacketSizes sets the packet size histograms of containers, sampled
+// for ids. They stay unset without the XDP router, and for containers it
+// doesn't route.
+func (s *statsService) setPacketSizes(ids []string, containers []*pb.ContainerStats) error {
+	var id string
+	if len(ids) == 1 {
+		id = ids[0]
+	}
+	snap, err := s.network.GetPacketSizes(id)
+	switch {
+	case errors.Is(err, network.ErrXDPInactive), errors.Is(err, network.ErrInvalidDatapath),
+		errors.Is(err, network.ErrDirectAttachment), errors.Is(err, network.ErrContainerNotFound):
+		return nil
+	case err != nil:
+		return networkError(err)
+	}
+	for _, c := range containers {
+		if sizes, ok := snap.Containers[c.ContainerId]; ok {
+			c.IngressSizes, c.EgressSizes = packetSizeStats(sizes.Ingress), packetSizeStats(sizes.Egress)
+		}
+	}
+	return nil
+}
+
+func packetSizeStats(h network.SizeHistogram) *pb.PacketSizeStats {
+	return &pb.PacketSizeStats{Packets: h.Packets, Bytes: h.Bytes, Buckets: h.Buckets[:]}
+}
+
+// setUsage sets the resource usage of c to what the runtime reported
+// lately, or else reads it from the container's cgroup
+func (s *statsService) setUsage(c *pb.ContainerStats, now time.Time) {
+	s.mu.Lock()
+	r, ok := s.reported[c.ContainerId]
+	s.mu.Unlock()
+	if ok && now.Sub(r.at) <= s.config.ReportMaxAge {
+		// Streams set the CPU percent of their samples
+		reported := proto.Clone(r.stats).(*pb.ContainerStats)
+		c.Time, c.Source = reported.Time, "runtime"
+		c.Cpu, c.Memory, c.Io, c.Pids = reported.Cpu, reported.Memory, reported.Io, reported.Pids
+		return
+	}
+
+	usage, err := cgroup.Read(filepath.Join(s.config.CgroupRoot, c.ContainerId))
+	if err != nil {
+		if !errors.Is(err, cgroup.ErrNotFound) {
+			s.log.Debug("Failed to read container cgroup", "container_id", c.ContainerId, "error", err)
+		}
+		return
+	}
+	c.Time, c.Source = timestamppb.New(now), "cgroup"
+	c.Cpu = &pb.CpuStats{
+		UsageUsec:        usage.CPU.UsageUsec,
+		UserUsec:         usage.CPU.UserUsec,
+		SystemUsec:       usage.CPU.SystemUsec,
+		Periods:          usage.CPU.Periods,
+		ThrottledPeriods: usage.CPU.ThrottledPeriods,
+		ThrottledUsec:    usage.CPU.ThrottledUsec,
+	}
+	c.Memory = &pb.MemoryStats{
+		UsageBytes:      usage.Memory.Usage,
+		LimitBytes:      usage.Memory.Limit,
+		WorkingSetBytes: usage.Memory.WorkingSet,
+		AnonBytes:       usage.Memory.Anon,
+		FileBytes:       usage.Memory.File,
+		KernelBytes:     usage.Memory.Kernel,
+		OomKills:        usage.Memory.OOMKills,
+	}
+	c.Io = &pb.IoStats{
+		ReadBytes:  usage.IO.ReadBytes,
+		WriteBytes: usage.IO.WriteBytes,
+		ReadOps:    usage.IO.ReadOps,
+		WriteOps:   usage.IO.WriteOps,
+	}
+	for _, d := range usage.IO.Devices {
+		c.Io.Devices = append(c.Io.Devices, &pb.IoDeviceStats{
+			Device:     fmt.Sprintf("%d:%d", d.Major, d.Minor),
+			ReadBytes:  d.ReadBytes,
+			WriteBytes: d.WriteBytes,
+			ReadOps:    d.ReadOps,
+			WriteOps:   d.WriteOps,
+		})
+	}
+	c.Pids = &pb.PidsStats{Current: usage.Pids.Current, Limit: usage.Pids.Limit}
+}
+
+// report records the resource usage the runtime reported for a container,
+// which is used rather than its cgroup for ReportMaxAge. Its network
+// counters are ignored.
+func (s *statsService) report(stats *pb.ContainerStats) error {
+	id := stats.GetContainerId()
+	if id == "" {
+		return fmt.Errorf("%w: container_id is required", errInvalidStats)
+	}
+	if _, err := s.network.GetContainerStats(id); err != nil {
+		if errors.Is(err, network.ErrContainerNotFound) {
+			return fmt.Errorf("%w: %v", errInvalidStats, err)
+		}
+		return err
+	}
+	now := time.Now()
+	stats = &pb.ContainerStats{
+		ContainerId: id,
+		Time:        stats.Time,
+		Cpu:         stats.Cpu,
+		Memory:      stats.Memory,
+		Io:          stats.Io,
+		Pids:        stats.Pids,
+	}
+	if stats.Time == nil {
+		stats.Time = timestamppb.New(now)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reported[id] = reportedStats{stats: stats, at: now}
+	return nil
+}
+
+// forget drops the usage reported for containers not in counters, which
+// holds every container
+func (s *statsService) forget(counters map[string]map[string]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.reported {
+		if _, ok := counters[id]; !ok {
+			delete(s.reported, id)
+		}
+	}
+}
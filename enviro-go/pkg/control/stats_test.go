@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+func TestStatsConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  StatsConfig
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "set", config: StatsConfig{Interval: time.Second, ReportMaxAge: time.Minute}},
+		{name: "short interval", config: StatsConfig{Interval: time.Millisecond}, wantErr: true},
+		{name: "negative max age", config: StatsConfig{ReportMaxAge: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.config.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSetCPUPercent(t *testing.T) {
+	start := time.Now()
+	sample := func(after time.Duration, usec uint64) *pb.ContainerStats {
+		return &pb.ContainerStats{Time: timestamppb.New(start.Add(after)), Cpu: &pb.CpuStats{UsageUsec: usec}}
+	}
+	tests := []struct {
+		name    string
+		c, prev *pb.ContainerStats
+		want    float64
+	}{
+		{name: "half a CPU", c: sample(2*time.Second, 3000000), prev: sample(0, 2000000), want: 50},
+		{name: "two CPUs", c: sample(time.Second, 2000000), prev: sample(0, 0), want: 200},
+		{name: "first sample", c: sample(time.Second, 1000000)},
+		{name: "no usage", c: &pb.ContainerStats{Time: timestamppb.New(start)}, prev: sample(0, 0)},
+		{name: "recreated cgroup", c: sample(time.Second, 10), prev: sample(0, 1000000)},
+		{name: "same time", c: sample(0, 1000000), prev: sample(0, 0)},
+	}
+	for _, tt := range tests {
+		setCPUPercent(tt.c, tt.prev)
+		if got := tt.c.GetCpu().GetUsagePercent(); got != tt.want {
+			t.Errorf("%s: CPU percent %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestStatsUsage reads the usage of containers from their cgroups, unless
+// the runtime reported it lately
+func TestStatsUsage(t *testing.T) {
+	root := t.TempDir()
+	group := filepath.Join(root, "web")
+	if err := os.Mkdir(group, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"cpu.stat":       "usage_usec 1500\n",
+		"memory.current": "4096\n",
+		"io.stat":        "8:0 rbytes=512 wbytes=0 rios=1 wios=0\n",
+		"pids.current":   "3\n",
+	} {
+		if err := os.WriteFile(filepath.Join(group, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newStatsService(StatsConfig{CgroupRoot: root, ReportMaxAge: time.Minute}, &network.NetworkManager{}, nil,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Now()
+
+	c := &pb.ContainerStats{ContainerId: "web"}
+	s.setUsage(c, now)
+	if c.Source != "cgroup" || c.Cpu.GetUsageUsec() != 1500 || c.Memory.GetUsageBytes() != 4096 || c.Pids.GetCurrent() != 3 {
+		t.Errorf("usage from the cgroup %v", c)
+	}
+	if d := c.Io.GetDevices(); len(d) != 1 || d[0].Device != "8:0" || d[0].ReadBytes != 512 {
+		t.Errorf("IO devices %v, want 8:0", d)
+	}
+
+	// A reported sample is used until it is older than ReportMaxAge
+	reported := &pb.ContainerStats{ContainerId: "web", Time: timestamppb.New(now), Cpu: &pb.CpuStats{UsageUsec: 9000}}
+	s.reported["web"] = reportedStats{stats: reported, at: now}
+	c = &pb.ContainerStats{ContainerId: "web"}
+	s.setUsage(c, now.Add(time.Second))
+	if c.Source != "runtime" || c.Cpu.GetUsageUsec() != 9000 || c.Memory != nil {
+		t.Errorf("usage with a reported sample %v, want the reported one", c)
+	}
+	c.Cpu.UsagePercent = 50
+	if reported.Cpu.UsagePercent != 0 {
+		t.Error("setting the CPU percent of a sample changed the reported one")
+	}
+	c = &pb.ContainerStats{ContainerId: "web"}
+	s.setUsage(c, now.Add(2*time.Minute))
+	if c.Source != "cgroup" {
+		t.Errorf("usage source %q with an expired report, want cgroup", c.Source)
+	}
+
+	// Containers without a cgroup have no usage
+	c = &pb.ContainerStats{ContainerId: "api"}
+	s.setUsage(c, now)
+	if c.Source != "" || c.Cpu != nil {
+		t.Errorf("usage without a cgroup %v", c)
+	}
+
+	s.forget(map[string]map[string]uint64{"api": nil})
+	if _, ok := s.reported["web"]; ok {
+		t.Error("usage reported for a deleted container kept")
+	}
+	for _, invalid := range []*pb.ContainerStats{{}, {ContainerId: "missing"}} {
+		if err := s.report(invalid); !errors.Is(err, errInvalidStats) {
+			t.Errorf("report(%v) = %v, want %v", invalid, err, errInvalidStats)
+		}
+	}
+}
+
+func TestStatsErrors(t *testing.T) {
+	s := newStatsService(StatsConfig{CgroupRoot: t.TempDir()}, &network.NetworkManager{}, nil,
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	_, err := s.GetContainerStats(context.Background(), &pb.GetContainerStatsRequest{ContainerIds: []string{"missing"}})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetContainerStats() of a missing container = %v, want %v", err, codes.NotFound)
+	}
+	for _, interval := range []*durationpb.Duration{durationpb.New(time.Millisecond), {Nanos: -1, Seconds: 1}} {
+		err := s.StreamContainerStats(&pb.StreamContainerStatsRequest{Interval: interval}, nil)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("StreamContainerStats() every %v = %v, want %v", interval, err, codes.InvalidArgument)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// StorageConfig tunes how the state files under StateDir are written.
+// Each write replaces its file atomically, and a file found torn or
+// corrupt on start is read from its previous generation, whatever the
+// policy.
+type StorageConfig struct {
+	// Fsync is when writes reach the disk: "always", the default, before
+	// each returns; "batched" every FsyncInterval; or "never", leaving it
+	// to the kernel. The latter two make creates faster, at the cost of
+	// the last writes before a power loss.
+	Fsync storage.FsyncPolicy `json:"fsync"`
+	// FsyncInterval is how often "batched" flushes,
+	// storage.DefaultBatchInterval when zero
+	FsyncInterval time.Duration `json:"fsync_interval"`
+}
+
+func (c StorageConfig) validate() error {
+	if c.FsyncInterval < 0 {
+		return errors.New("fsync_interval must not be negative")
+	}
+	if c.FsyncInterval != 0 && c.Fsync != storage.FsyncBatched {
+		return errors.New("fsync_interval needs fsync batched")
+	}
+	return nil
+}
+
+// open opens the state store of dir
+func (c StorageConfig) open(dir string, logger *slog.Logger) (*storage.Store, error) {
+	return storage.Open(storage.Config{
+		Dir:           dir,
+		Fsync:         c.Fsync,
+		BatchInterval: c.FsyncInterval,
+		Logger:        logger,
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCertReloadInterval is how often the TLS files are checked for
+// changes unless CertReloadInterval says otherwise
+const DefaultCertReloadInterval = 30 * time.Second
+
+// certReloader serves the most recently loaded certificate and client CA
+// pool so certificates can be rotated without restarting the listener.
+type certReloader struct {
+	// interval is how often watch checks the files, never when not
+	// positive
+	interval time.Duration
+
+	mu sync.RWMutex
+	// The files and client certificate checks can change on Reload
+	certFile, keyFile, caFile string
+	requireClientCert         bool
+	// spiffeIDs are the SPIFFE IDs and trust domains client certificates
+	// must match, any when empty
+	spiffeIDs []*url.URL
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	// files is the modification time and size of each file when last
+	// loaded
+	files map[string]fileStamp
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newCertReloader(config ControlPlaneConfig) (*certReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("TLS requires both cert_file and key_file")
+	}
+	if config.RequireClientCert && config.ClientCAFile == "" {
+		return nil, errors.New("require_client_cert needs client_ca_file")
+	}
+	if len(config.AllowedSPIFFEIDs) > 0 && !config.RequireClientCert {
+		return nil, errors.New("allowed_spiffe_ids needs require_client_cert")
+	}
+
+	r := &certReloader{
+		certFile:          config.CertFile,
+		keyFile:           config.KeyFile,
+		caFile:            config.ClientCAFile,
+		requireClientCert: config.RequireClientCert,
+		interval:          config.CertReloadInterval,
+		stop:              make(chan struct{}),
+	}
+	if r.interval == 0 {
+		r.interval = DefaultCertReloadInterval
+	}
+	for _, id := range config.AllowedSPIFFEIDs {
+		u, err := parseSPIFFEID(id)
+		if err != nil {
+			return nil, err
+		}
+		r.spiffeIDs = append(r.spiffeIDs, u)
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the certificate, key and CA files again. On error the
+// previously loaded material stays in use.
+func (r *certReloader) reload() error {
+	r.mu.RLock()
+	certFile, keyFile, caFile := r.certFile, r.keyFile, r.caFile
+	r.mu.RUnlock()
+
+	// Stamp the files first, so a change while loading them is reloaded
+	// again by watch
+	files := stampFiles(certFile, keyFile, caFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.pool = pool
+	r.files = files
+	r.mu.Unlock()
+	return nil
+}
+
+// update switches to the files and client certificate checks of config,
+// loading them. On error the previous files and material stay in use.
+func (r *certReloader) update(config ControlPlaneConfig) error {
+	next, err := newCertReloader(config)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certFile, r.keyFile, r.caFile = next.certFile, next.keyFile, next.caFile
+	r.requireClientCert = next.requireClientCert
+	r.spiffeIDs = next.spiffeIDs
+	r.cert, r.pool, r.files = next.cert, next.pool, next.files
+	return nil
+}
+
+// stamps returns the current stamp of each file, leaving out those that
+// can't be read
+func (r *certReloader) stamps() map[string]fileStamp {
+	r.mu.RLock()
+	certFile, keyFile, caFile := r.certFile, r.keyFile, r.caFile
+	r.mu.RUnlock()
+	return stampFiles(certFile, keyFile, caFile)
+}
+
+// stampFiles returns the current stamp of each named file, leaving out
+// those that can't be read
+func stampFiles(names ...string) map[string]fileStamp {
+	files := make(map[string]fileStamp, len(names))
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		// Stat follows symlinks, so Kubernetes-style secret mounts that
+		// swap a symlink are seen to change
+		if fi, err := os.Stat(name); err == nil {
+			files[name] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return files
+}
+
+// changed reports whether any file changed since it was last loaded
+func (r *certReloader) changed() bool {
+	files := r.stamps()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(files) != len(r.files) {
+		return true
+	}
+	for name, stamp := range files {
+		if old, ok := r.files[name]; !ok || !old.modTime.Equal(stamp.modTime) || old.size != stamp.size {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files whenever they change until close is called.
+// Errors are logged, as the previous material stays in use.
+func (r *certReloader) watch(logger *slog.Logger) {
+	if r.interval <= 0 {
+		return
+	}
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			logger.Error("Failed to reload changed TLS certificates", "error", err)
+			continue
+		}
+		logger.Info("Reloaded changed TLS certificates")
+	}
+}
+
+// close stops watch
+func (r *certReloader) close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// tlsConfig returns a server config that picks up reloaded material on
+// every new handshake.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientCAs:    r.pool,
+			}
+			switch {
+			case r.requireClientCert:
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			case r.pool != nil:
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			if ids := r.spiffeIDs; len(ids) > 0 {
+				cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+					return verifySPIFFEID(cs, ids)
+				}
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// verifySPIFFEID rejects clients whose verified certificate doesn't carry
+// one of the allowed SPIFFE IDs
+func verifySPIFFEID(cs tls.ConnectionState, allowedIDs []*url.URL) error {
+	if len(cs.VerifiedChains) == 0 {
+		return errors.New("client certificate required")
+	}
+	leaf := cs.VerifiedChains[0][0]
+	var id *url.URL
+	for _, u := range leaf.URIs {
+		if u.Scheme == "spiffe" {
+			if id != nil {
+				return errors.New("client certificate has more than one SPIFFE ID")
+			}
+			id = u
+		}
+	}
+	if id == nil {
+		return errors.New("client certificate has no SPIFFE ID")
+	}
+	for _, allowed := range allowedIDs {
+		if id.Host == allowed.Host && (allowed.Path == "" || id.Path == allowed.Path) {
+			return nil
+		}
+	}
+	return fmt.Errorf("SPIFFE ID %s is not allowed", id)
+}
+
+// parseSPIFFEID parses a SPIFFE ID, e.g. spiffe://example.org/agent, or a
+// trust domain, spiffe://example.org, which allows any ID in it
+func parseSPIFFEID(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPIFFE ID %q: %w", s, err)
+	}
+	if u.Scheme != "spiffe" || u.Host == "" || u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid SPIFFE ID %q", s)
+	}
+	if u.Path == "/" {
+		u.Path = ""
+	}
+	return u, nil
+}
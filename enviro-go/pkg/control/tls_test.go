@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), serial: 1}
+}
+
+// issue writes a certificate for localhost with the given URIs and its
+// key to dir, returning the certificate and key files
+func (ca *testCA) issue(t *testing.T, dir, name string, uris ...string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects to a server using config with a client presenting
+// the key pair of certFile and keyFile, none if empty. It returns the
+// server's certificate and handshake error.
+func handshake(t *testing.T, ca *testCA, config *tls.Config, certFile, keyFile string) (*x509.Certificate, error) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- tls.Server(conn, config).Handshake()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Certificates = []tls.Certificate{cert}
+	}
+	conn, err := tls.Dial("tcp", lis.Addr().String(), client)
+	if err != nil {
+		return nil, <-done
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0], <-done
+}
+
+func TestNewCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "server")
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	tests := []struct {
+		name   string
+		config ControlPlaneConfig
+		// wantErr is part of the error, none if empty
+		wantErr string
+	}{
+		{name: "TLS", config: ControlPlaneConfig{CertFile: certFile, KeyFile: keyFile}},
+		{name: "mTLS", config: ControlPlaneConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile,
+			RequireClientCert: true, AllowedSPIFFEIDs: []string{"spiffe://example.org"}}},
+		{name: "no key", config: ControlPlaneConfig{CertFile: certFile}, wantErr: "requires both cert_file and key_file"},
+		{name: "no client CA", config: ControlPlaneConfig{CertFile: certFile, KeyFile: keyFile, RequireClientCert: true},
+			wantErr: "require_client_cert needs client_ca_file"},
+		{name: "SPIFFE IDs without client certificates", config: ControlPlaneConfig{CertFile: certFile, KeyFile: keyFile,
+			AllowedSPIFFEIDs: []string{"spiffe://example.org"}}, wantErr: "allowed_spiffe_ids needs require_client_cert"},
+		{name: "invalid SPIFFE ID", config: ControlPlaneConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile,
+			RequireClientCert: true, AllowedSPIFFEIDs: []string{"https://example.org"}}, wantErr: `invalid SPIFFE ID "https://example.org"`},
+		{name: "missing key", config: ControlPlaneConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key")},
+			wantErr: "failed to load TLS key pair"},
+		{name: "CA without certificates", config: ControlPlaneConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile},
+			wantErr: "no certificates found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCertReloader(tt.config)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("newCertReloader() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newCertReloader() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCertReloaderHandshake checks client certificates and their SPIFFE
+// IDs in handshakes
+func TestCertReloaderHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "server")
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	agentCert, agentKey := ca.issue(t, dir, "agent", "spiffe://example.org/agent")
+	otherCert, otherKey := ca.issue(t, dir, "other", "spiffe://other.org/agent")
+	twoCert, twoKey := ca.issue(t, dir, "two", "spiffe://example.org/a", "spiffe://example.org/b")
+	plainCert, plainKey := ca.issue(t, dir, "plain")
+
+	tests := []struct {
+		name              string
+		config            ControlPlaneConfig
+		certFile, keyFile string
+		// wantErr is part of the server's handshake error, none if empty
+		wantErr string
+	}{
+		{name: "TLS", config: ControlPlaneConfig{}},
+		{name: "optional client certificate", config: ControlPlaneConfig{ClientCAFile: caFile}},
+		{name: "optional client certificate given", config: ControlPlaneConfig{ClientCAFile: caFile},
+			certFile: plainCert, keyFile: plainKey},
+		{name: "required client certificate", config: ControlPlaneConfig{ClientCAFile: caFile, RequireClientCert: true},
+			wantErr: "client didn't provide a certificate"},
+		{name: "allowed SPIFFE ID", config: ControlPlaneConfig{ClientCAFile: caFile, RequireClientCert: true,
+			AllowedSPIFFEIDs: []string{"spiffe://example.org/agent"}}, certFile: agentCert, keyFile: agentKey},
+		{name: "trust domain", config: ControlPlaneConfig{ClientCAFile: caFile, RequireClientCert: true,
+			AllowedSPIFFEIDs: []string{"spiffe://example.org/"}}, certFile: agentCert, keyFile: agentKey},
+		{name: "other trust domain", config: ControlPlaneConfig{ClientCAFile: caFile, RequireClientCert: true,
+			AllowedSPIFFEIDs: []string{"spiffe://example.org"}}, certFile: otherCert, keyFile: otherKey,
+			wantErr: "SPIFFE ID spiffe://other.org/agent is not allowed"},
+		{name: "other path", config: ControlPlaneConfig{ClientCAFile: caFile, RequireClientCert: true,
+			AllowedSPIFFEIDs: []string{"spiffe://example.org/admin"}}, certFile: agentCert, keyFile: agentKey,
+			wantErr: "is not allowed"},
+		{name: "two SPIFFE IDs", config: ControlPlaneConfig{ClientCAFile: caFile, RequireClientCert: true,
+			AllowedSPIFFEIDs: []string{"spiffe://example.org"}}, certFile: twoCert, keyFile: twoKey,
+			wantErr: "more than one SPIFFE ID"},
+		{name: "no SPIFFE ID", config: ControlPlaneConfig{ClientCAFile: caFile, RequireClientCert: true,
+			AllowedSPIFFEIDs: []string{"spiffe://example.org"}}, certFile: plainCert, keyFile: plainKey,
+			wantErr: "no SPIFFE ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.CertFile, tt.config.KeyFile = certFile, keyFile
+			r, err := newCertReloader(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = handshake(t, ca, r.tlsConfig(), tt.certFile, tt.keyFile)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("handshake = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("handshake = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCertReloaderReload serves a rotated certificate once it is seen to
+// change, and keeps the previous one while the files are broken
+func TestCertReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "server")
+	r, err := newCertReloader(ControlPlaneConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := r.tlsConfig()
+	first, err := handshake(t, ca, config, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.changed() {
+		t.Error("changed() right after loading")
+	}
+
+	// Rotating to a new key pair
+	newCert, newKey := ca.issue(t, dir, "rotated")
+	for name, to := range map[string]string{newCert: certFile, newKey: keyFile} {
+		if err := os.Rename(name, to); err != nil {
+			t.Fatal(err)
+		}
+		// The new files may have the same size and, on a coarse clock, time
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(to, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !r.changed() {
+		t.Fatal("changed() after rotating the files")
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := handshake(t, ca, config, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Errorf("served certificate %s after rotating, want a new one", rotated.SerialNumber)
+	}
+
+	writeFile(t, keyFile, []byte("broken"))
+	if err := r.reload(); err == nil {
+		t.Error("reload() of a broken key succeeded")
+	}
+	if kept, err := handshake(t, ca, config, "", ""); err != nil || kept.SerialNumber.Cmp(rotated.SerialNumber) != 0 {
+		t.Errorf("served %v, %v after a failed reload, want certificate %s", kept.SerialNumber, err, rotated.SerialNumber)
+	}
+}
+
+func TestParseSPIFFEID(t *testing.T) {
+	tests := []struct {
+		s        string
+		wantPath string
+		wantErr  bool
+	}{
+		{s: "spiffe://example.org/agent", wantPath: "/agent"},
+		{s: "spiffe://example.org"},
+		{s: "spiffe://example.org/"},
+		{s: "https://example.org", wantErr: true},
+		{s: "spiffe:///agent", wantErr: true},
+		{s: "spiffe://user@example.org", wantErr: true},
+		{s: "spiffe://example.org:443", wantErr: true},
+		{s: "spiffe://example.org/agent?x=1", wantErr: true},
+		{s: "spiffe://example.org/agent#x", wantErr: true},
+	}
+	for _, tt := range tests {
+		u, err := parseSPIFFEID(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSPIFFEID(%q) = %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err == nil && u.Path != tt.wantPath {
+			t.Errorf("parseSPIFFEID(%q) path %q, want %q", tt.s, u.Path, tt.wantPath)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// clusterView is where the containers of the cluster run, for splitting
+// the backends of services into those of a node and remote ones
+type clusterView struct {
+	containers map[string]*pb.Container
+	nodes      map[string]*pb.Node
+	// self and topology describe the node of the containers not placed
+	// on others, the leader's
+	self     string
+	topology network.NodeTopology
+}
+
+// clusterView returns the containers and registered nodes, as seen from
+// this node
+func (s *containerService) clusterView() clusterView {
+	v := clusterView{containers: make(map[string]*pb.Container), nodes: make(map[string]*pb.Node)}
+	s.mu.Lock()
+	for id, c := range s.containers {
+		v.containers[id] = cloneContainer(c)
+	}
+	s.mu.Unlock()
+	if s.scheduler != nil {
+		for _, n := range s.scheduler.nodes.list() {
+			v.nodes[n.Name] = n
+		}
+	}
+	return v
+}
+
+// split divides the backend IDs of a service into the containers on node,
+// "" for the leader's, and the remote backends on the others, both sorted
+// by ID. Unknown containers are kept local when keepUnknown is set, so
+// programming the service reports them, and dropped otherwise, as are
+// the containers of node whose network isn't set up yet.
+func (v clusterView) split(ids []string, node string, keepUnknown bool) ([]string, []network.RemoteBackend) {
+	ids = slices.Clone(ids)
+	sort.Strings(ids)
+	var local []string
+	var remote []network.RemoteBackend
+	for _, id := range ids {
+		c, ok := v.containers[id]
+		switch {
+		case !ok:
+			if keepUnknown {
+				local = append(local, id)
+			}
+		case c.Node == node:
+			if node == "" || c.Ip != "" || c.Ipv6 != "" {
+				local = append(local, id)
+			}
+		default:
+			remote = append(remote, v.remoteBackend(c))
+		}
+	}
+	return local, remote
+}
+
+// remoteBackend describes c as a backend on another node. It is unhealthy
+// unless both the container and its node are ready.
+func (v clusterView) remoteBackend(c *pb.Container) network.RemoteBackend {
+	b := network.RemoteBackend{ContainerID: c.Id, Node: c.Node, IPv4: c.Ip, IPv6: c.Ipv6}
+	healthy := c.State == pb.ContainerState_CONTAINER_STATE_READY || c.State == pb.ContainerState_CONTAINER_STATE_RUNNING
+	if c.Node == "" {
+		b.Node, b.Zone, b.Rack = v.self, v.topology.Zone, v.topology.Rack
+	} else if n, ok := v.nodes[c.Node]; ok {
+		b.Zone, b.Rack = n.Zone, n.Rack
+		healthy = healthy && n.State == pb.NodeState_NODE_STATE_READY
+	} else {
+		healthy = false
+	}
+	b.Unhealthy = !healthy
+	return b
+}
+
+// programRequest returns the request programming svc on node
+func (v clusterView) programRequest(svc network.Service, node string) *pb.ProgramServiceRequest {
+	local, remote := v.split(serviceBackendIDs(svc), node, false)
+	p := serviceToProto(svc)
+	p.Backends = local
+	req := &pb.ProgramServiceRequest{Name: svc.Name, Service: p}
+	for _, b := range remote {
+		req.RemoteBackends = append(req.RemoteBackends, remoteBackendToProto(b))
+	}
+	return req
+}
+
+// serviceBackendIDs returns the IDs of the local and remote backends of
+// svc, sorted
+func serviceBackendIDs(svc network.Service) []string {
+	ids := slices.Clone(svc.Backends)
+	for _, b := range svc.RemoteBackends {
+		ids = append(ids, b.ContainerID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// refreshServices moves the backends of this node's services placed on
+// other nodes to their remote backends, as their containers and nodes
+// change, and drops the deleted ones. It returns the services with the
+// view they were refreshed to.
+func (s *containerService) refreshServices() (clusterView, []network.Service) {
+	s.servicesMu.Lock()
+	defer s.servicesMu.Unlock()
+
+	view := s.clusterView()
+	services := s.network.ListServices()
+	for i, svc := range services {
+		local, remote := view.split(serviceBackendIDs(svc), "", false)
+		if slices.Equal(local, svc.Backends) && slices.Equal(remote, svc.RemoteBackends) {
+			continue
+		}
+		svc.Backends, svc.RemoteBackends = local, remote
+		updated, err := s.network.PutService(svc)
+		if err != nil {
+			s.log.Warn("Failed to refresh service backends", "service", svc.Name, "error", err)
+			continue
+		}
+		services[i] = updated
+		s.replicateService(svc.Name)
+	}
+	return view, services
+}
+
+// ProgramService creates, replaces or deletes a service as the leader
+// distributes it
+func (s *containerService) ProgramService(ctx context.Context, req *pb.ProgramServiceRequest) (*pb.ProgramServiceResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	s.servicesMu.Lock()
+	defer s.servicesMu.Unlock()
+
+	if req.Service == nil {
+		if err := s.network.DeleteService(req.Name); err != nil && !errors.Is(err, network.ErrServiceNotFound) {
+			return nil, networkError(err)
+		}
+		return &pb.ProgramServiceResponse{}, nil
+	}
+	if req.Service.Name != req.Name {
+		return nil, status.Errorf(codes.InvalidArgument, "service is named %q, not %q", req.Service.Name, req.Name)
+	}
+	if err := validateServicePorts(req.Service); err != nil {
+		return nil, err
+	}
+	svc := serviceFromProto(req.Service)
+	for _, b := range req.RemoteBackends {
+		svc.RemoteBackends = append(svc.RemoteBackends, remoteBackendFromProto(b))
+	}
+	if _, err := s.network.PutService(svc); err != nil {
+		return nil, networkError(err)
+	}
+	return &pb.ProgramServiceResponse{}, nil
+}
+
+// GetServiceConnections returns the connections of this node's services
+// by the locality of their backend
+func (s *containerService) GetServiceConnections(ctx context.Context, req *pb.GetServiceConnectionsRequest) (*pb.GetServiceConnectionsResponse, error) {
+	conns, err := s.network.ServiceConnections()
+	if err != nil {
+		return nil, networkError(err)
+	}
+	resp := &pb.GetServiceConnectionsResponse{}
+	for _, c := range conns {
+		sc := &pb.ServiceConnections{
+			Service:   c.Service,
+			Node:      c.Connections[network.LocalityNode],
+			Rack:      c.Connections[network.LocalityRack],
+			Zone:      c.Connections[network.LocalityZone],
+			CrossZone: c.Connections[network.LocalityCrossZone],
+		}
+		for _, p := range c.Ports {
+			sc.Ports = append(sc.Ports, &pb.ServicePortConnections{
+				Name:      p.Port.Name,
+				Port:      uint32(p.Port.Port),
+				Protocol:  p.Port.Protocol,
+				Node:      p.Connections[network.LocalityNode],
+				Rack:      p.Connections[network.LocalityRack],
+				Zone:      p.Connections[network.LocalityZone],
+				CrossZone: p.Connections[network.LocalityCrossZone],
+			})
+		}
+		resp.Services = append(resp.Services, sc)
+	}
+	return resp, nil
+}
+
+func remoteBackendToProto(b network.RemoteBackend) *pb.RemoteBackend {
+	return &pb.RemoteBackend{
+		ContainerId: b.ContainerID,
+		Node:        b.Node,
+		Zone:        b.Zone,
+		Rack:        b.Rack,
+		Ipv4:        b.IPv4,
+		Ipv6:        b.IPv6,
+		Unhealthy:   b.Unhealthy,
+	}
+}
+
+func remoteBackendFromProto(b *pb.RemoteBackend) network.RemoteBackend {
+	return network.RemoteBackend{
+		ContainerID: b.GetContainerId(),
+		Node:        b.GetNode(),
+		Zone:        b.GetZone(),
+		Rack:        b.GetRack(),
+		IPv4:        b.GetIpv4(),
+		IPv6:        b.GetIpv6(),
+		Unhealthy:   b.GetUnhealthy(),
+	}
+}
+
+// serviceDistributor programs the leader's services on the registered
+// nodes, each with the backends placed on it local and the others
+// remote, so every node balances across the backends its topology
+// prefers. A node is only sent the services that changed since it was
+// last programmed, and everything once it registers again or comes back
+// from NOT_READY.
+type serviceDistributor struct {
+	containers *containerService
+	nodes      *nodeRegistry
+	scheduler  *scheduler
+	// self and topology describe the leader's node to the others
+	self     string
+	topology network.NodeTopology
+	interval time.Duration
+	// active reports whether this control plane leads
+	active func() bool
+	log    *slog.Logger
+
+	trigger chan struct{}
+	// loopMu guards cancel and done, which start and stop hand over
+	loopMu sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	// programmed is what each node was last sent, only used by run
+	programmed map[string]*programmedNode
+}
+
+// programmedNode is the services a registration of a node was sent
+type programmedNode struct {
+	registeredAt time.Time
+	services     map[string]*pb.ProgramServiceRequest
+}
+
+func newServiceDistributor(containers *containerService, nodes *nodeRegistry, sched *scheduler, self string, topology network.NodeTopology, logger *slog.Logger) *serviceDistributor {
+	return &serviceDistributor{
+		containers: containers,
+		nodes:      nodes,
+		scheduler:  sched,
+		self:       self,
+		topology:   topology,
+		interval:   nodes.interval,
+		active:     func() bool { return nodes.leading() },
+		log:        logger,
+		trigger:    make(chan struct{}, 1),
+		programmed: make(map[string]*programmedNode),
+	}
+}
+
+// start runs the distribution loop until stop is called
+func (d *serviceDistributor) start() {
+	d.loopMu.Lock()
+	defer d.loopMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.done = make(chan struct{})
+	go d.run(ctx)
+}
+
+// stop ends the loop, cancelling a distribution in progress
+func (d *serviceDistributor) stop() {
+	d.loopMu.Lock()
+	cancel, done := d.cancel, d.done
+	d.loopMu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// kick requests a distribution, e.g. after a service or placement
+// changed. It does nothing on a nil distributor.
+func (d *serviceDistributor) kick() {
+	if d == nil {
+		return
+	}
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (d *serviceDistributor) run(ctx context.Context) {
+	defer close(d.done)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		if d.active() {
+			d.distribute(ctx)
+		} else {
+			clear(d.programmed)
+		}
+		select {
+		case <-ticker.C:
+		case <-d.trigger:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// distribute programs the services on the ready nodes. Without
+// registered nodes there is nothing to distribute, and the services of
+// nodes programmed by a leader are left alone.
+func (d *serviceDistributor) distribute(ctx context.Context) {
+	nodes := d.nodes.list()
+	if len(nodes) == 0 {
+		clear(d.programmed)
+		return
+	}
+	view, services := d.containers.refreshServices()
+	view.self, view.topology = d.self, d.topology
+
+	registered := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		registered[n.Name] = true
+		if n.State != pb.NodeState_NODE_STATE_READY {
+			delete(d.programmed, n.Name)
+			continue
+		}
+		if err := d.program(ctx, n, view, services); err != nil {
+			// Everything is sent again on the next pass
+			delete(d.programmed, n.Name)
+			d.log.Warn("Failed to program services on node", "node", n.Name, "error", err)
+		}
+	}
+	for name := range d.programmed {
+		if !registered[name] {
+			delete(d.programmed, name)
+		}
+	}
+}
+
+// program sends node n the services that changed since it was last
+// programmed, and deletes those gone
+func (d *serviceDistributor) program(ctx context.Context, n *pb.Node, view clusterView, services []network.Service) error {
+	registeredAt := n.RegisteredAt.AsTime()
+	p := d.programmed[n.Name]
+	if p == nil || !p.registeredAt.Equal(registeredAt) {
+		p = &programmedNode{registeredAt: registeredAt, services: make(map[string]*pb.ProgramServiceRequest)}
+		d.programmed[n.Name] = p
+	}
+	var reqs []*pb.ProgramServiceRequest
+	want := make(map[string]bool, len(services))
+	for _, svc := range services {
+		want[svc.Name] = true
+		if req := view.programRequest(svc, n.Name); !proto.Equal(req, p.services[svc.Name]) {
+			reqs = append(reqs, req)
+		}
+	}
+	for name := range p.services {
+		if !want[name] {
+			reqs = append(reqs, &pb.ProgramServiceRequest{Name: name})
+		}
+	}
+	if len(reqs) == 0 {
+		return nil
+	}
+	c, err := d.scheduler.client(n.Name)
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		if err := c.ProgramService(ctx, req); err != nil {
+			return fmt.Errorf("service %s: %w", req.Name, err)
+		}
+		if req.Service == nil {
+			delete(p.services, req.Name)
+		} else {
+			p.services[req.Name] = req
+		}
+	}
+	d.log.Debug("Programmed services on node", "node", n.Name, "changed", len(reqs))
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+func TestClusterViewSplit(t *testing.T) {
+	ready := pb.ContainerState_CONTAINER_STATE_READY
+	view := clusterView{
+		containers: map[string]*pb.Container{
+			"leader":   {Id: "leader", Ip: "10.88.0.2", State: pb.ContainerState_CONTAINER_STATE_RUNNING},
+			"n1":       {Id: "n1", Node: "n1", Ip: "10.88.1.2", State: ready},
+			"n1-new":   {Id: "n1-new", Node: "n1", State: pb.ContainerState_CONTAINER_STATE_CREATING},
+			"n2":       {Id: "n2", Node: "n2", Ip: "10.88.2.2", Ipv6: "fd00::2", State: ready},
+			"lost":     {Id: "lost", Node: "lost", Ip: "10.88.3.2", State: ready},
+			"gone":     {Id: "gone", Node: "gone", Ip: "10.88.4.2", State: ready},
+			"stopping": {Id: "stopping", Node: "n2", Ip: "10.88.2.3", State: pb.ContainerState_CONTAINER_STATE_DRAINING},
+		},
+		nodes: map[string]*pb.Node{
+			"n1":   {Name: "n1", Zone: "a", Rack: "r1", State: pb.NodeState_NODE_STATE_READY},
+			"n2":   {Name: "n2", Zone: "b", State: pb.NodeState_NODE_STATE_READY},
+			"lost": {Name: "lost", Zone: "a", State: pb.NodeState_NODE_STATE_NOT_READY},
+		},
+		self:     "leader-host",
+		topology: network.NodeTopology{Zone: "a", Rack: "r2"},
+	}
+	n1 := network.RemoteBackend{ContainerID: "n1", Node: "n1", Zone: "a", Rack: "r1", IPv4: "10.88.1.2"}
+	n2 := network.RemoteBackend{ContainerID: "n2", Node: "n2", Zone: "b", IPv4: "10.88.2.2", IPv6: "fd00::2"}
+	tests := []struct {
+		name        string
+		ids         []string
+		node        string
+		keepUnknown bool
+		wantLocal   []string
+		wantRemote  []network.RemoteBackend
+	}{
+		{name: "leader", ids: []string{"n2", "leader", "n1"}, wantLocal: []string{"leader"},
+			wantRemote: []network.RemoteBackend{n1, n2}},
+		{name: "leader keeps unknown", ids: []string{"unknown", "leader"}, keepUnknown: true,
+			wantLocal: []string{"leader", "unknown"}},
+		{name: "leader drops unknown", ids: []string{"unknown", "leader"}, wantLocal: []string{"leader"}},
+		{name: "node", ids: []string{"leader", "n1", "n2"}, node: "n1", wantLocal: []string{"n1"},
+			wantRemote: []network.RemoteBackend{
+				{ContainerID: "leader", Node: "leader-host", Zone: "a", Rack: "r2", IPv4: "10.88.0.2"},
+				n2,
+			}},
+		{name: "node without network yet", ids: []string{"n1", "n1-new"}, node: "n1", wantLocal: []string{"n1"}},
+		{name: "unhealthy", ids: []string{"lost", "gone", "stopping"},
+			wantRemote: []network.RemoteBackend{
+				{ContainerID: "gone", Node: "gone", IPv4: "10.88.4.2", Unhealthy: true},
+				{ContainerID: "lost", Node: "lost", Zone: "a", IPv4: "10.88.3.2", Unhealthy: true},
+				{ContainerID: "stopping", Node: "n2", Zone: "b", IPv4: "10.88.2.3", Unhealthy: true},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := view.split(tt.ids, tt.node, tt.keepUnknown)
+			if !slices.Equal(local, tt.wantLocal) {
+				t.Errorf("local %v, want %v", local, tt.wantLocal)
+			}
+			if !slices.Equal(remote, tt.wantRemote) {
+				t.Errorf("remote %+v, want %+v", remote, tt.wantRemote)
+			}
+		})
+	}
+}
+
+func TestProgramRequest(t *testing.T) {
+	view := clusterView{
+		containers: map[string]*pb.Container{
+			"a": {Id: "a", Ip: "10.88.0.2", State: pb.ContainerState_CONTAINER_STATE_READY},
+			"b": {Id: "b", Node: "n1", Ip: "10.88.1.2", State: pb.ContainerState_CONTAINER_STATE_READY},
+		},
+		nodes: map[string]*pb.Node{"n1": {Name: "n1", Zone: "z1", State: pb.NodeState_NODE_STATE_READY}},
+		self:  "leader",
+	}
+	svc := network.Service{
+		Name: "web", Namespace: "default", VIP: "10.96.0.10", Port: 80, Protocol: "tcp", TargetPort: 8080,
+		Backends:         []string{"a"},
+		RemoteBackends:   []network.RemoteBackend{{ContainerID: "b", Node: "n1", Zone: "z1", IPv4: "10.88.1.2"}},
+		Topology:         network.TopologyPreferZone,
+		MinLocalBackends: 2,
+		ExposeNodePort:   true,
+		NodePort:         30080,
+	}
+	if got := serviceToProto(svc).Backends; !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("service backends %v, want local and remote", got)
+	}
+
+	req := view.programRequest(svc, "n1")
+	if req.Name != "web" || !slices.Equal(req.Service.Backends, []string{"b"}) {
+		t.Errorf("request for n1 %v, want web with local backend b", req)
+	}
+	if req.Service.Topology != "prefer-zone" || req.Service.MinLocalBackends != 2 || req.Service.TargetPort != 8080 ||
+		!req.Service.ExposeNodePort || req.Service.NodePort != 30080 {
+		t.Errorf("request for n1 lost service fields: %v", req.Service)
+	}
+	if len(req.RemoteBackends) != 1 || req.RemoteBackends[0].ContainerId != "a" || req.RemoteBackends[0].Node != "leader" {
+		t.Errorf("remote backends for n1 %v, want a on leader", req.RemoteBackends)
+	}
+	got := serviceFromProto(req.Service)
+	for _, b := range req.RemoteBackends {
+		got.RemoteBackends = append(got.RemoteBackends, remoteBackendFromProto(b))
+	}
+	if got.Topology != network.TopologyPreferZone || got.MinLocalBackends != 2 || got.RemoteBackends[0].IPv4 != "10.88.0.2" ||
+		got.NodePort != 30080 {
+		t.Errorf("programmed service %+v", got)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/tracing"
+)
+
+// DefaultServiceName is the service traces of the control plane are
+// recorded under unless configured otherwise
+const DefaultServiceName = "enviro-control-plane"
+
+// TracingConfig exports OpenTelemetry traces of the control plane. Trace
+// context arrives in W3C traceparent gRPC metadata or, through the FFI,
+// as traceparent strings.
+type TracingConfig struct {
+	// Endpoint is the OTLP/gRPC collector to export spans to, e.g.
+	// "localhost:4317". Without it spans go to TracerProvider.
+	Endpoint string `json:"endpoint"`
+	// Insecure exports to Endpoint without TLS
+	Insecure bool `json:"insecure"`
+	// ServiceName is DefaultServiceName when empty
+	ServiceName string `json:"service_name"`
+	// SampleRatio is the share of the traces starting in the control
+	// plane that are recorded, all of them when zero. Traces continued
+	// from a caller follow the caller's decision.
+	SampleRatio float64 `json:"sample_ratio"`
+	// TracerProvider records the spans when no Endpoint is set, defaults
+	// to otel.GetTracerProvider()
+	TracerProvider trace.TracerProvider `json:"-"`
+}
+
+func (c TracingConfig) validate() error {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return errors.New("sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// tracer records the spans of a control plane
+type tracer struct {
+	provider trace.TracerProvider
+	// sdk exports to the configured endpoint, nil without one
+	sdk *sdktrace.TracerProvider
+}
+
+func newTracer(config TracingConfig) (*tracer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		provider := config.TracerProvider
+		if provider == nil {
+			provider = otel.GetTracerProvider()
+		}
+		return &tracer{provider: provider}, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	// The exporter connects lazily, so this doesn't block on the collector
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+	name := config.ServiceName
+	if name == "" {
+		name = DefaultServiceName
+	}
+	ratio := config.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	sdk := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(name))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	return &tracer{provider: sdk, sdk: sdk}, nil
+}
+
+// serverOptions traces every RPC, continuing the trace of the caller
+func (t *tracer) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{grpc.StatsHandler(otelgrpc.NewServerHandler(
+		otelgrpc.WithTracerProvider(t.provider),
+		otelgrpc.WithPropagators(tracing.Propagator),
+	))}
+}
+
+// dialOptions traces the RPCs to other control planes, passing the trace
+// on to them
+func (t *tracer) dialOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithStatsHandler(otelgrpc.NewClientHandler(
+		otelgrpc.WithTracerProvider(t.provider),
+		otelgrpc.WithPropagators(tracing.Propagator),
+	))}
+}
+
+// start starts a span of the control plane
+func (t *tracer) start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return t.provider.Tracer("github.com/1090mb/enviro/enviro-go/pkg/control").Start(ctx, name, opts...)
+}
+
+// shutdown exports the remaining spans
+func (t *tracer) shutdown(ctx context.Context) error {
+	if t.sdk == nil {
+		return nil
+	}
+	return t.sdk.Shutdown(ctx)
+}
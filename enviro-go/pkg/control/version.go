@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/1090mb/enviro/enviro-go/pkg/api/v1"
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// Version is the version of the control plane build, set with
+// -ldflags "-X main.Version=v1.4.0". Builds without it report their VCS
+// revision.
+var Version = ""
+
+// APIVersion is the version of the API the control plane serves
+const APIVersion = "v1"
+
+// apiPackage is the proto package of APIVersion, and legacyPackage the
+// unversioned package that preceded it. Its messages are the same on the
+// wire, so the methods of both are served by the same handlers.
+const (
+	apiPackage    = "enviro.api.v1"
+	legacyPackage = "enviro.api"
+)
+
+// apiFeatures are the features of the API every control plane of this
+// build supports. GetAPIInfo adds those depending on the config.
+var apiFeatures = []string{
+	"admission",
+	"apply_spec",
+	"backup",
+	"capture",
+	"exec",
+	"garbage_collection",
+	"logs",
+	"namespaces",
+	"placement",
+	"policies",
+	"qos",
+	"reservations",
+	"services",
+	"service_topology",
+	"stats",
+}
+
+// serverVersion returns Version, or the VCS revision of the build
+func serverVersion() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	revision, modified := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return info.Main.Version
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// canonicalMethod returns the APIVersion name of a method called by its
+// legacy name, e.g. /enviro.api.v1.NodeService/ListNodes for
+// /enviro.api.NodeService/ListNodes, so interceptors treat both alike
+func canonicalMethod(method string) string {
+	if rest, ok := strings.CutPrefix(method, "/"+legacyPackage+"."); ok {
+		if service, _, ok := strings.Cut(rest, "/"); ok && !strings.Contains(service, ".") {
+			return "/" + apiPackage + "." + rest
+		}
+	}
+	return method
+}
+
+// registerLegacyServices serves the services under their legacy names too,
+// for clients built before the API was versioned
+func registerLegacyServices(server *grpc.Server, containers pb.ContainerServiceServer, nodes pb.NodeServiceServer) {
+	for _, s := range []struct {
+		desc grpc.ServiceDesc
+		impl any
+	}{
+		{pb.ContainerService_ServiceDesc, containers},
+		{pb.NodeService_ServiceDesc, nodes},
+	} {
+		desc := s.desc
+		desc.ServiceName = legacyPackage + strings.TrimPrefix(desc.ServiceName, apiPackage)
+		server.RegisterService(&desc, s.impl)
+	}
+}
+
+// infoService implements pb.InfoServiceServer
+type infoService struct {
+	pb.UnimplementedInfoServiceServer
+
+	config  ControlPlaneConfig
+	network *network.NetworkManager
+}
+
+// GetAPIInfo returns the version and features of the control plane
+func (s *infoService) GetAPIInfo(ctx context.Context, req *pb.GetAPIInfoRequest) (*pb.GetAPIInfoResponse, error) {
+	features := append([]string(nil), apiFeatures...)
+	if s.config.Runtime != nil {
+		features = append(features, "runtime")
+		if _, ok := s.config.Runtime.(SessionRuntime); ok {
+			features = append(features, "sessions")
+		}
+	}
+	if s.config.Raft != nil {
+		features = append(features, "raft")
+	}
+	if s.config.GatewayAddress != "" {
+		features = append(features, "gateway")
+	}
+	if s.config.Audit.Path != "" {
+		features = append(features, "audit")
+	}
+	if s.config.Chaos.Enable {
+		features = append(features, "chaos")
+	}
+	if s.config.Images.dir(s.config.StateDir) != "" {
+		features = append(features, "images")
+	}
+	if s.config.Network.Analytics.Enable {
+		features = append(features, "flow_analytics")
+	}
+	if s.config.Network.Leases.TTL > 0 {
+		features = append(features, "leases")
+	}
+	if len(s.config.Network.Devices.PhysicalFunctions) > 0 {
+		features = append(features, "sriov")
+	}
+	caps := s.network.Capabilities()
+	if caps.Rootless {
+		features = append(features, "rootless")
+	}
+	if caps.XDP {
+		features = append(features, "xdp")
+		if caps.XDPMode != network.DatapathTC {
+			features = append(features, "af_xdp")
+		}
+	}
+	// A control plane created with DeferNetwork has none until
+	// InitNetwork
+	if s.network.Initialized() {
+		features = append(features, "network")
+	}
+	sort.Strings(features)
+
+	recv, send := s.config.Server.MaxRecvMsgSize, s.config.Server.MaxSendMsgSize
+	if recv == 0 {
+		recv = DefaultMaxMsgSize
+	}
+	if send == 0 {
+		send = DefaultMaxMsgSize
+	}
+	return &pb.GetAPIInfoResponse{
+		ServerVersion:      serverVersion(),
+		ApiVersion:         APIVersion,
+		CompatiblePackages: []string{legacyPackage},
+		Features:           features,
+		MaxRecvMessageSize: int32(recv),
+		MaxSendMessageSize: int32(send),
+	}, nil
+}
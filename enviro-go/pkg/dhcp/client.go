@@ -0,0 +1,292 @@
+// Package dhcp leases IPv4 addresses from a DHCP server on behalf of
+// clients that can't ask for themselves. Messages are relayed as a BOOTP
+// relay agent would (RFC 1542), from an address of this host the server can
+// reach, so the clients' subnet needn't be the host's.
+package dhcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Port is the port DHCP servers and relay agents listen on
+const Port = 67
+
+// DefaultTimeout bounds each exchange with the server, see Config
+const DefaultTimeout = 10 * time.Second
+
+// ErrNAK is returned when the server declines a request
+var ErrNAK = errors.New("dhcp: server declined the request")
+
+// retransmits are the delays before a message is sent again, the last
+// repeating until the exchange times out (RFC 2131 4.1)
+var retransmits = []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+
+// Config configures a Client
+type Config struct {
+	// Server is the DHCP server messages are sent to, on Port when it has
+	// none
+	Server netip.AddrPort
+	// RelayAddr is the address of this host messages are relayed from and
+	// the server replies to, on Port
+	RelayAddr netip.Addr
+	// Timeout bounds each exchange with the server, DefaultTimeout when
+	// zero
+	Timeout time.Duration
+}
+
+// Request is who an address is leased to
+type Request struct {
+	// ClientID identifies the client to the server, which keeps its lease
+	// by it
+	ClientID []byte
+	// HardwareAddr is the client's MAC address
+	HardwareAddr net.HardwareAddr
+	// Subnet is an address of the subnet to lease from, such as its
+	// gateway (RFC 3011), when it isn't that of RelayAddr
+	Subnet netip.Addr
+	// Addr is the address the client asks for, when set
+	Addr     netip.Addr
+	Hostname string
+}
+
+// Lease is an address leased by the server
+type Lease struct {
+	Addr netip.Addr
+	// Server is the server that granted the lease
+	Server   netip.Addr
+	Obtained time.Time
+	// Duration is how long the lease lasts from Obtained, zero when it
+	// doesn't expire
+	Duration time.Duration
+	// Renew is when after Obtained the lease is due to be renewed
+	Renew time.Duration
+}
+
+// Expires returns when the lease expires, zero when it doesn't
+func (l Lease) Expires() time.Time {
+	if l.Duration == 0 {
+		return time.Time{}
+	}
+	return l.Obtained.Add(l.Duration)
+}
+
+// Client leases addresses from a DHCP server. Its methods are safe for
+// concurrent use.
+type Client struct {
+	config Config
+	conn   *net.UDPConn
+
+	mu sync.Mutex
+	// pending holds the replies awaited, by transaction ID
+	pending map[uint32]chan *message
+	done    chan struct{}
+}
+
+// NewClient listens for the server's replies on RelayAddr
+func NewClient(config Config) (*Client, error) {
+	if !config.Server.Addr().Is4() || !config.RelayAddr.Is4() {
+		return nil, errors.New("dhcp: server and relay addresses must be IPv4")
+	}
+	if config.Server.Port() == 0 {
+		config.Server = netip.AddrPortFrom(config.Server.Addr(), Port)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	conn, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.AddrPortFrom(config.RelayAddr, Port)))
+	if err != nil {
+		return nil, fmt.Errorf("dhcp: failed to listen: %w", err)
+	}
+	c := &Client{config: config, conn: conn, pending: make(map[uint32]chan *message), done: make(chan struct{})}
+	go c.read()
+	return c, nil
+}
+
+// Close stops listening; exchanges under way fail
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// Acquire leases an address, req.Addr when the server agrees
+func (c *Client) Acquire(ctx context.Context, req Request) (Lease, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	discover := c.newMessage(req, msgDiscover)
+	if req.Addr.Is4() {
+		discover.options[optRequestedIP] = addrBytes(req.Addr)
+	}
+	offer, err := c.exchange(ctx, discover, func(m *message) bool {
+		return m.msgType() == msgOffer && m.yiaddr.IsValid() && !m.yiaddr.IsUnspecified()
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+	server := offer.addrOption(optServerID)
+	if !server.IsValid() {
+		return Lease{}, fmt.Errorf("%w: offer without a server identifier", errMalformed)
+	}
+
+	request := c.newMessage(req, msgRequest)
+	request.options[optRequestedIP] = addrBytes(offer.yiaddr)
+	request.options[optServerID] = addrBytes(server)
+	return c.lease(ctx, request)
+}
+
+// Renew extends lease, which the server may decline with ErrNAK
+func (c *Client) Renew(ctx context.Context, req Request, lease Lease) (Lease, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	request := c.newMessage(req, msgRequest)
+	request.ciaddr = lease.Addr
+	return c.lease(ctx, request)
+}
+
+// Release gives lease back to the server. The server doesn't reply, so
+// this only fails when the message can't be sent.
+func (c *Client) Release(req Request, lease Lease) error {
+	release := c.newMessage(req, msgRelease)
+	release.ciaddr = lease.Addr
+	if lease.Server.IsValid() {
+		release.options[optServerID] = addrBytes(lease.Server)
+	}
+	delete(release.options, optParams)
+	delete(release.options, optHostname)
+	if _, err := c.conn.WriteToUDPAddrPort(release.marshal(), c.config.Server); err != nil {
+		return fmt.Errorf("dhcp: failed to send release: %w", err)
+	}
+	return nil
+}
+
+// lease sends request and returns the lease it is acknowledged with
+func (c *Client) lease(ctx context.Context, request *message) (Lease, error) {
+	reply, err := c.exchange(ctx, request, func(m *message) bool {
+		t := m.msgType()
+		return t == msgNak || t == msgAck && m.yiaddr.IsValid() && !m.yiaddr.IsUnspecified()
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+	if reply.msgType() == msgNak {
+		if msg := reply.options[optMessage]; len(msg) > 0 {
+			return Lease{}, fmt.Errorf("%w: %s", ErrNAK, msg)
+		}
+		return Lease{}, ErrNAK
+	}
+
+	l := Lease{Addr: reply.yiaddr, Server: reply.addrOption(optServerID), Obtained: time.Now()}
+	// A lease time of all ones is infinite
+	if secs, ok := reply.secondsOption(optLeaseTime); ok && secs != ^uint32(0) {
+		l.Duration = time.Duration(secs) * time.Second
+		l.Renew = l.Duration / 2
+		if t1, ok := reply.secondsOption(optRenewalTime); ok && time.Duration(t1)*time.Second < l.Duration {
+			l.Renew = time.Duration(t1) * time.Second
+		}
+	}
+	return l, nil
+}
+
+// newMessage returns a message of type typ from the client of req, relayed
+// from RelayAddr
+func (c *Client) newMessage(req Request, typ byte) *message {
+	m := &message{
+		op:     opRequest,
+		hops:   1,
+		xid:    rand.Uint32(),
+		giaddr: c.config.RelayAddr,
+		chaddr: req.HardwareAddr,
+		options: map[byte][]byte{
+			optMessageType: {typ},
+			optParams:      {1, 3, 6, optLeaseTime, optRenewalTime},
+		},
+	}
+	if len(req.ClientID) > 0 {
+		m.options[optClientID] = req.ClientID
+	}
+	if req.Subnet.Is4() {
+		m.options[optSubnetSelection] = addrBytes(req.Subnet)
+	}
+	if req.Hostname != "" {
+		m.options[optHostname] = []byte(req.Hostname)
+	}
+	return m
+}
+
+// exchange sends m, again after each of retransmits, until a reply to it
+// is accepted or ctx is done
+func (c *Client) exchange(ctx context.Context, m *message, accept func(*message) bool) (*message, error) {
+	replies := make(chan *message, 4)
+	c.mu.Lock()
+	for c.pending[m.xid] != nil {
+		m.xid++
+	}
+	c.pending[m.xid] = replies
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, m.xid)
+		c.mu.Unlock()
+	}()
+
+	b := m.marshal()
+	for i := 0; ; i++ {
+		if _, err := c.conn.WriteToUDPAddrPort(b, c.config.Server); err != nil {
+			return nil, fmt.Errorf("dhcp: failed to send to %s: %w", c.config.Server, err)
+		}
+		timer := time.NewTimer(retransmits[min(i, len(retransmits)-1)])
+		for wait := true; wait; {
+			select {
+			case reply := <-replies:
+				if accept(reply) {
+					timer.Stop()
+					return reply, nil
+				}
+			case <-timer.C:
+				wait = false
+			case <-c.done:
+				timer.Stop()
+				return nil, net.ErrClosed
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("dhcp: no reply from %s: %w", c.config.Server, ctx.Err())
+			}
+		}
+	}
+}
+
+// read hands the replies received to the exchanges awaiting them, until
+// the connection is closed
+func (c *Client) read() {
+	defer close(c.done)
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.conn.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		m, err := unmarshal(buf[:n])
+		if err != nil || m.op != opReply {
+			continue
+		}
+		c.mu.Lock()
+		replies := c.pending[m.xid]
+		c.mu.Unlock()
+		select {
+		case replies <- m:
+		default:
+		}
+	}
+}
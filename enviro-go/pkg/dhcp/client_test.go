@@ -0,0 +1,206 @@
+package dhcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer answers the messages relayed to it with those reply returns,
+// none when it returns nil, sending the replies to the relay agent
+type fakeServer struct {
+	conn     *net.UDPConn
+	reply    func(m *message) *message
+	received chan *message
+}
+
+func newFakeServer(t *testing.T, reply func(m *message) *message) *fakeServer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{conn: conn, reply: reply, received: make(chan *message, 16)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1500)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			m, err := unmarshal(buf[:n])
+			if err != nil {
+				continue
+			}
+			s.received <- m
+			if r := s.reply(m); r != nil {
+				r.op, r.xid, r.giaddr, r.chaddr = opReply, m.xid, m.giaddr, m.chaddr
+				conn.WriteToUDPAddrPort(r.marshal(), netip.AddrPortFrom(m.giaddr, Port))
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return s
+}
+
+// addr returns the address to configure as the server
+func (s *fakeServer) addr() netip.AddrPort {
+	return s.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// newTestClient relays to s from the loopback address, skipping the test
+// when the DHCP port can't be bound
+func newTestClient(t *testing.T, s *fakeServer, timeout time.Duration) *Client {
+	t.Helper()
+	c, err := NewClient(Config{Server: s.addr(), RelayAddr: netip.MustParseAddr("127.0.0.1"), Timeout: timeout})
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("binding the DHCP port needs privileges")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func seconds(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+// TestClient leases an address, renews it and releases it, with the
+// server offering what the client asks for
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	serverID := netip.MustParseAddr("192.0.2.67")
+	s := newFakeServer(t, func(m *message) *message {
+		offered := netip.MustParseAddr("10.88.0.10")
+		if requested := m.addrOption(optRequestedIP); requested.IsValid() {
+			offered = requested
+		}
+		switch m.msgType() {
+		case msgDiscover:
+			return &message{yiaddr: offered, options: map[byte][]byte{optMessageType: {msgOffer}, optServerID: addrBytes(serverID)}}
+		case msgRequest:
+			if m.ciaddr.IsValid() && m.ciaddr != netip.IPv4Unspecified() {
+				if m.ciaddr == netip.MustParseAddr("10.88.0.99") {
+					return &message{options: map[byte][]byte{optMessageType: {msgNak}, optMessage: []byte("lease unknown")}}
+				}
+				offered = m.ciaddr
+			}
+			return &message{yiaddr: offered, options: map[byte][]byte{
+				optMessageType: {msgAck},
+				optServerID:    addrBytes(serverID),
+				optLeaseTime:   seconds(3600),
+				optRenewalTime: seconds(600),
+			}}
+		}
+		return nil
+	})
+	c := newTestClient(t, s, 5*time.Second)
+	req := Request{
+		ClientID:     []byte("container-1"),
+		HardwareAddr: net.HardwareAddr{0x0a, 0x58, 0x0a, 0x58, 0x00, 0x0a},
+		Subnet:       netip.MustParseAddr("10.88.0.1"),
+		Hostname:     "web",
+	}
+
+	lease, err := c.Acquire(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Addr != netip.MustParseAddr("10.88.0.10") || lease.Server != serverID || lease.Duration != time.Hour || lease.Renew != 10*time.Minute {
+		t.Errorf("Acquire() = %+v", lease)
+	}
+	if want := lease.Obtained.Add(time.Hour); !lease.Expires().Equal(want) {
+		t.Errorf("lease expires %s, want %s", lease.Expires(), want)
+	}
+	discover, request := <-s.received, <-s.received
+	if discover.msgType() != msgDiscover || discover.giaddr != netip.MustParseAddr("127.0.0.1") || discover.hops != 1 {
+		t.Errorf("discover %+v, want it relayed from 127.0.0.1", discover)
+	}
+	if got := discover.addrOption(optSubnetSelection); got != req.Subnet {
+		t.Errorf("subnet selection %s, want %s", got, req.Subnet)
+	}
+	if string(discover.options[optClientID]) != "container-1" || string(discover.options[optHostname]) != "web" {
+		t.Errorf("discover options %v", discover.options)
+	}
+	if request.msgType() != msgRequest || request.addrOption(optRequestedIP) != lease.Addr || request.addrOption(optServerID) != serverID {
+		t.Errorf("request %+v, want the offer of %s", request, serverID)
+	}
+
+	// The requested address is offered
+	req.Addr = netip.MustParseAddr("10.88.0.20")
+	if again, err := c.Acquire(ctx, req); err != nil || again.Addr != req.Addr {
+		t.Errorf("Acquire() of %s = %+v, %v", req.Addr, again, err)
+	}
+	<-s.received
+	<-s.received
+
+	renewed, err := c.Renew(ctx, req, lease)
+	if err != nil || renewed.Addr != lease.Addr {
+		t.Errorf("Renew() = %+v, %v, want %s", renewed, err, lease.Addr)
+	}
+	<-s.received
+	if _, err := c.Renew(ctx, req, Lease{Addr: netip.MustParseAddr("10.88.0.99")}); !errors.Is(err, ErrNAK) || !strings.Contains(err.Error(), "lease unknown") {
+		t.Errorf("Renew() of an unknown lease = %v, want %v", err, ErrNAK)
+	}
+	<-s.received
+
+	if err := c.Release(req, lease); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case release := <-s.received:
+		if release.msgType() != msgRelease || release.ciaddr != lease.Addr || release.options[optHostname] != nil {
+			t.Errorf("release %+v of %s", release, lease.Addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("release not received")
+	}
+}
+
+// TestClientNoReply times out on a server that doesn't answer, and on one
+// offering without identifying itself
+func TestClientNoReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   func(m *message) *message
+		wantErr error
+	}{
+		{name: "silent", reply: func(*message) *message { return nil }, wantErr: context.DeadlineExceeded},
+		{name: "anonymous offer", reply: func(*message) *message {
+			return &message{yiaddr: netip.MustParseAddr("10.88.0.10"), options: map[byte][]byte{optMessageType: {msgOffer}}}
+		}, wantErr: errMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, newFakeServer(t, tt.reply), 100*time.Millisecond)
+			if _, err := c.Acquire(context.Background(), Request{HardwareAddr: net.HardwareAddr{0x0a, 0x58, 0, 0, 0, 1}}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Acquire() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	v6 := netip.MustParseAddr("fd00::1")
+	for _, config := range []Config{
+		{Server: netip.AddrPortFrom(v6, Port), RelayAddr: netip.MustParseAddr("127.0.0.1")},
+		{Server: netip.MustParseAddrPort("127.0.0.1:67"), RelayAddr: v6},
+	} {
+		if _, err := NewClient(config); err == nil {
+			t.Errorf("NewClient(%+v) succeeded", config)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// Message types, option 53
+const (
+	msgDiscover = 1
+	msgOffer    = 2
+	msgRequest  = 3
+	msgAck      = 5
+	msgNak      = 6
+	msgRelease  = 7
+)
+
+// Options
+const (
+	optPad             = 0
+	optHostname        = 12
+	optRequestedIP     = 50
+	optLeaseTime       = 51
+	optMessageType     = 53
+	optServerID        = 54
+	optParams          = 55
+	optMessage         = 56
+	optRenewalTime     = 58
+	optClientID        = 61
+	optSubnetSelection = 118
+	optEnd             = 255
+)
+
+const (
+	opRequest = 1
+	opReply   = 2
+
+	// headerLen is the fixed part of a message, before the magic cookie
+	headerLen = 236
+	// minLen is the smallest message BOOTP relays and servers must accept
+	minLen = 300
+)
+
+var magicCookie = [4]byte{99, 130, 83, 99}
+
+// errMalformed is returned for messages that can't be decoded
+var errMalformed = errors.New("dhcp: malformed message")
+
+// message is a DHCP message, with just the fields leasing needs
+type message struct {
+	op     byte
+	hops   byte
+	xid    uint32
+	ciaddr netip.Addr
+	yiaddr netip.Addr
+	giaddr netip.Addr
+	chaddr net.HardwareAddr
+	// options holds the options by code, without pad and end
+	options map[byte][]byte
+}
+
+// msgType returns the DHCP message type, 0 for a plain BOOTP message
+func (m *message) msgType() byte {
+	if v := m.options[optMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// addrOption returns the IPv4 address in option code, if any
+func (m *message) addrOption(code byte) netip.Addr {
+	if v := m.options[code]; len(v) == 4 {
+		return netip.AddrFrom4([4]byte(v))
+	}
+	return netip.Addr{}
+}
+
+// secondsOption returns the 32-bit number of seconds in option code, and
+// whether it is set
+func (m *message) secondsOption(code byte) (uint32, bool) {
+	if v := m.options[code]; len(v) == 4 {
+		return binary.BigEndian.Uint32(v), true
+	}
+	return 0, false
+}
+
+// marshal encodes m, the message type first and padded to minLen
+func (m *message) marshal() []byte {
+	b := make([]byte, headerLen, minLen)
+	b[0] = m.op
+	b[1] = 1 // Ethernet
+	b[2] = byte(len(m.chaddr))
+	b[3] = m.hops
+	binary.BigEndian.PutUint32(b[4:], m.xid)
+	putAddr(b[12:], m.ciaddr)
+	putAddr(b[16:], m.yiaddr)
+	putAddr(b[24:], m.giaddr)
+	copy(b[28:44], m.chaddr)
+	b = append(b, magicCookie[:]...)
+
+	codes := make([]int, 0, len(m.options))
+	for code := range m.options {
+		codes = append(codes, int(code))
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if (codes[i] == optMessageType) != (codes[j] == optMessageType) {
+			return codes[i] == optMessageType
+		}
+		return codes[i] < codes[j]
+	})
+	for _, code := range codes {
+		v := m.options[byte(code)]
+		// Longer values are split, to be concatenated again (RFC 3396)
+		for len(v) > 255 {
+			b = append(append(b, byte(code), 255), v[:255]...)
+			v = v[255:]
+		}
+		b = append(append(b, byte(code), byte(len(v))), v...)
+	}
+	b = append(b, optEnd)
+	for len(b) < minLen {
+		b = append(b, optPad)
+	}
+	return b
+}
+
+// unmarshal decodes a message. Options in the sname and file fields,
+// which servers only use when they run out of room, are ignored.
+func unmarshal(b []byte) (*message, error) {
+	if len(b) < headerLen+len(magicCookie) || [4]byte(b[headerLen:]) != magicCookie {
+		return nil, errMalformed
+	}
+	hlen := int(b[2])
+	if hlen > 16 {
+		return nil, errMalformed
+	}
+	m := &message{
+		op:      b[0],
+		hops:    b[3],
+		xid:     binary.BigEndian.Uint32(b[4:]),
+		ciaddr:  netip.AddrFrom4([4]byte(b[12:])),
+		yiaddr:  netip.AddrFrom4([4]byte(b[16:])),
+		giaddr:  netip.AddrFrom4([4]byte(b[24:])),
+		chaddr:  net.HardwareAddr(append([]byte(nil), b[28:28+hlen]...)),
+		options: make(map[byte][]byte),
+	}
+	opts := b[headerLen+len(magicCookie):]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, errMalformed
+		}
+		n := int(opts[1])
+		m.options[code] = append(m.options[code], opts[2:2+n]...)
+		opts = opts[2+n:]
+	}
+	return m, nil
+}
+
+// putAddr writes the IPv4 address addr to b, leaving zeros for none
+func putAddr(b []byte, addr netip.Addr) {
+	if addr.Is4() {
+		a := addr.As4()
+		copy(b, a[:])
+	}
+}
+
+// addrBytes returns the four bytes of the IPv4 address addr
+func addrBytes(addr netip.Addr) []byte {
+	a := addr.As4()
+	return a[:]
+}
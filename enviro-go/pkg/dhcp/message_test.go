@@ -0,0 +1,82 @@
+package dhcp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 300)
+	m := &message{
+		op:     opRequest,
+		hops:   1,
+		xid:    0xdeadbeef,
+		ciaddr: netip.MustParseAddr("10.88.0.2"),
+		giaddr: netip.MustParseAddr("192.0.2.1"),
+		chaddr: net.HardwareAddr{0x0a, 0x58, 0x0a, 0x58, 0x00, 0x02},
+		options: map[byte][]byte{
+			optMessageType: {msgRequest},
+			optLeaseTime:   {0, 0, 0x0e, 0x10},
+			optHostname:    long,
+		},
+	}
+	b := m.marshal()
+	if len(b) < minLen {
+		t.Errorf("marshaled %d bytes, want at least %d", len(b), minLen)
+	}
+	// The message type comes first
+	if opts := b[headerLen+len(magicCookie):]; opts[0] != optMessageType || opts[2] != msgRequest {
+		t.Errorf("options start with % x, want the message type", opts[:3])
+	}
+
+	got, err := unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.op != m.op || got.hops != m.hops || got.xid != m.xid || got.ciaddr != m.ciaddr || got.giaddr != m.giaddr ||
+		!bytes.Equal(got.chaddr, m.chaddr) {
+		t.Errorf("unmarshaled %+v, want %+v", got, m)
+	}
+	if got.yiaddr != netip.IPv4Unspecified() {
+		t.Errorf("yiaddr %s, want it unset", got.yiaddr)
+	}
+	// The long option was split and is concatenated again
+	if !bytes.Equal(got.options[optHostname], long) {
+		t.Errorf("hostname of %d bytes, want %d", len(got.options[optHostname]), len(long))
+	}
+	if got.msgType() != msgRequest {
+		t.Errorf("message type %d, want %d", got.msgType(), msgRequest)
+	}
+	if secs, ok := got.secondsOption(optLeaseTime); !ok || secs != 3600 {
+		t.Errorf("lease time %d, %v, want 3600", secs, ok)
+	}
+	if addr := got.addrOption(optServerID); addr.IsValid() {
+		t.Errorf("server identifier %s without the option", addr)
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	valid := (&message{op: opReply, options: map[byte][]byte{optMessageType: {msgAck}}}).marshal()
+	tests := []struct {
+		name  string
+		apply func(b []byte) []byte
+	}{
+		{name: "short", apply: func(b []byte) []byte { return b[:headerLen] }},
+		{name: "cookie", apply: func(b []byte) []byte { b[headerLen] = 0; return b }},
+		{name: "hardware address length", apply: func(b []byte) []byte { b[2] = 17; return b }},
+		{name: "truncated option", apply: func(b []byte) []byte {
+			return append(b[:headerLen+len(magicCookie)], optHostname, 10, 'x')
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.apply(append([]byte(nil), valid...))
+			if _, err := unmarshal(b); !errors.Is(err, errMalformed) {
+				t.Errorf("unmarshal() = %v, want %v", err, errMalformed)
+			}
+		})
+	}
+}
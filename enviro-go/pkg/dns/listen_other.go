@@ -0,0 +1,13 @@
+//go:build !linux
+
+package dns
+
+import (
+	"net"
+	"net/netip"
+)
+
+// listenUDP binds addr, which must already be assigned to an interface
+func listenUDP(addr netip.AddrPort) (net.PacketConn, error) {
+	return net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+}
@@ -0,0 +1,498 @@
+// Package dns answers container name queries for Enviro
+//
+// The server is authoritative for a single domain, answering from a
+// Resolver:
+//
+//	<name>.<domain>                        A and AAAA of a container
+//	<name>.svc.<domain>                    A or AAAA of a service's virtual IP
+//	_<name>._<proto>.svc.<domain>          SRV of a service's ports
+//	_<port>._<proto>.<name>.svc.<domain>   SRV of a named port of a service
+//
+// as well as the PTR records of those addresses in the in-addr.arpa and
+// ip6.arpa names of its reverse zones, and forwards every other query to
+// an upstream resolver. It only answers queries: zone transfers are
+// refused and other opcodes are not implemented.
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultDomain is the domain container names are served under
+const DefaultDomain = "enviro"
+
+// DefaultTTL is the TTL of records, in seconds, kept short since
+// containers come and go
+const DefaultTTL = 5
+
+// upstreamTimeout bounds a forwarded query
+const upstreamTimeout = 2 * time.Second
+
+// maxMessageSize is the largest UDP message read or relayed
+const maxMessageSize = 4096
+
+// serviceLabel is the subdomain services are served under
+const serviceLabel = "svc"
+
+// typeIXFR is the type of incremental zone transfer queries, which
+// dnsmessage has no constant for
+const typeIXFR dnsmessage.Type = 251
+
+// Resolver looks up containers and services by name, and the names of
+// their addresses
+type Resolver interface {
+	// Lookup returns the addresses of name, or false if no container has it
+	Lookup(name string) ([]Record, bool)
+	// LookupService returns the service name, or false if there is none
+	LookupService(name string) (Service, bool)
+	// LookupAddr returns the name addr is served for relative to the
+	// domain, e.g. "web" or "api.svc", and the TTL of its PTR record, or
+	// false if it has none
+	LookupAddr(addr netip.Addr) (name string, ttl uint32, ok bool)
+}
+
+// Record is an address served for a name
+type Record struct {
+	Addr netip.Addr
+	// TTL is in seconds, that of the server when zero
+	TTL uint32
+}
+
+// Service is a load-balanced service as served in DNS
+type Service struct {
+	VIP   netip.Addr
+	Ports []ServicePort
+}
+
+// ServicePort is a port of a Service
+type ServicePort struct {
+	// Name is empty for the only port of a service
+	Name string
+	Port uint16
+	// Protocol is "tcp" or "udp"
+	Protocol string
+}
+
+// Config holds the DNS server settings
+type Config struct {
+	// Domain defaults to DefaultDomain
+	Domain string
+	// Upstream receives queries outside Domain, e.g. "1.1.1.1:53". Such
+	// queries are refused when empty.
+	Upstream string
+	// TTL of records without one of their own, DefaultTTL when zero
+	TTL uint32
+	// ReverseZones are the networks whose addresses PTR queries are
+	// answered for rather than forwarded, e.g. the container networks
+	ReverseZones []netip.Prefix
+	// Logger defaults to slog.Default()
+	Logger *slog.Logger
+}
+
+// Server is a UDP DNS server
+type Server struct {
+	domain   string
+	upstream string
+	ttl      uint32
+	reverse  []netip.Prefix
+	resolver Resolver
+	log      *slog.Logger
+
+	mu    sync.Mutex
+	conns []net.PacketConn
+	wg    sync.WaitGroup
+}
+
+// NewServer creates a server answering from resolver
+func NewServer(config Config, resolver Resolver) *Server {
+	domain := strings.ToLower(strings.Trim(config.Domain, "."))
+	if domain == "" {
+		domain = DefaultDomain
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	ttl := config.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	reverse := make([]netip.Prefix, len(config.ReverseZones))
+	for i, zone := range config.ReverseZones {
+		reverse[i] = zone.Masked()
+	}
+	return &Server{
+		domain:   domain,
+		upstream: config.Upstream,
+		ttl:      ttl,
+		reverse:  reverse,
+		resolver: resolver,
+		log:      logger,
+	}
+}
+
+// Listen serves on port 53 of addr. The address does not need to be
+// assigned to an interface yet where the platform allows it.
+func (s *Server) Listen(addr netip.Addr) error {
+	conn, err := listenUDP(netip.AddrPortFrom(addr, 53))
+	if err != nil {
+		return fmt.Errorf("failed to listen for DNS on %s: %w", addr, err)
+	}
+
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.serve(conn)
+	s.log.Info("Serving container DNS", "address", addr, "domain", s.domain)
+	return nil
+}
+
+// Close stops serving and waits for in-progress queries
+func (s *Server) Close() error {
+	s.mu.Lock()
+	var errs []error
+	for _, conn := range s.conns {
+		errs = append(errs, conn.Close())
+	}
+	s.conns = nil
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *Server) serve(conn net.PacketConn) {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.log.Error("DNS server stopped", "error", err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if resp := s.handle(query); resp != nil {
+				conn.WriteTo(resp, peer)
+			}
+		}()
+	}
+}
+
+// handle returns the response to a raw query, or nil to drop it
+func (s *Server) handle(query []byte) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil || hdr.Response {
+		return nil
+	}
+	// Only queries are answered, not e.g. updates or notifies
+	if hdr.OpCode != 0 {
+		return reply(hdr, nil, dnsmessage.RCodeNotImplemented, nil, nil)
+	}
+	q, err := p.Question()
+	if err != nil {
+		return reply(hdr, nil, dnsmessage.RCodeFormatError, nil, nil)
+	}
+	// Nor are zones transferred, whether served or forwarded
+	if q.Type == dnsmessage.TypeAXFR || q.Type == typeIXFR {
+		return reply(hdr, &q, dnsmessage.RCodeRefused, nil, nil)
+	}
+
+	if prefix, ok := reversePrefix(q.Name.String()); ok && s.inReverseZones(prefix) {
+		answers, found := s.lookupPTR(prefix, q)
+		if !found {
+			return reply(hdr, &q, dnsmessage.RCodeNameError, nil, nil)
+		}
+		return reply(hdr, &q, dnsmessage.RCodeSuccess, answers, nil)
+	}
+
+	name, ok := s.localName(q.Name.String())
+	if !ok {
+		return s.forward(hdr, q, query)
+	}
+
+	answers, additionals, found := s.lookup(name, q)
+	if !found {
+		return reply(hdr, &q, dnsmessage.RCodeNameError, nil, nil)
+	}
+	// Types without records get an empty answer, since the name exists
+	return reply(hdr, &q, dnsmessage.RCodeSuccess, answers, additionals)
+}
+
+// localName returns the part of fqdn before the served domain, if it is
+// in the domain
+func (s *Server) localName(fqdn string) (string, bool) {
+	name := strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	if name == s.domain {
+		return "", true
+	}
+	return strings.CutSuffix(name, "."+s.domain)
+}
+
+// lookup returns the records for the local name queried by q, or false if
+// the name doesn't exist
+func (s *Server) lookup(name string, q dnsmessage.Question) (answers, additionals []dnsmessage.Resource, found bool) {
+	labels := strings.Split(name, ".")
+	switch {
+	case len(labels) == 1 && name != "":
+		records, ok := s.resolver.Lookup(name)
+		if !ok {
+			return nil, nil, false
+		}
+		return s.addrRecords(q.Name, q.Type, records), nil, true
+
+	case len(labels) == 2 && labels[1] == serviceLabel:
+		svc, ok := s.resolver.LookupService(labels[0])
+		if !ok {
+			return nil, nil, false
+		}
+		return s.addrRecords(q.Name, q.Type, []Record{{Addr: svc.VIP}}), nil, true
+
+	case len(labels) == 3 && labels[2] == serviceLabel:
+		svcName, ok1 := strings.CutPrefix(labels[0], "_")
+		proto, ok2 := strings.CutPrefix(labels[1], "_")
+		if !ok1 || !ok2 {
+			return nil, nil, false
+		}
+		return s.srvRecords(q, svcName, func(p ServicePort) bool { return p.Protocol == proto })
+
+	case len(labels) == 4 && labels[3] == serviceLabel:
+		port, ok1 := strings.CutPrefix(labels[0], "_")
+		proto, ok2 := strings.CutPrefix(labels[1], "_")
+		if !ok1 || !ok2 || port == "" {
+			return nil, nil, false
+		}
+		return s.srvRecords(q, labels[2], func(p ServicePort) bool { return p.Name == port && p.Protocol == proto })
+	}
+	return nil, nil, false
+}
+
+// srvRecords returns the SRV records of the ports of service svcName
+// matching match, queried by q, or false if the service has none
+func (s *Server) srvRecords(q dnsmessage.Question, svcName string, match func(ServicePort) bool) (answers, additionals []dnsmessage.Resource, found bool) {
+	svc, ok := s.resolver.LookupService(svcName)
+	if !ok {
+		return nil, nil, false
+	}
+	var ports []ServicePort
+	for _, p := range svc.Ports {
+		if match(p) {
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, nil, false
+	}
+	if q.Type != dnsmessage.TypeSRV {
+		return nil, nil, true
+	}
+	target, err := dnsmessage.NewName(svcName + "." + serviceLabel + "." + s.domain + ".")
+	if err != nil {
+		return nil, nil, false
+	}
+	for _, p := range ports {
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl},
+			Body:   &dnsmessage.SRVResource{Port: p.Port, Target: target},
+		})
+	}
+	typ := dnsmessage.TypeA
+	if svc.VIP.Is6() {
+		typ = dnsmessage.TypeAAAA
+	}
+	return answers, s.addrRecords(target, typ, []Record{{Addr: svc.VIP}}), true
+}
+
+// lookupPTR returns the PTR record of the address or the prefix of a
+// partial name in the reverse zones queried by q, or false if the name
+// doesn't exist
+func (s *Server) lookupPTR(prefix netip.Prefix, q dnsmessage.Question) ([]dnsmessage.Resource, bool) {
+	// The partial names of a zone are empty non-terminals
+	if !prefix.IsSingleIP() {
+		return nil, true
+	}
+	name, ttl, ok := s.resolver.LookupAddr(prefix.Addr())
+	if !ok {
+		return nil, false
+	}
+	if q.Type != dnsmessage.TypePTR {
+		return nil, true
+	}
+	target, err := dnsmessage.NewName(name + "." + s.domain + ".")
+	if err != nil {
+		return nil, false
+	}
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+	return []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.PTRResource{PTR: target},
+	}}, true
+}
+
+// inReverseZones reports whether the addresses of prefix are all in the
+// reverse zones
+func (s *Server) inReverseZones(prefix netip.Prefix) bool {
+	for _, zone := range s.reverse {
+		if zone.Bits() <= prefix.Bits() && zone.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// reversePrefix returns the addresses a name in the in-addr.arpa or
+// ip6.arpa trees stands for: the address of a full name, or the prefix of
+// a partial one
+func reversePrefix(fqdn string) (netip.Prefix, bool) {
+	name := strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) > 4 {
+			return netip.Prefix{}, false
+		}
+		var b [4]byte
+		for i, label := range labels {
+			// Octets are decimal without leading zeros
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil || strconv.FormatUint(n, 10) != label {
+				return netip.Prefix{}, false
+			}
+			b[len(labels)-1-i] = byte(n)
+		}
+		return netip.PrefixFrom(netip.AddrFrom4(b), 8*len(labels)), true
+	}
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) > 32 {
+			return netip.Prefix{}, false
+		}
+		var b [16]byte
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Prefix{}, false
+			}
+			// The first label is the last nibble
+			nibble := len(labels) - 1 - i
+			b[nibble/2] |= byte(n) << (4 * (1 - nibble%2))
+		}
+		return netip.PrefixFrom(netip.AddrFrom16(b), 4*len(labels)), true
+	}
+	return netip.Prefix{}, false
+}
+
+// addrRecords returns the A or AAAA records of name for the records of
+// the family queried by typ
+func (s *Server) addrRecords(name dnsmessage.Name, typ dnsmessage.Type, records []Record) []dnsmessage.Resource {
+	var out []dnsmessage.Resource
+	for _, r := range records {
+		ttl := r.TTL
+		if ttl == 0 {
+			ttl = s.ttl
+		}
+		h := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}
+		switch {
+		case typ == dnsmessage.TypeA && r.Addr.Is4():
+			out = append(out, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: r.Addr.As4()}})
+		case typ == dnsmessage.TypeAAAA && r.Addr.Is6():
+			out = append(out, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: r.Addr.As16()}})
+		}
+	}
+	return out
+}
+
+// forward relays query to the upstream resolver
+func (s *Server) forward(hdr dnsmessage.Header, q dnsmessage.Question, query []byte) []byte {
+	if s.upstream == "" {
+		return reply(hdr, &q, dnsmessage.RCodeRefused, nil, nil)
+	}
+
+	conn, err := net.DialTimeout("udp", s.upstream, upstreamTimeout)
+	if err != nil {
+		s.log.Warn("Failed to reach upstream DNS", "upstream", s.upstream, "error", err)
+		return reply(hdr, &q, dnsmessage.RCodeServerFailure, nil, nil)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return reply(hdr, &q, dnsmessage.RCodeServerFailure, nil, nil)
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		s.log.Warn("Upstream DNS query failed", "upstream", s.upstream, "name", q.Name.String(), "error", err)
+		return reply(hdr, &q, dnsmessage.RCodeServerFailure, nil, nil)
+	}
+	return buf[:n]
+}
+
+// reply builds a response to the query with header hdr and question q
+func reply(hdr dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, answers, additionals []dnsmessage.Resource) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		OpCode:             hdr.OpCode,
+		Authoritative:      rcode != dnsmessage.RCodeRefused && rcode != dnsmessage.RCodeServerFailure,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if q == nil {
+		out, _ := b.Finish()
+		return out
+	}
+
+	b.StartQuestions()
+	b.Question(*q)
+	b.StartAnswers()
+	for _, r := range answers {
+		addResource(&b, r)
+	}
+	b.StartAdditionals()
+	for _, r := range additionals {
+		addResource(&b, r)
+	}
+	out, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// addResource adds r, an A, AAAA, SRV or PTR record, to the current
+// section
+func addResource(b *dnsmessage.Builder, r dnsmessage.Resource) {
+	switch body := r.Body.(type) {
+	case *dnsmessage.AResource:
+		b.AResource(r.Header, *body)
+	case *dnsmessage.AAAAResource:
+		b.AAAAResource(r.Header, *body)
+	case *dnsmessage.SRVResource:
+		b.SRVResource(r.Header, *body)
+	case *dnsmessage.PTRResource:
+		b.PTRResource(r.Header, *body)
+	}
+}
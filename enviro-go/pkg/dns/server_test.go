@@ -0,0 +1,248 @@
+package dns
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver serves fixed containers and services
+type fakeResolver struct {
+	names    map[string][]Record
+	services map[string]Service
+}
+
+func (r fakeResolver) Lookup(name string) ([]Record, bool) {
+	records, ok := r.names[name]
+	return records, ok
+}
+
+func (r fakeResolver) LookupService(name string) (Service, bool) {
+	svc, ok := r.services[name]
+	return svc, ok
+}
+
+func (r fakeResolver) LookupAddr(addr netip.Addr) (string, uint32, bool) {
+	for name, records := range r.names {
+		for _, rec := range records {
+			if rec.Addr == addr {
+				return name, rec.TTL, true
+			}
+		}
+	}
+	for name, svc := range r.services {
+		if svc.VIP == addr {
+			return name + "." + serviceLabel, 0, true
+		}
+	}
+	return "", 0, false
+}
+
+func newTestServer() *Server {
+	return NewServer(Config{
+		TTL:          30,
+		ReverseZones: []netip.Prefix{netip.MustParsePrefix("10.88.0.0/16"), netip.MustParsePrefix("fd00:88::/64")},
+	}, fakeResolver{
+		names: map[string][]Record{
+			"web": {{Addr: netip.MustParseAddr("10.88.0.2"), TTL: 60}, {Addr: netip.MustParseAddr("fd00:88::2")}},
+		},
+		services: map[string]Service{
+			"api": {VIP: netip.MustParseAddr("10.88.255.1"), Ports: []ServicePort{
+				{Name: "http", Port: 80, Protocol: "tcp"},
+				{Name: "https", Port: 443, Protocol: "tcp"},
+				{Name: "dns", Port: 53, Protocol: "udp"},
+			}},
+		},
+	})
+}
+
+// query asks s for name of type typ with opcode, returning the response
+func query(t *testing.T, s *Server, name string, typ dnsmessage.Type, opcode dnsmessage.OpCode) (dnsmessage.Header, []dnsmessage.Resource) {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, OpCode: opcode, RecursionDesired: true})
+	b.StartQuestions()
+	if err := b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := s.handle(msg)
+	if resp == nil {
+		t.Fatalf("no response to %s %s", name, typ)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 7 {
+		t.Errorf("response ID %d, want 7", m.ID)
+	}
+	return m.Header, m.Answers
+}
+
+func TestServerReverse(t *testing.T) {
+	s := newTestServer()
+	tests := []struct {
+		name    string
+		qname   string
+		typ     dnsmessage.Type
+		rcode   dnsmessage.RCode
+		want    string
+		wantTTL uint32
+	}{
+		{name: "v4", qname: "2.0.88.10.in-addr.arpa.", typ: dnsmessage.TypePTR, want: "web.enviro.", wantTTL: 60},
+		{
+			name:    "v6",
+			qname:   "2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.8.0.0.0.0.d.f.ip6.arpa.",
+			typ:     dnsmessage.TypePTR,
+			want:    "web.enviro.",
+			wantTTL: 30,
+		},
+		{name: "case insensitive", qname: "2.0.88.10.IN-ADDR.ARPA.", typ: dnsmessage.TypePTR, want: "web.enviro.", wantTTL: 60},
+		{name: "service", qname: "1.255.88.10.in-addr.arpa.", typ: dnsmessage.TypePTR, want: "api.svc.enviro.", wantTTL: 30},
+		{name: "unallocated", qname: "3.0.88.10.in-addr.arpa.", typ: dnsmessage.TypePTR, rcode: dnsmessage.RCodeNameError},
+		{name: "other type", qname: "2.0.88.10.in-addr.arpa.", typ: dnsmessage.TypeA},
+		{name: "partial name", qname: "0.88.10.in-addr.arpa.", typ: dnsmessage.TypePTR},
+		// Outside the zones and without an upstream
+		{name: "other network", qname: "2.0.89.10.in-addr.arpa.", typ: dnsmessage.TypePTR, rcode: dnsmessage.RCodeRefused},
+		{name: "apex of a wider network", qname: "10.in-addr.arpa.", typ: dnsmessage.TypePTR, rcode: dnsmessage.RCodeRefused},
+		{name: "forward names keep working", qname: "web.enviro.", typ: dnsmessage.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr, answers := query(t, s, tt.qname, tt.typ, 0)
+			if hdr.RCode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", hdr.RCode, tt.rcode)
+			}
+			if tt.want == "" {
+				if tt.typ != dnsmessage.TypeA && len(answers) != 0 {
+					t.Errorf("answers = %v, want none", answers)
+				}
+				return
+			}
+			if len(answers) != 1 {
+				t.Fatalf("answers = %v, want one PTR", answers)
+			}
+			ptr, ok := answers[0].Body.(*dnsmessage.PTRResource)
+			if !ok || ptr.PTR.String() != tt.want || answers[0].Header.TTL != tt.wantTTL {
+				t.Errorf("answer = %v, want PTR %s with TTL %d", answers[0], tt.want, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestServerServicePorts(t *testing.T) {
+	s := newTestServer()
+	tests := []struct {
+		name  string
+		qname string
+		rcode dnsmessage.RCode
+		want  []uint16
+	}{
+		{name: "ports of protocol", qname: "_api._tcp.svc.enviro.", want: []uint16{80, 443}},
+		{name: "other protocol", qname: "_api._udp.svc.enviro.", want: []uint16{53}},
+		{name: "named port", qname: "_https._tcp.api.svc.enviro.", want: []uint16{443}},
+		{name: "named port of other protocol", qname: "_dns._tcp.api.svc.enviro.", rcode: dnsmessage.RCodeNameError},
+		{name: "unknown port", qname: "_grpc._tcp.api.svc.enviro.", rcode: dnsmessage.RCodeNameError},
+		{name: "unknown service", qname: "_http._tcp.db.svc.enviro.", rcode: dnsmessage.RCodeNameError},
+		{name: "unknown protocol", qname: "_api._sctp.svc.enviro.", rcode: dnsmessage.RCodeNameError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr, answers := query(t, s, tt.qname, dnsmessage.TypeSRV, 0)
+			if hdr.RCode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", hdr.RCode, tt.rcode)
+			}
+			var got []uint16
+			for _, a := range answers {
+				srv, ok := a.Body.(*dnsmessage.SRVResource)
+				if !ok || srv.Target.String() != "api.svc.enviro." {
+					t.Fatalf("answer = %v, want SRV of api.svc.enviro.", a)
+				}
+				got = append(got, srv.Port)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ports = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerForwardTTL(t *testing.T) {
+	s := newTestServer()
+	for _, tt := range []struct {
+		typ  dnsmessage.Type
+		want uint32
+	}{
+		{typ: dnsmessage.TypeA, want: 60},
+		{typ: dnsmessage.TypeAAAA, want: 30},
+	} {
+		_, answers := query(t, s, "web.enviro.", tt.typ, 0)
+		if len(answers) != 1 || answers[0].Header.TTL != tt.want {
+			t.Errorf("%s answers = %v, want one with TTL %d", tt.typ, answers, tt.want)
+		}
+	}
+}
+
+func TestServerRefusesTransfers(t *testing.T) {
+	s := newTestServer()
+	tests := []struct {
+		name   string
+		qname  string
+		typ    dnsmessage.Type
+		opcode dnsmessage.OpCode
+		want   dnsmessage.RCode
+	}{
+		{name: "axfr", qname: "enviro.", typ: dnsmessage.TypeAXFR, want: dnsmessage.RCodeRefused},
+		{name: "ixfr", qname: "enviro.", typ: typeIXFR, want: dnsmessage.RCodeRefused},
+		{name: "reverse axfr", qname: "88.10.in-addr.arpa.", typ: dnsmessage.TypeAXFR, want: dnsmessage.RCodeRefused},
+		{name: "notify", qname: "enviro.", typ: dnsmessage.TypeSOA, opcode: 4, want: dnsmessage.RCodeNotImplemented},
+		{name: "update", qname: "enviro.", typ: dnsmessage.TypeSOA, opcode: 5, want: dnsmessage.RCodeNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr, answers := query(t, s, tt.qname, tt.typ, tt.opcode)
+			if hdr.RCode != tt.want || len(answers) != 0 {
+				t.Errorf("rcode = %s with %d answers, want %s", hdr.RCode, len(answers), tt.want)
+			}
+		})
+	}
+}
+
+func TestReversePrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "4.3.2.1.in-addr.arpa.", want: "1.2.3.4/32"},
+		{name: "2.1.in-addr.arpa", want: "1.2.0.0/16"},
+		{name: "0.in-addr.arpa.", want: "0.0.0.0/8"},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", want: "2001:db8::1/128"},
+		{name: "8.b.d.0.1.0.0.2.ip6.arpa.", want: "2001:db8::/32"},
+		{name: "F.ip6.arpa.", want: "f000::/4"},
+		{name: "5.4.3.2.1.in-addr.arpa."},
+		{name: "256.in-addr.arpa."},
+		{name: "01.in-addr.arpa."},
+		{name: "a.in-addr.arpa."},
+		{name: "10.ip6.arpa."},
+		{name: "g.ip6.arpa."},
+		{name: "in-addr.arpa."},
+		{name: "web.enviro."},
+	}
+	for _, tt := range tests {
+		got, ok := reversePrefix(tt.name)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("reversePrefix(%q) = %s, want none", tt.name, got)
+			}
+			continue
+		}
+		if !ok || got != netip.MustParsePrefix(tt.want) {
+			t.Errorf("reversePrefix(%q) = %s, %v, want %s", tt.name, got, ok, tt.want)
+		}
+	}
+}
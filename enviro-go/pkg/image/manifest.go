@@ -0,0 +1,139 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Media types of the manifests and indexes images are pulled by. Docker's
+// schema 1 manifests are not supported.
+const (
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// manifestAccept is the Accept header of manifest requests
+var manifestAccept = strings.Join([]string{MediaTypeOCIIndex, MediaTypeOCIManifest, MediaTypeDockerList, MediaTypeDockerManifest}, ", ")
+
+// maxManifestSize bounds the manifests and indexes read
+const maxManifestSize = 4 << 20
+
+// Descriptor references content by digest, as in OCI manifests
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    Digest    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Platform is what an image of a multi-platform index runs on
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// DefaultPlatform is the platform of this build, e.g. linux/amd64
+func DefaultPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// ParsePlatform parses "os/arch" or "os/arch/variant", e.g. "linux/arm64"
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("image: platform %q is not os/arch[/variant]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// matches reports whether an image for other runs on p. Without a variant,
+// p runs any variant of its architecture.
+func (p Platform) matches(other Platform) bool {
+	return p.OS == other.OS && p.Architecture == other.Architecture &&
+		(p.Variant == "" || p.Variant == other.Variant)
+}
+
+// manifest is an OCI image manifest or a Docker schema 2 manifest, or an
+// index or manifest list of them
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// parseManifest decodes a manifest or index, served as mediaType
+func parseManifest(data []byte, mediaType string) (*manifest, error) {
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("image: invalid manifest: %w", err)
+	}
+	if m.MediaType == "" {
+		// OCI manifests needn't name their media type
+		m.MediaType, _, _ = strings.Cut(mediaType, ";")
+	}
+	if m.SchemaVersion != 2 {
+		return nil, fmt.Errorf("image: unsupported manifest schema version %d", m.SchemaVersion)
+	}
+	switch m.MediaType {
+	case MediaTypeOCIIndex, MediaTypeDockerList:
+		if m.Manifests == nil {
+			return nil, fmt.Errorf("image: index has no manifests")
+		}
+		// The manifest picked is fetched by this digest, which is only
+		// verified if it is one
+		for _, d := range m.Manifests {
+			if _, err := ParseDigest(string(d.Digest)); err != nil {
+				return nil, err
+			}
+		}
+	case MediaTypeOCIManifest, MediaTypeDockerManifest:
+		if m.Config.Digest == "" {
+			return nil, fmt.Errorf("image: manifest has no config")
+		}
+		for _, d := range append([]Descriptor{m.Config}, m.Layers...) {
+			if _, err := ParseDigest(string(d.Digest)); err != nil {
+				return nil, err
+			}
+			if d.Size < 0 {
+				return nil, fmt.Errorf("image: %s has a negative size", d.Digest)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("image: unsupported manifest media type %q", m.MediaType)
+	}
+	return &m, nil
+}
+
+// isIndex reports whether m is an index of manifests per platform
+func (m *manifest) isIndex() bool {
+	return m.MediaType == MediaTypeOCIIndex || m.MediaType == MediaTypeDockerList
+}
+
+// forPlatform returns the manifest of index m for p
+func (m *manifest) forPlatform(p Platform) (Descriptor, error) {
+	for _, d := range m.Manifests {
+		if d.Platform != nil && p.matches(*d.Platform) {
+			return d, nil
+		}
+	}
+	return Descriptor{}, fmt.Errorf("image: no manifest for platform %s", p)
+}
@@ -0,0 +1,184 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testLayerDigest = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+
+func TestParseManifest(t *testing.T) {
+	image := func(mediaType, config, layer string) string {
+		return fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,
+			"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":100},
+			"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q,"size":200}]}`,
+			mediaType, config, layer)
+	}
+	index := func(digest string) string {
+		return fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[
+			{"mediaType":%q,"digest":%q,"size":300,"platform":{"os":"linux","architecture":"amd64"}}]}`,
+			MediaTypeOCIIndex, MediaTypeOCIManifest, digest)
+	}
+
+	tests := []struct {
+		name          string
+		data          string
+		mediaType     string
+		wantMediaType string
+		wantIndex     bool
+		wantErr       string
+	}{
+		{
+			name:          "oci manifest",
+			data:          image(MediaTypeOCIManifest, testDigest, testLayerDigest),
+			wantMediaType: MediaTypeOCIManifest,
+		},
+		{
+			name:          "docker manifest",
+			data:          image(MediaTypeDockerManifest, testDigest, testLayerDigest),
+			wantMediaType: MediaTypeDockerManifest,
+		},
+		{
+			name:          "media type from the response",
+			data:          strings.Replace(image("", testDigest, testLayerDigest), `"mediaType":"",`, "", 1),
+			mediaType:     MediaTypeOCIManifest + "; charset=utf-8",
+			wantMediaType: MediaTypeOCIManifest,
+		},
+		{
+			name:          "oci index",
+			data:          index(testDigest),
+			wantMediaType: MediaTypeOCIIndex,
+			wantIndex:     true,
+		},
+		{
+			name:          "docker manifest list",
+			data:          strings.Replace(index(testDigest), MediaTypeOCIIndex, MediaTypeDockerList, 1),
+			wantMediaType: MediaTypeDockerList,
+			wantIndex:     true,
+		},
+		{name: "not json", data: "<html>", wantErr: "invalid manifest"},
+		{name: "schema 1", data: `{"schemaVersion":1,"mediaType":"` + MediaTypeDockerManifest + `"}`, wantErr: "schema version 1"},
+		{name: "unknown media type", data: `{"schemaVersion":2,"mediaType":"text/plain"}`, wantErr: "unsupported manifest media type"},
+		{name: "no media type", data: `{"schemaVersion":2}`, wantErr: "unsupported manifest media type"},
+		{name: "no config", data: `{"schemaVersion":2,"mediaType":"` + MediaTypeOCIManifest + `"}`, wantErr: "no config"},
+		{
+			name:    "invalid config digest",
+			data:    image(MediaTypeOCIManifest, "sha256:abc", testLayerDigest),
+			wantErr: "not a sha256 digest",
+		},
+		{
+			name:    "invalid layer digest",
+			data:    image(MediaTypeOCIManifest, testDigest, "md5:d41d8cd98f00b204e9800998ecf8427e"),
+			wantErr: "not a sha256 digest",
+		},
+		{
+			name:    "negative size",
+			data:    strings.Replace(image(MediaTypeOCIManifest, testDigest, testLayerDigest), `"size":200`, `"size":-1`, 1),
+			wantErr: "negative size",
+		},
+		{name: "index without manifests", data: `{"schemaVersion":2,"mediaType":"` + MediaTypeOCIIndex + `"}`, wantErr: "no manifests"},
+		{name: "index with invalid digest", data: index("sha256:../../v2/other/manifests/latest"), wantErr: "not a sha256 digest"},
+		{name: "index with tag for digest", data: index("latest"), wantErr: "not a sha256 digest"},
+		{name: "index with other algorithm", data: index("sha512:" + strings.Repeat("a", 128)), wantErr: "not a sha256 digest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseManifest([]byte(tt.data), tt.mediaType)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseManifest() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseManifest(): %v", err)
+			}
+			if m.MediaType != tt.wantMediaType || m.isIndex() != tt.wantIndex {
+				t.Errorf("parseManifest() media type %s, index %v, want %s, %v", m.MediaType, m.isIndex(), tt.wantMediaType, tt.wantIndex)
+			}
+			if !tt.wantIndex && (m.Config.Digest != testDigest || len(m.Layers) != 1 || m.Layers[0].Digest != testLayerDigest) {
+				t.Errorf("parseManifest() config %s, layers %v", m.Config.Digest, m.Layers)
+			}
+		})
+	}
+}
+
+func TestForPlatform(t *testing.T) {
+	digest := func(i int) Digest {
+		return Digest(fmt.Sprintf("sha256:%064d", i))
+	}
+	m := &manifest{MediaType: MediaTypeOCIIndex, Manifests: []Descriptor{
+		{Digest: digest(1), Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: digest(2), Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{Digest: digest(3), Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{Digest: digest(4)},
+		{Digest: digest(5), Platform: &Platform{OS: "windows", Architecture: "amd64"}},
+	}}
+
+	tests := []struct {
+		platform string
+		want     Digest
+	}{
+		{platform: "linux/amd64", want: digest(1)},
+		{platform: "linux/arm/v7", want: digest(3)},
+		{platform: "linux/arm", want: digest(2)},
+		{platform: "windows/amd64", want: digest(5)},
+		{platform: "linux/arm64"},
+		{platform: "linux/arm/v8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			p, err := ParsePlatform(tt.platform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := m.forPlatform(p)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("forPlatform(%s) = %s, want an error", p, d.Digest)
+				}
+				return
+			}
+			if err != nil || d.Digest != tt.want {
+				t.Errorf("forPlatform(%s) = %s, %v, want %s", p, d.Digest, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Platform
+		wantErr bool
+	}{
+		{in: "linux/amd64", want: Platform{OS: "linux", Architecture: "amd64"}},
+		{in: "linux/arm/v7", want: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{in: "linux", wantErr: true},
+		{in: "linux/", wantErr: true},
+		{in: "/amd64", wantErr: true},
+		{in: "linux/arm/v7/extra", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePlatform(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePlatform(%q) = %+v, %v, want %+v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil && got.String() != tt.in {
+			t.Errorf("%+v.String() = %q, want %q", got, got.String(), tt.in)
+		}
+	}
+}
+
+func TestParseManifestIndexErrors(t *testing.T) {
+	// Index entries are checked before any is fetched, whatever the
+	// platform
+	data := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[
+		{"digest":%q,"platform":{"os":"linux","architecture":"amd64"}},
+		{"digest":"sha256:bad","platform":{"os":"linux","architecture":"arm64"}}]}`, MediaTypeOCIIndex, testDigest)
+	if _, err := parseManifest([]byte(data), ""); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("parseManifest() error = %v, want %v", err, ErrInvalidReference)
+	}
+}
@@ -0,0 +1,556 @@
+// Package image pulls OCI and Docker images from registries into a
+// content-addressed cache shared by every container of the node. Blobs are
+// kept by digest and verified as they are downloaded; concurrent pulls of
+// an image share one pull, and of a layer one download.
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxConcurrentDownloads bounds the blobs downloaded at once,
+// across pulls, unless Config says otherwise
+const DefaultMaxConcurrentDownloads = 4
+
+// blobAttempts is how often a blob download is tried before the pull fails
+const blobAttempts = 3
+
+// sharedProgressInterval is how often the progress of a layer downloaded
+// by another pull is updated
+const sharedProgressInterval = 250 * time.Millisecond
+
+// Config configures a Puller
+type Config struct {
+	// Dir is the cache directory, created if needed
+	Dir string
+	// Keychain returns the credentials of registries; nil pulls
+	// anonymously
+	Keychain Keychain
+	// PlainHTTP lists the registries served over HTTP rather than HTTPS,
+	// e.g. "localhost:5000"
+	PlainHTTP []string
+	// Platform selects the image of multi-platform indexes,
+	// DefaultPlatform when zero
+	Platform Platform
+	// MaxConcurrentDownloads defaults to DefaultMaxConcurrentDownloads
+	MaxConcurrentDownloads int
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Logger defaults to slog.Default()
+	Logger *slog.Logger
+}
+
+// Policy is when Pull contacts the registry
+type Policy int
+
+const (
+	// PullIfMissing returns the cached image of a reference if there is
+	// one
+	PullIfMissing Policy = iota
+	// PullAlways resolves tags again, downloading only the blobs that
+	// aren't cached
+	PullAlways
+)
+
+// Phase is how far a pull got
+type Phase string
+
+const (
+	PhaseResolving   Phase = "resolving"
+	PhaseDownloading Phase = "downloading"
+	PhaseDone        Phase = "done"
+)
+
+// Progress is the state of a pull
+type Progress struct {
+	Reference string
+	Phase     Phase
+	// Layers are set once the manifest is resolved
+	Layers []LayerProgress
+}
+
+// LayerProgress is the download of a layer
+type LayerProgress struct {
+	Digest     Digest
+	Size       int64
+	Downloaded int64
+	// Cached layers were in the cache already
+	Cached bool
+	Done   bool
+}
+
+// Puller pulls images into the cache
+type Puller struct {
+	config   Config
+	store    *store
+	registry *registry
+	log      *slog.Logger
+	// slots bounds the blobs downloaded at once
+	slots chan struct{}
+
+	// gc is held by pulls, and exclusively while removing images
+	gc sync.RWMutex
+
+	mu sync.Mutex
+	// pulls are those running, by reference
+	pulls map[string]*pull
+	// downloads are the blobs being downloaded, by digest
+	downloads map[Digest]*download
+}
+
+// pull is a pull shared by the callers of Pull with the same reference
+type pull struct {
+	ref    Reference
+	policy Policy
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	image  Image
+	err    error
+
+	mu       sync.Mutex
+	progress Progress
+	// waiters are notified of progress, and the pull is cancelled once
+	// none are left
+	waiters map[chan struct{}]bool
+}
+
+// download is a blob being downloaded for a pull, which others wait for
+type download struct {
+	done       chan struct{}
+	err        error
+	downloaded atomic.Int64
+}
+
+// NewPuller opens the cache at config.Dir
+func NewPuller(config Config) (*Puller, error) {
+	if config.Dir == "" {
+		return nil, errors.New("image: cache directory not configured")
+	}
+	if config.Platform == (Platform{}) {
+		config.Platform = DefaultPlatform()
+	}
+	if config.MaxConcurrentDownloads <= 0 {
+		config.MaxConcurrentDownloads = DefaultMaxConcurrentDownloads
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.Keychain == nil {
+		config.Keychain = func(string) (Credentials, bool) { return Credentials{}, false }
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	s, err := openStore(config.Dir, config.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image cache: %w", err)
+	}
+	return &Puller{
+		config:    config,
+		store:     s,
+		registry:  newRegistry(config.HTTPClient, config.Keychain, config.PlainHTTP),
+		log:       config.Logger,
+		slots:     make(chan struct{}, config.MaxConcurrentDownloads),
+		pulls:     make(map[string]*pull),
+		downloads: make(map[Digest]*download),
+	}, nil
+}
+
+// Close cancels the pulls running and closes the cache
+func (p *Puller) Close() error {
+	p.mu.Lock()
+	for _, pl := range p.pulls {
+		pl.cancel()
+	}
+	p.mu.Unlock()
+	p.gc.Lock()
+	defer p.gc.Unlock()
+	return p.store.close()
+}
+
+// Platform returns the platform images are pulled for
+func (p *Puller) Platform() Platform {
+	return p.config.Platform
+}
+
+// BlobPath returns the file a blob of a cached image is kept in. Layers
+// are kept as the registry serves them, usually gzipped tarballs.
+func (p *Puller) BlobPath(d Digest) string {
+	return p.store.blobPath(d)
+}
+
+// Images returns the cached images ordered by reference
+func (p *Puller) Images() []Image {
+	return p.store.list()
+}
+
+// Image returns the cached image of ref
+func (p *Puller) Image(ref string) (Image, error) {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return Image{}, err
+	}
+	img, ok := p.store.image(r.String())
+	if !ok {
+		return Image{}, fmt.Errorf("%w: image %s is not cached", ErrNotFound, r)
+	}
+	return img, nil
+}
+
+// Remove forgets the cached image of ref and deletes the blobs no other
+// image uses, returning the image and the bytes freed. It waits for the
+// pulls running.
+func (p *Puller) Remove(ref string) (Image, int64, error) {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return Image{}, 0, err
+	}
+	p.gc.Lock()
+	defer p.gc.Unlock()
+	return p.store.remove(r.String())
+}
+
+// Pull returns the image of ref, pulling it into the cache as policy says.
+// A pull of the same reference running already is joined. progress, if
+// not nil, is called on the caller's goroutine as the pull progresses,
+// skipping updates it is too slow for. The pull is cancelled once every
+// caller's ctx is done.
+func (p *Puller) Pull(ctx context.Context, ref string, policy Policy, progress func(Progress)) (Image, error) {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return Image{}, err
+	}
+	if policy == PullIfMissing {
+		if img, ok := p.store.image(r.String()); ok {
+			if progress != nil {
+				progress(Progress{Reference: r.String(), Phase: PhaseDone, Layers: cachedLayers(img)})
+			}
+			return img, nil
+		}
+	}
+
+	pl, updates := p.join(r, policy)
+	defer p.leave(pl, updates)
+	var last Phase
+	report := func() {
+		if progress != nil {
+			pr := pl.snapshot()
+			last = pr.Phase
+			progress(pr)
+		}
+	}
+	for {
+		select {
+		case <-updates:
+			report()
+		case <-pl.done:
+			if pl.err == nil && last != PhaseDone {
+				report()
+			}
+			return pl.image, pl.err
+		case <-ctx.Done():
+			return Image{}, ctx.Err()
+		}
+	}
+}
+
+// join returns the pull of r, starting it unless running, and the channel
+// the caller is notified of its progress on
+func (p *Puller) join(r Reference, policy Policy) (*pull, chan struct{}) {
+	key := r.String()
+	updates := make(chan struct{}, 1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A running pull serves PullAlways only if it resolves the tag too,
+	// and none once cancelled by its last caller leaving
+	if pl, ok := p.pulls[key]; ok && (pl.policy == PullAlways || policy == PullIfMissing) {
+		pl.mu.Lock()
+		joined := pl.ctx.Err() == nil
+		if joined {
+			pl.waiters[updates] = true
+		}
+		pl.mu.Unlock()
+		if joined {
+			return pl, updates
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pl := &pull{
+		ref:      r,
+		policy:   policy,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		progress: Progress{Reference: key, Phase: PhaseResolving},
+		waiters:  map[chan struct{}]bool{updates: true},
+	}
+	p.pulls[key] = pl
+	go func() {
+		pl.image, pl.err = p.run(pl)
+		cancel()
+		p.mu.Lock()
+		if p.pulls[key] == pl {
+			delete(p.pulls, key)
+		}
+		p.mu.Unlock()
+		close(pl.done)
+	}()
+	return pl, updates
+}
+
+// leave stops notifying updates, cancelling the pull if no caller waits
+// for it anymore
+func (p *Puller) leave(pl *pull, updates chan struct{}) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	delete(pl.waiters, updates)
+	if len(pl.waiters) == 0 {
+		pl.cancel()
+	}
+}
+
+// run pulls the image of pl
+func (p *Puller) run(pl *pull) (Image, error) {
+	p.gc.RLock()
+	defer p.gc.RUnlock()
+	ctx, ref := pl.ctx, pl.ref
+	logger := p.log.With("image", ref.String())
+	start := time.Now()
+
+	data, mediaType, digest, err := p.registry.fetchManifest(ctx, ref, ref.manifestRef())
+	if err != nil {
+		return Image{}, err
+	}
+	m, err := parseManifest(data, mediaType)
+	if err != nil {
+		return Image{}, err
+	}
+	img := Image{Reference: ref.String(), Platform: p.config.Platform}
+	if m.isIndex() {
+		if err := p.putBlob(Descriptor{MediaType: m.MediaType, Digest: digest, Size: int64(len(data))}, data); err != nil {
+			return Image{}, err
+		}
+		img.Index = digest
+		desc, err := m.forPlatform(p.config.Platform)
+		if err != nil {
+			return Image{}, fmt.Errorf("%w: %s", err, ref)
+		}
+		img.Platform = *desc.Platform
+		if data, mediaType, digest, err = p.registry.fetchManifest(ctx, ref, string(desc.Digest)); err != nil {
+			return Image{}, err
+		}
+		if m, err = parseManifest(data, mediaType); err != nil {
+			return Image{}, err
+		}
+		if m.isIndex() {
+			return Image{}, fmt.Errorf("image: index of %s nests another index", ref)
+		}
+	}
+	img.Manifest = Descriptor{MediaType: m.MediaType, Digest: digest, Size: int64(len(data))}
+	img.Config, img.Layers = m.Config, m.Layers
+	if err := p.putBlob(img.Manifest, data); err != nil {
+		return Image{}, err
+	}
+
+	if cached, ok := p.store.image(img.Reference); ok && cached.Manifest.Digest == img.Manifest.Digest && p.store.missingBlob(cached) == "" {
+		pl.update(func(pr *Progress) {
+			pr.Phase = PhaseDone
+			pr.Layers = cachedLayers(cached)
+		})
+		logger.Debug("Image is up to date", "digest", cached.Manifest.Digest)
+		return cached, nil
+	}
+
+	pl.update(func(pr *Progress) {
+		pr.Phase = PhaseDownloading
+		for _, l := range img.Layers {
+			pr.Layers = append(pr.Layers, LayerProgress{Digest: l.Digest, Size: l.Size})
+		}
+	})
+	if err := p.fetchBlob(ctx, ref, img.Config, func(int64) {}); err != nil {
+		return Image{}, err
+	}
+	if err := p.fetchLayers(pl, img.Layers); err != nil {
+		return Image{}, err
+	}
+
+	img.PulledAt = time.Now().UTC()
+	if err := p.store.put(img); err != nil {
+		return Image{}, err
+	}
+	pl.update(func(pr *Progress) { pr.Phase = PhaseDone })
+	logger.Info("Pulled image", "digest", img.Manifest.Digest, "platform", img.Platform,
+		"layers", len(img.Layers), "size", img.Size(), "duration", time.Since(start))
+	return img, nil
+}
+
+// fetchLayers downloads the layers of pl that aren't cached in parallel,
+// failing on the first error
+func (p *Puller) fetchLayers(pl *pull, layers []Descriptor) error {
+	ctx, cancel := context.WithCancel(pl.ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i, l := range layers {
+		if p.store.hasBlob(l) {
+			pl.update(func(pr *Progress) {
+				pr.Layers[i].Cached, pr.Layers[i].Done, pr.Layers[i].Downloaded = true, true, l.Size
+			})
+			continue
+		}
+		wg.Add(1)
+		go func(i int, l Descriptor) {
+			defer wg.Done()
+			err := p.fetchBlob(ctx, pl.ref, l, func(n int64) {
+				pl.update(func(pr *Progress) { pr.Layers[i].Downloaded = n })
+			})
+			if err != nil {
+				once.Do(func() {
+					firstErr = fmt.Errorf("failed to pull layer %s: %w", l.Digest, err)
+					cancel()
+				})
+				return
+			}
+			pl.update(func(pr *Progress) { pr.Layers[i].Downloaded, pr.Layers[i].Done = l.Size, true })
+		}(i, l)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// fetchBlob downloads the blob of desc unless cached, or waits for the
+// download another pull started. progress is called with the bytes
+// downloaded so far.
+func (p *Puller) fetchBlob(ctx context.Context, ref Reference, desc Descriptor, progress func(int64)) error {
+	for !p.store.hasBlob(desc) {
+		p.mu.Lock()
+		d, shared := p.downloads[desc.Digest]
+		if !shared {
+			d = &download{done: make(chan struct{})}
+			p.downloads[desc.Digest] = d
+		}
+		p.mu.Unlock()
+
+		if !shared {
+			d.err = p.downloadBlob(ctx, ref, desc, func(n int64) { progress(d.downloaded.Add(n)) })
+			p.mu.Lock()
+			delete(p.downloads, desc.Digest)
+			p.mu.Unlock()
+			close(d.done)
+			return d.err
+		}
+
+		ticker := time.NewTicker(sharedProgressInterval)
+	wait:
+		for {
+			select {
+			case <-d.done:
+				break wait
+			case <-ticker.C:
+				progress(d.downloaded.Load())
+			case <-ctx.Done():
+				ticker.Stop()
+				return ctx.Err()
+			}
+		}
+		ticker.Stop()
+		// A download cancelled with its pull is started over by this one
+		if d.err != nil && !errors.Is(d.err, context.Canceled) {
+			return d.err
+		}
+	}
+	return nil
+}
+
+// downloadBlob downloads the blob of desc into the cache, retrying
+// transfers that fail or are corrupted
+func (p *Puller) downloadBlob(ctx context.Context, ref Reference, desc Descriptor, progress func(int64)) error {
+	var err error
+	for attempt := 1; attempt <= blobAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(time.Duration(attempt-1) * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			p.log.Warn("Retrying blob download", "image", ref.String(), "blob", desc.Digest, "attempt", attempt, "error", err)
+		}
+		var written int64
+		err = func() error {
+			select {
+			case p.slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-p.slots }()
+			body, err := p.registry.fetchBlob(ctx, ref, desc)
+			if err != nil {
+				return err
+			}
+			defer body.Close()
+			return p.store.writeBlob(desc, body, func(n int64) {
+				written += n
+				progress(n)
+			})
+		}()
+		if err == nil {
+			return nil
+		}
+		// The next attempt starts over
+		progress(-written)
+		if ctx.Err() != nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnauthorized) {
+			break
+		}
+	}
+	return err
+}
+
+// putBlob caches data as the blob of desc
+func (p *Puller) putBlob(desc Descriptor, data []byte) error {
+	if p.store.hasBlob(desc) {
+		return nil
+	}
+	return p.store.writeBlob(desc, bytes.NewReader(data), func(int64) {})
+}
+
+// update changes the progress of pl with fn and notifies its waiters
+func (pl *pull) update(fn func(*Progress)) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	fn(&pl.progress)
+	for updates := range pl.waiters {
+		select {
+		case updates <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// snapshot returns a copy of the progress of pl
+func (pl *pull) snapshot() Progress {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pr := pl.progress
+	pr.Layers = append([]LayerProgress(nil), pr.Layers...)
+	return pr
+}
+
+// cachedLayers returns the progress of the layers of a cached image
+func cachedLayers(img Image) []LayerProgress {
+	layers := make([]LayerProgress, len(img.Layers))
+	for i, l := range img.Layers {
+		layers[i] = LayerProgress{Digest: l.Digest, Size: l.Size, Downloaded: l.Size, Cached: true, Done: true}
+	}
+	return layers
+}
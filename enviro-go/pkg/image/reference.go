@@ -0,0 +1,135 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidReference is returned for image references that can't be
+// parsed
+var ErrInvalidReference = errors.New("image: invalid reference")
+
+// ErrDigestMismatch is returned for content that doesn't match the digest
+// it was fetched by
+var ErrDigestMismatch = errors.New("image: digest mismatch")
+
+// DockerHub is the registry of references without one, and
+// dockerHubHost the host its registry API is served from
+const (
+	DockerHub     = "docker.io"
+	dockerHubHost = "registry-1.docker.io"
+)
+
+// defaultTag is the tag of references with neither a tag nor a digest
+const defaultTag = "latest"
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	sha256Pattern     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Digest identifies content by its SHA-256, e.g. "sha256:6c3c62...". It is
+// the only algorithm supported.
+type Digest string
+
+// FromBytes returns the digest of data
+func FromBytes(data []byte) Digest {
+	sum := sha256.Sum256(data)
+	return Digest("sha256:" + hex.EncodeToString(sum[:]))
+}
+
+// ParseDigest checks s is a SHA-256 digest
+func ParseDigest(s string) (Digest, error) {
+	if !sha256Pattern.MatchString(s) {
+		return "", fmt.Errorf("%w: %q is not a sha256 digest", ErrInvalidReference, s)
+	}
+	return Digest(s), nil
+}
+
+// Hex returns the hex-encoded hash of d
+func (d Digest) Hex() string {
+	_, hash, _ := strings.Cut(string(d), ":")
+	return hash
+}
+
+// Reference names an image of a registry by tag or digest
+type Reference struct {
+	// Registry is the host and port of the registry, DockerHub for
+	// references without one
+	Registry string
+	// Repository is e.g. "library/nginx"
+	Repository string
+	// Tag is empty for references by digest only
+	Tag string
+	// Digest pins the manifest, if set
+	Digest Digest
+}
+
+// ParseReference parses references as docker does: "nginx" is
+// "docker.io/library/nginx:latest", and the first component of a name is
+// its registry when it has a dot or a port or is "localhost", e.g.
+// "ghcr.io/org/app:v1" or "localhost:5000/app@sha256:...".
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		d, err := ParseDigest(name[i+1:])
+		if err != nil {
+			return Reference{}, err
+		}
+		ref.Digest, name = d, name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i+1:], "/") {
+		ref.Tag, name = name[i+1:], name[:i]
+		if !tagPattern.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("%w: %q has an invalid tag", ErrInvalidReference, s)
+		}
+	}
+
+	ref.Registry = DockerHub
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.Registry, name = first, rest
+	}
+	if ref.Registry == DockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !repositoryPattern.MatchString(name) {
+		return Reference{}, fmt.Errorf("%w: %q has an invalid repository", ErrInvalidReference, s)
+	}
+	ref.Repository = name
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	return ref, nil
+}
+
+// String returns the canonical form of r, e.g.
+// "docker.io/library/nginx:latest"
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + string(r.Digest)
+	}
+	return s
+}
+
+// Name returns r without its tag and digest
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// manifestRef returns what the manifest of r is fetched by
+func (r Reference) manifestRef() string {
+	if r.Digest != "" {
+		return string(r.Digest)
+	}
+	return r.Tag
+}
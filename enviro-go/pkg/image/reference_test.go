@@ -0,0 +1,102 @@
+package image
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Reference
+	}{
+		{in: "nginx", want: Reference{Registry: DockerHub, Repository: "library/nginx", Tag: "latest"}},
+		{in: "nginx:1.25", want: Reference{Registry: DockerHub, Repository: "library/nginx", Tag: "1.25"}},
+		{in: "bitnami/redis", want: Reference{Registry: DockerHub, Repository: "bitnami/redis", Tag: "latest"}},
+		{in: "docker.io/library/nginx:latest", want: Reference{Registry: DockerHub, Repository: "library/nginx", Tag: "latest"}},
+		{in: "ghcr.io/org/app:v1", want: Reference{Registry: "ghcr.io", Repository: "org/app", Tag: "v1"}},
+		{in: "ghcr.io/app", want: Reference{Registry: "ghcr.io", Repository: "app", Tag: "latest"}},
+		{in: "localhost/app", want: Reference{Registry: "localhost", Repository: "app", Tag: "latest"}},
+		{in: "localhost:5000/app", want: Reference{Registry: "localhost:5000", Repository: "app", Tag: "latest"}},
+		{in: "registry:5000/team/app:v2", want: Reference{Registry: "registry:5000", Repository: "team/app", Tag: "v2"}},
+		{in: "nginx@" + testDigest, want: Reference{Registry: DockerHub, Repository: "library/nginx", Digest: testDigest}},
+		{
+			in:   "localhost:5000/app:v1@" + testDigest,
+			want: Reference{Registry: "localhost:5000", Repository: "app", Tag: "v1", Digest: testDigest},
+		},
+		{in: "org/my_app.v2-beta", want: Reference{Registry: DockerHub, Repository: "org/my_app.v2-beta", Tag: "latest"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseReference(tt.in)
+			if err != nil {
+				t.Fatalf("ParseReference(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseReference(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+			// The canonical form parses back to the same reference
+			again, err := ParseReference(got.String())
+			if err != nil || again != got {
+				t.Errorf("ParseReference(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+			}
+		})
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"Nginx",
+		"nginx:",
+		"nginx:-tag",
+		"nginx:" + strings.Repeat("a", 129),
+		"nginx@sha256:abc",
+		"nginx@sha512:" + strings.Repeat("a", 128),
+		"nginx@" + strings.ToUpper(testDigest),
+		"org//app",
+		"org/app/",
+		"-app",
+		"app..name",
+		"ghcr.io/",
+		"ghcr.io/Org/app",
+	} {
+		t.Run(in, func(t *testing.T) {
+			if ref, err := ParseReference(in); !errors.Is(err, ErrInvalidReference) {
+				t.Errorf("ParseReference(%q) = %+v, %v, want %v", in, ref, err, ErrInvalidReference)
+			}
+		})
+	}
+}
+
+func TestReferenceManifestRef(t *testing.T) {
+	tests := []struct {
+		ref  Reference
+		want string
+	}{
+		{ref: Reference{Tag: "v1"}, want: "v1"},
+		{ref: Reference{Digest: testDigest}, want: testDigest},
+		{ref: Reference{Tag: "v1", Digest: testDigest}, want: testDigest},
+	}
+	for _, tt := range tests {
+		if got := tt.ref.manifestRef(); got != tt.want {
+			t.Errorf("%+v.manifestRef() = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	d := FromBytes([]byte("hello"))
+	if want := Digest("sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"); d != want {
+		t.Errorf("FromBytes(hello) = %s, want %s", d, want)
+	}
+	if _, err := ParseDigest(string(d)); err != nil {
+		t.Errorf("ParseDigest(%s): %v", d, err)
+	}
+	if got := d.Hex(); got != strings.TrimPrefix(string(d), "sha256:") {
+		t.Errorf("Hex() = %s", got)
+	}
+}
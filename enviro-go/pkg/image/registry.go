@@ -0,0 +1,274 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors of registry requests
+var (
+	// ErrNotFound is returned for images and blobs the registry doesn't
+	// have
+	ErrNotFound = errors.New("image: not found")
+	// ErrUnauthorized is returned when the registry refuses the
+	// credentials, or asks for some and there are none
+	ErrUnauthorized = errors.New("image: unauthorized")
+)
+
+// defaultTokenLifetime is how long tokens without an expiry are used
+const defaultTokenLifetime = time.Minute
+
+// Credentials authenticate pulls from a registry
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Keychain returns the credentials of a registry by its host, e.g.
+// "ghcr.io" or DockerHub, false to pull anonymously
+type Keychain func(registry string) (Credentials, bool)
+
+// registry pulls from registries over the OCI distribution API,
+// authenticating as they challenge to
+type registry struct {
+	client   *http.Client
+	keychain Keychain
+	// plainHTTP holds the registries served over HTTP
+	plainHTTP map[string]bool
+
+	mu sync.Mutex
+	// tokens holds the bearer tokens by registry and repository
+	tokens map[string]bearerToken
+}
+
+type bearerToken struct {
+	token   string
+	expires time.Time
+}
+
+func newRegistry(client *http.Client, keychain Keychain, plainHTTP []string) *registry {
+	r := &registry{
+		client:    client,
+		keychain:  keychain,
+		plainHTTP: make(map[string]bool),
+		tokens:    make(map[string]bearerToken),
+	}
+	for _, host := range plainHTTP {
+		r.plainHTTP[host] = true
+	}
+	return r
+}
+
+// fetchManifest returns the manifest or index of ref, its media type and
+// digest. Manifests fetched by digest are verified.
+func (r *registry) fetchManifest(ctx context.Context, ref Reference, manifestRef string) ([]byte, string, Digest, error) {
+	resp, err := r.get(ctx, ref, "manifests/"+manifestRef, manifestAccept)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if len(data) > maxManifestSize {
+		return nil, "", "", fmt.Errorf("image: manifest of %s is larger than %d bytes", ref, maxManifestSize)
+	}
+	digest := FromBytes(data)
+	if strings.HasPrefix(manifestRef, "sha256:") && digest != Digest(manifestRef) {
+		return nil, "", "", fmt.Errorf("%w: manifest %s of %s", ErrDigestMismatch, manifestRef, ref.Name())
+	}
+	return data, resp.Header.Get("Content-Type"), digest, nil
+}
+
+// fetchBlob opens the blob of desc in the repository of ref. Its content
+// is verified by the caller.
+func (r *registry) fetchBlob(ctx context.Context, ref Reference, desc Descriptor) (io.ReadCloser, error) {
+	resp, err := r.get(ctx, ref, "blobs/"+string(desc.Digest), "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// get requests path of the repository of ref, authenticating when the
+// registry challenges the request. The response is successful.
+func (r *registry) get(ctx context.Context, ref Reference, path, accept string) (*http.Response, error) {
+	scheme, host := "https", ref.Registry
+	if r.plainHTTP[ref.Registry] {
+		scheme = "http"
+	}
+	if host == DockerHub {
+		host = dockerHubHost
+	}
+	target := fmt.Sprintf("%s://%s/v2/%s/%s", scheme, host, ref.Repository, path)
+	tokenKey := ref.Registry + "/" + ref.Repository
+
+	var challenged bool
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if token, ok := r.token(tokenKey); ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if creds, ok := r.keychain(ref.Registry); ok && challenged {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		err = responseError(resp, ref, path)
+		if resp.StatusCode != http.StatusUnauthorized || challenged {
+			return nil, err
+		}
+
+		challenged = true
+		scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			if err := r.authenticate(ctx, ref, tokenKey, params); err != nil {
+				return nil, err
+			}
+		case "basic":
+			if _, ok := r.keychain(ref.Registry); !ok {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+	}
+}
+
+// token returns the unexpired bearer token of key
+func (r *registry) token(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tokens[key]
+	if !ok || time.Now().After(t.expires) {
+		delete(r.tokens, key)
+		return "", false
+	}
+	return t.token, true
+}
+
+// authenticate gets a token to pull the repository of ref from the token
+// service of a bearer challenge, with the registry's credentials if any
+func (r *registry) authenticate(ctx context.Context, ref Reference, key string, params map[string]string) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || (realm.Scheme != "https" && realm.Scheme != "http") {
+		return fmt.Errorf("%w: %s challenged with invalid realm %q", ErrUnauthorized, ref.Registry, params["realm"])
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", "repository:"+ref.Repository+":pull")
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if creds, ok := r.keychain(ref.Registry); ok {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get token for %s: %w", ref.Name(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: token service of %s returned %s", ErrUnauthorized, ref.Registry, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return fmt.Errorf("invalid token response from %s: %w", ref.Registry, err)
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return fmt.Errorf("%w: token service of %s returned no token", ErrUnauthorized, ref.Registry)
+	}
+	lifetime := defaultTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	r.mu.Lock()
+	// Expire early rather than fail requests in flight
+	r.tokens[key] = bearerToken{token: token, expires: time.Now().Add(lifetime * 9 / 10)}
+	r.mu.Unlock()
+	return nil
+}
+
+// responseError returns the error of an unsuccessful response, closing
+// its body
+func responseError(resp *http.Response, ref Reference, path string) error {
+	defer resp.Body.Close()
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	msg := resp.Status
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil && len(body.Errors) > 0 {
+		msg = body.Errors[0].Code + ": " + body.Errors[0].Message
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s %s: %s", ErrNotFound, ref.Name(), path, msg)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w: %s %s: %s", ErrUnauthorized, ref.Name(), path, msg)
+	}
+	return fmt.Errorf("image: %s %s: %s", ref.Name(), path, msg)
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			end := strings.Index(after[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, rest = after[1:end+1], after[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(after, ",")
+			rest = "," + rest
+		}
+		params[key] = value
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), ","))
+	}
+	return scheme, params
+}
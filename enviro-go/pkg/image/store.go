@@ -0,0 +1,286 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// imagesFileName is the file of the cache directory the pulled images are
+// kept in, and imagesVersion bumped on incompatible changes to it
+const (
+	imagesFileName = "images.json"
+	imagesVersion  = 1
+)
+
+// Image is an image pulled into the cache. Its manifest, config and layers
+// are blobs of the cache, read from BlobPath.
+type Image struct {
+	// Reference is the canonical reference the image was pulled by
+	Reference string `json:"reference"`
+	// Manifest is the manifest of the image for Platform
+	Manifest Descriptor `json:"manifest"`
+	// Index is the digest of the multi-platform index Reference resolved
+	// to, if any
+	Index    Digest       `json:"index,omitempty"`
+	Platform Platform     `json:"platform"`
+	Config   Descriptor   `json:"config"`
+	Layers   []Descriptor `json:"layers"`
+	PulledAt time.Time    `json:"pulled_at"`
+}
+
+// Size returns the size of the image's config and layers
+func (i Image) Size() int64 {
+	size := i.Config.Size
+	for _, l := range i.Layers {
+		size += l.Size
+	}
+	return size
+}
+
+// blobs returns the digests of every blob of i
+func (i Image) blobs() []Digest {
+	digests := []Digest{i.Manifest.Digest, i.Config.Digest}
+	if i.Index != "" {
+		digests = append(digests, i.Index)
+	}
+	for _, l := range i.Layers {
+		digests = append(digests, l.Digest)
+	}
+	return digests
+}
+
+type imagesFile struct {
+	Version int              `json:"version"`
+	Images  map[string]Image `json:"images"`
+}
+
+// store keeps blobs by digest under blobs/sha256 of its directory, shared
+// by every image, and the images pulled
+type store struct {
+	dir   string
+	state *storage.Store
+	log   *slog.Logger
+
+	mu sync.Mutex
+	// images holds the pulled images by reference
+	images map[string]Image
+}
+
+func openStore(dir string, logger *slog.Logger) (*store, error) {
+	state, err := storage.Open(storage.Config{Dir: dir, Logger: logger})
+	if err != nil {
+		return nil, err
+	}
+	s := &store{dir: dir, state: state, log: logger, images: make(map[string]Image)}
+	// Downloads interrupted by a restart start over
+	if err := os.RemoveAll(s.ingestDir()); err != nil {
+		return nil, err
+	}
+	for _, d := range []string{s.ingestDir(), filepath.Join(dir, "blobs", "sha256")} {
+		if err := os.MkdirAll(d, 0o700); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := state.Read(imagesFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file imagesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", storage.ErrCorrupt, imagesFileName, err)
+	}
+	if file.Version != imagesVersion {
+		return nil, fmt.Errorf("image cache %s has unsupported version %d", imagesFileName, file.Version)
+	}
+	for ref, img := range file.Images {
+		if missing := s.missingBlob(img); missing != "" {
+			logger.Warn("Forgetting cached image with a missing blob", "image", ref, "blob", missing)
+			continue
+		}
+		s.images[ref] = img
+	}
+	return s, nil
+}
+
+func (s *store) close() error {
+	return s.state.Close()
+}
+
+func (s *store) ingestDir() string {
+	return filepath.Join(s.dir, "ingest")
+}
+
+// blobPath returns where the blob of d is kept
+func (s *store) blobPath(d Digest) string {
+	return filepath.Join(s.dir, "blobs", "sha256", d.Hex())
+}
+
+// hasBlob reports whether the blob of desc is cached
+func (s *store) hasBlob(desc Descriptor) bool {
+	fi, err := os.Stat(s.blobPath(desc.Digest))
+	return err == nil && fi.Mode().IsRegular() && fi.Size() == desc.Size
+}
+
+// missingBlob returns a blob of img that isn't cached, if any
+func (s *store) missingBlob(img Image) Digest {
+	for _, d := range append([]Descriptor{img.Manifest, img.Config}, img.Layers...) {
+		if !s.hasBlob(d) {
+			return d.Digest
+		}
+	}
+	return ""
+}
+
+// writeBlob caches the content of desc read from r, reporting the bytes
+// read to progress. Content that doesn't match desc is discarded.
+func (s *store) writeBlob(desc Descriptor, r io.Reader, progress func(n int64)) error {
+	f, err := os.CreateTemp(s.ingestDir(), desc.Digest.Hex()+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	buf := make([]byte, 32<<10)
+	var n int64
+	for {
+		m, err := r.Read(buf)
+		if m > 0 {
+			if _, err := w.Write(buf[:m]); err != nil {
+				f.Close()
+				return err
+			}
+			n += int64(m)
+			if n > desc.Size {
+				break
+			}
+			progress(int64(m))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if n != desc.Size {
+		return fmt.Errorf("%w: %s is %d bytes, not %d", ErrDigestMismatch, desc.Digest, n, desc.Size)
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); Digest(got) != desc.Digest {
+		return fmt.Errorf("%w: got %s for %s", ErrDigestMismatch, got, desc.Digest)
+	}
+	return os.Rename(f.Name(), s.blobPath(desc.Digest))
+}
+
+// image returns the image pulled by ref
+func (s *store) image(ref string) (Image, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img, ok := s.images[ref]
+	return img, ok
+}
+
+// list returns the pulled images ordered by reference
+func (s *store) list() []Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	images := make([]Image, 0, len(s.images))
+	for _, img := range s.images {
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Reference < images[j].Reference })
+	return images
+}
+
+// put records img as pulled by its reference
+func (s *store) put(img Image) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.images[img.Reference]
+	s.images[img.Reference] = img
+	if err := s.save(); err != nil {
+		if existed {
+			s.images[img.Reference] = prev
+		} else {
+			delete(s.images, img.Reference)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove forgets the image of ref and deletes the blobs no other image
+// uses, returning the bytes freed. Callers must keep pulls from adding
+// blobs meanwhile.
+func (s *store) remove(ref string) (Image, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img, ok := s.images[ref]
+	if !ok {
+		return Image{}, 0, fmt.Errorf("%w: image %s is not cached", ErrNotFound, ref)
+	}
+	delete(s.images, ref)
+	if err := s.save(); err != nil {
+		s.images[ref] = img
+		return Image{}, 0, err
+	}
+
+	used := make(map[Digest]bool)
+	for _, other := range s.images {
+		for _, d := range other.blobs() {
+			used[d] = true
+		}
+	}
+	var freed int64
+	for _, d := range img.blobs() {
+		if used[d] {
+			continue
+		}
+		used[d] = true
+		path := s.blobPath(d)
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			s.log.Warn("Failed to delete blob", "blob", d, "error", err)
+			continue
+		}
+		freed += fi.Size()
+	}
+	return img, freed, nil
+}
+
+// save writes the images to the cache directory. Callers must hold s.mu.
+func (s *store) save() error {
+	data, err := json.Marshal(imagesFile{Version: imagesVersion, Images: s.images})
+	if err != nil {
+		return err
+	}
+	return s.state.Write(imagesFileName, data)
+}
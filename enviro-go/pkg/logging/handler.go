@@ -0,0 +1,202 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SubsystemKey is the attribute naming the subsystem that logged a record
+const SubsystemKey = "subsystem"
+
+// allLevels lets sinks handle every record; the logger in front of them
+// decides which records are logged
+var allLevels = slog.Level(math.MinInt)
+
+// NewHandler creates a sink writing records to w in format, "text" (the
+// default) or "json". It handles records of every level, so it is meant
+// to be passed to Fanout.
+func NewHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: allLevels}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// NewCallbackHandler creates a sink passing each record to fn, encoded as
+// a JSON object without a trailing newline. fn is called with one record
+// at a time and must not keep record after returning.
+func NewCallbackHandler(fn func(level slog.Level, record []byte)) slog.Handler {
+	cw := &callbackWriter{fn: fn}
+	return &callbackHandler{
+		Handler: slog.NewJSONHandler(cw, &slog.HandlerOptions{Level: allLevels}),
+		out:     cw,
+	}
+}
+
+// callbackWriter passes what the JSON handler writes, one record per
+// write, to the callback
+type callbackWriter struct {
+	mu sync.Mutex
+	// level is that of the record being written
+	level slog.Level
+	fn    func(slog.Level, []byte)
+}
+
+func (w *callbackWriter) Write(p []byte) (int, error) {
+	w.fn(w.level, bytes.TrimSuffix(p, []byte("\n")))
+	return len(p), nil
+}
+
+type callbackHandler struct {
+	slog.Handler
+	out *callbackWriter
+}
+
+func (h *callbackHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *callbackHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &callbackHandler{Handler: h.Handler.WithAttrs(attrs), out: h.out}
+}
+
+func (h *callbackHandler) WithGroup(name string) slog.Handler {
+	return &callbackHandler{Handler: h.Handler.WithGroup(name), out: h.out}
+}
+
+// Fanout creates a logger passing the records at or above level to every
+// sink enabled for them
+func Fanout(level slog.Leveler, sinks ...slog.Handler) *slog.Logger {
+	var h slog.Handler = multiHandler(sinks)
+	if len(sinks) == 1 {
+		h = sinks[0]
+	}
+	return slog.New(&leveledHandler{inner: h, level: level})
+}
+
+// Levels overrides the level of subsystem loggers. The overrides can be
+// replaced while the loggers are in use.
+type Levels struct {
+	overrides atomic.Pointer[map[string]slog.Level]
+}
+
+// NewLevels creates the overrides, keyed by subsystem name
+func NewLevels(overrides map[string]slog.Level) *Levels {
+	ls := &Levels{}
+	ls.Set(overrides)
+	return ls
+}
+
+// Set replaces the overrides. Subsystems left without one log at the level
+// of their parent logger again.
+func (ls *Levels) Set(overrides map[string]slog.Level) {
+	m := make(map[string]slog.Level, len(overrides))
+	for name, level := range overrides {
+		m[name] = level
+	}
+	ls.overrides.Store(&m)
+}
+
+// Subsystem returns the logger of subsystem name of l, whose records are
+// tagged with SubsystemKey. While name has an override it logs at that
+// level instead of the level of l, given that l was created by this
+// package.
+func (ls *Levels) Subsystem(l *slog.Logger, name string) *slog.Logger {
+	h := l.Handler()
+	if lh, ok := h.(*leveledHandler); ok {
+		h = &leveledHandler{inner: lh.inner, level: subsystemLevel{levels: ls, name: name, parent: lh.level}}
+	}
+	return slog.New(h).With(SubsystemKey, name)
+}
+
+// subsystemLevel is the override of a subsystem, or the level of its
+// parent without one
+type subsystemLevel struct {
+	levels *Levels
+	name   string
+	parent slog.Leveler
+}
+
+func (l subsystemLevel) Level() slog.Level {
+	if level, ok := (*l.levels.overrides.Load())[l.name]; ok {
+		return level
+	}
+	return l.parent.Level()
+}
+
+// leveledHandler drops the records below level before they reach the
+// sinks, which handle all levels
+type leveledHandler struct {
+	inner slog.Handler
+	level slog.Leveler
+}
+
+func (h *leveledHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.inner.Enabled(ctx, level)
+}
+
+func (h *leveledHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *leveledHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &leveledHandler{inner: h.inner.WithAttrs(attrs), level: h.level}
+}
+
+func (h *leveledHandler) WithGroup(name string) slog.Handler {
+	return &leveledHandler{inner: h.inner.WithGroup(name), level: h.level}
+}
+
+// multiHandler passes records to several sinks
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
@@ -0,0 +1,138 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewHandler(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "", want: "level=DEBUG msg=hello key=value\n"},
+		{format: "TEXT", want: "level=DEBUG msg=hello key=value\n"},
+		{format: "json", want: `{"level":"DEBUG","msg":"hello","key":"value"}` + "\n"},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		h, err := NewHandler(&b, tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without a time, so the output is stable
+		h = removeTime{h}
+		slog.New(h).Debug("hello", "key", "value")
+		if b.String() != tt.want {
+			t.Errorf("format %q wrote %q, want %q", tt.format, b.String(), tt.want)
+		}
+	}
+	if _, err := NewHandler(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("NewHandler() of an unknown format succeeded")
+	}
+}
+
+// removeTime drops the time of records
+type removeTime struct{ slog.Handler }
+
+func (h removeTime) Handle(ctx context.Context, r slog.Record) error {
+	r.Time = time.Time{}
+	return h.Handler.Handle(ctx, r)
+}
+
+// callbackRecord is a record passed to a callback
+type callbackRecord struct {
+	level  slog.Level
+	record map[string]any
+}
+
+func TestCallbackHandler(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []callbackRecord
+	)
+	h := NewCallbackHandler(func(level slog.Level, record []byte) {
+		var m map[string]any
+		if err := json.Unmarshal(record, &m); err != nil {
+			t.Errorf("record %q: %v", record, err)
+		}
+		if bytes.HasSuffix(record, []byte("\n")) {
+			t.Errorf("record %q ends with a newline", record)
+		}
+		mu.Lock()
+		got = append(got, callbackRecord{level, m})
+		mu.Unlock()
+	})
+	var level slog.LevelVar
+	level.Set(slog.LevelInfo)
+	l := Fanout(&level, h).With("subsystem", "raft").WithGroup("g")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Warn("warning", "n", 1)
+		}()
+	}
+	wg.Wait()
+	l.Debug("dropped")
+	if len(got) != 10 {
+		t.Fatalf("callback got %d records, want 10", len(got))
+	}
+	for _, r := range got {
+		g, _ := r.record["g"].(map[string]any)
+		if r.level != slog.LevelWarn || r.record["msg"] != "warning" || r.record["subsystem"] != "raft" || g["n"] != 1.0 {
+			t.Errorf("callback got %v %v", r.level, r.record)
+		}
+	}
+}
+
+// TestFanout passes records to the sinks enabled for them, at the level of
+// the logger and any subsystem override
+func TestFanout(t *testing.T) {
+	var all, warn bytes.Buffer
+	allSink, _ := NewHandler(&all, "text")
+	warnSink := slog.NewTextHandler(&warn, &slog.HandlerOptions{Level: slog.LevelWarn})
+	var level slog.LevelVar
+	l := Fanout(&level, allSink, warnSink)
+	levels := NewLevels(map[string]slog.Level{"raft": slog.LevelError})
+	raft := levels.Subsystem(l, "raft")
+	api := levels.Subsystem(l, "api")
+
+	l.Debug("below")
+	l.Info("info")
+	l.Warn("warn")
+	raft.Warn("raft warn")
+	raft.Error("raft error")
+	api.Info("api info")
+
+	// The override goes and api follows the logger's level
+	levels.Set(nil)
+	level.Set(slog.LevelWarn)
+	raft.Warn("raft warn again")
+	api.Info("api dropped")
+
+	lines := func(b *bytes.Buffer) []string {
+		var msgs []string
+		for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			_, msg, _ := strings.Cut(line, "msg=")
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+	wantAll := []string{"info", "warn", `"raft error" subsystem=raft`, `"api info" subsystem=api`, `"raft warn again" subsystem=raft`}
+	if got := lines(&all); strings.Join(got, "|") != strings.Join(wantAll, "|") {
+		t.Errorf("sink of all levels got %q, want %q", got, wantAll)
+	}
+	wantWarn := []string{"warn", `"raft error" subsystem=raft`, `"raft warn again" subsystem=raft`}
+	if got := lines(&warn); strings.Join(got, "|") != strings.Join(wantWarn, "|") {
+		t.Errorf("warn sink got %q, want %q", got, wantWarn)
+	}
+}
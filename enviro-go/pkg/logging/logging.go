@@ -0,0 +1,81 @@
+// Package logging builds the structured loggers used across Enviro and
+// carries request-scoped loggers through contexts.
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// ParseLevel parses a level name such as "debug", "info", "warn" or
+// "error". The empty string is info.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+// New creates a logger writing to w at the given level. Format is "text"
+// (the default) or "json".
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	var v slog.LevelVar
+	v.Set(lvl)
+	return NewLeveled(w, &v, format)
+}
+
+// NewLeveled is like New, but logs at whatever level is currently set in
+// level, so it can be changed at runtime
+func NewLeveled(w io.Writer, level *slog.LevelVar, format string) (*slog.Logger, error) {
+	h, err := NewHandler(w, format)
+	if err != nil {
+		return nil, err
+	}
+	return Fanout(level, h), nil
+}
+
+// ParseLevels parses the levels of subsystems, e.g. "raft=warn,network=debug"
+func ParseLevels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	levels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		name, level, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid subsystem log level %q, want subsystem=level", kv)
+		}
+		if _, err := ParseLevel(level); err != nil {
+			return nil, err
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying l, e.g. with request fields attached
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or fallback if there is none
+func FromContext(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return fallback
+}
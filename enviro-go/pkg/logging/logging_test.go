@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseLevels(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want map[string]string
+		// wantErr is part of the error, none if empty
+		wantErr string
+	}{
+		{name: "empty"},
+		{name: "levels", s: "raft=warn,network=debug", want: map[string]string{"raft": "warn", "network": "debug"}},
+		{name: "no level", s: "raft", wantErr: `invalid subsystem log level "raft"`},
+		{name: "no subsystem", s: "=warn", wantErr: `invalid subsystem log level "=warn"`},
+		{name: "invalid level", s: "raft=loud", wantErr: `invalid log level "loud"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLevels(tt.s)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseLevels() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !maps.Equal(got, tt.want) {
+				t.Errorf("ParseLevels() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+	if level, err := ParseLevel(""); err != nil || level != slog.LevelInfo {
+		t.Errorf("ParseLevel(\"\") = %v, %v, want info", level, err)
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	fallback, l := slog.Default(), slog.Default().With("request", 1)
+	if got := FromContext(context.Background(), fallback); got != fallback {
+		t.Error("FromContext() without a logger didn't return the fallback")
+	}
+	if got := FromContext(WithLogger(context.Background(), l), fallback); got != l {
+		t.Error("FromContext() didn't return the logger of the context")
+	}
+}
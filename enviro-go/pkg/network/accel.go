@@ -0,0 +1,37 @@
+package network
+
+import "fmt"
+
+// SocketAccelerationConfig splices TCP between containers of this node past
+// both kernel stacks once connections are established: eBPF programs
+// attached to the cgroup of each container given a
+// ContainerNetworkSpec.CgroupPath add its sockets to a sockhash, keyed
+// like their conntrack entries, and hand what they send straight to the
+// peer socket. Both containers need a cgroup; other connections take the
+// stack as before.
+//
+// Spliced data skips every packet-level feature, so containers whose
+// traffic is shaped, mirrored, impaired or captured take the stack
+// meanwhile, as do flows the policies deny since. Bytes are counted per
+// message in conntrack and GetStats rather than per packet.
+//
+// Socket acceleration needs the XDP router and a kernel from 5.4. It stays
+// off with a warning elsewhere, see Capabilities.SocketAcceleration.
+type SocketAccelerationConfig struct {
+	Enable bool `json:"enable"`
+}
+
+// validate checks that XDP is enabled
+func (c SocketAccelerationConfig) validate(cfg NetworkConfig) error {
+	if c.Enable && !cfg.EnableXDP {
+		return fmt.Errorf("%w: socket acceleration requires XDP", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// accelerable reports whether TCP of cn may be spliced past the stacks,
+// which skips everything in between: not while its traffic takes the
+// kernel path or is limited, mirrored either way, impaired or captured
+func (cn *ContainerNetwork) accelerable() bool {
+	return !cn.kernelPath() && cn.EgressBps == 0 && len(cn.Mirrors) == 0 && cn.fault == nil && cn.captures == 0
+}
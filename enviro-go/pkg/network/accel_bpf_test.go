@@ -0,0 +1,235 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// accelEchoEnv has the test binary, run as a helper process, connect
+// over TCP between the two addresses it holds, comma-separated, and echo a
+// message back
+const accelEchoEnv = "ENVIRO_TEST_ACCEL_ECHO"
+
+// accelMessage is what accelEcho sends each way
+const accelMessage = "hello"
+
+// accelEcho listens on the first address of addrs, connects from the
+// second and has the message echoed
+func accelEcho(addrs string) error {
+	server, client, _ := strings.Cut(addrs, ",")
+	l, err := net.Listen("tcp", server+":0")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(accelMessage))
+		if _, err := io.ReadFull(conn, buf); err == nil {
+			conn.Write(buf)
+		}
+	}()
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(client)}}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(accelMessage)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(accelMessage))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != accelMessage {
+		return fmt.Errorf("echoed %q, want %q", buf, accelMessage)
+	}
+	return nil
+}
+
+// echoFromCgroup runs accelEcho between server and client from a process
+// in the cgroup dir
+func echoFromCgroup(t *testing.T, dir string, server, client netip.Addr) {
+	t.Helper()
+	fd, err := unix.Open(dir, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), accelEchoEnv+"="+server.String()+","+client.String())
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: fd}
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		t.Fatalf("echo failed: %s", out)
+	}
+	if err != nil {
+		t.Skipf("can't start a process in a cgroup: %v", err)
+	}
+}
+
+func TestSocketAcceleration(t *testing.T) {
+	if !probedKernel().Datapath.SocketAcceleration {
+		t.Skip("kernel can't splice sockets")
+	}
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		t.Fatal(err)
+	}
+	trimPrograms(spec, []DatapathMode{DatapathXDPNative})
+	x := &xdpProgram{socketAcceleration: true}
+	x.applyConnectPolicy(spec)
+	x.applySocketAcceleration(spec)
+	coll, err := ebpf.NewCollection(spec)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("loading eBPF not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(coll.Close)
+	x.setCollection(coll)
+	if !x.hasSocketAcceleration() {
+		t.Fatal("router loaded without socket acceleration")
+	}
+	if err := x.attachSkMsg(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(x.detachSkMsg)
+
+	// Loopback addresses stand in for containers, both in one cgroup
+	server, client := netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.3")
+	const clientIfindex = testIfindex + 1
+	for ifindex, addr := range map[int]netip.Addr{testIfindex: server, clientIfindex: client} {
+		if err := x.AddContainer(ifindex, []netip.Addr{addr}, nil, nil, false, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := testCgroup(t, "enviro-test")
+	a, err := x.attachCgroup(dir, testIfindex, []netip.Addr{server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.detachCgroup(a)
+
+	tests := []struct {
+		name string
+		// excluded is the container excluded from acceleration, if any
+		excluded int
+		// spliced is whether the connection is expected to be spliced
+		spliced bool
+	}{
+		{name: "accelerated", spliced: true},
+		{name: "server excluded", excluded: testIfindex},
+		{name: "client excluded", excluded: clientIfindex},
+	}
+	addrs := map[int]netip.Addr{testIfindex: server, clientIfindex: client}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.excluded != 0 {
+				if err := x.SetAccelerated(tt.excluded, []netip.Addr{addrs[tt.excluded]}, false); err != nil {
+					t.Fatal(err)
+				}
+				defer x.SetAccelerated(tt.excluded, nil, true)
+			}
+			before := map[int]datapathStats{}
+			for ifindex := range addrs {
+				s, err := x.ContainerStats(ifindex)
+				if err != nil {
+					t.Fatal(err)
+				}
+				before[ifindex] = s
+			}
+
+			echoFromCgroup(t, dir, server, client)
+
+			for ifindex := range addrs {
+				s, err := x.ContainerStats(ifindex)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sockets, msgs := s.AccelSockets-before[ifindex].AccelSockets, s.AccelMsgs-before[ifindex].AccelMsgs
+				n := s.AccelBytes - before[ifindex].AccelBytes
+				var want uint64
+				if tt.spliced {
+					want = 1
+				}
+				if sockets != want || msgs != want || n != want*uint64(len(accelMessage)) {
+					t.Errorf("container %d spliced %d sockets, %d messages, %d bytes, want %d, %d, %d",
+						ifindex, sockets, msgs, n, want, want, want*uint64(len(accelMessage)))
+				}
+			}
+		})
+	}
+
+	// Spliced connections are tracked although the router saw no packet
+	if n, err := countEntries(x.conntrack); err != nil || n != 2 {
+		t.Errorf("conntrack has %d entries, %v, want one per direction", n, err)
+	}
+}
+
+func TestSetAccelerated(t *testing.T) {
+	if !probedKernel().Datapath.SocketAcceleration {
+		t.Skip("kernel can't splice sockets")
+	}
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ebpf.NewMap(spec.Maps["accel_excluded"])
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("creating maps not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	socks, err := ebpf.NewMap(spec.Maps["accel_socks"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	x := &xdpProgram{accelSocks: socks, accelExcluded: m}
+
+	addr := netip.MustParseAddr("10.0.0.2")
+	if err := x.SetAccelerated(testIfindex, []netip.Addr{addr}, false); err != nil {
+		t.Fatal(err)
+	}
+	var v uint8
+	if err := m.Lookup(uint32(testIfindex), &v); err != nil || v != 1 {
+		t.Errorf("accel_excluded[%d] = %d, %v, want 1", testIfindex, v, err)
+	}
+	if err := x.SetAccelerated(testIfindex, []netip.Addr{addr}, true); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := countEntries(m); err != nil || n != 0 {
+		t.Errorf("accel_excluded has %d entries after accelerating, %v", n, err)
+	}
+	// Accelerating twice is no error
+	if err := x.SetAccelerated(testIfindex, []netip.Addr{addr}, true); err != nil {
+		t.Fatal(err)
+	}
+}
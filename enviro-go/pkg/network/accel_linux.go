@@ -0,0 +1,130 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// accelProgram adds the sockets of container cgroups to accel_socks, and
+// skMsgProgram, attached to the map, splices what they send
+var accelProgram = cgroupProgram{"sockops_accelerate", ebpf.AttachCGroupSockOps}
+
+const skMsgProgram = "sk_msg_accelerate"
+
+// applySocketAcceleration removes the programs of socket acceleration and
+// their sockhash from spec unless x accelerates sockets, as the kernel may
+// not be able to load them
+func (x *xdpProgram) applySocketAcceleration(spec *ebpf.CollectionSpec) {
+	if x.socketAcceleration {
+		return
+	}
+	delete(spec.Programs, accelProgram.name)
+	delete(spec.Programs, skMsgProgram)
+	delete(spec.Maps, "accel_socks")
+}
+
+// hasSocketAcceleration reports whether the router was loaded with the
+// programs of socket acceleration
+func (x *xdpProgram) hasSocketAcceleration() bool {
+	return x.accelSocks != nil && x.accelExcluded != nil &&
+		x.coll.Programs[accelProgram.name] != nil && x.coll.Programs[skMsgProgram] != nil
+}
+
+// attachSkMsg attaches the sk_msg program in use to accel_socks, replacing
+// the previous one for the sockets added from then on
+func (x *xdpProgram) attachSkMsg() error {
+	if !x.hasSocketAcceleration() {
+		return nil
+	}
+	prog := x.coll.Programs[skMsgProgram]
+	err := link.RawAttachProgram(link.RawAttachProgramOptions{Target: x.accelSocks.FD(), Program: prog, Attach: ebpf.AttachSkMsgVerdict})
+	if err != nil {
+		return fmt.Errorf("failed to attach %s: %w", skMsgProgram, err)
+	}
+	x.skMsg = prog
+	return nil
+}
+
+// detachSkMsg detaches the sk_msg program from accel_socks
+func (x *xdpProgram) detachSkMsg() {
+	if x.skMsg == nil {
+		return
+	}
+	link.RawDetachProgram(link.RawDetachProgramOptions{Target: x.accelSocks.FD(), Program: x.skMsg, Attach: ebpf.AttachSkMsgVerdict})
+	x.skMsg = nil
+}
+
+// SetAccelerated lets the sockets of the container behind ifindex with
+// addrs be spliced, or excludes it, evicting its sockets in accel_socks so
+// their traffic takes the stack from then on
+func (x *xdpProgram) SetAccelerated(ifindex int, addrs []netip.Addr, accelerate bool) error {
+	if accelerate {
+		return ignoreNotExist(x.accelExcluded.Delete(uint32(ifindex)))
+	}
+	if err := x.accelExcluded.Put(uint32(ifindex), uint8(1)); err != nil {
+		return err
+	}
+	return x.evictSockets(addrs)
+}
+
+// evictSockets removes the sockets to or from addrs from accel_socks.
+// Sockets only hold their key, so the map is walked by key.
+func (x *xdpProgram) evictSockets(addrs []netip.Addr) error {
+	owned := make(map[[16]byte]bool, len(addrs))
+	for _, addr := range addrs {
+		owned[addr.As16()] = true
+	}
+	var evict []ctKey
+	var key ctKey
+	var prev any
+	for {
+		if err := x.accelSocks.NextKey(prev, &key); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				break
+			}
+			return fmt.Errorf("failed to list accelerated sockets: %w", err)
+		}
+		if owned[key.Src] || owned[key.Dst] {
+			evict = append(evict, key)
+		}
+		k := key
+		prev = &k
+	}
+	var errs []error
+	for _, k := range evict {
+		errs = append(errs, ignoreNotExist(x.accelSocks.Delete(k)))
+	}
+	return errors.Join(errs...)
+}
+
+// syncAcceleration lets the sockets of cn be spliced, or excludes it, as
+// cn.accelerable says. Callers must hold nm.mu.
+func (nm *NetworkManager) syncAcceleration(cn *ContainerNetwork) error {
+	if nm.xdp == nil || !nm.xdp.hasSocketAcceleration() || cn.Rootless || cn.Attachment.direct() {
+		return nil
+	}
+	if err := nm.xdp.SetAccelerated(cn.HostIfindex, cn.addrs(), cn.accelerable()); err != nil {
+		return fmt.Errorf("failed to update socket acceleration: %w", err)
+	}
+	return nil
+}
+
+// initSocketAcceleration records whether the freshly loaded xdp splices
+// sockets, warning when it is enabled but can't
+func (nm *NetworkManager) initSocketAcceleration(xdp *xdpProgram) {
+	if !nm.config.SocketAcceleration.Enable {
+		return
+	}
+	if !xdp.hasSocketAcceleration() {
+		nm.log.Warn("Socket acceleration unavailable: the kernel can't splice sockets before 5.4, so TCP between containers takes the stack")
+		return
+	}
+	nm.caps.SocketAcceleration = true
+	nm.log.Info("Splicing TCP between containers of this node")
+}
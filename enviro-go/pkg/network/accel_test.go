@@ -0,0 +1,48 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSocketAccelerationValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     NetworkConfig
+		wantErr bool
+	}{
+		{name: "disabled", cfg: NetworkConfig{}},
+		{name: "with XDP", cfg: NetworkConfig{EnableXDP: true, SocketAcceleration: SocketAccelerationConfig{Enable: true}}},
+		{name: "without XDP", cfg: NetworkConfig{SocketAcceleration: SocketAccelerationConfig{Enable: true}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.SocketAcceleration.validate(tt.cfg)
+			if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validate() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAccelerable(t *testing.T) {
+	tests := []struct {
+		name string
+		cn   ContainerNetwork
+		want bool
+	}{
+		{name: "plain", want: true},
+		{name: "ingress limit", cn: ContainerNetwork{IngressBps: 1e6}},
+		{name: "egress limit", cn: ContainerNetwork{EgressBps: 1e6}},
+		{name: "mirrored egress", cn: ContainerNetwork{Mirrors: []Mirror{{TargetID: "tap", Direction: DirectionEgress}}}},
+		{name: "impaired", cn: ContainerNetwork{fault: &ContainerFault{DropPercent: 1}}},
+		{name: "captured", cn: ContainerNetwork{captures: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cn.accelerable(); got != tt.want {
+				t.Errorf("accelerable() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
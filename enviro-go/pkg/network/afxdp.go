@@ -0,0 +1,243 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// ErrInvalidAFXDP is returned for malformed AF_XDP socket specs
+var ErrInvalidAFXDP = errors.New("network: invalid AF_XDP socket")
+
+// ErrAFXDPInUse is returned when attaching a socket to a queue that has
+// one, or for a container that owns one
+var ErrAFXDPInUse = errors.New("network: AF_XDP socket in use")
+
+// ErrAFXDPNotFound is returned for containers without an AF_XDP socket
+var ErrAFXDPNotFound = errors.New("network: AF_XDP socket not found")
+
+// AF_XDP socket defaults, see AFXDPSpec
+const (
+	DefaultAFXDPFrameSize  = 4096
+	DefaultAFXDPFrameCount = 4096
+)
+
+// Bounds of AFXDPSpec.FrameCount, and the largest queue index the router
+// has a socket slot for
+const (
+	minAFXDPFrames = 64
+	maxAFXDPFrames = 1 << 20
+	maxAFXDPQueue  = 63
+)
+
+// AFXDPFlow selects the traffic to a container that is steered to an
+// AF_XDP socket
+type AFXDPFlow struct {
+	// Container is the destination container, the socket's owner when
+	// empty
+	Container string `json:"container,omitempty"`
+	// Protocol is "tcp" or "udp"
+	Protocol string `json:"protocol"`
+	// Port is the destination port, 0 for any
+	Port uint16 `json:"port,omitempty"`
+}
+
+// AFXDPSpec describes an AF_XDP socket owned by a container. The socket is
+// bound to a receive queue of the XDP interface, and packets of its flows
+// arriving on that queue are delivered to it instead of the destination
+// container. Those arriving on other queues take the usual path, so
+// flows are typically pinned to the queue with ethtool ntuple rules.
+type AFXDPSpec struct {
+	// ContainerID is the owner; the socket is closed when its network is
+	// deleted
+	ContainerID string
+	// Queue is the receive queue of the XDP interface to bind to
+	Queue int
+	// Flows are steered to the socket
+	Flows []AFXDPFlow
+	// FrameSize is the size of each UMEM frame, 2048 or 4096, and bounds
+	// the packets the socket takes. DefaultAFXDPFrameSize when zero.
+	FrameSize int
+	// FrameCount is the number of UMEM frames, a power of two, and the size
+	// of each ring. DefaultAFXDPFrameCount when zero.
+	FrameCount int
+	// SocketPath is the Unix socket the owner picks the AF_XDP socket up
+	// from, see AFXDPHandoff. It is typically bind-mounted into the
+	// container.
+	SocketPath string
+	// ZeroCopy binds in zero-copy mode, which needs driver support and
+	// native XDP; copy mode works with any attach mode but TC
+	ZeroCopy bool
+}
+
+// withDefaults fills in unset values
+func (s AFXDPSpec) withDefaults() AFXDPSpec {
+	if s.FrameSize == 0 {
+		s.FrameSize = DefaultAFXDPFrameSize
+	}
+	if s.FrameCount == 0 {
+		s.FrameCount = DefaultAFXDPFrameCount
+	}
+	s.Flows = slices.Clone(s.Flows)
+	for i := range s.Flows {
+		if s.Flows[i].Container == "" {
+			s.Flows[i].Container = s.ContainerID
+		}
+	}
+	return s
+}
+
+// Validate checks that the spec, with defaults applied, is well formed
+func (s AFXDPSpec) Validate() error {
+	switch {
+	case s.ContainerID == "":
+		return fmt.Errorf("%w: container ID is required", ErrInvalidAFXDP)
+	case s.Queue < 0 || s.Queue > maxAFXDPQueue:
+		return fmt.Errorf("%w: queue %d is outside 0-%d", ErrInvalidAFXDP, s.Queue, maxAFXDPQueue)
+	case len(s.Flows) == 0:
+		return fmt.Errorf("%w: no flows to steer", ErrInvalidAFXDP)
+	case s.FrameSize != 2048 && s.FrameSize != 4096:
+		return fmt.Errorf("%w: frame size must be 2048 or 4096", ErrInvalidAFXDP)
+	case s.FrameCount < minAFXDPFrames || s.FrameCount > maxAFXDPFrames || s.FrameCount&(s.FrameCount-1) != 0:
+		return fmt.Errorf("%w: frame count must be a power of two between %d and %d", ErrInvalidAFXDP, minAFXDPFrames, maxAFXDPFrames)
+	case s.SocketPath == "":
+		return fmt.Errorf("%w: socket path is required", ErrInvalidAFXDP)
+	}
+	for _, f := range s.Flows {
+		if f.Protocol != "tcp" && f.Protocol != "udp" {
+			return fmt.Errorf("%w: flow protocol must be tcp or udp, not %q", ErrInvalidAFXDP, f.Protocol)
+		}
+	}
+	return nil
+}
+
+// AFXDPSocket is an attached AF_XDP socket
+type AFXDPSocket struct {
+	ContainerID string
+	Queue       int
+	// Flows have their Container filled in
+	Flows      []AFXDPFlow
+	FrameSize  int
+	FrameCount int
+	SocketPath string
+	// ZeroCopy is true when the socket is bound in zero-copy mode
+	ZeroCopy bool
+}
+
+// AFXDPHandoff is the JSON message a connection to AFXDPSpec.SocketPath
+// receives, along with two file descriptors: the AF_XDP socket and a
+// memfd holding its UMEM. The owner maps the UMEM, FrameCount frames of
+// FrameSize bytes, and the rings from the socket at the usual offsets,
+// reading them with getsockopt(XDP_MMAP_OFFSETS). The first FillFrames
+// frames were put on the fill ring; the others are free for transmitting.
+// Every connection gets the same socket, so an owner that restarted picks
+// up where it left the rings.
+type AFXDPHandoff struct {
+	Queue      int  `json:"queue"`
+	FrameSize  int  `json:"frame_size"`
+	FrameCount int  `json:"frame_count"`
+	FillFrames int  `json:"fill_frames"`
+	ZeroCopy   bool `json:"zero_copy"`
+	// NeedWakeup is set since the socket is bound with
+	// XDP_USE_NEED_WAKEUP: the owner must kick the kernel with sendto or
+	// poll when a ring's flags ask for it
+	NeedWakeup bool `json:"need_wakeup"`
+}
+
+// AttachAFXDP creates an AF_XDP socket with its UMEM and rings for the
+// container of spec, serves it on spec.SocketPath and steers the flows of
+// spec to it. Steered packets skip connection tracking and the
+// container's MTU check. It needs the XDP router attached in an XDP mode,
+// else it fails with ErrXDPInactive. Sockets are not persisted, so they
+// must be attached again after a restart.
+func (nm *NetworkManager) AttachAFXDP(ctx context.Context, spec AFXDPSpec) (AFXDPSocket, error) {
+	spec = spec.withDefaults()
+	if err := spec.Validate(); err != nil {
+		return AFXDPSocket{}, err
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.xdp == nil || nm.caps.XDPMode == DatapathTC {
+		return AFXDPSocket{}, fmt.Errorf("%w: AF_XDP needs the router attached in an XDP mode", ErrXDPInactive)
+	}
+	owner, ok := nm.containers[spec.ContainerID]
+	if !ok {
+		return AFXDPSocket{}, fmt.Errorf("%w: %s", ErrContainerNotFound, spec.ContainerID)
+	}
+	if err := owner.checkAttachment("AF_XDP sockets"); err != nil {
+		return AFXDPSocket{}, err
+	}
+	for _, f := range spec.Flows {
+		cn, ok := nm.containers[f.Container]
+		if !ok {
+			return AFXDPSocket{}, fmt.Errorf("%w: flow to %s", ErrContainerNotFound, f.Container)
+		}
+		if err := cn.checkAttachment("AF_XDP flows"); err != nil {
+			return AFXDPSocket{}, err
+		}
+	}
+	if _, ok := nm.xsks[spec.ContainerID]; ok {
+		return AFXDPSocket{}, fmt.Errorf("%w: %s already owns one", ErrAFXDPInUse, spec.ContainerID)
+	}
+	for _, x := range nm.xsks {
+		if x.spec.Queue == spec.Queue {
+			return AFXDPSocket{}, fmt.Errorf("%w: queue %d is taken by %s", ErrAFXDPInUse, spec.Queue, x.spec.ContainerID)
+		}
+	}
+
+	logger := nm.logger(ctx).With("container_id", spec.ContainerID, "queue", spec.Queue)
+	x, err := nm.attachAFXDP(ctx, spec, logger)
+	if err != nil {
+		return AFXDPSocket{}, fmt.Errorf("failed to attach AF_XDP socket: %w", err)
+	}
+	nm.xsks[spec.ContainerID] = x
+	logger.Info("Attached AF_XDP socket", "flows", len(spec.Flows), "frames", spec.FrameCount,
+		"zero_copy", x.zeroCopy, "path", spec.SocketPath)
+	return x.info(), nil
+}
+
+// DetachAFXDP stops steering the flows of the container's AF_XDP socket
+// and closes it. Owners that picked it up keep their descriptors, but
+// receive nothing more.
+func (nm *NetworkManager) DetachAFXDP(ctx context.Context, containerID string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, ok := nm.xsks[containerID]; !ok {
+		return fmt.Errorf("%w: %s", ErrAFXDPNotFound, containerID)
+	}
+	return nm.detachAFXDP(nm.logger(ctx), containerID)
+}
+
+// ListAFXDPSockets returns the attached AF_XDP sockets ordered by owner
+func (nm *NetworkManager) ListAFXDPSockets() []AFXDPSocket {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	out := make([]AFXDPSocket, 0, len(nm.xsks))
+	for _, x := range nm.xsks {
+		out = append(out, x.info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ContainerID < out[j].ContainerID })
+	return out
+}
+
+// removeAFXDPFlowsTo detaches the sockets owned by containerID or steering
+// flows to it, as its addresses may be reused. Callers must hold nm.mu.
+func (nm *NetworkManager) removeAFXDPFlowsTo(containerID string) {
+	logger := nm.log.With("container_id", containerID)
+	for owner, x := range nm.xsks {
+		if owner != containerID && !slices.ContainsFunc(x.spec.Flows, func(f AFXDPFlow) bool {
+			return f.Container == containerID
+		}) {
+			continue
+		}
+		if err := nm.detachAFXDP(logger, owner); err != nil {
+			logger.Error("Failed to detach AF_XDP socket", "owner", owner, "error", err)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// xskFlowKey mirrors struct xsk_flow_key in bpf/container_router.c. IPv4
+// addresses are IPv4-mapped; the port is in network byte order.
+type xskFlowKey struct {
+	Dst   [16]byte
+	Port  [2]byte
+	Proto uint8
+	Pad   uint8
+}
+
+// afxdpSocket is an AF_XDP socket with its UMEM, served to its owner
+type afxdpSocket struct {
+	spec     AFXDPSpec
+	fd       int
+	umemFD   int
+	umem     []byte
+	zeroCopy bool
+	// keys are the steered flows as programmed in the router
+	keys     []xskFlowKey
+	listener *net.UnixListener
+	// served is closed once the listener's accept loop returned
+	served chan struct{}
+}
+
+func (x *afxdpSocket) info() AFXDPSocket {
+	return AFXDPSocket{
+		ContainerID: x.spec.ContainerID,
+		Queue:       x.spec.Queue,
+		Flows:       x.spec.Flows,
+		FrameSize:   x.spec.FrameSize,
+		FrameCount:  x.spec.FrameCount,
+		SocketPath:  x.spec.SocketPath,
+		ZeroCopy:    x.zeroCopy,
+	}
+}
+
+// attachAFXDP creates the socket of spec, steers its flows to it and
+// serves it. Callers must hold nm.mu.
+func (nm *NetworkManager) attachAFXDP(ctx context.Context, spec AFXDPSpec, logger *slog.Logger) (*afxdpSocket, error) {
+	if !nm.xdp.hasXSKs() {
+		return nil, fmt.Errorf("%w: the router has no AF_XDP maps", ErrXDPInactive)
+	}
+	ifc, err := net.InterfaceByName(nm.config.Interface)
+	if err != nil {
+		return nil, err
+	}
+	x, err := newAFXDPSocket(spec, ifc.Index)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range spec.Flows {
+		for _, addr := range nm.containers[f.Container].addrs() {
+			key := xskFlowKey{Dst: addr.As16(), Proto: protocolNumber(f.Protocol, addr)}
+			key.Port[0], key.Port[1] = byte(f.Port>>8), byte(f.Port)
+			x.keys = append(x.keys, key)
+		}
+	}
+
+	j := newOpJournal(ctx, nm.tracer, logger)
+	err = j.run("register socket", func() error {
+		return nm.xdp.PutXSK(spec.Queue, x.fd)
+	}, func() error {
+		return nm.xdp.DeleteXSK(spec.Queue)
+	})
+	if err == nil {
+		err = j.run("steer flows", func() error {
+			for _, key := range x.keys {
+				if err := nm.xdp.PutXSKFlow(key, spec.Queue); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, func() error {
+			return nm.xdp.DeleteXSKFlows(x.keys)
+		})
+	}
+	if err == nil {
+		err = x.serve(logger)
+	}
+	if err != nil {
+		j.rollback()
+		x.close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// detachAFXDP stops steering to the socket of owner and closes it.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) detachAFXDP(logger *slog.Logger, owner string) error {
+	x := nm.xsks[owner]
+	var errs []error
+	if nm.xdp != nil {
+		errs = append(errs, nm.xdp.DeleteXSKFlows(x.keys), nm.xdp.DeleteXSK(x.spec.Queue))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	x.close()
+	delete(nm.xsks, owner)
+	logger.Info("Detached AF_XDP socket", "owner", owner, "queue", x.spec.Queue)
+	return nil
+}
+
+// newAFXDPSocket creates an AF_XDP socket with a UMEM in a memfd and its
+// rings, puts the first half of the frames on the fill ring and binds it
+// to queue of ifindex
+func newAFXDPSocket(spec AFXDPSpec, ifindex int) (x *afxdpSocket, err error) {
+	x = &afxdpSocket{spec: spec, fd: -1, umemFD: -1, zeroCopy: spec.ZeroCopy}
+	defer func() {
+		if err != nil {
+			x.close()
+		}
+	}()
+
+	x.fd, err = unix.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AF_XDP socket: %w", err)
+	}
+	size := spec.FrameSize * spec.FrameCount
+	x.umemFD, err = unix.MemfdCreate("enviro-afxdp-umem", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create UMEM: %w", err)
+	}
+	if err := unix.Ftruncate(x.umemFD, int64(size)); err != nil {
+		return nil, fmt.Errorf("failed to size UMEM: %w", err)
+	}
+	x.umem, err = unix.Mmap(x.umemFD, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map UMEM: %w", err)
+	}
+
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&x.umem[0]))),
+		Len:  uint64(size),
+		Size: uint32(spec.FrameSize),
+	}
+	if err := setsockopt(x.fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return nil, fmt.Errorf("failed to register UMEM: %w", err)
+	}
+	for _, ring := range []int{unix.XDP_UMEM_FILL_RING, unix.XDP_UMEM_COMPLETION_RING, unix.XDP_RX_RING, unix.XDP_TX_RING} {
+		if err := unix.SetsockoptInt(x.fd, unix.SOL_XDP, ring, spec.FrameCount); err != nil {
+			return nil, fmt.Errorf("failed to size AF_XDP ring: %w", err)
+		}
+	}
+	if err := x.primeFillRing(spec.FrameCount / 2); err != nil {
+		return nil, err
+	}
+
+	flags := uint16(unix.XDP_USE_NEED_WAKEUP | unix.XDP_COPY)
+	if spec.ZeroCopy {
+		flags = unix.XDP_USE_NEED_WAKEUP | unix.XDP_ZEROCOPY
+	}
+	sa := &unix.SockaddrXDP{Flags: flags, Ifindex: uint32(ifindex), QueueID: uint32(spec.Queue)}
+	if err := unix.Bind(x.fd, sa); err != nil {
+		return nil, fmt.Errorf("failed to bind AF_XDP socket to queue %d: %w", spec.Queue, err)
+	}
+	return x, nil
+}
+
+// primeFillRing puts the first n frames of the UMEM on the fill ring, so
+// the kernel has frames to receive into before the owner runs
+func (x *afxdpSocket) primeFillRing(n int) error {
+	var off unix.XDPMmapOffsets
+	size := unsafe.Sizeof(off)
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(x.fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS,
+		uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to read AF_XDP ring offsets: %w", errno)
+	}
+
+	length := int(off.Fr.Desc) + x.spec.FrameCount*8
+	ring, err := unix.Mmap(x.fd, unix.XDP_UMEM_PGOFF_FILL_RING, length, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("failed to map fill ring: %w", err)
+	}
+	defer unix.Munmap(ring)
+
+	descs := unsafe.Slice((*uint64)(unsafe.Pointer(&ring[off.Fr.Desc])), x.spec.FrameCount)
+	for i := 0; i < n; i++ {
+		descs[i] = uint64(i * x.spec.FrameSize)
+	}
+	// The kernel reads the descriptors once it sees the producer move
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&ring[off.Fr.Producer])), uint32(n))
+	return nil
+}
+
+// setsockopt sets an SOL_XDP option to the size bytes at val
+func setsockopt(fd, opt int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// serve listens on the socket path and hands the socket and UMEM to every
+// connection until close
+func (x *afxdpSocket) serve(logger *slog.Logger) error {
+	path := x.spec.SocketPath
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return err
+	}
+	x.listener = listener
+	x.served = make(chan struct{})
+
+	header, _ := json.Marshal(AFXDPHandoff{
+		Queue:      x.spec.Queue,
+		FrameSize:  x.spec.FrameSize,
+		FrameCount: x.spec.FrameCount,
+		FillFrames: x.spec.FrameCount / 2,
+		ZeroCopy:   x.zeroCopy,
+		NeedWakeup: true,
+	})
+	rights := unix.UnixRights(x.fd, x.umemFD)
+	go func() {
+		defer close(x.served)
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				return
+			}
+			if _, _, err := conn.WriteMsgUnix(header, rights, nil); err != nil {
+				logger.Warn("Failed to hand over AF_XDP socket", "error", err)
+			} else {
+				logger.Debug("Handed over AF_XDP socket")
+			}
+			conn.Close()
+		}
+	}()
+	return nil
+}
+
+// close stops serving the socket and releases it and its UMEM
+func (x *afxdpSocket) close() {
+	if x.listener != nil {
+		x.listener.Close()
+		<-x.served
+		x.listener = nil
+	}
+	if x.fd >= 0 {
+		unix.Close(x.fd)
+		x.fd = -1
+	}
+	if x.umem != nil {
+		unix.Munmap(x.umem)
+		x.umem = nil
+	}
+	if x.umemFD >= 0 {
+		unix.Close(x.umemFD)
+		x.umemFD = -1
+	}
+}
@@ -0,0 +1,68 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// ErrCapabilityRequired is returned for options that need a capability the
+// container wasn't granted
+var ErrCapabilityRequired = errors.New("network: capability required")
+
+// NetworkCapability is a network privilege granted to a container in its
+// ContainerNetworkSpec
+type NetworkCapability string
+
+const (
+	// CapabilitySpoofSource lets a container opt out of source checks
+	// with ContainerNetworkSpec.DisableSourceCheck, and so send from any
+	// MAC and address
+	CapabilitySpoofSource NetworkCapability = "spoof_source"
+)
+
+// exemptSources6 are the IPv6 sources, and targets of neighbor
+// advertisements, left unchecked like by source_exempt6 in
+// bpf/container_router.c: link-local addresses only reach the container's
+// own veth, and duplicate address detection sends from the unspecified
+// address.
+var exemptSources6 = []netip.Prefix{netip.MustParsePrefix("fe80::/10"), netip.MustParsePrefix("::/128")}
+
+// validateSources checks the source check options of spec: the allowed
+// sources must be prefixes, and opting out needs CapabilitySpoofSource
+func validateSources(spec ContainerNetworkSpec) error {
+	for _, c := range spec.Capabilities {
+		if c != CapabilitySpoofSource {
+			return fmt.Errorf("%w: unknown capability %q", ErrInvalidConfig, c)
+		}
+	}
+	for _, s := range spec.AllowedSources {
+		if _, err := netip.ParsePrefix(s); err != nil {
+			return fmt.Errorf("%w: allowed source: %v", ErrInvalidConfig, err)
+		}
+	}
+	if spec.DisableSourceCheck && !slices.Contains(spec.Capabilities, CapabilitySpoofSource) {
+		return fmt.Errorf("%w: disabling source checks needs %s", ErrCapabilityRequired, CapabilitySpoofSource)
+	}
+	return nil
+}
+
+// sourceChecked reports whether what cn sends is checked against its
+// sources, which needs a veth and cn not to have opted out
+func (cn *ContainerNetwork) sourceChecked() bool {
+	return !cn.Rootless && !cn.Attachment.direct() && !cn.SourceCheckDisabled
+}
+
+// sources returns the prefixes cn may send from: its addresses, then the
+// allowed sources, which must be valid
+func (cn *ContainerNetwork) sources() []netip.Prefix {
+	var out []netip.Prefix
+	for _, addr := range cn.addrs() {
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	for _, s := range cn.AllowedSources {
+		out = append(out, netip.MustParsePrefix(s).Masked())
+	}
+	return out
+}
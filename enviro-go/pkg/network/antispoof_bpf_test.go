@@ -0,0 +1,191 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// TC verdicts of the source check
+const (
+	tcOK   = 0
+	tcShot = 2
+)
+
+// testIfindex is the ifindex BPF_PROG_TEST_RUN runs TC programs on, the
+// loopback device's
+const testIfindex = 1
+
+// loadSourceCheck loads the embedded router with the source check,
+// unattached, and programs mac and prefixes for testIfindex
+func loadSourceCheck(t *testing.T, mac net.HardwareAddr, prefixes []netip.Prefix) *xdpProgram {
+	t.Helper()
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		t.Fatal(err)
+	}
+	trimPrograms(spec, []DatapathMode{DatapathTC})
+	sizes := programSizes(spec)
+	coll, err := ebpf.NewCollection(spec)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("loading eBPF not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(coll.Close)
+	x := &xdpProgram{sizes: sizes}
+	x.setCollection(coll)
+	if !x.hasSourceCheck() {
+		t.Fatal("router loaded without the source check")
+	}
+	if err := x.SetSources(testIfindex, mac, prefixes); err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+// withMAC sets the Ethernet source of frame to mac
+func withMAC(frame []byte, mac net.HardwareAddr) []byte {
+	copy(frame[6:12], mac)
+	return frame
+}
+
+func TestSourceCheck(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	forged := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x66}
+	own4, own6 := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::2")
+	vip := netip.MustParseAddr("10.9.0.7")
+	other4, other6 := netip.MustParseAddr("10.0.0.3"), netip.MustParseAddr("fd00::3")
+	peer := netip.MustParseAddr("10.0.0.1")
+	x := loadSourceCheck(t, mac, []netip.Prefix{
+		netip.PrefixFrom(own4, 32), netip.PrefixFrom(own6, 128), netip.MustParsePrefix("10.9.0.0/16"),
+	})
+	segment := func(src, dst netip.Addr) []byte {
+		return tcpSegment{src: netip.AddrPortFrom(src, 40000), dst: netip.AddrPortFrom(dst, 80), flags: tcpSYN}.frame()
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  uint32
+	}{
+		{name: "IPv4", frame: withMAC(segment(own4, peer), mac), want: tcOK},
+		{name: "IPv6", frame: withMAC(segment(own6, netip.MustParseAddr("fd00::1")), mac), want: tcOK},
+		{name: "allowed source", frame: withMAC(segment(vip, peer), mac), want: tcOK},
+		{name: "forged IPv4", frame: withMAC(segment(other4, peer), mac), want: tcShot},
+		{name: "forged IPv6", frame: withMAC(segment(other6, netip.MustParseAddr("fd00::1")), mac), want: tcShot},
+		{name: "forged MAC", frame: withMAC(segment(own4, peer), forged), want: tcShot},
+		{name: "link-local", frame: withMAC(segment(netip.MustParseAddr("fe80::2"), netip.MustParseAddr("fe80::1")), mac), want: tcOK},
+	}
+	shot := uint64(0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ret, _, err := x.coll.Programs[sourceProgram].Test(tt.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ret != tt.want {
+				t.Errorf("verdict %d, want %d", ret, tt.want)
+			}
+		})
+		if tt.want == tcShot {
+			shot++
+		}
+	}
+
+	s, err := x.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Spoofed != shot {
+		t.Errorf("%d spoofed frames counted, want %d", s.Spoofed, shot)
+	}
+
+	// Without sources the container goes unchecked
+	if err := x.DeleteSources(testIfindex); err != nil {
+		t.Fatal(err)
+	}
+	if ret, _, err := x.coll.Programs[sourceProgram].Test(withMAC(segment(other4, peer), forged)); err != nil || ret != tcOK {
+		t.Errorf("unchecked forged frame: verdict %d, %v, want %d", ret, err, tcOK)
+	}
+	if n, err := countEntries(x.coll.Maps["source_addrs"]); err != nil || n != 0 {
+		t.Errorf("source_addrs has %d entries after DeleteSources, %v", n, err)
+	}
+}
+
+// TestSourceConntrack tracks the flows of the frames the source check
+// passes, as the container's outbound direction, and not those it drops
+func TestSourceConntrack(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	own := netip.MustParseAddrPort("10.0.0.2:40000")
+	peer := netip.MustParseAddrPort("198.51.100.1:443")
+	x := loadSourceCheck(t, mac, []netip.Prefix{netip.PrefixFrom(own.Addr(), 32)})
+
+	syn := withMAC(tcpSegment{src: own, dst: peer, flags: tcpSYN}.frame(), mac)
+	ack := withMAC(tcpSegment{src: own, dst: peer, flags: tcpACK}.frame(), mac)
+	forged := withMAC(tcpSegment{src: netip.MustParseAddrPort("10.0.0.3:40000"), dst: peer, flags: tcpSYN}.frame(), mac)
+	for _, frame := range [][]byte{syn, ack, forged} {
+		if _, _, err := x.coll.Programs[sourceProgram].Test(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	owners := map[int]string{testIfindex: "c1"}
+	conns, err := (&NetworkManager{xdp: x}).readConnections(owners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 {
+		t.Fatalf("%d flows tracked, want 1: %+v", len(conns), conns)
+	}
+	c := conns[0]
+	if c.ContainerID != "c1" || c.Protocol != "tcp" || c.Src != own || c.Dst != peer || !c.Outbound {
+		t.Errorf("tracked %+v, want the container's outbound flow %s > %s", c, own, peer)
+	}
+	if c.State != ConnEstablished || c.Packets != 2 || c.Bytes != uint64(len(syn)+len(ack)) {
+		t.Errorf("state %s, %d packets, %d bytes, want %s, 2 and %d", c.State, c.Packets, c.Bytes, ConnEstablished, len(syn)+len(ack))
+	}
+}
+
+// TestNeighborSourceCheck runs the neighbor cases the neighbor tables are
+// tested with through the source check, which must decide the same
+func TestNeighborSourceCheck(t *testing.T) {
+	h := testNeighborHosts
+	x := loadSourceCheck(t, h.mac, h.sources())
+	spoofed := uint64(0)
+	for _, tt := range neighborCases {
+		t.Run(tt.name, func(t *testing.T) {
+			ret, _, err := x.coll.Programs[sourceProgram].Test(tt.frame(h))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[bool]uint32{false: tcOK, true: tcShot}[tt.spoofed]; ret != want {
+				t.Errorf("verdict %d, want %d", ret, want)
+			}
+		})
+		if tt.spoofed {
+			spoofed++
+		}
+	}
+
+	s, err := x.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neighbor discovery from a forged address is dropped as spoofed
+	// before its message is looked at
+	if got := s.Spoofed + s.NeighborSpoofed; got != spoofed || s.NeighborSpoofed == 0 {
+		t.Errorf("%d spoofed and %d neighbor_spoofed counted, want %d together", s.Spoofed, s.NeighborSpoofed, spoofed)
+	}
+}
@@ -0,0 +1,183 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// sourceMAC mirrors struct source_mac in bpf/container_router.c
+type sourceMAC struct {
+	Addr [6]byte
+	Pad  uint16
+}
+
+// sourceKey mirrors struct source_key in bpf/container_router.c. The
+// kernel reads Prefixlen in host byte order.
+type sourceKey struct {
+	Prefixlen uint32
+	Ifindex   uint32
+	Addr      [16]byte
+}
+
+// Bits of a source key before the address, which always match
+const sourcePrefixBits = 32
+
+func newSourceKey(ifindex int, p netip.Prefix) sourceKey {
+	k := sourceKey{Prefixlen: sourcePrefixBits + uint32(p.Bits()), Ifindex: uint32(ifindex), Addr: p.Addr().As16()}
+	if p.Addr().Is4() {
+		// IPv4 prefixes are IPv4-mapped
+		k.Prefixlen += 96
+	}
+	return k
+}
+
+// sourcePrefix returns the prefix of a source_addrs key
+func sourcePrefix(k sourceKey) netip.Prefix {
+	addr, bits := netip.AddrFrom16(k.Addr), int(k.Prefixlen)-sourcePrefixBits
+	if addr.Is4In6() {
+		return netip.PrefixFrom(addr.Unmap(), bits-96)
+	}
+	return netip.PrefixFrom(addr, bits)
+}
+
+// hasSourceCheck reports whether the router was loaded with the source
+// check, which needs TC support
+func (x *xdpProgram) hasSourceCheck() bool {
+	return x.sourceMACs != nil && x.coll.Programs[sourceProgram] != nil
+}
+
+// SetSources programs the MAC and the prefixes the container behind the
+// host veth ifindex may send from, replacing the previous ones
+func (x *xdpProgram) SetSources(ifindex int, mac net.HardwareAddr, prefixes []netip.Prefix) error {
+	want := make(map[sourceKey]bool, len(prefixes))
+	for _, p := range prefixes {
+		want[newSourceKey(ifindex, p)] = true
+	}
+	if err := x.syncSources(ifindex, want); err != nil {
+		return err
+	}
+	var v sourceMAC
+	copy(v.Addr[:], mac)
+	return x.sourceMACs.Put(uint32(ifindex), v)
+}
+
+// DeleteSources removes the entries of the host veth ifindex, so what the
+// container behind it sends goes unchecked
+func (x *xdpProgram) DeleteSources(ifindex int) error {
+	if err := ignoreNotExist(x.sourceMACs.Delete(uint32(ifindex))); err != nil {
+		return err
+	}
+	return x.syncSources(ifindex, nil)
+}
+
+// syncSources leaves the prefixes of want as the only source_addrs entries
+// of ifindex
+func (x *xdpProgram) syncSources(ifindex int, want map[sourceKey]bool) error {
+	// Deleting while iterating can restart the iteration, so collect first
+	batch := newMapBatch[sourceKey, uint8](x.sourceAddrs)
+	var key sourceKey
+	var v uint8
+	iter := x.sourceAddrs.Iterate()
+	for iter.Next(&key, &v) {
+		if key.Ifindex == uint32(ifindex) && !want[key] {
+			batch.delete(key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for key := range want {
+		batch.put(key, 1)
+	}
+	return batch.flush()
+}
+
+// sourceFilter is the source check's filter on the host veth with index,
+// on clsact ingress, where the frames the container sends arrive
+func sourceFilter(index int) *netlink.BpfFilter {
+	return &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Handle:    1,
+			Priority:  tcFilterPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Name:         sourceProgram,
+		DirectAction: true,
+	}
+}
+
+// attachSourceCheck attaches the source check to the host veth ifindex,
+// or points the filter there at the program in use
+func (x *xdpProgram) attachSourceCheck(ifindex int) error {
+	if err := addClsact(ifindex); err != nil {
+		return err
+	}
+	l := &tcLink{filter: sourceFilter(ifindex)}
+	return l.Update(x.coll.Programs[sourceProgram])
+}
+
+// detachSourceCheck removes the source check from the host veth ifindex
+func detachSourceCheck(ifindex int) error {
+	err := deleteFilter(sourceFilter(ifindex))
+	// The veth has no clsact qdisc
+	if errors.Is(err, unix.EINVAL) {
+		return nil
+	}
+	return err
+}
+
+// checkSources has the router check what cn sends against its MAC and
+// sources, or stop checking when cn opted out. Callers must hold nm.mu.
+func (nm *NetworkManager) checkSources(cn *ContainerNetwork) error {
+	if nm.xdp == nil || !nm.xdp.hasSourceCheck() || cn.Rootless || cn.Attachment.direct() {
+		return nil
+	}
+	if cn.SourceCheckDisabled {
+		if err := detachSourceCheck(cn.HostIfindex); err != nil {
+			return fmt.Errorf("failed to detach source check: %w", err)
+		}
+		return nm.xdp.DeleteSources(cn.HostIfindex)
+	}
+	mac, err := net.ParseMAC(cn.MAC)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMAC, err)
+	}
+	if err := nm.xdp.SetSources(cn.HostIfindex, mac, cn.sources()); err != nil {
+		return fmt.Errorf("failed to program sources: %w", err)
+	}
+	if err := nm.xdp.attachSourceCheck(cn.HostIfindex); err != nil {
+		return fmt.Errorf("failed to attach source check: %w", err)
+	}
+	return nm.xdp.keepTapFirst(cn.HostIfindex)
+}
+
+// syncSourceChecks points the source check of every container at the
+// program in use, e.g. after an upgrade. Callers must hold nm.mu.
+func (nm *NetworkManager) syncSourceChecks() error {
+	var errs []error
+	for _, cn := range nm.containers {
+		if err := nm.checkSources(cn); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", cn.ContainerID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// initSourceCheck records whether the freshly loaded xdp checks sources,
+// warning when it can't
+func (nm *NetworkManager) initSourceCheck(xdp *xdpProgram) {
+	if !xdp.hasSourceCheck() {
+		nm.log.Warn("Source checks unavailable: the kernel can't run the TC router, so containers may send from any address")
+		return
+	}
+	nm.caps.SourceCheck = true
+}
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestValidateSources(t *testing.T) {
+	spoof := []NetworkCapability{CapabilitySpoofSource}
+	tests := []struct {
+		name    string
+		spec    ContainerNetworkSpec
+		wantErr error
+	}{
+		{name: "defaults"},
+		{name: "allowed sources", spec: ContainerNetworkSpec{AllowedSources: []string{"10.9.0.0/16", "2001:db8::/64"}}},
+		{name: "opted out", spec: ContainerNetworkSpec{Capabilities: spoof, DisableSourceCheck: true}},
+		{name: "capability unused", spec: ContainerNetworkSpec{Capabilities: spoof}},
+		{name: "address without length", spec: ContainerNetworkSpec{AllowedSources: []string{"10.9.0.1"}}, wantErr: ErrInvalidConfig},
+		{name: "bad prefix", spec: ContainerNetworkSpec{AllowedSources: []string{"10.9.0.0/33"}}, wantErr: ErrInvalidConfig},
+		{name: "unknown capability", spec: ContainerNetworkSpec{Capabilities: []NetworkCapability{"net_admin"}}, wantErr: ErrInvalidConfig},
+		{name: "opted out without capability", spec: ContainerNetworkSpec{DisableSourceCheck: true}, wantErr: ErrCapabilityRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSources(tt.spec)
+			if tt.wantErr == nil && err != nil || !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateSources() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestContainerSources(t *testing.T) {
+	tests := []struct {
+		name string
+		cn   ContainerNetwork
+		want []string
+	}{
+		{name: "no addresses"},
+		{name: "IPv4", cn: ContainerNetwork{IPv4: "10.0.0.2"}, want: []string{"10.0.0.2/32"}},
+		{
+			name: "dual stack",
+			cn:   ContainerNetwork{IPv4: "10.0.0.2", IPv6: "fd00::2"},
+			want: []string{"10.0.0.2/32", "fd00::2/128"},
+		},
+		{
+			name: "allowed sources are masked",
+			cn:   ContainerNetwork{IPv4: "10.0.0.2", AllowedSources: []string{"10.9.1.1/16", "2001:db8::1/64"}},
+			want: []string{"10.0.0.2/32", "10.9.0.0/16", "2001:db8::/64"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []netip.Prefix
+			for _, s := range tt.want {
+				want = append(want, netip.MustParsePrefix(s))
+			}
+			if got := tt.cn.sources(); !slices.Equal(got, want) {
+				t.Errorf("sources() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package network
+
+import "fmt"
+
+// SetBandwidthLimit caps traffic to (ingress) and from (egress) a container
+// in bits per second, replacing any previous limit. A limit of 0 means
+// unlimited. Traffic over the limit is queued briefly, then dropped. The
+// router paces it where the kernel has the fq qdisc, giving each packet a
+// departure time, and a tbf qdisc shapes it otherwise. Either way limits
+// change in place, without recreating the network.
+func (nm *NetworkManager) SetBandwidthLimit(containerID string, ingressBps, egressBps uint64) error {
+	if err := nm.checkPrivileged("bandwidth limits"); err != nil {
+		return err
+	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	if err := cn.checkAttachment("bandwidth limits"); err != nil {
+		return err
+	}
+	if cn.IngressBps == ingressBps && cn.EgressBps == egressBps {
+		return nil
+	}
+	if err := nm.checkQuota(cn.Namespace, containerID, 0, ingressBps, egressBps); err != nil {
+		return err
+	}
+
+	if err := nm.applyBandwidthLimit(cn, ingressBps, egressBps); err != nil {
+		return fmt.Errorf("failed to set bandwidth limit of %s: %w", containerID, err)
+	}
+	cn.IngressBps, cn.EgressBps = ingressBps, egressBps
+	if err := nm.syncAcceleration(cn); err != nil {
+		return fmt.Errorf("failed to set bandwidth limit of %s: %w", containerID, err)
+	}
+	nm.log.Info("Set container bandwidth limit", "container_id", containerID,
+		"ingress_bps", ingressBps, "egress_bps", egressBps)
+	return nm.saveState()
+}
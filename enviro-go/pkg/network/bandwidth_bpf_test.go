@@ -0,0 +1,208 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// skBuff is struct __sk_buff, of which the pacing tests set and read back
+// tstamp
+type skBuff struct {
+	_      [36]uint32 // len to data_meta
+	_      uint64     // flow_keys
+	Tstamp uint64
+	_      [4]uint64 // wire_len to hwtstamp
+}
+
+// runPaced runs prog on frame with the departure time tstamp and returns
+// its verdict and the departure time it left
+func runPaced(t *testing.T, prog *ebpf.Program, frame []byte, tstamp uint64) (uint32, uint64) {
+	t.Helper()
+	in, out := skBuff{Tstamp: tstamp}, skBuff{}
+	ret, err := prog.Run(&ebpf.RunOptions{Data: frame, Context: in, ContextOut: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret, out.Tstamp
+}
+
+// TestPacing schedules the departures of packets at a container's rate
+// once its bucket is empty, and drops those due past the horizon
+func TestPacing(t *testing.T) {
+	x := loadSourceCheck(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}, nil)
+	if !x.hasPacing() {
+		t.Fatal("router loaded without the pacing")
+	}
+	frame := tcpSegment{
+		src:   netip.MustParseAddrPort("192.0.2.7:40000"),
+		dst:   netip.MustParseAddrPort("10.0.0.2:80"),
+		flags: tcpSYN,
+	}.frame()
+	// A packet's transmit time, with two in the bucket and five fitting
+	// within the horizon
+	gap := time.Duration(len(frame)) * time.Millisecond
+	limit := paceLimit{
+		Rate:      1000,
+		BurstNS:   uint64(2 * gap),
+		HorizonNS: uint64(5*gap + gap/2),
+	}
+	ingress := x.coll.Programs[paceIngressProgram]
+	if err := x.paceLimits.Put(paceKey{Ifindex: testIfindex, Dir: paceIngress}, limit); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bucket lets the first packets leave at once
+	for i := 0; i < 2; i++ {
+		if ret, departure := runPaced(t, ingress, frame, 0); ret != tcOK || departure > monotonicNow() {
+			t.Fatalf("packet %d: verdict %d, departure %v ahead, want %d and none", i, ret, time.Duration(departure-monotonicNow()), tcOK)
+		}
+	}
+	// The next leave one transmit time after another
+	var last uint64
+	delayed := 0
+	for {
+		ret, departure := runPaced(t, ingress, frame, 0)
+		if ret == tcShot {
+			break
+		}
+		if ret != tcOK {
+			t.Fatalf("verdict %d, want %d or %d", ret, tcOK, tcShot)
+		}
+		if departure <= monotonicNow() {
+			t.Fatalf("packet %d not held back", delayed)
+		}
+		if last != 0 && time.Duration(departure-last) != gap {
+			t.Errorf("packet %d leaves %v after the one before, want %v", delayed, time.Duration(departure-last), gap)
+		}
+		last = departure
+		delayed++
+		if delayed > 10 {
+			t.Fatal("no packet dropped past the horizon")
+		}
+	}
+	if delayed < 4 || delayed > 5 {
+		t.Errorf("%d packets held back before the first drop, want 4 or 5", delayed)
+	}
+	var got paceLimit
+	if err := x.paceLimits.Lookup(paceKey{Ifindex: testIfindex, Dir: paceIngress}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Delayed != uint64(delayed) || got.Dropped != 1 {
+		t.Errorf("counted %d delayed and %d dropped, want %d and 1", got.Delayed, got.Dropped, delayed)
+	}
+
+	// A sender's departure time is kept while the bucket has room, a
+	// receive timestamp isn't
+	if err := x.paceLimits.Put(paceKey{Ifindex: testIfindex, Dir: paceIngress}, limit); err != nil {
+		t.Fatal(err)
+	}
+	want := monotonicNow() + uint64(gap)
+	if _, departure := runPaced(t, ingress, frame, want); departure != want {
+		t.Errorf("departure %d, want the sender's %d", departure, want)
+	}
+	received := uint64(time.Now().UnixNano())
+	if _, departure := runPaced(t, ingress, frame, received); departure > monotonicNow() {
+		t.Errorf("departure %v ahead, want the receive timestamp replaced", time.Duration(departure-monotonicNow()))
+	}
+
+	// Limits apply in their own direction only
+	if ret, departure := runPaced(t, x.coll.Programs[paceEgressProgram], frame, 0); ret != tcOK || departure != 0 {
+		t.Errorf("unlimited direction: verdict %d, departure %d, want %d and none", ret, departure, tcOK)
+	}
+}
+
+// TestFaultDelay pushes the departures of the packets to a container back
+// by the delay of its fault, give or take the jitter, after pacing them,
+// except for those it reorders
+func TestFaultDelay(t *testing.T) {
+	x := loadSourceCheck(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}, nil)
+	if !x.hasFaultDelays() {
+		t.Fatal("router loaded without the fault delays")
+	}
+	frame := tcpSegment{
+		src:   netip.MustParseAddrPort("192.0.2.7:40000"),
+		dst:   netip.MustParseAddrPort("10.0.0.2:80"),
+		flags: tcpSYN,
+	}.frame()
+	ingress := x.coll.Programs[paceIngressProgram]
+	// delayed runs ingress on frame, checking it leaves between min and
+	// max after it ran
+	delayed := func(tstamp uint64, min, max time.Duration) time.Duration {
+		t.Helper()
+		before := monotonicNow()
+		ret, departure := runPaced(t, ingress, frame, tstamp)
+		after := monotonicNow()
+		if ret != tcOK {
+			t.Fatalf("verdict %d, want %d", ret, tcOK)
+		}
+		if departure < before+uint64(min) || departure > after+uint64(max) {
+			t.Fatalf("departure %v ahead, want between %v and %v", time.Duration(departure-after), min, max)
+		}
+		return time.Duration(departure - before)
+	}
+
+	const delay = 10 * time.Millisecond
+	if err := x.SetFaultDelay(testIfindex, &ContainerFault{Delay: delay}); err != nil {
+		t.Fatal(err)
+	}
+	delayed(0, delay, delay)
+	// A receive timestamp is on another clock
+	delayed(uint64(time.Now().UnixNano()), delay, delay)
+
+	// Jitter spreads the departures either way
+	const jitter = 5 * time.Millisecond
+	if err := x.SetFaultDelay(testIfindex, &ContainerFault{Delay: delay, Jitter: jitter}); err != nil {
+		t.Fatal(err)
+	}
+	var early, late int
+	for i := 0; i < 200; i++ {
+		d := delayed(0, delay-jitter, delay+jitter)
+		if d < delay-jitter/2 {
+			early++
+		} else if d > delay+jitter/2 {
+			late++
+		}
+	}
+	if early == 0 || late == 0 {
+		t.Errorf("%d departures a quarter of the jitter early and %d late, want some of both", early, late)
+	}
+
+	// Reordered packets skip the delay
+	if err := x.SetFaultDelay(testIfindex, &ContainerFault{Delay: delay, ReorderPercent: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, departure := runPaced(t, ingress, frame, 0); departure != 0 {
+		t.Errorf("reordered packet departs %v ahead, want no delay", time.Duration(departure-monotonicNow()))
+	}
+
+	// Paced packets are delayed after their turn
+	if err := x.SetFaultDelay(testIfindex, &ContainerFault{Delay: delay}); err != nil {
+		t.Fatal(err)
+	}
+	gap := time.Duration(len(frame)) * time.Millisecond
+	limit := paceLimit{Rate: 1000, HorizonNS: uint64(2 * gap)}
+	if err := x.paceLimits.Put(paceKey{Ifindex: testIfindex, Dir: paceIngress}, limit); err != nil {
+		t.Fatal(err)
+	}
+	delayed(0, gap+delay, gap+delay)
+
+	// The traffic from the container isn't delayed
+	if ret, departure := runPaced(t, x.coll.Programs[paceEgressProgram], frame, 0); ret != tcOK || departure != 0 {
+		t.Errorf("traffic from the container: verdict %d, departure %d, want %d and none", ret, departure, tcOK)
+	}
+	if err := x.paceLimits.Delete(paceKey{Ifindex: testIfindex, Dir: paceIngress}); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.SetFaultDelay(testIfindex, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, departure := runPaced(t, ingress, frame, 0); departure != 0 {
+		t.Errorf("departure %v ahead after the fault was cleared, want none", time.Duration(departure-monotonicNow()))
+	}
+}
@@ -0,0 +1,443 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// shapingLatency bounds how long traffic may queue before tbf drops
+	// it, or be held back by pacing
+	shapingLatency = 50 * time.Millisecond
+	// minShapingBurst fits a full GSO packet, which veths pass unsegmented
+	minShapingBurst = 64 << 10
+	// fqHorizon bounds the departures fq holds packets until, which the
+	// delays of faults push out by up to twice MaxFaultDelay
+	fqHorizon = shapingLatency + 2*MaxFaultDelay
+	// fqFlowLimit is how many packets of a flow fq holds, as many as
+	// netem holds by default
+	fqFlowLimit = 1000
+)
+
+// shapingHandle is the handle of the tbf or fq root qdisc limiting a veth
+// end
+var shapingHandle = netlink.MakeHandle(1, 0)
+
+// Directions of paceKey, mirroring PACE_*
+const (
+	paceIngress = 0
+	paceEgress  = 1
+)
+
+// paceKey mirrors struct pace_key in bpf/container_router.c
+type paceKey struct {
+	Ifindex uint32
+	Dir     uint32
+}
+
+// paceLimit mirrors struct pace_limit in bpf/container_router.c
+type paceLimit struct {
+	Rate      uint64
+	BurstNS   uint64
+	HorizonNS uint64
+	LastNS    uint64
+	Delayed   uint64
+	Dropped   uint64
+}
+
+// hasPacing reports whether the router was loaded with the pacing, which
+// needs TC support
+func (x *xdpProgram) hasPacing() bool {
+	return x.paceLimits != nil && x.coll.Programs[paceIngressProgram] != nil && x.coll.Programs[paceEgressProgram] != nil
+}
+
+// paces reports whether the router can pace containers. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) paces() bool {
+	return nm.xdp != nil && nm.xdp.hasPacing()
+}
+
+// applyBandwidthLimit replaces the limits of cn. Traffic to the container
+// is limited as it leaves the host veth and traffic from it as it leaves
+// the container's eth0, since a qdisc only holds back egress. Callers must
+// hold nm.mu.
+func (nm *NetworkManager) applyBandwidthLimit(cn *ContainerNetwork, ingressBps, egressBps uint64) error {
+	if ingressBps != cn.IngressBps {
+		if err := nm.limitIngress(cn, ingressBps); err != nil {
+			return fmt.Errorf("failed to shape traffic to the container: %w", err)
+		}
+		if err := nm.reapplyFaultQdisc(cn, ingressBps > 0); err != nil {
+			return err
+		}
+		// Redirected packets skip the qdisc and filters, so shaped ones
+		// take the stack
+		if nm.xdp != nil {
+			if err := nm.xdp.SetShaped(cn.addrs(), ingressBps > 0 || mirrorsIngress(cn.Mirrors) || cn.faultQdisc || cn.faultDelayed || cn.captures > 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	if egressBps != cn.EgressBps {
+		if err := nm.limitEgress(cn, egressBps); err != nil {
+			return fmt.Errorf("failed to shape traffic from the container: %w", err)
+		}
+	}
+	return nil
+}
+
+// limitIngress limits the traffic to cn to bps, removing the limit when
+// bps is 0. The router paces it where it can, see tc_pace_ingress in
+// bpf/container_router.c, and tbf shapes it otherwise. With a fault's
+// netem qdisc, which hangs below tbf, the traffic is shaped. Callers must
+// hold nm.mu.
+func (nm *NetworkManager) limitIngress(cn *ContainerNetwork, bps uint64) error {
+	h := &netlink.Handle{}
+	key := paceKey{Ifindex: uint32(cn.HostIfindex), Dir: paceIngress}
+	if bps > 0 && nm.paces() && !cn.faultQdisc {
+		paced, err := nm.xdp.pace(h, cn.HostInterface, key, paceIngressProgram, bps)
+		if err != nil {
+			return err
+		}
+		if paced {
+			cn.pacedIngress = true
+			return nm.xdp.keepTapFirst(cn.HostIfindex)
+		}
+	}
+	// The filter and fq stay while they delay a fault
+	if bps == 0 && cn.faultDelayed {
+		if err := ignoreNotExist(nm.xdp.paceLimits.Delete(key)); err != nil {
+			return err
+		}
+		cn.pacedIngress = false
+		return nil
+	}
+	if err := nm.unpace(h, cn.HostInterface, key); err != nil {
+		return err
+	}
+	cn.pacedIngress = false
+	return setShaping(h, cn.HostInterface, bps)
+}
+
+// limitEgress is limitIngress for the traffic from cn, on its eth0. It is
+// paced by the ifindex of eth0, which is only unique within the
+// container's namespace, so a container whose ifindex another container
+// paced already is shaped instead. Callers must hold nm.mu.
+func (nm *NetworkManager) limitEgress(cn *ContainerNetwork, bps uint64) error {
+	h, err := containerHandle(cn)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	link, err := h.LinkByName(containerIfName)
+	if err != nil {
+		return err
+	}
+	index := link.Attrs().Index
+	key := paceKey{Ifindex: uint32(index), Dir: paceEgress}
+	if bps > 0 && nm.paces() && !nm.pacesEgressOf(cn, index) {
+		paced, err := nm.xdp.pace(h, containerIfName, key, paceEgressProgram, bps)
+		if err != nil {
+			return err
+		}
+		if paced {
+			cn.pacedEgress = index
+			return nil
+		}
+	}
+	// The limit of another container's interface is left alone
+	if nm.pacesEgressOf(cn, index) {
+		err = unpaceLink(h, containerIfName)
+	} else {
+		err = nm.unpace(h, containerIfName, key)
+	}
+	if err != nil {
+		return err
+	}
+	cn.pacedEgress = 0
+	return setShaping(h, containerIfName, bps)
+}
+
+// pacesEgressOf reports whether the router paces the traffic from a
+// container other than cn by the ifindex index. Callers must hold nm.mu.
+func (nm *NetworkManager) pacesEgressOf(cn *ContainerNetwork, index int) bool {
+	for _, other := range nm.containers {
+		if other != cn && other.pacedEgress == index {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreBandwidthLimit limits cn as it was before a restart or an
+// upgrade of the router: the filters left on its interfaces run the
+// previous program, and the limits pacing it may be gone with its maps.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) restoreBandwidthLimit(cn *ContainerNetwork) error {
+	if cn.IngressBps > 0 {
+		if err := nm.limitIngress(cn, cn.IngressBps); err != nil {
+			return fmt.Errorf("failed to shape traffic to the container: %w", err)
+		}
+		if err := nm.reapplyFaultQdisc(cn, true); err != nil {
+			return err
+		}
+	}
+	if cn.EgressBps > 0 {
+		if err := nm.limitEgress(cn, cn.EgressBps); err != nil {
+			return fmt.Errorf("failed to shape traffic from the container: %w", err)
+		}
+	}
+	return nil
+}
+
+// syncBandwidthLimits restores the limits of every container, e.g. after
+// an upgrade. Callers must hold nm.mu.
+func (nm *NetworkManager) syncBandwidthLimits() error {
+	var errs []error
+	for id, cn := range nm.containers {
+		if err := nm.restoreBandwidthLimit(cn); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// paceFilter is the pacing's filter on the interface with index, on
+// clsact egress
+func paceFilter(index int) *netlink.BpfFilter {
+	return &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: index,
+			Parent:    netlink.HANDLE_MIN_EGRESS,
+			Handle:    1,
+			Priority:  tcFilterPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		DirectAction: true,
+	}
+}
+
+// pace has prog pace the traffic leaving the interface name at bps as the
+// limit of key, behind an fq qdisc at its root, which holds packets until
+// their departure time, and reports whether it does. Without fq, e.g. as
+// the kernel lacks sch_fq, it doesn't. A limit changed in place keeps its
+// bucket and counters.
+func (x *xdpProgram) pace(h *netlink.Handle, name string, key paceKey, prog string, bps uint64) (bool, error) {
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return false, err
+	}
+	var limit paceLimit
+	if err := x.paceLimits.Lookup(key, &limit); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return false, err
+	}
+	paced, err := x.attachPacing(h, link.Attrs().Index, prog)
+	if !paced {
+		return false, err
+	}
+	rate := max(bps/8, 1)
+	limit.Rate = rate
+	limit.BurstNS = uint64(time.Duration(shapingBurst(rate)) * time.Second / time.Duration(rate))
+	limit.HorizonNS = uint64(shapingLatency)
+	if err := x.paceLimits.Put(key, limit); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// attachPacing puts an fq qdisc at the root of the interface index and
+// prog on its clsact egress, and reports whether it could. Without fq it
+// leaves the interface alone.
+func (x *xdpProgram) attachPacing(h *netlink.Handle, index int, prog string) (bool, error) {
+	fq := netlink.NewFq(netlink.QdiscAttrs{LinkIndex: index, Handle: shapingHandle, Parent: netlink.HANDLE_ROOT})
+	fq.Horizon = uint32(fqHorizon.Microseconds())
+	fq.FlowPacketLimit = fqFlowLimit
+	if h.QdiscReplace(fq) != nil {
+		return false, nil
+	}
+
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: index,
+			Parent:    netlink.HANDLE_CLSACT,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+		},
+		QdiscType: "clsact",
+	}
+	if err := h.QdiscAdd(clsact); err != nil && !errors.Is(err, unix.EEXIST) {
+		return false, fmt.Errorf("failed to add clsact qdisc: %w", err)
+	}
+	filter := paceFilter(index)
+	filter.Name, filter.Fd = prog, x.coll.Programs[prog].FD()
+	if err := h.FilterReplace(filter); err != nil {
+		return false, fmt.Errorf("failed to install TC filter: %w", err)
+	}
+	return true, nil
+}
+
+// unpace stops pacing the interface name as the limit of key, if the
+// router paced it, now or before a restart
+func (nm *NetworkManager) unpace(h *netlink.Handle, name string, key paceKey) error {
+	if err := unpaceLink(h, name); err != nil {
+		return err
+	}
+	if !nm.paces() {
+		return nil
+	}
+	return ignoreNotExist(nm.xdp.paceLimits.Delete(key))
+}
+
+// unpaceLink removes the pacing's filter and fq qdisc from the interface
+// name
+func unpaceLink(h *netlink.Handle, name string) error {
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	index := link.Attrs().Index
+	err = h.FilterDel(paceFilter(index))
+	// The interface has no clsact qdisc, or no filter
+	if err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+		return err
+	}
+	err = h.QdiscDel(netlink.NewFq(netlink.QdiscAttrs{LinkIndex: index, Handle: shapingHandle, Parent: netlink.HANDLE_ROOT}))
+	// The root qdisc is another, or the default
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EINVAL) {
+		return nil
+	}
+	return err
+}
+
+// DeletePacing removes the limits of keys, e.g. as the interfaces they
+// pace go away and their ifindexes may be reused
+func (x *xdpProgram) DeletePacing(keys ...paceKey) error {
+	for _, key := range keys {
+		if err := ignoreNotExist(x.paceLimits.Delete(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setShaping replaces the tbf on the named link, removing it when bps is 0
+func setShaping(h *netlink.Handle, name string, bps uint64) error {
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	attrs := netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    shapingHandle,
+		Parent:    netlink.HANDLE_ROOT,
+	}
+	if bps == 0 {
+		err := h.QdiscDel(&netlink.Tbf{QdiscAttrs: attrs})
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EINVAL) {
+			return nil
+		}
+		return err
+	}
+
+	rate := bps / 8
+	burst := shapingBurst(rate)
+	return h.QdiscReplace(&netlink.Tbf{
+		QdiscAttrs: attrs,
+		Rate:       rate,
+		Limit:      burst + uint32(math.Min(float64(rate)*shapingLatency.Seconds(), math.MaxUint32/2)),
+		Buffer:     uint32(netlink.Xmittime(rate, burst)),
+	})
+}
+
+// readShapingStats adds the packets dropped and held back by cn's limits
+func (nm *NetworkManager) readShapingStats(cn *ContainerNetwork, stats map[string]uint64) error {
+	if nm.paces() {
+		keys := []paceKey{{Ifindex: uint32(cn.HostIfindex), Dir: paceIngress}}
+		if cn.pacedEgress != 0 {
+			keys = append(keys, paceKey{Ifindex: uint32(cn.pacedEgress), Dir: paceEgress})
+		}
+		for _, key := range keys {
+			var limit paceLimit
+			err := nm.xdp.paceLimits.Lookup(key, &limit)
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read stats for %s: %w", cn.ContainerID, err)
+			}
+			stats["shaping_dropped_packets"] += limit.Dropped
+			stats["shaping_delayed_packets"] += limit.Delayed
+		}
+	}
+	if cn.IngressBps > 0 && !cn.pacedIngress {
+		if err := addShapingStats(&netlink.Handle{}, cn.HostInterface, stats); err != nil {
+			return fmt.Errorf("failed to read stats for %s: %w", cn.ContainerID, err)
+		}
+	}
+	if cn.EgressBps > 0 && cn.pacedEgress == 0 {
+		h, err := containerHandle(cn)
+		if err != nil {
+			return err
+		}
+		defer h.Delete()
+		if err := addShapingStats(h, containerIfName, stats); err != nil {
+			return fmt.Errorf("failed to read stats for %s: %w", cn.ContainerID, err)
+		}
+	}
+	return nil
+}
+
+func addShapingStats(h *netlink.Handle, name string, stats map[string]uint64) error {
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	qdiscs, err := h.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		attrs := q.Attrs()
+		if _, ok := q.(*netlink.Tbf); !ok || attrs.Handle != shapingHandle || attrs.Statistics == nil || attrs.Statistics.Queue == nil {
+			continue
+		}
+		stats["shaping_dropped_packets"] += uint64(attrs.Statistics.Queue.Drops)
+		stats["shaping_delayed_packets"] += uint64(attrs.Statistics.Queue.Overlimits)
+	}
+	return nil
+}
+
+// containerHandle opens netlink in cn's namespace. Note that a container
+// with CAP_NET_ADMIN can remove the qdisc limiting its own traffic.
+func containerHandle(cn *ContainerNetwork) (*netlink.Handle, error) {
+	if cn.NetnsPath == "" {
+		return nil, fmt.Errorf("network namespace of %s is unknown", cn.ContainerID)
+	}
+	ns, err := netns.GetFromPath(cn.NetnsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %s: %w", cn.NetnsPath, err)
+	}
+	defer ns.Close()
+	return netlink.NewHandleAt(ns)
+}
+
+// shapingBurst is the bucket size in bytes for rate in bytes per second
+func shapingBurst(rate uint64) uint32 {
+	// 10ms worth of traffic
+	burst := rate / 100
+	if burst < minShapingBurst {
+		return minShapingBurst
+	}
+	if burst > math.MaxUint32/2 {
+		return math.MaxUint32 / 2
+	}
+	return uint32(burst)
+}
@@ -0,0 +1,178 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// maxBatch bounds the entries written by one batch syscall. The kernel
+// copies a batch in from userspace element by element, so smaller ones
+// only cost more syscalls, but they bound how much memory an update
+// pins at once.
+const maxBatch = 512
+
+// mapBatch coalesces updates to a map: each key keeps its last put or
+// delete. flush writes them with BPF_MAP_DELETE_BATCH and
+// BPF_MAP_UPDATE_BATCH, or an update per entry on kernels before 5.6
+// and for maps without batch support, like per-CPU maps and LPM tries.
+type mapBatch[K comparable, V any] struct {
+	m    *ebpf.Map
+	puts map[K]V
+	dels map[K]struct{}
+}
+
+func newMapBatch[K comparable, V any](m *ebpf.Map) *mapBatch[K, V] {
+	return &mapBatch[K, V]{m: m, puts: make(map[K]V), dels: make(map[K]struct{})}
+}
+
+func (b *mapBatch[K, V]) put(key K, value V) {
+	delete(b.dels, key)
+	b.puts[key] = value
+}
+
+func (b *mapBatch[K, V]) delete(key K) {
+	delete(b.puts, key)
+	b.dels[key] = struct{}{}
+}
+
+// flush writes the deletes, ignoring missing keys, and then the puts.
+// Updates left unwritten by an error stay queued.
+func (b *mapBatch[K, V]) flush() error {
+	if len(b.dels) > 0 {
+		keys := make([]K, 0, len(b.dels))
+		for key := range b.dels {
+			keys = append(keys, key)
+		}
+		if err := batchDelete(b.m, keys); err != nil {
+			return err
+		}
+		clear(b.dels)
+	}
+	if len(b.puts) > 0 {
+		keys := make([]K, 0, len(b.puts))
+		values := make([]V, 0, len(b.puts))
+		for key, value := range b.puts {
+			keys = append(keys, key)
+			values = append(values, value)
+		}
+		if err := batchUpdate(b.m, keys, values); err != nil {
+			return err
+		}
+		clear(b.puts)
+	}
+	return nil
+}
+
+// batchUpdate puts keys and values into m in batches of up to maxBatch,
+// halving them while the kernel is short of memory or finds a bucket
+// busy, which the datapath holding it can cause. Kernels probed without
+// batch ops get an update per entry straight away.
+func batchUpdate[K, V any](m *ebpf.Map, keys []K, values []V) error {
+	if !probedKernel().Datapath.BatchOps {
+		return putEach(m, keys, values)
+	}
+	size := maxBatch
+	for len(keys) > 0 {
+		n := min(size, len(keys))
+		done, err := m.BatchUpdate(keys[:n], values[:n], nil)
+		switch {
+		case errors.Is(err, ebpf.ErrNotSupported):
+			return putEach(m, keys, values)
+		case isBackpressure(err) && size > 1:
+			size /= 2
+		case err != nil:
+			return err
+		}
+		keys, values = keys[done:], values[done:]
+	}
+	return nil
+}
+
+// batchDelete deletes keys from m in batches of up to maxBatch, skipping
+// those that are missing
+func batchDelete[K any](m *ebpf.Map, keys []K) error {
+	if !probedKernel().Datapath.BatchOps {
+		return deleteEach(m, keys)
+	}
+	size := maxBatch
+	for len(keys) > 0 {
+		n := min(size, len(keys))
+		done, err := m.BatchDelete(keys[:n], nil)
+		switch {
+		case errors.Is(err, ebpf.ErrNotSupported):
+			return deleteEach(m, keys)
+		case errors.Is(err, ebpf.ErrKeyNotExist):
+			// The batch stopped at the missing key
+			done++
+		case isBackpressure(err) && size > 1:
+			size /= 2
+		case err != nil:
+			return err
+		}
+		keys = keys[done:]
+	}
+	return nil
+}
+
+// putEach puts keys and values into m one by one, for kernels and maps
+// without batch support
+func putEach[K, V any](m *ebpf.Map, keys []K, values []V) error {
+	for i := range keys {
+		if err := m.Put(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteEach deletes keys from m one by one, skipping those that are
+// missing
+func deleteEach[K any](m *ebpf.Map, keys []K) error {
+	for _, key := range keys {
+		if err := ignoreNotExist(m.Delete(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isBackpressure reports whether a batch failed for want of resources a
+// smaller one might get
+func isBackpressure(err error) bool {
+	return errors.Is(err, unix.ENOMEM) || errors.Is(err, unix.EBUSY)
+}
+
+// routeBatch queues the route updates of an xdpProgram, see BatchRoutes
+type routeBatch struct {
+	routes  *mapBatch[routeKey, containerInfo]
+	routes6 *mapBatch[routeKey6, containerInfo]
+}
+
+// BatchRoutes queues the route updates of AddContainer, DeleteContainer
+// and the node routes until FlushRoutes writes them in batches. SetShaped
+// and SetMTU don't see the queued routes meanwhile.
+func (x *xdpProgram) BatchRoutes() {
+	if x.batch == nil {
+		x.batch = &routeBatch{
+			routes:  newMapBatch[routeKey, containerInfo](x.routes),
+			routes6: newMapBatch[routeKey6, containerInfo](x.routes6),
+		}
+	}
+}
+
+// FlushRoutes writes the queued route updates and stops queueing them
+func (x *xdpProgram) FlushRoutes() error {
+	b := x.batch
+	x.batch = nil
+	if b == nil {
+		return nil
+	}
+	if err := b.routes.flush(); err != nil {
+		return err
+	}
+	return b.routes6.flush()
+}
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// Buckets of the database of a BoltStateStore. Containers are keyed by
+// container ID, the rest of the state by its field in stateFile.
+var (
+	boltContainers = []byte("containers")
+	boltState      = []byte("state")
+)
+
+// boltLockTimeout is how long NewBoltStateStore waits for another process
+// holding the database to let go of it
+const boltLockTimeout = 5 * time.Second
+
+// BoltStateStore keeps state in a bolt database, a key per container, so a
+// save only rewrites the pages of the containers that changed rather than
+// the whole state, as NewFileStateStore does. The database is held open,
+// and locked against other processes, until Close.
+type BoltStateStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStateStore opens or creates the bolt database at path
+func NewBoltStateStore(path string) (*BoltStateStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network state %s: %w", path, err)
+	}
+	return &BoltStateStore{db: db}, nil
+}
+
+// Close closes the database
+func (s *BoltStateStore) Close() error {
+	return s.db.Close()
+}
+
+// Save implements StateStore. Containers no longer in state are deleted and
+// unchanged ones left alone, in one transaction.
+func (s *BoltStateStore) Save(state SavedState) error {
+	fields := map[string]any{
+		"version":      StateVersion,
+		"policies":     state.Policies,
+		"services":     state.Services,
+		"namespaces":   state.Namespaces,
+		"reservations": state.Reservations,
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltState)
+		if err != nil {
+			return err
+		}
+		for key, v := range fields {
+			if err := putJSON(b, []byte(key), v); err != nil {
+				return err
+			}
+		}
+
+		containers, err := tx.CreateBucketIfNotExists(boltContainers)
+		if err != nil {
+			return err
+		}
+		var gone [][]byte
+		if err := containers.ForEach(func(id, _ []byte) error {
+			if _, ok := state.Containers[string(id)]; !ok {
+				gone = append(gone, id)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, id := range gone {
+			if err := containers.Delete(id); err != nil {
+				return err
+			}
+		}
+		for id, cn := range state.Containers {
+			if err := putJSON(containers, []byte(id), cn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// putJSON stores v as JSON under key of b, unless it's stored already
+func putJSON(b *bolt.Bucket, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if string(b.Get(key)) == string(data) {
+		return nil
+	}
+	return b.Put(key, data)
+}
+
+// Load implements StateStore
+func (s *BoltStateStore) Load() (SavedState, error) {
+	state := SavedState{Containers: map[string]ContainerNetwork{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltState)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte("version")); string(v) != strconv.Itoa(StateVersion) {
+			return fmt.Errorf("network state %s has unsupported version %s", s.db.Path(), v)
+		}
+		for key, v := range map[string]any{
+			"policies":     &state.Policies,
+			"services":     &state.Services,
+			"namespaces":   &state.Namespaces,
+			"reservations": &state.Reservations,
+		} {
+			if err := getJSON(b, key, v); err != nil {
+				return err
+			}
+		}
+
+		containers := tx.Bucket(boltContainers)
+		if containers == nil {
+			return nil
+		}
+		return containers.ForEach(func(id, data []byte) error {
+			var cn ContainerNetwork
+			if err := json.Unmarshal(data, &cn); err != nil {
+				return fmt.Errorf("%w: container %s: %v", storage.ErrCorrupt, id, err)
+			}
+			state.Containers[string(id)] = cn
+			return nil
+		})
+	})
+	if err != nil {
+		return SavedState{}, err
+	}
+	return state, nil
+}
+
+// getJSON decodes the JSON under key of b into v, leaving it alone when
+// the key is missing
+func getJSON(b *bolt.Bucket, key string, v any) error {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s: %v", storage.ErrCorrupt, key, err)
+	}
+	return nil
+}
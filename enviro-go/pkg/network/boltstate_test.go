@@ -0,0 +1,56 @@
+package network
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBoltStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network.db")
+	s, err := NewBoltStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty.Containers) != 0 || empty.Containers == nil {
+		t.Errorf("Load() of an empty store = %+v, want no containers", empty)
+	}
+
+	state := SavedState{
+		Containers: map[string]ContainerNetwork{
+			"c1": {ContainerID: "c1", IPv4: "10.0.0.2"},
+			"c2": {ContainerID: "c2", IPv4: "10.0.0.3", IPv6: "fd00::3"},
+		},
+		Policies:     []NetworkPolicy{{Name: "deny-all"}},
+		Namespaces:   []Namespace{{Name: "team-a"}},
+		Reservations: []Reservation{{ContainerID: "c3", IPv4: "10.0.0.9"}},
+	}
+	if err := s.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	delete(state.Containers, "c1")
+	state.Policies = nil
+	if err := s.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewBoltStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	got, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, state) {
+		t.Errorf("Load() = %+v, want %+v", got, state)
+	}
+}
@@ -0,0 +1,3670 @@
+// SPDX-License-Identifier: GPL-2.0
+//
+// XDP program for container packet forwarding, with a TC classifier
+// variant for interfaces XDP can't be attached to, a classifier checking
+// the sources of the traffic containers send, classifiers pacing that of
+// containers with a bandwidth limit and one capturing that of containers
+// being captured. Both routers tail call the datapath extensions
+// registered at their hooks. Optional cgroup programs enforce the same
+// policies as containers connect, splice TCP between containers of this
+// node past both kernel stacks, and steer traffic of containers to a
+// proxy of theirs.
+//
+// Compiled to eBPF bytecode with `make bpf` and embedded into the Go
+// binary when built with -tags bpfobj. Map layouts must match the Go
+// definitions in pkg/network/xdp_linux.go.
+
+#include <linux/bpf.h>
+#include <linux/icmp.h>
+#include <linux/icmpv6.h>
+#include <linux/if_arp.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/ipv6.h>
+#include <linux/pkt_cls.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_endian.h>
+
+// ctx_load reads a field of a context or socket as a load of its own.
+// Otherwise the compiler may sink the reads of an IPv4 address and of the
+// last word of an IPv6 one, taken on different branches, into one load
+// through a computed pointer, which the verifier rejects for these.
+#define ctx_load(field) (*(volatile typeof(field) *)&(field))
+
+// Deliver through the kernel stack so the veth's qdisc and filters can
+// shape and mirror traffic
+#define CONTAINER_F_SHAPED 1
+// mac and host_mac are set. Without them a redirected frame would not be
+// addressed to the container, so it takes the kernel stack instead.
+#define CONTAINER_F_MAC 2
+// The container is draining before its deletion: SYNs opening connections
+// to it take the kernel stack, which rejects them, while the connections
+// it has keep being redirected
+#define CONTAINER_F_DRAINING 4
+// The route covers a prefix behind ifindex, e.g. another node's subnet,
+// rather than a container of this node. Packets to it are forwarded
+// without the checks of containers, which the node they reach applies.
+#define CONTAINER_F_PREFIX 8
+
+struct container_info {
+	__u32 ifindex;
+	__u32 flags;
+	// Redirected frames are rewritten to go from host_mac, the host-side
+	// veth, to mac, the container's eth0
+	__u8 mac[ETH_ALEN];
+	__u8 host_mac[ETH_ALEN];
+	// Largest IP packet the container's interface takes, 0 for no check
+	__u32 mtu;
+};
+
+// route_key is a prefix of container_routes: a container's address as a
+// /32, or a prefix routed elsewhere with CONTAINER_F_PREFIX
+struct route_key {
+	__u32 prefixlen;
+	__u32 addr;
+};
+
+// route_key6 is route_key for IPv6
+struct route_key6 {
+	__u32 prefixlen;
+	struct in6_addr addr;
+};
+
+// IPv4 prefix (network byte order) -> host-side veth or the interface
+// the prefix is behind. The longest prefix matches, so a container's /32
+// wins over a node's subnet it lies in.
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 65536);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct route_key);
+	__type(value, struct container_info);
+} container_routes SEC(".maps");
+
+// IPv6 prefix -> host-side veth or the interface the prefix is behind
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 65536);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct route_key6);
+	__type(value, struct container_info);
+} container_routes6 SEC(".maps");
+
+// lookup_route4 and lookup_route6 return the longest route to addr, NULL
+// if none covers it
+static __always_inline struct container_info *lookup_route4(__u32 addr)
+{
+	struct route_key key = { .prefixlen = 32, .addr = addr };
+	return bpf_map_lookup_elem(&container_routes, &key);
+}
+
+static __always_inline struct container_info *lookup_route6(const struct in6_addr *addr)
+{
+	struct route_key6 key = { .prefixlen = 128, .addr = *addr };
+	return bpf_map_lookup_elem(&container_routes6, &key);
+}
+
+// container4 and container6 return the route to the container of this
+// node at addr, NULL if there is none
+static __always_inline struct container_info *container4(__u32 addr)
+{
+	struct container_info *info = lookup_route4(addr);
+	if (!info || (info->flags & CONTAINER_F_PREFIX))
+		return NULL;
+	return info;
+}
+
+static __always_inline struct container_info *container6(const struct in6_addr *addr)
+{
+	struct container_info *info = lookup_route6(addr);
+	if (!info || (info->flags & CONTAINER_F_PREFIX))
+		return NULL;
+	return info;
+}
+
+struct datapath_stats {
+	__u64 packets;
+	__u64 bytes;
+	__u64 drops;
+	__u64 redirects;
+	// Packets over the container's MTU answered with an ICMP error
+	__u64 frag_needed;
+	// Packets a reject policy answered with a TCP reset or an ICMP error,
+	// which drops doesn't count
+	__u64 rejects;
+	// SYNs to flooded destinations answered with a cookie, and resets
+	// answering those whose cookie was valid or not, see syn_protect
+	__u64 syn_cookies_sent;
+	__u64 syn_cookies_valid;
+	__u64 syn_cookies_invalid;
+	// Frames containers sent from a MAC or address not theirs, dropped by
+	// tc_container_source
+	__u64 spoofed;
+	// ARP and neighbor discovery messages containers sent claiming an
+	// address or MAC not theirs, which spoofed leaves out
+	__u64 neighbor_spoofed;
+	// Packets checked against the policies, and the connections and UDP
+	// sends cgroup_connect4/6 and cgroup_sendmsg4/6 checked and of those
+	// refused, counted for the container connecting
+	__u64 policy_checks;
+	__u64 connect_checks;
+	__u64 connect_denied;
+	// Sockets sockops_accelerate added to accel_socks, and the messages
+	// and bytes sk_msg_accelerate spliced to their peers, counted for the
+	// container sending
+	__u64 accel_sockets;
+	__u64 accel_msgs;
+	__u64 accel_bytes;
+};
+
+// Node-wide counters, one slot summed across CPUs by userspace
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct datapath_stats);
+} stats SEC(".maps");
+
+// Per-container counters keyed by host-side veth ifindex, so both address
+// families of a container share one entry. Entries are created by
+// userspace when the container is added, never by the program.
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u32);
+	__type(value, struct datapath_stats);
+} container_stats SEC(".maps");
+
+// LATENCY_BUCKETS is the number of log2 latency buckets: bucket i counts
+// packets handled in [2^i, 2^(i+1)) nanoseconds, the last any longer
+#define LATENCY_BUCKETS 32
+
+// latency_hist is a histogram of the time the router takes per packet,
+// from entering the program to its verdict
+struct latency_hist {
+	__u64 packets;
+	__u64 total_ns;
+	__u64 buckets[LATENCY_BUCKETS];
+};
+
+// Node-wide latency, one slot summed across CPUs by userspace
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct latency_hist);
+} latency SEC(".maps");
+
+// Per-container latency keyed like container_stats, with entries created
+// by userspace alongside
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u32);
+	__type(value, struct latency_hist);
+} container_latency SEC(".maps");
+
+// Directions and protocols of the traffic breakdown
+#define TRAFFIC_INGRESS 0
+#define TRAFFIC_EGRESS 1
+#define TRAFFIC_DIRECTIONS 2
+#define TRAFFIC_TCP 0
+#define TRAFFIC_UDP 1
+#define TRAFFIC_ICMP 2
+#define TRAFFIC_OTHER 3
+#define TRAFFIC_PROTOS 4
+// SIZE_BUCKETS is the number of packet size buckets: bucket 0 counts
+// packets under 64 bytes, bucket i those of [2^(i+5), 2^(i+6)) bytes, the
+// last any larger, e.g. GRO and TSO super-packets
+#define SIZE_BUCKETS 12
+
+struct traffic_counter {
+	__u64 packets;
+	__u64 bytes;
+};
+
+// traffic_dir is the traffic of a container in one direction, by
+// protocol and by size
+struct traffic_dir {
+	struct traffic_counter protos[TRAFFIC_PROTOS];
+	__u64 sizes[SIZE_BUCKETS];
+};
+
+// traffic_stats is 160 bytes a direction, so an entry takes 320 bytes per
+// possible CPU
+struct traffic_stats {
+	struct traffic_dir dirs[TRAFFIC_DIRECTIONS];
+};
+
+// Per-container traffic breakdown keyed like container_stats, with entries
+// created by userspace alongside. Entries are allocated as containers are
+// added rather than up front, so the map costs nothing per container it
+// could hold but doesn't.
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+	__uint(max_entries, 65536);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, __u32);
+	__type(value, struct traffic_stats);
+} container_traffic SEC(".maps");
+
+// log2_u64 returns the index of the highest bit set in v, 0 for 0
+static __always_inline __u32 log2_u64(__u64 v)
+{
+	__u32 r, shift;
+
+	r = (v > 0xffffffff) << 5;
+	v >>= r;
+	shift = (v > 0xffff) << 4;
+	v >>= shift;
+	r |= shift;
+	shift = (v > 0xff) << 3;
+	v >>= shift;
+	r |= shift;
+	shift = (v > 0xf) << 2;
+	v >>= shift;
+	r |= shift;
+	shift = (v > 0x3) << 1;
+	v >>= shift;
+	r |= shift;
+	return r | (v >> 1);
+}
+
+static __always_inline void record_latency(struct latency_hist *h, __u64 ns)
+{
+	if (!h)
+		return;
+	__u32 b = log2_u64(ns);
+	if (b >= LATENCY_BUCKETS)
+		b = LATENCY_BUCKETS - 1;
+	h->packets++;
+	h->total_ns += ns;
+	h->buckets[b]++;
+}
+
+// record_traffic counts a packet of proto and bytes in direction dir of
+// the container behind ifindex
+static __always_inline void record_traffic(__u32 ifindex, __u32 dir, __u8 proto, __u64 bytes)
+{
+	struct traffic_stats *t = bpf_map_lookup_elem(&container_traffic, &ifindex);
+	if (!t || dir >= TRAFFIC_DIRECTIONS)
+		return;
+	__u32 p;
+	switch (proto) {
+	case IPPROTO_TCP:
+		p = TRAFFIC_TCP;
+		break;
+	case IPPROTO_UDP:
+		p = TRAFFIC_UDP;
+		break;
+	case IPPROTO_ICMP:
+	case IPPROTO_ICMPV6:
+		p = TRAFFIC_ICMP;
+		break;
+	default:
+		p = TRAFFIC_OTHER;
+	}
+	__u32 b = log2_u64(bytes);
+	b = b < 6 ? 0 : b - 5;
+	if (b >= SIZE_BUCKETS)
+		b = SIZE_BUCKETS - 1;
+	struct traffic_dir *d = &t->dirs[dir];
+	d->protos[p].packets++;
+	d->protos[p].bytes += bytes;
+	d->sizes[b]++;
+}
+
+#define POLICY_ALLOW 1
+#define POLICY_DENY 2
+#define POLICY_REJECT 3
+
+// Addresses and port in network byte order. Zero src, proto or port are
+// wildcards; dst is always a container address.
+struct policy_key {
+	__u32 src;
+	__u32 dst;
+	__u16 port;
+	__u8 proto;
+	__u8 pad;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, struct policy_key);
+	__type(value, __u8);
+} policies SEC(".maps");
+
+// IPv6 counterpart of policy_key, with the same wildcards
+struct policy_key6 {
+	struct in6_addr src;
+	struct in6_addr dst;
+	__u16 port;
+	__u8 proto;
+	__u8 pad;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, struct policy_key6);
+	__type(value, __u8);
+} policies6 SEC(".maps");
+
+// Rules with a source CIDR. Everything before src must match exactly, so
+// prefixlen is the bits of dst, port, proto and pad plus the length of
+// the CIDR, and a lookup finds the longest CIDR containing the source.
+#define POLICY_CIDR_BITS 64
+#define POLICY_CIDR6_BITS 160
+
+struct policy_cidr_key {
+	__u32 prefixlen;
+	__u32 dst;
+	__u16 port;
+	__u8 proto;
+	__u8 pad;
+	__u32 src;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 16384);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct policy_cidr_key);
+	__type(value, __u8);
+} policy_cidrs SEC(".maps");
+
+struct policy_cidr_key6 {
+	__u32 prefixlen;
+	struct in6_addr dst;
+	__u16 port;
+	__u8 proto;
+	__u8 pad;
+	struct in6_addr src;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 16384);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct policy_cidr_key6);
+	__type(value, __u8);
+} policy_cidrs6 SEC(".maps");
+
+// Slot 0 holds the MAC of the interface the program is attached to, which
+// ARP replies for container addresses point at
+struct iface_mac {
+	__u8 addr[ETH_ALEN];
+	__u16 pad;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct iface_mac);
+} router_mac SEC(".maps");
+
+// Connection states, ordered so a flow only ever advances. Each direction
+// of a flow is tracked apart, so states are inferred from the packets of
+// that direction alone.
+#define CT_NEW 1
+#define CT_ESTABLISHED 2
+#define CT_CLOSING 3
+#define CT_CLOSED 4
+
+// Directions of ct_key: the router tracks the packets towards containers,
+// the source check those containers send
+#define CT_DIR_IN 0
+#define CT_DIR_OUT 1
+
+// One direction of a TCP or UDP flow of a container. IPv4 addresses are
+// stored IPv4-mapped so both families share the map; ports are in network
+// byte order. The replies of a flow have a key of their own, with the
+// addresses and ports the other way round and the other direction.
+struct ct_key {
+	struct in6_addr src;
+	struct in6_addr dst;
+	__u16 sport;
+	__u16 dport;
+	__u8 proto;
+	__u8 dir;
+	__u8 pad[2];
+};
+
+// Times are bpf_ktime_get_ns(), i.e. CLOCK_MONOTONIC
+struct ct_entry {
+	__u64 created;
+	__u64 last_seen;
+	__u64 packets;
+	__u64 bytes;
+	// Host-side veth of the container, the destination of CT_DIR_IN
+	// packets and the source of CT_DIR_OUT ones
+	__u32 ifindex;
+	__u8 state;
+	__u8 pad[3];
+};
+
+// Evicts the least recently used flows when full rather than failing
+// inserts. Userspace sizes the map and expires idle entries.
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 131072);
+	__type(key, struct ct_key);
+	__type(value, struct ct_entry);
+} conntrack SEC(".maps");
+
+// A forwarded host port: TCP or UDP traffic to it on a host address is
+// translated to a container's address and port, see tc_port_forward. The
+// port is in network byte order.
+struct forward_key {
+	__u16 port;
+	__u8 proto;
+	__u8 pad;
+};
+
+// Where a host port is forwarded to: the container's addresses, zero for
+// a family it has none of, its port in network byte order, and its
+// host-side veth, whose source check translates the replies back
+struct forward {
+	struct in6_addr addr6;
+	__u32 addr4;
+	__u32 ifindex;
+	__u16 port;
+	__u16 pad;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 4096);
+	__type(key, struct forward_key);
+	__type(value, struct forward);
+} port_forwards SEC(".maps");
+
+// How to translate the replies of a forwarded flow back: the host address
+// and port the client connected to, and the uplink and the MACs its
+// frames came with, for sending the replies back the same way
+struct nat_entry {
+	struct in6_addr addr;
+	__u32 ifindex;
+	__u16 port;
+	__u8 mac[ETH_ALEN];
+	__u8 host_mac[ETH_ALEN];
+	__u8 pad[6];
+};
+
+// Forwarded flows as the container replies, keyed like conntrack with the
+// container as the source. Userspace removes them along with the flows
+// they translate.
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 131072);
+	__type(key, struct ct_key);
+	__type(value, struct nat_entry);
+} nat_conntrack SEC(".maps");
+
+// forward_of returns the forward of the TCP or UDP destination port of the
+// transport header at l4, NULL if it isn't forwarded
+static __always_inline struct forward *forward_of(__u8 proto, void *l4, void *data_end)
+{
+	__u16 *ports = l4;
+	if (proto != IPPROTO_TCP && proto != IPPROTO_UDP)
+		return NULL;
+	if ((void *)(ports + 2) > data_end)
+		return NULL;
+	struct forward_key key = { .port = ports[1], .proto = proto };
+	return bpf_map_lookup_elem(&port_forwards, &key);
+}
+
+// Container address -> ID of its namespace, for containers outside the
+// default namespace, whose ID is 0
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u32);
+	__type(value, __u32);
+} container_ns SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, struct in6_addr);
+	__type(value, __u32);
+} container_ns6 SEC(".maps");
+
+struct ns_pair {
+	__u32 src;
+	__u32 dst;
+};
+
+// Pairs of different namespaces whose traffic is let through; any other
+// traffic between containers of different namespaces is dropped
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 4096);
+	__type(key, struct ns_pair);
+	__type(value, __u8);
+} namespace_allow SEC(".maps");
+
+// ns_denied reports whether traffic from a container in the namespace of
+// src_ns to one in that of dst_ns is dropped. Missing entries are the
+// default namespace.
+static __always_inline int ns_denied(__u32 *src_ns, __u32 *dst_ns)
+{
+	struct ns_pair pair = { .src = src_ns ? *src_ns : 0, .dst = dst_ns ? *dst_ns : 0 };
+	if (pair.src == pair.dst)
+		return 0;
+	return !bpf_map_lookup_elem(&namespace_allow, &pair);
+}
+
+// xsk_flow_key selects traffic steered to an AF_XDP socket. IPv4
+// destinations are IPv4-mapped; port 0 matches any port.
+struct xsk_flow_key {
+	struct in6_addr dst;
+	__u16 port;
+	__u8 proto;
+	__u8 pad;
+};
+
+// Steered flow -> receive queue whose socket in xsks takes it
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 4096);
+	__type(key, struct xsk_flow_key);
+	__type(value, __u32);
+} xsk_flows SEC(".maps");
+
+// Receive queue -> AF_XDP socket bound to it
+struct {
+	__uint(type, BPF_MAP_TYPE_XSKMAP);
+	__uint(max_entries, 64);
+	__type(key, __u32);
+	__type(value, __u32);
+} xsks SEC(".maps");
+
+// xsk_steered reports whether the flow of key is steered to an AF_XDP
+// socket, trying its port and then any port
+static __always_inline int xsk_steered(struct xsk_flow_key *key)
+{
+	if (bpf_map_lookup_elem(&xsk_flows, key))
+		return 1;
+	key->port = 0;
+	return bpf_map_lookup_elem(&xsk_flows, key) != NULL;
+}
+
+// container_fault is a fault injected into the traffic to a container.
+// The router drops its packets here, and delays them in tc_pace_ingress,
+// see fault_delays.
+struct container_fault {
+	// Packets are dropped when a random number is below drop_threshold
+	__u32 drop_threshold;
+	__u32 pad;
+};
+
+// Host-side veth ifindex -> fault injected into the container's traffic.
+// Entries only exist while userspace injects one.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 4096);
+	__type(key, __u32);
+	__type(value, struct container_fault);
+} container_faults SEC(".maps");
+
+// fault_drops reports whether an injected fault drops a packet to the
+// container behind ifindex
+static __always_inline int fault_drops(__u32 ifindex)
+{
+	struct container_fault *f = bpf_map_lookup_elem(&container_faults, &ifindex);
+	return f && bpf_get_prandom_u32() < f->drop_threshold;
+}
+
+// Slot 0 holds the action applied when no policy matches, slot 1 how many
+// rejected packets each CPU answers per second
+#define POLICY_SLOT_DEFAULT 0
+#define POLICY_SLOT_REJECT_RATE 1
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 2);
+	__type(key, __u32);
+	__type(value, __u32);
+} policy_default SEC(".maps");
+
+static __always_inline __u8 policy_default_action(void)
+{
+	__u32 slot = POLICY_SLOT_DEFAULT;
+	__u32 *def = bpf_map_lookup_elem(&policy_default, &slot);
+	if (def && (*def == POLICY_DENY || *def == POLICY_REJECT))
+		return *def;
+	return POLICY_ALLOW;
+}
+
+// reject_bucket is the token bucket limiting the rejects a CPU answers,
+// holding up to a second's worth
+struct reject_bucket {
+	__u64 tokens;
+	__u64 last_ns;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct reject_bucket);
+} reject_buckets SEC(".maps");
+
+#define NSEC_PER_SEC 1000000000ULL
+
+// reject_allowed takes a token for answering a rejected packet, failing
+// when this CPU has answered its rate's worth lately
+static __always_inline int reject_allowed(void)
+{
+	__u32 slot = POLICY_SLOT_REJECT_RATE, zero = 0;
+	__u32 *rate = bpf_map_lookup_elem(&policy_default, &slot);
+	struct reject_bucket *b = bpf_map_lookup_elem(&reject_buckets, &zero);
+	if (!rate || !*rate || !b)
+		return 0;
+
+	__u64 now = bpf_ktime_get_ns();
+	// A second refills the bucket, which bounds the product
+	__u64 elapsed = now - b->last_ns;
+	if (elapsed > NSEC_PER_SEC)
+		elapsed = NSEC_PER_SEC;
+	__u64 refill = elapsed * *rate / NSEC_PER_SEC;
+	if (refill) {
+		b->tokens += refill;
+		if (b->tokens > *rate)
+			b->tokens = *rate;
+		b->last_ns = now;
+	}
+	if (!b->tokens)
+		return 0;
+	b->tokens--;
+	return 1;
+}
+
+// policy_lookup tries keys from most to least specific: rules from the
+// source container, then from CIDRs containing the source, then from
+// anywhere, each by protocol and port first
+static __always_inline __u8 policy_lookup(__u32 src, __u32 dst, __u8 proto, __u16 port)
+{
+	struct policy_key keys[6] = {
+		{ .src = src, .dst = dst, .proto = proto, .port = port },
+		{ .src = src, .dst = dst, .proto = proto },
+		{ .src = src, .dst = dst },
+		{ .dst = dst, .proto = proto, .port = port },
+		{ .dst = dst, .proto = proto },
+		{ .dst = dst },
+	};
+	struct policy_cidr_key cidr_keys[3] = {
+		{ .prefixlen = POLICY_CIDR_BITS + 32, .dst = dst, .proto = proto, .port = port, .src = src },
+		{ .prefixlen = POLICY_CIDR_BITS + 32, .dst = dst, .proto = proto, .src = src },
+		{ .prefixlen = POLICY_CIDR_BITS + 32, .dst = dst, .src = src },
+	};
+	__u8 *action;
+
+#pragma unroll
+	for (int i = 0; i < 3; i++) {
+		action = bpf_map_lookup_elem(&policies, &keys[i]);
+		if (action)
+			return *action;
+	}
+#pragma unroll
+	for (int i = 0; i < 3; i++) {
+		action = bpf_map_lookup_elem(&policy_cidrs, &cidr_keys[i]);
+		if (action)
+			return *action;
+	}
+#pragma unroll
+	for (int i = 3; i < 6; i++) {
+		action = bpf_map_lookup_elem(&policies, &keys[i]);
+		if (action)
+			return *action;
+	}
+
+	return policy_default_action();
+}
+
+// policy_lookup6 is policy_lookup for IPv6
+static __always_inline __u8 policy_lookup6(struct in6_addr *src, struct in6_addr *dst, __u8 proto, __u16 port)
+{
+	struct policy_key6 key = {};
+	struct policy_cidr_key6 cidr_key = {};
+	__u8 *action;
+
+#pragma unroll
+	for (int i = 0; i < 9; i++) {
+		if (i >= 3 && i < 6) {
+			__builtin_memset(&cidr_key, 0, sizeof(cidr_key));
+			cidr_key.prefixlen = POLICY_CIDR6_BITS + 128;
+			cidr_key.dst = *dst;
+			cidr_key.src = *src;
+			if (i % 3 < 2)
+				cidr_key.proto = proto;
+			if (i % 3 == 0)
+				cidr_key.port = port;
+
+			action = bpf_map_lookup_elem(&policy_cidrs6, &cidr_key);
+			if (action)
+				return *action;
+			continue;
+		}
+
+		__builtin_memset(&key, 0, sizeof(key));
+		if (i < 3)
+			key.src = *src;
+		key.dst = *dst;
+		if (i % 3 < 2)
+			key.proto = proto;
+		if (i % 3 == 0)
+			key.port = port;
+
+		action = bpf_map_lookup_elem(&policies6, &key);
+		if (action)
+			return *action;
+	}
+
+	return policy_default_action();
+}
+
+// l4_dport returns the TCP/UDP destination port of the transport header at
+// l4, or 0 for other protocols
+static __always_inline __u16 l4_dport(void *l4, __u8 proto, void *data_end)
+{
+	if (proto == IPPROTO_TCP) {
+		struct tcphdr *tcp = l4;
+		if ((void *)(tcp + 1) <= data_end)
+			return tcp->dest;
+	} else if (proto == IPPROTO_UDP) {
+		struct udphdr *udp = l4;
+		if ((void *)(udp + 1) <= data_end)
+			return udp->dest;
+	}
+	return 0;
+}
+
+// ct_update records a packet of len bytes to or from the container behind
+// ifindex. key holds the addresses, protocol and direction; the ports are
+// filled in from the transport header at l4. Other protocols are not
+// tracked.
+static __always_inline void ct_update(struct ct_key *key, void *l4, void *data_end, __u32 ifindex, __u64 len)
+{
+	__u8 state = CT_ESTABLISHED;
+
+	if (key->proto == IPPROTO_TCP) {
+		struct tcphdr *tcp = l4;
+		if ((void *)(tcp + 1) > data_end)
+			return;
+		key->sport = tcp->source;
+		key->dport = tcp->dest;
+		if (tcp->rst)
+			state = CT_CLOSED;
+		else if (tcp->fin)
+			state = CT_CLOSING;
+		else if (tcp->syn && !tcp->ack)
+			state = CT_NEW;
+	} else if (key->proto == IPPROTO_UDP) {
+		struct udphdr *udp = l4;
+		if ((void *)(udp + 1) > data_end)
+			return;
+		key->sport = udp->source;
+		key->dport = udp->dest;
+	} else {
+		return;
+	}
+
+	__u64 now = bpf_ktime_get_ns();
+	struct ct_entry *e = bpf_map_lookup_elem(&conntrack, key);
+	if (!e) {
+		// A flow first seen mid-stream, e.g. after a restart, is
+		// established; a UDP flow is new until its second packet
+		struct ct_entry entry = {
+			.created = now,
+			.last_seen = now,
+			.packets = 1,
+			.bytes = len,
+			.ifindex = ifindex,
+			.state = key->proto == IPPROTO_UDP ? CT_NEW : state,
+		};
+		bpf_map_update_elem(&conntrack, key, &entry, BPF_NOEXIST);
+		return;
+	}
+
+	__sync_fetch_and_add(&e->packets, 1);
+	__sync_fetch_and_add(&e->bytes, len);
+	e->last_seen = now;
+	if (state > e->state)
+		e->state = state;
+}
+
+// Why a packet was dropped, reported in drop_event.reason
+#define DROP_MALFORMED 1
+#define DROP_NAMESPACE 2
+#define DROP_POLICY 3
+// Answering an oversized packet with an ICMP error failed midway
+#define DROP_ICMP_ERROR 4
+// An injected fault, see container_faults
+#define DROP_FAULT 5
+// Answering a SYN to a flooded destination with a cookie failed midway
+#define DROP_SYN_COOKIE 6
+// A container sent from a MAC or address not its own, see
+// tc_container_source
+#define DROP_SPOOFED 7
+// A container sent ARP or neighbor discovery claiming an address or MAC
+// not its own
+#define DROP_NEIGHBOR_SPOOFED 8
+
+// drop_event describes a dropped packet. IPv4 addresses are IPv4-mapped;
+// the port is the TCP/UDP destination port in network byte order. Packets
+// dropped as malformed have no addresses.
+struct drop_event {
+	__u64 timestamp;
+	struct in6_addr src;
+	struct in6_addr dst;
+	// Host-side veth of the destination container, 0 for none, or for
+	// DROP_SPOOFED and DROP_NEIGHBOR_SPOOFED of the sending one
+	__u32 ifindex;
+	__u32 len;
+	__u16 port;
+	__u8 proto;
+	__u8 reason;
+	__u8 pad[4];
+};
+
+// Drop events for userspace to aggregate and audit. Events that don't fit
+// while userspace falls behind are counted in drop_events_lost instead.
+struct {
+	__uint(type, BPF_MAP_TYPE_RINGBUF);
+	__uint(max_entries, 256 * 1024);
+} drop_events SEC(".maps");
+
+// Kernels without ring buffers (before 5.8) get drop events through
+// drop_events_perf instead: userspace sets perf_drop_events at load and
+// replaces drop_events with a placeholder, and the verifier prunes the
+// ring buffer code as dead.
+volatile const __u32 perf_drop_events = 0;
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(__u32));
+	__uint(value_size, sizeof(__u32));
+} drop_events_perf SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, __u64);
+} drop_events_lost SEC(".maps");
+
+// What a packet did in a SYN cookie exchange, see syn_protect
+#define SYN_COOKIE_SENT 1
+#define SYN_COOKIE_VALID 2
+#define SYN_COOKIE_INVALID 3
+
+// route_result describes a routed packet for accounting
+struct route_result {
+	// ifindex of the destination container's veth, 0 for none
+	__u32 dest;
+	// The packet exceeded the container's MTU and was answered with an
+	// ICMP error
+	__u8 too_big;
+	// A reject policy answered the packet
+	__u8 rejected;
+	// The packet took part in a SYN cookie exchange, SYN_COOKIE_*
+	__u8 syn_cookie;
+	// The router took the packet for itself, so XDP_DROP is no drop
+	__u8 consumed;
+	// The packet is redirected to the AF_XDP socket of its receive queue
+	// rather than to dest
+	__u8 xsk;
+	// The packet was checked against the policies
+	__u8 policy_checked;
+	// Why the packet was dropped, DROP_*, and its flow as far as it was
+	// parsed
+	__u8 drop_reason;
+	__u8 proto;
+	__u16 port;
+	// The packet is to a forwarded host port, which tc_port_forward
+	// translates and counts once it routed it
+	__u8 forwarded;
+	struct in6_addr src;
+	struct in6_addr dst;
+};
+
+// drop records why the packet of res is dropped
+static __always_inline int drop(struct route_result *res, __u8 reason)
+{
+	res->drop_reason = reason;
+	return XDP_DROP;
+}
+
+// count_lost_drop counts a drop whose event didn't fit
+static __always_inline void count_lost_drop(void)
+{
+	__u32 zero = 0;
+	__u64 *lost = bpf_map_lookup_elem(&drop_events_lost, &zero);
+	if (lost)
+		(*lost)++;
+}
+
+// fill_drop_event describes the drop of the len byte packet of res in e
+static __always_inline void fill_drop_event(struct drop_event *e, struct route_result *res, __u64 len)
+{
+	e->timestamp = bpf_ktime_get_ns();
+	e->src = res->src;
+	e->dst = res->dst;
+	e->ifindex = res->dest;
+	e->len = len;
+	e->port = res->port;
+	e->proto = res->proto;
+	e->reason = res->drop_reason;
+	__builtin_memset(e->pad, 0, sizeof(e->pad));
+}
+
+// report_drop sends the drop of the len byte packet of res to userspace.
+// ctx is the context of the program, which perf events are output from.
+static __always_inline void report_drop(void *ctx, struct route_result *res, __u64 len)
+{
+	if (perf_drop_events) {
+		struct drop_event e;
+		fill_drop_event(&e, res, len);
+		if (bpf_perf_event_output(ctx, &drop_events_perf, BPF_F_CURRENT_CPU, &e, sizeof(e)))
+			count_lost_drop();
+		return;
+	}
+
+	struct drop_event *e = bpf_ringbuf_reserve(&drop_events, sizeof(*e), 0);
+	if (!e) {
+		count_lost_drop();
+		return;
+	}
+	fill_drop_event(e, res, len);
+	bpf_ringbuf_submit(e, 0);
+}
+
+static __always_inline void account(struct datapath_stats *s, __u64 bytes, int verdict, struct route_result *res)
+{
+	if (!s)
+		return;
+	s->packets++;
+	s->bytes += bytes;
+	if (verdict == XDP_DROP && !res->consumed)
+		s->drops++;
+	else if (verdict == XDP_REDIRECT)
+		s->redirects++;
+	if (res->too_big)
+		s->frag_needed++;
+	if (res->rejected)
+		s->rejects++;
+	if (res->policy_checked)
+		s->policy_checks++;
+	switch (res->syn_cookie) {
+	case SYN_COOKIE_SENT:
+		s->syn_cookies_sent++;
+		break;
+	case SYN_COOKIE_VALID:
+		s->syn_cookies_valid++;
+		break;
+	case SYN_COOKIE_INVALID:
+		s->syn_cookies_invalid++;
+		break;
+	}
+}
+
+static __always_inline int route(void *data, void *data_end, __u64 len, struct xdp_md *xdp,
+				 struct route_result *res);
+static __always_inline int forward_port(struct __sk_buff *skb);
+
+// Datapath extensions are programs of users' own the router tail calls at
+// its hooks, see RegisterDatapathExtension in pkg/network. The extensions
+// of hook take the slots from hook * EXT_CHAIN on in ext_xdp or ext_tc,
+// in order, followed by the router's resume program. Each ends by tail
+// calling the slot after its own, see bpf/extensions/enviro_ext.h, so the
+// last hands the packet back to the router.
+#define EXT_HOOK_PRE_ROUTING 0
+#define EXT_HOOK_POST_POLICY 1
+#define EXT_HOOK_PRE_REDIRECT 2
+#define EXT_HOOKS 3
+// EXT_SLOTS is how many extensions a hook takes, EXT_CHAIN with the resume
+// program
+#define EXT_SLOTS 8
+#define EXT_CHAIN (EXT_SLOTS + 1)
+
+// Chains of the XDP router
+struct {
+	__uint(type, BPF_MAP_TYPE_PROG_ARRAY);
+	__uint(max_entries, EXT_HOOKS * EXT_CHAIN);
+	__type(key, __u32);
+	__type(value, __u32);
+} ext_xdp SEC(".maps");
+
+// Chains of the TC router
+struct {
+	__uint(type, BPF_MAP_TYPE_PROG_ARRAY);
+	__uint(max_entries, EXT_HOOKS * EXT_CHAIN);
+	__type(key, __u32);
+	__type(value, __u32);
+} ext_tc SEC(".maps");
+
+// ext_cursor is what extensions see of the router: the hook and slot
+// running, and copies of the packet's destination and verdict. Changing
+// them only changes which extensions run next.
+struct ext_cursor {
+	__u32 hook;
+	__u32 slot;
+	// ifindex of the destination container's veth, 0 for none and before
+	// routing
+	__u32 dest;
+	// XDP_* in both program types, XDP_ABORTED before routing
+	__s32 verdict;
+	__u64 len;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct ext_cursor);
+} ext_cursor SEC(".maps");
+
+// ext_state is the router's state across the tail calls of a hook, which
+// extensions can't reach. A packet runs to its verdict on one CPU before
+// the next is handled there.
+struct ext_state {
+	__u64 start;
+	__u64 bytes;
+	// Time the router took to its verdict, extensions left out
+	__u64 ns;
+	__s32 verdict;
+	// stage is the hook the packet is at, which resuming continues after
+	__u32 stage;
+	struct route_result res;
+};
+
+// Slots of ext_states, one for each router
+#define EXT_STATE_XDP 0
+#define EXT_STATE_TC 1
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 2);
+	__type(key, __u32);
+	__type(value, struct ext_state);
+} ext_states SEC(".maps");
+
+// ext_enter hands the packet to the extensions of hook in chain, and only
+// returns when the hook has none
+static __always_inline void ext_enter(void *ctx, void *chain, struct ext_state *st, __u32 hook)
+{
+	__u32 zero = 0;
+	struct ext_cursor *c = bpf_map_lookup_elem(&ext_cursor, &zero);
+	if (!c)
+		return;
+	__u32 slot = hook * EXT_CHAIN;
+	c->hook = hook;
+	c->slot = slot;
+	c->dest = st->res.dest;
+	c->verdict = st->verdict;
+	c->len = st->bytes;
+	st->stage = hook;
+	bpf_tail_call(ctx, chain, slot);
+}
+
+// ext_state_begin returns the state of the router in slot, reset for a
+// new packet
+static __always_inline struct ext_state *ext_state_begin(__u32 slot, __u64 bytes)
+{
+	struct ext_state *st = bpf_map_lookup_elem(&ext_states, &slot);
+	if (!st)
+		return NULL;
+	__builtin_memset(st, 0, sizeof(*st));
+	st->start = bpf_ktime_get_ns();
+	st->bytes = bytes;
+	st->verdict = XDP_ABORTED;
+	return st;
+}
+
+// account_packet counts the packet of st and reports its drop. ctx is the
+// context of the program, which perf events are output from.
+static __always_inline void account_packet(void *ctx, struct ext_state *st)
+{
+	__u32 zero = 0;
+	if (st->res.forwarded)
+		return;
+	account(bpf_map_lookup_elem(&stats, &zero), st->bytes, st->verdict, &st->res);
+	record_latency(bpf_map_lookup_elem(&latency, &zero), st->ns);
+	if (st->res.dest) {
+		account(bpf_map_lookup_elem(&container_stats, &st->res.dest), st->bytes, st->verdict, &st->res);
+		record_latency(bpf_map_lookup_elem(&container_latency, &st->res.dest), st->ns);
+		record_traffic(st->res.dest, TRAFFIC_INGRESS, st->res.proto, st->bytes);
+	}
+	if (st->verdict == XDP_DROP && !st->res.consumed)
+		report_drop(ctx, &st->res, st->bytes);
+}
+
+// xdp_run runs the XDP router on the packet of st from its stage on,
+// entering the extensions of each hook on the way. resumed is set when
+// those of the stage's hook ran already.
+static __always_inline int xdp_run(struct xdp_md *ctx, struct ext_state *st, int resumed)
+{
+	switch (st->stage) {
+	case EXT_HOOK_PRE_ROUTING:
+		if (!resumed)
+			ext_enter(ctx, &ext_xdp, st, EXT_HOOK_PRE_ROUTING);
+		resumed = 0;
+		// Extensions may have resized the packet
+		st->bytes = ctx->data_end - ctx->data;
+		st->verdict = route((void *)(long)ctx->data, (void *)(long)ctx->data_end, st->bytes, ctx, &st->res);
+		st->ns = bpf_ktime_get_ns() - st->start;
+		// fallthrough
+	case EXT_HOOK_POST_POLICY:
+		if (!resumed)
+			ext_enter(ctx, &ext_xdp, st, EXT_HOOK_POST_POLICY);
+		resumed = 0;
+		account_packet(ctx, st);
+		if (st->verdict != XDP_REDIRECT)
+			return st->verdict;
+		// fallthrough
+	case EXT_HOOK_PRE_REDIRECT:
+		if (!resumed)
+			ext_enter(ctx, &ext_xdp, st, EXT_HOOK_PRE_REDIRECT);
+		// Queues without a socket route the packet through the kernel
+		if (st->res.xsk)
+			return bpf_redirect_map(&xsks, ctx->rx_queue_index, XDP_PASS);
+		return bpf_redirect(st->res.dest, 0);
+	}
+	return XDP_PASS;
+}
+
+SEC("xdp")
+int xdp_container_router(struct xdp_md *ctx)
+{
+	struct ext_state *st = ext_state_begin(EXT_STATE_XDP, ctx->data_end - ctx->data);
+	if (!st)
+		return XDP_PASS;
+	return xdp_run(ctx, st, 0);
+}
+
+// xdp_ext_resume continues the XDP router after the extensions of a hook
+SEC("xdp")
+int xdp_ext_resume(struct xdp_md *ctx)
+{
+	__u32 slot = EXT_STATE_XDP;
+	struct ext_state *st = bpf_map_lookup_elem(&ext_states, &slot);
+	if (!st)
+		return XDP_PASS;
+	return xdp_run(ctx, st, 1);
+}
+
+// ROUTE_PULL covers every header route reads: Ethernet, IPv4 with the
+// longest options, and the ports
+#define ROUTE_PULL (sizeof(struct ethhdr) + 60 + 4)
+
+// tc_run runs the TC router like xdp_run, translating its verdicts
+static __always_inline int tc_run(struct __sk_buff *skb, struct ext_state *st, int resumed)
+{
+	switch (st->stage) {
+	case EXT_HOOK_PRE_ROUTING:
+		if (!resumed)
+			ext_enter(skb, &ext_tc, st, EXT_HOOK_PRE_ROUTING);
+		resumed = 0;
+		st->bytes = skb->len;
+		// Direct access only reaches the linear part of the packet
+		bpf_skb_pull_data(skb, st->bytes < ROUTE_PULL ? st->bytes : ROUTE_PULL);
+		st->verdict = route((void *)(long)skb->data, (void *)(long)skb->data_end, st->bytes, NULL, &st->res);
+		st->ns = bpf_ktime_get_ns() - st->start;
+		// fallthrough
+	case EXT_HOOK_POST_POLICY:
+		if (!resumed)
+			ext_enter(skb, &ext_tc, st, EXT_HOOK_POST_POLICY);
+		resumed = 0;
+		account_packet(skb, st);
+		switch (st->verdict) {
+		case XDP_DROP:
+			return TC_ACT_SHOT;
+		case XDP_REDIRECT:
+			break;
+		case XDP_TX:
+			// Back out of the interface the frame arrived on
+			return bpf_redirect(skb->ifindex, 0);
+		default:
+			return TC_ACT_OK;
+		}
+		// fallthrough
+	case EXT_HOOK_PRE_REDIRECT:
+		if (!resumed)
+			ext_enter(skb, &ext_tc, st, EXT_HOOK_PRE_REDIRECT);
+		return bpf_redirect(st->res.dest, 0);
+	}
+	return TC_ACT_OK;
+}
+
+// tc_container_router is the router on clsact ingress, for interfaces XDP
+// can't be attached to. It shares the maps and verdicts of the XDP program
+// except for oversized packets, which it leaves to the kernel to answer,
+// and translates forwarded ports itself, see tc_port_forward.
+SEC("tc")
+int tc_container_router(struct __sk_buff *skb)
+{
+	if (forward_port(skb) < 0)
+		return TC_ACT_SHOT;
+	struct ext_state *st = ext_state_begin(EXT_STATE_TC, skb->len);
+	if (!st)
+		return TC_ACT_OK;
+	return tc_run(skb, st, 0);
+}
+
+// tc_ext_resume continues the TC router after the extensions of a hook
+SEC("tc")
+int tc_ext_resume(struct __sk_buff *skb)
+{
+	__u32 slot = EXT_STATE_TC;
+	struct ext_state *st = bpf_map_lookup_elem(&ext_states, &slot);
+	if (!st)
+		return TC_ACT_OK;
+	return tc_run(skb, st, 1);
+}
+
+// redirected reports whether deliver redirects frames to the container
+// behind info rather than passing them to the kernel stack
+static __always_inline int redirected(struct container_info *info)
+{
+	return !(info->flags & CONTAINER_F_SHAPED) && (info->flags & CONTAINER_F_MAC);
+}
+
+// opens_tcp reports whether the l4 header of proto is a SYN without ACK,
+// opening a TCP connection
+static __always_inline int opens_tcp(void *l4, __u8 proto, void *data_end)
+{
+	struct tcphdr *tcp = l4;
+	if (proto != IPPROTO_TCP || (void *)(tcp + 1) > data_end)
+		return 0;
+	return tcp->syn && !tcp->ack;
+}
+
+// deliver readies a frame for the container behind info, rewriting the
+// Ethernet addresses so the container accepts it. The caller of route
+// redirects it to route_result.dest.
+static __always_inline int deliver(struct ethhdr *eth, struct container_info *info)
+{
+	if (!redirected(info))
+		return XDP_PASS;
+
+	__builtin_memcpy(eth->h_dest, info->mac, ETH_ALEN);
+	__builtin_memcpy(eth->h_source, info->host_mac, ETH_ALEN);
+	return XDP_REDIRECT;
+}
+
+// forward_prefix readies a packet of len bytes for the interface behind
+// the prefix route info, like deliver. The kernel gets those over the
+// route's MTU, to fragment them or answer itself.
+static __always_inline int forward_prefix(struct ethhdr *eth, struct container_info *info, __u32 len)
+{
+	if (info->mtu && len > info->mtu)
+		return XDP_PASS;
+	return deliver(eth, info);
+}
+
+// IP_DF is the Don't Fragment flag of iphdr.frag_off
+#define IP_DF 0x4000
+
+// ICMP errors quote the offending IP header and the first 8 bytes of its
+// payload, which hold the ports the sender needs to find the flow
+#define ICMP_QUOTE 8
+
+static __always_inline __u16 csum_fold(__u32 csum)
+{
+	csum = (csum & 0xffff) + (csum >> 16);
+	csum = (csum & 0xffff) + (csum >> 16);
+	return ~csum;
+}
+
+// unreach4 turns the IPv4 packet in ctx into an ICMP Destination
+// Unreachable error with code back to its sender, advertising mtu for
+// ICMP_FRAG_NEEDED. The error comes from the packet's destination, the
+// only address on the path the sender is sure to route back. Returns
+// XDP_PASS, leaving the packet to the kernel, when it has IP options.
+static __always_inline int unreach4(struct xdp_md *ctx, __u8 code, __u32 mtu)
+{
+	int len = ctx->data_end - ctx->data;
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+
+	struct ethhdr *eth = data;
+	struct iphdr *ip = (void *)(eth + 1);
+	if ((void *)(ip + 1) + ICMP_QUOTE > data_end || ip->ihl != 5)
+		return XDP_PASS;
+
+	struct ethhdr reply_eth = { .h_proto = eth->h_proto };
+	__builtin_memcpy(reply_eth.h_dest, eth->h_source, ETH_ALEN);
+	__builtin_memcpy(reply_eth.h_source, eth->h_dest, ETH_ALEN);
+	__be32 saddr = ip->daddr, daddr = ip->saddr;
+
+	// Keep only the quote, then make room for the new IP and ICMP headers
+	int quoted = sizeof(struct ethhdr) + sizeof(struct iphdr) + ICMP_QUOTE;
+	if (bpf_xdp_adjust_tail(ctx, quoted - len))
+		return XDP_PASS;
+	if (bpf_xdp_adjust_head(ctx, -(int)(sizeof(struct iphdr) + sizeof(struct icmphdr))))
+		return XDP_DROP;
+
+	data = (void *)(long)ctx->data;
+	data_end = (void *)(long)ctx->data_end;
+	eth = data;
+	ip = (void *)(eth + 1);
+	struct icmphdr *icmp = (void *)(ip + 1);
+	__u16 icmp_len = sizeof(struct icmphdr) + sizeof(struct iphdr) + ICMP_QUOTE;
+	if ((void *)icmp + icmp_len > data_end)
+		return XDP_DROP;
+
+	__builtin_memcpy(eth, &reply_eth, sizeof(reply_eth));
+	*ip = (struct iphdr){
+		.version = 4,
+		.ihl = 5,
+		.tot_len = bpf_htons(sizeof(struct iphdr) + icmp_len),
+		.ttl = 64,
+		.protocol = IPPROTO_ICMP,
+		.saddr = saddr,
+		.daddr = daddr,
+	};
+	ip->check = csum_fold(bpf_csum_diff(0, 0, (__be32 *)ip, sizeof(struct iphdr), 0));
+
+	*icmp = (struct icmphdr){ .type = ICMP_DEST_UNREACH, .code = code };
+	icmp->un.frag.mtu = bpf_htons(mtu);
+	icmp->checksum = csum_fold(bpf_csum_diff(0, 0, (__be32 *)icmp, icmp_len, 0));
+	return XDP_TX;
+}
+
+// frag_needed4 turns the IPv4 packet in ctx into an ICMP Fragmentation
+// Needed error back to its sender, advertising mtu
+static __always_inline int frag_needed4(struct xdp_md *ctx, __u32 mtu)
+{
+	return unreach4(ctx, ICMP_FRAG_NEEDED, mtu);
+}
+
+// icmp6_error turns the IPv6 packet in ctx into an ICMPv6 error of type
+// and code back to its sender, like unreach4, with mtu in the field
+// Packet Too Big errors advertise it in
+static __always_inline int icmp6_error(struct xdp_md *ctx, __u8 type, __u8 code, __u32 mtu)
+{
+	int len = ctx->data_end - ctx->data;
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+
+	struct ethhdr *eth = data;
+	struct ipv6hdr *ip6 = (void *)(eth + 1);
+	if ((void *)(ip6 + 1) + ICMP_QUOTE > data_end)
+		return XDP_PASS;
+
+	struct ethhdr reply_eth = { .h_proto = eth->h_proto };
+	__builtin_memcpy(reply_eth.h_dest, eth->h_source, ETH_ALEN);
+	__builtin_memcpy(reply_eth.h_source, eth->h_dest, ETH_ALEN);
+	struct in6_addr saddr = ip6->daddr, daddr = ip6->saddr;
+
+	int quoted = sizeof(struct ethhdr) + sizeof(struct ipv6hdr) + ICMP_QUOTE;
+	if (bpf_xdp_adjust_tail(ctx, quoted - len))
+		return XDP_PASS;
+	if (bpf_xdp_adjust_head(ctx, -(int)(sizeof(struct ipv6hdr) + sizeof(struct icmp6hdr))))
+		return XDP_DROP;
+
+	data = (void *)(long)ctx->data;
+	data_end = (void *)(long)ctx->data_end;
+	eth = data;
+	ip6 = (void *)(eth + 1);
+	struct icmp6hdr *icmp6 = (void *)(ip6 + 1);
+	__u16 icmp_len = sizeof(struct icmp6hdr) + sizeof(struct ipv6hdr) + ICMP_QUOTE;
+	if ((void *)icmp6 + icmp_len > data_end)
+		return XDP_DROP;
+
+	__builtin_memcpy(eth, &reply_eth, sizeof(reply_eth));
+	*ip6 = (struct ipv6hdr){
+		.version = 6,
+		.payload_len = bpf_htons(icmp_len),
+		.nexthdr = IPPROTO_ICMPV6,
+		.hop_limit = 64,
+		.saddr = saddr,
+		.daddr = daddr,
+	};
+
+	*icmp6 = (struct icmp6hdr){ .icmp6_type = type, .icmp6_code = code };
+	icmp6->icmp6_mtu = bpf_htonl(mtu);
+	// The checksum also covers a pseudo-header of the addresses, length
+	// and next header
+	__be32 pseudo[2] = { bpf_htonl(icmp_len), bpf_htonl(IPPROTO_ICMPV6) };
+	__s64 sum = bpf_csum_diff(0, 0, (__be32 *)&ip6->saddr, 2 * sizeof(struct in6_addr), 0);
+	sum = bpf_csum_diff(0, 0, pseudo, sizeof(pseudo), sum);
+	sum = bpf_csum_diff(0, 0, (__be32 *)icmp6, icmp_len, sum);
+	icmp6->icmp6_cksum = csum_fold(sum);
+	return XDP_TX;
+}
+
+// packet_too_big6 turns the IPv6 packet in ctx into an ICMPv6 Packet Too
+// Big error back to its sender, advertising mtu
+static __always_inline int packet_too_big6(struct xdp_md *ctx, __u32 mtu)
+{
+	return icmp6_error(ctx, ICMPV6_PKT_TOOBIG, 0, mtu);
+}
+
+// tcp_reply is a segment the router answers with, a bare header without
+// options or payload
+struct tcp_reply {
+	__be16 source;
+	__be16 dest;
+	__be32 seq;
+	__be32 ack_seq;
+	__u8 syn;
+	__u8 ack;
+	__u8 rst;
+};
+
+// reset_of fills r with a reset answering the TCP segment tcp with
+// payload bytes of data. Following RFC 9293, a segment with an ACK is
+// answered from its acknowledgment number, and one without is
+// acknowledged instead. Returns 0 for a reset, which is never answered.
+static __always_inline int reset_of(struct tcphdr *tcp, __u32 payload, struct tcp_reply *r)
+{
+	if (tcp->rst)
+		return 0;
+	r->source = tcp->dest;
+	r->dest = tcp->source;
+	r->syn = 0;
+	r->rst = 1;
+	if (tcp->ack) {
+		r->seq = tcp->ack_seq;
+		r->ack = 0;
+		return 1;
+	}
+	// SYN and FIN take a sequence number each
+	r->seq = 0;
+	r->ack_seq = bpf_htonl(bpf_ntohl(tcp->seq) + payload + tcp->syn + tcp->fin);
+	r->ack = 1;
+	return 1;
+}
+
+// fill_reply writes r into tcp, all but its checksum
+static __always_inline void fill_reply(struct tcphdr *tcp, struct tcp_reply *r)
+{
+	__builtin_memset(tcp, 0, sizeof(*tcp));
+	tcp->source = r->source;
+	tcp->dest = r->dest;
+	tcp->seq = r->seq;
+	tcp->ack_seq = r->ack_seq;
+	tcp->doff = sizeof(*tcp) / 4;
+	tcp->syn = r->syn;
+	tcp->ack = r->ack;
+	tcp->rst = r->rst;
+}
+
+// reply4 turns the IPv4 TCP segment in ctx into r back to its sender, from
+// its destination. Returns XDP_DROP for segments with IP options, which
+// it can't answer.
+static __always_inline int reply4(struct xdp_md *ctx, struct tcp_reply *r)
+{
+	int len = ctx->data_end - ctx->data;
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+
+	struct ethhdr *eth = data;
+	struct iphdr *ip = (void *)(eth + 1);
+	struct tcphdr *tcp = (void *)(ip + 1);
+	if ((void *)(tcp + 1) > data_end || ip->ihl != 5)
+		return XDP_DROP;
+
+	struct ethhdr reply_eth = { .h_proto = eth->h_proto };
+	__builtin_memcpy(reply_eth.h_dest, eth->h_source, ETH_ALEN);
+	__builtin_memcpy(reply_eth.h_source, eth->h_dest, ETH_ALEN);
+	__be32 saddr = ip->daddr, daddr = ip->saddr;
+
+	// Keep just the headers, without options
+	int reply_len = sizeof(struct ethhdr) + sizeof(struct iphdr) + sizeof(struct tcphdr);
+	if (bpf_xdp_adjust_tail(ctx, reply_len - len))
+		return XDP_DROP;
+
+	data = (void *)(long)ctx->data;
+	data_end = (void *)(long)ctx->data_end;
+	eth = data;
+	ip = (void *)(eth + 1);
+	tcp = (void *)(ip + 1);
+	if ((void *)(tcp + 1) > data_end)
+		return XDP_DROP;
+
+	__builtin_memcpy(eth, &reply_eth, sizeof(reply_eth));
+	*ip = (struct iphdr){
+		.version = 4,
+		.ihl = 5,
+		.tot_len = bpf_htons(sizeof(struct iphdr) + sizeof(struct tcphdr)),
+		.ttl = 64,
+		.protocol = IPPROTO_TCP,
+		.saddr = saddr,
+		.daddr = daddr,
+	};
+	ip->check = csum_fold(bpf_csum_diff(0, 0, (__be32 *)ip, sizeof(struct iphdr), 0));
+
+	fill_reply(tcp, r);
+	// The checksum also covers a pseudo-header of the addresses, protocol
+	// and length
+	__be32 pseudo = bpf_htonl(IPPROTO_TCP << 16 | sizeof(struct tcphdr));
+	__s64 sum = bpf_csum_diff(0, 0, (__be32 *)&ip->saddr, 2 * sizeof(__be32), 0);
+	sum = bpf_csum_diff(0, 0, &pseudo, sizeof(pseudo), sum);
+	sum = bpf_csum_diff(0, 0, (__be32 *)tcp, sizeof(struct tcphdr), sum);
+	tcp->check = csum_fold(sum);
+	return XDP_TX;
+}
+
+// reply6 is reply4 for IPv6, where the segment must directly follow the
+// fixed header
+static __always_inline int reply6(struct xdp_md *ctx, struct tcp_reply *r)
+{
+	int len = ctx->data_end - ctx->data;
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+
+	struct ethhdr *eth = data;
+	struct ipv6hdr *ip6 = (void *)(eth + 1);
+	struct tcphdr *tcp = (void *)(ip6 + 1);
+	if ((void *)(tcp + 1) > data_end || ip6->nexthdr != IPPROTO_TCP)
+		return XDP_DROP;
+
+	struct ethhdr reply_eth = { .h_proto = eth->h_proto };
+	__builtin_memcpy(reply_eth.h_dest, eth->h_source, ETH_ALEN);
+	__builtin_memcpy(reply_eth.h_source, eth->h_dest, ETH_ALEN);
+	struct in6_addr saddr = ip6->daddr, daddr = ip6->saddr;
+
+	int reply_len = sizeof(struct ethhdr) + sizeof(struct ipv6hdr) + sizeof(struct tcphdr);
+	if (bpf_xdp_adjust_tail(ctx, reply_len - len))
+		return XDP_DROP;
+
+	data = (void *)(long)ctx->data;
+	data_end = (void *)(long)ctx->data_end;
+	eth = data;
+	ip6 = (void *)(eth + 1);
+	tcp = (void *)(ip6 + 1);
+	if ((void *)(tcp + 1) > data_end)
+		return XDP_DROP;
+
+	__builtin_memcpy(eth, &reply_eth, sizeof(reply_eth));
+	*ip6 = (struct ipv6hdr){
+		.version = 6,
+		.payload_len = bpf_htons(sizeof(struct tcphdr)),
+		.nexthdr = IPPROTO_TCP,
+		.hop_limit = 64,
+		.saddr = saddr,
+		.daddr = daddr,
+	};
+
+	fill_reply(tcp, r);
+	__be32 pseudo[2] = { bpf_htonl(sizeof(struct tcphdr)), bpf_htonl(IPPROTO_TCP) };
+	__s64 sum = bpf_csum_diff(0, 0, (__be32 *)&ip6->saddr, 2 * sizeof(struct in6_addr), 0);
+	sum = bpf_csum_diff(0, 0, pseudo, sizeof(pseudo), sum);
+	sum = bpf_csum_diff(0, 0, (__be32 *)tcp, sizeof(struct tcphdr), sum);
+	tcp->check = csum_fold(sum);
+	return XDP_TX;
+}
+
+// reset4 turns the IPv4 TCP segment in ctx into a reset back to its
+// sender. Returns XDP_DROP for segments it can't or mustn't answer:
+// resets, and those with IP options.
+static __always_inline int reset4(struct xdp_md *ctx)
+{
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+
+	struct ethhdr *eth = data;
+	struct iphdr *ip = (void *)(eth + 1);
+	struct tcphdr *tcp = (void *)(ip + 1);
+	if ((void *)(tcp + 1) > data_end || ip->ihl != 5)
+		return XDP_DROP;
+
+	struct tcp_reply r;
+	__u32 payload = bpf_ntohs(ip->tot_len) - sizeof(*ip) - tcp->doff * 4;
+	if (!reset_of(tcp, payload, &r))
+		return XDP_DROP;
+	return reply4(ctx, &r);
+}
+
+// reset6 is reset4 for IPv6
+static __always_inline int reset6(struct xdp_md *ctx)
+{
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+
+	struct ethhdr *eth = data;
+	struct ipv6hdr *ip6 = (void *)(eth + 1);
+	struct tcphdr *tcp = (void *)(ip6 + 1);
+	if ((void *)(tcp + 1) > data_end || ip6->nexthdr != IPPROTO_TCP)
+		return XDP_DROP;
+
+	struct tcp_reply r;
+	__u32 payload = bpf_ntohs(ip6->payload_len) - tcp->doff * 4;
+	if (!reset_of(tcp, payload, &r))
+		return XDP_DROP;
+	return reply6(ctx, &r);
+}
+
+// reject answers the packet in ctx, which a reject policy matched, with a
+// TCP reset or else an ICMP administratively prohibited error, within the
+// rate limit. Packets it can't answer are dropped: those over the limit,
+// those the TC variant sees, and those reset4 and unreach4 refuse.
+static __always_inline int reject(struct xdp_md *ctx, struct route_result *res, int ipv6)
+{
+	if (!ctx || !reject_allowed())
+		return drop(res, DROP_POLICY);
+
+	int verdict;
+	if (res->proto == IPPROTO_TCP)
+		verdict = ipv6 ? reset6(ctx) : reset4(ctx);
+	else if (ipv6)
+		verdict = icmp6_error(ctx, ICMPV6_DEST_UNREACH, ICMPV6_ADM_PROHIBITED, 0);
+	else
+		verdict = unreach4(ctx, ICMP_PKT_FILTERED, 0);
+	if (verdict != XDP_TX)
+		return drop(res, DROP_POLICY);
+	res->rejected = 1;
+	return XDP_TX;
+}
+
+// SYN protection guards published ports and service VIPs against SYN
+// floods, see SYNProtectionConfig in pkg/network/synprotect.go. Userspace
+// sets syn_protection at load on kernels with the raw SYN cookie helpers,
+// from 6.0; elsewhere the verifier prunes the stage as dead.
+volatile const __u32 syn_protection = 0;
+
+// syn_dest is a protected destination. IPv4 addresses are IPv4-mapped,
+// and the zero address is every local address, as port forwards take;
+// the port is in network byte order.
+struct syn_dest {
+	struct in6_addr addr;
+	__u16 port;
+	__u16 pad;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 4096);
+	__type(key, struct syn_dest);
+	__type(value, __u8);
+} syn_protected SEC(".maps");
+
+// syn_rate counts the SYNs to a protected destination in the current
+// window of a second
+struct syn_rate {
+	__u64 window_ns;
+	__u64 syns;
+	// SYNs are answered with cookies until then
+	__u64 cookies_until;
+};
+
+// Protected destination -> its SYN rate. Userspace removes the entries of
+// destinations no longer protected.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 4096);
+	__type(key, struct syn_dest);
+	__type(value, struct syn_rate);
+} syn_rates SEC(".maps");
+
+// syn_prefix is a trusted source prefix, IPv4 ones IPv4-mapped, whose
+// SYNs are never answered with cookies nor counted
+struct syn_prefix {
+	__u32 prefixlen;
+	struct in6_addr addr;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 1024);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct syn_prefix);
+	__type(value, __u8);
+} syn_trusted SEC(".maps");
+
+// Source that completed a cookie exchange, IPv4-mapped -> when it did.
+// Its SYNs are let through for SYN_VERIFIED_NS from then on.
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 65536);
+	__type(key, struct in6_addr);
+	__type(value, __u64);
+} syn_verified SEC(".maps");
+
+// Slot 0 holds how many SYNs a second a destination takes before cookies
+// answer them
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, __u32);
+} syn_config SEC(".maps");
+
+// SYN_PASS is the verdict of syn_protect for segments routed on as usual
+#define SYN_PASS -1
+// A destination over the threshold stays in cookie mode this long after
+// its last second over it
+#define SYN_COOKIE_HOLD_NS (10 * NSEC_PER_SEC)
+#define SYN_VERIFIED_NS (300 * NSEC_PER_SEC)
+
+// syn_lookup finds the protected destination of key, trying its address
+// and then every local address, and leaves the one found in key
+static __always_inline int syn_lookup(struct syn_dest *key)
+{
+	if (bpf_map_lookup_elem(&syn_protected, key))
+		return 1;
+	__builtin_memset(&key->addr, 0, sizeof(key->addr));
+	return bpf_map_lookup_elem(&syn_protected, key) != NULL;
+}
+
+// syn_flooded counts a SYN to dest and reports whether it is to be
+// answered with a cookie
+static __always_inline int syn_flooded(struct syn_dest *dest, __u64 now)
+{
+	__u32 zero = 0;
+	__u32 *threshold = bpf_map_lookup_elem(&syn_config, &zero);
+	if (!threshold || !*threshold)
+		return 0;
+
+	struct syn_rate *r = bpf_map_lookup_elem(&syn_rates, dest);
+	if (!r) {
+		struct syn_rate first = { .window_ns = now, .syns = 1 };
+		bpf_map_update_elem(&syn_rates, dest, &first, BPF_NOEXIST);
+		return 0;
+	}
+	// CPUs racing at the window's start lose a few counts at most
+	if (now - r->window_ns >= NSEC_PER_SEC) {
+		r->window_ns = now;
+		r->syns = 0;
+	}
+	__sync_fetch_and_add(&r->syns, 1);
+	if (r->syns > *threshold)
+		r->cookies_until = now + SYN_COOKIE_HOLD_NS;
+	return now < r->cookies_until;
+}
+
+// syn_cookie_mode reports whether SYNs to dest are answered with cookies
+static __always_inline int syn_cookie_mode(struct syn_dest *dest, __u64 now)
+{
+	struct syn_rate *r = bpf_map_lookup_elem(&syn_rates, dest);
+	return r && now < r->cookies_until;
+}
+
+// syn_verified_src reports whether src completed a cookie exchange lately
+static __always_inline int syn_verified_src(struct in6_addr *src, __u64 now)
+{
+	__u64 *at = bpf_map_lookup_elem(&syn_verified, src);
+	return at && now - *at < SYN_VERIFIED_NS;
+}
+
+// The raw SYN cookie helpers of Linux 6.0 postdate the helper declarations
+// of libbpf releases before 1.0, so they are declared here by their ids
+static __s64 (*const raw_gen_syncookie_ipv4)(struct iphdr *iph, struct tcphdr *th,
+					     __u32 th_len) = (void *)BPF_FUNC_tcp_raw_gen_syncookie_ipv4;
+static __s64 (*const raw_gen_syncookie_ipv6)(struct ipv6hdr *iph, struct tcphdr *th,
+					     __u32 th_len) = (void *)BPF_FUNC_tcp_raw_gen_syncookie_ipv6;
+static long (*const raw_check_syncookie_ipv4)(struct iphdr *iph,
+					      struct tcphdr *th) = (void *)BPF_FUNC_tcp_raw_check_syncookie_ipv4;
+static long (*const raw_check_syncookie_ipv6)(struct ipv6hdr *iph,
+					      struct tcphdr *th) = (void *)BPF_FUNC_tcp_raw_check_syncookie_ipv6;
+
+// syn_cookie returns the cookie of a SYN of res from port source to dest.
+// The cookie covers a sequence number of 0 rather than the SYN's, so the
+// reset echoing it back can be checked without the SYN.
+static __always_inline __s64 syn_cookie(struct route_result *res, __be16 source, __be16 dest, int ipv6)
+{
+	struct tcphdr th = { .source = source, .dest = dest, .doff = sizeof(th) / 4, .syn = 1 };
+	if (ipv6) {
+		struct ipv6hdr ip6 = { .saddr = res->src, .daddr = res->dst };
+		return raw_gen_syncookie_ipv6(&ip6, &th, sizeof(th));
+	}
+	struct iphdr ip = { .saddr = res->src.s6_addr32[3], .daddr = res->dst.s6_addr32[3] };
+	return raw_gen_syncookie_ipv4(&ip, &th, sizeof(th));
+}
+
+// syn_cookie_valid reports whether the sequence number of the reset tcp
+// of res is a cookie syn_cookie handed out. The kernel checks an ACK, so
+// the reset is presented as the ACK completing the handshake of a SYN
+// with sequence number 0.
+static __always_inline int syn_cookie_valid(struct route_result *res, struct tcphdr *tcp, int ipv6)
+{
+	struct tcphdr th = {
+		.source = tcp->source,
+		.dest = tcp->dest,
+		.seq = bpf_htonl(1),
+		.ack_seq = bpf_htonl(bpf_ntohl(tcp->seq) + 1),
+		.doff = sizeof(th) / 4,
+		.ack = 1,
+	};
+	if (ipv6) {
+		struct ipv6hdr ip6 = { .saddr = res->src, .daddr = res->dst };
+		return raw_check_syncookie_ipv6(&ip6, &th) == 0;
+	}
+	struct iphdr ip = { .saddr = res->src.s6_addr32[3], .daddr = res->dst.s6_addr32[3] };
+	return raw_check_syncookie_ipv4(&ip, &th) == 0;
+}
+
+// syn_protect answers SYNs to a flooded protected destination statelessly
+// instead of letting them reach conntrack. The SYN-ACK carries the cookie
+// as its acknowledgment number, which is never the right one, so a real
+// TCP stack answers it with a reset echoing the cookie as its sequence
+// number (RFC 9293 3.10.7.3) and retransmits its SYN a second later. A
+// valid cookie verifies the source, whose SYNs are let through from then
+// on; spoofed sources never answer. Trusted sources skip all of it.
+// Returns SYN_PASS for segments to route on as usual.
+static __always_inline int syn_protect(struct xdp_md *ctx, struct route_result *res, struct tcphdr *tcp,
+				       void *data_end, int ipv6)
+{
+	if ((void *)(tcp + 1) > data_end)
+		return SYN_PASS;
+	struct syn_dest dest = { .addr = res->dst, .port = tcp->dest };
+	if (!syn_lookup(&dest))
+		return SYN_PASS;
+
+	__u64 now = bpf_ktime_get_ns();
+	if (tcp->rst && !tcp->ack) {
+		// Resets of connections seen outside cookie mode aren't checked
+		if (!syn_cookie_mode(&dest, now))
+			return SYN_PASS;
+		if (!syn_cookie_valid(res, tcp, ipv6)) {
+			res->syn_cookie = SYN_COOKIE_INVALID;
+			return SYN_PASS;
+		}
+		bpf_map_update_elem(&syn_verified, &res->src, &now, BPF_ANY);
+		res->syn_cookie = SYN_COOKIE_VALID;
+		res->consumed = 1;
+		return XDP_DROP;
+	}
+	if (!tcp->syn || tcp->ack)
+		return SYN_PASS;
+	struct syn_prefix trusted = { .prefixlen = 128, .addr = res->src };
+	if (bpf_map_lookup_elem(&syn_trusted, &trusted))
+		return SYN_PASS;
+	if (!syn_flooded(&dest, now) || syn_verified_src(&res->src, now))
+		return SYN_PASS;
+
+	__s64 cookie = syn_cookie(res, tcp->source, tcp->dest, ipv6);
+	if (cookie < 0)
+		return SYN_PASS;
+	struct tcp_reply r = {
+		.source = tcp->dest,
+		.dest = tcp->source,
+		.seq = bpf_htonl((__u32)cookie),
+		.ack_seq = bpf_htonl((__u32)cookie),
+		.syn = 1,
+		.ack = 1,
+	};
+	int verdict = ipv6 ? reply6(ctx, &r) : reply4(ctx, &r);
+	if (verdict != XDP_TX)
+		return drop(res, DROP_SYN_COOKIE);
+	res->syn_cookie = SYN_COOKIE_SENT;
+	return XDP_TX;
+}
+
+static __always_inline int route4(struct ethhdr *eth, void *data_end, __u64 len, struct xdp_md *xdp,
+				  struct route_result *res)
+{
+	struct iphdr *ip = (void *)(eth + 1);
+	if ((void *)(ip + 1) > data_end)
+		return drop(res, DROP_MALFORMED);
+
+	res->proto = ip->protocol;
+	res->src.s6_addr16[5] = 0xffff;
+	res->src.s6_addr32[3] = ip->saddr;
+	res->dst.s6_addr16[5] = 0xffff;
+	res->dst.s6_addr32[3] = ip->daddr;
+
+	// SYN floods are answered before anything is tracked. The TC variant
+	// can't answer and leaves them to the kernel.
+	if (syn_protection && xdp && ip->protocol == IPPROTO_TCP && ip->ihl == 5) {
+		int verdict = syn_protect(xdp, res, (void *)(ip + 1), data_end, 0);
+		if (verdict != SYN_PASS)
+			return verdict;
+	}
+
+	// Lookup destination container in eBPF map
+	__u32 dest_ip = ip->daddr;
+	struct container_info *info = lookup_route4(dest_ip);
+	if (!info) {
+		res->forwarded = xdp && forward_of(ip->protocol, (void *)ip + ip->ihl * 4, data_end) != NULL;
+		return XDP_PASS;
+	}
+
+	res->dest = info->ifindex;
+	if (info->flags & CONTAINER_F_PREFIX)
+		return forward_prefix(eth, info, bpf_ntohs(ip->tot_len));
+
+	// Namespaces isolate containers of this node before any policy
+	__u32 src_ip = ip->saddr;
+	if (container4(src_ip) &&
+	    ns_denied(bpf_map_lookup_elem(&container_ns, &src_ip), bpf_map_lookup_elem(&container_ns, &dest_ip)))
+		return drop(res, DROP_NAMESPACE);
+
+	// Enforce network policy before forwarding
+	void *l4 = (void *)ip + ip->ihl * 4;
+	__u16 port = l4_dport(l4, ip->protocol, data_end);
+	res->port = port;
+	res->policy_checked = 1;
+	__u8 action = policy_lookup(ip->saddr, dest_ip, ip->protocol, port);
+	if (action == POLICY_REJECT)
+		return reject(xdp, res, 0);
+	if (action == POLICY_DENY)
+		return drop(res, DROP_POLICY);
+	if (fault_drops(info->ifindex))
+		return drop(res, DROP_FAULT);
+	if ((info->flags & CONTAINER_F_DRAINING) && opens_tcp(l4, ip->protocol, data_end))
+		return XDP_PASS;
+
+	// AF_XDP sockets take their flows whole, before the MTU check and
+	// connection tracking. The TC variant has no sockets to steer to.
+	if (xdp) {
+		struct xsk_flow_key xk = { .port = port, .proto = ip->protocol };
+		xk.dst.s6_addr16[5] = 0xffff;
+		xk.dst.s6_addr32[3] = dest_ip;
+		if (xsk_steered(&xk)) {
+			res->xsk = 1;
+			return XDP_REDIRECT;
+		}
+	}
+
+	// Redirects skip the kernel's MTU check, so oversized frames would be
+	// dropped silently. The kernel fragments those it may and, without
+	// XDP to answer from, replies to the rest itself.
+	if (redirected(info) && info->mtu && bpf_ntohs(ip->tot_len) > info->mtu) {
+		if (!xdp || !(ip->frag_off & bpf_htons(IP_DF)))
+			return XDP_PASS;
+		int verdict = frag_needed4(xdp, info->mtu);
+		res->too_big = verdict == XDP_TX;
+		if (verdict == XDP_DROP)
+			res->drop_reason = DROP_ICMP_ERROR;
+		return verdict;
+	}
+
+	struct ct_key key = { .proto = ip->protocol };
+	key.src.s6_addr16[5] = 0xffff;
+	key.src.s6_addr32[3] = ip->saddr;
+	key.dst.s6_addr16[5] = 0xffff;
+	key.dst.s6_addr32[3] = dest_ip;
+	ct_update(&key, l4, data_end, info->ifindex, len);
+
+	// Direct forwarding to container veth
+	return deliver(eth, info);
+}
+
+// route6 handles IPv6. Extension headers are not walked, so policies with
+// a port only match when TCP/UDP directly follows the fixed header.
+static __always_inline int route6(struct ethhdr *eth, void *data_end, __u64 len, struct xdp_md *xdp,
+				  struct route_result *res)
+{
+	struct ipv6hdr *ip6 = (void *)(eth + 1);
+	if ((void *)(ip6 + 1) > data_end)
+		return drop(res, DROP_MALFORMED);
+
+	res->proto = ip6->nexthdr;
+	res->src = ip6->saddr;
+	res->dst = ip6->daddr;
+
+	if (syn_protection && xdp && ip6->nexthdr == IPPROTO_TCP) {
+		int verdict = syn_protect(xdp, res, (void *)(ip6 + 1), data_end, 1);
+		if (verdict != SYN_PASS)
+			return verdict;
+	}
+
+	struct container_info *info = lookup_route6(&ip6->daddr);
+	if (!info) {
+		res->forwarded = xdp && forward_of(ip6->nexthdr, ip6 + 1, data_end) != NULL;
+		return XDP_PASS;
+	}
+
+	res->dest = info->ifindex;
+	if (info->flags & CONTAINER_F_PREFIX)
+		return forward_prefix(eth, info, sizeof(*ip6) + bpf_ntohs(ip6->payload_len));
+
+	if (container6(&ip6->saddr) &&
+	    ns_denied(bpf_map_lookup_elem(&container_ns6, &ip6->saddr), bpf_map_lookup_elem(&container_ns6, &ip6->daddr)))
+		return drop(res, DROP_NAMESPACE);
+
+	__u16 port = l4_dport(ip6 + 1, ip6->nexthdr, data_end);
+	res->port = port;
+	res->policy_checked = 1;
+	__u8 action = policy_lookup6(&ip6->saddr, &ip6->daddr, ip6->nexthdr, port);
+	if (action == POLICY_REJECT)
+		return reject(xdp, res, 1);
+	if (action == POLICY_DENY)
+		return drop(res, DROP_POLICY);
+	if (fault_drops(info->ifindex))
+		return drop(res, DROP_FAULT);
+	if ((info->flags & CONTAINER_F_DRAINING) && opens_tcp(ip6 + 1, ip6->nexthdr, data_end))
+		return XDP_PASS;
+
+	if (xdp) {
+		struct xsk_flow_key xk = { .dst = ip6->daddr, .port = port, .proto = ip6->nexthdr };
+		if (xsk_steered(&xk)) {
+			res->xsk = 1;
+			return XDP_REDIRECT;
+		}
+	}
+
+	// IPv6 is never fragmented on the way
+	if (redirected(info) && info->mtu && sizeof(*ip6) + bpf_ntohs(ip6->payload_len) > info->mtu) {
+		if (!xdp)
+			return XDP_PASS;
+		int verdict = packet_too_big6(xdp, info->mtu);
+		res->too_big = verdict == XDP_TX;
+		if (verdict == XDP_DROP)
+			res->drop_reason = DROP_ICMP_ERROR;
+		return verdict;
+	}
+
+	struct ct_key key = { .src = ip6->saddr, .dst = ip6->daddr, .proto = ip6->nexthdr };
+	ct_update(&key, ip6 + 1, data_end, info->ifindex, len);
+
+	return deliver(eth, info);
+}
+
+// arp_ipv4 is an ARP packet for IPv4 over Ethernet
+struct arp_ipv4 {
+	struct arphdr hdr;
+	__u8 sha[ETH_ALEN];
+	__be32 sip;
+	__u8 tha[ETH_ALEN];
+	__be32 tip;
+} __attribute__((packed));
+
+// answer_arp replies to requests for container addresses with the MAC of
+// this interface, proxying for the containers behind it. Neighbor
+// solicitations for IPv6 containers are answered by the kernel from proxy
+// entries userspace adds, since replies would need their checksum redone.
+static __always_inline int answer_arp(struct ethhdr *eth, void *data_end)
+{
+	struct arp_ipv4 *arp = (void *)(eth + 1);
+	if ((void *)(arp + 1) > data_end)
+		return XDP_PASS;
+	if (arp->hdr.ar_hrd != bpf_htons(ARPHRD_ETHER) || arp->hdr.ar_pro != bpf_htons(ETH_P_IP) ||
+	    arp->hdr.ar_op != bpf_htons(ARPOP_REQUEST))
+		return XDP_PASS;
+
+	__be32 target = arp->tip;
+	if (!container4(target))
+		return XDP_PASS;
+
+	__u32 zero = 0;
+	struct iface_mac *mac = bpf_map_lookup_elem(&router_mac, &zero);
+	if (!mac)
+		return XDP_PASS;
+
+	arp->hdr.ar_op = bpf_htons(ARPOP_REPLY);
+	__builtin_memcpy(arp->tha, arp->sha, ETH_ALEN);
+	arp->tip = arp->sip;
+	__builtin_memcpy(arp->sha, mac->addr, ETH_ALEN);
+	arp->sip = target;
+
+	__builtin_memcpy(eth->h_dest, eth->h_source, ETH_ALEN);
+	__builtin_memcpy(eth->h_source, mac->addr, ETH_ALEN);
+	return XDP_TX;
+}
+
+// route returns the verdict for the len byte frame at data, as an XDP
+// action, and fills res for accounting. Oversized packets are answered
+// with ICMP errors through xdp, and passed when it is NULL.
+static __always_inline int route(void *data, void *data_end, __u64 len, struct xdp_md *xdp,
+				 struct route_result *res)
+{
+	// Parse Ethernet header
+	struct ethhdr *eth = data;
+	if ((void *)(eth + 1) > data_end)
+		return drop(res, DROP_MALFORMED);
+
+	switch (eth->h_proto) {
+	case bpf_htons(ETH_P_IP):
+		return route4(eth, data_end, len, xdp, res);
+	case bpf_htons(ETH_P_IPV6):
+		return route6(eth, data_end, len, xdp, res);
+	case bpf_htons(ETH_P_ARP):
+		return answer_arp(eth, data_end);
+	default:
+		return XDP_PASS;
+	}
+}
+
+// Anti-spoofing: tc_container_source checks the frames a container sends,
+// on clsact ingress of its host-side veth, against the MAC and addresses
+// userspace assigned it, so they can't be sent in another's name. Veths
+// without a source_macs entry belong to containers that opted out.
+
+struct source_mac {
+	__u8 addr[ETH_ALEN];
+	__u16 pad;
+};
+
+// Host-side veth ifindex -> MAC the container's frames must come from
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u32);
+	__type(value, struct source_mac);
+} source_macs SEC(".maps");
+
+// Prefixes a container may send from: its own addresses, and any it is
+// allowed besides. IPv4 prefixes are IPv4-mapped. The ifindex must match
+// exactly, so prefixlen is its 32 bits plus the length of the prefix.
+#define SOURCE_PREFIX_BITS 32
+
+struct source_key {
+	__u32 prefixlen;
+	__u32 ifindex;
+	struct in6_addr addr;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 65536);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct source_key);
+	__type(value, __u8);
+} source_addrs SEC(".maps");
+
+// nd_msg is a neighbor solicitation or advertisement
+struct nd_msg {
+	struct icmp6hdr icmp6;
+	struct in6_addr target;
+};
+
+// nd_lladdr_msg is an nd_msg with its first option, which Linux makes the
+// sender's or target's link-layer address
+struct nd_lladdr_msg {
+	struct nd_msg nd;
+	__u8 opt_type;
+	__u8 opt_len;
+	__u8 lladdr[ETH_ALEN];
+};
+
+#define NDISC_NEIGHBOUR_SOLICITATION 135
+#define NDISC_NEIGHBOUR_ADVERTISEMENT 136
+#define ND_OPT_SOURCE_LL_ADDR 1
+#define ND_OPT_TARGET_LL_ADDR 2
+
+// SOURCE_PULL covers every header the source check reads: neighbor
+// discovery messages, and the transport headers of the flows it tracks
+// behind IPv4 headers with options
+#define SOURCE_PULL (sizeof(struct ethhdr) + 60 + sizeof(struct tcphdr))
+
+static __always_inline int mac_equal(const __u8 *a, const __u8 *b)
+{
+	__u8 diff = 0;
+#pragma unroll
+	for (int i = 0; i < ETH_ALEN; i++)
+		diff |= a[i] ^ b[i];
+	return !diff;
+}
+
+// source_allowed reports whether the container behind ifindex may send
+// from addr
+static __always_inline int source_allowed(__u32 ifindex, struct in6_addr *addr)
+{
+	struct source_key key = { .prefixlen = SOURCE_PREFIX_BITS + 128, .ifindex = ifindex, .addr = *addr };
+	return bpf_map_lookup_elem(&source_addrs, &key) != NULL;
+}
+
+static __always_inline int source_allowed4(__u32 ifindex, __be32 addr)
+{
+	struct in6_addr mapped = {};
+	mapped.s6_addr16[5] = 0xffff;
+	mapped.s6_addr32[3] = addr;
+	return source_allowed(ifindex, &mapped);
+}
+
+// source_exempt6 reports whether an IPv6 source is left unchecked: link-local
+// addresses, which never leave the veth, and the unspecified address
+// duplicate address detection sends from
+static __always_inline int source_exempt6(struct in6_addr *addr)
+{
+	if (addr->s6_addr[0] == 0xfe && (addr->s6_addr[1] & 0xc0) == 0x80)
+		return 1;
+	return !(addr->s6_addr32[0] | addr->s6_addr32[1] | addr->s6_addr32[2] | addr->s6_addr32[3]);
+}
+
+// nd_spoofed reports whether the neighbor discovery message after ip6,
+// sent by the container behind ifindex, announces a link-layer address
+// other than mac, or advertises an address the container may not send
+// from. Like the kernel table in neighbor_linux.go, link-local targets are
+// left unchecked as they only reach the container's own veth.
+static __always_inline int nd_spoofed(struct ipv6hdr *ip6, void *data_end, __u32 ifindex, struct source_mac *mac)
+{
+	struct nd_msg *nd = (void *)(ip6 + 1);
+	if ((void *)(nd + 1) > data_end)
+		return 0;
+	if (nd->icmp6.icmp6_type != NDISC_NEIGHBOUR_SOLICITATION &&
+	    nd->icmp6.icmp6_type != NDISC_NEIGHBOUR_ADVERTISEMENT)
+		return 0;
+	if (nd->icmp6.icmp6_type == NDISC_NEIGHBOUR_ADVERTISEMENT &&
+	    !source_exempt6(&nd->target) && !source_allowed(ifindex, &nd->target))
+		return 1;
+
+	struct nd_lladdr_msg *opt = (void *)nd;
+	if ((void *)(opt + 1) > data_end)
+		return 0;
+	if ((opt->opt_type != ND_OPT_SOURCE_LL_ADDR && opt->opt_type != ND_OPT_TARGET_LL_ADDR) || opt->opt_len != 1)
+		return 0;
+	return !mac_equal(opt->lladdr, mac->addr);
+}
+
+// source_spoofed returns why the frame at eth, sent by the container
+// behind ifindex, is dropped: DROP_SPOOFED when it comes from a MAC or
+// address not its own, DROP_NEIGHBOR_SPOOFED when it is ARP or neighbor
+// discovery claiming one, and 0 to pass it. It fills res with the flow for
+// the drop event.
+static __always_inline int source_spoofed(struct ethhdr *eth, void *data_end, __u32 ifindex,
+					  struct source_mac *mac, struct route_result *res)
+{
+	if (!mac_equal(eth->h_source, mac->addr))
+		return DROP_SPOOFED;
+
+	switch (eth->h_proto) {
+	case bpf_htons(ETH_P_IP): {
+		struct iphdr *ip = (void *)(eth + 1);
+		if ((void *)(ip + 1) > data_end)
+			return 0;
+		res->src.s6_addr16[5] = 0xffff;
+		res->src.s6_addr32[3] = ip->saddr;
+		res->dst.s6_addr16[5] = 0xffff;
+		res->dst.s6_addr32[3] = ip->daddr;
+		res->proto = ip->protocol;
+		return source_allowed4(ifindex, ip->saddr) ? 0 : DROP_SPOOFED;
+	}
+	case bpf_htons(ETH_P_IPV6): {
+		struct ipv6hdr *ip6 = (void *)(eth + 1);
+		if ((void *)(ip6 + 1) > data_end)
+			return 0;
+		res->src = ip6->saddr;
+		res->dst = ip6->daddr;
+		res->proto = ip6->nexthdr;
+		if (!source_exempt6(&ip6->saddr) && !source_allowed(ifindex, &ip6->saddr))
+			return DROP_SPOOFED;
+		if (ip6->nexthdr == IPPROTO_ICMPV6 && nd_spoofed(ip6, data_end, ifindex, mac))
+			return DROP_NEIGHBOR_SPOOFED;
+		return 0;
+	}
+	case bpf_htons(ETH_P_ARP): {
+		struct arp_ipv4 *arp = (void *)(eth + 1);
+		if ((void *)(arp + 1) > data_end)
+			return 0;
+		if (arp->hdr.ar_hrd != bpf_htons(ARPHRD_ETHER) || arp->hdr.ar_pro != bpf_htons(ETH_P_IP))
+			return 0;
+		res->src.s6_addr16[5] = 0xffff;
+		res->src.s6_addr32[3] = arp->sip;
+		res->dst.s6_addr16[5] = 0xffff;
+		res->dst.s6_addr32[3] = arp->tip;
+		// Replies, and gratuitous ARP, may only announce the container's
+		// own addresses. Probes for a conflicting address are sent from
+		// 0.0.0.0.
+		if (!mac_equal(arp->sha, mac->addr) || (arp->sip && !source_allowed4(ifindex, arp->sip)))
+			return DROP_NEIGHBOR_SPOOFED;
+		return 0;
+	}
+	default:
+		return 0;
+	}
+}
+
+// Port forwards: tc_port_forward, behind the XDP router on clsact ingress
+// of the uplink, and the TC router itself translate TCP and UDP traffic to
+// a forwarded port of a host address to the container's address and port,
+// before routing it to the container, as the nftables DNAT rules of
+// pkg/network do for the traffic the kernel routes, e.g. from the host
+// itself. tc_container_source translates the replies back. Packets are
+// rewritten with the skb helpers, which keep checksums valid in whatever
+// state the device left them, unlike writes from XDP.
+
+// IP_MF and IP_OFFSET are the More Fragments flag and the fragment offset
+// of iphdr.frag_off. Fragments are left to the kernel, which reassembles
+// them before its own translation.
+#define IP_MF 0x2000
+#define IP_OFFSET 0x1fff
+
+// L4_CSUM_OFF returns the offset of the checksum in the transport header
+// of proto, TCP or UDP, and L4_CSUM_FLAGS the flags of updating it: a UDP
+// datagram over IPv4 may go without one, which stays so, and one coming
+// out as zero is sent as its complement
+#define L4_CSUM_OFF(proto) ((proto) == IPPROTO_TCP ? 16 : 6)
+#define L4_CSUM_FLAGS(proto) ((proto) == IPPROTO_UDP ? BPF_F_MARK_MANGLED_0 : 0)
+
+// host_local4 reports whether the kernel delivers a packet from src to dst
+// arriving on the interface of skb locally, as the nftables rules match
+// with fib daddr type local. The FIB lookup can't tell local destinations
+// from broadcast ones, so those are told by address, except the directed
+// broadcast of a subnet.
+static __always_inline int host_local4(struct __sk_buff *skb, __u32 src, __u32 dst)
+{
+	if (dst == 0xffffffff || (bpf_ntohl(dst) >> 28) == 0xe)
+		return 0;
+	struct bpf_fib_lookup p = {
+		.family = 2 /* AF_INET */,
+		.ifindex = skb->ifindex,
+		.ipv4_src = src,
+		.ipv4_dst = dst,
+	};
+	return bpf_fib_lookup(skb, &p, sizeof(p), 0) == BPF_FIB_LKUP_RET_NOT_FWDED;
+}
+
+// host_local6 is host_local4 for IPv6
+static __always_inline int host_local6(struct __sk_buff *skb, struct in6_addr *src, struct in6_addr *dst)
+{
+	if (dst->s6_addr[0] == 0xff)
+		return 0;
+	struct bpf_fib_lookup p = { .family = 10 /* AF_INET6 */, .ifindex = skb->ifindex };
+	__builtin_memcpy(p.ipv6_src, src, sizeof(p.ipv6_src));
+	__builtin_memcpy(p.ipv6_dst, dst, sizeof(p.ipv6_dst));
+	return bpf_fib_lookup(skb, &p, sizeof(p), 0) == BPF_FIB_LKUP_RET_NOT_FWDED;
+}
+
+// forwarded_to returns a copy of the forward of the packet at l4 in fwd,
+// or 0 when the port isn't forwarded or the replies of the container it
+// is forwarded to can't be translated back, lacking a source check
+static __always_inline int forwarded_to(__u8 proto, void *l4, void *data_end, struct forward *fwd)
+{
+	struct forward *f = forward_of(proto, l4, data_end);
+	if (!f || !bpf_map_lookup_elem(&source_macs, &f->ifindex))
+		return 0;
+	*fwd = *f;
+	return 1;
+}
+
+// record_forward remembers how to translate the replies to the frame at
+// eth from the client at src, from its port sport, back to the host address
+// dst and port dport. key holds the container's address, port and the
+// protocol.
+static __always_inline void record_forward(struct __sk_buff *skb, struct ethhdr *eth, struct ct_key *key,
+					   struct in6_addr *src, __u16 sport, struct in6_addr *dst, __u16 dport)
+{
+	key->dst = *src;
+	key->dport = sport;
+	struct nat_entry e = { .addr = *dst, .ifindex = skb->ifindex, .port = dport };
+	__builtin_memcpy(e.mac, eth->h_source, ETH_ALEN);
+	__builtin_memcpy(e.host_mac, eth->h_dest, ETH_ALEN);
+
+	struct nat_entry *old = bpf_map_lookup_elem(&nat_conntrack, key);
+	if (old && old->ifindex == e.ifindex && mac_equal(old->mac, e.mac) && mac_equal(old->host_mac, e.host_mac))
+		return;
+	bpf_map_update_elem(&nat_conntrack, key, &e, BPF_ANY);
+}
+
+// forward4 translates the IPv4 packet at eth if it is to a forwarded port
+// of a host address. Returns 1 when it did, 0 when the packet isn't
+// forwarded and -1 when rewriting it failed midway.
+static __always_inline int forward4(struct __sk_buff *skb, struct ethhdr *eth, void *data_end)
+{
+	struct iphdr *ip = (void *)(eth + 1);
+	if ((void *)(ip + 1) > data_end || ip->ihl < 5 || (ip->frag_off & bpf_htons(IP_MF | IP_OFFSET)))
+		return 0;
+	__u32 l4_off = sizeof(*eth) + ip->ihl * 4;
+	__u16 *ports = (void *)eth + l4_off;
+	struct forward fwd;
+	if (!forwarded_to(ip->protocol, ports, data_end, &fwd) || !fwd.addr4)
+		return 0;
+	if ((void *)(ports + 2) > data_end)
+		return 0;
+	__u8 proto = ip->protocol;
+	__u32 saddr = ip->saddr, daddr = ip->daddr;
+	__u16 sport = ports[0], dport = ports[1];
+	if (!container4(fwd.addr4) || !host_local4(skb, saddr, daddr))
+		return 0;
+
+	struct ct_key key = { .sport = fwd.port, .proto = proto };
+	key.src.s6_addr16[5] = 0xffff;
+	key.src.s6_addr32[3] = fwd.addr4;
+	struct in6_addr src = {}, dst = {};
+	src.s6_addr16[5] = 0xffff;
+	src.s6_addr32[3] = saddr;
+	dst.s6_addr16[5] = 0xffff;
+	dst.s6_addr32[3] = daddr;
+	record_forward(skb, eth, &key, &src, sport, &dst, dport);
+
+	__u32 csum_off = l4_off + L4_CSUM_OFF(proto);
+	__u64 flags = L4_CSUM_FLAGS(proto);
+	if (bpf_l4_csum_replace(skb, csum_off, daddr, fwd.addr4, flags | BPF_F_PSEUDO_HDR | sizeof(daddr)) ||
+	    bpf_l4_csum_replace(skb, csum_off, dport, fwd.port, flags | sizeof(dport)) ||
+	    bpf_l3_csum_replace(skb, sizeof(*eth) + offsetof(struct iphdr, check), daddr, fwd.addr4, sizeof(daddr)) ||
+	    bpf_skb_store_bytes(skb, sizeof(*eth) + offsetof(struct iphdr, daddr), &fwd.addr4, sizeof(daddr), 0) ||
+	    bpf_skb_store_bytes(skb, l4_off + sizeof(sport), &fwd.port, sizeof(dport), 0))
+		return -1;
+	return 1;
+}
+
+// forward6 is forward4 for IPv6, whose forwarded ports must follow the
+// fixed header
+static __always_inline int forward6(struct __sk_buff *skb, struct ethhdr *eth, void *data_end)
+{
+	struct ipv6hdr *ip6 = (void *)(eth + 1);
+	if ((void *)(ip6 + 1) > data_end)
+		return 0;
+	__u16 *ports = (void *)(ip6 + 1);
+	struct forward fwd;
+	if (!forwarded_to(ip6->nexthdr, ports, data_end, &fwd) || !fwd.addr6.s6_addr32[0])
+		return 0;
+	if ((void *)(ports + 2) > data_end)
+		return 0;
+	__u8 proto = ip6->nexthdr;
+	struct in6_addr src = ip6->saddr, dst = ip6->daddr;
+	__u16 sport = ports[0], dport = ports[1];
+	if (!container6(&fwd.addr6) || !host_local6(skb, &src, &dst))
+		return 0;
+
+	struct ct_key key = { .src = fwd.addr6, .sport = fwd.port, .proto = proto };
+	record_forward(skb, eth, &key, &src, sport, &dst, dport);
+
+	__u32 l4_off = sizeof(*eth) + sizeof(*ip6);
+	__u32 csum_off = l4_off + L4_CSUM_OFF(proto);
+	__u64 flags = L4_CSUM_FLAGS(proto);
+	__s64 diff = bpf_csum_diff((__be32 *)&dst, sizeof(dst), (__be32 *)&fwd.addr6, sizeof(fwd.addr6), 0);
+	if (diff < 0 ||
+	    bpf_l4_csum_replace(skb, csum_off, 0, diff, flags | BPF_F_PSEUDO_HDR) ||
+	    bpf_l4_csum_replace(skb, csum_off, dport, fwd.port, flags | sizeof(dport)) ||
+	    bpf_skb_store_bytes(skb, sizeof(*eth) + offsetof(struct ipv6hdr, daddr), &fwd.addr6, sizeof(dst), 0) ||
+	    bpf_skb_store_bytes(skb, l4_off + sizeof(sport), &fwd.port, sizeof(dport), 0))
+		return -1;
+	return 1;
+}
+
+// forward_port translates the packet of skb, arriving on the uplink, if it
+// is to a forwarded port of a host address, see forward4
+static __always_inline int forward_port(struct __sk_buff *skb)
+{
+	__u32 len = skb->len;
+	bpf_skb_pull_data(skb, len < ROUTE_PULL ? len : ROUTE_PULL);
+	void *data = (void *)(long)skb->data;
+	void *data_end = (void *)(long)skb->data_end;
+	struct ethhdr *eth = data;
+	if ((void *)(eth + 1) > data_end)
+		return 0;
+	if (eth->h_proto == bpf_htons(ETH_P_IP))
+		return forward4(skb, eth, data_end);
+	if (eth->h_proto == bpf_htons(ETH_P_IPV6))
+		return forward6(skb, eth, data_end);
+	return 0;
+}
+
+// tc_port_forward runs on clsact ingress of the uplink behind the XDP
+// router, which passes traffic to host addresses to the kernel. It
+// translates what is to forwarded ports and routes it on like the TC
+// router, leaving the rest to the kernel.
+SEC("tc")
+int tc_port_forward(struct __sk_buff *skb)
+{
+	int translated = forward_port(skb);
+	if (translated < 0)
+		return TC_ACT_SHOT;
+	if (!translated)
+		return TC_ACT_OK;
+	struct ext_state *st = ext_state_begin(EXT_STATE_TC, skb->len);
+	if (!st)
+		return TC_ACT_OK;
+	return tc_run(skb, st, 0);
+}
+
+// unforward translates a reply to a forwarded flow, which the container
+// sends from its address and port, back to the host address and port the
+// client connected to, and returns the verdict sending it out of the
+// uplink the client's frames came in on. Returns -1 for other frames.
+static __always_inline int unforward(struct __sk_buff *skb, struct ethhdr *eth, void *data_end)
+{
+	struct ct_key key = {};
+	__u32 l4_off = sizeof(*eth);
+	__u16 *ports;
+	int ipv6 = eth->h_proto == bpf_htons(ETH_P_IPV6);
+	if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+		struct iphdr *ip = (void *)(eth + 1);
+		if ((void *)(ip + 1) > data_end || ip->ihl < 5 || (ip->frag_off & bpf_htons(IP_MF | IP_OFFSET)))
+			return -1;
+		key.proto = ip->protocol;
+		key.src.s6_addr16[5] = 0xffff;
+		key.src.s6_addr32[3] = ip->saddr;
+		key.dst.s6_addr16[5] = 0xffff;
+		key.dst.s6_addr32[3] = ip->daddr;
+		l4_off += ip->ihl * 4;
+	} else if (ipv6) {
+		struct ipv6hdr *ip6 = (void *)(eth + 1);
+		if ((void *)(ip6 + 1) > data_end)
+			return -1;
+		key.proto = ip6->nexthdr;
+		key.src = ip6->saddr;
+		key.dst = ip6->daddr;
+		l4_off += sizeof(*ip6);
+	} else {
+		return -1;
+	}
+	if (key.proto != IPPROTO_TCP && key.proto != IPPROTO_UDP)
+		return -1;
+	ports = (void *)eth + l4_off;
+	if ((void *)(ports + 2) > data_end)
+		return -1;
+	key.sport = ports[0];
+	key.dport = ports[1];
+
+	struct nat_entry *found = bpf_map_lookup_elem(&nat_conntrack, &key);
+	if (!found)
+		return -1;
+	struct nat_entry e = *found;
+
+	__u32 csum_off = l4_off + L4_CSUM_OFF(key.proto);
+	__u64 flags = L4_CSUM_FLAGS(key.proto);
+	if (ipv6) {
+		__s64 diff = bpf_csum_diff((__be32 *)&key.src, sizeof(key.src), (__be32 *)&e.addr, sizeof(e.addr), 0);
+		if (diff < 0 || bpf_l4_csum_replace(skb, csum_off, 0, diff, flags | BPF_F_PSEUDO_HDR) ||
+		    bpf_skb_store_bytes(skb, sizeof(*eth) + offsetof(struct ipv6hdr, saddr), &e.addr, sizeof(e.addr), 0))
+			return TC_ACT_SHOT;
+	} else {
+		__u32 from = key.src.s6_addr32[3], to = e.addr.s6_addr32[3];
+		if (bpf_l4_csum_replace(skb, csum_off, from, to, flags | BPF_F_PSEUDO_HDR | sizeof(to)) ||
+		    bpf_l3_csum_replace(skb, sizeof(*eth) + offsetof(struct iphdr, check), from, to, sizeof(to)) ||
+		    bpf_skb_store_bytes(skb, sizeof(*eth) + offsetof(struct iphdr, saddr), &to, sizeof(to), 0))
+			return TC_ACT_SHOT;
+	}
+	if (bpf_l4_csum_replace(skb, csum_off, key.sport, e.port, flags | sizeof(e.port)) ||
+	    bpf_skb_store_bytes(skb, l4_off, &e.port, sizeof(e.port), 0) ||
+	    bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), e.mac, ETH_ALEN, 0) ||
+	    bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), e.host_mac, ETH_ALEN, 0))
+		return TC_ACT_SHOT;
+	return bpf_redirect(e.ifindex, 0);
+}
+
+// ct_source records a packet of len bytes the container behind ifindex
+// sends, in the direction CT_DIR_OUT
+static __always_inline void ct_source(struct ethhdr *eth, void *data_end, __u32 ifindex, __u64 len)
+{
+	if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+		struct iphdr *ip = (void *)(eth + 1);
+		if ((void *)(ip + 1) > data_end)
+			return;
+		struct ct_key key = { .proto = ip->protocol, .dir = CT_DIR_OUT };
+		key.src.s6_addr16[5] = 0xffff;
+		key.src.s6_addr32[3] = ip->saddr;
+		key.dst.s6_addr16[5] = 0xffff;
+		key.dst.s6_addr32[3] = ip->daddr;
+		ct_update(&key, (void *)ip + ip->ihl * 4, data_end, ifindex, len);
+	} else if (eth->h_proto == bpf_htons(ETH_P_IPV6)) {
+		struct ipv6hdr *ip6 = (void *)(eth + 1);
+		if ((void *)(ip6 + 1) > data_end)
+			return;
+		struct ct_key key = { .src = ip6->saddr, .dst = ip6->daddr, .proto = ip6->nexthdr, .dir = CT_DIR_OUT };
+		ct_update(&key, ip6 + 1, data_end, ifindex, len);
+	}
+}
+
+// tc_container_source drops the frames a container sends from a MAC or
+// address not its own, counting them in spoofed, and the ARP and neighbor
+// discovery claiming one, counting them in neighbor_spoofed. They are no
+// traffic of the router, so its other counters leave them out. The frames
+// it passes are counted in container_traffic, and their flows tracked in
+// conntrack.
+SEC("tc")
+int tc_container_source(struct __sk_buff *skb)
+{
+	__u32 zero = 0;
+	__u32 ifindex = skb->ifindex;
+	struct source_mac *mac = bpf_map_lookup_elem(&source_macs, &ifindex);
+	if (!mac)
+		return TC_ACT_OK;
+
+	__u64 bytes = skb->len;
+	bpf_skb_pull_data(skb, bytes < SOURCE_PULL ? bytes : SOURCE_PULL);
+	void *data = (void *)(long)skb->data;
+	void *data_end = (void *)(long)skb->data_end;
+	struct ethhdr *eth = data;
+	if ((void *)(eth + 1) > data_end)
+		return TC_ACT_OK;
+
+	struct route_result res = { .dest = ifindex };
+	int reason = source_spoofed(eth, data_end, ifindex, mac, &res);
+	if (!reason) {
+		// What the container sends is counted here, as the router
+		// only sees traffic to containers
+		record_traffic(ifindex, TRAFFIC_EGRESS, res.proto, bytes);
+		ct_source(eth, data_end, ifindex, bytes);
+		int verdict = unforward(skb, eth, data_end);
+		return verdict < 0 ? TC_ACT_OK : verdict;
+	}
+
+	struct datapath_stats *node = bpf_map_lookup_elem(&stats, &zero);
+	struct datapath_stats *s = bpf_map_lookup_elem(&container_stats, &ifindex);
+	if (reason == DROP_NEIGHBOR_SPOOFED) {
+		if (node)
+			node->neighbor_spoofed++;
+		if (s)
+			s->neighbor_spoofed++;
+	} else {
+		if (node)
+			node->spoofed++;
+		if (s)
+			s->spoofed++;
+	}
+	res.drop_reason = reason;
+	report_drop(skb, &res, bytes);
+	return TC_ACT_SHOT;
+}
+
+// Bandwidth pacing: tc_pace_ingress and tc_pace_egress run on clsact
+// egress of the host veth of a container with a limit and of the
+// container's own interface, for the traffic to and from it. They give
+// each packet an earliest departure time, which the fq qdisc at the root
+// of the interface holds it back until, spacing the packets out at the
+// container's rate. Departures may lag the clock by up to the bucket's
+// worth of time, which lets a burst leave at once after a quiet spell:
+// a token bucket whose tokens are nanoseconds. tc_pace_ingress also runs
+// on the host veth of a container whose traffic an injected fault
+// delays, pushing the departures back further.
+
+// Directions of pace_key, as SetBandwidthLimit names them
+#define PACE_INGRESS 0
+#define PACE_EGRESS 1
+
+// pace_key is the interface a limit paces and its direction. That is the
+// host veth for PACE_INGRESS, and the container's interface, whose
+// ifindex userspace keeps apart from those of other containers, for
+// PACE_EGRESS: a container controls the addresses it sends from, not the
+// interface it sends on.
+struct pace_key {
+	__u32 ifindex;
+	__u32 dir;
+};
+
+// pace_limit is a container's bandwidth limit in one direction
+struct pace_limit {
+	// Bytes per second
+	__u64 rate;
+	// How far departures may lag the clock, the size of the bucket
+	__u64 burst_ns;
+	// Packets due later than this from now are dropped, bounding how
+	// long fq holds them
+	__u64 horizon_ns;
+	// Departure time of the last packet, in bpf_ktime_get_ns time
+	__u64 last_ns;
+	// Packets held back and packets dropped
+	__u64 delayed;
+	__u64 dropped;
+};
+
+// Interface and direction -> the limit pacing it. Entries only exist
+// while userspace paces the interface rather than shaping it with tbf.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 8192);
+	__type(key, struct pace_key);
+	__type(value, struct pace_limit);
+} pace_limits SEC(".maps");
+
+// pace schedules the departure of the packet leaving on the interface of
+// skb in direction dir. CPUs sending at once may each read last_ns before
+// the other wrote it, letting a packet out early, like the counters of
+// the router they trade exactness for not taking a lock.
+static __always_inline int pace(struct __sk_buff *skb, __u32 dir)
+{
+	struct pace_key key = { .ifindex = skb->ifindex, .dir = dir };
+	struct pace_limit *l = bpf_map_lookup_elem(&pace_limits, &key);
+	if (!l || !l->rate)
+		return TC_ACT_OK;
+
+	__u64 now = bpf_ktime_get_ns();
+	// A departure time set before, e.g. by the sender, is kept, unless it
+	// is a receive timestamp, which is on another clock
+	__u64 t = skb->tstamp;
+	if (t < now || t - now > l->horizon_ns)
+		t = now;
+	__u64 last = l->last_ns;
+	if (last + l->burst_ns < now)
+		last = now - l->burst_ns;
+	__u64 next = last + (__u64)skb->len * NSEC_PER_SEC / l->rate;
+	if (next <= t) {
+		l->last_ns = next;
+		skb->tstamp = t;
+		return TC_ACT_OK;
+	}
+	if (next - now > l->horizon_ns) {
+		__sync_fetch_and_add(&l->dropped, 1);
+		return TC_ACT_SHOT;
+	}
+	l->last_ns = next;
+	__sync_fetch_and_add(&l->delayed, 1);
+	skb->tstamp = next;
+	return TC_ACT_OK;
+}
+
+// fault_delay is the delay an injected fault adds to the traffic to a
+// container. fq sends the packets of a flow in the order of their
+// departures, so jitter reorders them as netem's does.
+struct fault_delay {
+	__u64 delay_ns;
+	// Delays vary by up to jitter_ns either way, which is at most
+	// delay_ns
+	__u64 jitter_ns;
+	// Packets skip the delay when a random number is below
+	// reorder_threshold, overtaking those held back
+	__u32 reorder_threshold;
+	__u32 pad;
+};
+
+// Host-side veth ifindex -> delay of the fault injected into the
+// container's traffic. Entries only exist while userspace injects one and
+// fq is at the root of the veth.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 4096);
+	__type(key, __u32);
+	__type(value, struct fault_delay);
+} fault_delays SEC(".maps");
+
+// Departures set further ahead than this are receive timestamps, which
+// are on another clock. Pacing and delays never get as far.
+#define FAULT_HORIZON_NS (60 * NSEC_PER_SEC)
+
+// fault_delay_packet delays the packet leaving the host veth of skb as
+// the fault injected into the container's traffic does, if any
+static __always_inline void fault_delay_packet(struct __sk_buff *skb)
+{
+	__u32 ifindex = skb->ifindex;
+	struct fault_delay *f = bpf_map_lookup_elem(&fault_delays, &ifindex);
+	if (!f || bpf_get_prandom_u32() < f->reorder_threshold)
+		return;
+
+	__u64 now = bpf_ktime_get_ns();
+	__u64 t = skb->tstamp;
+	if (t < now || t - now > FAULT_HORIZON_NS)
+		t = now;
+	__u64 delay = f->delay_ns;
+	if (f->jitter_ns) {
+		// Uniform in steps of 1024 ns, so that the product fits
+		__u64 span = (2 * f->jitter_ns) >> 10;
+		delay += (((__u64)bpf_get_prandom_u32() * span) >> 22) - f->jitter_ns;
+	}
+	skb->tstamp = t + delay;
+}
+
+// tc_pace_ingress paces the traffic to a container, on its host veth,
+// and delays it by an injected fault
+SEC("tc")
+int tc_pace_ingress(struct __sk_buff *skb)
+{
+	int ret = pace(skb, PACE_INGRESS);
+	if (ret == TC_ACT_OK)
+		fault_delay_packet(skb);
+	return ret;
+}
+
+// tc_pace_egress paces the traffic from a container, on its interface
+SEC("tc")
+int tc_pace_egress(struct __sk_buff *skb)
+{
+	return pace(skb, PACE_EGRESS);
+}
+
+// Packet capture: tc_capture runs on clsact ingress and egress of the
+// host veth of a container while CaptureTraffic captures it, ahead of the
+// source check and the pacing there, and copies the frames its filter
+// matches to capture_events, each behind a capture_event. Traffic to the
+// container takes the kernel stack meanwhile, see CONTAINER_F_SHAPED, so
+// none skips the veth.
+
+// Protocols of capture_filter
+#define CAPTURE_TCP 1
+#define CAPTURE_UDP 2
+#define CAPTURE_ICMP 4
+
+// Perf samples are at most 64 KiB, their headers included
+#define CAPTURE_MAX_LEN 0xff00
+
+// CAPTURE_PULL covers the headers capture_matches reads
+#define CAPTURE_PULL (sizeof(struct ethhdr) + 60 + sizeof(struct udphdr))
+
+// capture_filter selects the frames of a host veth to capture: those of
+// the protocols set, every frame when none is, and those from or to port,
+// in host byte order, unless it is 0. Userspace merges the filters of
+// concurrent captures into one and tells their frames apart itself.
+struct capture_filter {
+	// Bytes of a frame to copy at most
+	__u32 snap_len;
+	__u16 port;
+	__u8 protocols;
+	__u8 pad;
+};
+
+// Host-side veth ifindex -> the filter of its captures
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 1024);
+	__type(key, __u32);
+	__type(value, struct capture_filter);
+} capture_filters SEC(".maps");
+
+// capture_event precedes a captured frame in capture_events
+struct capture_event {
+	__u64 timestamp;
+	__u32 ifindex;
+	// Length of the frame, and of the part of it that follows
+	__u32 len;
+	__u32 cap_len;
+	__u32 pad;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(__u32));
+	__uint(value_size, sizeof(__u32));
+} capture_events SEC(".maps");
+
+// capture_matches reports whether f selects the frame at eth
+static __always_inline int capture_matches(struct capture_filter *f, struct ethhdr *eth, void *data_end)
+{
+	if (!f->protocols)
+		return 1;
+	if ((void *)(eth + 1) > data_end)
+		return 0;
+
+	__u8 proto;
+	void *l4;
+	if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+		struct iphdr *ip = (void *)(eth + 1);
+		if ((void *)(ip + 1) > data_end)
+			return 0;
+		proto = ip->protocol;
+		l4 = (void *)ip + ip->ihl * 4;
+	} else if (eth->h_proto == bpf_htons(ETH_P_IPV6)) {
+		struct ipv6hdr *ip6 = (void *)(eth + 1);
+		if ((void *)(ip6 + 1) > data_end)
+			return 0;
+		proto = ip6->nexthdr;
+		l4 = ip6 + 1;
+	} else {
+		return 0;
+	}
+
+	__u8 bit = 0;
+	if (proto == IPPROTO_TCP)
+		bit = CAPTURE_TCP;
+	else if (proto == IPPROTO_UDP)
+		bit = CAPTURE_UDP;
+	else if (proto == IPPROTO_ICMP || proto == IPPROTO_ICMPV6)
+		bit = CAPTURE_ICMP;
+	if (!(f->protocols & bit))
+		return 0;
+	if (!f->port)
+		return 1;
+	// Only TCP and UDP have ports, at the same place
+	__be16 *ports = l4;
+	if (bit == CAPTURE_ICMP || (void *)(ports + 2) > data_end)
+		return 0;
+	return bpf_ntohs(ports[0]) == f->port || bpf_ntohs(ports[1]) == f->port;
+}
+
+// tc_capture leaves every frame to the filters after it, whether it
+// copied it or not
+SEC("tc")
+int tc_capture(struct __sk_buff *skb)
+{
+	__u32 ifindex = skb->ifindex;
+	struct capture_filter *f = bpf_map_lookup_elem(&capture_filters, &ifindex);
+	if (!f)
+		return TC_ACT_UNSPEC;
+
+	__u64 len = skb->len;
+	if (f->protocols)
+		bpf_skb_pull_data(skb, len < CAPTURE_PULL ? len : CAPTURE_PULL);
+	void *data = (void *)(long)skb->data;
+	void *data_end = (void *)(long)skb->data_end;
+	if (!capture_matches(f, data, data_end))
+		return TC_ACT_UNSPEC;
+
+	__u64 cap_len = len < f->snap_len ? len : f->snap_len;
+	if (cap_len > CAPTURE_MAX_LEN)
+		cap_len = CAPTURE_MAX_LEN;
+	struct capture_event e = {
+		.timestamp = bpf_ktime_get_ns(),
+		.ifindex = ifindex,
+		.len = len,
+		.cap_len = cap_len,
+	};
+	// The perf event takes cap_len bytes of the frame after e
+	bpf_perf_event_output(skb, &capture_events, BPF_F_CURRENT_CPU | (cap_len << 32), &e, sizeof(e));
+	return TC_ACT_UNSPEC;
+}
+
+// Connect-time policy: the cgroup programs below run as a container's
+// processes connect or send UDP, and refuse with EPERM what the policies
+// deny or reject towards containers of this node, before any packet
+// exists. The router still checks the packets, which covers traffic
+// these programs don't see, e.g. from outside the node.
+
+// CGROUP_DEPTH is how deep the cgroups of containers' processes may be
+// nested, counting from the root
+#define CGROUP_DEPTH 16
+
+// connect_source is a container whose cgroup the programs are attached to
+struct connect_source {
+	// Host-side veth, which the container's counters are keyed by
+	__u32 ifindex;
+	// IPv4 address in network byte order, 0 for none
+	__u32 addr4;
+	struct in6_addr addr6;
+};
+
+// cgroup v2 ID of a container's cgroup -> the container. Entries are
+// created by userspace as it attaches the programs.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u64);
+	__type(value, struct connect_source);
+} connect_sources SEC(".maps");
+
+// current_source returns the container the current process belongs to,
+// whose cgroup is the outermost of its ancestors with an entry
+static __always_inline struct connect_source *current_source(void)
+{
+#pragma unroll
+	for (int level = 1; level < CGROUP_DEPTH; level++) {
+		__u64 id = bpf_get_current_ancestor_cgroup_id(level);
+		if (!id)
+			break;
+		struct connect_source *src = bpf_map_lookup_elem(&connect_sources, &id);
+		if (src)
+			return src;
+	}
+	return NULL;
+}
+
+// connect_verdict counts a connection of src the policies allowed or not,
+// returning the program's verdict: 1 lets it through, 0 fails it with
+// EPERM
+static __always_inline int connect_verdict(struct connect_source *src, int allowed)
+{
+	__u32 zero = 0;
+	struct datapath_stats *node = bpf_map_lookup_elem(&stats, &zero);
+	struct datapath_stats *s = bpf_map_lookup_elem(&container_stats, &src->ifindex);
+	if (node) {
+		node->connect_checks++;
+		node->connect_denied += !allowed;
+	}
+	if (s) {
+		s->connect_checks++;
+		s->connect_denied += !allowed;
+	}
+	return allowed;
+}
+
+// connect4 checks a connection or send of the current process to dst and
+// port, in network byte order, like route4
+static __always_inline int connect4(__u32 dst, __u16 port, __u8 proto)
+{
+	struct connect_source *src = current_source();
+	if (!src || !src->addr4 || !container4(dst))
+		return 1;
+	if (ns_denied(bpf_map_lookup_elem(&container_ns, &src->addr4), bpf_map_lookup_elem(&container_ns, &dst)))
+		return connect_verdict(src, 0);
+	__u8 action = policy_lookup(src->addr4, dst, proto, port);
+	return connect_verdict(src, action != POLICY_DENY && action != POLICY_REJECT);
+}
+
+// connect6 is connect4 for IPv6
+static __always_inline int connect6(struct bpf_sock_addr *ctx, __u8 proto)
+{
+	struct connect_source *src = current_source();
+	if (!src)
+		return 1;
+	struct in6_addr dst = {};
+	dst.s6_addr32[0] = ctx->user_ip6[0];
+	dst.s6_addr32[1] = ctx->user_ip6[1];
+	dst.s6_addr32[2] = ctx->user_ip6[2];
+	dst.s6_addr32[3] = ctx->user_ip6[3];
+	struct in6_addr saddr = src->addr6;
+	if (!(saddr.s6_addr32[0] | saddr.s6_addr32[1] | saddr.s6_addr32[2] | saddr.s6_addr32[3]) ||
+	    !container6(&dst))
+		return 1;
+	if (ns_denied(bpf_map_lookup_elem(&container_ns6, &saddr), bpf_map_lookup_elem(&container_ns6, &dst)))
+		return connect_verdict(src, 0);
+	__u8 action = policy_lookup6(&saddr, &dst, proto, ctx->user_port);
+	return connect_verdict(src, action != POLICY_DENY && action != POLICY_REJECT);
+}
+
+// user_port holds the port in network byte order in its low 16 bits
+SEC("cgroup/connect4")
+int cgroup_connect4(struct bpf_sock_addr *ctx)
+{
+	return connect4(ctx->user_ip4, ctx->user_port, ctx->protocol);
+}
+
+SEC("cgroup/connect6")
+int cgroup_connect6(struct bpf_sock_addr *ctx)
+{
+	return connect6(ctx, ctx->protocol);
+}
+
+// UDP sockets need not connect, so each datagram sent to an address is
+// checked
+SEC("cgroup/sendmsg4")
+int cgroup_sendmsg4(struct bpf_sock_addr *ctx)
+{
+	return connect4(ctx->user_ip4, ctx->user_port, IPPROTO_UDP);
+}
+
+SEC("cgroup/sendmsg6")
+int cgroup_sendmsg6(struct bpf_sock_addr *ctx)
+{
+	return connect6(ctx, IPPROTO_UDP);
+}
+
+// Socket acceleration: sockops_accelerate, attached to the cgroups of
+// containers, adds their established TCP sockets connected to another
+// container of this node to accel_socks, and sk_msg_accelerate splices
+// what they send straight into the peer socket, skipping both stacks and
+// the router. Whatever it can't splice takes the stack as usual, so a
+// peer outside the map, e.g. without a cgroup, costs nothing but the
+// lookup.
+
+// Established sockets keyed like their conntrack entry, from the local
+// socket to its peer
+struct {
+	__uint(type, BPF_MAP_TYPE_SOCKHASH);
+	__uint(max_entries, 65536);
+	// Sizes rather than types: older kernels refuse BTF on socket maps
+	__uint(key_size, sizeof(struct ct_key));
+	__uint(value_size, sizeof(__u32));
+} accel_socks SEC(".maps");
+
+// Host-side veth ifindex -> 1 for containers whose traffic must take the
+// stack, e.g. while captured or mirrored. Userspace evicts their sockets
+// from accel_socks as it adds them.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u32);
+	__type(value, __u8);
+} accel_excluded SEC(".maps");
+
+// accel_container returns the container at addr if its sockets may be
+// spliced, NULL if it isn't one of this node or its traffic is shaped,
+// impaired or excluded by userspace
+static __always_inline struct container_info *accel_container(struct in6_addr *addr)
+{
+	struct container_info *info;
+	if (!addr->s6_addr32[0] && !addr->s6_addr32[1] && addr->s6_addr32[2] == bpf_htonl(0xffff)) {
+		__u32 addr4 = addr->s6_addr32[3];
+		info = container4(addr4);
+	} else {
+		info = container6(addr);
+	}
+	if (!info || (info->flags & CONTAINER_F_SHAPED))
+		return NULL;
+	if (bpf_map_lookup_elem(&accel_excluded, &info->ifindex) ||
+	    bpf_map_lookup_elem(&container_faults, &info->ifindex))
+		return NULL;
+	return info;
+}
+
+// accel_port returns a port of sock_ops or sk_msg_md in network byte
+// order in the upper 16 bits of remote_port, as the kernel stores it on
+// little-endian hosts
+static __always_inline __u16 accel_port(__u32 remote_port)
+{
+#if __BYTE_ORDER__ == __ORDER_LITTLE_ENDIAN__
+	return remote_port >> 16;
+#else
+	return remote_port;
+#endif
+}
+
+// sockops_key fills key with the flow of ops from the local socket to its
+// peer, returning 0 for sockets of other families
+static __always_inline int sockops_key(struct bpf_sock_ops *ops, struct ct_key *key)
+{
+	key->proto = IPPROTO_TCP;
+	// local_port is in host byte order
+	key->sport = bpf_htons(ops->local_port);
+	key->dport = accel_port(ops->remote_port);
+	if (ops->family == 2 /* AF_INET */) {
+		key->src.s6_addr16[5] = 0xffff;
+		key->src.s6_addr32[3] = ctx_load(ops->local_ip4);
+		key->dst.s6_addr16[5] = 0xffff;
+		key->dst.s6_addr32[3] = ctx_load(ops->remote_ip4);
+		return 1;
+	}
+	if (ops->family == 10 /* AF_INET6 */) {
+		key->src.s6_addr32[0] = ops->local_ip6[0];
+		key->src.s6_addr32[1] = ops->local_ip6[1];
+		key->src.s6_addr32[2] = ops->local_ip6[2];
+		key->src.s6_addr32[3] = ops->local_ip6[3];
+		key->dst.s6_addr32[0] = ops->remote_ip6[0];
+		key->dst.s6_addr32[1] = ops->remote_ip6[1];
+		key->dst.s6_addr32[2] = ops->remote_ip6[2];
+		key->dst.s6_addr32[3] = ops->remote_ip6[3];
+		return 1;
+	}
+	return 0;
+}
+
+// msg_key is sockops_key for the socket msg is sent on
+static __always_inline int msg_key(struct sk_msg_md *msg, struct ct_key *key)
+{
+	key->proto = IPPROTO_TCP;
+	key->sport = bpf_htons(msg->local_port);
+	key->dport = accel_port(msg->remote_port);
+	if (msg->family == 2 /* AF_INET */) {
+		key->src.s6_addr16[5] = 0xffff;
+		key->src.s6_addr32[3] = ctx_load(msg->local_ip4);
+		key->dst.s6_addr16[5] = 0xffff;
+		key->dst.s6_addr32[3] = ctx_load(msg->remote_ip4);
+		return 1;
+	}
+	if (msg->family == 10 /* AF_INET6 */) {
+		key->src.s6_addr32[0] = msg->local_ip6[0];
+		key->src.s6_addr32[1] = msg->local_ip6[1];
+		key->src.s6_addr32[2] = msg->local_ip6[2];
+		key->src.s6_addr32[3] = msg->local_ip6[3];
+		key->dst.s6_addr32[0] = msg->remote_ip6[0];
+		key->dst.s6_addr32[1] = msg->remote_ip6[1];
+		key->dst.s6_addr32[2] = msg->remote_ip6[2];
+		key->dst.s6_addr32[3] = msg->remote_ip6[3];
+		return 1;
+	}
+	return 0;
+}
+
+// accel_ct records a socket established to the container behind ifindex
+// in conntrack, which the router no longer sees the flow's packets for
+static __always_inline void accel_ct(struct ct_key *key, __u32 ifindex)
+{
+	__u64 now = bpf_ktime_get_ns();
+	struct ct_entry *e = bpf_map_lookup_elem(&conntrack, key);
+	if (e) {
+		e->last_seen = now;
+		if (e->state < CT_ESTABLISHED)
+			e->state = CT_ESTABLISHED;
+		return;
+	}
+	struct ct_entry entry = {
+		.created = now,
+		.last_seen = now,
+		.ifindex = ifindex,
+		.state = CT_ESTABLISHED,
+	};
+	bpf_map_update_elem(&conntrack, key, &entry, BPF_NOEXIST);
+}
+
+SEC("sockops")
+int sockops_accelerate(struct bpf_sock_ops *ops)
+{
+	struct ct_key key = {};
+	if (!sockops_key(ops, &key))
+		return 1;
+
+	if (ops->op == BPF_SOCK_OPS_STATE_CB) {
+		// Sockets leave accel_socks by themselves as they close; the
+		// flow's entry is closed like a reset would
+		if (ops->args[1] == BPF_TCP_CLOSE) {
+			struct ct_entry *e = bpf_map_lookup_elem(&conntrack, &key);
+			if (e)
+				e->state = CT_CLOSED;
+		}
+		return 1;
+	}
+	if (ops->op != BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB && ops->op != BPF_SOCK_OPS_PASSIVE_ESTABLISHED_CB)
+		return 1;
+
+	struct container_info *src = accel_container(&key.src);
+	if (!src)
+		return 1;
+	__u32 src_ifindex = src->ifindex;
+	struct container_info *dst = accel_container(&key.dst);
+	if (!dst)
+		return 1;
+	if (bpf_sock_hash_update(ops, &accel_socks, &key, BPF_NOEXIST))
+		return 1;
+	bpf_sock_ops_cb_flags_set(ops, BPF_SOCK_OPS_STATE_CB_FLAG);
+	accel_ct(&key, dst->ifindex);
+
+	__u32 zero = 0;
+	struct datapath_stats *node = bpf_map_lookup_elem(&stats, &zero);
+	struct datapath_stats *s = bpf_map_lookup_elem(&container_stats, &src_ifindex);
+	if (node)
+		node->accel_sockets++;
+	if (s)
+		s->accel_sockets++;
+	return 1;
+}
+
+// accel_denied reports whether the router would drop the flow of key,
+// whose policies may have changed since it was established, or steer it
+// to an AF_XDP socket
+static __always_inline int accel_denied(struct ct_key *key)
+{
+	struct xsk_flow_key xk = { .dst = key->dst, .port = key->dport, .proto = IPPROTO_TCP };
+	if (xsk_steered(&xk))
+		return 1;
+	__u8 action;
+	if (key->src.s6_addr16[5] == 0xffff && !key->src.s6_addr32[0]) {
+		__u32 src = key->src.s6_addr32[3], dst = key->dst.s6_addr32[3];
+		if (ns_denied(bpf_map_lookup_elem(&container_ns, &src), bpf_map_lookup_elem(&container_ns, &dst)))
+			return 1;
+		action = policy_lookup(src, dst, IPPROTO_TCP, key->dport);
+	} else {
+		if (ns_denied(bpf_map_lookup_elem(&container_ns6, &key->src), bpf_map_lookup_elem(&container_ns6, &key->dst)))
+			return 1;
+		action = policy_lookup6(&key->src, &key->dst, IPPROTO_TCP, key->dport);
+	}
+	return action == POLICY_DENY || action == POLICY_REJECT;
+}
+
+// Runs for messages sent on sockets in accel_socks. Messages it doesn't
+// splice, e.g. once either container is excluded or the policies deny
+// the flow, take the stack and the router.
+SEC("sk_msg")
+int sk_msg_accelerate(struct sk_msg_md *msg)
+{
+	struct ct_key key = {};
+	if (!msg_key(msg, &key))
+		return SK_PASS;
+	struct container_info *src = accel_container(&key.src);
+	if (!src)
+		return SK_PASS;
+	__u32 src_ifindex = src->ifindex;
+	if (!accel_container(&key.dst) || accel_denied(&key))
+		return SK_PASS;
+
+	struct ct_key peer = {
+		.src = key.dst,
+		.dst = key.src,
+		.sport = key.dport,
+		.dport = key.sport,
+		.proto = IPPROTO_TCP,
+	};
+	if (bpf_msg_redirect_hash(msg, &accel_socks, &peer, BPF_F_INGRESS) != SK_PASS)
+		return SK_PASS;
+
+	// Account the spliced bytes at the message layer, where the router
+	// would have counted packets
+	__u64 len = msg->size;
+	struct ct_entry *e = bpf_map_lookup_elem(&conntrack, &key);
+	if (e) {
+		__sync_fetch_and_add(&e->packets, 1);
+		__sync_fetch_and_add(&e->bytes, len);
+		e->last_seen = bpf_ktime_get_ns();
+	}
+	__u32 zero = 0;
+	struct datapath_stats *node = bpf_map_lookup_elem(&stats, &zero);
+	struct datapath_stats *s = bpf_map_lookup_elem(&container_stats, &src_ifindex);
+	if (node) {
+		node->accel_msgs++;
+		node->accel_bytes += len;
+	}
+	if (s) {
+		s->accel_msgs++;
+		s->accel_bytes += len;
+	}
+	return SK_PASS;
+}
+
+// Proxy redirection: traffic of a container matching its redirects is
+// steered to a proxy in its network namespace, e.g. a service mesh
+// sidecar, without iptables. tc_proxy_ingress, on the container's own
+// interface, hands what arrives for it to the proxy's socket like TPROXY,
+// so accepted connections keep the original destination as their local
+// address. cgroup_proxy_connect4/6 point connections the container makes
+// at the proxy on loopback, and cgroup_proxy_getsockopt answers
+// SO_ORIGINAL_DST on the proxy's side with where they were headed.
+
+#define PROXY_INGRESS 1
+#define PROXY_EGRESS 2
+
+#ifndef SOL_IP
+#define SOL_IP 0
+#endif
+#ifndef SOL_IPV6
+#define SOL_IPV6 41
+#endif
+// As in linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+#define SO_ORIGINAL_DST 80
+
+struct proxy_key {
+	// The container's address: the destination of traffic to it, the
+	// source of connections it makes. IPv4 addresses are IPv4-mapped.
+	struct in6_addr addr;
+	// Destination port in network byte order, 0 for any
+	__u16 port;
+	__u8 proto;
+	// PROXY_INGRESS or PROXY_EGRESS
+	__u8 direction;
+};
+
+struct proxy_target {
+	// Port the proxy listens on, in network byte order
+	__u16 port;
+	__u16 pad;
+	// Connections made as exempt_uid, unless it is ~0, or from the cgroup
+	// exempt_cgroup or below, unless it is 0, are the proxy's own and
+	// never redirected
+	__u32 exempt_uid;
+	__u64 exempt_cgroup;
+};
+
+// Redirected traffic -> the proxy taking it. Entries are kept by
+// userspace as containers' redirects change.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 16384);
+	__type(key, struct proxy_key);
+	__type(value, struct proxy_target);
+} proxy_redirects SEC(".maps");
+
+// proxy_origin is where a redirected connection was headed
+struct proxy_origin {
+	struct in6_addr addr;
+	__u16 port;
+	__u8 v4;
+	__u8 pad;
+};
+
+// Socket cookie of a redirected connection -> its origin, until
+// sockops_proxy knows the connection's local port
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u64);
+	__type(value, struct proxy_origin);
+} proxy_origins SEC(".maps");
+
+// proxy_peer is the local end of a redirected connection, the remote end
+// of the proxy's socket. IPv4 addresses are IPv4-mapped.
+struct proxy_peer {
+	struct in6_addr addr;
+	__u16 port;
+	__u16 pad;
+};
+
+// Local end of a redirected connection -> its origin, for
+// cgroup_proxy_getsockopt
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 65536);
+	__type(key, struct proxy_peer);
+	__type(value, struct proxy_origin);
+} proxy_peers SEC(".maps");
+
+// proxy_lookup returns the proxy taking the traffic of key, trying its
+// port and then any port
+static __always_inline struct proxy_target *proxy_lookup(struct proxy_key *key)
+{
+	struct proxy_target *t = bpf_map_lookup_elem(&proxy_redirects, key);
+	if (t)
+		return t;
+	key->port = 0;
+	return bpf_map_lookup_elem(&proxy_redirects, key);
+}
+
+// proxy_assign hands the packet of tuple to the socket of the proxy on
+// port, or to the socket of a connection the proxy accepted already. It
+// drops the packet while the proxy isn't listening, e.g. as it restarts.
+static __always_inline int proxy_assign(struct __sk_buff *skb, struct bpf_sock_tuple *tuple, int v4, __u8 proto, __u16 port)
+{
+	__u32 len = v4 ? sizeof(tuple->ipv4) : sizeof(tuple->ipv6);
+	struct bpf_sock *sk;
+	if (proto == IPPROTO_TCP) {
+		sk = bpf_skc_lookup_tcp(skb, tuple, len, BPF_F_CURRENT_NETNS, 0);
+		if (sk) {
+			if (sk->state != BPF_TCP_LISTEN)
+				goto assign;
+			bpf_sk_release(sk);
+		}
+	}
+	if (v4)
+		tuple->ipv4.dport = port;
+	else
+		tuple->ipv6.dport = port;
+	if (proto == IPPROTO_TCP)
+		sk = bpf_skc_lookup_tcp(skb, tuple, len, BPF_F_CURRENT_NETNS, 0);
+	else
+		sk = bpf_sk_lookup_udp(skb, tuple, len, BPF_F_CURRENT_NETNS, 0);
+	if (!sk)
+		return TC_ACT_SHOT;
+	if (proto == IPPROTO_TCP && sk->state != BPF_TCP_LISTEN) {
+		bpf_sk_release(sk);
+		return TC_ACT_SHOT;
+	}
+assign:;
+	long err = bpf_sk_assign(skb, sk, 0);
+	bpf_sk_release(sk);
+	return err ? TC_ACT_SHOT : TC_ACT_OK;
+}
+
+// Attached to clsact ingress of the interface inside a container with
+// ingress redirects. IPv4 packets with options aren't redirected.
+SEC("tc")
+int tc_proxy_ingress(struct __sk_buff *skb)
+{
+	void *data = (void *)(long)skb->data;
+	void *data_end = (void *)(long)skb->data_end;
+	struct ethhdr *eth = data;
+	if ((void *)(eth + 1) > data_end)
+		return TC_ACT_OK;
+
+	struct bpf_sock_tuple tuple = {};
+	struct proxy_key key = { .direction = PROXY_INGRESS };
+	void *l4;
+	int v4 = eth->h_proto == bpf_htons(ETH_P_IP);
+	if (v4) {
+		struct iphdr *ip = (void *)(eth + 1);
+		if ((void *)(ip + 1) > data_end || ip->ihl != 5)
+			return TC_ACT_OK;
+		key.proto = ip->protocol;
+		tuple.ipv4.saddr = ip->saddr;
+		tuple.ipv4.daddr = ip->daddr;
+		key.addr.s6_addr16[5] = 0xffff;
+		key.addr.s6_addr32[3] = ip->daddr;
+		l4 = ip + 1;
+	} else if (eth->h_proto == bpf_htons(ETH_P_IPV6)) {
+		struct ipv6hdr *ip6 = (void *)(eth + 1);
+		if ((void *)(ip6 + 1) > data_end)
+			return TC_ACT_OK;
+		key.proto = ip6->nexthdr;
+		__builtin_memcpy(tuple.ipv6.saddr, &ip6->saddr, sizeof(tuple.ipv6.saddr));
+		__builtin_memcpy(tuple.ipv6.daddr, &ip6->daddr, sizeof(tuple.ipv6.daddr));
+		key.addr = ip6->daddr;
+		l4 = ip6 + 1;
+	} else {
+		return TC_ACT_OK;
+	}
+
+	// TCP and UDP headers start with the ports alike
+	if (key.proto != IPPROTO_TCP && key.proto != IPPROTO_UDP)
+		return TC_ACT_OK;
+	struct udphdr *ports = l4;
+	if ((void *)(ports + 1) > data_end)
+		return TC_ACT_OK;
+	__u16 sport = ports->source, dport = ports->dest;
+	key.port = dport;
+	struct proxy_target *t = proxy_lookup(&key);
+	if (!t)
+		return TC_ACT_OK;
+	if (v4) {
+		tuple.ipv4.sport = sport;
+		tuple.ipv4.dport = dport;
+	} else {
+		tuple.ipv6.sport = sport;
+		tuple.ipv6.dport = dport;
+	}
+	return proxy_assign(skb, &tuple, v4, key.proto, t->port);
+}
+
+// proxy_exempt reports whether the current process is the proxy of t
+static __always_inline int proxy_exempt(struct proxy_target *t)
+{
+	if (t->exempt_uid != (__u32)-1 && (__u32)bpf_get_current_uid_gid() == t->exempt_uid)
+		return 1;
+	if (!t->exempt_cgroup)
+		return 0;
+#pragma unroll
+	for (int level = 1; level < CGROUP_DEPTH; level++) {
+		__u64 id = bpf_get_current_ancestor_cgroup_id(level);
+		if (!id)
+			break;
+		if (id == t->exempt_cgroup)
+			return 1;
+	}
+	return 0;
+}
+
+// proxy_connect returns the proxy taking the TCP connection the current
+// process makes to port from addr, the address of its container in the
+// family of the connection, if any and the process isn't the proxy
+static __always_inline struct proxy_target *proxy_connect(struct bpf_sock_addr *ctx, struct in6_addr *addr)
+{
+	if (ctx->type != 1 /* SOCK_STREAM */)
+		return NULL;
+	struct proxy_key key = {
+		.addr = *addr,
+		.port = ctx->user_port,
+		.proto = IPPROTO_TCP,
+		.direction = PROXY_EGRESS,
+	};
+	struct proxy_target *t = proxy_lookup(&key);
+	if (!t || proxy_exempt(t))
+		return NULL;
+	return t;
+}
+
+// proxy_record remembers where the connection of ctx was headed
+static __always_inline void proxy_record(struct bpf_sock_addr *ctx, struct proxy_origin *o)
+{
+	__u64 cookie = bpf_get_socket_cookie(ctx);
+	bpf_map_update_elem(&proxy_origins, &cookie, o, BPF_ANY);
+}
+
+SEC("cgroup/connect4")
+int cgroup_proxy_connect4(struct bpf_sock_addr *ctx)
+{
+	struct connect_source *src = current_source();
+	if (!src || !src->addr4)
+		return 1;
+	// Connections within the container, e.g. the proxy forwarding to
+	// the application, stay
+	__u32 dst = ctx->user_ip4;
+	if (dst == src->addr4 || (bpf_ntohl(dst) >> 24) == 127)
+		return 1;
+	struct in6_addr addr = {};
+	addr.s6_addr16[5] = 0xffff;
+	addr.s6_addr32[3] = src->addr4;
+	struct proxy_target *t = proxy_connect(ctx, &addr);
+	if (!t)
+		return 1;
+
+	struct proxy_origin o = { .port = ctx->user_port, .v4 = 1 };
+	o.addr.s6_addr16[5] = 0xffff;
+	o.addr.s6_addr32[3] = dst;
+	proxy_record(ctx, &o);
+	ctx->user_ip4 = bpf_htonl(0x7f000001);
+	ctx->user_port = t->port;
+	return 1;
+}
+
+SEC("cgroup/connect6")
+int cgroup_proxy_connect6(struct bpf_sock_addr *ctx)
+{
+	struct connect_source *src = current_source();
+	if (!src)
+		return 1;
+	struct in6_addr addr = src->addr6;
+	if (!(addr.s6_addr32[0] | addr.s6_addr32[1] | addr.s6_addr32[2] | addr.s6_addr32[3]))
+		return 1;
+	struct proxy_origin o = { .port = ctx->user_port };
+	o.addr.s6_addr32[0] = ctx->user_ip6[0];
+	o.addr.s6_addr32[1] = ctx->user_ip6[1];
+	o.addr.s6_addr32[2] = ctx->user_ip6[2];
+	o.addr.s6_addr32[3] = ctx->user_ip6[3];
+	int loopback = !(o.addr.s6_addr32[0] | o.addr.s6_addr32[1] | o.addr.s6_addr32[2]) &&
+		       o.addr.s6_addr32[3] == bpf_htonl(1);
+	if (loopback || (o.addr.s6_addr32[0] == addr.s6_addr32[0] && o.addr.s6_addr32[1] == addr.s6_addr32[1] &&
+			 o.addr.s6_addr32[2] == addr.s6_addr32[2] && o.addr.s6_addr32[3] == addr.s6_addr32[3]))
+		return 1;
+	struct proxy_target *t = proxy_connect(ctx, &addr);
+	if (!t)
+		return 1;
+
+	proxy_record(ctx, &o);
+	ctx->user_ip6[0] = 0;
+	ctx->user_ip6[1] = 0;
+	ctx->user_ip6[2] = 0;
+	ctx->user_ip6[3] = bpf_htonl(1);
+	ctx->user_port = t->port;
+	return 1;
+}
+
+// The local port of a redirected connection is known once it connects,
+// which keys its origin for the proxy from then on
+SEC("sockops")
+int sockops_proxy(struct bpf_sock_ops *ops)
+{
+	if (ops->op != BPF_SOCK_OPS_TCP_CONNECT_CB)
+		return 1;
+	__u64 cookie = bpf_get_socket_cookie(ops);
+	struct proxy_origin *o = bpf_map_lookup_elem(&proxy_origins, &cookie);
+	if (!o)
+		return 1;
+	struct proxy_origin origin = *o;
+	struct proxy_peer peer = { .port = bpf_htons(ops->local_port) };
+	if (ops->family == 2 /* AF_INET */) {
+		peer.addr.s6_addr16[5] = 0xffff;
+		peer.addr.s6_addr32[3] = ctx_load(ops->local_ip4);
+	} else {
+		peer.addr.s6_addr32[0] = ops->local_ip6[0];
+		peer.addr.s6_addr32[1] = ops->local_ip6[1];
+		peer.addr.s6_addr32[2] = ops->local_ip6[2];
+		peer.addr.s6_addr32[3] = ops->local_ip6[3];
+	}
+	bpf_map_update_elem(&proxy_peers, &peer, &origin, BPF_ANY);
+	bpf_map_delete_elem(&proxy_origins, &cookie);
+	return 1;
+}
+
+// Answers SO_ORIGINAL_DST, as netfilter would after a REDIRECT, on the
+// proxy's socket of a redirected connection
+SEC("cgroup/getsockopt")
+int cgroup_proxy_getsockopt(struct bpf_sockopt *ctx)
+{
+	if (ctx->optname != SO_ORIGINAL_DST || (ctx->level != SOL_IP && ctx->level != SOL_IPV6))
+		return 1;
+	struct bpf_sock *sk = ctx->sk;
+	if (!sk)
+		return 1;
+	struct proxy_peer peer = { .port = sk->dst_port };
+	if (sk->family == 2 /* AF_INET */) {
+		peer.addr.s6_addr16[5] = 0xffff;
+		peer.addr.s6_addr32[3] = ctx_load(sk->dst_ip4);
+	} else {
+		peer.addr.s6_addr32[0] = sk->dst_ip6[0];
+		peer.addr.s6_addr32[1] = sk->dst_ip6[1];
+		peer.addr.s6_addr32[2] = sk->dst_ip6[2];
+		peer.addr.s6_addr32[3] = sk->dst_ip6[3];
+	}
+	struct proxy_origin *o = bpf_map_lookup_elem(&proxy_peers, &peer);
+	if (!o)
+		return 1;
+
+	if (ctx->level == SOL_IP) {
+		struct sockaddr_in *sin = ctx->optval;
+		if (!o->v4 || (void *)(sin + 1) > ctx->optval_end)
+			return 1;
+		sin->sin_family = 2 /* AF_INET */;
+		sin->sin_port = o->port;
+		sin->sin_addr.s_addr = o->addr.s6_addr32[3];
+		ctx->optlen = sizeof(*sin);
+	} else {
+		struct sockaddr_in6 *sin6 = ctx->optval;
+		if ((void *)(sin6 + 1) > ctx->optval_end)
+			return 1;
+		__builtin_memset(sin6, 0, sizeof(*sin6));
+		sin6->sin6_family = 10 /* AF_INET6 */;
+		sin6->sin6_port = o->port;
+		sin6->sin6_addr = o->addr;
+		ctx->optlen = sizeof(*sin6);
+	}
+	ctx->retval = 0;
+	return 1;
+}
+
+char _license[] SEC("license") = "GPL";
@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: GPL-2.0
+//
+// Contract between the container router in ../container_router.c and the
+// datapath extensions it tail calls at its hooks. An extension includes
+// this header, is loaded with ext_cursor and its chain map replaced by
+// those the router pinned, e.g. /sys/fs/bpf/enviro/ext_cursor and
+// /sys/fs/bpf/enviro/ext_xdp, and ends by returning enviro_ext_next.
+//
+// Define ENVIRO_EXT_TC before including it for extensions of the TC
+// router. The layouts must match the router's.
+
+#ifndef ENVIRO_EXT_H
+#define ENVIRO_EXT_H
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+
+// Hooks, as in enviro_ext_cursor.hook
+#define ENVIRO_EXT_HOOK_PRE_ROUTING 0
+#define ENVIRO_EXT_HOOK_POST_POLICY 1
+#define ENVIRO_EXT_HOOK_PRE_REDIRECT 2
+
+#define ENVIRO_EXT_HOOKS 3
+#define ENVIRO_EXT_CHAIN 9
+
+// enviro_ext_cursor is what the router shares about the packet. Its
+// destination and verdict are copies; only the router's own count.
+struct enviro_ext_cursor {
+	__u32 hook;
+	__u32 slot;
+	// ifindex of the destination container's veth, 0 for none and before
+	// routing
+	__u32 dest;
+	// XDP_* in both program types, XDP_ABORTED before routing
+	__s32 verdict;
+	__u64 len;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct enviro_ext_cursor);
+} ext_cursor SEC(".maps");
+
+#ifdef ENVIRO_EXT_TC
+#define ENVIRO_EXT_CHAIN_MAP ext_tc
+#define ENVIRO_EXT_ABORT TC_ACT_OK
+#else
+#define ENVIRO_EXT_CHAIN_MAP ext_xdp
+#define ENVIRO_EXT_ABORT XDP_PASS
+#endif
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PROG_ARRAY);
+	__uint(max_entries, ENVIRO_EXT_HOOKS * ENVIRO_EXT_CHAIN);
+	__type(key, __u32);
+	__type(value, __u32);
+} ENVIRO_EXT_CHAIN_MAP SEC(".maps");
+
+// enviro_ext_cursor returns what the router shares about the packet, or
+// NULL, which the verifier requires checking for
+static __always_inline struct enviro_ext_cursor *enviro_ext_cursor(void)
+{
+	__u32 zero = 0;
+	return bpf_map_lookup_elem(&ext_cursor, &zero);
+}
+
+// enviro_ext_next hands the packet to the next extension of the hook, or
+// back to the router after the last. Extensions must return it. It only
+// returns, passing the packet to the kernel, while the router rewrites the
+// chain.
+static __always_inline int enviro_ext_next(void *ctx)
+{
+	struct enviro_ext_cursor *c = enviro_ext_cursor();
+	if (c) {
+		__u32 slot = ++c->slot;
+		bpf_tail_call(ctx, &ENVIRO_EXT_CHAIN_MAP, slot);
+	}
+	return ENVIRO_EXT_ABORT;
+}
+
+#endif
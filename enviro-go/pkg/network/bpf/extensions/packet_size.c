@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: GPL-2.0
+//
+// Example datapath extension: a histogram of the sizes of the packets the
+// XDP router sees at the hook it is registered at. Bucket i of
+// packet_sizes counts packets of [2^i, 2^(i+1)) bytes, the last any
+// larger, summed across CPUs.
+//
+// Built with `make bpf`, then loaded against the router's pinned maps and
+// registered, e.g. from Go:
+//
+//	spec, _ := ebpf.LoadCollectionSpec("packet_size.o")
+//	cursor, _ := ebpf.LoadPinnedMap("/sys/fs/bpf/enviro/ext_cursor", nil)
+//	chain, _ := ebpf.LoadPinnedMap("/sys/fs/bpf/enviro/ext_xdp", nil)
+//	coll, _ := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{
+//		MapReplacements: map[string]*ebpf.Map{"ext_cursor": cursor, "ext_xdp": chain},
+//	})
+//	nm.RegisterDatapathExtension(network.DatapathExtension{
+//		Name: "packet-size", Hook: network.HookPreRouting, FD: coll.Programs["packet_size"].FD(),
+//	})
+
+#include "enviro_ext.h"
+
+#define SIZE_BUCKETS 16
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, SIZE_BUCKETS);
+	__type(key, __u32);
+	__type(value, __u64);
+} packet_sizes SEC(".maps");
+
+SEC("xdp")
+int packet_size(struct xdp_md *ctx)
+{
+	__u64 len = ctx->data_end - ctx->data;
+	__u32 bucket = 0;
+
+#pragma unroll
+	for (int i = 1; i < SIZE_BUCKETS; i++) {
+		if (len >> i)
+			bucket = i;
+	}
+	__u64 *n = bpf_map_lookup_elem(&packet_sizes, &bucket);
+	if (n)
+		(*n)++;
+	return enviro_ext_next(ctx);
+}
+
+char _license[] SEC("license") = "GPL";
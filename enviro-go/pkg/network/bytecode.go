@@ -0,0 +1,7 @@
+//go:build linux && !bpfobj
+
+package network
+
+// routerBytecode is empty unless built with -tags bpfobj after `make bpf`;
+// XDP then falls back to the non-XDP datapath.
+var routerBytecode []byte
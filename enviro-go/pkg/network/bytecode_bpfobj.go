@@ -0,0 +1,10 @@
+//go:build linux && bpfobj
+
+package network
+
+import _ "embed"
+
+// routerBytecode is the compiled bpf/container_router.c
+//
+//go:embed bpf/container_router.o
+var routerBytecode []byte
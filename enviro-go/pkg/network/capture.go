@@ -0,0 +1,264 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrInvalidCapture is returned for capture options that can't be applied
+var ErrInvalidCapture = errors.New("network: invalid capture options")
+
+const (
+	// DefaultSnapLen captures whole packets
+	DefaultSnapLen = 65535
+	// captureBufferSize fits the largest GSO packet a veth passes up
+	captureBufferSize = 64<<10 + 256
+)
+
+// CaptureOptions limits a packet capture. A capture stops at whichever
+// limit is hit first, or when its context is done.
+type CaptureOptions struct {
+	// SnapLen truncates captured packets, defaults to DefaultSnapLen
+	SnapLen int
+	// Duration stops the capture after this long, 0 for no limit
+	Duration time.Duration
+	// MaxPackets stops the capture after this many packets, 0 for no limit
+	MaxPackets int
+	// Protocol keeps only "tcp", "udp" or "icmp" packets, the latter
+	// including ICMPv6. Empty keeps all.
+	Protocol string
+	// Port keeps only TCP and UDP packets from or to this port, 0 for any
+	Port uint16
+}
+
+// CaptureStats summarizes a finished capture
+type CaptureStats struct {
+	// Packets is the number of packets written
+	Packets int
+	// Dropped counts packets the kernel dropped because the capture fell
+	// behind
+	Dropped uint64
+}
+
+// captureSource reads frames seen by a container's interface
+type captureSource interface {
+	// read blocks for the next frame, returning its captured and original
+	// length and when it was seen. It fails once ctx is done.
+	read(ctx context.Context, buf []byte) (n, origLen int, ts time.Time, err error)
+	// dropped returns the frames lost so far
+	dropped() uint64
+	Close() error
+}
+
+// CaptureTraffic writes the traffic of a container to w in pcap format
+// until a limit in opts is hit or ctx is done, which is not an error.
+// Concurrent captures of the same container each get every packet.
+func (nm *NetworkManager) CaptureTraffic(ctx context.Context, containerID string, opts CaptureOptions, w io.Writer) (CaptureStats, error) {
+	filter, err := opts.filter()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	snapLen := opts.SnapLen
+	if snapLen == 0 {
+		snapLen = DefaultSnapLen
+	}
+
+	nm.mu.Lock()
+	cn, ok := nm.containers[containerID]
+	x := nm.xdp
+	var syncErr error
+	if ok {
+		cn.captures++
+		syncErr = nm.syncCapture(cn)
+		cn = cn.clone()
+	}
+	nm.mu.Unlock()
+	if !ok {
+		return CaptureStats{}, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	defer nm.endCapture(containerID)
+	if syncErr != nil {
+		return CaptureStats{}, fmt.Errorf("failed to start capture on %s: %w", containerID, syncErr)
+	}
+
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+
+	src, err := nm.openCapture(x, cn, filter, snapLen)
+	if err != nil {
+		return CaptureStats{}, fmt.Errorf("failed to start capture on %s: %w", containerID, err)
+	}
+	defer src.Close()
+
+	logger := nm.logger(ctx).With("container_id", containerID)
+	logger.Info("Starting packet capture", "snap_len", snapLen, "duration", opts.Duration,
+		"max_packets", opts.MaxPackets, "protocol", opts.Protocol, "port", opts.Port)
+
+	var stats CaptureStats
+	pw := &pcapWriter{w: w}
+	if err := pw.writeHeader(snapLen); err != nil {
+		return stats, err
+	}
+	buf := make([]byte, captureBufferSize)
+	for opts.MaxPackets == 0 || stats.Packets < opts.MaxPackets {
+		n, origLen, ts, err := src.read(ctx, buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return stats, fmt.Errorf("capture on %s failed: %w", containerID, err)
+		}
+		if !filter.match(buf[:n]) {
+			continue
+		}
+		if err := pw.writePacket(ts, buf[:min(n, snapLen)], origLen); err != nil {
+			return stats, err
+		}
+		stats.Packets++
+	}
+	stats.Dropped = src.dropped()
+	logger.Info("Finished packet capture", "packets", stats.Packets, "dropped", stats.Dropped)
+	return stats, nil
+}
+
+// endCapture lets the traffic of containerID be redirected and its
+// sockets spliced again once no capture of it runs
+func (nm *NetworkManager) endCapture(containerID string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	// A container deleted meanwhile may have been created again
+	cn, ok := nm.containers[containerID]
+	if !ok || cn.captures == 0 {
+		return
+	}
+	cn.captures--
+	if err := nm.syncCapture(cn); err != nil {
+		nm.log.Warn("Failed to end capture", "container_id", containerID, "error", err)
+	}
+}
+
+// captureFilter matches frames by IP protocol and TCP/UDP port
+type captureFilter struct {
+	// protocols are the IP protocol numbers kept, nil for all
+	protocols []uint8
+	port      uint16
+}
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+func (o CaptureOptions) filter() (captureFilter, error) {
+	if o.SnapLen < 0 || o.Duration < 0 || o.MaxPackets < 0 {
+		return captureFilter{}, fmt.Errorf("%w: limits must not be negative", ErrInvalidCapture)
+	}
+	var f captureFilter
+	switch o.Protocol {
+	case "":
+	case "tcp":
+		f.protocols = []uint8{protoTCP}
+	case "udp":
+		f.protocols = []uint8{protoUDP}
+	case "icmp":
+		f.protocols = []uint8{protoICMP, protoICMPv6}
+	default:
+		return captureFilter{}, fmt.Errorf("%w: unknown protocol %q", ErrInvalidCapture, o.Protocol)
+	}
+	if o.Port != 0 {
+		if len(f.protocols) == 0 {
+			f.protocols = []uint8{protoTCP, protoUDP}
+		} else if f.protocols[0] == protoICMP {
+			return captureFilter{}, fmt.Errorf("%w: icmp has no ports", ErrInvalidCapture)
+		}
+		f.port = o.Port
+	}
+	return f, nil
+}
+
+// match reports whether an Ethernet frame passes the filter. Non-IP frames
+// only pass an empty filter.
+func (f captureFilter) match(frame []byte) bool {
+	if len(f.protocols) == 0 {
+		return true
+	}
+	if len(frame) < 14 {
+		return false
+	}
+
+	var proto uint8
+	var l4 []byte
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case 0x0800:
+		ip := frame[14:]
+		if len(ip) < 20 {
+			return false
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		if len(ip) < ihl {
+			return false
+		}
+		proto, l4 = ip[9], ip[ihl:]
+	case 0x86dd:
+		ip := frame[14:]
+		if len(ip) < 40 {
+			return false
+		}
+		proto, l4 = ip[6], ip[40:]
+	default:
+		return false
+	}
+
+	found := false
+	for _, p := range f.protocols {
+		found = found || p == proto
+	}
+	if !found {
+		return false
+	}
+	if f.port == 0 {
+		return true
+	}
+	if len(l4) < 4 {
+		return false
+	}
+	return binary.BigEndian.Uint16(l4[0:2]) == f.port || binary.BigEndian.Uint16(l4[2:4]) == f.port
+}
+
+// pcapWriter writes the classic libpcap format with Ethernet link type
+type pcapWriter struct {
+	w io.Writer
+}
+
+func (p *pcapWriter) writeHeader(snapLen int) error {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(snapLen))
+	binary.LittleEndian.PutUint32(hdr[20:], 1) // LINKTYPE_ETHERNET
+	_, err := p.w.Write(hdr[:])
+	return err
+}
+
+// writePacket writes a record in a single Write, so writers that frame
+// each call, like a gRPC stream, send whole packets
+func (p *pcapWriter) writePacket(ts time.Time, data []byte, origLen int) error {
+	rec := make([]byte, 16+len(data))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(origLen))
+	copy(rec[16:], data)
+	_, err := p.w.Write(rec)
+	return err
+}
@@ -0,0 +1,141 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/perf"
+)
+
+// tcUnspec is TC_ACT_UNSPEC, with which tc_capture leaves every frame to
+// the filters after it
+const tcUnspec = 0xffffffff
+
+// TestCapture copies the frames the merged filter of a host veth's
+// captures selects to capture_events, and hands each capture those its
+// own filter does, cut to the longest snap length
+func TestCapture(t *testing.T) {
+	x := loadSourceCheck(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}, nil)
+	if !x.hasCapture() {
+		t.Fatal("router loaded without the capture")
+	}
+
+	web := &tapSource{
+		filter: captureFilter{protocols: []uint8{protoTCP, protoUDP}, port: 80},
+		frames: make(chan tapFrame, tapQueueSize),
+	}
+	dns := &tapSource{
+		filter: captureFilter{protocols: []uint8{protoUDP}, port: 53},
+		frames: make(chan tapFrame, tapQueueSize),
+	}
+	web.value, dns.value = web.filter.value(64), dns.filter.value(32)
+	merged := web.value.merge(dns.value)
+	if want := (captureFilterValue{SnapLen: 64, Protocols: captureTCP | captureUDP}); merged != want {
+		t.Fatalf("merged filter %+v, want %+v", merged, want)
+	}
+	if err := x.captureFilters.Put(uint32(testIfindex), merged); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := perf.NewReader(x.captureEvents, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.tap.sources = map[int][]*tapSource{testIfindex: {web, dns}}
+	done := make(chan struct{})
+	go x.tap.run(r, done)
+	defer func() {
+		r.Close()
+		<-done
+	}()
+
+	request := tcpSegment{
+		src:   netip.MustParseAddrPort("192.0.2.7:40000"),
+		dst:   netip.MustParseAddrPort("10.0.0.2:80"),
+		flags: tcpSYN,
+	}.frame()
+	reply := tcpSegment{
+		src:   netip.MustParseAddrPort("[fd99::2]:80"),
+		dst:   netip.MustParseAddrPort("[2001:db8::7]:40000"),
+		flags: tcpSYN | tcpACK,
+	}.frame()
+	other := tcpSegment{
+		src:   netip.MustParseAddrPort("192.0.2.7:40000"),
+		dst:   netip.MustParseAddrPort("10.0.0.2:443"),
+		flags: tcpSYN,
+	}.frame()
+	arp := append(make([]byte, 12), 0x08, 0x06)
+	arp = append(arp, make([]byte, 28)...)
+
+	prog := x.coll.Programs[captureProgram]
+	start := time.Now()
+	for _, frame := range [][]byte{request, other, arp, reply} {
+		ret, err := prog.Run(&ebpf.RunOptions{Data: frame})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret != tcUnspec {
+			t.Errorf("verdict %d, want %d", ret, uint32(tcUnspec))
+		}
+	}
+
+	for _, want := range [][]byte{request, reply} {
+		select {
+		case f := <-web.frames:
+			if !bytes.Equal(f.data, want[:min(len(want), 64)]) || f.origLen != len(want) {
+				t.Errorf("captured %d of %d bytes %x, want %x", len(f.data), f.origLen, f.data, want)
+			}
+			if f.time.Before(start.Add(-time.Millisecond)) || f.time.After(time.Now()) {
+				t.Errorf("captured at %v, want after %v", f.time, start)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("frame not captured")
+		}
+	}
+	select {
+	case f := <-web.frames:
+		t.Errorf("captured %x, which the filter doesn't select", f.data)
+	case f := <-dns.frames:
+		t.Errorf("captured %x for another capture", f.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Without protocols, every frame is captured
+	if err := x.captureFilters.Put(uint32(testIfindex), captureFilterValue{SnapLen: DefaultSnapLen}); err != nil {
+		t.Fatal(err)
+	}
+	all := &tapSource{frames: make(chan tapFrame, tapQueueSize)}
+	x.tap.sourcesMu.Lock()
+	x.tap.sources[testIfindex] = []*tapSource{all}
+	x.tap.sourcesMu.Unlock()
+	if _, err := prog.Run(&ebpf.RunOptions{Data: arp}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-all.frames:
+		if !bytes.Equal(f.data, arp) {
+			t.Errorf("captured %x, want %x", f.data, arp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame not captured")
+	}
+
+	// Frames of other interfaces aren't
+	if err := x.captureFilters.Delete(uint32(testIfindex)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prog.Run(&ebpf.RunOptions{Data: request}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-all.frames:
+		t.Errorf("captured %x off an interface not being captured", f.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
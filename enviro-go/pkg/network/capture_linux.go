@@ -0,0 +1,580 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf/perf"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// syncCapture routes the traffic to cn through the kernel while it is
+// captured, as redirected packets skip the host veth's filters, and so
+// does what spliced sockets send. Callers must hold nm.mu.
+func (nm *NetworkManager) syncCapture(cn *ContainerNetwork) error {
+	if nm.xdp != nil {
+		if err := nm.xdp.SetShaped(cn.addrs(), cn.kernelPath()); err != nil {
+			return err
+		}
+	}
+	return nm.syncAcceleration(cn)
+}
+
+// packetSocket is an AF_PACKET socket bound to one interface
+type packetSocket struct {
+	f  *os.File
+	rc syscall.RawConn
+	// lost accumulates PACKET_STATISTICS, which resets on every read
+	lost uint64
+}
+
+// openCapture reads the frames of cn that filter selects, up to snapLen
+// bytes of each. The router x copies them off the host veth with
+// tc_capture, as cn takes the kernel path while captured. Without the
+// router, a packet socket taps the host veth, and where the router can't
+// capture, the container side of the pair, as packets the router
+// redirects to the container skip the host veth's taps.
+func (nm *NetworkManager) openCapture(x *xdpProgram, cn *ContainerNetwork, filter captureFilter, snapLen int) (captureSource, error) {
+	if x == nil {
+		return openPacketSocket(cn.HostIfindex)
+	}
+	if x.hasCapture() && cn.HostIfindex != 0 && !cn.Rootless && !cn.Attachment.direct() {
+		return x.openTap(cn.HostIfindex, filter, snapLen)
+	}
+
+	h, err := containerHandle(cn)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Delete()
+	link, err := h.LinkByName(containerIfName)
+	if err != nil {
+		return nil, err
+	}
+
+	ns, err := netns.GetFromPath(cn.NetnsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %s: %w", cn.NetnsPath, err)
+	}
+	defer ns.Close()
+
+	// Sockets stay in the namespace they were created in
+	var sock *packetSocket
+	err = inNetns(ns, func() (err error) {
+		sock, err = openPacketSocket(link.Attrs().Index)
+		return err
+	})
+	if err != nil {
+		if sock != nil {
+			sock.Close()
+		}
+		return nil, fmt.Errorf("netns %s: %w", cn.NetnsPath, err)
+	}
+	return sock, nil
+}
+
+// inNetns runs fn on a thread in ns. The thread is locked by a goroutine
+// of its own, which exits with it still locked if it can't be moved back,
+// so the runtime terminates it rather than schedule other goroutines in ns.
+func inNetns(ns netns.NsHandle, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		orig, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- err
+			return
+		}
+		defer orig.Close()
+		if err := netns.Set(ns); err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("failed to enter network namespace: %w", err)
+			return
+		}
+		fnErr := fn()
+		if err := netns.Set(orig); err != nil {
+			errc <- errors.Join(fnErr, fmt.Errorf("failed to restore network namespace: %w", err))
+			return
+		}
+		runtime.UnlockOSThread()
+		errc <- fnErr
+	}()
+	return <-errc
+}
+
+func openPacketSocket(ifindex int) (*packetSocket, error) {
+	proto := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: ifindex}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind packet socket: %w", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "packet")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &packetSocket{f: f, rc: rc}, nil
+}
+
+// read implements captureSource
+func (s *packetSocket) read(ctx context.Context, buf []byte) (int, int, time.Time, error) {
+	stop := context.AfterFunc(ctx, func() {
+		s.f.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var n int
+	var readErr error
+	err := s.rc.Read(func(fd uintptr) bool {
+		// MSG_TRUNC returns the original length of longer packets
+		n, _, readErr = unix.Recvfrom(int(fd), buf, unix.MSG_TRUNC)
+		return !errors.Is(readErr, unix.EAGAIN)
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	return min(n, len(buf)), n, time.Now(), nil
+}
+
+// dropped implements captureSource
+func (s *packetSocket) dropped() uint64 {
+	s.rc.Control(func(fd uintptr) {
+		if st, err := unix.GetsockoptTpacketStats(int(fd), unix.SOL_PACKET, unix.PACKET_STATISTICS); err == nil {
+			s.lost += uint64(st.Drops)
+		}
+	})
+	return s.lost
+}
+
+// Close implements captureSource
+func (s *packetSocket) Close() error {
+	return s.f.Close()
+}
+
+// captureFilterValue mirrors struct capture_filter in
+// bpf/container_router.c
+type captureFilterValue struct {
+	SnapLen   uint32
+	Port      uint16
+	Protocols uint8
+	Pad       uint8
+}
+
+// Protocols of captureFilterValue, mirroring CAPTURE_*
+const (
+	captureTCP  = 1
+	captureUDP  = 2
+	captureICMP = 4
+)
+
+// captureRecord mirrors struct capture_event in bpf/container_router.c
+type captureRecord struct {
+	Timestamp uint64
+	Ifindex   uint32
+	Len       uint32
+	CapLen    uint32
+	Pad       uint32
+}
+
+// perfCaptureBuffer is the size of the per-CPU buffers of capture_events
+const perfCaptureBuffer = 1 << 20
+
+// tapQueueSize is how many frames a capture reading from the router may
+// fall behind by before the next are dropped
+const tapQueueSize = 1024
+
+// value returns the router's form of f, copying up to snapLen bytes of
+// each frame
+func (f captureFilter) value(snapLen int) captureFilterValue {
+	v := captureFilterValue{SnapLen: uint32(snapLen), Port: f.port}
+	for _, p := range f.protocols {
+		switch p {
+		case protoTCP:
+			v.Protocols |= captureTCP
+		case protoUDP:
+			v.Protocols |= captureUDP
+		case protoICMP, protoICMPv6:
+			v.Protocols |= captureICMP
+		}
+	}
+	return v
+}
+
+// merge returns the filter selecting what either v or o selects
+func (v captureFilterValue) merge(o captureFilterValue) captureFilterValue {
+	m := captureFilterValue{SnapLen: max(v.SnapLen, o.SnapLen)}
+	if v.Protocols != 0 && o.Protocols != 0 {
+		m.Protocols = v.Protocols | o.Protocols
+		if v.Port == o.Port {
+			m.Port = v.Port
+		}
+	}
+	return m
+}
+
+// hasCapture reports whether the router was loaded with tc_capture, which
+// needs TC support
+func (x *xdpProgram) hasCapture() bool {
+	return x.captureFilters != nil && x.captureEvents != nil && x.coll.Programs[captureProgram] != nil
+}
+
+// captureTap hands the frames tc_capture copies to capture_events to the
+// captures of their host veth, reading them while any runs. Its zero
+// value is ready to use.
+type captureTap struct {
+	// mu serializes opening and closing captures
+	mu     sync.Mutex
+	reader *perf.Reader
+	done   chan struct{}
+
+	// sourcesMu guards sources, the running captures by host veth
+	// ifindex, which the reader looks up
+	sourcesMu sync.RWMutex
+	sources   map[int][]*tapSource
+}
+
+// tapSource is a capture reading the frames of a host veth from the
+// router's captureTap
+type tapSource struct {
+	x       *xdpProgram
+	ifindex int
+	filter  captureFilter
+	value   captureFilterValue
+	frames  chan tapFrame
+	// missed counts the frames dropped as the capture fell behind, or
+	// the reader did while it ran
+	missed atomic.Uint64
+}
+
+// tapFrame is a frame copied by tc_capture
+type tapFrame struct {
+	data    []byte
+	origLen int
+	time    time.Time
+}
+
+// captureFilterOf is the filter of tc_capture on parent of the host veth
+// with index, before the source check on ingress and the pacing on egress
+// at the same priority: the kernel runs the filters of a priority newest
+// first.
+func captureFilterOf(index int, parent uint32) *netlink.BpfFilter {
+	return &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: index,
+			Parent:    parent,
+			Handle:    2,
+			Priority:  tcFilterPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Name:         captureProgram,
+		DirectAction: true,
+	}
+}
+
+// attachCapture adds the capture filters to the host veth index, ahead
+// of those there
+func (x *xdpProgram) attachCapture(index int) error {
+	if err := addClsact(index); err != nil {
+		return err
+	}
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filter := captureFilterOf(index, parent)
+		filter.Fd = x.coll.Programs[captureProgram].FD()
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("failed to add capture filter: %w", err)
+		}
+	}
+	return nil
+}
+
+// detachCapture removes the capture filters from the host veth index
+func detachCapture(index int) error {
+	var errs []error
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		err := deleteFilter(captureFilterOf(index, parent))
+		// The veth has no clsact qdisc
+		if !errors.Is(err, unix.EINVAL) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// openTap starts a capture of the frames of the host veth ifindex that
+// filter selects, up to snapLen bytes of each
+func (x *xdpProgram) openTap(ifindex int, filter captureFilter, snapLen int) (*tapSource, error) {
+	t := &x.tap
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.reader == nil {
+		r, err := perf.NewReader(x.captureEvents, perfCaptureBuffer)
+		if err != nil {
+			return nil, err
+		}
+		t.reader, t.done = r, make(chan struct{})
+		go t.run(r, t.done)
+	}
+	s := &tapSource{
+		x:       x,
+		ifindex: ifindex,
+		filter:  filter,
+		value:   filter.value(snapLen),
+		frames:  make(chan tapFrame, tapQueueSize),
+	}
+	t.sourcesMu.Lock()
+	if t.sources == nil {
+		t.sources = make(map[int][]*tapSource)
+	}
+	t.sources[ifindex] = append(t.sources[ifindex], s)
+	t.sourcesMu.Unlock()
+
+	if err := x.programTap(ifindex); err != nil {
+		x.removeTap(s)
+		return nil, err
+	}
+	return s, nil
+}
+
+// programTap sets the filter of the host veth ifindex to the captures of
+// it that run, attaching tc_capture there as the first one starts and
+// detaching it as the last one ends. Callers must hold x.tap.mu.
+func (x *xdpProgram) programTap(ifindex int) error {
+	t := &x.tap
+	t.sourcesMu.RLock()
+	sources := t.sources[ifindex]
+	var v captureFilterValue
+	for i, s := range sources {
+		if i == 0 {
+			v = s.value
+		} else {
+			v = v.merge(s.value)
+		}
+	}
+	t.sourcesMu.RUnlock()
+
+	if len(sources) == 0 {
+		return errors.Join(detachCapture(ifindex), ignoreNotExist(x.captureFilters.Delete(uint32(ifindex))))
+	}
+	if err := x.captureFilters.Put(uint32(ifindex), v); err != nil {
+		return err
+	}
+	if len(sources) > 1 {
+		return nil
+	}
+	if err := x.attachCapture(ifindex); err != nil {
+		return errors.Join(err, detachCapture(ifindex))
+	}
+	return nil
+}
+
+// removeTap ends s, closing the reader once no capture runs. Callers must
+// hold x.tap.mu.
+func (x *xdpProgram) removeTap(s *tapSource) error {
+	t := &x.tap
+	t.sourcesMu.Lock()
+	sources := t.sources[s.ifindex]
+	found := false
+	for i, o := range sources {
+		if o == s {
+			sources = append(sources[:i:i], sources[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if len(sources) == 0 {
+		delete(t.sources, s.ifindex)
+	} else {
+		t.sources[s.ifindex] = sources
+	}
+	running := len(t.sources)
+	t.sourcesMu.Unlock()
+	if !found {
+		return nil
+	}
+
+	err := x.programTap(s.ifindex)
+	if running == 0 && t.reader != nil {
+		t.reader.Close()
+		<-t.done
+		t.reader = nil
+	}
+	return err
+}
+
+// keepTapFirst moves the capture filters of the host veth ifindex back
+// ahead of a filter added there since they were, if it is being captured
+func (x *xdpProgram) keepTapFirst(ifindex int) error {
+	t := &x.tap
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sourcesMu.RLock()
+	captured := len(t.sources[ifindex]) > 0
+	t.sourcesMu.RUnlock()
+	if !captured {
+		return nil
+	}
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Index: ifindex}}
+		filters, err := netlink.FilterList(link, parent)
+		if err != nil {
+			return err
+		}
+		if len(filters) > 0 && filters[0].Attrs().Handle != captureFilterOf(ifindex, parent).Handle {
+			if err := detachCapture(ifindex); err != nil {
+				return err
+			}
+			return x.attachCapture(ifindex)
+		}
+	}
+	return nil
+}
+
+// syncTaps points the capture filters at the program in use, e.g. after
+// an upgrade, which carries capture_events and capture_filters over. A
+// program that can't capture ends the captures.
+func (x *xdpProgram) syncTaps() error {
+	if !x.hasCapture() {
+		x.closeTaps()
+		return nil
+	}
+	t := &x.tap
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sourcesMu.RLock()
+	defer t.sourcesMu.RUnlock()
+	var errs []error
+	for ifindex := range t.sources {
+		for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+			l := &tcLink{filter: captureFilterOf(ifindex, parent)}
+			if err := l.Update(x.coll.Programs[captureProgram]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeTaps ends every capture, as the router closes
+func (x *xdpProgram) closeTaps() {
+	t := &x.tap
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reader == nil {
+		return
+	}
+	t.reader.Close()
+	<-t.done
+	t.reader = nil
+	t.sourcesMu.Lock()
+	defer t.sourcesMu.Unlock()
+	for ifindex, sources := range t.sources {
+		detachCapture(ifindex)
+		for _, s := range sources {
+			close(s.frames)
+		}
+	}
+	t.sources = nil
+}
+
+// run hands the frames r reads to the captures of their host veth until
+// r is closed, then closes done
+func (t *captureTap) run(r *perf.Reader, done chan struct{}) {
+	defer close(done)
+	size := binary.Size(captureRecord{})
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		if rec.LostSamples > 0 {
+			// Lost frames can't be told apart, so every capture
+			// counts them
+			t.sourcesMu.RLock()
+			for _, sources := range t.sources {
+				for _, s := range sources {
+					s.missed.Add(rec.LostSamples)
+				}
+			}
+			t.sourcesMu.RUnlock()
+			continue
+		}
+		if len(rec.RawSample) < size {
+			continue
+		}
+		e := decodeAs[captureRecord](rec.RawSample)
+		data := rec.RawSample[size:]
+		data = data[:min(len(data), int(e.CapLen))]
+		frame := tapFrame{data: data, origLen: int(e.Len), time: time.Now()}
+		if now := monotonicNow(); e.Timestamp < now {
+			frame.time = frame.time.Add(-time.Duration(now - e.Timestamp))
+		}
+
+		t.sourcesMu.RLock()
+		for _, s := range t.sources[int(e.Ifindex)] {
+			if !s.filter.match(data) {
+				continue
+			}
+			select {
+			case s.frames <- frame:
+			default:
+				s.missed.Add(1)
+			}
+		}
+		t.sourcesMu.RUnlock()
+	}
+}
+
+// read implements captureSource
+func (s *tapSource) read(ctx context.Context, buf []byte) (int, int, time.Time, error) {
+	select {
+	case f, ok := <-s.frames:
+		if !ok {
+			return 0, 0, time.Time{}, errors.New("router closed")
+		}
+		return copy(buf, f.data), f.origLen, f.time, nil
+	case <-ctx.Done():
+		return 0, 0, time.Time{}, ctx.Err()
+	}
+}
+
+// dropped implements captureSource
+func (s *tapSource) dropped() uint64 {
+	return s.missed.Load()
+}
+
+// Close implements captureSource
+func (s *tapSource) Close() error {
+	s.x.tap.mu.Lock()
+	defer s.x.tap.mu.Unlock()
+	return s.x.removeTap(s)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,196 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// cgroupProgram is a program of the router object attached to the cgroup
+// of each container, at the hook attach
+type cgroupProgram struct {
+	name   string
+	attach ebpf.AttachType
+}
+
+// cgroupPrograms returns the programs to attach to the cgroups of
+// containers, those of the features the router in use was loaded with
+func (x *xdpProgram) cgroupPrograms() []cgroupProgram {
+	var progs []cgroupProgram
+	if x.hasConnectPolicy() {
+		progs = append(progs, connectPrograms...)
+	}
+	if x.hasSocketAcceleration() {
+		progs = append(progs, accelProgram)
+	}
+	if x.hasProxyRedirect() {
+		progs = append(progs, proxyPrograms...)
+	}
+	return progs
+}
+
+// cgroupID returns the ID of the cgroup v2 directory path, its inode
+func cgroupID(path string) (uint64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.IsDir() {
+		return 0, fmt.Errorf("%s is not a cgroup directory", path)
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino, nil
+}
+
+// cgroupAttachment is the programs attached to the cgroup of a container
+type cgroupAttachment struct {
+	path string
+	// cgroup is the ID the container's entry in connect_sources is keyed
+	// by, and source that entry
+	cgroup uint64
+	source connectSource
+	// links are by program name
+	links map[string]link.Link
+}
+
+// Close detaches the programs. A cgroup removed with the container's
+// processes detached them by itself.
+func (a *cgroupAttachment) Close() error {
+	var errs []error
+	for _, l := range a.links {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// attachCgroup attaches the cgroup programs to the cgroup at path, for the
+// container behind ifindex with addrs
+func (x *xdpProgram) attachCgroup(path string, ifindex int, addrs []netip.Addr) (*cgroupAttachment, error) {
+	id, err := cgroupID(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &cgroupAttachment{path: path, cgroup: id, source: newConnectSource(ifindex, addrs), links: make(map[string]link.Link)}
+	if err := x.updateCgroup(a); err != nil {
+		x.detachCgroup(a)
+		return nil, err
+	}
+	return a, nil
+}
+
+// updateCgroup points the links of a at the programs in use, e.g. after an
+// upgrade, attaching those it lacks and detaching those the router in use
+// doesn't have
+func (x *xdpProgram) updateCgroup(a *cgroupAttachment) error {
+	// Connect-time policy and proxy redirection both find the container
+	// by its cgroup
+	if x.connectSources != nil {
+		if err := x.connectSources.Put(a.cgroup, a.source); err != nil {
+			return fmt.Errorf("failed to program cgroup: %w", err)
+		}
+	}
+	want := make(map[string]bool)
+	for _, p := range x.cgroupPrograms() {
+		want[p.name] = true
+		prog := x.coll.Programs[p.name]
+		if l, ok := a.links[p.name]; ok {
+			if err := l.Update(prog); err != nil {
+				return fmt.Errorf("failed to update %s: %w", p.name, err)
+			}
+			continue
+		}
+		l, err := link.AttachCgroup(link.CgroupOptions{Path: a.path, Attach: p.attach, Program: prog})
+		if err != nil {
+			return fmt.Errorf("failed to attach %s: %w", p.name, err)
+		}
+		a.links[p.name] = l
+	}
+	var errs []error
+	for name, l := range a.links {
+		if !want[name] {
+			errs = append(errs, l.Close())
+			delete(a.links, name)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// detachCgroup detaches the programs of a and removes its entry
+func (x *xdpProgram) detachCgroup(a *cgroupAttachment) error {
+	err := a.Close()
+	if x.connectSources != nil {
+		err = errors.Join(err, ignoreNotExist(x.connectSources.Delete(a.cgroup)))
+	}
+	return err
+}
+
+// attachCgroup attaches the cgroup programs to the cgroup of cn, when it
+// has one and any are loaded. Callers must hold nm.mu.
+func (nm *NetworkManager) attachCgroup(cn *ContainerNetwork) error {
+	if nm.xdp == nil || len(nm.xdp.cgroupPrograms()) == 0 || cn.CgroupPath == "" || nm.cgroups[cn.ContainerID] != nil {
+		return nil
+	}
+	a, err := nm.xdp.attachCgroup(cn.CgroupPath, cn.HostIfindex, cn.addrs())
+	if err != nil {
+		return fmt.Errorf("failed to attach programs to cgroup: %w", err)
+	}
+	if nm.cgroups == nil {
+		nm.cgroups = make(map[string]*cgroupAttachment)
+	}
+	nm.cgroups[cn.ContainerID] = a
+	return nil
+}
+
+// detachCgroup detaches the cgroup programs from the cgroup of the
+// container containerID. Callers must hold nm.mu.
+func (nm *NetworkManager) detachCgroup(containerID string) error {
+	a, ok := nm.cgroups[containerID]
+	if !ok {
+		return nil
+	}
+	delete(nm.cgroups, containerID)
+	return nm.xdp.detachCgroup(a)
+}
+
+// syncCgroups points the attachments of every container at the programs
+// in use, e.g. after an upgrade, attaching or detaching them as the router
+// in use has them or not. Callers must hold nm.mu.
+func (nm *NetworkManager) syncCgroups() error {
+	nm.caps.ConnectPolicy = nm.xdp.hasConnectPolicy()
+	nm.caps.SocketAcceleration = nm.xdp.hasSocketAcceleration()
+	progs := nm.xdp.cgroupPrograms()
+	var errs []error
+	for id, cn := range nm.containers {
+		a, ok := nm.cgroups[id]
+		var err error
+		switch {
+		case !ok:
+			err = nm.attachCgroup(cn)
+		case len(progs) == 0:
+			err = nm.detachCgroup(id)
+		default:
+			err = nm.xdp.updateCgroup(a)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeCgroups detaches the cgroup programs from the cgroups of all
+// containers. Callers must hold nm.mu.
+func (nm *NetworkManager) closeCgroups() {
+	for id, a := range nm.cgroups {
+		if err := a.Close(); err != nil {
+			nm.log.Warn("Failed to detach cgroup programs", "container_id", id, "error", err)
+		}
+	}
+	nm.cgroups = nil
+}
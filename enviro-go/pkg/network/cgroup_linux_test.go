@@ -0,0 +1,26 @@
+//go:build linux
+
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCgroupID(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := cgroupID(dir); err != nil || id == 0 {
+		t.Errorf("cgroupID(dir) = %d, %v, want the inode", id, err)
+	}
+	if _, err := cgroupID(file); err == nil {
+		t.Error("cgroupID(file) succeeded, want an error")
+	}
+	if _, err := cgroupID(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("cgroupID(missing) = %v, want not exist", err)
+	}
+}
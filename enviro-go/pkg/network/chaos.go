@@ -0,0 +1,118 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidFault is returned for faults that can't be injected
+var ErrInvalidFault = errors.New("network: invalid fault")
+
+// MaxFaultDelay bounds the delay of faults, as fq or netem hold back
+// every packet of the container meanwhile
+const MaxFaultDelay = 10 * time.Second
+
+// ContainerFault degrades the traffic to a container, for testing how its
+// workload copes, e.g. in game days. The XDP router drops packets when it
+// is attached, and delays them where the kernel has the fq qdisc, which
+// holds them on the host veth; anything else is done by a netem qdisc
+// there. Traffic to the container passes through the kernel stack for
+// either. Faults aren't persisted, so a restart clears them.
+type ContainerFault struct {
+	// DropPercent of the packets are dropped at random, reported as drops
+	// of reason DropFault by the XDP router
+	DropPercent float64 `json:"drop_percent,omitempty"`
+	// Delay holds back each packet, give or take Jitter
+	Delay  time.Duration `json:"delay,omitempty"`
+	Jitter time.Duration `json:"jitter,omitempty"`
+	// ReorderPercent of the packets skip the Delay, overtaking those held
+	// back. Requires Delay.
+	ReorderPercent float64 `json:"reorder_percent,omitempty"`
+}
+
+// Validate checks the percentages and durations of f
+func (f ContainerFault) Validate() error {
+	for _, p := range []struct {
+		name  string
+		value float64
+	}{{"drop", f.DropPercent}, {"reorder", f.ReorderPercent}} {
+		if p.value < 0 || p.value > 100 {
+			return fmt.Errorf("%w: %s percentage %v is not between 0 and 100", ErrInvalidFault, p.name, p.value)
+		}
+	}
+	switch {
+	case f.Delay < 0 || f.Jitter < 0:
+		return fmt.Errorf("%w: delay and jitter must not be negative", ErrInvalidFault)
+	case f.Delay > MaxFaultDelay:
+		return fmt.Errorf("%w: delay %s exceeds %s", ErrInvalidFault, f.Delay, MaxFaultDelay)
+	case f.Jitter > f.Delay:
+		return fmt.Errorf("%w: jitter %s exceeds the delay", ErrInvalidFault, f.Jitter)
+	case f.ReorderPercent > 0 && f.Delay == 0:
+		return fmt.Errorf("%w: reordering requires a delay", ErrInvalidFault)
+	case f == (ContainerFault{}):
+		return fmt.Errorf("%w: fault has no effect", ErrInvalidFault)
+	}
+	return nil
+}
+
+// SetContainerFault injects f into the traffic to containerID, replacing
+// the fault injected before, if any
+func (nm *NetworkManager) SetContainerFault(containerID string, f ContainerFault) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	if err := nm.checkPrivileged("fault injection"); err != nil {
+		return err
+	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	if err := cn.checkAttachment("fault injection"); err != nil {
+		return err
+	}
+	if err := nm.applyFault(cn, &f); err != nil {
+		return fmt.Errorf("failed to inject fault into %s: %w", containerID, err)
+	}
+	nm.log.Warn("Injected fault into container traffic", "container_id", containerID,
+		"drop_percent", f.DropPercent, "delay", f.Delay, "jitter", f.Jitter, "reorder_percent", f.ReorderPercent)
+	return nil
+}
+
+// ClearContainerFault stops injecting a fault into the traffic to
+// containerID. Containers without a fault are left alone.
+func (nm *NetworkManager) ClearContainerFault(containerID string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	if cn.fault == nil {
+		return nil
+	}
+	if err := nm.applyFault(cn, nil); err != nil {
+		return fmt.Errorf("failed to clear fault of %s: %w", containerID, err)
+	}
+	nm.log.Info("Cleared fault of container traffic", "container_id", containerID)
+	return nil
+}
+
+// ContainerFaults returns the injected faults by container ID
+func (nm *NetworkManager) ContainerFaults() map[string]ContainerFault {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	faults := make(map[string]ContainerFault)
+	for id, cn := range nm.containers {
+		if cn.fault != nil {
+			faults[id] = *cn.fault
+		}
+	}
+	return faults
+}
@@ -0,0 +1,220 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// faultHandle is the handle of the netem qdisc applying a fault on a host
+// veth: its root qdisc, or the child of the tbf of a bandwidth limit
+var faultHandle = netlink.MakeHandle(0xfa, 0)
+
+// applyFault replaces the fault of cn with f, clearing it when f is nil.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) applyFault(cn *ContainerNetwork, f *ContainerFault) error {
+	xdpDrops := nm.xdp != nil && nm.xdp.hasFaults()
+	delayed, err := nm.delayFault(cn, f)
+	if err != nil {
+		return fmt.Errorf("failed to delay traffic to the container: %w", err)
+	}
+	qdisc := f != nil && (f.Delay > 0 && !delayed || f.DropPercent > 0 && !xdpDrops)
+
+	link, err := netlink.LinkByName(cn.HostInterface)
+	if err != nil {
+		return err
+	}
+	hadQdisc := cn.faultQdisc
+	if qdisc {
+		// The netem qdisc hangs below tbf, so the traffic can't stay paced
+		if cn.pacedIngress {
+			cn.faultQdisc = true
+			if err := nm.limitIngress(cn, cn.IngressBps); err != nil {
+				cn.faultQdisc = hadQdisc
+				return fmt.Errorf("failed to shape traffic to the container: %w", err)
+			}
+		}
+		if err := setFaultQdisc(link, *f, !xdpDrops, cn.IngressBps > 0); err != nil {
+			return fmt.Errorf("failed to add netem qdisc: %w", err)
+		}
+	} else if cn.faultQdisc {
+		if err := delFaultQdisc(link, cn.IngressBps > 0); err != nil {
+			return fmt.Errorf("failed to remove netem qdisc: %w", err)
+		}
+	}
+	if xdpDrops {
+		var drop float64
+		if f != nil {
+			drop = f.DropPercent
+		}
+		if err := nm.xdp.SetFaultDrops(cn.HostIfindex, drop); err != nil {
+			return err
+		}
+	}
+	cn.fault, cn.faultQdisc, cn.faultDelayed = f, qdisc, delayed
+	// Without it, the router may pace the traffic again
+	if hadQdisc && !qdisc && cn.IngressBps > 0 && nm.paces() {
+		if err := nm.limitIngress(cn, cn.IngressBps); err != nil {
+			return fmt.Errorf("failed to shape traffic to the container: %w", err)
+		}
+	}
+
+	// Redirected packets skip the qdiscs and filters, so delayed ones take
+	// the stack, as does what spliced sockets send
+	if nm.xdp != nil {
+		if err := nm.xdp.SetShaped(cn.addrs(), cn.kernelPath()); err != nil {
+			return err
+		}
+	}
+	return nm.syncAcceleration(cn)
+}
+
+// delayFault has the router delay the traffic to cn as f does, reporting
+// whether it does, or stop delaying it when f has no delay. It does so as
+// it paces the traffic, behind the same fq qdisc and filter, which stay
+// while either needs them. Without fq, a netem qdisc delays the traffic
+// instead. Callers must hold nm.mu.
+func (nm *NetworkManager) delayFault(cn *ContainerNetwork, f *ContainerFault) (bool, error) {
+	if nm.xdp == nil || !nm.xdp.hasFaultDelays() {
+		return false, nil
+	}
+	h := &netlink.Handle{}
+	if f != nil && f.Delay > 0 {
+		link, err := h.LinkByName(cn.HostInterface)
+		if err != nil {
+			return false, err
+		}
+		delayed, err := nm.xdp.attachPacing(h, link.Attrs().Index, paceIngressProgram)
+		if err == nil && delayed {
+			err = nm.xdp.SetFaultDelay(cn.HostIfindex, f)
+		}
+		if err != nil || !delayed {
+			return false, err
+		}
+		return true, nm.xdp.keepTapFirst(cn.HostIfindex)
+	}
+	if err := nm.xdp.SetFaultDelay(cn.HostIfindex, nil); err != nil {
+		return false, err
+	}
+	if cn.faultDelayed && !cn.pacedIngress {
+		return false, unpaceLink(h, cn.HostInterface)
+	}
+	return false, nil
+}
+
+// syncFaults applies the fault of every container anew, e.g. after an
+// upgrade of the router, whose filters delaying containers still run the
+// old program. Callers must hold nm.mu.
+func (nm *NetworkManager) syncFaults() error {
+	var errs []error
+	for id, cn := range nm.containers {
+		if cn.fault == nil {
+			continue
+		}
+		if err := nm.applyFault(cn, cn.fault); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeStaleFaultDelay stops the router delaying the traffic to cn for
+// a fault injected before a restart, which forgot it, unless its bandwidth
+// limit still needs the pacing. Callers must hold nm.mu.
+func (nm *NetworkManager) removeStaleFaultDelay(cn *ContainerNetwork) error {
+	if nm.xdp == nil || !nm.xdp.hasFaultDelays() {
+		return nil
+	}
+	if err := nm.xdp.SetFaultDelay(cn.HostIfindex, nil); err != nil {
+		return err
+	}
+	if cn.IngressBps > 0 {
+		return nil
+	}
+	return unpaceLink(&netlink.Handle{}, cn.HostInterface)
+}
+
+// faultParent returns where the netem qdisc of a fault hangs: below the
+// tbf of a bandwidth limit, so that both apply, or at the root
+func faultParent(shaped bool) uint32 {
+	if shaped {
+		return netlink.MakeHandle(1, 1)
+	}
+	return netlink.HANDLE_ROOT
+}
+
+// setFaultQdisc replaces the netem qdisc applying f to the traffic leaving
+// link. It drops packets too when loss is set.
+func setFaultQdisc(link netlink.Link, f ContainerFault, loss, shaped bool) error {
+	attrs := netem(f, loss)
+	return netlink.QdiscReplace(netlink.NewNetem(netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    faultHandle,
+		Parent:    faultParent(shaped),
+	}, attrs))
+}
+
+// netem returns the netem parameters of f
+func netem(f ContainerFault, loss bool) netlink.NetemQdiscAttrs {
+	attrs := netlink.NetemQdiscAttrs{
+		Latency:     uint32(f.Delay.Microseconds()),
+		Jitter:      uint32(f.Jitter.Microseconds()),
+		ReorderProb: float32(f.ReorderPercent),
+	}
+	if loss {
+		attrs.Loss = float32(f.DropPercent)
+	}
+	return attrs
+}
+
+// delFaultQdisc removes the netem qdisc of a fault from link
+func delFaultQdisc(link netlink.Link, shaped bool) error {
+	err := netlink.QdiscDel(&netlink.Netem{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    faultHandle,
+		Parent:    faultParent(shaped),
+	}})
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EINVAL) {
+		return nil
+	}
+	return err
+}
+
+// reapplyFaultQdisc adds the netem qdisc of cn's fault back after its
+// bandwidth limit changed, which replaces or removes the qdisc it hung
+// from. Callers must hold nm.mu.
+func (nm *NetworkManager) reapplyFaultQdisc(cn *ContainerNetwork, shaped bool) error {
+	if !cn.faultQdisc {
+		return nil
+	}
+	link, err := netlink.LinkByName(cn.HostInterface)
+	if err != nil {
+		return err
+	}
+	xdpDrops := nm.xdp != nil && nm.xdp.hasFaults()
+	if err := setFaultQdisc(link, *cn.fault, !xdpDrops, shaped); err != nil {
+		return fmt.Errorf("failed to add netem qdisc back: %w", err)
+	}
+	return nil
+}
+
+// removeStaleFault removes the netem qdisc of a fault injected before a
+// restart, which forgot it, from link
+func removeStaleFault(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Handle == faultHandle {
+			if err := netlink.QdiscDel(q); err != nil && !errors.Is(err, unix.ENOENT) {
+				return err
+			}
+		}
+	}
+	return nil
+}
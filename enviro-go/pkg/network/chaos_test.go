@@ -0,0 +1,42 @@
+package network
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContainerFaultValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault ContainerFault
+		// wantErr is part of the error, none if empty
+		wantErr string
+	}{
+		{name: "drop", fault: ContainerFault{DropPercent: 100}},
+		{name: "delay", fault: ContainerFault{Delay: time.Second, Jitter: time.Second, ReorderPercent: 25}},
+		{name: "no effect", wantErr: "fault has no effect"},
+		{name: "drop percentage", fault: ContainerFault{DropPercent: 100.5}, wantErr: "drop percentage 100.5"},
+		{name: "reorder percentage", fault: ContainerFault{Delay: time.Second, ReorderPercent: -1}, wantErr: "reorder percentage -1"},
+		{name: "negative delay", fault: ContainerFault{Delay: -time.Second}, wantErr: "must not be negative"},
+		{name: "long delay", fault: ContainerFault{Delay: MaxFaultDelay + time.Second}, wantErr: "exceeds 10s"},
+		{name: "jitter", fault: ContainerFault{Delay: time.Millisecond, Jitter: time.Second}, wantErr: "jitter 1s exceeds the delay"},
+		{name: "reordering without a delay", fault: ContainerFault{DropPercent: 1, ReorderPercent: 1},
+			wantErr: "reordering requires a delay"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fault.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want no error", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidFault) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want %v with %q", err, ErrInvalidFault, tt.wantErr)
+			}
+		})
+	}
+}
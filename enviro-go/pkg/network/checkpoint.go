@@ -0,0 +1,230 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+)
+
+// checkpointVersion is bumped on incompatible changes to NetworkCheckpoint
+const checkpointVersion = 1
+
+// NetworkCheckpoint is the network of a container as CheckpointNetwork
+// captures it, for moving the container with CRIU: what
+// ExportNetworkState captures, and what lives in the kernel besides
+type NetworkCheckpoint struct {
+	Version int `json:"version"`
+	// State holds the container's addresses, reservation, policies,
+	// services and the flows the XDP router tracks
+	State NetworkState `json:"state"`
+	// Ports are the host ports published to the container
+	Ports []PortForward `json:"ports,omitempty"`
+	// Routes are those inside the container's namespace, besides the
+	// ones of its addresses
+	Routes []ContainerRoute `json:"routes,omitempty"`
+	// Flows are the established flows of the container in the kernel's
+	// connection tracking table
+	Flows []KernelFlow `json:"flows,omitempty"`
+}
+
+// ContainerRoute is a route inside a container's network namespace
+type ContainerRoute struct {
+	Dst netip.Prefix `json:"dst"`
+	// Gateway is unset for routes to directly reachable destinations
+	Gateway netip.Addr `json:"gateway,omitempty"`
+}
+
+func (r ContainerRoute) String() string {
+	if r.Gateway.IsValid() {
+		return fmt.Sprintf("route %s via %s", r.Dst, r.Gateway)
+	}
+	return "route " + r.Dst.String()
+}
+
+// KernelFlow is a flow the kernel's connection tracking table tracks
+type KernelFlow struct {
+	// Protocol is "tcp" or "udp"
+	Protocol string `json:"protocol"`
+	// Original is the flow as its first packet was sent, and Reply as
+	// answers come back: the two differ where NAT translated them, e.g. for
+	// published ports
+	Original FlowTuple `json:"original"`
+	Reply    FlowTuple `json:"reply"`
+	// Timeout is how many seconds the kernel keeps the flow without
+	// packets
+	Timeout uint32 `json:"timeout"`
+	Mark    uint32 `json:"mark,omitempty"`
+}
+
+// FlowTuple is a direction of a KernelFlow
+type FlowTuple struct {
+	Src netip.AddrPort `json:"src"`
+	Dst netip.AddrPort `json:"dst"`
+}
+
+func (f KernelFlow) String() string {
+	return fmt.Sprintf("flow %s %s -> %s", f.Protocol, f.Original.Src, f.Original.Dst)
+}
+
+// RestoreReport tells how RestoreNetwork restored the flows of a
+// container, which it does best-effort
+type RestoreReport struct {
+	// Flows counts the flows tracked again, by the XDP router and the
+	// kernel
+	Flows int `json:"flows"`
+	// Failures are the flows that couldn't be restored, with why
+	Failures []RestoreFailure `json:"failures,omitempty"`
+}
+
+// RestoreFailure is a part of a checkpoint RestoreNetwork couldn't restore
+type RestoreFailure struct {
+	// What names the part, e.g. "flow tcp 10.0.0.1:40000 -> 10.88.0.2:80"
+	What  string `json:"what"`
+	Error string `json:"error"`
+}
+
+// CheckpointNetwork captures the network of containerID for
+// RestoreNetwork, on this node or another, as a versioned JSON blob. Run
+// it once the container is frozen, so its flows don't move on.
+//
+// The container's addresses stay reserved for it until RestoreNetwork takes
+// them back: deleting its network no longer returns them to the pools, nor
+// to an external IPAM backend shared by the cluster, so no other
+// container gets them during the migration. Once it is restored on
+// another node, ReleaseReservation drops the reservation here; the
+// external backend keeps the addresses for the restored network.
+func (nm *NetworkManager) CheckpointNetwork(containerID string) ([]byte, error) {
+	state, err := nm.ExportNetworkState(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	cp := NetworkCheckpoint{
+		Version: checkpointVersion,
+		State:   state,
+		Ports:   append([]PortForward(nil), cn.Ports...),
+	}
+	if !cn.Rootless {
+		if cp.Routes, err = readRoutes(cn); err != nil {
+			return nil, fmt.Errorf("failed to read routes: %w", err)
+		}
+		if cp.Flows, err = readKernelFlows(cn.addrs()); err != nil {
+			return nil, fmt.Errorf("failed to read kernel flows: %w", err)
+		}
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return nil, err
+	}
+
+	res := Reservation{ContainerID: containerID, IPv4: cn.IPv4, IPv6: cn.IPv6, MAC: cn.MAC, Migrating: true}
+	if cn.Rootless {
+		res.IPv4, res.IPv6 = "", ""
+	}
+	if err := nm.reserve(res); err != nil {
+		return nil, fmt.Errorf("failed to reserve addresses: %w", err)
+	}
+	if err := nm.saveState(); err != nil {
+		return nil, err
+	}
+	nm.log.Info("Checkpointed container network", "container_id", containerID,
+		"ports", len(cp.Ports), "routes", len(cp.Routes), "flows", len(cp.Flows)+len(state.Connections))
+	return data, nil
+}
+
+// RestoreNetwork creates the network of containerID in the namespace at
+// netnsPath as checkpoint, from CheckpointNetwork, describes it: as
+// ImportNetworkState does, then publishing its ports and adding its routes
+// again, which must succeed. Its flows are restored best-effort, as the
+// report tells. The network is deleted again when any other step fails.
+func (nm *NetworkManager) RestoreNetwork(ctx context.Context, containerID string, checkpoint []byte, netnsPath string) (*ContainerNetwork, RestoreReport, error) {
+	var cp NetworkCheckpoint
+	if err := json.Unmarshal(checkpoint, &cp); err != nil {
+		return nil, RestoreReport{}, fmt.Errorf("%w: %v", ErrInvalidNetworkState, err)
+	}
+	if cp.Version != checkpointVersion {
+		return nil, RestoreReport{}, fmt.Errorf("%w: unsupported checkpoint version %d", ErrInvalidNetworkState, cp.Version)
+	}
+	for _, p := range cp.Ports {
+		if p.ContainerID != containerID {
+			return nil, RestoreReport{}, fmt.Errorf("%w: port %d is published to %s", ErrInvalidNetworkState, p.HostPort, p.ContainerID)
+		}
+	}
+
+	// The flows are restored once everything else is
+	state := cp.State
+	conns := state.Connections
+	state.Connections = nil
+	if _, err := nm.ImportNetworkState(ctx, ContainerNetworkSpec{ContainerID: containerID, NetnsPath: netnsPath}, state); err != nil {
+		return nil, RestoreReport{}, err
+	}
+	logger := nm.logger(ctx).With("container_id", containerID)
+	if err := nm.restoreKernelState(containerID, cp); err != nil {
+		logger.Warn("Deleting network of failed restore", "error", err)
+		if err := nm.DeleteContainerNetwork(ctx, containerID); err != nil {
+			logger.Error("Failed to delete network of failed restore", "error", err)
+		}
+		return nil, RestoreReport{}, fmt.Errorf("failed to restore network of %s: %w", containerID, err)
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return nil, RestoreReport{}, fmt.Errorf("%w: %s was deleted during the restore", ErrContainerNotFound, containerID)
+	}
+	var report RestoreReport
+	if n, err := nm.importConnections(cn, conns); err != nil {
+		report.Failures = append(report.Failures, RestoreFailure{
+			What:  fmt.Sprintf("%d of %d flows of the XDP router", len(conns)-n, len(conns)),
+			Error: err.Error(),
+		})
+		report.Flows += n
+	} else {
+		report.Flows += len(conns)
+	}
+	if !cn.Rootless {
+		for _, f := range cp.Flows {
+			if err := restoreKernelFlow(f); err != nil {
+				report.Failures = append(report.Failures, RestoreFailure{What: f.String(), Error: err.Error()})
+				continue
+			}
+			report.Flows++
+		}
+	}
+	logger.Info("Restored container network", "ports", len(cp.Ports), "routes", len(cp.Routes),
+		"flows", report.Flows, "failed", len(report.Failures))
+	return cn.clone(), report, nil
+}
+
+// restoreKernelState publishes the ports of cp and adds its routes to the
+// network of containerID, just imported
+func (nm *NetworkManager) restoreKernelState(containerID string, cp NetworkCheckpoint) error {
+	for _, p := range cp.Ports {
+		if _, err := nm.ExposePort(containerID, p.HostPort, p.ContainerPort, p.Protocol); err != nil {
+			return fmt.Errorf("failed to publish port %s/%d: %w", p.Protocol, p.HostPort, err)
+		}
+	}
+	if len(cp.Routes) == 0 {
+		return nil
+	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	for _, r := range cp.Routes {
+		if err := addRoute(cn, r); err != nil {
+			return fmt.Errorf("failed to add %s: %w", r, err)
+		}
+	}
+	return nil
+}
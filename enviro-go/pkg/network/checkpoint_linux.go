@@ -0,0 +1,175 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// readRoutes returns the routes of the main table inside the namespace of
+// cn, leaving out those the kernel adds for its addresses
+func readRoutes(cn *ContainerNetwork) ([]ContainerRoute, error) {
+	h, err := containerHandle(cn)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+	link, err := h.LinkByName(containerIfName)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := h.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	var out []ContainerRoute
+	for _, r := range routes {
+		if r.Protocol == unix.RTPROT_KERNEL || (r.Table != 0 && r.Table != unix.RT_TABLE_MAIN) {
+			continue
+		}
+		route := ContainerRoute{Dst: netip.PrefixFrom(netip.IPv4Unspecified(), 0)}
+		if r.Family == unix.AF_INET6 {
+			route.Dst = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		}
+		if r.Dst != nil {
+			addr, _ := netip.AddrFromSlice(r.Dst.IP)
+			ones, _ := r.Dst.Mask.Size()
+			route.Dst = netip.PrefixFrom(addr.Unmap(), ones)
+		}
+		if r.Gw != nil {
+			gw, _ := netip.AddrFromSlice(r.Gw)
+			route.Gateway = gw.Unmap()
+		}
+		out = append(out, route)
+	}
+	return out, nil
+}
+
+// addRoute adds r to the interface inside the namespace of cn, unless it
+// has it already, as creating the network added the default routes
+func addRoute(cn *ContainerNetwork, r ContainerRoute) error {
+	h, err := containerHandle(cn)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	link, err := h.LinkByName(containerIfName)
+	if err != nil {
+		return err
+	}
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: r.Dst.Addr().AsSlice(), Mask: net.CIDRMask(r.Dst.Bits(), r.Dst.Addr().BitLen())},
+	}
+	if r.Gateway.IsValid() {
+		route.Gw = r.Gateway.AsSlice()
+	}
+	if err := h.RouteAdd(route); err != nil && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	return nil
+}
+
+// readKernelFlows returns the flows from or to addrs in the kernel's
+// connection tracking table, of TCP those established
+func readKernelFlows(addrs []netip.Addr) ([]KernelFlow, error) {
+	var out []KernelFlow
+	for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+		var ips []net.IP
+		for _, addr := range addrs {
+			if addr.Is4() == (family == unix.AF_INET) {
+				ips = append(ips, addr.AsSlice())
+			}
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, flow := range flows {
+			if !flowOf(flow, ips) {
+				continue
+			}
+			f := KernelFlow{
+				Original: flowTuple(flow.Forward),
+				Reply:    flowTuple(flow.Reverse),
+				Timeout:  flow.TimeOut,
+				Mark:     flow.Mark,
+			}
+			switch flow.Forward.Protocol {
+			case unix.IPPROTO_TCP:
+				if tcp, ok := flow.ProtoInfo.(*netlink.ProtoInfoTCP); !ok || tcp.State != nl.TCP_CONNTRACK_ESTABLISHED {
+					continue
+				}
+				f.Protocol = "tcp"
+			case unix.IPPROTO_UDP:
+				f.Protocol = "udp"
+			default:
+				continue
+			}
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// flowOf reports whether one of ips sent flow or answers it
+func flowOf(flow *netlink.ConntrackFlow, ips []net.IP) bool {
+	for _, ip := range ips {
+		if flow.Forward.SrcIP.Equal(ip) || flow.Reverse.SrcIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func flowTuple(t netlink.IPTuple) FlowTuple {
+	src, _ := netip.AddrFromSlice(t.SrcIP)
+	dst, _ := netip.AddrFromSlice(t.DstIP)
+	return FlowTuple{
+		Src: netip.AddrPortFrom(src.Unmap(), t.SrcPort),
+		Dst: netip.AddrPortFrom(dst.Unmap(), t.DstPort),
+	}
+}
+
+// restoreKernelFlow tracks f in the kernel's connection tracking table
+// again, keeping the entry it may have by now
+func restoreKernelFlow(f KernelFlow) error {
+	flow := &netlink.ConntrackFlow{
+		FamilyType: unix.AF_INET,
+		Forward:    ipTuple(f.Original, unix.IPPROTO_UDP),
+		Reverse:    ipTuple(f.Reply, unix.IPPROTO_UDP),
+		TimeOut:    f.Timeout,
+		Mark:       f.Mark,
+	}
+	if f.Original.Src.Addr().Is6() {
+		flow.FamilyType = unix.AF_INET6
+	}
+	if f.Protocol == "tcp" {
+		flow.Forward.Protocol, flow.Reverse.Protocol = unix.IPPROTO_TCP, unix.IPPROTO_TCP
+		flow.ProtoInfo = &netlink.ProtoInfoTCP{State: nl.TCP_CONNTRACK_ESTABLISHED}
+	}
+	err := netlink.ConntrackCreate(netlink.ConntrackTable, netlink.InetFamily(flow.FamilyType), flow)
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	return err
+}
+
+func ipTuple(t FlowTuple, proto uint8) netlink.IPTuple {
+	return netlink.IPTuple{
+		SrcIP:    t.Src.Addr().AsSlice(),
+		DstIP:    t.Dst.Addr().AsSlice(),
+		SrcPort:  t.Src.Port(),
+		DstPort:  t.Dst.Port(),
+		Protocol: proto,
+	}
+}
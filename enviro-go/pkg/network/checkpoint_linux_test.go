@@ -0,0 +1,123 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkpointTestEnv has a child of TestCheckpointRestore run the test in
+// the network namespace of its own it was started in
+const checkpointTestEnv = "ENVIRO_TEST_CHECKPOINT"
+
+// TestCheckpointRestore checkpoints a container, tears its network down
+// and restores it in another namespace, as a migration with CRIU does. It
+// runs in a child in a network namespace of its own, so the manager's
+// bridge and rules stay off the host.
+func TestCheckpointRestore(t *testing.T) {
+	if os.Getenv(checkpointTestEnv) != "" {
+		runCheckpointRestore(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating container networks needs root")
+	}
+	runInNetns(t, checkpointTestEnv)
+}
+
+// containerNetns starts a process in a network namespace of its own,
+// standing in for a container, and returns the namespace's path
+func containerNetns(t *testing.T) string {
+	t.Helper()
+	cmd := exec.Command("sleep", "infinity")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid)
+}
+
+func runCheckpointRestore(t *testing.T) {
+	ctx := context.Background()
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:   "10.99.0.0/24",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+
+	cn, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "c1", NetnsPath: containerNetns(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nm.ExposePort("c1", 8080, 80, "tcp"); err != nil {
+		t.Fatal(err)
+	}
+	route := ContainerRoute{Dst: netip.MustParsePrefix("10.200.0.0/16"), Gateway: netip.MustParseAddr("10.99.0.1")}
+	if err := addRoute(cn, route); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := nm.CheckpointNetwork("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nm.DeleteContainerNetwork(ctx, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	// The address stays reserved through the migration
+	if i := slices.IndexFunc(nm.ListReservations(), func(r Reservation) bool { return r.ContainerID == "c1" }); i < 0 || !nm.ListReservations()[i].Migrating {
+		t.Errorf("reservations during migration: %+v, want c1 migrating", nm.ListReservations())
+	}
+	other, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "c2", NetnsPath: containerNetns(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.IPv4 == cn.IPv4 {
+		t.Errorf("c2 got %s, reserved for c1 during its migration", other.IPv4)
+	}
+
+	restored, report, err := nm.RestoreNetwork(ctx, "c1", checkpoint, containerNetns(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failures) != 0 {
+		t.Errorf("restore failures: %+v", report.Failures)
+	}
+	if restored.IPv4 != cn.IPv4 || restored.MAC != cn.MAC {
+		t.Errorf("restored with %s and %s, want %s and %s", restored.IPv4, restored.MAC, cn.IPv4, cn.MAC)
+	}
+	want := PortForward{ContainerID: "c1", HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+	if !slices.Contains(nm.ListPortForwards(), want) {
+		t.Errorf("port forwards %+v, want %+v", nm.ListPortForwards(), want)
+	}
+	routes, err := readRoutes(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(routes, route) {
+		t.Errorf("routes %+v, want %s", routes, route)
+	}
+	for _, r := range nm.ListReservations() {
+		if r.Migrating {
+			t.Errorf("reservation %+v still migrating after the restore", r)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestRestoreNetworkInvalid(t *testing.T) {
+	checkpoint := func(cp NetworkCheckpoint) []byte {
+		data, err := json.Marshal(cp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	state := NetworkState{Version: networkStateVersion, Network: ContainerNetwork{ContainerID: "c1"}}
+	tests := []struct {
+		name       string
+		checkpoint []byte
+	}{
+		{name: "not JSON", checkpoint: []byte("{")},
+		{name: "version", checkpoint: checkpoint(NetworkCheckpoint{Version: checkpointVersion + 1, State: state})},
+		{name: "state version", checkpoint: checkpoint(NetworkCheckpoint{Version: checkpointVersion, State: NetworkState{Network: state.Network}})},
+		{name: "other container", checkpoint: checkpoint(NetworkCheckpoint{
+			Version: checkpointVersion,
+			State:   NetworkState{Version: networkStateVersion, Network: ContainerNetwork{ContainerID: "c2"}},
+		})},
+		{name: "port of other container", checkpoint: checkpoint(NetworkCheckpoint{
+			Version: checkpointVersion,
+			State:   state,
+			Ports:   []PortForward{{ContainerID: "c2", HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := &NetworkManager{containers: map[string]*ContainerNetwork{}}
+			_, _, err := nm.RestoreNetwork(context.Background(), "c1", tt.checkpoint, "/proc/self/ns/net")
+			if !errors.Is(err, ErrInvalidNetworkState) {
+				t.Errorf("RestoreNetwork() = %v, want ErrInvalidNetworkState", err)
+			}
+		})
+	}
+}
+
+func TestKernelFlowJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		flow KernelFlow
+		want string
+	}{
+		{
+			name: "published port",
+			flow: KernelFlow{
+				Protocol: "tcp",
+				Original: FlowTuple{Src: netip.MustParseAddrPort("192.0.2.7:40000"), Dst: netip.MustParseAddrPort("198.51.100.1:8080")},
+				Reply:    FlowTuple{Src: netip.MustParseAddrPort("10.88.0.2:80"), Dst: netip.MustParseAddrPort("192.0.2.7:40000")},
+				Timeout:  432000,
+			},
+			want: "flow tcp 192.0.2.7:40000 -> 198.51.100.1:8080",
+		},
+		{
+			name: "IPv6",
+			flow: KernelFlow{
+				Protocol: "udp",
+				Original: FlowTuple{Src: netip.MustParseAddrPort("[fd00::2]:5353"), Dst: netip.MustParseAddrPort("[2001:db8::1]:53")},
+				Reply:    FlowTuple{Src: netip.MustParseAddrPort("[2001:db8::1]:53"), Dst: netip.MustParseAddrPort("[fd00::2]:5353")},
+				Timeout:  30,
+				Mark:     7,
+			},
+			want: "flow udp [fd00::2]:5353 -> [2001:db8::1]:53",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.flow.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			data, err := json.Marshal(tt.flow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got KernelFlow
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.flow {
+				t.Errorf("round trip through %s = %+v, want %+v", data, got, tt.flow)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ErrInvalidCIDR is returned for container networks that can't be used
+var ErrInvalidCIDR = errors.New("network: invalid CIDR")
+
+// ErrInvalidMTU is returned for MTUs outside MinMTU to MaxMTU
+var ErrInvalidMTU = errors.New("network: invalid MTU")
+
+// ErrInvalidInterface is returned when the XDP interface doesn't exist
+var ErrInvalidInterface = errors.New("network: invalid interface")
+
+// ErrInvalidConfig is returned for other invalid configuration, e.g. an
+// unknown default policy
+var ErrInvalidConfig = errors.New("network: invalid configuration")
+
+// Bounds of NetworkConfig.MTU: the minimum IPv4 datagram every host must
+// accept and the largest jumbo frame common NICs support
+const (
+	MinMTU = 576
+	MaxMTU = 9216
+)
+
+// Validate checks the configuration without changing the host. Errors wrap
+// ErrInvalidCIDR, ErrInvalidMTU, ErrInvalidInterface or ErrInvalidConfig.
+func (c NetworkConfig) Validate() error {
+	if c.CIDR == "" && c.CIDR6 == "" {
+		return fmt.Errorf("%w: no CIDR configured", ErrInvalidCIDR)
+	}
+	for _, cidr := range []string{c.CIDR, c.CIDR6} {
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrInvalidCIDR, cidr, err)
+		}
+		// Besides the network address, the gateway takes a host address
+		if prefix.Bits() > prefix.Addr().BitLen()-2 {
+			return fmt.Errorf("%w: %s leaves no room for containers", ErrInvalidCIDR, prefix)
+		}
+	}
+	if err := c.validateServiceCIDRs(); err != nil {
+		return err
+	}
+	// The container networks and service CIDRs must not overlap each other
+	// or the networks of the host
+	prefixes := c.configPrefixes()
+	if overlaps := findOverlaps(prefixes, nil); len(overlaps) > 0 {
+		return overlapError(overlaps)
+	}
+	if err := checkHostOverlap(prefixes); err != nil {
+		return err
+	}
+
+	if c.MTU != 0 && (c.MTU < MinMTU || c.MTU > MaxMTU) {
+		return fmt.Errorf("%w: %d is outside %d-%d", ErrInvalidMTU, c.MTU, MinMTU, MaxMTU)
+	}
+	if c.EnableXDP {
+		if c.Interface == "" {
+			return fmt.Errorf("%w: XDP enabled without an interface", ErrInvalidInterface)
+		}
+		if _, err := net.InterfaceByName(c.Interface); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidInterface, c.Interface, err)
+		}
+	}
+
+	if err := c.Conntrack.validate(); err != nil {
+		return err
+	}
+	if err := c.GC.validate(); err != nil {
+		return err
+	}
+	if err := c.Leases.validate(); err != nil {
+		return err
+	}
+	if err := c.Analytics.validate(); err != nil {
+		return err
+	}
+	if err := c.DropAudit.validate(); err != nil {
+		return err
+	}
+	if err := c.Rootless.validate(c); err != nil {
+		return err
+	}
+	if err := c.IPAM.validate(c); err != nil {
+		return err
+	}
+	if err := c.Devices.validate(c); err != nil {
+		return err
+	}
+	if err := c.WarmPool.validate(c); err != nil {
+		return err
+	}
+	if err := c.Readiness.validate(); err != nil {
+		return err
+	}
+	if err := c.DNS.validate(c); err != nil {
+		return err
+	}
+	if err := validateNodePorts(c.NodePorts); err != nil {
+		return err
+	}
+	if err := c.SNAT.validate(); err != nil {
+		return err
+	}
+	if err := c.SYNProtection.validate(c); err != nil {
+		return err
+	}
+	if err := c.ProgramStats.validate(c); err != nil {
+		return err
+	}
+	if err := c.ConnectPolicy.validate(c); err != nil {
+		return err
+	}
+	if err := c.SocketAcceleration.validate(c); err != nil {
+		return err
+	}
+	if err := c.ProxyRedirect.validate(c); err != nil {
+		return err
+	}
+
+	switch c.DefaultPolicy {
+	case "", PolicyAllow, PolicyDeny, PolicyReject:
+	default:
+		return fmt.Errorf("%w: unknown default policy %q", ErrInvalidConfig, c.DefaultPolicy)
+	}
+	if c.RejectRate < 0 {
+		return fmt.Errorf("%w: negative reject rate %d", ErrInvalidConfig, c.RejectRate)
+	}
+	switch c.DatapathMode {
+	case "", DatapathXDPNative, DatapathXDPGeneric, DatapathTC, DatapathUserspace:
+	default:
+		return fmt.Errorf("%w: unknown datapath mode %q", ErrInvalidConfig, c.DatapathMode)
+	}
+	if c.Instance != "" && !validInstance(c.Instance) {
+		return fmt.Errorf("%w: instance %q is not up to %d lowercase letters and digits", ErrInvalidConfig, c.Instance, MaxInstanceLen)
+	}
+	if c.KeepAttached && c.PinPath == "" {
+		return fmt.Errorf("%w: keeping the datapath attached requires a pin path", ErrInvalidConfig)
+	}
+	if c.Node != nil {
+		if err := validateNode(c); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+	// Checks families and gateways
+	_, err := newAddressPools(c)
+	return err
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNetworkConfigValidate(t *testing.T) {
+	// A network of the host, which container networks must stay out of
+	var hostCIDR string
+	host, err := hostNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range host {
+		if p.Prefix.Addr().Is4() && p.Prefix.Bits() <= 30 {
+			hostCIDR = p.Prefix.String()
+			break
+		}
+	}
+
+	tests := []struct {
+		name   string
+		config NetworkConfig
+		// onHost sets CIDR to the network of the host
+		onHost  bool
+		wantErr error
+	}{
+		{name: "valid", config: NetworkConfig{CIDR: "10.99.0.0/24"}},
+		{name: "dual stack", config: NetworkConfig{CIDR: "10.99.0.0/24", CIDR6: "fd99::/64"}},
+		{name: "IPv6 only", config: NetworkConfig{CIDR6: "fd99::/64"}},
+		{name: "empty CIDR", config: NetworkConfig{}, wantErr: ErrInvalidCIDR},
+		{name: "malformed CIDR", config: NetworkConfig{CIDR: "10.99.0.0/33"}, wantErr: ErrInvalidCIDR},
+		{name: "/32", config: NetworkConfig{CIDR: "10.99.0.1/32"}, wantErr: ErrInvalidCIDR},
+		{name: "/31", config: NetworkConfig{CIDR: "10.99.0.0/31"}, wantErr: ErrInvalidCIDR},
+		{name: "/30", config: NetworkConfig{CIDR: "10.99.0.0/30"}},
+		{name: "IPv6 /127", config: NetworkConfig{CIDR6: "fd99::/127"}, wantErr: ErrInvalidCIDR},
+		{name: "overlapping service CIDR", config: NetworkConfig{CIDR: "10.99.0.0/16", ServiceCIDR: "10.99.128.0/20"}, wantErr: ErrInvalidCIDR},
+		{name: "overlapping host network", onHost: true, wantErr: ErrInvalidCIDR},
+		{name: "jumbo MTU", config: NetworkConfig{CIDR: "10.99.0.0/24", MTU: 9000}},
+		{name: "largest MTU", config: NetworkConfig{CIDR: "10.99.0.0/24", MTU: MaxMTU}},
+		{name: "MTU above the largest", config: NetworkConfig{CIDR: "10.99.0.0/24", MTU: MaxMTU + 1}, wantErr: ErrInvalidMTU},
+		{name: "MTU below the smallest", config: NetworkConfig{CIDR: "10.99.0.0/24", MTU: MinMTU - 1}, wantErr: ErrInvalidMTU},
+		{name: "XDP without interface", config: NetworkConfig{CIDR: "10.99.0.0/24", EnableXDP: true}, wantErr: ErrInvalidInterface},
+		{name: "XDP on a missing interface", config: NetworkConfig{CIDR: "10.99.0.0/24", EnableXDP: true, Interface: "enviro-missing"}, wantErr: ErrInvalidInterface},
+		{name: "unknown default policy", config: NetworkConfig{CIDR: "10.99.0.0/24", DefaultPolicy: "maybe"}, wantErr: ErrInvalidConfig},
+		{name: "negative reject rate", config: NetworkConfig{CIDR: "10.99.0.0/24", RejectRate: -1}, wantErr: ErrInvalidConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.onHost {
+				if hostCIDR == "" {
+					t.Skip("the host has no IPv4 network")
+				}
+				tt.config.CIDR = hostCIDR
+			}
+			err := tt.config.Validate()
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("Validate() = %v, want no error", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package network
+
+import "fmt"
+
+// ConnectPolicyConfig enforces the policies between containers of this
+// node as their processes connect, and as they send UDP datagrams, rather
+// than per packet: eBPF programs attached to the cgroup of each container
+// given a ContainerNetworkSpec.CgroupPath fail what the policies deny or
+// reject with EPERM before any packet exists. The XDP router still checks
+// the packets, so traffic the programs don't see, e.g. from outside the
+// node or containers without a cgroup, is enforced as before.
+//
+// Connect-time policy needs the XDP router and a kernel from 5.7. It stays
+// off with a warning elsewhere, see Capabilities.ConnectPolicy. GetStats
+// reports the checks made per connection and per packet.
+type ConnectPolicyConfig struct {
+	Enable bool `json:"enable"`
+}
+
+// validate checks that XDP is enabled
+func (c ConnectPolicyConfig) validate(cfg NetworkConfig) error {
+	if c.Enable && !cfg.EnableXDP {
+		return fmt.Errorf("%w: connect-time policy requires XDP", ErrInvalidConfig)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/cgroup"
+)
+
+// connectDialEnv has the test binary, run as a helper process, dial UDP
+// to the address it holds and report the error
+const connectDialEnv = "ENVIRO_TEST_CONNECT_DIAL"
+
+// testCgroup creates a cgroup for the test, removed once it ends, or
+// skips it if the cgroup v2 hierarchy isn't mounted where expected
+func testCgroup(t *testing.T, name string) string {
+	t.Helper()
+	var fs unix.Statfs_t
+	if err := unix.Statfs(cgroup.DefaultRoot, &fs); err != nil || fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		t.Skipf("no cgroup v2 hierarchy at %s", cgroup.DefaultRoot)
+	}
+	dir := filepath.Join(cgroup.DefaultRoot, fmt.Sprintf("%s-%d", name, os.Getpid()))
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Skipf("can't create a cgroup: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(dir) })
+	return dir
+}
+
+func TestMain(m *testing.M) {
+	if addr := os.Getenv(connectDialEnv); addr != "" {
+		// Connecting a UDP socket runs cgroup/connect4 without sending
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+		conn.Close()
+		os.Exit(0)
+	}
+	if addrs := os.Getenv(accelEchoEnv); addrs != "" {
+		if err := accelEcho(addrs); err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if args := os.Getenv(proxyEnv); args != "" {
+		dst, err := proxyHelper(args)
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+		fmt.Print(dst)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// dialFromCgroup dials addr over UDP from a process in the cgroup dir,
+// returning whether the connect-time policy refused it
+func dialFromCgroup(t *testing.T, dir string, addr netip.AddrPort) bool {
+	t.Helper()
+	fd, err := unix.Open(dir, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), connectDialEnv+"="+addr.String())
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: fd}
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Skipf("can't start a process in a cgroup: %v", err)
+	}
+	return bytes.Contains(out, []byte(unix.EPERM.Error()))
+}
+
+func TestConnectPolicy(t *testing.T) {
+	if !probedKernel().Datapath.ConnectPolicy {
+		t.Skip("kernel can't enforce policies on connect")
+	}
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		t.Fatal(err)
+	}
+	trimPrograms(spec, []DatapathMode{DatapathXDPNative})
+	x := &xdpProgram{connectPolicy: true}
+	x.applyConnectPolicy(spec)
+	x.applySocketAcceleration(spec)
+	coll, err := ebpf.NewCollection(spec)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("loading eBPF not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(coll.Close)
+	x.setCollection(coll)
+	if !x.hasConnectPolicy() {
+		t.Fatal("router loaded without connect-time policy")
+	}
+
+	src, dst := netip.MustParseAddr("10.0.0.3"), netip.MustParseAddr("10.0.0.2")
+	const srcIfindex = testIfindex + 1
+	for ifindex, addr := range map[int]netip.Addr{testIfindex: dst, srcIfindex: src} {
+		if err := x.AddContainer(ifindex, []netip.Addr{addr}, nil, nil, false, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = x.UpdatePolicies(map[policyRule]PolicyAction{
+		{Src: netip.PrefixFrom(src, 32), Dst: dst, Proto: unix.IPPROTO_UDP, Port: 53}: PolicyDeny,
+		{Src: netip.PrefixFrom(src, 32), Dst: dst, Proto: unix.IPPROTO_UDP, Port: 54}: PolicyReject,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := testCgroup(t, "enviro-test")
+	a, err := x.attachCgroup(dir, srcIfindex, []netip.Addr{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.detachCgroup(a)
+
+	tests := []struct {
+		name   string
+		dest   netip.AddrPort
+		denied bool
+	}{
+		{name: "denied port", dest: netip.AddrPortFrom(dst, 53), denied: true},
+		{name: "rejected port", dest: netip.AddrPortFrom(dst, 54), denied: true},
+		{name: "allowed port", dest: netip.AddrPortFrom(dst, 80)},
+		{name: "outside the node", dest: netip.MustParseAddrPort("192.0.2.1:53")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dialFromCgroup(t, dir, tt.dest); got != tt.denied {
+				t.Errorf("dialing %s refused %t, want %t", tt.dest, got, tt.denied)
+			}
+		})
+	}
+
+	// Destinations outside the node aren't checked
+	s, err := x.ContainerStats(srcIfindex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ConnectChecks != 3 || s.ConnectDenied != 2 {
+		t.Errorf("container counted %d connect checks, %d denied, want 3 and 2", s.ConnectChecks, s.ConnectDenied)
+	}
+	if err := x.detachCgroup(a); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := countEntries(x.connectSources); err != nil || n != 0 {
+		t.Errorf("connect_sources has %d entries after detaching, %v", n, err)
+	}
+	if dialFromCgroup(t, dir, netip.AddrPortFrom(dst, 53)) {
+		t.Error("dial refused after detaching")
+	}
+}
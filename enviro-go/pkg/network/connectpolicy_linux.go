@@ -0,0 +1,78 @@
+//go:build linux
+
+package network
+
+import (
+	"net/netip"
+
+	"github.com/cilium/ebpf"
+)
+
+// connectPrograms are the programs of connect-time policy in the router
+// object, by the hook of the container cgroups they are attached to
+var connectPrograms = []cgroupProgram{
+	{"cgroup_connect4", ebpf.AttachCGroupInet4Connect},
+	{"cgroup_connect6", ebpf.AttachCGroupInet6Connect},
+	{"cgroup_sendmsg4", ebpf.AttachCGroupUDP4Sendmsg},
+	{"cgroup_sendmsg6", ebpf.AttachCGroupUDP6Sendmsg},
+}
+
+// connectSource mirrors struct connect_source in bpf/container_router.c
+type connectSource struct {
+	Ifindex uint32
+	Addr4   [4]byte
+	Addr6   [16]byte
+}
+
+// newConnectSource returns the entry of the container behind the host
+// veth ifindex with addrs
+func newConnectSource(ifindex int, addrs []netip.Addr) connectSource {
+	v := connectSource{Ifindex: uint32(ifindex)}
+	for _, addr := range addrs {
+		if addr.Is4() {
+			v.Addr4 = addr.As4()
+		} else {
+			v.Addr6 = addr.As16()
+		}
+	}
+	return v
+}
+
+// applyConnectPolicy removes the programs of connect-time policy from spec
+// unless x enforces it, as the kernel may not be able to load them
+func (x *xdpProgram) applyConnectPolicy(spec *ebpf.CollectionSpec) {
+	if x.connectPolicy {
+		return
+	}
+	for _, p := range connectPrograms {
+		delete(spec.Programs, p.name)
+	}
+}
+
+// hasConnectPolicy reports whether the router was loaded with the programs
+// of connect-time policy
+func (x *xdpProgram) hasConnectPolicy() bool {
+	if x.connectSources == nil {
+		return false
+	}
+	for _, p := range connectPrograms {
+		if x.coll.Programs[p.name] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// initConnectPolicy records whether the freshly loaded xdp enforces
+// policies as containers connect, warning when it is enabled but can't
+func (nm *NetworkManager) initConnectPolicy(xdp *xdpProgram) {
+	if !nm.config.ConnectPolicy.Enable {
+		return
+	}
+	if !xdp.hasConnectPolicy() {
+		nm.log.Warn("Connect-time policy unavailable: the kernel can't attach the programs to cgroups before 5.7, so policies are only enforced per packet")
+		return
+	}
+	nm.caps.ConnectPolicy = true
+	nm.log.Info("Enforcing policies as containers connect")
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package network
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestNewConnectSource(t *testing.T) {
+	v4, v6 := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::2")
+	tests := []struct {
+		name  string
+		addrs []netip.Addr
+		want  connectSource
+	}{
+		{name: "dual stack", addrs: []netip.Addr{v4, v6}, want: connectSource{Ifindex: 7, Addr4: v4.As4(), Addr6: v6.As16()}},
+		{name: "IPv4", addrs: []netip.Addr{v4}, want: connectSource{Ifindex: 7, Addr4: v4.As4()}},
+		{name: "IPv6", addrs: []netip.Addr{v6}, want: connectSource{Ifindex: 7, Addr6: v6.As16()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newConnectSource(7, tt.addrs); got != tt.want {
+				t.Errorf("newConnectSource() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConnectPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ConnectPolicyConfig
+		noXDP   bool
+		wantErr bool
+	}{
+		{name: "disabled", noXDP: true},
+		{name: "enabled", cfg: ConnectPolicyConfig{Enable: true}},
+		{name: "without XDP", cfg: ConnectPolicyConfig{Enable: true}, noXDP: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate(NetworkConfig{EnableXDP: !tt.noXDP})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validate() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validate() = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
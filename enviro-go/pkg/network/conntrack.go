@@ -0,0 +1,262 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// Conntrack defaults, see ConntrackConfig
+const (
+	DefaultConntrackMaxEntries = 131072
+	DefaultTCPTimeout          = time.Hour
+	DefaultUDPTimeout          = 30 * time.Second
+)
+
+// tcpCloseTimeout expires TCP flows seen closing or reset, which only
+// linger for retransmissions
+const tcpCloseTimeout = 10 * time.Second
+
+// ConntrackConfig sizes the XDP connection tracking table and sets how long
+// idle flows are kept. Zero values keep the defaults.
+type ConntrackConfig struct {
+	// MaxEntries bounds the table; the least recently used flows are
+	// evicted when it is full
+	MaxEntries int `json:"max_entries"`
+	// TCPTimeout and UDPTimeout expire flows without packets for that long
+	TCPTimeout time.Duration `json:"tcp_timeout"`
+	UDPTimeout time.Duration `json:"udp_timeout"`
+}
+
+// withDefaults fills in unset values
+func (c ConntrackConfig) withDefaults() ConntrackConfig {
+	if c.MaxEntries == 0 {
+		c.MaxEntries = DefaultConntrackMaxEntries
+	}
+	if c.TCPTimeout == 0 {
+		c.TCPTimeout = DefaultTCPTimeout
+	}
+	if c.UDPTimeout == 0 {
+		c.UDPTimeout = DefaultUDPTimeout
+	}
+	return c
+}
+
+func (c ConntrackConfig) validate() error {
+	if c.MaxEntries < 0 || c.TCPTimeout < 0 || c.UDPTimeout < 0 {
+		return fmt.Errorf("%w: conntrack limits must not be negative", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// ConnState is the state of a tracked connection. States are inferred from
+// the packets of one direction, see Connection.
+type ConnState string
+
+const (
+	// ConnNew is a TCP flow that only sent SYNs or a UDP flow with a
+	// single packet
+	ConnNew ConnState = "new"
+	// ConnEstablished is a flow past its first packets
+	ConnEstablished ConnState = "established"
+	// ConnClosing is a TCP flow that sent a FIN
+	ConnClosing ConnState = "closing"
+	// ConnClosed is a TCP flow that sent a RST
+	ConnClosed ConnState = "closed"
+)
+
+// Connection is one direction of a flow of a container tracked by the XDP
+// router: the packets towards the container, which the router routes, or
+// those it sends, which its source check passes. The replies of a flow
+// are a Connection of their own.
+type Connection struct {
+	ContainerID string `json:"container_id"`
+	// Protocol is "tcp" or "udp"
+	Protocol string         `json:"protocol"`
+	Src      netip.AddrPort `json:"src"`
+	Dst      netip.AddrPort `json:"dst"`
+	// Outbound is set for the packets the container sends, from Src
+	Outbound bool      `json:"outbound,omitempty"`
+	State    ConnState `json:"state"`
+	Packets  uint64    `json:"packets"`
+	Bytes    uint64    `json:"bytes"`
+	// Age is the time since the first packet, Idle since the last
+	Age  time.Duration `json:"age"`
+	Idle time.Duration `json:"idle"`
+}
+
+// ListConnections returns the tracked flows of containerID, or of every
+// container when it is empty, sorted by container and tuple. Connections
+// are only tracked while XDP is attached; otherwise ErrXDPInactive is
+// returned. Those containers send are only tracked with the source check,
+// see ContainerNetwork.SourceCheckDisabled.
+func (nm *NetworkManager) ListConnections(containerID string) ([]Connection, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.xdp == nil {
+		return nil, ErrXDPInactive
+	}
+	if cn, ok := nm.containers[containerID]; ok {
+		if err := cn.checkAttachment("connection tracking"); err != nil {
+			return nil, err
+		}
+	}
+	owners := make(map[int]string, len(nm.containers))
+	for id, cn := range nm.containers {
+		// Directly attached containers have no ifindex to track by
+		if (containerID == "" || id == containerID) && cn.HostIfindex != 0 {
+			owners[cn.HostIfindex] = id
+		}
+	}
+	if containerID != "" && len(owners) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+
+	conns, err := nm.readConnections(owners)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connections: %w", err)
+	}
+	sortConnections(conns)
+	return conns, nil
+}
+
+// Flow is a connection of a container, with both of its directions as
+// tracked by the router joined
+type Flow struct {
+	// Protocol is "tcp" or "udp"
+	Protocol string `json:"protocol"`
+	// Local is the container's end of the flow, Remote the peer's
+	Local  netip.AddrPort `json:"local"`
+	Remote netip.AddrPort `json:"remote"`
+	// Outbound is set for flows the container opened, i.e. whose packets
+	// from it were seen first
+	Outbound bool `json:"outbound,omitempty"`
+	// State is the furthest either direction got
+	State ConnState `json:"state"`
+	// What the container sent and received
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	// Age is the time since the first packet either way, Idle since the
+	// last
+	Age  time.Duration `json:"age"`
+	Idle time.Duration `json:"idle"`
+}
+
+// ListFlows returns the active flows of containerID, sorted by protocol
+// and tuple. A direction the router doesn't see counts nothing: what the
+// container sends without the source check, and the replies the kernel
+// translates back to the flows it masquerades. Like ListConnections, it
+// fails with ErrXDPInactive while XDP is not attached.
+func (nm *NetworkManager) ListFlows(containerID string) ([]Flow, error) {
+	if containerID == "" {
+		return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	conns, err := nm.ListConnections(containerID)
+	if err != nil {
+		return nil, err
+	}
+	flows := joinFlows(conns)
+	sort.Slice(flows, func(i, j int) bool {
+		a, b := flows[i], flows[j]
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.Local != b.Local {
+			return lessAddrPort(a.Local, b.Local)
+		}
+		return lessAddrPort(a.Remote, b.Remote)
+	})
+	return flows, nil
+}
+
+// flowEnds identifies a flow by its ends as the container sees them
+type flowEnds struct {
+	protocol      string
+	local, remote netip.AddrPort
+}
+
+// joinFlows joins the directions of the flows in conns, all of one
+// container
+func joinFlows(conns []Connection) []Flow {
+	var flows []Flow
+	index := make(map[flowEnds]int, len(conns))
+	for _, c := range conns {
+		t := flowEnds{protocol: c.Protocol, local: c.Dst, remote: c.Src}
+		if c.Outbound {
+			t.local, t.remote = c.Src, c.Dst
+		}
+		i, ok := index[t]
+		if !ok {
+			i = len(flows)
+			index[t] = i
+			flows = append(flows, Flow{
+				Protocol: t.protocol,
+				Local:    t.local,
+				Remote:   t.remote,
+				Outbound: c.Outbound,
+				State:    c.State,
+				Age:      c.Age,
+				Idle:     c.Idle,
+			})
+		}
+		f := &flows[i]
+		if c.Outbound {
+			f.TxPackets, f.TxBytes = c.Packets, c.Bytes
+		} else {
+			f.RxPackets, f.RxBytes = c.Packets, c.Bytes
+		}
+		if ok {
+			if c.Age > f.Age {
+				f.Age, f.Outbound = c.Age, c.Outbound
+			}
+			f.Idle = min(f.Idle, c.Idle)
+			if c.State.rank() > f.State.rank() {
+				f.State = c.State
+			}
+		}
+	}
+	return flows
+}
+
+// rank orders states as a flow advances through them
+func (s ConnState) rank() int {
+	switch s {
+	case ConnNew:
+		return 1
+	case ConnEstablished:
+		return 2
+	case ConnClosing:
+		return 3
+	case ConnClosed:
+		return 4
+	}
+	return 0
+}
+
+// sortConnections orders conns by container and tuple
+func sortConnections(conns []Connection) {
+	sort.Slice(conns, func(i, j int) bool {
+		a, b := conns[i], conns[j]
+		if a.ContainerID != b.ContainerID {
+			return a.ContainerID < b.ContainerID
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.Src != b.Src {
+			return lessAddrPort(a.Src, b.Src)
+		}
+		return lessAddrPort(a.Dst, b.Dst)
+	})
+}
+
+func lessAddrPort(a, b netip.AddrPort) bool {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c < 0
+	}
+	return a.Port() < b.Port()
+}
@@ -0,0 +1,264 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// ctKey mirrors struct ct_key in bpf/container_router.c
+type ctKey struct {
+	Src   [16]byte
+	Dst   [16]byte
+	Sport [2]byte
+	Dport [2]byte
+	Proto uint8
+	Dir   uint8
+	Pad   [2]uint8
+}
+
+// Directions of ctKey, mirroring CT_DIR_*
+const (
+	ctDirIn  = 0
+	ctDirOut = 1
+)
+
+// reverse returns the key of the flow's replies as the router sees them,
+// in the same direction
+func (k ctKey) reverse() ctKey {
+	k.Src, k.Dst = k.Dst, k.Src
+	k.Sport, k.Dport = k.Dport, k.Sport
+	return k
+}
+
+// ctEntry mirrors struct ct_entry in bpf/container_router.c
+type ctEntry struct {
+	Created  uint64
+	LastSeen uint64
+	Packets  uint64
+	Bytes    uint64
+	Ifindex  uint32
+	State    uint8
+	Pad      [3]uint8
+}
+
+// Connection states, mirroring CT_*
+var ctStates = map[uint8]ConnState{
+	1: ConnNew,
+	2: ConnEstablished,
+	3: ConnClosing,
+	4: ConnClosed,
+}
+
+// maxConntrackGCInterval bounds how long an expired flow can linger
+const maxConntrackGCInterval = 10 * time.Second
+
+// monotonicNow returns the clock of bpf_ktime_get_ns
+func monotonicNow() uint64 {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return uint64(ts.Nano())
+}
+
+// eachConnection calls fn for every tracked flow
+func (x *xdpProgram) eachConnection(fn func(ctKey, ctEntry)) error {
+	var key ctKey
+	var entry ctEntry
+	iter := x.conntrack.Iterate()
+	for iter.Next(&key, &entry) {
+		fn(key, entry)
+	}
+	return iter.Err()
+}
+
+// deleteConnections removes the flows for which match returns true and
+// returns how many there were
+func (x *xdpProgram) deleteConnections(match func(ctKey, ctEntry) bool) (int, error) {
+	// Deleting while iterating can restart the iteration, so collect first
+	var keys []ctKey
+	err := x.eachConnection(func(key ctKey, entry ctEntry) {
+		if match(key, entry) {
+			keys = append(keys, key)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := ignoreNotExist(x.conntrack.Delete(key)); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// FlushConnections removes the flows of the container behind ifindex,
+// along with the translations of those that were forwarded
+func (x *xdpProgram) FlushConnections(ifindex int) error {
+	_, err := x.deleteConnections(func(_ ctKey, entry ctEntry) bool {
+		return entry.Ifindex == uint32(ifindex)
+	})
+	if err != nil {
+		return err
+	}
+	return x.expireForwards()
+}
+
+// expireConnections removes flows idle for longer than their timeout,
+// along with the translations of those that were forwarded
+func (x *xdpProgram) expireConnections(cfg ConntrackConfig) (int, error) {
+	now := monotonicNow()
+	n, err := x.deleteConnections(func(key ctKey, entry ctEntry) bool {
+		return now > entry.LastSeen && time.Duration(now-entry.LastSeen) > cfg.timeout(key.Proto, entry.State)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, x.expireForwards()
+}
+
+// startConntrackGC expires idle flows in the background until Close. The
+// LRU map evicts on its own when full; expiry keeps it from filling up
+// with dead flows and ListConnections from showing them.
+func (x *xdpProgram) startConntrackGC(cfg ConntrackConfig, logger *slog.Logger) {
+	interval := min(cfg.TCPTimeout, cfg.UDPTimeout, tcpCloseTimeout) / 2
+	interval = max(min(interval, maxConntrackGCInterval), time.Second)
+
+	x.gcConfig, x.gcLog = cfg, logger
+	x.stopGC = make(chan struct{})
+	x.gcDone = make(chan struct{})
+	go func() {
+		defer close(x.gcDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-x.stopGC:
+				return
+			}
+			n, err := x.expireConnections(cfg)
+			if err != nil {
+				logger.Warn("Failed to expire connections", "error", err)
+			} else if n > 0 {
+				logger.Debug("Expired idle connections", "count", n)
+			}
+		}
+	}()
+}
+
+// stopConntrackGC waits for the expiry started by startConntrackGC to end
+func (x *xdpProgram) stopConntrackGC() {
+	if x.stopGC == nil {
+		return
+	}
+	close(x.stopGC)
+	<-x.gcDone
+	x.stopGC = nil
+}
+
+// timeout returns how long a flow of proto in state is kept without packets
+func (c ConntrackConfig) timeout(proto, state uint8) time.Duration {
+	if proto != unix.IPPROTO_TCP {
+		return c.UDPTimeout
+	}
+	if s := ctStates[state]; s == ConnClosing || s == ConnClosed {
+		return tcpCloseTimeout
+	}
+	return c.TCPTimeout
+}
+
+// readConnections returns the flows of the containers in owners, keyed by
+// host-side ifindex. Callers must hold nm.mu.
+func (nm *NetworkManager) readConnections(owners map[int]string) ([]Connection, error) {
+	now := monotonicNow()
+	var conns []Connection
+	err := nm.xdp.eachConnection(func(key ctKey, entry ctEntry) {
+		id, ok := owners[int(entry.Ifindex)]
+		if !ok {
+			return
+		}
+		c := Connection{
+			ContainerID: id,
+			Protocol:    "udp",
+			Src:         ctAddrPort(key.Src, key.Sport),
+			Dst:         ctAddrPort(key.Dst, key.Dport),
+			Outbound:    key.Dir == ctDirOut,
+			State:       ctStates[entry.State],
+			Packets:     entry.Packets,
+			Bytes:       entry.Bytes,
+		}
+		if key.Proto == unix.IPPROTO_TCP {
+			c.Protocol = "tcp"
+		}
+		if now > entry.Created {
+			c.Age = time.Duration(now - entry.Created)
+		}
+		if now > entry.LastSeen {
+			c.Idle = time.Duration(now - entry.LastSeen)
+		}
+		conns = append(conns, c)
+	})
+	return conns, err
+}
+
+// importConnections tracks conns as flows of the container behind
+// ifindex, as old as they were when read, and returns how many were added.
+// Flows the router tracks already are left alone.
+func (x *xdpProgram) importConnections(ifindex int, conns []Connection) (int, error) {
+	now := monotonicNow()
+	n := 0
+	for _, c := range conns {
+		key := ctKey{Src: c.Src.Addr().As16(), Dst: c.Dst.Addr().As16(), Proto: unix.IPPROTO_UDP}
+		binary.BigEndian.PutUint16(key.Sport[:], c.Src.Port())
+		binary.BigEndian.PutUint16(key.Dport[:], c.Dst.Port())
+		if c.Protocol == "tcp" {
+			key.Proto = unix.IPPROTO_TCP
+		}
+		if c.Outbound {
+			key.Dir = ctDirOut
+		}
+		entry := ctEntry{
+			Created:  now - min(uint64(c.Age), now),
+			LastSeen: now - min(uint64(c.Idle), now),
+			Packets:  c.Packets,
+			Bytes:    c.Bytes,
+			Ifindex:  uint32(ifindex),
+		}
+		for state, s := range ctStates {
+			if s == c.State {
+				entry.State = state
+			}
+		}
+		err := x.conntrack.Update(key, entry, ebpf.UpdateNoExist)
+		if errors.Is(err, ebpf.ErrKeyExist) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// importConnections tracks the flows of a container imported with
+// ImportNetworkState, if the XDP router runs. Callers must hold nm.mu.
+func (nm *NetworkManager) importConnections(cn *ContainerNetwork, conns []Connection) (int, error) {
+	if nm.xdp == nil || len(conns) == 0 {
+		return 0, nil
+	}
+	return nm.xdp.importConnections(cn.HostIfindex, conns)
+}
+
+// ctAddrPort converts a conntrack address, IPv4-mapped for IPv4, and port
+func ctAddrPort(addr [16]byte, port [2]byte) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom16(addr).Unmap(), binary.BigEndian.Uint16(port[:]))
+}
@@ -0,0 +1,50 @@
+package network
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// TestJoinFlows joins the directions of each flow, taking the one seen
+// first as the flow's opener
+func TestJoinFlows(t *testing.T) {
+	container := netip.MustParseAddrPort("10.0.0.2:80")
+	client := netip.MustParseAddrPort("192.0.2.7:40000")
+	ephemeral := netip.MustParseAddrPort("10.0.0.2:41000")
+	server := netip.MustParseAddrPort("198.51.100.1:443")
+	resolver := netip.MustParseAddrPort("198.51.100.53:53")
+
+	conns := []Connection{
+		// A client's connection to the container and the replies
+		{Protocol: "tcp", Src: client, Dst: container, State: ConnClosing,
+			Packets: 10, Bytes: 1000, Age: 5 * time.Second, Idle: time.Second},
+		{Protocol: "tcp", Src: container, Dst: client, Outbound: true, State: ConnEstablished,
+			Packets: 8, Bytes: 8000, Age: 4 * time.Second, Idle: 2 * time.Second},
+		// A connection the container opened, its replies seen by the router
+		{Protocol: "tcp", Src: server, Dst: ephemeral, State: ConnEstablished,
+			Packets: 3, Bytes: 3000, Age: time.Second, Idle: time.Second},
+		{Protocol: "tcp", Src: ephemeral, Dst: server, Outbound: true, State: ConnEstablished,
+			Packets: 4, Bytes: 400, Age: 2 * time.Second, Idle: 0},
+		// A query whose replies the kernel translated back
+		{Protocol: "udp", Src: ephemeral, Dst: resolver, Outbound: true, State: ConnNew,
+			Packets: 1, Bytes: 80, Age: time.Second, Idle: time.Second},
+	}
+	want := []Flow{
+		{Protocol: "tcp", Local: container, Remote: client, State: ConnClosing,
+			TxPackets: 8, TxBytes: 8000, RxPackets: 10, RxBytes: 1000, Age: 5 * time.Second, Idle: time.Second},
+		{Protocol: "tcp", Local: ephemeral, Remote: server, Outbound: true, State: ConnEstablished,
+			TxPackets: 4, TxBytes: 400, RxPackets: 3, RxBytes: 3000, Age: 2 * time.Second, Idle: 0},
+		{Protocol: "udp", Local: ephemeral, Remote: resolver, Outbound: true, State: ConnNew,
+			TxPackets: 1, TxBytes: 80, Age: time.Second, Idle: time.Second},
+	}
+	got := joinFlows(conns)
+	if len(got) != len(want) {
+		t.Fatalf("got %d flows, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("flow %d:\n got %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidAttachment is returned for unknown attachments and for
+// options that directly attached containers can't have
+var ErrInvalidAttachment = errors.New("network: invalid attachment")
+
+// ErrDeviceUnavailable is returned when no virtual function is free for
+// an SR-IOV attachment, and macvlan is not configured to stand in
+var ErrDeviceUnavailable = errors.New("network: no device available")
+
+// ErrDirectAttachment is returned for features of the host datapath,
+// which the traffic of directly attached containers bypasses
+var ErrDirectAttachment = errors.New("network: not supported for directly attached containers")
+
+// Attachment is how a container's interface is connected to the host
+type Attachment string
+
+const (
+	// AttachmentVeth connects the container with a veth pair routed by
+	// the host datapath. It is the default.
+	AttachmentVeth Attachment = "veth"
+	// AttachmentSRIOV moves a free virtual function of one of
+	// DeviceConfig.PhysicalFunctions into the container
+	AttachmentSRIOV Attachment = "sriov"
+	// AttachmentMacvlan gives the container a macvlan device on
+	// DeviceConfig.MacvlanParent, a software stand-in for a VF
+	AttachmentMacvlan Attachment = "macvlan"
+)
+
+// direct reports whether a is one of the device attachments, which have
+// no host veth
+func (a Attachment) direct() bool {
+	return a == AttachmentSRIOV || a == AttachmentMacvlan
+}
+
+// sysClassNet is where the kernel lists network interfaces in sysfs
+const sysClassNet = "/sys/class/net"
+
+// DeviceConfig configures directly attached containers, which get a
+// device on the physical network rather than a veth, for throughput close
+// to line rate. Their addresses still come from the pools, so the pools
+// and gateways must be those of the network the devices are on. Their
+// traffic bypasses the host datapath: XDP, policies, namespace isolation,
+// services, port forwards, bandwidth limits, QoS, faults and mirrors
+// don't apply to them.
+type DeviceConfig struct {
+	// PhysicalFunctions are the SR-IOV capable interfaces whose virtual
+	// functions are handed out, e.g. "ens1f0". The VFs must be created
+	// beforehand, by writing sriov_numvfs.
+	PhysicalFunctions []string `json:"physical_functions"`
+	// MacvlanParent is the interface macvlan devices are created on, the
+	// first of PhysicalFunctions, or else Interface, when empty
+	MacvlanParent string `json:"macvlan_parent"`
+	// MacvlanFallback attaches SR-IOV containers with macvlan when no VF
+	// is free, rather than failing with ErrDeviceUnavailable
+	MacvlanFallback bool `json:"macvlan_fallback"`
+}
+
+func (c DeviceConfig) validate(config NetworkConfig) error {
+	seen := make(map[string]bool)
+	for _, pf := range c.PhysicalFunctions {
+		if pf == "" || strings.ContainsAny(pf, "/ ") {
+			return fmt.Errorf("%w: physical function %q is not an interface name", ErrInvalidConfig, pf)
+		}
+		if seen[pf] {
+			return fmt.Errorf("%w: physical function %s is listed twice", ErrInvalidConfig, pf)
+		}
+		seen[pf] = true
+	}
+	if c.MacvlanFallback && c.macvlanParent(config) == "" {
+		return fmt.Errorf("%w: macvlan fallback without a parent interface", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// macvlanParent returns the interface macvlan devices are created on,
+// empty when there is none
+func (c DeviceConfig) macvlanParent(config NetworkConfig) string {
+	switch {
+	case c.MacvlanParent != "":
+		return c.MacvlanParent
+	case len(c.PhysicalFunctions) > 0:
+		return c.PhysicalFunctions[0]
+	default:
+		return config.Interface
+	}
+}
+
+// DeviceAttachment is the device of a directly attached container
+type DeviceAttachment struct {
+	// Parent is the physical function of a VF, or the parent of a macvlan
+	Parent string `json:"parent"`
+	// VF is the index of the virtual function on Parent
+	VF int `json:"vf,omitempty"`
+	// PCIAddress is that of the virtual function, e.g. "0000:3b:02.1",
+	// which finds it wherever it is
+	PCIAddress string `json:"pci_address,omitempty"`
+	// HostName is the name of the virtual function in the host namespace,
+	// which it gets back when released
+	HostName string `json:"host_name,omitempty"`
+}
+
+// VirtualFunction is a virtual function of a physical function
+type VirtualFunction struct {
+	// PF is the physical function and Index the VF's number on it
+	PF    string `json:"pf"`
+	Index int    `json:"index"`
+	// PCIAddress is the VF's PCI address, e.g. "0000:3b:02.1"
+	PCIAddress string `json:"pci_address"`
+	// Name is the VF's interface in the host namespace, empty while it is
+	// in a container or bound to a driver without one, such as vfio-pci
+	Name string `json:"name,omitempty"`
+	// ContainerID is the container holding the VF, if any
+	ContainerID string `json:"container_id,omitempty"`
+}
+
+// VirtualFunctions returns the virtual functions of the configured
+// physical functions, ordered by PF and index, with the containers
+// holding them
+func (nm *NetworkManager) VirtualFunctions() ([]VirtualFunction, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	var out []VirtualFunction
+	for _, pf := range nm.config.Devices.PhysicalFunctions {
+		vfs, err := discoverVFs(pf)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, vfs...)
+	}
+	holders := nm.vfHolders()
+	for i := range out {
+		out[i].ContainerID = holders[out[i].PCIAddress]
+	}
+	return out, nil
+}
+
+// vfHolders returns the containers holding VFs by PCI address. Callers
+// must hold nm.mu.
+func (nm *NetworkManager) vfHolders() map[string]string {
+	holders := make(map[string]string)
+	for id, cn := range nm.containers {
+		if cn.Device != nil && cn.Device.PCIAddress != "" {
+			holders[cn.Device.PCIAddress] = id
+		}
+	}
+	return holders
+}
+
+// claimVF picks the free virtual function with the lowest index, taking
+// the physical functions in order. VFs without an interface in the host
+// namespace are passed over. Callers must hold nm.mu.
+func (nm *NetworkManager) claimVF() (VirtualFunction, error) {
+	if len(nm.config.Devices.PhysicalFunctions) == 0 {
+		return VirtualFunction{}, fmt.Errorf("%w: no physical functions configured", ErrDeviceUnavailable)
+	}
+	holders := nm.vfHolders()
+	for _, pf := range nm.config.Devices.PhysicalFunctions {
+		vfs, err := discoverVFs(pf)
+		if err != nil {
+			return VirtualFunction{}, err
+		}
+		for _, vf := range vfs {
+			if _, held := holders[vf.PCIAddress]; !held && vf.Name != "" {
+				return vf, nil
+			}
+		}
+	}
+	return VirtualFunction{}, fmt.Errorf("%w: all virtual functions are in use", ErrDeviceUnavailable)
+}
+
+// discoverVFs lists the virtual functions of pf from sysfs, where each is
+// a virtfn<index> link to its PCI device
+func discoverVFs(pf string) ([]VirtualFunction, error) {
+	dev := filepath.Join(sysClassNet, pf, "device")
+	data, err := os.ReadFile(filepath.Join(dev, "sriov_numvfs"))
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, err := os.Stat(filepath.Join(sysClassNet, pf)); err != nil {
+			return nil, fmt.Errorf("%w: physical function %s: %v", ErrInvalidInterface, pf, err)
+		}
+		return nil, fmt.Errorf("%w: %s is not SR-IOV capable", ErrInvalidInterface, pf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sriov_numvfs of %s: %w", pf, err)
+	}
+
+	vfs := make([]VirtualFunction, 0, n)
+	for i := 0; i < n; i++ {
+		link, err := os.Readlink(filepath.Join(dev, fmt.Sprintf("virtfn%d", i)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to find VF %d of %s: %w", i, pf, err)
+		}
+		vf := VirtualFunction{PF: pf, Index: i, PCIAddress: filepath.Base(link)}
+		vf.Name = pciNetdev(vf.PCIAddress)
+		vfs = append(vfs, vf)
+	}
+	return vfs, nil
+}
+
+// pciNetdev returns the interface of the PCI device at addr in this
+// network namespace, empty if there is none
+func pciNetdev(addr string) string {
+	entries, err := os.ReadDir(filepath.Join("/sys/bus/pci/devices", addr, "net"))
+	if err != nil {
+		return ""
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// checkAttachment fails with ErrDirectAttachment when cn has no host veth
+// for what to act on
+func (cn *ContainerNetwork) checkAttachment(what string) error {
+	if cn.Attachment.direct() {
+		return fmt.Errorf("%w: %s", ErrDirectAttachment, what)
+	}
+	return nil
+}
+
+// checkAttachmentSpec checks the attachment of spec and the options that
+// come with it. Callers must hold nm.mu.
+func (nm *NetworkManager) checkAttachmentSpec(spec ContainerNetworkSpec) error {
+	switch spec.Attachment {
+	case "", AttachmentVeth:
+		return nil
+	case AttachmentSRIOV:
+		if len(nm.config.Devices.PhysicalFunctions) == 0 && !nm.config.Devices.MacvlanFallback {
+			return fmt.Errorf("%w: no physical functions configured", ErrDeviceUnavailable)
+		}
+	case AttachmentMacvlan:
+		if nm.config.Devices.MacvlanParent == "" {
+			return fmt.Errorf("%w: no macvlan parent configured", ErrDeviceUnavailable)
+		}
+	default:
+		return fmt.Errorf("%w: unknown attachment %q", ErrInvalidAttachment, spec.Attachment)
+	}
+	if err := nm.checkPrivileged("direct attachments"); err != nil {
+		return err
+	}
+	if spec.IngressBps > 0 || spec.EgressBps > 0 {
+		return fmt.Errorf("%w: bandwidth limits need a veth", ErrInvalidAttachment)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// hostNetnsPath is the network namespace of the manager, which released
+// virtual functions are moved back to
+const hostNetnsPath = "/proc/self/ns/net"
+
+// setupDevice moves a virtual function, or else a new macvlan, into the
+// container and addresses it like the container side of a veth. The VF is
+// recorded in the state before it is moved, so a restart after a crash
+// can find it and give it back.
+func (nm *NetworkManager) setupDevice(j *opJournal, spec ContainerNetworkSpec, cn *ContainerNetwork) error {
+	ns, err := openNetns(spec)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	var addrs []containerAddr
+	for _, addr := range cn.addrs() {
+		addrs = append(addrs, containerAddr{addr: addr, gateway: nm.gateway(addr)})
+	}
+	mac, err := net.ParseMAC(cn.MAC)
+	if err != nil {
+		return err
+	}
+	tmpName := tmpLinkName(nm.instance, cn.ContainerID)
+
+	if cn.Attachment == AttachmentSRIOV {
+		err := j.run("claim virtual function", func() error {
+			vf, err := nm.claimVF()
+			if errors.Is(err, ErrDeviceUnavailable) && nm.config.Devices.MacvlanFallback {
+				j.log.Info("Falling back to macvlan", "reason", err)
+				cn.Attachment = AttachmentMacvlan
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			cn.Device = &DeviceAttachment{Parent: vf.PF, VF: vf.Index, PCIAddress: vf.PCIAddress, HostName: vf.Name}
+			return nm.saveState()
+		}, func() error {
+			cn.Device = nil
+			return nm.saveState()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if cn.Attachment == AttachmentSRIOV {
+		err = j.run("move virtual function", func() error {
+			return moveVF(ns, cn.Device, mac, tmpName)
+		}, func() error {
+			return nm.releaseVF(cn)
+		})
+	} else {
+		parent := nm.config.Devices.MacvlanParent
+		cn.Device = &DeviceAttachment{Parent: parent}
+		// Deleting the macvlan removes every address and route the later
+		// steps add
+		err = j.run("create macvlan", func() error {
+			return createMacvlan(ns, parent, tmpName, nm.containerMTU(cn))
+		}, func() error {
+			return deleteMacvlan(cn, tmpName)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return j.run("configure container interface", func() error {
+		return configureContainerSide(ns, tmpName, addrs, mac, nm.containerMTU(cn))
+	}, nil)
+}
+
+// moveVF gives the virtual function of d the MAC of the container and
+// moves it into ns as tmpName, for configureContainerSide to rename
+func moveVF(ns netns.NsHandle, d *DeviceAttachment, mac net.HardwareAddr, tmpName string) error {
+	pf, err := netlink.LinkByName(d.Parent)
+	if err != nil {
+		return fmt.Errorf("failed to find physical function %s: %w", d.Parent, err)
+	}
+	// Drivers that check the source MAC of VFs only pass the one the PF
+	// assigned
+	if err := netlink.LinkSetVfHardwareAddr(pf, d.VF, mac); err != nil {
+		return fmt.Errorf("failed to set MAC of VF %d of %s: %w", d.VF, d.Parent, err)
+	}
+	name := pciNetdev(d.PCIAddress)
+	if name == "" {
+		return fmt.Errorf("%w: VF %s has no interface in the host namespace", ErrDeviceUnavailable, d.PCIAddress)
+	}
+	vf, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetDown(vf); err != nil {
+		return fmt.Errorf("failed to bring down %s: %w", name, err)
+	}
+	if err := netlink.LinkSetName(vf, tmpName); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", name, err)
+	}
+	if err := netlink.LinkSetNsFd(vf, int(ns)); err != nil {
+		return fmt.Errorf("failed to move %s into container namespace: %w", name, err)
+	}
+	return nil
+}
+
+// releaseVF moves the virtual function of cn back to the host namespace
+// under its old name, down. A VF already in the host namespace, as the
+// kernel returns VFs of namespaces that are destroyed, is only renamed.
+func (nm *NetworkManager) releaseVF(cn *ContainerNetwork) error {
+	d := cn.Device
+	if d == nil || d.PCIAddress == "" {
+		return nil
+	}
+	if name := pciNetdev(d.PCIAddress); name != "" {
+		return restoreVF(name, d.HostName)
+	}
+
+	h, err := containerHandle(cn)
+	if err != nil {
+		// With the namespace gone the kernel moved the VF back to the
+		// host's, where it would have been found unless its driver has
+		// no interface
+		return nil
+	}
+	defer h.Delete()
+	var vf netlink.Link
+	for _, name := range []string{containerIfName, tmpLinkName(nm.instance, cn.ContainerID)} {
+		if vf, err = h.LinkByName(name); err == nil {
+			break
+		}
+	}
+	if vf == nil {
+		return nil
+	}
+	host, err := netns.GetFromPath(hostNetnsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open host netns: %w", err)
+	}
+	defer host.Close()
+	if err := h.LinkSetDown(vf); err != nil {
+		return fmt.Errorf("failed to bring down VF %s: %w", d.PCIAddress, err)
+	}
+	// Renaming first keeps the container's eth0 from clashing with the
+	// host's
+	if d.HostName != "" {
+		if err := h.LinkSetName(vf, d.HostName); err != nil {
+			return fmt.Errorf("failed to rename VF %s: %w", d.PCIAddress, err)
+		}
+	}
+	if err := h.LinkSetNsFd(vf, int(host)); err != nil {
+		return fmt.Errorf("failed to move VF %s to the host namespace: %w", d.PCIAddress, err)
+	}
+	return nil
+}
+
+// restoreVF renames the VF interface name in the host namespace to
+// hostName, if known, and brings it down
+func restoreVF(name, hostName string) error {
+	vf, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetDown(vf); err != nil {
+		return fmt.Errorf("failed to bring down %s: %w", name, err)
+	}
+	if hostName == "" || hostName == name {
+		return nil
+	}
+	if err := netlink.LinkSetName(vf, hostName); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", name, hostName, err)
+	}
+	return nil
+}
+
+// createMacvlan creates a bridge mode macvlan on parent and moves it into
+// ns as tmpName. One left behind by an earlier attempt is replaced.
+func createMacvlan(ns netns.NsHandle, parent, tmpName string, mtu int) error {
+	if err := deleteVeth(tmpName); err != nil {
+		return err
+	}
+	p, err := netlink.LinkByName(parent)
+	if err != nil {
+		return fmt.Errorf("failed to find macvlan parent %s: %w", parent, err)
+	}
+	mv := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{Name: tmpName, ParentIndex: p.Attrs().Index, MTU: mtu},
+		// Containers on the same parent reach each other without a trip
+		// to the switch
+		Mode: netlink.MACVLAN_MODE_BRIDGE,
+	}
+	if err := netlink.LinkAdd(mv); err != nil {
+		return fmt.Errorf("failed to create macvlan on %s: %w", parent, err)
+	}
+	link, err := netlink.LinkByName(tmpName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		netlink.LinkDel(link)
+		return fmt.Errorf("failed to move macvlan into container namespace: %w", err)
+	}
+	return nil
+}
+
+// deleteMacvlan removes the macvlan of cn from its namespace. One that
+// didn't make it there is removed from the host's. The macvlan is gone
+// with the namespace.
+func deleteMacvlan(cn *ContainerNetwork, tmpName string) error {
+	if err := deleteVeth(tmpName); err != nil {
+		return err
+	}
+	h, err := containerHandle(cn)
+	if err != nil {
+		return nil
+	}
+	defer h.Delete()
+	for _, name := range []string{containerIfName, tmpName} {
+		link, err := h.LinkByName(name)
+		if err != nil || link.Type() != "macvlan" {
+			continue
+		}
+		if err := h.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete macvlan of %s: %w", cn.ContainerID, err)
+		}
+	}
+	return nil
+}
+
+// teardownDevice gives back the VF of a directly attached container, or
+// deletes its macvlan
+func (nm *NetworkManager) teardownDevice(cn *ContainerNetwork) error {
+	if cn.Attachment == AttachmentSRIOV {
+		return nm.releaseVF(cn)
+	}
+	return deleteMacvlan(cn, tmpLinkName(nm.instance, cn.ContainerID))
+}
+
+// adoptDevice reports whether the device of a directly attached container
+// restored from saved state is still in its namespace. A VF that isn't is
+// given back.
+func (nm *NetworkManager) adoptDevice(cn *ContainerNetwork) bool {
+	h, err := containerHandle(cn)
+	if err == nil {
+		_, err = h.LinkByName(containerIfName)
+		h.Delete()
+	}
+	if err == nil {
+		return true
+	}
+	if err := nm.teardownDevice(cn); err != nil {
+		nm.log.Warn("Failed to release device of container", "container_id", cn.ContainerID, "error", err)
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/dhcp"
+)
+
+// dhcpRenewCheck is how often leases are checked for being due to renew
+const dhcpRenewCheck = 10 * time.Second
+
+// dhcpMinRetry is the least time before a failed renewal is retried
+const dhcpMinRetry = time.Minute
+
+// DHCPConfig leases the IPv4 addresses of containers from a DHCP server,
+// relaying for them from an address of the node. The server must hand out
+// addresses of the IPv4 CIDR to requests selecting the subnet of its
+// gateway (RFC 3011). Creating a container waits for its lease, which is
+// renewed for as long as the container lives, and released with it.
+type DHCPConfig struct {
+	// Server is the address of the DHCP server, or of a relay towards it,
+	// with the port, 67 by default
+	Server string `json:"server"`
+	// RelayAddress is the address of the node the server replies to,
+	// by default the first IPv4 address of Interface
+	RelayAddress string `json:"relay_address"`
+	// Timeout bounds each exchange with the server, dhcp.DefaultTimeout
+	// when zero
+	Timeout time.Duration `json:"timeout"`
+}
+
+func (c DHCPConfig) validate(config NetworkConfig) error {
+	if _, err := c.server(); err != nil {
+		return fmt.Errorf("%w: DHCP server: %v", ErrInvalidConfig, err)
+	}
+	if c.RelayAddress == "" && config.Interface == "" {
+		return fmt.Errorf("%w: DHCP needs a relay address or an interface to take it from", ErrInvalidConfig)
+	}
+	if c.RelayAddress != "" {
+		if addr, err := netip.ParseAddr(c.RelayAddress); err != nil || !addr.Is4() {
+			return fmt.Errorf("%w: DHCP relay address %q is not an IPv4 address", ErrInvalidConfig, c.RelayAddress)
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("%w: DHCP timeout must not be negative", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// server parses Server, with or without a port
+func (c DHCPConfig) server() (netip.AddrPort, error) {
+	server, err := netip.ParseAddrPort(c.Server)
+	if err != nil {
+		var addr netip.Addr
+		if addr, err = netip.ParseAddr(c.Server); err != nil {
+			return netip.AddrPort{}, fmt.Errorf("%q is not an address", c.Server)
+		}
+		server = netip.AddrPortFrom(addr, dhcp.Port)
+	}
+	if !server.Addr().Is4() {
+		return netip.AddrPort{}, fmt.Errorf("%s is not an IPv4 address", server.Addr())
+	}
+	return server, nil
+}
+
+// relayAddr returns RelayAddress, or else the first IPv4 address of iface
+func (c DHCPConfig) relayAddr(iface string) (netip.Addr, error) {
+	if c.RelayAddress != "" {
+		return netip.ParseAddr(c.RelayAddress)
+	}
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			if addr, ok := netip.AddrFromSlice(ipnet.IP); ok && addr.Unmap().Is4() && !addr.IsLinkLocalUnicast() {
+				return addr.Unmap(), nil
+			}
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("%s has no IPv4 address", iface)
+}
+
+// dhcpLease is a lease of a container
+type dhcpLease struct {
+	req   dhcp.Request
+	lease dhcp.Lease
+	// renewAt is when the lease is next renewed, zero for leases that
+	// don't expire
+	renewAt time.Time
+}
+
+// dhcpIPAM is the IPAMDHCP backend
+type dhcpIPAM struct {
+	client *dhcp.Client
+	log    *slog.Logger
+
+	mu sync.Mutex
+	// leases holds the leases of containers by container ID
+	leases map[string]*dhcpLease
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDHCPIPAM returns an IPAM backend leasing IPv4 addresses from the DHCP
+// server of config, relaying from the first IPv4 address of iface unless
+// config sets one
+func NewDHCPIPAM(config DHCPConfig, iface string, logger *slog.Logger) (IPAM, error) {
+	server, err := config.server()
+	if err != nil {
+		return nil, fmt.Errorf("%w: DHCP server: %v", ErrInvalidConfig, err)
+	}
+	relay, err := config.relayAddr(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find DHCP relay address: %w", err)
+	}
+	client, err := dhcp.NewClient(dhcp.Config{Server: server, RelayAddr: relay, Timeout: config.Timeout})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Leasing container addresses over DHCP", "server", server, "relay", relay)
+	d := &dhcpIPAM{
+		client: client,
+		log:    logger,
+		leases: make(map[string]*dhcpLease),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go d.renewLoop()
+	return d, nil
+}
+
+func (d *dhcpIPAM) Name() string { return IPAMDHCP }
+
+func (d *dhcpIPAM) Manages(pool netip.Prefix) bool { return pool.Addr().Is4() }
+
+func (d *dhcpIPAM) Allocate(ctx context.Context, req IPAMRequest) (netip.Addr, error) {
+	d.mu.Lock()
+	l, ok := d.leases[req.ContainerID]
+	d.mu.Unlock()
+	if ok {
+		return l.lease.Addr, nil
+	}
+
+	r := dhcpRequest(req)
+	lease, err := d.client.Acquire(ctx, r)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w: %w", ErrIPAMUnavailable, err)
+	}
+	if req.Addr.IsValid() && lease.Addr != req.Addr {
+		if err := d.client.Release(r, lease); err != nil {
+			d.log.Warn("Failed to release lease", "container_id", req.ContainerID, "address", lease.Addr, "error", err)
+		}
+		return netip.Addr{}, fmt.Errorf("%w: DHCP server leased %s instead of %s", ErrAddressInUse, lease.Addr, req.Addr)
+	}
+	d.mu.Lock()
+	d.leases[req.ContainerID] = newDHCPLease(r, lease)
+	d.mu.Unlock()
+	return lease.Addr, nil
+}
+
+// Restore renews the lease of req.Addr on the next check, not knowing
+// when it expires
+func (d *dhcpIPAM) Restore(ctx context.Context, req IPAMRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := dhcpRequest(req)
+	d.leases[req.ContainerID] = &dhcpLease{req: r, lease: dhcp.Lease{Addr: req.Addr}, renewAt: time.Now()}
+	return nil
+}
+
+func (d *dhcpIPAM) Release(ctx context.Context, req IPAMRequest) error {
+	d.mu.Lock()
+	l, ok := d.leases[req.ContainerID]
+	delete(d.leases, req.ContainerID)
+	d.mu.Unlock()
+	if !ok {
+		l = &dhcpLease{req: dhcpRequest(req), lease: dhcp.Lease{Addr: req.Addr}}
+	}
+	return d.client.Release(l.req, l.lease)
+}
+
+// List returns the leases held, which the DHCP server may have forgotten
+func (d *dhcpIPAM) List(ctx context.Context, pool netip.Prefix) ([]IPAMAllocation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []IPAMAllocation
+	for id, l := range d.leases {
+		if pool.Contains(l.lease.Addr) {
+			out = append(out, IPAMAllocation{ContainerID: id, Addr: l.lease.Addr})
+		}
+	}
+	return out, nil
+}
+
+// Close stops renewing leases, which are kept for the containers to hold
+// on to their addresses across restarts
+func (d *dhcpIPAM) Close() error {
+	close(d.stop)
+	<-d.done
+	return d.client.Close()
+}
+
+// renewLoop renews the leases due until Close is called
+func (d *dhcpIPAM) renewLoop() {
+	defer close(d.done)
+	ticker := time.NewTicker(dhcpRenewCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.renewDue()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// renewDue renews the leases due. Renewals declined by the server are
+// retried as new leases of the same address, and failing ones again after
+// half the time the lease has left.
+func (d *dhcpIPAM) renewDue() {
+	now := time.Now()
+	due := make(map[string]dhcpLease)
+	d.mu.Lock()
+	for id, l := range d.leases {
+		if !l.renewAt.IsZero() && !l.renewAt.After(now) {
+			due[id] = *l
+		}
+	}
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for id, l := range due {
+		lease, err := d.client.Renew(ctx, l.req, l.lease)
+		if errors.Is(err, dhcp.ErrNAK) {
+			r := l.req
+			r.Addr = l.lease.Addr
+			if lease, err = d.client.Acquire(ctx, r); err == nil && lease.Addr != l.lease.Addr {
+				if err := d.client.Release(r, lease); err != nil {
+					d.log.Warn("Failed to release lease", "container_id", id, "address", lease.Addr, "error", err)
+				}
+				err = fmt.Errorf("server leased %s in its place", lease.Addr)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		d.mu.Lock()
+		cur, ok := d.leases[id]
+		switch {
+		case !ok || cur.lease.Obtained != l.lease.Obtained:
+			// Released or renewed meanwhile
+		case err == nil:
+			d.leases[id] = newDHCPLease(l.req, lease)
+		default:
+			retry := dhcpMinRetry
+			if expires := l.lease.Expires(); !expires.IsZero() {
+				retry = max(retry, time.Until(expires)/2)
+			}
+			cur.renewAt = time.Now().Add(retry)
+			if expires := l.lease.Expires(); !expires.IsZero() && expires.Before(time.Now()) {
+				d.log.Error("DHCP lease expired, the server may lease the address to another host",
+					"container_id", id, "address", l.lease.Addr, "error", err)
+			} else {
+				d.log.Warn("Failed to renew DHCP lease", "container_id", id, "address", l.lease.Addr, "retry", retry, "error", err)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// newDHCPLease returns the lease of req, due to renew as the server set
+func newDHCPLease(req dhcp.Request, lease dhcp.Lease) *dhcpLease {
+	l := &dhcpLease{req: req, lease: lease}
+	if lease.Duration > 0 {
+		l.renewAt = lease.Obtained.Add(lease.Renew)
+	}
+	return l
+}
+
+// dhcpRequest returns the DHCP request of req. The container is identified
+// by its ID; without a MAC yet, its hardware address is derived from the
+// ID too.
+func dhcpRequest(req IPAMRequest) dhcp.Request {
+	mac, err := ParseMAC(req.MAC)
+	if err != nil || mac == nil {
+		sum := sha256.Sum256([]byte(req.ContainerID))
+		mac = net.HardwareAddr{0x0a, 0x59, sum[0], sum[1], sum[2], sum[3]}
+	}
+	r := dhcp.Request{
+		// Type 0 is an identifier other than a hardware address
+		ClientID:     append([]byte{0}, req.ContainerID...),
+		HardwareAddr: mac,
+		Subnet:       req.Gateway,
+		Hostname:     req.Hostname,
+	}
+	if req.Addr.Is4() {
+		r.Addr = req.Addr
+	}
+	return r
+}
@@ -0,0 +1,109 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// drainPollInterval is how often draining counts the connections left
+const drainPollInterval = 500 * time.Millisecond
+
+// DrainContainerNetwork readies a container for deletion without resetting
+// the connections it serves: new TCP connections to it are rejected with
+// a reset, it is removed from the backends of services, and the call
+// waits until it has no tracked connections left or grace expires. It
+// returns the connections left then, which deleting the container resets.
+// progress, when set, is called with the connections left whenever their
+// number changes, starting with the number when draining started.
+//
+// Connections are those the XDP router tracks, or the kernel without XDP.
+// A container stays draining until deleted, including when ctx ends the
+// wait early with its error; draining isn't kept across restarts. Directly
+// attached and rootless containers can't be drained.
+func (nm *NetworkManager) DrainContainerNetwork(ctx context.Context, containerID string, grace time.Duration, progress func(remaining int)) (int, error) {
+	if err := nm.startDrain(ctx, containerID, grace); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	remaining, err := waitDrained(ctx, grace, drainPollInterval, func() (int, error) {
+		nm.mu.Lock()
+		defer nm.mu.Unlock()
+		cn, ok := nm.containers[containerID]
+		if !ok {
+			return 0, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+		}
+		return nm.countConnections(cn)
+	}, progress)
+	if err != nil {
+		return remaining, err
+	}
+	nm.logger(ctx).Info("Drained container network", "container_id", containerID,
+		"remaining", remaining, "elapsed", time.Since(start).Round(time.Millisecond))
+	return remaining, nil
+}
+
+// startDrain rejects new connections to containerID and removes it from
+// service backends
+func (nm *NetworkManager) startDrain(ctx context.Context, containerID string, grace time.Duration) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	if err := cn.checkAttachment("draining"); err != nil {
+		return err
+	}
+	if err := nm.checkPrivileged("draining"); err != nil {
+		return err
+	}
+
+	logger := nm.logger(ctx).With("container_id", containerID)
+	if !cn.draining {
+		logger.Info("Draining container network", "grace", grace)
+		cn.draining = true
+		if err := nm.applyDraining(cn); err != nil {
+			cn.draining = false
+			// Rules of other draining containers stay as they were
+			return fmt.Errorf("failed to reject new connections: %w", err)
+		}
+	}
+	if err := nm.removeServiceBackend(logger, containerID); err != nil {
+		return fmt.Errorf("failed to remove service backend: %w", err)
+	}
+	return nm.saveState()
+}
+
+// waitDrained polls count every interval until it returns 0 or grace
+// expires, returning the last count. progress is called with each count
+// that differs from the one before.
+func waitDrained(ctx context.Context, grace, interval time.Duration, count func() (int, error), progress func(int)) (int, error) {
+	deadline := time.NewTimer(grace)
+	defer deadline.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := -1
+	for {
+		n, err := count()
+		if err != nil {
+			return 0, err
+		}
+		if n != last && progress != nil {
+			progress(n)
+		}
+		last = n
+		if n == 0 {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case <-deadline.C:
+			return n, nil
+		case <-ticker.C:
+		}
+	}
+}
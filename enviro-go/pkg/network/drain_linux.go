@@ -0,0 +1,159 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// nftDrainTable is the inet table rejecting new connections to draining
+// containers
+const nftDrainTable = "enviro-drain"
+
+// applyDraining rejects new connections to cn, or accepts them again,
+// following cn.draining. Callers must hold nm.mu.
+func (nm *NetworkManager) applyDraining(cn *ContainerNetwork) error {
+	if nm.xdp != nil {
+		// The XDP router redirects past the kernel's rules, so it has to
+		// hand the SYNs over
+		if err := nm.xdp.SetDraining(cn.addrs(), cn.draining); err != nil {
+			return err
+		}
+	}
+	if nm.userspace != nil {
+		// So does the userspace forwarder
+		nm.userspace.SetDraining(cn.addrs(), cn.draining)
+	}
+	return nm.syncDrain()
+}
+
+// syncDrain rebuilds the drain table from the draining containers in one
+// atomic batch, removing it when there are none. SYNs to their addresses
+// are answered with a reset, whether forwarded or from the host. Callers
+// must hold nm.mu.
+func (nm *NetworkManager) syncDrain() error {
+	var addrs []netip.Addr
+	for _, cn := range nm.containers {
+		if cn.draining {
+			addrs = append(addrs, cn.addrs()...)
+		}
+	}
+
+	conn := &nftables.Conn{}
+	table := resetTable(conn, nm.nftTable(nftDrainTable), nftables.TableFamilyINet)
+	if len(addrs) > 0 {
+		conn.AddTable(table)
+		for _, hook := range []*nftables.ChainHook{nftables.ChainHookForward, nftables.ChainHookOutput} {
+			name := "forward"
+			if hook == nftables.ChainHookOutput {
+				name = "output"
+			}
+			chain := conn.AddChain(&nftables.Chain{
+				Name:     name,
+				Table:    table,
+				Type:     nftables.ChainTypeFilter,
+				Hooknum:  hook,
+				Priority: nftables.ChainPriorityFilter,
+			})
+			for _, addr := range addrs {
+				conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: drainExprs(addr)})
+			}
+		}
+	}
+	return conn.Flush()
+}
+
+// clearDrain removes the drain table of an earlier run, as draining isn't
+// kept across restarts
+func (nm *NetworkManager) clearDrain() error {
+	conn := &nftables.Conn{}
+	resetTable(conn, nm.nftTable(nftDrainTable), nftables.TableFamilyINet)
+	return conn.Flush()
+}
+
+// drainExprs rejects TCP SYNs to addr with a reset:
+//
+//	meta nfproto ipv4 ip daddr 10.88.0.2 meta l4proto tcp tcp flags & (syn | ack) == syn reject with tcp reset
+func drainExprs(addr netip.Addr) []expr.Any {
+	family, dstOffset := byte(unix.NFPROTO_IPV4), uint32(16)
+	if addr.Is6() {
+		family, dstOffset = unix.NFPROTO_IPV6, 24
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: dstOffset, Len: uint32(addr.BitLen() / 8)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr.AsSlice()},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		// Flags are the 14th byte of the TCP header
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{tcpSYN | tcpACK}, Xor: []byte{0}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{tcpSYN}},
+		&expr.Reject{Type: unix.NFT_REJECT_TCP_RST},
+	}
+}
+
+// countConnections returns how many connections to cn are open. Callers
+// must hold nm.mu.
+func (nm *NetworkManager) countConnections(cn *ContainerNetwork) (int, error) {
+	if nm.xdp != nil {
+		return nm.xdp.countConnections(cn.HostIfindex, nm.config.Conntrack)
+	}
+	return kernelConnections(cn.addrs())
+}
+
+// countConnections returns how many flows to the container behind ifindex
+// are neither reset nor expired. Its replies, and the flows it opens,
+// don't count.
+func (x *xdpProgram) countConnections(ifindex int, cfg ConntrackConfig) (int, error) {
+	now := monotonicNow()
+	n := 0
+	err := x.eachConnection(func(key ctKey, entry ctEntry) {
+		if entry.Ifindex != uint32(ifindex) || key.Dir != ctDirIn || ctStates[entry.State] == ConnClosed {
+			return
+		}
+		if now > entry.LastSeen && time.Duration(now-entry.LastSeen) > cfg.timeout(key.Proto, entry.State) {
+			return
+		}
+		n++
+	})
+	return n, err
+}
+
+// kernelConnections returns how many flows the kernel tracks to addrs as
+// their responder, including those translated to them, that aren't TCP
+// connections already closed
+func kernelConnections(addrs []netip.Addr) (int, error) {
+	n := 0
+	for _, addr := range addrs {
+		family := netlink.InetFamily(unix.AF_INET)
+		if addr.Is6() {
+			family = unix.AF_INET6
+		}
+		flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, family)
+		if err != nil {
+			return 0, err
+		}
+		ip := net.IP(addr.AsSlice())
+		for _, flow := range flows {
+			if !flow.Reverse.SrcIP.Equal(ip) {
+				continue
+			}
+			if tcp, ok := flow.ProtoInfo.(*netlink.ProtoInfoTCP); ok &&
+				(tcp.State == nl.TCP_CONNTRACK_TIME_WAIT || tcp.State == nl.TCP_CONNTRACK_CLOSE) {
+				continue
+			}
+			n++
+		}
+	}
+	return n, nil
+}
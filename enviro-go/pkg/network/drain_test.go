@@ -0,0 +1,90 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWaitDrained(t *testing.T) {
+	errCount := errors.New("count failed")
+	tests := []struct {
+		name string
+		// counts are returned by successive polls, the last one repeating
+		counts   []int
+		countErr error
+		grace    time.Duration
+		cancel   bool
+		want     int
+		wantErr  error
+		// progress are the counts reported
+		progress []int
+	}{
+		{
+			name:     "already drained",
+			counts:   []int{0},
+			grace:    time.Hour,
+			progress: []int{0},
+		},
+		{
+			name:     "drains early",
+			counts:   []int{3, 3, 2, 2, 1, 0},
+			grace:    time.Hour,
+			progress: []int{3, 2, 1, 0},
+		},
+		{
+			name:     "grace expires",
+			counts:   []int{3, 2},
+			grace:    20 * time.Millisecond,
+			want:     2,
+			progress: []int{3, 2},
+		},
+		{
+			name:     "count fails",
+			counts:   []int{3},
+			countErr: errCount,
+			grace:    time.Hour,
+			wantErr:  errCount,
+		},
+		{
+			name:     "canceled",
+			counts:   []int{3},
+			grace:    time.Hour,
+			cancel:   true,
+			want:     3,
+			wantErr:  context.Canceled,
+			progress: []int{3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			polls := 0
+			count := func() (int, error) {
+				if tt.countErr != nil {
+					return 0, tt.countErr
+				}
+				n := tt.counts[min(polls, len(tt.counts)-1)]
+				polls++
+				return n, nil
+			}
+			var progress []int
+			got, err := waitDrained(ctx, tt.grace, time.Millisecond, count, func(n int) {
+				progress = append(progress, n)
+			})
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("waitDrained() = %d, %v, want %d, %v", got, err, tt.want, tt.wantErr)
+			}
+			if !slices.Equal(progress, tt.progress) {
+				t.Errorf("progress = %v, want %v", progress, tt.progress)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Drop audit defaults, see DropAuditConfig
+const (
+	DefaultDropAuditMaxSize    = 100 << 20
+	DefaultDropAuditMaxBackups = 5
+)
+
+// DropAuditConfig writes the drop events of the XDP router to a file for
+// security review. Zero values keep the defaults.
+type DropAuditConfig struct {
+	// Path is the file events are appended to, one JSON object per line;
+	// none are written when empty
+	Path string `json:"path"`
+	// MaxSize rotates the file before it grows past this many bytes
+	MaxSize int64 `json:"max_size"`
+	// MaxBackups is the number of rotated files kept, Path.1 being the
+	// newest; older ones are deleted
+	MaxBackups int `json:"max_backups"`
+}
+
+func (c DropAuditConfig) withDefaults() DropAuditConfig {
+	if c.MaxSize == 0 {
+		c.MaxSize = DefaultDropAuditMaxSize
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = DefaultDropAuditMaxBackups
+	}
+	return c
+}
+
+func (c DropAuditConfig) validate() error {
+	if c.MaxSize < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("%w: drop audit limits must not be negative", ErrInvalidConfig)
+	}
+	if c.Path == "" {
+		return nil
+	}
+	if fi, err := os.Stat(filepath.Dir(c.Path)); err != nil || !fi.IsDir() {
+		return fmt.Errorf("%w: drop audit directory of %s doesn't exist", ErrInvalidConfig, c.Path)
+	}
+	return nil
+}
+
+// auditLog appends drop events to a file, rotating it by size. The file
+// is opened on the first event.
+type auditLog struct {
+	config DropAuditConfig
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newAuditLog(config DropAuditConfig) *auditLog {
+	return &auditLog{config: config}
+}
+
+func (l *auditLog) write(e DropEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil && l.size+int64(len(line)) > l.config.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// open opens the file for appending, readable only by its owner as it
+// reveals the traffic of every container
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// rotate shifts Path.N to Path.N+1, dropping the oldest, and Path to
+// Path.1. The next write opens a new file.
+func (l *auditLog) rotate() error {
+	err := l.f.Close()
+	l.f = nil
+	if err != nil {
+		return err
+	}
+	path, keep := l.config.Path, l.config.MaxBackups
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, keep)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := keep - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
+
+func (l *auditLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,342 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInvalidDropFilter is returned for drop event filters naming an
+// unknown reason
+var ErrInvalidDropFilter = errors.New("network: invalid drop event filter")
+
+// DropReason is why the XDP router dropped a packet
+type DropReason string
+
+const (
+	// DropMalformed is a packet whose headers are cut short
+	DropMalformed DropReason = "malformed"
+	// DropNamespace is traffic between containers of namespaces that
+	// aren't allowed to talk
+	DropNamespace DropReason = "namespace"
+	// DropPolicy is traffic a deny policy matched
+	DropPolicy DropReason = "policy"
+	// DropDefaultPolicy is traffic no policy matched while the default
+	// policy is deny
+	DropDefaultPolicy DropReason = "default_policy"
+	// DropICMPError is an oversized packet the router failed to answer
+	// with an ICMP error
+	DropICMPError DropReason = "icmp_error"
+	// DropFault is a packet dropped by a fault injected with
+	// SetContainerFault
+	DropFault DropReason = "fault"
+	// DropSYNCookie is a SYN to a flooded destination the router failed
+	// to answer with a cookie, see SYNProtectionConfig
+	DropSYNCookie DropReason = "syn_cookie"
+	// DropSpoofed is a frame a container sent from a MAC or address not
+	// its own, see ContainerNetworkSpec.AllowedSources
+	DropSpoofed DropReason = "spoofed"
+	// DropNeighborSpoofed is an ARP or neighbor discovery message a
+	// container sent claiming an address or MAC not its own
+	DropNeighborSpoofed DropReason = "neighbor_spoofed"
+)
+
+// dropReasons are the reasons of the router's DROP_* codes by code
+var dropReasons = map[uint8]DropReason{
+	1: DropMalformed,
+	2: DropNamespace,
+	3: DropPolicy,
+	4: DropICMPError,
+	5: DropFault,
+	6: DropSYNCookie,
+	7: DropSpoofed,
+	8: DropNeighborSpoofed,
+}
+
+// Buffers of drop events: those read from the router but not yet
+// resolved, and those not yet received by each watch. Events beyond
+// them are counted as lost and missed respectively.
+const (
+	dropQueueSize = 4096
+	dropWatchSize = 256
+)
+
+// DropEvent is a packet the XDP router dropped
+type DropEvent struct {
+	Time   time.Time  `json:"time"`
+	Reason DropReason `json:"reason"`
+	// Src and Dst are unset for malformed packets
+	Src netip.Addr `json:"src"`
+	Dst netip.Addr `json:"dst"`
+	// Protocol is the IP protocol, e.g. "tcp", or its number when it has
+	// no name
+	Protocol string `json:"protocol,omitempty"`
+	// Port is the TCP or UDP destination port, 0 for other protocols
+	Port  uint16 `json:"port,omitempty"`
+	Bytes int    `json:"bytes"`
+	// ContainerID is the destination container, and SourceContainerID
+	// the source when it is a container of this node. For DropSpoofed and
+	// DropNeighborSpoofed, SourceContainerID is the container that sent the frame, whatever
+	// its source address.
+	ContainerID       string `json:"container_id,omitempty"`
+	SourceContainerID string `json:"source_container_id,omitempty"`
+	// Policy is the name of the deny policy that matched, for DropPolicy.
+	// It is looked up when the event is read, so policies changed since
+	// the drop may be misattributed.
+	Policy string `json:"policy,omitempty"`
+}
+
+// DropFilter selects drop events; zero fields match any
+type DropFilter struct {
+	// ContainerID matches drops of packets from or to the container
+	ContainerID string
+	Reason      DropReason
+}
+
+// Validate rejects unknown reasons
+func (f DropFilter) Validate() error {
+	switch f.Reason {
+	case "", DropMalformed, DropNamespace, DropPolicy, DropDefaultPolicy, DropICMPError, DropFault, DropSYNCookie, DropSpoofed, DropNeighborSpoofed:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown reason %q", ErrInvalidDropFilter, f.Reason)
+}
+
+func (f DropFilter) match(e DropEvent) bool {
+	if f.ContainerID != "" && f.ContainerID != e.ContainerID && f.ContainerID != e.SourceContainerID {
+		return false
+	}
+	return f.Reason == "" || f.Reason == e.Reason
+}
+
+// DropCount is the number of drops of a reason, and for DropPolicy of a
+// policy
+type DropCount struct {
+	Reason  DropReason
+	Policy  string
+	Packets uint64
+}
+
+// DropStats aggregates the drop events read since the manager started
+type DropStats struct {
+	// Counts are ordered by reason and policy
+	Counts []DropCount
+	// Lost counts the drops whose events were discarded as they were read
+	// too slowly, included in no count
+	Lost uint64
+}
+
+// DropWatch receives drop events as they are read, see WatchDrops
+type DropWatch struct {
+	// C receives the events. It is closed by Close, and when the manager
+	// closes.
+	C <-chan DropEvent
+
+	ch     chan DropEvent
+	filter DropFilter
+	missed atomic.Uint64
+	m      *dropMonitor
+}
+
+// Missed returns how many events were discarded since the previous call
+// as the watch fell behind
+func (w *DropWatch) Missed() uint64 {
+	return w.missed.Swap(0)
+}
+
+// Close stops the watch
+func (w *DropWatch) Close() {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	if _, ok := w.m.watches[w]; ok {
+		delete(w.m.watches, w)
+		close(w.ch)
+	}
+}
+
+// WatchDrops returns a watch receiving the drop events matching filter
+// from now on. It fails with ErrXDPInactive without the router, as the
+// kernel's drops are not reported, and with ErrInvalidDatapath when the
+// router predates drop events.
+func (nm *NetworkManager) WatchDrops(filter DropFilter) (*DropWatch, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if err := nm.checkDropEvents(); err != nil {
+		return nil, err
+	}
+
+	m := nm.drops
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, fmt.Errorf("%w: manager closed", ErrXDPInactive)
+	}
+	w := &DropWatch{ch: make(chan DropEvent, dropWatchSize), filter: filter, m: m}
+	w.C = w.ch
+	m.watches[w] = struct{}{}
+	return w, nil
+}
+
+// DropStats returns the drops counted by reason and policy. It fails like
+// WatchDrops.
+func (nm *NetworkManager) DropStats() (DropStats, error) {
+	if err := nm.checkDropEvents(); err != nil {
+		return DropStats{}, err
+	}
+	lost, err := nm.readDropsLost()
+	if err != nil {
+		return DropStats{}, err
+	}
+
+	m := nm.drops
+	m.mu.Lock()
+	stats := DropStats{Lost: lost + m.lost.Load()}
+	for key, n := range m.counts {
+		stats.Counts = append(stats.Counts, DropCount{Reason: key.reason, Policy: key.policy, Packets: n})
+	}
+	m.mu.Unlock()
+	sort.Slice(stats.Counts, func(i, j int) bool {
+		a, b := stats.Counts[i], stats.Counts[j]
+		if a.Reason != b.Reason {
+			return a.Reason < b.Reason
+		}
+		return a.Policy < b.Policy
+	})
+	return stats, nil
+}
+
+// dropRecord mirrors struct drop_event in bpf/container_router.c
+type dropRecord struct {
+	Timestamp uint64
+	Src       [16]byte
+	Dst       [16]byte
+	Ifindex   uint32
+	Len       uint32
+	Port      [2]byte
+	Proto     uint8
+	Reason    uint8
+	Pad       [4]byte
+}
+
+type dropKey struct {
+	reason DropReason
+	policy string
+}
+
+// dropMonitor resolves the drop events read from the router, counts them
+// and hands them to the watches and the audit log. Events are queued as
+// they are read, since resolving them waits for the manager's lock.
+type dropMonitor struct {
+	queue chan dropRecord
+	stop  chan struct{}
+	done  chan struct{}
+	// lost counts the events the queue had no room for
+	lost  atomic.Uint64
+	audit *auditLog
+	log   *LogThrottle
+
+	mu      sync.Mutex
+	watches map[*DropWatch]struct{}
+	counts  map[dropKey]uint64
+	running bool
+	closed  bool
+}
+
+func newDropMonitor(config DropAuditConfig, log *LogThrottle) *dropMonitor {
+	m := &dropMonitor{
+		queue:   make(chan dropRecord, dropQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		log:     log,
+		watches: make(map[*DropWatch]struct{}),
+		counts:  make(map[dropKey]uint64),
+	}
+	if config.Path != "" {
+		m.audit = newAuditLog(config.withDefaults())
+	}
+	return m
+}
+
+// enqueue queues rec for resolving without blocking
+func (m *dropMonitor) enqueue(rec dropRecord) {
+	select {
+	case m.queue <- rec:
+	default:
+		m.lost.Add(1)
+	}
+}
+
+// start resolves the queued events with resolve and publishes them until
+// close is called
+func (m *dropMonitor) start(resolve func(dropRecord) DropEvent) {
+	m.mu.Lock()
+	m.running = true
+	m.mu.Unlock()
+	go func() {
+		defer close(m.done)
+		for {
+			select {
+			case rec := <-m.queue:
+				m.publish(resolve(rec))
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *dropMonitor) publish(e DropEvent) {
+	m.mu.Lock()
+	m.counts[dropKey{reason: e.Reason, policy: e.Policy}]++
+	for w := range m.watches {
+		if !w.filter.match(e) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+			w.missed.Add(1)
+		}
+	}
+	m.mu.Unlock()
+
+	m.log.Debugf("drop", e.ContainerID, "Dropped %s packet from %s to %s port %d: %s %s",
+		e.Protocol, e.Src, e.Dst, e.Port, e.Reason, e.Policy)
+	if m.audit != nil {
+		if err := m.audit.write(e); err != nil {
+			m.log.Logf("drop_audit", "", "Failed to write drop audit log: %v", err)
+		}
+	}
+}
+
+// close stops resolving events, ends the watches and closes the audit log
+func (m *dropMonitor) close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	running := m.running
+	m.mu.Unlock()
+
+	close(m.stop)
+	if running {
+		<-m.done
+	}
+	m.mu.Lock()
+	for w := range m.watches {
+		delete(m.watches, w)
+		close(w.ch)
+	}
+	m.mu.Unlock()
+	if m.audit != nil {
+		return m.audit.close()
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// perfDropBuffer is the size of the per-CPU buffers of drop_events_perf,
+// which together hold about as many events as drop_events
+const perfDropBuffer = 64 * 1024
+
+// startDropReader hands each event of drop_events, or drop_events_perf on
+// kernels without ring buffers, to onDrop, which must not block, until
+// stopDropReader. Routers without drop events are left alone, but onDrop
+// is kept for Upgrade to start reading those of a newer one.
+func (x *xdpProgram) startDropReader(onDrop func(dropRecord)) error {
+	x.onDrop = onDrop
+	var read func() ([]byte, error)
+	switch {
+	case x.dropEvents != nil:
+		r, err := ringbuf.NewReader(x.dropEvents)
+		if err != nil {
+			return err
+		}
+		x.drops = r
+		read = func() ([]byte, error) {
+			rec, err := r.Read()
+			return rec.RawSample, err
+		}
+	case x.dropEventsPerf != nil:
+		r, err := perf.NewReader(x.dropEventsPerf, perfDropBuffer)
+		if err != nil {
+			return err
+		}
+		x.drops = r
+		read = func() ([]byte, error) {
+			rec, err := r.Read()
+			x.perfLost.Add(rec.LostSamples)
+			return rec.RawSample, err
+		}
+	default:
+		return nil
+	}
+	x.dropsDone = make(chan struct{})
+	go func() {
+		defer close(x.dropsDone)
+		for {
+			sample, err := read()
+			// Both readers fail with os.ErrClosed once closed
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			if err != nil || len(sample) < binary.Size(dropRecord{}) {
+				continue
+			}
+			onDrop(decodeAs[dropRecord](sample))
+		}
+	}()
+	return nil
+}
+
+// stopDropReader stops the reader of startDropReader
+func (x *xdpProgram) stopDropReader() {
+	if x.drops == nil {
+		return
+	}
+	x.drops.Close()
+	<-x.dropsDone
+	x.drops = nil
+}
+
+// DropsLost returns the drops whose events didn't fit in drop_events,
+// summed across CPUs, or that the reader of drop_events_perf missed
+func (x *xdpProgram) DropsLost() (uint64, error) {
+	n := x.perfLost.Load()
+	if x.dropEventsLost == nil {
+		return n, nil
+	}
+	var perCPU []uint64
+	if err := x.dropEventsLost.Lookup(uint32(0), &perCPU); err != nil {
+		return 0, err
+	}
+	for _, v := range perCPU {
+		n += v
+	}
+	return n, nil
+}
+
+// startDropEvents reads the drop events of the router into nm.drops
+func (nm *NetworkManager) startDropEvents() {
+	nm.drops.start(nm.resolveDrop)
+	if err := nm.xdp.startDropReader(nm.drops.enqueue); err != nil {
+		nm.log.Warn("Failed to read drop events", "error", err)
+	}
+}
+
+// checkDropEvents fails unless the router reports drop events
+func (nm *NetworkManager) checkDropEvents() error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.xdp == nil {
+		return fmt.Errorf("%w: drop events are reported by the XDP router", ErrXDPInactive)
+	}
+	if nm.xdp.dropEvents == nil && nm.xdp.dropEventsPerf == nil {
+		return fmt.Errorf("%w: router has no drop events", ErrInvalidDatapath)
+	}
+	return nil
+}
+
+func (nm *NetworkManager) readDropsLost() (uint64, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.xdp == nil {
+		return 0, nil
+	}
+	return nm.xdp.DropsLost()
+}
+
+// resolveDrop turns rec into an event, naming the containers and the
+// policy involved as they are now
+func (nm *NetworkManager) resolveDrop(rec dropRecord) DropEvent {
+	e := DropEvent{
+		Time:   time.Now(),
+		Reason: dropReasons[rec.Reason],
+		Bytes:  int(rec.Len),
+	}
+	if now := monotonicNow(); rec.Timestamp < now {
+		e.Time = e.Time.Add(-time.Duration(now - rec.Timestamp))
+	}
+	if e.Reason == "" {
+		e.Reason = DropReason(strconv.Itoa(int(rec.Reason)))
+	}
+	if e.Reason == DropMalformed {
+		return e
+	}
+	e.Src = netip.AddrFrom16(rec.Src).Unmap()
+	e.Dst = netip.AddrFrom16(rec.Dst).Unmap()
+	e.Protocol = formatProto(rec.Proto)
+	e.Port = binary.BigEndian.Uint16(rec.Port[:])
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if e.Reason == DropSpoofed || e.Reason == DropNeighborSpoofed {
+		// The source address is forged, and the veth is the sender's
+		for id, cn := range nm.containers {
+			if cn.HostIfindex == int(rec.Ifindex) {
+				e.SourceContainerID = id
+			}
+		}
+		return e
+	}
+	for id, cn := range nm.containers {
+		if rec.Ifindex != 0 && cn.HostIfindex == int(rec.Ifindex) {
+			e.ContainerID = id
+		}
+		for _, addr := range cn.addrs() {
+			if addr == e.Src {
+				e.SourceContainerID = id
+			}
+		}
+	}
+	if e.Reason == DropPolicy {
+		var ok bool
+		if e.Policy, ok = matchPolicy(nm.policyOwners, e.Src, e.Dst, rec.Proto, e.Port); !ok {
+			e.Reason = DropDefaultPolicy
+		}
+	}
+	return e
+}
@@ -0,0 +1,11 @@
+package network
+
+// NewHostLocalIPAM returns the IPAMHostLocal backend of a pool of cidr,
+// for the conformance tests of ipamtest
+func NewHostLocalIPAM(cidr, gateway string) (IPAM, error) {
+	pool, err := newIPAllocator(cidr, gateway)
+	if err != nil {
+		return nil, err
+	}
+	return hostLocal{pool}, nil
+}
@@ -0,0 +1,155 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ErrInvalidExtension is returned for datapath extensions that can't be
+// registered, e.g. as they don't fit the router
+var ErrInvalidExtension = errors.New("network: invalid datapath extension")
+
+// ErrExtensionNotFound is returned when unregistering an extension that
+// isn't registered
+var ErrExtensionNotFound = errors.New("network: datapath extension not found")
+
+// DatapathHook is a point in the XDP router where datapath extensions run
+type DatapathHook string
+
+const (
+	// HookPreRouting runs before the router looks at the packet, which
+	// extensions may rewrite, e.g. to decapsulate a protocol of their own
+	HookPreRouting DatapathHook = "pre-routing"
+	// HookPostPolicy runs once the routes and policies decided the verdict,
+	// before the packet is counted
+	HookPostPolicy DatapathHook = "post-policy"
+	// HookPreRedirect runs before a packet is redirected to a container,
+	// with its addresses rewritten
+	HookPreRedirect DatapathHook = "pre-redirect"
+)
+
+// datapathHooks are the hooks by their index in the router,
+// EXT_HOOK_* in bpf/container_router.c
+var datapathHooks = []DatapathHook{HookPreRouting, HookPostPolicy, HookPreRedirect}
+
+// MaxHookExtensions is how many extensions a hook takes, EXT_SLOTS in
+// bpf/container_router.c
+const MaxHookExtensions = 8
+
+// DatapathExtension is an eBPF program of the user's own that the XDP
+// router tail calls at a hook. It is an XDP program, or a TC classifier
+// when the router runs in TC mode, and must use the router's maps from
+// PinPath: ext_cursor, and ext_xdp or ext_tc by the mode. It sees the
+// packet and, in ext_cursor, copies of the router's destination and
+// verdict, and ends by tail calling the next slot of the chain, see
+// bpf/extensions/enviro_ext.h. Extensions can't use other maps of the
+// router, so the verdict stays the router's. The latency histograms leave
+// the time they take out.
+type DatapathExtension struct {
+	// Name identifies the extension for UnregisterDatapathExtension
+	Name string       `json:"name"`
+	Hook DatapathHook `json:"hook"`
+	// Priority orders the extensions of a hook, lowest first. Those of
+	// equal priority run in the order they were registered.
+	Priority int `json:"priority"`
+	// PinnedPath is where the program is pinned in bpffs. Without it, FD
+	// is the program's file descriptor, which the manager duplicates.
+	PinnedPath string `json:"pinned_path,omitempty"`
+	FD         int    `json:"-"`
+}
+
+// validate checks the name, hook and program of e
+func (e DatapathExtension) validate() error {
+	switch {
+	case e.Name == "":
+		return fmt.Errorf("%w: name is required", ErrInvalidExtension)
+	case !slices.Contains(datapathHooks, e.Hook):
+		return fmt.Errorf("%w: unknown hook %q", ErrInvalidExtension, e.Hook)
+	case e.PinnedPath == "" && e.FD <= 0:
+		return fmt.Errorf("%w: a pinned path or program file descriptor is required", ErrInvalidExtension)
+	case e.PinnedPath != "" && e.FD > 0:
+		return fmt.Errorf("%w: both a pinned path and a file descriptor set", ErrInvalidExtension)
+	}
+	return nil
+}
+
+// extensionChain returns the extensions of exts, in registration order,
+// at hook, in the order they run
+func extensionChain(exts []DatapathExtension, hook DatapathHook) []DatapathExtension {
+	var out []DatapathExtension
+	for _, e := range exts {
+		if e.Hook == hook {
+			out = append(out, e)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b DatapathExtension) int { return a.Priority - b.Priority })
+	return out
+}
+
+// RegisterDatapathExtension has the XDP router run ext at its hook, after
+// the extensions of lower priority. The program is verified to be of the
+// router's type and to use its maps; it is re-registered with the router
+// UpgradeDataPath swaps in. It fails with ErrXDPInactive without the
+// router.
+func (nm *NetworkManager) RegisterDatapathExtension(ext DatapathExtension) error {
+	if err := ext.validate(); err != nil {
+		return err
+	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.xdp == nil {
+		return fmt.Errorf("%w: extensions run in the XDP router", ErrXDPInactive)
+	}
+	registered := nm.registeredExtensions()
+	for _, e := range registered {
+		if e.Name == ext.Name {
+			return fmt.Errorf("%w: %s is registered already", ErrInvalidExtension, ext.Name)
+		}
+	}
+	if len(extensionChain(registered, ext.Hook)) == MaxHookExtensions {
+		return fmt.Errorf("%w: hook %s takes at most %d extensions", ErrInvalidExtension, ext.Hook, MaxHookExtensions)
+	}
+	if err := nm.addExtension(ext); err != nil {
+		return fmt.Errorf("failed to register extension %s: %w", ext.Name, err)
+	}
+	nm.log.Info("Registered datapath extension", "name", ext.Name, "hook", ext.Hook, "priority", ext.Priority)
+	return nil
+}
+
+// UnregisterDatapathExtension stops running the extension name
+func (nm *NetworkManager) UnregisterDatapathExtension(name string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if !slices.ContainsFunc(nm.registeredExtensions(), func(e DatapathExtension) bool { return e.Name == name }) {
+		return fmt.Errorf("%w: %s", ErrExtensionNotFound, name)
+	}
+	if err := nm.removeExtension(name); err != nil {
+		return fmt.Errorf("failed to unregister extension %s: %w", name, err)
+	}
+	nm.log.Info("Unregistered datapath extension", "name", name)
+	return nil
+}
+
+// registeredExtensions returns the extensions in registration order.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) registeredExtensions() []DatapathExtension {
+	out := make([]DatapathExtension, len(nm.extensions))
+	for i, e := range nm.extensions {
+		out[i] = e.DatapathExtension
+	}
+	return out
+}
+
+// ListDatapathExtensions returns the registered extensions by hook, in the
+// order they run
+func (nm *NetworkManager) ListDatapathExtensions() []DatapathExtension {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	registered := nm.registeredExtensions()
+	var out []DatapathExtension
+	for _, hook := range datapathHooks {
+		out = append(out, extensionChain(registered, hook)...)
+	}
+	return out
+}
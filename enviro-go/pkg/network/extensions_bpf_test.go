@@ -0,0 +1,334 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+// xdpRedirect is the verdict of packets redirected to a container
+const xdpRedirect = 4
+
+// loadExtensionRouter loads the embedded XDP router, unattached, with a
+// container behind testIfindex at addr, in a manager extensions can be
+// registered with
+func loadExtensionRouter(t *testing.T, addr netip.Addr) *NetworkManager {
+	t.Helper()
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		t.Fatal(err)
+	}
+	trimPrograms(spec, []DatapathMode{DatapathXDPNative})
+	coll, err := ebpf.NewCollection(spec)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("loading eBPF not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(coll.Close)
+	x := &xdpProgram{mode: DatapathXDPNative}
+	x.setCollection(coll)
+	if !x.hasExtensions() {
+		t.Fatal("router loaded without extension hooks")
+	}
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	hostMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	if err := x.AddContainer(testIfindex, []netip.Addr{addr}, mac, hostMAC, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	nm := &NetworkManager{xdp: x, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	t.Cleanup(nm.closeExtensions)
+	return nm
+}
+
+// extensionOptions shape the extensions testExtension builds
+type extensionOptions struct {
+	// counter counts the packets the extension sees in its slot 0
+	counter *ebpf.Map
+	// tamper sets the verdict in ext_cursor to drop and its destination to
+	// none
+	tamper bool
+	// chain hands the packet on as enviro_ext_next does, else the
+	// extension drops it
+	chain bool
+	// extra is a map the extension uses besides
+	extra *ebpf.Map
+}
+
+// testExtension returns an XDP extension of the router of nm built as o
+// says, like one built on bpf/extensions/enviro_ext.h
+func testExtension(t *testing.T, nm *NetworkManager, o extensionOptions) *ebpf.Program {
+	t.Helper()
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.StoreImm(asm.R10, -8, 0, asm.DWord),
+	}
+	if o.extra != nil {
+		// Keys of up to 8 bytes, e.g. the router's route prefixes
+		insns = append(insns,
+			asm.Mov.Reg(asm.R2, asm.R10),
+			asm.Add.Imm(asm.R2, -8),
+			asm.LoadMapPtr(asm.R1, o.extra.FD()),
+			asm.FnMapLookupElem.Call(),
+		)
+	}
+	if o.chain {
+		insns = append(insns,
+			asm.Mov.Reg(asm.R2, asm.R10),
+			asm.Add.Imm(asm.R2, -4),
+			asm.LoadMapPtr(asm.R1, nm.xdp.coll.Maps[extCursorMap].FD()),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "abort"),
+			asm.Mov.Reg(asm.R7, asm.R0),
+		)
+		if o.tamper {
+			insns = append(insns,
+				asm.StoreImm(asm.R7, 12, xdpDrop, asm.Word),
+				asm.StoreImm(asm.R7, 8, 0, asm.Word),
+			)
+		}
+		next := asm.LoadMem(asm.R3, asm.R7, 4, asm.Word)
+		if o.counter != nil {
+			insns = append(insns,
+				asm.Mov.Reg(asm.R2, asm.R10),
+				asm.Add.Imm(asm.R2, -4),
+				asm.LoadMapPtr(asm.R1, o.counter.FD()),
+				asm.FnMapLookupElem.Call(),
+				asm.JEq.Imm(asm.R0, 0, "next"),
+				asm.Mov.Imm(asm.R1, 1),
+				asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+			)
+			next = next.WithSymbol("next")
+		}
+		insns = append(insns,
+			next,
+			asm.Add.Imm(asm.R3, 1),
+			asm.StoreMem(asm.R7, 4, asm.R3, asm.Word),
+			asm.Mov.Reg(asm.R1, asm.R6),
+			asm.LoadMapPtr(asm.R2, nm.xdp.coll.Maps[chainMap(DatapathXDPNative)].FD()),
+			asm.FnTailCall.Call(),
+			asm.Mov.Imm(asm.R0, xdpPass).WithSymbol("abort"),
+			asm.Return(),
+		)
+	} else {
+		insns = append(insns, asm.Mov.Imm(asm.R0, xdpDrop), asm.Return())
+	}
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{Type: ebpf.XDP, License: "GPL", Instructions: insns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { prog.Close() })
+	return prog
+}
+
+// newCounter returns an array of one packet counter
+func newCounter(t *testing.T) *ebpf.Map {
+	t.Helper()
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Array, KeySize: 4, ValueSize: 8, MaxEntries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// readCounter returns the count of m
+func readCounter(t *testing.T, m *ebpf.Map) uint64 {
+	t.Helper()
+	var n uint64
+	if err := m.Lookup(uint32(0), &n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// chainSlots returns the occupied slots of a chain map
+func chainSlots(t *testing.T, m *ebpf.Map) []uint32 {
+	t.Helper()
+	var slots []uint32
+	for slot := uint32(0); slot < m.MaxEntries(); slot++ {
+		var id uint32
+		err := m.Lookup(slot, &id)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+func TestExtensionVerification(t *testing.T) {
+	nm := loadExtensionRouter(t, netip.MustParseAddr("10.0.0.2"))
+	tc, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.SchedCLS,
+		License:      "GPL",
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 0), asm.Return()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	tests := []struct {
+		name    string
+		prog    *ebpf.Program
+		wantErr bool
+	}{
+		{name: "chains", prog: testExtension(t, nm, extensionOptions{chain: true})},
+		{name: "with maps of its own", prog: testExtension(t, nm, extensionOptions{chain: true, counter: newCounter(t)})},
+		{name: "returns its own verdict", prog: testExtension(t, nm, extensionOptions{}), wantErr: true},
+		{name: "uses the router's counters", prog: testExtension(t, nm, extensionOptions{chain: true, extra: nm.xdp.stats}), wantErr: true},
+		{name: "uses the router's routes", prog: testExtension(t, nm, extensionOptions{extra: nm.xdp.routes}), wantErr: true},
+		{name: "TC classifier", prog: tc, wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := nm.RegisterDatapathExtension(DatapathExtension{Name: tt.name, Hook: datapathHooks[i%len(datapathHooks)], FD: tt.prog.FD()})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("RegisterDatapathExtension() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidExtension) {
+				t.Errorf("RegisterDatapathExtension() = %v, want ErrInvalidExtension", err)
+			}
+		})
+	}
+}
+
+// TestExtensionChains runs packets through extensions at every hook, one
+// of which tampers with what it sees, and checks that each sees the
+// packets it should and the router's verdicts stand
+func TestExtensionChains(t *testing.T) {
+	dest := netip.MustParseAddr("10.0.0.2")
+	nm := loadExtensionRouter(t, dest)
+	x := nm.xdp
+	counters := make(map[DatapathHook]*ebpf.Map)
+	for _, hook := range datapathHooks {
+		counters[hook] = newCounter(t)
+		prog := testExtension(t, nm, extensionOptions{chain: true, counter: counters[hook]})
+		if err := nm.RegisterDatapathExtension(DatapathExtension{Name: string(hook), Hook: hook, FD: prog.FD()}); err != nil {
+			t.Fatal(err)
+		}
+		// Ahead of the counter, so it would see the tampering
+		tamper := testExtension(t, nm, extensionOptions{chain: true, tamper: true})
+		if err := nm.RegisterDatapathExtension(DatapathExtension{Name: string(hook) + "-tamper", Hook: hook, Priority: -1, FD: tamper.FD()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	routed := tcpSegment{src: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.9"), 40000), dst: netip.AddrPortFrom(dest, 80), flags: tcpSYN}
+	unrouted := tcpSegment{src: routed.src, dst: netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), 80), flags: tcpSYN}
+	const packets = 10
+	for i := 0; i < packets; i++ {
+		for _, tt := range []struct {
+			segment tcpSegment
+			want    uint32
+		}{{routed, xdpRedirect}, {unrouted, xdpPass}} {
+			ret, _, err := x.coll.Programs[routerProgram].Test(tt.segment.frame())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ret != tt.want {
+				t.Fatalf("verdict %d for %s, want %d", ret, tt.segment.dst, tt.want)
+			}
+		}
+	}
+
+	// Only routed packets reach pre-redirect
+	for hook, want := range map[DatapathHook]uint64{HookPreRouting: 2 * packets, HookPostPolicy: 2 * packets, HookPreRedirect: packets} {
+		if n := readCounter(t, counters[hook]); n != want {
+			t.Errorf("extension at %s saw %d packets, want %d", hook, n, want)
+		}
+	}
+	s, err := x.ContainerStats(testIfindex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Redirects != packets || s.Drops != 0 {
+		t.Errorf("container counted %d redirects and %d drops, want %d and 0", s.Redirects, s.Drops, packets)
+	}
+
+	// Each hook runs its two extensions and the resume program
+	chains := x.coll.Maps[chainMap(DatapathXDPNative)]
+	if got := chainSlots(t, chains); len(got) != 3*len(datapathHooks) {
+		t.Errorf("chain slots %v, want 3 a hook", got)
+	}
+	for _, e := range nm.ListDatapathExtensions() {
+		if err := nm.UnregisterDatapathExtension(e.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := chainSlots(t, chains); len(got) != 0 {
+		t.Errorf("chain slots %v left after unregistering every extension", got)
+	}
+	if err := nm.UnregisterDatapathExtension(string(HookPreRouting)); !errors.Is(err, ErrExtensionNotFound) {
+		t.Errorf("unregistering again = %v, want ErrExtensionNotFound", err)
+	}
+	if ret, _, err := x.coll.Programs[routerProgram].Test(routed.frame()); err != nil || ret != xdpRedirect {
+		t.Errorf("verdict %d, %v without extensions, want %d", ret, err, xdpRedirect)
+	}
+}
+
+// TestPacketSizeExtension registers the example extension built by
+// `make bpf` and checks its histogram
+func TestPacketSizeExtension(t *testing.T) {
+	dest := netip.MustParseAddr("10.0.0.2")
+	nm := loadExtensionRouter(t, dest)
+	obj, err := os.ReadFile("bpf/extensions/packet_size.o")
+	if err != nil {
+		t.Fatalf("example extension not built, run make bpf: %v", err)
+	}
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(obj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{MapReplacements: map[string]*ebpf.Map{
+		extCursorMap: nm.xdp.coll.Maps[extCursorMap],
+		"ext_xdp":    nm.xdp.coll.Maps["ext_xdp"],
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Close()
+	ext := DatapathExtension{Name: "packet-size", Hook: HookPreRouting, FD: coll.Programs["packet_size"].FD()}
+	if err := nm.RegisterDatapathExtension(ext); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := tcpSegment{src: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.9"), 40000), dst: netip.AddrPortFrom(dest, 80), flags: tcpSYN}.frame()
+	const packets = 5
+	for i := 0; i < packets; i++ {
+		if ret, _, err := nm.xdp.coll.Programs[routerProgram].Test(frame); err != nil || ret != xdpRedirect {
+			t.Fatalf("verdict %d, %v, want %d", ret, err, xdpRedirect)
+		}
+	}
+	// 54 byte frames count in [32, 64)
+	var perCPU []uint64
+	if err := coll.Maps["packet_sizes"].Lookup(uint32(5), &perCPU); err != nil {
+		t.Fatal(err)
+	}
+	var n uint64
+	for _, c := range perCPU {
+		n += c
+	}
+	if n != packets {
+		t.Errorf("%d packets in bucket 5, want %d", n, packets)
+	}
+}
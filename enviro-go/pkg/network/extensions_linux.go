@@ -0,0 +1,241 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// Programs the extensions of each hook hand packets back to, by router
+const (
+	xdpResumeProgram = "xdp_ext_resume"
+	tcResumeProgram  = "tc_ext_resume"
+)
+
+// extCursorMap is the map the router shares with extensions
+const extCursorMap = "ext_cursor"
+
+// extensionProgram is a registered extension and its program, which the
+// manager holds so it can register it again
+type extensionProgram struct {
+	DatapathExtension
+	prog *ebpf.Program
+}
+
+// chainMap returns the name of the program array the router in mode tail
+// calls extensions from
+func chainMap(mode DatapathMode) string {
+	if mode == DatapathTC {
+		return "ext_tc"
+	}
+	return "ext_xdp"
+}
+
+// resumeProgram returns the name of the program the extensions of the
+// router in mode hand packets back to
+func resumeProgram(mode DatapathMode) string {
+	if mode == DatapathTC {
+		return tcResumeProgram
+	}
+	return xdpResumeProgram
+}
+
+// hasExtensions reports whether the router has hooks for extensions
+func (x *xdpProgram) hasExtensions() bool {
+	return x.coll.Maps[extCursorMap] != nil && x.coll.Maps[chainMap(x.mode)] != nil &&
+		x.coll.Programs[resumeProgram(x.mode)] != nil
+}
+
+// openExtension returns the program of ext
+func openExtension(ext DatapathExtension) (*ebpf.Program, error) {
+	if ext.PinnedPath != "" {
+		return ebpf.LoadPinnedProgram(ext.PinnedPath, nil)
+	}
+	fd, err := unix.FcntlInt(uintptr(ext.FD), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate program file descriptor: %w", err)
+	}
+	prog, err := ebpf.NewProgramFromFD(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return prog, nil
+}
+
+// verifyExtension checks that prog can run at the hooks of the router: it
+// must be of the router's program type and use the router's chain map and
+// ext_cursor, and no other of its maps
+func (x *xdpProgram) verifyExtension(prog *ebpf.Program) error {
+	if !x.hasExtensions() {
+		return fmt.Errorf("%w: router has no extension hooks", ErrInvalidDatapath)
+	}
+	if want := programType(x.mode); prog.Type() != want {
+		return fmt.Errorf("%w: %s program, the router in %s mode runs %s programs", ErrInvalidExtension, prog.Type(), x.mode, want)
+	}
+	info, err := prog.Info()
+	if err != nil {
+		return fmt.Errorf("failed to read program info: %w", err)
+	}
+	ids, ok := info.MapIDs()
+	if !ok {
+		return errors.New("kernel doesn't report the maps of programs")
+	}
+	names := make(map[ebpf.MapID]string, len(x.coll.Maps))
+	for name, m := range x.coll.Maps {
+		mi, err := m.Info()
+		if err != nil {
+			return fmt.Errorf("failed to read info of map %s: %w", name, err)
+		}
+		if id, ok := mi.ID(); ok {
+			names[id] = name
+		}
+	}
+	chain := chainMap(x.mode)
+	used := make(map[string]bool)
+	for _, id := range ids {
+		name, ok := names[id]
+		if !ok {
+			continue
+		}
+		if name != chain && name != extCursorMap {
+			return fmt.Errorf("%w: uses the router's map %s", ErrInvalidExtension, name)
+		}
+		used[name] = true
+	}
+	if !used[chain] || !used[extCursorMap] {
+		return fmt.Errorf("%w: doesn't use the router's maps %s and %s, so it can't hand packets back", ErrInvalidExtension, chain, extCursorMap)
+	}
+	return nil
+}
+
+// SetExtensions writes the chain of each hook into the program array of
+// the router's mode: its extensions of exts in order, then the resume
+// program. Slots are written back to front, so packets in flight reach
+// the resume program. The other program array is cleared.
+func (x *xdpProgram) SetExtensions(exts []*extensionProgram) error {
+	if !x.hasExtensions() {
+		if len(exts) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%w: router has no extension hooks", ErrInvalidDatapath)
+	}
+	registered := make([]DatapathExtension, len(exts))
+	progs := make(map[string]*ebpf.Program, len(exts))
+	for i, e := range exts {
+		registered[i] = e.DatapathExtension
+		progs[e.Name] = e.prog
+	}
+
+	chains := x.coll.Maps[chainMap(x.mode)]
+	resume := x.coll.Programs[resumeProgram(x.mode)]
+	for i, hook := range datapathHooks {
+		base := uint32(i * (MaxHookExtensions + 1))
+		chain := extensionChain(registered, hook)
+		end := base + uint32(len(chain))
+		if len(chain) > 0 {
+			if err := chains.Put(end, resume); err != nil {
+				return fmt.Errorf("failed to hand hook %s back to the router: %w", hook, err)
+			}
+		}
+		for j := len(chain) - 1; j >= 0; j-- {
+			if err := chains.Put(base+uint32(j), progs[chain[j].Name]); err != nil {
+				return fmt.Errorf("failed to chain extension %s: %w", chain[j].Name, err)
+			}
+		}
+		unused := base
+		if len(chain) > 0 {
+			unused = end + 1
+		}
+		for slot := unused; slot < base+MaxHookExtensions+1; slot++ {
+			if err := ignoreNotExist(chains.Delete(slot)); err != nil {
+				return fmt.Errorf("failed to clear hook %s: %w", hook, err)
+			}
+		}
+	}
+
+	for _, mode := range []DatapathMode{DatapathXDPNative, DatapathTC} {
+		name := chainMap(mode)
+		if name == chainMap(x.mode) || x.coll.Maps[name] == nil {
+			continue
+		}
+		for slot := uint32(0); slot < x.coll.Maps[name].MaxEntries(); slot++ {
+			if err := ignoreNotExist(x.coll.Maps[name].Delete(slot)); err != nil {
+				return fmt.Errorf("failed to clear %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addExtension verifies and chains ext, keeping the chains as they were
+// when it fails. Callers must hold nm.mu.
+func (nm *NetworkManager) addExtension(ext DatapathExtension) error {
+	prog, err := openExtension(ext)
+	if err != nil {
+		return err
+	}
+	if err := nm.xdp.verifyExtension(prog); err != nil {
+		prog.Close()
+		return err
+	}
+	exts := append(slices.Clone(nm.extensions), &extensionProgram{DatapathExtension: ext, prog: prog})
+	if err := nm.xdp.SetExtensions(exts); err != nil {
+		prog.Close()
+		if err := nm.xdp.SetExtensions(nm.extensions); err != nil {
+			nm.log.Warn("Failed to restore datapath extensions", "error", err)
+		}
+		return err
+	}
+	nm.extensions = exts
+	return nil
+}
+
+// removeExtension unchains the extension name, which is registered.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) removeExtension(name string) error {
+	i := slices.IndexFunc(nm.extensions, func(e *extensionProgram) bool { return e.Name == name })
+	exts := slices.Delete(slices.Clone(nm.extensions), i, i+1)
+	if err := nm.xdp.SetExtensions(exts); err != nil {
+		return err
+	}
+	nm.extensions[i].prog.Close()
+	nm.extensions = exts
+	return nil
+}
+
+// syncExtensions registers the extensions again with the router in use,
+// e.g. after an upgrade or a reattach in another mode, dropping those that
+// no longer fit it. Callers must hold nm.mu.
+func (nm *NetworkManager) syncExtensions() {
+	if len(nm.extensions) == 0 {
+		return
+	}
+	var kept []*extensionProgram
+	for _, e := range nm.extensions {
+		if err := nm.xdp.verifyExtension(e.prog); err != nil {
+			nm.log.Error("Dropping datapath extension", "name", e.Name, "error", err)
+			e.prog.Close()
+			continue
+		}
+		kept = append(kept, e)
+	}
+	nm.extensions = kept
+	if err := nm.xdp.SetExtensions(kept); err != nil {
+		nm.log.Error("Failed to register datapath extensions", "error", err)
+	}
+}
+
+// closeExtensions releases the programs of the extensions. Callers must
+// own nm exclusively.
+func (nm *NetworkManager) closeExtensions() {
+	for _, e := range nm.extensions {
+		e.prog.Close()
+	}
+	nm.extensions = nil
+}
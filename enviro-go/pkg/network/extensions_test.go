@@ -0,0 +1,64 @@
+package network
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestDatapathExtensionValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		ext     DatapathExtension
+		wantErr bool
+	}{
+		{name: "pinned", ext: DatapathExtension{Name: "a", Hook: HookPreRouting, PinnedPath: "/sys/fs/bpf/a"}},
+		{name: "file descriptor", ext: DatapathExtension{Name: "a", Hook: HookPreRedirect, FD: 7}},
+		{name: "no name", ext: DatapathExtension{Hook: HookPreRouting, FD: 7}, wantErr: true},
+		{name: "unknown hook", ext: DatapathExtension{Name: "a", Hook: "post-routing", FD: 7}, wantErr: true},
+		{name: "no program", ext: DatapathExtension{Name: "a", Hook: HookPostPolicy}, wantErr: true},
+		{name: "both", ext: DatapathExtension{Name: "a", Hook: HookPostPolicy, FD: 7, PinnedPath: "/sys/fs/bpf/a"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ext.validate()
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validate() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidExtension) {
+				t.Errorf("validate() = %v, want ErrInvalidExtension", err)
+			}
+		})
+	}
+}
+
+func TestExtensionChain(t *testing.T) {
+	ext := func(name string, hook DatapathHook, priority int) DatapathExtension {
+		return DatapathExtension{Name: name, Hook: hook, Priority: priority}
+	}
+	// In registration order
+	registered := []DatapathExtension{
+		ext("late", HookPreRouting, 10),
+		ext("redirect", HookPreRedirect, 0),
+		ext("first", HookPreRouting, -5),
+		ext("tie-a", HookPreRouting, 0),
+		ext("tie-b", HookPreRouting, 0),
+	}
+	tests := []struct {
+		hook DatapathHook
+		want []string
+	}{
+		{hook: HookPreRouting, want: []string{"first", "tie-a", "tie-b", "late"}},
+		{hook: HookPostPolicy},
+		{hook: HookPreRedirect, want: []string{"redirect"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, e := range extensionChain(registered, tt.hook) {
+			got = append(got, e.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("chain of %s = %v, want %v", tt.hook, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// DefaultGCInterval is how often orphaned network resources are collected
+// unless configured otherwise
+const DefaultGCInterval = 5 * time.Minute
+
+// GCConfig tunes the periodic collection of network resources no container
+// owns, e.g. the veth of a create interrupted by a crash
+type GCConfig struct {
+	// Interval is how often orphans are collected, DefaultGCInterval when
+	// zero
+	Interval time.Duration `json:"interval"`
+	// DryRun only logs the orphans found instead of removing them
+	DryRun bool `json:"dry_run"`
+}
+
+func (c GCConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("%w: gc interval must not be negative", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// OrphanKind is the kind of an orphaned network resource
+type OrphanKind string
+
+const (
+	// OrphanVeth is a host veth named like a container's
+	OrphanVeth OrphanKind = "veth"
+	// OrphanRoute is an XDP route to a container address or a prefix no
+	// node route has
+	OrphanRoute OrphanKind = "route"
+	// OrphanCounters are the XDP counters and latency of a container
+	// interface
+	OrphanCounters OrphanKind = "counters"
+	// OrphanLease is an address allocated to a container
+	OrphanLease OrphanKind = "lease"
+)
+
+// Orphan is a network resource that no known container owns
+type Orphan struct {
+	Kind OrphanKind
+	// Name identifies the resource: the veth name, the route's address,
+	// the ifindex of the counters or the container ID of the lease
+	Name string
+	// Address is the address of a lease
+	Address string
+	// Removed is true once the orphan is gone; false in a dry run
+	Removed bool
+	// Error is why removing the orphan failed
+	Error string
+}
+
+// setResult records the outcome of removing o
+func (o *Orphan) setResult(err error) {
+	if err != nil {
+		o.Error = err.Error()
+		return
+	}
+	o.Removed = true
+}
+
+// knownResources are the resources of the containers the manager knows,
+// including those being created or deleted, and of its warm attachments
+type knownResources struct {
+	containers map[string]bool
+	interfaces map[string]bool
+	ifindexes  map[int]bool
+	addrs      map[netip.Addr]bool
+	// routes are the prefixes of the node routes
+	routes map[netip.Prefix]bool
+}
+
+// knownResources collects the resources of nm.containers. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) knownResources() knownResources {
+	known := knownResources{
+		containers: make(map[string]bool, len(nm.containers)),
+		interfaces: make(map[string]bool, len(nm.containers)),
+		ifindexes:  make(map[int]bool, len(nm.containers)),
+		addrs:      make(map[netip.Addr]bool, 2*len(nm.containers)),
+		routes:     make(map[netip.Prefix]bool),
+	}
+	for id, cn := range nm.containers {
+		known.containers[id] = true
+		known.interfaces[cn.HostInterface] = true
+		if cn.HostIfindex != 0 {
+			known.ifindexes[cn.HostIfindex] = true
+		}
+		for _, addr := range cn.addrs() {
+			known.addrs[addr] = true
+		}
+	}
+	for _, w := range nm.warm {
+		known.containers[w.id] = true
+		known.interfaces[w.hostName] = true
+		known.ifindexes[w.hostIfindex] = true
+		for _, addr := range w.addrs {
+			known.addrs[addr] = true
+		}
+	}
+	for _, routes := range nm.nodeRoutes {
+		for _, r := range routes {
+			known.routes[r.Prefix] = true
+		}
+	}
+	return known
+}
+
+// CollectGarbage finds the veths, XDP routes and counters and address
+// leases that no known container owns, and removes them unless dryRun is
+// set. Creates and deletes wait for it, so their resources are never taken
+// for orphans. The orphans are returned sorted by kind and name, with the
+// failure to remove each in its Error. The error is returned when some
+// resources couldn't be listed; the orphans found are returned with it.
+func (nm *NetworkManager) CollectGarbage(ctx context.Context, dryRun bool) ([]Orphan, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	logger := nm.logger(ctx)
+	known := nm.knownResources()
+	orphans, err := nm.collectDatapathGarbage(known, dryRun)
+	orphans = append(orphans, nm.collectLeases(known, dryRun)...)
+
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].Kind != orphans[j].Kind {
+			return orphans[i].Kind < orphans[j].Kind
+		}
+		return orphans[i].Name < orphans[j].Name
+	})
+	for _, o := range orphans {
+		switch {
+		case dryRun:
+			logger.Info("Found orphaned network resource", "kind", o.Kind, "name", o.Name)
+		case o.Error != "":
+			logger.Warn("Failed to remove orphaned network resource", "kind", o.Kind, "name", o.Name, "error", o.Error)
+		default:
+			logger.Info("Removed orphaned network resource", "kind", o.Kind, "name", o.Name)
+		}
+	}
+	return orphans, err
+}
+
+// collectLeases releases the addresses of containers the manager doesn't
+// know. Callers must hold nm.mu.
+func (nm *NetworkManager) collectLeases(known knownResources, dryRun bool) []Orphan {
+	var orphans []Orphan
+	for _, pool := range nm.pools {
+		for id, addr := range pool.Allocations() {
+			if known.containers[id] {
+				continue
+			}
+			o := Orphan{Kind: OrphanLease, Name: id, Address: addr.String()}
+			if !dryRun {
+				nm.releaseAddr(pool, id)
+				o.Removed = true
+			}
+			orphans = append(orphans, o)
+		}
+	}
+	return orphans
+}
+
+// startGC collects orphans every GC.Interval until stopGC is called
+func (nm *NetworkManager) startGC() {
+	nm.gcStop = make(chan struct{})
+	nm.gcDone = make(chan struct{})
+	go func() {
+		defer close(nm.gcDone)
+		ticker := time.NewTicker(nm.config.GC.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-nm.gcStop:
+				return
+			}
+			if _, err := nm.CollectGarbage(context.Background(), nm.config.GC.DryRun); err != nil {
+				nm.log.Warn("Failed to collect orphaned network resources", "error", err)
+			}
+		}
+	}()
+}
+
+// stopGC waits for the collection started by startGC to end
+func (nm *NetworkManager) stopGC() {
+	if nm.gcStop == nil {
+		return
+	}
+	close(nm.gcStop)
+	<-nm.gcDone
+	nm.gcStop = nil
+}
@@ -0,0 +1,142 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+)
+
+// collectDatapathGarbage removes the host veths, XDP routes and counters
+// that are not in known, unless dryRun is set. Callers must hold nm.mu.
+func (nm *NetworkManager) collectDatapathGarbage(known knownResources, dryRun bool) ([]Orphan, error) {
+	var errs []error
+	orphans, err := collectVeths(nm.instance, known, dryRun)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to list interfaces: %w", err))
+	}
+	if nm.xdp != nil {
+		entries, err := nm.xdp.collectEntries(known, dryRun)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to walk XDP maps: %w", err))
+		}
+		orphans = append(orphans, entries...)
+	}
+	return orphans, errors.Join(errs...)
+}
+
+// collectVeths removes the veths named like a container's host interface
+// in instance that are not in known
+func collectVeths(instance string, known knownResources, dryRun bool) ([]Orphan, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "veth" || !isHostVethName(instance, name) || known.interfaces[name] {
+			continue
+		}
+		o := Orphan{Kind: OrphanVeth, Name: name}
+		if !dryRun {
+			o.setResult(deleteVeth(name))
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans, nil
+}
+
+// collectEntries removes the routes to addresses and prefixes and the
+// counters of ifindexes that are not in known, and the flows to those
+// ifindexes
+func (x *xdpProgram) collectEntries(known knownResources, dryRun bool) ([]Orphan, error) {
+	var orphans []Orphan
+	var errs []error
+	for _, m := range []*ebpf.Map{x.routes, x.routes6} {
+		keys, err := mapKeys(m)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, key := range keys {
+			prefix := routePrefix(key)
+			name := prefix.String()
+			if prefix.IsSingleIP() {
+				if known.addrs[prefix.Addr()] {
+					continue
+				}
+				name = prefix.Addr().String()
+			}
+			if known.routes[prefix] {
+				continue
+			}
+			o := Orphan{Kind: OrphanRoute, Name: name}
+			if !dryRun {
+				o.setResult(ignoreNotExist(m.Delete(key)))
+			}
+			orphans = append(orphans, o)
+		}
+	}
+
+	keys, err := mapKeys(x.containerStats)
+	if err != nil {
+		return orphans, errors.Join(append(errs, err)...)
+	}
+	stale := make(map[uint32]bool)
+	for _, key := range keys {
+		ifindex := binary.NativeEndian.Uint32(key)
+		if known.ifindexes[int(ifindex)] {
+			continue
+		}
+		o := Orphan{Kind: OrphanCounters, Name: strconv.FormatUint(uint64(ifindex), 10)}
+		if !dryRun {
+			err := ignoreNotExist(x.containerStats.Delete(key))
+			if x.containerLatency != nil {
+				err = errors.Join(err, ignoreNotExist(x.containerLatency.Delete(key)))
+			}
+			if x.hasTraffic() {
+				err = errors.Join(err, ignoreNotExist(x.containerTraffic.Delete(key)))
+			}
+			o.setResult(err)
+			stale[ifindex] = true
+		}
+		orphans = append(orphans, o)
+	}
+	if len(stale) > 0 {
+		// The ifindexes may be reused by the next containers' veths
+		_, err := x.deleteConnections(func(_ ctKey, entry ctEntry) bool {
+			return stale[entry.Ifindex]
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush connections: %w", err))
+		}
+	}
+	return orphans, errors.Join(errs...)
+}
+
+// mapKeys returns the keys of m, like countEntries capped at its capacity.
+// Deleting while walking can restart the walk, so orphans are collected
+// before any is removed.
+func mapKeys(m *ebpf.Map) ([][]byte, error) {
+	var keys [][]byte
+	var prev any
+	for uint32(len(keys)) < m.MaxEntries() {
+		next := make([]byte, m.KeySize())
+		err := m.NextKey(prev, next)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, next)
+		prev = next
+	}
+	return keys, nil
+}
@@ -0,0 +1,114 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// initTestEnv has a child of TestStagedInit run the test in the network
+// namespace of its own it was started in
+const initTestEnv = "ENVIRO_TEST_INIT"
+
+// memoryState is a StateStore keeping the state in memory
+type memoryState struct {
+	mu    sync.Mutex
+	state SavedState
+}
+
+func (s *memoryState) Save(state SavedState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	return nil
+}
+
+func (s *memoryState) Load() (SavedState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, nil
+}
+
+// TestStagedInit initializes a deferred manager, rebuilds its datapath
+// for a new config and fails to for an invalid one, checking that
+// container networks are only created while initialized and survive the
+// rebuild. It runs in a child in a network namespace of its own, so the
+// manager's routes stay off the host.
+func TestStagedInit(t *testing.T) {
+	if os.Getenv(initTestEnv) != "" {
+		runStagedInit(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("setting up the datapath needs root")
+	}
+	runInNetns(t, initTestEnv)
+}
+
+func runStagedInit(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	state := &memoryState{}
+	config := NetworkConfig{CIDR: "10.99.0.0/24", Logger: logger, State: state}
+
+	nm := NewDeferredNetworkManager(NetworkConfig{Logger: logger})
+	defer nm.Close()
+
+	steps := []struct {
+		name string
+		// init, when set, is the config Init is called with
+		init    *NetworkConfig
+		wantErr bool
+		// create is the container created after the step, if any
+		create          string
+		wantInitialized bool
+		wantContainers  []string
+	}{
+		{name: "deferred", create: "c1"},
+		{name: "init", init: &config, create: "c1", wantInitialized: true, wantContainers: []string{"c1"}},
+		{name: "rebuild", init: &NetworkConfig{CIDR: config.CIDR, Logger: logger, State: state, DefaultPolicy: PolicyDeny},
+			create: "c2", wantInitialized: true, wantContainers: []string{"c1", "c2"}},
+		{name: "invalid config", init: &NetworkConfig{CIDR: "10.99.0.0/33", Logger: logger, State: state}, wantErr: true, create: "c3"},
+		{name: "init again", init: &config, wantInitialized: true, wantContainers: []string{"c1", "c2"}},
+	}
+	for _, step := range steps {
+		if step.init != nil {
+			err := nm.Init(*step.init)
+			if gotErr := err != nil; gotErr != step.wantErr {
+				t.Fatalf("%s: Init() = %v, want error %v", step.name, err, step.wantErr)
+			}
+		}
+		if got := nm.Initialized(); got != step.wantInitialized {
+			t.Errorf("%s: Initialized() = %v, want %v", step.name, got, step.wantInitialized)
+		}
+		if step.create != "" {
+			_, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: step.create, NetnsPath: containerNetns(t)})
+			if step.wantInitialized && err != nil {
+				t.Fatalf("%s: CreateContainerNetwork() = %v", step.name, err)
+			}
+			if !step.wantInitialized && !errors.Is(err, ErrNotInitialized) {
+				t.Errorf("%s: CreateContainerNetwork() = %v, want ErrNotInitialized", step.name, err)
+			}
+		}
+		var got []string
+		for id := range nm.ContainerNetworks() {
+			got = append(got, id)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, step.wantContainers) {
+			t.Errorf("%s: containers %q, want %q", step.name, got, step.wantContainers)
+		}
+	}
+
+	networks := nm.ContainerNetworks()
+	if a, b := networks["c1"], networks["c2"]; a == nil || b == nil || a.IPv4 == b.IPv4 {
+		t.Errorf("containers have addresses %+v and %+v", a, b)
+	}
+}
@@ -0,0 +1,116 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidInspection is returned for malformed datapath inspection
+// requests, e.g. with a page token of another map
+var ErrInvalidInspection = errors.New("network: invalid datapath inspection")
+
+// ErrMapNotFound is returned when inspecting a map the router doesn't have
+var ErrMapNotFound = errors.New("network: datapath map not found")
+
+// Page sizes of InspectDatapath
+const (
+	DefaultInspectPageSize = 100
+	maxInspectPageSize     = 1000
+)
+
+// InspectRequest selects what InspectDatapath dumps
+type InspectRequest struct {
+	// Map is the name of the map whose entries to dump; none are when
+	// empty
+	Map string
+	// PageSize caps the entries returned, DefaultInspectPageSize when zero
+	PageSize int
+	// PageToken is the NextPageToken of the previous page
+	PageToken string
+}
+
+// DatapathProgram is a program of the loaded router object
+type DatapathProgram struct {
+	Name string
+	// Type is the eBPF program type, e.g. "XDP" or "SchedCLS"
+	Type string
+	// ID is the kernel's ID of the program, as bpftool shows it
+	ID uint32
+	// Tag is the hash of the program's instructions
+	Tag string
+	// Attached is true for the program running on Interface in Mode
+	Attached  bool
+	Interface string
+	Mode      DatapathMode
+	// LoadedAt is when the object was loaded, and LoadDuration how long
+	// loading it took, most of which the verifier spends
+	LoadedAt     time.Time
+	LoadDuration time.Duration
+	// RunCount and RunTime are only counted while kernel BPF statistics
+	// are enabled, e.g. with sysctl kernel.bpf_stats_enabled
+	RunCount uint64
+	RunTime  time.Duration
+}
+
+// DatapathMap is a map of the loaded router object
+type DatapathMap struct {
+	Name string
+	// Type is the eBPF map type, e.g. "Hash" or "PerCPUArray"
+	Type       string
+	ID         uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+}
+
+// DatapathEntry is an entry of a datapath map
+type DatapathEntry struct {
+	// Key and Value are decoded for the router's maps, e.g.
+	// "10.0.0.5" and "ifindex=12 mtu=1500"; per-CPU values are summed
+	// across CPUs. Maps without a decoder show them in hex.
+	Key   string
+	Value string
+	// RawKey and RawValue are the bytes stored in the map, the values of
+	// every CPU in order for per-CPU maps
+	RawKey   []byte
+	RawValue []byte
+}
+
+// DatapathInspection is the state of the XDP router
+type DatapathInspection struct {
+	Programs []DatapathProgram
+	// Maps are sorted by name
+	Maps []DatapathMap
+	// Entries are a page of the requested map, in the map's iteration
+	// order
+	Entries []DatapathEntry
+	// NextPageToken continues with the next page, empty after the last.
+	// Maps change between pages, so a page may miss entries added meanwhile
+	// or repeat some, and starts over when the last entry of the previous
+	// one was deleted.
+	NextPageToken string
+}
+
+// InspectDatapath returns the programs and maps of the XDP router, and a
+// page of the entries of req.Map, the way bpftool would show them. It
+// fails with ErrXDPInactive without the router, and ErrMapNotFound for
+// maps it doesn't have.
+func (nm *NetworkManager) InspectDatapath(req InspectRequest) (DatapathInspection, error) {
+	if req.PageSize == 0 {
+		req.PageSize = DefaultInspectPageSize
+	}
+	if req.PageSize < 0 || req.PageSize > maxInspectPageSize {
+		return DatapathInspection{}, fmt.Errorf("%w: page size must be between 1 and %d", ErrInvalidInspection, maxInspectPageSize)
+	}
+	if req.PageToken != "" && req.Map == "" {
+		return DatapathInspection{}, fmt.Errorf("%w: page token without a map", ErrInvalidInspection)
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.xdp == nil {
+		return DatapathInspection{}, fmt.Errorf("%w: there is no router to inspect", ErrXDPInactive)
+	}
+	return nm.inspectDatapath(req)
+}
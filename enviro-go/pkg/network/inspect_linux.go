@@ -0,0 +1,404 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// inspectDatapath implements InspectDatapath. Callers must hold nm.mu.
+func (nm *NetworkManager) inspectDatapath(req InspectRequest) (DatapathInspection, error) {
+	x := nm.xdp
+	var out DatapathInspection
+	for name, prog := range x.coll.Programs {
+		p := DatapathProgram{
+			Name:         name,
+			Type:         prog.Type().String(),
+			Attached:     x.link != nil && name == programName(x.mode),
+			LoadedAt:     x.loadedAt,
+			LoadDuration: x.loadTime,
+		}
+		if p.Attached {
+			p.Interface, p.Mode = nm.config.Interface, x.mode
+		}
+		if info, err := prog.Info(); err == nil {
+			id, _ := info.ID()
+			p.ID, p.Tag = uint32(id), info.Tag
+			p.RunCount, _ = info.RunCount()
+			p.RunTime, _ = info.Runtime()
+		}
+		out.Programs = append(out.Programs, p)
+	}
+	sort.Slice(out.Programs, func(i, j int) bool { return out.Programs[i].Name < out.Programs[j].Name })
+
+	for name, m := range x.coll.Maps {
+		dm := DatapathMap{
+			Name:       name,
+			Type:       m.Type().String(),
+			KeySize:    m.KeySize(),
+			ValueSize:  m.ValueSize(),
+			MaxEntries: m.MaxEntries(),
+		}
+		if info, err := m.Info(); err == nil {
+			id, _ := info.ID()
+			dm.ID = uint32(id)
+		}
+		out.Maps = append(out.Maps, dm)
+	}
+	sort.Slice(out.Maps, func(i, j int) bool { return out.Maps[i].Name < out.Maps[j].Name })
+
+	if req.Map == "" {
+		return out, nil
+	}
+	m, ok := x.coll.Maps[req.Map]
+	if !ok {
+		return DatapathInspection{}, fmt.Errorf("%w: %s", ErrMapNotFound, req.Map)
+	}
+	var err error
+	out.Entries, out.NextPageToken, err = dumpMap(req.Map, m, req.PageSize, req.PageToken)
+	if err != nil {
+		return DatapathInspection{}, err
+	}
+	return out, nil
+}
+
+// dumpMap returns up to n entries of the map name after those of token,
+// and the token of the next page
+func dumpMap(name string, m *ebpf.Map, n int, token string) ([]DatapathEntry, string, error) {
+	switch m.Type() {
+	case ebpf.XSKMap:
+		return nil, "", fmt.Errorf("%w: the kernel doesn't let sockets in %s be read", ErrInvalidInspection, name)
+	case ebpf.RingBuf:
+		return nil, "", fmt.Errorf("%w: %s is a ring buffer; its events are streamed as drop events", ErrInvalidInspection, name)
+	}
+	var prev any
+	if token != "" {
+		mapName, key, ok := strings.Cut(token, ":")
+		raw, err := hex.DecodeString(key)
+		if !ok || mapName != name || err != nil || len(raw) != int(m.KeySize()) {
+			return nil, "", fmt.Errorf("%w: page token is not one of map %s", ErrInvalidInspection, name)
+		}
+		prev = raw
+	}
+
+	perCPU := isPerCPU(m.Type())
+	decode := mapDecoders[name]
+	var entries []DatapathEntry
+	var last []byte
+	for len(entries) < n {
+		next := make([]byte, m.KeySize())
+		err := m.NextKey(prev, next)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return entries, "", nil
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to walk map %s: %w", name, err)
+		}
+		prev, last = next, next
+
+		var values [][]byte
+		if perCPU {
+			err = m.Lookup(next, &values)
+		} else {
+			var value []byte
+			err = m.Lookup(next, &value)
+			values = [][]byte{value}
+		}
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			// Deleted since
+			continue
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read map %s: %w", name, err)
+		}
+
+		e := DatapathEntry{RawKey: next, RawValue: bytes.Join(values, nil)}
+		if decode != nil {
+			e.Key, e.Value = decode(next, values)
+		} else {
+			e.Key, e.Value = hex.EncodeToString(e.RawKey), hex.EncodeToString(e.RawValue)
+		}
+		entries = append(entries, e)
+	}
+
+	// Only hand out a token when there is a next page
+	if err := m.NextKey(last, make([]byte, m.KeySize())); errors.Is(err, ebpf.ErrKeyNotExist) {
+		return entries, "", nil
+	}
+	return entries, name + ":" + hex.EncodeToString(last), nil
+}
+
+func isPerCPU(t ebpf.MapType) bool {
+	switch t {
+	case ebpf.PerCPUHash, ebpf.PerCPUArray, ebpf.LRUCPUHash:
+		return true
+	}
+	return false
+}
+
+// mapDecoders show the entries of the router's maps by map name. They
+// take the key and the value of each CPU, one for other maps.
+var mapDecoders = map[string]func(key []byte, values [][]byte) (string, string){
+	"container_routes":  decodeRoute,
+	"container_routes6": decodeRoute,
+	"stats":             decodeStats,
+	"container_stats":   decodeStats,
+	"latency":           decodeLatency,
+	"container_latency": decodeLatency,
+	"container_traffic": decodeTraffic,
+	"policies": func(key []byte, values [][]byte) (string, string) {
+		k := decodeAs[policyKey](key)
+		return formatPolicyKey(addrOrAny(k.Src[:]), addrOrAny(k.Dst[:]), k.Proto, k.Port), formatAction(values[0][0])
+	},
+	"policies6": func(key []byte, values [][]byte) (string, string) {
+		k := decodeAs[policyKey6](key)
+		return formatPolicyKey(addrOrAny(k.Src[:]), addrOrAny(k.Dst[:]), k.Proto, k.Port), formatAction(values[0][0])
+	},
+	"policy_cidrs": func(key []byte, values [][]byte) (string, string) {
+		k := decodeAs[policyCIDRKey](key)
+		src := netip.PrefixFrom(netip.AddrFrom4(k.Src), int(k.Prefixlen)-policyCIDRBits)
+		return formatPolicyKey(src.String(), netip.AddrFrom4(k.Dst).String(), k.Proto, k.Port), formatAction(values[0][0])
+	},
+	"policy_cidrs6": func(key []byte, values [][]byte) (string, string) {
+		k := decodeAs[policyCIDRKey6](key)
+		src := netip.PrefixFrom(netip.AddrFrom16(k.Src), int(k.Prefixlen)-policyCIDR6Bits)
+		return formatPolicyKey(src.String(), netip.AddrFrom16(k.Dst).String(), k.Proto, k.Port), formatAction(values[0][0])
+	},
+	"policy_default": func(key []byte, values [][]byte) (string, string) {
+		v := binary.NativeEndian.Uint32(values[0])
+		if binary.NativeEndian.Uint32(key) == policySlotRejectRate {
+			return "reject_rate", strconv.Itoa(int(v))
+		}
+		return decodeUint32(key), formatAction(uint8(v))
+	},
+	"router_mac": func(key []byte, values [][]byte) (string, string) {
+		mac := decodeAs[ifaceMAC](values[0])
+		return decodeUint32(key), net.HardwareAddr(mac.Addr[:]).String()
+	},
+	"conntrack":     decodeConnection,
+	"container_ns":  decodeNamespaceMember,
+	"container_ns6": decodeNamespaceMember,
+	"namespace_allow": func(key []byte, values [][]byte) (string, string) {
+		p := decodeAs[nsPair](key)
+		return fmt.Sprintf("src_ns=%d dst_ns=%d", p.Src, p.Dst), "allow"
+	},
+	"drop_events_lost": func(key []byte, values [][]byte) (string, string) {
+		var n uint64
+		for _, v := range values {
+			n += binary.NativeEndian.Uint64(v)
+		}
+		return decodeUint32(key), strconv.FormatUint(n, 10)
+	},
+	"container_faults": func(key []byte, values [][]byte) (string, string) {
+		f := decodeAs[containerFault](values[0])
+		return decodeUint32(key), fmt.Sprintf("drop=%.2f%%", float64(f.DropThreshold)/(1<<32)*100)
+	},
+	"fault_delays": func(key []byte, values [][]byte) (string, string) {
+		f := decodeAs[faultDelay](values[0])
+		return decodeUint32(key), fmt.Sprintf("delay=%s jitter=%s reorder=%.2f%%",
+			time.Duration(f.DelayNS), time.Duration(f.JitterNS), float64(f.ReorderThreshold)/(1<<32)*100)
+	},
+	"syn_protected": func(key []byte, values [][]byte) (string, string) {
+		return decodeSYNDest(key), "protected"
+	},
+	"syn_rates": func(key []byte, values [][]byte) (string, string) {
+		r := decodeAs[synRate](values[0])
+		now := monotonicNow()
+		mode := "counting"
+		if r.CookiesUntil > now {
+			mode = "cookies"
+		}
+		return decodeSYNDest(key), fmt.Sprintf("mode=%s syns=%d window_age=%s", mode, r.SYNs, sinceMonotonic(now, r.WindowNs))
+	},
+	"syn_trusted": func(key []byte, values [][]byte) (string, string) {
+		k := decodeAs[synPrefixKey](key)
+		return synPrefix(k).String(), "trusted"
+	},
+	"syn_verified": func(key []byte, values [][]byte) (string, string) {
+		at := binary.NativeEndian.Uint64(values[0])
+		return decodeAddr(key).Unmap().String(), "verified=" + sinceMonotonic(monotonicNow(), at).String() + " ago"
+	},
+	"syn_config": func(key []byte, values [][]byte) (string, string) {
+		return "threshold", decodeUint32(values[0])
+	},
+	"source_macs": func(key []byte, values [][]byte) (string, string) {
+		mac := decodeAs[sourceMAC](values[0])
+		return decodeUint32(key), net.HardwareAddr(mac.Addr[:]).String()
+	},
+	"source_addrs": func(key []byte, values [][]byte) (string, string) {
+		k := decodeAs[sourceKey](key)
+		return fmt.Sprintf("ifindex=%d", k.Ifindex), sourcePrefix(k).String()
+	},
+	"xsk_flows": func(key []byte, values [][]byte) (string, string) {
+		k := decodeAs[xskFlowKey](key)
+		dst := netip.AddrFrom16(k.Dst).Unmap()
+		return fmt.Sprintf("dst=%s proto=%s port=%s", dst, formatProto(k.Proto), formatPort(k.Port)),
+			"queue=" + decodeUint32(values[0])
+	},
+}
+
+// decodeAs reads b, in the kernel's layout, into a T
+func decodeAs[T any](b []byte) T {
+	var v T
+	binary.Read(bytes.NewReader(b), binary.NativeEndian, &v)
+	return v
+}
+
+func decodeUint32(b []byte) string {
+	return strconv.FormatUint(uint64(binary.NativeEndian.Uint32(b)), 10)
+}
+
+// decodeAddr reads an IPv4 or IPv6 address by its length
+func decodeAddr(b []byte) netip.Addr {
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func addrOrAny(b []byte) string {
+	if addr := decodeAddr(b); !addr.IsUnspecified() {
+		return addr.String()
+	}
+	return "*"
+}
+
+func decodeRoute(key []byte, values [][]byte) (string, string) {
+	info := decodeAs[containerInfo](values[0])
+	var flags []string
+	if info.Flags&containerMACSet != 0 {
+		flags = append(flags, "mac")
+	}
+	if info.Flags&containerShaped != 0 {
+		flags = append(flags, "shaped")
+	}
+	if info.Flags&containerPrefix != 0 {
+		flags = append(flags, "prefix")
+	}
+	if len(flags) == 0 {
+		flags = append(flags, "none")
+	}
+	prefix := routePrefix(key)
+	name := prefix.String()
+	if prefix.IsSingleIP() {
+		name = prefix.Addr().String()
+	}
+	return name, fmt.Sprintf("ifindex=%d mtu=%d mac=%s host_mac=%s flags=%s",
+		info.Ifindex, info.MTU, net.HardwareAddr(info.MAC[:]), net.HardwareAddr(info.HostMAC[:]), strings.Join(flags, ","))
+}
+
+func decodeStats(key []byte, values [][]byte) (string, string) {
+	var s datapathStats
+	for _, v := range values {
+		s.add(decodeAs[datapathStats](v))
+	}
+	return decodeUint32(key), fmt.Sprintf("packets=%d bytes=%d drops=%d redirects=%d frag_needed=%d rejects=%d "+
+		"syn_cookies_sent=%d syn_cookies_valid=%d syn_cookies_invalid=%d spoofed=%d neighbor_spoofed=%d "+
+		"policy_checks=%d connect_checks=%d connect_denied=%d accel_sockets=%d accel_msgs=%d accel_bytes=%d",
+		s.Packets, s.Bytes, s.Drops, s.Redirects, s.FragNeeded, s.Rejects,
+		s.SYNCookiesSent, s.SYNCookiesValid, s.SYNCookiesInvalid, s.Spoofed, s.NeighborSpoofed,
+		s.PolicyChecks, s.ConnectChecks, s.ConnectDenied, s.AccelSockets, s.AccelMsgs, s.AccelBytes)
+}
+
+func decodeLatency(key []byte, values [][]byte) (string, string) {
+	var h LatencyHistogram
+	for _, v := range values {
+		h.add(decodeAs[latencyHist](v).histogram())
+	}
+	return decodeUint32(key), fmt.Sprintf("packets=%d mean=%s p50=%s p95=%s p99=%s",
+		h.Packets, h.Mean(), h.Quantile(0.5), h.Quantile(0.95), h.Quantile(0.99))
+}
+
+func decodeTraffic(key []byte, values [][]byte) (string, string) {
+	var t trafficStats
+	for _, v := range values {
+		t.add(decodeAs[trafficStats](v))
+	}
+	var b strings.Builder
+	for d, dir := range []Direction{DirectionIngress, DirectionEgress} {
+		for p, proto := range TrafficProtocols {
+			c := t.Dirs[d].Protos[p]
+			fmt.Fprintf(&b, "%s_%s=%d/%dB ", dir, proto, c.Packets, c.Bytes)
+		}
+	}
+	return decodeUint32(key), strings.TrimSpace(b.String())
+}
+
+func decodeConnection(key []byte, values [][]byte) (string, string) {
+	k, e := decodeAs[ctKey](key), decodeAs[ctEntry](values[0])
+	now := monotonicNow()
+	state := string(ctStates[e.State])
+	if state == "" {
+		state = strconv.Itoa(int(e.State))
+	}
+	dir := "in"
+	if k.Dir == ctDirOut {
+		dir = "out"
+	}
+	return fmt.Sprintf("%s %s > %s %s", formatProto(k.Proto), ctAddrPort(k.Src, k.Sport), ctAddrPort(k.Dst, k.Dport), dir),
+		fmt.Sprintf("state=%s ifindex=%d packets=%d bytes=%d age=%s idle=%s", state, e.Ifindex, e.Packets, e.Bytes,
+			sinceMonotonic(now, e.Created), sinceMonotonic(now, e.LastSeen))
+}
+
+// sinceMonotonic returns how long before now, both bpf_ktime_get_ns
+// readings, t was
+func sinceMonotonic(now, t uint64) time.Duration {
+	if t > now {
+		return 0
+	}
+	return time.Duration(now - t).Truncate(time.Millisecond)
+}
+
+func decodeNamespaceMember(key []byte, values [][]byte) (string, string) {
+	return decodeAddr(key).String(), "ns=" + decodeUint32(values[0])
+}
+
+func formatPolicyKey(src, dst string, proto uint8, port [2]byte) string {
+	return fmt.Sprintf("src=%s dst=%s proto=%s port=%s", src, dst, formatProto(proto), formatPort(port))
+}
+
+// formatProto names the IP protocol number p, "*" for 0
+func formatProto(p uint8) string {
+	switch p {
+	case 0:
+		return "*"
+	case 58:
+		return "icmpv6"
+	}
+	for name, n := range protocolNumbers {
+		if n == p {
+			return name
+		}
+	}
+	return strconv.Itoa(int(p))
+}
+
+// formatPort formats a port in network byte order, "*" for 0
+func formatPort(port [2]byte) string {
+	if p := binary.BigEndian.Uint16(port[:]); p != 0 {
+		return strconv.Itoa(int(p))
+	}
+	return "*"
+}
+
+func formatAction(action uint8) string {
+	switch action {
+	case bpfPolicyAllow:
+		return string(PolicyAllow)
+	case bpfPolicyDeny:
+		return string(PolicyDeny)
+	case bpfPolicyReject:
+		return string(PolicyReject)
+	}
+	return strconv.Itoa(int(action))
+}
@@ -0,0 +1,199 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrInstanceInUse is returned by Init when another manager of the process
+// runs the same instance or holds a resource the config needs that can't
+// be shared, see NetworkConfig.Instance
+var ErrInstanceInUse = errors.New("network: instance in use")
+
+// MaxInstanceLen is the longest NetworkConfig.Instance, which has to fit
+// in the host interface names of its containers
+const MaxInstanceLen = 4
+
+// instances holds what the running managers of the process claimed, see
+// claim
+var instances = struct {
+	sync.Mutex
+	claims map[*NetworkManager]instanceClaim
+}{claims: make(map[*NetworkManager]instanceClaim)}
+
+// instanceClaim is what a running manager holds
+type instanceClaim struct {
+	name string
+	// resources can only be held by one manager
+	resources []string
+	prefixes  []sourcedPrefix
+}
+
+// claim records the instance and exclusive resources of config for nm,
+// failing with ErrInstanceInUse when another manager holds them
+func (nm *NetworkManager) claim(config NetworkConfig) error {
+	c := instanceClaim{name: config.Instance, prefixes: config.configPrefixes()}
+	if config.EnableXDP {
+		c.resources = append(c.resources, "XDP on "+config.Interface)
+	}
+	if config.PinPath != "" {
+		c.resources = append(c.resources, "pin path "+instancePinPath(config))
+	}
+	if config.Node != nil {
+		c.resources = append(c.resources, "the overlay")
+	}
+	for _, pf := range config.Devices.PhysicalFunctions {
+		c.resources = append(c.resources, "physical function "+pf)
+	}
+
+	instances.Lock()
+	defer instances.Unlock()
+	for m, other := range instances.claims {
+		if m == nm {
+			continue
+		}
+		if other.name == c.name {
+			return fmt.Errorf("%w: instance %s runs in another manager", ErrInstanceInUse, instanceLabel(c.name))
+		}
+		for _, r := range c.resources {
+			for _, o := range other.resources {
+				if r == o {
+					return fmt.Errorf("%w: %s is held by instance %s", ErrInstanceInUse, r, instanceLabel(other.name))
+				}
+			}
+		}
+		others := make([]sourcedPrefix, len(other.prefixes))
+		for i, p := range other.prefixes {
+			others[i] = sourcedPrefix{p.Prefix, p.Source + " of instance " + instanceLabel(other.name)}
+		}
+		var overlaps []CIDROverlap
+		for _, p := range c.prefixes {
+			overlaps = append(overlaps, findOverlaps([]sourcedPrefix{p}, others)...)
+		}
+		if len(overlaps) > 0 {
+			return overlapError(overlaps)
+		}
+	}
+	instances.claims[nm] = c
+	return nil
+}
+
+// release gives up what claim recorded for nm
+func (nm *NetworkManager) release() {
+	instances.Lock()
+	defer instances.Unlock()
+	delete(instances.claims, nm)
+}
+
+// instanceLabel names instance in errors
+func instanceLabel(instance string) string {
+	if instance == "" {
+		return "default"
+	}
+	return fmt.Sprintf("%q", instance)
+}
+
+// validInstance reports whether name can name an instance: lowercase
+// letters and digits, at most MaxInstanceLen of them
+func validInstance(name string) bool {
+	if name == "" || len(name) > MaxInstanceLen {
+		return false
+	}
+	return strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789") == ""
+}
+
+// Instance returns the instance name of the manager, empty for the
+// default instance
+func (nm *NetworkManager) Instance() string {
+	return nm.instance
+}
+
+// nftTable scopes the name of an nftables table to the instance
+func (nm *NetworkManager) nftTable(name string) string {
+	if nm.instance == "" {
+		return name
+	}
+	return name + "-" + nm.instance
+}
+
+// instancePinPath returns the directory the maps of config are pinned in
+func instancePinPath(config NetworkConfig) string {
+	if config.Instance == "" || config.PinPath == "" {
+		return config.PinPath
+	}
+	return filepath.Join(config.PinPath, config.Instance)
+}
+
+// maxLinkName is the longest interface name the kernel takes
+const maxLinkName = 15
+
+// Host veth names of the default instance are hostVethPrefix and
+// hostVethHexLen lowercase hex digits, which tells them from other veths,
+// e.g. Docker's shorter ones. Those of other instances fill maxLinkName
+// after their prefix, see vethPrefix.
+const (
+	hostVethPrefix = "veth"
+	hostVethHexLen = 10
+)
+
+// vethPrefix returns the prefix of the host veth names of instance
+func vethPrefix(instance string) string {
+	if instance == "" {
+		return hostVethPrefix
+	}
+	return "v" + instance + "-"
+}
+
+// vethDigits returns the hex digits of the host veth name of containerID
+// in instance
+func vethDigits(instance, containerID string) string {
+	key, n := containerID, hostVethHexLen
+	if instance != "" {
+		key, n = instance+"/"+containerID, maxLinkName-len(vethPrefix(instance))
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:n]
+}
+
+// hostVethName derives a stable host-side interface name from containerID
+// in instance, so teardown can find the interface even without a record
+// of it
+func hostVethName(instance, containerID string) string {
+	return vethPrefix(instance) + vethDigits(instance, containerID)
+}
+
+// tmpLinkName names the container side of the veth, or the device, of
+// containerID in instance until it is renamed in the container's
+// namespace
+func tmpLinkName(instance, containerID string) string {
+	return "tmp" + vethDigits(instance, containerID)
+}
+
+// isHostVethName reports whether name is like those of hostVethName for
+// instance
+func isHostVethName(instance, name string) bool {
+	digits, ok := strings.CutPrefix(name, vethPrefix(instance))
+	if !ok || len(digits) != len(vethDigits(instance, "")) {
+		return false
+	}
+	return strings.Trim(digits, "0123456789abcdef") == ""
+}
+
+// isAnyHostVethName reports whether name is like those of hostVethName
+// for any instance
+func isAnyHostVethName(name string) bool {
+	if isHostVethName("", name) {
+		return true
+	}
+	rest, ok := strings.CutPrefix(name, "v")
+	if !ok {
+		return false
+	}
+	instance, _, ok := strings.Cut(rest, "-")
+	return ok && validInstance(instance) && isHostVethName(instance, name)
+}
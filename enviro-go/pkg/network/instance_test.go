@@ -0,0 +1,75 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInstanceClaims(t *testing.T) {
+	a := &NetworkManager{instance: "a"}
+	if err := a.claim(NetworkConfig{Instance: "a", CIDR: "10.1.0.0/24", EnableXDP: true, Interface: "eth0",
+		PinPath: "/sys/fs/bpf/enviro"}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.release()
+
+	tests := []struct {
+		name   string
+		config NetworkConfig
+		want   error
+	}{
+		{name: "other instance", config: NetworkConfig{Instance: "b", CIDR: "10.2.0.0/24", EnableXDP: true,
+			Interface: "eth1", PinPath: "/sys/fs/bpf/enviro"}},
+		{name: "same instance", config: NetworkConfig{Instance: "a", CIDR: "10.2.0.0/24"}, want: ErrInstanceInUse},
+		{name: "same interface", config: NetworkConfig{Instance: "b", CIDR: "10.2.0.0/24", EnableXDP: true,
+			Interface: "eth0"}, want: ErrInstanceInUse},
+		{name: "same pin path", config: NetworkConfig{Instance: "", CIDR: "10.2.0.0/24", PinPath: "/sys/fs/bpf/enviro/a"},
+			want: ErrInstanceInUse},
+		{name: "overlapping cidr", config: NetworkConfig{Instance: "b", CIDR: "10.1.0.0/16"}, want: ErrInvalidCIDR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &NetworkManager{instance: tt.config.Instance}
+			err := b.claim(tt.config)
+			b.release()
+			if tt.want == nil && err != nil || !errors.Is(err, tt.want) {
+				t.Errorf("claim() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Released claims can be taken again
+	a.release()
+	b := &NetworkManager{instance: "a"}
+	if err := b.claim(NetworkConfig{Instance: "a", CIDR: "10.1.0.0/24"}); err != nil {
+		t.Errorf("claim() after release = %v", err)
+	}
+	b.release()
+}
+
+func TestHostVethNames(t *testing.T) {
+	for _, instance := range []string{"", "a", "b2", "abcd"} {
+		name := hostVethName(instance, "c1")
+		if len(name) > maxLinkName {
+			t.Errorf("hostVethName(%q) = %q, longer than %d", instance, name, maxLinkName)
+		}
+		if tmp := tmpLinkName(instance, "c1"); len(tmp) > maxLinkName {
+			t.Errorf("tmpLinkName(%q) = %q, longer than %d", instance, tmp, maxLinkName)
+		}
+		if !isHostVethName(instance, name) || !isAnyHostVethName(name) {
+			t.Errorf("%q isn't a host veth name of instance %q", name, instance)
+		}
+		for _, other := range []string{"", "a", "b2", "abcd"} {
+			if other != instance && isHostVethName(other, name) {
+				t.Errorf("%q of instance %q is a host veth name of instance %q", name, instance, other)
+			}
+		}
+	}
+	if got := hostVethName("", "c1"); got[:4] != "veth" || len(got) != 14 {
+		t.Errorf("hostVethName() of the default instance = %q, want veth and 10 digits", got)
+	}
+	// The same container in two instances gets veths of its own in each
+	if hostVethName("a", "c1")[3:] == hostVethName("b", "c1")[3:] || tmpLinkName("a", "c1") == tmpLinkName("b", "c1") {
+		t.Error("instances a and b name the links of c1 alike")
+	}
+}
@@ -0,0 +1,743 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ipamCallTimeout bounds each call into an IPAM backend. The manager's
+// lock is held through them, so an unreachable DHCP server or plugin
+// would otherwise stall every other operation.
+const ipamCallTimeout = 10 * time.Second
+
+// ErrPoolExhausted is returned when every address in the CIDR is allocated
+var ErrPoolExhausted = errors.New("network: address pool exhausted")
+
+// ErrInvalidAddress is returned for requested addresses the pools can't
+// hand out
+var ErrInvalidAddress = errors.New("network: invalid address")
+
+// ErrAddressInUse is returned for requested addresses another container
+// holds or has reserved
+var ErrAddressInUse = errors.New("network: address in use")
+
+// ErrIPAMUnavailable is returned when the IPAM backend can't be reached or
+// fails to allocate an address
+var ErrIPAMUnavailable = errors.New("network: IPAM backend unavailable")
+
+// ipAllocator hands out container addresses from a single CIDR.
+// The network, broadcast and gateway addresses are never allocated.
+type ipAllocator struct {
+	mu      sync.Mutex
+	prefix  netip.Prefix
+	gateway netip.Addr
+	// byContainer maps containerID to its address
+	byContainer map[string]netip.Addr
+	// inUse maps allocated addresses back to their containerID
+	inUse map[netip.Addr]string
+	// next is where the search for a free address resumes
+	next netip.Addr
+	// ranges are the parts of prefix reserved for namespaces, by name.
+	// Containers of such a namespace only get addresses in its range and
+	// those of other namespaces never do.
+	ranges map[string]netip.Prefix
+	// pinned maps addresses reserved for a container to its ID. They are
+	// only allocated to that container, even while it has none.
+	pinned map[netip.Addr]string
+}
+
+// newIPAllocator parses cidr and reserves gateway, which defaults to the
+// first host address when empty.
+func newIPAllocator(cidr, gateway string) (*ipAllocator, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrInvalidCIDR, cidr, err)
+	}
+	prefix = prefix.Masked()
+	if prefix.Addr().Is4In6() {
+		return nil, fmt.Errorf("%w: %s: IPv4-mapped IPv6 networks are not supported", ErrInvalidCIDR, prefix)
+	}
+
+	a := &ipAllocator{
+		prefix:      prefix,
+		byContainer: make(map[string]netip.Addr),
+		inUse:       make(map[netip.Addr]string),
+		ranges:      make(map[string]netip.Prefix),
+		pinned:      make(map[netip.Addr]string),
+	}
+
+	first := prefix.Addr().Next()
+	if !a.usable(first) {
+		return nil, fmt.Errorf("%w: %s has no usable host addresses", ErrInvalidCIDR, prefix)
+	}
+
+	if gateway == "" {
+		a.gateway = first
+	} else {
+		gw, err := netip.ParseAddr(gateway)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid gateway %q: %v", ErrInvalidConfig, gateway, err)
+		}
+		if !a.usable(gw) {
+			return nil, fmt.Errorf("%w: gateway %s is not a host address in %s", ErrInvalidConfig, gw, prefix)
+		}
+		a.gateway = gw
+	}
+
+	a.next = first
+	return a, nil
+}
+
+// newAddressPools builds one allocator per configured CIDR, IPv4 first.
+// At most one IPv4 and one IPv6 network may be configured. In an overlay
+// the allocators cover only this node's subnets.
+func newAddressPools(config NetworkConfig) ([]*ipAllocator, error) {
+	if config.CIDR == "" && config.CIDR6 == "" {
+		return nil, fmt.Errorf("%w: no CIDR configured", ErrInvalidCIDR)
+	}
+
+	var pools []*ipAllocator
+	for _, c := range []struct{ cidr, subnet, gateway string }{
+		{config.CIDR, nodeSubnet(config, false), config.Gateway},
+		{config.CIDR6, nodeSubnet(config, true), config.Gateway6},
+	} {
+		if c.cidr == "" {
+			continue
+		}
+		if c.subnet != "" {
+			c.cidr = c.subnet
+		}
+		a, err := newIPAllocator(c.cidr, c.gateway)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range pools {
+			if other.prefix.Overlaps(a.prefix) {
+				return nil, fmt.Errorf("%w: CIDRs %s and %s overlap", ErrInvalidCIDR, other.prefix, a.prefix)
+			}
+			if other.prefix.Addr().Is4() == a.prefix.Addr().Is4() {
+				return nil, fmt.Errorf("%w: CIDRs %s and %s are the same family; configure one IPv4 and one IPv6 network", ErrInvalidCIDR, other.prefix, a.prefix)
+			}
+		}
+		pools = append(pools, a)
+	}
+	if config.CIDR6 != "" && !pools[len(pools)-1].prefix.Addr().Is6() {
+		return nil, fmt.Errorf("%w: CIDR6 %s is not an IPv6 network", ErrInvalidCIDR, config.CIDR6)
+	}
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].prefix.Addr().Is4() && !pools[j].prefix.Addr().Is4()
+	})
+	return pools, nil
+}
+
+// usable reports whether addr is a host address inside the prefix
+func (a *ipAllocator) usable(addr netip.Addr) bool {
+	if !a.prefix.Contains(addr) || addr == a.prefix.Addr() {
+		return false
+	}
+	if addr.Is4() && addr == lastAddr(a.prefix) {
+		return false // broadcast
+	}
+	return true
+}
+
+// Allocate returns the address for containerID, allocating the next free
+// one for the namespace if the container has none yet.
+func (a *ipAllocator) Allocate(containerID, namespace string) (netip.Addr, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	scope, ok := a.ranges[namespace]
+	if !ok {
+		scope = a.prefix
+	}
+	return a.allocate(containerID, namespace, scope)
+}
+
+// AllocateIn is Allocate limited to the addresses of scope, a part of the
+// pool
+func (a *ipAllocator) AllocateIn(containerID, namespace string, scope netip.Prefix) (netip.Addr, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if scope.Bits() < a.prefix.Bits() || !a.prefix.Contains(scope.Addr()) {
+		return netip.Addr{}, fmt.Errorf("%w: %s is outside %s", ErrInvalidAddress, scope, a.prefix)
+	}
+	return a.allocate(containerID, namespace, scope)
+}
+
+// allocate allocates the next free address of scope the namespace may
+// have. Callers must hold a.mu.
+func (a *ipAllocator) allocate(containerID, namespace string, scope netip.Prefix) (netip.Addr, error) {
+	if addr, ok := a.byContainer[containerID]; ok {
+		return addr, nil
+	}
+
+	own, ranged := a.ranges[namespace]
+	if !scope.Contains(a.next) {
+		a.next = scope.Addr()
+	}
+	start := a.next
+	addr := start
+	for {
+		if a.usable(addr) && addr != a.gateway && a.rangeOwner(addr, namespace) && (!ranged || own.Contains(addr)) {
+			_, taken := a.inUse[addr]
+			if owner, ok := a.pinned[addr]; !taken && (!ok || owner == containerID) {
+				break
+			}
+		}
+		addr = addr.Next()
+		if !addr.IsValid() || !scope.Contains(addr) {
+			addr = scope.Addr()
+		}
+		if addr == start {
+			return netip.Addr{}, fmt.Errorf("%w: %s", ErrPoolExhausted, scope)
+		}
+	}
+
+	a.byContainer[containerID] = addr
+	a.inUse[addr] = containerID
+	a.next = addr.Next()
+	return addr, nil
+}
+
+// AllocateAddr allocates addr, which a container of namespace requested,
+// to containerID. It fails with ErrInvalidAddress unless the namespace may
+// have addr, and with ErrAddressInUse when another container holds or
+// pinned it.
+func (a *ipAllocator) AllocateAddr(containerID, namespace string, addr netip.Addr) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.checkAddr(addr); err != nil {
+		return err
+	}
+	if !a.rangeOwner(addr, namespace) {
+		return fmt.Errorf("%w: %s is outside the range of namespace %s", ErrInvalidAddress, addr, namespace)
+	}
+	if owner, ok := a.pinned[addr]; ok && owner != containerID {
+		return fmt.Errorf("%w: %s is reserved for %s", ErrAddressInUse, addr, owner)
+	}
+	return a.claim(containerID, addr)
+}
+
+// Reserve claims addr for containerID, e.g. when restoring saved state
+func (a *ipAllocator) Reserve(containerID string, addr netip.Addr) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.checkAddr(addr); err != nil {
+		return err
+	}
+	if owner, ok := a.pinned[addr]; ok && owner != containerID {
+		return fmt.Errorf("address %s is reserved for %s", addr, owner)
+	}
+	return a.claim(containerID, addr)
+}
+
+// checkAddr fails with ErrInvalidAddress unless addr may be allocated
+func (a *ipAllocator) checkAddr(addr netip.Addr) error {
+	if !a.usable(addr) || addr == a.gateway {
+		return fmt.Errorf("%w: %s is not allocatable in %s", ErrInvalidAddress, addr, a.prefix)
+	}
+	return nil
+}
+
+// claim records addr as held by containerID. Callers must hold a.mu.
+func (a *ipAllocator) claim(containerID string, addr netip.Addr) error {
+	if owner, taken := a.inUse[addr]; taken && owner != containerID {
+		return fmt.Errorf("%w: %s is already held by %s", ErrAddressInUse, addr, owner)
+	}
+	if old, ok := a.byContainer[containerID]; ok && old != addr {
+		return fmt.Errorf("container %s already holds %s", containerID, old)
+	}
+
+	a.byContainer[containerID] = addr
+	a.inUse[addr] = containerID
+	return nil
+}
+
+// Pin reserves addr for containerID, which must be the only container
+// holding or pinning it. A container pins at most one address of a pool,
+// so pinning another releases the previous one.
+func (a *ipAllocator) Pin(containerID string, addr netip.Addr) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.checkAddr(addr); err != nil {
+		return err
+	}
+	if owner, ok := a.pinned[addr]; ok && owner != containerID {
+		return fmt.Errorf("%w: %s is reserved for %s", ErrAddressInUse, addr, owner)
+	}
+	if owner, taken := a.inUse[addr]; taken && owner != containerID {
+		return fmt.Errorf("%w: %s is held by %s", ErrAddressInUse, addr, owner)
+	}
+	a.unpin(containerID)
+	a.pinned[addr] = containerID
+	return nil
+}
+
+// Unpin drops the address pinned for containerID, if any. An address it
+// holds stays allocated until released.
+func (a *ipAllocator) Unpin(containerID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.unpin(containerID)
+}
+
+func (a *ipAllocator) unpin(containerID string) {
+	for addr, owner := range a.pinned {
+		if owner == containerID {
+			delete(a.pinned, addr)
+		}
+	}
+}
+
+// rangeOwner reports whether addr is in the range of namespace or in none
+func (a *ipAllocator) rangeOwner(addr netip.Addr, namespace string) bool {
+	for name, r := range a.ranges {
+		if r.Contains(addr) {
+			return name == namespace
+		}
+	}
+	return true
+}
+
+// ReserveRange reserves prefix for the containers of namespace. It must be
+// inside the pool, overlap no other range and hold no allocated address.
+func (a *ipAllocator) ReserveRange(namespace string, prefix netip.Prefix) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if prefix.Bits() < a.prefix.Bits() || !a.prefix.Contains(prefix.Addr()) {
+		return fmt.Errorf("range %s is outside %s", prefix, a.prefix)
+	}
+	for name, r := range a.ranges {
+		if name != namespace && r.Overlaps(prefix) {
+			return fmt.Errorf("range %s overlaps %s of namespace %s", prefix, r, name)
+		}
+	}
+	for addr, owner := range a.inUse {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("range %s holds %s of %s", prefix, addr, owner)
+		}
+	}
+	a.ranges[namespace] = prefix
+	return nil
+}
+
+// ReleaseRange drops the range of namespace, if any
+func (a *ipAllocator) ReleaseRange(namespace string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.ranges, namespace)
+}
+
+// Transfer hands the address held by from to containerID of namespace,
+// e.g. that of a warm attachment. It fails with ErrInvalidAddress unless
+// the namespace would be allocated the address and with ErrAddressInUse
+// when it is pinned for another container, leaving it to from.
+func (a *ipAllocator) Transfer(from, containerID, namespace string) (netip.Addr, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	addr, ok := a.byContainer[from]
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("%s holds no address of %s", from, a.prefix)
+	}
+	if own, ranged := a.ranges[namespace]; !a.rangeOwner(addr, namespace) || ranged && !own.Contains(addr) {
+		return netip.Addr{}, fmt.Errorf("%w: %s is outside the range of namespace %s", ErrInvalidAddress, addr, namespace)
+	}
+	if owner, ok := a.pinned[addr]; ok && owner != containerID {
+		return netip.Addr{}, fmt.Errorf("%w: %s is reserved for %s", ErrAddressInUse, addr, owner)
+	}
+	if old, ok := a.byContainer[containerID]; ok {
+		return netip.Addr{}, fmt.Errorf("container %s already holds %s", containerID, old)
+	}
+	delete(a.byContainer, from)
+	a.byContainer[containerID] = addr
+	a.inUse[addr] = containerID
+	return addr, nil
+}
+
+// Release frees the address held by containerID, if any
+func (a *ipAllocator) Release(containerID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if addr, ok := a.byContainer[containerID]; ok {
+		delete(a.inUse, addr)
+		delete(a.byContainer, containerID)
+	}
+}
+
+// Lookup returns the address held by containerID
+func (a *ipAllocator) Lookup(containerID string) (netip.Addr, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	addr, ok := a.byContainer[containerID]
+	return addr, ok
+}
+
+// Allocations returns a copy of the containerID to address table
+func (a *ipAllocator) Allocations() map[string]netip.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := make(map[string]netip.Addr, len(a.byContainer))
+	for id, addr := range a.byContainer {
+		out[id] = addr
+	}
+	return out
+}
+
+// Usage returns the size and allocations of the pool
+func (a *ipAllocator) Usage() PoolUsage {
+	a.mu.Lock()
+	allocated := len(a.byContainer)
+	warm := 0
+	for id := range a.byContainer {
+		if isWarmID(id) {
+			warm++
+		}
+	}
+	a.mu.Unlock()
+
+	// All addresses but the network address, the gateway and, for IPv4,
+	// the broadcast address
+	reserved := uint64(2)
+	if a.prefix.Addr().Is4() {
+		reserved = 3
+	}
+	size := uint64(math.MaxUint64)
+	if hostBits := a.prefix.Addr().BitLen() - a.prefix.Bits(); hostBits < 64 {
+		size = uint64(1)<<hostBits - reserved
+	}
+	return PoolUsage{CIDR: a.prefix.String(), Size: size, Allocated: allocated, Warm: warm}
+}
+
+// IPAM backends, see IPAMConfig
+const (
+	IPAMHostLocal = "host-local"
+	IPAMDHCP      = "dhcp"
+	IPAMExternal  = "external"
+)
+
+// Failure policies of IPAM backends, see IPAMConfig
+const (
+	IPAMFailClosed    = "fail-closed"
+	IPAMFailEmergency = "emergency-pool"
+)
+
+// IPAMConfig chooses where container addresses come from. The pools keep
+// track of the addresses of containers either way, so namespace ranges,
+// reservations and requested addresses still apply to those a backend
+// hands out: addresses breaking them are given back and the container
+// fails to start.
+type IPAMConfig struct {
+	// Backend is IPAMHostLocal, the default, which allocates from the
+	// pools themselves, IPAMDHCP or IPAMExternal
+	Backend string `json:"backend"`
+	// DHCP configures the IPAMDHCP backend
+	DHCP DHCPConfig `json:"dhcp"`
+	// External is the IPAMExternal backend, such as an IPAM plugin the
+	// control plane connects to. The manager closes it on Close, the
+	// caller when NewNetworkManager fails.
+	External IPAM `json:"-"`
+	// FailurePolicy is what becomes of allocations while the backend is
+	// unavailable: IPAMFailClosed, the default, fails them and
+	// IPAMFailEmergency allocates from EmergencyRanges instead
+	FailurePolicy string `json:"failure_policy"`
+	// EmergencyRanges are parts of the pools, in CIDR notation, the
+	// manager allocates from itself under IPAMFailEmergency. The backend
+	// must not hand out their addresses; it learns of those allocated
+	// while it was unavailable when the IPAM state is reconciled.
+	EmergencyRanges []string `json:"emergency_ranges"`
+	// Reconcile compares the addresses the backend holds with those of
+	// the containers periodically, see ReconcileIPAM
+	Reconcile IPAMReconcileConfig `json:"reconcile"`
+}
+
+func (c IPAMConfig) validate(config NetworkConfig) error {
+	switch c.Backend {
+	case "", IPAMHostLocal:
+	case IPAMDHCP:
+		if config.CIDR == "" {
+			return fmt.Errorf("%w: DHCP leases IPv4 addresses but no IPv4 CIDR is configured", ErrInvalidConfig)
+		}
+		return c.DHCP.validate(config)
+	case IPAMExternal:
+		if c.External == nil {
+			return fmt.Errorf("%w: no external IPAM backend configured", ErrInvalidConfig)
+		}
+	default:
+		return fmt.Errorf("%w: unknown IPAM backend %q", ErrInvalidConfig, c.Backend)
+	}
+	local := c.Backend == "" || c.Backend == IPAMHostLocal
+
+	switch c.FailurePolicy {
+	case "", IPAMFailClosed:
+	case IPAMFailEmergency:
+		if local {
+			return fmt.Errorf("%w: the %s IPAM backend has no failure policy", ErrInvalidConfig, IPAMHostLocal)
+		}
+		if len(c.EmergencyRanges) == 0 {
+			return fmt.Errorf("%w: IPAM failure policy %s needs emergency ranges", ErrInvalidConfig, IPAMFailEmergency)
+		}
+	default:
+		return fmt.Errorf("%w: unknown IPAM failure policy %q", ErrInvalidConfig, c.FailurePolicy)
+	}
+	for _, r := range c.EmergencyRanges {
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return fmt.Errorf("%w: invalid emergency range %q: %v", ErrInvalidConfig, r, err)
+		}
+		if !insideCIDR(prefix, config.CIDR) && !insideCIDR(prefix, config.CIDR6) {
+			return fmt.Errorf("%w: emergency range %s is outside the configured networks", ErrInvalidConfig, prefix)
+		}
+	}
+
+	if err := c.Reconcile.validate(); err != nil {
+		return err
+	}
+	if c.Reconcile.Mode != "" && local {
+		return fmt.Errorf("%w: the %s IPAM backend has nothing to reconcile", ErrInvalidConfig, IPAMHostLocal)
+	}
+	return nil
+}
+
+// insideCIDR reports whether prefix is a part of cidr, which may be empty
+func insideCIDR(prefix netip.Prefix, cidr string) bool {
+	network, err := netip.ParsePrefix(cidr)
+	return err == nil && prefix.Bits() >= network.Bits() && network.Masked().Contains(prefix.Addr())
+}
+
+// IPAM is a backend container addresses are allocated from
+type IPAM interface {
+	// Name names the backend in logs
+	Name() string
+	// Manages reports whether the backend allocates the addresses of pool.
+	// Those of the other pools are allocated by the pools themselves.
+	Manages(pool netip.Prefix) bool
+	// Allocate returns an address of req.Pool for the container, req.Addr
+	// when set. Allocating for a container holding an address returns that
+	// address.
+	Allocate(ctx context.Context, req IPAMRequest) (netip.Addr, error)
+	// Restore reserves req.Addr for the container, which held it before
+	// the manager restarted or while the backend was unavailable
+	Restore(ctx context.Context, req IPAMRequest) error
+	// Release frees req.Addr, the container's address
+	Release(ctx context.Context, req IPAMRequest) error
+	// List returns the addresses of pool the backend holds for the
+	// containers of this node
+	List(ctx context.Context, pool netip.Prefix) ([]IPAMAllocation, error)
+	Close() error
+}
+
+// IPAMAllocation is an address a backend holds for a container
+type IPAMAllocation struct {
+	ContainerID string
+	Addr        netip.Addr
+}
+
+// IPAMRequest is an address allocation of a container
+type IPAMRequest struct {
+	ContainerID string
+	Namespace   string
+	// Pool is the pool the address is of, and Gateway its gateway
+	Pool    netip.Prefix
+	Gateway netip.Addr
+	// Addr is the address the container requested when allocating, and
+	// the one it holds when restoring or releasing
+	Addr netip.Addr
+	// MAC is the MAC of the container interface when known, else empty
+	MAC string
+	// Hostname is the container's name, if it has one
+	Hostname string
+}
+
+// hostLocal is the IPAMHostLocal backend of a single pool
+type hostLocal struct {
+	pool *ipAllocator
+}
+
+func (h hostLocal) Name() string { return IPAMHostLocal }
+
+func (h hostLocal) Manages(pool netip.Prefix) bool { return pool == h.pool.prefix }
+
+func (h hostLocal) Allocate(ctx context.Context, req IPAMRequest) (netip.Addr, error) {
+	if req.Addr.IsValid() {
+		return req.Addr, h.pool.AllocateAddr(req.ContainerID, req.Namespace, req.Addr)
+	}
+	return h.pool.Allocate(req.ContainerID, req.Namespace)
+}
+
+func (h hostLocal) Restore(ctx context.Context, req IPAMRequest) error {
+	return h.pool.Reserve(req.ContainerID, req.Addr)
+}
+
+func (h hostLocal) Release(ctx context.Context, req IPAMRequest) error {
+	h.pool.Release(req.ContainerID)
+	return nil
+}
+
+func (h hostLocal) List(ctx context.Context, pool netip.Prefix) ([]IPAMAllocation, error) {
+	var out []IPAMAllocation
+	for id, addr := range h.pool.Allocations() {
+		out = append(out, IPAMAllocation{ContainerID: id, Addr: addr})
+	}
+	return out, nil
+}
+
+func (h hostLocal) Close() error { return nil }
+
+// newIPAM returns the backend config.IPAM chooses, nil for IPAMHostLocal
+func newIPAM(config NetworkConfig, logger *slog.Logger) (IPAM, error) {
+	switch config.IPAM.Backend {
+	case IPAMDHCP:
+		return NewDHCPIPAM(config.IPAM.DHCP, config.Interface, logger)
+	case IPAMExternal:
+		return config.IPAM.External, nil
+	}
+	return nil, nil
+}
+
+// dropIPAM closes the backend newIPAM made, when the manager fails to
+// start
+func (nm *NetworkManager) dropIPAM() {
+	if nm.ipam != nil && nm.config.IPAM.Backend != IPAMExternal {
+		nm.ipam.Close()
+	}
+}
+
+// backend returns the backend allocating the addresses of pool
+func (nm *NetworkManager) backend(pool *ipAllocator) IPAM {
+	if nm.ipam != nil && nm.ipam.Manages(pool.prefix) {
+		return nm.ipam
+	}
+	return hostLocal{pool}
+}
+
+// allocateAddr allocates an address of pool to the container of req and
+// records it in the pool, which gives it back to the backend unless the
+// container may have it
+func (nm *NetworkManager) allocateAddr(ctx context.Context, pool *ipAllocator, req IPAMRequest) (netip.Addr, error) {
+	b := nm.backend(pool)
+	ctx, cancel := context.WithTimeout(ctx, ipamCallTimeout)
+	defer cancel()
+	addr, err := b.Allocate(ctx, req)
+	if errors.Is(err, ErrIPAMUnavailable) && nm.config.IPAM.FailurePolicy == IPAMFailEmergency {
+		return nm.allocateEmergency(pool, req, fmt.Errorf("%s IPAM: %w", b.Name(), err))
+	}
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%s IPAM: %w", b.Name(), err)
+	}
+	if err := pool.AllocateAddr(req.ContainerID, req.Namespace, addr); err != nil {
+		req.Addr = addr
+		if err := b.Release(ctx, req); err != nil {
+			nm.log.Warn("Failed to release refused address", "ipam", b.Name(), "container_id", req.ContainerID, "address", addr, "error", err)
+		}
+		return netip.Addr{}, fmt.Errorf("%s IPAM: %w", b.Name(), err)
+	}
+	return addr, nil
+}
+
+// allocateEmergency allocates an address of the emergency range of pool to
+// the container of req while the backend fails with cause. Containers
+// requesting an address still fail, as only the backend knows whether it
+// is free.
+func (nm *NetworkManager) allocateEmergency(pool *ipAllocator, req IPAMRequest, cause error) (netip.Addr, error) {
+	if req.Addr.IsValid() {
+		return netip.Addr{}, cause
+	}
+	for _, r := range nm.config.IPAM.EmergencyRanges {
+		scope, err := netip.ParsePrefix(r)
+		if err != nil || !pool.prefix.Contains(scope.Addr()) || scope.Bits() < pool.prefix.Bits() {
+			continue
+		}
+		addr, err := pool.AllocateIn(req.ContainerID, req.Namespace, scope.Masked())
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("%w; emergency range %s: %w", cause, scope, err)
+		}
+		nm.log.Warn("Allocated address from the emergency range", "container_id", req.ContainerID, "address", addr, "range", scope, "error", cause)
+		return addr, nil
+	}
+	return netip.Addr{}, cause
+}
+
+// restoreAddr takes back addr, held by the container of cn before a
+// restart
+func (nm *NetworkManager) restoreAddr(cn *ContainerNetwork, addr netip.Addr) error {
+	for _, pool := range nm.pools {
+		if !pool.prefix.Contains(addr) {
+			continue
+		}
+		b := nm.backend(pool)
+		req := IPAMRequest{
+			ContainerID: cn.ContainerID,
+			Namespace:   cn.Namespace,
+			Pool:        pool.prefix,
+			Gateway:     pool.gateway,
+			Addr:        addr,
+			MAC:         cn.MAC,
+			Hostname:    cn.Name,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ipamCallTimeout)
+		err := b.Restore(ctx, req)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s IPAM: %w", b.Name(), err)
+		}
+		return pool.Reserve(cn.ContainerID, addr)
+	}
+	return fmt.Errorf("address %s is outside the configured networks", addr)
+}
+
+// releaseAddr returns the address of containerID in pool, if any, to its
+// backend, unless the container is migrating. Backends failing to free it
+// only lose track of it for as long as they keep it, so the failure is
+// logged.
+func (nm *NetworkManager) releaseAddr(pool *ipAllocator, containerID string) {
+	addr, ok := pool.Lookup(containerID)
+	if !ok {
+		return
+	}
+	pool.Release(containerID)
+	if nm.reservations[containerID].Migrating {
+		// Kept for the network RestoreNetwork creates, maybe on another node
+		return
+	}
+	b := nm.backend(pool)
+	req := IPAMRequest{ContainerID: containerID, Pool: pool.prefix, Gateway: pool.gateway, Addr: addr}
+	ctx, cancel := context.WithTimeout(context.Background(), ipamCallTimeout)
+	defer cancel()
+	if err := b.Release(ctx, req); err != nil {
+		nm.log.Warn("Failed to release address", "ipam", b.Name(), "container_id", containerID, "address", addr, "error", err)
+	}
+}
+
+// lastAddr returns the highest address in prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	bits := prefix.Bits()
+	for i := range b {
+		hostBits := len(b)*8 - bits - (len(b)-1-i)*8
+		switch {
+		case hostBits >= 8:
+			b[i] = 0xff
+		case hostBits > 0:
+			b[i] |= byte(1<<hostBits) - 1
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,18 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+	"github.com/1090mb/enviro/enviro-go/pkg/network/ipamtest"
+)
+
+func TestHostLocalConformance(t *testing.T) {
+	ipamtest.Run(t, func(t *testing.T) network.IPAM {
+		b, err := network.NewHostLocalIPAM(ipamtest.Pool.String(), ipamtest.Gateway.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	})
+}
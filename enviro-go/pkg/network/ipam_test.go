@@ -0,0 +1,511 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestNewIPAllocator(t *testing.T) {
+	tests := []struct {
+		name        string
+		cidr        string
+		gateway     string
+		wantGateway string
+		wantErr     error
+	}{
+		{name: "default gateway", cidr: "10.0.0.0/24", wantGateway: "10.0.0.1"},
+		{name: "unmasked cidr", cidr: "10.0.0.7/24", wantGateway: "10.0.0.1"},
+		{name: "explicit gateway", cidr: "10.0.0.0/24", gateway: "10.0.0.254", wantGateway: "10.0.0.254"},
+		{name: "ipv6", cidr: "fd00::/64", wantGateway: "fd00::1"},
+		{name: "invalid cidr", cidr: "10.0.0.0/33", wantErr: ErrInvalidCIDR},
+		{name: "no host addresses", cidr: "10.0.0.0/32", wantErr: ErrInvalidCIDR},
+		{name: "ipv4-mapped", cidr: "::ffff:10.0.0.0/120", wantErr: ErrInvalidCIDR},
+		{name: "gateway outside", cidr: "10.0.0.0/24", gateway: "10.0.1.1", wantErr: ErrInvalidConfig},
+		{name: "gateway is broadcast", cidr: "10.0.0.0/24", gateway: "10.0.0.255", wantErr: ErrInvalidConfig},
+		{name: "gateway unparsable", cidr: "10.0.0.0/24", gateway: "gw", wantErr: ErrInvalidConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newIPAllocator(tt.cidr, tt.gateway)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("newIPAllocator(%q, %q) error = %v, want %v", tt.cidr, tt.gateway, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newIPAllocator(%q, %q): %v", tt.cidr, tt.gateway, err)
+			}
+			if got := a.gateway.String(); got != tt.wantGateway {
+				t.Errorf("gateway = %s, want %s", got, tt.wantGateway)
+			}
+		})
+	}
+}
+
+func TestIPAllocatorAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidr    string
+		gateway string
+		// ids are allocated in order, and want holds what each gets
+		ids  []string
+		want []string
+		// wantErr is the error of allocating one more address
+		wantErr error
+	}{
+		{
+			name:    "skips gateway and broadcast",
+			cidr:    "10.0.0.0/30",
+			ids:     []string{"a"},
+			want:    []string{"10.0.0.2"},
+			wantErr: ErrPoolExhausted,
+		},
+		{
+			name:    "skips explicit gateway",
+			cidr:    "10.0.0.0/29",
+			gateway: "10.0.0.2",
+			ids:     []string{"a", "b", "c", "d", "e"},
+			want:    []string{"10.0.0.1", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"},
+			wantErr: ErrPoolExhausted,
+		},
+		{
+			name: "same container gets same address",
+			cidr: "10.0.0.0/24",
+			ids:  []string{"a", "b", "a"},
+			want: []string{"10.0.0.2", "10.0.0.3", "10.0.0.2"},
+		},
+		{
+			name:    "ipv6 has no broadcast",
+			cidr:    "fd00::/126",
+			ids:     []string{"a", "b"},
+			want:    []string{"fd00::2", "fd00::3"},
+			wantErr: ErrPoolExhausted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newIPAllocator(tt.cidr, tt.gateway)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, id := range tt.ids {
+				addr, err := a.Allocate(id, DefaultNamespace)
+				if err != nil {
+					t.Fatalf("Allocate(%s): %v", id, err)
+				}
+				if addr.String() != tt.want[i] {
+					t.Errorf("Allocate(%s) = %s, want %s", id, addr, tt.want[i])
+				}
+			}
+			_, err = a.Allocate("extra", DefaultNamespace)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Allocate(extra): %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Allocate(extra) error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIPAllocatorRelease(t *testing.T) {
+	a, err := newIPAllocator("10.0.0.0/29", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10.0.0.2 to 10.0.0.6 are allocatable
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := a.Allocate(id, DefaultNamespace); err != nil {
+			t.Fatalf("Allocate(%s): %v", id, err)
+		}
+	}
+	if _, err := a.Allocate("f", DefaultNamespace); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Allocate(f) error = %v, want %v", err, ErrPoolExhausted)
+	}
+
+	a.Release("c")
+	a.Release("unknown")
+	if _, ok := a.Lookup("c"); ok {
+		t.Error("Lookup(c) found a released address")
+	}
+	if got := a.Usage().Allocated; got != 4 {
+		t.Errorf("Usage().Allocated = %d, want 4", got)
+	}
+	addr, err := a.Allocate("f", DefaultNamespace)
+	if err != nil {
+		t.Fatalf("Allocate(f) after release: %v", err)
+	}
+	if want := netip.MustParseAddr("10.0.0.4"); addr != want {
+		t.Errorf("Allocate(f) = %s, want the released %s", addr, want)
+	}
+	if got := a.Allocations(); len(got) != 5 || got["f"] != addr {
+		t.Errorf("Allocations() = %v", got)
+	}
+}
+
+func TestIPAllocatorAllocateAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		addr    string
+		wantErr error
+	}{
+		{name: "free address", id: "b", addr: "10.0.0.10"},
+		{name: "held by the container", id: "a", addr: "10.0.0.2"},
+		{name: "held by another", id: "b", addr: "10.0.0.2", wantErr: ErrAddressInUse},
+		{name: "pinned by another", id: "b", addr: "10.0.0.20", wantErr: ErrAddressInUse},
+		{name: "pinned by the container", id: "p", addr: "10.0.0.20"},
+		{name: "gateway", id: "b", addr: "10.0.0.1", wantErr: ErrInvalidAddress},
+		{name: "network address", id: "b", addr: "10.0.0.0", wantErr: ErrInvalidAddress},
+		{name: "broadcast", id: "b", addr: "10.0.0.255", wantErr: ErrInvalidAddress},
+		{name: "outside the pool", id: "b", addr: "10.0.1.2", wantErr: ErrInvalidAddress},
+		{name: "in another namespace's range", id: "b", addr: "10.0.0.130", wantErr: ErrInvalidAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newIPAllocator("10.0.0.0/24", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.Allocate("a", DefaultNamespace); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Pin("p", netip.MustParseAddr("10.0.0.20")); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.ReserveRange("team", netip.MustParsePrefix("10.0.0.128/25")); err != nil {
+				t.Fatal(err)
+			}
+
+			err = a.AllocateAddr(tt.id, DefaultNamespace, netip.MustParseAddr(tt.addr))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("AllocateAddr(%s, %s) error = %v, want %v", tt.id, tt.addr, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AllocateAddr(%s, %s): %v", tt.id, tt.addr, err)
+			}
+			if got, _ := a.Lookup(tt.id); got.String() != tt.addr {
+				t.Errorf("Lookup(%s) = %s, want %s", tt.id, got, tt.addr)
+			}
+		})
+	}
+}
+
+func TestIPAllocatorRanges(t *testing.T) {
+	a, err := newIPAllocator("10.0.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReserveRange("team", netip.MustParsePrefix("10.0.0.128/30")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReserveRange("other", netip.MustParsePrefix("10.0.0.128/29")); err == nil {
+		t.Error("ReserveRange accepted a range overlapping another namespace's")
+	}
+	if err := a.ReserveRange("other", netip.MustParsePrefix("10.0.1.0/30")); err == nil {
+		t.Error("ReserveRange accepted a range outside the pool")
+	}
+
+	// Only the pool's network and broadcast addresses are skipped, not
+	// those of the range
+	want := []string{"10.0.0.128", "10.0.0.129", "10.0.0.130", "10.0.0.131"}
+	for i, w := range want {
+		addr, err := a.Allocate(string(rune('a'+i)), "team")
+		if err != nil {
+			t.Fatalf("Allocate in range: %v", err)
+		}
+		if addr.String() != w {
+			t.Errorf("Allocate in range = %s, want %s", addr, w)
+		}
+	}
+	if _, err := a.Allocate("e", "team"); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Allocate in full range error = %v, want %v", err, ErrPoolExhausted)
+	}
+	addr, err := a.Allocate("x", DefaultNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if netip.MustParsePrefix("10.0.0.128/30").Contains(addr) {
+		t.Errorf("container outside the namespace got %s of its range", addr)
+	}
+
+	if err := a.ReserveRange("busy", netip.PrefixFrom(addr, 32)); err == nil {
+		t.Error("ReserveRange accepted a range holding an allocated address")
+	}
+}
+
+func TestIPAllocatorUsage(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want uint64
+	}{
+		{cidr: "10.0.0.0/24", want: 253},
+		{cidr: "10.0.0.0/30", want: 1},
+		{cidr: "fd00::/120", want: 254},
+		{cidr: "fd00::/64", want: 1<<64 - 1},
+	}
+	for _, tt := range tests {
+		a, err := newIPAllocator(tt.cidr, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Usage().Size; got != tt.want {
+			t.Errorf("Usage(%s).Size = %d, want %d", tt.cidr, got, tt.want)
+		}
+	}
+}
+
+// fakeIPAM hands out addr, or fails with err, and lists held
+type fakeIPAM struct {
+	pool     netip.Prefix
+	addr     netip.Addr
+	err      error
+	held     []IPAMAllocation
+	deadline bool
+	released []netip.Addr
+	restored []netip.Addr
+}
+
+func (f *fakeIPAM) Name() string                   { return "fake" }
+func (f *fakeIPAM) Manages(pool netip.Prefix) bool { return pool == f.pool }
+func (f *fakeIPAM) Close() error                   { return nil }
+
+func (f *fakeIPAM) Restore(ctx context.Context, req IPAMRequest) error {
+	f.restored = append(f.restored, req.Addr)
+	return nil
+}
+
+func (f *fakeIPAM) List(ctx context.Context, pool netip.Prefix) ([]IPAMAllocation, error) {
+	return f.held, f.err
+}
+
+func (f *fakeIPAM) Allocate(ctx context.Context, req IPAMRequest) (netip.Addr, error) {
+	_, f.deadline = ctx.Deadline()
+	return f.addr, f.err
+}
+
+func (f *fakeIPAM) Release(ctx context.Context, req IPAMRequest) error {
+	f.released = append(f.released, req.Addr)
+	return nil
+}
+
+func TestAllocateAddrBackend(t *testing.T) {
+	errDown := errors.New("server down")
+	tests := []struct {
+		name         string
+		addr         string
+		err          error
+		wantErr      error
+		wantReleased bool
+	}{
+		{name: "allocated", addr: "10.0.0.50"},
+		{name: "backend fails", err: errDown, wantErr: errDown},
+		{name: "address outside the pool", addr: "10.0.1.50", wantErr: ErrInvalidAddress, wantReleased: true},
+		{name: "address held by another", addr: "10.0.0.2", wantErr: ErrAddressInUse, wantReleased: true},
+		{name: "gateway", addr: "10.0.0.1", wantErr: ErrInvalidAddress, wantReleased: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := newIPAllocator("10.0.0.0/24", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := pool.Allocate("other", DefaultNamespace); err != nil {
+				t.Fatal(err)
+			}
+			b := &fakeIPAM{pool: pool.prefix, err: tt.err}
+			if tt.addr != "" {
+				b.addr = netip.MustParseAddr(tt.addr)
+			}
+			nm := &NetworkManager{log: slog.New(slog.NewTextHandler(io.Discard, nil)), pools: []*ipAllocator{pool}, ipam: b}
+
+			req := IPAMRequest{ContainerID: "c", Namespace: DefaultNamespace, Pool: pool.prefix, Gateway: pool.gateway}
+			addr, err := nm.allocateAddr(context.Background(), pool, req)
+			if !b.deadline {
+				t.Error("backend called without a deadline")
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("allocateAddr() error = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("allocateAddr(): %v", err)
+			} else if got, _ := pool.Lookup("c"); addr != b.addr || got != b.addr {
+				t.Errorf("allocateAddr() = %s and pool holds %s, want %s", addr, got, b.addr)
+			}
+			if released := len(b.released) > 0; released != tt.wantReleased {
+				t.Errorf("backend released %v, want release %v", b.released, tt.wantReleased)
+			}
+		})
+	}
+}
+
+func TestAllocateEmergency(t *testing.T) {
+	unavailable := fmt.Errorf("%w: server down", ErrIPAMUnavailable)
+	tests := []struct {
+		name    string
+		policy  string
+		ranges  []string
+		err     error
+		addr    string
+		want    string
+		wantErr error
+	}{
+		{name: "fail closed", policy: IPAMFailClosed, ranges: []string{"10.0.0.128/30"}, err: unavailable, wantErr: ErrIPAMUnavailable},
+		{name: "emergency range", policy: IPAMFailEmergency, ranges: []string{"fd00::/120", "10.0.0.128/30"}, err: unavailable, want: "10.0.0.128/30"},
+		{name: "backend refuses", policy: IPAMFailEmergency, ranges: []string{"10.0.0.128/30"}, err: ErrPoolExhausted, wantErr: ErrPoolExhausted},
+		{name: "requested address", policy: IPAMFailEmergency, ranges: []string{"10.0.0.128/30"}, err: unavailable, addr: "10.0.0.129",
+			wantErr: ErrIPAMUnavailable},
+		{name: "no range of the pool", policy: IPAMFailEmergency, ranges: []string{"fd00::/120"}, err: unavailable, wantErr: ErrIPAMUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := newIPAllocator("10.0.0.0/24", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := &fakeIPAM{pool: pool.prefix, err: tt.err}
+			nm := &NetworkManager{log: slog.New(slog.NewTextHandler(io.Discard, nil)), pools: []*ipAllocator{pool}, ipam: b,
+				config: NetworkConfig{IPAM: IPAMConfig{Backend: IPAMExternal, FailurePolicy: tt.policy, EmergencyRanges: tt.ranges}}}
+
+			req := IPAMRequest{ContainerID: "c", Namespace: DefaultNamespace, Pool: pool.prefix, Gateway: pool.gateway}
+			if tt.addr != "" {
+				req.Addr = netip.MustParseAddr(tt.addr)
+			}
+			addr, err := nm.allocateAddr(context.Background(), pool, req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("allocateAddr() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !netip.MustParsePrefix(tt.want).Contains(addr) {
+				t.Errorf("allocateAddr() = %s, want one of %s", addr, tt.want)
+			}
+			if got, _ := pool.Lookup("c"); got != addr {
+				t.Errorf("pool holds %s, want %s", got, addr)
+			}
+		})
+	}
+}
+
+func TestReconcileIPAM(t *testing.T) {
+	pool, err := newIPAllocator("10.0.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, addr := range map[string]string{"ok": "10.0.0.2", "missing": "10.0.0.3", "conflict": "10.0.0.4"} {
+		if err := pool.Reserve(id, netip.MustParseAddr(addr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	held := func(id, addr string) IPAMAllocation {
+		return IPAMAllocation{ContainerID: id, Addr: netip.MustParseAddr(addr)}
+	}
+	b := &fakeIPAM{pool: pool.prefix, held: []IPAMAllocation{
+		held("ok", "10.0.0.2"),
+		held("other", "10.0.0.4"),
+		held("gone", "10.0.0.5"),
+		held("moving", "10.0.0.6"),
+	}}
+	nm := &NetworkManager{
+		log:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		pools:        []*ipAllocator{pool},
+		ipam:         b,
+		containers:   map[string]*ContainerNetwork{"missing": {ContainerID: "missing", Namespace: "web", Name: "db"}},
+		reservations: map[string]Reservation{"moving": {ContainerID: "moving", Migrating: true}},
+	}
+
+	want := []IPAMDivergence{
+		{Kind: IPAMMissing, Addr: netip.MustParseAddr("10.0.0.3"), ContainerID: "missing"},
+		{Kind: IPAMConflict, Addr: netip.MustParseAddr("10.0.0.4"), ContainerID: "conflict", BackendContainerID: "other"},
+		{Kind: IPAMStale, Addr: netip.MustParseAddr("10.0.0.5"), BackendContainerID: "gone"},
+	}
+	check := func(dryRun bool) {
+		t.Helper()
+		got, err := nm.ReconcileIPAM(context.Background(), dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("ReconcileIPAM(%v) = %+v, want %+v", dryRun, got, want)
+		}
+		for i, d := range got {
+			w := want[i]
+			w.Pool = pool.prefix
+			w.Repaired = !dryRun && w.Kind != IPAMConflict
+			if d != w {
+				t.Errorf("ReconcileIPAM(%v) divergence %d = %+v, want %+v", dryRun, i, d, w)
+			}
+		}
+	}
+
+	check(true)
+	if len(b.restored) != 0 || len(b.released) != 0 {
+		t.Fatalf("dry run restored %v and released %v", b.restored, b.released)
+	}
+	check(false)
+	if len(b.restored) != 1 || b.restored[0].String() != "10.0.0.3" {
+		t.Errorf("restored %v, want 10.0.0.3", b.restored)
+	}
+	if len(b.released) != 1 || b.released[0].String() != "10.0.0.5" {
+		t.Errorf("released %v, want 10.0.0.5", b.released)
+	}
+
+	b.err = errors.New("server down")
+	if _, err := nm.ReconcileIPAM(context.Background(), false); err == nil {
+		t.Error("ReconcileIPAM() succeeded while the backend fails to list")
+	}
+}
+
+func TestIPAMConfigValidate(t *testing.T) {
+	external := &fakeIPAM{}
+	tests := []struct {
+		name   string
+		config IPAMConfig
+		err    string
+	}{
+		{name: "default"},
+		{name: "emergency", config: IPAMConfig{Backend: IPAMExternal, External: external, FailurePolicy: IPAMFailEmergency,
+			EmergencyRanges: []string{"10.0.0.240/28", "fd00::ff00/120"}, Reconcile: IPAMReconcileConfig{Mode: IPAMReconcileRepair}}},
+		{name: "host-local emergency", config: IPAMConfig{FailurePolicy: IPAMFailEmergency, EmergencyRanges: []string{"10.0.0.240/28"}},
+			err: "has no failure policy"},
+		{name: "no ranges", config: IPAMConfig{Backend: IPAMExternal, External: external, FailurePolicy: IPAMFailEmergency},
+			err: "needs emergency ranges"},
+		{name: "range outside", config: IPAMConfig{Backend: IPAMExternal, External: external, FailurePolicy: IPAMFailEmergency,
+			EmergencyRanges: []string{"10.0.1.0/28"}}, err: "outside the configured networks"},
+		{name: "unknown policy", config: IPAMConfig{Backend: IPAMExternal, External: external, FailurePolicy: "fail-open"},
+			err: "unknown IPAM failure policy"},
+		{name: "unknown reconcile mode", config: IPAMConfig{Backend: IPAMExternal, External: external,
+			Reconcile: IPAMReconcileConfig{Mode: "fix"}}, err: "unknown IPAM reconcile mode"},
+		{name: "host-local reconcile", config: IPAMConfig{Reconcile: IPAMReconcileConfig{Mode: IPAMReconcileReport}},
+			err: "nothing to reconcile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate(NetworkConfig{CIDR: "10.0.0.0/24", CIDR6: "fd00::/64"})
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("validate() = %v, want an error with %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// DefaultIPAMReconcileInterval is how often the IPAM state is reconciled
+// unless configured otherwise
+const DefaultIPAMReconcileInterval = 10 * time.Minute
+
+// IPAM reconciliation modes, see IPAMReconcileConfig
+const (
+	IPAMReconcileReport = "report"
+	IPAMReconcileRepair = "repair"
+)
+
+// IPAMReconcileConfig tunes the periodic comparison of the addresses the
+// IPAM backend holds with those the containers of this node hold
+type IPAMReconcileConfig struct {
+	// Mode is IPAMReconcileReport, which logs the divergences found,
+	// IPAMReconcileRepair, which also repairs them, or empty, which leaves
+	// reconciling to ReconcileIPAM callers
+	Mode string `json:"mode"`
+	// Interval is how often the state is reconciled,
+	// DefaultIPAMReconcileInterval when zero
+	Interval time.Duration `json:"interval"`
+}
+
+func (c IPAMReconcileConfig) validate() error {
+	switch c.Mode {
+	case "", IPAMReconcileReport, IPAMReconcileRepair:
+	default:
+		return fmt.Errorf("%w: unknown IPAM reconcile mode %q", ErrInvalidConfig, c.Mode)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("%w: IPAM reconcile interval must not be negative", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// IPAMDivergenceKind is how the addresses a backend holds differ from
+// those of the containers
+type IPAMDivergenceKind string
+
+const (
+	// IPAMMissing is an address a container holds that the backend
+	// doesn't, e.g. one of an emergency range. Repairing restores it with
+	// the backend.
+	IPAMMissing IPAMDivergenceKind = "missing"
+	// IPAMStale is an address the backend holds for a container of this
+	// node that doesn't hold it, e.g. one whose release failed. Repairing
+	// releases it.
+	IPAMStale IPAMDivergenceKind = "stale"
+	// IPAMConflict is an address the backend holds for another container
+	// than the one holding it. It is only reported: the container keeps
+	// the address until it is deleted.
+	IPAMConflict IPAMDivergenceKind = "conflict"
+)
+
+// IPAMDivergence is an address on which a backend and the containers
+// disagree
+type IPAMDivergence struct {
+	Kind IPAMDivergenceKind
+	Pool netip.Prefix
+	Addr netip.Addr
+	// ContainerID is the container holding Addr, if any, and
+	// BackendContainerID the one the backend holds it for
+	ContainerID        string
+	BackendContainerID string
+	// Repaired is true once the backend agrees with the container
+	Repaired bool
+	// Error is why repairing the divergence failed
+	Error string
+}
+
+// ReconcileIPAM compares the addresses the backend holds in the pools it
+// manages with those of the containers, repairing the divergences found
+// unless dryRun is set. Addresses kept for migrating containers aren't
+// stale. Pools the backend fails to list are skipped, failing the call.
+func (nm *NetworkManager) ReconcileIPAM(ctx context.Context, dryRun bool) ([]IPAMDivergence, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.ipam == nil {
+		return nil, nil
+	}
+	logger := nm.logger(ctx)
+	var divergences []IPAMDivergence
+	var errs []error
+	for _, pool := range nm.pools {
+		if !nm.ipam.Manages(pool.prefix) {
+			continue
+		}
+		found, err := nm.reconcilePool(ctx, pool, dryRun)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s IPAM: %w", nm.ipam.Name(), err))
+		}
+		divergences = append(divergences, found...)
+	}
+
+	for _, d := range divergences {
+		attrs := []any{"kind", d.Kind, "address", d.Addr, "container_id", d.ContainerID, "backend_container_id", d.BackendContainerID}
+		switch {
+		case d.Error != "":
+			logger.Warn("Failed to repair IPAM divergence", append(attrs, "error", d.Error)...)
+		case d.Repaired:
+			logger.Info("Repaired IPAM divergence", attrs...)
+		default:
+			logger.Warn("Found IPAM divergence", attrs...)
+		}
+	}
+	return divergences, errors.Join(errs...)
+}
+
+// reconcilePool reconciles the addresses of pool. Callers must hold nm.mu.
+func (nm *NetworkManager) reconcilePool(ctx context.Context, pool *ipAllocator, dryRun bool) ([]IPAMDivergence, error) {
+	listCtx, cancel := context.WithTimeout(ctx, ipamCallTimeout)
+	held, err := nm.ipam.List(listCtx, pool.prefix)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	backend := make(map[netip.Addr]string, len(held))
+	for _, a := range held {
+		backend[a.Addr] = a.ContainerID
+	}
+	local := pool.Allocations()
+	holders := make(map[netip.Addr]string, len(local))
+	for id, addr := range local {
+		holders[addr] = id
+	}
+
+	var divergences []IPAMDivergence
+	for id, addr := range local {
+		owner, ok := backend[addr]
+		switch {
+		case !ok:
+			d := IPAMDivergence{Kind: IPAMMissing, Pool: pool.prefix, Addr: addr, ContainerID: id}
+			if !dryRun {
+				d.repair(nm.repairMissing(ctx, pool, id, addr))
+			}
+			divergences = append(divergences, d)
+		case owner != id:
+			divergences = append(divergences, IPAMDivergence{Kind: IPAMConflict, Pool: pool.prefix, Addr: addr,
+				ContainerID: id, BackendContainerID: owner})
+		}
+	}
+	for addr, owner := range backend {
+		if _, ok := holders[addr]; ok || nm.reservations[owner].Migrating {
+			continue
+		}
+		d := IPAMDivergence{Kind: IPAMStale, Pool: pool.prefix, Addr: addr, BackendContainerID: owner}
+		if !dryRun {
+			req := IPAMRequest{ContainerID: owner, Pool: pool.prefix, Gateway: pool.gateway, Addr: addr}
+			callCtx, cancel := context.WithTimeout(ctx, ipamCallTimeout)
+			d.repair(nm.ipam.Release(callCtx, req))
+			cancel()
+		}
+		divergences = append(divergences, d)
+	}
+
+	sort.Slice(divergences, func(i, j int) bool { return divergences[i].Addr.Less(divergences[j].Addr) })
+	return divergences, nil
+}
+
+// repairMissing restores addr, held by containerID, with the backend.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) repairMissing(ctx context.Context, pool *ipAllocator, containerID string, addr netip.Addr) error {
+	req := IPAMRequest{ContainerID: containerID, Pool: pool.prefix, Gateway: pool.gateway, Addr: addr}
+	if cn := nm.containers[containerID]; cn != nil {
+		req.Namespace, req.MAC, req.Hostname = cn.Namespace, cn.MAC, cn.Name
+	}
+	ctx, cancel := context.WithTimeout(ctx, ipamCallTimeout)
+	defer cancel()
+	return nm.ipam.Restore(ctx, req)
+}
+
+// repair records the outcome of repairing d
+func (d *IPAMDivergence) repair(err error) {
+	if err != nil {
+		d.Error = err.Error()
+		return
+	}
+	d.Repaired = true
+}
+
+// startIPAMReconcile reconciles the IPAM state every
+// IPAM.Reconcile.Interval until stopIPAMReconcile is called
+func (nm *NetworkManager) startIPAMReconcile() {
+	nm.ipamStop = make(chan struct{})
+	nm.ipamDone = make(chan struct{})
+	go func() {
+		defer close(nm.ipamDone)
+		ticker := time.NewTicker(nm.config.IPAM.Reconcile.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-nm.ipamStop:
+				return
+			}
+			dryRun := nm.config.IPAM.Reconcile.Mode != IPAMReconcileRepair
+			if _, err := nm.ReconcileIPAM(context.Background(), dryRun); err != nil {
+				nm.log.Warn("Failed to reconcile IPAM state", "error", err)
+			}
+		}
+	}()
+}
+
+// stopIPAMReconcile waits for the reconciliation started by
+// startIPAMReconcile to end
+func (nm *NetworkManager) stopIPAMReconcile() {
+	if nm.ipamStop == nil {
+		return
+	}
+	close(nm.ipamStop)
+	<-nm.ipamDone
+	nm.ipamStop = nil
+}
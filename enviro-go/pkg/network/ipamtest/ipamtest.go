@@ -0,0 +1,146 @@
+// Package ipamtest checks that IPAM backends behave alike, so the network
+// manager can rely on any of them the way it does on the pools
+package ipamtest
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/network"
+)
+
+// Pool is the pool the backends under test allocate from, and Gateway its
+// gateway. Its usable addresses are .2 to .6.
+var (
+	Pool    = netip.MustParsePrefix("10.77.0.0/29")
+	Gateway = netip.MustParseAddr("10.77.0.1")
+)
+
+// poolSize is the number of addresses of Pool a backend hands out
+const poolSize = 5
+
+// Run runs the conformance tests against the backends newIPAM returns,
+// one for each test, managing Pool
+func Run(t *testing.T, newIPAM func(t *testing.T) network.IPAM) {
+	ctx := context.Background()
+	req := func(id, addr string) network.IPAMRequest {
+		r := network.IPAMRequest{ContainerID: id, Namespace: network.DefaultNamespace, Pool: Pool, Gateway: Gateway}
+		if addr != "" {
+			r.Addr = netip.MustParseAddr(addr)
+		}
+		return r
+	}
+	allocate := func(t *testing.T, b network.IPAM, r network.IPAMRequest) netip.Addr {
+		t.Helper()
+		addr, err := b.Allocate(ctx, r)
+		if err != nil {
+			t.Fatalf("Allocate(%s): %v", r.ContainerID, err)
+		}
+		return addr
+	}
+	list := func(t *testing.T, b network.IPAM) map[netip.Addr]string {
+		t.Helper()
+		held, err := b.List(ctx, Pool)
+		if err != nil {
+			t.Fatalf("List(): %v", err)
+		}
+		out := make(map[netip.Addr]string, len(held))
+		for _, a := range held {
+			out[a.Addr] = a.ContainerID
+		}
+		return out
+	}
+
+	t.Run("Allocate", func(t *testing.T) {
+		b := newIPAM(t)
+		if !b.Manages(Pool) {
+			t.Fatalf("backend doesn't manage %s", Pool)
+		}
+		a := allocate(t, b, req("c1", ""))
+		if !Pool.Contains(a) || a == Gateway || a == Pool.Addr() {
+			t.Fatalf("Allocate() = %s, want a host address of %s but the gateway", a, Pool)
+		}
+		if again := allocate(t, b, req("c1", "")); again != a {
+			t.Errorf("Allocate() again = %s, want %s", again, a)
+		}
+		if other := allocate(t, b, req("c2", "")); other == a {
+			t.Errorf("Allocate() of another container = %s, held by c1", other)
+		}
+	})
+
+	t.Run("AllocateRequested", func(t *testing.T) {
+		b := newIPAM(t)
+		if a := allocate(t, b, req("c1", "10.77.0.5")); a.String() != "10.77.0.5" {
+			t.Fatalf("Allocate() of 10.77.0.5 = %s", a)
+		}
+		if _, err := b.Allocate(ctx, req("c2", "10.77.0.5")); !errors.Is(err, network.ErrAddressInUse) {
+			t.Errorf("Allocate() of a held address = %v, want %v", err, network.ErrAddressInUse)
+		}
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		b := newIPAM(t)
+		a := allocate(t, b, req("c1", "10.77.0.5"))
+		r := req("c1", a.String())
+		if err := b.Release(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Release(ctx, r); err != nil {
+			t.Errorf("Release() of a released address = %v", err)
+		}
+		if got := allocate(t, b, req("c2", a.String())); got != a {
+			t.Errorf("Allocate() of a released address = %s, want %s", got, a)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		b := newIPAM(t)
+		if err := b.Restore(ctx, req("c1", "10.77.0.6")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Allocate(ctx, req("c2", "10.77.0.6")); !errors.Is(err, network.ErrAddressInUse) {
+			t.Errorf("Allocate() of a restored address = %v, want %v", err, network.ErrAddressInUse)
+		}
+		if got := allocate(t, b, req("c1", "")); got.String() != "10.77.0.6" {
+			t.Errorf("Allocate() after Restore() = %s, want 10.77.0.6", got)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		b := newIPAM(t)
+		want := map[netip.Addr]string{
+			allocate(t, b, req("c1", "")):          "c1",
+			allocate(t, b, req("c2", "10.77.0.4")): "c2",
+		}
+		released := allocate(t, b, req("c3", ""))
+		if err := b.Release(ctx, req("c3", released.String())); err != nil {
+			t.Fatal(err)
+		}
+		got := list(t, b)
+		if len(got) != len(want) {
+			t.Fatalf("List() = %v, want %v", got, want)
+		}
+		for addr, id := range want {
+			if got[addr] != id {
+				t.Errorf("List() holds %s for %q, want %q", addr, got[addr], id)
+			}
+		}
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		b := newIPAM(t)
+		seen := make(map[netip.Addr]bool)
+		for i := 0; i < poolSize; i++ {
+			a := allocate(t, b, req(string(rune('a'+i)), ""))
+			if seen[a] {
+				t.Fatalf("Allocate() handed out %s twice", a)
+			}
+			seen[a] = true
+		}
+		if _, err := b.Allocate(ctx, req("full", "")); !errors.Is(err, network.ErrPoolExhausted) {
+			t.Errorf("Allocate() from a full pool = %v, want %v", err, network.ErrPoolExhausted)
+		}
+	})
+}
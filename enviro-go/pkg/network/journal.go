@@ -0,0 +1,104 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/tracing"
+)
+
+const (
+	// stepAttempts bounds how often a step failing transiently is run
+	stepAttempts = 4
+	// stepBackoff is the delay before the first retry, doubling after
+	stepBackoff = 10 * time.Millisecond
+)
+
+// stepFault, when set by tests, runs before each attempt of a step; an
+// error it returns fails the attempt as if the step did
+var stepFault func(step string) error
+
+// opStep is a completed step of a container network operation
+type opStep struct {
+	name string
+	// undo reverses the step; nil when nothing needs reversing, e.g.
+	// because undoing an earlier step removes its effects too
+	undo func() error
+}
+
+// opJournal runs the steps of an operation and records the completed ones,
+// so a failure rolls back exactly those in reverse order. Steps must be
+// idempotent, since a transient failure runs a step again from the start.
+type opJournal struct {
+	log *slog.Logger
+	// ctx carries the span of the operation, the parent of a span per step
+	ctx    context.Context
+	tracer trace.Tracer
+	done   []opStep
+	// timing, when set, takes the time of the steps by their stage
+	timing *SetupTiming
+}
+
+func newOpJournal(ctx context.Context, tracer trace.Tracer, logger *slog.Logger) *opJournal {
+	return &opJournal{log: logger, ctx: ctx, tracer: tracer}
+}
+
+// run executes do, retrying transient failures, and records undo on success
+func (j *opJournal) run(name string, do, undo func() error) error {
+	start := time.Now()
+	_, span := j.tracer.Start(j.ctx, name)
+	err := retryTransient(j.log, name, func() error {
+		if stepFault != nil {
+			if err := stepFault(name); err != nil {
+				return err
+			}
+		}
+		return do()
+	})
+	tracing.End(span, err)
+	if stage, ok := stepStages[name]; ok && j.timing != nil {
+		j.timing.add(stage, start)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	j.done = append(j.done, opStep{name: name, undo: undo})
+	return nil
+}
+
+// rollback undoes the completed steps, newest first. Failures are logged
+// and don't stop the remaining steps from being undone.
+func (j *opJournal) rollback() {
+	for i := len(j.done) - 1; i >= 0; i-- {
+		step := j.done[i]
+		if step.undo == nil {
+			continue
+		}
+		_, span := j.tracer.Start(j.ctx, "undo "+step.name)
+		err := retryTransient(j.log, "undo "+step.name, step.undo)
+		tracing.End(span, err)
+		if err != nil {
+			j.log.Warn("Failed to roll back step", "step", step.name, "error", err)
+		}
+	}
+	j.done = nil
+}
+
+// retryTransient runs fn until it succeeds, fails permanently or has been
+// tried stepAttempts times, backing off exponentially in between
+func retryTransient(logger *slog.Logger, name string, fn func() error) error {
+	backoff := stepBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == stepAttempts || !isTransient(err) {
+			return err
+		}
+		logger.Debug("Retrying step", "step", name, "attempt", attempt, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
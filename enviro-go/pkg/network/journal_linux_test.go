@@ -0,0 +1,149 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// journalTestEnv has a child of TestCreateRollback run the test in the
+// network namespace of its own it was started in
+const journalTestEnv = "ENVIRO_TEST_JOURNAL"
+
+func TestRetryTransient(t *testing.T) {
+	errPermanent := errors.New("permanent")
+	tests := []struct {
+		name string
+		// errs are the errors of the attempts, the last repeating
+		errs      []error
+		wantRuns  int
+		wantError error
+	}{
+		{name: "succeeds", errs: []error{nil}, wantRuns: 1},
+		{name: "transient then succeeds", errs: []error{unix.EAGAIN, unix.EBUSY, nil}, wantRuns: 3},
+		{name: "permanent", errs: []error{errPermanent}, wantRuns: 1, wantError: errPermanent},
+		{name: "transient then permanent", errs: []error{unix.EINTR, errPermanent}, wantRuns: 2, wantError: errPermanent},
+		{name: "always transient", errs: []error{unix.ENOBUFS}, wantRuns: stepAttempts, wantError: unix.ENOBUFS},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			err := retryTransient(logger, "step", func() error {
+				err := tt.errs[min(runs, len(tt.errs)-1)]
+				runs++
+				return err
+			})
+			if !errors.Is(err, tt.wantError) || (err == nil) != (tt.wantError == nil) {
+				t.Errorf("retryTransient() = %v, want %v", err, tt.wantError)
+			}
+			if runs != tt.wantRuns {
+				t.Errorf("ran %d times, want %d", runs, tt.wantRuns)
+			}
+		})
+	}
+}
+
+// TestCreateRollback fails each step of creating a container network in
+// turn and checks the create leaves no address allocated and no veth
+// behind, then fails each transiently and checks the create succeeds. It
+// runs in a child in a network namespace of its own, so the veths stay
+// off the host.
+func TestCreateRollback(t *testing.T) {
+	if os.Getenv(journalTestEnv) != "" {
+		runCreateRollback(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating container networks needs root")
+	}
+	runInNetns(t, journalTestEnv)
+}
+
+func runCreateRollback(t *testing.T) {
+	ctx := context.Background()
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:   "10.99.0.0/24",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+	defer func() { stepFault = nil }()
+	netnsPath := containerNetns(t)
+
+	// A create that succeeds names the steps to fail
+	var steps []string
+	stepFault = func(step string) error {
+		steps = append(steps, step)
+		return nil
+	}
+	if _, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "c", NetnsPath: netnsPath}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nm.DeleteContainerNetwork(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) < 2 {
+		t.Fatalf("create ran steps %v, want several", steps)
+	}
+
+	errFault := errors.New("injected")
+	for i, failing := range steps {
+		t.Run(failing, func(t *testing.T) {
+			stepFault = func(step string) error {
+				if step == failing {
+					return errFault
+				}
+				return nil
+			}
+			id := fmt.Sprintf("fail%d", i)
+			_, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: id, NetnsPath: netnsPath})
+			if !errors.Is(err, errFault) {
+				t.Fatalf("create failing %q = %v, want %v", failing, err, errFault)
+			}
+			if got := nm.Allocations(); len(got) != 0 {
+				t.Errorf("addresses %v left allocated", got)
+			}
+			if got := nm.PoolUsage()[0]; got.Allocated != 0 {
+				t.Errorf("PoolUsage() = %+v, want no addresses allocated", got)
+			}
+			if _, ok := nm.ContainerNetworks()[id]; ok {
+				t.Error("container network left registered")
+			}
+			if left := hostVeths(t); len(left) != 0 {
+				t.Errorf("veths %v left", left)
+			}
+		})
+
+		t.Run(failing+" transiently", func(t *testing.T) {
+			failed := false
+			stepFault = func(step string) error {
+				if step == failing && !failed {
+					failed = true
+					return unix.EAGAIN
+				}
+				return nil
+			}
+			id := fmt.Sprintf("retry%d", i)
+			if _, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: id, NetnsPath: netnsPath}); err != nil {
+				t.Fatalf("create failing %q transiently = %v", failing, err)
+			}
+			if !failed {
+				t.Errorf("step %q didn't run", failing)
+			}
+			if err := nm.DeleteContainerNetwork(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
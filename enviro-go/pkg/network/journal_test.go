@@ -0,0 +1,106 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestOpJournalRollback(t *testing.T) {
+	errStep := errors.New("step failed")
+	tests := []struct {
+		name string
+		// fail is the step failing, none if empty
+		fail string
+		// failUndo are the steps failing to be undone
+		failUndo []string
+		// wantUndone are the steps undone, in order
+		wantUndone []string
+	}{
+		{name: "first step fails", fail: "a"},
+		{name: "middle step fails", fail: "c", wantUndone: []string{"a"}},
+		{name: "last step fails", fail: "d", wantUndone: []string{"c", "a"}},
+		{name: "undo fails", fail: "d", failUndo: []string{"c"}, wantUndone: []string{"c", "a"}},
+		{name: "all steps succeed", wantUndone: []string{"d", "c", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			j := newOpJournal(context.Background(), otel.GetTracerProvider().Tracer(tracerName), logger)
+			var ran, undone []string
+			var err error
+			for _, step := range []string{"a", "b", "c", "d"} {
+				step := step
+				undo := func() error {
+					undone = append(undone, step)
+					if slices.Contains(tt.failUndo, step) {
+						return errStep
+					}
+					return nil
+				}
+				// b needs no undoing
+				if step == "b" {
+					undo = nil
+				}
+				err = j.run(step, func() error {
+					ran = append(ran, step)
+					if step == tt.fail {
+						return errStep
+					}
+					return nil
+				}, undo)
+				if err != nil {
+					break
+				}
+			}
+			if tt.fail != "" && !errors.Is(err, errStep) {
+				t.Fatalf("run() = %v, want %v", err, errStep)
+			}
+			if tt.fail != "" && ran[len(ran)-1] != tt.fail {
+				t.Errorf("ran %v after %s failed", ran, tt.fail)
+			}
+			j.rollback()
+			if !slices.Equal(undone, tt.wantUndone) {
+				t.Errorf("undone %v, want %v", undone, tt.wantUndone)
+			}
+			if len(j.done) != 0 {
+				t.Errorf("%d steps left after rollback", len(j.done))
+			}
+		})
+	}
+}
+
+func TestStepFault(t *testing.T) {
+	errFault := errors.New("injected")
+	var faulted []string
+	stepFault = func(step string) error {
+		faulted = append(faulted, step)
+		if step == "b" {
+			return errFault
+		}
+		return nil
+	}
+	defer func() { stepFault = nil }()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	j := newOpJournal(context.Background(), otel.GetTracerProvider().Tracer(tracerName), logger)
+	var ran []string
+	for _, step := range []string{"a", "b"} {
+		step := step
+		err := j.run(step, func() error {
+			ran = append(ran, step)
+			return nil
+		}, nil)
+		if step == "b" && !errors.Is(err, errFault) {
+			t.Errorf("run(%q) = %v, want %v", step, err, errFault)
+		}
+	}
+	if !slices.Equal(faulted, []string{"a", "b"}) || !slices.Equal(ran, []string{"a"}) {
+		t.Errorf("faulted %v and ran %v, want a and b faulted and only a run", faulted, ran)
+	}
+}
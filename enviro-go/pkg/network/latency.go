@@ -0,0 +1,151 @@
+package network
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// LatencyBuckets is the number of buckets of a LatencyHistogram
+const LatencyBuckets = 32
+
+// LatencyHistogram is how long the XDP router took to handle packets,
+// from entering the program to its verdict: the lookups, policy checks,
+// connection tracking and rewriting, but not the time spent queued on
+// the container's veth or in the kernel stack.
+type LatencyHistogram struct {
+	Packets uint64
+	// Total is the sum of the latencies of all packets
+	Total time.Duration
+	// Buckets[i] counts the packets handled in [2^i, 2^(i+1))
+	// nanoseconds; the last bucket counts any longer
+	Buckets [LatencyBuckets]uint64
+}
+
+func (h *LatencyHistogram) add(o LatencyHistogram) {
+	h.Packets += o.Packets
+	h.Total += o.Total
+	for i, n := range o.Buckets {
+		h.Buckets[i] += n
+	}
+}
+
+// observe counts a latency of d
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := 0
+	if d > 1 {
+		i = min(bits.Len64(uint64(d))-1, LatencyBuckets-1)
+	}
+	h.Packets++
+	h.Total += d
+	h.Buckets[i]++
+}
+
+// Mean returns the average latency, 0 without packets
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Packets == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Packets)
+}
+
+// Quantile estimates the latency below which a fraction q of the packets
+// were handled, interpolating linearly within a bucket, so it is off by
+// at most a factor of two. It returns 0 without packets, and the lower
+// bound of the last bucket for packets in it.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Packets == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.Packets)))
+	rank = max(rank, 1)
+	var seen uint64
+	for i, n := range h.Buckets {
+		if n == 0 || seen+n < rank {
+			seen += n
+			continue
+		}
+		lo, hi := bucketBounds(i)
+		if i == LatencyBuckets-1 {
+			return lo
+		}
+		frac := float64(rank-seen) / float64(n)
+		return lo + time.Duration(frac*float64(hi-lo))
+	}
+	lo, _ := bucketBounds(LatencyBuckets - 1)
+	return lo
+}
+
+// UpperBounds returns the exclusive upper bound of each bucket but the
+// last, which is unbounded
+func (LatencyHistogram) UpperBounds() []time.Duration {
+	bounds := make([]time.Duration, LatencyBuckets-1)
+	for i := range bounds {
+		_, bounds[i] = bucketBounds(i)
+	}
+	return bounds
+}
+
+// bucketBounds returns the range of latencies bucket i counts
+func bucketBounds(i int) (lo, hi time.Duration) {
+	if i > 0 {
+		lo = time.Duration(1) << i
+	}
+	return lo, time.Duration(1) << (i + 1)
+}
+
+// LatencySnapshot is the node-wide and per-container latency read in one
+// pass
+type LatencySnapshot struct {
+	// Time is when the histograms were read
+	Time time.Time
+	// Node covers every packet the router handled, including those to no
+	// container and to containers since deleted
+	Node LatencyHistogram
+	// Containers holds the latency of packets to each container by
+	// containerID
+	Containers map[string]LatencyHistogram
+}
+
+// GetLatencyStats returns the latency histograms of the XDP router, with
+// those of containerID only when it is set. It fails with ErrXDPInactive
+// without the router, as packets then take the kernel's path, which isn't
+// measured. Like ListStats, it reads the datapath without holding the
+// manager's lock, leaving out containers deleted meanwhile.
+func (nm *NetworkManager) GetLatencyStats(containerID string) (LatencySnapshot, error) {
+	nm.mu.Lock()
+	if nm.xdp == nil {
+		nm.mu.Unlock()
+		return LatencySnapshot{}, fmt.Errorf("%w: latency is measured by the XDP router", ErrXDPInactive)
+	}
+	var containers []*ContainerNetwork
+	if containerID != "" {
+		cn, ok := nm.containers[containerID]
+		if !ok {
+			nm.mu.Unlock()
+			return LatencySnapshot{}, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+		}
+		if err := cn.checkAttachment("latency"); err != nil {
+			nm.mu.Unlock()
+			return LatencySnapshot{}, err
+		}
+		containers = append(containers, cn.clone())
+	} else {
+		for _, cn := range nm.containers {
+			if !cn.Attachment.direct() {
+				containers = append(containers, cn.clone())
+			}
+		}
+	}
+	nm.mu.Unlock()
+
+	snap := LatencySnapshot{
+		Time:       time.Now(),
+		Containers: make(map[string]LatencyHistogram, len(containers)),
+	}
+	if err := nm.readLatency(containers, &snap); err != nil {
+		return LatencySnapshot{}, err
+	}
+	return snap, nil
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"time"
+)
+
+// latencyHist mirrors struct latency_hist in bpf/container_router.c
+type latencyHist struct {
+	Packets uint64
+	TotalNS uint64
+	Buckets [LatencyBuckets]uint64
+}
+
+func (h latencyHist) histogram() LatencyHistogram {
+	return LatencyHistogram{Packets: h.Packets, Total: time.Duration(h.TotalNS), Buckets: h.Buckets}
+}
+
+// readLatency fills snap from the router's histograms for containers,
+// clones taken under nm.mu
+func (nm *NetworkManager) readLatency(containers []*ContainerNetwork, snap *LatencySnapshot) error {
+	if !nm.xdp.hasLatency() {
+		return fmt.Errorf("%w: router has no latency maps", ErrInvalidDatapath)
+	}
+	node, err := nm.xdp.Latency()
+	if err != nil {
+		return fmt.Errorf("failed to read datapath latency: %w", err)
+	}
+	snap.Node = node
+	for _, cn := range containers {
+		h, err := nm.xdp.ContainerLatency(cn.HostIfindex)
+		if err != nil {
+			nm.mu.Lock()
+			_, ok := nm.containers[cn.ContainerID]
+			nm.mu.Unlock()
+			if !ok {
+				continue
+			}
+			return fmt.Errorf("failed to read latency for %s: %w", cn.ContainerID, err)
+		}
+		snap.Containers[cn.ContainerID] = h
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultLeaseInterval is how often expired address leases are looked for
+// unless configured otherwise
+const DefaultLeaseInterval = time.Minute
+
+// LeaseConfig expires the addresses of containers that are gone without
+// their network being deleted, e.g. as the orchestrator crashed before
+// starting them. A container's lease is renewed while its attachment
+// exists, or by RenewLease; once it expired, the reaper deletes the
+// network and reclaims its addresses.
+//
+// Containers holding reserved addresses, such as requested static IPs,
+// and rootless containers, which live in the host's network through
+// slirp4netns, never expire.
+type LeaseConfig struct {
+	// TTL is how long a lease lasts without being renewed; 0 disables
+	// leases
+	TTL time.Duration `json:"ttl"`
+	// Interval is how often expired leases are looked for,
+	// DefaultLeaseInterval when zero
+	Interval time.Duration `json:"interval"`
+	// DryRun only reports the leases that expired instead of reclaiming
+	// them
+	DryRun bool `json:"dry_run"`
+	// OnReclaim is called for each lease reclaimed, once the network is
+	// deleted
+	OnReclaim func(LeaseReclaim) `json:"-"`
+}
+
+func (c LeaseConfig) validate() error {
+	if c.TTL < 0 {
+		return fmt.Errorf("%w: lease ttl must not be negative", ErrInvalidConfig)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("%w: lease interval must not be negative", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// LeaseReclaim is an expired lease, reclaimed or found in a dry run
+type LeaseReclaim struct {
+	ContainerID string
+	IPv4        string
+	IPv6        string
+	// Renewed is when the lease was last renewed
+	Renewed time.Time
+	// Removed is true once the network is deleted; false in a dry run
+	Removed bool
+	// Error is why deleting the network failed
+	Error string
+}
+
+// RenewLease renews the lease of containerID's addresses, for
+// orchestrators vouching for containers whose attachment can't tell, e.g.
+// one not started yet
+func (nm *NetworkManager) RenewLease(containerID string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, ok := nm.containers[containerID]; !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	nm.leases[containerID] = time.Now()
+	return nil
+}
+
+// leaseExempt reports whether cn keeps its addresses without a lease
+func (nm *NetworkManager) leaseExempt(cn *ContainerNetwork) bool {
+	if cn.Rootless || len(cn.addrs()) == 0 {
+		return true
+	}
+	res, ok := nm.reservations[cn.ContainerID]
+	return ok && (res.IPv4 != "" || res.IPv6 != "")
+}
+
+// ReclaimLeases deletes the networks of containers whose lease expired,
+// unless dryRun is set, and returns them sorted by container ID. A lease
+// starts once it is first looked at, and is renewed whenever the
+// container's attachment is found. An expired lease is only reclaimed
+// when no interface, namespace or host address still references its
+// addresses. The error is returned when some leases couldn't be checked;
+// the leases reclaimed are returned with it.
+func (nm *NetworkManager) ReclaimLeases(ctx context.Context, dryRun bool) ([]LeaseReclaim, error) {
+	reclaims, err := nm.reclaimLeases(ctx, dryRun)
+	logger := nm.logger(ctx)
+	for _, r := range reclaims {
+		switch {
+		case dryRun:
+			logger.Info("Found expired address lease", "container_id", r.ContainerID, "renewed", r.Renewed)
+		case r.Error != "":
+			logger.Warn("Failed to reclaim expired address lease", "container_id", r.ContainerID, "error", r.Error)
+		default:
+			logger.Info("Reclaimed expired address lease", "container_id", r.ContainerID,
+				"ipv4", r.IPv4, "ipv6", r.IPv6, "renewed", r.Renewed)
+			if nm.config.Leases.OnReclaim != nil {
+				nm.config.Leases.OnReclaim(r)
+			}
+		}
+	}
+	return reclaims, err
+}
+
+func (nm *NetworkManager) reclaimLeases(ctx context.Context, dryRun bool) ([]LeaseReclaim, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	ttl := nm.config.Leases.TTL
+	if ttl == 0 {
+		return nil, nil
+	}
+	for id := range nm.leases {
+		if _, ok := nm.containers[id]; !ok {
+			delete(nm.leases, id)
+		}
+	}
+	ids := make([]string, 0, len(nm.containers))
+	for id := range nm.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	var reclaims []LeaseReclaim
+	var errs []error
+	for _, id := range ids {
+		cn := nm.containers[id]
+		if nm.leaseExempt(cn) {
+			delete(nm.leases, id)
+			continue
+		}
+		renewed, ok := nm.leases[id]
+		if !ok || cn.Intent != "" {
+			nm.leases[id] = now
+			continue
+		}
+		inUse, err := leaseInUse(cn)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to check lease of %s: %w", id, err))
+			continue
+		}
+		if inUse {
+			nm.leases[id] = now
+			continue
+		}
+		if now.Sub(renewed) < ttl {
+			continue
+		}
+		r := LeaseReclaim{ContainerID: id, IPv4: cn.IPv4, IPv6: cn.IPv6, Renewed: renewed}
+		if !dryRun {
+			if err := nm.removeContainerNetwork(ctx, id); err != nil {
+				r.Error = err.Error()
+			} else {
+				r.Removed = true
+			}
+		}
+		reclaims = append(reclaims, r)
+	}
+	return reclaims, errors.Join(errs...)
+}
+
+// startLeases reclaims expired leases every Leases.Interval until
+// stopLeases is called
+func (nm *NetworkManager) startLeases() {
+	nm.leaseStop = make(chan struct{})
+	nm.leaseDone = make(chan struct{})
+	go func() {
+		defer close(nm.leaseDone)
+		ticker := time.NewTicker(nm.config.Leases.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-nm.leaseStop:
+				return
+			}
+			if _, err := nm.ReclaimLeases(context.Background(), nm.config.Leases.DryRun); err != nil {
+				nm.log.Warn("Failed to reclaim expired address leases", "error", err)
+			}
+		}
+	}()
+}
+
+// stopLeases waits for the reaper started by startLeases to end
+func (nm *NetworkManager) stopLeases() {
+	if nm.leaseStop == nil {
+		return
+	}
+	close(nm.leaseStop)
+	<-nm.leaseDone
+	nm.leaseStop = nil
+}
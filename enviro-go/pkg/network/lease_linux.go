@@ -0,0 +1,51 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// leaseInUse reports whether anything in the kernel still references the
+// network of cn: its host veth, its namespace, or a host interface
+// carrying one of its addresses
+func leaseInUse(cn *ContainerNetwork) (bool, error) {
+	if cn.HostInterface != "" {
+		_, err := netlink.LinkByName(cn.HostInterface)
+		if err == nil {
+			return true, nil
+		}
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return false, err
+		}
+	}
+	if cn.NetnsPath != "" {
+		ns, err := netns.GetFromPath(cn.NetnsPath)
+		if err == nil {
+			ns.Close()
+			return true, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		addr, _ := netip.AddrFromSlice(a.IP)
+		for _, own := range cn.addrs() {
+			if addr.Unmap() == own {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,218 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestReclaimLeasesDryRun(t *testing.T) {
+	const ttl = time.Hour
+	expired, recent := -2*ttl, -time.Minute
+	tests := []struct {
+		name string
+		cn   ContainerNetwork
+		// renewed is when the lease was renewed relative to now, nil when
+		// it wasn't looked at yet
+		renewed  *time.Duration
+		reserved bool
+		// reclaimed is whether the lease expired, and renewedNow whether
+		// it was renewed by looking at it
+		reclaimed  bool
+		renewedNow bool
+	}{
+		{name: "leaked", cn: ContainerNetwork{IPv4: "10.254.0.2", HostInterface: "vethleasetest", NetnsPath: "/nonexistent"},
+			renewed: &expired, reclaimed: true},
+		{name: "first look", cn: ContainerNetwork{IPv4: "10.254.0.2", HostInterface: "vethleasetest"}, renewedNow: true},
+		{name: "renewed", cn: ContainerNetwork{IPv4: "10.254.0.2", HostInterface: "vethleasetest"}, renewed: &recent},
+		{name: "namespace alive", cn: ContainerNetwork{IPv4: "10.254.0.2", NetnsPath: "/proc/self/ns/net"},
+			renewed: &expired, renewedNow: true},
+		{name: "address on host", cn: ContainerNetwork{IPv4: "127.0.0.1", HostInterface: "vethleasetest"},
+			renewed: &expired, renewedNow: true},
+		{name: "being created", cn: ContainerNetwork{IPv4: "10.254.0.2", HostInterface: "vethleasetest", Intent: IntentCreate},
+			renewed: &expired, renewedNow: true},
+		{name: "static address", cn: ContainerNetwork{IPv4: "10.254.0.2", HostInterface: "vethleasetest"},
+			renewed: &expired, reserved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cn := tt.cn
+			cn.ContainerID = "c1"
+			nm := &NetworkManager{
+				config:       NetworkConfig{Leases: LeaseConfig{TTL: ttl}},
+				log:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+				containers:   map[string]*ContainerNetwork{"c1": &cn},
+				reservations: map[string]Reservation{},
+				leases:       map[string]time.Time{},
+			}
+			if tt.reserved {
+				nm.reservations["c1"] = Reservation{ContainerID: "c1", IPv4: cn.IPv4}
+			}
+			start := time.Now()
+			if tt.renewed != nil {
+				nm.leases["c1"] = start.Add(*tt.renewed)
+			}
+			reclaims, err := nm.ReclaimLeases(context.Background(), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(reclaims) == 1; got != tt.reclaimed {
+				t.Fatalf("reclaims %+v, want reclaimed %v", reclaims, tt.reclaimed)
+			}
+			if tt.reclaimed && (reclaims[0].ContainerID != "c1" || reclaims[0].Removed) {
+				t.Errorf("reclaim %+v, want c1 not removed in a dry run", reclaims[0])
+			}
+			if renewed := !nm.leases["c1"].Before(start); renewed != tt.renewedNow {
+				t.Errorf("lease renewed at %s, want renewed now %v", nm.leases["c1"], tt.renewedNow)
+			}
+			if _, ok := nm.containers["c1"]; !ok {
+				t.Error("dry run deleted the network")
+			}
+		})
+	}
+}
+
+// leaseTestEnv has a child of TestLeaseReclaim run the test in the network
+// namespace of its own it was started in
+const leaseTestEnv = "ENVIRO_TEST_LEASE"
+
+// TestLeaseReclaim leaks container networks by ending their containers
+// without deleting the networks, and checks that only those are
+// reclaimed. It runs in a child in a network namespace of its own, so the
+// manager's bridge and rules stay off the host.
+func TestLeaseReclaim(t *testing.T) {
+	if os.Getenv(leaseTestEnv) != "" {
+		runLeaseReclaim(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating container networks needs root")
+	}
+	runInNetns(t, leaseTestEnv)
+}
+
+// leakedNetns starts a process in a network namespace of its own and
+// returns the namespace's path and a func ending the process, which
+// returns once the kernel removed the namespace's end of hostInterface
+func leakedNetns(t *testing.T) (string, func(hostInterface string)) {
+	t.Helper()
+	cmd := exec.Command("sleep", "infinity")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWNET}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	end := func(hostInterface string) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, err := netlink.LinkByName(hostInterface); err != nil {
+				return
+			}
+		}
+		t.Fatalf("%s still exists after its namespace ended", hostInterface)
+	}
+	return fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid), end
+}
+
+func runLeaseReclaim(t *testing.T) {
+	ctx := context.Background()
+	const ttl = 100 * time.Millisecond
+	var events []LeaseReclaim
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:   "10.99.0.0/24",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Leases: LeaseConfig{
+			TTL: ttl,
+			// The test reclaims leases itself
+			Interval:  time.Hour,
+			OnReclaim: func(r LeaseReclaim) { events = append(events, r) },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+
+	live, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "live", NetnsPath: containerNetns(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leak := func(spec ContainerNetworkSpec) *ContainerNetwork {
+		path, end := leakedNetns(t)
+		spec.NetnsPath = path
+		cn, err := nm.CreateContainerNetwork(ctx, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end(cn.HostInterface)
+		return cn
+	}
+	leaked := leak(ContainerNetworkSpec{ContainerID: "leaked"})
+	leak(ContainerNetworkSpec{ContainerID: "static", RequestedIP: "10.99.0.200"})
+	leak(ContainerNetworkSpec{ContainerID: "vouched"})
+
+	// Leases start once looked at
+	if reclaims, err := nm.ReclaimLeases(ctx, false); err != nil || len(reclaims) != 0 {
+		t.Fatalf("first ReclaimLeases() = %+v, %v, want none", reclaims, err)
+	}
+	time.Sleep(2 * ttl)
+	reclaims, err := nm.ReclaimLeases(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := func(reclaims []LeaseReclaim) []string {
+		var out []string
+		for _, r := range reclaims {
+			out = append(out, r.ContainerID)
+		}
+		return out
+	}
+	if got := ids(reclaims); !slices.Equal(got, []string{"leaked", "vouched"}) {
+		t.Fatalf("dry run found %v, want [leaked vouched]", got)
+	}
+	if len(events) != 0 {
+		t.Errorf("dry run emitted %+v", events)
+	}
+
+	if err := nm.RenewLease("vouched"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nm.RenewLease("unknown"); !errors.Is(err, ErrContainerNotFound) {
+		t.Errorf("RenewLease(unknown) = %v, want ErrContainerNotFound", err)
+	}
+	reclaims, err = nm.ReclaimLeases(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(reclaims); !slices.Equal(got, []string{"leaked"}) || !reclaims[0].Removed {
+		t.Fatalf("reclaimed %+v, want leaked removed", reclaims)
+	}
+	if len(events) != 1 || events[0].IPv4 != leaked.IPv4 {
+		t.Errorf("events %+v, want the reclaim of %s", events, leaked.IPv4)
+	}
+
+	// The live container keeps its address and the leaked one is free again
+	next, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "next", NetnsPath: containerNetns(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.IPv4 == live.IPv4 {
+		t.Errorf("next got %s of the live container", next.IPv4)
+	}
+	if err := nm.DeleteContainerNetwork(ctx, "leaked"); err != nil {
+		t.Errorf("deleting the reclaimed network again: %v", err)
+	}
+}
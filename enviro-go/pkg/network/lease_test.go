@@ -0,0 +1,59 @@
+package network
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaseConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  LeaseConfig
+		wantErr bool
+	}{
+		{name: "disabled"},
+		{name: "ttl", config: LeaseConfig{TTL: time.Hour, Interval: time.Minute}},
+		{name: "negative ttl", config: LeaseConfig{TTL: -time.Second}, wantErr: true},
+		{name: "negative interval", config: LeaseConfig{TTL: time.Hour, Interval: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validate() = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
+
+func TestLeaseExempt(t *testing.T) {
+	tests := []struct {
+		name        string
+		cn          ContainerNetwork
+		reservation *Reservation
+		want        bool
+	}{
+		{name: "pool address", cn: ContainerNetwork{ContainerID: "c1", IPv4: "10.88.0.2"}},
+		{name: "static address", cn: ContainerNetwork{ContainerID: "c1", IPv4: "10.88.0.2"},
+			reservation: &Reservation{ContainerID: "c1", IPv4: "10.88.0.2"}, want: true},
+		{name: "reserved MAC only", cn: ContainerNetwork{ContainerID: "c1", IPv4: "10.88.0.2"},
+			reservation: &Reservation{ContainerID: "c1", MAC: "02:00:00:00:00:01"}},
+		{name: "rootless", cn: ContainerNetwork{ContainerID: "c1", IPv4: "10.0.2.100", Rootless: true}, want: true},
+		{name: "no address", cn: ContainerNetwork{ContainerID: "c1"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := &NetworkManager{reservations: map[string]Reservation{}}
+			if tt.reservation != nil {
+				nm.reservations[tt.reservation.ContainerID] = *tt.reservation
+			}
+			if got := nm.leaseExempt(&tt.cn); got != tt.want {
+				t.Errorf("leaseExempt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
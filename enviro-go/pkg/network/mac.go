@@ -0,0 +1,67 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ErrInvalidMAC is returned for requested MACs that can't be assigned to a
+// container interface
+var ErrInvalidMAC = errors.New("network: invalid MAC address")
+
+// ErrMACInUse is returned when another container already has the MAC
+var ErrMACInUse = errors.New("network: MAC address in use")
+
+// ParseMAC parses a requested container MAC. It must be a 48-bit unicast
+// address other than all zeros. The empty string is valid and means the
+// MAC is derived from the container's addresses.
+func ParseMAC(s string) (net.HardwareAddr, error) {
+	if s == "" {
+		return nil, nil
+	}
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("%w: %q is not a 48-bit MAC", ErrInvalidMAC, s)
+	}
+	if mac[0]&1 != 0 {
+		return nil, fmt.Errorf("%w: %s is a multicast address", ErrInvalidMAC, mac)
+	}
+	if mac.String() == "00:00:00:00:00:00" {
+		return nil, fmt.Errorf("%w: %s is the zero address", ErrInvalidMAC, mac)
+	}
+	return mac, nil
+}
+
+// containerMAC derives a locally administered MAC from a container's
+// addresses: 0a:58 followed by the IPv4 address, or by the last four bytes
+// of the IPv6 address on IPv6-only networks. Addresses are unique across
+// nodes, so derived MACs are too.
+func containerMAC(addrs []netip.Addr) net.HardwareAddr {
+	mac := net.HardwareAddr{0x0a, 0x58, 0, 0, 0, 0}
+	for _, addr := range addrs {
+		b := addr.AsSlice()
+		copy(mac[2:], b[len(b)-4:])
+		if addr.Is4() {
+			break
+		}
+	}
+	return mac
+}
+
+// macInUse reports whether a container other than containerID has mac or
+// reserved it. Callers must hold nm.mu.
+func (nm *NetworkManager) macInUse(mac, containerID string) bool {
+	for id, cn := range nm.containers {
+		if cn.MAC == mac && id != containerID {
+			return true
+		}
+	}
+	for id, res := range nm.reservations {
+		if res.MAC == mac && id != containerID {
+			return true
+		}
+	}
+	return false
+}
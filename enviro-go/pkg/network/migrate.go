@@ -0,0 +1,254 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// ErrInvalidNetworkState is returned for exported network states that
+// can't be imported
+var ErrInvalidNetworkState = errors.New("network: invalid network state")
+
+// networkStateVersion is bumped on incompatible changes to NetworkState
+const networkStateVersion = 1
+
+// NetworkState is the network of a container as ExportNetworkState
+// captures it, for moving the container to another node
+type NetworkState struct {
+	Version int `json:"version"`
+	// Network holds the container's name, namespace, addresses, MAC, MTU,
+	// bandwidth limits and QoS class. Its port forwards and mirrors are
+	// tied to the node and aren't imported.
+	Network ContainerNetwork `json:"network"`
+	// Reservation is the container's reservation, if any
+	Reservation *Reservation `json:"reservation,omitempty"`
+	// Policies are those naming the container, in the order they were
+	// applied
+	Policies []NetworkPolicy `json:"policies,omitempty"`
+	// Services are those the container backs, ordered by name
+	Services []Service `json:"services,omitempty"`
+	// Connections are the flows to the container the XDP router tracks,
+	// none without it
+	Connections []Connection `json:"connections,omitempty"`
+}
+
+// ExportNetworkState captures the network of containerID for
+// ImportNetworkState on another node. The container keeps its network;
+// it is deleted once the import succeeded.
+func (nm *NetworkManager) ExportNetworkState(containerID string) (NetworkState, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return NetworkState{}, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	// The device is the node's
+	if err := cn.checkAttachment("migration"); err != nil {
+		return NetworkState{}, err
+	}
+	state := NetworkState{Version: networkStateVersion, Network: *cn.clone()}
+	if res, ok := nm.reservations[containerID]; ok {
+		state.Reservation = &res
+	}
+	for _, name := range nm.policyOrder {
+		if p := nm.policies[name]; p.references(containerID) {
+			state.Policies = append(state.Policies, p)
+		}
+	}
+	for _, s := range nm.sortedServices() {
+		if slices.Contains(s.Backends, containerID) {
+			s.Backends = append([]string(nil), s.Backends...)
+			state.Services = append(state.Services, s)
+		}
+	}
+	if nm.xdp != nil {
+		conns, err := nm.readConnections(map[int]string{cn.HostIfindex: containerID})
+		if err != nil {
+			return NetworkState{}, fmt.Errorf("failed to read connections: %w", err)
+		}
+		sortConnections(conns)
+		state.Connections = conns
+	}
+	return state, nil
+}
+
+// ImportNetworkState creates the network of spec's container as state
+// describes it: with the same addresses and MAC, which must be free in
+// this node's pools, its reservation, the policies naming it and its
+// membership of services. Policies and services of the same name must
+// match those of state; missing ones are created. Connections are
+// tracked again with the XDP router, as they were at export, so their
+// counters and states carry over. Of spec, only the container ID and
+// network namespace are used. The network is deleted again when any step
+// fails.
+func (nm *NetworkManager) ImportNetworkState(ctx context.Context, spec ContainerNetworkSpec, state NetworkState) (*ContainerNetwork, error) {
+	if state.Version != networkStateVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidNetworkState, state.Version)
+	}
+	n := state.Network
+	if n.ContainerID != spec.ContainerID {
+		return nil, fmt.Errorf("%w: state is of container %s, not %s", ErrInvalidNetworkState, n.ContainerID, spec.ContainerID)
+	}
+	if state.Reservation != nil && state.Reservation.ContainerID != spec.ContainerID {
+		return nil, fmt.Errorf("%w: reservation is of container %s", ErrInvalidNetworkState, state.Reservation.ContainerID)
+	}
+	nm.mu.Lock()
+	_, exists := nm.containers[spec.ContainerID]
+	nm.mu.Unlock()
+	if exists {
+		return nil, fmt.Errorf("%w: container %s already has a network", ErrInvalidNetworkState, spec.ContainerID)
+	}
+
+	spec = ContainerNetworkSpec{
+		ContainerID: spec.ContainerID,
+		Name:        n.Name,
+		NetnsPath:   spec.NetnsPath,
+		Pid:         spec.Pid,
+		MAC:         n.MAC,
+		MTU:         n.MTU,
+		Namespace:   n.Namespace,
+		IngressBps:  n.IngressBps,
+		EgressBps:   n.EgressBps,
+		DNSTTL:      n.DNSTTL,
+
+		AllowedSources:     n.AllowedSources,
+		DisableSourceCheck: n.SourceCheckDisabled,
+	}
+	if n.SourceCheckDisabled {
+		// The capability was granted where the container was created
+		spec.Capabilities = []NetworkCapability{CapabilitySpoofSource}
+	}
+	if !n.Rootless {
+		// slirp4netns gives every container the same addresses
+		spec.RequestedIP, spec.RequestedIP6 = n.IPv4, n.IPv6
+	}
+	if _, err := nm.CreateContainerNetwork(ctx, spec); err != nil {
+		return nil, err
+	}
+	logger := nm.logger(ctx).With("container_id", spec.ContainerID)
+	if err := nm.importState(ctx, state); err != nil {
+		logger.Warn("Deleting network of failed import", "error", err)
+		if err := nm.DeleteContainerNetwork(ctx, spec.ContainerID); err != nil {
+			logger.Error("Failed to delete network of failed import", "error", err)
+		}
+		return nil, fmt.Errorf("failed to import network state of %s: %w", spec.ContainerID, err)
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	cn, ok := nm.containers[spec.ContainerID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s was deleted during the import", ErrContainerNotFound, spec.ContainerID)
+	}
+	logger.Info("Imported container network", "policies", len(state.Policies),
+		"services", len(state.Services), "connections", len(state.Connections))
+	return cn.clone(), nil
+}
+
+// importState applies the parts of state beyond the container's network,
+// which was just created
+func (nm *NetworkManager) importState(ctx context.Context, state NetworkState) error {
+	id := state.Network.ContainerID
+	if err := nm.importReservation(id, state.Reservation); err != nil {
+		return err
+	}
+	if class := state.Network.QoSClass; class != QoSDefault {
+		if err := nm.SetQoSClass(id, class); err != nil {
+			return err
+		}
+	}
+	for _, p := range state.Policies {
+		if err := nm.importPolicy(p); err != nil {
+			return err
+		}
+	}
+	for _, s := range state.Services {
+		if err := nm.importService(id, s); err != nil {
+			return err
+		}
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	cn, ok := nm.containers[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+	// Flows only feed counters, so failing to track them doesn't fail the
+	// import
+	if n, err := nm.importConnections(cn, state.Connections); err != nil {
+		nm.logger(ctx).Warn("Failed to import connections", "container_id", id, "imported", n, "error", err)
+	}
+	return nil
+}
+
+// importReservation replaces the reservation the create made for the
+// requested addresses with the exported one, if any
+func (nm *NetworkManager) importReservation(containerID string, res *Reservation) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if res != nil {
+		if err := nm.reserve(*res); err != nil {
+			return err
+		}
+	} else {
+		nm.unreserve(containerID)
+	}
+	return nm.saveState()
+}
+
+// importPolicy applies p unless the same policy is applied already
+func (nm *NetworkManager) importPolicy(p NetworkPolicy) error {
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidNetworkState, err)
+	}
+	p.Namespace = namespaceOf(p.Namespace)
+	nm.mu.Lock()
+	existing, ok := nm.policies[p.Name]
+	nm.mu.Unlock()
+	if ok {
+		if existing != p {
+			return fmt.Errorf("%w: policy %s differs on this node", ErrInvalidNetworkState, p.Name)
+		}
+		return nil
+	}
+	return nm.ApplyPolicy(p)
+}
+
+// importService adds containerID to the backends of s, creating s when
+// this node has no service of its name
+func (nm *NetworkManager) importService(containerID string, s Service) error {
+	if err := s.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidNetworkState, err)
+	}
+	s = s.withDefaults()
+	nm.mu.Lock()
+	existing, ok := nm.services[s.Name]
+	nm.mu.Unlock()
+	// Remote backends are those of the other node's view of the cluster,
+	// and its node ports of the other node's range
+	s = s.withoutNodePorts()
+	s.RemoteBackends = nil
+	if !ok {
+		s.Backends = []string{containerID}
+		_, err := nm.CreateService(s)
+		return err
+	}
+
+	backends := existing.Backends
+	existing.Backends, s.Backends = nil, nil
+	existing = existing.withoutNodePorts()
+	existing.RemoteBackends = nil
+	if !reflect.DeepEqual(existing, s) {
+		return fmt.Errorf("%w: service %s differs on this node", ErrInvalidNetworkState, s.Name)
+	}
+	if slices.Contains(backends, containerID) {
+		return nil
+	}
+	_, err := nm.UpdateBackends(s.Name, append(slices.Clone(backends), containerID))
+	return err
+}
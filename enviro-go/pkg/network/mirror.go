@@ -0,0 +1,236 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// ErrInvalidMirror is returned for mirrors that can't be set up
+var ErrInvalidMirror = errors.New("network: invalid mirror")
+
+// ErrMirrorNotFound is returned when stopping a mirror that isn't set up
+var ErrMirrorNotFound = errors.New("network: mirror not found")
+
+// Direction selects which traffic of a container is mirrored
+type Direction string
+
+const (
+	// DirectionIngress mirrors traffic to the container
+	DirectionIngress Direction = "ingress"
+	// DirectionEgress mirrors traffic from the container
+	DirectionEgress Direction = "egress"
+	// DirectionBoth mirrors traffic in both directions
+	DirectionBoth Direction = "both"
+)
+
+func (d Direction) ingress() bool { return d == DirectionIngress || d == DirectionBoth }
+func (d Direction) egress() bool  { return d == DirectionEgress || d == DirectionBoth }
+
+// Mirror copies the traffic of one container to another, e.g. one running
+// an IDS. Copies are sent out of the target's interface unchanged, so the
+// target has to capture in promiscuous mode.
+type Mirror struct {
+	SourceID  string    `json:"source_id"`
+	TargetID  string    `json:"target_id"`
+	Direction Direction `json:"direction"`
+}
+
+// MirrorTraffic copies the traffic of the source container in direction
+// to the target container, replacing the direction of an existing mirror
+// between the two. Both must be in the same namespace. Targets can't be
+// mirrored themselves, so copies never loop. The mirror is removed when either container is deleted.
+func (nm *NetworkManager) MirrorTraffic(sourceContainerID, targetContainerID string, direction Direction) error {
+	if !direction.ingress() && !direction.egress() {
+		return fmt.Errorf("%w: unknown direction %q", ErrInvalidMirror, direction)
+	}
+	if sourceContainerID == targetContainerID {
+		return fmt.Errorf("%w: %s can't mirror to itself", ErrInvalidMirror, sourceContainerID)
+	}
+	if err := nm.checkPrivileged("mirrors"); err != nil {
+		return err
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	src, ok := nm.containers[sourceContainerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, sourceContainerID)
+	}
+	target, ok := nm.containers[targetContainerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, targetContainerID)
+	}
+	for _, cn := range []*ContainerNetwork{src, target} {
+		if err := cn.checkAttachment("mirrors"); err != nil {
+			return err
+		}
+	}
+	if len(target.Mirrors) > 0 {
+		return fmt.Errorf("%w: target %s is mirrored itself", ErrInvalidMirror, targetContainerID)
+	}
+	if src.Namespace != target.Namespace {
+		return fmt.Errorf("%w: target %s is in namespace %s, not %s", ErrInvalidMirror, targetContainerID, target.Namespace, src.Namespace)
+	}
+	if nm.mirrorTarget(sourceContainerID) {
+		return fmt.Errorf("%w: source %s is a mirror target", ErrInvalidMirror, sourceContainerID)
+	}
+
+	m := Mirror{SourceID: sourceContainerID, TargetID: targetContainerID, Direction: direction}
+	mirrors := append([]Mirror{m}, mirrorsExcept(src.Mirrors, targetContainerID)...)
+	if err := nm.setMirrors(src, mirrors); err != nil {
+		return fmt.Errorf("failed to mirror %s to %s: %w", sourceContainerID, targetContainerID, err)
+	}
+	nm.log.Info("Mirroring container traffic", "container_id", sourceContainerID,
+		"target", targetContainerID, "direction", direction)
+	return nm.saveState()
+}
+
+// StopMirror stops copying the traffic of the source container to the
+// target container
+func (nm *NetworkManager) StopMirror(sourceContainerID, targetContainerID string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	src, ok := nm.containers[sourceContainerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, sourceContainerID)
+	}
+	if err := nm.stopMirror(src, targetContainerID); err != nil {
+		return err
+	}
+	nm.log.Info("Stopped mirroring container traffic", "container_id", sourceContainerID, "target", targetContainerID)
+	return nm.saveState()
+}
+
+// ListMirrors returns the mirrors sorted by source and target
+func (nm *NetworkManager) ListMirrors() []Mirror {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	var out []Mirror
+	for _, cn := range nm.containers {
+		out = append(out, cn.Mirrors...)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].SourceID != out[j].SourceID {
+			return out[i].SourceID < out[j].SourceID
+		}
+		return out[i].TargetID < out[j].TargetID
+	})
+	return out
+}
+
+// stopMirror removes the mirror from src to targetID. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) stopMirror(src *ContainerNetwork, targetID string) error {
+	mirrors := mirrorsExcept(src.Mirrors, targetID)
+	if len(mirrors) == len(src.Mirrors) {
+		return fmt.Errorf("%w: %s to %s", ErrMirrorNotFound, src.ContainerID, targetID)
+	}
+	if err := nm.setMirrors(src, mirrors); err != nil {
+		return fmt.Errorf("failed to stop mirroring %s to %s: %w", src.ContainerID, targetID, err)
+	}
+	return nil
+}
+
+// setMirrors replaces the mirrors of src, restoring the previous ones when
+// they can't be programmed. Callers must hold nm.mu.
+func (nm *NetworkManager) setMirrors(src *ContainerNetwork, mirrors []Mirror) error {
+	prev := src.Mirrors
+	src.Mirrors = mirrors
+	if err := nm.syncMirrors(src); err != nil {
+		src.Mirrors = prev
+		if err := nm.syncMirrors(src); err != nil {
+			nm.log.Warn("Failed to restore mirrors", "container_id", src.ContainerID, "error", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// removeMirrorsTo stops every mirror to a deleted container. Mirrors from
+// it went away with its interface. Callers must hold nm.mu.
+func (nm *NetworkManager) removeMirrorsTo(logger *slog.Logger, containerID string) {
+	for _, cn := range nm.containers {
+		if len(mirrorsExcept(cn.Mirrors, containerID)) == len(cn.Mirrors) {
+			continue
+		}
+		logger.Info("Removing mirror to deleted container", "source", cn.ContainerID)
+		if err := nm.stopMirror(cn, containerID); err != nil {
+			logger.Error("Failed to remove mirror", "source", cn.ContainerID, "error", err)
+		}
+	}
+}
+
+// restoreMirrors programs the mirrors of restored containers again,
+// dropping those whose target is gone. Callers must own nm exclusively.
+func (nm *NetworkManager) restoreMirrors() {
+	for _, cn := range nm.containers {
+		if len(cn.Mirrors) == 0 {
+			continue
+		}
+		var mirrors []Mirror
+		for _, m := range cn.Mirrors {
+			if _, ok := nm.containers[m.TargetID]; ok {
+				mirrors = append(mirrors, m)
+			} else {
+				nm.log.Info("Dropping mirror to container that is gone", "container_id", cn.ContainerID, "target", m.TargetID)
+			}
+		}
+		cn.Mirrors = mirrors
+		if err := nm.syncMirrors(cn); err != nil {
+			nm.log.Warn("Failed to restore mirrors", "container_id", cn.ContainerID, "error", err)
+		}
+	}
+}
+
+func mirrorsExcept(mirrors []Mirror, targetID string) []Mirror {
+	var out []Mirror
+	for _, m := range mirrors {
+		if m.TargetID != targetID {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// mirrorTarget reports whether any container mirrors to containerID.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) mirrorTarget(containerID string) bool {
+	for _, cn := range nm.containers {
+		for _, m := range cn.Mirrors {
+			if m.TargetID == containerID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// kernelPath reports whether traffic to cn has to take the kernel stack
+// rather than be redirected by XDP, which skips the host veth's qdisc and
+// filters: when it is shaped, mirrored, delayed by a fault or captured
+func (cn *ContainerNetwork) kernelPath() bool {
+	return cn.IngressBps > 0 || mirrorsIngress(cn.Mirrors) || cn.faultQdisc || cn.faultDelayed || cn.captures > 0
+}
+
+func mirrorsIngress(mirrors []Mirror) bool {
+	for _, m := range mirrors {
+		if m.Direction.ingress() {
+			return true
+		}
+	}
+	return false
+}
+
+func mirrorsEgress(mirrors []Mirror) bool {
+	for _, m := range mirrors {
+		if m.Direction.egress() {
+			return true
+		}
+	}
+	return false
+}
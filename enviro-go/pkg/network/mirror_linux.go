@@ -0,0 +1,102 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// syncMirrors replaces the mirror filters on cn's host veth with those of
+// cn.Mirrors. Traffic to the container leaves the host veth and traffic
+// from it arrives there, so they are copied on egress and ingress of the
+// veth respectively. The filters hang off a clsact qdisc, which is
+// recreated rather than edited and removed along with the last mirror, so
+// unmirrored containers pay nothing for it, and the source check sharing
+// it is attached anew. Callers must hold nm.mu.
+func (nm *NetworkManager) syncMirrors(cn *ContainerNetwork) error {
+	link, err := netlink.LinkByName(cn.HostInterface)
+	if err != nil {
+		return err
+	}
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_CLSACT,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+		},
+		QdiscType: "clsact",
+	}
+
+	err = netlink.QdiscDel(clsact)
+	if err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("failed to remove clsact qdisc: %w", err)
+	}
+	if len(cn.Mirrors) > 0 {
+		if err := netlink.QdiscAdd(clsact); err != nil {
+			return fmt.Errorf("failed to add clsact qdisc: %w", err)
+		}
+		for _, m := range cn.Mirrors {
+			target, ok := nm.containers[m.TargetID]
+			if !ok {
+				continue
+			}
+			if m.Direction.ingress() {
+				if err := addMirrorFilter(link, netlink.HANDLE_MIN_EGRESS, target.HostIfindex); err != nil {
+					return err
+				}
+			}
+			if m.Direction.egress() {
+				if err := addMirrorFilter(link, netlink.HANDLE_MIN_INGRESS, target.HostIfindex); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := nm.checkSources(cn); err != nil {
+		return err
+	}
+	// The router only translates forwards to containers whose replies
+	// skip no mirror
+	if err := nm.syncDatapathForwards(); err != nil {
+		return err
+	}
+	// Redirected packets skip the filters, so mirrored ones take the stack,
+	// as does what spliced sockets send
+	if nm.xdp != nil {
+		if err := nm.xdp.SetShaped(cn.addrs(), cn.kernelPath()); err != nil {
+			return err
+		}
+	}
+	return nm.syncAcceleration(cn)
+}
+
+// addMirrorFilter copies every packet passing parent of link to the
+// interface targetIfindex, leaving the original untouched
+func addMirrorFilter(link netlink.Link, parent uint32, targetIfindex int) error {
+	mirred := netlink.NewMirredAction(targetIfindex)
+	mirred.MirredAction = netlink.TCA_EGRESS_MIRROR
+	mirred.Action = netlink.TC_ACT_PIPE
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		// A single zero key under a zero mask matches every packet
+		Sel: &netlink.TcU32Sel{
+			Flags: netlink.TC_U32_TERMINAL,
+			Nkeys: 1,
+			Keys:  []netlink.TcU32Key{{}},
+		},
+		Actions: []netlink.Action{mirred},
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to add mirror filter: %w", err)
+	}
+	return nil
+}
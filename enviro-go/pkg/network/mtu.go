@@ -0,0 +1,106 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// SetMTU changes NetworkConfig.MTU and applies it to the existing
+// containers that have no MTU of their own or of their namespace,
+// returning how many were updated. It must be between MinMTU and what the
+// uplink carries, see uplinkMTU. The change is not persisted; set
+// NetworkConfig.MTU to keep it across restarts.
+//
+// Containers are updated one at a time. Failures don't stop the others
+// and are returned together; those containers keep their old MTU.
+func (nm *NetworkManager) SetMTU(ctx context.Context, mtu int) (int, error) {
+	if err := nm.checkPrivileged("changing the MTU"); err != nil {
+		return 0, err
+	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if err := nm.checkMTU(mtu); err != nil {
+		return 0, err
+	}
+	nm.config.MTU = mtu
+
+	ids := make([]string, 0, len(nm.containers))
+	for id, cn := range nm.containers {
+		if cn.MTU == 0 && nm.namespaces[namespaceOf(cn.Namespace)].MTU == 0 && cn.Intent == "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var errs []error
+	updated := 0
+	for _, id := range ids {
+		if err := nm.applyMTU(nm.containers[id], mtu); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set MTU of %s: %w", id, err))
+			continue
+		}
+		updated++
+	}
+	nm.logger(ctx).Info("Set container MTU", "mtu", mtu, "containers", updated, "failed", len(errs))
+	return updated, errors.Join(errs...)
+}
+
+// mtuLimit returns the largest MTU containers may use: that of the uplink,
+// see uplinkMTU, and never more than MaxMTU. Callers must hold nm.mu.
+func (nm *NetworkManager) mtuLimit() (int, error) {
+	uplink, err := nm.uplinkMTU()
+	if err != nil || uplink == 0 {
+		return MaxMTU, err
+	}
+	return min(uplink, MaxMTU), nil
+}
+
+// initMTU sets NetworkConfig.MTU to what the uplink carries when it is 0,
+// so containers don't send packets the uplink drops or fragments, and
+// fails with ErrInvalidMTU when it is more. Without an uplink to detect
+// it from, the kernel default is kept.
+func (nm *NetworkManager) initMTU() error {
+	if nm.config.MTU != 0 {
+		return nm.checkMTU(nm.config.MTU)
+	}
+	uplink, err := nm.uplinkMTU()
+	if err != nil {
+		nm.log.Warn("Failed to detect uplink MTU, keeping the kernel default", "error", err)
+		return nil
+	}
+	if uplink == 0 {
+		return nil
+	}
+	nm.config.MTU = max(min(uplink, MaxMTU), MinMTU)
+	nm.log.Info("Detected container MTU", "mtu", nm.config.MTU)
+	return nil
+}
+
+// checkMTU fails with ErrInvalidMTU unless mtu is between MinMTU and
+// mtuLimit. Callers must hold nm.mu.
+func (nm *NetworkManager) checkMTU(mtu int) error {
+	limit, err := nm.mtuLimit()
+	if err != nil {
+		return fmt.Errorf("failed to determine MTU limit: %w", err)
+	}
+	if mtu < MinMTU || mtu > limit {
+		return fmt.Errorf("%w: %d is outside %d-%d", ErrInvalidMTU, mtu, MinMTU, limit)
+	}
+	return nil
+}
+
+// containerMTU returns the MTU cn's interfaces are set to: its own, or
+// else that of its namespace, or else NetworkConfig.MTU, 0 for the kernel
+// default. Callers must hold nm.mu.
+func (nm *NetworkManager) containerMTU(cn *ContainerNetwork) int {
+	if cn.MTU != 0 {
+		return cn.MTU
+	}
+	if mtu := nm.namespaces[namespaceOf(cn.Namespace)].MTU; mtu != 0 {
+		return mtu
+	}
+	return nm.config.MTU
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+)
+
+// VXLAN encapsulation overhead: outer IP, UDP and VXLAN headers plus the
+// inner Ethernet header
+const (
+	vxlanOverhead  = 20 + 8 + 8 + 14
+	vxlan6Overhead = 40 + 8 + 8 + 14
+)
+
+// WireGuard encapsulation overhead: outer IP and UDP headers plus the
+// WireGuard data header and authentication tag
+const (
+	wireGuardOverhead  = 20 + 8 + 16 + 16
+	wireGuard6Overhead = 40 + 8 + 16 + 16
+)
+
+// uplinkMTU returns the MTU of the path container traffic leaves the node
+// by: that of the overlay's underlay less the VXLAN or WireGuard overhead,
+// or else that of the XDP interface, or else that of the interface of the
+// default routes. It returns 0 when there is no such interface. Callers
+// must hold nm.mu.
+func (nm *NetworkManager) uplinkMTU() (int, error) {
+	if node := nm.config.Node; node != nil {
+		local := netip.MustParseAddr(node.Address)
+		underlay, err := linkWithAddr(local)
+		if err != nil {
+			return 0, err
+		}
+		overhead := vxlanOverhead
+		switch {
+		case node.WireGuard != nil && local.Is6():
+			overhead = wireGuard6Overhead
+		case node.WireGuard != nil:
+			overhead = wireGuardOverhead
+		case local.Is6():
+			overhead = vxlan6Overhead
+		}
+		return underlay.Attrs().MTU - overhead, nil
+	}
+	if nm.config.Interface != "" {
+		link, err := netlink.LinkByName(nm.config.Interface)
+		if err != nil {
+			return 0, err
+		}
+		return link.Attrs().MTU, nil
+	}
+	return nm.defaultRouteMTU()
+}
+
+// defaultRouteMTU returns the smallest MTU of the interfaces of the
+// default routes of the families of the container networks, 0 when there
+// are none. Multipath routes are skipped.
+func (nm *NetworkManager) defaultRouteMTU() (int, error) {
+	mtu := 0
+	for _, pool := range nm.pools {
+		family := netlink.FAMILY_V4
+		if pool.prefix.Addr().Is6() {
+			family = netlink.FAMILY_V6
+		}
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range routes {
+			if r.LinkIndex == 0 || !isDefaultRoute(r) {
+				continue
+			}
+			link, err := netlink.LinkByIndex(r.LinkIndex)
+			if err != nil {
+				return 0, err
+			}
+			if mtu == 0 || link.Attrs().MTU < mtu {
+				mtu = link.Attrs().MTU
+			}
+		}
+	}
+	return mtu, nil
+}
+
+// isDefaultRoute reports whether r is a route to everywhere
+func isDefaultRoute(r netlink.Route) bool {
+	if r.Dst == nil {
+		return true
+	}
+	ones, _ := r.Dst.Mask.Size()
+	return ones == 0
+}
+
+// applyMTU sets mtu on both ends of cn's veth and in the XDP router or
+// userspace forwarder.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) applyMTU(cn *ContainerNetwork, mtu int) error {
+	h, err := containerHandle(cn)
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	eth, err := h.LinkByName(containerIfName)
+	if err != nil {
+		return err
+	}
+	if err := h.LinkSetMTU(eth, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU of %s: %w", containerIfName, err)
+	}
+	if cn.Attachment.direct() {
+		return nil
+	}
+	host, err := netlink.LinkByName(cn.HostInterface)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetMTU(host, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU of %s: %w", cn.HostInterface, err)
+	}
+	if nm.userspace != nil {
+		nm.userspace.SetMTU(cn.addrs(), mtu)
+	}
+	if nm.xdp != nil {
+		return nm.xdp.SetMTU(cn.addrs(), mtu)
+	}
+	return nil
+}
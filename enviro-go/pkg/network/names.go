@@ -0,0 +1,266 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/dns"
+)
+
+// ErrInvalidName is returned for container names that are not DNS labels
+var ErrInvalidName = errors.New("network: invalid container name")
+
+// ErrNameInUse is returned when another container already has the name
+var ErrNameInUse = errors.New("network: container name in use")
+
+// DNSConfig configures service discovery of containers by name
+type DNSConfig struct {
+	// Enable serves DNS on the gateway addresses
+	Enable bool `json:"enable"`
+	// Domain containers are resolvable under, defaults to "enviro"
+	Domain string `json:"domain"`
+	// Upstream resolves all other domains, e.g. "1.1.1.1:53". Such
+	// queries are refused when empty.
+	Upstream string `json:"upstream"`
+	// TTL of the records of containers in seconds, 5 when zero, up to
+	// MaxDNSTTL
+	TTL uint32 `json:"ttl"`
+	// PoolTTLs overrides TTL for the addresses of a pool, keyed by its
+	// CIDR, i.e. CIDR or CIDR6. A container's own TTL overrides both.
+	PoolTTLs map[string]uint32 `json:"pool_ttls"`
+}
+
+// MaxDNSTTL bounds the TTLs of container records, as clients would keep
+// resolving a deleted container for as long
+const MaxDNSTTL = 86400
+
+// validate checks the TTLs, and that the pools of PoolTTLs are those of c
+func (d DNSConfig) validate(c NetworkConfig) error {
+	if d.TTL > MaxDNSTTL {
+		return fmt.Errorf("%w: DNS TTL %d is longer than %d", ErrInvalidConfig, d.TTL, MaxDNSTTL)
+	}
+	for cidr, ttl := range d.PoolTTLs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("%w: DNS TTL of pool %q: %v", ErrInvalidConfig, cidr, err)
+		}
+		if !slices.ContainsFunc([]string{c.CIDR, c.CIDR6}, func(s string) bool {
+			pool, err := netip.ParsePrefix(s)
+			return err == nil && pool.Masked() == prefix.Masked()
+		}) {
+			return fmt.Errorf("%w: DNS TTL of %s, which is not a pool", ErrInvalidConfig, cidr)
+		}
+		if ttl > MaxDNSTTL {
+			return fmt.Errorf("%w: DNS TTL %d of pool %s is longer than %d", ErrInvalidConfig, ttl, cidr, MaxDNSTTL)
+		}
+	}
+	return nil
+}
+
+// poolTTLs returns the TTLs of PoolTTLs by prefix
+func (d DNSConfig) poolTTLs() map[netip.Prefix]uint32 {
+	ttls := make(map[netip.Prefix]uint32, len(d.PoolTTLs))
+	for cidr, ttl := range d.PoolTTLs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			ttls[prefix.Masked()] = ttl
+		}
+	}
+	return ttls
+}
+
+// ValidateName checks name is a lowercase DNS label. The empty name is
+// valid; such containers are not resolvable.
+func ValidateName(name string) error {
+	if len(name) > 63 {
+		return fmt.Errorf("%w: %q is longer than 63 characters", ErrInvalidName, name)
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-' && i > 0 && i < len(name)-1:
+		default:
+			return fmt.Errorf("%w: %q must be lowercase letters, digits and inner hyphens", ErrInvalidName, name)
+		}
+	}
+	return nil
+}
+
+// nameInUse reports whether a container other than containerID has name.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) nameInUse(name, containerID string) bool {
+	for id, cn := range nm.containers {
+		if cn.Name == name && id != containerID {
+			return true
+		}
+	}
+	return false
+}
+
+// nameTable holds the addresses served for each container name and the
+// services, and the name each address is served for. It has its own lock
+// so queries are not held up by slow container setup.
+type nameTable struct {
+	mu    sync.RWMutex
+	addrs map[string][]dns.Record
+	// owners maps the addresses of containers and the VIPs of services to
+	// their names, "<service>.svc" for services
+	owners   map[netip.Addr]string
+	services map[string]dns.Service
+	// ttl and poolTTLs are the TTLs of records without one of their own,
+	// see DNSConfig
+	ttl      uint32
+	poolTTLs map[netip.Prefix]uint32
+}
+
+func newNameTable(config DNSConfig) *nameTable {
+	return &nameTable{
+		addrs:    make(map[string][]dns.Record),
+		owners:   make(map[netip.Addr]string),
+		services: make(map[string]dns.Service),
+		ttl:      config.TTL,
+		poolTTLs: config.poolTTLs(),
+	}
+}
+
+// Lookup implements dns.Resolver
+func (t *nameTable) Lookup(name string) ([]dns.Record, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	records, ok := t.addrs[name]
+	return records, ok
+}
+
+// LookupAddr implements dns.Resolver
+func (t *nameTable) LookupAddr(addr netip.Addr) (string, uint32, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	name, ok := t.owners[addr]
+	if !ok {
+		return "", 0, false
+	}
+	for _, r := range t.addrs[name] {
+		if r.Addr == addr {
+			return name, r.TTL, true
+		}
+	}
+	return name, t.ttl, true
+}
+
+// LookupService implements dns.Resolver
+func (t *nameTable) LookupService(name string) (dns.Service, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	svc, ok := t.services[name]
+	return svc, ok
+}
+
+// addService publishes s
+func (t *nameTable) addService(s Service) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	vip := netip.MustParseAddr(s.VIP)
+	if old, ok := t.services[s.Name]; ok && t.owners[old.VIP] == s.Name+".svc" {
+		delete(t.owners, old.VIP)
+	}
+	svc := dns.Service{VIP: vip}
+	for _, p := range s.Ports {
+		svc.Ports = append(svc.Ports, dns.ServicePort{Name: p.Name, Port: p.Port, Protocol: p.Protocol})
+	}
+	t.services[s.Name] = svc
+	t.owners[vip] = s.Name + ".svc"
+}
+
+func (t *nameTable) removeService(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if svc, ok := t.services[name]; ok && t.owners[svc.VIP] == name+".svc" {
+		delete(t.owners, svc.VIP)
+	}
+	delete(t.services, name)
+}
+
+// add publishes the addresses of cn, if it has a name, replacing those it
+// had. An address served for another container moves to cn, which keeps
+// forward and reverse records consistent when an address changes hands
+// before its old holder is deleted, e.g. on migration.
+func (t *nameTable) add(cn *ContainerNetwork) {
+	if cn.Name == "" {
+		return
+	}
+	var records []dns.Record
+	for _, addr := range cn.addrs() {
+		records = append(records, dns.Record{Addr: addr, TTL: t.recordTTL(cn, addr)})
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.release(cn.Name)
+	for _, r := range records {
+		if owner, ok := t.owners[r.Addr]; ok && owner != cn.Name {
+			t.addrs[owner] = slices.DeleteFunc(t.addrs[owner], func(o dns.Record) bool { return o.Addr == r.Addr })
+		}
+		t.owners[r.Addr] = cn.Name
+	}
+	t.addrs[cn.Name] = records
+}
+
+func (t *nameTable) remove(name string) {
+	if name == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.release(name)
+	delete(t.addrs, name)
+}
+
+// release stops the reverse records of the addresses of name that are
+// still its own. Callers must hold t.mu.
+func (t *nameTable) release(name string) {
+	for _, r := range t.addrs[name] {
+		if t.owners[r.Addr] == name {
+			delete(t.owners, r.Addr)
+		}
+	}
+}
+
+// recordTTL returns the TTL of cn's record of addr: its own, that of the
+// pool of addr or the configured one, the server's when zero
+func (t *nameTable) recordTTL(cn *ContainerNetwork, addr netip.Addr) uint32 {
+	if cn.DNSTTL != 0 {
+		return cn.DNSTTL
+	}
+	for prefix, ttl := range t.poolTTLs {
+		if prefix.Contains(addr) && ttl != 0 {
+			return ttl
+		}
+	}
+	return t.ttl
+}
+
+// startDNS serves the name table on every gateway address, with the
+// reverse zones of the pools
+func (nm *NetworkManager) startDNS() error {
+	var zones []netip.Prefix
+	for _, pool := range nm.pools {
+		zones = append(zones, pool.prefix)
+	}
+	server := dns.NewServer(dns.Config{
+		Domain:       nm.config.DNS.Domain,
+		Upstream:     nm.config.DNS.Upstream,
+		TTL:          nm.config.DNS.TTL,
+		ReverseZones: zones,
+		Logger:       nm.log,
+	}, nm.names)
+	for _, pool := range nm.pools {
+		if err := server.Listen(pool.gateway); err != nil {
+			server.Close()
+			return err
+		}
+	}
+	nm.dns = server
+	return nil
+}
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/dns"
+)
+
+func TestNameTableRecords(t *testing.T) {
+	table := newNameTable(DNSConfig{TTL: 30, PoolTTLs: map[string]uint32{"fd00:88::/64": 300}})
+	tests := []struct {
+		name string
+		cn   ContainerNetwork
+		want []dns.Record
+	}{
+		{
+			name: "pool ttls",
+			cn:   ContainerNetwork{Name: "web", IPv4: "10.88.0.2", IPv6: "fd00:88::2"},
+			want: []dns.Record{
+				{Addr: netip.MustParseAddr("10.88.0.2"), TTL: 30},
+				{Addr: netip.MustParseAddr("fd00:88::2"), TTL: 300},
+			},
+		},
+		{
+			name: "container ttl",
+			cn:   ContainerNetwork{Name: "db", IPv4: "10.88.0.3", IPv6: "fd00:88::3", DNSTTL: 1},
+			want: []dns.Record{
+				{Addr: netip.MustParseAddr("10.88.0.3"), TTL: 1},
+				{Addr: netip.MustParseAddr("fd00:88::3"), TTL: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table.add(&tt.cn)
+			got, ok := table.Lookup(tt.cn.Name)
+			if !ok || !slices.Equal(got, tt.want) {
+				t.Fatalf("Lookup(%s) = %v, want %v", tt.cn.Name, got, tt.want)
+			}
+			for _, r := range tt.want {
+				name, ttl, ok := table.LookupAddr(r.Addr)
+				if !ok || name != tt.cn.Name || ttl != r.TTL {
+					t.Errorf("LookupAddr(%s) = %s, %d, %v, want %s, %d", r.Addr, name, ttl, ok, tt.cn.Name, r.TTL)
+				}
+			}
+		})
+	}
+}
+
+// TestNameTableMoves checks forward and reverse records stay consistent
+// as addresses move between containers, e.g. when a container migrates
+// to a new ID before the old one is deleted
+func TestNameTableMoves(t *testing.T) {
+	addr := netip.MustParseAddr("10.88.0.2")
+	addr6 := netip.MustParseAddr("fd00:88::2")
+	type want struct {
+		name  string
+		addrs []netip.Addr
+	}
+	tests := []struct {
+		name   string
+		change func(*nameTable)
+		// names are the forward records expected after the change; every
+		// address listed must resolve back to its name, and the others
+		// not at all
+		names []want
+	}{
+		{
+			name: "address moves to a new container",
+			change: func(table *nameTable) {
+				table.add(&ContainerNetwork{Name: "web-2", IPv4: "10.88.0.2"})
+			},
+			names: []want{{name: "web", addrs: []netip.Addr{addr6}}, {name: "web-2", addrs: []netip.Addr{addr}}},
+		},
+		{
+			name: "old container deleted after the move",
+			change: func(table *nameTable) {
+				table.add(&ContainerNetwork{Name: "web-2", IPv4: "10.88.0.2", IPv6: "fd00:88::2"})
+				table.remove("web")
+			},
+			names: []want{{name: "web-2", addrs: []netip.Addr{addr, addr6}}},
+		},
+		{
+			name: "container readdressed",
+			change: func(table *nameTable) {
+				table.add(&ContainerNetwork{Name: "web", IPv4: "10.88.0.9"})
+			},
+			names: []want{{name: "web", addrs: []netip.Addr{netip.MustParseAddr("10.88.0.9")}}},
+		},
+		{
+			name:   "container deleted",
+			change: func(table *nameTable) { table.remove("web") },
+		},
+		{
+			name: "address reused after delete",
+			change: func(table *nameTable) {
+				table.remove("web")
+				table.add(&ContainerNetwork{Name: "db", IPv6: "fd00:88::2"})
+			},
+			names: []want{{name: "db", addrs: []netip.Addr{addr6}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newNameTable(DNSConfig{})
+			table.add(&ContainerNetwork{Name: "web", IPv4: "10.88.0.2", IPv6: "fd00:88::2"})
+			tt.change(table)
+
+			owned := make(map[netip.Addr]bool)
+			for _, w := range tt.names {
+				records, ok := table.Lookup(w.name)
+				var got []netip.Addr
+				for _, r := range records {
+					got = append(got, r.Addr)
+				}
+				if !ok || !slices.Equal(got, w.addrs) {
+					t.Errorf("Lookup(%s) = %v, want %v", w.name, got, w.addrs)
+				}
+				for _, a := range w.addrs {
+					owned[a] = true
+					if name, _, ok := table.LookupAddr(a); !ok || name != w.name {
+						t.Errorf("LookupAddr(%s) = %s, %v, want %s", a, name, ok, w.name)
+					}
+				}
+			}
+			for _, a := range []netip.Addr{addr, addr6} {
+				if name, _, ok := table.LookupAddr(a); ok && !owned[a] {
+					t.Errorf("LookupAddr(%s) = %s, want none", a, name)
+				}
+			}
+		})
+	}
+}
+
+func TestNameTableServices(t *testing.T) {
+	table := newNameTable(DNSConfig{})
+	vip := netip.MustParseAddr("10.88.255.1")
+	table.addService(Service{Name: "api", VIP: vip.String(), Port: 80, Protocol: "tcp"})
+	if name, _, ok := table.LookupAddr(vip); !ok || name != "api.svc" {
+		t.Errorf("LookupAddr(%s) = %s, %v, want api.svc", vip, name, ok)
+	}
+	table.removeService("api")
+	if name, _, ok := table.LookupAddr(vip); ok {
+		t.Errorf("LookupAddr(%s) = %s after removal, want none", vip, name)
+	}
+}
+
+func TestDNSConfigValidate(t *testing.T) {
+	config := NetworkConfig{CIDR: "10.88.0.0/16", CIDR6: "fd00:88::/64"}
+	tests := []struct {
+		name    string
+		dns     DNSConfig
+		wantErr bool
+	}{
+		{name: "zero"},
+		{name: "ttls", dns: DNSConfig{TTL: 60, PoolTTLs: map[string]uint32{"10.88.0.0/16": 30, "fd00:88::/64": MaxDNSTTL}}},
+		{name: "unmasked pool", dns: DNSConfig{PoolTTLs: map[string]uint32{"10.88.1.0/16": 30}}},
+		{name: "ttl too long", dns: DNSConfig{TTL: MaxDNSTTL + 1}, wantErr: true},
+		{name: "pool ttl too long", dns: DNSConfig{PoolTTLs: map[string]uint32{"10.88.0.0/16": MaxDNSTTL + 1}}, wantErr: true},
+		{name: "not a pool", dns: DNSConfig{PoolTTLs: map[string]uint32{"10.89.0.0/16": 30}}, wantErr: true},
+		{name: "subnet of a pool", dns: DNSConfig{PoolTTLs: map[string]uint32{"10.88.0.0/24": 30}}, wantErr: true},
+		{name: "not a cidr", dns: DNSConfig{PoolTTLs: map[string]uint32{"10.88.0.0": 30}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.dns.validate(config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validate() error = %v, want %v", err, ErrInvalidConfig)
+			}
+		})
+	}
+}
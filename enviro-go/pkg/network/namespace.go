@@ -0,0 +1,403 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+// DefaultNamespace holds the containers, services and policies created
+// without a namespace. It always exists and can't be deleted.
+const DefaultNamespace = "default"
+
+// Errors returned by namespace operations
+var (
+	// ErrNamespaceNotFound is returned for operations on an unknown
+	// namespace
+	ErrNamespaceNotFound = errors.New("network: namespace not found")
+	// ErrNamespaceExists is returned when creating a namespace whose name
+	// is taken
+	ErrNamespaceExists = errors.New("network: namespace exists")
+	// ErrNamespaceNotEmpty is returned when deleting a namespace that still
+	// has containers, services or policies
+	ErrNamespaceNotEmpty = errors.New("network: namespace not empty")
+	// ErrInvalidNamespace is returned for malformed namespaces
+	ErrInvalidNamespace = errors.New("network: invalid namespace")
+	// ErrQuotaExceeded is returned when a change would take a namespace
+	// over its quota
+	ErrQuotaExceeded = errors.New("network: namespace quota exceeded")
+)
+
+// Namespace isolates a group of containers. Traffic between containers of
+// different namespaces is dropped, before any policy applies, unless the
+// destination namespace allows the source one. Services and policies
+// belong to a namespace and only cover its containers.
+type Namespace struct {
+	// Name is a DNS label
+	Name string `json:"name"`
+	// CIDR and CIDR6 reserve ranges of the node's networks for the
+	// namespace, whose containers then only get addresses from them. Other
+	// namespaces never allocate from a reserved range.
+	CIDR  string `json:"cidr,omitempty"`
+	CIDR6 string `json:"cidr6,omitempty"`
+	// AllowFrom names the namespaces whose containers may reach this one's
+	AllowFrom []string `json:"allow_from,omitempty"`
+	// Quota bounds the resources of the namespace
+	Quota NamespaceQuota `json:"quota"`
+	// MTU overrides NetworkConfig.MTU for the namespace's containers when
+	// set, e.g. for jumbo frames between them. It must fit the uplink.
+	MTU int `json:"mtu,omitempty"`
+	// ID identifies the namespace in the datapath, 0 for the default one
+	ID uint32 `json:"id"`
+}
+
+// NamespaceQuota bounds the resources of a namespace, zero meaning
+// unlimited
+type NamespaceQuota struct {
+	MaxContainers int `json:"max_containers,omitempty"`
+	// MaxAddresses counts the addresses of both families
+	MaxAddresses int `json:"max_addresses,omitempty"`
+	// MaxBandwidthBps bounds the sum of the bandwidth limits of the
+	// namespace's containers in each direction. Containers of a namespace
+	// with such a quota must have both limits.
+	MaxBandwidthBps uint64 `json:"max_bandwidth_bps,omitempty"`
+}
+
+// NamespaceUsage is what the containers of a namespace hold against its
+// quota
+type NamespaceUsage struct {
+	Containers int
+	Addresses  int
+	// IngressBps and EgressBps sum the bandwidth limits of the containers
+	IngressBps uint64
+	EgressBps  uint64
+}
+
+// namespaceOf returns the namespace name, which is empty in objects saved
+// before namespaces existed, for the default namespace
+func namespaceOf(name string) string {
+	if name == "" {
+		return DefaultNamespace
+	}
+	return name
+}
+
+// Validate checks that the namespace is well formed
+func (ns Namespace) Validate() error {
+	if ns.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidNamespace)
+	}
+	if err := ValidateName(ns.Name); err != nil {
+		return fmt.Errorf("%w: %q must be a DNS label", ErrInvalidNamespace, ns.Name)
+	}
+	for _, c := range []struct {
+		cidr string
+		v6   bool
+	}{{ns.CIDR, false}, {ns.CIDR6, true}} {
+		if c.cidr == "" {
+			continue
+		}
+		if ns.Name == DefaultNamespace {
+			return fmt.Errorf("%w: the default namespace can't reserve addresses", ErrInvalidNamespace)
+		}
+		prefix, err := netip.ParsePrefix(c.cidr)
+		if err != nil {
+			return fmt.Errorf("%w: namespace %s: %v", ErrInvalidNamespace, ns.Name, err)
+		}
+		if prefix.Addr().Is6() != c.v6 || prefix.Addr().Is4In6() {
+			return fmt.Errorf("%w: namespace %s: %s is not of the expected family", ErrInvalidNamespace, ns.Name, prefix)
+		}
+	}
+	for _, from := range ns.AllowFrom {
+		if err := ValidateName(from); err != nil || from == "" {
+			return fmt.Errorf("%w: namespace %s allows invalid namespace %q", ErrInvalidNamespace, ns.Name, from)
+		}
+	}
+	if ns.Quota.MaxContainers < 0 || ns.Quota.MaxAddresses < 0 {
+		return fmt.Errorf("%w: namespace %s has a negative quota", ErrInvalidNamespace, ns.Name)
+	}
+	if ns.MTU != 0 && (ns.MTU < MinMTU || ns.MTU > MaxMTU) {
+		return fmt.Errorf("%w: namespace %s: %d is outside %d-%d", ErrInvalidMTU, ns.Name, ns.MTU, MinMTU, MaxMTU)
+	}
+	return nil
+}
+
+// CreateNamespace adds a namespace, reserving its address ranges
+func (nm *NetworkManager) CreateNamespace(ns Namespace) (Namespace, error) {
+	if err := ns.Validate(); err != nil {
+		return Namespace{}, err
+	}
+	ns.AllowFrom = slices.Clone(ns.AllowFrom)
+	ns.ID = 0
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, ok := nm.namespaces[ns.Name]; ok {
+		return Namespace{}, fmt.Errorf("%w: %s", ErrNamespaceExists, ns.Name)
+	}
+	if ns.MTU != 0 {
+		if err := nm.checkMTU(ns.MTU); err != nil {
+			return Namespace{}, err
+		}
+	}
+	for _, other := range nm.namespaces {
+		ns.ID = max(ns.ID, other.ID)
+	}
+	ns.ID++
+	if err := nm.reserveRanges(ns); err != nil {
+		return Namespace{}, err
+	}
+	nm.namespaces[ns.Name] = ns
+	if err := nm.syncNamespaces(); err != nil {
+		nm.log.Error("Failed to program namespace isolation", "error", err)
+	}
+	nm.log.Info("Created namespace", "namespace", ns.Name, "cidr", ns.CIDR, "cidr6", ns.CIDR6,
+		"allow_from", ns.AllowFrom, "max_containers", ns.Quota.MaxContainers,
+		"max_addresses", ns.Quota.MaxAddresses, "max_bandwidth_bps", ns.Quota.MaxBandwidthBps, "mtu", ns.MTU)
+	return ns, nm.saveState()
+}
+
+// UpdateNamespace replaces the namespaces allowed into name and its quota.
+// A lower quota only stops new containers; existing ones are kept.
+func (nm *NetworkManager) UpdateNamespace(name string, allowFrom []string, quota NamespaceQuota) (Namespace, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	old, ok := nm.namespaces[name]
+	if !ok {
+		return Namespace{}, fmt.Errorf("%w: %s", ErrNamespaceNotFound, name)
+	}
+	ns := old
+	ns.AllowFrom = slices.Clone(allowFrom)
+	ns.Quota = quota
+	if err := ns.Validate(); err != nil {
+		return Namespace{}, err
+	}
+
+	nm.namespaces[name] = ns
+	if err := nm.syncNamespaces(); err != nil {
+		nm.namespaces[name] = old
+		return Namespace{}, fmt.Errorf("failed to program namespace isolation: %w", err)
+	}
+	nm.log.Info("Updated namespace", "namespace", name, "allow_from", ns.AllowFrom,
+		"max_containers", quota.MaxContainers, "max_addresses", quota.MaxAddresses,
+		"max_bandwidth_bps", quota.MaxBandwidthBps)
+	return ns, nm.saveState()
+}
+
+// DeleteNamespace removes an empty namespace and releases its address
+// ranges
+func (nm *NetworkManager) DeleteNamespace(name string) error {
+	if name == DefaultNamespace {
+		return fmt.Errorf("%w: the default namespace can't be deleted", ErrInvalidNamespace)
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, ok := nm.namespaces[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNamespaceNotFound, name)
+	}
+	if usage := nm.namespaceUsage(name); usage.Containers > 0 {
+		return fmt.Errorf("%w: %s has %d containers", ErrNamespaceNotEmpty, name, usage.Containers)
+	}
+	for _, s := range nm.services {
+		if s.Namespace == name {
+			return fmt.Errorf("%w: %s has service %s", ErrNamespaceNotEmpty, name, s.Name)
+		}
+	}
+	for _, p := range nm.policies {
+		if p.Namespace == name {
+			return fmt.Errorf("%w: %s has policy %s", ErrNamespaceNotEmpty, name, p.Name)
+		}
+	}
+
+	delete(nm.namespaces, name)
+	nm.releaseRanges(name)
+	nm.log.Info("Deleted namespace", "namespace", name)
+	return nm.saveState()
+}
+
+// ListNamespaces returns all namespaces ordered by name
+func (nm *NetworkManager) ListNamespaces() []Namespace {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.sortedNamespaces()
+}
+
+// sortedNamespaces returns copies of the namespaces ordered by name.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) sortedNamespaces() []Namespace {
+	out := make([]Namespace, 0, len(nm.namespaces))
+	for _, ns := range nm.namespaces {
+		ns.AllowFrom = slices.Clone(ns.AllowFrom)
+		out = append(out, ns)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// NamespaceUsage returns what the containers of the namespace name hold
+// against its quota
+func (nm *NetworkManager) NamespaceUsage(name string) (NamespaceUsage, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, ok := nm.namespaces[name]; !ok {
+		return NamespaceUsage{}, fmt.Errorf("%w: %s", ErrNamespaceNotFound, name)
+	}
+	return nm.namespaceUsage(name), nil
+}
+
+// namespaceUsage sums the containers of the namespace name. Callers must
+// hold nm.mu.
+func (nm *NetworkManager) namespaceUsage(name string) NamespaceUsage {
+	var usage NamespaceUsage
+	for _, cn := range nm.containers {
+		if cn.Namespace != name {
+			continue
+		}
+		usage.Containers++
+		usage.Addresses += len(cn.addrs())
+		usage.IngressBps += cn.IngressBps
+		usage.EgressBps += cn.EgressBps
+	}
+	return usage
+}
+
+// checkQuota fails with ErrQuotaExceeded when adding the container
+// containerID with addrs addresses and the given bandwidth limits to the
+// namespace name would exceed its quota. For a container already in it,
+// only the change of its limits is checked. Callers must hold nm.mu.
+func (nm *NetworkManager) checkQuota(name, containerID string, addrs int, ingressBps, egressBps uint64) error {
+	quota := nm.namespaces[name].Quota
+	usage := nm.namespaceUsage(name)
+	if cn, ok := nm.containers[containerID]; ok {
+		usage.IngressBps -= cn.IngressBps
+		usage.EgressBps -= cn.EgressBps
+	} else {
+		if quota.MaxContainers > 0 && usage.Containers+1 > quota.MaxContainers {
+			return fmt.Errorf("%w: %s allows %d containers", ErrQuotaExceeded, name, quota.MaxContainers)
+		}
+		if quota.MaxAddresses > 0 && usage.Addresses+addrs > quota.MaxAddresses {
+			return fmt.Errorf("%w: %s allows %d addresses", ErrQuotaExceeded, name, quota.MaxAddresses)
+		}
+	}
+	if quota.MaxBandwidthBps == 0 {
+		return nil
+	}
+	if ingressBps == 0 || egressBps == 0 {
+		return fmt.Errorf("%w: containers of %s need ingress and egress bandwidth limits", ErrQuotaExceeded, name)
+	}
+	if usage.IngressBps+ingressBps > quota.MaxBandwidthBps || usage.EgressBps+egressBps > quota.MaxBandwidthBps {
+		return fmt.Errorf("%w: %s allows %d bps in each direction", ErrQuotaExceeded, name, quota.MaxBandwidthBps)
+	}
+	return nil
+}
+
+// reserveRanges reserves the address ranges of ns in the pools of their
+// family, which must contain them. Callers must hold nm.mu.
+func (nm *NetworkManager) reserveRanges(ns Namespace) error {
+	for _, cidr := range []string{ns.CIDR, ns.CIDR6} {
+		if cidr == "" {
+			continue
+		}
+		prefix := netip.MustParsePrefix(cidr).Masked()
+		var pool *ipAllocator
+		for _, p := range nm.pools {
+			if p.prefix.Addr().Is4() == prefix.Addr().Is4() {
+				pool = p
+			}
+		}
+		if pool == nil {
+			nm.releaseRanges(ns.Name)
+			return fmt.Errorf("%w: namespace %s: no network for %s", ErrInvalidNamespace, ns.Name, prefix)
+		}
+		if err := pool.ReserveRange(ns.Name, prefix); err != nil {
+			nm.releaseRanges(ns.Name)
+			return fmt.Errorf("%w: namespace %s: %v", ErrInvalidNamespace, ns.Name, err)
+		}
+	}
+	return nil
+}
+
+// releaseRanges releases the address ranges of the namespace name
+func (nm *NetworkManager) releaseRanges(name string) {
+	for _, pool := range nm.pools {
+		pool.ReleaseRange(name)
+	}
+}
+
+// isolated reports whether traffic from containers of the namespace src
+// to those of dst is dropped. Callers must hold nm.mu.
+func (nm *NetworkManager) isolated(src, dst string) bool {
+	return src != dst && !slices.Contains(nm.namespaces[dst].AllowFrom, src)
+}
+
+// namespaceID returns the datapath ID of the namespace name, 0 for the
+// default namespace and any that is gone. Callers must hold nm.mu.
+func (nm *NetworkManager) namespaceID(name string) uint32 {
+	return nm.namespaces[name].ID
+}
+
+// namespaceDenials returns, for each namespace with containers, the
+// addresses of containers in other namespaces it doesn't allow, keyed by
+// the destination namespace, along with the addresses of its own
+// containers. Namespaces nothing is denied into are left out. Callers must
+// hold nm.mu.
+func (nm *NetworkManager) namespaceDenials() map[string]namespaceDenial {
+	members := make(map[string][]netip.Addr)
+	for _, cn := range nm.containers {
+		members[cn.Namespace] = append(members[cn.Namespace], cn.addrs()...)
+	}
+	out := make(map[string]namespaceDenial)
+	for dst, dstAddrs := range members {
+		d := namespaceDenial{Dst: dstAddrs}
+		for src, srcAddrs := range members {
+			if nm.isolated(src, dst) {
+				d.Src = append(d.Src, srcAddrs...)
+			}
+		}
+		if len(d.Src) > 0 {
+			sortAddrs(d.Dst)
+			sortAddrs(d.Src)
+			out[dst] = d
+		}
+	}
+	return out
+}
+
+// namespaceDenial is the traffic dropped into a namespace: from any of
+// Src to any of Dst
+type namespaceDenial struct {
+	Dst []netip.Addr
+	Src []netip.Addr
+}
+
+func sortAddrs(addrs []netip.Addr) {
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+}
+
+// restoreNamespaces adds the saved namespaces and reserves their ranges
+// again, before the containers' addresses are. It runs before the manager
+// is shared.
+func (nm *NetworkManager) restoreNamespaces(namespaces []Namespace) {
+	for _, ns := range namespaces {
+		logger := nm.log.With("namespace", ns.Name)
+		if err := ns.Validate(); err != nil {
+			logger.Warn("Dropping saved namespace", "error", err)
+			continue
+		}
+		if err := nm.reserveRanges(ns); err != nil {
+			logger.Warn("Dropping saved namespace", "error", err)
+			continue
+		}
+		nm.namespaces[ns.Name] = ns
+	}
+	if len(nm.namespaces) > 1 {
+		nm.log.Info("Restored namespaces", "count", len(nm.namespaces)-1)
+	}
+}
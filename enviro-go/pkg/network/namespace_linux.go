@@ -0,0 +1,156 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftNamespaceTable is the inet table dropping traffic between isolated
+// namespaces
+const nftNamespaceTable = "enviro_namespaces"
+
+// syncNamespaces isolates the namespaces from each other. The XDP router,
+// when loaded, drops what arrives on its interface from a container of an
+// isolated namespace. Traffic between the containers of this node is
+// forwarded by the kernel, so in every mode the namespace table is rebuilt
+// in one atomic batch: for each namespace something is denied into, sets
+// of its addresses and of the addresses denied, with a rule dropping
+// traffic from the one to the other. It hooks forward just before the
+// policy table, so namespaces apply first. Rootless containers are
+// isolated from all others anyway. Callers must hold nm.mu.
+func (nm *NetworkManager) syncNamespaces() error {
+	if nm.rootless {
+		return nil
+	}
+	conn := &nftables.Conn{}
+	table := resetTable(conn, nm.nftTable(nftNamespaceTable), nftables.TableFamilyINet)
+
+	denials := nm.namespaceDenials()
+	if len(denials) > 0 {
+		conn.AddTable(table)
+		chain := conn.AddChain(&nftables.Chain{
+			Name:     "forward",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookForward,
+			Priority: nftables.ChainPriorityRef(*nftables.ChainPriorityFilter - 1),
+		})
+		names := make([]string, 0, len(denials))
+		for name := range denials {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			d := denials[name]
+			for _, v6 := range []bool{false, true} {
+				dst := namespaceSet(table, fmt.Sprintf("dst%d_%d", i, ipVersion(v6)), d.Dst, v6)
+				src := namespaceSet(table, fmt.Sprintf("src%d_%d", i, ipVersion(v6)), d.Src, v6)
+				if dst == nil || src == nil {
+					continue
+				}
+				for _, s := range []*namespaceSetElems{dst, src} {
+					if err := conn.AddSet(s.set, s.elems); err != nil {
+						return fmt.Errorf("namespace %s: %w", name, err)
+					}
+				}
+				conn.AddRule(&nftables.Rule{
+					Table:    table,
+					Chain:    chain,
+					Exprs:    namespaceExprs(dst.set, src.set, v6),
+					UserData: []byte(name),
+				})
+			}
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	if nm.xdp == nil {
+		return nil
+	}
+	members := make(map[netip.Addr]uint32)
+	for _, cn := range nm.containers {
+		if id := nm.namespaceID(cn.Namespace); id != 0 {
+			for _, addr := range cn.addrs() {
+				members[addr] = id
+			}
+		}
+	}
+	allowed := make(map[nsPair]bool)
+	for _, ns := range nm.namespaces {
+		for _, from := range ns.AllowFrom {
+			if src, ok := nm.namespaces[from]; ok && src.ID != ns.ID {
+				allowed[nsPair{Src: src.ID, Dst: ns.ID}] = true
+			}
+		}
+	}
+	return nm.xdp.SetNamespaces(members, allowed)
+}
+
+// ipVersion returns the IP version of a family, for naming sets
+func ipVersion(v6 bool) int {
+	if v6 {
+		return 6
+	}
+	return 4
+}
+
+// namespaceSetElems is a named address set and its elements
+type namespaceSetElems struct {
+	set   *nftables.Set
+	elems []nftables.SetElement
+}
+
+// namespaceSet returns the set of the addresses of the family, nil when
+// there are none
+func namespaceSet(table *nftables.Table, name string, addrs []netip.Addr, v6 bool) *namespaceSetElems {
+	s := &namespaceSetElems{set: &nftables.Set{Table: table, Name: name, KeyType: nftables.TypeIPAddr}}
+	if v6 {
+		s.set.KeyType = nftables.TypeIP6Addr
+	}
+	for _, addr := range addrs {
+		if addr.Is6() == v6 {
+			s.elems = append(s.elems, nftables.SetElement{Key: addr.AsSlice()})
+		}
+	}
+	if len(s.elems) == 0 {
+		return nil
+	}
+	return s
+}
+
+// namespaceExprs drops traffic to an address of dst from one of src:
+//
+//	meta nfproto ipv4 ip daddr @dst0_4 ip saddr @src0_4 counter drop
+func namespaceExprs(dst, src *nftables.Set, v6 bool) []expr.Any {
+	family, srcOffset, dstOffset, addrLen := byte(unix.NFPROTO_IPV4), uint32(12), uint32(16), uint32(4)
+	if v6 {
+		family, srcOffset, dstOffset, addrLen = unix.NFPROTO_IPV6, 8, 24, 16
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: dstOffset, Len: addrLen},
+		&expr.Lookup{SourceRegister: 1, SetName: dst.Name, SetID: dst.ID},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: srcOffset, Len: addrLen},
+		&expr.Lookup{SourceRegister: 1, SetName: src.Name, SetID: src.ID},
+		&expr.Counter{},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}
+}
+
+// clearNamespaces removes the namespace table of an earlier run, which
+// is rebuilt once the namespaces are restored
+func (nm *NetworkManager) clearNamespaces() error {
+	conn := &nftables.Conn{}
+	resetTable(conn, nm.nftTable(nftNamespaceTable), nftables.TableFamilyINet)
+	return conn.Flush()
+}
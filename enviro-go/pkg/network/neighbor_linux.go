@@ -0,0 +1,315 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftNeighborTable names the arp and ip6 tables dropping the ARP and
+// neighbor discovery containers send claiming an address or MAC not
+// theirs, while the router's source check doesn't run
+const nftNeighborTable = "enviro-neighbor"
+
+// arpHookIn is NF_ARP_IN, where the ARP arriving for the host is filtered
+const arpHookIn = 0
+
+// Neighbor discovery messages and options, see RFC 4861
+const (
+	ndNeighborSolicitation  = 135
+	ndNeighborAdvertisement = 136
+	ndOptSourceLLAddr       = 1
+	ndOptTargetLLAddr       = 2
+)
+
+// guardsNeighbors reports whether the neighbor tables check what
+// containers announce, as the router's source check doesn't run
+func (nm *NetworkManager) guardsNeighbors() bool {
+	return nm.xdp == nil || !nm.xdp.hasSourceCheck()
+}
+
+// syncNeighbors rebuilds the neighbor tables in one atomic batch, or
+// removes them while the router's source check makes the same decisions,
+// see source_spoofed in bpf/container_router.c. The ARP a container sends
+// may only announce its MAC and the addresses it may send from, and its
+// neighbor solicitations and advertisements those and link-local ones.
+//
+// Drop rules count their packets and carry the ID of the container, see
+// readNeighborCounters. Callers must hold nm.mu.
+func (nm *NetworkManager) syncNeighbors() error {
+	if nm.rootless {
+		return nil
+	}
+	// Keep the counts of the tables about to be replaced. Those of deleted
+	// containers only still matter for the node total.
+	if counts, err := nm.readNeighborCounters(); err == nil {
+		nm.neighborCounters = make(map[string]uint64)
+		for id, n := range counts {
+			if _, ok := nm.containers[id]; !ok {
+				id = ""
+			}
+			nm.neighborCounters[id] += n
+		}
+	}
+
+	conn := &nftables.Conn{}
+	arp := resetTable(conn, nm.nftTable(nftNeighborTable), nftables.TableFamilyARP)
+	nd := resetTable(conn, nm.nftTable(nftNeighborTable), nftables.TableFamilyIPv6)
+	if !nm.guardsNeighbors() {
+		return conn.Flush()
+	}
+
+	conn.AddTable(arp)
+	conn.AddTable(nd)
+	arpInput := conn.AddChain(&nftables.Chain{
+		Name:     "input",
+		Table:    arp,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookRef(arpHookIn),
+		Priority: nftables.ChainPriorityFilter,
+	})
+	ndInput := conn.AddChain(&nftables.Chain{
+		Name:     "input",
+		Table:    nd,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	ids := make([]string, 0, len(nm.containers))
+	for id := range nm.containers {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		cn := nm.containers[id]
+		if !cn.sourceChecked() {
+			continue
+		}
+		mac, err := net.ParseMAC(cn.MAC)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidMAC, id, err)
+		}
+		var sources4, sources6 []netip.Prefix
+		for _, p := range cn.sources() {
+			if p.Addr().Is4() {
+				sources4 = append(sources4, p)
+			} else {
+				sources6 = append(sources6, p)
+			}
+		}
+		sources6 = append(slices.Clone(exemptSources6), sources6...)
+
+		// Each container gets chains named after its veth, jumped to
+		// from the input chains
+		chain := conn.AddChain(&nftables.Chain{Name: cn.HostInterface, Table: arp})
+		conn.AddRule(&nftables.Rule{Table: arp, Chain: arpInput,
+			Exprs: append(matchIIF(cn.HostIfindex), &expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name})})
+		for _, exprs := range arpGuardExprs(mac, sources4) {
+			conn.AddRule(&nftables.Rule{Table: arp, Chain: chain, Exprs: exprs, UserData: []byte(id)})
+		}
+
+		source := conn.AddChain(&nftables.Chain{Name: cn.HostInterface, Table: nd})
+		target := conn.AddChain(&nftables.Chain{Name: cn.HostInterface + "-target", Table: nd})
+		for _, typ := range []byte{ndNeighborSolicitation, ndNeighborAdvertisement} {
+			conn.AddRule(&nftables.Rule{Table: nd, Chain: ndInput,
+				Exprs: append(matchIIF(cn.HostIfindex),
+					&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{typ}},
+					&expr.Verdict{Kind: expr.VerdictJump, Chain: source.Name},
+				)})
+		}
+		for _, exprs := range ndSourceExprs(mac, sources6, target.Name) {
+			conn.AddRule(&nftables.Rule{Table: nd, Chain: source, Exprs: exprs, UserData: []byte(id)})
+		}
+		for _, exprs := range ndTargetExprs(sources6) {
+			conn.AddRule(&nftables.Rule{Table: nd, Chain: target, Exprs: exprs, UserData: []byte(id)})
+		}
+	}
+	return conn.Flush()
+}
+
+// readNeighborCounters returns the messages the neighbor tables dropped,
+// keyed by the ID of the container that sent them. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) readNeighborCounters() (map[string]uint64, error) {
+	counts := make(map[string]uint64)
+	for id, n := range nm.neighborCounters {
+		counts[id] = n
+	}
+	if nm.rootless {
+		return counts, nil
+	}
+	conn := &nftables.Conn{}
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyARP, nftables.TableFamilyIPv6} {
+		chains, err := conn.ListChainsOfTableFamily(family)
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return nil, err
+		}
+		for _, chain := range chains {
+			if chain.Table.Name != nm.nftTable(nftNeighborTable) || chain.Hooknum != nil {
+				continue
+			}
+			rules, err := conn.GetRules(chain.Table, chain)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range rules {
+				for _, e := range r.Exprs {
+					if c, ok := e.(*expr.Counter); ok {
+						counts[string(r.UserData)] += c.Packets
+					}
+				}
+			}
+		}
+	}
+	return counts, nil
+}
+
+// matchIIF matches packets arriving on the interface with index
+func matchIIF(index int) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIF, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(index))},
+	}
+}
+
+// matchPrefix matches the address at offset of base within p
+func matchPrefix(base expr.PayloadBase, offset uint32, p netip.Prefix) []expr.Any {
+	n := uint32(p.Addr().BitLen() / 8)
+	exprs := []expr.Any{&expr.Payload{DestRegister: 1, Base: base, Offset: offset, Len: n}}
+	if !p.IsSingleIP() {
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            n,
+			Mask:           net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+			Xor:            make([]byte, n),
+		})
+	}
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: p.Masked().Addr().AsSlice()})
+}
+
+// countedDrop counts and drops what a rule matched
+func countedDrop() []expr.Any {
+	return []expr.Any{&expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}}
+}
+
+// arpGuardExprs returns the rules of a container's ARP chain, in order:
+//
+//	arp htype != 1 ... return
+//	arp saddr ether != 02:00:0a:58:00:02 counter drop
+//	arp saddr ip 0.0.0.0 accept
+//	arp saddr ip 10.88.0.2 accept
+//	counter drop
+func arpGuardExprs(mac net.HardwareAddr, sources []netip.Prefix) [][]expr.Any {
+	out := [][]expr.Any{
+		// Only Ethernet ARP for IPv4 announces addresses the host uses
+		{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 0, Len: 6},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, unix.ARPHRD_ETHER, 0x08, 0x00, 6, 4}},
+			&expr.Verdict{Kind: expr.VerdictReturn},
+		},
+		append([]expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 6},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: mac},
+		}, countedDrop()...),
+		// Probes for a conflicting address are sent from 0.0.0.0
+		append(matchPrefix(expr.PayloadBaseNetworkHeader, 14, netip.PrefixFrom(netip.IPv4Unspecified(), 32)),
+			&expr.Verdict{Kind: expr.VerdictAccept}),
+	}
+	for _, p := range sources {
+		out = append(out, append(matchPrefix(expr.PayloadBaseNetworkHeader, 14, p), &expr.Verdict{Kind: expr.VerdictAccept}))
+	}
+	return append(out, countedDrop())
+}
+
+// ndSourceExprs returns the rules of a container's neighbor discovery
+// chain, in order, which checks the link-layer address option and the
+// source before going to the target chain:
+//
+//	icmpv6 option 1 or 2 != 02:00:0a:58:00:02 counter drop
+//	ip6 saddr fe80::/10 goto veth-target
+//	counter drop
+func ndSourceExprs(mac net.HardwareAddr, sources []netip.Prefix, target string) [][]expr.Any {
+	var out [][]expr.Any
+	// The option follows the 8 bytes of header and the 16 of the target
+	for _, opt := range []byte{ndOptSourceLLAddr, ndOptTargetLLAddr} {
+		out = append(out, append([]expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 24, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{opt, 1}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 26, Len: 6},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: mac},
+		}, countedDrop()...))
+	}
+	for _, p := range sources {
+		out = append(out, append(matchPrefix(expr.PayloadBaseNetworkHeader, 8, p), &expr.Verdict{Kind: expr.VerdictGoto, Chain: target}))
+	}
+	return append(out, countedDrop())
+}
+
+// ndTargetExprs returns the rules of a container's target chain, in
+// order, which lets advertisements announce its addresses only:
+//
+//	icmpv6 type nd-neighbor-solicit accept
+//	icmpv6 target fe80::/10 accept
+//	counter drop
+func ndTargetExprs(sources []netip.Prefix) [][]expr.Any {
+	out := [][]expr.Any{{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{ndNeighborSolicitation}},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}}
+	for _, p := range sources {
+		out = append(out, append(matchPrefix(expr.PayloadBaseTransportHeader, 8, p), &expr.Verdict{Kind: expr.VerdictAccept}))
+	}
+	return append(out, countedDrop())
+}
+
+// NeighborSpoofing returns how many ARP and neighbor discovery messages
+// each container sent claiming an address or MAC not its own were
+// dropped, by container ID. Containers without any are left out.
+func (nm *NetworkManager) NeighborSpoofing() (map[string]uint64, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.guardsNeighbors() {
+		counts, err := nm.readNeighborCounters()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read neighbor counters: %w", err)
+		}
+		delete(counts, "")
+		for id, n := range counts {
+			if n == 0 {
+				delete(counts, id)
+			}
+		}
+		return counts, nil
+	}
+	counts := make(map[string]uint64)
+	for id, cn := range nm.containers {
+		if !cn.sourceChecked() {
+			continue
+		}
+		s, err := nm.xdp.ContainerStats(cn.HostIfindex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stats for %s: %w", id, err)
+		}
+		if s.NeighborSpoofed > 0 {
+			counts[id] = s.NeighborSpoofed
+		}
+	}
+	return counts, nil
+}
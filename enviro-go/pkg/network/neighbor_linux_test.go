@@ -0,0 +1,313 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// neighborTestEnv marks the child of TestNeighborTables
+const neighborTestEnv = "ENVIRO_TEST_NEIGHBOR_TABLES"
+
+// neighborHosts are the parties of the neighbor cases: a container, the
+// host its veth leads to, and a victim whose address the container claims
+type neighborHosts struct {
+	mac, hostMAC, victimMAC net.HardwareAddr
+	own4, host4, victim4    netip.Addr
+	own6, host6, victim6    netip.Addr
+}
+
+var testNeighborHosts = neighborHosts{
+	mac:       net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02},
+	hostMAC:   net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+	victimMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03},
+	own4:      netip.MustParseAddr("10.0.0.2"),
+	host4:     netip.MustParseAddr("10.0.0.1"),
+	victim4:   netip.MustParseAddr("10.0.0.3"),
+	own6:      netip.MustParseAddr("fd00::2"),
+	host6:     netip.MustParseAddr("fd00::1"),
+	victim6:   netip.MustParseAddr("fd00::3"),
+}
+
+// sources are the prefixes the container of h may send from
+func (h neighborHosts) sources() []netip.Prefix {
+	return []netip.Prefix{netip.PrefixFrom(h.own4, 32), netip.PrefixFrom(h.own6, 128)}
+}
+
+// neighborCases are the ARP and neighbor discovery the container of
+// testNeighborHosts sends, which the router's source check and the
+// neighbor tables must both pass or drop
+var neighborCases = []struct {
+	name    string
+	frame   func(h neighborHosts) []byte
+	spoofed bool
+}{
+	{
+		name:  "ARP request",
+		frame: func(h neighborHosts) []byte { return arpFrame(h.hostMAC, h.mac, 1, h.mac, h.own4, h.host4) },
+	},
+	{
+		name: "ARP probe",
+		frame: func(h neighborHosts) []byte {
+			return arpFrame(h.hostMAC, h.mac, 1, h.mac, netip.IPv4Unspecified(), h.own4)
+		},
+	},
+	{
+		name:  "ARP reply",
+		frame: func(h neighborHosts) []byte { return arpFrame(h.hostMAC, h.mac, 2, h.mac, h.own4, h.host4) },
+	},
+	{
+		name:    "ARP reply for another address",
+		frame:   func(h neighborHosts) []byte { return arpFrame(h.hostMAC, h.mac, 2, h.mac, h.victim4, h.host4) },
+		spoofed: true,
+	},
+	{
+		name:    "gratuitous ARP for another address",
+		frame:   func(h neighborHosts) []byte { return arpFrame(h.hostMAC, h.mac, 1, h.mac, h.victim4, h.victim4) },
+		spoofed: true,
+	},
+	{
+		name:    "ARP announcing another MAC",
+		frame:   func(h neighborHosts) []byte { return arpFrame(h.hostMAC, h.mac, 2, h.victimMAC, h.own4, h.host4) },
+		spoofed: true,
+	},
+	{
+		name: "neighbor solicitation",
+		frame: func(h neighborHosts) []byte {
+			return ndFrame(h.hostMAC, h.mac, h.own6, h.host6, ndNeighborSolicitation, h.host6, h.mac)
+		},
+	},
+	{
+		name: "neighbor advertisement",
+		frame: func(h neighborHosts) []byte {
+			return ndFrame(h.hostMAC, h.mac, h.own6, h.host6, ndNeighborAdvertisement, h.own6, h.mac)
+		},
+	},
+	{
+		name: "neighbor advertisement for a link-local address",
+		frame: func(h neighborHosts) []byte {
+			ll := netip.MustParseAddr("fe80::2")
+			return ndFrame(h.hostMAC, h.mac, ll, h.host6, ndNeighborAdvertisement, ll, h.mac)
+		},
+	},
+	{
+		name: "neighbor advertisement for another address",
+		frame: func(h neighborHosts) []byte {
+			return ndFrame(h.hostMAC, h.mac, h.own6, h.host6, ndNeighborAdvertisement, h.victim6, h.mac)
+		},
+		spoofed: true,
+	},
+	{
+		name: "neighbor advertisement announcing another MAC",
+		frame: func(h neighborHosts) []byte {
+			return ndFrame(h.hostMAC, h.mac, h.own6, h.host6, ndNeighborAdvertisement, h.own6, h.victimMAC)
+		},
+		spoofed: true,
+	},
+	{
+		name: "neighbor solicitation from another address",
+		frame: func(h neighborHosts) []byte {
+			return ndFrame(h.hostMAC, h.mac, h.victim6, h.host6, ndNeighborSolicitation, h.host6, h.mac)
+		},
+		spoofed: true,
+	},
+}
+
+// arpFrame returns an Ethernet ARP packet of op from src to dst, whose
+// sender is sha and sip
+func arpFrame(dst, src net.HardwareAddr, op uint16, sha net.HardwareAddr, sip, tip netip.Addr) []byte {
+	var b bytes.Buffer
+	b.Write(dst)
+	b.Write(src)
+	binary.Write(&b, binary.BigEndian, []uint16{unix.ETH_P_ARP, unix.ARPHRD_ETHER, unix.ETH_P_IP})
+	b.Write([]byte{6, 4})
+	binary.Write(&b, binary.BigEndian, op)
+	b.Write(sha)
+	b.Write(sip.AsSlice())
+	b.Write(make([]byte, 6))
+	b.Write(tip.AsSlice())
+	return b.Bytes()
+}
+
+// ndFrame returns a neighbor solicitation or advertisement of target from
+// src to dst, whose link-layer address option is lladdr. Advertisements
+// are unsolicited and override the entry.
+func ndFrame(dstMAC, srcMAC net.HardwareAddr, src, dst netip.Addr, typ uint8, target netip.Addr, lladdr net.HardwareAddr) []byte {
+	icmp := make([]byte, 32)
+	icmp[0] = typ
+	opt := byte(ndOptSourceLLAddr)
+	if typ == ndNeighborAdvertisement {
+		icmp[4] = 0x20
+		opt = ndOptTargetLLAddr
+	}
+	copy(icmp[8:], target.AsSlice())
+	icmp[24], icmp[25] = opt, 1
+	copy(icmp[26:], lladdr)
+	binary.BigEndian.PutUint16(icmp[2:], icmp6Checksum(src, dst, icmp))
+
+	var b bytes.Buffer
+	b.Write(dstMAC)
+	b.Write(srcMAC)
+	binary.Write(&b, binary.BigEndian, uint16(unix.ETH_P_IPV6))
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(icmp)))
+	ip[6] = unix.IPPROTO_ICMPV6
+	ip[7] = 255
+	copy(ip[8:], src.AsSlice())
+	copy(ip[24:], dst.AsSlice())
+	b.Write(ip)
+	b.Write(icmp)
+	return b.Bytes()
+}
+
+// icmp6Checksum returns the checksum of the ICMPv6 message from src to
+// dst, whose checksum field is zero
+func icmp6Checksum(src, dst netip.Addr, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src.AsSlice())
+	add(dst.AsSlice())
+	add(binary.BigEndian.AppendUint32(nil, uint32(len(msg))))
+	add([]byte{0, 0, 0, unix.IPPROTO_ICMPV6})
+	add(msg)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// TestNeighborTables sends the neighbor cases from a container's end of a
+// veth in a child in a network namespace of its own, and checks that the
+// host's neighbor table keeps the victim's entries
+func TestNeighborTables(t *testing.T) {
+	if os.Getenv(neighborTestEnv) != "" {
+		runNeighborTables(t)
+		return
+	}
+	runInNetns(t, neighborTestEnv)
+}
+
+// runNeighborTables runs TestNeighborTables as its child
+func runNeighborTables(t *testing.T) {
+	h := testNeighborHosts
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "host0", HardwareAddr: h.hostMAC}, PeerName: "ctr0", PeerHardwareAddr: h.mac}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	host, err := netlink.LinkByName("host0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctr, err := netlink.LinkByName("ctr0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The container end sends nothing of its own
+	if err := os.WriteFile("/proc/sys/net/ipv6/conf/ctr0/disable_ipv6", []byte("1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"10.0.0.1/24", "fd00::1/64"} {
+		addr := &netlink.Addr{IPNet: prefixIPNet(netip.MustParsePrefix(p)), Flags: unix.IFA_F_NODAD}
+		if err := netlink.AddrAdd(host, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range []netlink.Link{host, ctr} {
+		if err := netlink.LinkSetUp(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, victim := range []netip.Addr{h.victim4, h.victim6} {
+		err := netlink.NeighAdd(&netlink.Neigh{
+			LinkIndex:    host.Attrs().Index,
+			Family:       addrFamily(victim),
+			State:        netlink.NUD_STALE,
+			IP:           victim.AsSlice(),
+			HardwareAddr: h.victimMAC,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nm := &NetworkManager{containers: map[string]*ContainerNetwork{"test": {
+		ContainerID:   "test",
+		HostInterface: "host0",
+		HostIfindex:   host.Attrs().Index,
+		MAC:           h.mac.String(),
+		IPv4:          h.own4.String(),
+		IPv6:          h.own6.String(),
+	}}}
+	if err := nm.syncNeighbors(); err != nil {
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EOPNOTSUPP) {
+			t.Skipf("nftables unavailable: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	to := &unix.SockaddrLinklayer{Ifindex: ctr.Attrs().Index, Halen: 6}
+	copy(to.Addr[:], h.hostMAC)
+	spoofed := uint64(0)
+	for _, tt := range neighborCases {
+		if err := unix.Sendto(fd, tt.frame(h), 0, to); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.spoofed {
+			spoofed++
+		}
+	}
+	// The veth hands the frames to the host's backlog
+	time.Sleep(100 * time.Millisecond)
+
+	neighs, err := netlink.NeighList(host.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	learned := make(map[netip.Addr]string)
+	for _, n := range neighs {
+		addr, _ := netip.AddrFromSlice(n.IP)
+		learned[addr.Unmap()] = n.HardwareAddr.String()
+	}
+	for addr, want := range map[netip.Addr]net.HardwareAddr{
+		h.victim4: h.victimMAC, h.victim6: h.victimMAC,
+		// The requests the container may send teach the host its entries
+		h.own4: h.mac, h.own6: h.mac,
+	} {
+		if learned[addr] != want.String() {
+			t.Errorf("neighbor %s is at %q, want %s", addr, learned[addr], want)
+		}
+	}
+
+	nm.mu.Lock()
+	counts, err := nm.readNeighborCounters()
+	nm.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["test"] != spoofed {
+		t.Errorf("%d messages counted, want %d", counts["test"], spoofed)
+	}
+}
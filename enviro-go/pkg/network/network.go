@@ -8,111 +8,1617 @@
 package network
 
 import (
+	"context"
+	"crypto/ecdh"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/dns"
+	"github.com/1090mb/enviro/enviro-go/pkg/logging"
+	"github.com/1090mb/enviro/enviro-go/pkg/tracing"
 )
 
+// ErrUnsupportedPlatform is returned by datapath operations on platforms
+// without eBPF support. IPAM, state and configuration remain usable.
+var ErrUnsupportedPlatform = errors.New("network: datapath not supported on this platform")
+
+// ErrXDPInactive is returned for XDP operations while no XDP program is
+// attached
+var ErrXDPInactive = errors.New("network: XDP not attached")
+
+// ErrNotInitialized is returned for operations on the datapath of a
+// manager from NewDeferredNetworkManager before its Init
+var ErrNotInitialized = errors.New("network: not initialized")
+
+// ErrInvalidDatapath is returned by UpgradeDataPath for objects that can't
+// replace the running XDP router
+var ErrInvalidDatapath = errors.New("network: invalid datapath object")
+
+// ErrContainerNotFound is returned for containers the manager has no network for
+var ErrContainerNotFound = errors.New("network: container not found")
+
 // NetworkConfig holds eBPF networking configuration
 type NetworkConfig struct {
+	// Instance names the manager among others of the process, up to
+	// MaxInstanceLen lowercase letters and digits; the default instance
+	// has none. It scopes the host resources of the manager: its nftables
+	// tables are suffixed with it, its maps are pinned in a directory of
+	// PinPath named after it, and the host veths of its containers are
+	// named v<instance>-<hash> rather than veth<hash>, which also keeps
+	// the garbage collector of one instance off the veths of another.
+	// Without a Logger, the instance is added to the default logger's
+	// records.
+	//
+	// Some resources can't be shared however the instances are named, and
+	// Init fails with ErrInstanceInUse while another manager holds one:
+	// the instance name itself, the interface the XDP router attaches to,
+	// as it runs a single XDP program, the pin path, the overlay, whose
+	// devices and ports are the host's, and the physical functions of
+	// Devices. The container networks and service CIDRs of the instances
+	// must not overlap either, failing Init with ErrInvalidCIDR. Sysctls
+	// such as IP forwarding are the host's, set alike by every instance.
+	//
+	// The instance is fixed by the first config the manager is created
+	// with; later Init configs may leave it empty.
+	Instance string `json:"instance"`
 	// Enable XDP mode for maximum performance
-	EnableXDP bool
-	// Container network CIDR
-	CIDR string
-	// MTU for container network
-	MTU int
+	EnableXDP bool `json:"enable_xdp"`
+	// Interface is the host interface the XDP program attaches to
+	Interface string `json:"interface"`
+	// DatapathMode is the first mode tried for attaching the XDP program.
+	// Failing modes fall back to the next of native XDP, generic XDP and
+	// TC, and when none works to forwarding in userspace. Empty starts
+	// with native XDP; DatapathUserspace skips XDP.
+	DatapathMode DatapathMode `json:"datapath_mode"`
+	// PinPath pins the XDP maps in this bpffs directory when set, e.g.
+	// "/sys/fs/bpf/enviro", for inspection with bpftool. Connections and
+	// counters pinned by a previous run are carried over, so they survive
+	// a restart of the manager.
+	PinPath string `json:"pin_path"`
+	// KeepAttached leaves the XDP router attached when the manager closes,
+	// with its link pinned in PinPath, which is required. Containers keep
+	// their connectivity until the next manager takes the router over
+	// without detaching it.
+	KeepAttached bool `json:"keep_attached"`
+	// Container network CIDR, IPv4 or IPv6
+	CIDR string `json:"cidr"`
+	// Gateway address reserved in CIDR, defaults to the first host address
+	Gateway string `json:"gateway"`
+	// CIDR6 is an IPv6 container network, for dual-stack with an IPv4 CIDR
+	// or on its own for IPv6-only
+	CIDR6 string `json:"cidr6"`
+	// Gateway6 is the gateway reserved in CIDR6, like Gateway
+	Gateway6 string `json:"gateway6"`
+	// ServiceCIDR and ServiceCIDR6 are the IPv4 and IPv6 networks service
+	// VIPs are taken from, when set. They must not overlap the container
+	// networks or the host's.
+	ServiceCIDR  string `json:"service_cidr"`
+	ServiceCIDR6 string `json:"service_cidr6"`
+	// MTU of container interfaces. It must fit the uplink: the overlay's
+	// underlay less the encapsulation overhead, or else Interface, or else
+	// the interface of the default route. 0 detects the MTU of the uplink,
+	// falling back to the kernel default without one. Namespaces and
+	// containers can override it.
+	MTU int `json:"mtu"`
+	// LogThrottle limits per-packet and per-flow event logging
+	LogThrottle ThrottleConfig `json:"log_throttle"`
+	// DefaultPolicy applies to traffic matching no policy, defaults to allow
+	DefaultPolicy PolicyAction `json:"default_policy"`
+	// RejectRate is how many packets refused by PolicyReject are answered
+	// per second, on each CPU with XDP and by each rule without,
+	// DefaultRejectRate when zero. The rest are dropped, so rejects can't
+	// be used to reflect floods.
+	RejectRate int `json:"reject_rate"`
+	// Conntrack sizes the XDP connection tracking table
+	Conntrack ConntrackConfig `json:"conntrack"`
+	// DropAudit writes the packets the XDP router drops to a file
+	DropAudit DropAuditConfig `json:"drop_audit"`
+	// DNS resolves containers by name for other containers
+	DNS DNSConfig `json:"dns"`
+	// SNAT masquerades traffic from containers leaving the node
+	SNAT SNATConfig `json:"snat"`
+	// SYNProtection answers SYN floods to published ports and services
+	// with SYN cookies in the XDP router
+	SYNProtection SYNProtectionConfig `json:"syn_protection"`
+	// ProgramStats measures the time the XDP router's programs take
+	ProgramStats ProgramStatsConfig `json:"program_stats"`
+	// ConnectPolicy enforces policies as containers connect
+	ConnectPolicy ConnectPolicyConfig `json:"connect_policy"`
+	// SocketAcceleration splices TCP between containers of this node
+	SocketAcceleration SocketAccelerationConfig `json:"socket_acceleration"`
+	// ProxyRedirect lets containers steer their traffic to a proxy
+	ProxyRedirect ProxyRedirectConfig `json:"proxy_redirect"`
+	// Node joins a multi-node overlay when set
+	Node *NodeConfig `json:"node"`
+	// Topology is where this node runs, for services preferring nearby
+	// backends
+	Topology NodeTopology `json:"topology"`
+	// NodePorts is the range services exposed on every node take their
+	// port from, DefaultNodePorts when zero. The nodes of a cluster share
+	// the range, as the leader picks the ports.
+	NodePorts PortRange `json:"node_ports"`
+	// Logger receives network logs, defaults to slog.Default()
+	Logger *slog.Logger `json:"-"`
+	// TracerProvider records the spans of creating and deleting container
+	// networks, defaults to otel.GetTracerProvider()
+	TracerProvider trace.TracerProvider `json:"-"`
+	// GC collects the network resources of unknown containers
+	GC GCConfig `json:"gc"`
+	// Leases expire the addresses of containers that are gone
+	Leases LeaseConfig `json:"leases"`
+	// Analytics ranks the flows to containers by their traffic
+	Analytics AnalyticsConfig `json:"analytics"`
+	// State persists container networks across restarts when set
+	State StateStore `json:"-"`
+	// IPAM chooses where container addresses come from
+	IPAM IPAMConfig `json:"ipam"`
+	// Rootless connects containers with slirp4netns, for running without
+	// CAP_NET_ADMIN
+	Rootless RootlessConfig `json:"rootless"`
+	// Devices are handed to containers attached directly, with SR-IOV or
+	// macvlan
+	Devices DeviceConfig `json:"devices"`
+	// WarmPool keeps veth pairs ready for containers to take
+	WarmPool WarmPoolConfig `json:"warm_pool"`
+	// Readiness configures VerifyContainerNetwork
+	Readiness ReadinessConfig `json:"readiness"`
 }
 
 // NetworkManager handles eBPF-based container networking
 type NetworkManager struct {
+	// initMu serializes Init and Close, and initialized is set once Init
+	// succeeded
+	initMu      sync.Mutex
+	initialized atomic.Bool
+	// instance is NetworkConfig.Instance, fixed at creation
+	instance string
+	// mu serializes container create and delete
+	mu     sync.Mutex
 	config NetworkConfig
-	// TODO: Add eBPF map handles
-	// ebpfMaps map[string]*ebpf.Map
+	log    *slog.Logger
+	tracer trace.Tracer
+	// events throttles logs originating from datapath events
+	events *LogThrottle
+	// pools allocate container addresses, one per family with IPv4 first
+	pools []*ipAllocator
+	// ipam is the backend of the pools it manages, nil when all allocate
+	// their addresses themselves
+	ipam IPAM
+	// containers holds the network of each container, keyed by containerID
+	containers map[string]*ContainerNetwork
+	// policies holds network policies by name; policyOrder is apply order
+	policies    map[string]NetworkPolicy
+	policyOrder []string
+	// programmed is the policy rule set currently in the datapath, and
+	// policyOwners the policy each of its rules comes from
+	programmed   map[policyRule]PolicyAction
+	policyOwners map[policyRule]string
+	// policyCounters carries the counters of replaced kernel policy
+	// tables, by container ID
+	policyCounters map[string]policyCounts
+	// serviceCounters carries the connection counters of replaced service
+	// tables, by service name and backend locality
+	serviceCounters map[servicePort]map[Locality]uint64
+	// neighborCounters carries the counters of replaced neighbor tables,
+	// by container ID
+	neighborCounters map[string]uint64
+	// forwarding is true while port forward rules are installed
+	forwarding bool
+	// snat allocates the SNAT port slices, nil unless SNAT.SliceSize is
+	// set; snatExhausted counts the containers that found none free
+	snat          *snatAllocator
+	snatExhausted atomic.Uint64
+	// prioritizing is true while QoS classes are programmed
+	prioritizing bool
+	// services holds the load-balanced services by name
+	services map[string]Service
+	// namespaces holds the namespaces by name, including the default one
+	namespaces map[string]Namespace
+	// names backs DNS lookups; dns serves it when enabled
+	names *nameTable
+	dns   *dns.Server
+	// peers holds the overlay peers by name; overlayIndex is the ifindex
+	// of the VXLAN or WireGuard device
+	peers        map[string]Peer
+	overlayIndex int
+	// nodeRoutes holds the prefix routes by node, see UpdateNodeRoutes
+	nodeRoutes map[string][]PrefixRoute
+	// wgKey is the node's WireGuard private key with encryption
+	wgKey *ecdh.PrivateKey
+	// xdp is the attached XDP program, nil in non-XDP mode
+	xdp *xdpProgram
+	// userspace forwards the traffic from the uplink in place of xdp when
+	// it couldn't be attached, nil otherwise
+	userspace *userspaceForwarder
+	caps      Capabilities
+	// xsks holds the AF_XDP sockets by owning container ID
+	xsks map[string]*afxdpSocket
+	// drops aggregates the drop events of the XDP router
+	drops *dropMonitor
+	// rootless is true when containers are connected by the slirp4netns
+	// processes in slirps, keyed by container ID, see RootlessConfig
+	rootless bool
+	slirps   map[string]*slirpProcess
+	// reservations holds the addresses reserved for containers, by
+	// container ID, whether or not they have a network
+	reservations map[string]Reservation
+	// flows samples the tracked flows for TopFlows, nil unless
+	// Analytics.Enable is set
+	flows *flowAnalytics
+	// programStats collects the run counts of the router's programs, nil
+	// unless ProgramStats.Enable is set
+	programStats *programSampler
+	// extensions are the registered datapath extensions in registration
+	// order
+	extensions []*extensionProgram
+	// cgroups are the programs of connect-time policy and socket
+	// acceleration attached to the cgroups of containers, by container ID
+	cgroups map[string]*cgroupAttachment
+	// gcStop ends the collection started by startGC, which closes gcDone
+	// once it returned
+	gcStop chan struct{}
+	gcDone chan struct{}
+	// leases holds when the lease of each container was last renewed, by
+	// container ID, while LeaseConfig.TTL is set
+	leases map[string]time.Time
+	// leaseStop ends the reaper started by startLeases, which closes
+	// leaseDone once it returned
+	leaseStop chan struct{}
+	leaseDone chan struct{}
+	// ipamStop ends the reconciliation started by startIPAMReconcile,
+	// which closes ipamDone once it returned
+	ipamStop chan struct{}
+	ipamDone chan struct{}
+	// warm holds the warm attachments ready to be taken, oldest first,
+	// with their peers in the parking namespace; warmSeq numbers them and
+	// warmClaims and warmMisses count the creates that took one and the
+	// eligible ones that found none, see WarmPoolStatus
+	warm       []*warmAttachment
+	warmSeq    uint64
+	parking    *parkingNetns
+	warmClaims uint64
+	warmMisses uint64
+	// warmStop ends the replenishing started by startWarmPool, which
+	// closes warmDone once it returned
+	warmStop chan struct{}
+	warmDone chan struct{}
+	// backendHealth holds the outcome of the health checks of service
+	// backends, see checkServiceHealth
+	backendHealth map[backendCheck]*backendHealth
+	// healthStop ends the checker started by startServiceHealth, which
+	// closes healthDone once it returned
+	healthStop chan struct{}
+	healthDone chan struct{}
+	// overlaps are the host networks overlapping the configuration, see
+	// CIDROverlaps; overlapStop ends the watcher started by
+	// startOverlapWatch, which closes overlapDone
+	overlaps    []CIDROverlap
+	overlapStop chan struct{}
+	overlapDone chan struct{}
+	// setups keeps the timings of the creates for SetupLatency, across
+	// rebuilds of the datapath
+	setups *setupRecorder
+}
+
+// DatapathMode is how the XDP router is attached to its interface
+type DatapathMode string
+
+const (
+	// DatapathXDPNative runs the router in the interface driver
+	DatapathXDPNative DatapathMode = "native"
+	// DatapathXDPGeneric runs it once the kernel has allocated the packet,
+	// on any interface
+	DatapathXDPGeneric DatapathMode = "generic"
+	// DatapathTC runs it as a TC classifier on clsact ingress, for kernels
+	// without XDP or interfaces another XDP program is attached to
+	DatapathTC DatapathMode = "tc"
+	// DatapathUserspace forwards the IPv4 traffic from the interface to
+	// the containers in userspace, through packet sockets, as the manager
+	// does when no other mode works. It is much slower than the router
+	// but needs neither BPF nor a recent kernel.
+	DatapathUserspace DatapathMode = "userspace"
+)
+
+// datapathModes are the attach modes in the order they are tried
+var datapathModes = []DatapathMode{DatapathXDPNative, DatapathXDPGeneric, DatapathTC}
+
+// Capabilities reports which datapath features are active
+type Capabilities struct {
+	// XDP is true when the XDP program is attached
+	XDP bool
+	// XDPMode is how the program is attached while XDP is true
+	XDPMode DatapathMode
+	// XDPError explains why XDP is inactive although it was requested
+	XDPError string
+	// Userspace is true when the userspace forwarder stands in for the XDP
+	// router, see DatapathUserspace
+	Userspace bool
+	// Rootless is true when containers are connected with slirp4netns
+	Rootless bool
+	// SYNProtection is true when the XDP router answers SYN floods with
+	// cookies, see SYNProtectionConfig
+	SYNProtection bool
+	// SourceCheck is true when the router drops what containers send from
+	// a MAC or address not theirs, see ContainerNetworkSpec.AllowedSources
+	SourceCheck bool
+	// ConnectPolicy is true when policies are enforced as containers
+	// connect, see ConnectPolicyConfig
+	ConnectPolicy bool
+	// SocketAcceleration is true when TCP between containers of this node
+	// is spliced through a sockhash, see SocketAccelerationConfig
+	SocketAcceleration bool
+	// ProxyRedirect is true when containers can steer their traffic to a
+	// proxy, see ProxyRedirectConfig
+	ProxyRedirect bool
 }
 
-// NewNetworkManager creates a new network manager
+// NewNetworkManager creates a network manager and sets up its datapath
 func NewNetworkManager(config NetworkConfig) (*NetworkManager, error) {
-	log.Printf("Initializing network manager with CIDR: %s", config.CIDR)
+	nm := NewDeferredNetworkManager(config)
+	if err := nm.Init(config); err != nil {
+		return nil, err
+	}
+	return nm, nil
+}
+
+// NewDeferredNetworkManager creates a network manager whose datapath Init
+// sets up later, e.g. once the config arrived from a remote source. Only
+// the Instance, Logger and TracerProvider of config are used until then. The
+// manager holds no containers before Init, and creating one fails with
+// ErrNotInitialized.
+func NewDeferredNetworkManager(config NetworkConfig) *NetworkManager {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+		if config.Instance != "" {
+			logger = logger.With("instance", config.Instance)
+		}
+	}
+	tracerProvider := config.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	nm := &NetworkManager{
+		instance: config.Instance,
+		log:      logger,
+		tracer:   tracerProvider.Tracer(tracerName),
+		setups:   newSetupRecorder(),
+	}
+	nm.reset(NetworkConfig{}, nil)
+	return nm
+}
+
+// Init sets up the datapath for config. Called again, e.g. after a config
+// change the running datapath can't take, it tears the datapath down and
+// sets it up again for the new config, re-adopting the container networks
+// saved in NetworkConfig.State; without a State they are forgotten. A
+// failed Init leaves the manager uninitialized.
+func (nm *NetworkManager) Init(config NetworkConfig) error {
+	nm.initMu.Lock()
+	defer nm.initMu.Unlock()
+
+	if nm.initialized.Load() {
+		nm.log.Info("Rebuilding datapath for the new network config")
+		nm.initialized.Store(false)
+		if err := nm.teardown(); err != nil {
+			nm.log.Warn("Failed to tear down datapath", "error", err)
+		}
+		// An external backend is the caller's, and kept
+		nm.dropIPAM()
+	}
+	var pools []*ipAllocator
+	var err error
+	switch config.Instance {
+	case "":
+		config.Instance = nm.instance
+	case nm.instance:
+	default:
+		err = fmt.Errorf("%w: instance %q of a manager created as %s", ErrInvalidConfig, config.Instance, instanceLabel(nm.instance))
+	}
+	if err == nil {
+		config, pools, err = prepareConfig(config, nm.log)
+	}
+	if err == nil {
+		err = nm.claim(config)
+	}
+	nm.mu.Lock()
+	if err == nil {
+		nm.reset(config, pools)
+		if err = nm.setup(); err != nil {
+			nm.release()
+		}
+	}
+	if err != nil {
+		// Forget what a previous Init left
+		nm.reset(NetworkConfig{}, nil)
+	}
+	nm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	nm.startGC()
+	nm.startServiceHealth()
+	nm.startOverlapWatch()
+	if config.Leases.TTL > 0 {
+		nm.startLeases()
+	}
+	if config.IPAM.Reconcile.Mode != "" {
+		nm.startIPAMReconcile()
+	}
+	if config.WarmPool.Size > 0 && !nm.rootless {
+		nm.startWarmPool()
+	}
+	if config.Analytics.Enable {
+		nm.startAnalytics()
+	}
+	if nm.programStats != nil {
+		nm.startProgramStats()
+	}
+	nm.initialized.Store(true)
+	return nil
+}
+
+// Initialized reports whether Init set up the datapath
+func (nm *NetworkManager) Initialized() bool {
+	return nm.initialized.Load()
+}
+
+// prepareConfig validates config and applies its defaults, returning it
+// with the address pools it configures
+func prepareConfig(config NetworkConfig, logger *slog.Logger) (NetworkConfig, []*ipAllocator, error) {
+	logger.Info("Initializing network manager", "cidr", config.CIDR, "cidr6", config.CIDR6)
+
+	if err := config.Validate(); err != nil {
+		return config, nil, err
+	}
+	if config.Node != nil {
+		node := *config.Node
+		if node.VNI == 0 {
+			node.VNI = defaultVNI
+		}
+		if node.Port == 0 {
+			node.Port = defaultVXLANPort
+		}
+		if node.WireGuard != nil {
+			wg := *node.WireGuard
+			if wg.Port == 0 {
+				wg.Port = defaultWireGuardPort
+			}
+			node.WireGuard = &wg
+		}
+		config.Node = &node
+	}
+
+	pools, err := newAddressPools(config)
+	if err != nil {
+		return config, nil, err
+	}
+
+	if config.LogThrottle == (ThrottleConfig{}) {
+		config.LogThrottle = DefaultThrottleConfig()
+	}
+	config.Conntrack = config.Conntrack.withDefaults()
+	if config.DefaultPolicy == "" {
+		config.DefaultPolicy = PolicyAllow
+	}
+	if config.RejectRate == 0 {
+		config.RejectRate = DefaultRejectRate
+	}
+	if config.GC.Interval == 0 {
+		config.GC.Interval = DefaultGCInterval
+	}
+	if config.Leases.Interval == 0 {
+		config.Leases.Interval = DefaultLeaseInterval
+	}
+	if config.IPAM.Reconcile.Interval == 0 {
+		config.IPAM.Reconcile.Interval = DefaultIPAMReconcileInterval
+	}
+	if config.WarmPool.Interval == 0 {
+		config.WarmPool.Interval = DefaultWarmInterval
+	}
+	config.WarmPool.Namespaces = slices.Clone(config.WarmPool.Namespaces)
+	if config.NodePorts == (PortRange{}) {
+		config.NodePorts = DefaultNodePorts
+	}
+	if config.IPAM.Backend == "" {
+		config.IPAM.Backend = IPAMHostLocal
+	}
+	if config.SNAT.Enable {
+		config.SNAT = config.SNAT.withDefaults()
+	}
+	if config.SYNProtection.Enable {
+		config.SYNProtection = config.SYNProtection.withDefaults()
+	}
+	if config.ProgramStats.Enable {
+		config.ProgramStats = config.ProgramStats.withDefaults()
+	}
+	config.Devices.PhysicalFunctions = slices.Clone(config.Devices.PhysicalFunctions)
+	config.Devices.MacvlanParent = config.Devices.macvlanParent(config)
+	return config, pools, nil
+}
+
+// reset replaces the state of the manager with that of a new one for
+// config. Callers must hold nm.mu unless the manager is new.
+func (nm *NetworkManager) reset(config NetworkConfig, pools []*ipAllocator) {
+	nm.config = config
+	nm.events = newLogThrottle(config.LogThrottle, nm.log)
+	nm.pools = pools
+	nm.ipam = nil
+	nm.containers = make(map[string]*ContainerNetwork)
+	nm.policies = make(map[string]NetworkPolicy)
+	nm.policyOrder = nil
+	nm.programmed = make(map[policyRule]PolicyAction)
+	nm.policyOwners = nil
+	nm.policyCounters = nil
+	nm.serviceCounters = nil
+	nm.neighborCounters = nil
+	nm.forwarding = false
+	nm.snat = nil
+	if config.SNAT.Enable && config.SNAT.SliceSize > 0 {
+		nm.snat = newSNATAllocator(config.SNAT)
+	}
+	nm.prioritizing = false
+	nm.services = make(map[string]Service)
+	nm.namespaces = map[string]Namespace{DefaultNamespace: {Name: DefaultNamespace}}
+	nm.names = newNameTable(config.DNS)
+	nm.dns = nil
+	nm.peers = make(map[string]Peer)
+	nm.overlayIndex = 0
+	nm.nodeRoutes = make(map[string][]PrefixRoute)
+	nm.wgKey = nil
+	nm.xdp = nil
+	nm.caps = Capabilities{}
+	nm.xsks = make(map[string]*afxdpSocket)
+	nm.drops = newDropMonitor(config.DropAudit, nm.events)
+	nm.rootless = false
+	nm.slirps = make(map[string]*slirpProcess)
+	nm.reservations = make(map[string]Reservation)
+	nm.flows = nil
+	if config.Analytics.Enable {
+		nm.flows = newFlowAnalytics(config.Analytics.withDefaults())
+	}
+	nm.programStats = nil
+	nm.extensions = nil
+	nm.cgroups = nil
+	nm.leases = make(map[string]time.Time)
+	nm.warm = nil
+	nm.warmClaims, nm.warmMisses = 0, 0
+	nm.backendHealth = make(map[backendCheck]*backendHealth)
+	nm.overlaps = nil
+}
+
+// setup programs the datapath for the config of the manager and restores
+// the saved state, undoing what it did on failure. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) setup() error {
+	config := nm.config
+	nm.logKernel()
+	if err := nm.initDatapath(); err != nil {
+		return fmt.Errorf("failed to initialize datapath: %w", err)
+	}
+	if config.Node != nil {
+		if err := nm.initOverlay(); err != nil {
+			nm.closeDatapath()
+			return fmt.Errorf("failed to initialize overlay: %w", err)
+		}
+	}
+	if err := nm.initMTU(); err != nil {
+		nm.closeDatapath()
+		return err
+	}
+	var err error
+	if nm.ipam, err = newIPAM(config, nm.log); err != nil {
+		nm.closeDatapath()
+		return err
+	}
+	if config.State != nil {
+		if err := nm.restoreState(); err != nil {
+			nm.closeDatapath()
+			nm.dropIPAM()
+			return err
+		}
+	}
+	if err := nm.syncSNAT(); err != nil {
+		nm.closeDatapath()
+		nm.dropIPAM()
+		return fmt.Errorf("failed to program SNAT: %w", err)
+	}
+	if err := nm.syncNeighbors(); err != nil {
+		nm.log.Warn("Failed to program neighbor tables, containers may announce any address", "error", err)
+	}
+	if config.DNS.Enable {
+		if err := nm.startDNS(); err != nil {
+			nm.closeDatapath()
+			nm.dropIPAM()
+			return err
+		}
+	}
+	if config.ProgramStats.Enable && nm.xdp != nil {
+		nm.programStats = &programSampler{config: config.ProgramStats}
+	}
+	return nil
+}
+
+// Capabilities returns the datapath features that are actually active
+func (nm *NetworkManager) Capabilities() Capabilities {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.caps
+}
+
+// Config returns the effective configuration: defaults applied, gateways
+// resolved and the MTU as set for the overlay
+func (nm *NetworkManager) Config() NetworkConfig {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cfg := nm.config
+	for _, pool := range nm.pools {
+		if pool.prefix.Addr().Is4() {
+			cfg.Gateway = pool.gateway.String()
+		} else {
+			cfg.Gateway6 = pool.gateway.String()
+		}
+	}
+	if cfg.Node != nil {
+		node := *cfg.Node
+		node.Peers = nm.sortedPeers()
+		cfg.Node = &node
+	}
+	return cfg
+}
+
+// ReloadXDP detaches the XDP router and attaches it again, e.g. after the
+// interface was recreated. The loaded program and its maps are kept, so
+// container routes, policies and counters survive.
+func (nm *NetworkManager) ReloadXDP(ctx context.Context) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.xdp == nil {
+		if nm.caps.XDPError != "" {
+			return fmt.Errorf("%w: %s", ErrXDPInactive, nm.caps.XDPError)
+		}
+		return ErrXDPInactive
+	}
+	if err := nm.reattachDatapath(); err != nil {
+		return fmt.Errorf("failed to reload XDP on %s: %w", nm.config.Interface, err)
+	}
+	nm.logger(ctx).Info("Reloaded XDP container router", "interface", nm.config.Interface, "mode", nm.caps.XDPMode)
+	return nil
+}
+
+// UpgradeDataPath replaces the attached XDP router with the one in the
+// eBPF object at objPath, without a moment in which no program is
+// attached. The new program takes over the maps in use, which must be
+// compatible, so routes, policies and counters are kept. Errors leave the
+// old program attached.
+func (nm *NetworkManager) UpgradeDataPath(ctx context.Context, objPath string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.xdp == nil || !nm.caps.XDP {
+		if nm.caps.XDPError != "" {
+			return fmt.Errorf("%w: %s", ErrXDPInactive, nm.caps.XDPError)
+		}
+		return ErrXDPInactive
+	}
+	if err := nm.upgradeDatapath(objPath); err != nil {
+		return fmt.Errorf("failed to upgrade XDP router from %s: %w", objPath, err)
+	}
+	nm.logger(ctx).Info("Upgraded XDP container router", "object", objPath, "interface", nm.config.Interface)
+	return nil
+}
+
+// Close stops the DNS server, closes the AF_XDP sockets and detaches the
+// eBPF programs, unless NetworkConfig.KeepAttached is set. Container
+// networks are left in place.
+func (nm *NetworkManager) Close() error {
+	nm.initMu.Lock()
+	defer nm.initMu.Unlock()
+	nm.initialized.Store(false)
+	err := nm.teardown()
+	var ipamErr error
+	if nm.ipam != nil {
+		ipamErr = nm.ipam.Close()
+	}
+	return errors.Join(err, ipamErr)
+}
+
+// teardown stops what Init started but the IPAM backend. Callers must
+// hold nm.initMu.
+func (nm *NetworkManager) teardown() error {
+	nm.stopGC()
+	nm.stopServiceHealth()
+	nm.stopOverlapWatch()
+	nm.stopLeases()
+	nm.stopIPAMReconcile()
+	nm.stopWarmPool()
+	nm.stopAnalytics()
+	nm.stopProgramStats()
+	var dnsErr error
+	if nm.dns != nil {
+		dnsErr = nm.dns.Close()
+	}
+	nm.mu.Lock()
+	for owner := range nm.xsks {
+		if err := nm.detachAFXDP(nm.log, owner); err != nil {
+			nm.log.Error("Failed to detach AF_XDP socket", "owner", owner, "error", err)
+		}
+	}
+	nm.mu.Unlock()
+	datapathErr := nm.closeDatapath()
+	nm.release()
+	return errors.Join(dnsErr, datapathErr, nm.drops.close())
+}
+
+// SetLogThrottle updates datapath event log throttling at runtime
+func (nm *NetworkManager) SetLogThrottle(cfg ThrottleConfig) {
+	nm.events.SetConfig(cfg)
+}
+
+// ContainerNetworkSpec describes the network to create for a container
+type ContainerNetworkSpec struct {
+	ContainerID string
+	// Name makes the container resolvable as <name>.<domain> when set. It
+	// must be a lowercase DNS label, unique among containers.
+	Name string
+	// NetnsPath is the container's network namespace, e.g. /proc/<pid>/ns/net
+	NetnsPath string
+	// Pid locates the namespace when NetnsPath is empty
+	Pid int
+	// MAC is assigned to the container interface when set, see ParseMAC.
+	// By default it is the reserved one, or derived from the container's
+	// addresses.
+	MAC string
+	// RequestedIP and RequestedIP6 are given to the container instead of
+	// free addresses of the pools when set. They must be host addresses of
+	// the pools, in the namespace's range if it has one, that no other
+	// container holds or reserved. Requesting an address or a MAC reserves
+	// them for the container, see Reservation; addresses it doesn't
+	// request are then the reserved ones.
+	RequestedIP  string
+	RequestedIP6 string
+	// MTU overrides that of the namespace and NetworkConfig.MTU for this
+	// container when set. It must be between MinMTU and what the uplink
+	// carries, see SetMTU.
+	MTU int
+	// Namespace is the namespace the container joins, DefaultNamespace when
+	// empty. Its addresses come from the namespace's ranges, if any.
+	Namespace string
+	// IngressBps and EgressBps limit the container's bandwidth from the
+	// start, see SetBandwidthLimit. Namespaces with a bandwidth quota
+	// require both.
+	IngressBps uint64
+	EgressBps  uint64
+	// Attachment is how the container is connected, AttachmentVeth when
+	// empty. Directly attached containers can't have bandwidth limits.
+	Attachment Attachment
+	// DNSTTL overrides the TTL of the container's records when set, up to
+	// MaxDNSTTL, see DNSConfig
+	DNSTTL uint32
+	// AllowedSources are prefixes the container may send from besides its
+	// own addresses, e.g. VIPs it holds or networks it routes. The XDP
+	// router drops what a container sends from any other address or MAC.
+	AllowedSources []string
+	// Capabilities are the network privileges granted to the container
+	Capabilities []NetworkCapability
+	// DisableSourceCheck lets the container send from any address and
+	// MAC. It requires CapabilitySpoofSource.
+	DisableSourceCheck bool
+	// CgroupPath is the cgroup v2 directory of the container's processes,
+	// whose connections are checked against the policies as they are
+	// opened when ConnectPolicyConfig is enabled
+	CgroupPath string
+	// RequiredDestinations are addresses the container must be allowed to
+	// reach before VerifyContainerNetwork finds it ready
+	RequiredDestinations []Destination
+}
+
+// ContainerNetwork describes a container's configured network
+type ContainerNetwork struct {
+	ContainerID string `json:"container_id"`
+	// Name is the DNS name of the container, if any
+	Name string `json:"name,omitempty"`
+	// Namespace is the namespace the container belongs to
+	Namespace string `json:"namespace,omitempty"`
+	// IPv4 and IPv6 are the container addresses; one is empty on a
+	// single-stack network
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+	// MAC is the address of the container interface, which the datapath
+	// addresses frames to
+	MAC string `json:"mac,omitempty"`
+	// MTU is the container's own MTU; 0 follows that of its namespace or
+	// NetworkConfig.MTU
+	MTU int `json:"mtu,omitempty"`
+	// DNSTTL is the TTL of the container's records, 0 following its pool
+	DNSTTL uint32 `json:"dns_ttl,omitempty"`
+	// HostInterface is the host-side veth name, for attaching eBPF
+	// programs. It is empty for directly attached containers.
+	HostInterface string `json:"host_interface"`
+	// HostIfindex is the ifindex of HostInterface
+	HostIfindex int `json:"host_ifindex"`
+	// NetnsPath is the container's network namespace
+	NetnsPath string `json:"netns_path,omitempty"`
+	// Ports are the host ports forwarded to the container
+	Ports []PortForward `json:"ports,omitempty"`
+	// IngressBps and EgressBps limit traffic to and from the container in
+	// bits per second, 0 meaning unlimited
+	IngressBps uint64 `json:"ingress_bps,omitempty"`
+	EgressBps  uint64 `json:"egress_bps,omitempty"`
+	// QoSClass prioritizes the container's traffic leaving the node
+	QoSClass QoSClass `json:"qos_class,omitempty"`
+	// Mirrors copy the container's traffic to other containers
+	Mirrors []Mirror `json:"mirrors,omitempty"`
+	// Proxy steers the container's traffic to its proxy, see
+	// SetProxyRedirect
+	Proxy *ProxyConfig `json:"proxy,omitempty"`
+	// SNATPorts is the container's slice of the SNAT port range, when
+	// SNATConfig.SliceSize is set
+	SNATPorts *PortRange `json:"snat_ports,omitempty"`
+	// Intent is set while a create or delete is changing the datapath, so
+	// a restart after a crash knows to roll it back or finish it
+	Intent Intent `json:"intent,omitempty"`
+	// Rootless is set for containers connected with slirp4netns, which
+	// have no host interface
+	Rootless bool `json:"rootless,omitempty"`
+	// Attachment is how the container is connected; empty is a veth, or
+	// slirp4netns's tap device when Rootless
+	Attachment Attachment `json:"attachment,omitempty"`
+	// Device is the VF or macvlan of a directly attached container
+	Device *DeviceAttachment `json:"device,omitempty"`
+	// AllowedSources are the prefixes the container may send from besides
+	// its addresses, and SourceCheckDisabled is set when it may send from
+	// any, see ContainerNetworkSpec
+	AllowedSources      []string `json:"allowed_sources,omitempty"`
+	SourceCheckDisabled bool     `json:"source_check_disabled,omitempty"`
+	// CgroupPath is the cgroup of the container's processes, see
+	// ContainerNetworkSpec
+	CgroupPath string `json:"cgroup_path,omitempty"`
+	// RequiredDestinations are checked by VerifyContainerNetwork, see
+	// ContainerNetworkSpec
+	RequiredDestinations []Destination `json:"required_destinations,omitempty"`
+	// Timing is how long creating the network took, only set on the
+	// network CreateContainerNetwork returns for a new container
+	Timing *SetupTiming `json:"-"`
+	// Readiness is the verification of a new container network when
+	// ReadinessConfig.VerifyOnCreate is set, like Timing
+	Readiness *ReadinessReport `json:"-"`
+
+	// fault is the fault injected with SetContainerFault, if any,
+	// faultQdisc whether a netem qdisc on the host veth applies it and
+	// faultDelayed whether the router delays the traffic to the container
+	// instead, see delayFault. Faults aren't persisted.
+	fault        *ContainerFault
+	faultQdisc   bool
+	faultDelayed bool
+	// pacedIngress is set while the router paces the traffic to the
+	// container rather than tbf shaping it, and pacedEgress is the
+	// ifindex of the container's eth0 while it paces the traffic from
+	// it, see limitIngress and limitEgress. Both are found anew on
+	// restore.
+	pacedIngress bool
+	pacedEgress  int
+	// draining is set once DrainContainerNetwork rejects new connections
+	// to the container, until it is deleted
+	draining bool
+	// captures counts the CaptureTraffic calls running on the container
+	captures int
+	// warm is the warm attachment the container takes while it is
+	// created, if any
+	warm *warmAttachment
+}
+
+// Intent is an in-progress change to a container network
+type Intent string
+
+const (
+	// IntentCreate is rolled back when found on restart
+	IntentCreate Intent = "create"
+	// IntentDelete is finished when found on restart
+	IntentDelete Intent = "delete"
+)
+
+// clone returns a copy of cn that shares no memory with it
+func (cn *ContainerNetwork) clone() *ContainerNetwork {
+	out := *cn
+	out.Ports = append([]PortForward(nil), cn.Ports...)
+	out.Mirrors = append([]Mirror(nil), cn.Mirrors...)
+	if cn.Proxy != nil {
+		proxy := *cn.Proxy
+		proxy.Redirects = append([]ProxyRedirect(nil), cn.Proxy.Redirects...)
+		if cn.Proxy.ExemptUID != nil {
+			uid := *cn.Proxy.ExemptUID
+			proxy.ExemptUID = &uid
+		}
+		out.Proxy = &proxy
+	}
+	out.AllowedSources = append([]string(nil), cn.AllowedSources...)
+	out.RequiredDestinations = append([]Destination(nil), cn.RequiredDestinations...)
+	if cn.Device != nil {
+		device := *cn.Device
+		out.Device = &device
+	}
+	if cn.SNATPorts != nil {
+		ports := *cn.SNATPorts
+		out.SNATPorts = &ports
+	}
+	return &out
+}
 
-	// TODO: Initialize eBPF programs
-	// In production, this would:
-	// 1. Load eBPF programs from embedded bytecode
-	// 2. Attach XDP programs to network interfaces
-	// 3. Create eBPF maps for routing tables
+// CreateContainerNetwork sets up networking for a new container. Calling it
+// again for the same container returns the existing network. Log lines use
+// the logger carried by ctx, if any, and the span of each step is a child
+// of the span in ctx. With ReadinessConfig.VerifyOnCreate, new networks
+// are verified with VerifyContainerNetwork before they are returned.
+func (nm *NetworkManager) CreateContainerNetwork(ctx context.Context, spec ContainerNetworkSpec) (*ContainerNetwork, error) {
+	ctx, span := nm.tracer.Start(ctx, "CreateContainerNetwork",
+		trace.WithAttributes(attribute.String("container.id", spec.ContainerID)))
+	cn, err := nm.createContainerNetwork(ctx, spec)
+	if err == nil && cn.Timing != nil && nm.config.Readiness.VerifyOnCreate {
+		cn, err = nm.verifyCreated(ctx, cn)
+	}
+	tracing.End(span, err)
+	return cn, err
+}
+
+// verifyCreated verifies the network just created for cn, deleting it
+// when it doesn't become ready
+func (nm *NetworkManager) verifyCreated(ctx context.Context, cn *ContainerNetwork) (*ContainerNetwork, error) {
+	report, err := nm.VerifyContainerNetwork(ctx, cn.ContainerID)
+	if err != nil {
+		nm.logger(ctx).Warn("Deleting container network that isn't ready", "container_id", cn.ContainerID, "error", err)
+		if delErr := nm.DeleteContainerNetwork(context.WithoutCancel(ctx), cn.ContainerID); delErr != nil {
+			err = errors.Join(err, delErr)
+		}
+		return nil, err
+	}
+	cn.Readiness = &report
+	return cn, nil
+}
+
+func (nm *NetworkManager) createContainerNetwork(ctx context.Context, spec ContainerNetworkSpec) (*ContainerNetwork, error) {
+	start := time.Now()
+	if !nm.initialized.Load() {
+		return nil, ErrNotInitialized
+	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if cn, ok := nm.containers[spec.ContainerID]; ok {
+		return cn.clone(), nil
+	}
+	if isWarmID(spec.ContainerID) {
+		return nil, fmt.Errorf("%w: container ID %q is reserved for warm attachments", ErrInvalidConfig, spec.ContainerID)
+	}
+	if err := ValidateName(spec.Name); err != nil {
+		return nil, err
+	}
+	if spec.Name != "" && nm.nameInUse(spec.Name, spec.ContainerID) {
+		return nil, fmt.Errorf("%w: %s", ErrNameInUse, spec.Name)
+	}
+	if spec.DNSTTL > MaxDNSTTL {
+		return nil, fmt.Errorf("%w: DNS TTL %d is longer than %d", ErrInvalidConfig, spec.DNSTTL, MaxDNSTTL)
+	}
+	if err := validateSources(spec); err != nil {
+		return nil, err
+	}
+	if spec.CgroupPath != "" && !filepath.IsAbs(spec.CgroupPath) {
+		return nil, fmt.Errorf("%w: cgroup path %q is not absolute", ErrInvalidConfig, spec.CgroupPath)
+	}
+	for _, d := range spec.RequiredDestinations {
+		if err := d.validate(); err != nil {
+			return nil, err
+		}
+	}
+	mac, err := ParseMAC(spec.MAC)
+	if err != nil {
+		return nil, err
+	}
+	if spec.MTU != 0 {
+		if err := nm.checkMTU(spec.MTU); err != nil {
+			return nil, err
+		}
+	}
+	spec.Namespace = namespaceOf(spec.Namespace)
+	if _, ok := nm.namespaces[spec.Namespace]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNamespaceNotFound, spec.Namespace)
+	}
+	if err := nm.checkQuota(spec.Namespace, spec.ContainerID, len(nm.pools), spec.IngressBps, spec.EgressBps); err != nil {
+		return nil, err
+	}
+	if spec.IngressBps > 0 || spec.EgressBps > 0 {
+		if err := nm.checkPrivileged("bandwidth limits"); err != nil {
+			return nil, err
+		}
+	}
+	if err := nm.checkAttachmentSpec(spec); err != nil {
+		return nil, err
+	}
+	res, err := nm.reservationFor(spec, mac)
+	if err != nil {
+		return nil, err
+	}
+
+	hostIf := hostVethName(nm.instance, spec.ContainerID)
+	if nm.rootless || spec.Attachment.direct() {
+		// slirp4netns or the device connects the container, without a
+		// host interface
+		hostIf = ""
+	}
+	logger := nm.logger(ctx).With("container_id", spec.ContainerID, "interface", hostIf)
+	logger.Info("Creating container network")
+
+	cn := &ContainerNetwork{
+		ContainerID:   spec.ContainerID,
+		Name:          spec.Name,
+		Namespace:     spec.Namespace,
+		MAC:           mac.String(),
+		MTU:           spec.MTU,
+		DNSTTL:        spec.DNSTTL,
+		HostInterface: hostIf,
+		NetnsPath:     spec.NetnsPath,
+		Rootless:      nm.rootless,
+
+		AllowedSources:      append([]string(nil), spec.AllowedSources...),
+		SourceCheckDisabled: spec.DisableSourceCheck,
+		CgroupPath:          spec.CgroupPath,
+
+		RequiredDestinations: append([]Destination(nil), spec.RequiredDestinations...),
+	}
+	if spec.Attachment.direct() {
+		cn.Attachment = spec.Attachment
+	}
+	if res != nil && res.MAC != "" {
+		cn.MAC = res.MAC
+	}
+	if cn.NetnsPath == "" && spec.Pid > 0 {
+		cn.NetnsPath = fmt.Sprintf("/proc/%d/ns/net", spec.Pid)
+	}
 
-	return &NetworkManager{
-		config: config,
-	}, nil
+	j := newOpJournal(ctx, nm.tracer, logger)
+	j.timing = newSetupTiming()
+	if err := nm.createSteps(j, spec, res, cn); err != nil {
+		logger.Warn("Rolling back container network", "error", err)
+		j.rollback()
+		return nil, fmt.Errorf("failed to create network for %s: %w", spec.ContainerID, err)
+	}
+	if cn.warm != nil {
+		j.timing.Warm = true
+		cn.warm = nil
+	}
+	nm.names.add(cn)
+	synced := time.Now()
+	if err := nm.syncNamespaces(); err != nil {
+		logger.Error("Failed to program namespace isolation", "error", err)
+	}
+	if err := nm.syncPolicies(); err != nil {
+		logger.Error("Failed to program network policies", "error", err)
+	}
+	if err := nm.syncNeighbors(); err != nil {
+		logger.Error("Failed to program neighbor tables", "error", err)
+	}
+	j.timing.add(SetupMaps, synced)
+	out := cn.clone()
+	out.Timing = j.timing
+	out.Timing.Total = time.Since(start)
+	nm.setups.record(*out.Timing)
+	logger.Debug("Created container network", "namespace", cn.Namespace, "ipv4", cn.IPv4, "ipv6", cn.IPv6, "duration", out.Timing.Total)
+	return out, nil
 }
 
-// CreateContainerNetwork sets up networking for a new container
-func (nm *NetworkManager) CreateContainerNetwork(containerID string) (string, error) {
-	log.Printf("Creating network for container: %s", containerID)
+// createSteps runs the steps of creating cn with the reservation res, if
+// any, recording them in j
+func (nm *NetworkManager) createSteps(j *opJournal, spec ContainerNetworkSpec, res *Reservation, cn *ContainerNetwork) error {
+	if nm.config.WarmPool.Size > 0 {
+		// The container gets the addresses and MAC of the attachment it
+		// takes; rolling back deletes the attachment with them
+		err := j.run("take warm attachment", func() error {
+			cn.warm = nm.takeWarm(spec, res, cn)
+			return nil
+		}, func() error {
+			if cn.warm == nil {
+				return nil
+			}
+			return nm.dropWarm(cn.warm)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err := j.run("allocate addresses", func() error {
+		if cn.Rootless {
+			// Each container is on a network of its own
+			cn.IPv4, cn.IPv6 = nm.rootlessAddrs()
+			return nil
+		}
+		if cn.warm != nil {
+			return nil
+		}
+		for _, pool := range nm.pools {
+			// Backends return the existing address on a retry
+			addr, err := nm.allocateAddr(j.ctx, pool, IPAMRequest{
+				ContainerID: spec.ContainerID,
+				Namespace:   spec.Namespace,
+				Pool:        pool.prefix,
+				Gateway:     pool.gateway,
+				Addr:        res.addr(pool.prefix.Addr().Is4()),
+				MAC:         cn.MAC,
+				Hostname:    cn.Name,
+			})
+			if err != nil {
+				return err
+			}
+			if addr.Is4() {
+				cn.IPv4 = addr.String()
+			} else {
+				cn.IPv6 = addr.String()
+			}
+		}
+		return nil
+	}, func() error {
+		nm.releaseAddrs(spec.ContainerID)
+		return nil
+	})
+	if err != nil {
+		nm.releaseAddrs(spec.ContainerID)
+		return err
+	}
+
+	// Undone once the container is forgotten again, which drops its rules
+	// from the SNAT table
+	err = j.run("allocate SNAT ports", func() error {
+		return nm.allocateSNAT(cn)
+	}, func() error {
+		if cn.SNATPorts == nil {
+			return nil
+		}
+		nm.releaseSNAT(spec.ContainerID)
+		cn.SNATPorts = nil
+		return nm.syncSNAT()
+	})
+	if err != nil {
+		return err
+	}
+
+	if cn.MAC == "" {
+		cn.MAC = containerMAC(cn.addrs()).String()
+	}
+	if !cn.Rootless && nm.macInUse(cn.MAC, spec.ContainerID) {
+		return fmt.Errorf("%w: %s", ErrMACInUse, cn.MAC)
+	}
+
+	// Record the intent first so a crash during setup doesn't leak an
+	// interface that a restart would not know about
+	err = j.run("record intent", func() error {
+		cn.Intent = IntentCreate
+		nm.containers[spec.ContainerID] = cn
+		return nm.saveState()
+	}, func() error {
+		delete(nm.containers, spec.ContainerID)
+		return nm.saveState()
+	})
+	if err != nil {
+		delete(nm.containers, spec.ContainerID)
+		return err
+	}
+
+	if err := nm.setupContainerDatapath(j, spec, cn); err != nil {
+		return err
+	}
+	if cn.SNATPorts != nil {
+		if err := j.run("masquerade", nm.syncSNAT, nil); err != nil {
+			return err
+		}
+	}
+	if spec.IngressBps > 0 || spec.EgressBps > 0 {
+		// Deleting the veth on rollback removes the qdiscs
+		err := j.run("limit bandwidth", func() error {
+			if err := nm.applyBandwidthLimit(cn, spec.IngressBps, spec.EgressBps); err != nil {
+				return err
+			}
+			cn.IngressBps, cn.EgressBps = spec.IngressBps, spec.EgressBps
+			// Spliced sockets would skip the limit
+			return nm.syncAcceleration(cn)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
 
-	// TODO: Implement actual networking
-	// 1. Allocate IP from CIDR range
-	// 2. Create veth pair
-	// 3. Attach eBPF program for traffic routing
-	// 4. Update eBPF maps with container routing info
+	if res != nil {
+		prev, reserved := nm.reservations[spec.ContainerID]
+		err := j.run("reserve addresses", func() error {
+			return nm.reserve(*res)
+		}, func() error {
+			nm.unreserve(spec.ContainerID)
+			if reserved {
+				return nm.reserve(prev)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
 
-	// Placeholder: return a fake IP
-	return "10.0.0.2", nil
+	return j.run("commit", func() error {
+		cn.Intent = ""
+		return nm.saveState()
+	}, nil)
 }
 
-// DeleteContainerNetwork tears down container networking
-func (nm *NetworkManager) DeleteContainerNetwork(containerID string) error {
-	log.Printf("Deleting network for container: %s", containerID)
+// DeleteContainerNetwork tears down container networking. It also cleans up
+// after a create that failed half way, so it is safe to call for containers
+// the manager has no record of.
+func (nm *NetworkManager) DeleteContainerNetwork(ctx context.Context, containerID string) error {
+	ctx, span := nm.tracer.Start(ctx, "DeleteContainerNetwork",
+		trace.WithAttributes(attribute.String("container.id", containerID)))
+	err := nm.deleteContainerNetwork(ctx, containerID)
+	tracing.End(span, err)
+	return err
+}
 
-	// TODO: Implement cleanup
-	// 1. Remove from eBPF maps
-	// 2. Delete veth pair
-	// 3. Release IP address
+func (nm *NetworkManager) deleteContainerNetwork(ctx context.Context, containerID string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.removeContainerNetwork(ctx, containerID)
+}
+
+// removeContainerNetwork deletes the network of containerID. Callers must
+// hold nm.mu.
+func (nm *NetworkManager) removeContainerNetwork(ctx context.Context, containerID string) error {
+	if isWarmID(containerID) {
+		// No container has the network of a warm attachment
+		return nil
+	}
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		cn = &ContainerNetwork{
+			ContainerID:   containerID,
+			HostInterface: hostVethName(nm.instance, containerID),
+		}
+	}
+
+	logger := nm.logger(ctx).With("container_id", containerID, "interface", cn.HostInterface)
+	logger.Info("Deleting container network")
+
+	if ok {
+		cn.Intent = IntentDelete
+		if err := nm.saveState(); err != nil {
+			cn.Intent = ""
+			return err
+		}
+	}
+	// Stop resolving the name before the address can be reused
+	nm.names.remove(cn.Name)
+	_, span := nm.tracer.Start(ctx, "tear down datapath")
+	err := retryTransient(logger, "tear down datapath", func() error {
+		return nm.teardownContainerDatapath(cn)
+	})
+	tracing.End(span, err)
+	if err != nil {
+		nm.names.add(cn)
+		return fmt.Errorf("failed to tear down datapath for %s: %w", containerID, err)
+	}
 
+	delete(nm.containers, containerID)
+	delete(nm.leases, containerID)
+	nm.removeMirrorsTo(logger, containerID)
+	nm.removeAFXDPFlowsTo(containerID)
+	if len(cn.Ports) > 0 {
+		if err := nm.syncForwards(); err != nil {
+			logger.Error("Failed to remove port forwards", "error", err)
+		}
+	}
+	if cn.QoSClass != QoSDefault {
+		if err := nm.syncQoS(); err != nil {
+			logger.Error("Failed to remove QoS class", "error", err)
+		}
+	}
+	if cn.draining {
+		if err := nm.syncDrain(); err != nil {
+			logger.Error("Failed to remove drain rules", "error", err)
+		}
+	}
+	if cn.SNATPorts != nil {
+		nm.releaseSNAT(containerID)
+		if err := nm.syncSNAT(); err != nil {
+			logger.Error("Failed to remove SNAT port slice", "error", err)
+		}
+	}
+	nm.removeContainerPolicies(logger, containerID)
+	if err := nm.syncPolicies(); err != nil {
+		logger.Error("Failed to remove network policies", "error", err)
+	}
+	if err := nm.syncNeighbors(); err != nil {
+		logger.Error("Failed to remove neighbor tables", "error", err)
+	}
+	if err := nm.syncNamespaces(); err != nil {
+		logger.Error("Failed to remove namespace isolation", "error", err)
+	}
+	if err := nm.removeServiceBackend(logger, containerID); err != nil {
+		logger.Error("Failed to remove service backend", "error", err)
+	}
+	if err := nm.saveState(); err != nil {
+		// The interface is gone, so a restart drops the stale entry anyway
+		logger.Error("Failed to save network state", "error", err)
+	}
+	nm.releaseAddrs(containerID)
 	return nil
 }
 
-// GetStats returns networking performance statistics
+// releaseAddrs returns the container's addresses to their pools
+func (nm *NetworkManager) releaseAddrs(containerID string) {
+	for _, pool := range nm.pools {
+		nm.releaseAddr(pool, containerID)
+	}
+}
+
+// addrs returns the container's addresses, IPv4 first
+func (cn *ContainerNetwork) addrs() []netip.Addr {
+	var out []netip.Addr
+	for _, s := range []string{cn.IPv4, cn.IPv6} {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// gateway returns the gateway of the pool containing addr
+func (nm *NetworkManager) gateway(addr netip.Addr) netip.Addr {
+	for _, pool := range nm.pools {
+		if pool.prefix.Contains(addr) {
+			return pool.gateway
+		}
+	}
+	return netip.Addr{}
+}
+
+// tracerName names the tracer of the network manager's spans
+const tracerName = "github.com/1090mb/enviro/enviro-go/pkg/network"
+
+// logger returns the request logger carried by ctx, or the manager's logger
+func (nm *NetworkManager) logger(ctx context.Context) *slog.Logger {
+	return logging.FromContext(ctx, nm.log)
+}
+
+// ContainerNetworks returns copies of the container networks, keyed by
+// containerID
+func (nm *NetworkManager) ContainerNetworks() map[string]*ContainerNetwork {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	out := make(map[string]*ContainerNetwork, len(nm.containers))
+	for id, cn := range nm.containers {
+		out[id] = cn.clone()
+	}
+	return out
+}
+
+// Allocations returns the addresses assigned to each container, IPv4
+// first, keyed by containerID. Those of warm attachments aren't included.
+func (nm *NetworkManager) Allocations() map[string][]string {
+	out := make(map[string][]string)
+	for _, pool := range nm.pools {
+		for id, addr := range pool.Allocations() {
+			if isWarmID(id) {
+				continue
+			}
+			out[id] = append(out[id], addr.String())
+		}
+	}
+	return out
+}
+
+// PoolUsage is the utilization of an address pool
+type PoolUsage struct {
+	CIDR string
+	// Size is the number of allocatable addresses, capped at the largest
+	// uint64 for large IPv6 networks
+	Size uint64
+	// Allocated is the number of addresses assigned to containers,
+	// including the Warm ones held by warm attachments, see WarmPoolConfig
+	Allocated int
+	Warm      int
+	// IPAM names the backend allocating the addresses, see IPAMConfig
+	IPAM string
+}
+
+// PoolUsage returns the utilization of each address pool, IPv4 first
+func (nm *NetworkManager) PoolUsage() []PoolUsage {
+	usage := make([]PoolUsage, 0, len(nm.pools))
+	for _, pool := range nm.pools {
+		u := pool.Usage()
+		u.IPAM = nm.backend(pool).Name()
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+// MapUsage is the fill of an eBPF map
+type MapUsage struct {
+	Entries    uint32
+	MaxEntries uint32
+}
+
+// DatapathMapUsage returns how full the hash maps of the XDP router are,
+// keyed by map name, or nil without XDP. Each call walks the maps, so it
+// costs in proportion to their entries.
+func (nm *NetworkManager) DatapathMapUsage() (map[string]MapUsage, error) {
+	return nm.readMapUsage()
+}
+
+// GetStats returns networking performance statistics. Totals include
+// traffic of containers that have since been deleted. With the XDP router,
+// the keys program_<name>_* and interface_<name>_ns_per_packet report
+// what its programs cost, see GetProgramStats.
 func (nm *NetworkManager) GetStats() (map[string]uint64, error) {
 	stats := map[string]uint64{
 		"packets_processed": 0,
 		"bytes_processed":   0,
 		"drop_count":        0,
+		"redirect_count":    0,
+		"frag_needed_count": 0,
+		// Packets refused by PolicyReject and answered, which drop_count
+		// doesn't count
+		"reject_count": 0,
+		// SYNs answered with a cookie, and resets answering those whose
+		// cookie was valid or not, see SYNProtectionConfig
+		"syn_cookies_sent":      0,
+		"syn_cookies_validated": 0,
+		"syn_cookies_failed":    0,
+		// Frames containers sent from a MAC or address not theirs, and
+		// ARP and neighbor discovery claiming one
+		"drop_spoofed":          0,
+		"drop_neighbor_spoofed": 0,
+		// Policy checks made by the router per packet, and as containers
+		// connected, of which those refused, see ConnectPolicyConfig
+		"policy_packet_checks":  0,
+		"policy_connect_checks": 0,
+		"policy_connect_denied": 0,
+		// Sockets spliced past the stacks and what they carried, see
+		// SocketAccelerationConfig
+		"accelerated_sockets":  0,
+		"accelerated_messages": 0,
+		"accelerated_bytes":    0,
+		"logs_suppressed":      nm.events.Suppressed(),
+		// Containers denied a SNAT port slice, see SNATConfig
+		"snat_slices_exhausted": nm.snatExhausted.Load(),
 	}
 
-	// TODO: Read from eBPF maps
+	if err := nm.readDatapathStats(stats); err != nil {
+		return nil, err
+	}
 	return stats, nil
 }
 
-// Example eBPF program (commented pseudo-code)
-/*
-// XDP program for container packet forwarding
-// This would be compiled to eBPF bytecode and loaded at runtime
-
-int xdp_container_router(struct xdp_md *ctx) {
-    void *data = (void *)(long)ctx->data;
-    void *data_end = (void *)(long)ctx->data_end;
+// GetContainerStats returns the statistics for a single container, using the
+// same keys as GetStats. shaping_dropped_packets and shaping_delayed_packets
+// count packets dropped or queued by its bandwidth limit. frag_needed_count
+// counts packets over the container's MTU that the XDP router or the
+// userspace forwarder answered with an ICMP error; otherwise the kernel
+// does so uncounted. The keys of
+// TrafficStatKey break the container's traffic down by protocol, and stay
+// 0 without XDP.
+func (nm *NetworkManager) GetContainerStats(containerID string) (map[string]uint64, error) {
+	nm.mu.Lock()
+	cn, ok := nm.containers[containerID]
+	if ok {
+		cn = cn.clone()
+	}
+	nm.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	return nm.containerStats(cn)
+}
 
-    // Parse Ethernet header
-    struct ethhdr *eth = data;
-    if ((void *)(eth + 1) > data_end)
-        return XDP_DROP;
+// containerStats reads the statistics of cn, a clone taken under nm.mu
+func (nm *NetworkManager) containerStats(cn *ContainerNetwork) (map[string]uint64, error) {
+	stats := map[string]uint64{
+		"packets_processed": 0,
+		"bytes_processed":   0,
+		"drop_count":        0,
+		"redirect_count":    0,
+		"frag_needed_count": 0,
+		"reject_count":      0,
+		"drop_spoofed":      0,
 
-    // Parse IP header
-    if (eth->h_proto != htons(ETH_P_IP))
-        return XDP_PASS;
+		"drop_neighbor_spoofed":   0,
+		"policy_packet_checks":    0,
+		"policy_connect_checks":   0,
+		"policy_connect_denied":   0,
+		"accelerated_sockets":     0,
+		"accelerated_messages":    0,
+		"accelerated_bytes":       0,
+		"shaping_dropped_packets": 0,
+		"shaping_delayed_packets": 0,
+	}
+	for _, dir := range []Direction{DirectionIngress, DirectionEgress} {
+		for _, proto := range TrafficProtocols {
+			stats[TrafficStatKey(dir, proto, "packets")] = 0
+			stats[TrafficStatKey(dir, proto, "bytes")] = 0
+		}
+	}
+	if err := nm.readContainerStats(cn, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
 
-    struct iphdr *ip = (void *)(eth + 1);
-    if ((void *)(ip + 1) > data_end)
-        return XDP_DROP;
+// GetAllContainerStats returns the statistics of every container, as
+// returned by GetContainerStats, keyed by containerID. Containers deleted
+// while their statistics are read are left out.
+func (nm *NetworkManager) GetAllContainerStats() (map[string]map[string]uint64, error) {
+	snap, err := nm.ListStats()
+	if err != nil {
+		return nil, err
+	}
+	return snap.Containers, nil
+}
 
-    // Lookup destination container in eBPF map
-    __u32 dest_ip = ip->daddr;
-    struct container_info *info = bpf_map_lookup_elem(&container_routes, &dest_ip);
+// StatsSnapshot is the node-wide and per-container statistics read in one
+// pass
+type StatsSnapshot struct {
+	// Time is when the counters were read
+	Time time.Time
+	// Node holds the counters of GetStats
+	Node map[string]uint64
+	// Containers holds the counters of GetContainerStats by containerID
+	Containers map[string]map[string]uint64
+	// Peers holds the tunnel state of the overlay peers, sorted by name
+	Peers []PeerStats
+}
 
-    if (info) {
-        // Direct forwarding to container veth
-        return bpf_redirect(info->ifindex, 0);
-    }
+// ListStats returns the statistics of the node and every container. The
+// container list is copied once, so counters are read without holding
+// the manager's lock and container changes aren't held up by a scrape.
+// Containers deleted while their statistics are read are left out.
+func (nm *NetworkManager) ListStats() (StatsSnapshot, error) {
+	nm.mu.Lock()
+	containers := make([]*ContainerNetwork, 0, len(nm.containers))
+	for _, cn := range nm.containers {
+		containers = append(containers, cn.clone())
+	}
+	nm.mu.Unlock()
 
-    return XDP_PASS;
+	snap := StatsSnapshot{
+		Time:       time.Now(),
+		Containers: make(map[string]map[string]uint64, len(containers)),
+	}
+	var err error
+	if snap.Node, err = nm.GetStats(); err != nil {
+		return StatsSnapshot{}, err
+	}
+	for _, cn := range containers {
+		stats, err := nm.containerStats(cn)
+		if err != nil {
+			nm.mu.Lock()
+			_, ok := nm.containers[cn.ContainerID]
+			nm.mu.Unlock()
+			if !ok {
+				continue
+			}
+			return StatsSnapshot{}, err
+		}
+		snap.Containers[cn.ContainerID] = stats
+	}
+	if snap.Peers, err = nm.PeerStats(); err != nil {
+		return StatsSnapshot{}, err
+	}
+	return snap, nil
 }
-*/
@@ -0,0 +1,741 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// initDatapath enables forwarding and, when requested, attaches the XDP
+// router. Failing to attach XDP is not fatal: the manager falls back to
+// kernel routing, with policies enforced by nftables, and records why in
+// Capabilities.
+func (nm *NetworkManager) initDatapath() error {
+	if nm.useRootless() {
+		return nm.initRootless()
+	}
+
+	// Containers are routed, not bridged, so the host must forward
+	for _, pool := range nm.pools {
+		path, family := "/proc/sys/net/ipv4/ip_forward", "IPv4"
+		if pool.prefix.Addr().Is6() {
+			path, family = "/proc/sys/net/ipv6/conf/all/forwarding", "IPv6"
+		}
+		if err := os.WriteFile(path, []byte("1"), 0o644); err != nil {
+			nm.log.Warn("Failed to enable forwarding", "family", family, "error", err)
+		}
+	}
+
+	if err := nm.clearServices(); err != nil {
+		nm.log.Warn("Failed to remove service table", "error", err)
+	}
+	if err := nm.clearNamespaces(); err != nil {
+		nm.log.Warn("Failed to remove namespace table", "error", err)
+	}
+	if err := nm.clearDrain(); err != nil {
+		nm.log.Warn("Failed to remove drain table", "error", err)
+	}
+	if err := nm.clearUserspace(); err != nil {
+		nm.log.Warn("Failed to remove userspace forwarding table", "error", err)
+	}
+	if !nm.config.SNAT.Enable {
+		if err := nm.clearSNAT(); err != nil {
+			nm.log.Warn("Failed to remove SNAT table", "error", err)
+		}
+	}
+
+	if !nm.config.EnableXDP {
+		nm.detachKept()
+		return nm.initKernelPolicies()
+	}
+
+	synProtection := nm.config.SYNProtection.Enable && probedKernel().Datapath.SYNCookies
+	connectPolicy := nm.config.ConnectPolicy.Enable && probedKernel().Datapath.ConnectPolicy
+	socketAcceleration := nm.config.SocketAcceleration.Enable && probedKernel().Datapath.SocketAcceleration
+	proxyRedirect := nm.config.ProxyRedirect.Enable && probedKernel().Datapath.ProxyRedirect
+	var xdp *xdpProgram
+	err := errUserspaceMode
+	if nm.config.DatapathMode != DatapathUserspace {
+		xdp, err = loadXDP(nm.config.Interface, nm.config.DatapathMode, nm.config.Conntrack.MaxEntries, instancePinPath(nm.config),
+			synProtection, connectPolicy, socketAcceleration, proxyRedirect)
+	}
+	if err != nil {
+		nm.log.Warn("XDP unavailable, falling back to userspace forwarding", "interface", nm.config.Interface, "error", err)
+		nm.caps.XDPError = err.Error()
+		nm.detachKept()
+		if err := nm.initKernelPolicies(); err != nil {
+			return err
+		}
+		nm.initUserspace()
+		return nil
+	}
+	if err := nm.clearKernelPolicies(); err != nil {
+		nm.log.Warn("Failed to remove kernel policy table", "error", err)
+	}
+
+	if err := xdp.SetDefaultPolicy(nm.config.DefaultPolicy); err != nil {
+		xdp.Close()
+		return fmt.Errorf("failed to set default policy: %w", err)
+	}
+	if err := xdp.SetRejectRate(nm.config.RejectRate); err != nil {
+		xdp.Close()
+		return fmt.Errorf("failed to set reject rate: %w", err)
+	}
+	if err := nm.initSYNProtection(xdp); err != nil {
+		xdp.Close()
+		return fmt.Errorf("failed to configure SYN protection: %w", err)
+	}
+	nm.initSourceCheck(xdp)
+	nm.initPortForwards(xdp)
+	nm.initConnectPolicy(xdp)
+	nm.initSocketAcceleration(xdp)
+	nm.initProxyRedirect(xdp)
+
+	nm.enableProxyNDP()
+	xdp.startConntrackGC(nm.config.Conntrack, nm.log)
+
+	nm.log.Info("Attached XDP container router", "interface", nm.config.Interface, "mode", xdp.mode, "carried_over", xdp.carried)
+	xdp.keep = nm.config.KeepAttached
+	nm.xdp = xdp
+	nm.caps.XDP = true
+	nm.caps.XDPMode = xdp.mode
+	nm.startDropEvents()
+	return nil
+}
+
+// initUserspace starts forwarding the IPv4 traffic arriving for the
+// containers in userspace in place of the XDP router. Without it the kernel
+// routes that traffic too.
+func (nm *NetworkManager) initUserspace() {
+	var pools []netip.Prefix
+	for _, pool := range nm.pools {
+		pools = append(pools, pool.prefix)
+	}
+	fwd, err := startUserspace(nm.config.Interface, pools, nm.config.RejectRate, nm.nftTable(nftUserspaceTable), nm.log)
+	if err != nil {
+		nm.log.Warn("Userspace forwarding unavailable, falling back to kernel routing", "interface", nm.config.Interface, "error", err)
+		return
+	}
+	fwd.SetPolicies(nm.programmed, nm.config.DefaultPolicy)
+	nm.log.Info("Forwarding container traffic in userspace", "interface", nm.config.Interface)
+	nm.userspace = fwd
+	nm.caps.Userspace = true
+}
+
+// detachKept detaches a router a previous run kept attached, which would
+// route with stale entries while no manager updates it
+func (nm *NetworkManager) detachKept() {
+	if nm.config.PinPath == "" {
+		return
+	}
+	if err := detachKept(nm.config.Interface, instancePinPath(nm.config)); err != nil {
+		nm.log.Warn("Failed to detach kept XDP router", "error", err)
+	}
+}
+
+// initKernelPolicies replaces the policy table of an earlier run with one
+// applying just the default policy. Without nftables, policies can't be
+// enforced; that only fails startup when the default policy keeps traffic
+// out.
+func (nm *NetworkManager) initKernelPolicies() error {
+	if err := nm.syncKernelPolicies(nil); err != nil {
+		if nm.config.DefaultPolicy.denies() {
+			return fmt.Errorf("failed to enforce default policy: %w", err)
+		}
+		nm.log.Warn("Failed to initialize kernel policy table", "error", err)
+	}
+	return nil
+}
+
+// enableProxyNDP makes the kernel answer neighbor solicitations from the
+// proxy entries of each container. The XDP router answers ARP itself.
+func (nm *NetworkManager) enableProxyNDP() {
+	path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/proxy_ndp", nm.config.Interface)
+	if err := os.WriteFile(path, []byte("1"), 0o644); err != nil {
+		nm.log.Warn("Failed to enable proxy NDP", "interface", nm.config.Interface, "error", err)
+	}
+}
+
+// reattachDatapath attaches the loaded XDP router to the interface again
+// and restores the interface settings containers rely on, which are lost
+// when it is recreated. Callers must hold nm.mu.
+func (nm *NetworkManager) reattachDatapath() error {
+	if err := nm.xdp.Reattach(nm.config.Interface); err != nil {
+		nm.caps.XDP, nm.caps.XDPMode, nm.caps.XDPError = false, "", err.Error()
+		return err
+	}
+	nm.caps.XDP, nm.caps.XDPMode, nm.caps.XDPError = true, nm.xdp.mode, ""
+	// The mode may have changed, and with it the extensions' type
+	nm.syncExtensions()
+
+	nm.enableProxyNDP()
+	for _, cn := range nm.containers {
+		if err := nm.proxyNeighbors(cn, true); err != nil {
+			return fmt.Errorf("failed to proxy neighbor discovery for %s: %w", cn.ContainerID, err)
+		}
+	}
+	return nil
+}
+
+// upgradeDatapath swaps in the XDP router from objPath. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) upgradeDatapath(objPath string) error {
+	spec, err := ebpf.LoadCollectionSpec(objPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDatapath, err)
+	}
+	if err := nm.xdp.Upgrade(spec); err != nil {
+		return err
+	}
+	// Maps new in this version start out empty
+	if err := nm.syncNamespaces(); err != nil {
+		nm.log.Error("Failed to program namespace isolation", "error", err)
+	}
+	if err := nm.syncTraffic(); err != nil {
+		nm.log.Error("Failed to create traffic counters", "error", err)
+	}
+	// The veths' filters still run the old source check
+	nm.caps.SourceCheck = nm.xdp.hasSourceCheck()
+	if err := nm.syncSourceChecks(); err != nil {
+		nm.log.Error("Failed to check container sources", "error", err)
+	}
+	// The new router may translate forwards where the old one didn't
+	if err := nm.syncDatapathForwards(); err != nil {
+		nm.log.Error("Failed to program port forwards", "error", err)
+	}
+	// The neighbor tables stand in for the source check while it's missing
+	if err := nm.syncNeighbors(); err != nil {
+		nm.log.Error("Failed to program neighbor tables", "error", err)
+	}
+	// The chains still hand packets back to the old resume program
+	nm.syncExtensions()
+	// The cgroups still run the old connect-time policy and sockops
+	if err := nm.syncCgroups(); err != nil {
+		nm.log.Error("Failed to attach cgroup programs", "error", err)
+	}
+	// The filters pacing containers still run the old program
+	if err := nm.syncBandwidthLimits(); err != nil {
+		nm.log.Error("Failed to restore bandwidth limits", "error", err)
+	}
+	// As do those delaying them for faults, which the new one may delay
+	// where netem did
+	if err := nm.syncFaults(); err != nil {
+		nm.log.Error("Failed to inject faults", "error", err)
+	}
+	// The containers' own interfaces still hand packets to the old proxy
+	// redirection
+	if err := nm.syncProxies(); err != nil {
+		nm.log.Error("Failed to redirect to proxies", "error", err)
+	}
+	// The host veths of running captures still copy them with the old
+	// program
+	if err := nm.xdp.syncTaps(); err != nil {
+		nm.log.Error("Failed to keep capturing traffic", "error", err)
+	}
+	return nil
+}
+
+func (nm *NetworkManager) closeDatapath() error {
+	slirpErr := nm.stopSlirps()
+	if nm.userspace != nil {
+		err := nm.userspace.Close()
+		nm.userspace = nil
+		return errors.Join(slirpErr, err)
+	}
+	if nm.xdp == nil {
+		return slirpErr
+	}
+	nm.closeExtensions()
+	nm.closeCgroups()
+	err := nm.xdp.Close()
+	nm.xdp = nil
+	return errors.Join(slirpErr, err)
+}
+
+// syncPolicies programs the compiled policy rules into the datapath,
+// writing only entries that changed, in batches. Without XDP the nftables policy
+// table is rebuilt instead, and the userspace forwarder given the rules.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) syncPolicies() error {
+	desired, owners := nm.compilePolicies()
+	if nm.rootless {
+		// Containers can't reach each other, and rootless mode has no
+		// means to filter their other traffic
+		nm.programmed, nm.policyOwners = desired, owners
+		return nil
+	}
+	if nm.xdp == nil {
+		if err := nm.syncKernelPolicies(desired); err != nil {
+			return fmt.Errorf("failed to program policy table: %w", err)
+		}
+		if nm.userspace != nil {
+			nm.userspace.SetPolicies(desired, nm.config.DefaultPolicy)
+		}
+		nm.programmed, nm.policyOwners = desired, owners
+		return nil
+	}
+
+	var dels []policyRule
+	for rule := range nm.programmed {
+		if _, ok := desired[rule]; !ok {
+			dels = append(dels, rule)
+		}
+	}
+	puts := make(map[policyRule]PolicyAction)
+	for rule, action := range desired {
+		if nm.programmed[rule] != action {
+			puts[rule] = action
+		}
+	}
+	nm.policyOwners = owners
+	if len(dels) == 0 && len(puts) == 0 {
+		return nil
+	}
+	// Only record the changes once all are written; syncing again after
+	// a failure repeats them, which is harmless
+	if err := nm.xdp.UpdatePolicies(puts, dels); err != nil {
+		return err
+	}
+	for _, rule := range dels {
+		delete(nm.programmed, rule)
+	}
+	for rule, action := range puts {
+		nm.programmed[rule] = action
+	}
+	return nil
+}
+
+// applyDefaultPolicy programs nm.config.DefaultPolicy into the XDP router,
+// or rebuilds the nftables policy table without XDP. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) applyDefaultPolicy() error {
+	if nm.xdp == nil {
+		return nm.syncPolicies()
+	}
+	return nm.xdp.SetDefaultPolicy(nm.config.DefaultPolicy)
+}
+
+// setupContainerDatapath wires a container into the datapath, recording
+// each step in j
+func (nm *NetworkManager) setupContainerDatapath(j *opJournal, spec ContainerNetworkSpec, cn *ContainerNetwork) error {
+	if cn.Rootless {
+		return nm.setupSlirp(j, cn)
+	}
+	if cn.Attachment.direct() {
+		// The device bypasses the XDP router
+		return nm.setupDevice(j, spec, cn)
+	}
+	if err := nm.setupVeth(j, spec, cn); err != nil {
+		return err
+	}
+
+	if nm.userspace != nil {
+		return j.run("program userspace forwarder", func() error {
+			return nm.programUserspace(cn)
+		}, func() error {
+			return nm.userspace.DeleteContainer(cn.HostIfindex, cn.addrs())
+		})
+	}
+	if nm.xdp == nil {
+		return nil
+	}
+	err := j.run("program datapath", func() error {
+		if cn.warm != nil {
+			// Programmed with the attachment, whose ifindex the veth kept
+			return nil
+		}
+		return nm.programContainer(cn, false)
+	}, func() error {
+		return nm.xdp.DeleteContainer(cn.HostIfindex, cn.addrs())
+	})
+	if err != nil {
+		return err
+	}
+	// Deleting the veth on rollback removes the filter
+	err = j.run("check sources", func() error {
+		return nm.checkSources(cn)
+	}, func() error {
+		if !nm.xdp.hasSourceCheck() {
+			return nil
+		}
+		return nm.xdp.DeleteSources(cn.HostIfindex)
+	})
+	if err != nil {
+		return err
+	}
+	err = j.run("attach cgroup programs", func() error {
+		return nm.attachCgroup(cn)
+	}, func() error {
+		return nm.detachCgroup(cn.ContainerID)
+	})
+	if err != nil {
+		return err
+	}
+	return j.run("proxy neighbor discovery", func() error {
+		return nm.proxyNeighbors(cn, true)
+	}, func() error {
+		return nm.proxyNeighbors(cn, false)
+	})
+}
+
+// batchRoutes queues the routes of the containers programmed and torn
+// down until the returned function writes them in batches. Callers must
+// hold nm.mu.
+func (nm *NetworkManager) batchRoutes() (flush func() error) {
+	if nm.xdp == nil {
+		return func() error { return nil }
+	}
+	nm.xdp.BatchRoutes()
+	return nm.xdp.FlushRoutes
+}
+
+// programContainer adds cn to the XDP router, addressing redirected frames
+// from its host veth to its MAC. Packets are checked against the veth's
+// MTU, which is the kernel default unless one is configured.
+func (nm *NetworkManager) programContainer(cn *ContainerNetwork, shaped bool) error {
+	host, err := netlink.LinkByIndex(cn.HostIfindex)
+	if err != nil {
+		return err
+	}
+	mac, _ := net.ParseMAC(cn.MAC)
+	return nm.xdp.AddContainer(cn.HostIfindex, cn.addrs(), mac, host.Attrs().HardwareAddr, shaped, host.Attrs().MTU)
+}
+
+// programUserspace adds cn to the userspace forwarder like
+// programContainer does to the XDP router
+func (nm *NetworkManager) programUserspace(cn *ContainerNetwork) error {
+	host, err := netlink.LinkByIndex(cn.HostIfindex)
+	if err != nil {
+		return err
+	}
+	mac, _ := net.ParseMAC(cn.MAC)
+	return nm.userspace.AddContainer(cn.HostIfindex, cn.addrs(), mac, host.Attrs().HardwareAddr, host.Attrs().MTU)
+}
+
+// proxyNeighbors adds or removes the proxy entries that make the kernel
+// answer neighbor solicitations for cn's IPv6 address on the XDP interface
+func (nm *NetworkManager) proxyNeighbors(cn *ContainerNetwork, add bool) error {
+	if cn.IPv6 == "" {
+		return nil
+	}
+	uplink, err := netlink.LinkByName(nm.config.Interface)
+	if err != nil {
+		return err
+	}
+	neigh := &netlink.Neigh{
+		LinkIndex: uplink.Attrs().Index,
+		Family:    netlink.FAMILY_V6,
+		Flags:     netlink.NTF_PROXY,
+		IP:        net.ParseIP(cn.IPv6),
+	}
+	if add {
+		return netlink.NeighSet(neigh)
+	}
+	return ignoreMissing(netlink.NeighDel(neigh))
+}
+
+// adoptContainerDatapath re-attaches a container restored from saved
+// state. It returns false when its host interface no longer exists.
+func (nm *NetworkManager) adoptContainerDatapath(cn *ContainerNetwork) (bool, error) {
+	if cn.Rootless {
+		return nm.adoptSlirp(cn)
+	}
+	if cn.Attachment.direct() {
+		return nm.adoptDevice(cn), nil
+	}
+	link, err := netlink.LinkByName(cn.HostInterface)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	cn.HostIfindex = link.Attrs().Index
+
+	// Containers saved before MACs were recorded keep the one they have
+	if cn.MAC == "" {
+		if h, err := containerHandle(cn); err == nil {
+			if eth, err := h.LinkByName(containerIfName); err == nil {
+				cn.MAC = eth.Attrs().HardwareAddr.String()
+			}
+			h.Delete()
+		}
+	}
+
+	if err := removeStaleFault(link); err != nil {
+		nm.log.Warn("Failed to remove fault injected before the restart", "container_id", cn.ContainerID, "error", err)
+	}
+
+	if nm.userspace != nil {
+		if err := nm.programUserspace(cn); err != nil {
+			return false, err
+		}
+	}
+	// Any qdiscs shaping the container survive on the veth
+	if nm.xdp != nil {
+		if err := nm.programContainer(cn, cn.kernelPath()); err != nil {
+			return false, err
+		}
+		// The filter left on the veth runs the previous run's program
+		if err := nm.checkSources(cn); err != nil {
+			return false, err
+		}
+		// As do those pacing the container, whose limits are gone
+		if err := nm.restoreBandwidthLimit(cn); err != nil {
+			return false, err
+		}
+		// As do those delaying it for a fault, which is gone
+		if err := nm.removeStaleFaultDelay(cn); err != nil {
+			nm.log.Warn("Failed to remove fault injected before the restart", "container_id", cn.ContainerID, "error", err)
+		}
+		// Captures end with the run that started them
+		if err := detachCapture(cn.HostIfindex); err != nil {
+			nm.log.Warn("Failed to remove capture left by the previous run", "container_id", cn.ContainerID, "error", err)
+		}
+		// The cgroup goes with the container's processes, which a stopped
+		// container no longer has; its packets are still checked
+		if err := nm.attachCgroup(cn); err != nil {
+			nm.log.Warn("Failed to attach cgroup programs", "container_id", cn.ContainerID, "error", err)
+		}
+		if err := nm.syncAcceleration(cn); err != nil {
+			return false, err
+		}
+		if err := nm.applyProxy(cn, cn.Proxy); err != nil {
+			nm.log.Warn("Failed to redirect to proxy", "container_id", cn.ContainerID, "error", err)
+		}
+		if err := nm.proxyNeighbors(cn, true); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// teardownContainerDatapath removes a container from the datapath.
+// Deleting the veth also removes the qdiscs of any bandwidth limit.
+func (nm *NetworkManager) teardownContainerDatapath(cn *ContainerNetwork) error {
+	if cn.Rootless {
+		return nm.stopSlirp(cn.ContainerID)
+	}
+	if cn.Attachment.direct() {
+		return nm.teardownDevice(cn)
+	}
+	if nm.userspace != nil {
+		if err := nm.userspace.DeleteContainer(cn.HostIfindex, cn.addrs()); err != nil {
+			return err
+		}
+	}
+	if nm.xdp != nil {
+		if err := nm.detachCgroup(cn.ContainerID); err != nil {
+			return fmt.Errorf("failed to detach cgroup programs: %w", err)
+		}
+		// An exclusion left behind would apply to the next veth given
+		// its ifindex
+		if nm.xdp.hasSocketAcceleration() {
+			if err := nm.xdp.SetAccelerated(cn.HostIfindex, cn.addrs(), true); err != nil {
+				return err
+			}
+		}
+		if nm.xdp.hasProxyRedirect() {
+			if err := nm.xdp.SetProxyRedirects(cn.addrs(), nil); err != nil {
+				return err
+			}
+		}
+		if err := nm.xdp.DeleteContainer(cn.HostIfindex, cn.addrs()); err != nil {
+			return err
+		}
+		if nm.xdp.hasSourceCheck() {
+			if err := nm.xdp.DeleteSources(cn.HostIfindex); err != nil {
+				return err
+			}
+		}
+		if nm.xdp.hasPacing() {
+			keys := []paceKey{{Ifindex: uint32(cn.HostIfindex), Dir: paceIngress}}
+			if cn.pacedEgress != 0 {
+				keys = append(keys, paceKey{Ifindex: uint32(cn.pacedEgress), Dir: paceEgress})
+			}
+			if err := nm.xdp.DeletePacing(keys...); err != nil {
+				return err
+			}
+		}
+		// The ifindex may be reused by the next container's veth
+		if err := nm.xdp.FlushConnections(cn.HostIfindex); err != nil {
+			return fmt.Errorf("failed to flush connections: %w", err)
+		}
+		if err := nm.proxyNeighbors(cn, false); err != nil {
+			return err
+		}
+	}
+	return deleteVeth(cn.HostInterface)
+}
+
+// readDatapathStats fills stats from the eBPF counters and those the kernel
+// keeps of the router's programs, see addProgramStats. Without XDP only
+// drop_count and reject_count have a node-wide source, the policy table,
+// and drop_neighbor_spoofed the neighbor tables, besides the counters of
+// the userspace forwarder when it runs.
+func (nm *NetworkManager) readDatapathStats(stats map[string]uint64) error {
+	if err := nm.readNeighborStats(stats, ""); err != nil {
+		return err
+	}
+	if nm.xdp == nil {
+		nm.mu.Lock()
+		counts, err := nm.readPolicyCounters()
+		nm.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to read policy counters: %w", err)
+		}
+		for _, c := range counts {
+			stats["drop_count"] += c.dropped
+			stats["reject_count"] += c.rejected
+		}
+		if nm.userspace != nil {
+			nm.userspace.Stats(stats)
+		}
+		return nil
+	}
+	s, err := nm.xdp.Stats()
+	if err != nil {
+		return fmt.Errorf("failed to read datapath stats: %w", err)
+	}
+	stats["packets_processed"] = s.Packets
+	stats["bytes_processed"] = s.Bytes
+	stats["drop_count"] = s.Drops
+	stats["redirect_count"] = s.Redirects
+	stats["frag_needed_count"] = s.FragNeeded
+	stats["reject_count"] = s.Rejects
+	stats["syn_cookies_sent"] = s.SYNCookiesSent
+	stats["syn_cookies_validated"] = s.SYNCookiesValid
+	stats["syn_cookies_failed"] = s.SYNCookiesInvalid
+	stats["drop_spoofed"] = s.Spoofed
+	stats["policy_packet_checks"] = s.PolicyChecks
+	stats["policy_connect_checks"] = s.ConnectChecks
+	stats["policy_connect_denied"] = s.ConnectDenied
+	stats["accelerated_sockets"] = s.AccelSockets
+	stats["accelerated_messages"] = s.AccelMsgs
+	stats["accelerated_bytes"] = s.AccelBytes
+	if !nm.guardsNeighbors() {
+		stats["drop_neighbor_spoofed"] = s.NeighborSpoofed
+	}
+	progs, err := nm.GetProgramStats()
+	if err != nil {
+		return err
+	}
+	addProgramStats(stats, progs)
+	return nil
+}
+
+// readNeighborStats fills drop_neighbor_spoofed from the neighbor tables
+// while they stand in for the router's source check, for containerID or
+// when empty for the node
+func (nm *NetworkManager) readNeighborStats(stats map[string]uint64, containerID string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if !nm.guardsNeighbors() {
+		return nil
+	}
+	counts, err := nm.readNeighborCounters()
+	if err != nil {
+		return fmt.Errorf("failed to read neighbor counters: %w", err)
+	}
+	if containerID != "" {
+		stats["drop_neighbor_spoofed"] = counts[containerID]
+		return nil
+	}
+	for _, n := range counts {
+		stats["drop_neighbor_spoofed"] += n
+	}
+	return nil
+}
+
+// readMapUsage returns the fill of the XDP router's maps, nil without XDP
+func (nm *NetworkManager) readMapUsage() (map[string]MapUsage, error) {
+	if nm.xdp == nil {
+		return nil, nil
+	}
+	usage, err := nm.xdp.MapUsage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read datapath maps: %w", err)
+	}
+	return usage, nil
+}
+
+// readContainerStats fills stats for one container, from the XDP counters
+// when attached and otherwise from the host veth's interface counters, the
+// policy table and the userspace forwarder's counters. Rootless and directly attached containers have only
+// their interface's.
+func (nm *NetworkManager) readContainerStats(cn *ContainerNetwork, stats map[string]uint64) error {
+	if cn.Rootless || cn.Attachment.direct() {
+		return readContainerIfStats(cn, stats)
+	}
+	if nm.xdp != nil {
+		s, err := nm.xdp.ContainerStats(cn.HostIfindex)
+		if err != nil {
+			return fmt.Errorf("failed to read stats for %s: %w", cn.ContainerID, err)
+		}
+		stats["packets_processed"] = s.Packets
+		stats["bytes_processed"] = s.Bytes
+		stats["drop_count"] = s.Drops
+		stats["redirect_count"] = s.Redirects
+		stats["frag_needed_count"] = s.FragNeeded
+		stats["reject_count"] = s.Rejects
+		stats["drop_spoofed"] = s.Spoofed
+		stats["drop_neighbor_spoofed"] = s.NeighborSpoofed
+		stats["policy_packet_checks"] = s.PolicyChecks
+		stats["policy_connect_checks"] = s.ConnectChecks
+		stats["policy_connect_denied"] = s.ConnectDenied
+		stats["accelerated_sockets"] = s.AccelSockets
+		stats["accelerated_messages"] = s.AccelMsgs
+		stats["accelerated_bytes"] = s.AccelBytes
+		if nm.xdp.hasTraffic() {
+			t, err := nm.xdp.ContainerTraffic(cn.HostIfindex)
+			if err != nil {
+				return fmt.Errorf("failed to read traffic of %s: %w", cn.ContainerID, err)
+			}
+			t.fill(stats)
+		}
+		if err := nm.readNeighborStats(stats, cn.ContainerID); err != nil {
+			return err
+		}
+		return nm.readShapingStats(cn, stats)
+	}
+
+	link, err := netlink.LinkByName(cn.HostInterface)
+	if err != nil {
+		return fmt.Errorf("failed to read stats for %s: %w", cn.ContainerID, err)
+	}
+	if s := link.Attrs().Statistics; s != nil {
+		stats["packets_processed"] = s.RxPackets + s.TxPackets
+		stats["bytes_processed"] = s.RxBytes + s.TxBytes
+		stats["drop_count"] = s.RxDropped + s.TxDropped
+	}
+	nm.mu.Lock()
+	counts, err := nm.readPolicyCounters()
+	nm.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to read policy counters: %w", err)
+	}
+	stats["drop_count"] += counts[cn.ContainerID].dropped
+	stats["reject_count"] = counts[cn.ContainerID].rejected
+	if nm.userspace != nil {
+		nm.userspace.ContainerStats(cn.HostIfindex, stats)
+	}
+	if err := nm.readNeighborStats(stats, cn.ContainerID); err != nil {
+		return err
+	}
+	return nm.readShapingStats(cn, stats)
+}
+
+// isTransient reports whether a failed step may succeed when retried
+func isTransient(err error) bool {
+	return errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EBUSY) ||
+		errors.Is(err, unix.EINTR) || errors.Is(err, unix.ENOBUFS)
+}
@@ -0,0 +1,345 @@
+//go:build !linux
+
+package network
+
+import (
+	"context"
+	"crypto/ecdh"
+	"log/slog"
+	"net/netip"
+	"time"
+)
+
+// xdpProgram is never loaded on this platform
+type xdpProgram struct{}
+
+// userspaceForwarder is never started on this platform
+type userspaceForwarder struct{}
+
+// slirpProcess is never started on this platform
+type slirpProcess struct{}
+
+// parkingNetns is never created on this platform
+type parkingNetns struct{}
+
+func (p *parkingNetns) close() error { return nil }
+
+// initDatapath only fails when an eBPF datapath was explicitly requested,
+// so the rest of the manager stays usable for development on non-Linux hosts.
+func (nm *NetworkManager) initDatapath() error {
+	if nm.config.EnableXDP {
+		return ErrUnsupportedPlatform
+	}
+	return nil
+}
+
+// probeKernel finds no eBPF features on this platform
+func probeKernel() KernelCapabilities {
+	return KernelCapabilities{ProbedAt: time.Now(), Datapath: DatapathVariant{Error: ErrUnsupportedPlatform.Error()}}
+}
+
+func (nm *NetworkManager) closeDatapath() error {
+	return nil
+}
+
+func (nm *NetworkManager) reattachDatapath() error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) upgradeDatapath(objPath string) error {
+	return ErrUnsupportedPlatform
+}
+
+// syncPolicies only records the rules; there is no datapath to program
+func (nm *NetworkManager) syncPolicies() error {
+	nm.programmed, nm.policyOwners = nm.compilePolicies()
+	return nil
+}
+
+// syncNamespaces has no datapath to program
+func (nm *NetworkManager) syncNamespaces() error {
+	return nil
+}
+
+// syncNeighbors has no datapath to program
+func (nm *NetworkManager) syncNeighbors() error {
+	return nil
+}
+
+// NeighborSpoofing fails: nothing checks what containers announce on
+// this platform
+func (nm *NetworkManager) NeighborSpoofing() (map[string]uint64, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// applyDefaultPolicy only records the default; there is no datapath to
+// program
+func (nm *NetworkManager) applyDefaultPolicy() error {
+	return nil
+}
+
+// batchRoutes has no datapath to program
+func (nm *NetworkManager) batchRoutes() (flush func() error) {
+	return func() error { return nil }
+}
+
+// checkDropEvents fails as there is no XDP router to report drops
+func (nm *NetworkManager) checkDropEvents() error {
+	return ErrXDPInactive
+}
+
+func (nm *NetworkManager) readDropsLost() (uint64, error) {
+	return 0, nil
+}
+
+// adoptContainerDatapath reports saved containers as gone; they cannot
+// have been created on this platform
+func (nm *NetworkManager) adoptContainerDatapath(cn *ContainerNetwork) (bool, error) {
+	return false, nil
+}
+
+func (nm *NetworkManager) initOverlay() error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) programPeer(p Peer) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) unprogramPeer(p Peer) error {
+	return nil
+}
+
+func (nm *NetworkManager) setWireGuardKey(key *ecdh.PrivateKey) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) wireGuardPeers() (map[string]PeerStats, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) openCapture(x *xdpProgram, cn *ContainerNetwork, filter captureFilter, snapLen int) (captureSource, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) syncForwards() error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) syncQoS() error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) applyDraining(cn *ContainerNetwork) error {
+	return ErrUnsupportedPlatform
+}
+
+// syncDrain has no drain rules to remove
+func (nm *NetworkManager) syncDrain() error {
+	return nil
+}
+
+func (nm *NetworkManager) countConnections(cn *ContainerNetwork) (int, error) {
+	return 0, ErrUnsupportedPlatform
+}
+
+// syncSNAT has no kernel to program, which only matters once enabled
+func (nm *NetworkManager) syncSNAT() error {
+	if nm.config.SNAT.Enable {
+		return ErrUnsupportedPlatform
+	}
+	return nil
+}
+
+func (nm *NetworkManager) syncServices() error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) syncMirrors(cn *ContainerNetwork) error {
+	return ErrUnsupportedPlatform
+}
+
+// uplinkMTU leaves MTUs to the usual bounds; applyMTU fails anyway
+func (nm *NetworkManager) uplinkMTU() (int, error) {
+	return 0, nil
+}
+
+func (nm *NetworkManager) applyMTU(cn *ContainerNetwork, mtu int) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) applyBandwidthLimit(cn *ContainerNetwork, ingressBps, egressBps uint64) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) applyFault(cn *ContainerNetwork, f *ContainerFault) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) setupContainerDatapath(j *opJournal, spec ContainerNetworkSpec, cn *ContainerNetwork) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) newWarmAttachment(id string) (*warmAttachment, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) dropWarm(w *warmAttachment) error {
+	nm.releaseAddrs(w.id)
+	return nil
+}
+
+func (nm *NetworkManager) teardownContainerDatapath(cn *ContainerNetwork) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) readDatapathStats(stats map[string]uint64) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) readMapUsage() (map[string]MapUsage, error) {
+	return nil, nil
+}
+
+func (nm *NetworkManager) readConnections(owners map[int]string) ([]Connection, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) importConnections(cn *ContainerNetwork, conns []Connection) (int, error) {
+	return 0, nil
+}
+
+func (nm *NetworkManager) readContainerStats(cn *ContainerNetwork, stats map[string]uint64) error {
+	return ErrUnsupportedPlatform
+}
+
+func isTransient(err error) bool {
+	return false
+}
+
+func (nm *NetworkManager) collectDatapathGarbage(known knownResources, dryRun bool) ([]Orphan, error) {
+	return nil, nil
+}
+
+// afxdpSocket is never created on this platform
+type afxdpSocket struct {
+	spec     AFXDPSpec
+	zeroCopy bool
+}
+
+func (x *afxdpSocket) info() AFXDPSocket {
+	return AFXDPSocket{}
+}
+
+func (nm *NetworkManager) attachAFXDP(ctx context.Context, spec AFXDPSpec, logger *slog.Logger) (*afxdpSocket, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) detachAFXDP(logger *slog.Logger, owner string) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) readLatency(containers []*ContainerNetwork, snap *LatencySnapshot) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) readPacketSizes(containers []*ContainerNetwork, snap *PacketSizeSnapshot) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) inspectDatapath(req InspectRequest) (DatapathInspection, error) {
+	return DatapathInspection{}, ErrUnsupportedPlatform
+}
+
+// startProgramStats is never called, as there is no XDP router
+func (nm *NetworkManager) startProgramStats() {}
+
+func (nm *NetworkManager) readProgramStats(snap *ProgramStatsSnapshot) error {
+	return ErrUnsupportedPlatform
+}
+
+// extensionProgram is never registered on this platform
+type extensionProgram struct {
+	DatapathExtension
+}
+
+func (nm *NetworkManager) addExtension(ext DatapathExtension) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) removeExtension(name string) error {
+	return ErrUnsupportedPlatform
+}
+
+// cgroupAttachment is never made on this platform
+type cgroupAttachment struct{}
+
+func (nm *NetworkManager) syncCapture(cn *ContainerNetwork) error {
+	return nil
+}
+
+// syncAcceleration has no sockets to splice on this platform
+func (nm *NetworkManager) syncAcceleration(cn *ContainerNetwork) error {
+	return nil
+}
+
+func (nm *NetworkManager) applyProxy(cn *ContainerNetwork, cfg *ProxyConfig) error {
+	return ErrUnsupportedPlatform
+}
+
+func readRoutes(cn *ContainerNetwork) ([]ContainerRoute, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func addRoute(cn *ContainerNetwork, r ContainerRoute) error {
+	return ErrUnsupportedPlatform
+}
+
+func readKernelFlows(addrs []netip.Addr) ([]KernelFlow, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func restoreKernelFlow(f KernelFlow) error {
+	return ErrUnsupportedPlatform
+}
+
+// leaseInUse can't look at the kernel on this platform, so leases never
+// expire
+func leaseInUse(cn *ContainerNetwork) (bool, error) {
+	return true, nil
+}
+
+func (nm *NetworkManager) readServiceCounters() (map[servicePort]map[Locality]uint64, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// hostRoutes can't list routes on this platform, so only the addresses of
+// the host are checked for overlaps
+func hostRoutes() ([]sourcedPrefix, error) {
+	return nil, nil
+}
+
+// startOverlapWatch checks the host networks once, as their changes can't
+// be watched on this platform
+func (nm *NetworkManager) startOverlapWatch() {
+	nm.checkOverlaps()
+}
+
+func (nm *NetworkManager) stopOverlapWatch() {}
+
+// programNodeRoutes has no datapath to program
+func (nm *NetworkManager) programNodeRoutes(next map[string][]PrefixRoute) error {
+	return ErrUnsupportedPlatform
+}
+
+func (nm *NetworkManager) checkRoutes(cn *ContainerNetwork) error {
+	return ErrUnsupportedPlatform
+}
+
+func checkLinks(cn *ContainerNetwork) error {
+	return ErrUnsupportedPlatform
+}
+
+func probeGateways(ctx context.Context, cn *ContainerNetwork, gateways []netip.Addr) error {
+	return ErrUnsupportedPlatform
+}
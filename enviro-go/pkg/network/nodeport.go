@@ -0,0 +1,109 @@
+package network
+
+import (
+	"fmt"
+	"slices"
+)
+
+// DefaultNodePorts is the range node ports are taken from unless
+// configured otherwise
+var DefaultNodePorts = PortRange{Min: 30000, Max: 32767}
+
+// validateNodePorts checks the node port range of the configuration
+func validateNodePorts(r PortRange) error {
+	if r != (PortRange{}) && (r.Min == 0 || r.Min > r.Max) {
+		return fmt.Errorf("%w: node port range %s is empty", ErrInvalidConfig, r)
+	}
+	return nil
+}
+
+// hostPortOwner describes what takes port on every host address of this
+// node, a port forward or a node port of a service other than service.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) hostPortOwner(port uint16, protocol, service string) (string, bool) {
+	if fwd, ok := nm.findForward(port, protocol); ok {
+		return "forwarded to " + fwd.ContainerID, true
+	}
+	for _, s := range nm.services {
+		if s.Name != service && usesNodePort(s.Ports, port, protocol, -1) {
+			return "the node port of service " + s.Name, true
+		}
+	}
+	return "", false
+}
+
+// usesNodePort reports whether a port but the one at skip has node port
+// port of protocol
+func usesNodePort(ports []ServicePort, port uint16, protocol string, skip int) bool {
+	for i, p := range ports {
+		if i != skip && p.NodePort == port && p.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// assignNodePorts gives the ports of s, replacing old when exists, the
+// node port they request or, when none, the one the port of their name
+// had or the first free one of the range. The ports must be free of
+// forwards, other services and host processes. Callers must hold nm.mu.
+func (nm *NetworkManager) assignNodePorts(s *Service, old Service, exists bool) error {
+	if !s.ExposeNodePort {
+		return nil
+	}
+	r := nm.config.NodePorts
+	// kept returns the node port p had, when it had one
+	kept := func(p ServicePort) uint16 {
+		i := slices.IndexFunc(old.Ports, func(o ServicePort) bool { return o.Name == p.Name && o.Protocol == p.Protocol })
+		if !exists || i < 0 {
+			return 0
+		}
+		return old.Ports[i].NodePort
+	}
+	for i := range s.Ports {
+		if s.Ports[i].NodePort == 0 && !usesNodePort(s.Ports, kept(s.Ports[i]), s.Ports[i].Protocol, i) {
+			s.Ports[i].NodePort = kept(s.Ports[i])
+		}
+	}
+
+	for i, p := range s.Ports {
+		if p.NodePort == 0 {
+			continue
+		}
+		if !r.Contains(p.NodePort) {
+			return fmt.Errorf("%w: service %s: node port %d is outside %s", ErrInvalidService, s.Name, p.NodePort, r)
+		}
+		if usesNodePort(s.Ports, p.NodePort, p.Protocol, i) {
+			return fmt.Errorf("%w: service %s lists node port %d/%s twice", ErrInvalidService, s.Name, p.NodePort, p.Protocol)
+		}
+		if owner, ok := nm.hostPortOwner(p.NodePort, p.Protocol, s.Name); ok {
+			return fmt.Errorf("%w: %s/%d is %s", ErrPortInUse, p.Protocol, p.NodePort, owner)
+		}
+		if p.NodePort == kept(p) {
+			continue
+		}
+		if err := checkHostPortFree(p.NodePort, p.Protocol); err != nil {
+			return err
+		}
+	}
+
+	for i := range s.Ports {
+		p := &s.Ports[i]
+		for port := int(r.Min); p.NodePort == 0 && port <= int(r.Max); port++ {
+			if usesNodePort(s.Ports, uint16(port), p.Protocol, i) {
+				continue
+			}
+			if _, ok := nm.hostPortOwner(uint16(port), p.Protocol, s.Name); ok {
+				continue
+			}
+			if checkHostPortFree(uint16(port), p.Protocol) == nil {
+				p.NodePort = uint16(port)
+			}
+		}
+		if p.NodePort == 0 {
+			return fmt.Errorf("%w: service %s: no free node port in %s", ErrPortInUse, s.Name, r)
+		}
+	}
+	s.setFirstPort()
+	return nil
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestValidateNodePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		r       PortRange
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "range", r: PortRange{Min: 30000, Max: 30100}},
+		{name: "single port", r: PortRange{Min: 30000, Max: 30000}},
+		{name: "from zero", r: PortRange{Max: 100}, wantErr: true},
+		{name: "reversed", r: PortRange{Min: 30100, Max: 30000}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNodePorts(tt.r)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validateNodePorts() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validateNodePorts() = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
+
+// listenBelowEphemeral listens on a TCP port below the ephemeral range
+// whose next n ports are free, so that ports the kernel hands to other
+// tests meanwhile don't land among them
+func listenBelowEphemeral(t *testing.T, n int) net.Listener {
+	t.Helper()
+	for port := 20000; port < 32000; port += n + 1 {
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		free := true
+		for p := port + 1; p <= port+n && free; p++ {
+			free = checkHostPortFree(uint16(p), "tcp") == nil && checkHostPortFree(uint16(p), "udp") == nil
+		}
+		if free {
+			return l
+		}
+		l.Close()
+	}
+	t.Skip("no free ports below the ephemeral range")
+	return nil
+}
+
+func TestAssignNodePorts(t *testing.T) {
+	// A port a host process listens on, which no service may take
+	l := listenBelowEphemeral(t, 5)
+	defer l.Close()
+	busy := uint16(l.Addr().(*net.TCPAddr).Port)
+
+	web := Service{Name: "web", ExposeNodePort: true, Ports: []ServicePort{
+		{Name: "http", Port: 80, Protocol: "tcp", NodePort: busy + 1},
+		{Name: "https", Port: 443, Protocol: "tcp", NodePort: busy + 4},
+	}}
+	nm := &NetworkManager{
+		config: NetworkConfig{NodePorts: PortRange{Min: busy, Max: busy + 5}},
+		containers: map[string]*ContainerNetwork{
+			"c1": {ContainerID: "c1", Ports: []PortForward{{ContainerID: "c1", HostPort: busy + 2, Protocol: "tcp"}}},
+		},
+		services: map[string]Service{"web": web},
+	}
+	port := func(name, protocol string, nodePort uint16) ServicePort {
+		return ServicePort{Name: name, Port: 8000, Protocol: protocol, NodePort: nodePort}
+	}
+	tests := []struct {
+		name    string
+		service string
+		ports   []ServicePort
+		exists  bool
+		want    []uint16
+		wantErr error
+	}{
+		{name: "first free", service: "api", ports: []ServicePort{port("", "tcp", 0)}, want: []uint16{busy + 3}},
+		{name: "each port its own", service: "api", ports: []ServicePort{port("a", "tcp", 0), port("b", "tcp", 0)},
+			want: []uint16{busy + 3, busy + 5}},
+		{name: "requested port skipped", service: "api", ports: []ServicePort{port("a", "tcp", 0), port("b", "tcp", busy+3)},
+			want: []uint16{busy + 5, busy + 3}},
+		{name: "other protocol", service: "dns", ports: []ServicePort{port("", "udp", busy+1)}, want: []uint16{busy + 1}},
+		{name: "kept on replace", service: "web", ports: []ServicePort{port("https", "tcp", 0), port("http", "tcp", 0)}, exists: true,
+			want: []uint16{busy + 4, busy + 1}},
+		{name: "new port on replace", service: "web", ports: []ServicePort{port("http", "tcp", 0), port("admin", "tcp", 0)}, exists: true,
+			want: []uint16{busy + 1, busy + 3}},
+		{name: "outside range", service: "api", ports: []ServicePort{port("", "tcp", busy+6)}, wantErr: ErrInvalidService},
+		{name: "taken by service", service: "api", ports: []ServicePort{port("", "tcp", busy+1)}, wantErr: ErrPortInUse},
+		{name: "taken by forward", service: "api", ports: []ServicePort{port("", "tcp", busy+2)}, wantErr: ErrPortInUse},
+		{name: "taken by host", service: "api", ports: []ServicePort{port("", "tcp", busy)}, wantErr: ErrPortInUse},
+		{name: "kept taken by request", service: "web", ports: []ServicePort{port("http", "tcp", 0), port("admin", "tcp", busy+1)},
+			exists: true, want: []uint16{busy + 3, busy + 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Service{Name: tt.service, ExposeNodePort: true, Ports: slices.Clone(tt.ports)}
+			var old Service
+			if tt.exists {
+				old = nm.services[tt.service]
+			}
+			err := nm.assignNodePorts(&s, old, tt.exists)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("assignNodePorts() = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got []uint16
+			for _, p := range s.Ports {
+				got = append(got, p.NodePort)
+			}
+			if !slices.Equal(got, tt.want) || s.NodePort != tt.want[0] {
+				t.Errorf("node ports %v, first %d, want %v", got, s.NodePort, tt.want)
+			}
+		})
+	}
+
+	// Services not exposed get none
+	s := Service{Name: "api", Ports: []ServicePort{port("", "tcp", 0)}}
+	if err := nm.assignNodePorts(&s, Service{}, false); err != nil || s.Ports[0].NodePort != 0 {
+		t.Errorf("unexposed service got node port %d, %v", s.Ports[0].NodePort, err)
+	}
+}
+
+func TestHostPortOwner(t *testing.T) {
+	nm := &NetworkManager{
+		containers: map[string]*ContainerNetwork{
+			"c1": {ContainerID: "c1", Ports: []PortForward{{ContainerID: "c1", HostPort: 8080, Protocol: "tcp"}}},
+		},
+		services: map[string]Service{
+			"web": {Name: "web", ExposeNodePort: true, Ports: []ServicePort{
+				{Name: "http", Protocol: "tcp", NodePort: 30080},
+				{Name: "https", Protocol: "tcp", NodePort: 30443},
+			}},
+		},
+	}
+	tests := []struct {
+		name     string
+		port     uint16
+		protocol string
+		service  string
+		want     string
+	}{
+		{name: "forward", port: 8080, protocol: "tcp", want: "forwarded to c1"},
+		{name: "node port", port: 30080, protocol: "tcp", want: "the node port of service web"},
+		{name: "second node port", port: 30443, protocol: "tcp", want: "the node port of service web"},
+		{name: "own node port", port: 30080, protocol: "tcp", service: "web"},
+		{name: "other protocol", port: 30080, protocol: "udp"},
+		{name: "free", port: 30081, protocol: "tcp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nm.hostPortOwner(tt.port, tt.protocol, tt.service)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("hostPortOwner() = %q, %t, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// ErrInvalidRoute is returned for node routes that are malformed or
+// conflict with other routes or the containers of this node
+var ErrInvalidRoute = errors.New("network: invalid route")
+
+// PrefixRoute forwards the traffic to a prefix out of an interface of
+// this node, e.g. the subnet of another node into a tunnel to it, or the
+// addresses an egress gateway serves toward the gateway. The XDP router
+// takes the longest prefix that matches, so a container of this node wins
+// over the routes covering its address.
+type PrefixRoute struct {
+	Prefix netip.Prefix `json:"prefix"`
+	// Interface is where packets to Prefix leave this node
+	Interface string `json:"interface"`
+	// MAC is the next hop's on Interface, which frames are readdressed
+	// to. Without it they take the kernel stack, which routes them itself.
+	MAC string `json:"mac"`
+	// MTU is the largest packet forwarded, larger ones take the kernel
+	// stack; 0 is Interface's
+	MTU int `json:"mtu"`
+}
+
+// UpdateNodeRoutes replaces the prefix routes of node, e.g. a peer or an
+// egress gateway, with routes, and removes them all when routes is empty.
+// Routes are not persisted; like peers, the control plane is expected to
+// sync them after a restart. Routes need the XDP router, failing with
+// ErrXDPInactive without it.
+func (nm *NetworkManager) UpdateNodeRoutes(node string, routes []PrefixRoute) error {
+	return nm.BulkUpdateRoutes(map[string][]PrefixRoute{node: routes})
+}
+
+// BulkUpdateRoutes applies UpdateNodeRoutes to each node of updates at
+// once, writing the route changes in batches. Nothing is changed when any
+// route is invalid.
+func (nm *NetworkManager) BulkUpdateRoutes(updates map[string][]PrefixRoute) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.xdp == nil {
+		return ErrXDPInactive
+	}
+	next, err := nm.checkNodeRoutes(updates)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRoute, err)
+	}
+	if err := nm.programNodeRoutes(next); err != nil {
+		return fmt.Errorf("failed to program node routes: %w", err)
+	}
+	nm.nodeRoutes = next
+	nm.log.Info("Updated node routes", "nodes", len(updates))
+	return nil
+}
+
+// NodeRoutes returns the prefix routes by node
+func (nm *NetworkManager) NodeRoutes() map[string][]PrefixRoute {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	out := make(map[string][]PrefixRoute, len(nm.nodeRoutes))
+	for node, routes := range nm.nodeRoutes {
+		out[node] = append([]PrefixRoute(nil), routes...)
+	}
+	return out
+}
+
+// checkNodeRoutes returns the node routes with updates applied, with
+// canonical prefixes sorted by node. No two nodes can take the same
+// prefix, and no host prefix within the pools of this node, where it
+// would take the place of a container's route. Callers must hold nm.mu.
+func (nm *NetworkManager) checkNodeRoutes(updates map[string][]PrefixRoute) (map[string][]PrefixRoute, error) {
+	next := make(map[string][]PrefixRoute, len(nm.nodeRoutes)+len(updates))
+	for node, routes := range nm.nodeRoutes {
+		next[node] = routes
+	}
+	for node, routes := range updates {
+		if node == "" {
+			return nil, errors.New("node name is required")
+		}
+		if len(routes) == 0 {
+			delete(next, node)
+			continue
+		}
+		checked := make([]PrefixRoute, 0, len(routes))
+		for _, r := range routes {
+			r, err := nm.checkNodeRoute(r)
+			if err != nil {
+				return nil, fmt.Errorf("node %s: %w", node, err)
+			}
+			checked = append(checked, r)
+		}
+		sort.Slice(checked, func(i, j int) bool { return lessPrefix(checked[i].Prefix, checked[j].Prefix) })
+		next[node] = checked
+	}
+
+	owners := make(map[netip.Prefix]string)
+	nodes := make([]string, 0, len(next))
+	for node := range next {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		for _, r := range next[node] {
+			if other, ok := owners[r.Prefix]; ok {
+				if other == node {
+					return nil, fmt.Errorf("node %s routes %s twice", node, r.Prefix)
+				}
+				return nil, fmt.Errorf("node %s: %s is routed to node %s", node, r.Prefix, other)
+			}
+			owners[r.Prefix] = node
+		}
+	}
+	return next, nil
+}
+
+// checkNodeRoute checks r and returns it with its prefix masked
+func (nm *NetworkManager) checkNodeRoute(r PrefixRoute) (PrefixRoute, error) {
+	if !r.Prefix.IsValid() {
+		return r, errors.New("route without a prefix")
+	}
+	r.Prefix = r.Prefix.Masked()
+	if r.Interface == "" {
+		return r, fmt.Errorf("route to %s has no interface", r.Prefix)
+	}
+	if r.MAC != "" {
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil || len(mac) != 6 {
+			return r, fmt.Errorf("route to %s: invalid MAC %q", r.Prefix, r.MAC)
+		}
+		r.MAC = mac.String()
+	}
+	if r.MTU < 0 {
+		return r, fmt.Errorf("route to %s: invalid MTU %d", r.Prefix, r.MTU)
+	}
+	if r.Prefix.IsSingleIP() {
+		for _, pool := range nm.pools {
+			if pool.prefix.Contains(r.Prefix.Addr()) {
+				return r, fmt.Errorf("%s is in %s, where containers of this node are routed", r.Prefix, pool.prefix)
+			}
+		}
+	}
+	return r, nil
+}
+
+func lessPrefix(a, b netip.Prefix) bool {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c < 0
+	}
+	return a.Bits() < b.Bits()
+}
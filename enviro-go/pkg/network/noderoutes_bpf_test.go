@@ -0,0 +1,246 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// loadRouteRouter loads the embedded XDP router, unattached
+func loadRouteRouter(t *testing.T) *xdpProgram {
+	t.Helper()
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		t.Fatal(err)
+	}
+	trimPrograms(spec, []DatapathMode{DatapathXDPNative})
+	coll, err := ebpf.NewCollection(spec)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("loading eBPF not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(coll.Close)
+	x := &xdpProgram{mode: DatapathXDPNative, modes: []DatapathMode{DatapathXDPNative}}
+	x.setCollection(coll)
+	return x
+}
+
+// nodeRouteInfo is a prefix route out of ifindex to the next hop at mac
+func nodeRouteInfo(ifindex uint32, mac net.HardwareAddr) containerInfo {
+	info := containerInfo{Ifindex: ifindex, Flags: containerPrefix | containerMACSet}
+	copy(info.MAC[:], mac)
+	copy(info.HostMAC[:], net.HardwareAddr{0x02, 0, 0, 0, 0, 0xee})
+	return info
+}
+
+// routeVerdict runs the router on a UDP packet from src to dst, returning
+// its verdict and the destination MAC of the frame it left
+func routeVerdict(t *testing.T, x *xdpProgram, src, dst netip.Addr) (uint32, net.HardwareAddr) {
+	t.Helper()
+	ret, out, err := x.coll.Programs[routerProgram].Test(ipFrame(src, dst, unix.IPPROTO_UDP, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret, net.HardwareAddr(out[:6])
+}
+
+// TestRouteLongestPrefix routes a container's address inside the subnet
+// of another node, inside a gateway's wider prefix, and checks each
+// packet takes the longest route covering it, as routes come and go
+func TestRouteLongestPrefix(t *testing.T) {
+	x := loadRouteRouter(t)
+	containerMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	hostMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	nodeMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x24}
+	gatewayMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x16}
+	container4, container6 := netip.MustParseAddr("10.88.1.5"), netip.MustParseAddr("fd00:0:0:1::5")
+	if err := x.AddContainer(testIfindex, []netip.Addr{container4, container6}, containerMAC, hostMAC, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	routes := map[netip.Prefix]net.HardwareAddr{
+		netip.MustParsePrefix("10.88.1.0/24"):    nodeMAC,
+		netip.MustParsePrefix("10.88.0.0/16"):    gatewayMAC,
+		netip.MustParsePrefix("fd00:0:0:1::/64"): nodeMAC,
+		netip.MustParsePrefix("fd00::/48"):       gatewayMAC,
+		netip.MustParsePrefix("10.99.0.7/32"):    gatewayMAC,
+		netip.MustParsePrefix("fd00:99::7/128"):  gatewayMAC,
+	}
+	x.BatchRoutes()
+	for prefix, mac := range routes {
+		if err := x.putRoute(prefix, nodeRouteInfo(2, mac)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := x.FlushRoutes(); err != nil {
+		t.Fatal(err)
+	}
+
+	peer4, peer6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+	check := func(step string, dst netip.Addr, wantVerdict uint32, wantMAC net.HardwareAddr) {
+		t.Helper()
+		src := peer4
+		if dst.Is6() {
+			src = peer6
+		}
+		ret, mac := routeVerdict(t, x, src, dst)
+		if ret != wantVerdict || wantMAC != nil && !bytes.Equal(mac, wantMAC) {
+			t.Errorf("%s: packet to %s = verdict %d to %s, want %d to %s", step, dst, ret, mac, wantVerdict, wantMAC)
+		}
+	}
+	for _, tt := range []struct {
+		dst     string
+		verdict uint32
+		mac     net.HardwareAddr
+	}{
+		{"10.88.1.5", xdpRedirect, containerMAC},
+		{"10.88.1.9", xdpRedirect, nodeMAC},
+		{"10.88.2.9", xdpRedirect, gatewayMAC},
+		{"10.99.0.7", xdpRedirect, gatewayMAC},
+		{"10.99.0.8", xdpPass, nil},
+		{"fd00:0:0:1::5", xdpRedirect, containerMAC},
+		{"fd00:0:0:1::9", xdpRedirect, nodeMAC},
+		{"fd00:0:0:2::9", xdpRedirect, gatewayMAC},
+		{"fd00:99::7", xdpRedirect, gatewayMAC},
+		{"fd00:98::7", xdpPass, nil},
+	} {
+		check("all routes", netip.MustParseAddr(tt.dst), tt.verdict, tt.mac)
+	}
+
+	// Without the node's subnet, its addresses fall back to the gateway
+	for _, p := range []string{"10.88.1.0/24", "fd00:0:0:1::/64"} {
+		if err := x.deleteRoute(netip.MustParsePrefix(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("without the subnet", netip.MustParseAddr("10.88.1.9"), xdpRedirect, gatewayMAC)
+	check("without the subnet", netip.MustParseAddr("fd00:0:0:1::9"), xdpRedirect, gatewayMAC)
+	check("without the subnet", container4, xdpRedirect, containerMAC)
+	// Without the container, so does its address
+	if err := x.DeleteContainer(testIfindex, []netip.Addr{container4, container6}); err != nil {
+		t.Fatal(err)
+	}
+	check("without the container", container4, xdpRedirect, gatewayMAC)
+	check("without the container", container6, xdpRedirect, gatewayMAC)
+}
+
+// TestRouteARP checks the router only answers ARP for the containers of
+// this node, not for the addresses its prefix routes cover
+func TestRouteARP(t *testing.T) {
+	x := loadRouteRouter(t)
+	routerMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x10}
+	if err := x.coll.Maps["router_mac"].Put(uint32(0), ifaceMAC{Addr: [6]byte(routerMAC)}); err != nil {
+		t.Fatal(err)
+	}
+	container := netip.MustParseAddr("10.88.1.5")
+	mac, hostMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	if err := x.AddContainer(testIfindex, []netip.Addr{container}, mac, hostMAC, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.putRoute(netip.MustParsePrefix("10.88.1.0/24"), nodeRouteInfo(2, mac)); err != nil {
+		t.Fatal(err)
+	}
+
+	asker := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x99}
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	for _, tt := range []struct {
+		target string
+		want   uint32
+	}{
+		{"10.88.1.5", xdpTX},
+		{"10.88.1.9", xdpPass},
+	} {
+		frame := arpFrame(broadcast, asker, 1, asker, netip.MustParseAddr("10.88.1.1"), netip.MustParseAddr(tt.target))
+		ret, _, err := x.coll.Programs[routerProgram].Test(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret != tt.want {
+			t.Errorf("ARP request for %s = verdict %d, want %d", tt.target, ret, tt.want)
+		}
+	}
+}
+
+// upgradeLink stands in for the XDP link of a router under upgrade
+type upgradeLink struct {
+	prog *ebpf.Program
+}
+
+func (l *upgradeLink) Update(prog *ebpf.Program) error {
+	l.prog = prog
+	return nil
+}
+
+func (l *upgradeLink) Close() error { return nil }
+
+// TestUpgradeMigratesRoutes upgrades a router whose routes are hashes
+// keyed by container address, as before prefix routes, and checks the
+// new router routes to the containers they held
+func TestUpgradeMigratesRoutes(t *testing.T) {
+	old4, err := ebpf.NewMap(&ebpf.MapSpec{Name: "container_routes", Type: ebpf.Hash, KeySize: 4,
+		ValueSize: containerInfoSize, MaxEntries: 16})
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("creating eBPF maps not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	old6, err := ebpf.NewMap(&ebpf.MapSpec{Name: "container_routes6", Type: ebpf.Hash, KeySize: 16,
+		ValueSize: containerInfoSize, MaxEntries: 16})
+	if err != nil {
+		old4.Close()
+		t.Fatal(err)
+	}
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	info := containerInfo{Ifindex: testIfindex, Flags: containerMACSet}
+	copy(info.MAC[:], mac)
+	container4, container6 := netip.MustParseAddr("10.88.1.5"), netip.MustParseAddr("fd00:1::5")
+	if err := old4.Put(container4.As4(), info); err != nil {
+		t.Fatal(err)
+	}
+	if err := old6.Put(container6.As16(), info); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &upgradeLink{}
+	x := &xdpProgram{
+		coll:  &ebpf.Collection{Maps: map[string]*ebpf.Map{"container_routes": old4, "container_routes6": old6}},
+		link:  l,
+		mode:  DatapathXDPNative,
+		modes: []DatapathMode{DatapathXDPNative},
+	}
+	if err := x.Upgrade(spec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(x.coll.Close)
+	if l.prog != x.coll.Programs[routerProgram] {
+		t.Fatal("Upgrade() didn't switch the link to the new router")
+	}
+	if typ := x.routes.Type(); typ != ebpf.LPMTrie {
+		t.Fatalf("routes are a %s after the upgrade, want an LPM trie", typ)
+	}
+	for _, dst := range []netip.Addr{container4, container6} {
+		src := netip.MustParseAddr("192.0.2.1")
+		if dst.Is6() {
+			src = netip.MustParseAddr("2001:db8::1")
+		}
+		if ret, got := routeVerdict(t, x, src, dst); ret != xdpRedirect || !bytes.Equal(got, mac) {
+			t.Errorf("packet to %s after the upgrade = verdict %d to %s, want %d to %s", dst, ret, got, xdpRedirect, mac)
+		}
+	}
+}
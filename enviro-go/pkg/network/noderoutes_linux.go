@@ -0,0 +1,69 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+)
+
+// programNodeRoutes programs next in place of nm.nodeRoutes in batches:
+// the routes of prefixes next leaves out are deleted, and those that
+// changed put. Callers must hold nm.mu.
+func (nm *NetworkManager) programNodeRoutes(next map[string][]PrefixRoute) error {
+	current := make(map[netip.Prefix]PrefixRoute)
+	for _, routes := range nm.nodeRoutes {
+		for _, r := range routes {
+			current[r.Prefix] = r
+		}
+	}
+	puts := make(map[netip.Prefix]containerInfo)
+	for _, routes := range next {
+		for _, r := range routes {
+			if old, ok := current[r.Prefix]; ok && old == r {
+				delete(current, r.Prefix)
+				continue
+			}
+			delete(current, r.Prefix)
+			info, err := prefixRouteInfo(r)
+			if err != nil {
+				return err
+			}
+			puts[r.Prefix] = info
+		}
+	}
+
+	flush := nm.batchRoutes()
+	var errs []error
+	for prefix := range current {
+		errs = append(errs, nm.xdp.deleteRoute(prefix))
+	}
+	for prefix, info := range puts {
+		errs = append(errs, nm.xdp.putRoute(prefix, info))
+	}
+	return errors.Join(append(errs, flush())...)
+}
+
+// prefixRouteInfo returns the route to the interface of r, addressing
+// frames from it to the MAC of r when r has one
+func prefixRouteInfo(r PrefixRoute) (containerInfo, error) {
+	link, err := netlink.LinkByName(r.Interface)
+	if err != nil {
+		return containerInfo{}, fmt.Errorf("route to %s: failed to find interface %s: %w", r.Prefix, r.Interface, err)
+	}
+	attrs := link.Attrs()
+	info := containerInfo{Ifindex: uint32(attrs.Index), Flags: containerPrefix, MTU: uint32(r.MTU)}
+	if r.MTU == 0 {
+		info.MTU = uint32(attrs.MTU)
+	}
+	if mac, err := net.ParseMAC(r.MAC); err == nil && len(attrs.HardwareAddr) == 6 {
+		info.Flags |= containerMACSet
+		copy(info.MAC[:], mac)
+		copy(info.HostMAC[:], attrs.HardwareAddr)
+	}
+	return info, nil
+}
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestCheckNodeRoutes(t *testing.T) {
+	pool, err := newIPAllocator("10.88.1.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm := &NetworkManager{
+		pools: []*ipAllocator{pool},
+		nodeRoutes: map[string][]PrefixRoute{
+			"b": {{Prefix: netip.MustParsePrefix("10.88.2.0/24"), Interface: "enviro.vxlan"}},
+			"c": {{Prefix: netip.MustParsePrefix("10.88.3.0/24"), Interface: "enviro.vxlan"}},
+		},
+	}
+	route := func(prefix string) PrefixRoute {
+		return PrefixRoute{Prefix: netip.MustParsePrefix(prefix), Interface: "eth0"}
+	}
+
+	tests := []struct {
+		name    string
+		updates map[string][]PrefixRoute
+		// want are the prefixes by node after the updates, or err an
+		// error they fail with
+		want map[string][]string
+		err  string
+	}{
+		{
+			name:    "add",
+			updates: map[string][]PrefixRoute{"gw": {route("10.0.0.0/8"), route("192.0.2.0/24")}},
+			want:    map[string][]string{"b": {"10.88.2.0/24"}, "c": {"10.88.3.0/24"}, "gw": {"10.0.0.0/8", "192.0.2.0/24"}},
+		},
+		{
+			// The longest prefix wins in the datapath
+			name:    "overlapping prefixes",
+			updates: map[string][]PrefixRoute{"gw": {route("10.88.0.0/16"), route("10.88.2.7/32")}},
+			want: map[string][]string{"b": {"10.88.2.0/24"}, "c": {"10.88.3.0/24"},
+				"gw": {"10.88.0.0/16", "10.88.2.7/32"}},
+		},
+		{
+			name:    "masked",
+			updates: map[string][]PrefixRoute{"b": {route("10.88.2.9/24")}},
+			want:    map[string][]string{"b": {"10.88.2.0/24"}, "c": {"10.88.3.0/24"}},
+		},
+		{
+			name:    "remove",
+			updates: map[string][]PrefixRoute{"b": nil},
+			want:    map[string][]string{"c": {"10.88.3.0/24"}},
+		},
+		{
+			name:    "move a prefix",
+			updates: map[string][]PrefixRoute{"b": nil, "d": {route("10.88.2.0/24")}},
+			want:    map[string][]string{"c": {"10.88.3.0/24"}, "d": {"10.88.2.0/24"}},
+		},
+		{
+			name:    "prefix of another node",
+			updates: map[string][]PrefixRoute{"d": {route("10.88.3.0/24")}},
+			err:     "10.88.3.0/24 is routed to node c",
+		},
+		{
+			name:    "prefix twice",
+			updates: map[string][]PrefixRoute{"d": {route("10.77.0.0/16"), route("10.77.1.0/16")}},
+			err:     "node d routes 10.77.0.0/16 twice",
+		},
+		{
+			name:    "container address",
+			updates: map[string][]PrefixRoute{"d": {route("10.88.1.5/32")}},
+			err:     "where containers of this node are routed",
+		},
+		{
+			name:    "no interface",
+			updates: map[string][]PrefixRoute{"d": {{Prefix: netip.MustParsePrefix("10.77.0.0/16")}}},
+			err:     "has no interface",
+		},
+		{
+			name:    "bad MAC",
+			updates: map[string][]PrefixRoute{"d": {{Prefix: netip.MustParsePrefix("10.77.0.0/16"), Interface: "eth0", MAC: "02:00"}}},
+			err:     "invalid MAC",
+		},
+		{
+			name:    "no node",
+			updates: map[string][]PrefixRoute{"": {route("10.77.0.0/16")}},
+			err:     "node name is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nm.checkNodeRoutes(tt.updates)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("checkNodeRoutes() = %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("checkNodeRoutes() = %v, want %v", got, tt.want)
+			}
+			for node, prefixes := range tt.want {
+				routes := got[node]
+				if len(routes) != len(prefixes) {
+					t.Fatalf("node %s has routes %v, want %v", node, routes, prefixes)
+				}
+				for i, r := range routes {
+					if r.Prefix.String() != prefixes[i] {
+						t.Errorf("node %s route %d = %s, want %s", node, i, r.Prefix, prefixes[i])
+					}
+				}
+			}
+		})
+	}
+	if len(nm.nodeRoutes) != 2 {
+		t.Errorf("checkNodeRoutes() changed the routes in use: %v", nm.nodeRoutes)
+	}
+}
+
+func TestUpdateNodeRoutesWithoutXDP(t *testing.T) {
+	nm := &NetworkManager{nodeRoutes: make(map[string][]PrefixRoute)}
+	err := nm.UpdateNodeRoutes("b", []PrefixRoute{{Prefix: netip.MustParsePrefix("10.88.2.0/24"), Interface: "eth0"}})
+	if !errors.Is(err, ErrXDPInactive) {
+		t.Errorf("UpdateNodeRoutes() without XDP = %v, want %v", err, ErrXDPInactive)
+	}
+}
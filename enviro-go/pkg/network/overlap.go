@@ -0,0 +1,228 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// sourcedPrefix is a network and where it came from, e.g. "cidr" or
+// "route via eth0", so overlaps can name both sides
+type sourcedPrefix struct {
+	Prefix netip.Prefix
+	Source string
+}
+
+// CIDROverlap is a network of the configuration that overlaps another
+// network of the configuration or of the host. Overlapping networks
+// blackhole the traffic of one of them.
+type CIDROverlap struct {
+	// Prefix and Source are the network of the configuration and its
+	// field, e.g. "cidr"
+	Prefix netip.Prefix `json:"prefix"`
+	Source string       `json:"source"`
+	// Other and OtherSource are the network it overlaps and where that came
+	// from, e.g. "service_cidr", "address on eth0" or "route via eth0"
+	Other       netip.Prefix `json:"other"`
+	OtherSource string       `json:"other_source"`
+}
+
+// String tells which networks overlap and how, e.g. "cidr 10.88.0.0/16
+// contains 10.88.1.0/24 of route via eth0"
+func (o CIDROverlap) String() string {
+	how := "overlaps"
+	switch {
+	case o.Prefix == o.Other:
+		how = "is"
+	case o.Prefix.Bits() < o.Other.Bits():
+		how = "contains"
+	case o.Prefix.Bits() > o.Other.Bits():
+		how = "is within"
+	}
+	return fmt.Sprintf("%s %s %s %s of %s", o.Source, o.Prefix, how, o.Other, o.OtherSource)
+}
+
+// configPrefixes returns the container networks and service CIDRs of c,
+// which must parse
+func (c NetworkConfig) configPrefixes() []sourcedPrefix {
+	var out []sourcedPrefix
+	for _, f := range []struct{ cidr, source string }{
+		{c.CIDR, "cidr"}, {c.CIDR6, "cidr6"}, {c.ServiceCIDR, "service_cidr"}, {c.ServiceCIDR6, "service_cidr6"},
+	} {
+		if f.cidr != "" {
+			out = append(out, sourcedPrefix{netip.MustParsePrefix(f.cidr).Masked(), f.source})
+		}
+	}
+	return out
+}
+
+// serviceCIDR returns the service CIDR of the family of vip, if set
+func (c NetworkConfig) serviceCIDR(vip netip.Addr) (netip.Prefix, bool) {
+	cidr := c.ServiceCIDR
+	if vip.Is6() {
+		cidr = c.ServiceCIDR6
+	}
+	if cidr == "" {
+		return netip.Prefix{}, false
+	}
+	return netip.MustParsePrefix(cidr).Masked(), true
+}
+
+// validateServiceCIDRs checks that ServiceCIDR and ServiceCIDR6 are
+// networks of their family
+func (c NetworkConfig) validateServiceCIDRs() error {
+	for _, f := range []struct {
+		cidr, source string
+		v6           bool
+	}{{c.ServiceCIDR, "service_cidr", false}, {c.ServiceCIDR6, "service_cidr6", true}} {
+		if f.cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(f.cidr)
+		if err != nil {
+			return fmt.Errorf("%w: %s %q: %v", ErrInvalidCIDR, f.source, f.cidr, err)
+		}
+		if prefix.Addr().Is6() != f.v6 || prefix.Addr().Is4In6() {
+			return fmt.Errorf("%w: %s %s is not of the expected family", ErrInvalidCIDR, f.source, prefix)
+		}
+	}
+	return nil
+}
+
+// findOverlaps returns the overlaps among prefixes, and of prefixes with
+// others, in order
+func findOverlaps(prefixes, others []sourcedPrefix) []CIDROverlap {
+	var out []CIDROverlap
+	for i, p := range prefixes {
+		for _, o := range append(slices.Clone(prefixes[i+1:]), others...) {
+			if p.Prefix.Overlaps(o.Prefix) {
+				out = append(out, CIDROverlap{Prefix: p.Prefix, Source: p.Source, Other: o.Prefix, OtherSource: o.Source})
+			}
+		}
+	}
+	return out
+}
+
+// overlapError joins overlaps into an error wrapping ErrInvalidCIDR
+func overlapError(overlaps []CIDROverlap) error {
+	msgs := make([]string, len(overlaps))
+	for i, o := range overlaps {
+		msgs[i] = o.String()
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidCIDR, strings.Join(msgs, "; "))
+}
+
+// hostNetworks returns the networks of the host's interface addresses and
+// routes. Those of the manager's own devices are left out, as are
+// single-host ones, which cover the gateways and routes of container
+// veths, and loopback, link-local and default ones.
+func hostNetworks() ([]sourcedPrefix, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host interfaces: %w", err)
+	}
+	var out []sourcedPrefix
+	for _, iface := range ifaces {
+		if ownDevice(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses of %s: %w", iface.Name, err)
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipnet.IP)
+			if !ok {
+				continue
+			}
+			ones, _ := ipnet.Mask.Size()
+			if prefix := netip.PrefixFrom(ip.Unmap(), ones).Masked(); hostNetwork(prefix) {
+				out = append(out, sourcedPrefix{prefix, "address on " + iface.Name})
+			}
+		}
+	}
+	routes, err := hostRoutes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host routes: %w", err)
+	}
+	return append(out, routes...), nil
+}
+
+// hostNetwork reports whether prefix, of an address or route of the host,
+// can shadow a network of the configuration
+func hostNetwork(prefix netip.Prefix) bool {
+	addr := prefix.Addr()
+	return prefix.IsValid() && prefix.Bits() > 0 && !prefix.IsSingleIP() &&
+		!addr.IsLoopback() && !addr.IsLinkLocalUnicast() && !addr.IsMulticast()
+}
+
+// ownDevice reports whether the interface name is one a manager of any
+// instance creates for containers or the overlay, whose networks are
+// those of a configuration
+func ownDevice(name string) bool {
+	return name == overlayDevice || name == wireGuardDevice || isAnyHostVethName(name)
+}
+
+// checkHostOverlap fails when a network of the host overlaps one of
+// prefixes, whose routes would shadow the host's or be shadowed by them
+func checkHostOverlap(prefixes []sourcedPrefix) error {
+	host, err := hostNetworks()
+	if err != nil {
+		return err
+	}
+	if overlaps := overlapsWithHost(prefixes, host); len(overlaps) > 0 {
+		return overlapError(overlaps)
+	}
+	return nil
+}
+
+// overlapsWithHost returns the overlaps of prefixes with the networks of
+// the host
+func overlapsWithHost(prefixes, host []sourcedPrefix) []CIDROverlap {
+	var out []CIDROverlap
+	for _, p := range prefixes {
+		out = append(out, findOverlaps([]sourcedPrefix{p}, host)...)
+	}
+	return out
+}
+
+// CIDROverlaps returns the networks of the host overlapping the container
+// networks or service CIDRs since the manager started, e.g. of a route
+// added later, as last checked. Degraded nodes blackhole the traffic of
+// one side of each.
+func (nm *NetworkManager) CIDROverlaps() []CIDROverlap {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return slices.Clone(nm.overlaps)
+}
+
+// checkOverlaps compares the networks of the host with the configuration,
+// logging overlaps as they appear and disappear
+func (nm *NetworkManager) checkOverlaps() {
+	host, err := hostNetworks()
+	if err != nil {
+		nm.log.Warn("Failed to check host networks for overlaps", "error", err)
+		return
+	}
+	overlaps := overlapsWithHost(nm.config.configPrefixes(), host)
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	for _, o := range overlaps {
+		if !slices.Contains(nm.overlaps, o) {
+			nm.log.Warn("Host network overlaps the configuration, traffic may be blackholed", "overlap", o.String())
+		}
+	}
+	for _, o := range nm.overlaps {
+		if !slices.Contains(overlaps, o) {
+			nm.log.Info("Host network no longer overlaps the configuration", "overlap", o.String())
+		}
+	}
+	nm.overlaps = overlaps
+}
@@ -0,0 +1,111 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// overlapSettle is how long the overlap watcher waits for more changes
+// after a route or address changed, as they come in bursts, e.g. when an
+// interface comes up
+const overlapSettle = 200 * time.Millisecond
+
+// hostRoutes returns the networks routed by the main table, but through
+// the manager's own devices
+func hostRoutes() ([]sourcedPrefix, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	var out []sourcedPrefix
+	for _, r := range routes {
+		if r.Dst == nil {
+			continue
+		}
+		prefix, ok := ipNetPrefix(r.Dst)
+		if !ok || !hostNetwork(prefix) {
+			continue
+		}
+		source := "route"
+		if iface, err := net.InterfaceByIndex(r.LinkIndex); err == nil {
+			if ownDevice(iface.Name) {
+				continue
+			}
+			source += " via " + iface.Name
+		} else if r.Gw != nil {
+			source += " via " + r.Gw.String()
+		}
+		out = append(out, sourcedPrefix{prefix, source})
+	}
+	return out, nil
+}
+
+// ipNetPrefix converts n to a masked prefix
+func ipNetPrefix(n *net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(n.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ones, _ := n.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones).Masked(), true
+}
+
+// startOverlapWatch checks the host networks for overlaps with the
+// configuration whenever its routes or addresses change, until
+// stopOverlapWatch
+func (nm *NetworkManager) startOverlapWatch() {
+	nm.overlapStop = make(chan struct{})
+	nm.overlapDone = make(chan struct{})
+	routes := make(chan netlink.RouteUpdate, 64)
+	addrs := make(chan netlink.AddrUpdate, 64)
+	onError := func(err error) {
+		nm.log.Warn("Failed to watch host networks for overlaps", "error", err)
+	}
+	if err := netlink.RouteSubscribeWithOptions(routes, nm.overlapStop, netlink.RouteSubscribeOptions{ErrorCallback: onError}); err != nil {
+		onError(err)
+		routes = nil
+	}
+	if err := netlink.AddrSubscribeWithOptions(addrs, nm.overlapStop, netlink.AddrSubscribeOptions{ErrorCallback: onError}); err != nil {
+		onError(err)
+		addrs = nil
+	}
+	go func() {
+		defer close(nm.overlapDone)
+		settle := time.NewTimer(0)
+		defer settle.Stop()
+		for {
+			select {
+			case _, ok := <-routes:
+				if !ok {
+					routes = nil
+				}
+				settle.Reset(overlapSettle)
+			case _, ok := <-addrs:
+				if !ok {
+					addrs = nil
+				}
+				settle.Reset(overlapSettle)
+			case <-settle.C:
+				nm.checkOverlaps()
+			case <-nm.overlapStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopOverlapWatch waits for the watcher started by startOverlapWatch to
+// end
+func (nm *NetworkManager) stopOverlapWatch() {
+	if nm.overlapStop == nil {
+		return
+	}
+	close(nm.overlapStop)
+	<-nm.overlapDone
+	nm.overlapStop = nil
+}
@@ -0,0 +1,139 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// overlapTestEnv has a child of TestCIDROverlaps run the test in the
+// network namespace of its own it was started in
+const overlapTestEnv = "ENVIRO_TEST_OVERLAPS"
+
+// TestCIDROverlaps adds networks overlapping the container network to the
+// host, before and after the manager starts, and checks that they are
+// rejected and reported. It runs in a child in a network namespace of its
+// own, so the routes stay off the host.
+func TestCIDROverlaps(t *testing.T) {
+	if os.Getenv(overlapTestEnv) != "" {
+		runCIDROverlaps(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("adding routes needs root")
+	}
+	runInNetns(t, overlapTestEnv)
+}
+
+func runCIDROverlaps(t *testing.T) {
+	lan := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "lan0"}, PeerName: "lan1"}
+	if err := netlink.LinkAdd(lan); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"lan0", "lan1"} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	route := func(cidr string) *netlink.Route {
+		_, dst, _ := net.ParseCIDR(cidr)
+		return &netlink.Route{LinkIndex: lan.Attrs().Index, Dst: dst}
+	}
+	config := NetworkConfig{
+		CIDR:        "10.99.0.0/16",
+		CIDR6:       "fd00:99::/64",
+		ServiceCIDR: "10.98.0.0/16",
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	tests := []struct {
+		name    string
+		route   string
+		wantErr string
+	}{
+		{name: "within pool", route: "10.99.7.0/24", wantErr: "cidr 10.99.0.0/16 contains 10.99.7.0/24 of route via lan0"},
+		{name: "contains service CIDR", route: "10.96.0.0/12", wantErr: "service_cidr 10.98.0.0/16 is within 10.96.0.0/12 of route via lan0"},
+		{name: "v6", route: "fd00:99::/80", wantErr: "cidr6 fd00:99::/64 contains fd00:99::/80 of route via lan0"},
+		{name: "apart", route: "10.97.0.0/16"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := route(tt.route)
+			if err := netlink.RouteAdd(r); err != nil {
+				t.Fatal(err)
+			}
+			defer netlink.RouteDel(r)
+			err := config.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidCIDR) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want ErrInvalidCIDR with %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	nm, err := NewNetworkManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+	overlaps := func() []string {
+		var out []string
+		for _, o := range nm.CIDROverlaps() {
+			out = append(out, o.String())
+		}
+		return out
+	}
+	waitOverlaps := func(want []string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if slices.Equal(overlaps(), want) {
+				return
+			}
+		}
+		t.Fatalf("CIDROverlaps() = %q, want %q", overlaps(), want)
+	}
+	waitOverlaps(nil)
+
+	// Drift: a route appears after the manager started
+	r := route("10.99.128.0/17")
+	if err := netlink.RouteAdd(r); err != nil {
+		t.Fatal(err)
+	}
+	waitOverlaps([]string{"cidr 10.99.0.0/16 contains 10.99.128.0/17 of route via lan0"})
+	addr, _ := netlink.ParseAddr("10.98.1.1/24")
+	if err := netlink.AddrAdd(lan, addr); err != nil {
+		t.Fatal(err)
+	}
+	waitOverlaps([]string{
+		"cidr 10.99.0.0/16 contains 10.99.128.0/17 of route via lan0",
+		"service_cidr 10.98.0.0/16 contains 10.98.1.0/24 of address on lan0",
+		"service_cidr 10.98.0.0/16 contains 10.98.1.0/24 of route via lan0",
+	})
+	if err := netlink.RouteDel(r); err != nil {
+		t.Fatal(err)
+	}
+	// Removing the last address of the link also removes its routes
+	if err := netlink.AddrDel(lan, addr); err != nil {
+		t.Fatal(err)
+	}
+	waitOverlaps(nil)
+}
@@ -0,0 +1,160 @@
+package network
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFindOverlaps(t *testing.T) {
+	p := func(prefix, source string) sourcedPrefix {
+		return sourcedPrefix{netip.MustParsePrefix(prefix), source}
+	}
+	tests := []struct {
+		name     string
+		prefixes []sourcedPrefix
+		host     []sourcedPrefix
+		want     []string
+	}{
+		{name: "disjoint", prefixes: []sourcedPrefix{p("10.88.0.0/16", "cidr"), p("10.96.0.0/12", "service_cidr")},
+			host: []sourcedPrefix{p("192.168.1.0/24", "address on eth0")}},
+		{name: "same network", prefixes: []sourcedPrefix{p("10.88.0.0/16", "cidr"), p("10.88.0.0/16", "service_cidr")},
+			want: []string{"cidr 10.88.0.0/16 is 10.88.0.0/16 of service_cidr"}},
+		{name: "pool contains", prefixes: []sourcedPrefix{p("10.0.0.0/8", "cidr")},
+			host: []sourcedPrefix{p("10.1.2.0/24", "route via eth1")},
+			want: []string{"cidr 10.0.0.0/8 contains 10.1.2.0/24 of route via eth1"}},
+		{name: "pool within", prefixes: []sourcedPrefix{p("192.168.1.128/25", "cidr")},
+			host: []sourcedPrefix{p("192.168.0.0/16", "address on eth0")},
+			want: []string{"cidr 192.168.1.128/25 is within 192.168.0.0/16 of address on eth0"}},
+		{name: "partial overlap of pools", prefixes: []sourcedPrefix{p("10.88.0.0/15", "cidr"), p("10.89.128.0/17", "service_cidr")},
+			want: []string{"cidr 10.88.0.0/15 contains 10.89.128.0/17 of service_cidr"}},
+		{name: "v6 within", prefixes: []sourcedPrefix{p("fd00:88::/64", "cidr6"), p("fd00::/16", "service_cidr6")},
+			want: []string{"cidr6 fd00:88::/64 is within fd00::/16 of service_cidr6"}},
+		{name: "v6 contains host", prefixes: []sourcedPrefix{p("fd00::/48", "cidr6")},
+			host: []sourcedPrefix{p("fd00:0:0:5::/64", "route via wg0"), p("fd01::/64", "route via wg0")},
+			want: []string{"cidr6 fd00::/48 contains fd00:0:0:5::/64 of route via wg0"}},
+		{name: "families apart", prefixes: []sourcedPrefix{p("10.88.0.0/16", "cidr"), p("::ffff:10.88.0.0/112", "service_cidr6")},
+			host: []sourcedPrefix{p("::a58:0/112", "route via eth0")}},
+		{name: "all of them", prefixes: []sourcedPrefix{p("10.88.0.0/16", "cidr"), p("10.88.64.0/18", "service_cidr")},
+			host: []sourcedPrefix{p("10.88.1.0/24", "address on eth0")},
+			want: []string{
+				"cidr 10.88.0.0/16 contains 10.88.64.0/18 of service_cidr",
+				"cidr 10.88.0.0/16 contains 10.88.1.0/24 of address on eth0",
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, o := range findOverlaps(tt.prefixes, tt.host) {
+				got = append(got, o.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("findOverlaps() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateServiceCIDR(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  NetworkConfig
+		wantErr string
+	}{
+		{name: "apart", config: NetworkConfig{CIDR: "10.254.0.0/16", ServiceCIDR: "10.253.0.0/16"}},
+		{name: "v6 apart", config: NetworkConfig{CIDR6: "fd00:254::/64", ServiceCIDR6: "fd00:253::/108"}},
+		{name: "malformed", config: NetworkConfig{CIDR: "10.254.0.0/16", ServiceCIDR: "10.253.0.0"},
+			wantErr: "service_cidr"},
+		{name: "wrong family", config: NetworkConfig{CIDR: "10.254.0.0/16", ServiceCIDR6: "10.253.0.0/16"},
+			wantErr: "service_cidr6 10.253.0.0/16 is not of the expected family"},
+		{name: "within pool", config: NetworkConfig{CIDR: "10.254.0.0/16", ServiceCIDR: "10.254.128.0/20"},
+			wantErr: "cidr 10.254.0.0/16 contains 10.254.128.0/20 of service_cidr"},
+		{name: "contains pool", config: NetworkConfig{CIDR: "10.254.0.0/16", ServiceCIDR: "10.0.0.0/8"},
+			wantErr: "cidr 10.254.0.0/16 is within 10.0.0.0/8 of service_cidr"},
+		{name: "v6 pools", config: NetworkConfig{CIDR: "fd00:254::/64", CIDR6: "fd00::/16"},
+			wantErr: "cidr fd00:254::/64 is within fd00::/16 of cidr6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidCIDR) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want ErrInvalidCIDR with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostNetwork(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   bool
+	}{
+		{"192.168.1.0/24", true},
+		{"fd00::/64", true},
+		{"0.0.0.0/0", false},
+		{"::/0", false},
+		{"10.88.0.1/32", false},
+		{"fd00::1/128", false},
+		{"127.0.0.0/8", false},
+		{"fe80::/64", false},
+		{"224.0.0.0/4", false},
+	}
+	for _, tt := range tests {
+		if got := hostNetwork(netip.MustParsePrefix(tt.prefix)); got != tt.want {
+			t.Errorf("hostNetwork(%s) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestOwnDevice(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{hostVethName("", "c1"), true},
+		{hostVethName("b2", "c1"), true},
+		{"vb2-0123456789", false},
+		{overlayDevice, true},
+		{wireGuardDevice, true},
+		{"veth1234", false},
+		{"vethABCDEF0123", false},
+		{"veth0123456789a", false},
+		{"eth0", false},
+	}
+	for _, tt := range tests {
+		if got := ownDevice(tt.name); got != tt.want {
+			t.Errorf("ownDevice(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServiceOutsideServiceCIDR(t *testing.T) {
+	nm := &NetworkManager{
+		config:     NetworkConfig{ServiceCIDR: "10.96.0.0/12", ServiceCIDR6: "fd00:96::/108"},
+		namespaces: map[string]Namespace{DefaultNamespace: {Name: DefaultNamespace}},
+		services:   map[string]Service{},
+	}
+	tests := []struct {
+		vip     string
+		wantErr string
+	}{
+		{vip: "10.112.0.10", wantErr: "VIP 10.112.0.10 is outside the service CIDR 10.96.0.0/12"},
+		{vip: "fd00:97::10", wantErr: "VIP fd00:97::10 is outside the service CIDR fd00:96::/108"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.vip, func(t *testing.T) {
+			_, err := nm.CreateService(Service{Name: "api", VIP: tt.vip, Port: 80})
+			if !errors.Is(err, ErrInvalidService) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("CreateService() = %v, want ErrInvalidService with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
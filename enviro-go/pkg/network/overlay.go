@@ -0,0 +1,320 @@
+package network
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// overlayDevice is the VXLAN device carrying traffic between nodes
+const overlayDevice = "enviro.vxlan"
+
+// ErrPeerNotFound is returned when removing a peer the manager doesn't know
+var ErrPeerNotFound = errors.New("network: peer not found")
+
+// ErrOverlayDisabled is returned for peer changes without a NodeConfig
+var ErrOverlayDisabled = errors.New("network: overlay not configured")
+
+// ErrInvalidPeer is returned for peers that are malformed or whose subnets
+// conflict with this node or other peers
+var ErrInvalidPeer = errors.New("network: invalid peer")
+
+// NodeConfig joins the manager to a multi-node VXLAN overlay. Each node
+// allocates containers from its own subnet of CIDR and CIDR6, and traffic
+// to a peer's subnet is encapsulated toward the peer's underlay address.
+type NodeConfig struct {
+	// Address is this node's underlay address, the tunnel source
+	Address string `json:"address"`
+	// VNI identifies the overlay and must match on all nodes, defaults to 1
+	VNI uint32 `json:"vni"`
+	// Port is the VXLAN UDP port, defaults to 4789
+	Port int `json:"port"`
+	// Subnet and Subnet6 are this node's share of CIDR and CIDR6, see
+	// NodeSubnet. Each configured CIDR needs one.
+	Subnet  string `json:"subnet"`
+	Subnet6 string `json:"subnet6"`
+	// Peers are the other nodes at startup; see AddPeer
+	Peers []Peer `json:"peers"`
+	// WireGuard encrypts traffic between nodes instead of carrying it in
+	// plain VXLAN when set
+	WireGuard *WireGuardConfig `json:"wireguard"`
+}
+
+// Peer is another node of the overlay
+type Peer struct {
+	// Name identifies the peer for RemovePeer
+	Name string `json:"name"`
+	// Address is the peer's underlay address
+	Address string `json:"address"`
+	// Subnet and Subnet6 are the peer's shares of CIDR and CIDR6
+	Subnet  string `json:"subnet"`
+	Subnet6 string `json:"subnet6"`
+	// PublicKey is the peer's base64 WireGuard public key, required with
+	// encryption
+	PublicKey string `json:"public_key"`
+}
+
+const (
+	defaultVNI       = 1
+	defaultVXLANPort = 4789
+)
+
+// NodeSubnet returns subnet index of length bits in cidr, for splitting a
+// cluster network between nodes. With cidr 10.88.0.0/16 and bits 24, node
+// 3 gets 10.88.3.0/24.
+func NodeSubnet(cidr string, bits, index int) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+	}
+	prefix = prefix.Masked()
+	if bits < prefix.Bits() || bits > prefix.Addr().BitLen() {
+		return netip.Prefix{}, fmt.Errorf("subnet length /%d does not fit in %s", bits, prefix)
+	}
+	if index < 0 || (bits-prefix.Bits() < 63 && index >= 1<<(bits-prefix.Bits())) {
+		return netip.Prefix{}, fmt.Errorf("%s has no subnet /%d with index %d", prefix, bits, index)
+	}
+
+	n := new(big.Int).SetBytes(prefix.Addr().AsSlice())
+	n.Add(n, new(big.Int).Lsh(big.NewInt(int64(index)), uint(prefix.Addr().BitLen()-bits)))
+	buf := n.FillBytes(make([]byte, prefix.Addr().BitLen()/8))
+	addr, _ := netip.AddrFromSlice(buf)
+	return netip.PrefixFrom(addr, bits), nil
+}
+
+// validateNode checks config.Node against the container networks
+func validateNode(config NetworkConfig) error {
+	node := config.Node
+	if _, err := netip.ParseAddr(node.Address); err != nil {
+		return fmt.Errorf("invalid node address %q: %w", node.Address, err)
+	}
+	if node.VNI >= 1<<24 {
+		return fmt.Errorf("VNI %d does not fit in 24 bits", node.VNI)
+	}
+	if wg := node.WireGuard; wg != nil {
+		if wg.KeyFile == "" {
+			return errors.New("WireGuard needs a key_file")
+		}
+		if wg.Port < 0 || wg.Port > 65535 {
+			return fmt.Errorf("invalid WireGuard port %d", wg.Port)
+		}
+	}
+	for _, c := range []struct{ cidr, subnet string }{
+		{config.CIDR, node.Subnet},
+		{config.CIDR6, node.Subnet6},
+	} {
+		if c.cidr == "" {
+			if c.subnet != "" {
+				return fmt.Errorf("node subnet %s has no matching CIDR", c.subnet)
+			}
+			continue
+		}
+		if c.subnet == "" {
+			return fmt.Errorf("no node subnet configured for %s", c.cidr)
+		}
+		if _, err := subnetWithin(c.subnet, c.cidr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeSubnet returns this node's subnet of CIDR6 or CIDR, or "" outside an
+// overlay
+func nodeSubnet(config NetworkConfig, ipv6 bool) string {
+	switch {
+	case config.Node == nil:
+		return ""
+	case ipv6:
+		return config.Node.Subnet6
+	default:
+		return config.Node.Subnet
+	}
+}
+
+// subnetWithin parses subnet and checks it lies inside cidr
+func subnetWithin(subnet, cidr string) (netip.Prefix, error) {
+	sub, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid subnet %q: %w", subnet, err)
+	}
+	parent, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+	}
+	sub = sub.Masked()
+	if sub.Bits() < parent.Bits() || !parent.Contains(sub.Addr()) {
+		return netip.Prefix{}, fmt.Errorf("subnet %s is not inside %s", sub, parent.Masked())
+	}
+	return sub, nil
+}
+
+// peerSubnets parses the subnets of p, checking them against the container
+// networks, this node and the other peers. Callers must hold nm.mu or own
+// nm exclusively.
+func (nm *NetworkManager) peerSubnets(p Peer) ([]netip.Prefix, error) {
+	node := nm.config.Node
+	addr, err := netip.ParseAddr(p.Address)
+	if err != nil {
+		return nil, fmt.Errorf("peer %s: invalid address %q: %w", p.Name, p.Address, err)
+	}
+	local, _ := netip.ParseAddr(node.Address)
+	if addr.Is4() != local.Is4() {
+		return nil, fmt.Errorf("peer %s: address %s is not the same family as %s", p.Name, addr, local)
+	}
+	if addr == local {
+		return nil, fmt.Errorf("peer %s: address %s is this node", p.Name, addr)
+	}
+	if node.WireGuard != nil {
+		if _, err := parseWireGuardKey(p.PublicKey); err != nil {
+			return nil, fmt.Errorf("peer %s: %w", p.Name, err)
+		}
+		// WireGuard identifies peers by key
+		for name, other := range nm.peers {
+			if name != p.Name && other.PublicKey == p.PublicKey {
+				return nil, fmt.Errorf("peer %s: public key is used by peer %s", p.Name, name)
+			}
+		}
+	}
+
+	var subnets []netip.Prefix
+	for _, c := range []struct{ cidr, subnet string }{
+		{nm.config.CIDR, p.Subnet},
+		{nm.config.CIDR6, p.Subnet6},
+	} {
+		if c.subnet == "" {
+			continue
+		}
+		if c.cidr == "" {
+			return nil, fmt.Errorf("peer %s: subnet %s has no matching CIDR", p.Name, c.subnet)
+		}
+		sub, err := subnetWithin(c.subnet, c.cidr)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", p.Name, err)
+		}
+		for _, pool := range nm.pools {
+			if pool.prefix.Overlaps(sub) {
+				return nil, fmt.Errorf("peer %s: subnet %s overlaps this node's %s", p.Name, sub, pool.prefix)
+			}
+		}
+		for name, other := range nm.peers {
+			if name == p.Name {
+				continue
+			}
+			for _, s := range []string{other.Subnet, other.Subnet6} {
+				if s != "" && netip.MustParsePrefix(s).Overlaps(sub) {
+					return nil, fmt.Errorf("peer %s: subnet %s overlaps peer %s", p.Name, sub, name)
+				}
+			}
+		}
+		subnets = append(subnets, sub)
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("peer %s has no subnets", p.Name)
+	}
+	return subnets, nil
+}
+
+// AddPeer routes p's subnets through the overlay, replacing any peer with
+// the same name. Peers are not persisted; the control plane is expected to
+// sync membership after a restart.
+func (nm *NetworkManager) AddPeer(p Peer) error {
+	if nm.config.Node == nil {
+		return ErrOverlayDisabled
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.addPeer(p)
+}
+
+// addPeer programs p. Callers must hold nm.mu or own nm exclusively.
+func (nm *NetworkManager) addPeer(p Peer) error {
+	if p.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidPeer)
+	}
+	subnets, err := nm.peerSubnets(p)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPeer, err)
+	}
+	// Canonical subnets keep the overlap checks and removal exact
+	p.Subnet, p.Subnet6 = "", ""
+	for _, sub := range subnets {
+		if sub.Addr().Is4() {
+			p.Subnet = sub.String()
+		} else {
+			p.Subnet6 = sub.String()
+		}
+	}
+
+	if old, ok := nm.peers[p.Name]; ok {
+		if old == p {
+			return nil
+		}
+		if err := nm.unprogramPeer(old); err != nil {
+			return fmt.Errorf("failed to remove old routes of peer %s: %w", p.Name, err)
+		}
+		delete(nm.peers, p.Name)
+	}
+	if err := nm.programPeer(p); err != nil {
+		if cleanupErr := nm.unprogramPeer(p); cleanupErr != nil {
+			nm.log.Warn("Failed to clean up partial peer routes", "peer", p.Name, "error", cleanupErr)
+		}
+		return fmt.Errorf("failed to add peer %s: %w", p.Name, err)
+	}
+	nm.peers[p.Name] = p
+	nm.log.Info("Added overlay peer", "peer", p.Name, "address", p.Address, "subnet", p.Subnet, "subnet6", p.Subnet6)
+	return nil
+}
+
+// RemovePeer stops routing the subnets of the named peer
+func (nm *NetworkManager) RemovePeer(name string) error {
+	if nm.config.Node == nil {
+		return ErrOverlayDisabled
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	p, ok := nm.peers[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPeerNotFound, name)
+	}
+	if err := nm.unprogramPeer(p); err != nil {
+		return fmt.Errorf("failed to remove peer %s: %w", name, err)
+	}
+	delete(nm.peers, name)
+	nm.log.Info("Removed overlay peer", "peer", name)
+	return nil
+}
+
+// Peers returns the overlay peers sorted by name
+func (nm *NetworkManager) Peers() []Peer {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.sortedPeers()
+}
+
+// sortedPeers returns the peers by name. Callers must hold nm.mu.
+func (nm *NetworkManager) sortedPeers() []Peer {
+	out := make([]Peer, 0, len(nm.peers))
+	for _, p := range nm.peers {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// overlayMAC derives the MAC of a node's VXLAN device from its underlay
+// address, so nodes know each other's MAC without exchanging it
+func overlayMAC(addr netip.Addr) net.HardwareAddr {
+	sum := sha256.Sum256(addr.AsSlice())
+	mac := net.HardwareAddr(sum[:6])
+	// Locally administered unicast
+	mac[0] = mac[0]&0xfe | 0x02
+	return mac
+}
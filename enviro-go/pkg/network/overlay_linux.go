@@ -0,0 +1,217 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// initOverlay creates the VXLAN device, or the WireGuard device with
+// encryption, and routes the initial peers. A device left by a previous
+// run is replaced, dropping its peers.
+//
+// Only peer subnets are routed through the device. Local containers keep
+// their host routes, and the XDP router passes destinations it has no
+// container for up the stack, so same-node traffic never hairpins through
+// the tunnel.
+func (nm *NetworkManager) initOverlay() error {
+	node := nm.config.Node
+	local := netip.MustParseAddr(node.Address)
+	underlay, err := linkWithAddr(local)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{overlayDevice, wireGuardDevice} {
+		if old, err := netlink.LinkByName(name); err == nil {
+			if err := netlink.LinkDel(old); err != nil {
+				return fmt.Errorf("failed to remove stale %s: %w", name, err)
+			}
+		}
+	}
+
+	var link netlink.Link
+	if node.WireGuard != nil {
+		link, err = nm.createWireGuard(local, underlay)
+	} else {
+		link, err = nm.createVXLAN(local, underlay)
+	}
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		netlink.LinkDel(link)
+		return fmt.Errorf("failed to bring up %s: %w", link.Attrs().Name, err)
+	}
+	nm.overlayIndex = link.Attrs().Index
+
+	// Containers must fit the encapsulation overhead
+	if nm.config.MTU == 0 {
+		nm.config.MTU = link.Attrs().MTU
+	} else if nm.config.MTU > link.Attrs().MTU {
+		netlink.LinkDel(link)
+		return fmt.Errorf("%w: %d exceeds the %d %s carries", ErrInvalidMTU, nm.config.MTU, link.Attrs().MTU, link.Attrs().Name)
+	}
+	nm.log.Info("Created overlay", "device", link.Attrs().Name, "vni", node.VNI, "underlay", underlay.Attrs().Name,
+		"mtu", link.Attrs().MTU, "encrypted", node.WireGuard != nil)
+
+	for _, p := range node.Peers {
+		if err := nm.addPeer(p); err != nil {
+			netlink.LinkDel(link)
+			return err
+		}
+	}
+	return nil
+}
+
+// createVXLAN creates the VXLAN device of the overlay
+func (nm *NetworkManager) createVXLAN(local netip.Addr, underlay netlink.Link) (netlink.Link, error) {
+	node := nm.config.Node
+	vxlan := &netlink.Vxlan{
+		// The kernel sizes the MTU to fit the underlay, which leaves room
+		// for containers with an MTU above NetworkConfig.MTU
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         overlayDevice,
+			HardwareAddr: overlayMAC(local),
+		},
+		VxlanId:      int(node.VNI),
+		VtepDevIndex: underlay.Attrs().Index,
+		SrcAddr:      net.IP(local.AsSlice()),
+		Port:         node.Port,
+		// Peers are programmed explicitly; never learn from the wire
+		Learning: false,
+	}
+	if err := netlink.LinkAdd(vxlan); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", overlayDevice, err)
+	}
+	return netlink.LinkByName(overlayDevice)
+}
+
+// linkWithAddr returns the interface addr is assigned to
+func linkWithAddr(addr netip.Addr) (netlink.Link, error) {
+	family := netlink.FAMILY_V4
+	if addr.Is6() {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := netlink.AddrList(nil, family)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ip, ok := netip.AddrFromSlice(a.IP); ok && ip.Unmap() == addr {
+			return netlink.LinkByIndex(a.LinkIndex)
+		}
+	}
+	return nil, fmt.Errorf("node address %s is not assigned to any interface", addr)
+}
+
+// programPeer adds a forwarding entry sending frames for the peer's MAC to
+// its underlay address, and routes each of its subnets via a permanent
+// neighbor with that MAC. The neighbor address is only a key for the MAC
+// and is never contacted. With encryption the peer is added to the
+// WireGuard device instead.
+func (nm *NetworkManager) programPeer(p Peer) error {
+	if nm.config.Node.WireGuard != nil {
+		return nm.programWireGuardPeer(p)
+	}
+	addr := netip.MustParseAddr(p.Address)
+	mac := overlayMAC(addr)
+
+	fdb := &netlink.Neigh{
+		LinkIndex:    nm.overlayIndex,
+		Family:       unix.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT,
+		Flags:        netlink.NTF_SELF,
+		IP:           net.IP(addr.AsSlice()),
+		HardwareAddr: mac,
+	}
+	if err := netlink.NeighSet(fdb); err != nil {
+		return fmt.Errorf("failed to add forwarding entry: %w", err)
+	}
+
+	for _, sub := range peerPrefixes(p) {
+		nexthop := net.IP(sub.Addr().Next().AsSlice())
+		neigh := &netlink.Neigh{
+			LinkIndex:    nm.overlayIndex,
+			Family:       addrFamily(sub.Addr()),
+			State:        netlink.NUD_PERMANENT,
+			IP:           nexthop,
+			HardwareAddr: mac,
+		}
+		if err := netlink.NeighSet(neigh); err != nil {
+			return fmt.Errorf("failed to add neighbor for %s: %w", sub, err)
+		}
+		route := &netlink.Route{
+			LinkIndex: nm.overlayIndex,
+			Dst:       prefixIPNet(sub),
+			Gw:        nexthop,
+			Flags:     int(netlink.FLAG_ONLINK),
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to route %s: %w", sub, err)
+		}
+	}
+	return nil
+}
+
+// unprogramPeer undoes programPeer, ignoring entries that are already gone
+func (nm *NetworkManager) unprogramPeer(p Peer) error {
+	if nm.config.Node.WireGuard != nil {
+		return nm.unprogramWireGuardPeer(p)
+	}
+	addr := netip.MustParseAddr(p.Address)
+	var errs []error
+	for _, sub := range peerPrefixes(p) {
+		nexthop := net.IP(sub.Addr().Next().AsSlice())
+		errs = append(errs,
+			ignoreMissing(netlink.RouteDel(&netlink.Route{LinkIndex: nm.overlayIndex, Dst: prefixIPNet(sub), Gw: nexthop})),
+			ignoreMissing(netlink.NeighDel(&netlink.Neigh{LinkIndex: nm.overlayIndex, Family: addrFamily(sub.Addr()), IP: nexthop})),
+		)
+	}
+	errs = append(errs, ignoreMissing(netlink.NeighDel(&netlink.Neigh{
+		LinkIndex:    nm.overlayIndex,
+		Family:       unix.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		IP:           net.IP(addr.AsSlice()),
+		HardwareAddr: overlayMAC(addr),
+	})))
+	return errors.Join(errs...)
+}
+
+// peerPrefixes returns the subnets of a validated peer
+func peerPrefixes(p Peer) []netip.Prefix {
+	var out []netip.Prefix
+	for _, s := range []string{p.Subnet, p.Subnet6} {
+		if s != "" {
+			out = append(out, netip.MustParsePrefix(s))
+		}
+	}
+	return out
+}
+
+func addrFamily(addr netip.Addr) int {
+	if addr.Is4() {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+func prefixIPNet(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   net.IP(p.Addr().AsSlice()),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
+
+func ignoreMissing(err error) error {
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ESRCH) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,367 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+)
+
+// PolicyAction is the verdict of a network policy
+type PolicyAction string
+
+const (
+	// PolicyAllow lets matching traffic through
+	PolicyAllow PolicyAction = "allow"
+	// PolicyDeny drops matching traffic
+	PolicyDeny PolicyAction = "deny"
+	// PolicyReject refuses matching traffic: TCP with a reset, anything
+	// else with an ICMP administratively prohibited error, so clients
+	// fail at once rather than time out. Replies are rate limited, see
+	// NetworkConfig.RejectRate; traffic over the limit is dropped.
+	PolicyReject PolicyAction = "reject"
+)
+
+// DefaultRejectRate is the default of NetworkConfig.RejectRate
+const DefaultRejectRate = 100
+
+// policyCounts are the packets the policies protecting a container dropped
+// and rejected
+type policyCounts struct {
+	dropped  uint64
+	rejected uint64
+}
+
+func (c *policyCounts) add(o policyCounts) {
+	c.dropped += o.dropped
+	c.rejected += o.rejected
+}
+
+// valid reports whether a is a known action
+func (a PolicyAction) valid() bool {
+	return a == PolicyAllow || a == PolicyDeny || a == PolicyReject
+}
+
+// denies reports whether a keeps matching traffic out, dropping or
+// rejecting it
+func (a PolicyAction) denies() bool {
+	return a == PolicyDeny || a == PolicyReject
+}
+
+// Errors returned by policy operations
+var (
+	// ErrPolicyNotFound is returned when removing an unknown policy
+	ErrPolicyNotFound = errors.New("network: policy not found")
+	// ErrInvalidPolicy is returned when applying a malformed policy
+	ErrInvalidPolicy = errors.New("network: invalid policy")
+)
+
+// NetworkPolicy allows, denies or rejects traffic to a container, or to every
+// container with an address in DestCIDR, of its namespace. Traffic is
+// matched by its source container or a SourceCIDR, neither matching
+// anything. Empty Protocol or zero Port match anything. Policies can't
+// let in traffic the namespace isolation drops.
+type NetworkPolicy struct {
+	// Name identifies the policy; applying a policy with an existing name
+	// replaces it
+	Name string `json:"name"`
+	// Namespace is the namespace of the containers the policy protects,
+	// DefaultNamespace when empty
+	Namespace       string       `json:"namespace,omitempty"`
+	SourceContainer string       `json:"source_container"`
+	SourceCIDR      string       `json:"source_cidr"`
+	DestContainer   string       `json:"dest_container"`
+	DestCIDR        string       `json:"dest_cidr"`
+	Protocol        string       `json:"protocol"`
+	Port            uint16       `json:"port"`
+	Action          PolicyAction `json:"action"`
+}
+
+// protocolNumbers maps policy protocol names to IP protocol numbers
+var protocolNumbers = map[string]uint8{
+	"":     0,
+	"icmp": 1,
+	"tcp":  6,
+	"udp":  17,
+}
+
+// protocolNumber returns the protocol number of name for the address
+// family of dst; "icmp" means ICMPv6 for IPv6.
+func protocolNumber(name string, dst netip.Addr) uint8 {
+	if name == "icmp" && dst.Is6() {
+		return 58
+	}
+	return protocolNumbers[name]
+}
+
+// Validate checks that the policy is well formed
+func (p NetworkPolicy) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidPolicy)
+	}
+	if err := ValidateName(p.Namespace); err != nil {
+		return fmt.Errorf("%w: policy %s: %v", ErrInvalidPolicy, p.Name, err)
+	}
+	if (p.DestContainer == "") == (p.DestCIDR == "") {
+		return fmt.Errorf("%w: policy %s needs one of dest container and dest CIDR", ErrInvalidPolicy, p.Name)
+	}
+	if p.SourceContainer != "" && p.SourceCIDR != "" {
+		return fmt.Errorf("%w: policy %s has both a source container and a source CIDR", ErrInvalidPolicy, p.Name)
+	}
+	for _, cidr := range []string{p.SourceCIDR, p.DestCIDR} {
+		if cidr == "" {
+			continue
+		}
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("%w: policy %s: %v", ErrInvalidPolicy, p.Name, err)
+		}
+	}
+	if _, ok := protocolNumbers[p.Protocol]; !ok {
+		return fmt.Errorf("%w: policy %s has unsupported protocol %q", ErrInvalidPolicy, p.Name, p.Protocol)
+	}
+	if p.Port != 0 && p.Protocol != "tcp" && p.Protocol != "udp" {
+		return fmt.Errorf("%w: policy %s: port requires tcp or udp", ErrInvalidPolicy, p.Name)
+	}
+	if !p.Action.valid() {
+		return fmt.Errorf("%w: policy %s: action must be %q, %q or %q", ErrInvalidPolicy, p.Name, PolicyAllow, PolicyDeny, PolicyReject)
+	}
+	return nil
+}
+
+// references reports whether the policy names containerID
+func (p NetworkPolicy) references(containerID string) bool {
+	return p.SourceContainer == containerID || p.DestContainer == containerID
+}
+
+// policyRule is a policy resolved to addresses, as programmed in the
+// datapath. The zero Src, Proto and Port are wildcards. Src is a single
+// address for a source container.
+type policyRule struct {
+	Src   netip.Prefix
+	Dst   netip.Addr
+	Proto uint8
+	Port  uint16
+}
+
+// ApplyPolicy adds or replaces a policy. Policies naming containers that
+// don't have a network yet take effect once the network is created in the
+// policy's namespace.
+func (nm *NetworkManager) ApplyPolicy(p NetworkPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if err := nm.checkPrivileged("network policies"); err != nil {
+		return err
+	}
+	p.Namespace = namespaceOf(p.Namespace)
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, ok := nm.namespaces[p.Namespace]; !ok {
+		return fmt.Errorf("%w: %s", ErrNamespaceNotFound, p.Namespace)
+	}
+	if dst, ok := nm.containers[p.DestContainer]; ok && dst.Namespace != p.Namespace {
+		return fmt.Errorf("%w: policy %s: %s is in namespace %s", ErrInvalidPolicy, p.Name, p.DestContainer, dst.Namespace)
+	}
+
+	if _, exists := nm.policies[p.Name]; !exists {
+		nm.policyOrder = append(nm.policyOrder, p.Name)
+	}
+	nm.policies[p.Name] = p
+	nm.log.Info("Applied network policy", "policy", p.Name, "namespace", p.Namespace,
+		"source", p.SourceContainer, "source_cidr", p.SourceCIDR,
+		"dest", p.DestContainer, "dest_cidr", p.DestCIDR,
+		"protocol", p.Protocol, "port", p.Port, "action", p.Action)
+	if err := nm.syncPolicies(); err != nil {
+		return err
+	}
+	return nm.saveState()
+}
+
+// RemovePolicy deletes a policy by name
+func (nm *NetworkManager) RemovePolicy(name string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, ok := nm.policies[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrPolicyNotFound, name)
+	}
+	nm.deletePolicy(name)
+	if err := nm.syncPolicies(); err != nil {
+		return err
+	}
+	return nm.saveState()
+}
+
+// ListPolicies returns all policies ordered by name
+func (nm *NetworkManager) ListPolicies() []NetworkPolicy {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	out := make([]NetworkPolicy, 0, len(nm.policies))
+	for _, p := range nm.policies {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// SetDefaultPolicy changes the verdict for traffic matching no policy,
+// allow when empty. On error the previous default stays in effect.
+func (nm *NetworkManager) SetDefaultPolicy(action PolicyAction) error {
+	switch action {
+	case "":
+		action = PolicyAllow
+	case PolicyAllow, PolicyDeny, PolicyReject:
+	default:
+		return fmt.Errorf("%w: unknown default policy %q", ErrInvalidConfig, action)
+	}
+	if action.denies() {
+		if err := nm.checkPrivileged("a " + string(action) + " default policy"); err != nil {
+			return err
+		}
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	previous := nm.config.DefaultPolicy
+	if action == previous {
+		return nil
+	}
+	nm.config.DefaultPolicy = action
+	if err := nm.applyDefaultPolicy(); err != nil {
+		nm.config.DefaultPolicy = previous
+		return fmt.Errorf("failed to set default policy: %w", err)
+	}
+	nm.log.Info("Changed default network policy", "previous", previous, "action", action)
+	return nil
+}
+
+// deletePolicy removes a policy from the store. Callers must hold nm.mu.
+func (nm *NetworkManager) deletePolicy(name string) {
+	delete(nm.policies, name)
+	for i, n := range nm.policyOrder {
+		if n == name {
+			nm.policyOrder = append(nm.policyOrder[:i], nm.policyOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// removeContainerPolicies drops every policy referencing containerID.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) removeContainerPolicies(logger *slog.Logger, containerID string) {
+	for _, name := range append([]string(nil), nm.policyOrder...) {
+		if nm.policies[name].references(containerID) {
+			logger.Info("Removing network policy of deleted container", "policy", name)
+			nm.deletePolicy(name)
+		}
+	}
+}
+
+// compilePolicies resolves stored policies to datapath rules, one per
+// destination address whose family the source has. Later policies win
+// over earlier ones with the same key; policies naming a container
+// without a network are skipped. owners holds the name of the policy each
+// rule comes from. Callers must hold nm.mu.
+func (nm *NetworkManager) compilePolicies() (rules map[policyRule]PolicyAction, owners map[policyRule]string) {
+	rules = make(map[policyRule]PolicyAction)
+	owners = make(map[policyRule]string)
+	for _, name := range nm.policyOrder {
+		p := nm.policies[name]
+
+		var srcs []netip.Prefix
+		switch {
+		case p.SourceContainer != "":
+			src, ok := nm.containers[p.SourceContainer]
+			if !ok {
+				continue
+			}
+			for _, addr := range src.addrs() {
+				srcs = append(srcs, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		case p.SourceCIDR != "":
+			srcs = []netip.Prefix{netip.MustParsePrefix(p.SourceCIDR).Masked()}
+		}
+
+		for _, dstAddr := range nm.policyDests(p) {
+			rule := policyRule{Dst: dstAddr, Proto: protocolNumber(p.Protocol, dstAddr), Port: p.Port}
+			if srcs != nil {
+				var ok bool
+				if rule.Src, ok = sameFamily(srcs, dstAddr); !ok {
+					continue
+				}
+			}
+			rules[rule] = p.Action
+			owners[rule] = name
+		}
+	}
+	return rules, owners
+}
+
+// matchPolicy returns the policy whose rule the XDP router matches a packet
+// against, trying rules in the router's order: those from the source
+// address, from the longest source CIDR containing it and from anywhere,
+// each by protocol and port first
+func matchPolicy(owners map[policyRule]string, src, dst netip.Addr, proto uint8, port uint16) (string, bool) {
+	keys := []policyRule{{Proto: proto, Port: port}, {Proto: proto}, {}}
+	for _, k := range keys {
+		k.Src, k.Dst = netip.PrefixFrom(src, src.BitLen()), dst
+		if name, ok := owners[k]; ok {
+			return name, true
+		}
+	}
+	for _, k := range keys {
+		k.Dst = dst
+		for bits := src.BitLen() - 1; bits >= 0; bits-- {
+			k.Src = netip.PrefixFrom(src, bits).Masked()
+			if name, ok := owners[k]; ok {
+				return name, true
+			}
+		}
+	}
+	for _, k := range keys {
+		k.Dst = dst
+		if name, ok := owners[k]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// policyDests returns the container addresses p protects, those of its
+// namespace. Callers must hold nm.mu.
+func (nm *NetworkManager) policyDests(p NetworkPolicy) []netip.Addr {
+	if p.DestContainer != "" {
+		if dst, ok := nm.containers[p.DestContainer]; ok && dst.Namespace == p.Namespace {
+			return dst.addrs()
+		}
+		return nil
+	}
+	prefix := netip.MustParsePrefix(p.DestCIDR)
+	var out []netip.Addr
+	for _, cn := range nm.containers {
+		if cn.Namespace != p.Namespace {
+			continue
+		}
+		for _, addr := range cn.addrs() {
+			if prefix.Contains(addr) {
+				out = append(out, addr)
+			}
+		}
+	}
+	return out
+}
+
+// sameFamily returns the prefix in prefixes of the same family as like
+func sameFamily(prefixes []netip.Prefix, like netip.Addr) (netip.Prefix, bool) {
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is4() == like.Is4() {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
@@ -0,0 +1,286 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftPolicyTable is the inet table enforcing policies while the XDP router
+// is not loaded
+const nftPolicyTable = "enviro_policy"
+
+// syncKernelPolicies rebuilds the policy table from rules in one atomic
+// batch. Rules are tried in the order of the XDP router's lookup, most
+// specific first, and traffic to a container matching none gets the
+// default policy, so verdicts are the same on both paths. Unlike the XDP
+// router, which only sees traffic arriving on its interface, the table
+// also covers traffic between containers on this node.
+//
+// Drop and reject rules count their packets and carry the ID of the
+// container they protect, see readPolicyCounters. Callers must hold nm.mu.
+func (nm *NetworkManager) syncKernelPolicies(rules map[policyRule]PolicyAction) error {
+	// Keep the counts of the table about to be replaced. Those of deleted
+	// containers only still matter for the node total.
+	if counts, err := nm.readPolicyCounters(); err == nil {
+		nm.policyCounters = make(map[string]policyCounts)
+		for id, c := range counts {
+			if _, ok := nm.containers[id]; !ok {
+				id = ""
+			}
+			sum := nm.policyCounters[id]
+			sum.add(c)
+			nm.policyCounters[id] = sum
+		}
+	}
+
+	owners := make(map[netip.Addr]string)
+	var addrs []netip.Addr
+	for id, cn := range nm.containers {
+		for _, addr := range cn.addrs() {
+			owners[addr] = id
+			addrs = append(addrs, addr)
+		}
+	}
+
+	conn := &nftables.Conn{}
+	table := resetTable(conn, nm.nftTable(nftPolicyTable), nftables.TableFamilyINet)
+
+	deny := nm.config.DefaultPolicy.denies()
+	if len(rules) > 0 || deny {
+		conn.AddTable(table)
+		chain := conn.AddChain(&nftables.Chain{
+			Name:     "forward",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookForward,
+			Priority: nftables.ChainPriorityFilter,
+		})
+		add := func(rule policyRule, action PolicyAction) {
+			for _, exprs := range policyExprs(rule, action, nm.config.RejectRate) {
+				conn.AddRule(&nftables.Rule{
+					Table:    table,
+					Chain:    chain,
+					Exprs:    exprs,
+					UserData: []byte(owners[rule.Dst]),
+				})
+			}
+		}
+		for _, rule := range sortedPolicyRules(rules) {
+			add(rule, rules[rule])
+		}
+		if deny {
+			sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+			for _, addr := range addrs {
+				add(policyRule{Dst: addr}, nm.config.DefaultPolicy)
+			}
+		}
+	}
+	return conn.Flush()
+}
+
+// clearKernelPolicies removes the policy table, e.g. one left by a run
+// without XDP
+func (nm *NetworkManager) clearKernelPolicies() error {
+	conn := &nftables.Conn{}
+	resetTable(conn, nm.nftTable(nftPolicyTable), nftables.TableFamilyINet)
+	return conn.Flush()
+}
+
+// readPolicyCounters returns the packets dropped and rejected by policy
+// tables, keyed by the ID of the container they were addressed to.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) readPolicyCounters() (map[string]policyCounts, error) {
+	counts := make(map[string]policyCounts)
+	for id, c := range nm.policyCounters {
+		counts[id] = c
+	}
+	if nm.rootless {
+		return counts, nil
+	}
+	conn := &nftables.Conn{}
+	table := &nftables.Table{Name: nm.nftTable(nftPolicyTable), Family: nftables.TableFamilyINet}
+	rules, err := conn.GetRules(table, &nftables.Chain{Name: "forward", Table: table})
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return counts, nil
+		}
+		return nil, err
+	}
+	for _, r := range rules {
+		var packets uint64
+		rejects := false
+		for _, e := range r.Exprs {
+			switch e := e.(type) {
+			case *expr.Counter:
+				packets += e.Packets
+			case *expr.Reject:
+				rejects = true
+			}
+		}
+		c := counts[string(r.UserData)]
+		if rejects {
+			c.rejected += packets
+		} else {
+			c.dropped += packets
+		}
+		counts[string(r.UserData)] = c
+	}
+	return counts, nil
+}
+
+// policyRank orders rules like policy_lookup in bpf/container_router.c:
+// rules with a source address first, then those with a source CIDR, then
+// the rest, each by protocol and port
+func policyRank(r policyRule) int {
+	rank := 0
+	switch {
+	case !r.Src.IsValid():
+		rank = 6
+	case !r.Src.IsSingleIP():
+		rank = 3
+	}
+	switch {
+	case r.Port != 0:
+	case r.Proto != 0:
+		rank++
+	default:
+		rank += 2
+	}
+	return rank
+}
+
+// sortedPolicyRules returns the keys of rules by policyRank and longest
+// source CIDR, then by address, protocol and port for a stable table
+func sortedPolicyRules(rules map[policyRule]PolicyAction) []policyRule {
+	out := make([]policyRule, 0, len(rules))
+	for r := range rules {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if ra, rb := policyRank(a), policyRank(b); ra != rb {
+			return ra < rb
+		}
+		if a.Src.Bits() != b.Src.Bits() {
+			return a.Src.Bits() > b.Src.Bits()
+		}
+		if a.Dst != b.Dst {
+			return a.Dst.Less(b.Dst)
+		}
+		if a.Src != b.Src {
+			return a.Src.Addr().Less(b.Src.Addr())
+		}
+		if a.Proto != b.Proto {
+			return a.Proto < b.Proto
+		}
+		return a.Port < b.Port
+	})
+	return out
+}
+
+// policyExprs returns the rules applying action to the traffic rule
+// matches, in order. Rejects are answered within rejectRate per second,
+// TCP with a reset and the rest with an ICMP error, and dropped beyond:
+//
+//	meta nfproto ipv4 ip daddr 10.88.0.2 ip saddr 10.88.0.3 meta l4proto tcp th dport 80 counter drop
+//	meta nfproto ipv4 ip daddr 10.88.0.2 meta l4proto tcp limit rate 100/second counter reject with tcp reset
+//	meta nfproto ipv4 ip daddr 10.88.0.2 meta l4proto != tcp limit rate 100/second counter reject with icmpx admin-prohibited
+//	meta nfproto ipv4 ip daddr 10.88.0.2 counter drop
+func policyExprs(rule policyRule, action PolicyAction, rejectRate int) [][]expr.Any {
+	match := policyMatch(rule)
+	switch action {
+	case PolicyAllow:
+		return [][]expr.Any{append(match, &expr.Verdict{Kind: expr.VerdictAccept})}
+	case PolicyDeny:
+		return [][]expr.Any{append(match, &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop})}
+	}
+
+	limit := func() []expr.Any {
+		return []expr.Any{
+			&expr.Limit{Type: expr.LimitTypePkts, Rate: uint64(rejectRate), Unit: expr.LimitTimeSecond, Burst: uint32(rejectRate)},
+			&expr.Counter{},
+		}
+	}
+	var out [][]expr.Any
+	if rule.Proto == 0 || rule.Proto == unix.IPPROTO_TCP {
+		exprs := slices.Clone(match)
+		if rule.Proto == 0 {
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			)
+		}
+		exprs = append(exprs, limit()...)
+		out = append(out, append(exprs, &expr.Reject{Type: unix.NFT_REJECT_TCP_RST}))
+	}
+	if rule.Proto != unix.IPPROTO_TCP {
+		exprs := slices.Clone(match)
+		if rule.Proto == 0 {
+			// TCP over the limit of the reset rule is dropped below
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			)
+		}
+		exprs = append(exprs, limit()...)
+		out = append(out, append(exprs, &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED}))
+	}
+	return append(out, append(match, &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}))
+}
+
+// policyMatch matches traffic to rule.Dst and, when set, from rule.Src
+// with rule.Proto to rule.Port
+func policyMatch(rule policyRule) []expr.Any {
+	family, srcOffset, dstOffset := byte(unix.NFPROTO_IPV4), uint32(12), uint32(16)
+	if rule.Dst.Is6() {
+		family, srcOffset, dstOffset = unix.NFPROTO_IPV6, 8, 24
+	}
+	addrLen := uint32(rule.Dst.BitLen() / 8)
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: dstOffset, Len: addrLen},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: rule.Dst.AsSlice()},
+	}
+	if rule.Src.IsValid() {
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: srcOffset, Len: addrLen},
+		)
+		if !rule.Src.IsSingleIP() {
+			exprs = append(exprs, &expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            addrLen,
+				Mask:           net.CIDRMask(rule.Src.Bits(), rule.Src.Addr().BitLen()),
+				Xor:            make([]byte, addrLen),
+			})
+		}
+		exprs = append(exprs,
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: rule.Src.Masked().Addr().AsSlice()},
+		)
+	}
+	if rule.Proto != 0 {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{rule.Proto}},
+		)
+	}
+	if rule.Port != 0 {
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(rule.Port)},
+		)
+	}
+	return exprs
+}
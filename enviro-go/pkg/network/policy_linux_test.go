@@ -0,0 +1,203 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// policyTestEnv marks the child of TestPolicyActions
+const policyTestEnv = "ENVIRO_TEST_POLICY_ACTIONS"
+
+// TestPolicyActions connects through the rules of each action in a child
+// in a network namespace of its own. The connections are the host's own,
+// from 127.0.0.1 to 127.0.0.2, so the rules sit in the input hook, where
+// like in forward, dropping doesn't fail the sender's write.
+func TestPolicyActions(t *testing.T) {
+	if os.Getenv(policyTestEnv) != "" {
+		runPolicyActions(t)
+		return
+	}
+	runInNetns(t, policyTestEnv)
+}
+
+// runInNetns runs the test t again in a child in a network namespace of
+// its own, with env set to tell the child apart. The child of root keeps
+// root's privileges, such as loading BPF programs; that of another user
+// is root in a user namespace of its own, which is enough for rules and
+// links of the namespace.
+func runInNetns(t *testing.T, env string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), env+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if os.Geteuid() != 0 {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Skipf("can't create a network namespace: %v", err)
+	}
+	// Subtests of the child are reported as "--- SKIP: name/subtest"
+	if strings.Contains(string(out), "--- SKIP: "+t.Name()+" (") {
+		t.Skipf("child skipped:\n%s", out)
+	}
+	if err != nil || !strings.Contains(string(out), "--- PASS: "+t.Name()+" (") {
+		t.Fatalf("child failed: %v\n%s", err, out)
+	}
+}
+
+// runPolicyActions runs the cases of TestPolicyActions as its child
+func runPolicyActions(t *testing.T) {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	udp, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	const timeout = 500 * time.Millisecond
+	dialer := &net.Dialer{Timeout: timeout, LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	tests := []struct {
+		name   string
+		action PolicyAction
+		proto  uint8
+		// want is the error of connecting, nil to connect, and
+		// errTimeout to time out
+		want error
+		// wantCounts are the packets counted for the connection
+		wantCounts policyCounts
+	}{
+		{name: "allow", action: PolicyAllow, proto: unix.IPPROTO_TCP},
+		{name: "deny", action: PolicyDeny, proto: unix.IPPROTO_TCP, want: errTimeout, wantCounts: policyCounts{dropped: 1}},
+		{name: "reject", action: PolicyReject, proto: unix.IPPROTO_TCP, want: unix.ECONNREFUSED, wantCounts: policyCounts{rejected: 1}},
+		{name: "reject any protocol", action: PolicyReject, want: unix.ECONNREFUSED, wantCounts: policyCounts{rejected: 1}},
+		{name: "reject udp", action: PolicyReject, proto: unix.IPPROTO_UDP, want: unix.EHOSTUNREACH, wantCounts: policyCounts{rejected: 1}},
+		{name: "deny udp", action: PolicyDeny, proto: unix.IPPROTO_UDP, want: errTimeout, wantCounts: policyCounts{dropped: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := ln.Addr().(*net.TCPAddr).AddrPort()
+			if tt.proto == unix.IPPROTO_UDP {
+				addr = udp.LocalAddr().(*net.UDPAddr).AddrPort()
+			}
+			rule := policyRule{Dst: addr.Addr(), Proto: tt.proto, Port: addr.Port()}
+			if tt.proto == 0 {
+				rule.Port = 0
+			}
+			if err := programTestPolicy(rule, tt.action); err != nil {
+				if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EOPNOTSUPP) {
+					t.Skipf("nftables unavailable: %v", err)
+				}
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			if tt.proto == unix.IPPROTO_UDP {
+				err = exchangeUDP(addr, timeout)
+			} else {
+				var c net.Conn
+				if c, err = dialer.Dial("tcp4", addr.String()); err == nil {
+					c.Close()
+				}
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = errTimeout
+			}
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Fatalf("connect error = %v, want %v", err, tt.want)
+			}
+			if elapsed := time.Since(start); tt.want != errTimeout && elapsed > timeout/2 {
+				t.Errorf("connect took %s, want it to fail at once", elapsed)
+			}
+
+			nm := &NetworkManager{}
+			counts, err := nm.readPolicyCounters()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A connect timing out retransmits its SYN
+			got := counts["test"]
+			if got.dropped > 1 && tt.wantCounts.dropped == 1 {
+				got.dropped = 1
+			}
+			if got != tt.wantCounts {
+				t.Errorf("counts = %+v, want %+v", got, tt.wantCounts)
+			}
+		})
+	}
+}
+
+// errTimeout stands for connecting timing out in TestPolicyActions
+var errTimeout = errors.New("timeout")
+
+// programTestPolicy replaces the policy table with one applying action to
+// rule in the input hook, counting for container "test"
+func programTestPolicy(rule policyRule, action PolicyAction) error {
+	conn := &nftables.Conn{}
+	table := resetTable(conn, nftPolicyTable, nftables.TableFamilyINet)
+	conn.AddTable(table)
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	for _, exprs := range policyExprs(rule, action, DefaultRejectRate) {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs, UserData: []byte("test")})
+	}
+	return conn.Flush()
+}
+
+// exchangeUDP sends a datagram to addr and waits for timeout for the
+// error an ICMP reply reports
+func exchangeUDP(addr netip.AddrPort, timeout time.Duration) error {
+	c, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	_, err = c.Read(make([]byte, 1))
+	return err
+}
@@ -0,0 +1,180 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// ErrPortInUse is returned when a host port is already forwarded or bound
+var ErrPortInUse = errors.New("network: host port in use")
+
+// ErrForwardNotFound is returned when removing a port that isn't forwarded
+var ErrForwardNotFound = errors.New("network: port forward not found")
+
+// PortForward forwards a host port to a container port
+type PortForward struct {
+	ContainerID   string `json:"container_id"`
+	HostPort      uint16 `json:"host_port"`
+	ContainerPort uint16 `json:"container_port"`
+	// Protocol is "tcp" or "udp"
+	Protocol string `json:"protocol"`
+}
+
+// ExposePort forwards hostPort on every host address to containerPort on
+// the container's addresses. Protocol is "tcp" (the default) or "udp".
+// Traffic arriving on the router's interface is translated by the router
+// itself, tracking the flows to translate their replies back, where the
+// container's source is checked; nftables translates the rest.
+func (nm *NetworkManager) ExposePort(containerID string, hostPort, containerPort uint16, protocol string) (PortForward, error) {
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return PortForward{}, fmt.Errorf("unsupported protocol %q", protocol)
+	}
+	if hostPort == 0 || containerPort == 0 {
+		return PortForward{}, errors.New("host and container port are required")
+	}
+	fwd := PortForward{
+		ContainerID:   containerID,
+		HostPort:      hostPort,
+		ContainerPort: containerPort,
+		Protocol:      protocol,
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return PortForward{}, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	if err := cn.checkAttachment("port forwards"); err != nil {
+		return PortForward{}, err
+	}
+	if existing, ok := nm.findForward(hostPort, protocol); ok {
+		if existing == fwd {
+			return fwd, nil
+		}
+		return PortForward{}, fmt.Errorf("%w: %s/%d is forwarded to %s", ErrPortInUse, protocol, hostPort, existing.ContainerID)
+	}
+	if owner, ok := nm.hostPortOwner(hostPort, protocol, ""); ok {
+		return PortForward{}, fmt.Errorf("%w: %s/%d is %s", ErrPortInUse, protocol, hostPort, owner)
+	}
+	if err := checkHostPortFree(hostPort, protocol); err != nil {
+		return PortForward{}, err
+	}
+
+	cn.Ports = append(cn.Ports, fwd)
+	if err := nm.applyForwards(); err != nil {
+		cn.Ports = cn.Ports[:len(cn.Ports)-1]
+		return PortForward{}, err
+	}
+	nm.log.Info("Exposed container port", "container_id", containerID,
+		"host_port", hostPort, "container_port", containerPort, "protocol", protocol)
+	return fwd, nil
+}
+
+// PublishPort is ExposePort
+func (nm *NetworkManager) PublishPort(containerID string, hostPort, containerPort uint16, protocol string) (PortForward, error) {
+	return nm.ExposePort(containerID, hostPort, containerPort, protocol)
+}
+
+// UnexposePort removes the forward of hostPort to containerID
+func (nm *NetworkManager) UnexposePort(containerID string, hostPort uint16, protocol string) error {
+	if protocol == "" {
+		protocol = "tcp"
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	for i, fwd := range cn.Ports {
+		if fwd.HostPort == hostPort && fwd.Protocol == protocol {
+			ports := cn.Ports
+			cn.Ports = append(ports[:i:i], ports[i+1:]...)
+			if err := nm.applyForwards(); err != nil {
+				cn.Ports = ports
+				return err
+			}
+			nm.log.Info("Unexposed container port", "container_id", containerID,
+				"host_port", hostPort, "protocol", protocol)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s/%d on %s", ErrForwardNotFound, protocol, hostPort, containerID)
+}
+
+// ListPortForwards returns the active forwards ordered by protocol and
+// host port
+func (nm *NetworkManager) ListPortForwards() []PortForward {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.portForwards()
+}
+
+// portForwards collects the forwards of all containers. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) portForwards() []PortForward {
+	var out []PortForward
+	for _, cn := range nm.containers {
+		out = append(out, cn.Ports...)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Protocol != out[j].Protocol {
+			return out[i].Protocol < out[j].Protocol
+		}
+		return out[i].HostPort < out[j].HostPort
+	})
+	return out
+}
+
+// findForward returns the forward using hostPort. Callers must hold nm.mu.
+func (nm *NetworkManager) findForward(hostPort uint16, protocol string) (PortForward, bool) {
+	for _, cn := range nm.containers {
+		for _, fwd := range cn.Ports {
+			if fwd.HostPort == hostPort && fwd.Protocol == protocol {
+				return fwd, true
+			}
+		}
+	}
+	return PortForward{}, false
+}
+
+// applyForwards programs the current forwards and persists them. Callers
+// must hold nm.mu.
+func (nm *NetworkManager) applyForwards() error {
+	if err := nm.syncForwards(); err != nil {
+		return fmt.Errorf("failed to program port forwards: %w", err)
+	}
+	return nm.saveState()
+}
+
+// checkHostPortFree fails with ErrPortInUse when a host process is bound
+// to the port, since forwarded traffic would shadow it.
+func checkHostPortFree(port uint16, protocol string) error {
+	addr := net.JoinHostPort("", strconv.Itoa(int(port)))
+	var err error
+	if protocol == "udp" {
+		var conn net.PacketConn
+		if conn, err = net.ListenPacket("udp", addr); err == nil {
+			conn.Close()
+		}
+	} else {
+		var l net.Listener
+		if l, err = net.Listen("tcp", addr); err == nil {
+			l.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s/%d: %v", ErrPortInUse, protocol, port, err)
+	}
+	return nil
+}
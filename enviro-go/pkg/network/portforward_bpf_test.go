@@ -0,0 +1,152 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcRedirect is the TC verdict of bpf_redirect
+const tcRedirect = 7
+
+// onesSum adds the 16-bit words of b to sum
+func onesSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return sum
+}
+
+// segmentSums returns the ones' complement sums of the IPv4 header of the
+// TCP segment in frame, 0xffff for IPv6, which has no header checksum, and
+// of the segment with its pseudo header. Both are 0xffff when the
+// checksums are right.
+func segmentSums(frame []byte) (ip, tcp uint16) {
+	ip = 0xffff
+	var pseudo, seg []byte
+	if binary.BigEndian.Uint16(frame[12:]) == unix.ETH_P_IP {
+		ip = uint16(onesSum(0, frame[14:34]))
+		pseudo, seg = frame[26:34], frame[34:]
+	} else {
+		pseudo, seg = frame[22:54], frame[54:]
+	}
+	sum := onesSum(0, pseudo) + unix.IPPROTO_TCP + uint32(len(seg))
+	return ip, uint16(onesSum(sum, seg))
+}
+
+// withChecksums fills in the checksums of the TCP segment in frame
+func withChecksums(frame []byte) []byte {
+	tcp := 54
+	if binary.BigEndian.Uint16(frame[12:]) == unix.ETH_P_IP {
+		tcp = 34
+		ip, _ := segmentSums(frame)
+		binary.BigEndian.PutUint16(frame[24:], ^ip)
+	}
+	_, sum := segmentSums(frame)
+	binary.BigEndian.PutUint16(frame[tcp+16:], ^sum)
+	return frame
+}
+
+// TestUnforward translates the replies of forwarded flows back in the
+// source check, as tc_port_forward left them for it, and expires the
+// translations of flows conntrack no longer tracks
+func TestUnforward(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	clientMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0c}
+	hostMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	tests := []struct {
+		name              string
+		container, client netip.Addr
+		host              netip.Addr
+	}{
+		{
+			name:      "IPv4",
+			container: netip.MustParseAddr("10.0.0.2"),
+			client:    netip.MustParseAddr("192.0.2.7"),
+			host:      netip.MustParseAddr("198.51.100.1"),
+		},
+		{
+			name:      "IPv6",
+			container: netip.MustParseAddr("fd00::2"),
+			client:    netip.MustParseAddr("2001:db8::7"),
+			host:      netip.MustParseAddr("2001:db8:1::1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := loadSourceCheck(t, mac, []netip.Prefix{netip.PrefixFrom(tt.container, tt.container.BitLen())})
+			reply := tcpSegment{
+				src:   netip.AddrPortFrom(tt.container, 80),
+				dst:   netip.AddrPortFrom(tt.client, 40000),
+				flags: tcpSYN | tcpACK,
+			}
+			frame := func() []byte { return withChecksums(withMAC(reply.frame(), mac)) }
+
+			// Replies of flows that weren't forwarded are left alone
+			ret, _, err := x.coll.Programs[sourceProgram].Test(frame())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ret != tcOK {
+				t.Fatalf("reply to an unforwarded flow: verdict %d, want %d", ret, tcOK)
+			}
+
+			key := ctKey{Src: tt.container.As16(), Dst: tt.client.As16(), Proto: unix.IPPROTO_TCP}
+			binary.BigEndian.PutUint16(key.Sport[:], 80)
+			binary.BigEndian.PutUint16(key.Dport[:], 40000)
+			e := natEntry{Addr: tt.host.As16(), Ifindex: testIfindex}
+			binary.BigEndian.PutUint16(e.Port[:], 8080)
+			copy(e.MAC[:], clientMAC)
+			copy(e.HostMAC[:], hostMAC)
+			if err := x.natConntrack.Put(key, e); err != nil {
+				t.Fatal(err)
+			}
+
+			ret, out, err := x.coll.Programs[sourceProgram].Test(frame())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ret != tcRedirect {
+				t.Fatalf("reply to a forwarded flow: verdict %d, want %d", ret, tcRedirect)
+			}
+			got := parseSegment(t, out)
+			if want := netip.AddrPortFrom(tt.host, 8080); got.src != want || got.dst != reply.dst {
+				t.Errorf("reply translated to %v -> %v, want %v -> %v", got.src, got.dst, want, reply.dst)
+			}
+			if dst, src := net.HardwareAddr(out[0:6]), net.HardwareAddr(out[6:12]); dst.String() != clientMAC.String() || src.String() != hostMAC.String() {
+				t.Errorf("reply sent from %v to %v, want from %v to %v", src, dst, hostMAC, clientMAC)
+			}
+			if ip, tcp := segmentSums(out); ip != 0xffff || tcp != 0xffff {
+				t.Errorf("checksums off: IP header sums to %#x, TCP to %#x", ip, tcp)
+			}
+
+			// The translation lasts as long as the flow it translates
+			if err := x.conntrack.Put(key.reverse(), ctEntry{Ifindex: testIfindex, State: 2}); err != nil {
+				t.Fatal(err)
+			}
+			if err := x.expireForwards(); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := countEntries(x.natConntrack); err != nil || n != 1 {
+				t.Errorf("nat_conntrack has %d entries while the flow is tracked, %v", n, err)
+			}
+			if err := x.FlushConnections(testIfindex); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := countEntries(x.natConntrack); err != nil || n != 0 {
+				t.Errorf("nat_conntrack has %d entries once the flow is gone, %v", n, err)
+			}
+		})
+	}
+}
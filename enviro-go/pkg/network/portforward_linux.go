@@ -0,0 +1,331 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nftTableName is the inet table holding the port forward DNAT rules
+const nftTableName = "enviro"
+
+// syncForwards rebuilds the DNAT table from the current forwards in one
+// atomic batch and has the router translate them too, see
+// syncDatapathForwards. The rules translate what the router leaves to the
+// kernel, e.g. connections from the host itself, and conntrack reverses
+// the translation for replies. The forwarded TCP ports are also handed to
+// SYN protection. In rootless mode, the slirp4netns of each container
+// forwards its ports instead. Callers must hold nm.mu.
+func (nm *NetworkManager) syncForwards() error {
+	if nm.rootless {
+		return nm.syncSlirpForwards()
+	}
+	forwards := nm.portForwards()
+	if len(forwards) == 0 && !nm.forwarding {
+		return nil
+	}
+
+	conn := &nftables.Conn{}
+	table := resetTable(conn, nm.nftTable(nftTableName), nftables.TableFamilyINet)
+
+	if len(forwards) > 0 {
+		conn.AddTable(table)
+		chains := []*nftables.Chain{
+			conn.AddChain(&nftables.Chain{
+				Name:     "prerouting",
+				Table:    table,
+				Type:     nftables.ChainTypeNAT,
+				Hooknum:  nftables.ChainHookPrerouting,
+				Priority: nftables.ChainPriorityNATDest,
+			}),
+			// Connections from the host itself to a local address. Loopback
+			// destinations are left alone since the kernel drops them once
+			// rewritten to a non-local address.
+			conn.AddChain(&nftables.Chain{
+				Name:     "output",
+				Table:    table,
+				Type:     nftables.ChainTypeNAT,
+				Hooknum:  nftables.ChainHookOutput,
+				Priority: nftables.ChainPriorityNATDest,
+			}),
+		}
+
+		for _, fwd := range forwards {
+			for _, addr := range nm.containers[fwd.ContainerID].addrs() {
+				for _, chain := range chains {
+					conn.AddRule(&nftables.Rule{
+						Table: table,
+						Chain: chain,
+						Exprs: dnatExprs(fwd, addr.AsSlice(), chain.Hooknum == nftables.ChainHookOutput),
+					})
+				}
+			}
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	nm.forwarding = len(forwards) > 0
+	if err := nm.syncDatapathForwards(); err != nil {
+		return err
+	}
+	return nm.syncSYNProtection()
+}
+
+// resetTable queues deleting the nftables table name of family on conn and
+// returns it, for the caller to add again with its new contents. Adding
+// first makes the delete succeed when the table doesn't exist.
+func resetTable(conn *nftables.Conn, name string, family nftables.TableFamily) *nftables.Table {
+	table := &nftables.Table{Name: name, Family: family}
+	conn.AddTable(table)
+	conn.DelTable(table)
+	return table
+}
+
+// dnatExprs matches fwd's protocol and host port on traffic to a local
+// address of addr's family and rewrites it to addr and the container port:
+//
+//	meta nfproto ipv4 meta l4proto tcp fib daddr type local th dport 8080 dnat ip to 10.88.0.2:80
+//
+// With skipLoopback, destinations in 127.0.0.0/8 or ::1 don't match.
+func dnatExprs(fwd PortForward, addr []byte, skipLoopback bool) []expr.Any {
+	family := byte(unix.NFPROTO_IPV4)
+	if len(addr) == 16 {
+		family = unix.NFPROTO_IPV6
+	}
+	proto := byte(unix.IPPROTO_TCP)
+	if fwd.Protocol == "udp" {
+		proto = unix.IPPROTO_UDP
+	}
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+	}
+	if skipLoopback {
+		if family == unix.NFPROTO_IPV4 {
+			exprs = append(exprs,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 1},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{127}},
+			)
+		} else {
+			exprs = append(exprs,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: net.IPv6loopback},
+			)
+		}
+	}
+
+	return append(exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(fwd.HostPort)},
+		&expr.Immediate{Register: 1, Data: addr},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(fwd.ContainerPort)},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      uint32(family),
+			RegAddrMin:  1,
+			RegProtoMin: 2,
+		},
+	)
+}
+
+// forwardKey mirrors struct forward_key in bpf/container_router.c
+type forwardKey struct {
+	Port  [2]byte
+	Proto uint8
+	Pad   uint8
+}
+
+// bpfForward mirrors struct forward in bpf/container_router.c
+type bpfForward struct {
+	Addr6   [16]byte
+	Addr4   [4]byte
+	Ifindex uint32
+	Port    [2]byte
+	Pad     uint16
+}
+
+// natEntry mirrors struct nat_entry in bpf/container_router.c
+type natEntry struct {
+	Addr    [16]byte
+	Ifindex uint32
+	Port    [2]byte
+	MAC     [6]byte
+	HostMAC [6]byte
+	Pad     [6]byte
+}
+
+func newForwardKey(fwd PortForward) forwardKey {
+	key := forwardKey{Proto: unix.IPPROTO_TCP}
+	if fwd.Protocol == "udp" {
+		key.Proto = unix.IPPROTO_UDP
+	}
+	binary.BigEndian.PutUint16(key.Port[:], fwd.HostPort)
+	return key
+}
+
+func newBPFForward(cn *ContainerNetwork, fwd PortForward) bpfForward {
+	v := bpfForward{Ifindex: uint32(cn.HostIfindex)}
+	for _, addr := range cn.addrs() {
+		if addr.Is4() {
+			v.Addr4 = addr.As4()
+		} else {
+			v.Addr6 = addr.As16()
+		}
+	}
+	binary.BigEndian.PutUint16(v.Port[:], fwd.ContainerPort)
+	return v
+}
+
+// translatesForwards reports whether the router translates forwarded
+// ports: the TC router does itself, the XDP router with the port forward
+// filter behind it
+func (x *xdpProgram) translatesForwards() bool {
+	return x.portForwards != nil && x.natConntrack != nil && (x.mode == DatapathTC || x.forward != nil)
+}
+
+// SetForwards programs forwards as the only port_forwards entries
+func (x *xdpProgram) SetForwards(forwards map[forwardKey]bpfForward) error {
+	// Deleting while iterating can restart the iteration, so collect first
+	batch := newMapBatch[forwardKey, bpfForward](x.portForwards)
+	var key forwardKey
+	var v bpfForward
+	iter := x.portForwards.Iterate()
+	for iter.Next(&key, &v) {
+		if _, ok := forwards[key]; !ok {
+			batch.delete(key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for key, v := range forwards {
+		batch.put(key, v)
+	}
+	return batch.flush()
+}
+
+// expireForwards removes the translations of the forwarded flows the
+// router no longer tracks, which conntrack holds the other way round
+func (x *xdpProgram) expireForwards() error {
+	if x.natConntrack == nil {
+		return nil
+	}
+	// Deleting while iterating can restart the iteration, so collect first
+	var keys []ctKey
+	var key ctKey
+	var e natEntry
+	var entry ctEntry
+	iter := x.natConntrack.Iterate()
+	for iter.Next(&key, &e) {
+		if errors.Is(x.conntrack.Lookup(key.reverse(), &entry), ebpf.ErrKeyNotExist) {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := ignoreNotExist(x.natConntrack.Delete(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// portForwardFilter is the port forward filter behind the XDP router on the
+// interface with index. Its handle and priority differ from those of the
+// TC router's filter, so neither replaces the other.
+func portForwardFilter(index int) *netlink.BpfFilter {
+	return &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Handle:    2,
+			Priority:  tcFilterPriority + 1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Name:         forwardProgram,
+		DirectAction: true,
+	}
+}
+
+// attachForward attaches the port forward filter to ifc, or points the
+// filter there at the program in use, when the router runs in an XDP
+// mode. In TC mode, whose router translates forwarded ports itself, a
+// filter left from another mode is removed. Without the filter, e.g. as
+// the kernel can't run it, the nftables rules translate alone.
+func (x *xdpProgram) attachForward(ifc *net.Interface) {
+	prog := x.coll.Programs[forwardProgram]
+	if x.mode == DatapathTC || prog == nil {
+		detachForward(ifc.Index)
+		return
+	}
+	if addClsact(ifc.Index) != nil {
+		return
+	}
+	l := &tcLink{filter: portForwardFilter(ifc.Index)}
+	if l.Update(prog) == nil {
+		x.forward = l
+	}
+}
+
+// detachForward removes the port forward filter from the interface with
+// index
+func detachForward(index int) error {
+	err := deleteFilter(portForwardFilter(index))
+	// The interface has no clsact qdisc
+	if errors.Is(err, unix.EINVAL) {
+		return nil
+	}
+	return err
+}
+
+// syncDatapathForwards has the router translate the current forwards, to
+// the containers whose replies its source check translates back. It skips
+// containers mirroring what they send, as the translated replies leave
+// their veth before the mirror filters see them. The others are left to
+// the nftables rules. Callers must hold nm.mu.
+func (nm *NetworkManager) syncDatapathForwards() error {
+	if nm.xdp == nil || nm.xdp.portForwards == nil {
+		return nil
+	}
+	forwards := make(map[forwardKey]bpfForward)
+	if nm.xdp.translatesForwards() && nm.xdp.hasSourceCheck() {
+		for _, fwd := range nm.portForwards() {
+			cn := nm.containers[fwd.ContainerID]
+			if !cn.sourceChecked() || mirrorsEgress(cn.Mirrors) {
+				continue
+			}
+			forwards[newForwardKey(fwd)] = newBPFForward(cn, fwd)
+		}
+	}
+	if err := nm.xdp.SetForwards(forwards); err != nil {
+		return fmt.Errorf("failed to program datapath port forwards: %w", err)
+	}
+	return nil
+}
+
+// initPortForwards records whether the freshly loaded xdp translates
+// forwarded ports, noting when they are left to nftables
+func (nm *NetworkManager) initPortForwards(xdp *xdpProgram) {
+	if !xdp.translatesForwards() {
+		nm.log.Info("Port forwards translated by nftables only: the router can't translate them in this mode")
+	}
+}
@@ -0,0 +1,67 @@
+package network
+
+import "errors"
+
+// ErrPrivileges is returned when the manager can't drop its privileges,
+// or lacks one it still needs once they are dropped
+var ErrPrivileges = errors.New("network: privilege drop failed")
+
+// PrivilegeClass is a class of operations the manager runs after its
+// datapath is initialized, which each need some capabilities kept when
+// DropPrivileges drops the rest:
+//
+//	class    capabilities                     operations
+//	netlink  CAP_NET_ADMIN                    links, addresses, routes, qdiscs,
+//	                                          nftables, the overlay and WireGuard
+//	netns    CAP_SYS_ADMIN, CAP_SYS_PTRACE    entering container namespaces, and
+//	                                          opening those of other users' processes
+//	raw      CAP_NET_RAW                      packet capture, AF_XDP and DHCP sockets
+//	bpf      CAP_BPF, CAP_PERFMON             reloading and upgrading the XDP router,
+//	         (CAP_SYS_ADMIN before 5.8)       with CAP_NET_ADMIN to attach it
+//
+// Everything else, e.g. pinning programs, creating the bridge and overlay
+// devices, binding DNS and the API, is done while the manager and control
+// plane are created, before the drop. A rootless manager needs none.
+type PrivilegeClass string
+
+const (
+	PrivilegeNetlink PrivilegeClass = "netlink"
+	PrivilegeNetns   PrivilegeClass = "netns"
+	PrivilegeRaw     PrivilegeClass = "raw"
+	PrivilegeBPF     PrivilegeClass = "bpf"
+)
+
+// privilegeClasses returns the classes of operations the manager still
+// runs once initialized
+func (nm *NetworkManager) privilegeClasses() []PrivilegeClass {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.rootless {
+		return nil
+	}
+	classes := []PrivilegeClass{PrivilegeNetlink, PrivilegeNetns, PrivilegeRaw}
+	// ReloadXDP can attach the router later even if it failed at init
+	if nm.config.EnableXDP {
+		classes = append(classes, PrivilegeBPF)
+	}
+	return classes
+}
+
+// DropPrivileges switches the whole process to uid and gid, keeping only
+// the capabilities of the classes of operations the manager still runs,
+// then checks that an operation of each class succeeds. It is meant for a
+// process running a single manager, once it and everything else needing
+// root are initialized and before any request is served. A failed check
+// leaves the process without the privileges it needs, so it should exit.
+func (nm *NetworkManager) DropPrivileges(uid, gid int) error {
+	classes := nm.privilegeClasses()
+	caps, err := dropPrivileges(uid, gid, classes)
+	if err != nil {
+		return err
+	}
+	if err := checkPrivileges(classes); err != nil {
+		return err
+	}
+	nm.log.Info("Dropped privileges", "uid", uid, "gid", gid, "capabilities", caps)
+	return nil
+}
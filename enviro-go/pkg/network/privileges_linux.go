@@ -0,0 +1,224 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// privilegeCaps are the capabilities each class of operations needs, see
+// PrivilegeClass
+var privilegeCaps = map[PrivilegeClass][]int{
+	PrivilegeNetlink: {unix.CAP_NET_ADMIN},
+	PrivilegeNetns:   {unix.CAP_SYS_ADMIN, unix.CAP_SYS_PTRACE},
+	PrivilegeRaw:     {unix.CAP_NET_RAW},
+	PrivilegeBPF:     {unix.CAP_BPF, unix.CAP_PERFMON, unix.CAP_NET_ADMIN},
+}
+
+// capNames names the capabilities of privilegeCaps in logs and errors
+var capNames = map[int]string{
+	unix.CAP_NET_ADMIN:  "CAP_NET_ADMIN",
+	unix.CAP_SYS_ADMIN:  "CAP_SYS_ADMIN",
+	unix.CAP_SYS_PTRACE: "CAP_SYS_PTRACE",
+	unix.CAP_NET_RAW:    "CAP_NET_RAW",
+	unix.CAP_BPF:        "CAP_BPF",
+	unix.CAP_PERFMON:    "CAP_PERFMON",
+}
+
+// privilegeCanaries run an operation of each class, which fails without
+// its capabilities
+var privilegeCanaries = map[PrivilegeClass]func() error{
+	PrivilegeNetlink: func() error {
+		// Setting lo up changes nothing but is only allowed with
+		// CAP_NET_ADMIN
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(lo)
+	},
+	PrivilegeNetns: func() error {
+		ns, err := netns.Get()
+		if err != nil {
+			return err
+		}
+		defer ns.Close()
+		return inNetns(ns, func() error { return nil })
+	},
+	PrivilegeRaw: func() error {
+		fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		return unix.Close(fd)
+	},
+	PrivilegeBPF: func() error {
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Type:    ebpf.XDP,
+			License: "GPL",
+			Instructions: asm.Instructions{
+				asm.Mov.Imm(asm.R0, 2), // XDP_PASS
+				asm.Return(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return prog.Close()
+	},
+}
+
+// keptCaps returns the capabilities classes need, sorted, on a kernel
+// whose highest capability is last
+func keptCaps(classes []PrivilegeClass, last int) []int {
+	var caps []int
+	for _, class := range classes {
+		for _, c := range privilegeCaps[class] {
+			// Kernels before 5.8 gate eBPF on CAP_SYS_ADMIN
+			if c > last {
+				c = unix.CAP_SYS_ADMIN
+			}
+			if !slices.Contains(caps, c) {
+				caps = append(caps, c)
+			}
+		}
+	}
+	slices.Sort(caps)
+	return caps
+}
+
+// capNameList names caps
+func capNameList(caps []int) []string {
+	names := make([]string, len(caps))
+	for i, c := range caps {
+		names[i] = capNames[c]
+	}
+	return names
+}
+
+// lastCap returns the highest capability the kernel knows
+func lastCap() int {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	return last
+}
+
+// allThreads makes a system call without pointer arguments on every
+// thread of the process, for the credentials the kernel keeps per thread.
+// It fails with ENOTSUP in a cgo build, whose threads the Go runtime
+// doesn't all control.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	if _, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropPrivileges switches every thread to uid and gid with only the
+// capabilities of classes, which it returns, in their permitted and
+// effective sets and the bounding set of children
+func dropPrivileges(uid, gid int, classes []PrivilegeClass) ([]string, error) {
+	if uid < 0 || gid < 0 {
+		return nil, fmt.Errorf("%w: invalid uid %d or gid %d", ErrPrivileges, uid, gid)
+	}
+	last := lastCap()
+	caps := keptCaps(classes, last)
+	var keep uint64
+	for _, c := range caps {
+		keep |= 1 << c
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return nil, fmt.Errorf("%w: reading capabilities: %v", ErrPrivileges, err)
+	}
+	permitted := uint64(data[0].Permitted) | uint64(data[1].Permitted)<<32
+	if missing := keep &^ permitted; missing != 0 {
+		var names []int
+		for _, c := range caps {
+			if missing&(1<<c) != 0 {
+				names = append(names, c)
+			}
+		}
+		return nil, fmt.Errorf("%w: process lacks %s", ErrPrivileges, strings.Join(capNameList(names), ", "))
+	}
+
+	// Permitted capabilities only survive the switch away from root with
+	// keep caps set, which is per thread like them
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, fmt.Errorf("%w: a cgo build can't change the capabilities of all its threads", ErrPrivileges)
+		}
+		return nil, fmt.Errorf("%w: setting keep caps: %v", ErrPrivileges, err)
+	}
+	// Nor can children, e.g. slirp4netns, gain back the rest
+	for c := 0; c <= last; c++ {
+		if keep&(1<<c) != 0 {
+			continue
+		}
+		if err := allThreads(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, uintptr(c), 0); err != nil {
+			return nil, fmt.Errorf("%w: dropping capability %d from the bounding set: %v", ErrPrivileges, c, err)
+		}
+	}
+
+	// A user namespace whose gid map was written without CAP_SETGID denies
+	// setgroups, and has no supplementary groups to clear
+	if setgroups, err := os.ReadFile("/proc/self/setgroups"); err != nil || strings.TrimSpace(string(setgroups)) != "deny" {
+		if err := syscall.Setgroups(nil); err != nil {
+			return nil, fmt.Errorf("%w: clearing groups: %v", ErrPrivileges, err)
+		}
+	}
+	// The stdlib changes the IDs of every thread
+	if err := syscall.Setgid(gid); err != nil {
+		return nil, fmt.Errorf("%w: setting gid %d: %v", ErrPrivileges, gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return nil, fmt.Errorf("%w: setting uid %d: %v", ErrPrivileges, uid, err)
+	}
+
+	// The switch cleared the effective set; restore the kept capabilities
+	// there and drop the rest from the permitted set
+	data = [2]unix.CapUserData{
+		{Permitted: uint32(keep), Effective: uint32(keep)},
+		{Permitted: uint32(keep >> 32), Effective: uint32(keep >> 32)},
+	}
+	// Called directly for the pointers to be kept alive
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return nil, fmt.Errorf("%w: setting capabilities: %v", ErrPrivileges, errno)
+	}
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 0, 0); err != nil {
+		return nil, fmt.Errorf("%w: clearing keep caps: %v", ErrPrivileges, err)
+	}
+	return capNameList(caps), nil
+}
+
+// checkPrivileges runs the canary of each class, failing when one can't
+// run with the privileges left
+func checkPrivileges(classes []PrivilegeClass) error {
+	for _, class := range classes {
+		if err := privilegeCanaries[class](); err != nil {
+			return fmt.Errorf("%w: %s operations fail with the privileges left: %v", ErrPrivileges, class, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// privilegeTestEnv names the case a child of TestDropPrivileges runs
+const privilegeTestEnv = "ENVIRO_TEST_DROP_PRIVILEGES"
+
+func TestKeptCaps(t *testing.T) {
+	tests := []struct {
+		name    string
+		classes []PrivilegeClass
+		last    int
+		want    []int
+	}{
+		{name: "rootless"},
+		{name: "netlink", classes: []PrivilegeClass{PrivilegeNetlink}, last: unix.CAP_LAST_CAP, want: []int{unix.CAP_NET_ADMIN}},
+		{
+			name:    "all",
+			classes: []PrivilegeClass{PrivilegeNetlink, PrivilegeNetns, PrivilegeRaw, PrivilegeBPF},
+			last:    unix.CAP_LAST_CAP,
+			want:    []int{unix.CAP_NET_ADMIN, unix.CAP_NET_RAW, unix.CAP_SYS_PTRACE, unix.CAP_SYS_ADMIN, unix.CAP_PERFMON, unix.CAP_BPF},
+		},
+		{
+			name:    "bpf before 5.8",
+			classes: []PrivilegeClass{PrivilegeBPF},
+			last:    unix.CAP_AUDIT_READ,
+			want:    []int{unix.CAP_NET_ADMIN, unix.CAP_SYS_ADMIN},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keptCaps(tt.classes, tt.last); !slices.Equal(got, tt.want) {
+				t.Errorf("keptCaps() = %v, want %v", capNameList(got), capNameList(tt.want))
+			}
+		})
+	}
+}
+
+// TestDropPrivileges drops privileges in children in user and network
+// namespaces of their own, as a drop can't be undone. It runs as root in
+// CI; otherwise the children can only be root in their namespace.
+func TestDropPrivileges(t *testing.T) {
+	if name := os.Getenv(privilegeTestEnv); name != "" {
+		runPrivilegeCase(t, name)
+		return
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_GETPID, 0, 0, 0); errno == unix.ENOTSUP {
+		t.Skip("dropping privileges needs a build without cgo, run with CGO_ENABLED=0")
+	}
+
+	for _, name := range []string{"keep", "refuse"} {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$", "-test.v")
+			cmd.Env = append(os.Environ(), privilegeTestEnv+"="+name)
+			cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET}
+			if os.Getuid() == 0 {
+				cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}}
+				cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}}
+				cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+			} else {
+				cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+				cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+			}
+			out, err := cmd.CombinedOutput()
+			var exit *exec.ExitError
+			if err != nil && !errors.As(err, &exit) {
+				t.Skipf("user namespaces unavailable: %v", err)
+			}
+			if err != nil || !strings.Contains(string(out), "--- PASS: TestDropPrivileges") {
+				t.Fatalf("child failed: %v\n%s", err, out)
+			}
+		})
+	}
+}
+
+// runPrivilegeCase runs case name of TestDropPrivileges as its child
+func runPrivilegeCase(t *testing.T, name string) {
+	// Users other than root are mapped when the parent is root
+	uid, gid := 0, 0
+	data, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := strings.Fields(string(data)); len(fields) == 3 && fields[2] != "1" {
+		uid, gid = 65534, 65534
+	}
+
+	switch name {
+	case "keep":
+		classes := []PrivilegeClass{PrivilegeNetlink, PrivilegeNetns, PrivilegeRaw}
+		caps, err := dropPrivileges(uid, gid, classes)
+		if err != nil {
+			t.Fatalf("dropPrivileges(): %v", err)
+		}
+		if want := []string{"CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_SYS_PTRACE", "CAP_SYS_ADMIN"}; !slices.Equal(caps, want) {
+			t.Errorf("dropPrivileges() = %v, want %v", caps, want)
+		}
+		if os.Getuid() != uid || os.Getgid() != gid {
+			t.Errorf("running as %d:%d, want %d:%d", os.Getuid(), os.Getgid(), uid, gid)
+		}
+		if err := checkPrivileges(classes); err != nil {
+			t.Errorf("checkPrivileges(): %v", err)
+		}
+		hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+		var data [2]unix.CapUserData
+		if err := unix.Capget(&hdr, &data[0]); err != nil {
+			t.Fatal(err)
+		}
+		want := uint32(1<<unix.CAP_NET_ADMIN | 1<<unix.CAP_NET_RAW | 1<<unix.CAP_SYS_PTRACE | 1<<unix.CAP_SYS_ADMIN)
+		if data[0].Permitted != want || data[0].Effective != want || data[1].Permitted != 0 || data[1].Effective != 0 {
+			t.Errorf("capabilities = %+v, want %#x permitted and effective", data, want)
+		}
+	case "refuse":
+		if _, err := dropPrivileges(uid, gid, []PrivilegeClass{PrivilegeNetlink}); err != nil {
+			t.Fatalf("dropPrivileges(): %v", err)
+		}
+		if err := checkPrivileges([]PrivilegeClass{PrivilegeNetlink}); err != nil {
+			t.Errorf("checkPrivileges(netlink): %v", err)
+		}
+		if err := checkPrivileges([]PrivilegeClass{PrivilegeNetns}); !errors.Is(err, ErrPrivileges) {
+			t.Errorf("checkPrivileges(netns) error = %v, want %v", err, ErrPrivileges)
+		}
+		// Nor can the dropped capabilities be raised again
+		if _, err := dropPrivileges(uid, gid, []PrivilegeClass{PrivilegeRaw}); !errors.Is(err, ErrPrivileges) {
+			t.Errorf("dropPrivileges(raw) error = %v, want %v", err, ErrPrivileges)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package network
+
+// dropPrivileges has no capabilities to keep on this platform
+func dropPrivileges(uid, gid int, classes []PrivilegeClass) ([]string, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func checkPrivileges(classes []PrivilegeClass) error {
+	return ErrUnsupportedPlatform
+}
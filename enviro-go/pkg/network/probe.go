@@ -0,0 +1,112 @@
+package network
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// How the router reports drops, see DatapathVariant
+const (
+	DropEventsRingBuf = "ringbuf"
+	DropEventsPerf    = "perf"
+)
+
+// KernelFeature is an eBPF feature of the kernel the datapath may use
+type KernelFeature struct {
+	// Name is e.g. "map/ringbuf", "helper/xdp/bpf_redirect" or
+	// "kfunc/bpf_xdp_ct_lookup"
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	// Error is why the feature is unavailable or couldn't be probed
+	Error string `json:"error,omitempty"`
+}
+
+// DatapathVariant is how the router is loaded on this kernel, chosen from
+// its features
+type DatapathVariant struct {
+	// Modes are the attach modes the kernel can run the router in, in the
+	// order they are tried. Native XDP also needs a driver supporting it,
+	// so the router may end up attached in a later mode.
+	Modes []DatapathMode `json:"modes"`
+	// DropEvents is how drops are reported to userspace: through a ring
+	// buffer, or a perf event array on kernels before 5.8
+	DropEvents string `json:"drop_events"`
+	// ConntrackMap is the map type of the connection table, "lru_hash" or,
+	// on kernels without LRU maps, "hash", which stops tracking new
+	// connections once full until expiry makes room
+	ConntrackMap string `json:"conntrack_map"`
+	// BatchOps is true when map updates are written in batches
+	BatchOps bool `json:"batch_ops"`
+	// SYNCookies is true when the XDP router can answer SYN floods with
+	// cookies, from 6.0, see SYNProtectionConfig
+	SYNCookies bool `json:"syn_cookies"`
+	// ConnectPolicy is true when policies can be enforced as containers
+	// connect, from 5.7, see ConnectPolicyConfig
+	ConnectPolicy bool `json:"connect_policy"`
+	// SocketAcceleration is true when TCP between containers of this node
+	// can be spliced through a sockhash, from 5.4, see
+	// SocketAccelerationConfig
+	SocketAcceleration bool `json:"socket_acceleration"`
+	// ProxyRedirect is true when containers can steer their traffic to a
+	// proxy, from 5.7, see ProxyRedirectConfig
+	ProxyRedirect bool `json:"proxy_redirect"`
+	// Error is why the kernel can't run the router at all
+	Error string `json:"error,omitempty"`
+}
+
+// KernelCapabilities is what probing the kernel found it to support
+type KernelCapabilities struct {
+	// Release is the kernel release, as in uname -r
+	Release  string    `json:"release"`
+	ProbedAt time.Time `json:"probed_at"`
+	// Features are ordered by name
+	Features []KernelFeature `json:"features"`
+	Datapath DatapathVariant `json:"datapath"`
+}
+
+// Has reports whether the feature called name is available
+func (k KernelCapabilities) Has(name string) bool {
+	for _, f := range k.Features {
+		if f.Name == name {
+			return f.Available
+		}
+	}
+	return false
+}
+
+// sortFeatures orders features by name
+func sortFeatures(features []KernelFeature) {
+	sort.Slice(features, func(i, j int) bool { return features[i].Name < features[j].Name })
+}
+
+// probedKernel probes the kernel the first time it is called, which takes
+// a few dozen syscalls, and returns the same outcome from then on
+var probedKernel = sync.OnceValue(probeKernel)
+
+// KernelCapabilities returns the kernel features found at startup and the
+// datapath variant chosen for them
+func (nm *NetworkManager) KernelCapabilities() KernelCapabilities {
+	k := probedKernel()
+	k.Features = append([]KernelFeature(nil), k.Features...)
+	k.Datapath.Modes = append([]DatapathMode(nil), k.Datapath.Modes...)
+	return k
+}
+
+// logKernel logs the outcome of probing the kernel
+func (nm *NetworkManager) logKernel() {
+	k := probedKernel()
+	var missing []string
+	for _, f := range k.Features {
+		if !f.Available {
+			missing = append(missing, f.Name)
+		}
+	}
+	v := k.Datapath
+	if v.Error != "" {
+		nm.log.Info("Probed kernel, XDP router unsupported", "release", k.Release, "error", v.Error, "missing", missing)
+		return
+	}
+	nm.log.Info("Probed kernel", "release", k.Release, "modes", v.Modes, "drop_events", v.DropEvents,
+		"conntrack_map", v.ConntrackMap, "batch_ops", v.BatchOps, "syn_cookies", v.SYNCookies, "missing", missing)
+}
@@ -0,0 +1,285 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+	"golang.org/x/sys/unix"
+)
+
+// probedMaps are the map types the router may create, by the name they are
+// reported as. Those of optionalMaps have a fallback.
+var probedMaps = []struct {
+	name string
+	typ  ebpf.MapType
+}{
+	{"array", ebpf.Array},
+	{"hash", ebpf.Hash},
+	{"lpm_trie", ebpf.LPMTrie},
+	{"lru_hash", ebpf.LRUHash},
+	{"percpu_array", ebpf.PerCPUArray},
+	{"percpu_hash", ebpf.PerCPUHash},
+	{"perf_event_array", ebpf.PerfEventArray},
+	{"ringbuf", ebpf.RingBuf},
+	{"sockhash", ebpf.SockHash},
+	{"xskmap", ebpf.XSKMap},
+}
+
+var optionalMaps = map[string]bool{"lru_hash": true, "perf_event_array": true, "ringbuf": true, "sockhash": true}
+
+// routerHelpers are the helpers the router calls as each program type,
+// besides those of dropHelpers
+var routerHelpers = map[ebpf.ProgramType][]asm.BuiltinFunc{
+	ebpf.XDP: {
+		asm.FnRedirect, asm.FnRedirectMap, asm.FnXdpAdjustHead, asm.FnXdpAdjustTail,
+		asm.FnCsumDiff, asm.FnGetPrandomU32,
+	},
+	ebpf.SchedCLS: {asm.FnRedirect, asm.FnSkbPullData, asm.FnCsumDiff, asm.FnGetPrandomU32},
+}
+
+// dropHelpers are the helpers reporting drops, by DatapathVariant.DropEvents
+var dropHelpers = map[string][]asm.BuiltinFunc{
+	DropEventsRingBuf: {asm.FnRingbufReserve, asm.FnRingbufSubmit},
+	DropEventsPerf:    {asm.FnPerfEventOutput},
+}
+
+// synCookieHelpers are the helpers of the router's SYN protection, which
+// only XDP programs run
+var synCookieHelpers = []asm.BuiltinFunc{
+	asm.FnTcpRawGenSyncookieIpv4, asm.FnTcpRawGenSyncookieIpv6,
+	asm.FnTcpRawCheckSyncookieIpv4, asm.FnTcpRawCheckSyncookieIpv6,
+}
+
+// accelHelpers are the helpers of socket acceleration, by the program type
+// calling them
+var accelHelpers = map[ebpf.ProgramType][]asm.BuiltinFunc{
+	ebpf.SockOps: {asm.FnSockHashUpdate, asm.FnSockOpsCbFlagsSet},
+	ebpf.SkMsg:   {asm.FnMsgRedirectHash},
+}
+
+// proxyHelpers are the helpers of proxy redirection, by the program type
+// calling them
+var proxyHelpers = map[ebpf.ProgramType][]asm.BuiltinFunc{
+	ebpf.SchedCLS:       {asm.FnSkcLookupTcp, asm.FnSkLookupUdp, asm.FnSkRelease, asm.FnSkAssign},
+	ebpf.CGroupSockAddr: {asm.FnGetSocketCookie, asm.FnGetCurrentUidGid, asm.FnGetCurrentAncestorCgroupId},
+	ebpf.SockOps:        {asm.FnGetSocketCookie},
+	ebpf.CGroupSockopt:  nil,
+}
+
+// conntrackKfuncs are the kernel's conntrack lookups for XDP and TC
+// programs, from 6.0, which a router could use in place of its own table
+var conntrackKfuncs = []string{"bpf_xdp_ct_lookup", "bpf_skb_ct_lookup"}
+
+// probeKernel probes for the features the router uses and chooses the
+// variant of it the kernel can run
+func probeKernel() KernelCapabilities {
+	k := KernelCapabilities{Release: kernelRelease(), ProbedAt: time.Now()}
+	probe := func(name string, err error) error {
+		// Features several parts of the router use are reported once
+		for _, f := range k.Features {
+			if f.Name == name {
+				return err
+			}
+		}
+		f := KernelFeature{Name: name, Available: err == nil}
+		if err != nil {
+			f.Error = err.Error()
+		}
+		k.Features = append(k.Features, f)
+		return err
+	}
+
+	var errs []error
+	for _, m := range probedMaps {
+		err := probe("map/"+m.name, features.HaveMapType(m.typ))
+		if err != nil && !optionalMaps[m.name] {
+			errs = append(errs, fmt.Errorf("kernel lacks eBPF map type %s: %w", m.typ, err))
+		}
+	}
+	// The router's constants are read-only global data, from 5.2
+	if err := probe("global_data", features.HaveMapFlag(features.BPF_F_RDONLY_PROG)); err != nil {
+		errs = append(errs, fmt.Errorf("kernel lacks read-only global data: %w", err))
+	}
+
+	v := &k.Datapath
+	v.ConntrackMap = "hash"
+	if k.Has("map/lru_hash") {
+		v.ConntrackMap = "lru_hash"
+	}
+
+	// Drops are reported the same way by every mode, through a ring buffer
+	// where both program types can
+	helpers := make(map[ebpf.ProgramType]map[asm.BuiltinFunc]error)
+	typeErrs := make(map[ebpf.ProgramType]error)
+	for _, typ := range []ebpf.ProgramType{ebpf.XDP, ebpf.SchedCLS} {
+		name := programTypeName(typ)
+		if typeErrs[typ] = probe("program/"+name, features.HaveProgramType(typ)); typeErrs[typ] != nil {
+			continue
+		}
+		helpers[typ] = make(map[asm.BuiltinFunc]error)
+		fns := append(append(append([]asm.BuiltinFunc(nil), routerHelpers[typ]...),
+			dropHelpers[DropEventsRingBuf]...), dropHelpers[DropEventsPerf]...)
+		if typ == ebpf.XDP {
+			fns = append(fns, synCookieHelpers...)
+		}
+		for _, fn := range fns {
+			helpers[typ][fn] = probe("helper/"+name+"/"+helperName(fn), features.HaveProgramHelper(typ, fn))
+		}
+	}
+	for _, t := range []struct{ events, mapName string }{
+		{DropEventsRingBuf, "map/ringbuf"},
+		{DropEventsPerf, "map/perf_event_array"},
+	} {
+		ok := k.Has(t.mapName) && len(helpers) > 0
+		for _, fns := range helpers {
+			for _, fn := range dropHelpers[t.events] {
+				ok = ok && fns[fn] == nil
+			}
+		}
+		if ok {
+			v.DropEvents = t.events
+			break
+		}
+	}
+	if v.DropEvents == "" {
+		errs = append(errs, errors.New("kernel can't report drops through a ring buffer or perf event array"))
+	}
+
+	var modeErrs []error
+	for _, m := range datapathModes {
+		typ := programType(m)
+		if err := typeErrs[typ]; err != nil {
+			modeErrs = append(modeErrs, fmt.Errorf("%s: kernel lacks %s support: %w", m, programTypeName(typ), err))
+			continue
+		}
+		var missing []error
+		for _, fn := range append(routerHelpers[typ], dropHelpers[v.DropEvents]...) {
+			if err := helpers[typ][fn]; err != nil {
+				missing = append(missing, fmt.Errorf("%s: kernel lacks eBPF helper %s: %w", m, helperName(fn), err))
+			}
+		}
+		if len(missing) > 0 {
+			modeErrs = append(modeErrs, missing...)
+			continue
+		}
+		v.Modes = append(v.Modes, m)
+	}
+	if len(v.Modes) == 0 {
+		errs = append(errs, modeErrs...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		v.Modes, v.Error = nil, err.Error()
+	}
+
+	v.SYNCookies = len(v.Modes) > 0 && helpers[ebpf.XDP] != nil
+	for _, fn := range synCookieHelpers {
+		v.SYNCookies = v.SYNCookies && helpers[ebpf.XDP][fn] == nil
+	}
+
+	// The connect-time policy programs find the container by the cgroups
+	// the process is nested in
+	sockAddr := programTypeName(ebpf.CGroupSockAddr)
+	v.ConnectPolicy = len(v.Modes) > 0 &&
+		probe("program/"+sockAddr, features.HaveProgramType(ebpf.CGroupSockAddr)) == nil &&
+		probe("helper/"+sockAddr+"/"+helperName(asm.FnGetCurrentAncestorCgroupId),
+			features.HaveProgramHelper(ebpf.CGroupSockAddr, asm.FnGetCurrentAncestorCgroupId)) == nil
+
+	// Socket acceleration splices sockets of the container cgroups through
+	// a sockhash
+	v.SocketAcceleration = len(v.Modes) > 0 && k.Has("map/sockhash") && probeHelpers(probe, accelHelpers)
+	// Proxy redirection assigns sockets from TC, the uses of the program
+	// type the router runs in aside
+	v.ProxyRedirect = len(v.Modes) > 0 && probeHelpers(probe, proxyHelpers)
+
+	v.BatchOps = probe("batch_ops", probeBatchOps()) == nil
+	kernel, btfErr := btf.LoadKernelSpec()
+	for _, name := range conntrackKfuncs {
+		err := btfErr
+		if err == nil {
+			_, err = kernel.AnyTypeByName(name)
+		}
+		probe("kfunc/"+name, err)
+	}
+
+	sortFeatures(k.Features)
+	return k
+}
+
+// probeBatchOps checks for BPF_MAP_UPDATE_BATCH, from 5.6
+func probeBatchOps() error {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, KeySize: 4, ValueSize: 4, MaxEntries: 1})
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	_, err = m.BatchUpdate([]uint32{0}, []uint32{0}, nil)
+	return err
+}
+
+// probeHelpers probes for the program types of helpers and their helpers,
+// reporting whether the kernel has all of them
+func probeHelpers(probe func(string, error) error, helpers map[ebpf.ProgramType][]asm.BuiltinFunc) bool {
+	types := make([]ebpf.ProgramType, 0, len(helpers))
+	for typ := range helpers {
+		types = append(types, typ)
+	}
+	slices.Sort(types)
+	ok := true
+	for _, typ := range types {
+		fns := helpers[typ]
+		name := programTypeName(typ)
+		if probe("program/"+name, features.HaveProgramType(typ)) != nil {
+			ok = false
+			continue
+		}
+		for _, fn := range fns {
+			if probe("helper/"+name+"/"+helperName(fn), features.HaveProgramHelper(typ, fn)) != nil {
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// programTypeName is the name a program type is reported as
+func programTypeName(typ ebpf.ProgramType) string {
+	if typ == ebpf.SchedCLS {
+		return "sched_cls"
+	}
+	return strings.ToLower(typ.String())
+}
+
+// helperName turns e.g. asm.FnXdpAdjustHead into bpf_xdp_adjust_head
+func helperName(fn asm.BuiltinFunc) string {
+	var b strings.Builder
+	b.WriteString("bpf")
+	prev := '_'
+	for _, r := range strings.TrimPrefix(fn.String(), "Fn") {
+		if unicode.IsUpper(r) && !unicode.IsUpper(prev) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+		prev = r
+	}
+	return b.String()
+}
+
+// kernelRelease returns the release of the running kernel, "" when uname
+// fails
+func kernelRelease() string {
+	var u unix.Utsname
+	if err := unix.Uname(&u); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(u.Release[:])
+}
@@ -0,0 +1,152 @@
+package network
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProgramStatsWindow is ProgramStatsConfig.Window when zero
+const DefaultProgramStatsWindow = time.Minute
+
+// ProgramStatsConfig has the kernel count the runs of the router's eBPF
+// programs and the time spent in them, see ProgramStats. Counting reads
+// the clock twice per packet, so with Interval set it is only on for
+// Window every Interval, and the averages are those of the packets in the
+// windows.
+type ProgramStatsConfig struct {
+	Enable bool `json:"enable"`
+	// Interval starts a sampling window every Interval when set; zero
+	// counts all the time
+	Interval time.Duration `json:"interval"`
+	// Window is how long each sampling window lasts, shorter than
+	// Interval, DefaultProgramStatsWindow when zero
+	Window time.Duration `json:"window"`
+}
+
+// withDefaults fills in the window of sampling
+func (c ProgramStatsConfig) withDefaults() ProgramStatsConfig {
+	if c.Interval > 0 && c.Window == 0 {
+		c.Window = min(DefaultProgramStatsWindow, c.Interval/2)
+	}
+	return c
+}
+
+// validate checks the interval and window, and that XDP is enabled
+func (c ProgramStatsConfig) validate(cfg NetworkConfig) error {
+	if !c.Enable {
+		return nil
+	}
+	if !cfg.EnableXDP {
+		return fmt.Errorf("%w: program stats require XDP", ErrInvalidConfig)
+	}
+	if c.Interval < 0 || c.Window < 0 {
+		return fmt.Errorf("%w: program stats interval and window must not be negative", ErrInvalidConfig)
+	}
+	if c.Window > 0 && c.Interval == 0 {
+		return fmt.Errorf("%w: program stats window without an interval", ErrInvalidConfig)
+	}
+	if c = c.withDefaults(); c.Interval > 0 && c.Window >= c.Interval {
+		return fmt.Errorf("%w: program stats window %s is not shorter than the interval %s", ErrInvalidConfig, c.Window, c.Interval)
+	}
+	return nil
+}
+
+// ProgramStats is what the kernel counted for one of the router's eBPF
+// programs while program stats were collected, and its size as loaded
+type ProgramStats struct {
+	// Name is the program's name in the router object
+	Name string `json:"name"`
+	// Interfaces the program is attached to. A program runs as one on all
+	// of them, so its counts are theirs combined.
+	Interfaces []string `json:"interfaces"`
+	RunCount   uint64   `json:"run_count"`
+	// RunTime is the time spent in the program over RunCount runs
+	RunTime time.Duration `json:"run_time"`
+	// Instructions and MapLookups are the program's instructions and
+	// its calls to look up a map entry, counted when it was loaded
+	Instructions int `json:"instructions"`
+	MapLookups   int `json:"map_lookups"`
+}
+
+// Mean returns the average time of a run, 0 without runs
+func (s ProgramStats) Mean() time.Duration {
+	if s.RunCount == 0 {
+		return 0
+	}
+	return s.RunTime / time.Duration(s.RunCount)
+}
+
+// ProgramStatsSnapshot are the router's programs and the overhead they
+// add to the packets of each interface
+type ProgramStatsSnapshot struct {
+	// Time is when the counts were read
+	Time time.Time `json:"time"`
+	// Collecting is true while the kernel counts, false between sampling
+	// windows and with program stats disabled
+	Collecting bool           `json:"collecting"`
+	Programs   []ProgramStats `json:"programs"`
+	// Interfaces is the average time the programs attached to each
+	// interface took per packet, by interface name
+	Interfaces map[string]time.Duration `json:"interfaces"`
+}
+
+// programSampler turns program stats collection on and off, see
+// ProgramStatsConfig
+type programSampler struct {
+	config ProgramStatsConfig
+	// collecting is true while stats collection is on
+	collecting atomic.Bool
+	// stop ends the collection started by startProgramStats, which closes
+	// done once it returned
+	stop chan struct{}
+	done chan struct{}
+}
+
+// stopProgramStats waits for the collection started by startProgramStats
+// to end, which turns it off
+func (nm *NetworkManager) stopProgramStats() {
+	if nm.programStats == nil || nm.programStats.stop == nil {
+		return
+	}
+	close(nm.programStats.stop)
+	<-nm.programStats.done
+	nm.programStats.stop = nil
+}
+
+// GetProgramStats returns the run counts and times of the XDP router's
+// programs and its overhead per interface. It fails with ErrXDPInactive
+// without the router. Run counts stay at zero unless program stats are
+// enabled, see ProgramStatsConfig.
+func (nm *NetworkManager) GetProgramStats() (ProgramStatsSnapshot, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.xdp == nil {
+		return ProgramStatsSnapshot{}, fmt.Errorf("%w: program stats are those of the XDP router", ErrXDPInactive)
+	}
+	snap := ProgramStatsSnapshot{
+		Time:       time.Now(),
+		Collecting: nm.programStats != nil && nm.programStats.collecting.Load(),
+	}
+	if err := nm.readProgramStats(&snap); err != nil {
+		return ProgramStatsSnapshot{}, err
+	}
+	return snap, nil
+}
+
+// addProgramStats adds the GetStats keys of snap to stats: the run count,
+// run time, average nanoseconds per run, instructions and map lookups of
+// each program, and the nanoseconds per packet on each interface
+func addProgramStats(stats map[string]uint64, snap ProgramStatsSnapshot) {
+	for _, p := range snap.Programs {
+		prefix := "program_" + p.Name + "_"
+		stats[prefix+"run_count"] = p.RunCount
+		stats[prefix+"run_time_ns"] = uint64(p.RunTime)
+		stats[prefix+"ns_per_run"] = uint64(p.Mean())
+		stats[prefix+"instructions"] = uint64(p.Instructions)
+		stats[prefix+"map_lookups"] = uint64(p.MapLookups)
+	}
+	for iface, d := range snap.Interfaces {
+		stats["interface_"+iface+"_ns_per_packet"] = uint64(d)
+	}
+}
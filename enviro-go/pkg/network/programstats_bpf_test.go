@@ -0,0 +1,65 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// TestProgramStats runs traffic through the router and the source check
+// with program stats collected, and checks that their counts move and
+// that the overhead lands on the interfaces they are attached to
+func TestProgramStats(t *testing.T) {
+	h := testNeighborHosts
+	x := loadSourceCheck(t, h.mac, h.sources())
+	nm := &NetworkManager{
+		config:       NetworkConfig{Interface: "eth0"},
+		xdp:          x,
+		containers:   map[string]*ContainerNetwork{"test": {ContainerID: "test", HostInterface: "veth0"}},
+		programStats: &programSampler{},
+	}
+	stats := nm.enableProgramStats()
+	if stats == nil {
+		t.Skip("kernel refused to collect program stats")
+	}
+	defer stats.Close()
+
+	frame := tcpSegment{src: netip.AddrPortFrom(h.own4, 40000), dst: netip.AddrPortFrom(h.host4, 80), flags: tcpSYN}.frame()
+	const runs = 100
+	for _, name := range []string{tcRouterProgram, sourceProgram} {
+		for i := 0; i < runs; i++ {
+			if _, _, err := x.coll.Programs[name].Test(withMAC(frame, h.mac)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	snap, err := nm.GetProgramStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.Collecting {
+		t.Error("snapshot not collecting with stats enabled")
+	}
+	ran := map[string]bool{tcRouterProgram: true, sourceProgram: true}
+	for _, p := range snap.Programs {
+		if p.Instructions == 0 || p.MapLookups == 0 {
+			t.Errorf("%s: %d instructions and %d map lookups", p.Name, p.Instructions, p.MapLookups)
+		}
+		// Only the programs run above have counts to check
+		if !ran[p.Name] {
+			continue
+		}
+		delete(ran, p.Name)
+		if p.RunCount < runs || p.RunTime == 0 {
+			t.Errorf("%s: %d runs in %s, want at least %d", p.Name, p.RunCount, p.RunTime, runs)
+		}
+	}
+	for name := range ran {
+		t.Errorf("no stats of %s", name)
+	}
+	if d := snap.Interfaces["veth0"]; d == 0 {
+		t.Errorf("no overhead on the source checked veth: %v", snap.Interfaces)
+	}
+}
@@ -0,0 +1,129 @@
+//go:build linux
+
+package network
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+// programSize is the size of a program as loaded, see ProgramStats
+type programSize struct {
+	instructions int
+	mapLookups   int
+}
+
+// programSizes counts the instructions and map lookups of the programs of
+// spec, with the functions they call
+func programSizes(spec *ebpf.CollectionSpec) map[string]programSize {
+	out := make(map[string]programSize, len(spec.Programs))
+	for name, p := range spec.Programs {
+		var size programSize
+		for _, ins := range p.Instructions {
+			// Wide loads take two slots, as the verifier counts them
+			size.instructions += int(ins.Size() / asm.InstructionSize)
+			if ins.IsBuiltinCall() && asm.BuiltinFunc(ins.Constant) == asm.FnMapLookupElem {
+				size.mapLookups++
+			}
+		}
+		out[name] = size
+	}
+	return out
+}
+
+// startProgramStats has the kernel count the runs of eBPF programs, all
+// the time or in the sampling windows of the configuration, until
+// stopProgramStats is called
+func (nm *NetworkManager) startProgramStats() {
+	s := nm.programStats
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		var ticker <-chan time.Time
+		if s.config.Interval > 0 {
+			t := time.NewTicker(s.config.Interval)
+			defer t.Stop()
+			ticker = t.C
+		}
+		for {
+			stats := nm.enableProgramStats()
+			var window <-chan time.Time
+			if s.config.Interval > 0 {
+				window = time.After(s.config.Window)
+			}
+			select {
+			case <-window:
+			case <-s.stop:
+			}
+			if stats != nil {
+				s.collecting.Store(false)
+				stats.Close()
+			}
+			select {
+			case <-ticker:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// enableProgramStats turns stats collection on until the returned closer
+// is closed, or returns nil with a warning when the kernel refuses
+func (nm *NetworkManager) enableProgramStats() io.Closer {
+	stats, err := ebpf.EnableStats(uint32(unix.BPF_STATS_RUN_TIME))
+	if err != nil {
+		nm.log.Warn("Failed to enable eBPF program stats", "error", err)
+		return nil
+	}
+	nm.programStats.collecting.Store(true)
+	return stats
+}
+
+// readProgramStats fills snap from the kernel's counts for the programs of
+// the router in use. Callers must hold nm.mu.
+func (nm *NetworkManager) readProgramStats(snap *ProgramStatsSnapshot) error {
+	attached := make(map[string][]string)
+	if nm.xdp.link != nil {
+		name := programName(nm.xdp.mode)
+		attached[name] = append(attached[name], nm.config.Interface)
+	}
+	if nm.xdp.hasSourceCheck() {
+		for _, cn := range nm.containers {
+			if cn.sourceChecked() {
+				attached[sourceProgram] = append(attached[sourceProgram], cn.HostInterface)
+			}
+		}
+	}
+
+	snap.Interfaces = make(map[string]time.Duration)
+	for name, prog := range nm.xdp.coll.Programs {
+		info, err := prog.Info()
+		if err != nil {
+			return fmt.Errorf("failed to read stats of program %s: %w", name, err)
+		}
+		p := ProgramStats{
+			Name:         name,
+			Interfaces:   attached[name],
+			Instructions: nm.xdp.sizes[name].instructions,
+			MapLookups:   nm.xdp.sizes[name].mapLookups,
+		}
+		p.RunCount, _ = info.RunCount()
+		p.RunTime, _ = info.Runtime()
+		slices.Sort(p.Interfaces)
+		for _, iface := range p.Interfaces {
+			snap.Interfaces[iface] += p.Mean()
+		}
+		snap.Programs = append(snap.Programs, p)
+	}
+	slices.SortFunc(snap.Programs, func(a, b ProgramStats) int { return strings.Compare(a.Name, b.Name) })
+	return nil
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"errors"
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestProgramStatsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ProgramStatsConfig
+		noXDP   bool
+		wantErr bool
+	}{
+		{name: "disabled", cfg: ProgramStatsConfig{Interval: -1}, noXDP: true},
+		{name: "always on", cfg: ProgramStatsConfig{Enable: true}},
+		{name: "sampling", cfg: ProgramStatsConfig{Enable: true, Interval: 5 * time.Minute, Window: 30 * time.Second}},
+		{name: "default window", cfg: ProgramStatsConfig{Enable: true, Interval: time.Minute}},
+		{name: "without XDP", cfg: ProgramStatsConfig{Enable: true}, noXDP: true, wantErr: true},
+		{name: "negative interval", cfg: ProgramStatsConfig{Enable: true, Interval: -time.Minute}, wantErr: true},
+		{name: "window without interval", cfg: ProgramStatsConfig{Enable: true, Window: time.Minute}, wantErr: true},
+		{name: "window as long as interval", cfg: ProgramStatsConfig{Enable: true, Interval: time.Minute, Window: time.Minute}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate(NetworkConfig{EnableXDP: !tt.noXDP})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validate() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validate() = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
+
+func TestProgramStatsWindow(t *testing.T) {
+	tests := []struct {
+		interval, want time.Duration
+	}{
+		{interval: 0, want: 0},
+		{interval: 10 * time.Minute, want: DefaultProgramStatsWindow},
+		{interval: time.Minute, want: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := (ProgramStatsConfig{Interval: tt.interval}).withDefaults().Window; got != tt.want {
+			t.Errorf("window for interval %s = %s, want %s", tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestAddProgramStats(t *testing.T) {
+	snap := ProgramStatsSnapshot{
+		Programs: []ProgramStats{
+			{Name: "xdp_container_router", Interfaces: []string{"eth0"}, RunCount: 4, RunTime: 400, Instructions: 900, MapLookups: 12},
+			{Name: "tc_container_source", Interfaces: []string{"veth1", "veth2"}, Instructions: 200, MapLookups: 3},
+		},
+		Interfaces: map[string]time.Duration{"eth0": 100, "veth1": 0, "veth2": 0},
+	}
+	want := map[string]uint64{
+		"program_xdp_container_router_run_count":    4,
+		"program_xdp_container_router_run_time_ns":  400,
+		"program_xdp_container_router_ns_per_run":   100,
+		"program_xdp_container_router_instructions": 900,
+		"program_xdp_container_router_map_lookups":  12,
+		"program_tc_container_source_run_count":     0,
+		"program_tc_container_source_run_time_ns":   0,
+		"program_tc_container_source_ns_per_run":    0,
+		"program_tc_container_source_instructions":  200,
+		"program_tc_container_source_map_lookups":   3,
+		"interface_eth0_ns_per_packet":              100,
+		"interface_veth1_ns_per_packet":             0,
+		"interface_veth2_ns_per_packet":             0,
+	}
+	got := make(map[string]uint64)
+	addProgramStats(got, snap)
+	if !maps.Equal(got, want) {
+		t.Errorf("addProgramStats() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// ErrInvalidProxy is returned for proxy redirects that can't be set up
+var ErrInvalidProxy = errors.New("network: invalid proxy redirect")
+
+// ProxyRedirectConfig lets containers steer their traffic to a proxy of
+// theirs, e.g. an Envoy sidecar, with SetProxyRedirect rather than
+// iptables REDIRECT rules in their namespace.
+//
+// Traffic to a container is handed to the proxy's socket as it arrives,
+// like TPROXY, so the connections the proxy accepts keep the original
+// destination as their local address, from getsockname, and UDP
+// datagrams carry it with IP_RECVORIGDSTADDR. Connections the container
+// makes are pointed at the proxy on loopback instead, where
+// getsockopt(SO_ORIGINAL_DST) returns where they were headed, as after
+// REDIRECT. Redirecting what the container sends needs its
+// ContainerNetworkSpec.CgroupPath.
+//
+// Proxy redirection needs the XDP router and a kernel from 5.7. It stays
+// off with a warning elsewhere, see Capabilities.ProxyRedirect.
+type ProxyRedirectConfig struct {
+	Enable bool `json:"enable"`
+}
+
+// validate checks that XDP is enabled
+func (c ProxyRedirectConfig) validate(cfg NetworkConfig) error {
+	if c.Enable && !cfg.EnableXDP {
+		return fmt.Errorf("%w: proxy redirection requires XDP", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// ProxyRedirect steers the traffic of a container matching Direction,
+// Protocol and Port to its proxy listening on ProxyPort
+type ProxyRedirect struct {
+	// Direction is DirectionIngress for traffic to the container,
+	// DirectionEgress for connections it makes, or DirectionBoth
+	Direction Direction `json:"direction"`
+	// Protocol is "tcp" or, for ingress only, "udp"
+	Protocol string `json:"protocol"`
+	// Port is the destination port matched, 0 for any
+	Port uint16 `json:"port,omitempty"`
+	// ProxyPort is where the proxy listens in the container
+	ProxyPort uint16 `json:"proxy_port"`
+}
+
+// ProxyConfig is how the traffic of a container is steered to its proxy
+type ProxyConfig struct {
+	// Redirects are tried most specific port first
+	Redirects []ProxyRedirect `json:"redirects"`
+	// ExemptUID is the user the proxy runs as, and ExemptCgroupPath the
+	// cgroup it runs in if it has one of its own. Connections either
+	// makes are the proxy's own and never redirected, which egress
+	// redirects need one of to not loop.
+	ExemptUID        *uint32 `json:"exempt_uid,omitempty"`
+	ExemptCgroupPath string  `json:"exempt_cgroup_path,omitempty"`
+}
+
+// Validate checks the redirects of c
+func (c ProxyConfig) Validate() error {
+	type match struct {
+		ingress bool
+		proto   string
+		port    uint16
+	}
+	seen := make(map[match]bool)
+	egress := false
+	for _, r := range c.Redirects {
+		if !r.Direction.ingress() && !r.Direction.egress() {
+			return fmt.Errorf("%w: unknown direction %q", ErrInvalidProxy, r.Direction)
+		}
+		switch r.Protocol {
+		case "tcp":
+		case "udp":
+			if r.Direction.egress() {
+				return fmt.Errorf("%w: only TCP connections are redirected on egress", ErrInvalidProxy)
+			}
+		default:
+			return fmt.Errorf("%w: unknown protocol %q", ErrInvalidProxy, r.Protocol)
+		}
+		if r.ProxyPort == 0 {
+			return fmt.Errorf("%w: proxy port required", ErrInvalidProxy)
+		}
+		for _, ingress := range []bool{true, false} {
+			if ingress && !r.Direction.ingress() || !ingress && !r.Direction.egress() {
+				continue
+			}
+			m := match{ingress, r.Protocol, r.Port}
+			if seen[m] {
+				return fmt.Errorf("%w: %s port %d redirected twice", ErrInvalidProxy, r.Protocol, r.Port)
+			}
+			seen[m] = true
+		}
+		egress = egress || r.Direction.egress()
+	}
+	if egress && c.ExemptUID == nil && c.ExemptCgroupPath == "" {
+		return fmt.Errorf("%w: egress redirects need the proxy's user or cgroup exempted", ErrInvalidProxy)
+	}
+	if c.ExemptCgroupPath != "" && !filepath.IsAbs(c.ExemptCgroupPath) {
+		return fmt.Errorf("%w: exempt cgroup path must be absolute", ErrInvalidProxy)
+	}
+	return nil
+}
+
+// ingress and egress report whether c redirects traffic to or from the
+// container
+func (c *ProxyConfig) ingress() bool { return c != nil && c.hasDirection(Direction.ingress) }
+func (c *ProxyConfig) egress() bool  { return c != nil && c.hasDirection(Direction.egress) }
+
+func (c *ProxyConfig) hasDirection(in func(Direction) bool) bool {
+	for _, r := range c.Redirects {
+		if in(r.Direction) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetProxyRedirect steers the traffic of containerID to its proxy as cfg
+// says, replacing the redirects set before, e.g. as its sidecar restarts
+// on another port. Connections established before keep going where they
+// went. An empty cfg stops redirecting.
+func (nm *NetworkManager) SetProxyRedirect(containerID string, cfg ProxyConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if err := nm.checkPrivileged("proxy redirects"); err != nil {
+		return err
+	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	if err := cn.checkAttachment("proxy redirects"); err != nil {
+		return err
+	}
+	if cfg.egress() && cn.CgroupPath == "" {
+		return fmt.Errorf("%w: egress redirects need the container's cgroup", ErrInvalidProxy)
+	}
+	var proxy *ProxyConfig
+	if len(cfg.Redirects) > 0 {
+		proxy = &cfg
+	}
+	if err := nm.applyProxy(cn, proxy); err != nil {
+		return fmt.Errorf("failed to redirect %s to its proxy: %w", containerID, err)
+	}
+	cn.Proxy = proxy
+	nm.log.Info("Set container proxy redirects", "container_id", containerID, "redirects", len(cfg.Redirects))
+	return nm.saveState()
+}
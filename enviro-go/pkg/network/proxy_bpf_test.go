@@ -0,0 +1,241 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// proxyEnv has the test binary, run as a helper process, act as both a
+// container and its proxy: given a direction, the proxy port and a
+// destination, comma-separated, it listens on the proxy port, connects to
+// the destination and prints the original destination the proxy recovers
+const proxyEnv = "ENVIRO_TEST_PROXY"
+
+// proxyHelper is the helper process of proxyEnv. For ingress it runs in a
+// network namespace of its own, with tc_proxy_ingress as fd 3 to attach
+// to its loopback.
+func proxyHelper(args string) (string, error) {
+	parts := strings.Split(args, ",")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("bad arguments %q", args)
+	}
+	direction, port, dst := Direction(parts[0]), parts[1], parts[2]
+	if direction == DirectionIngress {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return "", err
+		}
+		if err := netlink.LinkSetUp(lo); err != nil {
+			return "", err
+		}
+		clsact := &netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{LinkIndex: lo.Attrs().Index, Parent: netlink.HANDLE_CLSACT, Handle: netlink.MakeHandle(0xffff, 0)},
+			QdiscType:  "clsact",
+		}
+		if err := netlink.QdiscAdd(clsact); err != nil {
+			return "", err
+		}
+		filter := proxyFilter(lo.Attrs().Index)
+		filter.Fd = 3
+		if err := netlink.FilterReplace(filter); err != nil {
+			return "", err
+		}
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := net.Dial("tcp", dst)
+		if err == nil {
+			defer conn.Close()
+			_, err = conn.Write([]byte(accelMessage))
+		}
+		dialed <- err
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := <-dialed; err != nil {
+		return "", err
+	}
+	if direction == DirectionIngress {
+		// Connections handed over keep their destination as local address
+		return conn.LocalAddr().String(), nil
+	}
+	return originalDst(conn.(*net.TCPConn))
+}
+
+// soOriginalDst is SO_ORIGINAL_DST of linux/netfilter_ipv4.h
+const soOriginalDst = 80
+
+// originalDst returns where the connection conn accepted was headed, from
+// getsockopt(SOL_IP, SO_ORIGINAL_DST)
+func originalDst(conn *net.TCPConn) (string, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var sa [unix.SizeofSockaddrInet4]byte
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		n := uint32(len(sa))
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.SOL_IP, soOriginalDst,
+			uintptr(unsafe.Pointer(&sa[0])), uintptr(unsafe.Pointer(&n)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+	addr := netip.AddrFrom4([4]byte(sa[4:8]))
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(sa[2:4])).String(), nil
+}
+
+// freePort returns a port nothing listens on
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestProxyRedirect(t *testing.T) {
+	if !probedKernel().Datapath.ProxyRedirect {
+		t.Skip("kernel can't assign sockets")
+	}
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		t.Fatal(err)
+	}
+	trimPrograms(spec, []DatapathMode{DatapathXDPNative})
+	x := &xdpProgram{proxyRedirect: true}
+	x.applyConnectPolicy(spec)
+	x.applySocketAcceleration(spec)
+	x.applyProxyRedirect(spec)
+	coll, err := ebpf.NewCollection(spec)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("loading eBPF not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(coll.Close)
+	x.setCollection(coll)
+	if !x.hasProxyRedirect() {
+		t.Fatal("router loaded without proxy redirection")
+	}
+
+	// The helper stands in for the container with addr, in the cgroup dir
+	addr := netip.MustParseAddr("10.0.0.2")
+	dir := testCgroup(t, "enviro-proxy-test")
+	a, err := x.attachCgroup(dir, testIfindex, []netip.Addr{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.detachCgroup(a)
+
+	nobody := uint32(65534)
+	tests := []struct {
+		name string
+		// addr is the address the redirect is programmed for
+		addr      netip.Addr
+		direction Direction
+		// dst is where the helper connects, and want the original
+		// destination its proxy is expected to recover
+		dst  string
+		want string
+	}{
+		{name: "egress", addr: addr, direction: DirectionEgress, dst: "192.0.2.1:80", want: "192.0.2.1:80"},
+		// Loopback of a namespace of its own stands in for the
+		// container's interface
+		{name: "ingress", addr: netip.MustParseAddr("127.0.0.1"), direction: DirectionIngress, dst: "127.0.0.1:80", want: "127.0.0.1:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freePort(t)
+			cfg := &ProxyConfig{
+				Redirects: []ProxyRedirect{{Direction: tt.direction, Protocol: "tcp", Port: 80, ProxyPort: port}},
+				ExemptUID: &nobody,
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			addrs := []netip.Addr{tt.addr}
+			if err := x.SetProxyRedirects(addrs, newProxyEntries(addrs, cfg, 0)); err != nil {
+				t.Fatal(err)
+			}
+			defer x.SetProxyRedirects(addrs, nil)
+
+			cmd := exec.Command(os.Args[0])
+			cmd.Env = append(os.Environ(), proxyEnv+"="+string(tt.direction)+","+strconv.Itoa(int(port))+","+tt.dst)
+			if tt.direction == DirectionIngress {
+				cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+				cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(coll.Programs[proxyIngressProgram].FD()), proxyIngressProgram)}
+			} else {
+				fd, err := unix.Open(dir, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer unix.Close(fd)
+				cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: fd}
+			}
+			out, err := cmd.Output()
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				t.Fatalf("proxy helper failed: %s", out)
+			}
+			if err != nil {
+				t.Skipf("can't start the proxy helper: %v", err)
+			}
+			if got := string(out); got != tt.want {
+				t.Errorf("proxy recovered %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Updating the redirects, as a sidecar restarts, leaves no stale ones
+	cfg := &ProxyConfig{Redirects: []ProxyRedirect{{Direction: DirectionIngress, Protocol: "udp", ProxyPort: 15053}}}
+	for _, want := range []uint32{1, 0} {
+		entries := newProxyEntries([]netip.Addr{addr}, cfg, 0)
+		if err := x.SetProxyRedirects([]netip.Addr{addr}, entries); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := countEntries(x.proxyRedirects); err != nil || n != want {
+			t.Errorf("proxy_redirects has %d entries, %v, want %d", n, err, want)
+		}
+		cfg = nil
+	}
+}
@@ -0,0 +1,285 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// proxyPrograms are the programs of proxy redirection attached to the
+// cgroups of containers, and proxyIngressProgram the one attached inside
+// containers with ingress redirects
+var proxyPrograms = []cgroupProgram{
+	{"cgroup_proxy_connect4", ebpf.AttachCGroupInet4Connect},
+	{"cgroup_proxy_connect6", ebpf.AttachCGroupInet6Connect},
+	{"sockops_proxy", ebpf.AttachCGroupSockOps},
+	{"cgroup_proxy_getsockopt", ebpf.AttachCGroupGetsockopt},
+}
+
+const proxyIngressProgram = "tc_proxy_ingress"
+
+// Directions of proxyKey, mirroring PROXY_*
+const (
+	proxyIngress = 1
+	proxyEgress  = 2
+)
+
+// proxyKey mirrors struct proxy_key in bpf/container_router.c
+type proxyKey struct {
+	Addr      [16]byte
+	Port      [2]byte
+	Proto     uint8
+	Direction uint8
+}
+
+// proxyTarget mirrors struct proxy_target in bpf/container_router.c
+type proxyTarget struct {
+	Port         [2]byte
+	Pad          uint16
+	ExemptUID    uint32
+	ExemptCgroup uint64
+}
+
+// noExemptUID is proxyTarget.ExemptUID for no exempt user
+const noExemptUID = ^uint32(0)
+
+// newProxyEntries returns the proxy_redirects entries of cfg for the
+// container with addrs, whose proxy's cgroup is exemptCgroup, if any
+func newProxyEntries(addrs []netip.Addr, cfg *ProxyConfig, exemptCgroup uint64) map[proxyKey]proxyTarget {
+	out := make(map[proxyKey]proxyTarget)
+	if cfg == nil {
+		return out
+	}
+	target := proxyTarget{ExemptUID: noExemptUID, ExemptCgroup: exemptCgroup}
+	if cfg.ExemptUID != nil {
+		target.ExemptUID = *cfg.ExemptUID
+	}
+	for _, r := range cfg.Redirects {
+		t := target
+		binary.BigEndian.PutUint16(t.Port[:], r.ProxyPort)
+		key := proxyKey{Proto: unix.IPPROTO_TCP}
+		if r.Protocol == "udp" {
+			key.Proto = unix.IPPROTO_UDP
+		}
+		binary.BigEndian.PutUint16(key.Port[:], r.Port)
+		for _, addr := range addrs {
+			key.Addr = addr.As16()
+			if r.Direction.ingress() {
+				key.Direction = proxyIngress
+				out[key] = t
+			}
+			if r.Direction.egress() {
+				key.Direction = proxyEgress
+				out[key] = t
+			}
+		}
+	}
+	return out
+}
+
+// applyProxyRedirect removes the programs of proxy redirection from spec
+// unless x redirects to proxies, as the kernel may not be able to load
+// them
+func (x *xdpProgram) applyProxyRedirect(spec *ebpf.CollectionSpec) {
+	if x.proxyRedirect {
+		return
+	}
+	for _, p := range proxyPrograms {
+		delete(spec.Programs, p.name)
+	}
+	delete(spec.Programs, proxyIngressProgram)
+}
+
+// hasProxyRedirect reports whether the router was loaded with the
+// programs of proxy redirection
+func (x *xdpProgram) hasProxyRedirect() bool {
+	if x.proxyRedirects == nil || x.coll.Programs[proxyIngressProgram] == nil {
+		return false
+	}
+	for _, p := range proxyPrograms {
+		if x.coll.Programs[p.name] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// SetProxyRedirects leaves want as the only proxy_redirects entries of
+// the container with addrs
+func (x *xdpProgram) SetProxyRedirects(addrs []netip.Addr, want map[proxyKey]proxyTarget) error {
+	owned := make(map[[16]byte]bool, len(addrs))
+	for _, addr := range addrs {
+		owned[addr.As16()] = true
+	}
+	// Deleting while iterating can restart the iteration, so collect first
+	var stale []proxyKey
+	var key proxyKey
+	var target proxyTarget
+	iter := x.proxyRedirects.Iterate()
+	for iter.Next(&key, &target) {
+		if _, ok := want[key]; owned[key.Addr] && !ok {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := ignoreNotExist(x.proxyRedirects.Delete(key)); err != nil {
+			return err
+		}
+	}
+	for key, target := range want {
+		if err := x.proxyRedirects.Put(key, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proxyFilter is the proxy redirection's filter on the interface with
+// index inside a container, on clsact ingress
+func proxyFilter(index int) *netlink.BpfFilter {
+	return &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Handle:    1,
+			Priority:  tcFilterPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Name:         proxyIngressProgram,
+		DirectAction: true,
+	}
+}
+
+// attachProxyIngress attaches the ingress redirection to the interface
+// inside the container cn, or points the filter there at the program in
+// use
+func (x *xdpProgram) attachProxyIngress(cn *ContainerNetwork) error {
+	h, err := containerHandle(cn)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	link, err := h.LinkByName(containerIfName)
+	if err != nil {
+		return err
+	}
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_CLSACT,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+		},
+		QdiscType: "clsact",
+	}
+	if err := h.QdiscAdd(clsact); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to add clsact qdisc: %w", err)
+	}
+	filter := proxyFilter(link.Attrs().Index)
+	filter.Fd = x.coll.Programs[proxyIngressProgram].FD()
+	if err := h.FilterReplace(filter); err != nil {
+		return fmt.Errorf("failed to install TC filter: %w", err)
+	}
+	return nil
+}
+
+// detachProxyIngress removes the ingress redirection from the interface
+// inside the container cn
+func detachProxyIngress(cn *ContainerNetwork) error {
+	h, err := containerHandle(cn)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	link, err := h.LinkByName(containerIfName)
+	if err != nil {
+		return err
+	}
+	err = h.FilterDel(proxyFilter(link.Attrs().Index))
+	// The interface has no clsact qdisc, or no filter
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EINVAL) {
+		return nil
+	}
+	return err
+}
+
+// applyProxy steers the traffic of cn to its proxy as cfg says, or stops
+// when it is nil, replacing cn.Proxy. Callers must hold nm.mu.
+func (nm *NetworkManager) applyProxy(cn *ContainerNetwork, cfg *ProxyConfig) error {
+	if nm.xdp == nil || !nm.xdp.hasProxyRedirect() {
+		if cfg == nil {
+			return nil
+		}
+		return fmt.Errorf("%w: proxy redirection is unavailable", ErrXDPInactive)
+	}
+	var exempt uint64
+	if cfg != nil && cfg.ExemptCgroupPath != "" {
+		id, err := cgroupID(cfg.ExemptCgroupPath)
+		if err != nil {
+			return fmt.Errorf("failed to find the proxy's cgroup: %w", err)
+		}
+		exempt = id
+	}
+	// The cgroup programs see connections as the container makes them
+	if cfg.egress() {
+		if err := nm.attachCgroup(cn); err != nil {
+			return err
+		}
+	}
+	if cfg.ingress() {
+		if err := nm.xdp.attachProxyIngress(cn); err != nil {
+			return fmt.Errorf("failed to attach ingress redirection: %w", err)
+		}
+	}
+	if err := nm.xdp.SetProxyRedirects(cn.addrs(), newProxyEntries(cn.addrs(), cfg, exempt)); err != nil {
+		return fmt.Errorf("failed to program redirects: %w", err)
+	}
+	if !cfg.ingress() && cn.Proxy.ingress() {
+		if err := detachProxyIngress(cn); err != nil {
+			return fmt.Errorf("failed to detach ingress redirection: %w", err)
+		}
+	}
+	return nil
+}
+
+// syncProxies points the ingress redirection of every container at the
+// program in use, e.g. after an upgrade. Callers must hold nm.mu.
+func (nm *NetworkManager) syncProxies() error {
+	nm.caps.ProxyRedirect = nm.xdp.hasProxyRedirect()
+	if !nm.caps.ProxyRedirect {
+		return nil
+	}
+	var errs []error
+	for id, cn := range nm.containers {
+		if !cn.Proxy.ingress() {
+			continue
+		}
+		if err := nm.xdp.attachProxyIngress(cn); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// initProxyRedirect records whether the freshly loaded xdp can redirect
+// to proxies, warning when it is enabled but can't
+func (nm *NetworkManager) initProxyRedirect(xdp *xdpProgram) {
+	if !nm.config.ProxyRedirect.Enable {
+		return
+	}
+	if !xdp.hasProxyRedirect() {
+		nm.log.Warn("Proxy redirection unavailable: the kernel can't assign sockets before 5.7, so containers can't steer traffic to a proxy")
+		return
+	}
+	nm.caps.ProxyRedirect = true
+	nm.log.Info("Containers may steer their traffic to a proxy")
+}
@@ -0,0 +1,64 @@
+//go:build linux
+
+package network
+
+import (
+	"net/netip"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNewProxyEntries(t *testing.T) {
+	uid := uint32(1337)
+	v4, v6 := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::2")
+	key := func(addr netip.Addr, proto uint8, port uint16, direction uint8) proxyKey {
+		return proxyKey{Addr: addr.As16(), Port: [2]byte{byte(port >> 8), byte(port)}, Proto: proto, Direction: direction}
+	}
+	target := func(port uint16, uid uint32, cgroup uint64) proxyTarget {
+		return proxyTarget{Port: [2]byte{byte(port >> 8), byte(port)}, ExemptUID: uid, ExemptCgroup: cgroup}
+	}
+	tests := []struct {
+		name   string
+		cfg    *ProxyConfig
+		cgroup uint64
+		want   map[proxyKey]proxyTarget
+	}{
+		{name: "none", want: map[proxyKey]proxyTarget{}},
+		{
+			name: "ingress per address",
+			cfg:  &ProxyConfig{Redirects: []ProxyRedirect{{Direction: DirectionIngress, Protocol: "udp", Port: 53, ProxyPort: 15053}}},
+			want: map[proxyKey]proxyTarget{
+				key(v4, unix.IPPROTO_UDP, 53, proxyIngress): target(15053, noExemptUID, 0),
+				key(v6, unix.IPPROTO_UDP, 53, proxyIngress): target(15053, noExemptUID, 0),
+			},
+		},
+		{
+			name: "both ways with exemptions",
+			cfg: &ProxyConfig{
+				Redirects: []ProxyRedirect{{Direction: DirectionBoth, Protocol: "tcp", ProxyPort: 15001}},
+				ExemptUID: &uid,
+			},
+			cgroup: 42,
+			want: map[proxyKey]proxyTarget{
+				key(v4, unix.IPPROTO_TCP, 0, proxyIngress): target(15001, uid, 42),
+				key(v4, unix.IPPROTO_TCP, 0, proxyEgress):  target(15001, uid, 42),
+				key(v6, unix.IPPROTO_TCP, 0, proxyIngress): target(15001, uid, 42),
+				key(v6, unix.IPPROTO_TCP, 0, proxyEgress):  target(15001, uid, 42),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newProxyEntries([]netip.Addr{v4, v6}, tt.cfg, tt.cgroup)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d entries, want %d: %v", len(got), len(tt.want), got)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("entry %+v = %+v, want %+v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
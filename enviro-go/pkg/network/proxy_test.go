@@ -0,0 +1,88 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProxyRedirectValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     NetworkConfig
+		wantErr bool
+	}{
+		{name: "disabled", cfg: NetworkConfig{}},
+		{name: "with XDP", cfg: NetworkConfig{EnableXDP: true, ProxyRedirect: ProxyRedirectConfig{Enable: true}}},
+		{name: "without XDP", cfg: NetworkConfig{ProxyRedirect: ProxyRedirectConfig{Enable: true}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.ProxyRedirect.validate(tt.cfg)
+			if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validate() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProxyConfigValidate(t *testing.T) {
+	uid := uint32(1337)
+	tests := []struct {
+		name    string
+		cfg     ProxyConfig
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "ingress", cfg: ProxyConfig{Redirects: []ProxyRedirect{
+			{Direction: DirectionIngress, Protocol: "tcp", Port: 80, ProxyPort: 15006},
+			{Direction: DirectionIngress, Protocol: "udp", ProxyPort: 15006},
+		}}},
+		{name: "egress exempting the proxy's user", cfg: ProxyConfig{
+			Redirects: []ProxyRedirect{{Direction: DirectionEgress, Protocol: "tcp", ProxyPort: 15001}},
+			ExemptUID: &uid,
+		}},
+		{name: "both exempting the proxy's cgroup", cfg: ProxyConfig{
+			Redirects:        []ProxyRedirect{{Direction: DirectionBoth, Protocol: "tcp", ProxyPort: 15001}},
+			ExemptCgroupPath: "/sys/fs/cgroup/pod/envoy",
+		}},
+		{name: "same port each way", cfg: ProxyConfig{
+			Redirects: []ProxyRedirect{
+				{Direction: DirectionIngress, Protocol: "tcp", Port: 80, ProxyPort: 15006},
+				{Direction: DirectionEgress, Protocol: "tcp", Port: 80, ProxyPort: 15001},
+			},
+			ExemptUID: &uid,
+		}},
+		{name: "unknown direction", cfg: ProxyConfig{Redirects: []ProxyRedirect{
+			{Direction: "sideways", Protocol: "tcp", ProxyPort: 15006},
+		}}, wantErr: true},
+		{name: "unknown protocol", cfg: ProxyConfig{Redirects: []ProxyRedirect{
+			{Direction: DirectionIngress, Protocol: "sctp", ProxyPort: 15006},
+		}}, wantErr: true},
+		{name: "egress UDP", cfg: ProxyConfig{
+			Redirects: []ProxyRedirect{{Direction: DirectionEgress, Protocol: "udp", ProxyPort: 15001}},
+			ExemptUID: &uid,
+		}, wantErr: true},
+		{name: "no proxy port", cfg: ProxyConfig{Redirects: []ProxyRedirect{
+			{Direction: DirectionIngress, Protocol: "tcp", Port: 80},
+		}}, wantErr: true},
+		{name: "port redirected twice", cfg: ProxyConfig{Redirects: []ProxyRedirect{
+			{Direction: DirectionIngress, Protocol: "tcp", Port: 80, ProxyPort: 15006},
+			{Direction: DirectionBoth, Protocol: "tcp", Port: 80, ProxyPort: 15001},
+		}, ExemptUID: &uid}, wantErr: true},
+		{name: "egress without exemption", cfg: ProxyConfig{Redirects: []ProxyRedirect{
+			{Direction: DirectionEgress, Protocol: "tcp", ProxyPort: 15001},
+		}}, wantErr: true},
+		{name: "relative cgroup", cfg: ProxyConfig{
+			Redirects:        []ProxyRedirect{{Direction: DirectionEgress, Protocol: "tcp", ProxyPort: 15001}},
+			ExemptCgroupPath: "pod/envoy",
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, ErrInvalidProxy) {
+				t.Errorf("Validate() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
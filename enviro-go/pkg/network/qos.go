@@ -0,0 +1,99 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidQoSClass is returned for unknown QoS classes, or classes set
+// without an uplink to prioritize on
+var ErrInvalidQoSClass = errors.New("network: invalid QoS class")
+
+// QoSClass orders a container's traffic leaving the node against that of
+// other containers. Classes are strict priorities on the uplink, so a
+// busy latency container can starve the others; combine it with an
+// egress bandwidth limit where that matters.
+type QoSClass string
+
+const (
+	// QoSLatency traffic is sent before any other, for latency-sensitive
+	// containers
+	QoSLatency QoSClass = "latency"
+	// QoSDefault is the class of containers without one, shared with the
+	// host's own traffic
+	QoSDefault QoSClass = ""
+	// QoSBulk traffic is only sent while no other is waiting, for bulk
+	// transfers
+	QoSBulk QoSClass = "bulk"
+)
+
+// Validate checks that c is a known class
+func (c QoSClass) Validate() error {
+	switch c {
+	case QoSLatency, QoSDefault, QoSBulk:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidQoSClass, c)
+}
+
+// band is the uplink priority band of c, 0 being sent first
+func (c QoSClass) band() int {
+	switch c {
+	case QoSLatency:
+		return 0
+	case QoSBulk:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// SetQoSClass changes the class of the traffic a container sends off the
+// node, taking effect on the next packet. The uplink is the overlay's
+// underlay interface, or else NetworkConfig.Interface.
+func (nm *NetworkManager) SetQoSClass(containerID string, class QoSClass) error {
+	if err := class.Validate(); err != nil {
+		return err
+	}
+	if err := nm.checkPrivileged("QoS classes"); err != nil {
+		return err
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	if err := cn.checkAttachment("QoS classes"); err != nil {
+		return err
+	}
+	if cn.QoSClass == class {
+		return nil
+	}
+	if class != QoSDefault && nm.config.Node == nil && nm.config.Interface == "" {
+		return fmt.Errorf("%w: no uplink interface to prioritize on", ErrInvalidQoSClass)
+	}
+
+	old := cn.QoSClass
+	cn.QoSClass = class
+	if err := nm.syncQoS(); err != nil {
+		cn.QoSClass = old
+		return fmt.Errorf("failed to set QoS class of %s: %w", containerID, err)
+	}
+	nm.log.Info("Set container QoS class", "container_id", containerID, "class", class)
+	return nm.saveState()
+}
+
+// classifiedContainers returns the containers with a QoS class. Callers
+// must hold nm.mu.
+func (nm *NetworkManager) classifiedContainers() []*ContainerNetwork {
+	var out []*ContainerNetwork
+	for _, cn := range nm.containers {
+		if cn.QoSClass != QoSDefault {
+			out = append(out, cn)
+		}
+	}
+	return out
+}
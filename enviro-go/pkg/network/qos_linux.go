@@ -0,0 +1,128 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nftQoSTable is the inet table classifying container traffic by QoS class
+const nftQoSTable = "enviro_qos"
+
+// qosHandle is the handle of the prio qdisc on the uplink. Packets whose
+// priority has its major number go straight to the band of their minor.
+var qosHandle = netlink.MakeHandle(0xe0, 0)
+
+// syncQoS classifies the traffic of containers with a QoS class and puts
+// a strict priority qdisc on the uplink, or removes both when no container
+// has a class. Packets forwarded from a container have their priority set
+// to the band of its class. Unclassified traffic keeps the default
+// priority, which the prio qdisc maps to the middle band.
+//
+// The prio qdisc replaces the uplink's root qdisc, such as mq on a
+// multi-queue NIC, until it is removed and the kernel restores the
+// default. Callers must hold nm.mu.
+func (nm *NetworkManager) syncQoS() error {
+	if nm.rootless {
+		return nil
+	}
+	classified := nm.classifiedContainers()
+	if len(classified) == 0 && !nm.prioritizing {
+		return nil
+	}
+	sort.Slice(classified, func(i, j int) bool { return classified[i].ContainerID < classified[j].ContainerID })
+
+	conn := &nftables.Conn{}
+	table := resetTable(conn, nm.nftTable(nftQoSTable), nftables.TableFamilyINet)
+	if len(classified) > 0 {
+		conn.AddTable(table)
+		chain := conn.AddChain(&nftables.Chain{
+			Name:     "forward",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookForward,
+			Priority: nftables.ChainPriorityMangle,
+		})
+		for _, cn := range classified {
+			for _, addr := range cn.addrs() {
+				conn.AddRule(&nftables.Rule{
+					Table: table,
+					Chain: chain,
+					Exprs: qosExprs(addr, cn.QoSClass),
+				})
+			}
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	if err := nm.syncUplinkQdisc(len(classified) > 0); err != nil {
+		return err
+	}
+	nm.prioritizing = len(classified) > 0
+	return nil
+}
+
+// syncUplinkQdisc adds or removes the prio qdisc of the uplink
+func (nm *NetworkManager) syncUplinkQdisc(enable bool) error {
+	var uplink netlink.Link
+	var err error
+	switch {
+	case nm.config.Node != nil:
+		uplink, err = linkWithAddr(netip.MustParseAddr(nm.config.Node.Address))
+	case nm.config.Interface != "":
+		uplink, err = netlink.LinkByName(nm.config.Interface)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find uplink: %w", err)
+	}
+
+	prio := netlink.NewPrio(netlink.QdiscAttrs{
+		LinkIndex: uplink.Attrs().Index,
+		Handle:    qosHandle,
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	if !enable {
+		err := netlink.QdiscDel(prio)
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EINVAL) {
+			return nil
+		}
+		return err
+	}
+	if err := netlink.QdiscReplace(prio); err != nil {
+		return fmt.Errorf("failed to add prio qdisc to %s: %w", uplink.Attrs().Name, err)
+	}
+	return nil
+}
+
+// qosExprs sets the priority of packets from addr to the band of class:
+//
+//	meta nfproto ipv4 ip saddr 10.88.0.2 meta priority set e0:1
+func qosExprs(addr netip.Addr, class QoSClass) []expr.Any {
+	family, offset := byte(unix.NFPROTO_IPV4), uint32(12)
+	if addr.Is6() {
+		family, offset = unix.NFPROTO_IPV6, 8
+	}
+	// Bands are numbered from 1 in the minor
+	priority := qosHandle | uint32(class.band()+1)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(addr.BitLen() / 8)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr.AsSlice()},
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(priority)},
+		&expr.Meta{Key: expr.MetaKeyPRIORITY, SourceRegister: true, Register: 1},
+	}
+}
@@ -0,0 +1,306 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// ErrNotReady is returned by VerifyContainerNetwork when a check still
+// fails once the timeout expires
+var ErrNotReady = errors.New("network: container network not ready")
+
+// DefaultReadinessTimeout bounds VerifyContainerNetwork unless configured
+// otherwise
+const DefaultReadinessTimeout = 5 * time.Second
+
+// readinessRetry is the pause between two rounds of the checks that
+// failed
+const readinessRetry = 10 * time.Millisecond
+
+// Checks of VerifyContainerNetwork, in the order they run
+const (
+	// ReadinessDatapath checks that the router's route map, or the kernel's
+	// routing table without it, sends the container's addresses to its
+	// host veth
+	ReadinessDatapath = "datapath"
+	// ReadinessLink checks that the container interface is up with carrier,
+	// and so is the host veth
+	ReadinessLink = "link"
+	// ReadinessGateway probes the gateways with an ICMP echo from inside
+	// the container's namespace
+	ReadinessGateway = "gateway"
+	// ReadinessPolicy checks that namespace isolation and the policies let
+	// the container reach its RequiredDestinations
+	ReadinessPolicy = "policy"
+)
+
+// ReadinessConfig configures VerifyContainerNetwork
+type ReadinessConfig struct {
+	// VerifyOnCreate verifies each new container network before
+	// CreateContainerNetwork returns it. Networks that don't become ready
+	// within Timeout are deleted and the create fails with ErrNotReady.
+	VerifyOnCreate bool `json:"verify_on_create"`
+	// Timeout bounds the checks unless the context of the call has an
+	// earlier deadline, DefaultReadinessTimeout when zero
+	Timeout time.Duration `json:"timeout"`
+}
+
+func (c ReadinessConfig) validate() error {
+	if c.Timeout < 0 {
+		return fmt.Errorf("%w: readiness timeout must not be negative", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// Destination is an address a container must be able to reach before it
+// is ready, see ContainerNetworkSpec.RequiredDestinations
+type Destination struct {
+	Addr string `json:"addr"`
+	// Protocol and Port are matched as in NetworkPolicy; empty and zero
+	// match any
+	Protocol string `json:"protocol,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+}
+
+func (d Destination) String() string {
+	s := d.Addr
+	if d.Protocol != "" {
+		s += "/" + d.Protocol
+	}
+	if d.Port != 0 {
+		s = fmt.Sprintf("%s:%d", s, d.Port)
+	}
+	return s
+}
+
+func (d Destination) validate() error {
+	if _, err := netip.ParseAddr(d.Addr); err != nil {
+		return fmt.Errorf("%w: required destination: %v", ErrInvalidConfig, err)
+	}
+	if _, ok := protocolNumbers[d.Protocol]; !ok {
+		return fmt.Errorf("%w: required destination %s has unsupported protocol %q", ErrInvalidConfig, d, d.Protocol)
+	}
+	if d.Port != 0 && d.Protocol != "tcp" && d.Protocol != "udp" {
+		return fmt.Errorf("%w: required destination %s: port requires tcp or udp", ErrInvalidConfig, d)
+	}
+	return nil
+}
+
+// ReadinessCheck is the outcome of a check of VerifyContainerNetwork
+type ReadinessCheck struct {
+	Name   string
+	Passed bool
+	// Error is why the check failed the last time it ran
+	Error string
+	// Duration is from the start of the verification until the check
+	// passed, or until it gave up
+	Duration time.Duration
+	// Attempts counts the times the check ran
+	Attempts int
+}
+
+// ReadinessReport is the outcome of VerifyContainerNetwork
+type ReadinessReport struct {
+	ContainerID string
+	// Ready is set when every check passed
+	Ready bool
+	// Checks are those that apply to the container, in the order they run
+	Checks   []ReadinessCheck
+	Duration time.Duration
+}
+
+// failed returns the first failed check of r
+func (r *ReadinessReport) failed() (ReadinessCheck, bool) {
+	for _, c := range r.Checks {
+		if !c.Passed {
+			return c, true
+		}
+	}
+	return ReadinessCheck{}, false
+}
+
+// readinessCheck is a check of VerifyContainerNetwork. Checks taking
+// nm.mu run with it held; probes run without it.
+type readinessCheck struct {
+	name   string
+	locked bool
+	run    func(ctx context.Context, cn *ContainerNetwork) error
+}
+
+// readinessChecks returns the checks that apply to cn. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) readinessChecks(cn *ContainerNetwork) []readinessCheck {
+	var checks []readinessCheck
+	if cn.Rootless {
+		// slirp4netns connects the container, with neither the router
+		// nor a host interface in the way
+		return nil
+	}
+	if !cn.Attachment.direct() {
+		checks = append(checks, readinessCheck{name: ReadinessDatapath, locked: true, run: func(_ context.Context, cn *ContainerNetwork) error {
+			return nm.checkRoutes(cn)
+		}})
+	}
+	var gateways []netip.Addr
+	for _, addr := range cn.addrs() {
+		if gw := nm.gateway(addr); gw.IsValid() {
+			gateways = append(gateways, gw)
+		}
+	}
+	checks = append(checks,
+		readinessCheck{name: ReadinessLink, run: func(_ context.Context, cn *ContainerNetwork) error {
+			return checkLinks(cn)
+		}},
+		readinessCheck{name: ReadinessGateway, run: func(ctx context.Context, cn *ContainerNetwork) error {
+			return probeGateways(ctx, cn, gateways)
+		}},
+	)
+	if len(cn.RequiredDestinations) > 0 {
+		checks = append(checks, readinessCheck{name: ReadinessPolicy, locked: true, run: func(_ context.Context, cn *ContainerNetwork) error {
+			return nm.checkDestinations(cn)
+		}})
+	}
+	return checks
+}
+
+// VerifyContainerNetwork checks that the network of a container carries
+// traffic, for runtimes to hold back its entrypoint until then: the
+// datapath routes its addresses to its host veth, both ends of the veth
+// are up with carrier, the gateways answer an ICMP echo sent from inside
+// its namespace, and namespace isolation and the policies let it reach its
+// RequiredDestinations. Checks that fail are retried until they pass or
+// the timeout of ReadinessConfig, or the earlier deadline of ctx, expires,
+// when it fails with ErrNotReady. The report is returned either way.
+//
+// Directly attached containers skip the datapath check, which their
+// device bypasses, and rootless ones every check.
+func (nm *NetworkManager) VerifyContainerNetwork(ctx context.Context, containerID string) (ReadinessReport, error) {
+	if !nm.initialized.Load() {
+		return ReadinessReport{}, ErrNotInitialized
+	}
+	nm.mu.Lock()
+	cn, ok := nm.containers[containerID]
+	if !ok {
+		nm.mu.Unlock()
+		return ReadinessReport{}, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+	cn = cn.clone()
+	timeout := nm.config.Readiness.Timeout
+	checks := nm.readinessChecks(cn)
+	nm.mu.Unlock()
+
+	if timeout == 0 {
+		timeout = DefaultReadinessTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	report := nm.verify(ctx, cn, checks)
+	if failed, ok := report.failed(); ok {
+		return report, fmt.Errorf("%w: %s after %v: %s check: %s", ErrNotReady, containerID,
+			report.Duration.Round(time.Millisecond), failed.Name, failed.Error)
+	}
+	nm.logger(ctx).Debug("Verified container network", "container_id", containerID, "duration", report.Duration)
+	return report, nil
+}
+
+// verify runs checks on cn until all passed or ctx is done
+func (nm *NetworkManager) verify(ctx context.Context, cn *ContainerNetwork, checks []readinessCheck) ReadinessReport {
+	start := time.Now()
+	report := ReadinessReport{ContainerID: cn.ContainerID, Checks: make([]ReadinessCheck, len(checks))}
+	for i, c := range checks {
+		report.Checks[i].Name = c.name
+	}
+	for !report.Ready {
+		report.Ready = true
+		for i, c := range checks {
+			out := &report.Checks[i]
+			if out.Passed {
+				continue
+			}
+			out.Attempts++
+			var err error
+			if c.locked {
+				nm.mu.Lock()
+				err = c.run(ctx, cn)
+				nm.mu.Unlock()
+			} else {
+				err = c.run(ctx, cn)
+			}
+			out.Duration = time.Since(start)
+			if err != nil {
+				out.Error = err.Error()
+				report.Ready = false
+				continue
+			}
+			out.Passed, out.Error = true, ""
+		}
+		if report.Ready {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			report.Duration = time.Since(start)
+			return report
+		case <-time.After(readinessRetry):
+		}
+	}
+	report.Duration = time.Since(start)
+	return report
+}
+
+// checkDestinations fails for the first of cn's RequiredDestinations
+// namespace isolation or a policy keeps it from. Destinations that aren't
+// containers of this node aren't subject to either. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) checkDestinations(cn *ContainerNetwork) error {
+	_, owners := nm.compilePolicies()
+	for _, d := range cn.RequiredDestinations {
+		if err := nm.checkDestination(cn, d, owners); err != nil {
+			return fmt.Errorf("%s: %w", d, err)
+		}
+	}
+	return nil
+}
+
+// checkDestination fails when the datapath would keep traffic from cn to
+// d out. owners are the rule owners of compilePolicies. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) checkDestination(cn *ContainerNetwork, d Destination, owners map[policyRule]string) error {
+	dst := netip.MustParseAddr(d.Addr).Unmap()
+	var target *ContainerNetwork
+	for _, other := range nm.containers {
+		for _, addr := range other.addrs() {
+			if addr == dst {
+				target = other
+			}
+		}
+	}
+	if target == nil {
+		return nil
+	}
+	var src netip.Addr
+	for _, addr := range cn.addrs() {
+		if addr.Is4() == dst.Is4() {
+			src = addr
+		}
+	}
+	if !src.IsValid() {
+		return fmt.Errorf("container has no address of the family of %s", dst)
+	}
+	if nm.isolated(cn.Namespace, target.Namespace) {
+		return fmt.Errorf("namespace %s isolates %s from %s", target.Namespace, target.ContainerID, cn.Namespace)
+	}
+	if name, ok := matchPolicy(owners, src, dst, protocolNumber(d.Protocol, dst), d.Port); ok {
+		if action := nm.policies[name].Action; action.denies() {
+			return fmt.Errorf("policy %s would %s it", name, action)
+		}
+		return nil
+	}
+	if action := nm.config.DefaultPolicy; action.denies() {
+		return fmt.Errorf("the default policy would %s it", action)
+	}
+	return nil
+}
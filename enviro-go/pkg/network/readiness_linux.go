@@ -0,0 +1,170 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// gatewayProbeTimeout bounds the wait for the reply to a gateway probe
+const gatewayProbeTimeout = 250 * time.Millisecond
+
+// checkRoutes fails unless the router's route map, when it runs, and the
+// kernel's routing table send the addresses of cn to its host veth.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) checkRoutes(cn *ContainerNetwork) error {
+	for _, addr := range cn.addrs() {
+		if nm.xdp != nil {
+			info, err := nm.xdp.Route(addr)
+			if err != nil {
+				return fmt.Errorf("no route map entry for %s: %w", addr, err)
+			}
+			if int(info.Ifindex) != cn.HostIfindex {
+				return fmt.Errorf("route map sends %s to ifindex %d, not %d", addr, info.Ifindex, cn.HostIfindex)
+			}
+		}
+		family := netlink.FAMILY_V4
+		if addr.Is6() {
+			family = netlink.FAMILY_V6
+		}
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Dst: hostPrefix(addr)}, netlink.RT_FILTER_DST)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, r := range routes {
+			found = found || r.LinkIndex == cn.HostIfindex
+		}
+		if !found {
+			return fmt.Errorf("no route to %s via %s", addr, cn.HostInterface)
+		}
+	}
+	return nil
+}
+
+// checkLinks fails unless the container interface of cn, and its host veth
+// if it has one, are up with carrier
+func checkLinks(cn *ContainerNetwork) error {
+	if cn.HostInterface != "" {
+		host, err := netlink.LinkByIndex(cn.HostIfindex)
+		if err != nil {
+			return fmt.Errorf("host veth %s: %w", cn.HostInterface, err)
+		}
+		if err := linkReady(host); err != nil {
+			return fmt.Errorf("host veth %s %w", cn.HostInterface, err)
+		}
+	}
+	ns, err := netns.GetFromPath(cn.NetnsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %s: %w", cn.NetnsPath, err)
+	}
+	defer ns.Close()
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink in container namespace: %w", err)
+	}
+	defer h.Delete()
+	link, err := h.LinkByName(containerIfName)
+	if err != nil {
+		return fmt.Errorf("container interface: %w", err)
+	}
+	if err := linkReady(link); err != nil {
+		return fmt.Errorf("container interface %w", err)
+	}
+	return nil
+}
+
+// linkReady fails unless link is up with carrier
+func linkReady(link netlink.Link) error {
+	attrs := link.Attrs()
+	if attrs.Flags&net.FlagUp == 0 {
+		return errors.New("is down")
+	}
+	if attrs.RawFlags&unix.IFF_LOWER_UP == 0 {
+		return errors.New("has no carrier")
+	}
+	return nil
+}
+
+// probeGateways sends an ICMP echo to each of gateways from inside the
+// namespace of cn and fails unless they all answer
+func probeGateways(ctx context.Context, cn *ContainerNetwork, gateways []netip.Addr) error {
+	ns, err := netns.GetFromPath(cn.NetnsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %s: %w", cn.NetnsPath, err)
+	}
+	defer ns.Close()
+	for _, gw := range gateways {
+		if err := probeGateway(ctx, ns, gw); err != nil {
+			return fmt.Errorf("gateway %s: %w", gw, err)
+		}
+	}
+	return nil
+}
+
+// probeGateway sends an ICMP echo to gw from ns and waits for the reply
+// until gatewayProbeTimeout or ctx ends
+func probeGateway(ctx context.Context, ns netns.NsHandle, gw netip.Addr) error {
+	network, proto, request, reply := "ip4:icmp", 1, icmp.Type(ipv4.ICMPTypeEcho), icmp.Type(ipv4.ICMPTypeEchoReply)
+	if gw.Is6() {
+		network, proto, request, reply = "ip6:ipv6-icmp", 58, ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	// The socket stays in the namespace it was opened in
+	var conn *icmp.PacketConn
+	err := inNetns(ns, func() (err error) {
+		conn, err = icmp.ListenPacket(network, "")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(gatewayProbeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	echo := &icmp.Echo{ID: rand.Intn(1 << 16), Seq: 1, Data: []byte("enviro readiness")}
+	msg, err := (&icmp.Message{Type: request, Body: echo}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: gw.AsSlice()}); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return errors.New("no reply to ICMP echo")
+			}
+			return err
+		}
+		if addr, ok := netip.AddrFromSlice(peer.(*net.IPAddr).IP); !ok || addr.Unmap() != gw {
+			continue
+		}
+		m, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || m.Type != reply {
+			continue
+		}
+		if got, ok := m.Body.(*icmp.Echo); ok && got.ID == echo.ID && got.Seq == echo.Seq {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,208 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// readinessTestEnv has a child of TestVerifyContainerNetwork run the test
+// in the network namespace of its own it was started in
+const readinessTestEnv = "ENVIRO_TEST_READINESS"
+
+// TestVerifyContainerNetwork verifies containers whose networks are
+// sabotaged one element at a time, and creates containers verified on
+// create. It runs in a child in a network namespace of its own, so the
+// veths stay off the host.
+func TestVerifyContainerNetwork(t *testing.T) {
+	if os.Getenv(readinessTestEnv) != "" {
+		t.Run("sabotage", runReadinessSabotage)
+		t.Run("on create", runVerifyOnCreate)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating container networks needs root")
+	}
+	runInNetns(t, readinessTestEnv)
+}
+
+// failedChecks returns the names of the checks of r that failed
+func failedChecks(r ReadinessReport) []string {
+	var out []string
+	for _, c := range r.Checks {
+		if !c.Passed {
+			out = append(out, c.Name)
+		}
+	}
+	return out
+}
+
+// inContainer runs fn in the namespace of cn with a netlink handle in it
+func inContainer(t *testing.T, cn *ContainerNetwork, fn func(h *netlink.Handle) error) {
+	t.Helper()
+	ns, err := netns.GetFromPath(cn.NetnsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Delete()
+	if err := fn(h); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runReadinessSabotage(t *testing.T) {
+	ctx := context.Background()
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:      "10.99.0.0/24",
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Readiness: ReadinessConfig{Timeout: 300 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+	server, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "server", NetnsPath: containerNetns(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	required := []Destination{{Addr: server.IPv4, Protocol: "tcp", Port: 80}}
+
+	if _, err := nm.VerifyContainerNetwork(ctx, "missing"); !errors.Is(err, ErrContainerNotFound) {
+		t.Errorf("VerifyContainerNetwork() of an unknown container = %v, want %v", err, ErrContainerNotFound)
+	}
+
+	tests := []struct {
+		name     string
+		sabotage func(t *testing.T, cn *ContainerNetwork)
+		// failed are the checks that fail, the sabotaged one first; what
+		// breaks a link or a route breaks the probe of the gateway too
+		failed []string
+	}{
+		{name: "ready"},
+		{name: "route map entry", failed: []string{ReadinessDatapath, ReadinessGateway},
+			sabotage: func(t *testing.T, cn *ContainerNetwork) {
+				route := &netlink.Route{LinkIndex: cn.HostIfindex, Dst: hostPrefix(netip.MustParseAddr(cn.IPv4)), Scope: netlink.SCOPE_LINK}
+				if err := netlink.RouteDel(route); err != nil {
+					t.Fatal(err)
+				}
+			}},
+		{name: "container interface down", failed: []string{ReadinessLink, ReadinessGateway},
+			sabotage: func(t *testing.T, cn *ContainerNetwork) {
+				inContainer(t, cn, func(h *netlink.Handle) error {
+					link, err := h.LinkByName(containerIfName)
+					if err != nil {
+						return err
+					}
+					return h.LinkSetDown(link)
+				})
+			}},
+		{name: "gateway unreachable", failed: []string{ReadinessGateway},
+			sabotage: func(t *testing.T, cn *ContainerNetwork) {
+				// Removing the gateway address would flush the routes
+				// through the veth, so the gateway ignores echoes instead
+				const sysctl = "/proc/sys/net/ipv4/icmp_echo_ignore_all"
+				if err := os.WriteFile(sysctl, []byte("1"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { os.WriteFile(sysctl, []byte("0"), 0o644) })
+			}},
+		{name: "destination denied", failed: []string{ReadinessPolicy},
+			sabotage: func(t *testing.T, cn *ContainerNetwork) {
+				p := NetworkPolicy{Name: "deny-" + cn.ContainerID, SourceContainer: cn.ContainerID, DestContainer: "server", Action: PolicyDeny}
+				if err := nm.ApplyPolicy(p); err != nil {
+					t.Fatal(err)
+				}
+			}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := fmt.Sprintf("client%d", i)
+			cn, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: id, NetnsPath: containerNetns(t), RequiredDestinations: required})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nm.DeleteContainerNetwork(ctx, id)
+			if tt.sabotage != nil {
+				tt.sabotage(t, cn)
+			}
+
+			report, err := nm.VerifyContainerNetwork(ctx, id)
+			if len(report.Checks) != 4 {
+				t.Fatalf("report has checks %+v, want 4", report.Checks)
+			}
+			if got := failedChecks(report); !slices.Equal(got, tt.failed) {
+				t.Errorf("failed checks = %v, want %v: %+v", got, tt.failed, report.Checks)
+			}
+			if tt.failed == nil {
+				if err != nil || !report.Ready {
+					t.Errorf("VerifyContainerNetwork() = %+v, %v, want ready", report, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrNotReady) || report.Ready {
+				t.Errorf("VerifyContainerNetwork() = %v, ready %v, want %v", err, report.Ready, ErrNotReady)
+			}
+			if report.Duration < 300*time.Millisecond {
+				t.Errorf("gave up after %v, before the timeout", report.Duration)
+			}
+		})
+	}
+}
+
+func runVerifyOnCreate(t *testing.T) {
+	ctx := context.Background()
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:      "10.99.0.0/24",
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Readiness: ReadinessConfig{VerifyOnCreate: true, Timeout: 300 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+
+	server, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "server", NetnsPath: containerNetns(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Readiness == nil || !server.Readiness.Ready {
+		t.Fatalf("created network has readiness %+v, want ready", server.Readiness)
+	}
+	// Creating it again doesn't verify it again
+	again, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "server", NetnsPath: server.NetnsPath})
+	if err != nil || again.Readiness != nil {
+		t.Errorf("create of an existing network = %+v, %v, want it unverified", again.Readiness, err)
+	}
+
+	if err := nm.ApplyPolicy(NetworkPolicy{Name: "deny-all", DestContainer: "server", Action: PolicyDeny}); err != nil {
+		t.Fatal(err)
+	}
+	spec := ContainerNetworkSpec{ContainerID: "client", NetnsPath: containerNetns(t),
+		RequiredDestinations: []Destination{{Addr: server.IPv4}}}
+	if _, err := nm.CreateContainerNetwork(ctx, spec); !errors.Is(err, ErrNotReady) {
+		t.Fatalf("create with a denied destination = %v, want %v", err, ErrNotReady)
+	}
+	if _, ok := nm.ContainerNetworks()["client"]; ok {
+		t.Error("network that isn't ready was kept")
+	}
+	if _, err := netlink.LinkByName(hostVethName(nm.instance, "client")); err == nil {
+		t.Error("host veth of the network that isn't ready was kept")
+	}
+}
@@ -0,0 +1,146 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDestinationValidate(t *testing.T) {
+	tests := []struct {
+		d   Destination
+		err string
+	}{
+		{d: Destination{Addr: "10.99.0.5"}},
+		{d: Destination{Addr: "fd00::5", Protocol: "tcp", Port: 443}},
+		{d: Destination{Addr: "db"}, err: "required destination"},
+		{d: Destination{Addr: "10.99.0.5", Protocol: "sctp"}, err: "unsupported protocol"},
+		{d: Destination{Addr: "10.99.0.5", Port: 80}, err: "port requires tcp or udp"},
+	}
+	for _, tt := range tests {
+		err := tt.d.validate()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: validate() = %v", tt.d, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: validate() = %v, want an ErrInvalidConfig with %q", tt.d, err, tt.err)
+		}
+	}
+}
+
+func TestCheckDestinations(t *testing.T) {
+	newManager := func() *NetworkManager {
+		return &NetworkManager{
+			config: NetworkConfig{DefaultPolicy: PolicyAllow},
+			containers: map[string]*ContainerNetwork{
+				"client": {ContainerID: "client", Namespace: DefaultNamespace, IPv4: "10.99.0.2"},
+				"db":     {ContainerID: "db", Namespace: DefaultNamespace, IPv4: "10.99.0.3", IPv6: "fd00::3"},
+				"vault":  {ContainerID: "vault", Namespace: "secure", IPv4: "10.99.0.4"},
+			},
+			namespaces: map[string]Namespace{DefaultNamespace: {Name: DefaultNamespace}, "secure": {Name: "secure"}},
+			policies:   make(map[string]NetworkPolicy),
+		}
+	}
+	apply := func(nm *NetworkManager, p NetworkPolicy) {
+		p.Namespace = DefaultNamespace
+		nm.policies[p.Name] = p
+		nm.policyOrder = append(nm.policyOrder, p.Name)
+	}
+
+	tests := []struct {
+		name  string
+		setup func(nm *NetworkManager)
+		dest  Destination
+		err   string
+	}{
+		{name: "allowed", dest: Destination{Addr: "10.99.0.3", Protocol: "tcp", Port: 5432}},
+		{name: "outside the node", dest: Destination{Addr: "192.0.2.1"},
+			setup: func(nm *NetworkManager) { nm.config.DefaultPolicy = PolicyDeny }},
+		{name: "no address of the family", dest: Destination{Addr: "fd00::3"}, err: "no address of the family"},
+		{name: "isolated", dest: Destination{Addr: "10.99.0.4"}, err: "namespace secure isolates vault"},
+		{name: "allowed from the namespace", dest: Destination{Addr: "10.99.0.4"}, setup: func(nm *NetworkManager) {
+			nm.namespaces["secure"] = Namespace{Name: "secure", AllowFrom: []string{DefaultNamespace}}
+		}},
+		{name: "denied", dest: Destination{Addr: "10.99.0.3", Protocol: "tcp", Port: 5432}, err: "policy db-deny would deny it",
+			setup: func(nm *NetworkManager) {
+				apply(nm, NetworkPolicy{Name: "db-deny", DestContainer: "db", SourceContainer: "client", Action: PolicyDeny})
+			}},
+		{name: "other port denied", dest: Destination{Addr: "10.99.0.3", Protocol: "tcp", Port: 5432},
+			setup: func(nm *NetworkManager) {
+				apply(nm, NetworkPolicy{Name: "db-ssh", DestContainer: "db", Protocol: "tcp", Port: 22, Action: PolicyReject})
+			}},
+		{name: "allowed over the default", dest: Destination{Addr: "10.99.0.3", Protocol: "tcp", Port: 5432},
+			setup: func(nm *NetworkManager) {
+				nm.config.DefaultPolicy = PolicyDeny
+				apply(nm, NetworkPolicy{Name: "db-pg", DestContainer: "db", SourceCIDR: "10.99.0.0/24", Protocol: "tcp", Port: 5432, Action: PolicyAllow})
+			}},
+		{name: "default", dest: Destination{Addr: "10.99.0.3"}, err: "default policy would reject it",
+			setup: func(nm *NetworkManager) { nm.config.DefaultPolicy = PolicyReject }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := newManager()
+			if tt.setup != nil {
+				tt.setup(nm)
+			}
+			cn := nm.containers["client"]
+			cn.RequiredDestinations = []Destination{tt.dest}
+			err := nm.checkDestinations(cn)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("checkDestinations() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("checkDestinations() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	nm := &NetworkManager{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	cn := &ContainerNetwork{ContainerID: "c1"}
+	// flaky fails its first two runs
+	runs := 0
+	flaky := readinessCheck{name: "flaky", run: func(context.Context, *ContainerNetwork) error {
+		if runs++; runs <= 2 {
+			return errors.New("not yet")
+		}
+		return nil
+	}}
+	ok := readinessCheck{name: "ok", locked: true, run: func(context.Context, *ContainerNetwork) error { return nil }}
+	broken := readinessCheck{name: "broken", run: func(context.Context, *ContainerNetwork) error { return errors.New("broken") }}
+
+	report := nm.verify(context.Background(), cn, []readinessCheck{ok, flaky})
+	if !report.Ready {
+		t.Fatalf("verify() = %+v, want ready", report)
+	}
+	if c := report.Checks[0]; c.Name != "ok" || !c.Passed || c.Attempts != 1 {
+		t.Errorf("ok check = %+v, want passed at the first attempt", c)
+	}
+	if c := report.Checks[1]; c.Name != "flaky" || !c.Passed || c.Attempts != 3 || c.Error != "" {
+		t.Errorf("flaky check = %+v, want passed at the third attempt", c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report = nm.verify(ctx, cn, []readinessCheck{ok, broken})
+	if report.Ready || report.Duration < 50*time.Millisecond {
+		t.Fatalf("verify() with a broken check = %+v, want not ready after the timeout", report)
+	}
+	if c := report.Checks[1]; c.Passed || c.Error != "broken" || c.Attempts < 2 {
+		t.Errorf("broken check = %+v, want failed and retried", c)
+	}
+	if c, ok := report.failed(); !ok || c.Name != "broken" {
+		t.Errorf("failed() = %+v, %v, want the broken check", c, ok)
+	}
+}
@@ -0,0 +1,177 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// ErrReservationNotFound is returned for containers without a reservation
+var ErrReservationNotFound = errors.New("network: reservation not found")
+
+// Reservation holds the addresses a container requested, see
+// ContainerNetworkSpec.RequestedIP. They outlive the container's network,
+// so creating it again gives it the same ones, and no other container
+// gets them until the reservation is released.
+type Reservation struct {
+	ContainerID string `json:"container_id"`
+	// IPv4 and IPv6 are empty for the families the container didn't
+	// request an address of
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+	MAC  string `json:"mac,omitempty"`
+	// Migrating is set by CheckpointNetwork: while it is, deleting the
+	// container's network leaves its addresses allocated in the IPAM
+	// backend, for the network RestoreNetwork creates
+	Migrating bool `json:"migrating,omitempty"`
+}
+
+// addr returns the reserved address of the family, if any. r may be nil.
+func (r *Reservation) addr(ipv4 bool) netip.Addr {
+	if r == nil {
+		return netip.Addr{}
+	}
+	s := r.IPv6
+	if ipv4 {
+		s = r.IPv4
+	}
+	addr, _ := netip.ParseAddr(s)
+	return addr
+}
+
+// reservationFor returns the reservation creating the network of spec
+// makes: the container's reservation, if any, with the addresses and mac
+// spec requests instead. It is nil when neither requests anything.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) reservationFor(spec ContainerNetworkSpec, mac net.HardwareAddr) (*Reservation, error) {
+	res, reserved := nm.reservations[spec.ContainerID]
+	if !reserved && mac == nil && spec.RequestedIP == "" && spec.RequestedIP6 == "" {
+		return nil, nil
+	}
+	res.ContainerID = spec.ContainerID
+	// The container took its addresses back
+	res.Migrating = false
+	if mac != nil {
+		res.MAC = mac.String()
+	}
+	for _, r := range []struct {
+		s      string
+		family string
+		ipv4   bool
+		dst    *string
+	}{
+		{spec.RequestedIP, "IPv4", true, &res.IPv4},
+		{spec.RequestedIP6, "IPv6", false, &res.IPv6},
+	} {
+		if r.s == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(r.s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q is not an IP address", ErrInvalidAddress, r.s)
+		}
+		if addr.Is4() != r.ipv4 {
+			return nil, fmt.Errorf("%w: %s is not an %s address", ErrInvalidAddress, addr, r.family)
+		}
+		if nm.poolOf(r.ipv4) == nil {
+			return nil, fmt.Errorf("%w: no %s network is configured for %s", ErrInvalidAddress, r.family, addr)
+		}
+		*r.dst = addr.String()
+	}
+	if res.IPv4 != "" || res.IPv6 != "" {
+		if err := nm.checkPrivileged("requested addresses"); err != nil {
+			return nil, err
+		}
+	}
+	return &res, nil
+}
+
+// poolOf returns the pool of the family, nil when none is configured
+func (nm *NetworkManager) poolOf(ipv4 bool) *ipAllocator {
+	for _, pool := range nm.pools {
+		if pool.prefix.Addr().Is4() == ipv4 {
+			return pool
+		}
+	}
+	return nil
+}
+
+// reserve records res, pinning its addresses in the pools. It replaces
+// the container's previous reservation, which is kept on failure. Callers
+// must hold nm.mu or own nm exclusively.
+func (nm *NetworkManager) reserve(res Reservation) error {
+	prev, reserved := nm.reservations[res.ContainerID]
+	for _, pool := range nm.pools {
+		addr := res.addr(pool.prefix.Addr().Is4())
+		if !addr.IsValid() {
+			pool.Unpin(res.ContainerID)
+			continue
+		}
+		if err := pool.Pin(res.ContainerID, addr); err != nil {
+			nm.unreserve(res.ContainerID)
+			if reserved {
+				nm.reserve(prev)
+			}
+			return err
+		}
+	}
+	nm.reservations[res.ContainerID] = res
+	return nil
+}
+
+// unreserve drops the reservation of containerID, if any
+func (nm *NetworkManager) unreserve(containerID string) {
+	for _, pool := range nm.pools {
+		pool.Unpin(containerID)
+	}
+	delete(nm.reservations, containerID)
+}
+
+// restoreReservations records the saved reservations again, dropping
+// those whose addresses left the pools
+func (nm *NetworkManager) restoreReservations(reservations []Reservation) {
+	for _, res := range reservations {
+		if err := nm.reserve(res); err != nil {
+			nm.log.Warn("Dropping saved address reservation", "container_id", res.ContainerID, "error", err)
+		}
+	}
+	if len(nm.reservations) > 0 {
+		nm.log.Info("Restored address reservations", "count", len(nm.reservations))
+	}
+}
+
+// sortedReservations returns the reservations ordered by container ID.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) sortedReservations() []Reservation {
+	out := make([]Reservation, 0, len(nm.reservations))
+	for _, res := range nm.reservations {
+		out = append(out, res)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ContainerID < out[j].ContainerID })
+	return out
+}
+
+// ListReservations returns the reservations ordered by container ID
+func (nm *NetworkManager) ListReservations() []Reservation {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.sortedReservations()
+}
+
+// ReleaseReservation drops the reservation of containerID, letting other
+// containers have its addresses. A container network holding them keeps
+// them until it is deleted. The addresses of a migrating container are
+// only released here, as its restored network holds them in the IPAM
+// backend.
+func (nm *NetworkManager) ReleaseReservation(containerID string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, ok := nm.reservations[containerID]; !ok {
+		return fmt.Errorf("%w: %s", ErrReservationNotFound, containerID)
+	}
+	nm.unreserve(containerID)
+	return nm.saveState()
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// ErrRootless is returned for operations that need CAP_NET_ADMIN on the
+// host while the manager runs in rootless mode
+var ErrRootless = errors.New("network: not supported in rootless mode")
+
+// RootlessMode selects when containers are connected with slirp4netns
+// instead of veth pairs
+type RootlessMode string
+
+const (
+	// RootlessOff always creates veth pairs, which requires CAP_NET_ADMIN
+	RootlessOff RootlessMode = "off"
+	// RootlessAuto uses slirp4netns when the manager lacks CAP_NET_ADMIN in
+	// the host's network namespace
+	RootlessAuto RootlessMode = "auto"
+	// RootlessOn always uses slirp4netns
+	RootlessOn RootlessMode = "on"
+)
+
+// Addresses slirp4netns gives each container on a network of its own:
+// slirpAddr and slirpAddr6 are the container's, and the gateway is the
+// host, reached through slirp4netns's user-mode NAT
+var (
+	slirpAddr  = netip.MustParseAddr("10.0.2.100")
+	slirpAddr6 = netip.MustParseAddr("fd00::100")
+)
+
+// RootlessConfig connects containers without privileges on the host. Each
+// container then gets a tap device from a slirp4netns process, on a
+// network of its own with fixed addresses: 10.0.2.100, and fd00::100 with
+// an IPv6 CIDR. Traffic leaves through the sockets of the slirp4netns
+// process, so containers can't reach each other except through forwarded
+// ports. XDP, the overlay, DNS, policies, services,
+// bandwidth limits, QoS and mirrors are unavailable.
+type RootlessConfig struct {
+	// Mode defaults to RootlessOff
+	Mode RootlessMode `json:"mode"`
+	// Slirp4netns is the slirp4netns binary, looked up in PATH by default
+	Slirp4netns string `json:"slirp4netns"`
+}
+
+func (c RootlessConfig) validate(config NetworkConfig) error {
+	switch c.Mode {
+	case "", RootlessOff, RootlessAuto:
+		return nil
+	case RootlessOn:
+		if config.EnableXDP {
+			return fmt.Errorf("%w: rootless mode doesn't support XDP", ErrInvalidConfig)
+		}
+		return checkRootless(config)
+	default:
+		return fmt.Errorf("%w: unknown rootless mode %q", ErrInvalidConfig, c.Mode)
+	}
+}
+
+// checkRootless fails for configurations that rootless mode can't honor.
+// XDP is left out, as falling back to rootless mode is like failing to
+// attach it.
+func checkRootless(config NetworkConfig) error {
+	var feature string
+	switch {
+	case config.Node != nil:
+		feature = "the overlay"
+	case config.DNS.Enable:
+		feature = "DNS"
+	case config.DefaultPolicy.denies():
+		feature = "a " + string(config.DefaultPolicy) + " default policy"
+	case config.SNAT.Enable:
+		feature = "SNAT, as slirp4netns translates addresses itself"
+	case len(config.Devices.PhysicalFunctions) > 0 || config.Devices.MacvlanFallback:
+		feature = "direct attachments"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: rootless mode doesn't support %s", ErrInvalidConfig, feature)
+}
+
+// checkPrivileged fails with ErrRootless in rootless mode, for operations
+// programming the host's network
+func (nm *NetworkManager) checkPrivileged(what string) error {
+	if nm.rootless {
+		return fmt.Errorf("%w: %s", ErrRootless, what)
+	}
+	return nil
+}
+
+// rootlessAddrs returns the addresses slirp4netns gives a container: an
+// IPv4 address always, and an IPv6 one with an IPv6 CIDR
+func (nm *NetworkManager) rootlessAddrs() (ipv4, ipv6 string) {
+	ipv4 = slirpAddr.String()
+	for _, pool := range nm.pools {
+		if pool.prefix.Addr().Is6() {
+			ipv6 = slirpAddr6.String()
+		}
+	}
+	return ipv4, ipv6
+}
@@ -0,0 +1,434 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Bounds of the waits on slirp4netns: for it to configure a container, for
+// a call to its API and for it to exit once told to
+const (
+	slirpReadyTimeout = 10 * time.Second
+	slirpAPITimeout   = 5 * time.Second
+	slirpStopTimeout  = 5 * time.Second
+)
+
+// slirpProcess is the slirp4netns process connecting a rootless container
+type slirpProcess struct {
+	cmd *exec.Cmd
+	// exit is the write end of the pipe passed as --exit-fd; slirp4netns
+	// exits once it is closed, including when the manager dies
+	exit *os.File
+	// api is the path of the API socket
+	api      string
+	done     chan struct{}
+	stopping atomic.Bool
+	output   *slirpOutput
+	// forwards are the IDs slirp4netns gave the ports it forwards
+	forwards map[PortForward]int
+}
+
+// useRootless reports whether containers are to be connected with
+// slirp4netns
+func (nm *NetworkManager) useRootless() bool {
+	switch nm.config.Rootless.Mode {
+	case RootlessOn:
+		return true
+	case RootlessAuto:
+		return !hasNetAdmin()
+	default:
+		return false
+	}
+}
+
+// initRootless leaves the host's network alone, as it can't be configured
+// without CAP_NET_ADMIN, and checks that slirp4netns is installed
+func (nm *NetworkManager) initRootless() error {
+	if err := checkRootless(nm.config); err != nil {
+		return err
+	}
+	path, err := nm.slirpPath()
+	if err != nil {
+		return err
+	}
+	if nm.config.EnableXDP {
+		nm.log.Warn("XDP unavailable in rootless mode, containers are connected with slirp4netns")
+		nm.caps.XDPError = "rootless mode"
+	}
+	nm.rootless = true
+	nm.caps.Rootless = true
+	nm.log.Info("Running rootless, connecting containers with slirp4netns", "slirp4netns", path)
+	return nil
+}
+
+// hasNetAdmin reports whether the process holds CAP_NET_ADMIN in the user
+// namespace owning its network namespace, which configuring the host's
+// network requires. It assumes so when that can't be told.
+func hasNetAdmin() bool {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return true
+	}
+	if data[0].Effective&(1<<unix.CAP_NET_ADMIN) == 0 {
+		return false
+	}
+
+	// Capabilities held in a user namespace don't extend to network
+	// namespaces its ancestors own, e.g. the host's
+	f, err := os.Open("/proc/self/ns/net")
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	fd, err := unix.IoctlRetInt(int(f.Fd()), unix.NS_GET_USERNS)
+	if errors.Is(err, unix.EPERM) {
+		// The owner is outside our user namespace
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	defer unix.Close(fd)
+	var owner, self unix.Stat_t
+	if unix.Fstat(fd, &owner) != nil || unix.Stat("/proc/self/ns/user", &self) != nil {
+		return true
+	}
+	return owner.Dev == self.Dev && owner.Ino == self.Ino
+}
+
+// slirpPath returns the slirp4netns binary to run
+func (nm *NetworkManager) slirpPath() (string, error) {
+	name := nm.config.Rootless.Slirp4netns
+	if name == "" {
+		name = "slirp4netns"
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: slirp4netns not found: %v", ErrRootless, err)
+	}
+	return path, nil
+}
+
+// setupSlirp connects cn with a slirp4netns process, which creates and
+// configures its interface, recording the step in j
+func (nm *NetworkManager) setupSlirp(j *opJournal, cn *ContainerNetwork) error {
+	if cn.NetnsPath == "" {
+		return errors.New("netns path or pid required")
+	}
+	return j.run("start slirp4netns", func() error {
+		p, err := nm.startSlirp(cn)
+		if err != nil {
+			return err
+		}
+		nm.slirps[cn.ContainerID] = p
+		return nil
+	}, func() error {
+		return nm.stopSlirp(cn.ContainerID)
+	})
+}
+
+// adoptSlirp connects a rootless container restored from saved state
+// again, as its slirp4netns exited with the previous manager. It returns
+// false when the container's namespace is gone.
+func (nm *NetworkManager) adoptSlirp(cn *ContainerNetwork) (bool, error) {
+	if _, err := os.Stat(cn.NetnsPath); err != nil {
+		return false, nil
+	}
+	p, err := nm.startSlirp(cn)
+	if err != nil {
+		return false, err
+	}
+	nm.slirps[cn.ContainerID] = p
+	return true, nil
+}
+
+// startSlirp runs slirp4netns for cn and waits until it has configured the
+// container's interface
+func (nm *NetworkManager) startSlirp(cn *ContainerNetwork) (*slirpProcess, error) {
+	path, err := nm.slirpPath()
+	if err != nil {
+		return nil, err
+	}
+	exitR, exitW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer exitR.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		exitW.Close()
+		return nil, err
+	}
+	defer readyR.Close()
+	defer readyW.Close()
+
+	api := slirpSocketPath(nm.instance, cn.ContainerID)
+	if err := os.Remove(api); err != nil && !errors.Is(err, os.ErrNotExist) {
+		exitW.Close()
+		return nil, err
+	}
+	args := []string{
+		"--configure",
+		"--disable-host-loopback",
+		"--macaddress=" + cn.MAC,
+		"--api-socket=" + api,
+		// ExtraFiles start at 3
+		"--exit-fd=3",
+		"--ready-fd=4",
+	}
+	if mtu := nm.containerMTU(cn); mtu > 0 {
+		args = append(args, "--mtu="+strconv.Itoa(mtu))
+	}
+	if cn.IPv6 != "" {
+		args = append(args, "--enable-ipv6")
+	}
+	args = append(args, "--netns-type=path", cn.NetnsPath, containerIfName)
+
+	p := &slirpProcess{
+		cmd:      exec.Command(path, args...),
+		exit:     exitW,
+		api:      api,
+		done:     make(chan struct{}),
+		output:   &slirpOutput{log: nm.log.With("container_id", cn.ContainerID)},
+		forwards: make(map[PortForward]int),
+	}
+	p.cmd.ExtraFiles = []*os.File{exitR, readyW}
+	p.cmd.Stdout, p.cmd.Stderr = p.output, p.output
+	if err := p.cmd.Start(); err != nil {
+		exitW.Close()
+		return nil, fmt.Errorf("failed to start slirp4netns: %w", err)
+	}
+	// Our copy would keep the ready pipe open after slirp4netns exits
+	readyW.Close()
+	go func() {
+		err := p.cmd.Wait()
+		if !p.stopping.Load() {
+			nm.log.Warn("slirp4netns exited, container is offline", "container_id", cn.ContainerID, "error", err)
+		}
+		os.Remove(api)
+		close(p.done)
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(slirpReadyTimeout):
+		err = fmt.Errorf("not ready after %s", slirpReadyTimeout)
+	}
+	if err != nil {
+		p.stop()
+		if last := p.output.lastLine(); last != "" {
+			err = errors.New(last)
+		}
+		return nil, fmt.Errorf("slirp4netns failed to connect %s: %w", cn.NetnsPath, err)
+	}
+	return p, nil
+}
+
+// slirpSocketPath returns where the API socket of the slirp4netns of
+// containerID in instance is created, in the user's runtime directory
+// when there is one. It is named like the container's host veth would be,
+// which keeps it short enough for a socket path.
+func slirpSocketPath(instance, containerID string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "enviro-slirp-"+hostVethName(instance, containerID)+".sock")
+}
+
+// stopSlirp stops the slirp4netns of a container, if any, which removes
+// the container's interface with it
+func (nm *NetworkManager) stopSlirp(containerID string) error {
+	p, ok := nm.slirps[containerID]
+	if !ok {
+		return nil
+	}
+	delete(nm.slirps, containerID)
+	return p.stop()
+}
+
+// stopSlirps stops the slirp4netns of every container
+func (nm *NetworkManager) stopSlirps() error {
+	var errs []error
+	for id := range nm.slirps {
+		errs = append(errs, nm.stopSlirp(id))
+	}
+	return errors.Join(errs...)
+}
+
+// stop closes the exit pipe and waits for slirp4netns to exit, killing it
+// when it takes too long
+func (p *slirpProcess) stop() error {
+	p.stopping.Store(true)
+	p.exit.Close()
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(slirpStopTimeout):
+	}
+	if err := p.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("failed to kill slirp4netns: %w", err)
+	}
+	<-p.done
+	return nil
+}
+
+// call sends a request to the API socket and decodes the return value into
+// resp, unless nil
+func (p *slirpProcess) call(execute string, args, resp any) error {
+	conn, err := net.DialTimeout("unix", p.api, slirpAPITimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to slirp4netns: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(slirpAPITimeout))
+
+	// slirp4netns reads a request with a single read, so it is written in
+	// one piece
+	req, err := json.Marshal(struct {
+		Execute   string `json:"execute"`
+		Arguments any    `json:"arguments,omitempty"`
+	}{execute, args})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("failed to call slirp4netns: %w", err)
+	}
+	var out struct {
+		Return json.RawMessage `json:"return"`
+		Error  *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&out); err != nil {
+		return fmt.Errorf("failed to read slirp4netns response: %w", err)
+	}
+	if out.Error != nil {
+		return fmt.Errorf("slirp4netns: %s: %s", execute, out.Error.Desc)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(out.Return, resp)
+}
+
+// slirpHostFwd are the arguments of add_hostfwd
+type slirpHostFwd struct {
+	Proto     string `json:"proto"`
+	HostAddr  string `json:"host_addr"`
+	HostPort  uint16 `json:"host_port"`
+	GuestAddr string `json:"guest_addr"`
+	GuestPort uint16 `json:"guest_port"`
+}
+
+// syncSlirpForwards makes the slirp4netns of each container forward its
+// ports and no others. Callers must hold nm.mu.
+func (nm *NetworkManager) syncSlirpForwards() error {
+	for id, p := range nm.slirps {
+		desired := make(map[PortForward]bool)
+		if cn, ok := nm.containers[id]; ok {
+			for _, fwd := range cn.Ports {
+				desired[fwd] = true
+			}
+		}
+		for fwd, fwdID := range p.forwards {
+			if desired[fwd] {
+				continue
+			}
+			if err := p.call("remove_hostfwd", map[string]int{"id": fwdID}, nil); err != nil {
+				return err
+			}
+			delete(p.forwards, fwd)
+		}
+		for fwd := range desired {
+			if _, ok := p.forwards[fwd]; ok {
+				continue
+			}
+			var added struct {
+				ID int `json:"id"`
+			}
+			err := p.call("add_hostfwd", slirpHostFwd{
+				Proto:     fwd.Protocol,
+				HostAddr:  "0.0.0.0",
+				HostPort:  fwd.HostPort,
+				GuestAddr: slirpAddr.String(),
+				GuestPort: fwd.ContainerPort,
+			}, &added)
+			if err != nil {
+				return err
+			}
+			p.forwards[fwd] = added.ID
+		}
+	}
+	return nil
+}
+
+// readContainerIfStats fills stats from the counters of a container's own
+// interface, read inside its namespace, for containers without a host veth
+func readContainerIfStats(cn *ContainerNetwork, stats map[string]uint64) error {
+	h, err := containerHandle(cn)
+	if err != nil {
+		return fmt.Errorf("failed to read stats for %s: %w", cn.ContainerID, err)
+	}
+	defer h.Delete()
+	link, err := h.LinkByName(containerIfName)
+	if err != nil {
+		return fmt.Errorf("failed to read stats for %s: %w", cn.ContainerID, err)
+	}
+	if s := link.Attrs().Statistics; s != nil {
+		stats["packets_processed"] = s.RxPackets + s.TxPackets
+		stats["bytes_processed"] = s.RxBytes + s.TxBytes
+		stats["drop_count"] = s.RxDropped + s.TxDropped
+	}
+	return nil
+}
+
+// slirpOutput logs what slirp4netns prints, keeping the last line to
+// explain failures
+type slirpOutput struct {
+	log *slog.Logger
+
+	mu   sync.Mutex
+	last string
+}
+
+func (o *slirpOutput) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		o.log.Debug("slirp4netns output", "line", line)
+		o.mu.Lock()
+		o.last = line
+		o.mu.Unlock()
+	}
+	return len(b), nil
+}
+
+func (o *slirpOutput) lastLine() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.last
+}
@@ -0,0 +1,450 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+// Errors returned by service operations
+var (
+	// ErrServiceNotFound is returned for operations on an unknown service
+	ErrServiceNotFound = errors.New("network: service not found")
+	// ErrServiceExists is returned when creating a service whose name or
+	// address and port are taken
+	ErrServiceExists = errors.New("network: service exists")
+	// ErrInvalidService is returned for malformed services
+	ErrInvalidService = errors.New("network: invalid service")
+)
+
+// maglevTableSize is the number of slots of a service's Maglev lookup
+// table. It is prime, as Maglev requires, and large enough to spread
+// connections evenly across maxServiceBackends.
+const maglevTableSize = 1021
+
+// maxServiceBackends bounds the backends of a service
+const maxServiceBackends = 64
+
+// Service is a virtual IP and ports whose connections are balanced across
+// backend containers. A backend is picked by hashing the client address
+// and port into a Maglev table, so a connection lands on the same backend
+// on every node, and changing the backends only moves the connections of
+// those added or removed. Established connections stay on their backend.
+//
+// Backends on other nodes of the overlay are RemoteBackends, which a
+// topology preference can keep connections away from while enough
+// backends are nearby.
+type Service struct {
+	// Name is a DNS label; with DNS enabled the VIP resolves as
+	// <name>.svc.<domain>, and the port as SRV _<name>._<protocol>.svc.<domain>
+	Name string `json:"name"`
+	// Namespace is the namespace of the service and its backends,
+	// DefaultNamespace when empty
+	Namespace string `json:"namespace,omitempty"`
+	// VIP is the address clients connect to. It must be outside the
+	// container networks, and is only reached from outside the node when
+	// routed to it.
+	VIP  string `json:"vip"`
+	Port uint16 `json:"port"`
+	// Protocol is "tcp" (the default) or "udp"
+	Protocol string `json:"protocol"`
+	// TargetPort is the port of the backends, Port when zero
+	TargetPort uint16 `json:"target_port"`
+	// Ports are the ports of a service listening on several. Port,
+	// Protocol, TargetPort and NodePort describe the only port when it is
+	// empty, and are set to those of the first port otherwise.
+	Ports []ServicePort `json:"ports,omitempty"`
+	// BackendPorts override the target port of single backends
+	BackendPorts []BackendPort `json:"backend_ports,omitempty"`
+	// Backends are the IDs of the containers connections are balanced
+	// across, using their address of the VIP's family. Deleted containers
+	// are removed.
+	Backends []string `json:"backends"`
+	// RemoteBackends are the backends on other nodes, e.g. as the leader
+	// of a cluster distributes the service
+	RemoteBackends []RemoteBackend `json:"remote_backends,omitempty"`
+	// Topology is how backends are weighed by where they run, TopologyAny
+	// when empty
+	Topology TopologyPreference `json:"topology,omitempty"`
+	// MinLocalBackends is how many healthy backends the tiers preferred by
+	// Topology must have before connections spill over to the next, 1
+	// when zero
+	MinLocalBackends int `json:"min_local_backends,omitempty"`
+	// ExposeNodePort also balances the connections to NodePort on every
+	// host address, for load balancers outside the cluster
+	ExposeNodePort bool `json:"expose_node_port,omitempty"`
+	// NodePort is taken from NetworkConfig.NodePorts, the first free port
+	// when zero. Like port forwards, it must be free on the host. Each of
+	// Ports has its own.
+	NodePort uint16 `json:"node_port,omitempty"`
+}
+
+// withDefaults fills in the namespace, ports and backend order
+func (s Service) withDefaults() Service {
+	s.Namespace = namespaceOf(s.Namespace)
+	s.Ports = s.ServicePorts()
+	s.setFirstPort()
+	s.BackendPorts = slices.Clone(s.BackendPorts)
+	sortBackendPorts(s.BackendPorts)
+	s.Backends = append([]string(nil), s.Backends...)
+	sort.Strings(s.Backends)
+	s.RemoteBackends = append([]RemoteBackend(nil), s.RemoteBackends...)
+	sort.Slice(s.RemoteBackends, func(i, j int) bool { return s.RemoteBackends[i].ContainerID < s.RemoteBackends[j].ContainerID })
+	if s.Topology == "" {
+		s.Topology = TopologyAny
+	}
+	if s.MinLocalBackends == 0 {
+		s.MinLocalBackends = 1
+	}
+	return s
+}
+
+// Validate checks that the service is well formed
+func (s Service) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidService)
+	}
+	// Services are resolvable as <name>.svc.<domain>
+	if err := ValidateName(s.Name); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidService, err)
+	}
+	if err := ValidateName(s.Namespace); err != nil {
+		return fmt.Errorf("%w: service %s: %v", ErrInvalidService, s.Name, err)
+	}
+	vip, err := netip.ParseAddr(s.VIP)
+	if err != nil {
+		return fmt.Errorf("%w: service %s: %v", ErrInvalidService, s.Name, err)
+	}
+	if vip.Zone() != "" || vip.Is4In6() || vip.IsUnspecified() || vip.IsLoopback() || vip.IsMulticast() {
+		return fmt.Errorf("%w: service %s: %s can't be a VIP", ErrInvalidService, s.Name, vip)
+	}
+	if err := s.validatePorts(); err != nil {
+		return err
+	}
+	if len(s.Backends)+len(s.RemoteBackends) > maxServiceBackends {
+		return fmt.Errorf("%w: service %s has more than %d backends", ErrInvalidService, s.Name, maxServiceBackends)
+	}
+	seen := make(map[string]bool, len(s.Backends)+len(s.RemoteBackends))
+	for _, id := range s.Backends {
+		if seen[id] {
+			return fmt.Errorf("%w: service %s lists backend %s twice", ErrInvalidService, s.Name, id)
+		}
+		seen[id] = true
+	}
+	for _, b := range s.RemoteBackends {
+		if err := b.validate(s.Name); err != nil {
+			return err
+		}
+		if seen[b.ContainerID] {
+			return fmt.Errorf("%w: service %s lists backend %s twice", ErrInvalidService, s.Name, b.ContainerID)
+		}
+		seen[b.ContainerID] = true
+	}
+	switch s.Topology {
+	case "", TopologyAny, TopologyPreferLocalNode, TopologyPreferZone:
+	default:
+		return fmt.Errorf("%w: service %s has unknown topology preference %q", ErrInvalidService, s.Name, s.Topology)
+	}
+	if s.MinLocalBackends < 0 || s.MinLocalBackends > maxServiceBackends {
+		return fmt.Errorf("%w: service %s: min_local_backends must be between 0 and %d", ErrInvalidService, s.Name, maxServiceBackends)
+	}
+	return nil
+}
+
+// CreateService adds a service balancing across its backends, which must
+// have networks in the service's namespace
+func (nm *NetworkManager) CreateService(s Service) (Service, error) {
+	return nm.putService(s, false)
+}
+
+// PutService creates s, or replaces the service of its name, as the
+// leader of a cluster does distributing its services to the nodes.
+// Connections established keep their backend.
+func (nm *NetworkManager) PutService(s Service) (Service, error) {
+	return nm.putService(s, true)
+}
+
+func (nm *NetworkManager) putService(s Service, replace bool) (Service, error) {
+	if err := s.Validate(); err != nil {
+		return Service{}, err
+	}
+	if err := nm.checkPrivileged("services"); err != nil {
+		return Service{}, err
+	}
+	s = s.withDefaults()
+	vip := netip.MustParseAddr(s.VIP)
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, ok := nm.namespaces[s.Namespace]; !ok {
+		return Service{}, fmt.Errorf("%w: %s", ErrNamespaceNotFound, s.Namespace)
+	}
+	old, exists := nm.services[s.Name]
+	if exists && !replace {
+		return Service{}, fmt.Errorf("%w: %s", ErrServiceExists, s.Name)
+	}
+	for _, other := range nm.services {
+		if other.Name == s.Name || other.VIP != vip.String() {
+			continue
+		}
+		for _, p := range s.Ports {
+			if slices.ContainsFunc(other.Ports, func(o ServicePort) bool { return o.Port == p.Port && o.Protocol == p.Protocol }) {
+				return Service{}, fmt.Errorf("%w: %s/%s:%d is used by %s", ErrServiceExists, p.Protocol, vip, p.Port, other.Name)
+			}
+		}
+	}
+	for _, pool := range nm.pools {
+		if pool.prefix.Contains(vip) {
+			return Service{}, fmt.Errorf("%w: service %s: VIP %s is in the container network %s", ErrInvalidService, s.Name, vip, pool.prefix)
+		}
+	}
+	if cidr, ok := nm.config.serviceCIDR(vip); ok && !cidr.Contains(vip) {
+		return Service{}, fmt.Errorf("%w: service %s: VIP %s is outside the service CIDR %s", ErrInvalidService, s.Name, vip, cidr)
+	}
+	if err := nm.checkBackends(s); err != nil {
+		return Service{}, err
+	}
+	if err := nm.assignNodePorts(&s, old, exists); err != nil {
+		return Service{}, err
+	}
+
+	s.VIP = vip.String()
+	nm.services[s.Name] = s
+	if err := nm.syncServices(); err != nil {
+		if exists {
+			nm.services[s.Name] = old
+		} else {
+			delete(nm.services, s.Name)
+		}
+		return Service{}, fmt.Errorf("failed to program service: %w", err)
+	}
+	msg := "Created service"
+	if exists {
+		nm.names.removeService(s.Name)
+		msg = "Replaced service"
+	}
+	nm.names.addService(s)
+	nm.log.Info(msg, "service", s.Name, "namespace", s.Namespace, "vip", s.VIP, "ports", portStrings(s.Ports),
+		"backends", len(s.Backends), "remote_backends", len(s.RemoteBackends), "topology", s.Topology)
+	nm.saveServices()
+	return s, nil
+}
+
+// UpdateBackends replaces the backends of the service name
+func (nm *NetworkManager) UpdateBackends(name string, backends []string) (Service, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	old, ok := nm.services[name]
+	if !ok {
+		return Service{}, fmt.Errorf("%w: %s", ErrServiceNotFound, name)
+	}
+	s := old
+	s.Backends = backends
+	if err := s.Validate(); err != nil {
+		return Service{}, err
+	}
+	s = s.withDefaults()
+	if err := nm.checkBackends(s); err != nil {
+		return Service{}, err
+	}
+
+	nm.services[name] = s
+	if err := nm.syncServices(); err != nil {
+		nm.services[name] = old
+		return Service{}, fmt.Errorf("failed to program service: %w", err)
+	}
+	nm.log.Info("Updated service backends", "service", name, "backends", len(s.Backends))
+	nm.saveServices()
+	return s, nil
+}
+
+// DeleteService removes a service by name
+func (nm *NetworkManager) DeleteService(name string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	s, ok := nm.services[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrServiceNotFound, name)
+	}
+	delete(nm.services, name)
+	if err := nm.syncServices(); err != nil {
+		nm.services[name] = s
+		return fmt.Errorf("failed to remove service: %w", err)
+	}
+	nm.names.removeService(name)
+	nm.log.Info("Deleted service", "service", name)
+	nm.saveServices()
+	return nil
+}
+
+// saveServices persists a service change that is already programmed, so a
+// failure only loses it on restart. Callers must hold nm.mu.
+func (nm *NetworkManager) saveServices() {
+	if err := nm.saveState(); err != nil {
+		nm.log.Error("Failed to save services", "error", err)
+	}
+}
+
+// ListServices returns all services ordered by name
+func (nm *NetworkManager) ListServices() []Service {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.sortedServices()
+}
+
+// sortedServices returns copies of the services ordered by name. Callers
+// must hold nm.mu.
+func (nm *NetworkManager) sortedServices() []Service {
+	out := make([]Service, 0, len(nm.services))
+	for _, s := range nm.services {
+		s.Backends = append([]string(nil), s.Backends...)
+		s.RemoteBackends = append([]RemoteBackend(nil), s.RemoteBackends...)
+		s.Ports = append([]ServicePort(nil), s.Ports...)
+		s.BackendPorts = append([]BackendPort(nil), s.BackendPorts...)
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// checkBackends fails with ErrContainerNotFound for backends of s without
+// a network, and with ErrInvalidService for those in another namespace.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) checkBackends(s Service) error {
+	for _, id := range s.Backends {
+		cn, ok := nm.containers[id]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+		}
+		if cn.Namespace != s.Namespace {
+			return fmt.Errorf("%w: service %s: backend %s is in namespace %s", ErrInvalidService, s.Name, id, cn.Namespace)
+		}
+		if cn.Attachment.direct() {
+			return fmt.Errorf("%w: service %s: backend %s is directly attached", ErrInvalidService, s.Name, id)
+		}
+	}
+	for _, b := range s.RemoteBackends {
+		if _, ok := nm.containers[b.ContainerID]; ok {
+			return fmt.Errorf("%w: service %s: remote backend %s has a network on this node", ErrInvalidService, s.Name, b.ContainerID)
+		}
+	}
+	return nil
+}
+
+// removeServiceBackend drops containerID from the backends of every
+// service and reprograms them when any changed. Callers must hold nm.mu.
+func (nm *NetworkManager) removeServiceBackend(logger *slog.Logger, containerID string) error {
+	changed := false
+	for name, s := range nm.services {
+		for i, id := range s.Backends {
+			if id == containerID {
+				s.Backends = append(s.Backends[:i:i], s.Backends[i+1:]...)
+				nm.services[name] = s
+				logger.Info("Removing deleted container from service", "service", name)
+				changed = true
+				break
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return nm.syncServices()
+}
+
+// serviceBackend is a backend resolved to the address traffic is
+// translated to
+type serviceBackend struct {
+	ContainerID string
+	Addr        netip.Addr
+	Port        uint16
+	// Locality is where the backend runs, and Unhealthy is set for
+	// unhealthy remote backends; draining containers are no backends
+	Locality  Locality
+	Unhealthy bool
+}
+
+// serviceBackends returns the backends of port p of s preferred by its
+// topology. Callers must hold nm.mu.
+func (nm *NetworkManager) serviceBackends(s Service, p ServicePort) []serviceBackend {
+	return preferredBackends(s.Topology, s.MinLocalBackends, nm.resolveBackends(s, p))
+}
+
+// resolveBackends resolves the backends of port p of s to their
+// addresses of the VIP's family and target ports, those of this node
+// first in the order of s.Backends. Backends without such an address are
+// skipped, and those failing the health check of p are unhealthy.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) resolveBackends(s Service, p ServicePort) []serviceBackend {
+	vip := netip.MustParseAddr(s.VIP)
+	var out []serviceBackend
+	for _, id := range s.Backends {
+		cn, ok := nm.containers[id]
+		if !ok {
+			continue
+		}
+		for _, addr := range cn.addrs() {
+			if addr.Is4() == vip.Is4() {
+				out = append(out, serviceBackend{ContainerID: id, Addr: addr, Port: s.targetPort(id, p),
+					Locality: LocalityNode, Unhealthy: nm.failingHealthCheck(s.Name, p.Name, id)})
+				break
+			}
+		}
+	}
+	for _, b := range s.RemoteBackends {
+		if addr, ok := b.addr(vip); ok {
+			out = append(out, serviceBackend{ContainerID: b.ContainerID, Addr: addr, Port: s.targetPort(b.ContainerID, p),
+				Locality:  nm.config.Topology.locality(b.Zone, b.Rack),
+				Unhealthy: b.Unhealthy || nm.failingHealthCheck(s.Name, p.Name, b.ContainerID)})
+		}
+	}
+	return out
+}
+
+// maglevTable fills a lookup table of size slots with indexes into
+// backends, named by container ID, as described in "Maglev: A Fast and Reliable Software Network
+// Load Balancer". Each backend walks its own permutation of the slots,
+// derived from its name, and takes turns claiming the next free one, so
+// backends get nearly equal shares and a change of backends only moves
+// the slots of the backends added or removed.
+func maglevTable(backends []serviceBackend, size int) []int {
+	if len(backends) == 0 {
+		return nil
+	}
+	table := make([]int, size)
+	for i := range table {
+		table[i] = -1
+	}
+
+	offsets := make([]uint64, len(backends))
+	skips := make([]uint64, len(backends))
+	for i, b := range backends {
+		sum := sha256.Sum256([]byte(b.ContainerID))
+		offsets[i] = binary.BigEndian.Uint64(sum[0:8]) % uint64(size)
+		skips[i] = binary.BigEndian.Uint64(sum[8:16])%uint64(size-1) + 1
+	}
+
+	next := make([]uint64, len(backends))
+	for filled := 0; ; {
+		for i := range backends {
+			slot := (offsets[i] + next[i]*skips[i]) % uint64(size)
+			for table[slot] >= 0 {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % uint64(size)
+			}
+			table[slot] = i
+			next[i]++
+			if filled++; filled == size {
+				return table
+			}
+		}
+	}
+}
@@ -0,0 +1,322 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftServiceTable is the inet table holding the service DNAT rules and
+// their Maglev maps
+const nftServiceTable = "enviro_services"
+
+// Registers of the service rules. An IPv4 address and a port fill the
+// first two 32-bit registers, an IPv6 address the first four with the
+// port in the fifth.
+const (
+	nftReg32First = 8
+	nftPortReg4   = nftReg32First + 1
+	nftPortReg6   = nftReg32First + 4
+)
+
+// syncServices rebuilds the service table from nm.services in one atomic
+// batch. Like port forwards, services are translated by nftables DNAT in
+// prerouting and output, so they work with and without XDP, and conntrack
+// keeps connections on their backend and reverses the translation for
+// replies. Each port of a service has a map from Maglev slot to backend
+// and target port, indexed by a hash of the client address and port, and
+// a rule per locality of its backends counting the connections sent
+// there, see readServiceCounters. Services exposed on node ports are also
+// matched on them at every local address. TCP VIPs and node ports are
+// handed to SYN protection. Callers must hold nm.mu.
+func (nm *NetworkManager) syncServices() error {
+	if nm.rootless {
+		return nil
+	}
+	// Keep the counts of the table about to be replaced, of the service
+	// ports still there
+	if counts, err := nm.readServiceCounters(); err == nil {
+		nm.serviceCounters = make(map[servicePort]map[Locality]uint64)
+		for key, c := range counts {
+			if s, ok := nm.services[key.Service]; ok && slices.ContainsFunc(s.Ports, func(p ServicePort) bool { return p.Name == key.Port }) {
+				nm.serviceCounters[key] = c
+			}
+		}
+	}
+
+	conn := &nftables.Conn{}
+	table := resetTable(conn, nm.nftTable(nftServiceTable), nftables.TableFamilyINet)
+
+	services := nm.sortedServices()
+	if len(services) > 0 {
+		conn.AddTable(table)
+		chains := []*nftables.Chain{
+			conn.AddChain(&nftables.Chain{
+				Name:     "prerouting",
+				Table:    table,
+				Type:     nftables.ChainTypeNAT,
+				Hooknum:  nftables.ChainHookPrerouting,
+				Priority: nftables.ChainPriorityNATDest,
+			}),
+			conn.AddChain(&nftables.Chain{
+				Name:     "output",
+				Table:    table,
+				Type:     nftables.ChainTypeNAT,
+				Hooknum:  nftables.ChainHookOutput,
+				Priority: nftables.ChainPriorityNATDest,
+			}),
+		}
+
+		for i, s := range services {
+			for j, p := range s.Ports {
+				if err := nm.addServicePort(conn, table, chains, fmt.Sprintf("svc%d_%d", i, j), s, p); err != nil {
+					return fmt.Errorf("service %s: %w", s.Name, err)
+				}
+			}
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	return nm.syncSYNProtection()
+}
+
+// addServicePort adds the maps of port p of s, prefixed by name, and its
+// rules to chains
+func (nm *NetworkManager) addServicePort(conn *nftables.Conn, table *nftables.Table, chains []*nftables.Chain, name string, s Service, p ServicePort) error {
+	backends := nm.serviceBackends(s, p)
+	if len(backends) == 0 {
+		return nil
+	}
+	slots := maglevTable(backends, maglevTableSize)
+	set, elems := serviceMap(table, name, backends, slots)
+	if err := conn.AddSet(set, elems); err != nil {
+		return err
+	}
+	for _, l := range Localities {
+		localSlots, elems := localitySlots(table, name+"_"+string(l), backends, slots, l)
+		if len(elems) == 0 {
+			continue
+		}
+		if err := conn.AddSet(localSlots, elems); err != nil {
+			return err
+		}
+		for _, chain := range chains {
+			matches := [][]expr.Any{serviceExprs(s.VIP, p)}
+			if p.NodePort != 0 {
+				matches = append(matches, nodePortExprs(s.VIP, p, chain.Hooknum == nftables.ChainHookOutput))
+			}
+			// The counts of the node port add to those of the VIP
+			for _, match := range matches {
+				conn.AddRule(&nftables.Rule{
+					Table:    table,
+					Chain:    chain,
+					Exprs:    append(match, balanceExprs(s.VIP, localSlots, set)...),
+					UserData: []byte(s.Name + "/" + p.Name + "/" + string(l)),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// clearServices removes the service table of an earlier run, as services
+// aren't kept across restarts
+func (nm *NetworkManager) clearServices() error {
+	conn := &nftables.Conn{}
+	resetTable(conn, nm.nftTable(nftServiceTable), nftables.TableFamilyINet)
+	return conn.Flush()
+}
+
+// readServiceCounters returns the connections the service table sent to
+// backends, by service port and backend locality, added to those of the
+// tables it replaced. Callers must hold nm.mu.
+func (nm *NetworkManager) readServiceCounters() (map[servicePort]map[Locality]uint64, error) {
+	counts := make(map[servicePort]map[Locality]uint64)
+	for key, c := range nm.serviceCounters {
+		counts[key] = maps.Clone(c)
+	}
+	if nm.rootless {
+		return counts, nil
+	}
+	conn := &nftables.Conn{}
+	table := &nftables.Table{Name: nm.nftTable(nftServiceTable), Family: nftables.TableFamilyINet}
+	for _, chain := range []string{"prerouting", "output"} {
+		rules, err := conn.GetRules(table, &nftables.Chain{Name: chain, Table: table})
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				return counts, nil
+			}
+			return nil, err
+		}
+		for _, r := range rules {
+			name, rest, ok1 := strings.Cut(string(r.UserData), "/")
+			port, l, ok2 := strings.Cut(rest, "/")
+			if !ok1 || !ok2 {
+				continue
+			}
+			key := servicePort{Service: name, Port: port}
+			for _, e := range r.Exprs {
+				if c, ok := e.(*expr.Counter); ok {
+					if counts[key] == nil {
+						counts[key] = make(map[Locality]uint64)
+					}
+					counts[key][Locality(l)] += c.Packets
+				}
+			}
+		}
+	}
+	return counts, nil
+}
+
+// serviceMap returns the map from Maglev slot to the address and port of
+// a backend, all of one family, for the slots of maglevTable
+func serviceMap(table *nftables.Table, name string, backends []serviceBackend, slots []int) (*nftables.Set, []nftables.SetElement) {
+	addrType := nftables.TypeIPAddr
+	if backends[0].Addr.Is6() {
+		addrType = nftables.TypeIP6Addr
+	}
+	set := &nftables.Set{
+		Table:    table,
+		Name:     name,
+		IsMap:    true,
+		KeyType:  nftables.TypeInteger,
+		DataType: nftables.MustConcatSetType(addrType, nftables.TypeInetService),
+	}
+
+	elems := make([]nftables.SetElement, len(slots))
+	for slot, i := range slots {
+		b := backends[i]
+		// Concatenated values are padded to 32 bits each
+		val := append(b.Addr.AsSlice(), binaryutil.BigEndian.PutUint16(b.Port)...)
+		elems[slot] = nftables.SetElement{
+			Key: binaryutil.NativeEndian.PutUint32(uint32(slot)),
+			Val: append(val, 0, 0),
+		}
+	}
+	return set, elems
+}
+
+// localitySlots returns the set of the slots of maglevTable whose backend
+// has locality l
+func localitySlots(table *nftables.Table, name string, backends []serviceBackend, slots []int, l Locality) (*nftables.Set, []nftables.SetElement) {
+	set := &nftables.Set{Table: table, Name: name, KeyType: nftables.TypeInteger}
+	var elems []nftables.SetElement
+	for slot, i := range slots {
+		if backends[i].Locality == l {
+			elems = append(elems, nftables.SetElement{Key: binaryutil.NativeEndian.PutUint32(uint32(slot))})
+		}
+	}
+	return set, elems
+}
+
+// serviceExprs matches traffic to vip and port p, to be followed by
+// balanceExprs. Only the first packet of a connection is translated, so
+// connections are counted:
+//
+//	meta nfproto ipv4 meta l4proto tcp ip daddr 10.96.0.10 th dport 80 jhash ip saddr . th sport mod 1021 @svc0_0_node counter dnat ip to jhash ip saddr . th sport mod 1021 map @svc0_0
+func serviceExprs(vipStr string, p ServicePort) []expr.Any {
+	vip := netip.MustParseAddr(vipStr)
+	dstOffset := uint32(16)
+	if vip.Is6() {
+		dstOffset = 24
+	}
+	return append(serviceProtoExprs(vip, p),
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: dstOffset, Len: uint32(vip.BitLen() / 8)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: vip.AsSlice()},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(p.Port)},
+	)
+}
+
+// nodePortExprs is serviceExprs for traffic to the node port of p on any
+// local address of the VIP's family. Like port forwards, the output chain
+// skips loopback destinations, which wouldn't be routed back:
+//
+//	meta nfproto ipv4 ip daddr != 127.0.0.0/8 meta l4proto tcp fib daddr type local th dport 30000 jhash ...
+func nodePortExprs(vipStr string, p ServicePort, skipLoopback bool) []expr.Any {
+	vip := netip.MustParseAddr(vipStr)
+	exprs := serviceProtoExprs(vip, p)
+	if skipLoopback {
+		if vip.Is4() {
+			exprs = append(exprs,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 1},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{127}},
+			)
+		} else {
+			exprs = append(exprs,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: net.IPv6loopback},
+			)
+		}
+	}
+	return append(exprs,
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(p.NodePort)},
+	)
+}
+
+// serviceProtoExprs matches the family of vip and the protocol of p
+func serviceProtoExprs(vip netip.Addr, p ServicePort) []expr.Any {
+	family := byte(unix.NFPROTO_IPV4)
+	if vip.Is6() {
+		family = unix.NFPROTO_IPV6
+	}
+	proto := byte(unix.IPPROTO_TCP)
+	if p.Protocol == "udp" {
+		proto = unix.IPPROTO_UDP
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+// balanceExprs counts the matched traffic whose slot, hashed from its
+// source address and port, is in slots and translates it to the backend
+// in set at the slot
+func balanceExprs(vipStr string, slots, set *nftables.Set) []expr.Any {
+	vip := netip.MustParseAddr(vipStr)
+	family, srcOffset, portReg := byte(unix.NFPROTO_IPV4), uint32(12), uint32(nftPortReg4)
+	if vip.Is6() {
+		family, srcOffset, portReg = unix.NFPROTO_IPV6, 8, nftPortReg6
+	}
+	addrLen := uint32(vip.BitLen() / 8)
+
+	return []expr.Any{
+		// Hash the source address and port, loaded back to back
+		&expr.Payload{DestRegister: nftReg32First, Base: expr.PayloadBaseNetworkHeader, Offset: srcOffset, Len: addrLen},
+		&expr.Payload{DestRegister: portReg, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2},
+		&expr.Hash{
+			SourceRegister: nftReg32First,
+			DestRegister:   1,
+			Length:         (portReg-nftReg32First)*4 + 2,
+			Modulus:        maglevTableSize,
+			Type:           expr.HashTypeJenkins,
+		},
+		&expr.Lookup{SourceRegister: 1, SetName: slots.Name, SetID: slots.ID},
+		&expr.Counter{},
+		&expr.Lookup{SourceRegister: 1, DestRegister: nftReg32First, IsDestRegSet: true, SetName: set.Name, SetID: set.ID},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      uint32(family),
+			RegAddrMin:  nftReg32First,
+			RegProtoMin: portReg,
+		},
+	}
+}
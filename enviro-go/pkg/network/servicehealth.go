@@ -0,0 +1,160 @@
+package network
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// serviceHealthTick is how often health checks that are due run, which
+// bounds how often a backend is checked
+const serviceHealthTick = time.Second
+
+// backendCheck is a backend checked by the health check of a service port
+type backendCheck struct {
+	servicePort
+	ContainerID string
+}
+
+// backendHealth is the outcome of the health checks of a backend so far
+type backendHealth struct {
+	checkedAt time.Time
+	// failures counts the checks failed in a row
+	failures int
+	failing  bool
+}
+
+// failingHealthCheck reports whether backend containerID fails the health
+// check of port of service. Callers must hold nm.mu.
+func (nm *NetworkManager) failingHealthCheck(service, port, containerID string) bool {
+	h, ok := nm.backendHealth[backendCheck{servicePort{service, port}, containerID}]
+	return ok && h.failing
+}
+
+// startServiceHealth checks the backends of service ports with health
+// checks until stopServiceHealth
+func (nm *NetworkManager) startServiceHealth() {
+	nm.healthStop = make(chan struct{})
+	nm.healthDone = make(chan struct{})
+	go func() {
+		defer close(nm.healthDone)
+		ticker := time.NewTicker(serviceHealthTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				nm.checkServiceHealth(now)
+			case <-nm.healthStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopServiceHealth waits for the checker started by startServiceHealth
+// to end
+func (nm *NetworkManager) stopServiceHealth() {
+	if nm.healthStop == nil {
+		return
+	}
+	close(nm.healthStop)
+	<-nm.healthDone
+	nm.healthStop = nil
+}
+
+// checkServiceHealth connects to the backends whose health check is due
+// at now, all at once, and reprograms the services when a backend starts
+// or stops failing. The outcomes of backends no longer checked are
+// forgotten.
+func (nm *NetworkManager) checkServiceHealth(now time.Time) {
+	type check struct {
+		key       backendCheck
+		addr      netip.AddrPort
+		timeout   time.Duration
+		threshold int
+		err       error
+	}
+	var due []check
+	nm.mu.Lock()
+	checked := make(map[backendCheck]bool)
+	for _, s := range nm.services {
+		for _, p := range s.Ports {
+			hc := p.HealthCheck
+			if hc == nil {
+				continue
+			}
+			for _, b := range nm.resolveBackends(s, p) {
+				key := backendCheck{servicePort{s.Name, p.Name}, b.ContainerID}
+				checked[key] = true
+				if h, ok := nm.backendHealth[key]; ok && now.Sub(h.checkedAt) < hc.Interval {
+					continue
+				}
+				port := hc.Port
+				if port == 0 {
+					port = b.Port
+				}
+				due = append(due, check{key: key, addr: netip.AddrPortFrom(b.Addr, port), timeout: hc.Timeout, threshold: hc.Threshold})
+			}
+		}
+	}
+	for key := range nm.backendHealth {
+		if !checked[key] {
+			delete(nm.backendHealth, key)
+		}
+	}
+	nm.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := range due {
+		wg.Add(1)
+		go func(c *check) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", c.addr.String(), c.timeout)
+			if err == nil {
+				conn.Close()
+			}
+			c.err = err
+		}(&due[i])
+	}
+	wg.Wait()
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	changed := false
+	for _, c := range due {
+		if _, ok := nm.services[c.key.Service]; !ok {
+			continue
+		}
+		h, ok := nm.backendHealth[c.key]
+		if !ok {
+			h = &backendHealth{}
+			nm.backendHealth[c.key] = h
+		}
+		h.checkedAt = now
+		if c.err == nil {
+			h.failures = 0
+		} else {
+			h.failures++
+		}
+		if failing := h.failures >= c.threshold; failing != h.failing {
+			h.failing = failing
+			changed = true
+			if failing {
+				nm.log.Warn("Service backend failing health check", "service", c.key.Service, "port", c.key.Port,
+					"container_id", c.key.ContainerID, "address", c.addr, "error", c.err)
+			} else {
+				nm.log.Info("Service backend passing health check", "service", c.key.Service, "port", c.key.Port,
+					"container_id", c.key.ContainerID, "address", c.addr)
+			}
+		}
+	}
+	if changed {
+		if err := nm.syncServices(); err != nil {
+			nm.log.Error("Failed to program service health", "error", err)
+		}
+	}
+}
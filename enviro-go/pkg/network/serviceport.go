@@ -0,0 +1,222 @@
+package network
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// maxServicePorts bounds the ports of a service, each of which gets its
+// own rules and maps
+const maxServicePorts = 32
+
+// Defaults of ServiceHealthCheck
+const (
+	DefaultHealthCheckInterval  = 5 * time.Second
+	DefaultHealthCheckTimeout   = time.Second
+	DefaultHealthCheckThreshold = 3
+)
+
+// ServicePort is a port of a service, translated to TargetPort of its
+// backends
+type ServicePort struct {
+	// Name tells the ports of a service apart, in SRV records, backend
+	// ports and connection counts. It is a DNS label, required of
+	// services with several ports.
+	Name string `json:"name,omitempty"`
+	Port uint16 `json:"port"`
+	// Protocol is "tcp" (the default) or "udp"
+	Protocol string `json:"protocol"`
+	// TargetPort is the port of the backends, Port when zero
+	TargetPort uint16 `json:"target_port"`
+	// NodePort is the port on every node of services exposed on node
+	// ports, see Service.ExposeNodePort
+	NodePort uint16 `json:"node_port,omitempty"`
+	// HealthCheck has the backends checked on the port, when set
+	HealthCheck *ServiceHealthCheck `json:"health_check,omitempty"`
+}
+
+// ServiceHealthCheck checks the backends of a service port by connecting
+// to them over TCP. Backends failing Threshold checks in a row only get
+// connections while no backend of the port passes, until they pass one.
+type ServiceHealthCheck struct {
+	// Port is the TCP port of the backends connected to, the target port
+	// of each when zero. Checks of UDP ports need one.
+	Port uint16 `json:"port,omitempty"`
+	// Interval is DefaultHealthCheckInterval when zero
+	Interval time.Duration `json:"interval,omitempty"`
+	// Timeout is DefaultHealthCheckTimeout when zero
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Threshold is DefaultHealthCheckThreshold when zero
+	Threshold int `json:"threshold,omitempty"`
+}
+
+// BackendPort overrides the target port of a service port for a single
+// backend, e.g. while a deployment moves to another port
+type BackendPort struct {
+	ContainerID string `json:"container_id"`
+	// Port is the name of the service port
+	Port       string `json:"port"`
+	TargetPort uint16 `json:"target_port"`
+}
+
+// ServicePorts returns the ports of s with their defaults, the one of
+// Port, Protocol, TargetPort and NodePort when s has no Ports
+func (s Service) ServicePorts() []ServicePort {
+	ports := slices.Clone(s.Ports)
+	if len(ports) == 0 {
+		ports = []ServicePort{{Port: s.Port, Protocol: s.Protocol, TargetPort: s.TargetPort, NodePort: s.NodePort}}
+	}
+	for i := range ports {
+		p := &ports[i]
+		if p.Protocol == "" {
+			p.Protocol = "tcp"
+		}
+		if p.TargetPort == 0 {
+			p.TargetPort = p.Port
+		}
+		if p.HealthCheck != nil {
+			hc := *p.HealthCheck
+			if hc.Interval == 0 {
+				hc.Interval = DefaultHealthCheckInterval
+			}
+			if hc.Timeout == 0 {
+				hc.Timeout = DefaultHealthCheckTimeout
+			}
+			if hc.Threshold == 0 {
+				hc.Threshold = DefaultHealthCheckThreshold
+			}
+			p.HealthCheck = &hc
+		}
+	}
+	return ports
+}
+
+// String formats p as name:port->target/protocol, leaving out the name
+// and target port when there are none
+func (p ServicePort) String() string {
+	s := fmt.Sprint(p.Port)
+	if p.Name != "" {
+		s = p.Name + ":" + s
+	}
+	if p.TargetPort != 0 && p.TargetPort != p.Port {
+		s += fmt.Sprintf("->%d", p.TargetPort)
+	}
+	return s + "/" + p.Protocol
+}
+
+// portStrings formats ports for logs
+func portStrings(ports []ServicePort) []string {
+	out := make([]string, len(ports))
+	for i, p := range ports {
+		out[i] = p.String()
+	}
+	return out
+}
+
+// setFirstPort sets the Port, Protocol, TargetPort and NodePort of s to
+// those of its first port
+func (s *Service) setFirstPort() {
+	first := s.Ports[0]
+	s.Port, s.Protocol, s.TargetPort, s.NodePort = first.Port, first.Protocol, first.TargetPort, first.NodePort
+}
+
+// validatePorts checks the ports of s and its backend ports
+func (s Service) validatePorts() error {
+	if len(s.Ports) > maxServicePorts {
+		return fmt.Errorf("%w: service %s has more than %d ports", ErrInvalidService, s.Name, maxServicePorts)
+	}
+	names := make(map[string]bool)
+	for _, p := range s.Ports {
+		if p.Name == "" && len(s.Ports) > 1 {
+			return fmt.Errorf("%w: service %s: port %d needs a name", ErrInvalidService, s.Name, p.Port)
+		}
+		if p.Name != "" {
+			if err := ValidateName(p.Name); err != nil {
+				return fmt.Errorf("%w: service %s: port %v", ErrInvalidService, s.Name, err)
+			}
+		}
+		if names[p.Name] {
+			return fmt.Errorf("%w: service %s has two ports named %q", ErrInvalidService, s.Name, p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	ports := s.ServicePorts()
+	for i, p := range ports {
+		if p.Port == 0 {
+			return fmt.Errorf("%w: service %s: port is required", ErrInvalidService, s.Name)
+		}
+		if p.Protocol != "tcp" && p.Protocol != "udp" {
+			return fmt.Errorf("%w: service %s has unsupported protocol %q", ErrInvalidService, s.Name, p.Protocol)
+		}
+		for _, other := range ports[:i] {
+			if other.Port == p.Port && other.Protocol == p.Protocol {
+				return fmt.Errorf("%w: service %s lists port %d/%s twice", ErrInvalidService, s.Name, p.Port, p.Protocol)
+			}
+			if p.NodePort != 0 && other.NodePort == p.NodePort && other.Protocol == p.Protocol {
+				return fmt.Errorf("%w: service %s lists node port %d/%s twice", ErrInvalidService, s.Name, p.NodePort, p.Protocol)
+			}
+		}
+		if p.NodePort != 0 && !s.ExposeNodePort {
+			return fmt.Errorf("%w: service %s has a node port without exposing it", ErrInvalidService, s.Name)
+		}
+		if hc := p.HealthCheck; hc != nil {
+			if p.Protocol == "udp" && hc.Port == 0 {
+				return fmt.Errorf("%w: service %s: health check of UDP port %d needs a TCP port", ErrInvalidService, s.Name, p.Port)
+			}
+			if hc.Interval < 0 || hc.Timeout < 0 || hc.Threshold < 0 {
+				return fmt.Errorf("%w: service %s: health check of port %d must not be negative", ErrInvalidService, s.Name, p.Port)
+			}
+		}
+	}
+
+	type backendPort struct{ id, port string }
+	seen := make(map[backendPort]bool, len(s.BackendPorts))
+	for _, bp := range s.BackendPorts {
+		if bp.ContainerID == "" || bp.TargetPort == 0 {
+			return fmt.Errorf("%w: service %s has a backend port without a container ID or target port", ErrInvalidService, s.Name)
+		}
+		if !slices.ContainsFunc(ports, func(p ServicePort) bool { return p.Name == bp.Port }) {
+			return fmt.Errorf("%w: service %s has no port %q for backend %s", ErrInvalidService, s.Name, bp.Port, bp.ContainerID)
+		}
+		key := backendPort{bp.ContainerID, bp.Port}
+		if seen[key] {
+			return fmt.Errorf("%w: service %s overrides port %q of backend %s twice", ErrInvalidService, s.Name, bp.Port, bp.ContainerID)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// sortBackendPorts orders backend ports by container and port
+func sortBackendPorts(ports []BackendPort) {
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].ContainerID != ports[j].ContainerID {
+			return ports[i].ContainerID < ports[j].ContainerID
+		}
+		return ports[i].Port < ports[j].Port
+	})
+}
+
+// targetPort returns the port of backend containerID that p of s is
+// translated to
+func (s Service) targetPort(containerID string, p ServicePort) uint16 {
+	for _, bp := range s.BackendPorts {
+		if bp.ContainerID == containerID && bp.Port == p.Name {
+			return bp.TargetPort
+		}
+	}
+	return p.TargetPort
+}
+
+// withoutNodePorts returns s with its node ports cleared
+func (s Service) withoutNodePorts() Service {
+	s.Ports = slices.Clone(s.Ports)
+	for i := range s.Ports {
+		s.Ports[i].NodePort = 0
+	}
+	s.NodePort = 0
+	return s
+}
@@ -0,0 +1,143 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+)
+
+// servicePortsTestEnv has a child of TestServicePorts run the test in the
+// network namespace of its own it was started in
+const servicePortsTestEnv = "ENVIRO_TEST_SERVICE_PORTS"
+
+// TestServicePorts programs a service with a TCP and a UDP port, one
+// backend of which listens on another target port, and checks the
+// translation of each port and their connection counts. It runs in a
+// child in a network namespace of its own, like TestServiceConnections.
+func TestServicePorts(t *testing.T) {
+	if os.Getenv(servicePortsTestEnv) != "" {
+		runServicePorts(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating container networks needs root")
+	}
+	runInNetns(t, servicePortsTestEnv)
+}
+
+func runServicePorts(t *testing.T) {
+	ctx := context.Background()
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:   "10.99.0.0/24",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+	addrs := make(map[string]netip.Addr)
+	for _, id := range []string{"a", "b"} {
+		cn, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: id, NetnsPath: containerNetns(t)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[id] = netip.MustParseAddr(cn.IPv4)
+	}
+
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		t.Fatal(err)
+	}
+	vip, _ := netlink.ParseAddr("10.96.0.10/32")
+	if err := netlink.AddrAdd(lo, vip); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nm.CreateService(Service{
+		Name: "web", VIP: "10.96.0.10", Backends: []string{"a", "b"},
+		Ports: []ServicePort{
+			{Name: "http", Port: 80, TargetPort: 8080},
+			{Name: "dns", Port: 53, Protocol: "udp"},
+		},
+		BackendPorts: []BackendPort{{ContainerID: "b", Port: "http", TargetPort: 9090}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each port has a map to its target ports
+	conn := &nftables.Conn{}
+	table := &nftables.Table{Name: nftServiceTable, Family: nftables.TableFamilyINet}
+	tests := []struct {
+		set  string
+		want map[netip.Addr]uint16
+	}{
+		{set: "svc0_0", want: map[netip.Addr]uint16{addrs["a"]: 8080, addrs["b"]: 9090}},
+		{set: "svc0_1", want: map[netip.Addr]uint16{addrs["a"]: 53, addrs["b"]: 53}},
+	}
+	for _, tt := range tests {
+		elems, err := conn.GetSetElements(&nftables.Set{
+			Table:    table,
+			Name:     tt.set,
+			IsMap:    true,
+			KeyType:  nftables.TypeInteger,
+			DataType: nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeInetService),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(elems) != maglevTableSize {
+			t.Errorf("%s has %d slots, want %d", tt.set, len(elems), maglevTableSize)
+		}
+		for _, e := range elems {
+			addr, _ := netip.AddrFromSlice(e.Val[:4])
+			if port, ok := tt.want[addr]; !ok || binary.BigEndian.Uint16(e.Val[4:6]) != port {
+				t.Fatalf("%s maps to %s:%d, want one of %v", tt.set, addr, binary.BigEndian.Uint16(e.Val[4:6]), tt.want)
+			}
+		}
+	}
+
+	// Connections are counted by port, UDP ones by their first datagram
+	for i := 0; i < 4; i++ {
+		if c, err := net.DialTimeout("tcp", "10.96.0.10:80", 50*time.Millisecond); err == nil {
+			c.Close()
+		}
+	}
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("udp", "10.96.0.10:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("query"))
+		c.Close()
+	}
+	conns, err := nm.ServiceConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || len(conns[0].Ports) != 2 {
+		t.Fatalf("connections %+v, want those of the ports of web", conns)
+	}
+	for i, want := range []uint64{4, 3} {
+		p := conns[0].Ports[i]
+		if got := p.Connections[LocalityNode]; got != want {
+			t.Errorf("%d connections to port %s, want %d", got, p.Port.Name, want)
+		}
+	}
+	if got := conns[0].Connections[LocalityNode]; got != 7 {
+		t.Errorf("%d connections to web, want 7", got)
+	}
+}
@@ -0,0 +1,239 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServiceValidatePorts(t *testing.T) {
+	base := Service{Name: "web", VIP: "10.96.0.10", Backends: []string{"c1"}}
+	http := ServicePort{Name: "http", Port: 80, TargetPort: 8080}
+	dns := ServicePort{Name: "dns", Port: 53, Protocol: "udp"}
+	tests := []struct {
+		name    string
+		modify  func(*Service)
+		wantErr bool
+	}{
+		{name: "single port", modify: func(s *Service) { s.Port = 80 }},
+		{name: "ports", modify: func(s *Service) { s.Ports = []ServicePort{http, dns} }},
+		{name: "unnamed only port", modify: func(s *Service) { s.Ports = []ServicePort{{Port: 80}} }},
+		{name: "same port of each protocol", modify: func(s *Service) {
+			s.Ports = []ServicePort{{Name: "dns", Port: 53}, {Name: "dns-udp", Port: 53, Protocol: "udp"}}
+		}},
+		{name: "backend port", modify: func(s *Service) {
+			s.Ports = []ServicePort{http, dns}
+			s.BackendPorts = []BackendPort{{ContainerID: "c1", Port: "http", TargetPort: 9090}}
+		}},
+		{name: "health check", modify: func(s *Service) {
+			s.Ports = []ServicePort{{Name: "http", Port: 80, HealthCheck: &ServiceHealthCheck{Interval: time.Second}}}
+		}},
+		{name: "health check of UDP port", modify: func(s *Service) {
+			s.Ports = []ServicePort{{Name: "dns", Port: 53, Protocol: "udp", HealthCheck: &ServiceHealthCheck{Port: 8053}}}
+		}},
+		{name: "no port", modify: func(*Service) {}, wantErr: true},
+		{name: "port zero", modify: func(s *Service) { s.Ports = []ServicePort{{Name: "http"}} }, wantErr: true},
+		{name: "unnamed of several", modify: func(s *Service) { s.Ports = []ServicePort{http, {Port: 443}} }, wantErr: true},
+		{name: "invalid name", modify: func(s *Service) { s.Ports = []ServicePort{{Name: "h_ttp", Port: 80}} }, wantErr: true},
+		{name: "name twice", modify: func(s *Service) { s.Ports = []ServicePort{http, {Name: "http", Port: 443}} }, wantErr: true},
+		{name: "port twice", modify: func(s *Service) {
+			s.Ports = []ServicePort{http, {Name: "alt", Port: 80, Protocol: "tcp"}}
+		}, wantErr: true},
+		{name: "unsupported protocol", modify: func(s *Service) { s.Ports = []ServicePort{{Port: 80, Protocol: "sctp"}} }, wantErr: true},
+		{name: "too many ports", modify: func(s *Service) {
+			for i := 0; i <= maxServicePorts; i++ {
+				s.Ports = append(s.Ports, ServicePort{Name: string(rune('a'+i%26)) + string(rune('a'+i/26)), Port: uint16(i + 1)})
+			}
+		}, wantErr: true},
+		{name: "node port not exposed", modify: func(s *Service) { s.Ports = []ServicePort{{Port: 80, NodePort: 30080}} }, wantErr: true},
+		{name: "node port twice", modify: func(s *Service) {
+			s.ExposeNodePort = true
+			s.Ports = []ServicePort{{Name: "a", Port: 80, NodePort: 30080}, {Name: "b", Port: 81, NodePort: 30080}}
+		}, wantErr: true},
+		{name: "health check of UDP port without TCP port", modify: func(s *Service) {
+			s.Ports = []ServicePort{{Name: "dns", Port: 53, Protocol: "udp", HealthCheck: &ServiceHealthCheck{}}}
+		}, wantErr: true},
+		{name: "negative health check", modify: func(s *Service) {
+			s.Ports = []ServicePort{{Port: 80, HealthCheck: &ServiceHealthCheck{Threshold: -1}}}
+		}, wantErr: true},
+		{name: "backend port of unknown port", modify: func(s *Service) {
+			s.Ports = []ServicePort{http}
+			s.BackendPorts = []BackendPort{{ContainerID: "c1", Port: "https", TargetPort: 9443}}
+		}, wantErr: true},
+		{name: "backend port twice", modify: func(s *Service) {
+			s.Ports = []ServicePort{http}
+			s.BackendPorts = []BackendPort{{ContainerID: "c1", Port: "http", TargetPort: 9090}, {ContainerID: "c1", Port: "http", TargetPort: 9091}}
+		}, wantErr: true},
+		{name: "backend port without target", modify: func(s *Service) {
+			s.Ports = []ServicePort{http}
+			s.BackendPorts = []BackendPort{{ContainerID: "c1", Port: "http"}}
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := base
+			tt.modify(&s)
+			err := s.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidService) {
+				t.Errorf("Validate() = %v, want ErrInvalidService", err)
+			}
+		})
+	}
+}
+
+func TestServiceWithDefaultsPorts(t *testing.T) {
+	tests := []struct {
+		name      string
+		service   Service
+		wantPorts []ServicePort
+	}{
+		{
+			name:      "single port",
+			service:   Service{Port: 53, Protocol: "udp"},
+			wantPorts: []ServicePort{{Port: 53, Protocol: "udp", TargetPort: 53}},
+		},
+		{
+			name: "ports",
+			service: Service{Port: 1, Protocol: "udp", Ports: []ServicePort{
+				{Name: "https", Port: 443, TargetPort: 8443},
+				{Name: "http", Port: 80},
+			}},
+			wantPorts: []ServicePort{
+				{Name: "https", Port: 443, Protocol: "tcp", TargetPort: 8443},
+				{Name: "http", Port: 80, Protocol: "tcp", TargetPort: 80},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.service.withDefaults()
+			if !slices.Equal(s.Ports, tt.wantPorts) {
+				t.Errorf("ports %+v, want %+v", s.Ports, tt.wantPorts)
+			}
+			first := tt.wantPorts[0]
+			if s.Port != first.Port || s.Protocol != first.Protocol || s.TargetPort != first.TargetPort {
+				t.Errorf("first port %d/%s->%d, want %s", s.Port, s.Protocol, s.TargetPort, first)
+			}
+		})
+	}
+
+	hc := Service{Ports: []ServicePort{{Port: 80, HealthCheck: &ServiceHealthCheck{Timeout: 2 * time.Second}}}}.withDefaults().Ports[0].HealthCheck
+	want := ServiceHealthCheck{Interval: DefaultHealthCheckInterval, Timeout: 2 * time.Second, Threshold: DefaultHealthCheckThreshold}
+	if *hc != want {
+		t.Errorf("health check %+v, want %+v", *hc, want)
+	}
+}
+
+func TestServiceTargetPort(t *testing.T) {
+	s := Service{
+		Ports:        []ServicePort{{Name: "http", Port: 80, TargetPort: 8080}, {Name: "admin", Port: 81, TargetPort: 8081}},
+		BackendPorts: []BackendPort{{ContainerID: "c2", Port: "http", TargetPort: 9090}},
+	}
+	tests := []struct {
+		id   string
+		port int
+		want uint16
+	}{
+		{id: "c1", port: 0, want: 8080},
+		{id: "c2", port: 0, want: 9090},
+		{id: "c2", port: 1, want: 8081},
+	}
+	for _, tt := range tests {
+		if got := s.targetPort(tt.id, s.Ports[tt.port]); got != tt.want {
+			t.Errorf("targetPort(%s, %s) = %d, want %d", tt.id, s.Ports[tt.port].Name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckServiceHealth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	up := uint16(l.Addr().(*net.TCPAddr).Port)
+	// Nothing listens on a port just closed
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := uint16(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+
+	check := &ServiceHealthCheck{Interval: time.Second, Timeout: time.Second, Threshold: 2}
+	s := Service{
+		Name: "web", VIP: "10.96.0.10",
+		Ports: []ServicePort{
+			{Name: "http", Port: 80, TargetPort: up, HealthCheck: check},
+			{Name: "dns", Port: 53, Protocol: "udp", HealthCheck: &ServiceHealthCheck{Port: down, Interval: time.Second, Timeout: time.Second, Threshold: 2}},
+		},
+		RemoteBackends: []RemoteBackend{{ContainerID: "up", IPv4: "127.0.0.1"}, {ContainerID: "down", IPv4: "127.0.0.1"}},
+		BackendPorts:   []BackendPort{{ContainerID: "down", Port: "http", TargetPort: down}},
+	}.withDefaults()
+	nm := &NetworkManager{
+		rootless:      true,
+		log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		services:      map[string]Service{"web": s},
+		backendHealth: make(map[backendCheck]*backendHealth),
+	}
+	failing := func() []string {
+		var out []string
+		for _, p := range s.Ports {
+			for _, id := range []string{"down", "up"} {
+				if nm.failingHealthCheck("web", p.Name, id) {
+					out = append(out, p.Name+"/"+id)
+				}
+			}
+		}
+		return out
+	}
+
+	start := time.Now()
+	steps := []struct {
+		name string
+		at   time.Duration
+		want []string
+	}{
+		{name: "first failure", at: 0},
+		{name: "not due yet", at: 500 * time.Millisecond},
+		{name: "threshold", at: time.Second, want: []string{"http/down", "dns/down", "dns/up"}},
+	}
+	for _, step := range steps {
+		nm.checkServiceHealth(start.Add(step.at))
+		if got := failing(); !slices.Equal(got, step.want) {
+			t.Errorf("%s: failing %v, want %v", step.name, got, step.want)
+		}
+	}
+	if got := nm.serviceBackends(s, s.Ports[0]); len(got) != 1 || got[0].ContainerID != "up" {
+		t.Errorf("backends of http %+v, want up only", got)
+	}
+
+	// Backends that pass a check recover, and those no longer checked are
+	// forgotten
+	s.BackendPorts = nil
+	s.Ports = s.Ports[:1]
+	nm.services["web"] = s
+	nm.checkServiceHealth(start.Add(2 * time.Second))
+	if got := failing(); len(got) != 0 {
+		t.Errorf("failing %v after recovering", got)
+	}
+	if len(nm.backendHealth) != 2 {
+		t.Errorf("%d backends checked, want those of http", len(nm.backendHealth))
+	}
+}
@@ -0,0 +1,180 @@
+package network
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SetupStage is a stage of creating a container network, see SetupTiming
+type SetupStage string
+
+const (
+	// SetupAllocation allocates the addresses, SNAT ports and devices
+	SetupAllocation SetupStage = "allocation"
+	// SetupNetlink creates the links and configures their host side
+	SetupNetlink SetupStage = "netlink"
+	// SetupNetns configures the interface in the container's namespace
+	SetupNetns SetupStage = "netns"
+	// SetupMaps programs the datapath: the eBPF maps, cgroup programs and
+	// the rules of the kernel path
+	SetupMaps SetupStage = "maps"
+	// SetupState records the network in the state store
+	SetupState SetupStage = "state"
+)
+
+// SetupStages are the stages of creating a container network in the
+// order they begin
+var SetupStages = []SetupStage{SetupAllocation, SetupState, SetupNetlink, SetupNetns, SetupMaps}
+
+// stepStages are the stages of the steps of creating a container network.
+// Steps missing only count toward the total.
+var stepStages = map[string]SetupStage{
+	"take warm attachment":          SetupAllocation,
+	"allocate addresses":            SetupAllocation,
+	"allocate SNAT ports":           SetupAllocation,
+	"reserve addresses":             SetupAllocation,
+	"claim virtual function":        SetupAllocation,
+	"record intent":                 SetupState,
+	"commit":                        SetupState,
+	"create veth":                   SetupNetlink,
+	"claim warm attachment":         SetupNetlink,
+	"configure host interface":      SetupNetlink,
+	"move virtual function":         SetupNetlink,
+	"create macvlan":                SetupNetlink,
+	"limit bandwidth":               SetupNetlink,
+	"start slirp4netns":             SetupNetns,
+	"configure container interface": SetupNetns,
+	"program datapath":              SetupMaps,
+	"check sources":                 SetupMaps,
+	"attach cgroup programs":        SetupMaps,
+	"proxy neighbor discovery":      SetupMaps,
+	"masquerade":                    SetupMaps,
+}
+
+// SetupTiming is how long creating a container network took
+type SetupTiming struct {
+	// Total is from the call of CreateContainerNetwork to its return,
+	// including waiting for other changes to the network to finish
+	Total time.Duration
+	// Stages is the time spent in each stage, retries included
+	Stages map[SetupStage]time.Duration
+	// Warm is true when the container took a warm attachment, see
+	// WarmPoolConfig
+	Warm bool
+}
+
+func newSetupTiming() *SetupTiming {
+	return &SetupTiming{Stages: make(map[SetupStage]time.Duration, len(SetupStages))}
+}
+
+// add counts the time since start toward stage
+func (t *SetupTiming) add(stage SetupStage, start time.Time) {
+	t.Stages[stage] += time.Since(start)
+}
+
+// SetupWindow is the number of the most recent creates the quantiles of
+// SetupLatency cover
+const SetupWindow = 1024
+
+// SetupLatency is how long creating container networks took, in total and
+// by stage
+type SetupLatency struct {
+	// Samples is the number of creates the quantiles cover, up to
+	// SetupWindow
+	Samples int
+	Total   SetupQuantiles
+	Stages  map[SetupStage]SetupQuantiles
+	// TotalHistogram and StageHistograms count every create since the
+	// manager was created, in Packets
+	TotalHistogram  LatencyHistogram
+	StageHistograms map[SetupStage]LatencyHistogram
+}
+
+// SetupQuantiles are exact quantiles of the latency of the most recent
+// creates
+type SetupQuantiles struct {
+	P50, P95, P99 time.Duration
+}
+
+// setupRecorder keeps the timings of the creates for SetupLatency
+type setupRecorder struct {
+	mu     sync.Mutex
+	total  LatencyHistogram
+	stages map[SetupStage]LatencyHistogram
+	// recent is a ring of the last SetupWindow timings, next the index
+	// the next one is recorded at once it is full
+	recent []SetupTiming
+	next   int
+}
+
+func newSetupRecorder() *setupRecorder {
+	return &setupRecorder{stages: make(map[SetupStage]LatencyHistogram, len(SetupStages))}
+}
+
+// record adds the timing of a create
+func (r *setupRecorder) record(t SetupTiming) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.total.observe(t.Total)
+	for _, stage := range SetupStages {
+		h := r.stages[stage]
+		h.observe(t.Stages[stage])
+		r.stages[stage] = h
+	}
+	if len(r.recent) < SetupWindow {
+		r.recent = append(r.recent, t)
+		return
+	}
+	r.recent[r.next] = t
+	r.next = (r.next + 1) % SetupWindow
+}
+
+// latency summarizes the recorded timings
+func (r *setupRecorder) latency() SetupLatency {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := SetupLatency{
+		Samples:         len(r.recent),
+		Stages:          make(map[SetupStage]SetupQuantiles, len(SetupStages)),
+		TotalHistogram:  r.total,
+		StageHistograms: make(map[SetupStage]LatencyHistogram, len(SetupStages)),
+	}
+	samples := make([]time.Duration, len(r.recent))
+	for i, t := range r.recent {
+		samples[i] = t.Total
+	}
+	out.Total = quantiles(samples)
+	for _, stage := range SetupStages {
+		for i, t := range r.recent {
+			samples[i] = t.Stages[stage]
+		}
+		out.Stages[stage] = quantiles(samples)
+		out.StageHistograms[stage] = r.stages[stage]
+	}
+	return out
+}
+
+// quantiles returns the nearest-rank quantiles of samples, which it sorts
+func quantiles(samples []time.Duration) SetupQuantiles {
+	if len(samples) == 0 {
+		return SetupQuantiles{}
+	}
+	slices.Sort(samples)
+	rank := func(q float64) time.Duration {
+		i := int(math.Ceil(q*float64(len(samples)))) - 1
+		return samples[max(i, 0)]
+	}
+	return SetupQuantiles{P50: rank(0.50), P95: rank(0.95), P99: rank(0.99)}
+}
+
+// SetupLatency returns how long creating container networks took: exact
+// quantiles over the last SetupWindow creates, against an SLO such as
+// "ready in under 20ms at p99", and histograms since the manager was
+// created. Failed creates aren't counted.
+func (nm *NetworkManager) SetupLatency() SetupLatency {
+	return nm.setups.latency()
+}
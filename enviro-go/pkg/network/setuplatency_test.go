@@ -0,0 +1,77 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuantiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		want    SetupQuantiles
+	}{
+		{name: "none"},
+		{name: "one", samples: []time.Duration{5}, want: SetupQuantiles{P50: 5, P95: 5, P99: 5}},
+		{name: "unsorted", samples: []time.Duration{4, 1, 3, 2}, want: SetupQuantiles{P50: 2, P95: 4, P99: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quantiles(tt.samples); got != tt.want {
+				t.Errorf("quantiles() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// 1..100: the nearest rank of q is 100q
+	samples := make([]time.Duration, 100)
+	for i := range samples {
+		samples[i] = time.Duration(100 - i)
+	}
+	if got, want := quantiles(samples), (SetupQuantiles{P50: 50, P95: 95, P99: 99}); got != want {
+		t.Errorf("quantiles() of 1..100 = %+v, want %+v", got, want)
+	}
+}
+
+// TestSetupRecorderWindow records more than SetupWindow creates, checking
+// that the quantiles only cover the most recent and the histograms all
+func TestSetupRecorderWindow(t *testing.T) {
+	r := newSetupRecorder()
+	record := func(total time.Duration) {
+		timing := newSetupTiming()
+		timing.Total = total
+		timing.Stages[SetupNetlink] = total / 2
+		r.record(*timing)
+	}
+	// Slow creates, then a window of fast ones pushing them out
+	for i := 0; i < 10; i++ {
+		record(time.Second)
+	}
+	for i := 0; i < SetupWindow; i++ {
+		record(time.Millisecond)
+	}
+
+	l := r.latency()
+	if l.Samples != SetupWindow {
+		t.Errorf("Samples = %d, want %d", l.Samples, SetupWindow)
+	}
+	if want := (SetupQuantiles{P50: time.Millisecond, P95: time.Millisecond, P99: time.Millisecond}); l.Total != want {
+		t.Errorf("Total = %+v, want %+v", l.Total, want)
+	}
+	if got, want := l.Stages[SetupNetlink].P99, time.Millisecond/2; got != want {
+		t.Errorf("netlink p99 = %v, want %v", got, want)
+	}
+	if got := l.Stages[SetupMaps]; got != (SetupQuantiles{}) {
+		t.Errorf("maps = %+v, want zero", got)
+	}
+	if got, want := l.TotalHistogram.Packets, uint64(SetupWindow+10); got != want {
+		t.Errorf("TotalHistogram counts %d creates, want %d", got, want)
+	}
+	// The slow creates are still in the histogram, ~2^30ns
+	if got := l.TotalHistogram.Buckets[29]; got != 10 {
+		t.Errorf("TotalHistogram has %d creates of about 1s, want 10", got)
+	}
+	if got := l.StageHistograms[SetupNetlink].Packets; got != uint64(SetupWindow+10) {
+		t.Errorf("netlink histogram counts %d creates, want %d", got, SetupWindow+10)
+	}
+}
@@ -0,0 +1,300 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrSNATExhausted is returned when creating a container while every
+// SNAT port slice is taken
+var ErrSNATExhausted = errors.New("network: SNAT port slices exhausted")
+
+// ErrSNATPortNotFound is returned when looking up a port outside every
+// allocated SNAT port slice
+var ErrSNATPortNotFound = errors.New("network: SNAT port not allocated")
+
+// Defaults of SNATConfig, the kernel's default ip_local_port_range
+const (
+	DefaultSNATPortMin = 32768
+	DefaultSNATPortMax = 60999
+)
+
+// SNATConfig masquerades traffic from containers to destinations outside
+// the container networks behind the address of the interface it leaves
+// through. Traffic between containers, including over the overlay, keeps
+// its source address.
+//
+// By default every container shares the whole port range, so a source
+// port seen outside the node could belong to any container. With
+// SliceSize set, each container gets a slice of the range of its own
+// instead, so the source port alone names the container, see
+// SNATMapping. The trade-off is capacity: a container can only have
+// SliceSize concurrent TCP or UDP flows to one destination address and
+// port, rather than the whole range, and the node can only run as many
+// containers as there are slices, creates failing with ErrSNATExhausted
+// beyond that. Protocols without ports, e.g. ICMP, are masqueraded
+// without a slice.
+type SNATConfig struct {
+	// Enable masquerades traffic leaving the container networks
+	Enable bool `json:"enable"`
+	// PortMin and PortMax bound the source ports of masqueraded flows,
+	// DefaultSNATPortMin and DefaultSNATPortMax when zero. The range
+	// should not overlap the host's ip_local_port_range, or connections
+	// of the host may collide with those of containers.
+	PortMin uint16 `json:"port_min"`
+	PortMax uint16 `json:"port_max"`
+	// SliceSize partitions the range into slices of this many ports, one
+	// per container, when set. Ports beyond the last whole slice are left
+	// unused.
+	SliceSize uint16 `json:"slice_size"`
+}
+
+// withDefaults fills in the port range
+func (c SNATConfig) withDefaults() SNATConfig {
+	if c.PortMin == 0 {
+		c.PortMin = DefaultSNATPortMin
+	}
+	if c.PortMax == 0 {
+		c.PortMax = DefaultSNATPortMax
+	}
+	return c
+}
+
+// validate checks the range holds at least one slice
+func (c SNATConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+	c = c.withDefaults()
+	if c.PortMin < 1024 {
+		return fmt.Errorf("%w: SNAT ports start at %d, below 1024", ErrInvalidConfig, c.PortMin)
+	}
+	if c.PortMin > c.PortMax {
+		return fmt.Errorf("%w: SNAT port range %d-%d is empty", ErrInvalidConfig, c.PortMin, c.PortMax)
+	}
+	if int(c.SliceSize) > c.ports() {
+		return fmt.Errorf("%w: SNAT slices of %d ports don't fit the range %d-%d", ErrInvalidConfig, c.SliceSize, c.PortMin, c.PortMax)
+	}
+	return nil
+}
+
+// ports returns the number of ports in the range
+func (c SNATConfig) ports() int {
+	return int(c.PortMax) - int(c.PortMin) + 1
+}
+
+// slices returns the number of slices of the range, 0 without slicing
+func (c SNATConfig) slices() int {
+	if c.SliceSize == 0 {
+		return 0
+	}
+	return c.ports() / int(c.SliceSize)
+}
+
+// slice returns the ports of slice i
+func (c SNATConfig) slice(i int) PortRange {
+	first := int(c.PortMin) + i*int(c.SliceSize)
+	return PortRange{Min: uint16(first), Max: uint16(first + int(c.SliceSize) - 1)}
+}
+
+// sliceOf returns the index of the slice r is, or false when r is not one
+func (c SNATConfig) sliceOf(r PortRange) (int, bool) {
+	if c.SliceSize == 0 || r.Min < c.PortMin {
+		return 0, false
+	}
+	i := int(r.Min-c.PortMin) / int(c.SliceSize)
+	return i, i < c.slices() && c.slice(i) == r
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Min uint16 `json:"min"`
+	Max uint16 `json:"max"`
+}
+
+// Contains reports whether port is in r
+func (r PortRange) Contains(port uint16) bool {
+	return r.Min <= port && port <= r.Max
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// SNATSlice is the slice of the SNAT port range of a container
+type SNATSlice struct {
+	ContainerID string    `json:"container_id"`
+	Ports       PortRange `json:"ports"`
+}
+
+// snatAllocator hands out the SNAT port slices. Released slices are
+// reused last, so a port recently seen outside the node keeps naming the
+// container that had it for as long as possible.
+type snatAllocator struct {
+	config SNATConfig
+	// owners holds the container of each slice, "" when free
+	owners []string
+	// next is where the search for a free slice starts
+	next int
+}
+
+func newSNATAllocator(config SNATConfig) *snatAllocator {
+	return &snatAllocator{config: config, owners: make([]string, config.slices())}
+}
+
+// allocate gives containerID a slice, the one it has on a retry
+func (a *snatAllocator) allocate(containerID string) (PortRange, error) {
+	for i, owner := range a.owners {
+		if owner == containerID {
+			return a.config.slice(i), nil
+		}
+	}
+	for n := range a.owners {
+		i := (a.next + n) % len(a.owners)
+		if a.owners[i] == "" {
+			a.owners[i] = containerID
+			a.next = (i + 1) % len(a.owners)
+			return a.config.slice(i), nil
+		}
+	}
+	return PortRange{}, fmt.Errorf("%w: all %d slices of %d ports are taken", ErrSNATExhausted, len(a.owners), a.config.SliceSize)
+}
+
+// claim gives containerID slice r again, failing when r is no slice of
+// the range or another container has it
+func (a *snatAllocator) claim(containerID string, r PortRange) error {
+	i, ok := a.config.sliceOf(r)
+	if !ok {
+		return fmt.Errorf("ports %s are no SNAT slice", r)
+	}
+	if owner := a.owners[i]; owner != "" && owner != containerID {
+		return fmt.Errorf("SNAT ports %s belong to %s", r, owner)
+	}
+	a.owners[i] = containerID
+	a.next = (i + 1) % len(a.owners)
+	return nil
+}
+
+// release frees the slice of containerID, if any
+func (a *snatAllocator) release(containerID string) {
+	for i, owner := range a.owners {
+		if owner == containerID {
+			a.owners[i] = ""
+		}
+	}
+}
+
+// lookup returns the slice containing port
+func (a *snatAllocator) lookup(port uint16) (SNATSlice, bool) {
+	if port < a.config.PortMin {
+		return SNATSlice{}, false
+	}
+	i := int(port-a.config.PortMin) / int(a.config.SliceSize)
+	if i >= len(a.owners) || a.owners[i] == "" {
+		return SNATSlice{}, false
+	}
+	return SNATSlice{ContainerID: a.owners[i], Ports: a.config.slice(i)}, true
+}
+
+// list returns the allocated slices by port
+func (a *snatAllocator) list() []SNATSlice {
+	var out []SNATSlice
+	for i, owner := range a.owners {
+		if owner != "" {
+			out = append(out, SNATSlice{ContainerID: owner, Ports: a.config.slice(i)})
+		}
+	}
+	return out
+}
+
+// snatSlicing reports whether containers get SNAT port slices
+func (nm *NetworkManager) snatSlicing() bool {
+	return nm.snat != nil
+}
+
+// allocateSNAT gives cn a SNAT port slice when slicing, counting the
+// containers that find none. Callers must hold nm.mu.
+func (nm *NetworkManager) allocateSNAT(cn *ContainerNetwork) error {
+	if !nm.snatSlicing() || cn.Rootless || cn.Attachment.direct() {
+		return nil
+	}
+	ports, err := nm.snat.allocate(cn.ContainerID)
+	if err != nil {
+		nm.snatExhausted.Add(1)
+		return err
+	}
+	cn.SNATPorts = &ports
+	return nil
+}
+
+// releaseSNAT frees the SNAT port slice of containerID. Callers must hold
+// nm.mu.
+func (nm *NetworkManager) releaseSNAT(containerID string) {
+	if nm.snatSlicing() {
+		nm.snat.release(containerID)
+	}
+}
+
+// restoreSNAT claims the slices of the re-adopted containers again and
+// allocates new ones to those whose slice no longer fits the range, e.g.
+// after SliceSize changed. Containers left without one keep running
+// unmasqueraded. Callers must hold nm.mu.
+func (nm *NetworkManager) restoreSNAT() {
+	if !nm.snatSlicing() {
+		for _, cn := range nm.containers {
+			cn.SNATPorts = nil
+		}
+		return
+	}
+	ids := make([]string, 0, len(nm.containers))
+	for id := range nm.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var moved []string
+	for _, id := range ids {
+		cn := nm.containers[id]
+		if cn.SNATPorts == nil {
+			moved = append(moved, id)
+			continue
+		}
+		if err := nm.snat.claim(id, *cn.SNATPorts); err != nil {
+			nm.log.Warn("Moving container to another SNAT port slice", "container_id", id, "error", err)
+			cn.SNATPorts = nil
+			moved = append(moved, id)
+		}
+	}
+	for _, id := range moved {
+		cn := nm.containers[id]
+		if err := nm.allocateSNAT(cn); err != nil {
+			nm.log.Warn("Container left without SNAT", "container_id", id, "error", err)
+		}
+	}
+}
+
+// SNATMapping returns the container whose SNAT port slice holds port, so
+// a flow seen outside the node can be traced back to its container. It
+// fails with ErrSNATPortNotFound when no container has the port,
+// including when SNATConfig.SliceSize is unset.
+func (nm *NetworkManager) SNATMapping(port uint16) (SNATSlice, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.snatSlicing() {
+		if slice, ok := nm.snat.lookup(port); ok {
+			return slice, nil
+		}
+	}
+	return SNATSlice{}, fmt.Errorf("%w: %d", ErrSNATPortNotFound, port)
+}
+
+// ListSNATSlices returns the allocated SNAT port slices ordered by port,
+// none unless SNATConfig.SliceSize is set
+func (nm *NetworkManager) ListSNATSlices() []SNATSlice {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if !nm.snatSlicing() {
+		return nil
+	}
+	return nm.snat.list()
+}
@@ -0,0 +1,130 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftSNATTable is the inet table holding the masquerade rules
+const nftSNATTable = "enviro-snat"
+
+// syncSNAT rebuilds the SNAT table in one atomic batch: each pool's
+// traffic to destinations outside it is masqueraded within the port
+// range, or each container's within its slice when slicing. Callers must
+// hold nm.mu.
+func (nm *NetworkManager) syncSNAT() error {
+	config := nm.config.SNAT
+	if nm.rootless || !config.Enable {
+		return nil
+	}
+
+	conn := &nftables.Conn{}
+	table := resetTable(conn, nm.nftTable(nftSNATTable), nftables.TableFamilyINet)
+	conn.AddTable(table)
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	add := func(exprs []expr.Any) {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	}
+
+	for _, pool := range nm.pools {
+		if !nm.snatSlicing() {
+			ports := PortRange{Min: config.PortMin, Max: config.PortMax}
+			for _, proto := range []byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+				add(snatExprs(pool.prefix, pool.prefix, proto, &ports))
+			}
+			add(snatExprs(pool.prefix, pool.prefix, 0, nil))
+			continue
+		}
+		for _, cn := range nm.containers {
+			if cn.SNATPorts == nil {
+				continue
+			}
+			for _, addr := range cn.addrs() {
+				if !pool.prefix.Contains(addr) {
+					continue
+				}
+				for _, proto := range []byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+					add(snatExprs(netip.PrefixFrom(addr, addr.BitLen()), pool.prefix, proto, cn.SNATPorts))
+				}
+			}
+		}
+		// Masquerading TCP and UDP without a slice would break the
+		// mapping, so containers without one only have the rest
+		add(snatExprs(pool.prefix, pool.prefix, 0, nil))
+	}
+	return conn.Flush()
+}
+
+// clearSNAT removes the SNAT table of an earlier run, for when SNAT was
+// since disabled
+func (nm *NetworkManager) clearSNAT() error {
+	conn := &nftables.Conn{}
+	resetTable(conn, nm.nftTable(nftSNATTable), nftables.TableFamilyINet)
+	return conn.Flush()
+}
+
+// snatExprs matches traffic from src to destinations outside pool with
+// proto, or any protocol but TCP and UDP when 0, and masquerades it to
+// ports when set:
+//
+//	meta nfproto ipv4 ip saddr 10.88.0.2 ip daddr != 10.88.0.0/16 meta l4proto tcp masquerade to :32768-32831
+//	meta nfproto ipv4 ip saddr 10.88.0.0/16 ip daddr != 10.88.0.0/16 meta l4proto != { tcp, udp } masquerade
+func snatExprs(src, pool netip.Prefix, proto byte, ports *PortRange) []expr.Any {
+	family, srcOffset, dstOffset := byte(unix.NFPROTO_IPV4), uint32(12), uint32(16)
+	if pool.Addr().Is6() {
+		family, srcOffset, dstOffset = unix.NFPROTO_IPV6, 8, 24
+	}
+	addrLen := uint32(pool.Addr().BitLen() / 8)
+	prefixExprs := func(offset uint32, p netip.Prefix, op expr.CmpOp) []expr.Any {
+		exprs := []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: addrLen},
+		}
+		if !p.IsSingleIP() {
+			exprs = append(exprs, &expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            addrLen,
+				Mask:           net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+				Xor:            make([]byte, addrLen),
+			})
+		}
+		return append(exprs, &expr.Cmp{Op: op, Register: 1, Data: p.Masked().Addr().AsSlice()})
+	}
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+	}
+	exprs = append(exprs, prefixExprs(srcOffset, src, expr.CmpOpEq)...)
+	exprs = append(exprs, prefixExprs(dstOffset, pool, expr.CmpOpNeq)...)
+	exprs = append(exprs, &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1})
+	if proto == 0 {
+		exprs = append(exprs,
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		)
+	} else {
+		exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}})
+	}
+	if ports == nil {
+		return append(exprs, &expr.Masq{})
+	}
+	return append(exprs,
+		&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(ports.Min)},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(ports.Max)},
+		&expr.Masq{ToPorts: true, RegProtoMin: 1, RegProtoMax: 2},
+	)
+}
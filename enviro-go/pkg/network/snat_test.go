@@ -0,0 +1,223 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+func TestSNATConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  SNATConfig
+		wantErr bool
+	}{
+		{name: "disabled", config: SNATConfig{PortMin: 1, PortMax: 0}},
+		{name: "defaults", config: SNATConfig{Enable: true}},
+		{name: "slices", config: SNATConfig{Enable: true, PortMin: 40000, PortMax: 40999, SliceSize: 100}},
+		{name: "one slice", config: SNATConfig{Enable: true, PortMin: 40000, PortMax: 40099, SliceSize: 100}},
+		{name: "privileged ports", config: SNATConfig{Enable: true, PortMin: 80}, wantErr: true},
+		{name: "empty range", config: SNATConfig{Enable: true, PortMin: 50000, PortMax: 40000}, wantErr: true},
+		{name: "slice too large", config: SNATConfig{Enable: true, PortMin: 40000, PortMax: 40098, SliceSize: 100}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validate() error = %v, want %v", err, ErrInvalidConfig)
+			}
+		})
+	}
+}
+
+// TestSNATAllocatorChurn creates and deletes containers against a range
+// of three slices, checking which slice each gets and that every port
+// maps back to its owner
+func TestSNATAllocatorChurn(t *testing.T) {
+	// 1000-1029 in slices of 10, and two ports left over
+	config := SNATConfig{Enable: true, PortMin: 1000, PortMax: 1031, SliceSize: 10}
+	type op struct {
+		// create, or else delete, id
+		create bool
+		id     string
+		// want is the slice created, or the error
+		want    PortRange
+		wantErr error
+	}
+	create := func(id string, first uint16) op {
+		return op{create: true, id: id, want: PortRange{Min: first, Max: first + 9}}
+	}
+	tests := []struct {
+		name string
+		ops  []op
+		// owners are the containers of the slices at the end
+		owners []string
+	}{
+		{
+			name:   "fills in order",
+			ops:    []op{create("a", 1000), create("b", 1010), create("c", 1020)},
+			owners: []string{"a", "b", "c"},
+		},
+		{
+			name: "exhausted",
+			ops: []op{
+				create("a", 1000), create("b", 1010), create("c", 1020),
+				{create: true, id: "d", wantErr: ErrSNATExhausted},
+			},
+			owners: []string{"a", "b", "c"},
+		},
+		{
+			name:   "retry keeps the slice",
+			ops:    []op{create("a", 1000), create("b", 1010), create("a", 1000)},
+			owners: []string{"a", "b", ""},
+		},
+		{
+			name: "released slices are reused last",
+			ops: []op{
+				create("a", 1000), create("b", 1010),
+				{id: "a"},
+				create("c", 1020), create("d", 1000),
+			},
+			owners: []string{"d", "b", "c"},
+		},
+		{
+			name: "reclaimed once exhausted",
+			ops: []op{
+				create("a", 1000), create("b", 1010), create("c", 1020),
+				{id: "b"},
+				create("d", 1010),
+				{create: true, id: "e", wantErr: ErrSNATExhausted},
+				{id: "a"}, {id: "c"},
+				create("e", 1020), create("f", 1000),
+			},
+			owners: []string{"f", "d", "e"},
+		},
+		{
+			name:   "deleting without a slice",
+			ops:    []op{create("a", 1000), {id: "b"}, create("c", 1010)},
+			owners: []string{"a", "c", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSNATAllocator(config)
+			for i, op := range tt.ops {
+				if !op.create {
+					a.release(op.id)
+					continue
+				}
+				got, err := a.allocate(op.id)
+				if !errors.Is(err, op.wantErr) || (err == nil && got != op.want) {
+					t.Fatalf("op %d: allocate(%s) = %s, %v, want %s, %v", i, op.id, got, err, op.want, op.wantErr)
+				}
+			}
+			if !slices.Equal(a.owners, tt.owners) {
+				t.Fatalf("owners = %q, want %q", a.owners, tt.owners)
+			}
+
+			var want []SNATSlice
+			for i, owner := range tt.owners {
+				if owner != "" {
+					want = append(want, SNATSlice{ContainerID: owner, Ports: config.slice(i)})
+				}
+			}
+			if got := a.list(); !slices.Equal(got, want) {
+				t.Errorf("list() = %v, want %v", got, want)
+			}
+			for port := uint16(990); port < 1040; port++ {
+				got, ok := a.lookup(port)
+				var owner string
+				if i := (int(port) - 1000) / 10; port >= 1000 && i < len(tt.owners) {
+					owner = tt.owners[i]
+				}
+				if ok != (owner != "") || got.ContainerID != owner || (ok && !got.Ports.Contains(port)) {
+					t.Errorf("lookup(%d) = %v, %v, want %q", port, got, ok, owner)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreSNAT(t *testing.T) {
+	config := SNATConfig{Enable: true, PortMin: 1000, PortMax: 1029, SliceSize: 10}
+	ports := func(first uint16) *PortRange {
+		return &PortRange{Min: first, Max: first + 9}
+	}
+	tests := []struct {
+		name  string
+		saved map[string]*PortRange
+		want  map[string]*PortRange
+		// exhausted is how many containers are left without a slice
+		exhausted uint64
+	}{
+		{
+			name:  "kept",
+			saved: map[string]*PortRange{"a": ports(1010), "b": ports(1000)},
+			want:  map[string]*PortRange{"a": ports(1010), "b": ports(1000)},
+		},
+		{
+			name:  "saved without slicing",
+			saved: map[string]*PortRange{"a": nil, "b": ports(1000)},
+			want:  map[string]*PortRange{"a": ports(1010), "b": ports(1000)},
+		},
+		{
+			name:  "slice size changed",
+			saved: map[string]*PortRange{"a": {Min: 1000, Max: 1019}, "b": ports(1020)},
+			want:  map[string]*PortRange{"a": ports(1000), "b": ports(1020)},
+		},
+		{
+			name:  "outside the range",
+			saved: map[string]*PortRange{"a": ports(2000)},
+			want:  map[string]*PortRange{"a": ports(1000)},
+		},
+		{
+			name:  "conflict",
+			saved: map[string]*PortRange{"a": ports(1000), "b": ports(1000)},
+			want:  map[string]*PortRange{"a": ports(1000), "b": ports(1010)},
+		},
+		{
+			name: "exhausted",
+			saved: map[string]*PortRange{
+				"a": ports(1000), "b": ports(1010), "c": ports(1020), "d": nil,
+			},
+			want: map[string]*PortRange{
+				"a": ports(1000), "b": ports(1010), "c": ports(1020), "d": nil,
+			},
+			exhausted: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := &NetworkManager{
+				config:     NetworkConfig{SNAT: config},
+				log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+				containers: make(map[string]*ContainerNetwork),
+				snat:       newSNATAllocator(config),
+			}
+			for id, r := range tt.saved {
+				nm.containers[id] = &ContainerNetwork{ContainerID: id, SNATPorts: r}
+			}
+			nm.restoreSNAT()
+			for id, want := range tt.want {
+				got := nm.containers[id].SNATPorts
+				if (got == nil) != (want == nil) || (got != nil && *got != *want) {
+					t.Errorf("%s has ports %v, want %v", id, got, want)
+				}
+				if want == nil {
+					continue
+				}
+				if slice, ok := nm.snat.lookup(want.Min); !ok || slice.ContainerID != id {
+					t.Errorf("lookup(%d) = %v, %v, want %s", want.Min, slice, ok, id)
+				}
+			}
+			if got := nm.snatExhausted.Load(); got != tt.exhausted {
+				t.Errorf("exhausted = %d, want %d", got, tt.exhausted)
+			}
+		})
+	}
+}
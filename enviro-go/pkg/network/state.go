@@ -0,0 +1,294 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// StateStore persists container networks so a restarted manager can
+// re-adopt them instead of leaking their addresses and interfaces, along
+// with the namespaces, policies and services it programs again.
+// NewFileStateStore and NewBoltStateStore are the backends of this package.
+type StateStore interface {
+	// Save replaces the stored state
+	Save(state SavedState) error
+	// Load returns the stored state, empty if nothing was saved yet
+	Load() (SavedState, error)
+}
+
+// SavedState is what a StateStore persists
+type SavedState struct {
+	// Containers are keyed by containerID
+	Containers map[string]ContainerNetwork
+	// Policies are in the order they were first applied
+	Policies []NetworkPolicy
+	// Services are ordered by name
+	Services []Service
+	// Namespaces are ordered by name
+	Namespaces []Namespace
+	// Reservations are ordered by container ID
+	Reservations []Reservation
+}
+
+// StateFileName is the file NewFileStateStore keeps its state in
+const StateFileName = "network.json"
+
+// StateVersion is bumped on incompatible changes to the state file. It is
+// the file's "version" field.
+const StateVersion = 1
+
+type stateFile struct {
+	Version    int                         `json:"version"`
+	Containers map[string]ContainerNetwork `json:"containers"`
+	// Policies, Services, Namespaces and Reservations are missing from
+	// files written before they were persisted
+	Policies     []NetworkPolicy `json:"policies,omitempty"`
+	Services     []Service       `json:"services,omitempty"`
+	Namespaces   []Namespace     `json:"namespaces,omitempty"`
+	Reservations []Reservation   `json:"reservations,omitempty"`
+}
+
+// fileStateStore keeps state as JSON in a checksummed storage file
+type fileStateStore struct {
+	store *storage.Store
+}
+
+// NewFileStateStore returns a StateStore writing JSON to store
+func NewFileStateStore(store *storage.Store) StateStore {
+	return &fileStateStore{store: store}
+}
+
+// Save implements StateStore
+func (s *fileStateStore) Save(state SavedState) error {
+	data, err := json.Marshal(stateFile{
+		Version:      StateVersion,
+		Containers:   state.Containers,
+		Policies:     state.Policies,
+		Services:     state.Services,
+		Namespaces:   state.Namespaces,
+		Reservations: state.Reservations,
+	})
+	if err != nil {
+		return err
+	}
+	return s.store.Write(StateFileName, data)
+}
+
+// Load implements StateStore
+func (s *fileStateStore) Load() (SavedState, error) {
+	data, err := s.store.Read(StateFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return SavedState{Containers: map[string]ContainerNetwork{}}, nil
+	}
+	if err != nil {
+		return SavedState{}, err
+	}
+
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return SavedState{}, fmt.Errorf("%w: %s: %v", storage.ErrCorrupt, StateFileName, err)
+	}
+	if state.Version != StateVersion {
+		return SavedState{}, fmt.Errorf("network state %s has unsupported version %d", StateFileName, state.Version)
+	}
+	if state.Containers == nil {
+		state.Containers = map[string]ContainerNetwork{}
+	}
+	return SavedState{
+		Containers:   state.Containers,
+		Policies:     state.Policies,
+		Services:     state.Services,
+		Namespaces:   state.Namespaces,
+		Reservations: state.Reservations,
+	}, nil
+}
+
+// restoreState re-adopts the containers in the state store whose host
+// interface still exists and forgets the rest. Creates and deletes that
+// were interrupted are rolled back and finished respectively. Namespaces
+// reserve their ranges and reservations their addresses before the
+// containers' addresses are reserved. Policies and
+// services are programmed again, services without the backends that are
+// gone. It runs before the manager is shared, after the datapath is
+// initialized.
+func (nm *NetworkManager) restoreState() error {
+	saved, err := nm.config.State.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load network state: %w", err)
+	}
+
+	nm.restoreNamespaces(saved.Namespaces)
+	nm.restoreReservations(saved.Reservations)
+	// Node restarts program every container at once, so write their routes
+	// in batches
+	flushRoutes := nm.batchRoutes()
+	for id, cn := range saved.Containers {
+		cn := cn
+		cn.ContainerID = id
+		cn.Namespace = namespaceOf(cn.Namespace)
+		logger := nm.log.With("container_id", id, "interface", cn.HostInterface)
+
+		if cn.Intent != "" {
+			logger.Info("Cleaning up interrupted container network change", "intent", cn.Intent)
+			if err := nm.teardownContainerDatapath(&cn); err != nil {
+				logger.Warn("Failed to clean up interrupted container network", "error", err)
+			}
+			continue
+		}
+
+		if err := nm.reserveAddrs(&cn); err != nil {
+			logger.Warn("Dropping saved container network", "error", err)
+			if err := nm.teardownContainerDatapath(&cn); err != nil {
+				logger.Warn("Failed to remove dropped container network", "error", err)
+			}
+			continue
+		}
+
+		adopted, err := nm.adoptContainerDatapath(&cn)
+		if err != nil {
+			return fmt.Errorf("failed to re-adopt network of %s: %w", id, err)
+		}
+		if !adopted {
+			logger.Info("Forgetting container network whose interface is gone")
+			nm.releaseAddrs(id)
+			continue
+		}
+
+		logger.Info("Re-adopted container network", "ipv4", cn.IPv4, "ipv6", cn.IPv6)
+		nm.containers[id] = &cn
+		nm.names.add(&cn)
+	}
+	if err := flushRoutes(); err != nil {
+		return fmt.Errorf("failed to program routes of re-adopted containers: %w", err)
+	}
+
+	nm.restoreMirrors()
+	if err := nm.syncNamespaces(); err != nil {
+		nm.log.Warn("Failed to restore namespace isolation", "error", err)
+	}
+	nm.restorePolicies(saved.Policies)
+	nm.restoreServices(saved.Services)
+
+	// Init programs the slices once restored
+	nm.restoreSNAT()
+	// Replace the forwards of the previous run, including any left behind
+	// for containers that are gone
+	nm.forwarding = true
+	if err := nm.syncForwards(); err != nil {
+		nm.log.Warn("Failed to restore port forwards", "error", err)
+	}
+	nm.prioritizing = true
+	if err := nm.syncQoS(); err != nil {
+		nm.log.Warn("Failed to restore QoS classes", "error", err)
+	}
+	return nm.saveState()
+}
+
+// restorePolicies applies the saved policies again, skipping any that
+// no longer validate. Policies naming containers that are gone are kept,
+// as ApplyPolicy keeps them.
+func (nm *NetworkManager) restorePolicies(policies []NetworkPolicy) {
+	for _, p := range policies {
+		if err := p.Validate(); err != nil {
+			nm.log.Warn("Dropping saved network policy", "policy", p.Name, "error", err)
+			continue
+		}
+		p.Namespace = namespaceOf(p.Namespace)
+		if _, exists := nm.policies[p.Name]; !exists {
+			nm.policyOrder = append(nm.policyOrder, p.Name)
+		}
+		nm.policies[p.Name] = p
+	}
+	if len(nm.policies) > 0 {
+		nm.log.Info("Restored network policies", "count", len(nm.policies))
+	}
+	if err := nm.syncPolicies(); err != nil {
+		nm.log.Warn("Failed to restore network policies", "error", err)
+	}
+}
+
+// restoreServices programs the saved services again. Backends whose
+// network was not re-adopted are removed, as deleting them would have.
+func (nm *NetworkManager) restoreServices(services []Service) {
+	for _, s := range services {
+		logger := nm.log.With("service", s.Name)
+		if err := s.Validate(); err != nil {
+			logger.Warn("Dropping saved service", "error", err)
+			continue
+		}
+		s = s.withDefaults()
+		backends := s.Backends[:0]
+		for _, id := range s.Backends {
+			if cn, ok := nm.containers[id]; ok && cn.Namespace == s.Namespace {
+				backends = append(backends, id)
+			} else {
+				logger.Info("Removing service backend whose network is gone", "container_id", id)
+			}
+		}
+		s.Backends = backends
+		nm.services[s.Name] = s
+		nm.names.addService(s)
+	}
+	if len(nm.services) == 0 {
+		return
+	}
+	nm.log.Info("Restored services", "count", len(nm.services))
+	if err := nm.syncServices(); err != nil {
+		nm.log.Warn("Failed to restore services", "error", err)
+	}
+}
+
+// reserveAddrs claims the saved addresses of cn in the address pools and
+// takes them back from their IPAM backends.
+// Those of rootless containers are slirp4netns's, outside the pools.
+func (nm *NetworkManager) reserveAddrs(cn *ContainerNetwork) error {
+	if cn.Rootless {
+		return nil
+	}
+	for _, s := range []string{cn.IPv4, cn.IPv6} {
+		if s == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			nm.releaseAddrs(cn.ContainerID)
+			return err
+		}
+		if err := nm.restoreAddr(cn, addr); err != nil {
+			nm.releaseAddrs(cn.ContainerID)
+			return err
+		}
+	}
+	return nil
+}
+
+// saveState writes the current containers, policies, services, namespaces
+// and reservations through to the state store, if one is configured. Callers
+// must hold nm.mu or own nm exclusively.
+func (nm *NetworkManager) saveState() error {
+	if nm.config.State == nil {
+		return nil
+	}
+	state := SavedState{
+		Containers:   make(map[string]ContainerNetwork, len(nm.containers)),
+		Policies:     make([]NetworkPolicy, 0, len(nm.policyOrder)),
+		Services:     nm.sortedServices(),
+		Namespaces:   nm.sortedNamespaces(),
+		Reservations: nm.sortedReservations(),
+	}
+	for id, cn := range nm.containers {
+		state.Containers[id] = *cn
+	}
+	for _, name := range nm.policyOrder {
+		state.Policies = append(state.Policies, nm.policies[name])
+	}
+	if err := nm.config.State.Save(state); err != nil {
+		return fmt.Errorf("failed to save network state: %w", err)
+	}
+	return nil
+}
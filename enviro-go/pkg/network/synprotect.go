@@ -0,0 +1,109 @@
+package network
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+)
+
+// DefaultSYNThreshold is SYNProtectionConfig.Threshold when zero
+const DefaultSYNThreshold = 1000
+
+// SYNProtectionConfig guards the TCP ports forwarded from the host and the
+// TCP service VIPs against SYN floods in the XDP router, before the
+// kernel tracks a connection for each SYN. The SYNs to each destination
+// are counted per second. Once a destination takes more than Threshold,
+// and for ten seconds after its last second over it, SYNs from sources
+// not known to be real are answered with a SYN cookie instead. The cookie
+// comes back in the reset a real TCP stack answers with, which verifies
+// the source for five minutes; the client connects with the SYN it
+// retransmits a second later. Spoofed sources never answer, so they
+// create no state.
+//
+// SYN protection needs the router attached in native or generic XDP mode
+// on a kernel from 6.0. It stays off with a warning elsewhere, see
+// Capabilities.SYNProtection.
+type SYNProtectionConfig struct {
+	Enable bool `json:"enable"`
+	// Threshold is how many SYNs a second a destination takes before its
+	// SYNs are answered with cookies, DefaultSYNThreshold when zero
+	Threshold int `json:"threshold"`
+	// Allowlist are the prefixes of trusted sources, e.g. load balancers
+	// or health checkers, whose SYNs are neither counted nor answered
+	// with cookies
+	Allowlist []string `json:"allowlist"`
+}
+
+// withDefaults fills in the threshold
+func (c SYNProtectionConfig) withDefaults() SYNProtectionConfig {
+	if c.Threshold == 0 {
+		c.Threshold = DefaultSYNThreshold
+	}
+	c.Allowlist = slices.Clone(c.Allowlist)
+	return c
+}
+
+// validate checks the threshold and allowlist, and that XDP is enabled
+func (c SYNProtectionConfig) validate(cfg NetworkConfig) error {
+	if !c.Enable {
+		return nil
+	}
+	if !cfg.EnableXDP {
+		return fmt.Errorf("%w: SYN protection requires XDP", ErrInvalidConfig)
+	}
+	if c.Threshold < 0 || int64(c.Threshold) > math.MaxUint32 {
+		return fmt.Errorf("%w: SYN threshold %d is out of range", ErrInvalidConfig, c.Threshold)
+	}
+	for _, s := range c.Allowlist {
+		if _, err := netip.ParsePrefix(s); err != nil {
+			return fmt.Errorf("%w: SYN allowlist: %v", ErrInvalidConfig, err)
+		}
+	}
+	return nil
+}
+
+// trusted returns the prefixes of the allowlist, which must be valid
+func (c SYNProtectionConfig) trusted() []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(c.Allowlist))
+	for _, s := range c.Allowlist {
+		out = append(out, netip.MustParsePrefix(s).Masked())
+	}
+	return out
+}
+
+// synDest is a destination SYN protection guards. Addr is unset for
+// every local address, which port forwards take.
+type synDest struct {
+	Addr netip.Addr
+	Port uint16
+}
+
+// synDests returns the TCP destinations of the port forwards and services,
+// ordered by address and port. Callers must hold nm.mu.
+func (nm *NetworkManager) synDests() []synDest {
+	var out []synDest
+	for _, fwd := range nm.portForwards() {
+		if fwd.Protocol == "tcp" {
+			out = append(out, synDest{Port: fwd.HostPort})
+		}
+	}
+	for _, s := range nm.services {
+		for _, p := range s.Ports {
+			if p.Protocol != "tcp" {
+				continue
+			}
+			out = append(out, synDest{Addr: netip.MustParseAddr(s.VIP), Port: p.Port})
+			if p.NodePort != 0 {
+				out = append(out, synDest{Port: p.NodePort})
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b synDest) int {
+		if c := a.Addr.Compare(b.Addr); c != 0 {
+			return c
+		}
+		return int(a.Port) - int(b.Port)
+	})
+	return slices.Compact(out)
+}
@@ -0,0 +1,300 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// XDP verdicts of the router
+const (
+	xdpDrop = 1
+	xdpPass = 2
+	xdpTX   = 3
+)
+
+// loadSYNRouter loads the embedded router with SYN protection, unattached,
+// for running it with BPF_PROG_TEST_RUN
+func loadSYNRouter(t *testing.T, threshold int, trusted []netip.Prefix, dests []synDest) *xdpProgram {
+	t.Helper()
+	if !probedKernel().Datapath.SYNCookies {
+		t.Skip("kernel lacks the raw SYN cookie helpers")
+	}
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		t.Fatal(err)
+	}
+	trimPrograms(spec, []DatapathMode{DatapathXDPNative})
+	x := &xdpProgram{synProtection: true}
+	if err := x.applySYNProtection(spec); err != nil {
+		t.Fatal(err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("loading eBPF not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(coll.Close)
+	x.setCollection(coll)
+	if err := x.SetSYNProtection(threshold, trusted); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.SetSYNProtected(dests); err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+// tcpSegment is a TCP segment without options or payload
+type tcpSegment struct {
+	src, dst netip.AddrPort
+	seq, ack uint32
+	flags    uint8
+}
+
+// frame returns s in an Ethernet frame. Checksums are left zero, which the
+// router doesn't check.
+func (s tcpSegment) frame() []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 12))
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], s.src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], s.dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], s.seq)
+	binary.BigEndian.PutUint32(tcp[8:], s.ack)
+	tcp[12] = 5 << 4
+	tcp[13] = s.flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	if s.src.Addr().Is4() {
+		binary.Write(&b, binary.BigEndian, uint16(unix.ETH_P_IP))
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], 40)
+		ip[8] = 64
+		ip[9] = unix.IPPROTO_TCP
+		copy(ip[12:], s.src.Addr().AsSlice())
+		copy(ip[16:], s.dst.Addr().AsSlice())
+		b.Write(ip)
+	} else {
+		binary.Write(&b, binary.BigEndian, uint16(unix.ETH_P_IPV6))
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], 20)
+		ip[6] = unix.IPPROTO_TCP
+		ip[7] = 64
+		copy(ip[8:], s.src.Addr().AsSlice())
+		copy(ip[24:], s.dst.Addr().AsSlice())
+		b.Write(ip)
+	}
+	b.Write(tcp)
+	return b.Bytes()
+}
+
+// parseSegment reads the TCP segment in frame
+func parseSegment(t *testing.T, frame []byte) tcpSegment {
+	t.Helper()
+	var src, dst netip.Addr
+	var tcp []byte
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case unix.ETH_P_IP:
+		ip := frame[14:]
+		src, _ = netip.AddrFromSlice(ip[12:16])
+		dst, _ = netip.AddrFromSlice(ip[16:20])
+		tcp = ip[20:]
+	case unix.ETH_P_IPV6:
+		ip := frame[14:]
+		src, _ = netip.AddrFromSlice(ip[8:24])
+		dst, _ = netip.AddrFromSlice(ip[24:40])
+		tcp = ip[40:]
+	default:
+		t.Fatalf("reply is no IP packet: %x", frame)
+	}
+	return tcpSegment{
+		src:   netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:])),
+		dst:   netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:])),
+		seq:   binary.BigEndian.Uint32(tcp[4:]),
+		ack:   binary.BigEndian.Uint32(tcp[8:]),
+		flags: tcp[13],
+	}
+}
+
+// runSegment runs the router on s, returning its verdict and the frame it
+// left
+func runSegment(t *testing.T, x *xdpProgram, s tcpSegment) (uint32, []byte) {
+	t.Helper()
+	ret, out, err := x.coll.Programs[routerProgram].Test(s.frame())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret, out
+}
+
+// TestSYNCookieRoundTrip floods protected destinations past the threshold
+// and completes cookie exchanges as a client's TCP stack would
+func TestSYNCookieRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		server, other   netip.Addr
+		client, spoofed netip.Addr
+		trustedClient   netip.Addr
+		trusted         netip.Prefix
+	}{
+		{
+			name:          "IPv4",
+			server:        netip.MustParseAddr("192.0.2.1"),
+			other:         netip.MustParseAddr("192.0.2.2"),
+			client:        netip.MustParseAddr("198.51.100.1"),
+			spoofed:       netip.MustParseAddr("198.51.100.2"),
+			trustedClient: netip.MustParseAddr("203.0.113.9"),
+			trusted:       netip.MustParsePrefix("203.0.113.0/24"),
+		},
+		{
+			name:          "IPv6",
+			server:        netip.MustParseAddr("2001:db8::1"),
+			other:         netip.MustParseAddr("2001:db8::2"),
+			client:        netip.MustParseAddr("2001:db8:1::1"),
+			spoofed:       netip.MustParseAddr("2001:db8:1::2"),
+			trustedClient: netip.MustParseAddr("2001:db8:2::9"),
+			trusted:       netip.MustParsePrefix("2001:db8:2::/48"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			const threshold = 2
+			// A service on server:80 and a forward of port 443 on every
+			// local address
+			x := loadSYNRouter(t, threshold, []netip.Prefix{tt.trusted},
+				[]synDest{{Addr: tt.server, Port: 80}, {Port: 443}})
+			service := netip.AddrPortFrom(tt.server, 80)
+			syn := func(src netip.Addr, dst netip.AddrPort) tcpSegment {
+				return tcpSegment{src: netip.AddrPortFrom(src, 40000), dst: dst, seq: 1000, flags: tcpSYN}
+			}
+
+			for i := 0; i < threshold; i++ {
+				if ret, _ := runSegment(t, x, syn(tt.client, service)); ret != xdpPass {
+					t.Fatalf("SYN %d below the threshold: verdict %d, want pass", i, ret)
+				}
+			}
+			ret, out := runSegment(t, x, syn(tt.client, service))
+			if ret != xdpTX {
+				t.Fatalf("SYN over the threshold: verdict %d, want tx", ret)
+			}
+			synACK := parseSegment(t, out)
+			if synACK.src != service || synACK.dst != netip.AddrPortFrom(tt.client, 40000) ||
+				synACK.flags != tcpSYN|tcpACK || synACK.ack != synACK.seq || synACK.ack == 1001 {
+				t.Fatalf("reply = %+v, want a SYN-ACK from %s acknowledging its cookie", synACK, service)
+			}
+
+			// The client's stack resets the SYN-ACK from its acknowledgment
+			// number
+			reset := tcpSegment{src: synACK.dst, dst: synACK.src, seq: synACK.ack, flags: tcpRST}
+			// The low bits of a cookie encode one of the MSS values the
+			// kernel checks against, so forging it off by one can still
+			// pass; this one is off in bits no MSS value covers
+			forged := reset
+			forged.seq += 1 << 12
+			if ret, _ := runSegment(t, x, forged); ret != xdpPass {
+				t.Errorf("reset with a wrong cookie: verdict %d, want pass", ret)
+			}
+			if ret, _ := runSegment(t, x, reset); ret != xdpDrop {
+				t.Errorf("reset with the cookie: verdict %d, want it consumed", ret)
+			}
+			if ret, _ := runSegment(t, x, syn(tt.client, service)); ret != xdpPass {
+				t.Errorf("SYN of a verified client: verdict %d, want pass", ret)
+			}
+
+			if ret, _ := runSegment(t, x, syn(tt.spoofed, service)); ret != xdpTX {
+				t.Errorf("SYN of an unverified client: verdict %d, want tx", ret)
+			}
+			for i := 0; i <= threshold; i++ {
+				if ret, _ := runSegment(t, x, syn(tt.trustedClient, service)); ret != xdpPass {
+					t.Errorf("SYN of a trusted client: verdict %d, want pass", ret)
+				}
+			}
+			if ret, _ := runSegment(t, x, syn(tt.spoofed, netip.AddrPortFrom(tt.server, 22))); ret != xdpPass {
+				t.Errorf("SYN to an unprotected port: verdict %d, want pass", ret)
+			}
+			// Port forwards count every local address together
+			forward := netip.AddrPortFrom(tt.other, 443)
+			for i := 0; i < threshold; i++ {
+				runSegment(t, x, syn(tt.spoofed, netip.AddrPortFrom(tt.server, 443)))
+			}
+			if ret, _ := runSegment(t, x, syn(tt.spoofed, forward)); ret != xdpTX {
+				t.Errorf("SYN to a flooded forward: verdict %d, want tx", ret)
+			}
+
+			s, err := x.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.SYNCookiesSent != 3 || s.SYNCookiesValid != 1 || s.SYNCookiesInvalid != 1 || s.Drops != 0 {
+				t.Errorf("stats = %+v, want 3 cookies sent, 1 valid, 1 invalid and no drops", s)
+			}
+		})
+	}
+}
+
+// TestSYNFloodBounded floods a protected destination from spoofed sources
+// and checks that no more SYNs reach the kernel, each of which its
+// conntrack would track, than the threshold lets through
+func TestSYNFloodBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("flood takes a while")
+	}
+	const (
+		threshold = 100
+		flood     = 20000
+	)
+	service := netip.MustParseAddrPort("192.0.2.1:80")
+	x := loadSYNRouter(t, threshold, nil, []synDest{{Addr: service.Addr(), Port: service.Port()}})
+
+	start := time.Now()
+	passed := 0
+	for i := 0; i < flood; i++ {
+		src := netip.AddrFrom4([4]byte{10, byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256))})
+		ret, _ := runSegment(t, x, tcpSegment{
+			src:   netip.AddrPortFrom(src, uint16(1024+rand.Intn(60000))),
+			dst:   service,
+			seq:   rand.Uint32(),
+			flags: tcpSYN,
+		})
+		if ret == xdpPass {
+			passed++
+		}
+	}
+	// The count starts over every second
+	seconds := int(time.Since(start)/time.Second) + 1
+	if passed > threshold*seconds {
+		t.Errorf("%d of %d SYNs passed in %d s, want at most %d", passed, flood, seconds, threshold*seconds)
+	}
+
+	s, err := x.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.SYNCookiesSent + uint64(passed); got != flood {
+		t.Errorf("%d cookies sent and %d SYNs passed, want %d together", s.SYNCookiesSent, passed, flood)
+	}
+	for name, want := range map[string]uint32{"syn_verified": 0, "syn_rates": 1, "conntrack": 0} {
+		n, err := countEntries(x.coll.Maps[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s has %d entries, want %d", name, n, want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// synDestKey mirrors struct syn_dest in bpf/container_router.c. The port is
+// in network byte order.
+type synDestKey struct {
+	Addr [16]byte
+	Port [2]byte
+	Pad  uint16
+}
+
+func newSYNDestKey(d synDest) synDestKey {
+	var k synDestKey
+	if d.Addr.IsValid() {
+		// IPv4 addresses come out IPv4-mapped
+		k.Addr = d.Addr.As16()
+	}
+	binary.BigEndian.PutUint16(k.Port[:], d.Port)
+	return k
+}
+
+// decodeSYNDest formats a syn_dest key, "*" standing for every local
+// address
+func decodeSYNDest(key []byte) string {
+	k := decodeAs[synDestKey](key)
+	return addrOrAny(netip.AddrFrom16(k.Addr).Unmap().AsSlice()) + ":" + formatPort(k.Port)
+}
+
+// synRate mirrors struct syn_rate in bpf/container_router.c
+type synRate struct {
+	WindowNs     uint64
+	SYNs         uint64
+	CookiesUntil uint64
+}
+
+// synPrefixKey mirrors struct syn_prefix in bpf/container_router.c. The
+// kernel reads Prefixlen in host byte order.
+type synPrefixKey struct {
+	Prefixlen uint32
+	Addr      [16]byte
+}
+
+// Bits an IPv4-mapped prefix has before the IPv4 address
+const synPrefix4Bits = 96
+
+func newSYNPrefixKey(p netip.Prefix) synPrefixKey {
+	k := synPrefixKey{Prefixlen: uint32(p.Bits()), Addr: p.Addr().As16()}
+	if p.Addr().Is4() {
+		k.Prefixlen += synPrefix4Bits
+	}
+	return k
+}
+
+// synPrefix returns the prefix of a syn_trusted key
+func synPrefix(k synPrefixKey) netip.Prefix {
+	addr := netip.AddrFrom16(k.Addr)
+	if addr.Is4In6() {
+		return netip.PrefixFrom(addr.Unmap(), int(k.Prefixlen)-synPrefix4Bits)
+	}
+	return netip.PrefixFrom(addr, int(k.Prefixlen))
+}
+
+// hasSYNProtection reports whether the router answers SYN floods with
+// cookies: it was loaded with the stage, which the TC variant skips
+func (x *xdpProgram) hasSYNProtection() bool {
+	return x.synProtection && x.mode != DatapathTC && x.synProtected != nil
+}
+
+// SetSYNProtection sets the SYNs a second a destination takes before they
+// are answered with cookies, and the trusted source prefixes, replacing
+// the previous ones
+func (x *xdpProgram) SetSYNProtection(threshold int, trusted []netip.Prefix) error {
+	if x.synConfig == nil || x.synTrusted == nil {
+		return fmt.Errorf("%w: router has no SYN protection maps", ErrInvalidDatapath)
+	}
+	if err := x.synConfig.Put(uint32(0), uint32(threshold)); err != nil {
+		return err
+	}
+
+	want := make(map[synPrefixKey]bool, len(trusted))
+	for _, p := range trusted {
+		want[newSYNPrefixKey(p)] = true
+	}
+	// Deleting while iterating can restart the iteration, so collect first
+	batch := newMapBatch[synPrefixKey, uint8](x.synTrusted)
+	var key synPrefixKey
+	var v uint8
+	iter := x.synTrusted.Iterate()
+	for iter.Next(&key, &v) {
+		if !want[key] {
+			batch.delete(key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for key := range want {
+		batch.put(key, 1)
+	}
+	return batch.flush()
+}
+
+// SetSYNProtected programs the destinations SYN protection guards,
+// replacing the previous ones. The SYN rates of those no longer guarded
+// are dropped with them.
+func (x *xdpProgram) SetSYNProtected(dests []synDest) error {
+	want := make(map[synDestKey]bool, len(dests))
+	for _, d := range dests {
+		want[newSYNDestKey(d)] = true
+	}
+
+	protected := newMapBatch[synDestKey, uint8](x.synProtected)
+	var key synDestKey
+	var v uint8
+	iter := x.synProtected.Iterate()
+	for iter.Next(&key, &v) {
+		if !want[key] {
+			protected.delete(key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for key := range want {
+		protected.put(key, 1)
+	}
+	if err := protected.flush(); err != nil {
+		return err
+	}
+
+	rates := newMapBatch[synDestKey, synRate](x.synRates)
+	var rate synRate
+	iter = x.synRates.Iterate()
+	for iter.Next(&key, &rate) {
+		if !want[key] {
+			rates.delete(key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return rates.flush()
+}
+
+// initSYNProtection configures the SYN protection of the freshly loaded
+// xdp, warning when it is enabled but can't run
+func (nm *NetworkManager) initSYNProtection(xdp *xdpProgram) error {
+	cfg := nm.config.SYNProtection
+	if !cfg.Enable {
+		return nil
+	}
+	switch {
+	case !xdp.synProtection:
+		nm.log.Warn("SYN protection unavailable: kernel lacks the raw SYN cookie helpers of 6.0")
+		return nil
+	case xdp.mode == DatapathTC:
+		nm.log.Warn("SYN protection unavailable: the router is attached in TC mode, which can't answer SYNs")
+		return nil
+	}
+	if err := xdp.SetSYNProtection(cfg.Threshold, cfg.trusted()); err != nil {
+		return err
+	}
+	nm.caps.SYNProtection = true
+	nm.log.Info("Enabled SYN protection", "threshold", cfg.Threshold, "allowlist", cfg.Allowlist)
+	return nil
+}
+
+// syncSYNProtection programs the destinations of the current port
+// forwards and services for SYN protection. Callers must hold nm.mu.
+func (nm *NetworkManager) syncSYNProtection() error {
+	if nm.xdp == nil || !nm.xdp.hasSYNProtection() {
+		return nil
+	}
+	if err := nm.xdp.SetSYNProtected(nm.synDests()); err != nil {
+		return fmt.Errorf("failed to program SYN protection: %w", err)
+	}
+	return nil
+}
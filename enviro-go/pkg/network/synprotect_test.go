@@ -0,0 +1,102 @@
+package network
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSYNProtectionValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SYNProtectionConfig
+		noXDP   bool
+		wantErr bool
+	}{
+		{name: "disabled", cfg: SYNProtectionConfig{Threshold: -1}, noXDP: true},
+		{name: "defaults", cfg: SYNProtectionConfig{Enable: true}},
+		{name: "allowlist", cfg: SYNProtectionConfig{Enable: true, Threshold: 50, Allowlist: []string{"10.0.0.0/8", "2001:db8::/32"}}},
+		{name: "without XDP", cfg: SYNProtectionConfig{Enable: true}, noXDP: true, wantErr: true},
+		{name: "negative threshold", cfg: SYNProtectionConfig{Enable: true, Threshold: -1}, wantErr: true},
+		{name: "address without length", cfg: SYNProtectionConfig{Enable: true, Allowlist: []string{"10.0.0.1"}}, wantErr: true},
+		{name: "bad prefix", cfg: SYNProtectionConfig{Enable: true, Allowlist: []string{"10.0.0.0/33"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate(NetworkConfig{EnableXDP: !tt.noXDP})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validate() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validate() = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
+
+func TestSYNProtectionTrusted(t *testing.T) {
+	cfg := SYNProtectionConfig{Allowlist: []string{"10.1.2.3/8", "2001:db8::1/32"}}
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	if got := cfg.trusted(); !slices.Equal(got, want) {
+		t.Errorf("trusted() = %v, want %v", got, want)
+	}
+}
+
+func TestSYNDests(t *testing.T) {
+	local := func(port uint16) synDest { return synDest{Port: port} }
+	vip := func(addr string, port uint16) synDest { return synDest{Addr: netip.MustParseAddr(addr), Port: port} }
+	tests := []struct {
+		name     string
+		ports    map[string][]PortForward
+		services []Service
+		want     []synDest
+	}{
+		{name: "nothing published"},
+		{
+			name: "TCP forwards",
+			ports: map[string][]PortForward{
+				"a": {{HostPort: 8080, Protocol: "tcp"}, {HostPort: 53, Protocol: "udp"}},
+				"b": {{HostPort: 443, Protocol: "tcp"}},
+			},
+			want: []synDest{local(443), local(8080)},
+		},
+		{
+			name: "TCP services",
+			services: []Service{
+				{Name: "web", VIP: "10.96.0.10", Port: 80, Protocol: "tcp"},
+				{Name: "dns", VIP: "10.96.0.10", Port: 53, Protocol: "udp"},
+				{Name: "api", VIP: "fd00::10", Port: 443, Protocol: "tcp"},
+			},
+			want: []synDest{vip("10.96.0.10", 80), vip("fd00::10", 443)},
+		},
+		{
+			name: "node ports",
+			services: []Service{
+				{Name: "web", VIP: "10.96.0.10", Port: 80, Protocol: "tcp", ExposeNodePort: true, NodePort: 30080},
+				{Name: "dns", VIP: "10.96.0.10", Port: 53, Protocol: "udp", ExposeNodePort: true, NodePort: 30053},
+			},
+			want: []synDest{local(30080), vip("10.96.0.10", 80)},
+		},
+		{
+			name:     "forwards before services",
+			ports:    map[string][]PortForward{"a": {{HostPort: 80, Protocol: "tcp"}}},
+			services: []Service{{Name: "web", VIP: "10.96.0.10", Port: 80, Protocol: "tcp"}},
+			want:     []synDest{local(80), vip("10.96.0.10", 80)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := &NetworkManager{containers: make(map[string]*ContainerNetwork), services: make(map[string]Service)}
+			for id, ports := range tt.ports {
+				nm.containers[id] = &ContainerNetwork{ContainerID: id, Ports: ports}
+			}
+			for _, s := range tt.services {
+				nm.services[s.Name] = s.withDefaults()
+			}
+			if got := nm.synDests(); !slices.Equal(got, tt.want) {
+				t.Errorf("synDests() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// tcFilterPriority is the priority of the router's filter on clsact
+// ingress. Filters of other tools with a lower number run first.
+const tcFilterPriority = 1
+
+// tcLink is the router attached as a direct-action BPF filter on clsact
+// ingress of an interface, for DatapathTC
+type tcLink struct {
+	filter *netlink.BpfFilter
+}
+
+// attachTC attaches prog to ifc, adding a clsact qdisc unless one exists
+func attachTC(ifc *net.Interface, prog *ebpf.Program) (*tcLink, error) {
+	if err := addClsact(ifc.Index); err != nil {
+		return nil, err
+	}
+	l := &tcLink{filter: routerFilter(ifc.Index)}
+	if err := l.Update(prog); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// addClsact adds a clsact qdisc to the interface with index unless one
+// exists
+func addClsact(index int) error {
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: index,
+			Parent:    netlink.HANDLE_CLSACT,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(clsact); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to add clsact qdisc: %w", err)
+	}
+	return nil
+}
+
+// routerFilter is the router's filter on the interface with index
+func routerFilter(index int) *netlink.BpfFilter {
+	return &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Handle:    1,
+			Priority:  tcFilterPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Name:         tcRouterProgram,
+		DirectAction: true,
+	}
+}
+
+// Update points the filter at prog. Replacing the filter swaps the
+// program without a moment in which none runs.
+func (l *tcLink) Update(prog *ebpf.Program) error {
+	l.filter.Fd = prog.FD()
+	if err := netlink.FilterReplace(l.filter); err != nil {
+		return fmt.Errorf("failed to install TC filter: %w", err)
+	}
+	return nil
+}
+
+// Close removes the filter. The qdisc stays, as it may have other users.
+func (l *tcLink) Close() error {
+	return deleteFilter(l.filter)
+}
+
+// detachTC removes a router filter left on ifc by a previous run
+func detachTC(ifc *net.Interface) error {
+	err := deleteFilter(routerFilter(ifc.Index))
+	// The interface has no clsact qdisc
+	if errors.Is(err, unix.EINVAL) {
+		return nil
+	}
+	return err
+}
+
+// deleteFilter removes filter, ignoring one that is already gone
+func deleteFilter(filter *netlink.BpfFilter) error {
+	err := netlink.FilterDel(filter)
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENODEV) {
+		return nil
+	}
+	return err
+}
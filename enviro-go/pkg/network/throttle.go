@@ -0,0 +1,182 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttleSlots bounds the throttle's memory. Keys hash into a fixed table
+// so an unbounded set of (event, container) pairs cannot grow it.
+const throttleSlots = 1024
+
+// ThrottleConfig controls rate limiting of high-frequency datapath logs
+type ThrottleConfig struct {
+	// Rate is the sustained number of messages per second per key
+	Rate float64 `json:"rate"`
+	// Burst is the number of messages a key may log before being limited
+	Burst int `json:"burst"`
+	// SampleEvery keeps one in every N debug messages (0 or 1 keeps all)
+	SampleEvery uint64 `json:"sample_every"`
+	// SummaryInterval is the minimum time between "suppressed" summaries
+	SummaryInterval time.Duration `json:"summary_interval"`
+}
+
+// DefaultThrottleConfig returns the throttle settings used when none are set
+func DefaultThrottleConfig() ThrottleConfig {
+	return ThrottleConfig{
+		Rate:            1,
+		Burst:           10,
+		SampleEvery:     100,
+		SummaryInterval: 10 * time.Second,
+	}
+}
+
+// LogThrottle rate limits log lines per (event type, container) key using a
+// token bucket, and periodically reports how many lines were suppressed.
+type LogThrottle struct {
+	log   *slog.Logger
+	mu    sync.Mutex
+	cfg   ThrottleConfig
+	slots [throttleSlots]throttleSlot
+
+	sampled    atomic.Uint64
+	suppressed atomic.Uint64
+}
+
+type throttleSlot struct {
+	hash        uint64
+	event       string
+	containerID string
+	tokens      float64
+	last        time.Time
+	lastSummary time.Time
+	suppressed  uint64
+}
+
+// NewLogThrottle creates a throttle with the given config, logging to
+// slog.Default()
+func NewLogThrottle(cfg ThrottleConfig) *LogThrottle {
+	return newLogThrottle(cfg, slog.Default())
+}
+
+func newLogThrottle(cfg ThrottleConfig, logger *slog.Logger) *LogThrottle {
+	t := &LogThrottle{log: logger}
+	t.SetConfig(cfg)
+	return t
+}
+
+// SetConfig replaces the throttle settings at runtime
+func (t *LogThrottle) SetConfig(cfg ThrottleConfig) {
+	if cfg.Burst < 1 {
+		cfg.Burst = 1
+	}
+	t.mu.Lock()
+	t.cfg = cfg
+	t.mu.Unlock()
+}
+
+// Suppressed returns the total number of messages dropped by the throttle
+func (t *LogThrottle) Suppressed() uint64 {
+	return t.suppressed.Load()
+}
+
+// Logf logs a message at info level for the given event and container
+// unless that key has exceeded its rate, in which case the message is
+// counted and dropped.
+func (t *LogThrottle) Logf(event, containerID, format string, args ...any) {
+	t.logf(slog.LevelInfo, event, containerID, format, args...)
+}
+
+func (t *LogThrottle) logf(level slog.Level, event, containerID, format string, args ...any) {
+	allowed, summary := t.allow(event, containerID, time.Now())
+	if summary > 0 {
+		t.log.Info("Suppressed similar messages", "event", event, "container_id", containerID, "count", summary)
+	}
+	if allowed {
+		t.log.Log(context.Background(), level, fmt.Sprintf(format, args...), "event", event, "container_id", containerID)
+	}
+}
+
+// Debugf is like Logf at debug level but first keeps only one in
+// SampleEvery messages. Sampling is deterministic, so the kept fraction is
+// exact. Nothing is done when debug logging is disabled.
+func (t *LogThrottle) Debugf(event, containerID, format string, args ...any) {
+	if !t.log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	t.mu.Lock()
+	every := t.cfg.SampleEvery
+	t.mu.Unlock()
+
+	if every > 1 && t.sampled.Add(1)%every != 0 {
+		t.suppressed.Add(1)
+		return
+	}
+	t.logf(slog.LevelDebug, event, containerID, fmt.Sprintf("[sampled 1/%d] %s", max(every, 1), format), args...)
+}
+
+// allow consumes a token for the key. It also returns the number of
+// suppressed messages to report when a summary is due.
+func (t *LogThrottle) allow(event, containerID string, now time.Time) (bool, uint64) {
+	h := hashKey(event, containerID)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	slot := &t.slots[h%throttleSlots]
+	if slot.hash != h || slot.event != event || slot.containerID != containerID {
+		// Evict whatever key held this slot; its pending count is lost
+		// from the summary but remains in the global counter.
+		*slot = throttleSlot{
+			hash:        h,
+			event:       event,
+			containerID: containerID,
+			tokens:      float64(t.cfg.Burst),
+			last:        now,
+			lastSummary: now,
+		}
+	}
+
+	slot.tokens += now.Sub(slot.last).Seconds() * t.cfg.Rate
+	if burst := float64(t.cfg.Burst); slot.tokens > burst {
+		slot.tokens = burst
+	}
+	slot.last = now
+
+	var summary uint64
+	if slot.suppressed > 0 && now.Sub(slot.lastSummary) >= t.cfg.SummaryInterval {
+		summary = slot.suppressed
+		slot.suppressed = 0
+		slot.lastSummary = now
+	}
+
+	if slot.tokens < 1 {
+		slot.suppressed++
+		t.suppressed.Add(1)
+		return false, summary
+	}
+	slot.tokens--
+	return true, summary
+}
+
+// hashKey is FNV-1a over both strings, computed without allocating
+func hashKey(event, containerID string) uint64 {
+	const (
+		offset = 14695981039346656037
+		prime  = 1099511628211
+	)
+	h := uint64(offset)
+	for i := 0; i < len(event); i++ {
+		h = (h ^ uint64(event[i])) * prime
+	}
+	h = (h ^ 0xff) * prime
+	for i := 0; i < len(containerID); i++ {
+		h = (h ^ uint64(containerID[i])) * prime
+	}
+	return h
+}
@@ -0,0 +1,38 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// BenchmarkLogThrottleAllow measures the datapath's cost of asking the
+// throttle whether to log, which must not allocate
+func BenchmarkLogThrottleAllow(b *testing.B) {
+	ids := make([]string, 4*throttleSlots)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("container-%d", i)
+	}
+	tests := []struct {
+		name string
+		keys int
+	}{
+		{name: "one key", keys: 1},
+		{name: "slots", keys: throttleSlots},
+		// Keys evict each other from their slots
+		{name: "evicting", keys: len(ids)},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			throttle := newLogThrottle(DefaultThrottleConfig(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+			now := time.Now()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				throttle.allow("drop", ids[i%tt.keys], now.Add(time.Duration(i)))
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrAnalyticsDisabled is returned by TopFlows unless flow analytics are
+// enabled
+var ErrAnalyticsDisabled = errors.New("network: flow analytics are not enabled")
+
+// Flow analytics defaults, see AnalyticsConfig
+const (
+	DefaultAnalyticsInterval = 10 * time.Second
+	DefaultAnalyticsWindow   = time.Minute
+	DefaultAnalyticsTopN     = 10
+)
+
+// AnalyticsConfig samples the counters of the flows the XDP router tracks,
+// ranking flows by their traffic over a sliding window, see TopFlows.
+// Like the counters, the traffic is that towards containers. Zero values
+// keep the defaults.
+type AnalyticsConfig struct {
+	Enable bool `json:"enable"`
+	// Interval is how often the flows are sampled
+	Interval time.Duration `json:"interval"`
+	// Window is how far back the traffic of the flows is summed, at least
+	// Interval
+	Window time.Duration `json:"window"`
+	// TopN is how many flows are ranked, per container and for the node
+	TopN int `json:"top_n"`
+}
+
+// withDefaults fills in unset values
+func (c AnalyticsConfig) withDefaults() AnalyticsConfig {
+	if c.Interval == 0 {
+		c.Interval = DefaultAnalyticsInterval
+	}
+	if c.Window == 0 {
+		c.Window = max(DefaultAnalyticsWindow, c.Interval)
+	}
+	if c.TopN == 0 {
+		c.TopN = DefaultAnalyticsTopN
+	}
+	return c
+}
+
+func (c AnalyticsConfig) validate() error {
+	if c.Interval < 0 || c.Window < 0 || c.TopN < 0 {
+		return fmt.Errorf("%w: analytics interval, window and top_n must not be negative", ErrInvalidConfig)
+	}
+	if c = c.withDefaults(); c.Window < c.Interval {
+		return fmt.Errorf("%w: analytics window %s is shorter than the interval %s", ErrInvalidConfig, c.Window, c.Interval)
+	}
+	return nil
+}
+
+// FlowRate is the traffic of a flow over the analytics window
+type FlowRate struct {
+	ContainerID string         `json:"container_id"`
+	Protocol    string         `json:"protocol"`
+	Src         netip.AddrPort `json:"src"`
+	Dst         netip.AddrPort `json:"dst"`
+	Packets     uint64         `json:"packets"`
+	Bytes       uint64         `json:"bytes"`
+	// PacketsPerSecond and BytesPerSecond average the traffic over the
+	// window
+	PacketsPerSecond float64 `json:"packets_per_second"`
+	BytesPerSecond   float64 `json:"bytes_per_second"`
+}
+
+// Talkers is the traffic of the node or a container over the analytics
+// window, and its flows with the most of it
+type Talkers struct {
+	Packets          uint64  `json:"packets"`
+	Bytes            uint64  `json:"bytes"`
+	PacketsPerSecond float64 `json:"packets_per_second"`
+	BytesPerSecond   float64 `json:"bytes_per_second"`
+	// Flows are the top flows by bytes, then packets
+	Flows []FlowRate `json:"flows"`
+}
+
+// TopFlows is the outcome of the latest flow sample
+type TopFlows struct {
+	// SampledAt is when the flows were sampled, zero before the second
+	// sample
+	SampledAt time.Time `json:"sampled_at"`
+	// Window is the time the traffic was summed over, shorter than
+	// AnalyticsConfig.Window until sampling ran that long
+	Window time.Duration `json:"window"`
+	Node   Talkers       `json:"node"`
+	// Containers holds the traffic of the containers with any, by
+	// container ID
+	Containers map[string]Talkers `json:"containers"`
+}
+
+// flowKey identifies a flow across samples
+type flowKey struct {
+	containerID string
+	protocol    string
+	src, dst    netip.AddrPort
+}
+
+// flowCounters are the packets and bytes of a flow
+type flowCounters struct {
+	packets, bytes uint64
+}
+
+// flowSample is the traffic of the flows with any since the sample at
+// from
+type flowSample struct {
+	from    time.Time
+	traffic map[flowKey]flowCounters
+}
+
+// flowAnalytics keeps the samples of the flows within the window and
+// ranks them after each sample
+type flowAnalytics struct {
+	config AnalyticsConfig
+
+	mu sync.Mutex
+	// last holds the counters of each flow at lastAt, the previous sample
+	last   map[flowKey]flowCounters
+	lastAt time.Time
+	// samples are the samples within the window, oldest first
+	samples []flowSample
+	top     TopFlows
+
+	// stop ends the sampling started by startAnalytics, which closes done
+	// once it returned
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newFlowAnalytics(config AnalyticsConfig) *flowAnalytics {
+	return &flowAnalytics{config: config, last: make(map[flowKey]flowCounters)}
+}
+
+// add records the counters of conns sampled at now. Flows seen for the
+// first time count in full when they started since the previous sample,
+// else only their traffic from now on.
+func (a *flowAnalytics) add(now time.Time, conns []Connection) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sample := flowSample{from: a.lastAt, traffic: make(map[flowKey]flowCounters)}
+	last := make(map[flowKey]flowCounters, len(conns))
+	for _, c := range conns {
+		k := flowKey{containerID: c.ContainerID, protocol: c.Protocol, src: c.Src, dst: c.Dst}
+		cur := flowCounters{packets: c.Packets, bytes: c.Bytes}
+		last[k] = cur
+		prev, seen := a.last[k]
+		switch {
+		case a.lastAt.IsZero(), !seen && c.Age > now.Sub(a.lastAt):
+			continue
+		case seen && cur.packets >= prev.packets && cur.bytes >= prev.bytes:
+			cur = flowCounters{packets: cur.packets - prev.packets, bytes: cur.bytes - prev.bytes}
+		}
+		// New flows, and those whose counters went back as they were
+		// tracked anew, count in full
+		if cur != (flowCounters{}) {
+			sample.traffic[k] = cur
+		}
+	}
+	first := a.lastAt.IsZero()
+	a.last, a.lastAt = last, now
+	if first {
+		return
+	}
+
+	a.samples = append(a.samples, sample)
+	// Samples are taken late by how long reading the flows took, which
+	// mustn't shorten the window by an interval
+	start := now.Add(-a.config.Window - a.config.Interval/2)
+	for len(a.samples) > 1 && a.samples[0].from.Before(start) {
+		a.samples = a.samples[1:]
+	}
+	a.top = a.rank()
+}
+
+// rank sums the traffic of the flows over the samples and ranks them.
+// Callers must hold a.mu.
+func (a *flowAnalytics) rank() TopFlows {
+	window := a.lastAt.Sub(a.samples[0].from)
+	totals := make(map[flowKey]flowCounters)
+	for _, s := range a.samples {
+		for k, c := range s.traffic {
+			t := totals[k]
+			totals[k] = flowCounters{packets: t.packets + c.packets, bytes: t.bytes + c.bytes}
+		}
+	}
+
+	rates := make([]FlowRate, 0, len(totals))
+	for k, t := range totals {
+		rates = append(rates, FlowRate{
+			ContainerID:      k.containerID,
+			Protocol:         k.protocol,
+			Src:              k.src,
+			Dst:              k.dst,
+			Packets:          t.packets,
+			Bytes:            t.bytes,
+			PacketsPerSecond: float64(t.packets) / window.Seconds(),
+			BytesPerSecond:   float64(t.bytes) / window.Seconds(),
+		})
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].busier(rates[j]) })
+
+	top := TopFlows{SampledAt: a.lastAt, Window: window, Containers: make(map[string]Talkers)}
+	for _, r := range rates {
+		top.Node.add(r, a.config.TopN)
+		t := top.Containers[r.ContainerID]
+		t.add(r, a.config.TopN)
+		top.Containers[r.ContainerID] = t
+	}
+	return top
+}
+
+// busier orders flows by bytes, then packets, then tuple, so rankings are
+// stable across samples
+func (r FlowRate) busier(o FlowRate) bool {
+	if r.Bytes != o.Bytes {
+		return r.Bytes > o.Bytes
+	}
+	if r.Packets != o.Packets {
+		return r.Packets > o.Packets
+	}
+	if r.ContainerID != o.ContainerID {
+		return r.ContainerID < o.ContainerID
+	}
+	if r.Protocol != o.Protocol {
+		return r.Protocol < o.Protocol
+	}
+	if r.Src != o.Src {
+		return lessAddrPort(r.Src, o.Src)
+	}
+	return lessAddrPort(r.Dst, o.Dst)
+}
+
+// add counts the traffic of r, ranking it among the top n flows when
+// there is room. Flows are added busiest first.
+func (t *Talkers) add(r FlowRate, n int) {
+	t.Packets += r.Packets
+	t.Bytes += r.Bytes
+	t.PacketsPerSecond += r.PacketsPerSecond
+	t.BytesPerSecond += r.BytesPerSecond
+	if len(t.Flows) < n {
+		t.Flows = append(t.Flows, r)
+	}
+}
+
+// limit returns t with its first n flows, all of them for n 0
+func (t Talkers) limit(n int) Talkers {
+	if n > 0 && len(t.Flows) > n {
+		t.Flows = t.Flows[:n]
+	}
+	t.Flows = append([]FlowRate(nil), t.Flows...)
+	return t
+}
+
+// TopFlows returns the flows with the most traffic over the analytics
+// window, of containerID or every container when it is empty, at most
+// limit of them per container and for the node, or AnalyticsConfig.TopN
+// for a limit of 0. The node's are those of containerID when set. Flows
+// are only tracked while XDP is attached; otherwise ErrXDPInactive is
+// returned.
+func (nm *NetworkManager) TopFlows(containerID string, limit int) (TopFlows, error) {
+	if nm.flows == nil {
+		return TopFlows{}, ErrAnalyticsDisabled
+	}
+	nm.mu.Lock()
+	_, ok := nm.containers[containerID]
+	active := nm.xdp != nil
+	nm.mu.Unlock()
+	if !active {
+		return TopFlows{}, ErrXDPInactive
+	}
+	if containerID != "" && !ok {
+		return TopFlows{}, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+	}
+
+	a := nm.flows
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	top := TopFlows{SampledAt: a.top.SampledAt, Window: a.top.Window, Containers: make(map[string]Talkers)}
+	if containerID != "" {
+		if t, ok := a.top.Containers[containerID]; ok {
+			top.Node = t.limit(limit)
+			top.Containers[containerID] = top.Node
+		}
+		return top, nil
+	}
+	top.Node = a.top.Node.limit(limit)
+	for id, t := range a.top.Containers {
+		top.Containers[id] = t.limit(limit)
+	}
+	return top, nil
+}
+
+// sampleFlows reads the counters of the tracked flows into the analytics.
+// Nothing is sampled while XDP is not attached.
+func (nm *NetworkManager) sampleFlows() error {
+	nm.mu.Lock()
+	if nm.xdp == nil {
+		nm.mu.Unlock()
+		return nil
+	}
+	owners := make(map[int]string, len(nm.containers))
+	for id, cn := range nm.containers {
+		if cn.HostIfindex != 0 {
+			owners[cn.HostIfindex] = id
+		}
+	}
+	conns, err := nm.readConnections(owners)
+	nm.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to read connections: %w", err)
+	}
+	nm.flows.add(time.Now(), conns)
+	return nil
+}
+
+// startAnalytics samples the flows every Analytics.Interval until
+// stopAnalytics is called
+func (nm *NetworkManager) startAnalytics() {
+	a := nm.flows
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(a.config.Interval)
+		defer ticker.Stop()
+		for {
+			if err := nm.sampleFlows(); err != nil {
+				nm.log.Warn("Failed to sample flows", "error", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopAnalytics waits for the sampling started by startAnalytics to end
+func (nm *NetworkManager) stopAnalytics() {
+	if nm.flows == nil || nm.flows.stop == nil {
+		return
+	}
+	close(nm.flows.stop)
+	<-nm.flows.done
+	nm.flows.stop = nil
+}
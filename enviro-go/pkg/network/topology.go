@@ -0,0 +1,192 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// TopologyPreference is how a service weighs its backends by where they
+// run relative to the node balancing a connection
+type TopologyPreference string
+
+const (
+	// TopologyAny balances across all backends alike
+	TopologyAny TopologyPreference = "any"
+	// TopologyPreferLocalNode balances across the backends on this node,
+	// adding those of its rack, then of its zone, then the rest while
+	// fewer than Service.MinLocalBackends are healthy
+	TopologyPreferLocalNode TopologyPreference = "prefer-local-node"
+	// TopologyPreferZone balances across the backends in this node's zone,
+	// adding the rest while fewer than Service.MinLocalBackends are healthy
+	TopologyPreferZone TopologyPreference = "prefer-zone"
+)
+
+// NodeTopology is where this node runs, for services preferring nearby
+// backends. Nodes without a zone find every remote backend cross-zone.
+type NodeTopology struct {
+	Zone string `json:"zone"`
+	Rack string `json:"rack"`
+}
+
+// Locality is where a service backend runs relative to this node
+type Locality string
+
+const (
+	// LocalityNode backends run on this node
+	LocalityNode Locality = "node"
+	// LocalityRack backends run on another node of this node's rack
+	LocalityRack Locality = "rack"
+	// LocalityZone backends run on another node of this node's zone
+	LocalityZone Locality = "zone"
+	// LocalityCrossZone backends run in another zone, or where the zone is
+	// unknown
+	LocalityCrossZone Locality = "cross_zone"
+)
+
+// Localities are the localities nearest first
+var Localities = []Locality{LocalityNode, LocalityRack, LocalityZone, LocalityCrossZone}
+
+// locality returns the locality of a backend on another node of zone and
+// rack
+func (t NodeTopology) locality(zone, rack string) Locality {
+	switch {
+	case t.Zone == "" || zone != t.Zone:
+		return LocalityCrossZone
+	case t.Rack != "" && rack == t.Rack:
+		return LocalityRack
+	default:
+		return LocalityZone
+	}
+}
+
+// RemoteBackend is a service backend on another node of the overlay,
+// which connections reach through it
+type RemoteBackend struct {
+	ContainerID string `json:"container_id"`
+	// Node, Zone and Rack are where the backend runs
+	Node string `json:"node"`
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+	// IPv4 and IPv6 are the backend's addresses; the one of the VIP's
+	// family is used
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+	// Unhealthy backends, e.g. on nodes missing heartbeats, only get
+	// connections while no backend of the service is healthy
+	Unhealthy bool `json:"unhealthy,omitempty"`
+}
+
+// validate checks the addresses of b
+func (b RemoteBackend) validate(service string) error {
+	if b.ContainerID == "" {
+		return fmt.Errorf("%w: service %s has a remote backend without a container ID", ErrInvalidService, service)
+	}
+	for _, a := range []struct {
+		addr string
+		is4  bool
+	}{{b.IPv4, true}, {b.IPv6, false}} {
+		if a.addr == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(a.addr)
+		if err != nil || addr.Is4() != a.is4 || addr.Zone() != "" {
+			return fmt.Errorf("%w: service %s: remote backend %s has invalid address %q", ErrInvalidService, service, b.ContainerID, a.addr)
+		}
+	}
+	return nil
+}
+
+// addr returns the address of b of the family of vip
+func (b RemoteBackend) addr(vip netip.Addr) (netip.Addr, bool) {
+	s := b.IPv6
+	if vip.Is4() {
+		s = b.IPv4
+	}
+	addr, err := netip.ParseAddr(s)
+	return addr, err == nil
+}
+
+// tiers groups the localities into the tiers p fills in turn
+func (p TopologyPreference) tiers() [][]Locality {
+	switch p {
+	case TopologyPreferLocalNode:
+		return [][]Locality{{LocalityNode}, {LocalityRack}, {LocalityZone}, {LocalityCrossZone}}
+	case TopologyPreferZone:
+		return [][]Locality{{LocalityNode, LocalityRack, LocalityZone}, {LocalityCrossZone}}
+	default:
+		return [][]Locality{Localities}
+	}
+}
+
+// preferredBackends returns the backends of a service with preference p
+// that connections are balanced across: the healthy ones, or all while
+// none is, of the nearest tiers of p holding at least min of them
+func preferredBackends(p TopologyPreference, min int, backends []serviceBackend) []serviceBackend {
+	healthy := slices.DeleteFunc(slices.Clone(backends), func(b serviceBackend) bool { return b.Unhealthy })
+	if len(healthy) > 0 {
+		backends = healthy
+	}
+	var out []serviceBackend
+	for _, tier := range p.tiers() {
+		if len(out) >= min && len(out) > 0 {
+			break
+		}
+		for _, b := range backends {
+			if slices.Contains(tier, b.Locality) {
+				out = append(out, b)
+			}
+		}
+	}
+	return out
+}
+
+// ServiceConnections counts the connections a service balanced by the
+// locality of the backend they went to, so traffic kept in the zone can
+// be told from traffic crossing zones
+type ServiceConnections struct {
+	Service string
+	// Connections sums those of Ports
+	Connections map[Locality]uint64
+	Ports       []PortConnections
+}
+
+// PortConnections counts the connections to a port of a service, like
+// ServiceConnections
+type PortConnections struct {
+	Port        ServicePort
+	Connections map[Locality]uint64
+}
+
+// servicePort is a port of a service by name
+type servicePort struct {
+	Service, Port string
+}
+
+// ServiceConnections returns the connection counts of the services
+// ordered by name, and of their ports in order. Counts start when the
+// service or port is created, or the manager.
+func (nm *NetworkManager) ServiceConnections() ([]ServiceConnections, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	counts, err := nm.readServiceCounters()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ServiceConnections, 0, len(nm.services))
+	for _, s := range nm.sortedServices() {
+		c := ServiceConnections{Service: s.Name, Connections: make(map[Locality]uint64, len(Localities))}
+		for _, p := range s.Ports {
+			pc := PortConnections{Port: p, Connections: make(map[Locality]uint64, len(Localities))}
+			for _, l := range Localities {
+				n := counts[servicePort{Service: s.Name, Port: p.Name}][l]
+				pc.Connections[l] = n
+				c.Connections[l] += n
+			}
+			c.Ports = append(c.Ports, pc)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
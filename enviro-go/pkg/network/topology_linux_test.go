@@ -0,0 +1,140 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// serviceTestEnv has a child of TestServiceConnections run the test in
+// the network namespace of its own it was started in
+const serviceTestEnv = "ENVIRO_TEST_SERVICE_CONNECTIONS"
+
+// TestServiceConnections connects to a service, on its VIP and its node
+// port, and checks the connections are counted by the locality of their
+// backend, across rebuilds of the service table. It runs in a child in a
+// network namespace of its own, so the manager's bridge and rules stay
+// off the host.
+func TestServiceConnections(t *testing.T) {
+	if os.Getenv(serviceTestEnv) != "" {
+		runServiceConnections(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating container networks needs root")
+	}
+	runInNetns(t, serviceTestEnv)
+}
+
+func runServiceConnections(t *testing.T) {
+	ctx := context.Background()
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:     "10.99.0.0/24",
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Topology: NodeTopology{Zone: "a", Rack: "r1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+	if _, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "near", NetnsPath: containerNetns(t)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connections from the node are translated in the output chain, once
+	// routed to the VIP
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		t.Fatal(err)
+	}
+	vip, _ := netlink.ParseAddr("10.96.0.10/32")
+	if err := netlink.AddrAdd(lo, vip); err != nil {
+		t.Fatal(err)
+	}
+	connect := func(port string, n int) {
+		for i := 0; i < n; i++ {
+			if conn, err := net.DialTimeout("tcp", net.JoinHostPort("10.96.0.10", port), 50*time.Millisecond); err == nil {
+				conn.Close()
+			}
+		}
+	}
+	far := RemoteBackend{ContainerID: "far", Node: "n2", Zone: "b", Rack: "r1", IPv4: "10.99.0.250"}
+
+	steps := []struct {
+		name    string
+		service Service
+		port    string
+		connect int
+		want    map[Locality]uint64
+	}{
+		{
+			name: "local node preferred",
+			service: Service{Name: "web", VIP: "10.96.0.10", Port: 80, Backends: []string{"near"},
+				RemoteBackends: []RemoteBackend{far}, Topology: TopologyPreferLocalNode},
+			port:    "80",
+			connect: 10,
+			want:    map[Locality]uint64{LocalityNode: 10},
+		},
+		{
+			name: "spilled to the other zone",
+			service: Service{Name: "web", VIP: "10.96.0.10", Port: 80,
+				RemoteBackends: []RemoteBackend{far}, Topology: TopologyPreferLocalNode},
+			port:    "80",
+			connect: 5,
+			want:    map[Locality]uint64{LocalityNode: 10, LocalityCrossZone: 5},
+		},
+		{
+			// The VIP is a local address too, so the node port answers on it
+			name: "node port",
+			service: Service{Name: "web", VIP: "10.96.0.10", Port: 80, Backends: []string{"near"},
+				ExposeNodePort: true, NodePort: 30080},
+			port:    "30080",
+			connect: 5,
+			want:    map[Locality]uint64{LocalityNode: 15, LocalityCrossZone: 5},
+		},
+	}
+	for _, step := range steps {
+		if _, err := nm.PutService(step.service); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		connect(step.port, step.connect)
+		conns, err := nm.ServiceConnections()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conns) != 1 || conns[0].Service != "web" {
+			t.Fatalf("%s: connections %+v, want those of web", step.name, conns)
+		}
+		for _, l := range Localities {
+			if got := conns[0].Connections[l]; got != step.want[l] {
+				t.Errorf("%s: %d connections to %s backends, want %d", step.name, got, l, step.want[l])
+			}
+		}
+	}
+
+	// Counts end with the service
+	if err := nm.DeleteService("web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nm.CreateService(steps[0].service); err != nil {
+		t.Fatal(err)
+	}
+	conns, err := nm.ServiceConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conns[0].Connections[LocalityNode]; got != 0 {
+		t.Errorf("recreated service starts with %d connections", got)
+	}
+}
@@ -0,0 +1,117 @@
+package network
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNodeTopologyLocality(t *testing.T) {
+	tests := []struct {
+		name       string
+		topology   NodeTopology
+		zone, rack string
+		want       Locality
+	}{
+		{name: "same rack", topology: NodeTopology{Zone: "a", Rack: "r1"}, zone: "a", rack: "r1", want: LocalityRack},
+		{name: "other rack", topology: NodeTopology{Zone: "a", Rack: "r1"}, zone: "a", rack: "r2", want: LocalityZone},
+		{name: "no racks", topology: NodeTopology{Zone: "a"}, zone: "a", want: LocalityZone},
+		{name: "other zone", topology: NodeTopology{Zone: "a", Rack: "r1"}, zone: "b", rack: "r1", want: LocalityCrossZone},
+		{name: "unknown zone", topology: NodeTopology{Zone: "a"}, want: LocalityCrossZone},
+		{name: "no zone", zone: "a", want: LocalityCrossZone},
+		{name: "neither zone", want: LocalityCrossZone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.topology.locality(tt.zone, tt.rack); got != tt.want {
+				t.Errorf("locality(%q, %q) = %s, want %s", tt.zone, tt.rack, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreferredBackends(t *testing.T) {
+	node := serviceBackend{ContainerID: "node", Locality: LocalityNode}
+	rack := serviceBackend{ContainerID: "rack", Locality: LocalityRack}
+	zone := serviceBackend{ContainerID: "zone", Locality: LocalityZone}
+	cross := serviceBackend{ContainerID: "cross", Locality: LocalityCrossZone}
+	sick := func(b serviceBackend) serviceBackend {
+		b.ContainerID += "-unhealthy"
+		b.Unhealthy = true
+		return b
+	}
+	all := []serviceBackend{node, rack, zone, cross}
+	tests := []struct {
+		name       string
+		preference TopologyPreference
+		min        int
+		backends   []serviceBackend
+		want       []string
+	}{
+		{name: "any", preference: TopologyAny, min: 1, backends: all, want: []string{"node", "rack", "zone", "cross"}},
+		{name: "local node", preference: TopologyPreferLocalNode, min: 1, backends: all, want: []string{"node"}},
+		{name: "local node spills to rack", preference: TopologyPreferLocalNode, min: 2, backends: all, want: []string{"node", "rack"}},
+		{name: "local node spills past zone", preference: TopologyPreferLocalNode, min: 4, backends: all, want: []string{"node", "rack", "zone", "cross"}},
+		{name: "no local node", preference: TopologyPreferLocalNode, min: 1, backends: []serviceBackend{zone, cross}, want: []string{"zone"}},
+		{name: "unhealthy local node", preference: TopologyPreferLocalNode, min: 1,
+			backends: []serviceBackend{sick(node), zone, cross}, want: []string{"zone"}},
+		{name: "zone", preference: TopologyPreferZone, min: 1, backends: all, want: []string{"node", "rack", "zone"}},
+		{name: "zone spills", preference: TopologyPreferZone, min: 4, backends: all, want: []string{"node", "rack", "zone", "cross"}},
+		{name: "no zone", preference: TopologyPreferZone, min: 1, backends: []serviceBackend{cross}, want: []string{"cross"}},
+		{name: "none healthy", preference: TopologyPreferZone, min: 1,
+			backends: []serviceBackend{sick(zone), sick(cross)}, want: []string{"zone-unhealthy"}},
+		{name: "min zero", preference: TopologyPreferLocalNode, backends: []serviceBackend{rack, cross}, want: []string{"rack"}},
+		{name: "no backends", preference: TopologyPreferLocalNode, min: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, b := range preferredBackends(tt.preference, tt.min, tt.backends) {
+				got = append(got, b.ContainerID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("preferredBackends() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceValidateTopology(t *testing.T) {
+	base := Service{Name: "web", VIP: "10.96.0.10", Port: 80, Backends: []string{"c1"}}
+	tests := []struct {
+		name    string
+		modify  func(*Service)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(*Service) {}},
+		{name: "prefer local node", modify: func(s *Service) { s.Topology, s.MinLocalBackends = TopologyPreferLocalNode, 2 }},
+		{name: "remote backend", modify: func(s *Service) {
+			s.RemoteBackends = []RemoteBackend{{ContainerID: "c2", Node: "n2", IPv4: "10.88.1.2", IPv6: "fd00::2"}}
+		}},
+		{name: "unknown topology", modify: func(s *Service) { s.Topology = "prefer-rack" }, wantErr: true},
+		{name: "negative min", modify: func(s *Service) { s.MinLocalBackends = -1 }, wantErr: true},
+		{name: "min over max", modify: func(s *Service) { s.MinLocalBackends = maxServiceBackends + 1 }, wantErr: true},
+		{name: "remote backend without ID", modify: func(s *Service) {
+			s.RemoteBackends = []RemoteBackend{{IPv4: "10.88.1.2"}}
+		}, wantErr: true},
+		{name: "remote backend of wrong family", modify: func(s *Service) {
+			s.RemoteBackends = []RemoteBackend{{ContainerID: "c2", IPv4: "fd00::2"}}
+		}, wantErr: true},
+		{name: "backend local and remote", modify: func(s *Service) {
+			s.RemoteBackends = []RemoteBackend{{ContainerID: "c1", IPv4: "10.88.1.2"}}
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := base
+			tt.modify(&s)
+			err := s.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidService) {
+				t.Errorf("Validate() = %v, want ErrInvalidService", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+//go:build linux && bpfobj
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// ipFrame returns an Ethernet frame of size bytes carrying a packet of
+// proto from src to dst, its payload zeroed
+func ipFrame(src, dst netip.Addr, proto uint8, size int) []byte {
+	frame := make([]byte, size)
+	l4 := frame[14:]
+	if src.Is4() {
+		binary.BigEndian.PutUint16(frame[12:], unix.ETH_P_IP)
+		ip := frame[14:34]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(size-14))
+		ip[8] = 64
+		ip[9] = proto
+		copy(ip[12:], src.AsSlice())
+		copy(ip[16:], dst.AsSlice())
+		l4 = frame[34:]
+	} else {
+		binary.BigEndian.PutUint16(frame[12:], unix.ETH_P_IPV6)
+		ip := frame[14:54]
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(size-54))
+		ip[6] = proto
+		ip[7] = 64
+		copy(ip[8:], src.AsSlice())
+		copy(ip[24:], dst.AsSlice())
+		l4 = frame[54:]
+	}
+	switch proto {
+	case unix.IPPROTO_TCP:
+		binary.BigEndian.PutUint16(l4[0:], 40000)
+		binary.BigEndian.PutUint16(l4[2:], 80)
+		l4[12] = 5 << 4
+		l4[13] = tcpACK
+	case unix.IPPROTO_UDP:
+		binary.BigEndian.PutUint16(l4[0:], 40000)
+		binary.BigEndian.PutUint16(l4[2:], 53)
+		binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+	case unix.IPPROTO_ICMP:
+		l4[0] = 8
+	case unix.IPPROTO_ICMPV6:
+		l4[0] = 128
+	}
+	return frame
+}
+
+// TestTraffic runs a known mix of protocols and sizes to a container
+// through the router and from it through the source check, and checks the
+// breakdown it lands in
+func TestTraffic(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		t.Fatal(err)
+	}
+	trimPrograms(spec, []DatapathMode{DatapathXDPNative, DatapathTC})
+	coll, err := ebpf.NewCollection(spec)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("loading eBPF not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(coll.Close)
+	x := &xdpProgram{mode: DatapathXDPNative}
+	x.setCollection(coll)
+	if !x.hasTraffic() {
+		t.Fatal("router loaded without the traffic breakdown")
+	}
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	hostMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	own4, own6 := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::2")
+	peer4, peer6 := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")
+	if err := x.AddContainer(testIfindex, []netip.Addr{own4, own6}, mac, hostMAC, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.SetSources(testIfindex, mac, []netip.Prefix{netip.PrefixFrom(own4, 32), netip.PrefixFrom(own6, 128)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		src, dst netip.Addr
+		proto    uint8
+		size     int
+		egress   bool
+		// protocol is the index in TrafficProtocols and bucket the
+		// SizeHistogram bucket the packet is counted in
+		protocol, bucket int
+	}{
+		{name: "TCP ACK", src: peer4, dst: own4, proto: unix.IPPROTO_TCP, size: 60, protocol: 0, bucket: 0},
+		{name: "TCP segment", src: peer4, dst: own4, proto: unix.IPPROTO_TCP, size: 1500, protocol: 0, bucket: 5},
+		{name: "TCP over IPv6", src: peer6, dst: own6, proto: unix.IPPROTO_TCP, size: 1000, protocol: 0, bucket: 4},
+		{name: "UDP", src: peer4, dst: own4, proto: unix.IPPROTO_UDP, size: 100, protocol: 1, bucket: 1},
+		{name: "ICMP", src: peer4, dst: own4, proto: unix.IPPROTO_ICMP, size: 98, protocol: 2, bucket: 1},
+		{name: "ICMPv6", src: peer6, dst: own6, proto: unix.IPPROTO_ICMPV6, size: 118, protocol: 2, bucket: 1},
+		{name: "GRE", src: peer4, dst: own4, proto: unix.IPPROTO_GRE, size: 300, protocol: 3, bucket: 3},
+		{name: "egress TCP", src: own4, dst: peer4, proto: unix.IPPROTO_TCP, size: 2000, egress: true, protocol: 0, bucket: 5},
+		{name: "egress UDP", src: own6, dst: peer6, proto: unix.IPPROTO_UDP, size: 64, egress: true, protocol: 1, bucket: 1},
+		{name: "egress ICMP", src: own4, dst: peer4, proto: unix.IPPROTO_ICMP, size: 42, egress: true, protocol: 2, bucket: 0},
+	}
+	var want trafficStats
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := ipFrame(tt.src, tt.dst, tt.proto, tt.size)
+			program, dir := routerProgram, trafficIngress
+			if tt.egress {
+				program, dir = sourceProgram, trafficEgress
+				frame = withMAC(frame, mac)
+			}
+			if _, _, err := x.coll.Programs[program].Test(frame); err != nil {
+				t.Fatal(err)
+			}
+			c := &want.Dirs[dir].Protos[tt.protocol]
+			c.Packets++
+			c.Bytes += uint64(tt.size)
+			want.Dirs[dir].Sizes[tt.bucket]++
+		})
+	}
+
+	got, err := x.ContainerTraffic(testIfindex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("breakdown %+v, want %+v", got, want)
+	}
+
+	// The breakdown goes with the container
+	if err := x.DeleteContainer(testIfindex, []netip.Addr{own4, own6}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.ContainerTraffic(testIfindex); !errors.Is(err, ebpf.ErrKeyNotExist) {
+		t.Errorf("breakdown after DeleteContainer: %v, want ErrKeyNotExist", err)
+	}
+}
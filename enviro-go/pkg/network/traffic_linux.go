@@ -0,0 +1,143 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// Directions of trafficStats, mirroring TRAFFIC_INGRESS and TRAFFIC_EGRESS
+const (
+	trafficIngress = iota
+	trafficEgress
+)
+
+// trafficCounter mirrors struct traffic_counter in bpf/container_router.c
+type trafficCounter struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// trafficDir mirrors struct traffic_dir, with protocols in the order of
+// TrafficProtocols
+type trafficDir struct {
+	Protos [len(TrafficProtocols)]trafficCounter
+	Sizes  [SizeBuckets]uint64
+}
+
+// trafficStats mirrors struct traffic_stats
+type trafficStats struct {
+	Dirs [2]trafficDir
+}
+
+func (t *trafficStats) add(o trafficStats) {
+	for d := range t.Dirs {
+		for p, c := range o.Dirs[d].Protos {
+			t.Dirs[d].Protos[p].Packets += c.Packets
+			t.Dirs[d].Protos[p].Bytes += c.Bytes
+		}
+		for i, n := range o.Dirs[d].Sizes {
+			t.Dirs[d].Sizes[i] += n
+		}
+	}
+}
+
+// fill sets the protocol counters of t in stats, by TrafficStatKey
+func (t trafficStats) fill(stats map[string]uint64) {
+	for d, dir := range []Direction{DirectionIngress, DirectionEgress} {
+		for p, proto := range TrafficProtocols {
+			stats[TrafficStatKey(dir, proto, "packets")] = t.Dirs[d].Protos[p].Packets
+			stats[TrafficStatKey(dir, proto, "bytes")] = t.Dirs[d].Protos[p].Bytes
+		}
+	}
+}
+
+// sizes returns the packet size histograms of t
+func (t trafficStats) sizes() PacketSizes {
+	histogram := func(d trafficDir) SizeHistogram {
+		h := SizeHistogram{Buckets: d.Sizes}
+		for _, c := range d.Protos {
+			h.Packets += c.Packets
+			h.Bytes += c.Bytes
+		}
+		return h
+	}
+	return PacketSizes{Ingress: histogram(t.Dirs[trafficIngress]), Egress: histogram(t.Dirs[trafficEgress])}
+}
+
+// hasTraffic reports whether the router breaks the traffic of containers
+// down
+func (x *xdpProgram) hasTraffic() bool {
+	return x.containerTraffic != nil
+}
+
+// ContainerTraffic returns the traffic breakdown of the container behind
+// ifindex summed across CPUs
+func (x *xdpProgram) ContainerTraffic(ifindex int) (trafficStats, error) {
+	var perCPU []trafficStats
+	if err := x.containerTraffic.Lookup(uint32(ifindex), &perCPU); err != nil {
+		return trafficStats{}, err
+	}
+	var total trafficStats
+	for _, t := range perCPU {
+		total.add(t)
+	}
+	return total, nil
+}
+
+// addTraffic creates the zeroed traffic breakdown of the container behind
+// ifindex, keeping the one it has when keep is set
+func (x *xdpProgram) addTraffic(ifindex int, keep bool) error {
+	flags := ebpf.UpdateAny
+	if keep {
+		flags = ebpf.UpdateNoExist
+	}
+	err := x.containerTraffic.Update(uint32(ifindex), []trafficStats{{}}, flags)
+	if keep && errors.Is(err, ebpf.ErrKeyExist) {
+		return nil
+	}
+	return err
+}
+
+// syncTraffic creates the traffic breakdown of the containers lacking one,
+// e.g. after an upgrade to a router with the map. Callers must hold nm.mu.
+func (nm *NetworkManager) syncTraffic() error {
+	if !nm.xdp.hasTraffic() {
+		return nil
+	}
+	var errs []error
+	for id, cn := range nm.containers {
+		if cn.Rootless || cn.Attachment.direct() {
+			continue
+		}
+		if err := nm.xdp.addTraffic(cn.HostIfindex, true); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readPacketSizes fills snap from the router's traffic breakdown for
+// containers, clones taken under nm.mu
+func (nm *NetworkManager) readPacketSizes(containers []*ContainerNetwork, snap *PacketSizeSnapshot) error {
+	if !nm.xdp.hasTraffic() {
+		return fmt.Errorf("%w: router has no traffic breakdown", ErrInvalidDatapath)
+	}
+	for _, cn := range containers {
+		t, err := nm.xdp.ContainerTraffic(cn.HostIfindex)
+		if err != nil {
+			nm.mu.Lock()
+			_, ok := nm.containers[cn.ContainerID]
+			nm.mu.Unlock()
+			if !ok {
+				continue
+			}
+			return fmt.Errorf("failed to read packet sizes for %s: %w", cn.ContainerID, err)
+		}
+		snap.Containers[cn.ContainerID] = t.sizes()
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package network
+
+import "testing"
+
+func TestTrafficStats(t *testing.T) {
+	var total trafficStats
+	// Two CPUs' share of the breakdown
+	for _, cpu := range []trafficStats{
+		{Dirs: [2]trafficDir{
+			trafficIngress: {Protos: [len(TrafficProtocols)]trafficCounter{{Packets: 2, Bytes: 3000}}, Sizes: [SizeBuckets]uint64{5: 2}},
+			trafficEgress:  {Protos: [len(TrafficProtocols)]trafficCounter{1: {Packets: 1, Bytes: 100}}, Sizes: [SizeBuckets]uint64{1: 1}},
+		}},
+		{Dirs: [2]trafficDir{
+			trafficIngress: {Protos: [len(TrafficProtocols)]trafficCounter{2: {Packets: 1, Bytes: 60}}, Sizes: [SizeBuckets]uint64{1}},
+		}},
+	} {
+		total.add(cpu)
+	}
+
+	stats := make(map[string]uint64)
+	total.fill(stats)
+	tests := []struct {
+		key  string
+		want uint64
+	}{
+		{"ingress_tcp_packets", 2},
+		{"ingress_tcp_bytes", 3000},
+		{"ingress_icmp_packets", 1},
+		{"ingress_udp_packets", 0},
+		{"egress_udp_bytes", 100},
+		{"egress_other_packets", 0},
+	}
+	for _, tt := range tests {
+		if got, ok := stats[tt.key]; !ok || got != tt.want {
+			t.Errorf("%s = %d (set %t), want %d", tt.key, got, ok, tt.want)
+		}
+	}
+	if len(stats) != 2*len(TrafficProtocols)*2 {
+		t.Errorf("%d keys filled, want %d", len(stats), 2*len(TrafficProtocols)*2)
+	}
+
+	sizes := total.sizes()
+	want := PacketSizes{
+		Ingress: SizeHistogram{Packets: 3, Bytes: 3060, Buckets: [SizeBuckets]uint64{0: 1, 5: 2}},
+		Egress:  SizeHistogram{Packets: 1, Bytes: 100, Buckets: [SizeBuckets]uint64{1: 1}},
+	}
+	if sizes != want {
+		t.Errorf("sizes %+v, want %+v", sizes, want)
+	}
+}
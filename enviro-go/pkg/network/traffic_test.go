@@ -0,0 +1,54 @@
+package network
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTrafficStatKey(t *testing.T) {
+	tests := []struct {
+		dir            Direction
+		protocol, unit string
+		want           string
+	}{
+		{DirectionIngress, "udp", "packets", "ingress_udp_packets"},
+		{DirectionEgress, "tcp", "bytes", "egress_tcp_bytes"},
+		{DirectionEgress, "icmp", "packets", "egress_icmp_packets"},
+	}
+	for _, tt := range tests {
+		if got := TrafficStatKey(tt.dir, tt.protocol, tt.unit); got != tt.want {
+			t.Errorf("TrafficStatKey(%s, %s, %s) = %q, want %q", tt.dir, tt.protocol, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	bounds := SizeHistogram{}.UpperBounds()
+	if len(bounds) != SizeBuckets-1 {
+		t.Fatalf("%d upper bounds, want %d", len(bounds), SizeBuckets-1)
+	}
+	tests := []struct {
+		bucket int
+		want   uint64
+	}{
+		{0, 64},
+		{1, 128},
+		{4, 1024},
+		{SizeBuckets - 2, 65536},
+	}
+	for _, tt := range tests {
+		if bounds[tt.bucket] != tt.want {
+			t.Errorf("bucket %d bounded by %d, want %d", tt.bucket, bounds[tt.bucket], tt.want)
+		}
+	}
+	if !slices.IsSorted(bounds) {
+		t.Errorf("upper bounds not ascending: %v", bounds)
+	}
+
+	h := SizeHistogram{Packets: 1, Bytes: 60, Buckets: [SizeBuckets]uint64{1}}
+	h.add(SizeHistogram{Packets: 2, Bytes: 3000, Buckets: [SizeBuckets]uint64{5: 2}})
+	want := SizeHistogram{Packets: 3, Bytes: 3060, Buckets: [SizeBuckets]uint64{0: 1, 5: 2}}
+	if h != want {
+		t.Errorf("sum %+v, want %+v", h, want)
+	}
+}
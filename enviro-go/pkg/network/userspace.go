@@ -0,0 +1,297 @@
+package network
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// Without XDP, a userspace forwarder can stand in for the router on the
+// IPv4 traffic arriving on NetworkConfig.Interface, see DatapathUserspace.
+// This file holds what it does to packets, which it handles as Ethernet
+// frames; userspace_linux.go moves them.
+
+// Header lengths of the frames the forwarder handles. IPv4 headers with
+// options are longer, and left alone where they would have to be
+// rewritten, like the router does.
+const (
+	ethHdrLen  = 14
+	ipv4HdrLen = 20
+	tcpHdrLen  = 20
+	icmpHdrLen = 8
+	// icmpQuote is what ICMP errors quote of the offending packet: its IP
+	// header and the first 8 bytes of its payload, which hold the ports
+	icmpQuote = ipv4HdrLen + 8
+)
+
+// IPv4 flags, and the fragment offset they share a field with
+const (
+	ipv4DF         = 0x4000
+	ipv4MF         = 0x2000
+	ipv4OffsetMask = 0x1fff
+)
+
+// TCP header flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpACK = 0x10
+)
+
+// ICMP Destination Unreachable and the codes the forwarder answers with
+const (
+	icmpDestUnreach = 3
+	icmpFragNeeded  = 4
+	// icmpPktFiltered is communication administratively prohibited
+	icmpPktFiltered = 13
+)
+
+// userspaceCounter indexes userspaceCounters
+type userspaceCounter int
+
+// Counters of the userspace forwarder, with the meaning of the XDP
+// router's of the same key
+const (
+	usPackets userspaceCounter = iota
+	usBytes
+	usDrops
+	usRedirects
+	usFragNeeded
+	usRejects
+	usPolicyChecks
+	usCounters
+)
+
+// userspaceStatKeys are the keys of GetStats the counters add to
+var userspaceStatKeys = [usCounters]string{
+	usPackets:      "packets_processed",
+	usBytes:        "bytes_processed",
+	usDrops:        "drop_count",
+	usRedirects:    "redirect_count",
+	usFragNeeded:   "frag_needed_count",
+	usRejects:      "reject_count",
+	usPolicyChecks: "policy_packet_checks",
+}
+
+// userspaceCounters are the counters of the forwarder, for the node or a
+// container
+type userspaceCounters [usCounters]atomic.Uint64
+
+// fill adds the counters to stats
+func (c *userspaceCounters) fill(stats map[string]uint64) {
+	for i, key := range userspaceStatKeys {
+		stats[key] += c[i].Load()
+	}
+}
+
+// rejectLimiter is a token bucket like reject_allowed of the router,
+// letting through rate rejects a second and at most rate at once
+type rejectLimiter struct {
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token for answering a rejected packet at now, failing
+// when there is none left
+func (l *rejectLimiter) allow(now time.Time) bool {
+	if l.last.IsZero() {
+		l.tokens = float64(l.rate)
+	} else {
+		l.tokens = min(float64(l.rate), l.tokens+now.Sub(l.last).Seconds()*float64(l.rate))
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// checksum adds b to the one's complement sum
+func checksum(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// foldChecksum folds sum into 16 bits and complements it
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pseudoChecksum sums the pseudo-header of an IPv4 segment of proto and
+// length, from the addresses of the IP header ip
+func pseudoChecksum(ip []byte, proto uint8, length int) uint32 {
+	sum := checksum(0, ip[12:20])
+	return sum + uint32(proto) + uint32(length)
+}
+
+// l4Port returns the destination port of a TCP or UDP packet, 0 for other
+// protocols, fragments past the first and packets too short to hold one
+func l4Port(ip []byte) uint16 {
+	proto := ip[9]
+	if proto != 6 && proto != 17 || binary.BigEndian.Uint16(ip[6:])&ipv4OffsetMask != 0 {
+		return 0
+	}
+	ihl := int(ip[0]&0xf) * 4
+	if len(ip) < ihl+4 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(ip[ihl+2:])
+}
+
+// opensTCP reports whether ip is a SYN opening a TCP connection, which a
+// draining container refuses
+func opensTCP(ip []byte) bool {
+	ihl := int(ip[0]&0xf) * 4
+	if ip[9] != 6 || len(ip) < ihl+tcpHdrLen {
+		return false
+	}
+	flags := ip[ihl+13]
+	return flags&tcpSYN != 0 && flags&tcpACK == 0
+}
+
+// replyFrame returns a frame of size bytes answering frame, addressed
+// back to its sender from its destination, with the IPv4 header of an
+// IP payload of proto filled in
+func replyFrame(frame []byte, size int, proto uint8) []byte {
+	reply := make([]byte, size)
+	copy(reply[0:6], frame[6:12])
+	copy(reply[6:12], frame[0:6])
+	binary.BigEndian.PutUint16(reply[12:], 0x0800)
+
+	ip, orig := reply[ethHdrLen:], frame[ethHdrLen:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(size-ethHdrLen))
+	ip[8] = 64
+	ip[9] = proto
+	copy(ip[12:16], orig[16:20])
+	copy(ip[16:20], orig[12:16])
+	binary.BigEndian.PutUint16(ip[10:], foldChecksum(checksum(0, ip[:ipv4HdrLen])))
+	return reply
+}
+
+// resetFrame returns the TCP reset answering the segment in frame, like
+// reset4 of the router: a segment with an ACK is answered from its
+// acknowledgment number, and one without is acknowledged instead. It
+// returns nil for resets, which are never answered, and for segments with
+// IP options.
+func resetFrame(frame []byte) []byte {
+	ip := frame[ethHdrLen:]
+	if len(ip) < ipv4HdrLen+tcpHdrLen || ip[0]&0xf != 5 {
+		return nil
+	}
+	tcp := ip[ipv4HdrLen:]
+	flags := tcp[13]
+	if flags&tcpRST != 0 {
+		return nil
+	}
+
+	reply := replyFrame(frame, ethHdrLen+ipv4HdrLen+tcpHdrLen, 6)
+	rip := reply[ethHdrLen:]
+	r := rip[ipv4HdrLen:]
+	copy(r[0:2], tcp[2:4])
+	copy(r[2:4], tcp[0:2])
+	r[12] = tcpHdrLen / 4 << 4
+	if flags&tcpACK != 0 {
+		copy(r[4:8], tcp[8:12])
+		r[13] = tcpRST
+	} else {
+		// SYN and FIN take a sequence number each
+		payload := int(binary.BigEndian.Uint16(ip[2:])) - ipv4HdrLen - int(tcp[12]>>4)*4
+		ack := binary.BigEndian.Uint32(tcp[4:]) + uint32(payload)
+		if flags&tcpSYN != 0 {
+			ack++
+		}
+		if flags&tcpFIN != 0 {
+			ack++
+		}
+		binary.BigEndian.PutUint32(r[8:], ack)
+		r[13] = tcpRST | tcpACK
+	}
+	sum := checksum(pseudoChecksum(rip, 6, tcpHdrLen), r[:tcpHdrLen])
+	binary.BigEndian.PutUint16(r[16:], foldChecksum(sum))
+	return reply
+}
+
+// unreachFrame returns the ICMP Destination Unreachable error with code
+// answering the packet in frame, like unreach4 of the router, advertising
+// mtu for icmpFragNeeded. It returns nil for packets with IP options.
+func unreachFrame(frame []byte, code uint8, mtu int) []byte {
+	ip := frame[ethHdrLen:]
+	if len(ip) < icmpQuote || ip[0]&0xf != 5 {
+		return nil
+	}
+	reply := replyFrame(frame, ethHdrLen+ipv4HdrLen+icmpHdrLen+icmpQuote, 1)
+	icmp := reply[ethHdrLen+ipv4HdrLen:]
+	icmp[0] = icmpDestUnreach
+	icmp[1] = code
+	binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+	copy(icmp[icmpHdrLen:], ip[:icmpQuote])
+	binary.BigEndian.PutUint16(icmp[2:], foldChecksum(checksum(0, icmp)))
+	return reply
+}
+
+// completeChecksum writes the transport checksum a sender left to the
+// hardware: the sum from start to the end of frame goes at offset from
+// start, where the sender put that of the pseudo-header. A UDP checksum
+// of 0 would mean none and is sent as 0xffff instead, like the kernel's
+// skb_checksum_help. It returns false for offsets past the frame.
+func completeChecksum(frame []byte, start, offset int) bool {
+	if start+offset+2 > len(frame) {
+		return false
+	}
+	sum := foldChecksum(checksum(0, frame[start:]))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(frame[start+offset:], sum)
+	return true
+}
+
+// fragmentFrame splits the IPv4 packet in frame into frames whose IP
+// packets are at most mtu bytes, as a router must before sending on a
+// link with a smaller MTU. Fragments of a fragment keep its offset and
+// last one its more fragments flag. It returns nil for packets with IP
+// options, which would have to be filtered for every fragment after the
+// first.
+func fragmentFrame(frame []byte, mtu int) [][]byte {
+	ip := frame[ethHdrLen:]
+	if len(ip) < ipv4HdrLen || ip[0]&0xf != 5 || mtu < ipv4HdrLen+8 {
+		return nil
+	}
+	total := min(int(binary.BigEndian.Uint16(ip[2:])), len(ip))
+	payload := ip[ipv4HdrLen:total]
+	field := binary.BigEndian.Uint16(ip[6:])
+	offset, more := field&ipv4OffsetMask, field&ipv4MF
+
+	step := (mtu - ipv4HdrLen) &^ 7
+	var frames [][]byte
+	for start := 0; start < len(payload); start += step {
+		end := min(start+step, len(payload))
+		f := make([]byte, ethHdrLen+ipv4HdrLen+end-start)
+		copy(f, frame[:ethHdrLen+ipv4HdrLen])
+		copy(f[ethHdrLen+ipv4HdrLen:], payload[start:end])
+
+		fip := f[ethHdrLen:]
+		binary.BigEndian.PutUint16(fip[2:], uint16(ipv4HdrLen+end-start))
+		flags := field&^(ipv4MF|ipv4OffsetMask) | more
+		if end < len(payload) {
+			flags |= ipv4MF
+		}
+		binary.BigEndian.PutUint16(fip[6:], flags|(offset+uint16(start/8)))
+		fip[10], fip[11] = 0, 0
+		binary.BigEndian.PutUint16(fip[10:], foldChecksum(checksum(0, fip[:ipv4HdrLen])))
+		frames = append(frames, f)
+	}
+	return frames
+}
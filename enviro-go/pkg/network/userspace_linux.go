@@ -0,0 +1,555 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nftUserspaceTable is the ip table dropping the kernel's copy of the
+// packets the userspace forwarder forwards
+const nftUserspaceTable = "enviro_userspace"
+
+// The virtio_net_hdr PACKET_VNET_HDR puts before each packet, with which
+// the forwarder passes the offloads of what it receives on to the
+// container: checksums left to the hardware, and GRO packets of many
+// segments, which the container's stack takes as they are
+const (
+	vnetHdrLen = 10
+	// vnetNeedsCsum marks a checksum the hardware was left to complete,
+	// and vnetDataValid one the receiving hardware checked
+	vnetNeedsCsum = 1
+	vnetDataValid = 2
+	// vnetGSOTCPv4 and vnetGSOUDPL4 are the GSO types of TCP and UDP
+	// segments the forwarder can check against the MTU
+	vnetGSONone  = 0
+	vnetGSOTCPv4 = 1
+	vnetGSOUDPL4 = 5
+)
+
+// errUserspaceMode is why XDP is inactive with DatapathUserspace
+var errUserspaceMode = errors.New("XDP skipped for userspace datapath mode")
+
+// skfAdPktType is the offset of the ancillary load of the packet type in
+// classic BPF, SKF_AD_OFF + SKF_AD_PKTTYPE in linux/filter.h
+const skfAdPktType = 0xfffff000 + 4
+
+// userspaceForwarder carries the IPv4 traffic arriving on the uplink for
+// containers of this node to their host veths in userspace, standing in
+// for the XDP router where it can't be attached, see DatapathUserspace.
+// An AF_PACKET socket taps the uplink before the kernel routes, the
+// nftables table nftUserspaceTable drops the kernel's copy of the packets
+// to container addresses in prerouting, and a second socket sends them
+// on. Like the router, it enforces the policies on what it forwards,
+// answers rejected packets within the reject rate and those over a
+// container's MTU, and leaves replies and the traffic between containers
+// of this node to the kernel and its policy table. Unlike the router, it
+// fragments packets over the MTU that may be fragmented, as the kernel
+// no longer sees them.
+type userspaceForwarder struct {
+	ifindex int
+	table   string
+	log     *slog.Logger
+	rx      *packetSocket
+	tx      int
+	// node counts every packet the forwarder saw; the container counters
+	// leave packets and bytes to the host veth's interface counters
+	node userspaceCounters
+	// rejects is only used by the goroutine of run
+	rejects rejectLimiter
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu sync.RWMutex
+	// routes holds the containers by address, sharing their counters,
+	// which counters holds by host veth ifindex
+	routes   map[netip.Addr]*userspaceRoute
+	counters map[int]*userspaceCounters
+	// policies holds the rules protecting each address, in the order
+	// policy_lookup of the router tries them, and fallback is the
+	// default policy for traffic none matches
+	policies map[netip.Addr][]policyRule
+	actions  map[policyRule]PolicyAction
+	fallback PolicyAction
+}
+
+// userspaceRoute is where the forwarder sends the traffic of a container
+// address, like container_info of the router
+type userspaceRoute struct {
+	ifindex      int
+	mac, hostMAC net.HardwareAddr
+	mtu          int
+	draining     bool
+	counters     *userspaceCounters
+}
+
+// startUserspace starts forwarding the traffic to pools arriving on iface
+// in userspace, answering rejects within rejectRate a second. table names
+// the instance's nftUserspaceTable.
+func startUserspace(iface string, pools []netip.Prefix, rejectRate int, table string, log *slog.Logger) (*userspaceForwarder, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %w", iface, err)
+	}
+	f := &userspaceForwarder{
+		ifindex:  link.Attrs().Index,
+		table:    table,
+		log:      log,
+		tx:       -1,
+		rejects:  rejectLimiter{rate: rejectRate},
+		routes:   make(map[netip.Addr]*userspaceRoute),
+		counters: make(map[int]*userspaceCounters),
+		policies: make(map[netip.Addr][]policyRule),
+	}
+	// A table of an earlier run would drop the traffic of its containers
+	if err := f.syncTable(); err != nil {
+		return nil, fmt.Errorf("failed to program %s table: %w", table, err)
+	}
+	if f.tx, err = openVnetSocket(unix.SOCK_CLOEXEC); err != nil {
+		return nil, err
+	}
+	if f.rx, err = openForwardSocket(f.ifindex, pools); err != nil {
+		unix.Close(f.tx)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.done = make(chan struct{})
+	go f.run(ctx)
+	return f, nil
+}
+
+// openVnetSocket opens an AF_PACKET socket taking packets with a
+// virtio_net_hdr, which receives nothing until bound to a protocol
+func openVnetSocket(flags int) (int, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|flags, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VNET_HDR, 1); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to enable virtio headers: %w", err)
+	}
+	return fd, nil
+}
+
+// openForwardSocket taps the interface with index ifindex for the IPv4
+// packets addressed to the host in pools. Taps see packets before the
+// kernel's hooks, so they get those prerouting drops. The filter is in
+// place before the socket is bound, so it never holds other packets.
+func openForwardSocket(ifindex int, pools []netip.Prefix) (*packetSocket, error) {
+	fd, err := openVnetSocket(unix.SOCK_NONBLOCK | unix.SOCK_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	filter := forwardFilter(pools)
+	prog := &unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to attach socket filter: %w", err)
+	}
+	proto := htons(unix.ETH_P_ALL)
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: ifindex}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind packet socket: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "forward")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &packetSocket{f: f, rc: rc}, nil
+}
+
+// forwardFilter returns the classic BPF program passing the IPv4 packets
+// to the host with a destination in the IPv4 pools:
+//
+//	ld #pkttype
+//	jne #host, drop
+//	ldh [12]
+//	jne #0x800, drop
+//	ld [30]
+//	and #0xffffff00
+//	jeq #0x0afa0000, pass
+//	...
+//	drop: ret #0
+//	pass: ret #-1
+func forwardFilter(pools []netip.Prefix) []unix.SockFilter {
+	var v4 []netip.Prefix
+	for _, p := range pools {
+		if p.Addr().Is4() {
+			v4 = append(v4, p.Masked())
+		}
+	}
+	// Jumps are relative to the next instruction; the pools take three
+	// each, and drop and pass follow them
+	n := uint8(3 * len(v4))
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfAdPktType},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.PACKET_HOST, Jf: n + 2},
+		{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 12},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.ETH_P_IP, Jf: n},
+	}
+	for i, p := range v4 {
+		left := n - uint8(3*i) - 3
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: ethHdrLen + 16},
+			unix.SockFilter{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: binary.BigEndian.Uint32(net.CIDRMask(p.Bits(), 32))},
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: binary.BigEndian.Uint32(p.Addr().AsSlice()), Jt: left + 1},
+		)
+	}
+	return append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: 0xffffffff},
+	)
+}
+
+// Close stops forwarding and hands the traffic back to the kernel
+func (f *userspaceForwarder) Close() error {
+	f.cancel()
+	<-f.done
+	f.mu.Lock()
+	clear(f.routes)
+	err := f.syncTable()
+	f.mu.Unlock()
+	return errors.Join(err, f.rx.Close(), unix.Close(f.tx))
+}
+
+// run forwards the packets of the tap until ctx is done
+func (f *userspaceForwarder) run(ctx context.Context) {
+	defer close(f.done)
+	buf := make([]byte, vnetHdrLen+captureBufferSize)
+	for {
+		n, origLen, _, err := f.rx.read(ctx, buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			f.log.Debug("Failed to read from uplink", "error", err)
+			continue
+		}
+		if n < origLen || n < vnetHdrLen {
+			// Larger than any GRO packet, and dropped by the table
+			f.node[usDrops].Add(1)
+			continue
+		}
+		f.forward(buf[:n])
+	}
+}
+
+// forward handles pkt, a packet of the tap behind its virtio_net_hdr, in
+// the steps of route4 of the router
+func (f *userspaceForwarder) forward(pkt []byte) {
+	hdr, frame := pkt[:vnetHdrLen], pkt[vnetHdrLen:]
+	f.node[usPackets].Add(1)
+	f.node[usBytes].Add(uint64(len(frame)))
+	if len(frame) < ethHdrLen+ipv4HdrLen {
+		return
+	}
+	ip := frame[ethHdrLen:]
+	src := netip.AddrFrom4([4]byte(ip[12:16]))
+	dst := netip.AddrFrom4([4]byte(ip[16:20]))
+
+	f.mu.RLock()
+	route, ok := f.routes[dst]
+	var r userspaceRoute
+	var action PolicyAction
+	if ok {
+		r = *route
+		action = f.lookup(src, dst, ip[9], l4Port(ip))
+	}
+	f.mu.RUnlock()
+	// The table leaves packets to other addresses to the kernel
+	if !ok {
+		return
+	}
+
+	f.count(&r, usPolicyChecks)
+	switch action {
+	case PolicyReject:
+		f.reject(&r, frame)
+		return
+	case PolicyDeny:
+		f.count(&r, usDrops)
+		return
+	}
+	if r.draining && opensTCP(ip) {
+		// Refused like the drain table does, uncounted
+		if reply := resetFrame(frame); reply != nil {
+			f.send(f.ifindex, nil, reply)
+		}
+		return
+	}
+	if r.mtu > 0 && segmentLen(hdr, ip) > r.mtu {
+		f.tooBig(&r, hdr, frame)
+		return
+	}
+
+	copy(frame[0:6], r.mac)
+	copy(frame[6:12], r.hostMAC)
+	// The container's stack checks what the uplink's hardware did
+	hdr[0] &^= vnetDataValid
+	if err := f.send(r.ifindex, hdr, frame); err != nil {
+		f.count(&r, usDrops)
+		return
+	}
+	f.count(&r, usRedirects)
+}
+
+// lookup returns the action of the first rule protecting dst that
+// matches, in the order of policy_lookup, or the default policy. Callers
+// must hold f.mu.
+func (f *userspaceForwarder) lookup(src, dst netip.Addr, proto uint8, port uint16) PolicyAction {
+	for _, rule := range f.policies[dst] {
+		if (!rule.Src.IsValid() || rule.Src.Contains(src)) &&
+			(rule.Proto == 0 || rule.Proto == proto) &&
+			(rule.Port == 0 || rule.Port == port) {
+			return f.actions[rule]
+		}
+	}
+	return f.fallback
+}
+
+// count adds a packet to counter c of the node and the container of r
+func (f *userspaceForwarder) count(r *userspaceRoute, c userspaceCounter) {
+	f.node[c].Add(1)
+	r.counters[c].Add(1)
+}
+
+// reject answers frame, which a reject policy matched, with a TCP reset
+// or else an ICMP administratively prohibited error, within the reject
+// rate, and drops it otherwise
+func (f *userspaceForwarder) reject(r *userspaceRoute, frame []byte) {
+	var reply []byte
+	if f.rejects.allow(time.Now()) {
+		if frame[ethHdrLen+9] == 6 {
+			reply = resetFrame(frame)
+		} else {
+			reply = unreachFrame(frame, icmpPktFiltered, 0)
+		}
+	}
+	if reply == nil || f.send(f.ifindex, nil, reply) != nil {
+		f.count(r, usDrops)
+		return
+	}
+	f.count(r, usRejects)
+}
+
+// tooBig handles frame, whose packet or segments are over the MTU of r:
+// with the Don't Fragment flag it answers with an ICMP Fragmentation
+// Needed error, otherwise it sends fragments. GSO packets without the
+// flag are dropped, as are those of either it can't answer or split.
+func (f *userspaceForwarder) tooBig(r *userspaceRoute, hdr, frame []byte) {
+	ip := frame[ethHdrLen:]
+	if binary.BigEndian.Uint16(ip[6:])&ipv4DF != 0 {
+		reply := unreachFrame(frame, icmpFragNeeded, r.mtu)
+		if reply == nil || f.send(f.ifindex, nil, reply) != nil {
+			f.count(r, usDrops)
+			return
+		}
+		f.count(r, usFragNeeded)
+		return
+	}
+
+	// Fragments carry the transport checksum in the first, so it can't be
+	// left to the hardware
+	if hdr[1] != vnetGSONone ||
+		hdr[0]&vnetNeedsCsum != 0 && !completeChecksum(frame, int(binary.NativeEndian.Uint16(hdr[6:])), int(binary.NativeEndian.Uint16(hdr[8:]))) {
+		f.count(r, usDrops)
+		return
+	}
+	frames := fragmentFrame(frame, r.mtu)
+	if frames == nil {
+		f.count(r, usDrops)
+		return
+	}
+	for _, fr := range frames {
+		copy(fr[0:6], r.mac)
+		copy(fr[6:12], r.hostMAC)
+		if err := f.send(r.ifindex, nil, fr); err != nil {
+			f.count(r, usDrops)
+			return
+		}
+	}
+	f.count(r, usRedirects)
+}
+
+// segmentLen returns the length of the IP packets the packet ip with the
+// virtio_net_hdr hdr makes on the wire: its own, or for a GRO packet that
+// of the segments it is split into again
+func segmentLen(hdr, ip []byte) int {
+	size := int(binary.NativeEndian.Uint16(hdr[4:]))
+	ihl := int(ip[0]&0xf) * 4
+	switch hdr[1] {
+	case vnetGSOTCPv4:
+		if len(ip) >= ihl+tcpHdrLen {
+			return ihl + int(ip[ihl+12]>>4)*4 + size
+		}
+	case vnetGSOUDPL4:
+		return ihl + 8 + size
+	}
+	return int(binary.BigEndian.Uint16(ip[2:]))
+}
+
+// send sends frame out of the interface with index ifindex behind hdr, or
+// without offloads when hdr is nil
+func (f *userspaceForwarder) send(ifindex int, hdr, frame []byte) error {
+	if hdr == nil {
+		hdr = make([]byte, vnetHdrLen)
+	}
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_IP), Ifindex: ifindex}
+	_, err := unix.SendmsgBuffers(f.tx, [][]byte{hdr, frame}, nil, sa, 0)
+	return err
+}
+
+// AddContainer forwards the traffic to the IPv4 addresses of a container
+// to its host veth with index ifindex, from hostMAC to mac, checking
+// packets against mtu
+func (f *userspaceForwarder) AddContainer(ifindex int, addrs []netip.Addr, mac, hostMAC net.HardwareAddr, mtu int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counters := f.counters[ifindex]
+	if counters == nil {
+		counters = &userspaceCounters{}
+		f.counters[ifindex] = counters
+	}
+	for _, addr := range addrs {
+		if addr.Is4() {
+			f.routes[addr] = &userspaceRoute{ifindex: ifindex, mac: mac, hostMAC: hostMAC, mtu: mtu, counters: counters}
+		}
+	}
+	return f.syncTable()
+}
+
+// DeleteContainer hands the traffic to addrs back to the kernel and drops
+// the counters of the host veth with index ifindex
+func (f *userspaceForwarder) DeleteContainer(ifindex int, addrs []netip.Addr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, addr := range addrs {
+		delete(f.routes, addr)
+	}
+	delete(f.counters, ifindex)
+	return f.syncTable()
+}
+
+// SetMTU checks the packets to addrs against mtu
+func (f *userspaceForwarder) SetMTU(addrs []netip.Addr, mtu int) {
+	f.update(addrs, func(r *userspaceRoute) { r.mtu = mtu })
+}
+
+// SetDraining refuses new TCP connections to addrs, or accepts them again
+func (f *userspaceForwarder) SetDraining(addrs []netip.Addr, draining bool) {
+	f.update(addrs, func(r *userspaceRoute) { r.draining = draining })
+}
+
+// update replaces the routes of addrs with copies fn changed, which the
+// packets forwarded meanwhile don't see half done
+func (f *userspaceForwarder) update(addrs []netip.Addr, fn func(*userspaceRoute)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, addr := range addrs {
+		if r, ok := f.routes[addr]; ok {
+			c := *r
+			fn(&c)
+			f.routes[addr] = &c
+		}
+	}
+}
+
+// SetPolicies replaces the policy rules and the default policy
+func (f *userspaceForwarder) SetPolicies(rules map[policyRule]PolicyAction, fallback PolicyAction) {
+	policies := make(map[netip.Addr][]policyRule)
+	for _, rule := range sortedPolicyRules(rules) {
+		if rule.Dst.Is4() {
+			policies[rule.Dst] = append(policies[rule.Dst], rule)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.policies, f.actions, f.fallback = policies, maps.Clone(rules), fallback
+}
+
+// Stats adds the counters of the node to stats
+func (f *userspaceForwarder) Stats(stats map[string]uint64) {
+	f.node.fill(stats)
+}
+
+// ContainerStats adds the counters of the container with the host veth
+// with index ifindex to stats
+func (f *userspaceForwarder) ContainerStats(ifindex int, stats map[string]uint64) {
+	f.mu.RLock()
+	counters := f.counters[ifindex]
+	f.mu.RUnlock()
+	if counters != nil {
+		counters.fill(stats)
+	}
+}
+
+// syncTable rebuilds the table dropping the kernel's copy of the packets
+// to the forwarded addresses in one atomic batch, removing it when there
+// are none. Callers must hold f.mu.
+//
+//	table ip enviro_userspace {
+//		set containers { type ipv4_addr; elements = { 10.88.0.2 } }
+//		chain prerouting {
+//			type filter hook prerouting priority raw
+//			iif 2 ip daddr @containers drop
+//		}
+//	}
+func (f *userspaceForwarder) syncTable() error {
+	conn := &nftables.Conn{}
+	table := resetTable(conn, f.table, nftables.TableFamilyIPv4)
+	if len(f.routes) == 0 {
+		return conn.Flush()
+	}
+
+	conn.AddTable(table)
+	set := &nftables.Set{Table: table, Name: "containers", KeyType: nftables.TypeIPAddr}
+	var elems []nftables.SetElement
+	for addr := range f.routes {
+		elems = append(elems, nftables.SetElement{Key: addr.AsSlice()})
+	}
+	if err := conn.AddSet(set, elems); err != nil {
+		return err
+	}
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityRaw,
+	})
+	exprs := append(matchIIF(f.ifindex),
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+	conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	return conn.Flush()
+}
+
+// clearUserspace removes the table of a forwarder of an earlier run, which
+// would keep the kernel from routing to the addresses of its containers
+func (nm *NetworkManager) clearUserspace() error {
+	conn := &nftables.Conn{}
+	resetTable(conn, nm.nftTable(nftUserspaceTable), nftables.TableFamilyIPv4)
+	return conn.Flush()
+}
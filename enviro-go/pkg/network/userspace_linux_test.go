@@ -0,0 +1,709 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// parityTestEnv marks the child of TestForwardingParity
+const parityTestEnv = "ENVIRO_TEST_PARITY"
+
+// The uplink of TestForwardingParity, a veth pair whose peer is in the
+// client's namespace, and the networks on it
+const (
+	parityUplink      = "parity0"
+	parityClientLink  = "parity1"
+	parityHostAddr    = "10.251.0.1/30"
+	parityClientAddr  = "10.251.0.2/30"
+	parityHostAddr6   = "fd51::1/64"
+	parityClientAddr6 = "fd51::2/64"
+	parityCIDR        = "10.99.0.0/24"
+	parityCIDR6       = "fd99::/64"
+)
+
+// TestForwardingParity checks policies, stats, port forwards, bandwidth
+// limits, captures and faults alike with the XDP and TC routers and the userspace
+// forwarder, with traffic from a client namespace behind the uplink to a
+// dual-stack container. The forwarder only carries IPv4, leaving IPv6 to
+// the kernel. It runs in a child in a network namespace of its own.
+// Without the router's bytecode, see the bpfobj build tag, only the
+// forwarder is checked.
+func TestForwardingParity(t *testing.T) {
+	if os.Getenv(parityTestEnv) != "" {
+		runForwardingParity(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("forwarding from the uplink needs root")
+	}
+	runInNetns(t, parityTestEnv)
+}
+
+func runForwardingParity(t *testing.T) {
+	client := setupParityClient(t)
+	modes := []struct {
+		name string
+		mode DatapathMode
+	}{
+		// Native XDP on a veth only delivers the frames it redirects or
+		// sends back to peers running XDP themselves
+		{name: "xdp", mode: DatapathXDPGeneric},
+		{name: "tc", mode: DatapathTC},
+		{name: "userspace", mode: DatapathUserspace},
+	}
+	for _, m := range modes {
+		t.Run(m.name, func(t *testing.T) {
+			nm, err := NewNetworkManager(NetworkConfig{
+				EnableXDP:    true,
+				Interface:    parityUplink,
+				DatapathMode: m.mode,
+				CIDR:         parityCIDR,
+				CIDR6:        parityCIDR6,
+				Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nm.Close()
+			caps := nm.Capabilities()
+			if m.mode == DatapathUserspace && !caps.Userspace {
+				t.Fatal("userspace forwarder didn't start")
+			}
+			if m.mode != DatapathUserspace && !caps.XDP {
+				t.Skipf("XDP unavailable: %s", caps.XDPError)
+			}
+
+			cn, err := nm.CreateContainerNetwork(context.Background(), ContainerNetworkSpec{ContainerID: "server", NetnsPath: containerNetns(t)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := serveEcho(t, cn)
+			t.Run("stats", func(t *testing.T) { checkParityStats(t, nm, client, server) })
+			t.Run("policies", func(t *testing.T) { checkParityPolicies(t, nm, client, server) })
+			t.Run("port forwards", func(t *testing.T) { checkParityForwards(t, nm, client, server) })
+			t.Run("ipv6", func(t *testing.T) { checkParityIPv6(t, nm, client, server) })
+			t.Run("bandwidth limits", func(t *testing.T) { checkParityBandwidth(t, nm, client, server) })
+			t.Run("captures", func(t *testing.T) { checkParityCaptures(t, nm, client, server) })
+			t.Run("faults", func(t *testing.T) { checkParityFaults(t, nm, client, server) })
+		})
+	}
+}
+
+// parityClient opens sockets in the client namespace
+type parityClient struct {
+	ns netns.NsHandle
+}
+
+// exchange sends a message to addr over network and waits for timeout for
+// the echo, returning errTimeout when none came
+func (c parityClient) exchange(network, addr string, timeout time.Duration) error {
+	var conn net.Conn
+	err := inNetns(c.ns, func() (err error) {
+		conn, err = net.DialTimeout(network, addr, timeout)
+		return err
+	})
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err = conn.Write([]byte("ping")); err == nil {
+			_, err = io.ReadFull(conn, make([]byte, 4))
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errTimeout
+	}
+	return err
+}
+
+// setupParityClient creates the uplink and the client namespace behind
+// it, routing the container network via the host
+func setupParityClient(t *testing.T) parityClient {
+	t.Helper()
+	ns, err := netns.GetFromPath(containerNetns(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: parityUplink}, PeerName: parityClientLink}); err != nil {
+		t.Fatal(err)
+	}
+	uplink, err := netlink.LinkByName(parityUplink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostAddr, _ := netlink.ParseAddr(parityHostAddr)
+	hostAddr6, _ := netlink.ParseAddr(parityHostAddr6)
+	// Without duplicate address detection the addresses are usable at once
+	hostAddr6.Flags = unix.IFA_F_NODAD
+	for _, addr := range []*netlink.Addr{hostAddr, hostAddr6} {
+		if err := netlink.AddrAdd(uplink, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := netlink.LinkSetUp(uplink); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := netlink.LinkByName(parityClientLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(ns)); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Delete()
+	if peer, err = h.LinkByName(parityClientLink); err != nil {
+		t.Fatal(err)
+	}
+	clientAddr, _ := netlink.ParseAddr(parityClientAddr)
+	clientAddr6, _ := netlink.ParseAddr(parityClientAddr6)
+	clientAddr6.Flags = unix.IFA_F_NODAD
+	for _, addr := range []*netlink.Addr{clientAddr, clientAddr6} {
+		if err := h.AddrAdd(peer, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.LinkSetUp(peer); err != nil {
+		t.Fatal(err)
+	}
+	for cidr, gw := range map[string]net.IP{parityCIDR: hostAddr.IP, parityCIDR6: hostAddr6.IP} {
+		_, dst, _ := net.ParseCIDR(cidr)
+		if err := h.RouteAdd(&netlink.Route{LinkIndex: peer.Attrs().Index, Dst: dst, Gw: gw}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return parityClient{ns: ns}
+}
+
+// echoServer is where serveEcho listens
+type echoServer struct {
+	container        string
+	ip, ip6          string
+	tcpPort, udpPort uint16
+}
+
+// port returns the port the server listens on for protocol
+func (s echoServer) port(protocol string) uint16 {
+	if protocol == "udp" {
+		return s.udpPort
+	}
+	return s.tcpPort
+}
+
+// addr returns the IPv4 address the server listens on for protocol
+func (s echoServer) addr(protocol string) string {
+	return net.JoinHostPort(s.ip, strconv.Itoa(int(s.port(protocol))))
+}
+
+// addr6 returns the IPv6 address the server listens on for protocol
+func (s echoServer) addr6(protocol string) string {
+	return net.JoinHostPort(s.ip6, strconv.Itoa(int(s.port(protocol))))
+}
+
+// serveEcho echoes on a TCP and a UDP port of all of cn's addresses until
+// the test ends
+func serveEcho(t *testing.T, cn *ContainerNetwork) echoServer {
+	t.Helper()
+	ns, err := netns.GetFromPath(cn.NetnsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	var ln net.Listener
+	var pc net.PacketConn
+	err = inNetns(ns, func() error {
+		if ln, err = net.Listen("tcp", ":0"); err != nil {
+			return err
+		}
+		pc, err = net.ListenPacket("udp", ":0")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		pc.Close()
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return echoServer{
+		container: cn.ContainerID,
+		ip:        cn.IPv4,
+		ip6:       cn.IPv6,
+		tcpPort:   uint16(ln.Addr().(*net.TCPAddr).Port),
+		udpPort:   uint16(pc.LocalAddr().(*net.UDPAddr).Port),
+	}
+}
+
+// parityTimeout is how long an exchange waits for an echo
+const parityTimeout = 500 * time.Millisecond
+
+// statsDelta returns by how much the container stats of the server grew
+// while fn ran
+func statsDelta(t *testing.T, nm *NetworkManager, server echoServer, fn func()) map[string]uint64 {
+	t.Helper()
+	before, err := nm.GetContainerStats(server.container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn()
+	after, err := nm.GetContainerStats(server.container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := make(map[string]uint64)
+	for key, n := range after {
+		delta[key] = n - before[key]
+	}
+	return delta
+}
+
+func checkParityStats(t *testing.T, nm *NetworkManager, client parityClient, server echoServer) {
+	node, err := nm.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := statsDelta(t, nm, server, func() {
+		for _, protocol := range []string{"tcp", "udp"} {
+			if err := client.exchange(protocol+"4", server.addr(protocol), parityTimeout); err != nil {
+				t.Errorf("%s exchange: %v", protocol, err)
+			}
+		}
+	})
+	// The handshake, the message and the close, and the datagram
+	if delta["redirect_count"] < 4 {
+		t.Errorf("redirect_count grew by %d, want the packets from the client", delta["redirect_count"])
+	}
+	if delta["packets_processed"] == 0 || delta["bytes_processed"] == 0 {
+		t.Errorf("packets_processed and bytes_processed grew by %d and %d, want the exchanges", delta["packets_processed"], delta["bytes_processed"])
+	}
+	if delta["drop_count"] != 0 {
+		t.Errorf("drop_count grew by %d, want no drops", delta["drop_count"])
+	}
+
+	after, err := nm.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"packets_processed", "redirect_count"} {
+		if after[key] <= node[key] {
+			t.Errorf("node %s stayed at %d", key, after[key])
+		}
+	}
+}
+
+func checkParityPolicies(t *testing.T, nm *NetworkManager, client parityClient, server echoServer) {
+	tests := []struct {
+		name     string
+		protocol string
+		action   PolicyAction
+		// want is the error of the exchange, errTimeout when it times out
+		want error
+		// wantCount is the stat counting the exchange's refused packets
+		wantCount string
+	}{
+		{name: "allow", protocol: "tcp", action: PolicyAllow},
+		{name: "deny", protocol: "tcp", action: PolicyDeny, want: errTimeout, wantCount: "drop_count"},
+		{name: "reject", protocol: "tcp", action: PolicyReject, want: unix.ECONNREFUSED, wantCount: "reject_count"},
+		{name: "deny udp", protocol: "udp", action: PolicyDeny, want: errTimeout, wantCount: "drop_count"},
+		{name: "reject udp", protocol: "udp", action: PolicyReject, want: unix.EHOSTUNREACH, wantCount: "reject_count"},
+	}
+	// The TC router can't answer packets, so it drops those it rejects
+	tc := nm.Capabilities().XDPMode == DatapathTC
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, wantCount := tt.want, tt.wantCount
+			if tc && tt.action == PolicyReject {
+				want, wantCount = errTimeout, "drop_count"
+			}
+			policy := NetworkPolicy{
+				Name:          "parity",
+				DestContainer: server.container,
+				Protocol:      tt.protocol,
+				Port:          server.port(tt.protocol),
+				Action:        tt.action,
+			}
+			if err := nm.ApplyPolicy(policy); err != nil {
+				t.Fatal(err)
+			}
+			defer nm.RemovePolicy(policy.Name)
+
+			var err error
+			delta := statsDelta(t, nm, server, func() {
+				err = client.exchange(tt.protocol+"4", server.addr(tt.protocol), parityTimeout)
+			})
+			if !errors.Is(err, want) || (want == nil && err != nil) {
+				t.Errorf("exchange error = %v, want %v", err, want)
+			}
+			if delta["policy_packet_checks"] == 0 {
+				t.Error("policy_packet_checks didn't grow")
+			}
+			for _, key := range []string{"drop_count", "reject_count"} {
+				if got := delta[key]; (got != 0) != (key == wantCount) {
+					t.Errorf("%s grew by %d, want it to count the refused packets only with %q", key, got, wantCount)
+				}
+			}
+		})
+	}
+}
+
+func checkParityForwards(t *testing.T, nm *NetworkManager, client parityClient, server echoServer) {
+	// The router translates forwarded ports itself and routes the packets
+	// on as redirected; the userspace forwarder leaves them to nftables
+	translated := nm.Capabilities().XDP
+	host, _ := netlink.ParseAddr(parityHostAddr)
+	for i, protocol := range []string{"tcp", "udp"} {
+		t.Run(protocol, func(t *testing.T) {
+			hostPort := uint16(18080 + i)
+			if _, err := nm.ExposePort(server.container, hostPort, server.port(protocol), protocol); err != nil {
+				t.Fatal(err)
+			}
+			defer nm.UnexposePort(server.container, hostPort, protocol)
+
+			addr := net.JoinHostPort(host.IP.String(), strconv.Itoa(int(hostPort)))
+			var err error
+			delta := statsDelta(t, nm, server, func() {
+				err = client.exchange(protocol+"4", addr, parityTimeout)
+			})
+			if err != nil {
+				t.Errorf("exchange through port %d: %v", hostPort, err)
+			}
+			if got := delta["redirect_count"]; (got > 0) != translated {
+				t.Errorf("redirect_count grew by %d, want growth %v", got, translated)
+			}
+		})
+	}
+}
+
+func checkParityIPv6(t *testing.T, nm *NetworkManager, client parityClient, server echoServer) {
+	if server.ip6 == "" {
+		t.Fatal("container got no IPv6 address")
+	}
+	// The routers route IPv6 like IPv4, the kernel does in place of the
+	// forwarder
+	routed := nm.Capabilities().XDP
+	host, _ := netlink.ParseAddr(parityHostAddr6)
+	for i, protocol := range []string{"tcp", "udp"} {
+		t.Run(protocol, func(t *testing.T) {
+			var err error
+			delta := statsDelta(t, nm, server, func() {
+				err = client.exchange(protocol+"6", server.addr6(protocol), parityTimeout)
+			})
+			if err != nil {
+				t.Errorf("exchange: %v", err)
+			}
+			if got := delta["redirect_count"]; (got > 0) != routed {
+				t.Errorf("redirect_count grew by %d, want growth %v", got, routed)
+			}
+		})
+		t.Run(protocol+" port forward", func(t *testing.T) {
+			hostPort := uint16(18090 + i)
+			if _, err := nm.ExposePort(server.container, hostPort, server.port(protocol), protocol); err != nil {
+				t.Fatal(err)
+			}
+			defer nm.UnexposePort(server.container, hostPort, protocol)
+
+			addr := net.JoinHostPort(host.IP.String(), strconv.Itoa(int(hostPort)))
+			var err error
+			delta := statsDelta(t, nm, server, func() {
+				err = client.exchange(protocol+"6", addr, parityTimeout)
+			})
+			if err != nil {
+				t.Errorf("exchange through port %d: %v", hostPort, err)
+			}
+			if got := delta["redirect_count"]; (got > 0) != routed {
+				t.Errorf("redirect_count grew by %d, want growth %v", got, routed)
+			}
+		})
+	}
+}
+
+// shapingQdisc returns the kind of the qdisc limiting the interface name
+// of h, "" for none
+func shapingQdisc(t *testing.T, h *netlink.Handle, name string) string {
+	t.Helper()
+	link, err := h.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qdiscs, err := h.QdiscList(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Handle == shapingHandle {
+			return q.Type()
+		}
+	}
+	return ""
+}
+
+func checkParityBandwidth(t *testing.T, nm *NetworkManager, client parityClient, server echoServer) {
+	nm.mu.Lock()
+	cn := nm.containers[server.container]
+	nm.mu.Unlock()
+	h, err := containerHandle(cn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Delete()
+
+	// Limits change in place, paced where the kernel has fq
+	for _, bps := range []uint64{8 << 20, 16 << 20} {
+		if err := nm.SetBandwidthLimit(server.container, bps, bps); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.exchange("tcp4", server.addr("tcp"), parityTimeout); err != nil {
+			t.Errorf("exchange at %d bps: %v", bps, err)
+		}
+		nm.mu.Lock()
+		pacedIngress, pacedEgress := cn.pacedIngress, cn.pacedEgress != 0
+		nm.mu.Unlock()
+		if (pacedIngress || pacedEgress) && !nm.Capabilities().XDP {
+			t.Error("paced without the router")
+		}
+		for _, side := range []struct {
+			h     *netlink.Handle
+			name  string
+			paced bool
+		}{{&netlink.Handle{}, cn.HostInterface, pacedIngress}, {h, containerIfName, pacedEgress}} {
+			want := "tbf"
+			if side.paced {
+				want = "fq"
+			}
+			if got := shapingQdisc(t, side.h, side.name); got != want {
+				t.Errorf("%s is limited by %q, want %q", side.name, got, want)
+			}
+		}
+	}
+
+	if err := nm.SetBandwidthLimit(server.container, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := shapingQdisc(t, &netlink.Handle{}, cn.HostInterface); got != "" {
+		t.Errorf("%s still limited by %q", cn.HostInterface, got)
+	}
+	if got := shapingQdisc(t, h, containerIfName); got != "" {
+		t.Errorf("%s still limited by %q", containerIfName, got)
+	}
+}
+
+// capturing reports whether the router copies the traffic of the host
+// veth name, where it captures
+func capturing(t *testing.T, name string) bool {
+	t.Helper()
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+	if err != nil && !errors.Is(err, unix.EINVAL) {
+		t.Fatal(err)
+	}
+	for _, f := range filters {
+		if f.Attrs().Handle == captureFilterOf(link.Attrs().Index, netlink.HANDLE_MIN_INGRESS).Handle {
+			return true
+		}
+	}
+	return false
+}
+
+func checkParityCaptures(t *testing.T, nm *NetworkManager, client parityClient, server echoServer) {
+	nm.mu.Lock()
+	cn := nm.containers[server.container]
+	tap := nm.xdp != nil && nm.xdp.hasCapture()
+	nm.mu.Unlock()
+	if nm.Capabilities().XDP && !tap {
+		t.Error("router can't capture")
+	}
+
+	const snapLen = 96
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var pcap bytes.Buffer
+	type result struct {
+		stats CaptureStats
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stats, err := nm.CaptureTraffic(ctx, server.container, CaptureOptions{SnapLen: snapLen, Protocol: "tcp", Port: server.tcpPort}, &pcap)
+		done <- result{stats, err}
+	}()
+	// The capture starts once the router copies the host veth's traffic,
+	// or soon after, as its packet socket is bound
+	if !tap {
+		time.Sleep(200 * time.Millisecond)
+	}
+	for deadline := time.Now().Add(2 * time.Second); tap && !capturing(t, cn.HostInterface); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("capture didn't start")
+		}
+	}
+
+	if err := client.exchange("tcp4", server.addr("tcp"), parityTimeout); err != nil {
+		t.Errorf("exchange during capture: %v", err)
+	}
+	if err := client.exchange("udp4", server.addr("udp"), parityTimeout); err != nil {
+		t.Errorf("exchange during capture: %v", err)
+	}
+	// Frames read by the router may still be on their way
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	b := pcap.Bytes()
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 {
+		t.Fatalf("no pcap header in %d bytes", len(b))
+	}
+	var toServer, fromServer, packets int
+	for b = b[24:]; len(b) >= 16; packets++ {
+		capLen, origLen := int(binary.LittleEndian.Uint32(b[8:])), int(binary.LittleEndian.Uint32(b[12:]))
+		if capLen > snapLen || capLen > origLen || len(b) < 16+capLen {
+			t.Fatalf("packet %d: captured %d of %d bytes, %d left, snap length %d", packets, capLen, origLen, len(b)-16, snapLen)
+		}
+		frame := b[16 : 16+capLen]
+		b = b[16+capLen:]
+		if len(frame) < 14+20+4 || binary.BigEndian.Uint16(frame[12:]) != 0x0800 || frame[14+9] != protoTCP {
+			t.Errorf("packet %d isn't TCP over IPv4", packets)
+			continue
+		}
+		l4 := frame[14+int(frame[14]&0x0f)*4:]
+		switch server.tcpPort {
+		case binary.BigEndian.Uint16(l4[2:]):
+			toServer++
+		case binary.BigEndian.Uint16(l4[0:]):
+			fromServer++
+		}
+	}
+	if len(b) != 0 {
+		t.Errorf("%d bytes trail the last packet", len(b))
+	}
+	if toServer == 0 || fromServer == 0 {
+		t.Errorf("captured %d packets to the server and %d from it, want both", toServer, fromServer)
+	}
+	if res.stats.Packets != packets {
+		t.Errorf("stats count %d packets, the pcap has %d", res.stats.Packets, packets)
+	}
+
+	nm.mu.Lock()
+	captures := cn.captures
+	nm.mu.Unlock()
+	if captures != 0 {
+		t.Errorf("%d captures still counted", captures)
+	}
+	if capturing(t, cn.HostInterface) {
+		t.Error("router still captures")
+	}
+}
+
+func checkParityFaults(t *testing.T, nm *NetworkManager, client parityClient, server echoServer) {
+	nm.mu.Lock()
+	cn := nm.containers[server.container]
+	nm.mu.Unlock()
+
+	const delay = 100 * time.Millisecond
+	err := nm.SetContainerFault(server.container, ContainerFault{Delay: delay, Jitter: delay / 10})
+	if errors.Is(err, unix.ENOENT) {
+		t.Skipf("kernel has neither fq nor netem: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm.mu.Lock()
+	delayed := cn.faultDelayed
+	nm.mu.Unlock()
+	want := "netem"
+	if delayed {
+		want = "fq"
+	}
+	if delayed && !nm.Capabilities().XDP {
+		t.Error("delayed without the router")
+	}
+	if got := faultQdisc(t, cn.HostInterface); got != want {
+		t.Errorf("%s delays with %q, want %q", cn.HostInterface, got, want)
+	}
+	start := time.Now()
+	if err := client.exchange("tcp4", server.addr("tcp"), 2*time.Second); err != nil {
+		t.Errorf("exchange with a delay: %v", err)
+	}
+	// The handshake and the echo each wait for the delay
+	if elapsed := time.Since(start); elapsed < 2*(delay-delay/10) {
+		t.Errorf("exchange took %v, want at least twice the delay", elapsed)
+	}
+
+	if err := nm.ClearContainerFault(server.container); err != nil {
+		t.Fatal(err)
+	}
+	if got := faultQdisc(t, cn.HostInterface); got != "" {
+		t.Errorf("%s still delays with %q", cn.HostInterface, got)
+	}
+	if err := client.exchange("tcp4", server.addr("tcp"), parityTimeout); err != nil {
+		t.Errorf("exchange after the fault: %v", err)
+	}
+}
+
+// faultQdisc returns the kind of the qdisc that delays the traffic leaving
+// the host veth name for a fault, if any
+func faultQdisc(t *testing.T, name string) string {
+	t.Helper()
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Handle == faultHandle || q.Type() == "fq" {
+			return q.Type()
+		}
+	}
+	return ""
+}
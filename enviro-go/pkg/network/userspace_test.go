@@ -0,0 +1,259 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testFrame returns an Ethernet frame from 10.0.0.1 to 10.88.0.2 carrying
+// an IPv4 packet of proto with the fragment field frag and payload l4
+func testFrame(proto uint8, frag uint16, l4 []byte) []byte {
+	frame := make([]byte, ethHdrLen+ipv4HdrLen+len(l4))
+	copy(frame[0:6], []byte{2, 0, 0, 0, 0, 1})
+	copy(frame[6:12], []byte{2, 0, 0, 0, 0, 2})
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	ip := frame[ethHdrLen:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipv4HdrLen+len(l4)))
+	binary.BigEndian.PutUint16(ip[4:], 0x1234)
+	binary.BigEndian.PutUint16(ip[6:], frag)
+	ip[8] = 64
+	ip[9] = proto
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 88, 0, 2})
+	binary.BigEndian.PutUint16(ip[10:], foldChecksum(checksum(0, ip[:ipv4HdrLen])))
+	copy(ip[ipv4HdrLen:], l4)
+	return frame
+}
+
+// testSegment returns a TCP header from port 40000 to 80 with seq, ack
+// and flags, followed by payload
+func testSegment(seq, ack uint32, flags uint8, payload []byte) []byte {
+	tcp := make([]byte, tcpHdrLen+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 80)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = tcpHdrLen / 4 << 4
+	tcp[13] = flags
+	copy(tcp[tcpHdrLen:], payload)
+	return tcp
+}
+
+// checkReply checks that reply answers frame at the Ethernet and IP layer
+// and that its IP header and payload of proto have valid checksums
+func checkReply(t *testing.T, frame, reply []byte, proto uint8) {
+	t.Helper()
+	if !bytes.Equal(reply[0:6], frame[6:12]) || !bytes.Equal(reply[6:12], frame[0:6]) {
+		t.Errorf("reply from %x to %x, want the frame's MACs swapped", reply[6:12], reply[0:6])
+	}
+	ip, orig := reply[ethHdrLen:], frame[ethHdrLen:]
+	if !bytes.Equal(ip[12:16], orig[16:20]) || !bytes.Equal(ip[16:20], orig[12:16]) {
+		t.Errorf("reply from %v to %v, want the packet's addresses swapped", ip[12:16], ip[16:20])
+	}
+	if int(binary.BigEndian.Uint16(ip[2:])) != len(ip) || ip[9] != proto {
+		t.Errorf("reply has length %d and protocol %d, want %d and %d", binary.BigEndian.Uint16(ip[2:]), ip[9], len(ip), proto)
+	}
+	if sum := foldChecksum(checksum(0, ip[:ipv4HdrLen])); sum != 0 {
+		t.Errorf("IP header checksum off by %#x", sum)
+	}
+	sum := checksum(0, ip[ipv4HdrLen:])
+	if proto == 6 {
+		sum += pseudoChecksum(ip, proto, len(ip)-ipv4HdrLen)
+	}
+	if got := foldChecksum(sum); got != 0 {
+		t.Errorf("payload checksum off by %#x", got)
+	}
+}
+
+func TestResetFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		wantNil bool
+		// wantSeq, wantAck and wantFlags are those of the reset
+		wantSeq, wantAck uint32
+		wantFlags        uint8
+	}{
+		{
+			name:      "syn",
+			frame:     testFrame(6, ipv4DF, testSegment(1000, 0, tcpSYN, nil)),
+			wantAck:   1001,
+			wantFlags: tcpRST | tcpACK,
+		},
+		{
+			name:      "fin with data",
+			frame:     testFrame(6, 0, testSegment(1000, 0, tcpFIN, []byte("hello"))),
+			wantAck:   1006,
+			wantFlags: tcpRST | tcpACK,
+		},
+		{
+			name:      "ack",
+			frame:     testFrame(6, 0, testSegment(1000, 5000, tcpACK, []byte("hello"))),
+			wantSeq:   5000,
+			wantFlags: tcpRST,
+		},
+		{name: "reset", frame: testFrame(6, 0, testSegment(1000, 0, tcpRST, nil)), wantNil: true},
+		{name: "truncated", frame: testFrame(6, 0, make([]byte, 10)), wantNil: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := resetFrame(tt.frame)
+			if tt.wantNil {
+				if reply != nil {
+					t.Errorf("resetFrame() = %x, want nil", reply)
+				}
+				return
+			}
+			checkReply(t, tt.frame, reply, 6)
+			tcp := reply[ethHdrLen+ipv4HdrLen:]
+			if sport, dport := binary.BigEndian.Uint16(tcp[0:]), binary.BigEndian.Uint16(tcp[2:]); sport != 80 || dport != 40000 {
+				t.Errorf("reset from port %d to %d, want 80 to 40000", sport, dport)
+			}
+			seq, ack := binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:])
+			if seq != tt.wantSeq || ack != tt.wantAck || tcp[13] != tt.wantFlags {
+				t.Errorf("reset has seq %d, ack %d and flags %#x, want %d, %d and %#x", seq, ack, tcp[13], tt.wantSeq, tt.wantAck, tt.wantFlags)
+			}
+		})
+	}
+}
+
+func TestUnreachFrame(t *testing.T) {
+	frame := testFrame(17, ipv4DF, make([]byte, 1400))
+	reply := unreachFrame(frame, icmpFragNeeded, 1280)
+	checkReply(t, frame, reply, 1)
+	icmp := reply[ethHdrLen+ipv4HdrLen:]
+	if icmp[0] != icmpDestUnreach || icmp[1] != icmpFragNeeded || binary.BigEndian.Uint16(icmp[6:]) != 1280 {
+		t.Errorf("ICMP type %d, code %d and MTU %d, want %d, %d and 1280", icmp[0], icmp[1], binary.BigEndian.Uint16(icmp[6:]), icmpDestUnreach, icmpFragNeeded)
+	}
+	if quote := icmp[icmpHdrLen:]; !bytes.Equal(quote, frame[ethHdrLen:ethHdrLen+icmpQuote]) {
+		t.Errorf("ICMP quotes %x, want the packet's header and ports", quote)
+	}
+
+	options := testFrame(17, 0, make([]byte, 100))
+	options[ethHdrLen] = 0x46
+	if reply := unreachFrame(options, icmpPktFiltered, 0); reply != nil {
+		t.Errorf("unreachFrame() of a packet with options = %x, want nil", reply)
+	}
+}
+
+func TestFragmentFrame(t *testing.T) {
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	tests := []struct {
+		name string
+		frag uint16
+		mtu  int
+		// want are the fragment fields and payload lengths of the fragments
+		want     []uint16
+		wantLens []int
+	}{
+		{name: "fits", mtu: 1500, want: []uint16{0}, wantLens: []int{100}},
+		{name: "split", mtu: 60, want: []uint16{ipv4MF, ipv4MF | 5, 10}, wantLens: []int{40, 40, 20}},
+		{name: "rounded down", mtu: 67, want: []uint16{ipv4MF, ipv4MF | 5, 10}, wantLens: []int{40, 40, 20}},
+		{name: "fragment", frag: ipv4MF | 100, mtu: 80, want: []uint16{ipv4MF | 100, ipv4MF | 107}, wantLens: []int{56, 44}},
+		{name: "mtu too small", mtu: 27},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := testFrame(17, tt.frag, payload)
+			frames := fragmentFrame(frame, tt.mtu)
+			if len(frames) != len(tt.want) {
+				t.Fatalf("%d fragments, want %d", len(frames), len(tt.want))
+			}
+			var joined []byte
+			for i, f := range frames {
+				ip := f[ethHdrLen:]
+				if !bytes.Equal(f[:ethHdrLen], frame[:ethHdrLen]) {
+					t.Errorf("fragment %d has Ethernet header %x, want the frame's", i, f[:ethHdrLen])
+				}
+				if field := binary.BigEndian.Uint16(ip[6:]); field != tt.want[i] {
+					t.Errorf("fragment %d has fragment field %#x, want %#x", i, field, tt.want[i])
+				}
+				if n := len(ip) - ipv4HdrLen; n != tt.wantLens[i] || int(binary.BigEndian.Uint16(ip[2:])) != len(ip) {
+					t.Errorf("fragment %d carries %d bytes with total length %d, want %d", i, n, binary.BigEndian.Uint16(ip[2:]), tt.wantLens[i])
+				}
+				if sum := foldChecksum(checksum(0, ip[:ipv4HdrLen])); sum != 0 {
+					t.Errorf("fragment %d has IP header checksum off by %#x", i, sum)
+				}
+				joined = append(joined, ip[ipv4HdrLen:]...)
+			}
+			if frames != nil && !bytes.Equal(joined, payload) {
+				t.Error("fragments don't join to the payload")
+			}
+		})
+	}
+}
+
+func TestCompleteChecksum(t *testing.T) {
+	udp := make([]byte, 8+11)
+	binary.BigEndian.PutUint16(udp[0:], 40000)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], "hello world")
+	frame := testFrame(17, 0, udp)
+	ip := frame[ethHdrLen:]
+	// The sender leaves the folded pseudo-header sum, uncomplemented
+	binary.BigEndian.PutUint16(ip[ipv4HdrLen+6:], ^foldChecksum(pseudoChecksum(ip, 17, len(udp))))
+
+	start := ethHdrLen + ipv4HdrLen
+	if !completeChecksum(frame, start, 6) {
+		t.Fatal("completeChecksum() = false")
+	}
+	if sum := foldChecksum(checksum(pseudoChecksum(ip, 17, len(udp)), ip[ipv4HdrLen:])); sum != 0 {
+		t.Errorf("UDP checksum off by %#x", sum)
+	}
+	if completeChecksum(frame, start, len(udp)-1) {
+		t.Error("completeChecksum() past the frame = true")
+	}
+}
+
+func TestL4Port(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  uint16
+	}{
+		{name: "tcp", frame: testFrame(6, 0, testSegment(0, 0, tcpSYN, nil)), want: 80},
+		{name: "udp", frame: testFrame(17, ipv4MF, []byte{0, 1, 0, 53}), want: 53},
+		{name: "icmp", frame: testFrame(1, 0, []byte{8, 0, 0, 0})},
+		{name: "later fragment", frame: testFrame(6, 10, testSegment(0, 0, 0, nil))},
+		{name: "truncated", frame: testFrame(17, 0, []byte{0, 1})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l4Port(tt.frame[ethHdrLen:]); got != tt.want {
+				t.Errorf("l4Port() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectLimiter(t *testing.T) {
+	l := rejectLimiter{rate: 2}
+	now := time.Now()
+	steps := []struct {
+		after time.Duration
+		want  bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{100 * time.Millisecond, false},
+		{400 * time.Millisecond, true},
+		{0, false},
+		{time.Hour, true},
+		{0, true},
+		{0, false},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if got := l.allow(now); got != step.want {
+			t.Errorf("step %d: allow() = %v, want %v", i, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// containerIfName is the interface name inside the container namespace
+const containerIfName = "eth0"
+
+// setupVeth creates the veth pair for a container and configures it as a
+// point-to-point link: for each address family the container gets a host
+// address (/32 or /128) with a default route via the gateway, and the host
+// side owns the gateway address. A container taking a warm attachment
+// gets its pair instead. Each step is recorded in j and can be rerun after
+// a partial failure.
+func (nm *NetworkManager) setupVeth(j *opJournal, spec ContainerNetworkSpec, cn *ContainerNetwork) error {
+	ns, err := openNetns(spec)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	var addrs []containerAddr
+	for _, addr := range cn.addrs() {
+		addrs = append(addrs, containerAddr{addr: addr, gateway: nm.gateway(addr)})
+	}
+	mac, err := net.ParseMAC(cn.MAC)
+	if err != nil {
+		return err
+	}
+	peerName := tmpLinkName(nm.instance, cn.ContainerID)
+
+	// Deleting the host side removes the peer and every address and route
+	// the later steps add, so only this step needs undoing
+	if w := cn.warm; w != nil {
+		peerName = w.peerName
+		err = j.run("claim warm attachment", func() error {
+			cn.HostIfindex = w.hostIfindex
+			return nm.parking.claim(w, ns, cn.HostInterface)
+		}, func() error {
+			return deleteVeth(cn.HostInterface)
+		})
+	} else {
+		err = j.run("create veth", func() error {
+			return nm.createVeth(ns, cn, peerName)
+		}, func() error {
+			return deleteVeth(cn.HostInterface)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	err = j.run("configure container interface", func() error {
+		return configureContainerSide(ns, peerName, addrs, mac, nm.containerMTU(cn))
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return j.run("configure host interface", func() error {
+		return configureHostSide(cn, addrs)
+	}, nil)
+}
+
+// createVeth creates the pair and moves the peer into ns. A pair left
+// behind by an earlier attempt is replaced; the manager only calls this
+// for containers it has no network for.
+func (nm *NetworkManager) createVeth(ns netns.NsHandle, cn *ContainerNetwork, peerName string) error {
+	if err := deleteVeth(cn.HostInterface); err != nil {
+		return err
+	}
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: cn.HostInterface, MTU: nm.containerMTU(cn)},
+		PeerName:  peerName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create veth %s: %w", cn.HostInterface, err)
+	}
+
+	host, err := netlink.LinkByName(cn.HostInterface)
+	if err != nil {
+		return err
+	}
+	cn.HostIfindex = host.Attrs().Index
+
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetNsFd(peer, int(ns)); err != nil {
+		return fmt.Errorf("failed to move %s into container namespace: %w", peerName, err)
+	}
+	return nil
+}
+
+// configureHostSide assigns the gateway addresses to the host veth and
+// routes the container addresses through it
+func configureHostSide(cn *ContainerNetwork, addrs []containerAddr) error {
+	host, err := netlink.LinkByName(cn.HostInterface)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		gwAddr := hostAddr(a.gateway)
+		if err := netlink.AddrAdd(host, gwAddr); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to assign gateway %s to %s: %w", a.gateway, cn.HostInterface, err)
+		}
+		if a.addr.Is6() {
+			if err := skipLinkLocalDAD(cn.HostInterface); err != nil {
+				return err
+			}
+		}
+	}
+	if err := netlink.LinkSetUp(host); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", cn.HostInterface, err)
+	}
+	for _, a := range addrs {
+		route := &netlink.Route{
+			LinkIndex: host.Attrs().Index,
+			Dst:       hostPrefix(a.addr),
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to route %s via %s: %w", a.addr, cn.HostInterface, err)
+		}
+	}
+	return nil
+}
+
+// skipLinkLocalDAD turns off duplicate address detection on the host
+// interface name before it comes up, so its link-local address isn't
+// tentative. The kernel only solicits the neighbors of traffic it forwards
+// from a usable link-local address, so container IPv6 addresses would be
+// unreachable through the kernel for the second or so detection takes.
+func skipLinkLocalDAD(name string) error {
+	path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_dad", name)
+	if err := os.WriteFile(path, []byte("0"), 0o644); err != nil {
+		return fmt.Errorf("failed to disable duplicate address detection on %s: %w", name, err)
+	}
+	return nil
+}
+
+// containerAddr is a container address and the gateway of its network
+type containerAddr struct {
+	addr    netip.Addr
+	gateway netip.Addr
+}
+
+// configureContainerSide renames, addresses and routes the peer inside
+// ns. It picks up where an earlier attempt left off, including after the
+// rename.
+func configureContainerSide(ns netns.NsHandle, peerName string, addrs []containerAddr, mac net.HardwareAddr, mtu int) error {
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink in container namespace: %w", err)
+	}
+	defer h.Delete()
+
+	link, err := h.LinkByName(peerName)
+	if err == nil {
+		if err := h.LinkSetName(link, containerIfName); err != nil {
+			return fmt.Errorf("failed to rename %s: %w", peerName, err)
+		}
+	} else if link, err = h.LinkByName(containerIfName); err != nil {
+		return err
+	}
+	if mtu > 0 {
+		if err := h.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("failed to set MTU %d: %w", mtu, err)
+		}
+	}
+	if err := h.LinkSetHardwareAddr(link, mac); err != nil {
+		return fmt.Errorf("failed to set MAC %s: %w", mac, err)
+	}
+	for _, a := range addrs {
+		if err := h.AddrAdd(link, hostAddr(a.addr)); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to assign %s: %w", a.addr, err)
+		}
+	}
+	if err := h.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", containerIfName, err)
+	}
+	if lo, err := h.LinkByName("lo"); err == nil {
+		h.LinkSetUp(lo)
+	}
+
+	idx := link.Attrs().Index
+	for _, a := range addrs {
+		if err := h.RouteReplace(&netlink.Route{
+			LinkIndex: idx,
+			Dst:       hostPrefix(a.gateway),
+			Scope:     netlink.SCOPE_LINK,
+		}); err != nil {
+			return fmt.Errorf("failed to add gateway route to %s: %w", a.gateway, err)
+		}
+		if err := h.RouteReplace(&netlink.Route{
+			LinkIndex: idx,
+			Gw:        net.IP(a.gateway.AsSlice()),
+		}); err != nil {
+			return fmt.Errorf("failed to add default route via %s: %w", a.gateway, err)
+		}
+	}
+	return nil
+}
+
+// deleteVeth removes the host side of a veth pair, which also removes the
+// peer. A missing interface is not an error.
+func deleteVeth(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to delete veth %s: %w", name, err)
+	}
+	return nil
+}
+
+func openNetns(spec ContainerNetworkSpec) (netns.NsHandle, error) {
+	switch {
+	case spec.NetnsPath != "":
+		ns, err := netns.GetFromPath(spec.NetnsPath)
+		if err != nil {
+			return netns.None(), fmt.Errorf("failed to open netns %s: %w", spec.NetnsPath, err)
+		}
+		return ns, nil
+	case spec.Pid > 0:
+		ns, err := netns.GetFromPid(spec.Pid)
+		if err != nil {
+			return netns.None(), fmt.Errorf("failed to open netns of pid %d: %w", spec.Pid, err)
+		}
+		return ns, nil
+	default:
+		return netns.None(), errors.New("netns path or pid required")
+	}
+}
+
+// hostAddr returns addr as a single-host interface address. IPv6 duplicate
+// address detection is skipped: both ends are ours and a tentative address
+// would delay the container's first packets.
+func hostAddr(addr netip.Addr) *netlink.Addr {
+	a := &netlink.Addr{IPNet: hostPrefix(addr)}
+	if addr.Is6() {
+		a.Flags = unix.IFA_F_NODAD
+	}
+	return a
+}
+
+// hostPrefix returns addr as a single-host IPNet
+func hostPrefix(addr netip.Addr) *net.IPNet {
+	bits := addr.BitLen()
+	return &net.IPNet{IP: net.IP(addr.AsSlice()), Mask: net.CIDRMask(bits, bits)}
+}
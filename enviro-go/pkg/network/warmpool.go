@@ -0,0 +1,231 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultWarmInterval is the pause between creating two warm attachments
+// unless configured otherwise
+const DefaultWarmInterval = 50 * time.Millisecond
+
+// warmRetryInterval is how long replenishing the warm pool pauses after
+// failing to create an attachment, e.g. with the address pools full
+const warmRetryInterval = 5 * time.Second
+
+// warmIDPrefix starts the IDs warm attachments hold their addresses
+// under, which containers can't have
+const warmIDPrefix = "warm/"
+
+// WarmPoolConfig keeps veth pairs ready for containers to take, with their
+// addresses allocated and their datapath entries programmed, so creating
+// a container network only moves a peer into the container's namespace
+// and renames its host side. Containers requesting a MAC, an address or
+// an MTU of their own, those holding reservations or attached to devices,
+// and those of namespaces reserving an address range take the usual path,
+// as do all while the pool is empty. The addresses of the attachments
+// count toward the pool usage, see PoolUsage.Warm.
+//
+// The attachments wait in a network namespace of the manager's, which
+// the kernel removes with them when the manager ends without closing.
+// Their addresses aren't saved, so a restart finds them free again, and
+// the garbage collector removes the datapath entries left.
+type WarmPoolConfig struct {
+	// Size is the number of attachments kept ready; 0 disables the pool
+	Size int `json:"size"`
+	// Interval is the pause between creating two attachments, which
+	// bounds how fast the pool refills, DefaultWarmInterval when zero
+	Interval time.Duration `json:"interval"`
+	// Namespaces are those whose containers may take attachments, all
+	// when empty
+	Namespaces []string `json:"namespaces"`
+}
+
+func (c WarmPoolConfig) validate(config NetworkConfig) error {
+	if c.Size < 0 {
+		return fmt.Errorf("%w: warm pool size must not be negative", ErrInvalidConfig)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("%w: warm pool interval must not be negative", ErrInvalidConfig)
+	}
+	if c.Size == 0 {
+		return nil
+	}
+	// Other backends would hand out addresses for containers that don't
+	// exist yet
+	if config.IPAM.Backend != "" && config.IPAM.Backend != IPAMHostLocal {
+		return fmt.Errorf("%w: a warm pool requires %s IPAM, not %s", ErrInvalidConfig, IPAMHostLocal, config.IPAM.Backend)
+	}
+	for _, ns := range c.Namespaces {
+		if err := ValidateName(ns); err != nil || ns == "" {
+			return fmt.Errorf("%w: warm pool namespace %q is not a DNS label", ErrInvalidConfig, ns)
+		}
+	}
+	return nil
+}
+
+// warmAttachment is a veth pair created before the container taking it.
+// Its addresses are held under id until then.
+type warmAttachment struct {
+	id string
+	// hostName and hostIfindex are the host side, and peerName the peer
+	// waiting in the parking namespace
+	hostName    string
+	hostIfindex int
+	peerName    string
+	addrs       []netip.Addr
+	mac         string
+	mtu         int
+}
+
+// isWarmID reports whether id holds the addresses of a warm attachment
+func isWarmID(id string) bool {
+	return strings.HasPrefix(id, warmIDPrefix)
+}
+
+// WarmPoolStatus is the state of the warm pool, see WarmPoolConfig
+type WarmPoolStatus struct {
+	// Size is the number of attachments kept ready and Ready the number
+	// waiting now
+	Size  int
+	Ready int
+	// Claims counts the creates that took an attachment and Misses the
+	// eligible ones that found none, since Init
+	Claims uint64
+	Misses uint64
+}
+
+// WarmPool returns the state of the warm pool
+func (nm *NetworkManager) WarmPool() WarmPoolStatus {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return WarmPoolStatus{
+		Size:   nm.config.WarmPool.Size,
+		Ready:  len(nm.warm),
+		Claims: nm.warmClaims,
+		Misses: nm.warmMisses,
+	}
+}
+
+// warmEligible reports whether the container of spec may take a warm
+// attachment
+func (nm *NetworkManager) warmEligible(spec ContainerNetworkSpec, res *Reservation, cn *ContainerNetwork) bool {
+	if cn.Rootless || spec.Attachment.direct() || res != nil || cn.MAC != "" {
+		return false
+	}
+	namespaces := nm.config.WarmPool.Namespaces
+	return len(namespaces) == 0 || slices.Contains(namespaces, cn.Namespace)
+}
+
+// takeWarm hands the oldest warm attachment to cn, with its addresses and
+// MAC, when the container is eligible and the pool has one that fits it.
+// Callers must hold nm.mu.
+func (nm *NetworkManager) takeWarm(spec ContainerNetworkSpec, res *Reservation, cn *ContainerNetwork) *warmAttachment {
+	if !nm.warmEligible(spec, res, cn) {
+		return nil
+	}
+	if len(nm.warm) == 0 || nm.warm[0].mtu != nm.containerMTU(cn) {
+		nm.warmMisses++
+		return nil
+	}
+	w := nm.warm[0]
+	if err := nm.transferWarm(w, cn); err != nil {
+		nm.log.Debug("Warm attachment doesn't fit container", "container_id", cn.ContainerID, "error", err)
+		nm.warmMisses++
+		return nil
+	}
+	nm.warm = nm.warm[1:]
+	nm.warmClaims++
+	return w
+}
+
+// transferWarm transfers the addresses of w to cn, or none of them
+func (nm *NetworkManager) transferWarm(w *warmAttachment, cn *ContainerNetwork) error {
+	for i, pool := range nm.pools {
+		addr, err := pool.Transfer(w.id, cn.ContainerID, cn.Namespace)
+		if err != nil {
+			for _, done := range nm.pools[:i] {
+				done.Transfer(cn.ContainerID, w.id, DefaultNamespace)
+			}
+			return err
+		}
+		if addr.Is4() {
+			cn.IPv4 = addr.String()
+		} else {
+			cn.IPv6 = addr.String()
+		}
+	}
+	cn.MAC = w.mac
+	return nil
+}
+
+// replenishWarm adds an attachment to the warm pool unless it is full
+func (nm *NetworkManager) replenishWarm() error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if len(nm.warm) >= nm.config.WarmPool.Size {
+		return nil
+	}
+	nm.warmSeq++
+	w, err := nm.newWarmAttachment(fmt.Sprintf("%s%d", warmIDPrefix, nm.warmSeq))
+	if err != nil {
+		return err
+	}
+	nm.warm = append(nm.warm, w)
+	return nil
+}
+
+// startWarmPool fills the warm pool, creating an attachment every
+// WarmPool.Interval while it isn't full, until stopWarmPool is called
+func (nm *NetworkManager) startWarmPool() {
+	nm.warmStop = make(chan struct{})
+	nm.warmDone = make(chan struct{})
+	go func() {
+		defer close(nm.warmDone)
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-nm.warmStop:
+				return
+			}
+			wait := nm.config.WarmPool.Interval
+			if err := nm.replenishWarm(); err != nil {
+				nm.log.Warn("Failed to create warm attachment", "error", err)
+				wait = warmRetryInterval
+			}
+			timer.Reset(wait)
+		}
+	}()
+}
+
+// stopWarmPool waits for the replenishing started by startWarmPool to end
+// and deletes the attachments no container took
+func (nm *NetworkManager) stopWarmPool() {
+	if nm.warmStop == nil {
+		return
+	}
+	close(nm.warmStop)
+	<-nm.warmDone
+	nm.warmStop = nil
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	for _, w := range nm.warm {
+		if err := nm.dropWarm(w); err != nil {
+			nm.log.Warn("Failed to delete warm attachment", "interface", w.hostName, "error", err)
+		}
+	}
+	nm.warm = nil
+	if nm.parking != nil {
+		if err := nm.parking.close(); err != nil {
+			nm.log.Warn("Failed to close parking namespace", "error", err)
+		}
+		nm.parking = nil
+	}
+}
@@ -0,0 +1,151 @@
+//go:build linux
+
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// parkingNetns is the network namespace the peers of warm attachments
+// wait in. Only the manager holds it, so the kernel removes it and the
+// attachments in it once the manager is gone.
+type parkingNetns struct {
+	ns netns.NsHandle
+	h  *netlink.Handle
+}
+
+// newParkingNetns creates a parking namespace
+func newParkingNetns() (*parkingNetns, error) {
+	var ns netns.NsHandle
+	// New moves the thread into the namespace it creates, so it runs on
+	// a thread moved back into the current one
+	cur, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+	err = inNetns(cur, func() (err error) {
+		ns, err = netns.New()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create parking namespace: %w", err)
+	}
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("failed to open netlink in parking namespace: %w", err)
+	}
+	return &parkingNetns{ns: ns, h: h}, nil
+}
+
+func (p *parkingNetns) close() error {
+	p.h.Delete()
+	return p.ns.Close()
+}
+
+// claim moves the peer of w into ns and renames its host side hostName.
+// It picks up where an earlier attempt left off.
+func (p *parkingNetns) claim(w *warmAttachment, ns netns.NsHandle, hostName string) error {
+	host, err := netlink.LinkByIndex(w.hostIfindex)
+	if err != nil {
+		return err
+	}
+	if host.Attrs().Name != hostName {
+		// A veth left behind by an earlier create of the container
+		if err := deleteVeth(hostName); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetName(host, hostName); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %w", w.hostName, hostName, err)
+		}
+	}
+	peer, err := p.h.LinkByName(w.peerName)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			// Moved already
+			return nil
+		}
+		return err
+	}
+	if err := p.h.LinkSetNsFd(peer, int(ns)); err != nil {
+		return fmt.Errorf("failed to move %s into container namespace: %w", w.peerName, err)
+	}
+	return nil
+}
+
+// newWarmAttachment allocates addresses for id and creates a veth pair
+// for them, its peer in the parking namespace and its host side down, and
+// programs it into the datapath. Callers must hold nm.mu.
+func (nm *NetworkManager) newWarmAttachment(id string) (*warmAttachment, error) {
+	if nm.parking == nil {
+		p, err := newParkingNetns()
+		if err != nil {
+			return nil, err
+		}
+		nm.parking = p
+	}
+	w := &warmAttachment{
+		id:       id,
+		hostName: hostVethName(nm.instance, id),
+		peerName: tmpLinkName(nm.instance, id),
+		mtu:      nm.containerMTU(&ContainerNetwork{Namespace: DefaultNamespace}),
+	}
+	if err := nm.setupWarm(w); err != nil {
+		return nil, errors.Join(err, nm.dropWarm(w))
+	}
+	return w, nil
+}
+
+func (nm *NetworkManager) setupWarm(w *warmAttachment) error {
+	for _, pool := range nm.pools {
+		addr, err := pool.Allocate(w.id, DefaultNamespace)
+		if err != nil {
+			return err
+		}
+		w.addrs = append(w.addrs, addr)
+	}
+	mac := containerMAC(w.addrs)
+	w.mac = mac.String()
+
+	// A pair of an attachment of an earlier run may be left until the
+	// kernel removed its namespace
+	if err := deleteVeth(w.hostName); err != nil {
+		return err
+	}
+	veth := &netlink.Veth{
+		LinkAttrs:        netlink.LinkAttrs{Name: w.hostName, MTU: w.mtu},
+		PeerName:         w.peerName,
+		PeerHardwareAddr: mac,
+		PeerNamespace:    netlink.NsFd(nm.parking.ns),
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create veth %s: %w", w.hostName, err)
+	}
+	host, err := netlink.LinkByName(w.hostName)
+	if err != nil {
+		return err
+	}
+	w.hostIfindex = host.Attrs().Index
+
+	if nm.xdp == nil {
+		return nil
+	}
+	return nm.xdp.AddContainer(w.hostIfindex, w.addrs, mac, host.Attrs().HardwareAddr, false, host.Attrs().MTU)
+}
+
+// dropWarm deletes the veth pair and datapath entries of w and releases
+// the addresses it still holds. Callers must hold nm.mu.
+func (nm *NetworkManager) dropWarm(w *warmAttachment) error {
+	err := deleteVeth(w.hostName)
+	if nm.xdp != nil && w.hostIfindex != 0 {
+		err = errors.Join(err, nm.xdp.DeleteContainer(w.hostIfindex, w.addrs))
+	}
+	nm.releaseAddrs(w.id)
+	return err
+}
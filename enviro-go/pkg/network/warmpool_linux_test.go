@@ -0,0 +1,249 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/1090mb/enviro/enviro-go/pkg/storage"
+)
+
+// warmTestEnv has a child of TestWarmPool run the test in the network
+// namespace of its own it was started in. warmCrashEnv has a child of
+// that one crash with a half-full warm pool, saving its state in the
+// directory it names and creating a container in the namespace at
+// warmNetnsEnv.
+const (
+	warmTestEnv  = "ENVIRO_TEST_WARM"
+	warmCrashEnv = "ENVIRO_TEST_WARM_CRASH"
+	warmNetnsEnv = "ENVIRO_TEST_WARM_NETNS"
+)
+
+// TestWarmPool creates containers from a warm pool and without, checks
+// the pool is emptied on close, and restarts a manager that crashed with
+// a half-full pool. It runs in a child in a network namespace of its own,
+// so the veths stay off the host.
+func TestWarmPool(t *testing.T) {
+	if dir := os.Getenv(warmCrashEnv); dir != "" {
+		crashWarmPool(t, dir, os.Getenv(warmNetnsEnv))
+		return
+	}
+	if os.Getenv(warmTestEnv) != "" {
+		t.Run("claim", runWarmClaim)
+		t.Run("crash", runWarmCrash)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating container networks needs root")
+	}
+	runInNetns(t, warmTestEnv)
+}
+
+// waitWarm waits for the warm pool of nm to hold n attachments
+func waitWarm(t *testing.T, nm *NetworkManager, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if nm.WarmPool().Ready == n {
+			return
+		}
+	}
+	t.Fatalf("warm pool holds %+v, want %d ready", nm.WarmPool(), n)
+}
+
+// hostVeths returns the names of the host veths of the default instance
+func hostVeths(t *testing.T) []string {
+	t.Helper()
+	links, err := netlink.LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, link := range links {
+		if isHostVethName("", link.Attrs().Name) {
+			names = append(names, link.Attrs().Name)
+		}
+	}
+	return names
+}
+
+func runWarmClaim(t *testing.T) {
+	ctx := context.Background()
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:     "10.99.0.0/24",
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		WarmPool: WarmPoolConfig{Size: 2, Interval: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitWarm(t, nm, 2)
+	if u := nm.PoolUsage()[0]; u.Allocated != 2 || u.Warm != 2 {
+		t.Errorf("PoolUsage() = %+v, want 2 warm addresses allocated", u)
+	}
+	if got := nm.Allocations(); len(got) != 0 {
+		t.Errorf("Allocations() = %v, want none for warm attachments", got)
+	}
+	if orphans, err := nm.CollectGarbage(ctx, true); err != nil || len(orphans) != 0 {
+		t.Errorf("CollectGarbage() = %+v, %v, want no orphans", orphans, err)
+	}
+
+	cn, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "warm", NetnsPath: containerNetns(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cn.Timing.Warm {
+		t.Error("create didn't take a warm attachment")
+	}
+	host, err := netlink.LinkByName(cn.HostInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Attrs().Index != cn.HostIfindex || host.Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("host veth %s has index %d and flags %s, want %d and up", cn.HostInterface, host.Attrs().Index, host.Attrs().Flags, cn.HostIfindex)
+	}
+	ns, err := netns.GetFromPath(cn.NetnsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Delete()
+	eth, err := h.LinkByName(containerIfName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eth.Attrs().HardwareAddr.String(); got != cn.MAC {
+		t.Errorf("container interface has MAC %s, want %s", got, cn.MAC)
+	}
+	addrs, err := h.AddrList(eth, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].IP.String() != cn.IPv4 {
+		t.Errorf("container interface has addresses %v, want %s", addrs, cn.IPv4)
+	}
+
+	// Requesting an address takes the usual path
+	cold, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "cold", NetnsPath: containerNetns(t), RequestedIP: "10.99.0.200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cold.Timing.Warm || cold.IPv4 != "10.99.0.200" {
+		t.Errorf("create requesting 10.99.0.200 got %s, warm %v", cold.IPv4, cold.Timing.Warm)
+	}
+	if s := nm.WarmPool(); s.Claims != 1 || s.Misses != 0 {
+		t.Errorf("WarmPool() = %+v, want a claim and no misses", s)
+	}
+	waitWarm(t, nm, 2)
+	if _, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: warmIDPrefix + "9", NetnsPath: containerNetns(t)}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("create with a warm attachment ID = %v, want %v", err, ErrInvalidConfig)
+	}
+
+	for _, id := range []string{"warm", "cold"} {
+		if err := nm.DeleteContainerNetwork(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if left := hostVeths(t); len(left) != 0 {
+		t.Errorf("veths %v left after close", left)
+	}
+}
+
+// openWarmState opens the state saved in dir
+func openWarmState(t *testing.T, dir string) StateStore {
+	t.Helper()
+	store, err := storage.Open(storage.Config{Dir: dir, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileStateStore(store)
+}
+
+// crashWarmPool creates a container in the namespace at path, which
+// doesn't take a warm attachment, and exits while the warm pool holds one
+// of its two, without closing the manager
+func crashWarmPool(t *testing.T, dir, path string) {
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:   "10.99.0.0/24",
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		State:  openWarmState(t, dir),
+		// The second attachment would be created in an hour
+		WarmPool: WarmPoolConfig{Size: 2, Interval: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitWarm(t, nm, 1)
+	spec := ContainerNetworkSpec{ContainerID: "survivor", NetnsPath: path, RequestedIP: "10.99.0.100"}
+	if _, err := nm.CreateContainerNetwork(context.Background(), spec); err != nil {
+		t.Fatal(err)
+	}
+	waitWarm(t, nm, 1)
+	os.Exit(0)
+}
+
+func runWarmCrash(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := containerNetns(t)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWarmPool$")
+	cmd.Env = append(os.Environ(), warmCrashEnv+"="+dir, warmNetnsEnv+"="+path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("crashing manager: %v: %s", err, out)
+	}
+
+	nm, err := NewNetworkManager(NetworkConfig{
+		CIDR:     "10.99.0.0/24",
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		State:    openWarmState(t, dir),
+		WarmPool: WarmPoolConfig{Size: 2, Interval: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nm.Close()
+	waitWarm(t, nm, 2)
+
+	survivor := nm.ContainerNetworks()["survivor"]
+	if survivor == nil {
+		t.Fatal("survivor wasn't restored")
+	}
+	if u := nm.PoolUsage()[0]; u.Allocated != 3 || u.Warm != 2 {
+		t.Errorf("PoolUsage() = %+v, want the survivor's and 2 warm addresses", u)
+	}
+	// The kernel removed the pairs of the crashed pool with its namespace,
+	// if the restart didn't replace them first
+	for deadline := time.Now().Add(10 * time.Second); len(hostVeths(t)) != 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("veths %v, want the survivor's and 2 warm ones", hostVeths(t))
+		}
+	}
+	if orphans, err := nm.CollectGarbage(ctx, false); err != nil || len(orphans) != 0 {
+		t.Errorf("CollectGarbage() = %+v, %v, want no orphans", orphans, err)
+	}
+
+	next, err := nm.CreateContainerNetwork(ctx, ContainerNetworkSpec{ContainerID: "next", NetnsPath: containerNetns(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.Timing.Warm || next.IPv4 == survivor.IPv4 {
+		t.Errorf("next got %s, warm %v, beside the survivor's %s", next.IPv4, next.Timing.Warm, survivor.IPv4)
+	}
+}
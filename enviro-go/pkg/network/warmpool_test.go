@@ -0,0 +1,193 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestWarmPoolConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config NetworkConfig
+		err    string
+	}{
+		{name: "disabled", config: NetworkConfig{IPAM: IPAMConfig{Backend: IPAMDHCP}}},
+		{name: "host-local", config: NetworkConfig{WarmPool: WarmPoolConfig{Size: 8, Namespaces: []string{"web"}}}},
+		{name: "negative size", config: NetworkConfig{WarmPool: WarmPoolConfig{Size: -1}}, err: "size"},
+		{name: "negative interval", config: NetworkConfig{WarmPool: WarmPoolConfig{Size: 1, Interval: -1}}, err: "interval"},
+		{name: "external IPAM", config: NetworkConfig{IPAM: IPAMConfig{Backend: IPAMExternal}, WarmPool: WarmPoolConfig{Size: 1}},
+			err: "requires host-local IPAM"},
+		{name: "bad namespace", config: NetworkConfig{WarmPool: WarmPoolConfig{Size: 1, Namespaces: []string{"Web"}}}, err: "not a DNS label"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.WarmPool.validate(tt.config)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("validate() = %v, want an ErrInvalidConfig with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	pool, err := newIPAllocator("10.99.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.ReserveRange("db", netip.MustParsePrefix("10.99.0.128/25")); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := pool.Allocate("warm/1", DefaultNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pool.Transfer("warm/1", "c1", "db"); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("Transfer() to a namespace with a range of its own = %v, want %v", err, ErrInvalidAddress)
+	}
+	if got, ok := pool.Lookup("warm/1"); !ok || got != addr {
+		t.Fatalf("a failed transfer left warm/1 with %s, want %s", got, addr)
+	}
+
+	got, err := pool.Transfer("warm/1", "c1", "web")
+	if err != nil || got != addr {
+		t.Fatalf("Transfer() = %s, %v, want %s", got, err, addr)
+	}
+	if _, ok := pool.Lookup("warm/1"); ok {
+		t.Error("warm/1 still holds an address after the transfer")
+	}
+	if owner := pool.Allocations(); owner["c1"] != addr || len(owner) != 1 {
+		t.Errorf("allocations after the transfer = %v", owner)
+	}
+	if _, err := pool.Transfer("warm/1", "c3", DefaultNamespace); err == nil {
+		t.Error("Transfer() from a container holding nothing succeeded")
+	}
+}
+
+func TestTakeWarm(t *testing.T) {
+	newManager := func(t *testing.T, config WarmPoolConfig) *NetworkManager {
+		t.Helper()
+		pool4, err := newIPAllocator("10.99.0.0/24", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool6, err := newIPAllocator("fd00:99::/64", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nm := &NetworkManager{
+			config:     NetworkConfig{WarmPool: config},
+			log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+			pools:      []*ipAllocator{pool4, pool6},
+			namespaces: map[string]Namespace{DefaultNamespace: {Name: DefaultNamespace}, "db": {Name: "db", MTU: 1400}},
+		}
+		for _, id := range []string{"warm/1", "warm/2"} {
+			w := &warmAttachment{id: id}
+			for _, pool := range nm.pools {
+				addr, err := pool.Allocate(id, DefaultNamespace)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.addrs = append(w.addrs, addr)
+			}
+			w.mac = containerMAC(w.addrs).String()
+			nm.warm = append(nm.warm, w)
+		}
+		return nm
+	}
+	take := func(nm *NetworkManager, spec ContainerNetworkSpec, res *Reservation) (*warmAttachment, *ContainerNetwork) {
+		cn := &ContainerNetwork{ContainerID: spec.ContainerID, Namespace: namespaceOf(spec.Namespace), MAC: spec.MAC, MTU: spec.MTU}
+		return nm.takeWarm(spec, res, cn), cn
+	}
+
+	t.Run("oldest first", func(t *testing.T) {
+		nm := newManager(t, WarmPoolConfig{Size: 2})
+		oldest := nm.warm[0]
+		w, cn := take(nm, ContainerNetworkSpec{ContainerID: "c1"}, nil)
+		if w != oldest {
+			t.Fatalf("takeWarm() = %+v, want the oldest attachment", w)
+		}
+		if cn.IPv4 != w.addrs[0].String() || cn.IPv6 != w.addrs[1].String() || cn.MAC != w.mac {
+			t.Errorf("container got %s, %s and %s, want those of the attachment %v and %s", cn.IPv4, cn.IPv6, cn.MAC, w.addrs, w.mac)
+		}
+		for _, pool := range nm.pools {
+			if _, ok := pool.Lookup(w.id); ok {
+				t.Errorf("%s still holds an address of %s", w.id, pool.prefix)
+			}
+		}
+		if len(nm.warm) != 1 || nm.warmClaims != 1 || nm.warmMisses != 0 {
+			t.Errorf("pool has %d attachments, %d claims and %d misses, want 1, 1 and 0", len(nm.warm), nm.warmClaims, nm.warmMisses)
+		}
+	})
+
+	ineligible := []struct {
+		name string
+		spec ContainerNetworkSpec
+		res  *Reservation
+		// miss is whether the container was eligible but found none
+		miss bool
+	}{
+		{name: "MAC", spec: ContainerNetworkSpec{MAC: "02:00:00:00:00:01"}},
+		{name: "reservation", res: &Reservation{IPv4: "10.99.0.200"}},
+		{name: "device", spec: ContainerNetworkSpec{Attachment: AttachmentMacvlan}},
+		{name: "namespace not listed", spec: ContainerNetworkSpec{Namespace: "web"}},
+		{name: "MTU", spec: ContainerNetworkSpec{MTU: 1400}, miss: true},
+		{name: "namespace MTU", spec: ContainerNetworkSpec{Namespace: "db"}, miss: true},
+	}
+	for _, tt := range ineligible {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := newManager(t, WarmPoolConfig{Size: 2, Namespaces: []string{DefaultNamespace, "db"}})
+			tt.spec.ContainerID = "c1"
+			if w, _ := take(nm, tt.spec, tt.res); w != nil {
+				t.Fatalf("takeWarm() = %+v, want none", w)
+			}
+			if len(nm.warm) != 2 {
+				t.Errorf("pool has %d attachments, want 2", len(nm.warm))
+			}
+			if miss := nm.warmMisses == 1; miss != tt.miss {
+				t.Errorf("misses = %d, want a miss %v", nm.warmMisses, tt.miss)
+			}
+		})
+	}
+
+	t.Run("range of its own", func(t *testing.T) {
+		nm := newManager(t, WarmPoolConfig{Size: 2})
+		if err := nm.pools[1].ReserveRange("db", netip.MustParsePrefix("fd00:99::8000/113")); err != nil {
+			t.Fatal(err)
+		}
+		nm.namespaces["db"] = Namespace{Name: "db"}
+		if w, _ := take(nm, ContainerNetworkSpec{ContainerID: "c1", Namespace: "db"}, nil); w != nil {
+			t.Fatalf("takeWarm() = %+v, want none outside the range", w)
+		}
+		// Neither address moved
+		for _, pool := range nm.pools {
+			if _, ok := pool.Lookup("warm/1"); !ok {
+				t.Errorf("warm/1 lost its address of %s", pool.prefix)
+			}
+			if _, ok := pool.Lookup("c1"); ok {
+				t.Errorf("c1 holds an address of %s", pool.prefix)
+			}
+		}
+		if nm.warmMisses != 1 {
+			t.Errorf("misses = %d, want 1", nm.warmMisses)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		nm := newManager(t, WarmPoolConfig{Size: 2})
+		nm.warm = nil
+		if w, _ := take(nm, ContainerNetworkSpec{ContainerID: "c1"}, nil); w != nil || nm.warmMisses != 1 {
+			t.Errorf("takeWarm() from an empty pool = %+v with %d misses, want none and a miss", w, nm.warmMisses)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// wireGuardDevice is the WireGuard device carrying encrypted traffic
+// between nodes
+const wireGuardDevice = "enviro.wg"
+
+// ErrEncryptionDisabled is returned for key rotation without WireGuard
+var ErrEncryptionDisabled = errors.New("network: overlay encryption not configured")
+
+// WireGuardConfig encrypts the overlay with WireGuard. Cross-node traffic
+// is routed through a WireGuard device instead of VXLAN, to each peer's
+// underlay address.
+type WireGuardConfig struct {
+	// KeyFile holds this node's private key, base64 encoded as by
+	// "wg genkey". A key is generated when the file doesn't exist.
+	KeyFile string `json:"key_file"`
+	// Port is the UDP port WireGuard listens on, defaults to 51820. It
+	// must match on all nodes.
+	Port int `json:"port"`
+}
+
+const defaultWireGuardPort = 51820
+
+// wireGuardKeyLen is the size of WireGuard's Curve25519 keys
+const wireGuardKeyLen = 32
+
+// PeerStats is the state of the tunnel to an overlay peer
+type PeerStats struct {
+	Name string
+	// Encrypted is true when traffic to the peer goes through WireGuard
+	Encrypted bool
+	// LastHandshake is when the current WireGuard session with the peer
+	// was established, zero before the first. Sessions are renewed every
+	// two minutes while traffic flows.
+	LastHandshake time.Time
+	// RxBytes and TxBytes count the WireGuard traffic with the peer
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// parseWireGuardKey decodes a base64 WireGuard key
+func parseWireGuardKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != wireGuardKeyLen {
+		return nil, fmt.Errorf("invalid WireGuard key %q", s)
+	}
+	return key, nil
+}
+
+// encodeWireGuardKey encodes a public key the way peers are given it
+func encodeWireGuardKey(key *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key.Bytes())
+}
+
+// loadWireGuardKey reads the private key at path, generating it when the
+// file doesn't exist
+func loadWireGuardKey(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeWireGuardKey(path, key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard key: %w", err)
+	}
+	raw, err := parseWireGuardKey(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// writeWireGuardKey replaces the private key at path, readable only by
+// its owner
+func writeWireGuardKey(path string, key *ecdh.PrivateKey) error {
+	tmp := path + ".tmp"
+	data := base64.StdEncoding.EncodeToString(key.Bytes()) + "\n"
+	if err := os.WriteFile(tmp, []byte(data), 0o600); err != nil {
+		return fmt.Errorf("failed to write WireGuard key: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write WireGuard key: %w", err)
+	}
+	return nil
+}
+
+// OverlayPublicKey returns this node's WireGuard public key, which peers
+// are added with, or "" without encryption
+func (nm *NetworkManager) OverlayPublicKey() string {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.wgKey == nil {
+		return ""
+	}
+	return encodeWireGuardKey(nm.wgKey.PublicKey())
+}
+
+// RotateKey replaces this node's WireGuard key, in the device and in
+// WireGuardConfig.KeyFile, and returns the new public key. Sessions with
+// the old key end, and peers can't establish new ones until they are
+// given the new key with AddPeer, so the control plane should propagate
+// it right away.
+func (nm *NetworkManager) RotateKey() (string, error) {
+	if nm.config.Node == nil || nm.config.Node.WireGuard == nil {
+		return "", ErrEncryptionDisabled
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if err := nm.setWireGuardKey(key); err != nil {
+		return "", fmt.Errorf("failed to set WireGuard key: %w", err)
+	}
+	if err := writeWireGuardKey(nm.config.Node.WireGuard.KeyFile, key); err != nil {
+		// Keep the device and the file in agreement
+		if restoreErr := nm.setWireGuardKey(nm.wgKey); restoreErr != nil {
+			nm.log.Error("Failed to restore WireGuard key", "error", restoreErr)
+		}
+		return "", err
+	}
+	nm.wgKey = key
+	public := encodeWireGuardKey(key.PublicKey())
+	nm.log.Info("Rotated WireGuard key", "public_key", public)
+	return public, nil
+}
+
+// PeerStats returns the tunnel state of each overlay peer, sorted by name
+func (nm *NetworkManager) PeerStats() ([]PeerStats, error) {
+	nm.mu.Lock()
+	peers := nm.sortedPeers()
+	encrypted := nm.wgKey != nil
+	nm.mu.Unlock()
+
+	if len(peers) == 0 {
+		return nil, nil
+	}
+	out := make([]PeerStats, len(peers))
+	for i, p := range peers {
+		out[i] = PeerStats{Name: p.Name, Encrypted: encrypted}
+	}
+	if !encrypted {
+		return out, nil
+	}
+
+	states, err := nm.wireGuardPeers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard peers: %w", err)
+	}
+	for i, p := range peers {
+		state, ok := states[p.PublicKey]
+		if !ok {
+			continue
+		}
+		out[i].LastHandshake = state.LastHandshake
+		out[i].RxBytes = state.RxBytes
+		out[i].TxBytes = state.TxBytes
+	}
+	return out, nil
+}
@@ -0,0 +1,271 @@
+//go:build linux
+
+package network
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// WireGuard generic netlink interface, from linux/wireguard.h
+const (
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+
+	wgCmdGetDevice = 0
+	wgCmdSetDevice = 1
+
+	wgDeviceIfindex    = 1
+	wgDevicePrivateKey = 3
+	wgDeviceListenPort = 6
+	wgDevicePeers      = 8
+
+	wgPeerPublicKey     = 1
+	wgPeerFlags         = 3
+	wgPeerEndpoint      = 4
+	wgPeerLastHandshake = 6
+	wgPeerRxBytes       = 7
+	wgPeerTxBytes       = 8
+	wgPeerAllowedIPs    = 9
+
+	wgPeerRemoveMe          = 1 << 0
+	wgPeerReplaceAllowedIPs = 1 << 1
+
+	wgAllowedIPFamily = 1
+	wgAllowedIPAddr   = 2
+	wgAllowedIPCIDR   = 3
+)
+
+// createWireGuard creates the WireGuard device listening on the configured
+// port with the node's key, sized to fit the underlay
+func (nm *NetworkManager) createWireGuard(local netip.Addr, underlay netlink.Link) (netlink.Link, error) {
+	config := nm.config.Node.WireGuard
+	key, err := loadWireGuardKey(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	overhead := wireGuardOverhead
+	if local.Is6() {
+		overhead = wireGuard6Overhead
+	}
+	wg := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{
+		Name: wireGuardDevice,
+		MTU:  underlay.Attrs().MTU - overhead,
+	}}
+	if err := netlink.LinkAdd(wg); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", wireGuardDevice, err)
+	}
+	link, err := netlink.LinkByName(wireGuardDevice)
+	if err != nil {
+		return nil, err
+	}
+
+	device := wgDeviceAttrs(link.Attrs().Index)
+	device = append(device,
+		nl.NewRtAttr(wgDevicePrivateKey, key.Bytes()),
+		nl.NewRtAttr(wgDeviceListenPort, nl.Uint16Attr(uint16(config.Port))),
+	)
+	if err := wgSetDevice(device...); err != nil {
+		netlink.LinkDel(link)
+		return nil, fmt.Errorf("failed to configure %s: %w", wireGuardDevice, err)
+	}
+	nm.wgKey = key
+	return link, nil
+}
+
+// setWireGuardKey changes the private key of the WireGuard device
+func (nm *NetworkManager) setWireGuardKey(key *ecdh.PrivateKey) error {
+	return wgSetDevice(append(wgDeviceAttrs(nm.overlayIndex), nl.NewRtAttr(wgDevicePrivateKey, key.Bytes()))...)
+}
+
+// programWireGuardPeer adds p to the WireGuard device, its subnets being
+// the allowed IPs of its key, and routes them through the device
+func (nm *NetworkManager) programWireGuardPeer(p Peer) error {
+	key, _ := parseWireGuardKey(p.PublicKey)
+	addr := netip.MustParseAddr(p.Address)
+
+	peer := nl.NewRtAttr(unix.NLA_F_NESTED, nil)
+	peer.AddRtAttr(wgPeerPublicKey, key)
+	peer.AddRtAttr(wgPeerFlags, nl.Uint32Attr(wgPeerReplaceAllowedIPs))
+	peer.AddRtAttr(wgPeerEndpoint, wgSockaddr(netip.AddrPortFrom(addr, uint16(nm.config.Node.WireGuard.Port))))
+	allowed := peer.AddRtAttr(unix.NLA_F_NESTED|wgPeerAllowedIPs, nil)
+	for _, sub := range peerPrefixes(p) {
+		family := uint16(unix.AF_INET)
+		if sub.Addr().Is6() {
+			family = unix.AF_INET6
+		}
+		ip := allowed.AddRtAttr(unix.NLA_F_NESTED, nil)
+		ip.AddRtAttr(wgAllowedIPFamily, nl.Uint16Attr(family))
+		ip.AddRtAttr(wgAllowedIPAddr, sub.Addr().AsSlice())
+		ip.AddRtAttr(wgAllowedIPCIDR, nl.Uint8Attr(uint8(sub.Bits())))
+	}
+	if err := nm.setWireGuardPeer(peer); err != nil {
+		return fmt.Errorf("failed to add WireGuard peer: %w", err)
+	}
+
+	for _, sub := range peerPrefixes(p) {
+		route := &netlink.Route{
+			LinkIndex: nm.overlayIndex,
+			Dst:       prefixIPNet(sub),
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to route %s: %w", sub, err)
+		}
+	}
+	return nil
+}
+
+// unprogramWireGuardPeer undoes programWireGuardPeer, ignoring entries
+// that are already gone
+func (nm *NetworkManager) unprogramWireGuardPeer(p Peer) error {
+	var errs []error
+	for _, sub := range peerPrefixes(p) {
+		errs = append(errs, ignoreMissing(netlink.RouteDel(&netlink.Route{LinkIndex: nm.overlayIndex, Dst: prefixIPNet(sub)})))
+	}
+	key, _ := parseWireGuardKey(p.PublicKey)
+	peer := nl.NewRtAttr(unix.NLA_F_NESTED, nil)
+	peer.AddRtAttr(wgPeerPublicKey, key)
+	peer.AddRtAttr(wgPeerFlags, nl.Uint32Attr(wgPeerRemoveMe))
+	if err := nm.setWireGuardPeer(peer); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove WireGuard peer: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// setWireGuardPeer applies one peer entry to the WireGuard device
+func (nm *NetworkManager) setWireGuardPeer(peer *nl.RtAttr) error {
+	peers := nl.NewRtAttr(unix.NLA_F_NESTED|wgDevicePeers, nil)
+	peers.AddChild(peer)
+	return wgSetDevice(append(wgDeviceAttrs(nm.overlayIndex), peers)...)
+}
+
+// wireGuardPeers reads the handshake time and traffic of the WireGuard
+// device's peers, keyed by their base64 public key
+func (nm *NetworkManager) wireGuardPeers() (map[string]PeerStats, error) {
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return nil, err
+	}
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_DUMP)
+	req.AddData(&nl.Genlmsg{Command: wgCmdGetDevice, Version: wgGenlVersion})
+	for _, a := range wgDeviceAttrs(nm.overlayIndex) {
+		req.AddData(a)
+	}
+	msgs, err := req.Execute(unix.NETLINK_GENERIC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Devices with many peers are split across messages
+	out := make(map[string]PeerStats)
+	for _, msg := range msgs {
+		attrs, err := nl.ParseRouteAttr(msg[nl.SizeofGenlmsg:])
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range attrs {
+			if wgAttrType(a.Attr.Type) != wgDevicePeers {
+				continue
+			}
+			peers, err := nl.ParseRouteAttr(a.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, peer := range peers {
+				key, stats, err := parseWireGuardPeer(peer.Value)
+				if err != nil {
+					return nil, err
+				}
+				out[key] = stats
+			}
+		}
+	}
+	return out, nil
+}
+
+// parseWireGuardPeer decodes the attributes of a dumped peer
+func parseWireGuardPeer(b []byte) (string, PeerStats, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return "", PeerStats{}, err
+	}
+	var key string
+	var stats PeerStats
+	native := nl.NativeEndian()
+	for _, a := range attrs {
+		switch wgAttrType(a.Attr.Type) {
+		case wgPeerPublicKey:
+			key = base64.StdEncoding.EncodeToString(a.Value)
+		case wgPeerLastHandshake:
+			// struct __kernel_timespec
+			if len(a.Value) < 16 {
+				continue
+			}
+			sec, nsec := int64(native.Uint64(a.Value[0:8])), int64(native.Uint64(a.Value[8:16]))
+			if sec != 0 || nsec != 0 {
+				stats.LastHandshake = time.Unix(sec, nsec)
+			}
+		case wgPeerRxBytes:
+			stats.RxBytes = native.Uint64(a.Value)
+		case wgPeerTxBytes:
+			stats.TxBytes = native.Uint64(a.Value)
+		}
+	}
+	return key, stats, nil
+}
+
+// wgSetDevice changes the WireGuard device per attrs
+func wgSetDevice(attrs ...*nl.RtAttr) error {
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return fmt.Errorf("WireGuard is unavailable: %w", err)
+	}
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: wgCmdSetDevice, Version: wgGenlVersion})
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	_, err = req.Execute(unix.NETLINK_GENERIC, 0)
+	return err
+}
+
+// wgDeviceAttrs selects the WireGuard device by ifindex
+func wgDeviceAttrs(index int) []*nl.RtAttr {
+	return []*nl.RtAttr{nl.NewRtAttr(wgDeviceIfindex, nl.Uint32Attr(uint32(index)))}
+}
+
+// wgAttrType strips the flags the kernel sets on attribute types
+func wgAttrType(t uint16) uint16 {
+	return t &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+}
+
+// wgSockaddr encodes a peer endpoint as a struct sockaddr_in or
+// sockaddr_in6
+func wgSockaddr(ap netip.AddrPort) []byte {
+	native := nl.NativeEndian()
+	if ap.Addr().Is4() {
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		native.PutUint16(b[0:2], unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:4], ap.Port())
+		a := ap.Addr().As4()
+		copy(b[4:8], a[:])
+		return b
+	}
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	native.PutUint16(b[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:4], ap.Port())
+	a := ap.Addr().As16()
+	copy(b[8:24], a[:])
+	return b
+}
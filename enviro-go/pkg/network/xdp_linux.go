@@ -0,0 +1,1521 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// containerInfo mirrors struct container_info in bpf/container_router.c
+type containerInfo struct {
+	Ifindex uint32
+	Flags   uint32
+	MAC     [6]byte
+	HostMAC [6]byte
+	MTU     uint32
+}
+
+// Flags of containerInfo, mirroring CONTAINER_F_*
+const (
+	containerShaped   = 1
+	containerMACSet   = 2
+	containerDraining = 4
+	containerPrefix   = 8
+)
+
+// routeKey mirrors struct route_key in bpf/container_router.c. The kernel
+// reads Prefixlen in host byte order.
+type routeKey struct {
+	Prefixlen uint32
+	Addr      [4]byte
+}
+
+// routeKey6 mirrors struct route_key6 in bpf/container_router.c
+type routeKey6 struct {
+	Prefixlen uint32
+	Addr      [16]byte
+}
+
+func newRouteKey(p netip.Prefix) routeKey {
+	return routeKey{Prefixlen: uint32(p.Bits()), Addr: p.Addr().As4()}
+}
+
+func newRouteKey6(p netip.Prefix) routeKey6 {
+	return routeKey6{Prefixlen: uint32(p.Bits()), Addr: p.Addr().As16()}
+}
+
+// routePrefix decodes a routeKey or routeKey6 read as bytes
+func routePrefix(key []byte) netip.Prefix {
+	addr, _ := netip.AddrFromSlice(key[4:])
+	return netip.PrefixFrom(addr, int(binary.NativeEndian.Uint32(key)))
+}
+
+// addrPrefix is the route prefix of the container address addr
+func addrPrefix(addr netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// containerFault mirrors struct container_fault in bpf/container_router.c
+type containerFault struct {
+	DropThreshold uint32
+	Pad           uint32
+}
+
+// faultDelay mirrors struct fault_delay in bpf/container_router.c
+type faultDelay struct {
+	DelayNS          uint64
+	JitterNS         uint64
+	ReorderThreshold uint32
+	Pad              uint32
+}
+
+// ifaceMAC mirrors struct iface_mac in bpf/container_router.c
+type ifaceMAC struct {
+	Addr [6]byte
+	Pad  uint16
+}
+
+// datapathStats mirrors struct datapath_stats in bpf/container_router.c
+type datapathStats struct {
+	Packets    uint64
+	Bytes      uint64
+	Drops      uint64
+	Redirects  uint64
+	FragNeeded uint64
+	Rejects    uint64
+	// SYN cookies sent, and those the resets answering them proved valid
+	// or not
+	SYNCookiesSent    uint64
+	SYNCookiesValid   uint64
+	SYNCookiesInvalid uint64
+	// Spoofed counts the frames containers sent from a MAC or address not
+	// theirs, which the other counters leave out
+	Spoofed uint64
+	// NeighborSpoofed counts the ARP and neighbor discovery messages
+	// containers sent claiming an address or MAC not theirs, which
+	// Spoofed leaves out
+	NeighborSpoofed uint64
+	// PolicyChecks counts the packets checked against the policies, and
+	// ConnectChecks the connections and UDP sends checked as they were
+	// made, ConnectDenied of which were refused
+	PolicyChecks  uint64
+	ConnectChecks uint64
+	ConnectDenied uint64
+	// AccelSockets counts the sockets added to the sockhash, and
+	// AccelMsgs and AccelBytes what was spliced through them, which the
+	// packet counters leave out
+	AccelSockets uint64
+	AccelMsgs    uint64
+	AccelBytes   uint64
+}
+
+func (s *datapathStats) add(o datapathStats) {
+	s.Packets += o.Packets
+	s.Bytes += o.Bytes
+	s.Drops += o.Drops
+	s.Redirects += o.Redirects
+	s.FragNeeded += o.FragNeeded
+	s.Rejects += o.Rejects
+	s.SYNCookiesSent += o.SYNCookiesSent
+	s.SYNCookiesValid += o.SYNCookiesValid
+	s.SYNCookiesInvalid += o.SYNCookiesInvalid
+	s.Spoofed += o.Spoofed
+	s.NeighborSpoofed += o.NeighborSpoofed
+	s.PolicyChecks += o.PolicyChecks
+	s.ConnectChecks += o.ConnectChecks
+	s.ConnectDenied += o.ConnectDenied
+	s.AccelSockets += o.AccelSockets
+	s.AccelMsgs += o.AccelMsgs
+	s.AccelBytes += o.AccelBytes
+}
+
+// policyKey mirrors struct policy_key in bpf/container_router.c. Addresses
+// and port are in network byte order.
+type policyKey struct {
+	Src   [4]byte
+	Dst   [4]byte
+	Port  [2]byte
+	Proto uint8
+	Pad   uint8
+}
+
+// policyKey6 mirrors struct policy_key6 in bpf/container_router.c
+type policyKey6 struct {
+	Src   [16]byte
+	Dst   [16]byte
+	Port  [2]byte
+	Proto uint8
+	Pad   uint8
+}
+
+// policyCIDRKey mirrors struct policy_cidr_key in bpf/container_router.c.
+// The kernel reads Prefixlen in host byte order.
+type policyCIDRKey struct {
+	Prefixlen uint32
+	Dst       [4]byte
+	Port      [2]byte
+	Proto     uint8
+	Pad       uint8
+	Src       [4]byte
+}
+
+// policyCIDRKey6 mirrors struct policy_cidr_key6 in bpf/container_router.c
+type policyCIDRKey6 struct {
+	Prefixlen uint32
+	Dst       [16]byte
+	Port      [2]byte
+	Proto     uint8
+	Pad       uint8
+	Src       [16]byte
+}
+
+// Bits of a policy CIDR key before the source, which always match
+const (
+	policyCIDRBits  = 64
+	policyCIDR6Bits = 160
+)
+
+// Policy verdicts as stored in the policies map
+const (
+	bpfPolicyAllow  uint8 = 1
+	bpfPolicyDeny   uint8 = 2
+	bpfPolicyReject uint8 = 3
+)
+
+// Slots of the policy_default map
+const (
+	policySlotDefault    uint32 = 0
+	policySlotRejectRate uint32 = 1
+)
+
+// xdpProgram is the loaded container router and its maps
+type xdpProgram struct {
+	coll             *ebpf.Collection
+	routes           *ebpf.Map
+	routes6          *ebpf.Map
+	stats            *ebpf.Map
+	containerStats   *ebpf.Map
+	policies         *ebpf.Map
+	policies6        *ebpf.Map
+	policyCIDRs      *ebpf.Map
+	policyCIDRs6     *ebpf.Map
+	policyDefault    *ebpf.Map
+	conntrack        *ebpf.Map
+	containerNS      *ebpf.Map
+	containerNS6     *ebpf.Map
+	namespaceAllow   *ebpf.Map
+	xsks             *ebpf.Map
+	xskFlows         *ebpf.Map
+	latency          *ebpf.Map
+	containerLatency *ebpf.Map
+	containerTraffic *ebpf.Map
+	dropEvents       *ebpf.Map
+	dropEventsPerf   *ebpf.Map
+	dropEventsLost   *ebpf.Map
+	containerFaults  *ebpf.Map
+	faultDelays      *ebpf.Map
+	synProtected     *ebpf.Map
+	synRates         *ebpf.Map
+	synTrusted       *ebpf.Map
+	synConfig        *ebpf.Map
+	sourceMACs       *ebpf.Map
+	sourceAddrs      *ebpf.Map
+	connectSources   *ebpf.Map
+	accelSocks       *ebpf.Map
+	accelExcluded    *ebpf.Map
+	proxyRedirects   *ebpf.Map
+	portForwards     *ebpf.Map
+	natConntrack     *ebpf.Map
+	paceLimits       *ebpf.Map
+	captureFilters   *ebpf.Map
+	captureEvents    *ebpf.Map
+	link             routerLink
+	mode             DatapathMode
+	// forward is the port forward filter behind the router on its
+	// interface in XDP modes, nil in TC mode, whose router translates
+	// forwarded ports itself, and where it couldn't be attached
+	forward *tcLink
+	// modes are the attach modes to try, in order, all supported by the
+	// kernel
+	modes []DatapathMode
+	// pinPath is the bpffs directory the maps are pinned in, if any
+	pinPath string
+	// carried are the maps taken over from a previous run
+	carried []string
+	// loadedAt is when the program in use was loaded, and loadTime how
+	// long loading and verifying it took
+	loadedAt time.Time
+	loadTime time.Duration
+	// sizes are the sizes of the programs in use, counted from their spec
+	sizes map[string]programSize
+	// keep leaves the router attached on Close
+	keep bool
+	// synProtection is set when the router was loaded with SYN
+	// protection, which upgrades keep
+	synProtection bool
+	// connectPolicy is set when the router was loaded with the programs
+	// of connect-time policy, which upgrades keep
+	connectPolicy bool
+	// socketAcceleration is set when the router was loaded with the
+	// programs of socket acceleration, which upgrades keep
+	socketAcceleration bool
+	// proxyRedirect is set when the router was loaded with the programs
+	// of proxy redirection, which upgrades keep
+	proxyRedirect bool
+	// skMsg is the sk_msg program attached to accel_socks, if any
+	skMsg *ebpf.Program
+	// batch queues route updates between BatchRoutes and FlushRoutes
+	batch *routeBatch
+	// stopGC ends the conntrack expiry started by startConntrackGC, which
+	// closes gcDone once it returned
+	stopGC   chan struct{}
+	gcDone   chan struct{}
+	gcConfig ConntrackConfig
+	gcLog    *slog.Logger
+	// drops reads drop_events or drop_events_perf for onDrop until
+	// stopDropReader closes it, and dropsDone is closed once the reader
+	// returned. perfLost counts the drops the perf reader missed.
+	drops     io.Closer
+	dropsDone chan struct{}
+	onDrop    func(dropRecord)
+	perfLost  atomic.Uint64
+	// tap hands the frames tc_capture copies to the captures running
+	tap captureTap
+}
+
+// Entry points in the router object: the XDP program, its TC variant,
+// the source check on the host veths, the port forward filter behind
+// the XDP program, the pacing of the traffic to and from containers
+// with a bandwidth limit and the copying of that of containers being
+// captured
+const (
+	routerProgram      = "xdp_container_router"
+	tcRouterProgram    = "tc_container_router"
+	sourceProgram      = "tc_container_source"
+	forwardProgram     = "tc_port_forward"
+	paceIngressProgram = "tc_pace_ingress"
+	paceEgressProgram  = "tc_pace_egress"
+	captureProgram     = "tc_capture"
+)
+
+// routerLink is the attachment of the router to its interface, an XDP
+// link or a tcLink
+type routerLink interface {
+	// Update replaces the attached program without detaching
+	Update(*ebpf.Program) error
+	Close() error
+}
+
+// loadXDP loads the embedded container router with a conntrack table of
+// conntrackMax entries and attaches it to iface in the first of the
+// supported modes from mode on that works. The maps are pinned in pinPath
+// when it is set, and those of carriedMaps a previous run pinned there
+// are taken over, as is a router it kept attached. synProtection enables
+// the SYN protection stage, while connectPolicy, socketAcceleration and
+// proxyRedirect load the programs of connect-time policy, socket
+// acceleration and proxy redirection, which the kernel must support.
+func loadXDP(iface string, mode DatapathMode, conntrackMax int, pinPath string, synProtection, connectPolicy, socketAcceleration, proxyRedirect bool) (*xdpProgram, error) {
+	if len(routerBytecode) == 0 {
+		return nil, errors.New("XDP bytecode not embedded (build with -tags bpfobj)")
+	}
+	if iface == "" {
+		return nil, errors.New("no interface configured for XDP")
+	}
+	ifc, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %w", iface, err)
+	}
+	modes, err := supportedModes(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(routerBytecode))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse XDP bytecode: %w", err)
+	}
+	spec.Maps["conntrack"].MaxEntries = uint32(conntrackMax)
+	if ms, ok := spec.Maps["nat_conntrack"]; ok {
+		ms.MaxEntries = uint32(conntrackMax)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		return nil, err
+	}
+	trimPrograms(spec, modes)
+
+	x := &xdpProgram{pinPath: pinPath, modes: modes, synProtection: synProtection, connectPolicy: connectPolicy,
+		socketAcceleration: socketAcceleration, proxyRedirect: proxyRedirect}
+	if err := x.applySYNProtection(spec); err != nil {
+		return nil, err
+	}
+	x.applyConnectPolicy(spec)
+	x.applySocketAcceleration(spec)
+	x.applyProxyRedirect(spec)
+	x.sizes = programSizes(spec)
+	carried := x.pinnedMaps(spec)
+	x.loadedAt = time.Now()
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{MapReplacements: carried})
+	x.loadTime = time.Since(x.loadedAt)
+	// Replacements are cloned
+	for name, m := range carried {
+		x.carried = append(x.carried, name)
+		m.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load XDP program: %w", err)
+	}
+	sort.Strings(x.carried)
+
+	x.setCollection(coll)
+	if err := x.pin(coll); err != nil {
+		coll.Close()
+		return nil, err
+	}
+
+	if err := x.attachSkMsg(); err != nil {
+		x.unpin()
+		coll.Close()
+		return nil, err
+	}
+	if err := x.takeOver(ifc); err != nil {
+		x.detachSkMsg()
+		x.unpin()
+		coll.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// supportedModes returns the attach modes from first on, in order, that
+// the kernel was probed to run the router in, so an old kernel is reported
+// as such rather than as a verifier or load error
+func supportedModes(first DatapathMode) ([]DatapathMode, error) {
+	v := probedKernel().Datapath
+	if v.Error != "" {
+		return nil, errors.New(v.Error)
+	}
+	order := datapathModes
+	for i, m := range datapathModes {
+		if m == first {
+			order = datapathModes[i:]
+		}
+	}
+	var modes []DatapathMode
+	for _, m := range order {
+		if slices.Contains(v.Modes, m) {
+			modes = append(modes, m)
+		}
+	}
+	if len(modes) == 0 {
+		return nil, fmt.Errorf("kernel can't run the router in %s mode or later ones, only in %v", first, v.Modes)
+	}
+	return modes, nil
+}
+
+// applyVariant adapts the router in spec to the kernel as probed: the
+// connection tables become plain hashes without LRU maps, and drops are
+// reported through drop_events_perf without ring buffers. drop_events then
+// stays as an unused placeholder, for the code the verifier prunes.
+func applyVariant(spec *ebpf.CollectionSpec, v DatapathVariant) error {
+	if v.ConntrackMap == "hash" {
+		// syn_verified goes unused there, as SYN protection needs 6.0
+		for _, name := range []string{"conntrack", "nat_conntrack", "syn_verified"} {
+			if m, ok := spec.Maps[name]; ok {
+				m.Type = ebpf.Hash
+			}
+		}
+	}
+	if v.DropEvents != DropEventsPerf || spec.Maps["drop_events"] == nil {
+		return nil
+	}
+	if spec.Maps["drop_events_perf"] == nil {
+		return fmt.Errorf("%w: router can't report drops on kernels without ring buffers", ErrInvalidDatapath)
+	}
+	spec.Maps["drop_events"] = &ebpf.MapSpec{Name: "drop_events", Type: ebpf.Array, KeySize: 4, ValueSize: 4, MaxEntries: 1}
+	if err := spec.RewriteConstants(map[string]interface{}{"perf_drop_events": uint32(1)}); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDatapath, err)
+	}
+	return nil
+}
+
+// applySYNProtection enables the SYN protection stage of the router in
+// spec when x has it
+func (x *xdpProgram) applySYNProtection(spec *ebpf.CollectionSpec) error {
+	if !x.synProtection {
+		return nil
+	}
+	if err := spec.RewriteConstants(map[string]interface{}{"syn_protection": uint32(1)}); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDatapath, err)
+	}
+	return nil
+}
+
+// programName returns the entry point attached in mode
+func programName(mode DatapathMode) string {
+	if mode == DatapathTC {
+		return tcRouterProgram
+	}
+	return routerProgram
+}
+
+// programType returns the program type of the entry point for mode
+func programType(mode DatapathMode) ebpf.ProgramType {
+	if mode == DatapathTC {
+		return ebpf.SchedCLS
+	}
+	return ebpf.XDP
+}
+
+// trimPrograms removes the entry points none of modes attaches from spec,
+// as the kernel may not be able to load them. The source check, the
+// pacing and the capture are kept where TC is among modes, as they need what the TC
+// router does, the port forward filter where XDP modes are too, and the
+// resume programs of extensions with their routers. The programs of
+// optional features are left to their apply functions.
+func trimPrograms(spec *ebpf.CollectionSpec, modes []DatapathMode) {
+	used := map[string]bool{routerProgram: false, tcRouterProgram: false}
+	for _, m := range modes {
+		used[programName(m)] = true
+	}
+	used[sourceProgram] = used[tcRouterProgram]
+	used[paceIngressProgram] = used[tcRouterProgram]
+	used[paceEgressProgram] = used[tcRouterProgram]
+	used[captureProgram] = used[tcRouterProgram]
+	used[forwardProgram] = used[tcRouterProgram] && used[routerProgram]
+	used[xdpResumeProgram] = used[routerProgram]
+	used[tcResumeProgram] = used[tcRouterProgram]
+	for name, ok := range used {
+		if !ok {
+			delete(spec.Programs, name)
+		}
+	}
+}
+
+// setCollection points x at the maps of coll
+func (x *xdpProgram) setCollection(coll *ebpf.Collection) {
+	x.coll = coll
+	x.routes = coll.Maps["container_routes"]
+	x.routes6 = coll.Maps["container_routes6"]
+	x.stats = coll.Maps["stats"]
+	x.containerStats = coll.Maps["container_stats"]
+	x.policies = coll.Maps["policies"]
+	x.policies6 = coll.Maps["policies6"]
+	x.policyCIDRs = coll.Maps["policy_cidrs"]
+	x.policyCIDRs6 = coll.Maps["policy_cidrs6"]
+	x.policyDefault = coll.Maps["policy_default"]
+	x.conntrack = coll.Maps["conntrack"]
+	x.containerNS = coll.Maps["container_ns"]
+	x.containerNS6 = coll.Maps["container_ns6"]
+	x.namespaceAllow = coll.Maps["namespace_allow"]
+	x.xsks = coll.Maps["xsks"]
+	x.xskFlows = coll.Maps["xsk_flows"]
+	x.latency = coll.Maps["latency"]
+	x.containerLatency = coll.Maps["container_latency"]
+	x.containerTraffic = coll.Maps["container_traffic"]
+	x.dropEvents = coll.Maps["drop_events"]
+	x.dropEventsLost = coll.Maps["drop_events_lost"]
+	x.containerFaults = coll.Maps["container_faults"]
+	x.faultDelays = coll.Maps["fault_delays"]
+	x.synProtected = coll.Maps["syn_protected"]
+	x.synRates = coll.Maps["syn_rates"]
+	x.synTrusted = coll.Maps["syn_trusted"]
+	x.synConfig = coll.Maps["syn_config"]
+	x.sourceMACs = coll.Maps["source_macs"]
+	x.sourceAddrs = coll.Maps["source_addrs"]
+	x.connectSources = coll.Maps["connect_sources"]
+	x.accelSocks = coll.Maps["accel_socks"]
+	x.accelExcluded = coll.Maps["accel_excluded"]
+	x.proxyRedirects = coll.Maps["proxy_redirects"]
+	x.portForwards = coll.Maps["port_forwards"]
+	x.natConntrack = coll.Maps["nat_conntrack"]
+	x.paceLimits = coll.Maps["pace_limits"]
+	x.captureFilters = coll.Maps["capture_filters"]
+	x.captureEvents = coll.Maps["capture_events"]
+	// drop_events is a placeholder where applyVariant chose perf events
+	if x.dropEvents != nil && x.dropEvents.Type() != ebpf.RingBuf {
+		x.dropEvents, x.dropEventsPerf = nil, coll.Maps["drop_events_perf"]
+	} else {
+		x.dropEventsPerf = nil
+	}
+}
+
+// carriedMaps are the maps whose entries stay valid across runs: the
+// connections, the translations of forwarded ones and the node's counters
+// and latency. Routes, policies and forwards are programmed anew from the
+// restored state.
+var carriedMaps = []string{"conntrack", "nat_conntrack", "stats", "latency"}
+
+// pinnedMaps opens the maps of carriedMaps pinned in x.pinPath by a
+// previous run, whether it was stopped or kept its router attached. Maps
+// that no longer fit spec, e.g. as the conntrack size changed, start over.
+func (x *xdpProgram) pinnedMaps(spec *ebpf.CollectionSpec) map[string]*ebpf.Map {
+	if x.pinPath == "" {
+		return nil
+	}
+	out := make(map[string]*ebpf.Map)
+	for _, name := range carriedMaps {
+		ms, ok := spec.Maps[name]
+		if !ok {
+			continue
+		}
+		m, err := ebpf.LoadPinnedMap(filepath.Join(x.pinPath, name), nil)
+		if err != nil {
+			continue
+		}
+		if ms.Compatible(m) != nil {
+			m.Close()
+			continue
+		}
+		ms.Pinning = ebpf.PinNone
+		out[name] = m
+	}
+	return out
+}
+
+// pin pins the maps of coll in x.pinPath, replacing existing pins, e.g.
+// those left behind by a previous run, whose entries would be stale unless
+// carried over
+func (x *xdpProgram) pin(coll *ebpf.Collection) error {
+	if x.pinPath == "" {
+		return nil
+	}
+	if err := os.MkdirAll(x.pinPath, 0o700); err != nil {
+		return fmt.Errorf("failed to create pin path: %w", err)
+	}
+	for name, m := range coll.Maps {
+		path := filepath.Join(x.pinPath, name)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale pin %s: %w", path, err)
+		}
+		if err := m.Pin(path); err != nil {
+			return fmt.Errorf("failed to pin map %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// unpin removes the pins of the maps, which are then released with the
+// last reference
+func (x *xdpProgram) unpin() {
+	if x.pinPath == "" {
+		return
+	}
+	for name := range x.coll.Maps {
+		os.Remove(filepath.Join(x.pinPath, name))
+	}
+}
+
+// Upgrade replaces the attached router with the one in spec without
+// detaching it: the new program is loaded against the maps in use, so
+// routes, policies, counters and connections carry over, and the XDP link
+// is switched to it atomically. The maps of the new program must match
+// those in use by type, key and value size, unless mapMigrations converts
+// their entries from one layout to the other; max entries and flags are
+// taken over. The old program stays attached when anything fails.
+func (x *xdpProgram) Upgrade(spec *ebpf.CollectionSpec) error {
+	if x.link == nil {
+		return errors.New("XDP router is not attached")
+	}
+	name := programName(x.mode)
+	progSpec, ok := spec.Programs[name]
+	if !ok {
+		return fmt.Errorf("%w: no program %s", ErrInvalidDatapath, name)
+	}
+	if want := programType(x.mode); progSpec.Type != want {
+		return fmt.Errorf("%w: %s is a %s program, want %s", ErrInvalidDatapath, name, progSpec.Type, want)
+	}
+	if err := applyVariant(spec, probedKernel().Datapath); err != nil {
+		return err
+	}
+	if err := x.applySYNProtection(spec); err != nil {
+		return err
+	}
+	trimPrograms(spec, x.modes)
+	x.applyConnectPolicy(spec)
+	x.applySocketAcceleration(spec)
+	x.applyProxyRedirect(spec)
+
+	replacements := make(map[string]*ebpf.Map, len(x.coll.Maps))
+	migrations := make(map[string]mapMigration)
+	for name, m := range x.coll.Maps {
+		ms, ok := spec.Maps[name]
+		if !ok {
+			return fmt.Errorf("%w: map %s is missing", ErrInvalidDatapath, name)
+		}
+		if ms.Type != m.Type() || ms.KeySize != m.KeySize() || ms.ValueSize != m.ValueSize() {
+			if mig, ok := mapMigrations[name]; ok && mig.from.of(m) && mig.to.ofSpec(ms) {
+				ms.Pinning = ebpf.PinNone
+				migrations[name] = mig
+				continue
+			}
+			return fmt.Errorf("%w: map %s is %s with %d byte keys and %d byte values, want %s with %d and %d",
+				ErrInvalidDatapath, name, ms.Type, ms.KeySize, ms.ValueSize, m.Type(), m.KeySize(), m.ValueSize())
+		}
+		ms.MaxEntries, ms.Flags, ms.Pinning = m.MaxEntries(), m.Flags(), ebpf.PinNone
+		replacements[name] = m
+	}
+
+	sizes := programSizes(spec)
+	loadedAt := time.Now()
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{MapReplacements: replacements})
+	if err != nil {
+		return fmt.Errorf("failed to load XDP program: %w", err)
+	}
+	loadTime := time.Since(loadedAt)
+	// Nothing else writes the maps while the old program still reads
+	// them, so the new one starts out with all their entries
+	for name, mig := range migrations {
+		if err := mig.migrate(x.coll.Maps[name], coll.Maps[name]); err != nil {
+			coll.Close()
+			return fmt.Errorf("failed to migrate map %s, keeping the old program: %w", name, err)
+		}
+	}
+	if err := x.link.Update(coll.Programs[name]); err != nil {
+		coll.Close()
+		return fmt.Errorf("failed to replace XDP program, keeping the old one: %w", err)
+	}
+	// Behind the new router, the old filter would translate into maps
+	// the new one may not read alike
+	if x.forward != nil {
+		if prog := coll.Programs[forwardProgram]; prog == nil || x.forward.Update(prog) != nil {
+			x.forward.Close()
+			x.forward = nil
+		}
+	}
+
+	// Replacements are cloned, so the old collection can go. Expiry and
+	// drop events run against the maps of the collection in use, which
+	// may have drop events where the old one had none.
+	old := x.coll
+	cfg, logger := x.gcConfig, x.gcLog
+	running := x.stopGC != nil
+	x.stopConntrackGC()
+	x.stopDropReader()
+	x.setCollection(coll)
+	x.loadedAt, x.loadTime = loadedAt, loadTime
+	x.sizes = sizes
+	if running {
+		x.startConntrackGC(cfg, logger)
+	}
+	if x.onDrop != nil {
+		if err := x.startDropReader(x.onDrop); err != nil {
+			logger.Warn("Failed to read drop events", "error", err)
+		}
+	}
+	// Sockets already in accel_socks keep the sk_msg program they were
+	// added with
+	skErr := x.attachSkMsg()
+	old.Close()
+	// Clones don't know their pins, and maps new in this version have none
+	return errors.Join(skErr, x.pin(coll))
+}
+
+// mapLayout is the type, key and value size of a map
+type mapLayout struct {
+	typ       ebpf.MapType
+	keySize   uint32
+	valueSize uint32
+}
+
+func (l mapLayout) of(m *ebpf.Map) bool {
+	return m.Type() == l.typ && m.KeySize() == l.keySize && m.ValueSize() == l.valueSize
+}
+
+func (l mapLayout) ofSpec(ms *ebpf.MapSpec) bool {
+	return ms.Type == l.typ && ms.KeySize == l.keySize && ms.ValueSize == l.valueSize
+}
+
+// mapMigration converts the entries of a map of an older router, laid out
+// as from, into the one of a newer router laid out as to
+type mapMigration struct {
+	from, to mapLayout
+	migrate  func(from, to *ebpf.Map) error
+}
+
+// mapMigrations are the migrations Upgrade applies by map name. The routes
+// were hashes keyed by container address before they took prefixes.
+var mapMigrations = map[string]mapMigration{
+	"container_routes": {
+		from:    mapLayout{ebpf.Hash, 4, containerInfoSize},
+		to:      mapLayout{ebpf.LPMTrie, routeKeySize, containerInfoSize},
+		migrate: migrateRoutes,
+	},
+	"container_routes6": {
+		from:    mapLayout{ebpf.Hash, 16, containerInfoSize},
+		to:      mapLayout{ebpf.LPMTrie, routeKey6Size, containerInfoSize},
+		migrate: migrateRoutes,
+	},
+}
+
+// Sizes of the route map entries
+var (
+	containerInfoSize = uint32(binary.Size(containerInfo{}))
+	routeKeySize      = uint32(binary.Size(routeKey{}))
+	routeKey6Size     = uint32(binary.Size(routeKey6{}))
+)
+
+// migrateRoutes puts the routes of from, a hash keyed by container
+// address, into to as host prefixes
+func migrateRoutes(from, to *ebpf.Map) error {
+	keys, err := mapKeys(from)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		var info containerInfo
+		if err := from.Lookup(key, &info); err != nil {
+			return err
+		}
+		addr, _ := netip.AddrFromSlice(key)
+		if addr.Is4() {
+			err = to.Put(newRouteKey(addrPrefix(addr)), info)
+		} else {
+			err = to.Put(newRouteKey6(addrPrefix(addr)), info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keptLink is where a router kept attached in mode is pinned: its XDP
+// link, or for TC, where the filter stays by itself, its program
+func keptLink(pinPath string, mode DatapathMode) string {
+	return filepath.Join(pinPath, "link_"+string(mode))
+}
+
+// takeOver attaches the router to ifc. A router a previous run kept
+// attached there is switched over to it without a moment in which none
+// runs; kept routers that can't be, e.g. as they are on another
+// interface, are detached.
+func (x *xdpProgram) takeOver(ifc *net.Interface) error {
+	if x.pinPath == "" {
+		return x.attach(ifc)
+	}
+	keptTC := os.Remove(keptLink(x.pinPath, DatapathTC)) == nil
+	for _, m := range []DatapathMode{DatapathXDPNative, DatapathXDPGeneric} {
+		l, err := link.LoadPinnedLink(keptLink(x.pinPath, m), nil)
+		if err != nil {
+			continue
+		}
+		// It is pinned again when kept once more
+		l.Unpin()
+		if x.link == nil && x.switchOver(l, m, ifc) {
+			continue
+		}
+		l.Close()
+	}
+
+	if x.link == nil {
+		// Attaching in TC mode replaces a kept filter
+		if err := x.attach(ifc); err != nil {
+			return err
+		}
+	}
+	if keptTC && x.mode != DatapathTC {
+		// The kept filter would run the old router behind this one
+		detachTC(ifc)
+	}
+	return nil
+}
+
+// switchOver points l, an XDP link kept attached in mode, at the loaded
+// program if it is attached to ifc
+func (x *xdpProgram) switchOver(l link.Link, mode DatapathMode, ifc *net.Interface) bool {
+	prog := x.coll.Programs[programName(mode)]
+	if prog == nil {
+		return false
+	}
+	info, err := l.Info()
+	if err != nil || info.XDP() == nil || int(info.XDP().Ifindex) != ifc.Index {
+		return false
+	}
+	if x.setInterface(ifc) != nil || l.Update(prog) != nil {
+		return false
+	}
+	x.link, x.mode = l, mode
+	x.attachForward(ifc)
+	return true
+}
+
+// detachKept detaches a router a previous run kept attached to iface, for
+// runs that don't load one. Its maps stay pinned.
+func detachKept(iface, pinPath string) error {
+	var errs []error
+	keptXDP := false
+	for _, m := range []DatapathMode{DatapathXDPNative, DatapathXDPGeneric} {
+		l, err := link.LoadPinnedLink(keptLink(pinPath, m), nil)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		keptXDP = true
+		errs = append(errs, l.Unpin(), l.Close())
+	}
+	keptTC := os.Remove(keptLink(pinPath, DatapathTC)) == nil
+	if keptXDP || keptTC {
+		ifc, err := net.InterfaceByName(iface)
+		if err == nil && keptTC {
+			err = detachTC(ifc)
+		}
+		// A router kept in an XDP mode leaves its port forward filter
+		if err == nil && keptXDP {
+			err = detachForward(ifc.Index)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// setInterface points ARP replies for containers at ifc
+func (x *xdpProgram) setInterface(ifc *net.Interface) error {
+	var mac ifaceMAC
+	copy(mac.Addr[:], ifc.HardwareAddr)
+	if err := x.coll.Maps["router_mac"].Put(uint32(0), mac); err != nil {
+		return fmt.Errorf("failed to set interface MAC: %w", err)
+	}
+	return nil
+}
+
+// attach attaches the router to ifc in the first of x.modes that works
+func (x *xdpProgram) attach(ifc *net.Interface) error {
+	if err := x.setInterface(ifc); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, m := range x.modes {
+		// An upgrade may have brought an object without this entry point
+		prog := x.coll.Programs[programName(m)]
+		if prog == nil {
+			continue
+		}
+		var l routerLink
+		var err error
+		switch m {
+		case DatapathXDPNative, DatapathXDPGeneric:
+			flags := link.XDPDriverMode
+			if m == DatapathXDPGeneric {
+				flags = link.XDPGenericMode
+			}
+			l, err = link.AttachXDP(link.XDPOptions{Program: prog, Interface: ifc.Index, Flags: flags})
+		case DatapathTC:
+			l, err = attachTC(ifc, prog)
+		}
+		if err == nil {
+			x.link, x.mode = l, m
+			x.attachForward(ifc)
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", m, err))
+	}
+	return fmt.Errorf("failed to attach XDP to %s: %w", ifc.Name, errors.Join(errs...))
+}
+
+// Reattach detaches the router and attaches it to iface again, keeping
+// the program and its maps. The router stays detached when attaching fails.
+func (x *xdpProgram) Reattach(iface string) error {
+	ifc, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %s: %w", iface, err)
+	}
+	if x.link != nil {
+		// Fails when the interface was deleted, which detached it already
+		x.link.Close()
+		x.link, x.mode = nil, ""
+	}
+	if x.forward != nil {
+		x.forward.Close()
+		x.forward = nil
+	}
+	return x.attach(ifc)
+}
+
+// AddContainer creates zeroed counters for the host-side veth ifindex and
+// points traffic for each of addrs at it. Redirected frames are rewritten
+// to go from hostMAC to mac; without mac they take the kernel stack.
+// Traffic to a shaped or mirrored container is passed to the kernel as
+// well, since redirects bypass the veth's qdisc and filters. Packets
+// larger than mtu are answered with an ICMP error instead of redirected.
+func (x *xdpProgram) AddContainer(ifindex int, addrs []netip.Addr, mac, hostMAC net.HardwareAddr, shaped bool, mtu int) error {
+	// Shorter per-CPU slices are zero-padded to the number of CPUs
+	zero := []datapathStats{{}}
+	if err := x.containerStats.Put(uint32(ifindex), zero); err != nil {
+		return err
+	}
+	if x.containerLatency != nil {
+		if err := x.containerLatency.Put(uint32(ifindex), []latencyHist{{}}); err != nil {
+			return err
+		}
+	}
+	if x.hasTraffic() {
+		if err := x.addTraffic(ifindex, false); err != nil {
+			return err
+		}
+	}
+
+	info := containerInfo{Ifindex: uint32(ifindex), MTU: uint32(mtu)}
+	if len(mac) == 6 && len(hostMAC) == 6 {
+		info.Flags |= containerMACSet
+		copy(info.MAC[:], mac)
+		copy(info.HostMAC[:], hostMAC)
+	}
+	if shaped {
+		info.Flags |= containerShaped
+	}
+	for _, addr := range addrs {
+		if err := x.putRoute(addrPrefix(addr), info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetShaped updates the routes of a container, keeping its counters and
+// MACs
+func (x *xdpProgram) SetShaped(addrs []netip.Addr, shaped bool) error {
+	return x.updateRoutes(addrs, func(info *containerInfo) {
+		if shaped {
+			info.Flags |= containerShaped
+		} else {
+			info.Flags &^= containerShaped
+		}
+	})
+}
+
+// SetDraining makes the routes of a container pass SYNs to the kernel,
+// which rejects them, or redirect them again
+func (x *xdpProgram) SetDraining(addrs []netip.Addr, draining bool) error {
+	return x.updateRoutes(addrs, func(info *containerInfo) {
+		if draining {
+			info.Flags |= containerDraining
+		} else {
+			info.Flags &^= containerDraining
+		}
+	})
+}
+
+// SetMTU updates the MTU the routes of a container check packets against
+func (x *xdpProgram) SetMTU(addrs []netip.Addr, mtu int) error {
+	return x.updateRoutes(addrs, func(info *containerInfo) {
+		info.MTU = uint32(mtu)
+	})
+}
+
+// Route returns the route for addr
+func (x *xdpProgram) Route(addr netip.Addr) (containerInfo, error) {
+	var info containerInfo
+	if addr.Is4() {
+		return info, x.routes.Lookup(newRouteKey(addrPrefix(addr)), &info)
+	}
+	return info, x.routes6.Lookup(newRouteKey6(addrPrefix(addr)), &info)
+}
+
+// updateRoutes applies fn to the routes for addrs
+func (x *xdpProgram) updateRoutes(addrs []netip.Addr, fn func(*containerInfo)) error {
+	for _, addr := range addrs {
+		info, err := x.Route(addr)
+		if err != nil {
+			return err
+		}
+		fn(&info)
+		if err := x.putRoute(addrPrefix(addr), info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putRoute routes prefix to info, queueing the update while batching
+func (x *xdpProgram) putRoute(prefix netip.Prefix, info containerInfo) error {
+	is4 := prefix.Addr().Is4()
+	switch {
+	case x.batch != nil && is4:
+		x.batch.routes.put(newRouteKey(prefix), info)
+		return nil
+	case x.batch != nil:
+		x.batch.routes6.put(newRouteKey6(prefix), info)
+		return nil
+	case is4:
+		return x.routes.Put(newRouteKey(prefix), info)
+	}
+	return x.routes6.Put(newRouteKey6(prefix), info)
+}
+
+// deleteRoute removes the route to prefix, ignoring a missing one, and
+// queues the delete while batching
+func (x *xdpProgram) deleteRoute(prefix netip.Prefix) error {
+	var err error
+	is4 := prefix.Addr().Is4()
+	switch {
+	case x.batch != nil && is4:
+		x.batch.routes.delete(newRouteKey(prefix))
+	case x.batch != nil:
+		x.batch.routes6.delete(newRouteKey6(prefix))
+	case is4:
+		err = x.routes.Delete(newRouteKey(prefix))
+	default:
+		err = x.routes6.Delete(newRouteKey6(prefix))
+	}
+	return ignoreNotExist(err)
+}
+
+// DeleteContainer removes the routes for addrs and the counters for
+// ifindex, ignoring missing entries. A zero ifindex only removes routes.
+func (x *xdpProgram) DeleteContainer(ifindex int, addrs []netip.Addr) error {
+	for _, addr := range addrs {
+		if err := x.deleteRoute(addrPrefix(addr)); err != nil {
+			return err
+		}
+	}
+	if ifindex == 0 {
+		return nil
+	}
+	if x.containerFaults != nil {
+		if err := ignoreNotExist(x.containerFaults.Delete(uint32(ifindex))); err != nil {
+			return err
+		}
+	}
+	if x.faultDelays != nil {
+		if err := ignoreNotExist(x.faultDelays.Delete(uint32(ifindex))); err != nil {
+			return err
+		}
+	}
+	if x.containerLatency != nil {
+		if err := ignoreNotExist(x.containerLatency.Delete(uint32(ifindex))); err != nil {
+			return err
+		}
+	}
+	if x.hasTraffic() {
+		if err := ignoreNotExist(x.containerTraffic.Delete(uint32(ifindex))); err != nil {
+			return err
+		}
+	}
+	return ignoreNotExist(x.containerStats.Delete(uint32(ifindex)))
+}
+
+// Stats returns the node-wide counters summed across CPUs
+func (x *xdpProgram) Stats() (datapathStats, error) {
+	var perCPU []datapathStats
+	if err := x.stats.Lookup(uint32(0), &perCPU); err != nil {
+		return datapathStats{}, err
+	}
+	return sumStats(perCPU), nil
+}
+
+// ContainerStats returns the counters for the container behind ifindex
+// summed across CPUs
+func (x *xdpProgram) ContainerStats(ifindex int) (datapathStats, error) {
+	var perCPU []datapathStats
+	if err := x.containerStats.Lookup(uint32(ifindex), &perCPU); err != nil {
+		return datapathStats{}, err
+	}
+	return sumStats(perCPU), nil
+}
+
+// hasLatency reports whether the router measures its latency
+func (x *xdpProgram) hasLatency() bool {
+	return x.latency != nil && x.containerLatency != nil
+}
+
+// Latency returns the node-wide latency histogram summed across CPUs
+func (x *xdpProgram) Latency() (LatencyHistogram, error) {
+	var perCPU []latencyHist
+	if err := x.latency.Lookup(uint32(0), &perCPU); err != nil {
+		return LatencyHistogram{}, err
+	}
+	return sumLatency(perCPU), nil
+}
+
+// ContainerLatency returns the latency histogram of the container behind
+// ifindex summed across CPUs
+func (x *xdpProgram) ContainerLatency(ifindex int) (LatencyHistogram, error) {
+	var perCPU []latencyHist
+	if err := x.containerLatency.Lookup(uint32(ifindex), &perCPU); err != nil {
+		return LatencyHistogram{}, err
+	}
+	return sumLatency(perCPU), nil
+}
+
+func sumLatency(perCPU []latencyHist) LatencyHistogram {
+	var total LatencyHistogram
+	for _, h := range perCPU {
+		total.add(h.histogram())
+	}
+	return total
+}
+
+// MapUsage returns the entries and capacity of each hash map. Other maps
+// are always full.
+func (x *xdpProgram) MapUsage() (map[string]MapUsage, error) {
+	usage := make(map[string]MapUsage)
+	for name, m := range x.coll.Maps {
+		switch m.Type() {
+		case ebpf.Hash, ebpf.LRUHash, ebpf.PerCPUHash, ebpf.LRUCPUHash, ebpf.LPMTrie:
+		default:
+			continue
+		}
+		n, err := countEntries(m)
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %w", name, err)
+		}
+		usage[name] = MapUsage{Entries: n, MaxEntries: m.MaxEntries()}
+	}
+	return usage, nil
+}
+
+// countEntries counts the keys of m by walking them. A walk restarts when
+// its current key is deleted meanwhile, so the count is capped at the
+// map's capacity.
+func countEntries(m *ebpf.Map) (uint32, error) {
+	key := make([]byte, m.KeySize())
+	next := make([]byte, m.KeySize())
+	var prev any
+	var n uint32
+	for n < m.MaxEntries() {
+		err := m.NextKey(prev, next)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		n++
+		copy(key, next)
+		prev = key
+	}
+	return n, nil
+}
+
+// UpdatePolicies removes the rules of dels, ignoring missing entries, and
+// programs those of puts, in batches. Rules with a source CIDR go to the
+// LPM tries, the rest to the hash maps.
+func (x *xdpProgram) UpdatePolicies(puts map[policyRule]PolicyAction, dels []policyRule) error {
+	policies := newMapBatch[policyKey, uint8](x.policies)
+	policies6 := newMapBatch[policyKey6, uint8](x.policies6)
+	var cidrs *mapBatch[policyCIDRKey, uint8]
+	var cidrs6 *mapBatch[policyCIDRKey6, uint8]
+	if x.policyCIDRs != nil {
+		cidrs = newMapBatch[policyCIDRKey, uint8](x.policyCIDRs)
+		cidrs6 = newMapBatch[policyCIDRKey6, uint8](x.policyCIDRs6)
+	}
+
+	for _, rule := range dels {
+		switch {
+		case isCIDRRule(rule) && cidrs == nil:
+		case isCIDRRule(rule) && rule.Dst.Is4():
+			cidrs.delete(newPolicyCIDRKey(rule))
+		case isCIDRRule(rule):
+			cidrs6.delete(newPolicyCIDRKey6(rule))
+		case rule.Dst.Is4():
+			policies.delete(newPolicyKey(rule))
+		default:
+			policies6.delete(newPolicyKey6(rule))
+		}
+	}
+	for rule, action := range puts {
+		switch {
+		case isCIDRRule(rule) && cidrs == nil:
+			return fmt.Errorf("%w: router has no source CIDR policy maps", ErrInvalidDatapath)
+		case isCIDRRule(rule) && rule.Dst.Is4():
+			cidrs.put(newPolicyCIDRKey(rule), bpfPolicyAction(action))
+		case isCIDRRule(rule):
+			cidrs6.put(newPolicyCIDRKey6(rule), bpfPolicyAction(action))
+		case rule.Dst.Is4():
+			policies.put(newPolicyKey(rule), bpfPolicyAction(action))
+		default:
+			policies6.put(newPolicyKey6(rule), bpfPolicyAction(action))
+		}
+	}
+
+	if err := policies.flush(); err != nil {
+		return err
+	}
+	if err := policies6.flush(); err != nil {
+		return err
+	}
+	if cidrs == nil {
+		return nil
+	}
+	if err := cidrs.flush(); err != nil {
+		return err
+	}
+	return cidrs6.flush()
+}
+
+// isCIDRRule reports whether rule matches a source CIDR rather than a
+// single address or anything
+func isCIDRRule(rule policyRule) bool {
+	return rule.Src.IsValid() && !rule.Src.IsSingleIP()
+}
+
+// nsPair mirrors struct ns_pair in bpf/container_router.c
+type nsPair struct {
+	Src uint32
+	Dst uint32
+}
+
+// SetNamespaces programs the namespace IDs of container addresses, which
+// only those outside the default namespace need, and the pairs of
+// namespaces let through, replacing all previous entries
+func (x *xdpProgram) SetNamespaces(members map[netip.Addr]uint32, allowed map[nsPair]bool) error {
+	if x.containerNS == nil || x.namespaceAllow == nil {
+		return fmt.Errorf("%w: router has no namespace maps", ErrInvalidDatapath)
+	}
+
+	// Deleting while iterating can restart the iteration, so collect first
+	ns := newMapBatch[[4]byte, uint32](x.containerNS)
+	ns6 := newMapBatch[[16]byte, uint32](x.containerNS6)
+	var addr4 [4]byte
+	var addr6 [16]byte
+	var id uint32
+	iter := x.containerNS.Iterate()
+	for iter.Next(&addr4, &id) {
+		if _, ok := members[netip.AddrFrom4(addr4)]; !ok {
+			ns.delete(addr4)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	iter = x.containerNS6.Iterate()
+	for iter.Next(&addr6, &id) {
+		if _, ok := members[netip.AddrFrom16(addr6)]; !ok {
+			ns6.delete(addr6)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for addr, id := range members {
+		if addr.Is4() {
+			ns.put(addr.As4(), id)
+		} else {
+			ns6.put(addr.As16(), id)
+		}
+	}
+	if err := ns.flush(); err != nil {
+		return err
+	}
+	if err := ns6.flush(); err != nil {
+		return err
+	}
+
+	pairs := newMapBatch[nsPair, uint8](x.namespaceAllow)
+	var pair nsPair
+	var allow uint8
+	iter = x.namespaceAllow.Iterate()
+	for iter.Next(&pair, &allow) {
+		if !allowed[pair] {
+			pairs.delete(pair)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for pair := range allowed {
+		pairs.put(pair, 1)
+	}
+	return pairs.flush()
+}
+
+// hasXSKs reports whether the router can steer flows to AF_XDP sockets
+func (x *xdpProgram) hasXSKs() bool {
+	return x.xsks != nil && x.xskFlows != nil
+}
+
+// PutXSK registers the AF_XDP socket fd bound to queue
+func (x *xdpProgram) PutXSK(queue int, fd int) error {
+	return x.xsks.Put(uint32(queue), uint32(fd))
+}
+
+// DeleteXSK unregisters the AF_XDP socket bound to queue
+func (x *xdpProgram) DeleteXSK(queue int) error {
+	return ignoreNotExist(x.xsks.Delete(uint32(queue)))
+}
+
+// PutXSKFlow steers the flow of key to the AF_XDP socket of queue
+func (x *xdpProgram) PutXSKFlow(key xskFlowKey, queue int) error {
+	return x.xskFlows.Put(key, uint32(queue))
+}
+
+// DeleteXSKFlows stops steering the flows of keys
+func (x *xdpProgram) DeleteXSKFlows(keys []xskFlowKey) error {
+	for _, key := range keys {
+		if err := ignoreNotExist(x.xskFlows.Delete(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasFaults reports whether the router can drop packets for injected
+// faults
+func (x *xdpProgram) hasFaults() bool {
+	return x.containerFaults != nil
+}
+
+// SetFaultDrops drops dropPercent of the packets to the container behind
+// ifindex, none when 0
+func (x *xdpProgram) SetFaultDrops(ifindex int, dropPercent float64) error {
+	if dropPercent == 0 {
+		return ignoreNotExist(x.containerFaults.Delete(uint32(ifindex)))
+	}
+	threshold := math.Min(dropPercent/100*(1<<32), math.MaxUint32)
+	return x.containerFaults.Put(uint32(ifindex), containerFault{DropThreshold: uint32(threshold)})
+}
+
+// hasFaultDelays reports whether the router can delay packets for
+// injected faults, which it does as it paces them
+func (x *xdpProgram) hasFaultDelays() bool {
+	return x.faultDelays != nil && x.hasFaults() && x.hasPacing()
+}
+
+// SetFaultDelay delays the packets to the container behind ifindex as f
+// does, none when f is nil or has no delay
+func (x *xdpProgram) SetFaultDelay(ifindex int, f *ContainerFault) error {
+	if f == nil || f.Delay == 0 {
+		return ignoreNotExist(x.faultDelays.Delete(uint32(ifindex)))
+	}
+	threshold := math.Min(f.ReorderPercent/100*(1<<32), math.MaxUint32)
+	return x.faultDelays.Put(uint32(ifindex), faultDelay{
+		DelayNS:          uint64(f.Delay),
+		JitterNS:         uint64(f.Jitter),
+		ReorderThreshold: uint32(threshold),
+	})
+}
+
+// SetDefaultPolicy sets the verdict for traffic matching no rule
+func (x *xdpProgram) SetDefaultPolicy(action PolicyAction) error {
+	return x.policyDefault.Put(policySlotDefault, uint32(bpfPolicyAction(action)))
+}
+
+// SetRejectRate sets how many rejected packets each CPU answers per
+// second
+func (x *xdpProgram) SetRejectRate(rate int) error {
+	return x.policyDefault.Put(policySlotRejectRate, uint32(rate))
+}
+
+func newPolicyKey(rule policyRule) policyKey {
+	key := policyKey{Proto: rule.Proto}
+	if rule.Src.IsValid() {
+		key.Src = rule.Src.Addr().As4()
+	}
+	key.Dst = rule.Dst.As4()
+	binary.BigEndian.PutUint16(key.Port[:], rule.Port)
+	return key
+}
+
+func newPolicyKey6(rule policyRule) policyKey6 {
+	key := policyKey6{Proto: rule.Proto}
+	if rule.Src.IsValid() {
+		key.Src = rule.Src.Addr().As16()
+	}
+	key.Dst = rule.Dst.As16()
+	binary.BigEndian.PutUint16(key.Port[:], rule.Port)
+	return key
+}
+
+func newPolicyCIDRKey(rule policyRule) policyCIDRKey {
+	key := policyCIDRKey{
+		Prefixlen: uint32(policyCIDRBits + rule.Src.Bits()),
+		Dst:       rule.Dst.As4(),
+		Proto:     rule.Proto,
+		Src:       rule.Src.Masked().Addr().As4(),
+	}
+	binary.BigEndian.PutUint16(key.Port[:], rule.Port)
+	return key
+}
+
+func newPolicyCIDRKey6(rule policyRule) policyCIDRKey6 {
+	key := policyCIDRKey6{
+		Prefixlen: uint32(policyCIDR6Bits + rule.Src.Bits()),
+		Dst:       rule.Dst.As16(),
+		Proto:     rule.Proto,
+		Src:       rule.Src.Masked().Addr().As16(),
+	}
+	binary.BigEndian.PutUint16(key.Port[:], rule.Port)
+	return key
+}
+
+func bpfPolicyAction(action PolicyAction) uint8 {
+	switch action {
+	case PolicyDeny:
+		return bpfPolicyDeny
+	case PolicyReject:
+		return bpfPolicyReject
+	}
+	return bpfPolicyAllow
+}
+
+func sumStats(perCPU []datapathStats) datapathStats {
+	var total datapathStats
+	for _, s := range perCPU {
+		total.add(s)
+	}
+	return total
+}
+
+func ignoreNotExist(err error) error {
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Close detaches the program and releases its maps. With x.keep the
+// router stays attached instead, pinned for the next run to take over.
+func (x *xdpProgram) Close() error {
+	x.stopConntrackGC()
+	x.stopDropReader()
+	x.closeTaps()
+	var err error
+	if x.keep && x.link != nil {
+		if err = x.pinLink(); err == nil {
+			x.coll.Close()
+			return nil
+		}
+		err = fmt.Errorf("failed to keep XDP router attached: %w", err)
+	}
+	if x.link != nil {
+		x.link.Close()
+	}
+	if x.forward != nil {
+		x.forward.Close()
+	}
+	x.detachSkMsg()
+	x.unpin()
+	x.coll.Close()
+	return err
+}
+
+// pinLink pins the attached router at its keptLink, so it outlives the
+// process
+func (x *xdpProgram) pinLink() error {
+	path := keptLink(x.pinPath, x.mode)
+	if l, ok := x.link.(link.Link); ok {
+		return l.Pin(path)
+	}
+	return x.coll.Programs[tcRouterProgram].Pin(path)
+}
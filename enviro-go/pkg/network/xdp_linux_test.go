@@ -0,0 +1,55 @@
+//go:build linux
+
+package network
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestTrimPrograms(t *testing.T) {
+	tests := []struct {
+		name  string
+		modes []DatapathMode
+		want  []string
+	}{
+		{
+			name:  "XDP",
+			modes: []DatapathMode{DatapathXDPNative, DatapathXDPGeneric},
+			want:  []string{"cgroup_connect4", routerProgram, xdpResumeProgram},
+		},
+		{
+			name:  "TC",
+			modes: []DatapathMode{DatapathTC},
+			want:  []string{"cgroup_connect4", sourceProgram, paceIngressProgram, paceEgressProgram, captureProgram, tcResumeProgram, tcRouterProgram},
+		},
+		{
+			name:  "both",
+			modes: []DatapathMode{DatapathXDPNative, DatapathTC},
+			want:  []string{"cgroup_connect4", sourceProgram, paceIngressProgram, paceEgressProgram, captureProgram, forwardProgram, tcResumeProgram, tcRouterProgram, routerProgram, xdpResumeProgram},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &ebpf.CollectionSpec{Programs: make(map[string]*ebpf.ProgramSpec)}
+			// Programs of optional features are trimmed by their apply
+			// functions
+			for _, name := range []string{routerProgram, tcRouterProgram, sourceProgram, paceIngressProgram, paceEgressProgram, captureProgram, forwardProgram, xdpResumeProgram, tcResumeProgram, "cgroup_connect4"} {
+				spec.Programs[name] = &ebpf.ProgramSpec{Name: name}
+			}
+			trimPrograms(spec, tt.modes)
+			var got []string
+			for name := range spec.Programs {
+				got = append(got, name)
+			}
+			slices.Sort(got)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("kept %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+// Package storage provides crash-safe persistence for Enviro state files
+//
+// Every file is written to a temporary path and renamed into place, with a
+// checksum footer validated on read. The previous generation of each file
+// is kept so a torn or corrupted write falls back to the last good copy
+// instead of failing startup.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FsyncPolicy controls when written files are flushed to stable storage
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs every write before it returns
+	FsyncAlways FsyncPolicy = iota
+	// FsyncBatched syncs dirty files every BatchInterval
+	FsyncBatched
+	// FsyncNever leaves flushing to the kernel
+	FsyncNever
+)
+
+var fsyncPolicies = map[FsyncPolicy]string{
+	FsyncAlways:  "always",
+	FsyncBatched: "batched",
+	FsyncNever:   "never",
+}
+
+// String returns the name of p as configured, e.g. "batched"
+func (p FsyncPolicy) String() string {
+	if name, ok := fsyncPolicies[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (p FsyncPolicy) MarshalText() ([]byte, error) {
+	if _, ok := fsyncPolicies[p]; !ok {
+		return nil, fmt.Errorf("unknown fsync policy %d", int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, taking "always",
+// "batched" or "never". Empty text is FsyncAlways.
+func (p *FsyncPolicy) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*p = FsyncAlways
+		return nil
+	}
+	for policy, name := range fsyncPolicies {
+		if string(text) == name {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown fsync policy %q, want always, batched or never", text)
+}
+
+const (
+	footerMagic = 0x53564e45 // "ENVS"
+	footerSize  = 12         // magic + length + crc32c
+
+	prevSuffix = ".prev"
+	tmpSuffix  = ".tmp"
+)
+
+// DefaultBatchInterval is how often FsyncBatched flushes unless
+// configured otherwise
+const DefaultBatchInterval = 100 * time.Millisecond
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt is returned when neither generation of a file is valid
+var ErrCorrupt = errors.New("storage: state file corrupt")
+
+// Config holds the storage settings
+type Config struct {
+	// Dir is the root state directory
+	Dir string
+	// Fsync is the flush policy for writes
+	Fsync FsyncPolicy
+	// BatchInterval is the flush period for FsyncBatched,
+	// DefaultBatchInterval when zero
+	BatchInterval time.Duration
+	// Logger receives storage logs, defaults to slog.Default()
+	Logger *slog.Logger
+}
+
+// Stats reports storage health counters
+type Stats struct {
+	Writes uint64
+	// WriteErrors counts failed writes and batched flushes
+	WriteErrors uint64
+	// FallbackReads counts reads served from the previous generation
+	FallbackReads uint64
+	// CorruptReads counts generations that failed validation on read
+	CorruptReads uint64
+	// Failing is set while the last write or flush failed
+	Failing bool
+}
+
+// Store reads and writes checksummed state files under a directory
+type Store struct {
+	config Config
+
+	mu    sync.Mutex
+	dirty map[string]struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	// snapshot is held by writes, and exclusively by Snapshot
+	snapshot sync.RWMutex
+
+	writes        atomic.Uint64
+	writeErrors   atomic.Uint64
+	fallbackReads atomic.Uint64
+	corruptReads  atomic.Uint64
+	failing       atomic.Bool
+}
+
+// Open creates the state directory if needed and returns a Store for it
+func Open(config Config) (*Store, error) {
+	if config.Dir == "" {
+		return nil, errors.New("storage: state directory not configured")
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create state dir %s: %w", config.Dir, err)
+	}
+	if config.Fsync == FsyncBatched && config.BatchInterval <= 0 {
+		config.BatchInterval = DefaultBatchInterval
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	s := &Store{
+		config: config,
+		dirty:  make(map[string]struct{}),
+		done:   make(chan struct{}),
+	}
+	if config.Fsync == FsyncBatched {
+		s.wg.Add(1)
+		go s.flushLoop()
+	}
+	return s, nil
+}
+
+// Close flushes pending batched writes and stops the flusher
+func (s *Store) Close() error {
+	if s.config.Fsync == FsyncBatched {
+		close(s.done)
+		s.wg.Wait()
+		s.flush()
+	}
+	return nil
+}
+
+// Dir returns the root state directory
+func (s *Store) Dir() string {
+	return s.config.Dir
+}
+
+// Stats returns the storage health counters
+func (s *Store) Stats() Stats {
+	return Stats{
+		Writes:        s.writes.Load(),
+		WriteErrors:   s.writeErrors.Load(),
+		FallbackReads: s.fallbackReads.Load(),
+		CorruptReads:  s.corruptReads.Load(),
+		Failing:       s.failing.Load(),
+	}
+}
+
+// Write atomically replaces the file name (relative to Dir) with data. The
+// current contents are kept as the previous generation.
+func (s *Store) Write(name string, data []byte) error {
+	if err := s.write(name, data); err != nil {
+		s.writeErrors.Add(1)
+		s.failing.Store(true)
+		return fmt.Errorf("failed to write state file %s: %w", name, err)
+	}
+	s.writes.Add(1)
+	s.failing.Store(false)
+	return nil
+}
+
+func (s *Store) write(name string, data []byte) error {
+	s.snapshot.RLock()
+	defer s.snapshot.RUnlock()
+	path := filepath.Join(s.config.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp := path + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(appendFooter(data)); err != nil {
+		f.Close()
+		return err
+	}
+	if s.config.Fsync == FsyncAlways {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// A current file failing validation is not kept, so a torn write
+	// never pushes out the last good generation
+	if _, err := readValidated(path); err == nil {
+		if err := os.Rename(path, path+prevSuffix); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	switch s.config.Fsync {
+	case FsyncAlways:
+		return syncDir(filepath.Dir(path))
+	case FsyncBatched:
+		s.mu.Lock()
+		s.dirty[path] = struct{}{}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Read returns the contents of name, falling back to the previous
+// generation when the current file is missing or fails validation.
+// It returns an error wrapping os.ErrNotExist when neither exists.
+func (s *Store) Read(name string) ([]byte, error) {
+	path := filepath.Join(s.config.Dir, name)
+
+	data, err := readValidated(path)
+	if err == nil {
+		return data, nil
+	}
+	if errors.Is(err, ErrCorrupt) {
+		s.corruptReads.Add(1)
+	}
+
+	prev, prevErr := readValidated(path + prevSuffix)
+	if prevErr == nil {
+		s.fallbackReads.Add(1)
+		s.config.Logger.Warn("State file unusable, using previous generation", "path", path, "error", err)
+		return prev, nil
+	}
+	if errors.Is(prevErr, ErrCorrupt) {
+		s.corruptReads.Add(1)
+	}
+
+	if errors.Is(err, os.ErrNotExist) && errors.Is(prevErr, os.ErrNotExist) {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: %s", ErrCorrupt, path)
+}
+
+// Snapshot returns the contents of the files of names that exist, read
+// while no file is written, so they are as they were at a single point in
+// time
+func (s *Store) Snapshot(names ...string) (map[string][]byte, error) {
+	s.snapshot.Lock()
+	defer s.snapshot.Unlock()
+	files := make(map[string][]byte, len(names))
+	for _, name := range names {
+		data, err := s.Read(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// Delete removes both generations of name
+func (s *Store) Delete(name string) error {
+	s.snapshot.RLock()
+	defer s.snapshot.RUnlock()
+	path := filepath.Join(s.config.Dir, name)
+	for _, p := range []string{path, path + prevSuffix, path + tmpSuffix} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) flushLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.BatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush syncs all files written since the last flush, and their directories
+func (s *Store) flush() {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[string]struct{})
+	s.mu.Unlock()
+
+	if len(dirty) == 0 {
+		return
+	}
+	failed := false
+	dirs := make(map[string]struct{})
+	for path := range dirty {
+		if err := syncFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			failed = true
+			s.writeErrors.Add(1)
+			s.config.Logger.Error("Failed to sync state file", "path", path, "error", err)
+		}
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			failed = true
+			s.writeErrors.Add(1)
+			s.config.Logger.Error("Failed to sync state dir", "path", dir, "error", err)
+		}
+	}
+	s.failing.Store(failed)
+}
+
+func appendFooter(data []byte) []byte {
+	out := make([]byte, len(data), len(data)+footerSize)
+	copy(out, data)
+	out = binary.LittleEndian.AppendUint32(out, footerMagic)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+	out = binary.LittleEndian.AppendUint32(out, crc32.Checksum(data, crcTable))
+	return out
+}
+
+func readValidated(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < footerSize {
+		return nil, ErrCorrupt
+	}
+	data, footer := raw[:len(raw)-footerSize], raw[len(raw)-footerSize:]
+	if binary.LittleEndian.Uint32(footer[0:4]) != footerMagic ||
+		binary.LittleEndian.Uint32(footer[4:8]) != uint32(len(data)) ||
+		binary.LittleEndian.Uint32(footer[8:12]) != crc32.Checksum(data, crcTable) {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func syncDir(dir string) error {
+	return syncFile(dir)
+}
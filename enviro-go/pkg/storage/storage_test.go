@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTest(t *testing.T, fsync FsyncPolicy) *Store {
+	t.Helper()
+	s, err := Open(Config{
+		Dir:    t.TempDir(),
+		Fsync:  fsync,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func mustWrite(t *testing.T, s *Store, name string, data []byte) {
+	t.Helper()
+	if err := s.Write(name, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTruncatedWrite cuts the current generation of a file at every
+// offset, as a power loss during a write not synced yet may, and checks
+// the previous generation is read instead, through each fsync policy
+func TestTruncatedWrite(t *testing.T) {
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncBatched, FsyncNever} {
+		t.Run(policy.String(), func(t *testing.T) {
+			s := openTest(t, policy)
+			name := "state/network.json"
+			gen1 := []byte(`{"containers":{"a":{}}}`)
+			gen2 := []byte(`{"containers":{"a":{},"b":{}}}`)
+			mustWrite(t, s, name, gen1)
+			mustWrite(t, s, name, gen2)
+
+			path := filepath.Join(s.Dir(), name)
+			full, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n := 0; n < len(full); n++ {
+				if err := os.WriteFile(path, full[:n], 0o600); err != nil {
+					t.Fatal(err)
+				}
+				got, err := s.Read(name)
+				if err != nil {
+					t.Fatalf("Read() with the current generation cut at %d = %v", n, err)
+				}
+				if !bytes.Equal(got, gen1) {
+					t.Fatalf("Read() with the current generation cut at %d = %q, want %q", n, got, gen1)
+				}
+			}
+			if err := os.WriteFile(path, full, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.Read(name); err != nil || !bytes.Equal(got, gen2) {
+				t.Fatalf("Read() of the whole file = %q, %v, want %q", got, err, gen2)
+			}
+			if stats := s.Stats(); stats.FallbackReads != uint64(len(full)) {
+				t.Errorf("FallbackReads = %d, want %d", stats.FallbackReads, len(full))
+			}
+		})
+	}
+}
+
+// TestCorruptWrite flips every byte of the current generation in turn,
+// which the checksum footer must catch
+func TestCorruptWrite(t *testing.T) {
+	s := openTest(t, FsyncAlways)
+	gen1, gen2 := []byte("first"), []byte("second")
+	mustWrite(t, s, "f", gen1)
+	mustWrite(t, s, "f", gen2)
+
+	path := filepath.Join(s.Dir(), "f")
+	full, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range full {
+		corrupt := bytes.Clone(full)
+		corrupt[i] ^= 0x40
+		if err := os.WriteFile(path, corrupt, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Read("f"); err != nil || !bytes.Equal(got, gen1) {
+			t.Fatalf("Read() with byte %d flipped = %q, %v, want %q", i, got, err, gen1)
+		}
+	}
+}
+
+// TestCrashDuringRename leaves a file as a write interrupted between its
+// renames would: the previous generation in place, the current one
+// missing and the new one in the temporary file
+func TestCrashDuringRename(t *testing.T) {
+	s := openTest(t, FsyncAlways)
+	gen1, gen2 := []byte("first"), []byte("second")
+	mustWrite(t, s, "f", gen1)
+	mustWrite(t, s, "f", gen2)
+
+	path := filepath.Join(s.Dir(), "f")
+	if err := os.Rename(path, path+tmpSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Read("f"); err != nil || !bytes.Equal(got, gen1) {
+		t.Fatalf("Read() = %q, %v, want %q", got, err, gen1)
+	}
+	// The next write replaces the leftover temporary file
+	gen3 := []byte("third")
+	mustWrite(t, s, "f", gen3)
+	if got, err := s.Read("f"); err != nil || !bytes.Equal(got, gen3) {
+		t.Fatalf("Read() after another write = %q, %v, want %q", got, err, gen3)
+	}
+}
+
+// TestWriteOverCorrupt writes over a current generation that is corrupt,
+// which must not push out the last good one
+func TestWriteOverCorrupt(t *testing.T) {
+	s := openTest(t, FsyncAlways)
+	gen1, gen2 := []byte("first"), []byte("second")
+	mustWrite(t, s, "f", gen1)
+	mustWrite(t, s, "f", gen2)
+
+	path := filepath.Join(s.Dir(), "f")
+	if err := os.WriteFile(path, []byte("sec"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	gen3 := []byte("third")
+	mustWrite(t, s, "f", gen3)
+	// Lose the new generation too: gen1 is still there
+	if err := os.Truncate(path, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Read("f"); err != nil || !bytes.Equal(got, gen1) {
+		t.Fatalf("Read() = %q, %v, want %q", got, err, gen1)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	s := openTest(t, FsyncAlways)
+	if _, err := s.Read("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read() of a missing file = %v, want %v", err, os.ErrNotExist)
+	}
+
+	mustWrite(t, s, "f", []byte("first"))
+	mustWrite(t, s, "f", []byte("second"))
+	path := filepath.Join(s.Dir(), "f")
+	for _, p := range []string{path, path + prevSuffix} {
+		if err := os.Truncate(p, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Read("f"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Read() with both generations corrupt = %v, want %v", err, ErrCorrupt)
+	}
+	if stats := s.Stats(); stats.CorruptReads != 2 {
+		t.Errorf("CorruptReads = %d, want 2", stats.CorruptReads)
+	}
+}
+
+// TestWriteFailing checks a failed write is counted and reported until a
+// write succeeds
+func TestWriteFailing(t *testing.T) {
+	s := openTest(t, FsyncAlways)
+	// A file where the write needs a directory
+	if err := os.WriteFile(filepath.Join(s.Dir(), "dir"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write("dir/f", []byte("data")); err == nil {
+		t.Fatal("Write() under a file succeeded")
+	}
+	if stats := s.Stats(); stats.WriteErrors != 1 || !stats.Failing {
+		t.Errorf("Stats() after a failed write = %+v", stats)
+	}
+	mustWrite(t, s, "f", []byte("data"))
+	if stats := s.Stats(); stats.Writes != 1 || stats.Failing {
+		t.Errorf("Stats() after a successful write = %+v", stats)
+	}
+}
+
+// TestBatchedClose checks Close flushes the writes of FsyncBatched
+func TestBatchedClose(t *testing.T) {
+	s, err := Open(Config{Dir: t.TempDir(), Fsync: FsyncBatched, BatchInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, s, "f", []byte("data"))
+	s.mu.Lock()
+	dirty := len(s.dirty)
+	s.mu.Unlock()
+	if dirty != 1 {
+		t.Fatalf("%d files waiting to be synced, want 1", dirty)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.dirty) != 0 {
+		t.Errorf("%d files still waiting to be synced after Close", len(s.dirty))
+	}
+}
+
+func TestFsyncPolicyText(t *testing.T) {
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncBatched, FsyncNever} {
+		text, err := policy.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got FsyncPolicy
+		if err := got.UnmarshalText(text); err != nil || got != policy {
+			t.Errorf("UnmarshalText(%q) = %v, %v, want %v", text, got, err, policy)
+		}
+	}
+	var p FsyncPolicy = FsyncNever
+	if err := p.UnmarshalText(nil); err != nil || p != FsyncAlways {
+		t.Errorf("UnmarshalText(\"\") = %v, %v, want always", p, err)
+	}
+	if err := p.UnmarshalText([]byte("sometimes")); err == nil || !strings.Contains(err.Error(), "sometimes") {
+		t.Errorf("UnmarshalText(\"sometimes\") = %v, want an error", err)
+	}
+}
@@ -0,0 +1,40 @@
+// Package tracing carries OpenTelemetry trace context through Enviro,
+// including across the FFI boundary as W3C traceparent strings.
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Propagator carries trace context in W3C traceparent headers
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// FromTraceparent returns ctx continuing the trace of a W3C traceparent
+// such as "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". An
+// empty traceparent returns ctx unchanged.
+func FromTraceparent(ctx context.Context, traceparent string) (context.Context, error) {
+	if traceparent == "" {
+		return ctx, nil
+	}
+	carrier := propagation.MapCarrier{"traceparent": traceparent}
+	out := Propagator.Extract(ctx, carrier)
+	if !trace.SpanContextFromContext(out).IsValid() {
+		return ctx, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	return out, nil
+}
+
+// End ends span, marking it failed when err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}